@@ -0,0 +1,178 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// Relaxation returns a function that accelerates the convergence of a
+// steady-state simulation by over-relaxation. After each time step, the
+// concentrations are set to x + ω(g - x), where x are the concentrations
+// at the end of the previous time step and g are the concentrations
+// calculated during this time step. Values of ω greater than one
+// extrapolate in the direction that the concentrations are changing,
+// and ω = 1 has no effect. It does not change the steady-state
+// concentrations, and it should be one of the RunFuncs after the science
+// calculations and before the convergence check. Concentrations that
+// would be negative are set to zero, and the acceleration starts over
+// whenever the grid changes.
+func Relaxation(ω float64) DomainManipulator {
+	var h iterationHistory
+	return func(d *InMAP) error {
+		if h.reset(d) {
+			return nil
+		}
+		for i, c := range h.cells {
+			for ii, g := range c.Cf {
+				x := math.Max(0, h.x[ii][i]+ω*(g-h.x[ii][i]))
+				c.Cf[ii] = x
+				h.x[ii][i] = x
+			}
+		}
+		return nil
+	}
+}
+
+// AndersonAcceleration returns a function that accelerates the
+// convergence of a steady-state simulation using Anderson acceleration
+// (Walker and Ni, 2011, doi:10.1137/10078356X). Each time step is treated
+// as one iteration of a fixed-point map, and after each time step the
+// concentrations are replaced by the combination of the results of the
+// last depth+1 time steps that minimizes the change in concentration
+// during a time step. All species are combined in the same way, so that
+// the chemical equilibria between them are preserved. It does not change
+// the steady-state concentrations, and it should be one of the RunFuncs
+// after the science calculations and before the convergence check.
+// Concentrations that would be negative are set to zero, and the
+// acceleration starts over whenever the grid changes.
+func AndersonAcceleration(depth int) DomainManipulator {
+	var h iterationHistory
+	// f and g are the change in concentration and the concentrations
+	// calculated during the previous time step, and dF and dG are the
+	// differences in f and g between the most recent time steps.
+	var f, g []float64
+	var dF, dG [][]float64
+	return func(d *InMAP) error {
+		if h.reset(d) {
+			f, g, dF, dG = nil, nil, nil, nil
+			return nil
+		}
+		x := h.flatten()
+		gk := make([]float64, len(x))
+		for ii := range h.x {
+			for i, c := range h.cells {
+				gk[ii*len(h.cells)+i] = c.Cf[ii]
+			}
+		}
+		fk := floats.SubTo(make([]float64, len(gk)), gk, x)
+		if f != nil && depth > 0 {
+			dF = append(dF, floats.SubTo(make([]float64, len(fk)), fk, f))
+			dG = append(dG, floats.SubTo(make([]float64, len(gk)), gk, g))
+			if len(dF) > depth {
+				dF, dG = dF[1:], dG[1:]
+			}
+		}
+		f, g = fk, gk
+		x = andersonMix(gk, fk, dF, dG)
+		for ii := range h.x {
+			for i, c := range h.cells {
+				v := math.Max(0, x[ii*len(h.cells)+i])
+				c.Cf[ii] = v
+				h.x[ii][i] = v
+			}
+		}
+		return nil
+	}
+}
+
+// andersonMix returns g - ΔG γ, where γ minimizes the L2 norm of
+// f - ΔF γ and the columns of ΔF and ΔG are dF and dG. If γ can not be
+// calculated, for example because ΔF is singular, it returns a copy of g.
+func andersonMix(g, f []float64, dF, dG [][]float64) []float64 {
+	x := append([]float64{}, g...)
+	if len(dF) == 0 {
+		return x
+	}
+	a := mat.NewDense(len(f), len(dF), nil)
+	for j, col := range dF {
+		for i, v := range col {
+			a.Set(i, j, v)
+		}
+	}
+	var γ mat.VecDense
+	if err := γ.SolveVec(a, mat.NewVecDense(len(f), append([]float64{}, f...))); err != nil {
+		return x
+	}
+	for j, col := range dG {
+		floats.AddScaled(x, -γ.AtVec(j), col)
+	}
+	if floats.HasNaN(x) {
+		return append(x[:0], g...)
+	}
+	return x
+}
+
+// iterationHistory holds the concentrations of each species in each grid
+// cell at the end of the previous time step, for accelerating
+// convergence.
+type iterationHistory struct {
+	cells []*Cell
+	x     [][]float64 // [species][cell]
+}
+
+// reset starts the history over with the concentrations in d if the grid
+// cells have changed since the previous time step, in which case it
+// returns true.
+func (h *iterationHistory) reset(d *InMAP) bool {
+	cells := d.cells.array()
+	same := len(cells) == len(h.cells)
+	for i := 0; same && i < len(cells); i++ {
+		same = cells[i] == h.cells[i]
+	}
+	if same {
+		return false
+	}
+	h.cells = cells
+	h.x = nil
+	if len(cells) == 0 {
+		return true
+	}
+	h.x = make([][]float64, len(cells[0].Cf))
+	for ii := range h.x {
+		h.x[ii] = make([]float64, len(cells))
+		for i, c := range cells {
+			h.x[ii][i] = c.Cf[ii]
+		}
+	}
+	return true
+}
+
+// flatten returns the concentrations in the history as a single
+// species-major array.
+func (h *iterationHistory) flatten() []float64 {
+	o := make([]float64, 0, len(h.x)*len(h.cells))
+	for _, x := range h.x {
+		o = append(o, x...)
+	}
+	return o
+}
@@ -0,0 +1,124 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestAcceleration(t *testing.T) {
+	const E = 1000000. // emissions [μg/s]
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		SOx:  E,
+		NOx:  E,
+		PM25: E,
+		VOC:  E,
+		NH3:  E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	})
+	m := Mech{}
+
+	// run runs a simulation for n time steps and returns the final
+	// concentrations.
+	run := func(n int, acceleration ...DomainManipulator) [][]float64 {
+		runFuncs := []DomainManipulator{
+			Calculations(AddEmissionsFlux()),
+			Calculations(UpwindAdvection(), Mixing(), MeanderMixing(), m.Chemistry()),
+		}
+		runFuncs = append(runFuncs, acceleration...)
+		d := &InMAP{
+			InitFuncs: []DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+				SetTimestepCFL(),
+			},
+			RunFuncs: append(runFuncs, SteadyStateConvergenceCheck(n, cfg.PopGridColumn, m, nil)),
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Run(); err != nil {
+			t.Fatal(err)
+		}
+		o := make([][]float64, d.cells.len())
+		for i, c := range d.Cells() {
+			o[i] = append([]float64{}, c.Cf...)
+		}
+		return o
+	}
+	// distance returns the L2 norm of the difference between a and b.
+	distance := func(a, b [][]float64) float64 {
+		var sum float64
+		for i := range a {
+			for ii := range a[i] {
+				sum += (a[i][ii] - b[i][ii]) * (a[i][ii] - b[i][ii])
+			}
+		}
+		return math.Sqrt(sum)
+	}
+
+	const n = 20 // The number of time steps to compare after.
+	steadyState := run(1000)
+	unaccelerated := distance(run(n), steadyState)
+	for _, test := range []struct {
+		name         string
+		acceleration func() DomainManipulator
+	}{
+		{name: "relaxation", acceleration: func() DomainManipulator { return Relaxation(1.5) }},
+		{name: "anderson", acceleration: func() DomainManipulator { return AndersonAcceleration(5) }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if accelerated := distance(run(n, test.acceleration()), steadyState); accelerated >= unaccelerated {
+				t.Errorf("after %d time steps, the distance from steady state with acceleration (%g) should be less than without (%g)",
+					n, accelerated, unaccelerated)
+			}
+			// The acceleration should not change the steady-state concentrations.
+			have := run(1000, test.acceleration())
+			for i := range have {
+				for ii, v := range have[i] {
+					if w := steadyState[i][ii]; different(v, w, 1.e-8) {
+						t.Errorf("cell %d species %d: have %g, want %g", i, ii, v, w)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAndersonMix(t *testing.T) {
+	// For the linear fixed-point map g(x) = 0.5x + 1, whose fixed point
+	// is x = 2, one step of Anderson acceleration gives the exact answer.
+	gx := func(x float64) float64 { return 0.5*x + 1 }
+	x0, x1 := 0., gx(0)
+	g0, g1 := gx(x0), gx(x1)
+	f0, f1 := g0-x0, g1-x1
+	have := andersonMix([]float64{g1}, []float64{f1}, [][]float64{{f1 - f0}}, [][]float64{{g1 - g0}})
+	if different(have[0], 2, 1.e-12) {
+		t.Errorf("have %g, want 2", have[0])
+	}
+	// If the differences are singular, the result should be unchanged.
+	have = andersonMix([]float64{g1}, []float64{f1}, [][]float64{{0}}, [][]float64{{0}})
+	if have[0] != g1 {
+		t.Errorf("have %g, want %g", have[0], g1)
+	}
+}
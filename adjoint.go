@@ -0,0 +1,328 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+)
+
+// The functions in this file are used for adjoint simulations, which
+// calculate the sensitivity of an exposure metric in a receptor region
+// to the emissions in every grid cell in a single simulation, rather than
+// one simulation for each grid cell.
+//
+// Each time step of a steady-state simulation with emissions flux E
+// calculates
+//	C = A(C + E Δt),
+// where A is the combination of the transport, deposition, and chemistry
+// calculations, which must be linear in the concentrations. If the
+// exposure metric is w·C, the sensitivity of the metric to E is the
+// steady-state solution of
+//	S = Aᵀ(S + w Δt),
+// which is calculated in the same way as the concentrations are, but
+// using the transpose of A and with w in place of the emissions flux.
+// The adjoint state S is held in the concentration fields of each cell.
+
+// AdjointTransport calculates the transpose of a set of transport
+// calculations, such as UpwindAdvection, Mixing, and MeanderMixing.
+// The transport calculations must be linear in the concentrations and
+// the time step and must treat all chemical species in the same way, and
+// the grid must not change during the simulation.
+type AdjointTransport struct {
+	transport []CellManipulator
+
+	// terms holds the cells whose adjoint state is transported to each
+	// cell and the associated coefficients [1/s].
+	terms map[*Cell][]adjointTerm
+}
+
+// adjointTerm is a contribution of the adjoint state in cell to another
+// cell.
+type adjointTerm struct {
+	cell *Cell
+	coef float64
+}
+
+// NewAdjointTransport returns a new AdjointTransport for the given
+// transport calculations.
+func NewAdjointTransport(transport ...CellManipulator) *AdjointTransport {
+	return &AdjointTransport{transport: transport}
+}
+
+// Init returns a function that calculates the transport coefficients
+// between each grid cell and its neighbors by running the transport
+// calculations with unit concentrations in one neighbor at a time.
+// It sets all of the concentrations to zero, so it should be one of the
+// InitFuncs, after the grid is created.
+func (a *AdjointTransport) Init() DomainManipulator {
+	return func(d *InMAP) error {
+		d.zeroConcentrations()
+		a.terms = make(map[*Cell][]adjointTerm, d.cells.len())
+		for _, c := range *d.cells {
+			for _, n := range c.transportSources(false) {
+				for ii := range n.Ci {
+					n.Ci[ii] = 1
+				}
+				for ii := range c.Cf {
+					c.Cf[ii] = 0
+				}
+				for _, f := range a.transport {
+					f(c.Cell, 1)
+				}
+				if coef := c.Cf[0]; coef != 0 {
+					a.terms[n] = append(a.terms[n], adjointTerm{cell: c.Cell, coef: coef})
+				}
+				for ii := range n.Ci {
+					n.Ci[ii] = 0
+				}
+			}
+		}
+		d.zeroConcentrations()
+		return nil
+	}
+}
+
+// Calculate returns a function that calculates the transpose of the
+// transport calculations for a cell, using the adjoint state at the
+// beginning of the time step in the cell and its neighbors. It should
+// be run in the same Calculations as the deposition calculations,
+// which are their own transpose because they remove each species
+// independently.
+func (a *AdjointTransport) Calculate() CellManipulator {
+	return func(c *Cell, Δt float64) {
+		for _, t := range a.terms[c] {
+			for ii, s := range t.cell.Ci {
+				c.Cf[ii] += t.coef * s * Δt
+			}
+		}
+	}
+}
+
+// transportSources returns c and the grid cells that the transport
+// calculations for c may use the concentrations of, including boundary
+// cells only if boundary is true.
+func (c *Cell) transportSources(boundary bool) []*Cell {
+	sources := []*Cell{c}
+	for _, l := range []*cellList{&c.west, &c.east, &c.south, &c.north, &c.below, &c.above, &c.groundLevel} {
+		for _, n := range *l {
+			if n.boundary && !boundary {
+				continue
+			}
+			duplicate := false
+			for _, s := range sources {
+				if s == n.Cell {
+					duplicate = true
+					break
+				}
+			}
+			if !duplicate {
+				sources = append(sources, n.Cell)
+			}
+		}
+	}
+	return sources
+}
+
+// zeroConcentrations sets the concentrations in all of the grid cells
+// and boundary cells to zero.
+func (d *InMAP) zeroConcentrations() {
+	for _, l := range []*cellList{d.cells, d.westBoundary, d.eastBoundary,
+		d.northBoundary, d.southBoundary, d.topBoundary} {
+		for _, c := range *l {
+			for ii := range c.Ci {
+				c.Ci[ii] = 0
+			}
+			for ii := range c.Cf {
+				c.Cf[ii] = 0
+			}
+		}
+	}
+}
+
+// AdjointChemistry returns a function that applies the transpose of the
+// chemistry calculations in chem to the adjoint state in a cell and then
+// sets c.Ci equal to c.Cf. chem must be linear in the concentrations and
+// must only use c.Cf. It should be run after AddEmissionsFlux in the
+// same Calculations, before the adjoint transport calculations.
+func AdjointChemistry(chem CellManipulator) CellManipulator {
+	return func(c *Cell, Δt float64) {
+		s := c.Cf
+		prev := append([]float64{}, s...)
+		probe := make([]float64, len(s))
+		c.Cf = probe
+		for ii := range s {
+			for i := range probe {
+				probe[i] = 0
+			}
+			probe[ii] = 1
+			chem(c, Δt)
+			var v float64
+			for i, p := range c.Cf {
+				v += p * prev[i]
+			}
+			s[ii] = v
+		}
+		c.Cf = s
+		copy(c.Ci, c.Cf)
+	}
+}
+
+// SetAdjointReceptor returns a function that sets the emissions flux of
+// each grid cell for an adjoint simulation, so that the simulation
+// calculates the sensitivity of the population-weighted average of the
+// sum of the given concentration variables (e.g., "PrimaryPM25") at
+// ground level within region to emissions in each grid cell. If region
+// is nil, the whole domain is used. popGridColumn is the population type
+// used for weighting. The variables must be linear in the
+// concentrations.
+func SetAdjointReceptor(region geom.Polygon, popGridColumn string, variables []string, m Mechanism) DomainManipulator {
+	return func(d *InMAP) error {
+		popIndex, ok := d.PopIndices[popGridColumn]
+		if !ok {
+			return fmt.Errorf("inmap: adjoint receptor population type %s doesn't exist", popGridColumn)
+		}
+		var totalPop float64
+		for _, c := range *d.cells {
+			c.EmisFlux = make([]float64, m.Len())
+			if c.Layer != 0 {
+				continue
+			}
+			pop := c.PopData[popIndex]
+			if region != nil {
+				pop *= regionFraction(region, c.Cell)
+			}
+			if pop == 0 {
+				continue
+			}
+			totalPop += pop
+			w, err := c.valueWeights(variables, m)
+			if err != nil {
+				return err
+			}
+			for ii, v := range w {
+				c.EmisFlux[ii] = pop * v
+			}
+		}
+		if totalPop == 0 {
+			return fmt.Errorf("inmap: there is no %s population in the adjoint receptor region", popGridColumn)
+		}
+		for _, c := range *d.cells {
+			for ii := range c.EmisFlux {
+				c.EmisFlux[ii] /= totalPop
+			}
+		}
+		return nil
+	}
+}
+
+// regionFraction returns the fraction of the area of c that is within
+// region.
+func regionFraction(region geom.Polygon, c *Cell) float64 {
+	intersection := region.Intersection(c.Polygonal)
+	if intersection == nil {
+		return 0
+	}
+	return intersection.Area() / c.Area()
+}
+
+// valueWeights returns the change in the sum of the given variables in
+// c per unit change in the concentration of each species.
+func (c *Cell) valueWeights(variables []string, m Mechanism) ([]float64, error) {
+	cf := c.Cf
+	defer func() { c.Cf = cf }()
+	w := make([]float64, len(cf))
+	for ii := range w {
+		c.Cf = make([]float64, len(cf))
+		c.Cf[ii] = 1
+		for _, v := range variables {
+			val, err := m.Value(c, v)
+			if err != nil {
+				return nil, err
+			}
+			w[ii] += val
+		}
+	}
+	return w, nil
+}
+
+// EmissionsSensitivity returns the sensitivity of the exposure metric
+// set by SetAdjointReceptor to emissions of each of the given pollutants
+// (e.g., "PM2_5") in each grid cell, after an adjoint simulation has
+// converged. The results are in units of the exposure metric per μg/s
+// of emissions, and are in the same order as d.Cells().
+func (d *InMAP) EmissionsSensitivity(m Mechanism, pollutants ...string) (map[string][]float64, error) {
+	cells := d.Cells()
+	o := make(map[string][]float64, len(pollutants))
+	for _, p := range pollutants {
+		o[p] = make([]float64, len(cells))
+	}
+	for i, c := range cells {
+		emisFlux := c.EmisFlux
+		for _, p := range pollutants {
+			c.EmisFlux = make([]float64, m.Len())
+			if err := m.AddEmisFlux(c, p, 1); err != nil {
+				c.EmisFlux = emisFlux
+				return nil, err
+			}
+			var s float64
+			for ii, e := range c.EmisFlux {
+				s += e * c.Cf[ii]
+			}
+			o[p][i] = s
+		}
+		c.EmisFlux = emisFlux
+	}
+	return o, nil
+}
+
+// OutputEmissionsSensitivity returns a function that saves the results
+// of EmissionsSensitivity to the shapefile (or GeoParquet file, if
+// fileName ends in ".parquet", or PostGIS table, if fileName is a
+// PostgreSQL URL) fileName, which uses spatial reference sr. If allLayers is false, only the ground-level cells are
+// saved.
+func OutputEmissionsSensitivity(fileName string, allLayers bool, sr *proj.SR, m Mechanism, pollutants ...string) DomainManipulator {
+	return func(d *InMAP) error {
+		s, err := d.EmissionsSensitivity(m, pollutants...)
+		if err != nil {
+			return err
+		}
+		cells := d.Cells()
+		if !allLayers {
+			var n int
+			for n < len(cells) && cells[n].Layer == 0 {
+				n++
+			}
+			cells = cells[:n]
+			for p := range s {
+				s[p] = s[p][:n]
+			}
+		}
+		if IsPostGISURL(fileName) {
+			return writePostGIS(context.TODO(), fileName, sr, cells, s)
+		}
+		if isGeoParquet(fileName) {
+			return writeGeoParquet(fileName, sr, cells, s)
+		}
+		return writeShapefile(fileName, sr, cells, s)
+	}
+}
@@ -0,0 +1,198 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestAdjointTranspose(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	m := Mech{}
+	transport := NewAdjointTransport(UpwindAdvection(), Mixing(), MeanderMixing())
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, nil, m),
+			SetTimestepCFL(),
+			transport.Init(),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	cells := d.Cells()
+	r := rand.New(rand.NewSource(1))
+	x := make([][]float64, len(cells))
+	y := make([][]float64, len(cells))
+	for i := range cells {
+		x[i] = make([]float64, m.Len())
+		y[i] = make([]float64, m.Len())
+		for ii := range x[i] {
+			x[i][ii] = r.Float64()
+			y[i][ii] = r.Float64()
+		}
+	}
+
+	// The dot product of y with Ax should equal the dot product of x
+	// with Aᵀy.
+	for i, c := range cells {
+		copy(c.Ci, x[i])
+		copy(c.Cf, x[i])
+	}
+	if err := Calculations(UpwindAdvection(), Mixing(), MeanderMixing(), m.Chemistry())(d); err != nil {
+		t.Fatal(err)
+	}
+	var yAx float64
+	for i, c := range cells {
+		for ii, v := range c.Cf {
+			yAx += y[i][ii] * v
+		}
+	}
+
+	for i, c := range cells {
+		copy(c.Cf, y[i])
+	}
+	for _, f := range []DomainManipulator{
+		Calculations(AdjointChemistry(m.Chemistry())),
+		Calculations(transport.Calculate()),
+	} {
+		if err := f(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var xATy float64
+	for i, c := range cells {
+		for ii, v := range c.Cf {
+			xATy += x[i][ii] * v
+		}
+	}
+	if different(yAx, xATy, 1.e-10) {
+		t.Errorf("y·Ax = %g but x·Aᵀy = %g", yAx, xATy)
+	}
+}
+
+func TestAdjointSensitivity(t *testing.T) {
+	const (
+		E = 1000000. // emissions [μg/s]
+		n = 200      // number of time steps
+	)
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	m := Mech{}
+	region := geom.Polygon{{{X: -4000, Y: -4000}, {X: 0, Y: -4000}, {X: 0, Y: 0}, {X: -4000, Y: 0}}}
+	variables := []string{"TotalPM25"}
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		SOx:  E,
+		NOx:  E,
+		PM25: E,
+		VOC:  E,
+		NH3:  E,
+		Geom: geom.Point{X: 2000, Y: 2000},
+	})
+
+	// Forward simulation.
+	fwd := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+			SetTimestepCFL(),
+		},
+		RunFuncs: []DomainManipulator{
+			Calculations(AddEmissionsFlux()),
+			Calculations(UpwindAdvection(), Mixing(), MeanderMixing(), m.Chemistry()),
+			SteadyStateConvergenceCheck(n, cfg.PopGridColumn, m, nil),
+		},
+	}
+	if err := fwd.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fwd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	popIndex := fwd.PopIndices[cfg.PopGridColumn]
+	var exposure, totalPop float64
+	for _, c := range fwd.Cells() {
+		if c.Layer != 0 {
+			continue
+		}
+		p := c.PopData[popIndex] * regionFraction(region, c)
+		v, err := m.Value(c, "TotalPM25")
+		if err != nil {
+			t.Fatal(err)
+		}
+		exposure += p * v
+		totalPop += p
+	}
+	exposure /= totalPop
+
+	// Adjoint simulation.
+	transport := NewAdjointTransport(UpwindAdvection(), Mixing(), MeanderMixing())
+	adj := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, nil, m),
+			SetTimestepCFL(),
+			transport.Init(),
+			SetAdjointReceptor(region, cfg.PopGridColumn, variables, m),
+		},
+		RunFuncs: []DomainManipulator{
+			Calculations(AddEmissionsFlux(), AdjointChemistry(m.Chemistry())),
+			Calculations(transport.Calculate()),
+			SteadyStateConvergenceCheck(n, cfg.PopGridColumn, m, nil),
+		},
+	}
+	if err := adj.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := adj.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if fwd.Dt != adj.Dt {
+		t.Fatalf("forward time step %g != adjoint time step %g", fwd.Dt, adj.Dt)
+	}
+
+	// After the same number of time steps, the exposure calculated
+	// using the sensitivities should match the forward simulation.
+	pollutants := []string{"VOC", "NOx", "NH3", "SOx", "PM2_5"}
+	s, err := adj.EmissionsSensitivity(m, pollutants...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have float64
+	var nSources int
+	for i, c := range fwd.Cells() {
+		if c.EmisFlux[iPM2_5] == 0 {
+			continue
+		}
+		nSources++
+		for _, p := range pollutants {
+			have += s[p][i] * E
+		}
+	}
+	if nSources != 1 {
+		t.Fatalf("emissions should be in 1 cell but are in %d", nSources)
+	}
+	if exposure == 0 {
+		t.Fatal("exposure should not be zero")
+	}
+	if different(have, exposure, 1.e-8) {
+		t.Errorf("adjoint exposure %g != forward exposure %g", have, exposure)
+	}
+}
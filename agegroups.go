@@ -0,0 +1,112 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AgeGroup specifies the population and baseline mortality rate of an
+// age group, for calculating the health impacts in each age group
+// separately (see AgeGroupOutputVariables).
+type AgeGroup struct {
+	// Name is the name of the age group, such as "Age65". It is used as
+	// the prefix of the output variables for the age group, so it can be
+	// no longer than 7 characters.
+	Name string
+
+	// PopColumn is the field in the census file that contains the
+	// population of the age group.
+	PopColumn string
+
+	// MortalityColumn is the field in the mortality rate file that
+	// contains the baseline mortality rate of the age group, in units
+	// of deaths per year per 100,000 people.
+	MortalityColumn string
+
+	// LifeExpectancy is the average remaining life expectancy [years]
+	// of people in the age group, which is used to calculate the years
+	// of life lost.
+	LifeExpectancy float64
+}
+
+// addAgeGroupColumns adds the population and mortality rate columns of
+// the age groups in c to CensusPopColumns and MortalityRateColumns, if
+// they are not already included, so that they are loaded into the grid.
+func (c *VarGridConfig) addAgeGroupColumns() {
+	for _, g := range c.AgeGroups {
+		c.addRateColumn(g.MortalityColumn, g.PopColumn)
+	}
+}
+
+// addRateColumn adds popColumn to CensusPopColumns and rateColumn to
+// MortalityRateColumns, population-weighted by popColumn, if they are not
+// already included.
+func (c *VarGridConfig) addRateColumn(rateColumn, popColumn string) {
+	var found bool
+	for _, p := range c.CensusPopColumns {
+		if p == popColumn {
+			found = true
+			break
+		}
+	}
+	if !found {
+		c.CensusPopColumns = append(c.CensusPopColumns, popColumn)
+	}
+	if c.MortalityRateColumns == nil {
+		c.MortalityRateColumns = make(map[string]string)
+	}
+	if _, ok := c.MortalityRateColumns[rateColumn]; !ok {
+		c.MortalityRateColumns[rateColumn] = popColumn
+	}
+}
+
+// AgeGroupOutputVariables returns output variable expressions (see
+// NewOutputter) for the health impacts in each of the given age groups,
+// where hazardRatio is an expression for the hazard ratio caused by the
+// change in concentrations, such as
+// "Krewski2009Ecologic(PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA)".
+// For each age group, the variable "<Name>D" is the number of deaths
+// per year and "<Name>YLL" is the number of years of life lost per year.
+// "TotalAgeD" and "TotalYLL" are the totals across all of the age groups.
+func AgeGroupOutputVariables(groups []AgeGroup, hazardRatio string) (map[string]string, error) {
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	if hazardRatio == "" {
+		return nil, fmt.Errorf("inmap: a hazard ratio expression is required for age group outputs")
+	}
+	o := make(map[string]string)
+	deaths := make([]string, len(groups))
+	yll := make([]string, len(groups))
+	for i, g := range groups {
+		if g.Name == "" || g.PopColumn == "" || g.MortalityColumn == "" {
+			return nil, fmt.Errorf("inmap: age group %d is missing its name, population column, or mortality column", i)
+		}
+		deaths[i] = g.Name + "D"
+		yll[i] = g.Name + "YLL"
+		o[deaths[i]] = fmt.Sprintf("(%s - 1) * %s * %s / 100000", hazardRatio, g.PopColumn, g.MortalityColumn)
+		o[yll[i]] = fmt.Sprintf("%s * %s", deaths[i], strconv.FormatFloat(g.LifeExpectancy, 'f', -1, 64))
+	}
+	o["TotalAgeD"] = strings.Join(deaths, " + ")
+	o["TotalYLL"] = strings.Join(yll, " + ")
+	return o, nil
+}
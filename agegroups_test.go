@@ -0,0 +1,74 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAgeGroupOutputVariables(t *testing.T) {
+	groups := []AgeGroup{
+		{Name: "Young", PopColumn: "PopYoung", MortalityColumn: "MortYoung", LifeExpectancy: 50},
+		{Name: "Old", PopColumn: "PopOld", MortalityColumn: "MortOld", LifeExpectancy: 12.5},
+	}
+	vars, err := AgeGroupOutputVariables(groups, "hr(TotalPM25)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"YoungD":    "(hr(TotalPM25) - 1) * PopYoung * MortYoung / 100000",
+		"YoungYLL":  "YoungD * 50",
+		"OldD":      "(hr(TotalPM25) - 1) * PopOld * MortOld / 100000",
+		"OldYLL":    "OldD * 12.5",
+		"TotalAgeD": "YoungD + OldD",
+		"TotalYLL":  "YoungYLL + OldYLL",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("have %v, want %v", vars, want)
+	}
+
+	if vars, err := AgeGroupOutputVariables(nil, ""); vars != nil || err != nil {
+		t.Errorf("no age groups: have %v, %v", vars, err)
+	}
+	if _, err := AgeGroupOutputVariables(groups, ""); err == nil {
+		t.Error("missing hazard ratio should cause an error")
+	}
+}
+
+func TestAddAgeGroupColumns(t *testing.T) {
+	c := VarGridConfig{
+		CensusPopColumns:     []string{"TotalPop", "PopOld"},
+		MortalityRateColumns: map[string]string{"AllCause": "TotalPop"},
+		AgeGroups: []AgeGroup{
+			{Name: "Young", PopColumn: "PopYoung", MortalityColumn: "MortYoung"},
+			{Name: "Old", PopColumn: "PopOld", MortalityColumn: "MortOld"},
+		},
+	}
+	c.addAgeGroupColumns()
+	c.addAgeGroupColumns()
+	wantPop := []string{"TotalPop", "PopOld", "PopYoung"}
+	if !reflect.DeepEqual(c.CensusPopColumns, wantPop) {
+		t.Errorf("pop columns: have %v, want %v", c.CensusPopColumns, wantPop)
+	}
+	wantMort := map[string]string{"AllCause": "TotalPop", "MortYoung": "PopYoung", "MortOld": "PopOld"}
+	if !reflect.DeepEqual(c.MortalityRateColumns, wantMort) {
+		t.Errorf("mortality columns: have %v, want %v", c.MortalityRateColumns, wantMort)
+	}
+}
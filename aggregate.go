@@ -0,0 +1,199 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/ctessum/geom/proj"
+)
+
+// AggregationUnit is an area, such as a county, census tract, or ZIP code,
+// that output variables can be aggregated to.
+type AggregationUnit struct {
+	// ID identifies the unit.
+	ID string
+
+	// Polygonal is the shape of the unit in the spatial reference
+	// of the model grid.
+	geom.Polygonal
+}
+
+// ReadAggregationUnits reads aggregation units from the polygons in
+// shapefile, converting them to gridSR, the spatial reference of the model
+// grid. The unit IDs are taken from the idColumn attribute.
+func ReadAggregationUnits(shapefile, idColumn string, gridSR *proj.SR) ([]AggregationUnit, error) {
+	f, err := shp.NewDecoder(shapefile)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: opening aggregation shapefile: %v", err)
+	}
+	defer f.Close()
+	sr, err := f.SR()
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading projection of aggregation shapefile: %v", err)
+	}
+	trans, err := sr.NewTransform(gridSR)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading aggregation shapefile: %v", err)
+	}
+	var units []AggregationUnit
+	for {
+		g, fields, more := f.DecodeRowFields(idColumn)
+		if !more {
+			break
+		}
+		id, ok := fields[idColumn]
+		if !ok {
+			return nil, fmt.Errorf("inmap: aggregation shapefile %s does not have column '%s'", shapefile, idColumn)
+		}
+		p, ok := g.(geom.Polygonal)
+		if !ok {
+			return nil, fmt.Errorf("inmap: aggregation shapefile %s: geometry of %s is %T but should be polygonal", shapefile, id, g)
+		}
+		gT, err := p.Transform(trans)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: reading aggregation shapefile: %v", err)
+		}
+		units = append(units, AggregationUnit{ID: strings.TrimSpace(id), Polygonal: gT.(geom.Polygonal)})
+	}
+	if err := f.Error(); err != nil {
+		return nil, fmt.Errorf("inmap: reading aggregation shapefile: %v", err)
+	}
+	return units, nil
+}
+
+// AggregateResults returns the averages of the ground-level values of the
+// output variables of o within each of the given units, in the form of
+// map[variable][unit]value. If weight is empty or "area", the averages are
+// weighted by the area of each grid cell that overlaps each unit.
+// Otherwise, weight is the name of a model variable, such as "TotalPop",
+// whose value is the amount of some quantity in each grid cell (e.g., the
+// number of people), which is assumed to be evenly spread across
+// the cell, and the averages are weighted by the amount of the quantity in
+// each grid cell that is within each unit (e.g., population-weighted
+// averages). The value is NaN for units that do not overlap the grid or
+// whose weight is zero.
+func (d *InMAP) AggregateResults(o *Outputter, units []AggregationUnit, weight string) (map[string][]float64, error) {
+	ground := *o
+	ground.allLayers = false
+	results, err := d.Results(&ground)
+	if err != nil {
+		return nil, err
+	}
+	var weights []float64
+	if weight != "" && weight != "area" {
+		if err := d.checkModelVars(o.m, weight); err != nil {
+			return nil, fmt.Errorf("inmap: aggregation weight: %v", err)
+		}
+		weights = d.toArray(weight, 0, o.m)
+	}
+	// rows holds the index of each ground-level cell in the results.
+	rows := make(map[*Cell]int)
+	for i, c := range d.cells.array() {
+		if c.Layer == 0 {
+			rows[c] = i
+		}
+	}
+
+	output := make(map[string][]float64, len(results))
+	for v := range results {
+		output[v] = make([]float64, len(units))
+	}
+	for i, u := range units {
+		var sumWeights float64
+		sums := make(map[string]float64, len(results))
+		for _, cI := range d.index.SearchIntersect(u.Bounds()) {
+			c := cI.(*Cell)
+			row, ok := rows[c]
+			if !ok {
+				continue
+			}
+			intersection := u.Intersection(c.Polygonal)
+			if intersection == nil {
+				continue
+			}
+			w := intersection.Area()
+			if weights != nil {
+				w *= weights[row] / c.Area()
+			}
+			if w == 0 {
+				continue
+			}
+			sumWeights += w
+			for v, vals := range results {
+				sums[v] += vals[row] * w
+			}
+		}
+		for v := range output {
+			if sumWeights == 0 {
+				output[v][i] = math.NaN()
+			} else {
+				output[v][i] = sums[v] / sumWeights
+			}
+		}
+	}
+	return output, nil
+}
+
+// OutputAggregated returns a function that writes the averages of the
+// output variables of o within each of the given units to fileName in
+// CSV format, with an "ID" column with the unit IDs and a column for each
+// output variable. See AggregateResults for how the averages
+// are calculated.
+func (o *Outputter) OutputAggregated(units []AggregationUnit, weight, fileName string) DomainManipulator {
+	return func(d *InMAP) error {
+		results, err := d.AggregateResults(o, units, weight)
+		if err != nil {
+			return err
+		}
+		vars := make([]string, 0, len(results))
+		for v := range results {
+			vars = append(vars, v)
+		}
+		sort.Strings(vars)
+
+		f, err := os.Create(fileName)
+		if err != nil {
+			return fmt.Errorf("inmap: creating aggregated output file: %v", err)
+		}
+		w := csv.NewWriter(f)
+		w.Write(append([]string{"ID"}, vars...))
+		for i, u := range units {
+			row := []string{u.ID}
+			for _, v := range vars {
+				row = append(row, strconv.FormatFloat(results[v][i], 'g', -1, 64))
+			}
+			w.Write(row)
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			f.Close()
+			return fmt.Errorf("inmap: writing aggregated output: %v", err)
+		}
+		return f.Close()
+	}
+}
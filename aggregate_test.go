@@ -0,0 +1,155 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap_test
+
+import (
+	"encoding/csv"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/ctessum/geom/proj"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/science/chem/simplechem"
+)
+
+func TestAggregateResults(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := inmap.VarGridTestData()
+	emis := inmap.NewEmissions()
+	var m simplechem.Mechanism
+
+	d := &inmap.InMAP{
+		InitFuncs: []inmap.DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	o, err := inmap.NewOutputter("", false, map[string]string{"WindSpeed": "WindSpeed"}, nil, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grid, err := d.Results(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cells := d.Cells()
+	b := geom.NewBounds()
+	var areaAvg, popAvg, totalArea, totalPop float64
+	for i, c := range cells[:len(grid["WindSpeed"])] {
+		b.Extend(c.Bounds())
+		a := c.Area()
+		areaAvg += grid["WindSpeed"][i] * a
+		totalArea += a
+		p := c.PopData[popIndices["TotalPop"]]
+		popAvg += grid["WindSpeed"][i] * p
+		totalPop += p
+	}
+	areaAvg /= totalArea
+	popAvg /= totalPop
+	rect := func(b *geom.Bounds) geom.Polygon {
+		return geom.Polygon{{b.Min, {X: b.Max.X, Y: b.Min.Y}, b.Max, {X: b.Min.X, Y: b.Max.Y}}}
+	}
+	domain := rect(b)
+
+	dir, err := os.MkdirTemp("", "aggregate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	type unit struct {
+		geom.Polygon
+		GEOID string
+	}
+	shpFile := filepath.Join(dir, "units.shp")
+	e, err := shp.NewEncoder(shpFile, unit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []unit{
+		{Polygon: rect(cells[0].Bounds()), GEOID: "first"},
+		{Polygon: domain, GEOID: "domain"},
+		{Polygon: geom.Polygon{{{X: 1.e8, Y: 1.e8}, {X: 1.e8 + 1, Y: 1.e8}, {X: 1.e8 + 1, Y: 1.e8 + 1}}}, GEOID: "outside"},
+	} {
+		if err := e.Encode(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.Close()
+	if err := os.WriteFile(filepath.Join(dir, "units.prj"), []byte(inmap.TestGridSR), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sr, err := proj.Parse(inmap.TestGridSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	units, err := inmap.ReadAggregationUnits(shpFile, "GEOID", sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(units) != 3 || units[0].ID != "first" {
+		t.Fatalf("invalid aggregation units %v", units)
+	}
+
+	different := func(a, b float64) bool { return math.Abs(a-b) > 1.e-8*math.Abs(b) }
+
+	r, err := d.AggregateResults(o, units, "area")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if different(r["WindSpeed"][0], grid["WindSpeed"][0]) {
+		t.Errorf("first cell: have %g, want %g", r["WindSpeed"][0], grid["WindSpeed"][0])
+	}
+	if different(r["WindSpeed"][1], areaAvg) {
+		t.Errorf("area-weighted domain average: have %g, want %g", r["WindSpeed"][1], areaAvg)
+	}
+	if !math.IsNaN(r["WindSpeed"][2]) {
+		t.Errorf("units outside of the domain should be NaN, not %g", r["WindSpeed"][2])
+	}
+
+	r, err = d.AggregateResults(o, units, "TotalPop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if different(r["WindSpeed"][1], popAvg) {
+		t.Errorf("population-weighted domain average: have %g, want %g", r["WindSpeed"][1], popAvg)
+	}
+
+	outFile := filepath.Join(dir, "aggregated.csv")
+	if err := o.OutputAggregated(units, "TotalPop", outFile)(d); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	recs, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 4 || recs[0][0] != "ID" || recs[0][1] != "WindSpeed" || recs[2][0] != "domain" {
+		t.Errorf("invalid aggregated output: %v", recs)
+	}
+}
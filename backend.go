@@ -0,0 +1,107 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Backend carries out the transport calculations, such as
+// UpwindAdvection, Mixing, and MeanderMixing, in all of the grid cells in
+// each time step of a simulation. The deposition and chemistry
+// calculations, which only use the concentrations in each cell, are run
+// afterward with Calculations. Backends that run on other hardware,
+// such as GPUs, can be made available with RegisterBackend.
+type Backend interface {
+	// Init returns a function that prepares the backend for the grid.
+	// It must be run after the grid is created and again after each
+	// change to the grid or the meteorology.
+	Init() DomainManipulator
+
+	// Calculate returns a function that adds the changes in
+	// concentration caused by transport over one time step to c.Cf in
+	// each grid cell and boundary cell.
+	Calculate() DomainManipulator
+}
+
+// cellBackend is a Backend that runs the transport calculations one
+// grid cell at a time with Calculations.
+type cellBackend []CellManipulator
+
+// Init returns a function that does nothing, because the calculations
+// do not need to be prepared.
+func (b cellBackend) Init() DomainManipulator {
+	return func(*InMAP) error { return nil }
+}
+
+// Calculate returns a function that runs the transport calculations.
+func (b cellBackend) Calculate() DomainManipulator {
+	return Calculations(b...)
+}
+
+var (
+	backendsMx sync.RWMutex
+	backends   = map[string]func(transport ...CellManipulator) Backend{
+		"cpu": func(transport ...CellManipulator) Backend {
+			return cellBackend(transport)
+		},
+		"batched": func(transport ...CellManipulator) Backend {
+			return NewBatchedTransport(transport...)
+		},
+	}
+)
+
+// RegisterBackend makes the Backend returned by f for a set of transport
+// calculations available under the given name, replacing any backend
+// already registered with that name. The "cpu" backend, which runs the
+// calculations one grid cell at a time, and the "batched" backend
+// (see BatchedTransport) are registered by default.
+func RegisterBackend(name string, f func(transport ...CellManipulator) Backend) {
+	backendsMx.Lock()
+	defer backendsMx.Unlock()
+	backends[name] = f
+}
+
+// NewBackend returns the backend registered with the given name for the
+// given transport calculations.
+func NewBackend(name string, transport ...CellManipulator) (Backend, error) {
+	backendsMx.RLock()
+	f, ok := backends[name]
+	backendsMx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("inmap: backend `%s` is not registered; registered backends are %s",
+			name, strings.Join(backendNames(), ", "))
+	}
+	return f(transport...), nil
+}
+
+// backendNames returns the names of the registered backends.
+func backendNames() []string {
+	backendsMx.RLock()
+	defer backendsMx.RUnlock()
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
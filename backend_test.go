@@ -0,0 +1,54 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewBackend(t *testing.T) {
+	if _, ok := mustBackend(t, "cpu").(cellBackend); !ok {
+		t.Error("cpu backend should run the calculations one cell at a time")
+	}
+	if _, ok := mustBackend(t, "batched").(*BatchedTransport); !ok {
+		t.Error("batched backend should be a BatchedTransport")
+	}
+
+	var transport []CellManipulator
+	RegisterBackend("test", func(t ...CellManipulator) Backend {
+		transport = t
+		return cellBackend(t)
+	})
+	mustBackend(t, "test")
+	if len(transport) != 3 {
+		t.Errorf("registered backend: have %d transport calculations, want 3", len(transport))
+	}
+	if _, err := NewBackend("xxx"); err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Errorf("expected a registration error but have %v", err)
+	}
+}
+
+func mustBackend(t *testing.T, name string) Backend {
+	b, err := NewBackend(name, UpwindAdvection(), Mixing(), MeanderMixing())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,248 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// BatchedTransport carries out a set of transport calculations, such as
+// UpwindAdvection, Mixing, and MeanderMixing, for all of the grid cells
+// at once rather than one cell at a time. The coefficients of the flux
+// between each cell and its neighbors are calculated once, combined
+// across all of the transport calculations, and stored in a sparse
+// matrix, and the concentrations of each chemical species are copied
+// into an array that holds that species in all of the cells (a
+// struct-of-arrays layout). Each time step is then one loop over the
+// matrix for each species, with no function calls, branches, or pointers
+// to neighboring cells to follow.
+//
+// As with AdjointTransport, the transport calculations must be linear in
+// the concentrations and the time step and must treat all chemical
+// species in the same way, so VanLeerAdvection can not be used. Init must
+// be run again after the grid or the meteorology changes.
+type BatchedTransport struct {
+	transport []CellManipulator
+
+	// cells holds the grid cells followed by the boundary cells, in the
+	// order of the concentration arrays.
+	cells []*Cell
+
+	// The change in the concentrations in cells[i] caused by transport
+	// is the sum of coef[k] [1/s] × Δt × the concentrations in
+	// cells[src[k]] for start[i] ≤ k < start[i+1].
+	start []int
+	src   []int32
+	coef  []float64
+
+	// ci and cf hold the concentration of each species in each cell at
+	// the beginning of the time step and its change over the time step,
+	// respectively.
+	ci, cf [][]float64
+}
+
+// NewBatchedTransport returns a new BatchedTransport for the given
+// transport calculations.
+func NewBatchedTransport(transport ...CellManipulator) *BatchedTransport {
+	return &BatchedTransport{transport: transport}
+}
+
+// Init returns a function that calculates the transport coefficients
+// between each grid cell and its neighbors in the same way as
+// AdjointTransport.Init, except that fluxes to and from boundary cells
+// are included. The concentrations are left unchanged. It should be run
+// after the grid is created.
+func (b *BatchedTransport) Init() DomainManipulator {
+	return func(d *InMAP) error {
+		lists := []*cellList{d.cells, d.westBoundary, d.eastBoundary,
+			d.northBoundary, d.southBoundary, d.topBoundary}
+		var ci, cf [][]float64
+		for _, l := range lists {
+			for _, c := range *l {
+				ci = append(ci, append([]float64{}, c.Ci...))
+				cf = append(cf, append([]float64{}, c.Cf...))
+			}
+		}
+		d.zeroConcentrations()
+
+		b.cells = b.cells[:0]
+		index := make(map[*Cell]int32, d.cells.len())
+		var terms []map[int32]float64 // coefficients by row and source
+		cellIndex := func(c *Cell) int32 {
+			i, ok := index[c]
+			if !ok {
+				i = int32(len(b.cells))
+				index[c] = i
+				b.cells = append(b.cells, c)
+				terms = append(terms, make(map[int32]float64))
+			}
+			return i
+		}
+		for _, c := range *d.cells {
+			cellIndex(c.Cell)
+		}
+		for _, c := range *d.cells {
+			if len(c.Cf) == 0 {
+				continue
+			}
+			sources := c.transportSources(true)
+			row := cellIndex(c.Cell)
+			for _, n := range sources {
+				for ii := range n.Ci {
+					n.Ci[ii] = 1
+				}
+				for _, f := range b.transport {
+					f(c.Cell, 1)
+				}
+				src := cellIndex(n)
+				terms[row][src] += c.Cf[0]
+				for ii := range c.Cf {
+					c.Cf[ii] = 0
+				}
+				// Transport out of the domain changes the
+				// concentrations in boundary cells.
+				for _, bc := range sources {
+					if !bc.boundary {
+						continue
+					}
+					terms[cellIndex(bc)][src] += bc.Cf[0]
+					for ii := range bc.Cf {
+						bc.Cf[ii] = 0
+					}
+				}
+				for ii := range n.Ci {
+					n.Ci[ii] = 0
+				}
+			}
+		}
+
+		b.start = append(b.start[:0], 0)
+		b.src, b.coef = b.src[:0], b.coef[:0]
+		for _, t := range terms {
+			row := make([]int32, 0, len(t))
+			for src, coef := range t {
+				if coef != 0 {
+					row = append(row, src)
+				}
+			}
+			sort.Slice(row, func(i, j int) bool { return row[i] < row[j] })
+			for _, src := range row {
+				b.src = append(b.src, src)
+				b.coef = append(b.coef, t[src])
+			}
+			b.start = append(b.start, len(b.src))
+		}
+		var nspecies int
+		if d.cells.len() > 0 {
+			nspecies = len((*d.cells)[0].Ci)
+		}
+		b.ci = make([][]float64, nspecies)
+		b.cf = make([][]float64, nspecies)
+		for ii := range b.ci {
+			b.ci[ii] = make([]float64, len(b.cells))
+			b.cf[ii] = make([]float64, len(b.cells))
+		}
+
+		i := 0
+		for _, l := range lists {
+			for _, c := range *l {
+				copy(c.Ci, ci[i])
+				copy(c.Cf, cf[i])
+				i++
+			}
+		}
+		return nil
+	}
+}
+
+// Calculate returns a function that calculates the changes in
+// concentration caused by the transport calculations in all of the grid
+// cells and adds them to c.Cf. The results are the same as running the
+// transport calculations in Calculations except for floating-point
+// rounding, and because the changes in each cell are calculated
+// independently of the others, they do not depend on the order in
+// which the cells are processed. It should be run before the
+// Calculations that carry out the deposition and chemistry.
+func (b *BatchedTransport) Calculate() DomainManipulator {
+	return func(d *InMAP) error {
+		b.parallel(b.gather)
+		b.parallel(func(lo, hi int) {
+			for ii := range b.ci {
+				b.flux(b.cf[ii], b.ci[ii], lo, hi, d.Dt)
+			}
+			b.scatter(lo, hi)
+		})
+		return nil
+	}
+}
+
+// parallel concurrently runs f on ranges [lo, hi) of the indices of
+// b.cells that together cover all of the cells.
+func (b *BatchedTransport) parallel(f func(lo, hi int)) {
+	n := len(b.cells)
+	nprocs := runtime.GOMAXPROCS(0)
+	chunk := (n + nprocs - 1) / nprocs
+	var wg sync.WaitGroup
+	for lo := 0; lo < n; lo += chunk {
+		hi := lo + chunk
+		if hi > n {
+			hi = n
+		}
+		wg.Add(1)
+		go func(lo, hi int) {
+			f(lo, hi)
+			wg.Done()
+		}(lo, hi)
+	}
+	wg.Wait()
+}
+
+// gather copies the concentrations in b.cells[lo:hi] into b.ci.
+func (b *BatchedTransport) gather(lo, hi int) {
+	for i, c := range b.cells[lo:hi] {
+		for ii, v := range c.Ci {
+			b.ci[ii][lo+i] = v
+		}
+	}
+}
+
+// flux sets cf[i] to the change over time step Δt in the concentration
+// of one species in b.cells[i] for lo ≤ i < hi, where ci holds the
+// concentrations of that species in all of the cells.
+func (b *BatchedTransport) flux(cf, ci []float64, lo, hi int, Δt float64) {
+	start, src, coef := b.start, b.src, b.coef
+	for i := lo; i < hi; i++ {
+		var v float64
+		for k := start[i]; k < start[i+1]; k++ {
+			v += coef[k] * ci[src[k]]
+		}
+		cf[i] = v * Δt
+	}
+}
+
+// scatter adds the changes in concentration in b.cf to b.cells[lo:hi].
+func (b *BatchedTransport) scatter(lo, hi int) {
+	for i, c := range b.cells[lo:hi] {
+		for ii := range c.Cf {
+			c.Cf[ii] += b.cf[ii][lo+i]
+		}
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+// Test whether the batched transport calculations give the same results
+// as the transport calculations run one cell at a time.
+func TestBatchedTransport(t *testing.T) {
+	const (
+		testTolerance = 1.e-10
+		numTimesteps  = 10
+	)
+
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		SOx:  E,
+		NOx:  E,
+		PM25: E,
+		VOC:  E,
+		NH3:  E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+
+	mutator, err := PopulationMutator(cfg, popIndices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Mech
+	// setBoundary sets concentrations at the west and top boundaries so
+	// that the transport into the domain is tested.
+	setBoundary := func(d *InMAP) error {
+		for _, l := range []*cellList{d.westBoundary, d.topBoundary} {
+			for _, c := range *l {
+				for ii := range c.Ci {
+					c.Ci[ii] = float64(ii + 1)
+				}
+			}
+		}
+		return nil
+	}
+	run := func(transport DomainManipulator, initFuncs ...DomainManipulator) *InMAP {
+		d := &InMAP{
+			InitFuncs: append([]DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+				cfg.MutateGrid(mutator, ctmdata, pop, mr, emis, m, nil),
+				SetTimestepCFL(),
+				setBoundary,
+			}, initFuncs...),
+			RunFuncs: []DomainManipulator{
+				Calculations(AddEmissionsFlux()),
+				transport,
+				SteadyStateConvergenceCheck(numTimesteps, cfg.PopGridColumn, m, nil),
+			},
+			Deterministic: true,
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Run(); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	want := run(Calculations(UpwindAdvection(), Mixing(), MeanderMixing()))
+	b := NewBatchedTransport(UpwindAdvection(), Mixing(), MeanderMixing())
+	have := run(b.Calculate(), b.Init())
+
+	if len(b.cells) <= want.cells.len() {
+		t.Errorf("batch has %d cells; it should include boundary cells in addition to %d grid cells",
+			len(b.cells), want.cells.len())
+	}
+	var nonzero bool
+	for _, l := range []func(d *InMAP) *cellList{
+		func(d *InMAP) *cellList { return d.cells },
+		func(d *InMAP) *cellList { return d.westBoundary },
+		func(d *InMAP) *cellList { return d.eastBoundary },
+		func(d *InMAP) *cellList { return d.northBoundary },
+		func(d *InMAP) *cellList { return d.southBoundary },
+		func(d *InMAP) *cellList { return d.topBoundary },
+	} {
+		wantCells, haveCells := *l(want), *l(have)
+		for i, wc := range wantCells {
+			hc := haveCells[i]
+			for ii, w := range wc.Cf {
+				if w != 0 {
+					nonzero = true
+				}
+				if different(hc.Cf[ii], w, testTolerance) {
+					t.Errorf("cell %d species %d: have %g, want %g", i, ii, hc.Cf[ii], w)
+				}
+			}
+		}
+	}
+	if !nonzero {
+		t.Error("all concentrations are zero")
+	}
+}
+
+// BenchmarkBatchedTransport compares the speed of the transport
+// calculations run one cell at a time and in batches on a uniform grid
+// with 128 × 128 cells in each of 10 layers.
+func BenchmarkBatchedTransport(b *testing.B) {
+	const n = 128
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	cfg.Xnests, cfg.Ynests = []int{n}, []int{n}
+	cfg.VariableGridDx = cfg.VariableGridDx * 2 / n
+	cfg.VariableGridDy = cfg.VariableGridDy * 2 / n
+
+	var m Mech
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, nil, m),
+			SetTimestepCFL(),
+		},
+	}
+	if err := d.Init(); err != nil {
+		b.Fatal(err)
+	}
+	batch := NewBatchedTransport(UpwindAdvection(), Mixing(), MeanderMixing())
+	if err := batch.Init()(d); err != nil {
+		b.Fatal(err)
+	}
+	b.Logf("%d grid cells", d.cells.len())
+
+	for _, f := range []struct {
+		name string
+		f    DomainManipulator
+	}{
+		{name: "Calculations", f: Calculations(UpwindAdvection(), Mixing(), MeanderMixing())},
+		{name: "Batched", f: batch.Calculate()},
+	} {
+		b.Run(f.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := f.f(d); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N*d.cells.len())/b.Elapsed().Seconds(), "cells/s")
+		})
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// BlobCacheDir is the directory where NetCDF and UAM-IV files that are
+// read from storage buckets (e.g., "s3://bucket/wrfout_d01_2005-01-01" or
+// "gs://bucket/wrfout_d01_2005-01-01") are cached. Each file is
+// downloaded the first time it is needed and is reused by later
+// preprocessing runs as long as its size matches the file in the bucket.
+// If BlobCacheDir is empty, a directory named "inmap_blob_cache" within
+// os.TempDir() is used.
+var BlobCacheDir string
+
+// openBucket opens the storage bucket with the given URL
+// (e.g., "s3://bucket").
+var openBucket = blob.OpenBucket
+
+// isBucket returns whether path is a storage bucket URL.
+func isBucket(path string) bool {
+	return strings.HasPrefix(path, "s3://") || strings.HasPrefix(path, "gs://")
+}
+
+// blobDownloads holds the result of caching each file, keyed by URL,
+// so that each file is only checked and downloaded once even though
+// it is opened once for every variable and record that is read from it.
+var blobDownloads sync.Map
+
+type blobDownload struct {
+	once sync.Once
+	path string // The path to the cached file.
+	err  error
+}
+
+// cacheBlob returns the path to a local copy of the file at the given
+// storage bucket URL, downloading it to BlobCacheDir if necessary.
+func cacheBlob(rawURL string) (string, error) {
+	d, _ := blobDownloads.LoadOrStore(rawURL, new(blobDownload))
+	dl := d.(*blobDownload)
+	dl.once.Do(func() {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			dl.err = err
+			return
+		}
+		ctx := context.Background()
+		b, err := openBucket(ctx, u.Scheme+"://"+u.Host)
+		if err != nil {
+			dl.err = err
+			return
+		}
+		defer b.Close()
+		dir := BlobCacheDir
+		if dir == "" {
+			dir = filepath.Join(os.TempDir(), "inmap_blob_cache")
+		}
+		key := strings.TrimPrefix(u.Path, "/")
+		dl.path = filepath.Join(dir, u.Scheme, u.Host, filepath.FromSlash(key))
+		dl.err = downloadBlob(ctx, b, key, dl.path)
+	})
+	return dl.path, dl.err
+}
+
+// downloadBlob downloads the object with the given key from b to
+// localPath, unless localPath already exists and has the same size
+// as the object.
+func downloadBlob(ctx context.Context, b *blob.Bucket, key, localPath string) error {
+	attrs, err := b.Attributes(ctx, key)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+		}
+		return err
+	}
+	if fi, err := os.Stat(localPath); err == nil && fi.Size() == attrs.Size {
+		return nil // The file is already cached.
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), os.ModePerm); err != nil {
+		return err
+	}
+	r, err := b.NewReader(ctx, key, nil)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	// Download to a temporary file first so that an interrupted
+	// download is not mistaken for a cached file.
+	w, err := os.Create(localPath + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return os.Rename(localPath+".tmp", localPath)
+}
+
+// openBlobNCF opens the NetCDF file at the given storage bucket URL
+// from the local cache. If there is no such file but there is a Zarr
+// store at the URL, the Zarr store is opened instead.
+func openBlobNCF(rawURL string) (ncfFile, error) {
+	p, err := cacheBlob(rawURL)
+	if os.IsNotExist(err) {
+		if z, zerr := openZarr(rawURL); zerr == nil {
+			return z, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading %s from storage bucket: %v", rawURL, err)
+	}
+	return openNCF(p)
+}
+
+// openBlob returns a local copy of the file at path if path is a
+// storage bucket URL, or opens path directly otherwise.
+func openBlob(p string) (*os.File, error) {
+	if !isBucket(p) {
+		return os.Open(p)
+	}
+	local, err := cacheBlob(p)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading %s from storage bucket: %v", p, err)
+	}
+	return os.Open(local)
+}
@@ -0,0 +1,130 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/fileblob"
+)
+
+func TestBlobNCF(t *testing.T) {
+	bucketDir, err := os.MkdirTemp("", "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bucketDir)
+	cacheDir, err := os.MkdirTemp("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	const name = "wrfout_d01_2005-01-01_00_00_00"
+	b, err := os.ReadFile(filepath.Join("cmd/inmap/testdata/preproc", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(bucketDir, name), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var opened int
+	openBucket = func(ctx context.Context, url string) (*blob.Bucket, error) {
+		opened++
+		return fileblob.OpenBucket(bucketDir, nil)
+	}
+	BlobCacheDir = cacheDir
+	defer func() {
+		openBucket = blob.OpenBucket
+		BlobCacheDir = ""
+	}()
+
+	wrf, err := NewWRFChem("s3://blobtest/wrfout_d01_[DATE]", "20050101", "20050102", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := Preprocess(wrf, -2004000, -540000, 12000, 12000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened != 1 {
+		t.Errorf("the bucket was opened %d times; the file should only be downloaded once", opened)
+	}
+	if _, err = os.Stat(filepath.Join(cacheDir, "s3", "blobtest", name)); err != nil {
+		t.Errorf("the file was not cached: %v", err)
+	}
+
+	wrf, err = NewWRFChem("cmd/inmap/testdata/preproc/wrfout_d01_[DATE]", "20050101", "20050102", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Preprocess(wrf, -2004000, -540000, 12000, 12000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"TotalPM25", "alt", "UAvg", "Kzz"} {
+		for i, w := range want.Data[v].Data.Elements {
+			if h := have.Data[v].Data.Elements[i]; different(h, w, 1.e-10) {
+				t.Errorf("%s[%d]: have %g, want %g", v, i, h, w)
+				break
+			}
+		}
+	}
+
+	if _, err = ncfFromTemplate("s3://blobtest/wrfout_d01_[DATE]", wrfFormat, wrf.start.AddDate(0, 0, 5)); err == nil {
+		t.Error("a missing file should cause an error")
+	}
+
+	// Cached files are reused as long as they have the same size as
+	// the file in the bucket.
+	ctx := context.Background()
+	bucket, err := fileblob.OpenBucket(bucketDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.Close()
+	cached := filepath.Join(cacheDir, "copy")
+	if err = downloadBlob(ctx, bucket, name, cached); err != nil {
+		t.Fatal(err)
+	}
+	modified := make([]byte, len(b))
+	if err = os.WriteFile(cached, modified, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = downloadBlob(ctx, bucket, name, cached); err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := os.ReadFile(cached); c[0] != 0 {
+		t.Error("a cached file with the same size should not be downloaded again")
+	}
+	if err = os.WriteFile(cached, modified[:10], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = downloadBlob(ctx, bucket, name, cached); err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := os.ReadFile(cached); len(c) != len(b) {
+		t.Error("a cached file with a different size should be downloaded again")
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Blosc header flags.
+const (
+	bloscShuffle    = 0x1
+	bloscMemcpyed   = 0x2
+	bloscBitShuffle = 0x4
+	bloscDontSplit  = 0x10
+)
+
+// Blosc internal compressor codes.
+const (
+	bloscCodeBloscLZ = iota
+	bloscCodeLZ4
+	bloscCodeSnappy
+	bloscCodeZlib
+	bloscCodeZstd
+)
+
+// bloscDecompress decompresses data compressed in the Blosc (version 1)
+// format, which is the default compressor for Zarr arrays. The
+// lz4, lz4hc, and zlib internal compressors and byte shuffling are
+// supported.
+func bloscDecompress(b []byte) ([]byte, error) {
+	const headerSize = 16
+	if len(b) < headerSize {
+		return nil, fmt.Errorf("blosc: header is too short")
+	}
+	flags := b[2]
+	typeSize := int(b[3])
+	nbytes := int(binary.LittleEndian.Uint32(b[4:8]))
+	blockSize := int(binary.LittleEndian.Uint32(b[8:12]))
+	cbytes := int(binary.LittleEndian.Uint32(b[12:16]))
+	if typeSize < 1 {
+		typeSize = 1
+	}
+	if cbytes > len(b) {
+		return nil, fmt.Errorf("blosc: compressed size %d is larger than buffer size %d", cbytes, len(b))
+	}
+	if flags&bloscMemcpyed != 0 {
+		if headerSize+nbytes > len(b) {
+			return nil, fmt.Errorf("blosc: buffer is too short")
+		}
+		return append([]byte{}, b[headerSize:headerSize+nbytes]...), nil
+	}
+	if flags&bloscBitShuffle != 0 && typeSize > 1 {
+		return nil, fmt.Errorf("blosc: bit shuffling is not supported")
+	}
+	if nbytes == 0 {
+		return []byte{}, nil
+	}
+	if blockSize <= 0 {
+		return nil, fmt.Errorf("blosc: invalid block size %d", blockSize)
+	}
+	var decompress func(src []byte, n int) ([]byte, error)
+	switch code := (flags >> 5) & 0x7; code {
+	case bloscCodeLZ4:
+		decompress = lz4Decompress
+	case bloscCodeZlib:
+		decompress = func(src []byte, n int) ([]byte, error) {
+			r, err := zlib.NewReader(bytes.NewReader(src))
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return io.ReadAll(r)
+		}
+	default:
+		names := map[byte]string{bloscCodeBloscLZ: "blosclz", bloscCodeSnappy: "snappy", bloscCodeZstd: "zstd"}
+		name, ok := names[code]
+		if !ok {
+			name = fmt.Sprint(code)
+		}
+		return nil, fmt.Errorf("blosc: internal compressor %s is not supported; supported compressors are lz4, lz4hc, and zlib", name)
+	}
+
+	nblocks := (nbytes + blockSize - 1) / blockSize
+	if headerSize+4*nblocks > len(b) {
+		return nil, fmt.Errorf("blosc: buffer is too short")
+	}
+	out := make([]byte, 0, nbytes)
+	for i := 0; i < nblocks; i++ {
+		bsize := blockSize
+		leftover := i == nblocks-1 && nbytes%blockSize != 0
+		if leftover {
+			bsize = nbytes % blockSize
+		}
+		nsplits := 1
+		if flags&bloscDontSplit == 0 && typeSize <= 16 && blockSize/typeSize >= 128 && !leftover {
+			nsplits = typeSize
+		}
+		splitSize := bsize / nsplits
+		pos := int(binary.LittleEndian.Uint32(b[headerSize+4*i:]))
+		block := make([]byte, 0, bsize)
+		for j := 0; j < nsplits; j++ {
+			if pos+4 > len(b) {
+				return nil, fmt.Errorf("blosc: buffer is too short")
+			}
+			n := int(int32(binary.LittleEndian.Uint32(b[pos:])))
+			pos += 4
+			if n < 0 || pos+n > len(b) {
+				return nil, fmt.Errorf("blosc: invalid split size %d", n)
+			}
+			src := b[pos : pos+n]
+			pos += n
+			if n == splitSize {
+				// The split was stored uncompressed.
+				block = append(block, src...)
+				continue
+			}
+			d, err := decompress(src, splitSize)
+			if err != nil {
+				return nil, fmt.Errorf("blosc: %v", err)
+			}
+			if len(d) != splitSize {
+				return nil, fmt.Errorf("blosc: decompressed split has %d bytes; expected %d", len(d), splitSize)
+			}
+			block = append(block, d...)
+		}
+		if flags&bloscShuffle != 0 && typeSize > 1 {
+			block = unshuffle(block, typeSize)
+		}
+		out = append(out, block...)
+	}
+	return out, nil
+}
+
+// unshuffle reverses the Blosc byte shuffle filter, where
+// typeSize is the number of bytes in each value.
+func unshuffle(b []byte, typeSize int) []byte {
+	n := len(b) / typeSize
+	out := make([]byte, len(b))
+	for i := 0; i < n; i++ {
+		for j := 0; j < typeSize; j++ {
+			out[i*typeSize+j] = b[j*n+i]
+		}
+	}
+	// Bytes left over at the end of the block are not shuffled.
+	copy(out[n*typeSize:], b[n*typeSize:])
+	return out
+}
+
+// lz4Decompress decompresses a block in the LZ4 block format
+// whose decompressed size is n bytes.
+func lz4Decompress(src []byte, n int) ([]byte, error) {
+	dst := make([]byte, 0, n)
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+		litLen := int(token >> 4)
+		if litLen == 15 {
+			for {
+				if i >= len(src) {
+					return nil, fmt.Errorf("lz4: corrupt input")
+				}
+				l := src[i]
+				i++
+				litLen += int(l)
+				if l != 255 {
+					break
+				}
+			}
+		}
+		if i+litLen > len(src) {
+			return nil, fmt.Errorf("lz4: corrupt input")
+		}
+		dst = append(dst, src[i:i+litLen]...)
+		i += litLen
+		if i == len(src) {
+			break // The last sequence only contains literals.
+		}
+		if i+2 > len(src) {
+			return nil, fmt.Errorf("lz4: corrupt input")
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, fmt.Errorf("lz4: invalid offset %d", offset)
+		}
+		matchLen := int(token & 0xf)
+		if matchLen == 15 {
+			for {
+				if i >= len(src) {
+					return nil, fmt.Errorf("lz4: corrupt input")
+				}
+				l := src[i]
+				i++
+				matchLen += int(l)
+				if l != 255 {
+					break
+				}
+			}
+		}
+		matchLen += 4
+		if len(dst)+matchLen > n {
+			return nil, fmt.Errorf("lz4: decompressed data is larger than %d bytes", n)
+		}
+		// Copy one byte at a time because the match may overlap
+		// the bytes being written.
+		p := len(dst) - offset
+		for k := 0; k < matchLen; k++ {
+			dst = append(dst, dst[p+k])
+		}
+	}
+	return dst, nil
+}
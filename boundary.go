@@ -0,0 +1,78 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+)
+
+// SetBoundaryConcentrations returns a function that sets the
+// concentrations in the boundary cells outside the edges and top of
+// the domain to the baseline concentrations in data, so that pollution
+// that is transported into the domain from outside is accounted for,
+// rather than assuming that the concentrations outside the domain are
+// zero. data can be, for example, preprocessed from a GEOS-Chem
+// simulation of a larger region. The concentrations in each boundary cell
+// are the baseline concentrations in data at the location of the
+// grid cell that it borders, so data must cover the whole domain.
+// Because the baseline PM2.5 concentration includes secondary
+// particulate matter, the baseline total PM2.5 minus the baseline
+// particulate sulfate, nitrate, ammonium, and SOA is used as the primary
+// PM2.5 concentration.
+//
+// The first len(PolNames) species of m must be those in PolNames, in
+// the same order and units, as in
+// github.com/yuzhou-wang/inmap/science/chem/simplechem; the
+// concentrations of any other species at the boundaries are zero.
+// The boundary cells are replaced when the grid changes, so
+// SetBoundaryConcentrations should be run again after the grid is
+// mutated.
+func SetBoundaryConcentrations(data *CTMData, m Mechanism) DomainManipulator {
+	return func(d *InMAP) error {
+		if m.Len() < len(PolNames) {
+			return fmt.Errorf("inmap: boundary concentrations require at least %d species but the mechanism has %d", len(PolNames), m.Len())
+		}
+		if nz := data.Data["UAvg"].Data.Shape[0]; nz < d.nlayers {
+			return fmt.Errorf("inmap: setting boundary concentrations: the data has %d layers but the grid has %d", nz, d.nlayers)
+		}
+		for _, l := range []*cellList{d.westBoundary, d.eastBoundary,
+			d.northBoundary, d.southBoundary, d.topBoundary} {
+			for _, b := range *l {
+				if b.Ci == nil {
+					b.Ci = make([]float64, m.Len())
+				}
+				for i := range b.Ci {
+					b.Ci[i] = 0
+				}
+				c := &Cell{
+					Polygonal: b.Polygonal,
+					CBaseline: make([]float64, len(PolNames)),
+				}
+				if err := c.loadData(data, b.Layer); err != nil {
+					return fmt.Errorf("inmap: setting boundary concentrations: %v", err)
+				}
+				copy(b.Ci, c.CBaseline)
+				b.Ci[iPM2_5] = math.Max(0, c.CBaseline[iPM2_5]-c.CBaseline[ipNH]*NtoNH4-
+					c.CBaseline[ipS]*StoSO4-c.CBaseline[ipNO]*NtoNO3-c.CBaseline[ipOrg])
+			}
+		}
+		return nil
+	}
+}
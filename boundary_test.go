@@ -0,0 +1,73 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import "testing"
+
+func TestSetBoundaryConcentrations(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	m := Mech{}
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, NewEmissions(), m),
+			SetBoundaryConcentrations(ctmdata, m),
+			SetTimestepCFL(),
+		},
+		RunFuncs: []DomainManipulator{
+			Calculations(AddEmissionsFlux()),
+			Calculations(UpwindAdvection(), Mixing(), MeanderMixing()),
+			SteadyStateConvergenceCheck(10, cfg.PopGridColumn, m, nil),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range *d.cells {
+		for _, l := range []*cellList{&c.west, &c.east, &c.south, &c.north, &c.above} {
+			for _, b := range *l {
+				if !b.boundary {
+					continue
+				}
+				if b.Ci[igS] != c.CBaseline[igS] {
+					t.Errorf("boundary of cell %v: have gS %g, want %g", c, b.Ci[igS], c.CBaseline[igS])
+				}
+				if b.Ci[iPM2_5] < 0 || b.Ci[iPM2_5] > c.CBaseline[iPM2_5] {
+					t.Errorf("boundary of cell %v: primary PM2.5 %g should be between 0 and total PM2.5 %g",
+						c, b.Ci[iPM2_5], c.CBaseline[iPM2_5])
+				}
+			}
+		}
+	}
+
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// There are no emissions, so all of the pollution in the domain
+	// has been transported in from the boundaries.
+	for _, c := range *d.cells {
+		for i, v := range c.Cf {
+			if v < 0 {
+				t.Errorf("cell %v: species %d: negative concentration %g", c, i, v)
+			}
+		}
+		if !(c.Cf[igS] > 0) {
+			t.Errorf("cell %v: pollution should have been transported in from the boundaries, but gS is %g", c, c.Cf[igS])
+		}
+	}
+}
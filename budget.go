@@ -0,0 +1,244 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// MassBudget keeps track of the mass [μg] of each species that is
+// emitted, transported out of the domain, removed by dry and wet
+// deposition, and created or destroyed by chemistry during a simulation,
+// and of the mass that remains in the domain, so that mass conservation
+// can be verified and the sinks of each species can be diagnosed.
+//
+// To use it, Init should be the last of the InitFuncs; Emissions
+// should be the first of the science calculations, and the deposition
+// and chemistry calculations should be wrapped with DryDeposition,
+// WetDeposition, and Chemistry, respectively; and Update should be run
+// at the end of each iteration.
+type MassBudget struct {
+	// Species are the names of the species in the budget.
+	Species []string
+
+	// Records holds the budget at the end of each iteration.
+	Records []MassBudgetRecord
+
+	// initialOut is the mass in the boundary cells at the start of
+	// the simulation.
+	initialOut []float64
+
+	// current holds the running totals.
+	current MassBudgetRecord
+
+	mu sync.Mutex
+}
+
+// MassBudgetRecord holds the mass budget [μg] of each species since
+// the start of a simulation.
+type MassBudgetRecord struct {
+	// Iteration is the iteration number.
+	Iteration int
+
+	// Initial is the mass in the domain at the start of the simulation.
+	Initial []float64
+
+	// Emitted is the mass that has been emitted.
+	Emitted []float64
+
+	// OutOfDomain is the net mass that has been transported out of the
+	// domain. It is negative if more mass has been transported into the
+	// domain from outside (see SetBoundaryConcentrations) than out of it.
+	OutOfDomain []float64
+
+	// DryDeposition and WetDeposition are the masses that have been
+	// removed by dry and wet deposition.
+	DryDeposition, WetDeposition []float64
+
+	// Chemistry is the net mass that has been created by chemical
+	// reactions. It is negative if mass has been destroyed.
+	Chemistry []float64
+
+	// Remaining is the mass in the domain.
+	Remaining []float64
+}
+
+// Imbalance returns the mass [μg] of each species that is not accounted
+// for by the other terms in the budget, which should be small compared to
+// the mass that has been emitted if mass is conserved.
+func (r MassBudgetRecord) Imbalance() []float64 {
+	o := make([]float64, len(r.Initial))
+	for i := range o {
+		o[i] = r.Initial[i] + r.Emitted[i] + r.Chemistry[i] - r.OutOfDomain[i] -
+			r.DryDeposition[i] - r.WetDeposition[i] - r.Remaining[i]
+	}
+	return o
+}
+
+// NewMassBudget returns a new mass budget for the species in m.
+func NewMassBudget(m Mechanism) *MassBudget {
+	return &MassBudget{Species: speciesNames(m)}
+}
+
+// Init returns a function that starts the budget using the mass that is
+// in the domain at the start of the simulation. Any previous records
+// are removed.
+func (b *MassBudget) Init() DomainManipulator {
+	return func(d *InMAP) error {
+		n := len(b.Species)
+		b.current = MassBudgetRecord{
+			Initial:       d.totalMass(n, d.cells),
+			Emitted:       make([]float64, n),
+			OutOfDomain:   make([]float64, n),
+			DryDeposition: make([]float64, n),
+			WetDeposition: make([]float64, n),
+			Chemistry:     make([]float64, n),
+			Remaining:     make([]float64, n),
+		}
+		b.current.Iteration = d.progress.Iteration
+		b.initialOut = d.totalMass(n, d.westBoundary, d.eastBoundary,
+			d.northBoundary, d.southBoundary, d.topBoundary)
+		b.Records = nil
+		return nil
+	}
+}
+
+// totalMass returns the total mass of each of the first n species in
+// the given cells.
+func (d *InMAP) totalMass(n int, lists ...*cellList) []float64 {
+	o := make([]float64, n)
+	for _, l := range lists {
+		for _, c := range *l {
+			for i := range o {
+				o[i] += c.Cf[i] * c.Volume
+			}
+		}
+	}
+	return o
+}
+
+// Emissions returns a function that adds the mass that is added to c
+// by AddEmissionsFlux in the current time step to the budget. It does
+// not change the concentrations.
+func (b *MassBudget) Emissions() CellManipulator {
+	return func(c *Cell, Δt float64) {
+		if c.EmisFlux == nil {
+			return
+		}
+		b.mu.Lock()
+		for i := range b.current.Emitted {
+			b.current.Emitted[i] += c.EmisFlux[i] * c.Volume * Δt
+		}
+		b.mu.Unlock()
+	}
+}
+
+// DryDeposition returns a function that runs the dry deposition
+// calculation f and adds the mass that it removes to the budget.
+func (b *MassBudget) DryDeposition(f CellManipulator) CellManipulator {
+	return b.track(f, func(r *MassBudgetRecord) []float64 { return r.DryDeposition }, -1)
+}
+
+// WetDeposition returns a function that runs the wet deposition
+// calculation f and adds the mass that it removes to the budget.
+func (b *MassBudget) WetDeposition(f CellManipulator) CellManipulator {
+	return b.track(f, func(r *MassBudgetRecord) []float64 { return r.WetDeposition }, -1)
+}
+
+// Chemistry returns a function that runs the chemistry calculation f
+// and adds the mass that it creates to the budget.
+func (b *MassBudget) Chemistry(f CellManipulator) CellManipulator {
+	return b.track(f, func(r *MassBudgetRecord) []float64 { return r.Chemistry }, 1)
+}
+
+// track returns a function that runs f and adds the change in mass that
+// f causes, multiplied by sign, to the budget term returned by term.
+func (b *MassBudget) track(f CellManipulator, term func(*MassBudgetRecord) []float64, sign float64) CellManipulator {
+	return func(c *Cell, Δt float64) {
+		before := make([]float64, len(c.Cf))
+		copy(before, c.Cf)
+		f(c, Δt)
+		b.mu.Lock()
+		t := term(&b.current)
+		for i := range t {
+			t[i] += sign * (c.Cf[i] - before[i]) * c.Volume
+		}
+		b.mu.Unlock()
+	}
+}
+
+// Update returns a function that calculates the mass that has been
+// transported out of the domain and the mass that remains in the
+// domain, and adds the budget as of the current iteration to b.Records.
+func (b *MassBudget) Update() DomainManipulator {
+	return func(d *InMAP) error {
+		n := len(b.Species)
+		out := d.totalMass(n, d.westBoundary, d.eastBoundary,
+			d.northBoundary, d.southBoundary, d.topBoundary)
+		for i := range out {
+			out[i] -= b.initialOut[i]
+		}
+		b.current.OutOfDomain = out
+		b.current.Remaining = d.totalMass(n, d.cells)
+		b.current.Iteration++
+
+		r := b.current
+		for _, s := range []*[]float64{&r.Initial, &r.Emitted, &r.OutOfDomain,
+			&r.DryDeposition, &r.WetDeposition, &r.Chemistry, &r.Remaining} {
+			*s = append([]float64(nil), *s...)
+		}
+		b.Records = append(b.Records, r)
+		return nil
+	}
+}
+
+// Output returns a function that writes the budget for each species and
+// iteration to fileName in CSV format.
+func (b *MassBudget) Output(fileName string) DomainManipulator {
+	return func(d *InMAP) error {
+		f, err := os.Create(fileName)
+		if err != nil {
+			return fmt.Errorf("inmap: creating mass budget file: %v", err)
+		}
+		w := csv.NewWriter(f)
+		w.Write([]string{"Iteration", "Species", "Initial (μg)", "Emitted (μg)",
+			"OutOfDomain (μg)", "DryDeposition (μg)", "WetDeposition (μg)",
+			"Chemistry (μg)", "Remaining (μg)", "Imbalance (μg)"})
+		format := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+		for _, r := range b.Records {
+			imbalance := r.Imbalance()
+			for i, sp := range b.Species {
+				w.Write([]string{strconv.Itoa(r.Iteration), sp, format(r.Initial[i]),
+					format(r.Emitted[i]), format(r.OutOfDomain[i]), format(r.DryDeposition[i]),
+					format(r.WetDeposition[i]), format(r.Chemistry[i]), format(r.Remaining[i]),
+					format(imbalance[i])})
+			}
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			f.Close()
+			return fmt.Errorf("inmap: writing mass budget file: %v", err)
+		}
+		return f.Close()
+	}
+}
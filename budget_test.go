@@ -0,0 +1,144 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap_test
+
+import (
+	"encoding/csv"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/science/chem/simplechem"
+)
+
+func TestMassBudget(t *testing.T) {
+	const n = 100 // number of time steps
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := inmap.VarGridTestData()
+	var m simplechem.Mechanism
+	emis := inmap.NewEmissions()
+	emis.Add(&inmap.EmisRecord{
+		SOx:  E,
+		NOx:  E,
+		PM25: E,
+		VOC:  E,
+		NH3:  E,
+		Geom: geom.Point{X: -3999, Y: -3999},
+	})
+	drydep, err := m.DryDep("simple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wetdep, err := m.WetDep("emep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator, err := inmap.PopulationMutator(cfg, popIndices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.MkdirTemp("", "budget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "budget.csv")
+
+	b := inmap.NewMassBudget(m)
+	d := &inmap.InMAP{
+		InitFuncs: []inmap.DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+			cfg.MutateGrid(mutator, ctmdata, pop, mr, emis, m, nil),
+			inmap.SetTimestepCFL(),
+			b.Init(),
+		},
+		RunFuncs: []inmap.DomainManipulator{
+			inmap.Calculations(inmap.AddEmissionsFlux()),
+			inmap.Calculations(
+				b.Emissions(),
+				inmap.UpwindAdvection(),
+				inmap.Mixing(),
+				inmap.MeanderMixing(),
+				b.DryDeposition(drydep),
+				b.WetDeposition(wetdep),
+				b.Chemistry(m.Chemistry()),
+			),
+			inmap.SteadyStateConvergenceCheck(n, cfg.PopGridColumn, m, nil),
+			b.Update(),
+		},
+		CleanupFuncs: []inmap.DomainManipulator{
+			b.Output(fileName),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b.Records) != n {
+		t.Fatalf("have %d budget records, want %d", len(b.Records), n)
+	}
+	r := b.Records[n-1]
+	if r.Iteration != n {
+		t.Errorf("have iteration %d, want %d", r.Iteration, n)
+	}
+	var emitted, removed, chemistry float64
+	for i := range b.Species {
+		emitted += r.Emitted[i]
+		removed += r.DryDeposition[i] + r.WetDeposition[i] + r.OutOfDomain[i]
+		chemistry += math.Abs(r.Chemistry[i])
+	}
+	for i, imbalance := range r.Imbalance() {
+		if math.Abs(imbalance) > 1.e-8*emitted {
+			t.Errorf("%s: mass imbalance %g with %g total emitted", b.Species[i], imbalance, emitted)
+		}
+	}
+	var want float64
+	for _, c := range d.Cells() {
+		for _, e := range c.EmisFlux {
+			want += e * c.Volume * d.Dt * n
+		}
+	}
+	if different(emitted, want, 1.e-8) {
+		t.Errorf("have %g emitted, want %g", emitted, want)
+	}
+	if !(removed > 0) || !(chemistry > 0) {
+		t.Errorf("the sinks and chemistry should be tracked but have removed=%g and chemistry=%g", removed, chemistry)
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 1 + n*len(b.Species); len(rows) != want {
+		t.Errorf("have %d rows in budget file, want %d", len(rows), want)
+	}
+}
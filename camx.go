@@ -0,0 +1,562 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/ctessum/sparse"
+)
+
+// camxFormat is the date format used in CAMx output file names.
+const camxFormat = "20060102"
+
+// CAMx is an InMAP preprocessor for CAMx output using the CB6 gas-phase
+// mechanism and the SOAP secondary organic aerosol scheme. Pollutant
+// concentrations are read from CAMx average concentration files in
+// either UAM-IV (Fortran binary) or NetCDF (classic or NetCDF-4) format. Because CAMx
+// meteorological inputs lack several variables that InMAP needs
+// (e.g., friction velocity and surface heat flux), meteorology is read from
+// the WRF output that was used to create the CAMx meteorological inputs,
+// which must be on the same grid as the CAMx simulation.
+type CAMx struct {
+	// WRFCmaq provides the meteorological variables.
+	*WRFCmaq
+
+	aVOC, bVOC, aSOA, bSOA, nox, pNO, sox, pS, nh3, pNH, totalPM25 map[string]float64
+
+	camxOut string
+}
+
+// NewCAMx initializes a CAMx preprocessor from the given
+// configuration information.
+// CAMxAvrg is the location of CAMx average concentration files, and
+// WRFOut is the location of the WRF output files used to drive the CAMx
+// simulation. [DATE] should be used as a wild card for the simulation date.
+// startDate and endDate are the dates of the beginning and end of the
+// simulation, respectively, in the format "YYYYMMDD".
+// If msgChan is not nil, status messages will be sent to it.
+func NewCAMx(CAMxAvrg, WRFOut, startDate, endDate string, msgChan chan string) (*CAMx, error) {
+	met, err := NewWRFCmaq(WRFOut, startDate, endDate, msgChan)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: CAMx preprocessor: %v", err)
+	}
+	c := CAMx{
+		WRFCmaq: met,
+
+		// Gas-phase species are in units of [ppmv] and are converted to [μg/kg].
+		// Molecular weights for lumped species are the nominal values used
+		// by the CAMx CB6 and SOAP mechanisms.
+
+		// anthropogenic VOC and semi-volatile SOA precursors.
+		aVOC: map[string]float64{
+			"TOL":  ppmvToUgKg(92.14),
+			"XYL":  ppmvToUgKg(106.16),
+			"BENZ": ppmvToUgKg(78.11),
+			"IVOA": ppmvToUgKg(212.),
+			"CG1":  ppmvToUgKg(150.),
+			"CG2":  ppmvToUgKg(150.),
+		},
+		// biogenic VOC and semi-volatile SOA precursors.
+		bVOC: map[string]float64{
+			"ISOP": ppmvToUgKg(68.12),
+			"TERP": ppmvToUgKg(136.24),
+			"SQT":  ppmvToUgKg(204.35),
+			"CG3":  ppmvToUgKg(180.),
+			"CG4":  ppmvToUgKg(180.),
+		},
+		// NOx as nitrogen.
+		nox: map[string]float64{
+			"NO":  ppmvToUgKg(mwN),
+			"NO2": ppmvToUgKg(mwN),
+		},
+		// SOx as sulfur.
+		sox: map[string]float64{"SO2": ppmvToUgKg(mwS)},
+		// NH3 as nitrogen.
+		nh3: map[string]float64{"NH3": ppmvToUgKg(mwN)},
+
+		// Particle-phase species are in units of [μg/m3].
+
+		// anthropogenic SOA.
+		aSOA: map[string]float64{"SOA1": 1., "SOA2": 1., "SOPA": 1.},
+		// biogenic SOA.
+		bSOA: map[string]float64{"SOA3": 1., "SOA4": 1., "SOPB": 1.},
+		// particulate nitrate as nitrogen.
+		pNO: map[string]float64{"PNO3": mwN / mwNO3},
+		// particulate sulfate as sulfur.
+		pS: map[string]float64{"PSO4": mwS / mwSO4},
+		// particulate ammonium as nitrogen.
+		pNH: map[string]float64{"PNH4": mwN / mwNH4},
+		// totalPM25 is total mass of fine (dry) PM.
+		totalPM25: map[string]float64{
+			"PSO4": 1., "PNO3": 1., "PNH4": 1., "POA": 1., "PEC": 1.,
+			"FPRM": 1., "FCRS": 1., "NA": 1., "PCL": 1.,
+			"SOA1": 1., "SOA2": 1., "SOA3": 1., "SOA4": 1., "SOPA": 1., "SOPB": 1.,
+		},
+		camxOut: CAMxAvrg,
+	}
+	if err := c.checkGrid(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// checkGrid makes sure that the CAMx and WRF grids have the same
+// dimensions. CAMx simulations are sometimes run on a subset of the
+// WRF domain or with collapsed layers, which is not supported here.
+func (c *CAMx) checkGrid() error {
+	fileName := templateFile(c.camxOut, camxFormat, c.start)
+	f, err := openBlob(fileName)
+	if err != nil {
+		return fmt.Errorf("inmap: CAMx preprocessor: %v", err)
+	}
+	defer f.Close()
+	cf, err := openCAMx(f)
+	if err != nil {
+		return fmt.Errorf("inmap: CAMx preprocessor: opening %s: %v", fileName, err)
+	}
+	camxShape, err := cf.shape()
+	if err != nil {
+		return fmt.Errorf("inmap: CAMx preprocessor: %s: %v", fileName, err)
+	}
+	wff, err := ncfFromTemplate(c.WRFCmaq.cmaqOut, c.WRFCmaq.dateFormat, c.start)
+	if err != nil {
+		return fmt.Errorf("inmap: CAMx preprocessor: %v", err)
+	}
+	defer wff.Close()
+	wrfShape := wff.Lengths("ALT")
+	if len(wrfShape) != 4 {
+		return fmt.Errorf("inmap: CAMx preprocessor: variable ALT not in WRF output")
+	}
+	wrfShape = wrfShape[1:]
+	for i, dim := range []string{"layer", "row", "column"} {
+		if camxShape[i] != wrfShape[i] {
+			return fmt.Errorf("inmap: CAMx preprocessor: CAMx grid has %d %ss but WRF grid has %d; "+
+				"the CAMx and WRF grids must match", camxShape[i], dim, wrfShape[i])
+		}
+	}
+	return nil
+}
+
+// ppmvToUgKg returns a conversion factor from
+// ppmv to μg/kg for a species with the given molecular weight.
+func ppmvToUgKg(mw float64) float64 {
+	return 1000 * ppbvToUgKg(mw)
+}
+
+// SetMissingDataPolicy sets how CAMx and WRF output files that are
+// missing and time steps that cannot be read are handled. policy can be
+// "fail" (the default), "skip", or "interpolate"; see MissingDataPolicy.
+// If either the CAMx or the WRF output file for a day is missing, both
+// are treated as missing. The output files for the first day of the
+// simulation must always be available.
+func (c *CAMx) SetMissingDataPolicy(policy string) error {
+	gaps, err := newGapTracker(policy, c.WRFCmaq.checkFile, c.checkFile)
+	if err != nil {
+		return fmt.Errorf("inmap: CAMx preprocessor: %v", err)
+	}
+	c.WRFCmaq.gaps = gaps
+	return nil
+}
+
+// checkFile returns an error if the CAMx average file for the
+// given date cannot be opened.
+func (c *CAMx) checkFile(date time.Time) error {
+	f, err := openBlob(templateFile(c.camxOut, camxFormat, date))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = openCAMx(f)
+	return err
+}
+
+func (c *CAMx) read(varName string) NextData {
+	if c.gaps != nil {
+		// The file for the current date is kept open until all of
+		// its records have been read or a different file is requested.
+		var f *os.File
+		var cf camxFile
+		var fileDate time.Time
+		return c.gaps.nextData(varName, c.start, c.end, c.recordDelta, c.fileDelta, func(date time.Time, index int) (*sparse.DenseArray, error) {
+			if f == nil || !date.Equal(fileDate) {
+				if f != nil {
+					f.Close()
+					f, cf = nil, nil
+				}
+				var err error
+				if f, err = openBlob(templateFile(c.camxOut, camxFormat, date)); err != nil {
+					return nil, err
+				}
+				if cf, err = openCAMx(f); err != nil {
+					f.Close()
+					f = nil
+					return nil, err
+				}
+				fileDate = date
+			}
+			data, err := cf.read(varName, index)
+			if index == fileRecords(date, c.recordDelta, c.fileDelta)-1 {
+				f.Close()
+				f, cf = nil, nil
+			}
+			return data, err
+		}, c.msgChan)
+	}
+	return nextDataCAMx(c.camxOut, varName, c.start, c.end, c.recordDelta, c.fileDelta, c.msgChan)
+}
+
+func (c *CAMx) readGroup(varGroup map[string]float64) NextData {
+	dataFuncs := make(map[string]NextData)
+	for v := range varGroup {
+		dataFuncs[v] = c.read(v)
+	}
+	return nextDataGroup(dataFuncs, varGroup)
+}
+
+// readGroupAlt reads a group of gas-phase variables and converts them
+// from [μg/kg] to [μg/m3].
+func (c *CAMx) readGroupAlt(varGroup map[string]float64) NextData {
+	return divideByAlt(c.readGroup(varGroup), c.WRFCmaq.ALT())
+}
+
+// AVOC helps fulfill the Preprocessor interface.
+func (c *CAMx) AVOC() NextData { return c.readGroupAlt(c.aVOC) }
+
+// BVOC helps fulfill the Preprocessor interface.
+func (c *CAMx) BVOC() NextData { return c.readGroupAlt(c.bVOC) }
+
+// NOx helps fulfill the Preprocessor interface.
+func (c *CAMx) NOx() NextData { return c.readGroupAlt(c.nox) }
+
+// SOx helps fulfill the Preprocessor interface.
+func (c *CAMx) SOx() NextData { return c.readGroupAlt(c.sox) }
+
+// NH3 helps fulfill the Preprocessor interface.
+func (c *CAMx) NH3() NextData { return c.readGroupAlt(c.nh3) }
+
+// ASOA helps fulfill the Preprocessor interface.
+func (c *CAMx) ASOA() NextData { return c.readGroup(c.aSOA) }
+
+// BSOA helps fulfill the Preprocessor interface.
+func (c *CAMx) BSOA() NextData { return c.readGroup(c.bSOA) }
+
+// PNO helps fulfill the Preprocessor interface.
+func (c *CAMx) PNO() NextData { return c.readGroup(c.pNO) }
+
+// PS helps fulfill the Preprocessor interface.
+func (c *CAMx) PS() NextData { return c.readGroup(c.pS) }
+
+// PNH helps fulfill the Preprocessor interface.
+func (c *CAMx) PNH() NextData { return c.readGroup(c.pNH) }
+
+// TotalPM25 helps fulfill the Preprocessor interface.
+func (c *CAMx) TotalPM25() NextData { return c.readGroup(c.totalPM25) }
+
+// HO helps fulfill the Preprocessor interface
+// by returning hydroxyl radical concentration [ppmv].
+func (c *CAMx) HO() NextData { return c.read("OH") }
+
+// H2O2 helps fulfill the Preprocessor interface
+// by returning hydrogen peroxide concentration [ppmv].
+func (c *CAMx) H2O2() NextData { return c.read("H2O2") }
+
+// O3 helps fulfill the Preprocessor interface
+// by returning ozone concentration [ppmv].
+func (c *CAMx) O3() NextData { return c.read("O3") }
+
+// HNO3 helps fulfill the Preprocessor interface
+// by returning nitric acid concentration [ppmv].
+func (c *CAMx) HNO3() NextData { return c.read("HNO3") }
+
+// camxFile is a CAMx average concentration file.
+type camxFile interface {
+	// read returns the values of varName at the given time index,
+	// with dimensions [layer, row, column].
+	read(varName string, index int) (*sparse.DenseArray, error)
+
+	// shape returns the number of layers, rows, and columns in the file.
+	shape() ([]int, error)
+}
+
+// nextDataCAMx is analogous to nextDataNCF, except that it reads
+// CAMx average files in either UAM-IV or NetCDF format.
+func nextDataCAMx(fileTemplate string, varName string, start, end time.Time, recordDelta, fileDelta time.Duration, msgChan chan string) NextData {
+	recordsPerFile := fileRecords(start, recordDelta, fileDelta)
+	var i int
+	date := start
+	// The file for the current date is kept open until
+	// all of its records have been read.
+	var f *os.File
+	var cf camxFile
+	return func() (*sparse.DenseArray, error) {
+		if !date.Before(end) {
+			return nil, io.EOF
+		}
+		fileName := templateFile(fileTemplate, camxFormat, date)
+		if f == nil {
+			var err error
+			f, err = openBlob(fileName)
+			if err != nil {
+				return nil, err
+			}
+			cf, err = openCAMx(f)
+			if err != nil {
+				f.Close()
+				f = nil
+				return nil, fmt.Errorf("inmap: CAMx preprocessor: opening %s: %v", fileName, err)
+			}
+		}
+		data, err := cf.read(varName, i)
+		if err != nil {
+			return nil, err
+		}
+		i++
+		if i == recordsPerFile {
+			if msgChan != nil {
+				msgChan <- fmt.Sprintf("Read %d records of %s from %s", i, varName, fileName)
+			}
+			i = 0
+			date = addInterval(date, fileDelta)
+			recordsPerFile = fileRecords(date, recordDelta, fileDelta)
+			f.Close()
+			f, cf = nil, nil
+		}
+		return data, nil
+	}
+}
+
+// openCAMx opens a CAMx file, determining whether it is in
+// NetCDF or UAM-IV format.
+func openCAMx(f *os.File) (camxFile, error) {
+	magic := make([]byte, 3)
+	if _, err := f.ReadAt(magic, 0); err != nil {
+		return nil, err
+	}
+	if string(magic) == "CDF" || string(magic) == "\x89HD" {
+		ff, err := newNCF(f)
+		if err != nil {
+			return nil, err
+		}
+		return camxNCF{ff}, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return openUAMIV(f, fi.Size())
+}
+
+// camxNCF is a CAMx file in NetCDF format.
+type camxNCF struct {
+	ncfFile
+}
+
+func (c camxNCF) read(varName string, index int) (*sparse.DenseArray, error) {
+	return readNCF(varName, c.ncfFile, index)
+}
+
+func (c camxNCF) shape() ([]int, error) {
+	for _, v := range c.Variables() {
+		dims := c.Dimensions(v)
+		if len(dims) == 4 && dims[1] == "LAY" && dims[2] == "ROW" && dims[3] == "COL" {
+			return c.Lengths(v)[1:], nil
+		}
+	}
+	return nil, fmt.Errorf("no (TSTEP, LAY, ROW, COL) variables in file")
+}
+
+// uamiv is a CAMx file in UAM-IV format, which is a Fortran
+// unformatted sequential file.
+type uamiv struct {
+	r         io.ReaderAt
+	size      int64 // file size in bytes
+	byteOrder binary.ByteOrder
+
+	nx, ny, nz int
+	species    []string
+
+	// headerLen is the length in bytes of the file header
+	// and stepLen is the length in bytes of each time step.
+	headerLen, stepLen int64
+}
+
+const (
+	uamivNameLen = 10 // number of characters in a species name
+	uamivNoteLen = 60 // number of characters in the file note
+)
+
+// openUAMIV reads the header of a UAM-IV file.
+// size is the length of the file in bytes.
+func openUAMIV(r io.ReaderAt, size int64) (*uamiv, error) {
+	u := &uamiv{r: r, size: size}
+
+	// The first record contains the file name, the note, and the number of
+	// species, so its length identifies the byte order.
+	const rec1Len = 4*uamivNameLen + 4*uamivNoteLen + 6*4
+	marker := make([]byte, 4)
+	if _, err := r.ReadAt(marker, 0); err != nil {
+		return nil, fmt.Errorf("inmap: reading UAM-IV file: %v", err)
+	}
+	switch {
+	case binary.BigEndian.Uint32(marker) == rec1Len:
+		u.byteOrder = binary.BigEndian
+	case binary.LittleEndian.Uint32(marker) == rec1Len:
+		u.byteOrder = binary.LittleEndian
+	default:
+		return nil, fmt.Errorf("inmap: file is not in UAM-IV or NetCDF format")
+	}
+
+	var pos int64
+	rec1, err := u.record(&pos)
+	if err != nil {
+		return nil, err
+	}
+	if len(rec1) != rec1Len {
+		return nil, fmt.Errorf("inmap: reading UAM-IV file: invalid header record")
+	}
+	nspec := int(u.byteOrder.Uint32(rec1[4*(uamivNameLen+uamivNoteLen)+4:]))
+
+	rec2, err := u.record(&pos)
+	if err != nil {
+		return nil, err
+	}
+	if len(rec2) < 10*4 {
+		return nil, fmt.Errorf("inmap: reading UAM-IV file: invalid grid record")
+	}
+	u.nx = int(u.byteOrder.Uint32(rec2[7*4:]))
+	u.ny = int(u.byteOrder.Uint32(rec2[8*4:]))
+	u.nz = int(u.byteOrder.Uint32(rec2[9*4:]))
+	if u.nx <= 0 || u.ny <= 0 || u.nz <= 0 || int64(u.nx)*int64(u.ny)*4 > size {
+		return nil, fmt.Errorf("inmap: reading UAM-IV file: invalid grid dimensions %dx%dx%d", u.nx, u.ny, u.nz)
+	}
+
+	if _, err = u.record(&pos); err != nil { // segment record, unused.
+		return nil, err
+	}
+
+	rec4, err := u.record(&pos)
+	if err != nil {
+		return nil, err
+	}
+	if len(rec4) != nspec*uamivNameLen*4 {
+		return nil, fmt.Errorf("inmap: reading UAM-IV file: invalid species record")
+	}
+	u.species = make([]string, nspec)
+	for i := range u.species {
+		u.species[i] = u.decodeName(rec4[i*uamivNameLen*4 : (i+1)*uamivNameLen*4])
+	}
+	u.headerLen = pos
+
+	// Each time step has a time record followed by one record per species
+	// and layer with the species name and the concentrations.
+	const timeRecLen = 4 + 4*4 + 4
+	concRecLen := int64(4 + 4 + uamivNameLen*4 + 4*u.nx*u.ny + 4)
+	u.stepLen = timeRecLen + int64(nspec*u.nz)*concRecLen
+	return u, nil
+}
+
+// record reads the Fortran record starting at *pos and advances *pos to the
+// beginning of the next record.
+func (u *uamiv) record(pos *int64) ([]byte, error) {
+	marker := make([]byte, 4)
+	if _, err := u.r.ReadAt(marker, *pos); err != nil {
+		return nil, fmt.Errorf("inmap: reading UAM-IV file: %v", err)
+	}
+	n := int64(u.byteOrder.Uint32(marker))
+	if *pos+n+8 > u.size {
+		return nil, fmt.Errorf("inmap: reading UAM-IV file: record at byte %d extends past end of file", *pos)
+	}
+	b := make([]byte, n+4)
+	if _, err := u.r.ReadAt(b, *pos+4); err != nil {
+		return nil, fmt.Errorf("inmap: reading UAM-IV file: %v", err)
+	}
+	if !bytes.Equal(b[n:], marker) {
+		return nil, fmt.Errorf("inmap: reading UAM-IV file: mismatched record markers")
+	}
+	*pos += n + 8
+	return b[:n], nil
+}
+
+// decodeName converts a name stored as one character per 4-byte word
+// into a string.
+func (u *uamiv) decodeName(b []byte) string {
+	var name []byte
+	for i := 0; i < len(b); i += 4 {
+		c := byte(u.byteOrder.Uint32(b[i:]))
+		if c != 0 && c != ' ' {
+			name = append(name, c)
+		}
+	}
+	return string(name)
+}
+
+func (u *uamiv) read(varName string, index int) (*sparse.DenseArray, error) {
+	s := -1
+	for i, n := range u.species {
+		if n == varName {
+			s = i
+			break
+		}
+	}
+	if s < 0 {
+		return nil, fmt.Errorf("inmap: preprocessor read UAM-IV: variable %v not in file", varName)
+	}
+	pos := u.headerLen + int64(index)*u.stepLen
+	if pos >= u.size {
+		return nil, fmt.Errorf("inmap: preprocessor read UAM-IV variable %s: time step %d not in file", varName, index)
+	}
+	if _, err := u.record(&pos); err != nil { // time record
+		return nil, err
+	}
+	concRecLen := u.stepLen - (4 + 4*4 + 4)
+	concRecLen /= int64(len(u.species) * u.nz)
+	pos += int64(s*u.nz) * concRecLen
+
+	data := sparse.ZerosDense(u.nz, u.ny, u.nx)
+	n := u.nx * u.ny
+	for k := 0; k < u.nz; k++ {
+		rec, err := u.record(&pos)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: preprocessor read UAM-IV variable %s: %v", varName, err)
+		}
+		if len(rec) != 4+uamivNameLen*4+4*n {
+			return nil, fmt.Errorf("inmap: preprocessor read UAM-IV variable %s: record length %d does not match grid size %dx%d",
+				varName, len(rec), u.nx, u.ny)
+		}
+		if name := u.decodeName(rec[4 : 4+uamivNameLen*4]); name != varName {
+			return nil, fmt.Errorf("inmap: preprocessor read UAM-IV: expected variable %s but found %s", varName, name)
+		}
+		vals := rec[4+uamivNameLen*4:]
+		for i := 0; i < n; i++ {
+			data.Elements[k*n+i] = float64(math.Float32frombits(u.byteOrder.Uint32(vals[i*4:])))
+		}
+	}
+	return data, nil
+}
+
+func (u *uamiv) shape() ([]int, error) {
+	return []int{u.nz, u.ny, u.nx}, nil
+}
@@ -0,0 +1,224 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ctessum/cdf"
+)
+
+// camxTestValue returns the value of the test data at the given
+// time step, species, and index.
+func camxTestValue(t, s, i int) float32 {
+	return float32(t*1000 + s*100 + i)
+}
+
+// writeUAMIV writes a test UAM-IV file with the given byte order.
+func writeUAMIV(byteOrder binary.ByteOrder, species []string, nsteps, nz, ny, nx int) []byte {
+	buf := new(bytes.Buffer)
+	record := func(vals ...interface{}) {
+		rec := new(bytes.Buffer)
+		for _, v := range vals {
+			binary.Write(rec, byteOrder, v)
+		}
+		binary.Write(buf, byteOrder, int32(rec.Len()))
+		buf.Write(rec.Bytes())
+		binary.Write(buf, byteOrder, int32(rec.Len()))
+	}
+	name := func(s string, n int) []int32 {
+		o := make([]int32, n)
+		for i := range o {
+			o[i] = ' '
+			if i < len(s) {
+				o[i] = int32(s[i])
+			}
+		}
+		return o
+	}
+	record(name("AVERAGE", uamivNameLen), name("test", uamivNoteLen), int32(1),
+		int32(len(species)), int32(16001), float32(0), int32(16001), float32(nsteps))
+	record(float32(0), float32(0), int32(0), float32(0), float32(0), float32(1000), float32(1000),
+		int32(nx), int32(ny), int32(nz), int32(0), int32(0), float32(0), float32(0), float32(0))
+	record(int32(1), int32(1), int32(nx), int32(ny))
+	var names []int32
+	for _, s := range species {
+		names = append(names, name(s, uamivNameLen)...)
+	}
+	record(names)
+	for t := 0; t < nsteps; t++ {
+		record(int32(16001), float32(t), int32(16001), float32(t+1))
+		for s, sp := range species {
+			for k := 0; k < nz; k++ {
+				vals := make([]float32, nx*ny)
+				for i := range vals {
+					vals[i] = camxTestValue(t, s, k*nx*ny+i)
+				}
+				record(int32(1), name(sp, uamivNameLen), vals)
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// writeCAMxNCF writes a test CAMx average file in NetCDF format.
+func writeCAMxNCF(f *os.File, species []string, nsteps, nz, ny, nx int) error {
+	h := cdf.NewHeader([]string{"TSTEP", "LAY", "ROW", "COL"}, []int{0, nz, ny, nx})
+	for _, s := range species {
+		h.AddVariable(s, []string{"TSTEP", "LAY", "ROW", "COL"}, []float32{0})
+	}
+	h.Define()
+	ff, err := cdf.Create(f, h)
+	if err != nil {
+		return err
+	}
+	n := nz * ny * nx
+	for s, sp := range species {
+		vals := make([]float32, nsteps*n)
+		for t := 0; t < nsteps; t++ {
+			for i := 0; i < n; i++ {
+				vals[t*n+i] = camxTestValue(t, s, i)
+			}
+		}
+		w := ff.Writer(sp, []int{0, 0, 0, 0}, []int{nsteps, nz, ny, nx})
+		if _, err := w.Write(vals); err != nil {
+			return err
+		}
+	}
+	return cdf.UpdateNumRecs(f)
+}
+
+func TestCAMxRead(t *testing.T) {
+	const nsteps, nz, ny, nx = 2, 2, 3, 4
+	species := []string{"NO2", "PSO4"}
+	dir, err := os.MkdirTemp("", "camx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]func(string) error{
+		"uamiv_big": func(path string) error {
+			return os.WriteFile(path, writeUAMIV(binary.BigEndian, species, nsteps, nz, ny, nx), 0644)
+		},
+		"uamiv_little": func(path string) error {
+			return os.WriteFile(path, writeUAMIV(binary.LittleEndian, species, nsteps, nz, ny, nx), 0644)
+		},
+		"netcdf": func(path string) error {
+			f, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return writeCAMxNCF(f, species, nsteps, nz, ny, nx)
+		},
+	}
+	for format, write := range files {
+		t.Run(format, func(t *testing.T) {
+			if err := write(filepath.Join(dir, format+".20160101")); err != nil {
+				t.Fatal(err)
+			}
+			start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+			f := nextDataCAMx(filepath.Join(dir, format+".[DATE]"), "PSO4", start, start.Add(2*time.Hour),
+				time.Hour, 2*time.Hour, nil)
+			for step := 0; step < nsteps; step++ {
+				data, err := f()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(data.Shape, []int{nz, ny, nx}) {
+					t.Fatalf("shape: have %v, want %v", data.Shape, []int{nz, ny, nx})
+				}
+				for i, v := range data.Elements {
+					if want := float64(camxTestValue(step, 1, i)); v != want {
+						t.Fatalf("step %d index %d: have %g, want %g", step, i, v, want)
+					}
+				}
+			}
+			if _, err := f(); err != io.EOF {
+				t.Errorf("expected io.EOF, got %v", err)
+			}
+			f = nextDataCAMx(filepath.Join(dir, format+".[DATE]"), "XXX", start, start.Add(2*time.Hour),
+				time.Hour, 2*time.Hour, nil)
+			if _, err := f(); err == nil {
+				t.Errorf("expected an error for a missing variable")
+			}
+		})
+	}
+}
+
+func TestPpmvToUgKg(t *testing.T) {
+	// 1 ppmv of a species with the molecular weight of air is 1 mg/kg.
+	if v := ppmvToUgKg(MWa); different(v, 1000, 1.e-10) {
+		t.Errorf("have %g, want 1000", v)
+	}
+}
+
+func TestCAMxMalformed(t *testing.T) {
+	const nsteps, nz, ny, nx = 1, 2, 3, 4
+	b := writeUAMIV(binary.BigEndian, []string{"NO2"}, nsteps, nz, ny, nx)
+	dir, err := os.MkdirTemp("", "camx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, data := range map[string][]byte{
+		"truncated": b[:len(b)-10],
+		"hdf5":      append([]byte("\x89HDF\r\n\x1a\n"), b...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := os.WriteFile(filepath.Join(dir, name+".20160101"), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			f := nextDataCAMx(filepath.Join(dir, name+".[DATE]"), "NO2", start, start.Add(time.Hour),
+				time.Hour, time.Hour, nil)
+			if _, err := f(); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestCAMxGridMismatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "camx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The WRF test files have 10 layers, 2 rows, and 2 columns.
+	b := writeUAMIV(binary.BigEndian, []string{"NO2"}, 1, 10, 2, 3)
+	if err := os.WriteFile(filepath.Join(dir, "camx.20050101"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewCAMx(filepath.Join(dir, "camx.[DATE]"),
+		"cmd/inmap/testdata/preproc/wrfout_d01_[DATE]_00_00_00", "20050101", "20050103", nil)
+	if err == nil || !strings.Contains(err.Error(), "grids must match") {
+		t.Errorf("expected an error for mismatched grids, got %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"unsafe"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+const (
+	// minSlabArrays and maxSlabArrays are the minimum and maximum
+	// number of arrays in each block of a floatSlab. The blocks double
+	// in size from the minimum to the maximum as the grid grows, so that
+	// small grids don't use much more memory than they need.
+	minSlabArrays = 256
+	maxSlabArrays = 1 << 16
+
+	// minCellBlock and maxCellBlock are the minimum and maximum number
+	// of cells in each block of cells allocated by a cellStore.
+	minCellBlock = 64
+	maxCellBlock = 4096
+)
+
+// cellStore holds the grid cells and their concentration arrays (Ci, Cf,
+// and CBaseline) in large contiguous blocks of memory rather than
+// as separate heap objects, which greatly reduces the number of objects
+// the garbage collector has to keep track of in grids with millions of
+// cells. If dir is not empty, the blocks of concentrations are
+// memory-mapped from files in dir rather than allocated on the heap, so
+// that the operating system can page them out when the grid is larger
+// than the available memory. The blocks of cells are always on the heap
+// because cells contain pointers, which the garbage collector must be
+// able to find.
+type cellStore struct {
+	dir string
+
+	mu       sync.Mutex
+	slabs    map[int]*floatSlab // The slabs for each array length.
+	err      error              // The first error that occurred in store.
+	unmapped bool               // Whether unmap has released the blocks.
+
+	nextCells []Cell  // The unused part of the newest block of cells.
+	freeCells []*Cell // Cells that have been released and can be reused.
+	cellBlock int     // The size of the newest block of cells.
+}
+
+// floatSlab allocates float64 arrays of length n from blocks of memory.
+type floatSlab struct {
+	n      int
+	next   []float64   // The unused part of the newest block.
+	free   [][]float64 // Arrays that have been released and can be reused.
+	blocks []*slabBlock
+}
+
+// slabBlock is a block of memory that arrays are allocated from.
+type slabBlock struct {
+	data []float64
+	m    mmap.MMap // m is nil if the block is on the heap.
+	name string    // name is the file to delete when the block is released.
+}
+
+// begin and end return the bounds of the memory of b.
+func (b *slabBlock) begin() uintptr { return uintptr(unsafe.Pointer(&b.data[0])) }
+func (b *slabBlock) end() uintptr   { return b.begin() + uintptr(len(b.data))*8 }
+
+// store moves the concentration arrays of c into s, if they are not
+// already there. If there is a problem allocating the memory, the arrays
+// are left where they are and the error is returned by s.error.
+func (s *cellStore) store(c *Cell) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range []*[]float64{&c.Ci, &c.Cf, &c.CBaseline} {
+		if len(*a) == 0 || s.owns(*a) {
+			continue
+		}
+		v, err := s.alloc(len(*a))
+		if err != nil {
+			if s.err == nil {
+				s.err = err
+			}
+			return
+		}
+		copy(v, *a)
+		*a = v
+	}
+}
+
+// newCell returns a new, empty cell from the blocks of cells in s.
+func (s *cellStore) newCell() *Cell {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.freeCells) > 0 {
+		c := s.freeCells[len(s.freeCells)-1]
+		s.freeCells = s.freeCells[:len(s.freeCells)-1]
+		c.inStore = true
+		return c
+	}
+	if len(s.nextCells) == 0 {
+		switch {
+		case s.cellBlock == 0:
+			s.cellBlock = minCellBlock
+		case s.cellBlock < maxCellBlock:
+			s.cellBlock *= 2
+		}
+		s.nextCells = make([]Cell, s.cellBlock)
+	}
+	c := &s.nextCells[0]
+	s.nextCells = s.nextCells[1:]
+	c.inStore = true
+	return c
+}
+
+// error returns the first error that occurred while storing cells.
+func (s *cellStore) error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// available returns an error if the concentration arrays are no longer
+// available because they were in memory-mapped blocks that have been
+// released by unmap.
+func (s *cellStore) available() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unmapped {
+		return fmt.Errorf("inmap: the concentrations are not available after Cleanup when CellStorageDir is set")
+	}
+	return nil
+}
+
+// release makes the concentration arrays of c, and c itself if it was
+// allocated by newCell, available to be reused by other cells. c should
+// not be used afterwards.
+func (s *cellStore) release(c *Cell) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range []*[]float64{&c.Ci, &c.Cf, &c.CBaseline} {
+		if len(*a) == 0 || !s.owns(*a) {
+			continue
+		}
+		slab := s.slabs[len(*a)]
+		slab.free = append(slab.free, *a)
+		*a = nil
+	}
+	if c.inStore {
+		*c = Cell{} // Don't keep the cell's data alive.
+		s.freeCells = append(s.freeCells, c)
+	}
+}
+
+// owns returns whether s allocated a.
+func (s *cellStore) owns(a []float64) bool {
+	slab, ok := s.slabs[len(a)]
+	if !ok {
+		return false
+	}
+	p := uintptr(unsafe.Pointer(&a[0]))
+	i := sort.Search(len(slab.blocks), func(i int) bool {
+		return slab.blocks[i].end() > p
+	})
+	return i < len(slab.blocks) && slab.blocks[i].begin() <= p
+}
+
+// alloc returns a zeroed array of length n.
+func (s *cellStore) alloc(n int) ([]float64, error) {
+	if s.slabs == nil {
+		s.slabs = make(map[int]*floatSlab)
+	}
+	slab, ok := s.slabs[n]
+	if !ok {
+		slab = &floatSlab{n: n}
+		s.slabs[n] = slab
+	}
+	if len(slab.free) > 0 {
+		a := slab.free[len(slab.free)-1]
+		slab.free = slab.free[:len(slab.free)-1]
+		for i := range a {
+			a[i] = 0
+		}
+		return a, nil
+	}
+	if len(slab.next) < n {
+		narrays := minSlabArrays
+		if len(slab.blocks) > 0 {
+			narrays = 2 * len(slab.blocks[len(slab.blocks)-1].data) / n
+		}
+		if narrays > maxSlabArrays {
+			narrays = maxSlabArrays
+		}
+		b, err := s.newBlock(narrays * n)
+		if err != nil {
+			return nil, err
+		}
+		// Keep the blocks sorted by address so owns can search them.
+		i := sort.Search(len(slab.blocks), func(i int) bool {
+			return slab.blocks[i].begin() > b.begin()
+		})
+		slab.blocks = append(slab.blocks, nil)
+		copy(slab.blocks[i+1:], slab.blocks[i:])
+		slab.blocks[i] = b
+		slab.next = b.data
+	}
+	a := slab.next[:n:n]
+	slab.next = slab.next[n:]
+	return a, nil
+}
+
+// newBlock allocates a block of n float64 values.
+func (s *cellStore) newBlock(n int) (*slabBlock, error) {
+	if s.dir == "" {
+		return &slabBlock{data: make([]float64, n)}, nil
+	}
+	f, err := os.CreateTemp(s.dir, "inmapcells")
+	if err != nil {
+		return nil, fmt.Errorf("inmap: creating cell storage: %v", err)
+	}
+	defer f.Close()
+	if err = f.Truncate(int64(n) * 8); err != nil {
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("inmap: creating cell storage: %v", err)
+	}
+	m, err := mmap.Map(f, mmap.RDWR, 0)
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("inmap: creating cell storage: %v", err)
+	}
+	b := &slabBlock{
+		// The mapping is page-aligned, so it can hold float64 values.
+		data: unsafe.Slice((*float64)(unsafe.Pointer(&m[0])), n),
+		m:    m,
+	}
+	// On most systems the file can be deleted now and its space will be
+	// reclaimed when it is unmapped. Otherwise, it is deleted by unmap.
+	if err := os.Remove(f.Name()); err != nil {
+		b.name = f.Name()
+	}
+	return b, nil
+}
+
+// unmap releases the memory-mapped blocks of s and sets the concentration
+// arrays of the given cells that are stored in them to nil, so that they
+// can't be used afterwards. Blocks on the heap are left to the garbage
+// collector.
+func (s *cellStore) unmap(cells ...*cellList) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir == "" {
+		return nil
+	}
+	s.unmapped = true
+	for _, l := range cells {
+		for _, c := range *l {
+			for _, a := range []*[]float64{&c.Ci, &c.Cf, &c.CBaseline} {
+				if len(*a) != 0 && s.owns(*a) {
+					*a = nil
+				}
+			}
+		}
+	}
+	var err error
+	for _, slab := range s.slabs {
+		for _, b := range slab.blocks {
+			if err2 := b.m.Unmap(); err2 != nil && err == nil {
+				err = fmt.Errorf("inmap: releasing cell storage: %v", err2)
+			}
+			if b.name != "" {
+				if err2 := os.Remove(b.name); err2 != nil && err == nil {
+					err = fmt.Errorf("inmap: releasing cell storage: %v", err2)
+				}
+			}
+		}
+	}
+	s.slabs = nil
+	return err
+}
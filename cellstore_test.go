@@ -0,0 +1,137 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"github.com/ctessum/geom"
+)
+
+// TestCellStorageDir checks that storing the cell concentrations in
+// memory-mapped files gives the same results as storing them in memory,
+// including when the grid changes during the simulation.
+func TestCellStorageDir(t *testing.T) {
+	const E = 1000000. // emissions [μg/s]
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		SOx:  E,
+		NOx:  E,
+		PM25: E,
+		VOC:  E,
+		NH3:  E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	})
+	popConcMutator := NewPopConcMutator(cfg, popIndices)
+	m := Mech{}
+
+	run := func(dir string) (*InMAP, [][]float64) {
+		var conc [][]float64
+		d := &InMAP{
+			InitFuncs: []DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+				SetTimestepCFL(),
+			},
+			RunFuncs: []DomainManipulator{
+				Calculations(AddEmissionsFlux()),
+				Calculations(
+					UpwindAdvection(),
+					Mixing(),
+					m.Chemistry(),
+				),
+				RunPeriodically(3600,
+					cfg.MutateGrid(popConcMutator.Mutate(), ctmdata, pop, mr, emis, m, nil)),
+				RunPeriodically(3600, SetTimestepCFL()),
+				SteadyStateConvergenceCheck(-1, cfg.PopGridColumn, m, nil),
+			},
+			CleanupFuncs: []DomainManipulator{
+				func(d *InMAP) error {
+					for _, c := range d.Cells() {
+						conc = append(conc, append([]float64{}, c.Cf...))
+					}
+					return nil
+				},
+			},
+			Deterministic:  true,
+			CellStorageDir: dir,
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Cleanup(); err != nil {
+			t.Fatal(err)
+		}
+		return d, conc
+	}
+
+	_, want := run("")
+	dir := t.TempDir()
+	d, have := run(dir)
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("concentrations in storage directory %v don't match concentrations in memory %v", have, want)
+	}
+	if files, err := os.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 0 {
+		t.Errorf("storage directory should be empty after cleanup but has %d files", len(files))
+	}
+	for _, c := range d.Cells() {
+		if c.Cf != nil {
+			t.Fatal("concentrations should not be available after cleanup")
+		}
+	}
+	o, err := NewOutputter("", false, map[string]string{"TotalPM25": "TotalPM25"}, nil, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Results(o); err == nil {
+		t.Error("results should not be available after cleanup")
+	}
+}
+
+// TestCellStoreCells checks that cells are allocated contiguously and
+// that released cells are emptied and reused.
+func TestCellStoreCells(t *testing.T) {
+	var s cellStore
+	c1, c2 := s.newCell(), s.newCell()
+	if uintptr(unsafe.Pointer(c2))-uintptr(unsafe.Pointer(c1)) != unsafe.Sizeof(Cell{}) {
+		t.Error("cells should be allocated contiguously")
+	}
+	c1.Layer = 3
+	c1.Ci = make([]float64, 9)
+	s.release(c1)
+	if c3 := s.newCell(); c3 != c1 {
+		t.Error("released cell should be reused")
+	} else if c3.Layer != 0 || c3.Ci != nil {
+		t.Errorf("reused cell should be empty but is %+v", c3)
+	}
+
+	// Cells that were not allocated by the store are not reused.
+	s.release(&Cell{})
+	if len(s.freeCells) != 0 {
+		t.Errorf("have %d free cells, want 0", len(s.freeCells))
+	}
+}
@@ -36,7 +36,7 @@ func readBlob(ctx context.Context, bucket *blob.Bucket, key string) ([]byte, err
 	var b bytes.Buffer
 	r, err := bucket.NewReader(ctx, key, nil)
 	if err != nil {
-		return nil, fmt.Errorf("reading blob key %s: %v", key, err)
+		return nil, fmt.Errorf("reading blob key %s: %w", key, err)
 	}
 	defer r.Close()
 	_, err = io.Copy(&b, r)
@@ -64,7 +64,8 @@ func writeBlob(ctx context.Context, bucket *blob.Bucket, key string, data []byte
 }
 
 // deleteBlobDir deletes all blobs in the the specified directory
-// of the specified bucket
+// of the specified bucket, including the blobs in subdirectories
+// such as the ones that hold the output of the tasks of work queue jobs.
 func deleteBlobDir(ctx context.Context, bucketName, user, jobName string) error {
 	bucket, err := OpenBucket(ctx, bucketName)
 	if err != nil {
@@ -76,10 +77,9 @@ func deleteBlobDir(ctx context.Context, bucketName, user, jobName string) error
 		return fmt.Errorf("cloud: parsing bucket name: %v", err)
 	}
 
-	prefix := fmt.Sprintf("%s/%s/%s/", strings.TrimLeft(url.Path, "/"), user, jobName)
+	prefix := strings.TrimLeft(fmt.Sprintf("%s/%s/%s/", url.Path, user, jobName), "/")
 	iter := bucket.List(&blob.ListOptions{
-		Prefix:    prefix,
-		Delimiter: "/",
+		Prefix: prefix,
 	})
 	for {
 		obj, err := iter.Next(ctx)
@@ -87,7 +87,7 @@ func deleteBlobDir(ctx context.Context, bucketName, user, jobName string) error
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("cloud: listing blob %s to delete: %v", obj.Key, err)
+			return fmt.Errorf("cloud: listing blobs in %s to delete: %v", prefix, err)
 		}
 		if err = bucket.Delete(ctx, obj.Key); err != nil {
 			return fmt.Errorf("cloud: deleting blob %s: %v", obj.Key, err)
@@ -96,7 +96,9 @@ func deleteBlobDir(ctx context.Context, bucketName, user, jobName string) error
 	return nil
 }
 
-// Output returns the output of the specified job.
+// Output returns the output of the specified job. If the job name is in
+// the format "queueName/taskName", the output of the given task of a work
+// queue job (see Queue) is returned once the task is complete.
 func (c *Client) Output(ctx context.Context, job *cloudrpc.JobName) (*cloudrpc.JobOutput, error) {
 	bucket, err := OpenBucket(ctx, c.bucketName)
 	if err != nil {
@@ -105,11 +107,26 @@ func (c *Client) Output(ctx context.Context, job *cloudrpc.JobName) (*cloudrpc.J
 	o := &cloudrpc.JobOutput{
 		Files: make(map[string][]byte),
 	}
-	k8sJob, err := c.getk8sJob(ctx, job)
-	if err != nil {
-		return nil, err
+	var cmd, args []string
+	if queueName, taskName, ok := splitTaskName(job.Name); ok {
+		t, s, retries, err := c.queueTask(ctx, bucket, queueName, taskName)
+		if err != nil {
+			return nil, err
+		}
+		if status := s.status(retries); status.Status == cloudrpc.Status_Failed {
+			return nil, fmt.Errorf("cloud: task %s has failed: %s", job.Name, status.Message)
+		} else if status.Status != cloudrpc.Status_Complete {
+			return nil, fmt.Errorf("cloud: task %s is not complete; its status is %s", job.Name, status.Status)
+		}
+		cmd, args = t.Cmd, t.Args
+	} else {
+		k8sJob, err := c.getk8sJob(ctx, job)
+		if err != nil {
+			return nil, err
+		}
+		cmd, args = k8sJob.Spec.Template.Spec.Containers[0].Command, k8sJob.Spec.Template.Spec.Containers[0].Args
 	}
-	addrs, err := c.jobOutputAddresses(ctx, job.Name, k8sJob.Spec.Template.Spec.Containers[0].Command)
+	addrs, err := c.jobOutputAddresses(ctx, job.Name, cmd, args)
 	if err != nil {
 		return nil, err
 	}
@@ -21,6 +21,7 @@ package cloud
 import (
 	"context"
 	"fmt"
+	"net"
 	"strings"
 
 	"github.com/improbable-eng/grpc-web/go/grpcweb"
@@ -37,6 +38,13 @@ import (
 )
 
 // Client is a Kubernetes client for InMAP.
+//
+// Each simulation is run as a Kubernetes Job that is created and
+// monitored through the CloudRPC service, and its output files are written
+// to the storage bucket. Large numbers of simulations, such as the ones
+// that make up a source-receptor matrix (see sr.SR.Start), are instead run
+// as the tasks of a single work queue job (see Queue). Failed simulations
+// can be retried and can run on spot nodes (see Retries and Spot).
 type Client struct {
 	*grpcweb.WrappedGrpcServer
 
@@ -61,6 +69,29 @@ type Client struct {
 	// Each volume will be mounted at /data/volumeName
 	// with read-only access.
 	Volumes []core.Volume
+
+	// Retries is the number of times a failed simulation is retried
+	// before its job is marked as failed. If it is nil, the Kubernetes
+	// default is used.
+	Retries *int32
+
+	// Spot specifies whether simulations are allowed to run on spot
+	// (preemptible) nodes. Spot nodes are preferred when they are
+	// available. Simulations that are interrupted when a node is reclaimed
+	// are restarted by the job controller, and the results are only
+	// written to the storage bucket after a simulation completes, so
+	// interrupted simulations do not leave partial output behind.
+	Spot bool
+}
+
+// spotNodeLabels holds the node labels (and their values) that are used
+// by cloud providers to mark spot and preemptible nodes. Some providers
+// also taint spot nodes with the same keys.
+var spotNodeLabels = []struct{ key, value string }{
+	{key: "cloud.google.com/gke-spot", value: "true"},
+	{key: "cloud.google.com/gke-preemptible", value: "true"},
+	{key: "kubernetes.azure.com/scalesetpriority", value: "spot"},
+	{key: "eks.amazonaws.com/capacityType", value: "SPOT"},
 }
 
 // NewClient creates a new distributed InMAP Kubernetes client.
@@ -94,6 +125,8 @@ func NewClient(k kubernetes.Interface, root *cobra.Command, config *viper.Viper,
 // RunJob creates (and queues) a Kubernetes job with the given name that executes
 // the given command with the given command-line arguments on the given container
 // image. resources specifies the minimum required resources for execution.
+// If job is a work queue job (see Queue), its tasks are run by a number of
+// worker pods.
 func (c *Client) RunJob(ctx context.Context, job *cloudrpc.JobSpec) (*cloudrpc.JobStatus, error) {
 	status, err := c.Status(ctx, &cloudrpc.JobName{Name: job.Name, Version: job.Version})
 	if status.Status != cloudrpc.Status_Missing && err != nil {
@@ -108,6 +141,10 @@ func (c *Client) RunJob(ctx context.Context, job *cloudrpc.JobSpec) (*cloudrpc.J
 		c.Delete(ctx, &cloudrpc.JobName{Name: job.Name, Version: job.Version})
 	}
 
+	workers, err := c.stageQueue(ctx, job)
+	if err != nil {
+		return nil, err
+	}
 	if err := c.stageInputs(ctx, job); err != nil {
 		return nil, err
 	}
@@ -118,9 +155,17 @@ func (c *Client) RunJob(ctx context.Context, job *cloudrpc.JobSpec) (*cloudrpc.J
 	if err != nil {
 		return nil, err
 	}
-	k8sJob := createJob(userJobName(user, job.Name), job.Cmd, job.Args, job.Version, core.ResourceList{
+	k8sJob := c.createJob(userJobName(user, job.Name), job.Cmd, job.Args, job.Version, core.ResourceList{
 		core.ResourceMemory: resource.MustParse(fmt.Sprintf("%dGi", job.MemoryGB)),
-	}, c.Volumes)
+	})
+	if workers > 0 {
+		// Run the workers of a work queue job in parallel. Without
+		// a number of completions, the job is complete once any
+		// of the workers succeeds and the others have finished,
+		// so each worker must only exit successfully after all of
+		// the tasks have been completed or have failed.
+		k8sJob.Spec.Parallelism = &workers
+	}
 	_, err = c.jobControl.Create(ctx, k8sJob, meta.CreateOptions{})
 	if err != nil {
 		return nil, err
@@ -175,8 +220,13 @@ func userJobName(user, name string) string {
 	return strings.Replace(user, "_", "-", -1) + "-" + strings.Replace(name, "_", "-", -1)
 }
 
-// Status returns the status of the given job.
+// Status returns the status of the given job. If the job name is in the
+// format "queueName/taskName", the status of the given task of a work queue
+// job (see Queue) is returned.
 func (c *Client) Status(ctx context.Context, job *cloudrpc.JobName) (*cloudrpc.JobStatus, error) {
+	if queueName, taskName, ok := splitTaskName(job.Name); ok {
+		return c.taskStatus(ctx, queueName, taskName)
+	}
 	s := new(cloudrpc.JobStatus)
 	k8sJob, err := c.getk8sJob(ctx, job)
 	if err != nil {
@@ -193,7 +243,8 @@ func (c *Client) Status(ctx context.Context, job *cloudrpc.JobName) (*cloudrpc.J
 			s.Status = cloudrpc.Status_Complete
 			s.StartTime = k8sJob.Status.StartTime.Time.Unix()
 			s.CompletionTime = k8sJob.Status.CompletionTime.Time.Unix()
-			err := c.checkOutputs(ctx, job.Name, k8sJob.Spec.Template.Spec.Containers[0].Command)
+			err := c.checkOutputs(ctx, job.Name, k8sJob.Spec.Template.Spec.Containers[0].Command,
+				k8sJob.Spec.Template.Spec.Containers[0].Args)
 			if err != nil {
 				s.Status = cloudrpc.Status_Failed
 				s.Message = fmt.Sprintf("job completed but the following error occurred when checking outputs: %s", err)
@@ -218,12 +269,12 @@ func (c *Client) Status(ctx context.Context, job *cloudrpc.JobName) (*cloudrpc.J
 // createJob creates a Kubernetes job specification with the given name that executes the
 // given command with the given command-line arguments on the given container
 // image. resources specifies the minimum required resources for execution.
-// volumes holds the list of k8s volumes to mount, with all volumes assumed to
+// c.Volumes holds the list of k8s volumes to mount, with all volumes assumed to
 // be read-only.
 // Version is the version of the InMAP docker image to use, such as "latest" or "v1.7.2".
-func createJob(name string, command, args []string, version string, resources core.ResourceList, volumes []core.Volume) *batch.Job {
-	volumeMounts := make([]core.VolumeMount, len(volumes))
-	for i, v := range volumes {
+func (c *Client) createJob(name string, command, args []string, version string, resources core.ResourceList) *batch.Job {
+	volumeMounts := make([]core.VolumeMount, len(c.Volumes))
+	for i, v := range c.Volumes {
 		volumeMounts[i] = core.VolumeMount{
 			Name:      v.Name,
 			ReadOnly:  true,
@@ -231,6 +282,63 @@ func createJob(name string, command, args []string, version string, resources co
 		}
 	}
 
+	podSpec := core.PodSpec{
+		Containers: []core.Container{
+			{
+				Name:    "inmap-container",
+				Image:   fmt.Sprintf("inmap/inmap:%s", version),
+				Command: command,
+				Args:    args,
+				Resources: core.ResourceRequirements{
+					Requests: resources,
+				},
+				VolumeMounts: volumeMounts,
+			},
+		},
+		Volumes:       c.Volumes,
+		RestartPolicy: core.RestartPolicyOnFailure,
+	}
+	if c.Spot {
+		var preferred []core.PreferredSchedulingTerm
+		for _, l := range spotNodeLabels {
+			podSpec.Tolerations = append(podSpec.Tolerations, core.Toleration{
+				Key:      l.key,
+				Operator: core.TolerationOpExists,
+				Effect:   core.TaintEffectNoSchedule,
+			})
+			preferred = append(preferred, core.PreferredSchedulingTerm{
+				Weight: 1,
+				Preference: core.NodeSelectorTerm{
+					MatchExpressions: []core.NodeSelectorRequirement{{
+						Key:      l.key,
+						Operator: core.NodeSelectorOpIn,
+						Values:   []string{l.value},
+					}},
+				},
+			})
+		}
+		podSpec.Affinity = &core.Affinity{
+			NodeAffinity: &core.NodeAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: preferred,
+			},
+		}
+	}
+
+	// Allow Prometheus to discover and scrape the metrics of the job
+	// if they are being served.
+	var annotations map[string]string
+	for _, a := range args {
+		if addr := strings.TrimPrefix(a, "--Metrics.Address="); addr != a && addr != "" {
+			if _, port, err := net.SplitHostPort(addr); err == nil {
+				annotations = map[string]string{
+					"prometheus.io/scrape": "true",
+					"prometheus.io/port":   port,
+					"prometheus.io/path":   "/metrics",
+				}
+			}
+		}
+	}
+
 	return &batch.Job{
 		TypeMeta: meta.TypeMeta{
 			Kind:       "Job",
@@ -240,27 +348,14 @@ func createJob(name string, command, args []string, version string, resources co
 			Name: name,
 		},
 		Spec: batch.JobSpec{
+			BackoffLimit: c.Retries,
 			Template: core.PodTemplateSpec{
 				ObjectMeta: meta.ObjectMeta{
-					Name:   name + "_pod",
-					Labels: map[string]string{"app": "inmap-distributed"},
-				},
-				Spec: core.PodSpec{
-					Containers: []core.Container{
-						{
-							Name:    "inmap-container",
-							Image:   fmt.Sprintf("inmap/inmap:%s", version),
-							Command: command,
-							Args:    args,
-							Resources: core.ResourceRequirements{
-								Requests: resources,
-							},
-							VolumeMounts: volumeMounts,
-						},
-					},
-					Volumes:       volumes,
-					RestartPolicy: core.RestartPolicyOnFailure,
+					Name:        name + "_pod",
+					Labels:      map[string]string{"app": "inmap-distributed"},
+					Annotations: annotations,
 				},
+				Spec: podSpec,
 			},
 		},
 	}
@@ -41,30 +41,97 @@ func init() {
 func TestClient_fake(t *testing.T) {
 	checkConfig := func(cmd []string) {
 		wantCmd := []string{"inmap", "run", "steady",
+			"--Acceleration=",
+			"--Advection=upwind",
+			"--AgeGroupHazardRatio=Krewski2009Ecologic(PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA)",
+			"--Aggregation.File=",
+			"--Aggregation.IDColumn=GEOID",
+			"--Aggregation.OutputFile=",
+			"--Aggregation.Weight=area",
+			"--AndersonDepth=5",
+			"--Backend=cpu",
+			"--BoundaryData=",
+			"--BudgetFile=",
+			"--CTMDataCacheDir=",
+			"--CellStorageDir=",
+			"--CheckpointFile=",
+			"--CheckpointInterval=1h",
+			"--ColumnOutputFile=",
+			"--ConvergenceCriterion=mass",
+			"--ConvergenceTolerance=0.001",
+			"--Dashboard.Address=",
+			"--Disparity.Epsilon=-0.5",
+			"--Disparity.Groups={}\n",
+			"--Disparity.Rank=",
+			"--Disparity.Reference=TotalPop",
+			"--Disparity.Variable=PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA",
+			"--DryRun.CellsPerSecond=100000",
+			"--DryRun.Iterations=1000",
 			"--EmissionMaskGeoJSON=",
 			"--EmissionUnits=tons/year",
-			"--EmissionsShapefiles=file://test/test/test_user/test_job/258bbcefe8c0073d6f323351463be9e9685e74bb92e367ca769b9536ed247213.shp",
+			"--EmissionsShapefiles=file://test/test/test_user/test_job/ca616f6d93abb72322a2bec3cc62e48e7e4a0ed23c22302c5a88d416549d355b.shp",
+			"--HealthFunctions={}\n",
 			"--InMAPData=file://test/test/test_user/test_job/434bf26e3fda1ef9cef7e1fa6cc6b5174d11a22b19cbe10d256adc83b2a97d44.ncf",
+			"--InMAPDataPeriods=",
+			"--Infiltration.DefaultFactor=1",
+			"--Infiltration.FactorColumn=Finf",
+			"--Infiltration.File=",
+			"--Infiltration.IndoorFraction=0.9",
+			"--Infiltration.OutputFile=",
 			"--LogFile=file://test/test/test_user/test_job/LogFile",
+			"--LogFormat=text",
+			"--LogLevel=info",
+			"--ManifestFile=",
+			"--Metrics.Address=",
+			"--Mobility.CrosswalkFile=",
+			"--Mobility.ODFile=",
+			"--Mobility.OutputFile=",
+			"--Mobility.PopColumn=TotalPop",
+			"--Mobility.WorkFraction=0.24",
+			"--NearRoadWidth=0",
 			"--NumIterations=0",
 			"--OutputFile=file://test/test/test_user/test_job/OutputFile.shp",
 			"--OutputVariables={\"TotalPM25\":\"PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA\",\"TotalPopD\":\"(exp(log(1.078)/10 * TotalPM25) - 1) * TotalPop * AllCause / 100000\"}\n",
-			"--VarGrid.CensusFile=file://test/test/test_user/test_job/72f6717ef5f6f9600378fe5b192776ba142b3e93311c3dfd0b67bfecbe399990.shp",
+			"--PlumeInGridDistance=0",
+			"--ReceptorFile=",
+			"--ReceptorOutputFile=",
+			"--RelaxationFactor=1.5",
+			"--Valuation.BaseIncome=0",
+			"--Valuation.Damages={}\n",
+			"--Valuation.DiscountRate=0.03",
+			"--Valuation.IncomeElasticity=0.4",
+			"--Valuation.VSL=7.4e+06",
+			"--VarGrid.AgeGroups={}\n",
+			"--VarGrid.CensusFile=file://test/test/test_user/test_job/c3bd73b90e0a7469be79e73e0069422bc0b9619275d790dec79d67a6da1a90f1.shp",
 			"--VarGrid.CensusPopColumns=TotalPop,WhiteNoLat,Black,Native,Asian,Latino",
+			"--VarGrid.CountryFile=", "--VarGrid.CountryIDColumn=ISO_A3", "--VarGrid.CountryMortalityFile=",
+			"--VarGrid.EmisDensityThreshold=0",
+			"--VarGrid.GradientColumn=", "--VarGrid.GradientFile=", "--VarGrid.GradientThreshold=0",
 			"--VarGrid.GridProj=+proj=lcc +lat_1=33.000000 +lat_2=45.000000 +lat_0=40.000000 +lon_0=-97.000000 +x_0=0 +y_0=0 +a=6370997.000000 +b=6370997.000000 +to_meter=1",
 			"--VarGrid.HiResLayers=1",
+			"--VarGrid.ImportanceColumn=", "--VarGrid.ImportanceFile=", "--VarGrid.ImportanceThreshold=0",
+			"--VarGrid.IncomeColumn=",
+			"--VarGrid.LandUseCategories=", "--VarGrid.LandUseColumn=", "--VarGrid.LandUseFile=",
+			"--VarGrid.MorbidityEndpoints={}\n",
 			"--VarGrid.MortalityRateColumns={\"AllCause\":\"TotalPop\",\"AsianMort\":\"Asian\",\"BlackMort\":\"Black\",\"LatinoMort\":\"Latino\",\"NativeMort\":\"Native\",\"WhNoLMort\":\"WhiteNoLat\"}\n",
-			"--VarGrid.MortalityRateFile=file://test/test/test_user/test_job/764874ad5081665459c67d40607f68df6fc689aa695b4822e012aef84cba5394.shp",
+			"--VarGrid.MortalityRateFile=file://test/test/test_user/test_job/db5394e880433178d28455d91841fb940f2e1aa1563f63345cb9e555a01e0b0d.shp",
 			"--VarGrid.PopConcThreshold=1e-09", "--VarGrid.PopDensityThreshold=0.0055",
-			"--VarGrid.PopGridColumn=TotalPop", "--VarGrid.PopThreshold=40000", "--VarGrid.VariableGridDx=4000",
+			"--VarGrid.PopGridColumn=TotalPop", "--VarGrid.PopThreshold=40000",
+			"--VarGrid.PopulationRasters={}\n",
+			"--VarGrid.ProjectionFile=", "--VarGrid.ProjectionIDColumn=GEOID", "--VarGrid.ProjectionRegionFile=", "--VarGrid.ProjectionYear=0",
+			"--VarGrid.RefinementCriteria=population", "--VarGrid.VariableGridDx=4000",
 			"--VarGrid.VariableGridDy=4000", "--VarGrid.VariableGridXo=-4000", "--VarGrid.VariableGridYo=-4000",
 			"--VarGrid.Xnests=2,2,2", "--VarGrid.Ynests=2,2,2",
 			"--VariableGridData=file://test/test/test_user/test_job/26b310adcf36530acdb518bd74b61355b2a2e7825c20a07f3631db412c655881.gob",
 			"--aep.GridRef=",
 			"--aep.InventoryConfig.COARDSFiles=",
 			"--aep.InventoryConfig.COARDSYear=0",
+			"--aep.InventoryConfig.DeltaFiles=",
 			"--aep.InventoryConfig.InputUnits=no_default",
 			"--aep.InventoryConfig.NEIFiles=",
+			"--aep.InventoryConfig.ScenarioRules=",
+			"--aep.InventoryConfig.SpeciationProfiles=",
+			"--aep.InventoryConfig.SpeciationRef=",
 			"--aep.PostGISURL=",
 			"--aep.SCCExactMatch=true",
 			"--aep.SpatialConfig.GridName=inmap",
@@ -159,7 +226,7 @@ func TestClient_fake(t *testing.T) {
 			"OutputFile.shp": 2276,
 			"OutputFile.dbf": 465,
 			"OutputFile.shx": 228,
-			"OutputFile.prj": 431,
+			"OutputFile.prj": 418,
 		}
 		if len(output.Files) != len(wantFiles) {
 			t.Errorf("wrong number of files: %d != %d", len(output.Files), len(wantFiles))
@@ -207,30 +274,97 @@ func TestClient_fakeCOARDS(t *testing.T) {
 
 	checkConfig := func(cmd []string) {
 		wantCmd := []string{"inmap", "run", "steady",
+			"--Acceleration=",
+			"--Advection=upwind",
+			"--AgeGroupHazardRatio=Krewski2009Ecologic(PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA)",
+			"--Aggregation.File=",
+			"--Aggregation.IDColumn=GEOID",
+			"--Aggregation.OutputFile=",
+			"--Aggregation.Weight=area",
+			"--AndersonDepth=5",
+			"--Backend=cpu",
+			"--BoundaryData=",
+			"--BudgetFile=",
+			"--CTMDataCacheDir=",
+			"--CellStorageDir=",
+			"--CheckpointFile=",
+			"--CheckpointInterval=1h",
+			"--ColumnOutputFile=",
+			"--ConvergenceCriterion=mass",
+			"--ConvergenceTolerance=0.001",
+			"--Dashboard.Address=",
+			"--Disparity.Epsilon=-0.5",
+			"--Disparity.Groups={}\n",
+			"--Disparity.Rank=",
+			"--Disparity.Reference=TotalPop",
+			"--Disparity.Variable=PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA",
+			"--DryRun.CellsPerSecond=100000",
+			"--DryRun.Iterations=1000",
 			"--EmissionMaskGeoJSON=",
 			"--EmissionUnits=tons/year",
 			"--EmissionsShapefiles=",
+			"--HealthFunctions={}\n",
 			"--InMAPData=file://test/test/test_user/test_job/434bf26e3fda1ef9cef7e1fa6cc6b5174d11a22b19cbe10d256adc83b2a97d44.ncf",
+			"--InMAPDataPeriods=",
+			"--Infiltration.DefaultFactor=1",
+			"--Infiltration.FactorColumn=Finf",
+			"--Infiltration.File=",
+			"--Infiltration.IndoorFraction=0.9",
+			"--Infiltration.OutputFile=",
 			"--LogFile=file://test/test/test_user/test_job/LogFile",
+			"--LogFormat=text",
+			"--LogLevel=info",
+			"--ManifestFile=",
+			"--Metrics.Address=",
+			"--Mobility.CrosswalkFile=",
+			"--Mobility.ODFile=",
+			"--Mobility.OutputFile=",
+			"--Mobility.PopColumn=TotalPop",
+			"--Mobility.WorkFraction=0.24",
+			"--NearRoadWidth=0",
 			"--NumIterations=0",
 			"--OutputFile=file://test/test/test_user/test_job/OutputFile.shp",
 			"--OutputVariables={\"TotalPM25\":\"PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA\",\"TotalPopD\":\"(exp(log(1.078)/10 * TotalPM25) - 1) * TotalPop * AllCause / 100000\"}\n",
-			"--VarGrid.CensusFile=file://test/test/test_user/test_job/72f6717ef5f6f9600378fe5b192776ba142b3e93311c3dfd0b67bfecbe399990.shp",
+			"--PlumeInGridDistance=0",
+			"--ReceptorFile=",
+			"--ReceptorOutputFile=",
+			"--RelaxationFactor=1.5",
+			"--Valuation.BaseIncome=0",
+			"--Valuation.Damages={}\n",
+			"--Valuation.DiscountRate=0.03",
+			"--Valuation.IncomeElasticity=0.4",
+			"--Valuation.VSL=7.4e+06",
+			"--VarGrid.AgeGroups={}\n",
+			"--VarGrid.CensusFile=file://test/test/test_user/test_job/c3bd73b90e0a7469be79e73e0069422bc0b9619275d790dec79d67a6da1a90f1.shp",
 			"--VarGrid.CensusPopColumns=TotalPop,WhiteNoLat,Black,Native,Asian,Latino",
+			"--VarGrid.CountryFile=", "--VarGrid.CountryIDColumn=ISO_A3", "--VarGrid.CountryMortalityFile=",
+			"--VarGrid.EmisDensityThreshold=0",
+			"--VarGrid.GradientColumn=", "--VarGrid.GradientFile=", "--VarGrid.GradientThreshold=0",
 			"--VarGrid.GridProj=+proj=lcc +lat_1=33.000000 +lat_2=45.000000 +lat_0=40.000000 +lon_0=-97.000000 +x_0=0 +y_0=0 +a=6370997.000000 +b=6370997.000000 +to_meter=1",
 			"--VarGrid.HiResLayers=1",
+			"--VarGrid.ImportanceColumn=", "--VarGrid.ImportanceFile=", "--VarGrid.ImportanceThreshold=0",
+			"--VarGrid.IncomeColumn=",
+			"--VarGrid.LandUseCategories=", "--VarGrid.LandUseColumn=", "--VarGrid.LandUseFile=",
+			"--VarGrid.MorbidityEndpoints={}\n",
 			"--VarGrid.MortalityRateColumns={\"AllCause\":\"TotalPop\",\"AsianMort\":\"Asian\",\"BlackMort\":\"Black\",\"LatinoMort\":\"Latino\",\"NativeMort\":\"Native\",\"WhNoLMort\":\"WhiteNoLat\"}\n",
-			"--VarGrid.MortalityRateFile=file://test/test/test_user/test_job/764874ad5081665459c67d40607f68df6fc689aa695b4822e012aef84cba5394.shp",
+			"--VarGrid.MortalityRateFile=file://test/test/test_user/test_job/db5394e880433178d28455d91841fb940f2e1aa1563f63345cb9e555a01e0b0d.shp",
 			"--VarGrid.PopConcThreshold=1e-09", "--VarGrid.PopDensityThreshold=0.0055",
-			"--VarGrid.PopGridColumn=TotalPop", "--VarGrid.PopThreshold=40000", "--VarGrid.VariableGridDx=4000",
+			"--VarGrid.PopGridColumn=TotalPop", "--VarGrid.PopThreshold=40000",
+			"--VarGrid.PopulationRasters={}\n",
+			"--VarGrid.ProjectionFile=", "--VarGrid.ProjectionIDColumn=GEOID", "--VarGrid.ProjectionRegionFile=", "--VarGrid.ProjectionYear=0",
+			"--VarGrid.RefinementCriteria=population", "--VarGrid.VariableGridDx=4000",
 			"--VarGrid.VariableGridDy=4000", "--VarGrid.VariableGridXo=-4000", "--VarGrid.VariableGridYo=-4000",
 			"--VarGrid.Xnests=2,2,2", "--VarGrid.Ynests=2,2,2",
 			"--VariableGridData=file://test/test/test_user/test_job/26b310adcf36530acdb518bd74b61355b2a2e7825c20a07f3631db412c655881.gob",
 			"--aep.GridRef=file://test/test/test_user/test_job/d471298031ee531438f90ae92878df0aae1f76fb81424e1f223bf7a602a1864c.txt",
 			"--aep.InventoryConfig.COARDSFiles={\"all\":[\"file://test/test/test_user/test_job/ffe280d818c1549074d0e15cfb74377b891287d7f81a4ad9038d0f65b12f6642.nc\"]}",
 			"--aep.InventoryConfig.COARDSYear=2016",
+			"--aep.InventoryConfig.DeltaFiles=",
 			"--aep.InventoryConfig.InputUnits=tons",
 			"--aep.InventoryConfig.NEIFiles=",
+			"--aep.InventoryConfig.ScenarioRules=",
+			"--aep.InventoryConfig.SpeciationProfiles=",
+			"--aep.InventoryConfig.SpeciationRef=",
 			"--aep.PostGISURL=" + postGISURL,
 			"--aep.SCCExactMatch=true",
 			"--aep.SpatialConfig.GridName=inmap",
@@ -333,7 +467,7 @@ func TestClient_fakeCOARDS(t *testing.T) {
 			"OutputFile.shp": 644,
 			"OutputFile.dbf": 181,
 			"OutputFile.shx": 132,
-			"OutputFile.prj": 431,
+			"OutputFile.prj": 418,
 		}
 		if len(output.Files) != len(wantFiles) {
 			t.Errorf("wrong number of files: %d != %d", len(output.Files), len(wantFiles))
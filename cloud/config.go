@@ -30,9 +30,12 @@ import (
 )
 
 // jobOutputAddresses returns the locations of where the output files of the job
-// with the given name, belonging to the given user, with the given command arguments,
-// will be stored.
-func (c *Client) jobOutputAddresses(ctx context.Context, name string, cmd []string) (map[string]string, error) {
+// with the given name, belonging to the given user, with the given command
+// and arguments, will be stored. Output files other than LogFile whose
+// names are empty in args, or that have empty default names and aren't
+// in args, are optional outputs that the job won't create, so they are
+// left out. The log file is always created.
+func (c *Client) jobOutputAddresses(ctx context.Context, name string, cmd, args []string) (map[string]string, error) {
 	outputFiles := make(map[string]struct{})
 	for _, f := range c.outputFileArgs {
 		outputFiles[f] = struct{}{}
@@ -50,15 +53,31 @@ func (c *Client) jobOutputAddresses(ctx context.Context, name string, cmd []stri
 	flags.AddFlagSet(execCmd.LocalFlags())
 	flags.VisitAll(func(f *pflag.Flag) {
 		if _, ok := outputFiles[f.Name]; ok { // Is this an output file?
-			ext := filepath.Ext(f.Value.String())
+			val := argValue(args, f.Name, f.Value.String())
+			if val == "" && f.Name != "LogFile" {
+				return
+			}
+			ext := filepath.Ext(val)
 			o[f.Name] = fmt.Sprintf("%s/%s/%s/%s%s", c.bucketName, user, name, strings.Replace(f.Name, ".", "_", -1), ext)
 		}
 	})
 	return o, nil
 }
 
-func (c *Client) checkOutputs(ctx context.Context, name string, cmd []string) error {
-	addrs, err := c.jobOutputAddresses(ctx, name, cmd)
+// argValue returns the value of the flag with the given name in args,
+// which holds pairs of flag names and values, or def if the flag is not
+// in args.
+func argValue(args []string, name, def string) string {
+	for i := 0; i < len(args)-1; i += 2 {
+		if strings.TrimLeft(args[i], "-") == name {
+			return args[i+1]
+		}
+	}
+	return def
+}
+
+func (c *Client) checkOutputs(ctx context.Context, name string, cmd, args []string) error {
+	addrs, err := c.jobOutputAddresses(ctx, name, cmd, args)
 	if err != nil {
 		return err
 	}
@@ -90,7 +109,7 @@ func (c *Client) checkOutputs(ctx context.Context, name string, cmd []string) er
 // job specification so that they match
 // the locations where the files should be stored.
 func (c *Client) setOutputPaths(ctx context.Context, job *cloudrpc.JobSpec) error {
-	addrs, err := c.jobOutputAddresses(ctx, job.Name, job.Cmd)
+	addrs, err := c.jobOutputAddresses(ctx, job.Name, job.Cmd, job.Args)
 	if err != nil {
 		return err
 	}
@@ -109,25 +128,35 @@ func (c *Client) stageInputs(ctx context.Context, job *cloudrpc.JobSpec) error {
 	if err != nil {
 		return err
 	}
-	url, err := url.Parse(c.bucketName)
-	if err != nil {
-		return fmt.Errorf("inmap/cloud: staging inputs: %v", err)
-	}
-
-	user, err := getUser(ctx)
-	if err != nil {
-		return err
-	}
 	for fname, data := range job.FileData {
-		filePath := strings.TrimPrefix(url.Path+"/"+user+"/"+job.Name+"/"+fname, "/")
+		addr, filePath, err := c.inputAddress(ctx, job.Name, fname)
+		if err != nil {
+			return err
+		}
 		if err := writeBlob(ctx, bucket, filePath, data); err != nil {
 			return err
 		}
 		for i, arg := range job.Args {
 			if strings.Contains(arg, fname) {
-				job.Args[i] = strings.Replace(arg, fname, url.Scheme+"://"+url.Hostname()+"/"+filePath, -1)
+				job.Args[i] = strings.Replace(arg, fname, addr, -1)
 			}
 		}
 	}
 	return nil
 }
+
+// inputAddress returns the location where the input file fname of
+// the job with the given name is staged, and its key in the
+// storage bucket.
+func (c *Client) inputAddress(ctx context.Context, jobName, fname string) (addr, key string, err error) {
+	url, err := url.Parse(c.bucketName)
+	if err != nil {
+		return "", "", fmt.Errorf("inmap/cloud: staging inputs: %v", err)
+	}
+	user, err := getUser(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	key = strings.TrimPrefix(url.Path+"/"+user+"/"+jobName+"/"+fname, "/")
+	return url.Scheme + "://" + url.Hostname() + "/" + key, key, nil
+}
@@ -41,46 +41,124 @@ func TestRunInputFromViper(t *testing.T) {
 	}
 
 	wantArgs := map[string]string{
-		"--EmissionMaskGeoJSON":               "",
-		"--aep.GridRef":                       "",
-		"--aep.InventoryConfig.NEIFiles":      "",
-		"--aep.SpatialConfig.SpatialCache":    "",
-		"--aep.SpatialConfig.SrgDataCache":    "",
-		"--aep.SrgSpecSMOKE":                  "",
-		"--aep.SrgSpecOSM":                    "",
-		"--VarGrid.MortalityRateFile":         "764874ad5081665459c67d40607f68df6fc689aa695b4822e012aef84cba5394.shp",
-		"--VarGrid.VariableGridDx":            "4000",
-		"--NumIterations":                     "0",
-		"--VarGrid.CensusPopColumns":          "TotalPop,WhiteNoLat,Black,Native,Asian,Latino",
-		"--VariableGridData":                  "26b310adcf36530acdb518bd74b61355b2a2e7825c20a07f3631db412c655881.gob",
-		"--OutputVariables":                   "{\"TotalPM25\":\"PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA\",\"TotalPopD\":\"(exp(log(1.078)/10 * TotalPM25) - 1) * TotalPop * AllCause / 100000\"}\n",
-		"--OutputFile":                        "inmap_output.shp",
-		"--VarGrid.PopThreshold":              "40000",
-		"--VarGrid.Ynests":                    "2,2,2",
-		"--VarGrid.MortalityRateColumns":      "{\"AllCause\":\"TotalPop\",\"AsianMort\":\"Asian\",\"BlackMort\":\"Black\",\"LatinoMort\":\"Latino\",\"NativeMort\":\"Native\",\"WhNoLMort\":\"WhiteNoLat\"}\n",
-		"--VarGrid.Xnests":                    "2,2,2",
-		"--EmissionsShapefiles":               "258bbcefe8c0073d6f323351463be9e9685e74bb92e367ca769b9536ed247213.shp",
-		"--VarGrid.PopGridColumn":             "TotalPop",
-		"--VarGrid.GridProj":                  "+proj=lcc +lat_1=33.000000 +lat_2=45.000000 +lat_0=40.000000 +lon_0=-97.000000 +x_0=0 +y_0=0 +a=6370997.000000 +b=6370997.000000 +to_meter=1",
-		"--VarGrid.PopConcThreshold":          "1e-09",
-		"--VarGrid.CensusFile":                "72f6717ef5f6f9600378fe5b192776ba142b3e93311c3dfd0b67bfecbe399990.shp",
-		"--VarGrid.VariableGridYo":            "-4000",
-		"--InMAPData":                         "434bf26e3fda1ef9cef7e1fa6cc6b5174d11a22b19cbe10d256adc83b2a97d44.ncf",
-		"--VarGrid.VariableGridXo":            "-4000",
-		"--VarGrid.HiResLayers":               "1",
-		"--VarGrid.PopDensityThreshold":       "0.0055",
-		"--VarGrid.VariableGridDy":            "4000",
-		"--EmissionUnits":                     "tons/year",
-		"--LogFile":                           "",
-		"--aep.InventoryConfig.COARDSFiles":   "{\"xxx\":[\"ffe280d818c1549074d0e15cfb74377b891287d7f81a4ad9038d0f65b12f6642.nc\",\"ffe280d818c1549074d0e15cfb74377b891287d7f81a4ad9038d0f65b12f6642.nc\"],\"yyy\":[\"ffe280d818c1549074d0e15cfb74377b891287d7f81a4ad9038d0f65b12f6642.nc\"]}",
-		"--aep.InventoryConfig.COARDSYear":    "0",
-		"--aep.InventoryConfig.InputUnits":    "no_default",
-		"--aep.SCCExactMatch":                 "true",
-		"--aep.PostGISURL":                    "",
-		"--aep.SpatialConfig.GridName":        "inmap",
-		"--aep.SpatialConfig.InputSR":         "+proj=longlat",
-		"--aep.SpatialConfig.MaxCacheEntries": "10",
-		"--aep.SrgShapefileDirectory":         "no_default",
+		"--EmissionMaskGeoJSON":                    "",
+		"--aep.GridRef":                            "",
+		"--aep.InventoryConfig.NEIFiles":           "",
+		"--aep.InventoryConfig.DeltaFiles":         "",
+		"--aep.InventoryConfig.ScenarioRules":      "",
+		"--aep.InventoryConfig.SpeciationRef":      "",
+		"--aep.InventoryConfig.SpeciationProfiles": "",
+		"--aep.SpatialConfig.SpatialCache":         "",
+		"--aep.SpatialConfig.SrgDataCache":         "",
+		"--aep.SrgSpecSMOKE":                       "",
+		"--aep.SrgSpecOSM":                         "",
+		"--VarGrid.MortalityRateFile":              "db5394e880433178d28455d91841fb940f2e1aa1563f63345cb9e555a01e0b0d.shp",
+		"--VarGrid.VariableGridDx":                 "4000",
+		"--InMAPDataPeriods":                       "",
+		"--PlumeInGridDistance":                    "0",
+		"--NearRoadWidth":                          "0",
+		"--VarGrid.RefinementCriteria":             "population",
+		"--VarGrid.EmisDensityThreshold":           "0",
+		"--VarGrid.LandUseFile":                    "",
+		"--VarGrid.LandUseColumn":                  "",
+		"--VarGrid.LandUseCategories":              "",
+		"--VarGrid.ImportanceFile":                 "",
+		"--VarGrid.ImportanceColumn":               "",
+		"--VarGrid.ImportanceThreshold":            "0",
+		"--VarGrid.GradientFile":                   "",
+		"--VarGrid.GradientColumn":                 "",
+		"--VarGrid.GradientThreshold":              "0",
+		"--CheckpointFile":                         "",
+		"--DryRun.CellsPerSecond":                  "100000",
+		"--DryRun.Iterations":                      "1000",
+		"--CheckpointInterval":                     "1h",
+		"--ConvergenceCriterion":                   "mass",
+		"--ConvergenceTolerance":                   "0.001",
+		"--Acceleration":                           "",
+		"--RelaxationFactor":                       "1.5",
+		"--AndersonDepth":                          "5",
+		"--Advection":                              "upwind",
+		"--Aggregation.File":                       "",
+		"--Aggregation.IDColumn":                   "GEOID",
+		"--Aggregation.OutputFile":                 "",
+		"--Aggregation.Weight":                     "area",
+		"--Mobility.ODFile":                        "",
+		"--Mobility.CrosswalkFile":                 "",
+		"--Mobility.PopColumn":                     "TotalPop",
+		"--Mobility.WorkFraction":                  "0.24",
+		"--Mobility.OutputFile":                    "",
+		"--Infiltration.File":                      "",
+		"--Infiltration.FactorColumn":              "Finf",
+		"--Infiltration.DefaultFactor":             "1",
+		"--Infiltration.IndoorFraction":            "0.9",
+		"--Infiltration.OutputFile":                "",
+		"--Dashboard.Address":                      "",
+		"--Backend":                                "cpu",
+		"--BoundaryData":                           "",
+		"--BudgetFile":                             "",
+		"--CTMDataCacheDir":                        "",
+		"--CellStorageDir":                         "",
+		"--ColumnOutputFile":                       "",
+		"--ReceptorFile":                           "",
+		"--ReceptorOutputFile":                     "",
+		"--NumIterations":                          "0",
+		"--VarGrid.CensusPopColumns":               "TotalPop,WhiteNoLat,Black,Native,Asian,Latino",
+		"--VariableGridData":                       "26b310adcf36530acdb518bd74b61355b2a2e7825c20a07f3631db412c655881.gob",
+		"--HealthFunctions":                        "{}\n",
+		"--AgeGroupHazardRatio":                    "Krewski2009Ecologic(PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA)",
+		"--VarGrid.AgeGroups":                      "{}\n",
+		"--VarGrid.MorbidityEndpoints":             "{}\n",
+		"--Disparity.Epsilon":                      "-0.5",
+		"--Disparity.Groups":                       "{}\n",
+		"--Disparity.Rank":                         "",
+		"--Disparity.Reference":                    "TotalPop",
+		"--Disparity.Variable":                     "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA",
+		"--Valuation.BaseIncome":                   "0",
+		"--Valuation.Damages":                      "{}\n",
+		"--Valuation.DiscountRate":                 "0.03",
+		"--Valuation.IncomeElasticity":             "0.4",
+		"--Valuation.VSL":                          "7.4e+06",
+		"--VarGrid.IncomeColumn":                   "",
+		"--VarGrid.PopulationRasters":              "{}\n",
+		"--VarGrid.CountryMortalityFile":           "",
+		"--VarGrid.CountryFile":                    "",
+		"--VarGrid.ProjectionFile":                 "",
+		"--VarGrid.ProjectionRegionFile":           "",
+		"--VarGrid.ProjectionIDColumn":             "GEOID",
+		"--VarGrid.ProjectionYear":                 "0",
+		"--VarGrid.CountryIDColumn":                "ISO_A3",
+		"--OutputVariables":                        "{\"TotalPM25\":\"PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA\",\"TotalPopD\":\"(exp(log(1.078)/10 * TotalPM25) - 1) * TotalPop * AllCause / 100000\"}\n",
+		"--OutputFile":                             "inmap_output.shp",
+		"--VarGrid.PopThreshold":                   "40000",
+		"--VarGrid.Ynests":                         "2,2,2",
+		"--VarGrid.MortalityRateColumns":           "{\"AllCause\":\"TotalPop\",\"AsianMort\":\"Asian\",\"BlackMort\":\"Black\",\"LatinoMort\":\"Latino\",\"NativeMort\":\"Native\",\"WhNoLMort\":\"WhiteNoLat\"}\n",
+		"--VarGrid.Xnests":                         "2,2,2",
+		"--EmissionsShapefiles":                    "ca616f6d93abb72322a2bec3cc62e48e7e4a0ed23c22302c5a88d416549d355b.shp",
+		"--VarGrid.PopGridColumn":                  "TotalPop",
+		"--VarGrid.GridProj":                       "+proj=lcc +lat_1=33.000000 +lat_2=45.000000 +lat_0=40.000000 +lon_0=-97.000000 +x_0=0 +y_0=0 +a=6370997.000000 +b=6370997.000000 +to_meter=1",
+		"--VarGrid.PopConcThreshold":               "1e-09",
+		"--VarGrid.CensusFile":                     "c3bd73b90e0a7469be79e73e0069422bc0b9619275d790dec79d67a6da1a90f1.shp",
+		"--VarGrid.VariableGridYo":                 "-4000",
+		"--InMAPData":                              "434bf26e3fda1ef9cef7e1fa6cc6b5174d11a22b19cbe10d256adc83b2a97d44.ncf",
+		"--VarGrid.VariableGridXo":                 "-4000",
+		"--VarGrid.HiResLayers":                    "1",
+		"--VarGrid.PopDensityThreshold":            "0.0055",
+		"--VarGrid.VariableGridDy":                 "4000",
+		"--EmissionUnits":                          "tons/year",
+		"--LogFile":                                "",
+		"--ManifestFile":                           "",
+		"--LogFormat":                              "text",
+		"--LogLevel":                               "info",
+		"--Metrics.Address":                        "",
+		"--aep.InventoryConfig.COARDSFiles":        "{\"xxx\":[\"ffe280d818c1549074d0e15cfb74377b891287d7f81a4ad9038d0f65b12f6642.nc\",\"ffe280d818c1549074d0e15cfb74377b891287d7f81a4ad9038d0f65b12f6642.nc\"],\"yyy\":[\"ffe280d818c1549074d0e15cfb74377b891287d7f81a4ad9038d0f65b12f6642.nc\"]}",
+		"--aep.InventoryConfig.COARDSYear":         "0",
+		"--aep.InventoryConfig.InputUnits":         "no_default",
+		"--aep.SCCExactMatch":                      "true",
+		"--aep.PostGISURL":                         "",
+		"--aep.SpatialConfig.GridName":             "inmap",
+		"--aep.SpatialConfig.InputSR":              "+proj=longlat",
+		"--aep.SpatialConfig.MaxCacheEntries":      "10",
+		"--aep.SrgShapefileDirectory":              "no_default",
 	}
 	if len(js.Args) != len(wantArgs)*2 {
 		t.Errorf("wrong number of arguments: %d != %d", len(js.Args)/2, len(wantArgs))
@@ -97,18 +175,18 @@ func TestRunInputFromViper(t *testing.T) {
 	}
 
 	wantFiles := map[string]int{
-		"258bbcefe8c0073d6f323351463be9e9685e74bb92e367ca769b9536ed247213.shp": 620,
-		"258bbcefe8c0073d6f323351463be9e9685e74bb92e367ca769b9536ed247213.dbf": 869,
-		"258bbcefe8c0073d6f323351463be9e9685e74bb92e367ca769b9536ed247213.prj": 432,
-		"258bbcefe8c0073d6f323351463be9e9685e74bb92e367ca769b9536ed247213.shx": 140,
-		"72f6717ef5f6f9600378fe5b192776ba142b3e93311c3dfd0b67bfecbe399990.shp": 236,
-		"72f6717ef5f6f9600378fe5b192776ba142b3e93311c3dfd0b67bfecbe399990.dbf": 353,
-		"72f6717ef5f6f9600378fe5b192776ba142b3e93311c3dfd0b67bfecbe399990.shx": 108,
-		"72f6717ef5f6f9600378fe5b192776ba142b3e93311c3dfd0b67bfecbe399990.prj": 432,
-		"764874ad5081665459c67d40607f68df6fc689aa695b4822e012aef84cba5394.shp": 236,
-		"764874ad5081665459c67d40607f68df6fc689aa695b4822e012aef84cba5394.shx": 108,
-		"764874ad5081665459c67d40607f68df6fc689aa695b4822e012aef84cba5394.dbf": 341,
-		"764874ad5081665459c67d40607f68df6fc689aa695b4822e012aef84cba5394.prj": 432,
+		"ca616f6d93abb72322a2bec3cc62e48e7e4a0ed23c22302c5a88d416549d355b.shp": 620,
+		"ca616f6d93abb72322a2bec3cc62e48e7e4a0ed23c22302c5a88d416549d355b.dbf": 869,
+		"ca616f6d93abb72322a2bec3cc62e48e7e4a0ed23c22302c5a88d416549d355b.prj": 432,
+		"ca616f6d93abb72322a2bec3cc62e48e7e4a0ed23c22302c5a88d416549d355b.shx": 140,
+		"c3bd73b90e0a7469be79e73e0069422bc0b9619275d790dec79d67a6da1a90f1.shp": 236,
+		"c3bd73b90e0a7469be79e73e0069422bc0b9619275d790dec79d67a6da1a90f1.dbf": 353,
+		"c3bd73b90e0a7469be79e73e0069422bc0b9619275d790dec79d67a6da1a90f1.shx": 108,
+		"c3bd73b90e0a7469be79e73e0069422bc0b9619275d790dec79d67a6da1a90f1.prj": 432,
+		"db5394e880433178d28455d91841fb940f2e1aa1563f63345cb9e555a01e0b0d.shp": 236,
+		"db5394e880433178d28455d91841fb940f2e1aa1563f63345cb9e555a01e0b0d.shx": 108,
+		"db5394e880433178d28455d91841fb940f2e1aa1563f63345cb9e555a01e0b0d.dbf": 341,
+		"db5394e880433178d28455d91841fb940f2e1aa1563f63345cb9e555a01e0b0d.prj": 432,
 		"434bf26e3fda1ef9cef7e1fa6cc6b5174d11a22b19cbe10d256adc83b2a97d44.ncf": 14284,
 		"ffe280d818c1549074d0e15cfb74377b891287d7f81a4ad9038d0f65b12f6642.nc":  3484,
 		"26b310adcf36530acdb518bd74b61355b2a2e7825c20a07f3631db412c655881.gob": 21276,
@@ -151,13 +229,34 @@ func TestSRPredictInputFromViper(t *testing.T) {
 	}
 
 	wantArgs := map[string]string{
-		"--EmissionMaskGeoJSON": "",
-		"--EmissionUnits":       "tons/year",
-		"--EmissionsShapefiles": "258bbcefe8c0073d6f323351463be9e9685e74bb92e367ca769b9536ed247213.shp",
-		"--OutputFile":          "inmap_output.shp",
-		"--OutputVariables":     "{\"PrimPM25\":\"PrimaryPM25\"}",
-		"--SR.OutputFile":       "${INMAP_ROOT_DIR}/cmd/inmap/testdata/output_${InMAPRunType}.shp",
-		"--VarGrid.GridProj":    "+proj=lcc +lat_1=33.000000 +lat_2=45.000000 +lat_0=40.000000 +lon_0=-97.000000 +x_0=0 +y_0=0 +a=6370997.000000 +b=6370997.000000 +to_meter=1",
+		"--EmissionMaskGeoJSON":        "",
+		"--EmissionUnits":              "tons/year",
+		"--EmissionsShapefiles":        "ca616f6d93abb72322a2bec3cc62e48e7e4a0ed23c22302c5a88d416549d355b.shp",
+		"--HealthFunctions":            "{}\n",
+		"--AgeGroupHazardRatio":        "Krewski2009Ecologic(PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA)",
+		"--VarGrid.AgeGroups":          "{}\n",
+		"--VarGrid.MorbidityEndpoints": "{}\n",
+		"--Disparity.Epsilon":          "-0.5",
+		"--Disparity.Groups":           "{}\n",
+		"--Disparity.Rank":             "",
+		"--Disparity.Reference":        "TotalPop",
+		"--Disparity.Variable":         "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA",
+		"--Valuation.BaseIncome":       "0",
+		"--Valuation.Damages":          "{}\n",
+		"--Valuation.DiscountRate":     "0.03",
+		"--Valuation.IncomeElasticity": "0.4",
+		"--Valuation.VSL":              "7.4e+06",
+		"--VarGrid.IncomeColumn":       "",
+		"--SR.SourceOutputFile":        "",
+		"--OutputFile":                 "inmap_output.shp",
+		"--LogFormat":                  "text",
+		"--LogLevel":                   "info",
+		"--Metrics.Address":            "",
+		"--OutputVariables":            "{\"PrimPM25\":\"PrimaryPM25\"}",
+		"--SR.OutputFile":              "${INMAP_ROOT_DIR}/cmd/inmap/testdata/output_${InMAPRunType}.shp",
+		"--SR.Procs":                   "0",
+		"--SR.SurrogateFile":           "",
+		"--VarGrid.GridProj":           "+proj=lcc +lat_1=33.000000 +lat_2=45.000000 +lat_0=40.000000 +lon_0=-97.000000 +x_0=0 +y_0=0 +a=6370997.000000 +b=6370997.000000 +to_meter=1",
 	}
 	if len(js.Args) != len(wantArgs)*2 {
 		t.Errorf("wrong number of arguments: %d != %d", len(js.Args)/2, len(wantArgs))
@@ -174,10 +273,10 @@ func TestSRPredictInputFromViper(t *testing.T) {
 	}
 
 	wantFiles := map[string]int{
-		"258bbcefe8c0073d6f323351463be9e9685e74bb92e367ca769b9536ed247213.shx": 140,
-		"258bbcefe8c0073d6f323351463be9e9685e74bb92e367ca769b9536ed247213.prj": 432,
-		"258bbcefe8c0073d6f323351463be9e9685e74bb92e367ca769b9536ed247213.shp": 620,
-		"258bbcefe8c0073d6f323351463be9e9685e74bb92e367ca769b9536ed247213.dbf": 869,
+		"ca616f6d93abb72322a2bec3cc62e48e7e4a0ed23c22302c5a88d416549d355b.shx": 140,
+		"ca616f6d93abb72322a2bec3cc62e48e7e4a0ed23c22302c5a88d416549d355b.prj": 432,
+		"ca616f6d93abb72322a2bec3cc62e48e7e4a0ed23c22302c5a88d416549d355b.shp": 620,
+		"ca616f6d93abb72322a2bec3cc62e48e7e4a0ed23c22302c5a88d416549d355b.dbf": 869,
 	}
 	if len(js.FileData) != len(wantFiles) {
 		t.Errorf("incorrect number of files: %d != %d", len(js.FileData), len(wantFiles))
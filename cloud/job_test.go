@@ -0,0 +1,76 @@
+/*
+Copyright © 2018 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"testing"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestCreateJob(t *testing.T) {
+	resources := core.ResourceList{core.ResourceMemory: resource.MustParse("1Gi")}
+
+	c := &Client{}
+	job := c.createJob("test", []string{"inmap"}, []string{"run", "steady"}, "latest", resources)
+	if job.Spec.BackoffLimit != nil {
+		t.Errorf("default backoff limit should be nil, have %d", *job.Spec.BackoffLimit)
+	}
+	pod := job.Spec.Template.Spec
+	if len(pod.Tolerations) != 0 || pod.Affinity != nil {
+		t.Errorf("non-spot job should not have tolerations or affinity")
+	}
+	if have, want := pod.Containers[0].Image, "inmap/inmap:latest"; have != want {
+		t.Errorf("image: have %s, want %s", have, want)
+	}
+
+	retries := int32(3)
+	c = &Client{Retries: &retries, Spot: true}
+	job = c.createJob("test", []string{"inmap"}, []string{"run", "steady"}, "latest", resources)
+	if job.Spec.BackoffLimit == nil || *job.Spec.BackoffLimit != 3 {
+		t.Errorf("backoff limit should be 3, have %v", job.Spec.BackoffLimit)
+	}
+	pod = job.Spec.Template.Spec
+	if have, want := len(pod.Tolerations), len(spotNodeLabels); have != want {
+		t.Errorf("tolerations: have %d, want %d", have, want)
+	}
+	if pod.Affinity == nil || pod.Affinity.NodeAffinity == nil {
+		t.Fatal("spot job should have node affinity")
+	}
+	if have, want := len(pod.Affinity.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution), len(spotNodeLabels); have != want {
+		t.Errorf("preferred node terms: have %d, want %d", have, want)
+	}
+	if pod.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil {
+		t.Errorf("spot nodes should be preferred, not required")
+	}
+}
+
+func TestCreateJob_metrics(t *testing.T) {
+	c := &Client{}
+	job := c.createJob("test", []string{"inmap"}, []string{"run", "steady", "--Metrics.Address="}, "latest", nil)
+	if a := job.Spec.Template.Annotations; a != nil {
+		t.Errorf("job without metrics should not have annotations, has %v", a)
+	}
+	job = c.createJob("test", []string{"inmap"}, []string{"run", "steady", "--Metrics.Address=:9090"}, "latest", nil)
+	a := job.Spec.Template.Annotations
+	if a["prometheus.io/scrape"] != "true" || a["prometheus.io/port"] != "9090" {
+		t.Errorf("invalid annotations %v", a)
+	}
+}
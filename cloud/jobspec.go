@@ -128,6 +128,9 @@ func JobSpec(root *cobra.Command, config *viper.Viper, version, name string, cmd
 		}
 		switch {
 		case argVal == "false":
+		case argVal == "" && (f.Value.Type() == "float64Slice" || f.Value.Type() == "intSlice"):
+			// Empty numeric lists can't be parsed from an empty argument,
+			// and leaving them out has the same effect.
 		case argVal == "true":
 			js.Args = append(js.Args, fmt.Sprintf("--%s", f.Name), "true")
 		default:
@@ -183,7 +186,9 @@ func stringsFromInterface(val interface{}) interface{} {
 // and returns the new file path of the file.
 // As a special case, if the file has the extension '.shp', the function
 // will copy the corresponding '.dbf', '.shx', and '.prj' files but only
-// return the path of the original '.shp' file.
+// return the path of the original '.shp' file. The checksum is then
+// calculated from the contents of all of the files, so that shapefiles
+// with the same geometry but different attributes have different paths.
 // filePath can contain environment variables.
 func localFileToRunInput(filePath string, js *cloudrpc.JobSpec) (string, error) {
 	if filePath == "" ||
@@ -199,18 +204,26 @@ func localFileToRunInput(filePath string, js *cloudrpc.JobSpec) (string, error)
 	if err != nil {
 		return "", err
 	}
-	newPath := sum + ext
-	js.FileData[newPath] = data
-	if ext == ".shp" {
-		for _, newExt := range []string{".dbf", ".shx", ".prj"} {
-			data, _, err := fileContentsAndSum(filePath[0:len(filePath)-4] + newExt)
-			if err != nil {
-				return "", err
-			}
-			js.FileData[sum+newExt] = data
+	if ext != ".shp" {
+		js.FileData[sum+ext] = data
+		return sum + ext, nil
+	}
+	files := map[string][]byte{ext: data}
+	h := sha256.New()
+	h.Write(data)
+	for _, newExt := range []string{".dbf", ".shx", ".prj"} {
+		data, _, err := fileContentsAndSum(filePath[0:len(filePath)-4] + newExt)
+		if err != nil {
+			return "", err
 		}
+		files[newExt] = data
+		h.Write(data)
+	}
+	sum = fmt.Sprintf("%x", h.Sum(nil))
+	for newExt, data := range files {
+		js.FileData[sum+newExt] = data
 	}
-	return newPath, nil
+	return sum + ext, nil
 }
 
 // fileContentsAndSum returns the contents and sha256 checksum of a file.
@@ -0,0 +1,499 @@
+/*
+Copyright © 2018 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/yuzhou-wang/inmap/cloud/cloudrpc"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// queueFile is the name of the file that holds the list of tasks in
+// a work queue job.
+const queueFile = "queue.json"
+
+// taskStateFile is the name of the file that holds the state of each
+// task in a work queue job. It is stored with the task's output files.
+const taskStateFile = "task.json"
+
+var (
+	// leaseDuration is how long a worker's claim to a task lasts
+	// unless it is renewed. Tasks claimed by workers that stop
+	// renewing their claims, for example because their spot node was
+	// reclaimed, are run again by other workers after the claim expires.
+	leaseDuration = 2 * time.Minute
+
+	// claimDelay is how long a worker waits after claiming a task
+	// before checking that another worker didn't claim it at the
+	// same time. Jobs with only one worker don't need to check.
+	claimDelay = time.Second
+
+	// pollInterval is how long a worker waits before checking again
+	// for tasks when all of the remaining tasks are claimed by other
+	// workers.
+	pollInterval = 30 * time.Second
+)
+
+// A Queue holds a set of simulations (tasks) that are run by a single
+// Kubernetes Job with a number of worker pods (see Work).
+// Each worker repeatedly claims a task that has not been completed
+// or claimed by another worker, runs it, and stores its
+// output in the storage bucket, until all of the tasks have been
+// completed or have failed. Failed tasks are retried, and tasks
+// whose workers are interrupted, for example when a spot node is
+// reclaimed, are run again by another worker.
+//
+// The output of each task can be retrieved with Client.Output, and its
+// status with Client.Status, using the job name "queueName/taskName".
+type Queue struct {
+	// Workers is the number of worker pods that run the
+	// tasks at the same time. If it is zero, one worker is used.
+	Workers int32
+
+	// Retries is the number of times a failed or interrupted
+	// task is retried before it is marked as failed.
+	Retries int
+
+	js    *cloudrpc.JobSpec
+	tasks []*queueTask
+}
+
+// queueSpec is the format of the task list file of a work queue job.
+type queueSpec struct {
+	Workers int32
+	Retries int
+	Tasks   []*queueTask
+}
+
+// queueTask is a task in a work queue job.
+type queueTask struct {
+	Name      string
+	Cmd, Args []string
+}
+
+// taskState is the state of a task in a work queue job.
+type taskState struct {
+	// Worker is the worker that has claimed the task, and Expires
+	// is when its claim expires unless it is renewed.
+	Worker  string
+	Expires time.Time
+
+	// Attempts is the number of times the task has been started.
+	Attempts int
+
+	// Done is whether the task has been completed successfully.
+	Done bool
+
+	// Err is the error from the most recent failed attempt.
+	Err string
+}
+
+// claimed returns whether the task is claimed by a worker at time t.
+func (s *taskState) claimed(t time.Time) bool {
+	return s.Worker != "" && t.Before(s.Expires)
+}
+
+// failed returns whether the task had failed at time t, after the given
+// number of retries.
+func (s *taskState) failed(t time.Time, retries int) bool {
+	return !s.Done && !s.claimed(t) && s.Attempts > retries
+}
+
+// NewQueue returns a new work queue job with the given name,
+// where version is the version of the InMAP Docker image to use
+// and memoryGB is the RAM required by each worker.
+func NewQueue(name, version string, memoryGB int32) *Queue {
+	return &Queue{
+		js: &cloudrpc.JobSpec{
+			Name:     name,
+			Version:  version,
+			Cmd:      []string{"inmap", "cloud", "work"},
+			Args:     []string{"--queue", queueFile},
+			MemoryGB: memoryGB,
+			FileData: make(map[string][]byte),
+		},
+	}
+}
+
+// Add adds a task to the queue, where task is created by JobSpec.
+// The task name must be unique within the queue and must not contain
+// "/". The input files of the task are combined with the input files of
+// the other tasks, so files that are used by more than one task are
+// only staged once.
+func (q *Queue) Add(task *cloudrpc.JobSpec) error {
+	if task.Name == "" || strings.Contains(task.Name, "/") {
+		return fmt.Errorf("cloud: invalid task name %q", task.Name)
+	}
+	for _, t := range q.tasks {
+		if t.Name == task.Name {
+			return fmt.Errorf("cloud: task %s is already in queue %s", task.Name, q.js.Name)
+		}
+	}
+	for fname, data := range task.FileData {
+		if d, ok := q.js.FileData[fname]; ok && !bytes.Equal(d, data) {
+			return fmt.Errorf("cloud: input file %s of task %s is different from the file with the same name in queue %s",
+				fname, task.Name, q.js.Name)
+		}
+		q.js.FileData[fname] = data
+	}
+	q.tasks = append(q.tasks, &queueTask{Name: task.Name, Cmd: task.Cmd, Args: task.Args})
+	return nil
+}
+
+// Len returns the number of tasks in the queue.
+func (q *Queue) Len() int { return len(q.tasks) }
+
+// JobSpec returns the specification of the work queue job, which can be
+// started with Client.RunJob.
+func (q *Queue) JobSpec() (*cloudrpc.JobSpec, error) {
+	b, err := json.Marshal(queueSpec{Workers: q.Workers, Retries: q.Retries, Tasks: q.tasks})
+	if err != nil {
+		return nil, fmt.Errorf("cloud: creating queue %s: %v", q.js.Name, err)
+	}
+	q.js.FileData[queueFile] = b
+	return q.js, nil
+}
+
+// stageQueue prepares the tasks of work queue job specification js,
+// if it is one, by replacing the input file locations in each task
+// with the locations where the files will be staged and by setting
+// the locations of the output files of each task to a directory with
+// the task name in the job directory. It returns the number of
+// workers that should run the tasks, or zero if js is not a work
+// queue job.
+func (c *Client) stageQueue(ctx context.Context, js *cloudrpc.JobSpec) (int32, error) {
+	b, ok := js.FileData[queueFile]
+	if !ok {
+		return 0, nil
+	}
+	var q queueSpec
+	if err := json.Unmarshal(b, &q); err != nil {
+		return 0, fmt.Errorf("cloud: reading queue %s: %v", js.Name, err)
+	}
+	for _, t := range q.Tasks {
+		for fname := range js.FileData {
+			if fname == queueFile {
+				continue
+			}
+			addr, _, err := c.inputAddress(ctx, js.Name, fname)
+			if err != nil {
+				return 0, err
+			}
+			for i, arg := range t.Args {
+				t.Args[i] = strings.Replace(arg, fname, addr, -1)
+			}
+		}
+		tjs := &cloudrpc.JobSpec{Name: js.Name + "/" + t.Name, Cmd: t.Cmd, Args: t.Args}
+		if err := c.setOutputPaths(ctx, tjs); err != nil {
+			return 0, err
+		}
+	}
+	b, err := json.Marshal(q)
+	if err != nil {
+		return 0, fmt.Errorf("cloud: staging queue %s: %v", js.Name, err)
+	}
+	js.FileData[queueFile] = b
+	if q.Workers <= 0 {
+		return 1, nil
+	}
+	return q.Workers, nil
+}
+
+// splitTaskName splits a job name in the format "queueName/taskName"
+// into the names of the queue and the task. ok is false if name is not
+// in that format.
+func splitTaskName(name string) (queueName, taskName string, ok bool) {
+	i := strings.Index(name, "/")
+	if i < 0 {
+		return "", "", false
+	}
+	return name[:i], name[i+1:], true
+}
+
+// queueTask returns the given task of the given work queue job, its
+// state, and the number of times it can be retried.
+func (c *Client) queueTask(ctx context.Context, bucket *blob.Bucket, queueName, taskName string) (*queueTask, *taskState, int, error) {
+	_, key, err := c.inputAddress(ctx, queueName, queueFile)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	b, err := readBlob(ctx, bucket, key)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("cloud: reading queue %s: %v", queueName, err)
+	}
+	var q queueSpec
+	if err := json.Unmarshal(b, &q); err != nil {
+		return nil, nil, 0, fmt.Errorf("cloud: reading queue %s: %v", queueName, err)
+	}
+	for _, t := range q.Tasks {
+		if t.Name != taskName {
+			continue
+		}
+		s, err := readTaskState(ctx, bucket, path.Join(path.Dir(key), taskName))
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		return t, s, q.Retries, nil
+	}
+	return nil, nil, 0, fmt.Errorf("cloud: queue %s does not have task %s", queueName, taskName)
+}
+
+// taskStatus returns the status of the given task of a work queue job.
+func (c *Client) taskStatus(ctx context.Context, queueName, taskName string) (*cloudrpc.JobStatus, error) {
+	bucket, err := OpenBucket(ctx, c.bucketName)
+	if err != nil {
+		return nil, err
+	}
+	defer bucket.Close()
+	_, s, retries, err := c.queueTask(ctx, bucket, queueName, taskName)
+	if err != nil {
+		return &cloudrpc.JobStatus{
+			Status:  cloudrpc.Status_Missing,
+			Message: err.Error(),
+		}, nil
+	}
+	return s.status(retries), nil
+}
+
+// status converts s to a job status, where retries is the number
+// of times the task can be retried.
+func (s *taskState) status(retries int) *cloudrpc.JobStatus {
+	now := time.Now()
+	switch {
+	case s.Done:
+		return &cloudrpc.JobStatus{Status: cloudrpc.Status_Complete}
+	case s.failed(now, retries):
+		return &cloudrpc.JobStatus{Status: cloudrpc.Status_Failed, Message: s.Err}
+	case s.claimed(now):
+		return &cloudrpc.JobStatus{Status: cloudrpc.Status_Running, Message: s.Err}
+	default:
+		return &cloudrpc.JobStatus{Status: cloudrpc.Status_Waiting, Message: s.Err}
+	}
+}
+
+// readTaskState reads the state of the task whose files are stored in
+// directory dir. Tasks that have not been started do not have a stored
+// state.
+func readTaskState(ctx context.Context, bucket *blob.Bucket, dir string) (*taskState, error) {
+	s := new(taskState)
+	b, err := readBlob(ctx, bucket, path.Join(dir, taskStateFile))
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cloud: reading task state: %v", err)
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("cloud: reading task state in %s: %v", dir, err)
+	}
+	return s, nil
+}
+
+// writeTaskState writes the state of the task whose files are stored
+// in directory dir.
+func writeTaskState(ctx context.Context, bucket *blob.Bucket, dir string, s *taskState) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return writeBlob(ctx, bucket, path.Join(dir, taskStateFile), b)
+}
+
+// Work runs the tasks of the work queue job whose task list is at
+// queueAddr, which is set by Client.RunJob. It is run by each of the
+// worker pods of the job. Work returns after all of the tasks have
+// been completed or have failed; the failures are recorded with the
+// tasks rather than returned so that the job is not restarted.
+//
+// There is no way to claim a task atomically in all types of
+// storage buckets, so two workers that claim the same task at the same
+// time can occasionally both run it. This is harmless, because both
+// runs produce the same output.
+func Work(ctx context.Context, queueAddr string) error {
+	u, err := url.Parse(queueAddr)
+	if err != nil {
+		return fmt.Errorf("cloud: parsing queue location: %v", err)
+	}
+	bucket, err := OpenBucket(ctx, queueAddr)
+	if err != nil {
+		return err
+	}
+	defer bucket.Close()
+	key := strings.TrimLeft(u.Path, "/")
+	b, err := readBlob(ctx, bucket, key)
+	if err != nil {
+		return fmt.Errorf("cloud: reading queue: %v", err)
+	}
+	var q queueSpec
+	if err := json.Unmarshal(b, &q); err != nil {
+		return fmt.Errorf("cloud: reading queue: %v", err)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	w := &worker{
+		name:   fmt.Sprintf("%s-%d", host, os.Getpid()),
+		bucket: bucket,
+		dir:    path.Dir(key),
+		shared: q.Workers > 1,
+	}
+
+	for {
+		var remaining int
+		var ran bool
+		// Start at a random task so that workers don't all try to claim
+		// the same one.
+		offset := rand.Intn(len(q.Tasks) + 1)
+		for i := range q.Tasks {
+			t := q.Tasks[(i+offset)%len(q.Tasks)]
+			s, err := readTaskState(ctx, bucket, w.taskDir(t))
+			if err != nil {
+				return err
+			}
+			now := time.Now()
+			if s.Done || s.failed(now, q.Retries) {
+				continue
+			}
+			remaining++
+			if s.claimed(now) {
+				continue
+			}
+			claimed, err := w.claim(ctx, t, s)
+			if err != nil {
+				return err
+			}
+			if !claimed {
+				continue
+			}
+			ran = true
+			if err := w.run(ctx, t, s); err != nil {
+				return err
+			}
+		}
+		if remaining == 0 {
+			return nil
+		}
+		if !ran {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(pollInterval):
+			}
+		}
+	}
+}
+
+// worker runs the tasks in a work queue.
+type worker struct {
+	name   string
+	bucket *blob.Bucket
+	dir    string // dir is the directory of the queue in the bucket.
+
+	// shared is whether there are other workers for the queue.
+	shared bool
+}
+
+// taskDir returns the directory that the files of task t are stored in.
+func (w *worker) taskDir(t *queueTask) string {
+	return path.Join(w.dir, t.Name)
+}
+
+// claim attempts to claim task t, which has state s, for w.
+// It returns whether the claim was successful.
+func (w *worker) claim(ctx context.Context, t *queueTask, s *taskState) (bool, error) {
+	s.Worker = w.name
+	s.Expires = time.Now().Add(leaseDuration)
+	s.Attempts++
+	if err := writeTaskState(ctx, w.bucket, w.taskDir(t), s); err != nil {
+		return false, err
+	}
+	if !w.shared {
+		return true, nil
+	}
+	time.Sleep(claimDelay)
+	s2, err := readTaskState(ctx, w.bucket, w.taskDir(t))
+	if err != nil {
+		return false, err
+	}
+	return s2.Worker == w.name, nil
+}
+
+// run runs task t, which has state s and has been claimed by w,
+// renewing the claim until it finishes, and then records the result.
+func (w *worker) run(ctx context.Context, t *queueTask, s *taskState) error {
+	log.Printf("cloud: running task %s, attempt %d", t.Name, s.Attempts)
+	done := make(chan struct{})
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		ticker := time.NewTicker(leaseDuration / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				renewal := *s
+				renewal.Expires = time.Now().Add(leaseDuration)
+				if err := writeTaskState(ctx, w.bucket, w.taskDir(t), &renewal); err != nil {
+					log.Printf("cloud: renewing claim to task %s: %v", t.Name, err)
+				}
+			}
+		}
+	}()
+
+	args := make([]string, 0, len(t.Cmd)+len(t.Args)/2)
+	args = append(args, t.Cmd[1:]...)
+	for i := 0; i < len(t.Args)-1; i += 2 {
+		args = append(args, fmt.Sprintf("%s=%s", t.Args[i], t.Args[i+1]))
+	}
+	o, err := exec.CommandContext(ctx, t.Cmd[0], args...).CombinedOutput()
+	close(done)
+	<-renewed
+
+	s.Worker, s.Expires = "", time.Time{}
+	if err != nil {
+		msg := strings.TrimSpace(string(o))
+		if len(msg) > 1000 {
+			msg = "..." + msg[len(msg)-1000:]
+		}
+		s.Err = fmt.Sprintf("attempt %d: %v", s.Attempts, err)
+		if msg != "" {
+			s.Err += ": " + msg
+		}
+		log.Printf("cloud: task %s failed: %s", t.Name, s.Err)
+	} else {
+		s.Done, s.Err = true, ""
+		log.Printf("cloud: task %s completed", t.Name)
+	}
+	return writeTaskState(ctx, w.bucket, w.taskDir(t), s)
+}
@@ -0,0 +1,143 @@
+/*
+Copyright © 2018 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lnashier/viper"
+	"github.com/spf13/cobra"
+	"github.com/yuzhou-wang/inmap/cloud/cloudrpc"
+)
+
+func TestQueue(t *testing.T) {
+	oldLease, oldClaim, oldPoll := leaseDuration, claimDelay, pollInterval
+	leaseDuration, claimDelay, pollInterval = time.Second, 10*time.Millisecond, 10*time.Millisecond
+	defer func() { leaseDuration, claimDelay, pollInterval = oldLease, oldClaim, oldPoll }()
+
+	os.Mkdir("testqueue", os.ModePerm)
+	defer os.RemoveAll("testqueue")
+	ctx := context.WithValue(context.Background(), "user", "test_user")
+	c, err := NewFakeClient(nil, nil, "file://testqueue", &cobra.Command{Use: "inmap"}, viper.New(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := NewQueue("test_queue", "latest", 1)
+	q.Workers, q.Retries = 2, 1
+	for _, task := range []*cloudrpc.JobSpec{
+		{Name: "ok", Cmd: []string{"true"}, Args: []string{"--InputFile", "abc.txt"},
+			FileData: map[string][]byte{"abc.txt": []byte("abc")}},
+		{Name: "fail", Cmd: []string{"false"}},
+		{Name: "interrupted", Cmd: []string{"true"}},
+		{Name: "claimed", Cmd: []string{"true"}},
+	} {
+		if err := q.Add(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, task := range []*cloudrpc.JobSpec{
+		{Name: "ok"},
+		{Name: "a/b"},
+		{Name: "other", FileData: map[string][]byte{"abc.txt": []byte("xyz")}},
+	} {
+		if err := q.Add(task); err == nil {
+			t.Errorf("adding task %s should cause an error", task.Name)
+		}
+	}
+	js, err := q.JobSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	workers, err := c.stageQueue(ctx, js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if workers != 2 {
+		t.Errorf("workers: have %d, want 2", workers)
+	}
+	var staged queueSpec
+	if err := json.Unmarshal(js.FileData[queueFile], &staged); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := staged.Tasks[0].Args[1], "file://testqueue/test_user/test_queue/abc.txt"; have != want {
+		t.Errorf("staged input file: have %s, want %s", have, want)
+	}
+	if err := c.stageInputs(ctx, js); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := js.Args[1], "file://testqueue/test_user/test_queue/queue.json"; have != want {
+		t.Errorf("queue location: have %s, want %s", have, want)
+	}
+
+	// One task was interrupted and one is claimed by a worker that
+	// will be interrupted.
+	bucket, err := OpenBucket(ctx, "file://testqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.Close()
+	for name, expires := range map[string]time.Time{
+		"interrupted": time.Now().Add(-time.Second),
+		"claimed":     time.Now().Add(100 * time.Millisecond),
+	} {
+		s := &taskState{Worker: "other", Expires: expires, Attempts: 1}
+		if err := writeTaskState(ctx, bucket, "test_user/test_queue/"+name, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Work(ctx, js.Args[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]cloudrpc.Status{
+		"ok":          cloudrpc.Status_Complete,
+		"fail":        cloudrpc.Status_Failed,
+		"interrupted": cloudrpc.Status_Complete,
+		"claimed":     cloudrpc.Status_Complete,
+		"missing":     cloudrpc.Status_Missing,
+	} {
+		s, err := c.Status(ctx, &cloudrpc.JobName{Name: "test_queue/" + name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Status != want {
+			t.Errorf("task %s: have status %s, want %s", name, s.Status, want)
+		}
+	}
+	s, err := readTaskState(ctx, bucket, "test_user/test_queue/fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Attempts != 2 || !strings.Contains(s.Err, "attempt 2") {
+		t.Errorf("failed task should have been attempted twice: %+v", s)
+	}
+	if _, err := c.Output(ctx, &cloudrpc.JobName{Name: "test_queue/fail"}); err == nil || !strings.Contains(err.Error(), "has failed") {
+		t.Errorf("output of failed task should cause an error but has %v", err)
+	}
+	if _, err := c.Output(ctx, &cloudrpc.JobName{Name: "test_queue/ok"}); err != nil {
+		t.Error(err)
+	}
+}
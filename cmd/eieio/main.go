@@ -0,0 +1,119 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Command eieio calculates the emissions, pollutant concentrations, and
+// health impacts that are attributable to a user-specified final demand
+// vector, such as the purchases of a single firm, using the extended
+// input-output model in package eieio.
+//
+// The final demand must be in a CSV file with a header row, commodity
+// names in the first column, and amounts in dollars in the second column.
+// The results are written in CSV format with a row for each air quality
+// model grid cell, and the totals are printed.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gonum.org/v1/gonum/mat"
+
+	"github.com/yuzhou-wang/inmap/emissions/slca"
+	"github.com/yuzhou-wang/inmap/emissions/slca/eieio"
+	"github.com/yuzhou-wang/inmap/epi"
+)
+
+var (
+	config     = flag.String("config", "${INMAP_ROOT_DIR}/emissions/slca/eieio/data/test_config.toml", "Path to the configuration file")
+	demandFile = flag.String("demand", "", "Path to the CSV file with the final demand for each commodity")
+	output     = flag.String("output", "eieio_attribution.csv", "Path where the results should be written")
+	aqm        = flag.String("aqm", "isrm", "Air quality model to use")
+	pop        = flag.String("pop", "TotalPop", "Population type to calculate health impacts for")
+	hr         = flag.String("hr", "NasariACS", "Hazard ratio function to calculate health impacts with")
+	year       = flag.Int("year", 2011, "Analysis year")
+	location   = flag.String("location", "domestic", "Location of the demand to include: domestic, imported, or total")
+)
+
+func main() {
+	flag.Parse()
+	if *demandFile == "" {
+		log.Fatal("the -demand flag must be specified")
+	}
+	var loc eieio.Location
+	switch strings.ToLower(*location) {
+	case "domestic":
+		loc = eieio.Domestic
+	case "imported":
+		loc = eieio.Imported
+	case "total":
+		loc = eieio.Total
+	default:
+		log.Fatalf("invalid location `%s`", *location)
+	}
+
+	f, err := os.Open(os.ExpandEnv(*config))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var c eieio.SpatialConfig
+	_, err = toml.DecodeReader(f, &c)
+	f.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	s, err := eieio.NewSpatial(&c, epi.NasariACS, epi.Krewski2009, epi.Krewski2009Ecologic, epi.Lepeule2012)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f, err = os.Open(*demandFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	demand, err := s.ReadFinalDemand(f)
+	f.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	a, err := s.Attribute(context.Background(), demand, *aqm, *pop, *hr, eieio.Year(*year), loc)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w, err := os.Create(*output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := a.WriteCSV(w); err != nil {
+		log.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, pol := range []slca.Pollutant{slca.PM25, slca.NH3, slca.NOx, slca.SOx, slca.VOC} {
+		fmt.Printf("%s emissions: %g\n", pol, mat.Sum(a.Emissions[pol]))
+	}
+	fmt.Printf("TotalPM25 deaths: %g\n", mat.Sum(a.Health[eieio.TotalPM25]))
+}
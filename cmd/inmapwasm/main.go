@@ -0,0 +1,271 @@
+//go:build js && wasm
+
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Command inmapwasm is a WebAssembly build of the InMAP source-receptor
+// (SR) matrix query and health impact calculation code, which lets
+// browser-based tools calculate the impacts of emissions entirely on the
+// client side. SR matrices are read using HTTP range requests, so they
+// must be hosted on a web server that supports them (and CORS, if on a
+// different domain). It can be built using:
+//
+//	GOOS=js GOARCH=wasm go build -o inmap.wasm ./cmd/inmapwasm
+//
+// and run using the wasm_exec.js support file from the Go distribution.
+// It adds an "inmap" object to the global scope with the functions below,
+// which all return Promises:
+//
+//	srOpen(url): open the SR matrix at url (a NetCDF file or Zarr store),
+//	    returning a handle to it.
+//	srClose(handle): close an SR matrix.
+//	srNumCells(handle): the number of grid cells in each layer.
+//	srConcentrations(handle, emis, pol): a Float64Array of the
+//	    change in the concentration of pol ("TotalPM25", "pNH4", "pNO3",
+//	    "pSO4", "SOA", or "PrimaryPM25") [μg/m³] in each grid cell caused by
+//	    the emissions in emis.
+//	srResults(handle, emis, variables): an object holding a
+//	    Float64Array of each of the output variables (e.g.,
+//	    {"Deaths": "(exp(log(1.078)/10 * TotalPM25) - 1) * TotalPop * allcause / 100000"};
+//	    see inmap.Outputter), such as health impacts, in each grid cell
+//	    caused by the emissions in emis.
+//
+// emis is an array of objects with the fields X and Y (the location of
+// the emissions in the spatial reference of the SR matrix grid), VOC, NOx,
+// NH3, SOx, and PM25 (emissions in μg/s), and, optionally, Height, Diam,
+// Temp, and Velocity.
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"syscall/js"
+
+	"github.com/ctessum/geom"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/sr"
+)
+
+// readers holds the SR matrices that have been opened, by handle.
+var readers = struct {
+	sync.Mutex
+	m    map[int]*sr.Reader
+	next int
+}{m: make(map[int]*sr.Reader)}
+
+func main() {
+	js.Global().Set("inmap", js.ValueOf(map[string]interface{}{
+		"srOpen":           js.FuncOf(srOpen),
+		"srClose":          js.FuncOf(srClose),
+		"srNumCells":       js.FuncOf(srNumCells),
+		"srConcentrations": js.FuncOf(srConcentrations),
+		"srResults":        js.FuncOf(srResults),
+	}))
+	select {} // Keep the functions available.
+}
+
+// promise runs f in a separate goroutine, because blocking operations
+// such as HTTP requests cannot be made in function callbacks, and returns
+// a JavaScript Promise of its result.
+func promise(f func() (interface{}, error)) interface{} {
+	return js.Global().Get("Promise").New(js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		resolve, reject := args[0], args[1]
+		go func() {
+			v, err := f()
+			if err != nil {
+				reject.Invoke(js.Global().Get("Error").New(err.Error()))
+				return
+			}
+			resolve.Invoke(v)
+		}()
+		return nil
+	}))
+}
+
+// reader returns the SR matrix with the handle in v.
+func reader(v js.Value) (*sr.Reader, error) {
+	readers.Lock()
+	defer readers.Unlock()
+	r, ok := readers.m[v.Int()]
+	if !ok {
+		return nil, fmt.Errorf("inmap: invalid SR matrix handle %d", v.Int())
+	}
+	return r, nil
+}
+
+func srOpen(this js.Value, args []js.Value) interface{} {
+	url := args[0].String()
+	return promise(func() (interface{}, error) {
+		r, err := sr.Open(context.Background(), url)
+		if err != nil {
+			return nil, err
+		}
+		readers.Lock()
+		defer readers.Unlock()
+		readers.next++
+		readers.m[readers.next] = r
+		return readers.next, nil
+	})
+}
+
+func srClose(this js.Value, args []js.Value) interface{} {
+	handle := args[0]
+	return promise(func() (interface{}, error) {
+		r, err := reader(handle)
+		if err != nil {
+			return nil, err
+		}
+		readers.Lock()
+		delete(readers.m, handle.Int())
+		readers.Unlock()
+		return nil, r.Close()
+	})
+}
+
+func srNumCells(this js.Value, args []js.Value) interface{} {
+	handle := args[0]
+	return promise(func() (interface{}, error) {
+		r, err := reader(handle)
+		if err != nil {
+			return nil, err
+		}
+		return len(r.Geometry()), nil
+	})
+}
+
+// emisRecord is an emissions record in the input to the functions.
+type emisRecord struct {
+	X, Y                         float64
+	VOC, NOx, NH3, SOx, PM25     float64
+	Height, Diam, Temp, Velocity float64
+}
+
+// emissions converts the JavaScript emissions records in v to
+// inmap.EmisRecords.
+func emissions(v js.Value) ([]*inmap.EmisRecord, error) {
+	var records []emisRecord
+	if err := json.Unmarshal([]byte(js.Global().Get("JSON").Call("stringify", v).String()), &records); err != nil {
+		return nil, fmt.Errorf("inmap: parsing emissions: %v", err)
+	}
+	e := make([]*inmap.EmisRecord, len(records))
+	for i, rec := range records {
+		e[i] = &inmap.EmisRecord{
+			Geom: geom.Point{X: rec.X, Y: rec.Y},
+			VOC:  rec.VOC, NOx: rec.NOx, NH3: rec.NH3, SOx: rec.SOx, PM25: rec.PM25,
+			Height: rec.Height, Diam: rec.Diam, Temp: rec.Temp, Velocity: rec.Velocity,
+		}
+	}
+	return e, nil
+}
+
+// concentrations returns the concentrations caused by the emissions
+// in v. Emissions above the top layer of the SR matrix are allocated to
+// the top layer.
+func concentrations(r *sr.Reader, v js.Value) (*sr.Concentrations, error) {
+	emis, err := emissions(v)
+	if err != nil {
+		return nil, err
+	}
+	c, err := r.Concentrations(emis...)
+	if err != nil {
+		if _, ok := err.(sr.AboveTopErr); !ok {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// float64Array converts v to a JavaScript Float64Array.
+func float64Array(v []float64) js.Value {
+	b := make([]byte, 8*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint64(b[8*i:], math.Float64bits(f))
+	}
+	u := js.Global().Get("Uint8Array").New(len(b))
+	js.CopyBytesToJS(u, b)
+	return js.Global().Get("Float64Array").New(u.Get("buffer"))
+}
+
+func srConcentrations(this js.Value, args []js.Value) interface{} {
+	handle, emis, pol := args[0], args[1], args[2].String()
+	return promise(func() (interface{}, error) {
+		r, err := reader(handle)
+		if err != nil {
+			return nil, err
+		}
+		c, err := concentrations(r, emis)
+		if err != nil {
+			return nil, err
+		}
+		var v []float64
+		switch pol {
+		case "TotalPM25":
+			v = c.TotalPM25()
+		case "pNH4":
+			v = c.PNH4
+		case "pNO3":
+			v = c.PNO3
+		case "pSO4":
+			v = c.PSO4
+		case "SOA":
+			v = c.SOA
+		case "PrimaryPM25":
+			v = c.PrimaryPM25
+		default:
+			return nil, fmt.Errorf("inmap: invalid pollutant %s", pol)
+		}
+		return float64Array(v), nil
+	})
+}
+
+func srResults(this js.Value, args []js.Value) interface{} {
+	handle, emis := args[0], args[1]
+	variables := make(map[string]string)
+	vars := args[2]
+	keys := js.Global().Get("Object").Call("keys", vars)
+	for i := 0; i < keys.Length(); i++ {
+		k := keys.Index(i).String()
+		variables[k] = vars.Get(k).String()
+	}
+	return promise(func() (interface{}, error) {
+		r, err := reader(handle)
+		if err != nil {
+			return nil, err
+		}
+		c, err := concentrations(r, emis)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.SetConcentrations(c); err != nil {
+			return nil, err
+		}
+		results, err := r.Results(variables, nil)
+		if err != nil {
+			return nil, err
+		}
+		o := make(map[string]interface{}, len(results))
+		for k, v := range results {
+			o[k] = float64Array(v)
+		}
+		return js.ValueOf(o), nil
+	})
+}
@@ -59,6 +59,8 @@ var (
 	tlsPort    = flag.String("tls-port", "10000", "Port to listen for encrypted requests")
 	port       = flag.String("port", "8080", "Port to listen for unencrypted requests")
 	bucket     = flag.String("bucket", "file://test", "Name of bucket for saving data")
+	retries    = flag.Int("retries", -1, "Number of times a failed simulation is retried; negative values use the Kubernetes default")
+	spot       = flag.Bool("spot", false, "Allow simulations to run on spot (preemptible) nodes")
 )
 
 var logger *logrus.Logger
@@ -146,6 +148,11 @@ func main() {
 		if err != nil {
 			logger.WithError(err).Fatal("failed to initialize InMAP server")
 		}
+		if *retries >= 0 {
+			r := int32(*retries)
+			inmapServer.Retries = &r
+		}
+		inmapServer.Spot = *spot
 	} else {
 		inmapServer, err = cloud.NewFakeClient(nil, nil, *bucket, cfg.Root, cfg.Viper, cfg.InputFiles(), cfg.OutputFiles())
 		if err != nil {
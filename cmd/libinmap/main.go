@@ -0,0 +1,237 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Command libinmap is a C shared library that exposes the InMAP model
+// and source-receptor (SR) matrix queries to other languages, such as
+// through the Python package in the python directory of this repository.
+// It can be built using:
+//
+//	go build -buildmode=c-shared -o libinmap.so ./cmd/libinmap
+//
+// which also creates the header file libinmap.h. Strings returned by the
+// library must be freed with inmap_free. Functions that can fail return
+// an error message, or NULL if there was no error.
+package main
+
+/*
+#include <stdlib.h>
+#include <stdint.h>
+*/
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"github.com/ctessum/geom"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/inmaputil"
+	"github.com/yuzhou-wang/inmap/sr"
+)
+
+func main() {}
+
+// readers holds the SR matrices that have been opened, by handle.
+// C code cannot hold pointers to Go memory, so handles are used instead.
+var readers = struct {
+	sync.Mutex
+	m    map[int64]*sr.Reader
+	next int64
+}{m: make(map[int64]*sr.Reader)}
+
+// cError converts err to a C string, or NULL if err is nil.
+func cError(err error) *C.char {
+	if err == nil {
+		return nil
+	}
+	return C.CString(err.Error())
+}
+
+// inmap_free frees a string that was returned by the library.
+//
+//export inmap_free
+func inmap_free(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
+
+// inmap_run runs the InMAP command-line interface with the arguments in
+// args, which is a JSON array of strings such as
+// ["run", "steady", "--config=config.toml"].
+//
+//export inmap_run
+func inmap_run(args *C.char) *C.char {
+	var a []string
+	if err := json.Unmarshal([]byte(C.GoString(args)), &a); err != nil {
+		return cError(fmt.Errorf("libinmap: parsing arguments: %v", err))
+	}
+	cfg := inmaputil.InitializeConfig()
+	cfg.Root.SetArgs(a)
+	return cError(cfg.Root.Execute())
+}
+
+// inmap_sr_open opens the SR matrix at path (see sr.Open) and stores a
+// handle to it in handle.
+//
+//export inmap_sr_open
+func inmap_sr_open(path *C.char, handle *C.int64_t) *C.char {
+	r, err := sr.Open(context.Background(), C.GoString(path))
+	if err != nil {
+		return cError(err)
+	}
+	readers.Lock()
+	defer readers.Unlock()
+	readers.next++
+	readers.m[readers.next] = r
+	*handle = C.int64_t(readers.next)
+	return nil
+}
+
+// reader returns the SR matrix with the given handle.
+func reader(handle C.int64_t) (*sr.Reader, error) {
+	readers.Lock()
+	defer readers.Unlock()
+	r, ok := readers.m[int64(handle)]
+	if !ok {
+		return nil, fmt.Errorf("libinmap: invalid SR matrix handle %d", handle)
+	}
+	return r, nil
+}
+
+// inmap_sr_close closes the SR matrix with the given handle.
+//
+//export inmap_sr_close
+func inmap_sr_close(handle C.int64_t) *C.char {
+	r, err := reader(handle)
+	if err != nil {
+		return cError(err)
+	}
+	readers.Lock()
+	delete(readers.m, int64(handle))
+	readers.Unlock()
+	return cError(r.Close())
+}
+
+// inmap_sr_ncells stores the number of grid cells in each layer of the
+// SR matrix with the given handle in n.
+//
+//export inmap_sr_ncells
+func inmap_sr_ncells(handle C.int64_t, n *C.int) *C.char {
+	r, err := reader(handle)
+	if err != nil {
+		return cError(err)
+	}
+	*n = C.int(len(r.Geometry()))
+	return nil
+}
+
+// cArray returns a Go slice that refers to the n elements of the C array a.
+func cArray(a *C.double, n C.int) []float64 {
+	return unsafe.Slice((*float64)(unsafe.Pointer(a)), int(n))
+}
+
+// inmap_sr_source stores the change in concentration of pollutant pol
+// [μg/m³ per μg/s] in each grid cell caused by emissions in the grid cell
+// with the given layer and index in out, which must have room for
+// the n grid cells in each layer (see inmap_sr_ncells).
+// pol is one of "pNH4", "pNO3", "pSO4", "SOA", or "PrimaryPM25".
+//
+//export inmap_sr_source
+func inmap_sr_source(handle C.int64_t, pol *C.char, layer, index C.int, out *C.double, n C.int) *C.char {
+	r, err := reader(handle)
+	if err != nil {
+		return cError(err)
+	}
+	v, err := r.Source(C.GoString(pol), int(layer), int(index))
+	if err != nil {
+		return cError(err)
+	}
+	if len(v) != int(n) {
+		return cError(fmt.Errorf("libinmap: output has length %d but there are %d grid cells", n, len(v)))
+	}
+	copy(cArray(out, n), v)
+	return nil
+}
+
+// emisRecord is an emissions record in the JSON input to
+// inmap_sr_concentrations. X and Y are the location of the emissions
+// in the spatial reference of the SR matrix grid, and the other
+// fields are the same as in inmap.EmisRecord.
+type emisRecord struct {
+	X, Y                         float64
+	VOC, NOx, NH3, SOx, PM25     float64
+	Height, Diam, Temp, Velocity float64
+}
+
+// inmap_sr_concentrations stores the change in the concentration of
+// pollutant pol [μg/m³] in each grid cell caused by the emissions in
+// emis, after accounting for plume rise, in out, which must have room for
+// the n grid cells in each layer. emis is a JSON array of objects with
+// the fields X, Y, VOC, NOx, NH3, SOx, PM25 (emissions in μg/s), Height,
+// Diam, Temp, and Velocity. pol is "TotalPM25" or one of the pollutants
+// accepted by inmap_sr_source.
+//
+//export inmap_sr_concentrations
+func inmap_sr_concentrations(handle C.int64_t, emis, pol *C.char, out *C.double, n C.int) *C.char {
+	r, err := reader(handle)
+	if err != nil {
+		return cError(err)
+	}
+	var records []emisRecord
+	if err := json.Unmarshal([]byte(C.GoString(emis)), &records); err != nil {
+		return cError(fmt.Errorf("libinmap: parsing emissions: %v", err))
+	}
+	e := make([]*inmap.EmisRecord, len(records))
+	for i, rec := range records {
+		e[i] = &inmap.EmisRecord{
+			Geom: geom.Point{X: rec.X, Y: rec.Y},
+			VOC:  rec.VOC, NOx: rec.NOx, NH3: rec.NH3, SOx: rec.SOx, PM25: rec.PM25,
+			Height: rec.Height, Diam: rec.Diam, Temp: rec.Temp, Velocity: rec.Velocity,
+		}
+	}
+	c, err := r.Concentrations(e...)
+	if err != nil {
+		if _, ok := err.(sr.AboveTopErr); !ok {
+			return cError(err)
+		}
+	}
+	var v []float64
+	switch p := C.GoString(pol); p {
+	case "TotalPM25":
+		v = c.TotalPM25()
+	case "pNH4":
+		v = c.PNH4
+	case "pNO3":
+		v = c.PNO3
+	case "pSO4":
+		v = c.PSO4
+	case "SOA":
+		v = c.SOA
+	case "PrimaryPM25":
+		v = c.PrimaryPM25
+	default:
+		return cError(fmt.Errorf("libinmap: invalid pollutant %s", p))
+	}
+	if len(v) != int(n) {
+		return cError(fmt.Errorf("libinmap: output has length %d but there are %d grid cells", n, len(v)))
+	}
+	copy(cArray(out, n), v)
+	return nil
+}
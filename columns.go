@@ -0,0 +1,102 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+)
+
+// verticalCoordinates are the model variables that are added to output
+// for all vertical layers so that the layer of each row can be identified.
+var verticalCoordinates = []string{"Layer", "LayerHeight", "Dz"}
+
+// ColumnResults returns the vertical integrals of the output variables
+// of o over the column of grid cells above each ground-level cell,
+// in the form of map[variable][row]value, where the rows correspond to
+// the ground-level cells. The value in each cell is multiplied by
+// the thickness of the cell (Dz [m]), so, for example, a concentration in
+// μg/m³ becomes a column density in μg/m². In layers where the grid is
+// coarser than at ground level, the cell that contains the center of the
+// ground-level cell is used.
+func (d *InMAP) ColumnResults(o *Outputter) (map[string][]float64, error) {
+	all := *o
+	all.allLayers = true
+	results, err := d.Results(&all)
+	if err != nil {
+		return nil, err
+	}
+	cells := d.cells.array()
+	rows := make(map[*Cell]int, len(cells))
+	for i, c := range cells {
+		rows[c] = i
+	}
+	var nGround int
+	for _, c := range cells {
+		if c.Layer != 0 {
+			break
+		}
+		nGround++
+	}
+
+	output := make(map[string][]float64, len(results))
+	for v := range results {
+		output[v] = make([]float64, nGround)
+	}
+	for i, g := range cells[:nGround] {
+		center := g.Centroid()
+		for c := g; !c.boundary; c = c.cellAbove(center) {
+			row := rows[c]
+			for v, vals := range results {
+				output[v][i] += vals[row] * c.Dz
+			}
+		}
+	}
+	return output, nil
+}
+
+// cellAbove returns the cell above c that contains point p, or the first
+// cell above c if none of them contain p.
+func (c *Cell) cellAbove(p geom.Point) *Cell {
+	for _, above := range c.above {
+		if b := above.Bounds(); b.Min.X <= p.X && p.X < b.Max.X && b.Min.Y <= p.Y && p.Y < b.Max.Y {
+			return above.Cell
+		}
+	}
+	return c.above[0].Cell
+}
+
+// OutputColumns returns a function that writes the vertical integrals of
+// the output variables of o (see ColumnResults) for each ground-level
+// grid cell to fileName, in any of the formats supported by Output.
+// sr is the spatial reference of the model grid.
+func (o *Outputter) OutputColumns(sr *proj.SR, fileName string) DomainManipulator {
+	return func(d *InMAP) error {
+		results, err := d.ColumnResults(o)
+		if err != nil {
+			return err
+		}
+		cells := d.cells.array()
+		for _, vals := range results {
+			cells = cells[:len(vals)]
+			break
+		}
+		return writeGridResults(fileName, sr, cells, results)
+	}
+}
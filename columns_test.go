@@ -0,0 +1,182 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap_test
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/ctessum/geom/proj"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/science/chem/simplechem"
+)
+
+func TestColumnResults(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := inmap.VarGridTestData()
+	emis := inmap.NewEmissions()
+	var m simplechem.Mechanism
+
+	d := &inmap.InMAP{
+		InitFuncs: []inmap.DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// The column integral of one is the height of the top of the grid.
+	var tops []float64
+	for _, g := range d.Cells() {
+		if g.Layer != 0 {
+			continue
+		}
+		p := g.Centroid()
+		var top float64
+		for _, c := range d.Cells() {
+			if b := c.Bounds(); b.Min.X <= p.X && p.X < b.Max.X && b.Min.Y <= p.Y && p.Y < b.Max.Y {
+				top = math.Max(top, c.LayerHeight+c.Dz)
+			}
+		}
+		tops = append(tops, top)
+	}
+	o, err := inmap.NewOutputter("", false, map[string]string{"Height": "Dz / Dz"}, nil, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := d.ColumnResults(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nGround := len(tops)
+	if len(r["Height"]) != nGround {
+		t.Fatalf("have %d columns, want %d", len(r["Height"]), nGround)
+	}
+	for i, h := range r["Height"] {
+		if math.Abs(h-tops[i]) > 1.e-6*tops[i] {
+			t.Errorf("column %d: have height %g, want %g", i, h, tops[i])
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "columns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sr, err := proj.Parse(inmap.TestGridSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(dir, "columns.shp")
+	if err := o.OutputColumns(sr, fileName)(d); err != nil {
+		t.Fatal(err)
+	}
+	dec, err := shp.NewDecoder(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	var n int
+	for {
+		var rec struct {
+			geom.Polygon
+			Height float64
+		}
+		if more := dec.DecodeRow(&rec); !more {
+			break
+		}
+		if math.Abs(rec.Height-tops[n]) > 1.e-6*tops[n] {
+			t.Errorf("row %d: have height %g, want %g", n, rec.Height, tops[n])
+		}
+		n++
+	}
+	if err := dec.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if n != nGround {
+		t.Errorf("have %d rows, want %d", n, nGround)
+	}
+}
+
+func TestOutputAllLayers(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := inmap.VarGridTestData()
+	emis := inmap.NewEmissions()
+	var m simplechem.Mechanism
+
+	dir, err := os.MkdirTemp("", "alllayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "output.shp")
+	o, err := inmap.NewOutputter(fileName, true, map[string]string{"WindSpeed": "WindSpeed"}, nil, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, err := proj.Parse(inmap.TestGridSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &inmap.InMAP{
+		InitFuncs: []inmap.DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+		},
+		CleanupFuncs: []inmap.DomainManipulator{o.Output(sr)},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+
+	dec, err := shp.NewDecoder(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	cells := d.Cells()
+	var n int
+	for {
+		var rec struct {
+			geom.Polygon
+			Layer       float64
+			LayerHeight float64
+			Dz          float64
+		}
+		if more := dec.DecodeRow(&rec); !more {
+			break
+		}
+		c := cells[n]
+		if int(rec.Layer) != c.Layer || math.Abs(rec.LayerHeight-c.LayerHeight) > 1.e-6 || math.Abs(rec.Dz-c.Dz) > 1.e-6 {
+			t.Errorf("row %d: have layer %g, height %g, thickness %g; want %d, %g, %g",
+				n, rec.Layer, rec.LayerHeight, rec.Dz, c.Layer, c.LayerHeight, c.Dz)
+		}
+		n++
+	}
+	if err := dec.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(cells) {
+		t.Errorf("have %d rows, want %d", n, len(cells))
+	}
+}
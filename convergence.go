@@ -0,0 +1,250 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+)
+
+// ConvergenceCriterion is a test of whether a steady-state simulation
+// has converged, which is used by ConvergenceCheck.
+type ConvergenceCriterion interface {
+	// Check compares the state of the simulation in d with the state at
+	// the previous check, previous, which is nil if there has not been
+	// a previous check. It returns the state to compare with at the next
+	// check, the relative change since the previous check in each of the
+	// quantities named by Names, and whether the simulation has
+	// converged.
+	Check(d *InMAP, m Mechanism, previous []float64) (state, change []float64, converged bool)
+
+	// Names returns the names of the quantities whose changes are
+	// returned by Check.
+	Names(m Mechanism) []string
+}
+
+// MassAndPopulationChange is a ConvergenceCriterion under which a
+// simulation has converged when the relative changes in both the total
+// mass and the population-weighted concentration of each species in the
+// domain are less than Tolerance. It is the criterion used by
+// SteadyStateConvergenceCheck.
+type MassAndPopulationChange struct {
+	// PopGridColumn is the name of the population type used to weight
+	// the concentrations, as in VarGridConfig.PopGridColumn.
+	PopGridColumn string
+
+	Tolerance float64
+}
+
+// Check implements ConvergenceCriterion.
+func (cr MassAndPopulationChange) Check(d *InMAP, m Mechanism, previous []float64) (state, change []float64, converged bool) {
+	popIndex := d.PopIndices[cr.PopGridColumn]
+	state = make([]float64, m.Len()*2)
+	for ii := 0; ii < m.Len(); ii++ {
+		for _, c := range *d.cells {
+			state[ii*2] += c.Cf[ii] * c.Volume
+		}
+		for _, c := range *d.cells {
+			state[ii*2+1] += c.Cf[ii] * c.PopData[popIndex]
+		}
+	}
+	change, converged = sumsConverged(state, previous, cr.Tolerance)
+	return state, change, converged
+}
+
+// Names implements ConvergenceCriterion.
+func (cr MassAndPopulationChange) Names(m Mechanism) []string {
+	var names []string
+	for _, n := range speciesNames(m) {
+		names = append(names, n, n+" pop-wtd")
+	}
+	return names
+}
+
+// PopulationWeightedChange is a ConvergenceCriterion under which a
+// simulation has converged when the relative change in the
+// population-weighted concentration of each species in the domain is
+// less than Tolerance.
+type PopulationWeightedChange struct {
+	// PopGridColumn is the name of the population type used to weight
+	// the concentrations, as in VarGridConfig.PopGridColumn.
+	PopGridColumn string
+
+	Tolerance float64
+}
+
+// Check implements ConvergenceCriterion.
+func (cr PopulationWeightedChange) Check(d *InMAP, m Mechanism, previous []float64) (state, change []float64, converged bool) {
+	popIndex := d.PopIndices[cr.PopGridColumn]
+	state = make([]float64, m.Len())
+	for ii := range state {
+		for _, c := range *d.cells {
+			state[ii] += c.Cf[ii] * c.PopData[popIndex]
+		}
+	}
+	change, converged = sumsConverged(state, previous, cr.Tolerance)
+	return state, change, converged
+}
+
+// Names implements ConvergenceCriterion.
+func (cr PopulationWeightedChange) Names(m Mechanism) []string {
+	names := speciesNames(m)
+	for i, n := range names {
+		names[i] = n + " pop-wtd"
+	}
+	return names
+}
+
+// sumsConverged returns the relative change between each of the values
+// in state and previous, and whether all of the changes are within
+// tolerance. If previous is not the same length as state, the previous
+// values are assumed to be zero.
+func sumsConverged(state, previous []float64, tolerance float64) ([]float64, bool) {
+	if len(previous) != len(state) {
+		previous = make([]float64, len(state))
+	}
+	change := make([]float64, len(state))
+	converged := true
+	for i, v := range state {
+		var ok bool
+		if change[i], ok = checkConvergence(v, previous[i], tolerance); !ok {
+			converged = false
+		}
+	}
+	return change, converged
+}
+
+// MaxCellChange is a ConvergenceCriterion under which a simulation has
+// converged when, for each species, the largest change in concentration
+// in any grid cell is less than Tolerance times the largest
+// concentration in any grid cell.
+type MaxCellChange struct {
+	Tolerance float64
+}
+
+// Check implements ConvergenceCriterion.
+func (cr MaxCellChange) Check(d *InMAP, m Mechanism, previous []float64) (state, change []float64, converged bool) {
+	return cellsConverged(d, m, previous, cr.Tolerance, func(diff, c []float64) float64 {
+		var maxDiff, maxC float64
+		for i := range diff {
+			maxDiff = math.Max(maxDiff, math.Abs(diff[i]))
+			maxC = math.Max(maxC, math.Abs(c[i]))
+		}
+		return relativeChange(maxDiff, maxC)
+	})
+}
+
+// Names implements ConvergenceCriterion.
+func (cr MaxCellChange) Names(m Mechanism) []string {
+	names := speciesNames(m)
+	for i, n := range names {
+		names[i] = n + " max cell"
+	}
+	return names
+}
+
+// L2NormChange is a ConvergenceCriterion under which a simulation has
+// converged when, for each species, the L2 norm of the change in
+// concentration across all grid cells is less than Tolerance times the
+// L2 norm of the concentrations.
+type L2NormChange struct {
+	Tolerance float64
+}
+
+// Check implements ConvergenceCriterion.
+func (cr L2NormChange) Check(d *InMAP, m Mechanism, previous []float64) (state, change []float64, converged bool) {
+	return cellsConverged(d, m, previous, cr.Tolerance, func(diff, c []float64) float64 {
+		var sumDiff, sumC float64
+		for i := range diff {
+			sumDiff += diff[i] * diff[i]
+			sumC += c[i] * c[i]
+		}
+		return relativeChange(math.Sqrt(sumDiff), math.Sqrt(sumC))
+	})
+}
+
+// Names implements ConvergenceCriterion.
+func (cr L2NormChange) Names(m Mechanism) []string {
+	names := speciesNames(m)
+	for i, n := range names {
+		names[i] = n + " L2 norm"
+	}
+	return names
+}
+
+// cellsConverged returns the concentrations of each species in each
+// grid cell in d, the change in each species since previous as
+// calculated by norm from the changes and the concentrations in each
+// grid cell, and whether all of the changes are within tolerance.
+// If the number of grid cells has changed since previous, as can happen
+// with a dynamic grid, the simulation has not converged.
+func cellsConverged(d *InMAP, m Mechanism, previous []float64, tolerance float64, norm func(diff, c []float64) float64) (state, change []float64, converged bool) {
+	nSpecies, nCells := m.Len(), d.cells.len()
+	state = make([]float64, nSpecies*nCells) // species-major order
+	for i, c := range *d.cells {
+		for ii := 0; ii < nSpecies; ii++ {
+			state[ii*nCells+i] = c.Cf[ii]
+		}
+	}
+	change = make([]float64, nSpecies)
+	if len(previous) != len(state) {
+		for ii := range change {
+			change[ii] = math.Inf(1)
+		}
+		return state, change, false
+	}
+	converged = true
+	diff := make([]float64, nCells)
+	for ii := range change {
+		c := state[ii*nCells : (ii+1)*nCells]
+		p := previous[ii*nCells : (ii+1)*nCells]
+		for i := range diff {
+			diff[i] = c[i] - p[i]
+		}
+		change[ii] = norm(diff, c)
+		if !(math.Abs(change[ii]) <= tolerance) {
+			converged = false
+		}
+	}
+	return state, change, converged
+}
+
+// relativeChange returns diff / norm, or zero if they are both zero.
+func relativeChange(diff, norm float64) float64 {
+	if diff == 0 {
+		return 0
+	}
+	return diff / norm
+}
+
+// speciesNames returns the names of the m.Len() species that are
+// simulated by m. Mechanisms may also output species that are not
+// simulated, such as PrimaryPM10, after the simulated ones.
+func speciesNames(m Mechanism) []string {
+	species := m.Species()
+	names := make([]string, m.Len())
+	for i := range names {
+		if i < len(species) {
+			names[i] = species[i]
+		} else {
+			names[i] = fmt.Sprintf("species %d", i)
+		}
+	}
+	return names
+}
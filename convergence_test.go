@@ -0,0 +1,101 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"testing"
+)
+
+func TestConvergenceCriteria(t *testing.T) {
+	const tol = 1.e-10
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	m := Mech{}
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, NewEmissions(), m),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	cells := d.Cells()
+	for _, c := range cells {
+		for ii := range c.Cf {
+			c.Cf[ii] = 1
+		}
+	}
+	n := float64(len(cells))
+
+	for _, test := range []struct {
+		name      string
+		criterion ConvergenceCriterion
+		want      float64 // change in species 0
+	}{
+		{
+			name:      "mass and population",
+			criterion: MassAndPopulationChange{PopGridColumn: cfg.PopGridColumn, Tolerance: 0.001},
+			want: 0.1 * cells[0].Volume / func() (v float64) {
+				for _, c := range cells {
+					v += c.Volume
+				}
+				return
+			}(),
+		},
+		{
+			name:      "max cell",
+			criterion: MaxCellChange{Tolerance: 0.001},
+			want:      0.1 / 1.1,
+		},
+		{
+			name:      "L2 norm",
+			criterion: L2NormChange{Tolerance: 0.001},
+			want:      0.1 / math.Sqrt(n-1+1.1*1.1),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cells[0].Cf[0] = 1
+			state, change, converged := test.criterion.Check(d, m, nil)
+			if converged {
+				t.Errorf("should not be converged at the first check: %v", change)
+			}
+			if len(change) != len(test.criterion.Names(m)) {
+				t.Errorf("there are %d changes but %d names", len(change), len(test.criterion.Names(m)))
+			}
+			if _, change, converged = test.criterion.Check(d, m, state); !converged {
+				t.Errorf("should be converged if nothing has changed: %v", change)
+			}
+			cells[0].Cf[0] = 1.1
+			_, change, converged = test.criterion.Check(d, m, state)
+			if converged {
+				t.Errorf("should not be converged: %v", change)
+			}
+			if different(change[0], test.want, tol) {
+				t.Errorf("change: have %g, want %g", change[0], test.want)
+			}
+		})
+	}
+	cells[0].Cf[0] = 1
+
+	// If the grid changes, the simulation has not converged.
+	state, _, _ := L2NormChange{Tolerance: 0.001}.Check(d, m, nil)
+	if _, _, converged := (L2NormChange{Tolerance: 0.001}).Check(d, m, state[1:]); converged {
+		t.Error("should not be converged after the grid changes")
+	}
+}
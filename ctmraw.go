@@ -0,0 +1,185 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"unsafe"
+
+	"github.com/ctessum/sparse"
+)
+
+// rawCTMMagic identifies CTM data in the binary layout written by
+// CTMData.WriteRaw.
+const rawCTMMagic = "INMAPCTM"
+
+// rawCTMHeader describes CTM data in the binary layout written by
+// CTMData.WriteRaw.
+type rawCTMHeader struct {
+	DataVersion    string
+	Xo, Yo, Dx, Dy float64
+	Nx, Ny, Nz     int
+	Vars           []rawCTMVar
+}
+
+// rawCTMVar describes a variable in CTM data in the binary layout
+// written by CTMData.WriteRaw. Offset is the location of its data,
+// in bytes from the beginning of the file.
+type rawCTMVar struct {
+	Name, Description, Units string
+	Dims                     []string
+	Shape                    []int
+	Offset                   int64
+}
+
+// WriteRaw writes d to w in a binary layout that can be read much more
+// quickly than the NetCDF format written by Write, and whose arrays can be
+// used in place from memory, for example from a memory-mapped file (see
+// ReadRawCTMData). The layout is specific to this version of InMAP and is
+// intended for caching CTM data rather than for sharing it. It consists of
+// an identifier, the length of a gob-encoded header, the header, and the
+// data of each variable as little-endian float64 values aligned to 8 bytes.
+func (d *CTMData) WriteRaw(w io.Writer) error {
+	names := make([]string, 0, len(d.Data))
+	for name := range d.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := rawCTMHeader{
+		DataVersion: InMAPDataVersion,
+		Xo:          d.xo, Yo: d.yo, Dx: d.dx, Dy: d.dy,
+		Nx: d.nx, Ny: d.ny,
+	}
+	if v, ok := d.Data["UAvg"]; ok {
+		h.Nz = v.Data.Shape[0]
+	}
+	for _, name := range names {
+		v := d.Data[name]
+		h.Vars = append(h.Vars, rawCTMVar{Name: name, Description: v.Description,
+			Units: v.Units, Dims: v.Dims, Shape: v.Data.Shape})
+	}
+
+	// The offsets depend on the length of the header, and the length of
+	// the header depends on the offsets, so make room for the largest
+	// offsets and pad the rest.
+	var enc bytes.Buffer
+	for i := range h.Vars {
+		h.Vars[i].Offset = math.MaxInt64
+	}
+	if err := gob.NewEncoder(&enc).Encode(h); err != nil {
+		return fmt.Errorf("inmap: writing raw CTM data: %v", err)
+	}
+	offset := rawCTMAlign(int64(len(rawCTMMagic) + 8 + enc.Len()))
+	headerLen := offset - int64(len(rawCTMMagic)+8)
+	for i, v := range h.Vars {
+		h.Vars[i].Offset = offset
+		offset += int64(8 * len(d.Data[v.Name].Data.Elements))
+	}
+	enc.Reset()
+	if err := gob.NewEncoder(&enc).Encode(h); err != nil {
+		return fmt.Errorf("inmap: writing raw CTM data: %v", err)
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(rawCTMMagic)
+	binary.Write(bw, binary.LittleEndian, uint64(headerLen))
+	bw.Write(enc.Bytes())
+	bw.Write(make([]byte, headerLen-int64(enc.Len())))
+	buf := make([]byte, 8)
+	for _, v := range h.Vars {
+		for _, val := range d.Data[v.Name].Data.Elements {
+			binary.LittleEndian.PutUint64(buf, math.Float64bits(val))
+			bw.Write(buf)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("inmap: writing raw CTM data: %v", err)
+	}
+	return nil
+}
+
+// rawCTMAlign rounds n up to a multiple of 8.
+func rawCTMAlign(n int64) int64 { return (n + 7) / 8 * 8 }
+
+// ReadRawCTMData reads CTM data in the binary layout written by
+// CTMData.WriteRaw from b. If the byte order of this computer is
+// little-endian, the arrays of the returned data refer to the memory of
+// b instead of being copied, so b must not be modified while the data is
+// in use.
+func ReadRawCTMData(b []byte) (*CTMData, error) {
+	if len(b) < len(rawCTMMagic)+8 || string(b[:len(rawCTMMagic)]) != rawCTMMagic {
+		return nil, fmt.Errorf("inmap: reading raw CTM data: invalid format")
+	}
+	headerLen := binary.LittleEndian.Uint64(b[len(rawCTMMagic):])
+	start := uint64(len(rawCTMMagic) + 8)
+	if headerLen > uint64(len(b))-start {
+		return nil, fmt.Errorf("inmap: reading raw CTM data: invalid header length")
+	}
+	var h rawCTMHeader
+	if err := gob.NewDecoder(bytes.NewReader(b[start : start+headerLen])).Decode(&h); err != nil {
+		return nil, fmt.Errorf("inmap: reading raw CTM data: %v", err)
+	}
+	if h.DataVersion != InMAPDataVersion {
+		return nil, fmt.Errorf("inmap: reading raw CTM data: data version %s is incompatible "+
+			"with the required version %s", h.DataVersion, InMAPDataVersion)
+	}
+
+	d := &CTMData{xo: h.Xo, yo: h.Yo, dx: h.Dx, dy: h.Dy, nx: h.Nx, ny: h.Ny}
+	for _, v := range h.Vars {
+		n := 1
+		for _, s := range v.Shape {
+			n *= s
+		}
+		if v.Offset < 0 || v.Offset%8 != 0 || uint64(v.Offset)+8*uint64(n) > uint64(len(b)) {
+			return nil, fmt.Errorf("inmap: reading raw CTM data: invalid location for variable %s", v.Name)
+		}
+		data := &sparse.DenseArray{Shape: v.Shape, Elements: rawFloat64s(b[v.Offset:v.Offset+8*int64(n)], n)}
+		data.Fix()
+		d.AddVariable(v.Name, v.Dims, v.Description, v.Units, data)
+	}
+	d.makeCTMgrid(h.Nz)
+	return d, nil
+}
+
+// nativeLittleEndian is whether the byte order of this computer is
+// little-endian.
+var nativeLittleEndian = binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+
+// rawFloat64s returns the n little-endian float64 values in b, which
+// refers to the memory of b if possible.
+func rawFloat64s(b []byte, n int) []float64 {
+	if n == 0 {
+		return []float64{}
+	}
+	if nativeLittleEndian && uintptr(unsafe.Pointer(&b[0]))%8 == 0 {
+		return unsafe.Slice((*float64)(unsafe.Pointer(&b[0])), n)
+	}
+	o := make([]float64, n)
+	for i := range o {
+		o[i] = math.Float64frombits(binary.LittleEndian.Uint64(b[8*i:]))
+	}
+	return o
+}
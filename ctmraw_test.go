@@ -0,0 +1,51 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestRawCTMData(t *testing.T) {
+	_, want := CreateTestCTMData()
+	var b bytes.Buffer
+	if err := want.WriteRaw(&b); err != nil {
+		t.Fatal(err)
+	}
+	have, err := ReadRawCTMData(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(have.Data, want.Data) {
+		t.Error("data does not match")
+	}
+	if have.xo != want.xo || have.yo != want.yo || have.dx != want.dx || have.dy != want.dy ||
+		have.nx != want.nx || have.ny != want.ny {
+		t.Errorf("grid does not match: have %+v, want %+v", have, want)
+	}
+	if have.gridTree.Size() != want.gridTree.Size() {
+		t.Errorf("grid index size: have %d, want %d", have.gridTree.Size(), want.gridTree.Size())
+	}
+
+	if _, err := ReadRawCTMData(b.Bytes()[:100]); err == nil {
+		t.Error("truncated data should cause an error")
+	}
+}
@@ -0,0 +1,537 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// isDAP returns whether path is the URL of an OPeNDAP (DAP2) dataset,
+// such as one served by a THREDDS or Hyrax server.
+func isDAP(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// dapDatasets holds the OPeNDAP datasets that have already been opened,
+// keyed by URL, so that the metadata does not need to be downloaded
+// every time a record is read.
+var dapDatasets sync.Map
+
+// openDAP opens the OPeNDAP dataset at the given URL (e.g.,
+// "https://server/thredds/dodsC/wrfout_d01_2005-01-01"). Only the
+// metadata is downloaded when the dataset is opened; variable values
+// are downloaded when they are read, and only for the requested indices.
+func openDAP(u string) (ncfFile, error) {
+	u = strings.TrimSuffix(u, ".html")
+	if d, ok := dapDatasets.Load(u); ok {
+		return d.(*dapDataset), nil
+	}
+	d := &dapDataset{url: u, client: http.DefaultClient}
+	dds, err := d.get(".dds", "")
+	if err != nil {
+		return nil, fmt.Errorf("inmap: opening OPeNDAP dataset %s: %v", u, err)
+	}
+	if d.vars, err = parseDDS(string(dds)); err != nil {
+		return nil, fmt.Errorf("inmap: opening OPeNDAP dataset %s: %v", u, err)
+	}
+	das, err := d.get(".das", "")
+	if err != nil {
+		return nil, fmt.Errorf("inmap: opening OPeNDAP dataset %s: %v", u, err)
+	}
+	if d.attrs, err = parseDAS(string(das)); err != nil {
+		return nil, fmt.Errorf("inmap: opening OPeNDAP dataset %s: %v", u, err)
+	}
+	dd, _ := dapDatasets.LoadOrStore(u, d)
+	return dd.(*dapDataset), nil
+}
+
+// dapDataset is an OPeNDAP dataset, which fulfills the ncfFile interface.
+type dapDataset struct {
+	url    string
+	client *http.Client
+	vars   map[string]*dapVar
+	attrs  map[string]map[string]interface{}
+}
+
+// dapVar is an array variable in an OPeNDAP dataset.
+type dapVar struct {
+	dtype string
+	dims  []string
+	shape []int
+}
+
+// get requests the given response type (e.g., ".dds") from the server,
+// with the given constraint expression.
+func (d *dapDataset) get(suffix, constraint string) ([]byte, error) {
+	u := d.url + suffix
+	if constraint != "" {
+		// Brackets need to be escaped for some servers.
+		u += "?" + url.PathEscape(constraint)
+	}
+	resp, err := d.client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s: %s", u, resp.Status, bytes.TrimSpace(b))
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("Error {")) {
+		return nil, fmt.Errorf("%s: %s", u, bytes.TrimSpace(b))
+	}
+	return b, nil
+}
+
+// Variables helps fulfill the ncfFile interface.
+func (d *dapDataset) Variables() []string {
+	o := make([]string, 0, len(d.vars))
+	for name := range d.vars {
+		o = append(o, name)
+	}
+	sort.Strings(o)
+	return o
+}
+
+// Lengths helps fulfill the ncfFile interface.
+func (d *dapDataset) Lengths(varName string) []int {
+	v, ok := d.vars[varName]
+	if !ok {
+		return nil
+	}
+	return v.shape
+}
+
+// Dimensions helps fulfill the ncfFile interface.
+func (d *dapDataset) Dimensions(varName string) []string {
+	v, ok := d.vars[varName]
+	if !ok {
+		return nil
+	}
+	return v.dims
+}
+
+// Attribute helps fulfill the ncfFile interface. Global attributes
+// are those in the NC_GLOBAL attribute container.
+func (d *dapDataset) Attribute(varName, attribute string) interface{} {
+	if varName == "" {
+		varName = "NC_GLOBAL"
+	}
+	return d.attrs[varName][attribute]
+}
+
+// Close helps fulfill the ncfFile interface. The dataset is kept open
+// so that it can be reused.
+func (d *dapDataset) Close() error { return nil }
+
+// Read helps fulfill the ncfFile interface.
+func (d *dapDataset) Read(varName string, start, end []int) (interface{}, error) {
+	v, ok := d.vars[varName]
+	if !ok {
+		return nil, fmt.Errorf("variable %s is not in the OPeNDAP dataset", varName)
+	}
+	if start == nil {
+		start, end = make([]int, len(v.shape)), v.shape
+	}
+	if len(start) != len(v.shape) || len(end) != len(v.shape) {
+		return nil, fmt.Errorf("variable %s has %d dimensions but %d were requested", varName, len(v.shape), len(start))
+	}
+	n := 1
+	constraint := varName
+	for i := range start {
+		if start[i] < 0 || end[i] > v.shape[i] || start[i] >= end[i] {
+			return nil, fmt.Errorf("variable %s: index range %v to %v is out of bounds for shape %v", varName, start, end, v.shape)
+		}
+		// DAP index ranges are [start:stride:stop], including the stop index.
+		constraint += fmt.Sprintf("[%d:1:%d]", start[i], end[i]-1)
+		n *= end[i] - start[i]
+	}
+	b, err := d.get(".dods", constraint)
+	if err != nil {
+		return nil, err
+	}
+	vals, err := decodeDODS(b, v.dtype, n)
+	if err != nil {
+		return nil, fmt.Errorf("variable %s: %v", varName, err)
+	}
+	return vals, nil
+}
+
+// decodeDODS decodes the values of the first array in the binary
+// DODS response b, which should contain n values of type dtype.
+// If the array is part of a Grid, its map vectors follow it and are ignored.
+func decodeDODS(b []byte, dtype string, n int) (interface{}, error) {
+	const marker = "\nData:\n"
+	i := bytes.Index(b, []byte(marker))
+	if i < 0 {
+		return nil, fmt.Errorf("invalid DODS response")
+	}
+	b = b[i+len(marker):]
+	// The number of values is stored twice.
+	if len(b) < 8 {
+		return nil, fmt.Errorf("DODS response is too short")
+	}
+	if nn := int(binary.BigEndian.Uint32(b)); nn != n {
+		return nil, fmt.Errorf("DODS response has %d values; expected %d", nn, n)
+	}
+	b = b[8:]
+	size := map[string]int{"Byte": 1, "Int16": 4, "UInt16": 4, "Int32": 4, "UInt32": 4, "Float32": 4, "Float64": 8}[dtype]
+	if len(b) < n*size {
+		return nil, fmt.Errorf("DODS response is too short")
+	}
+	switch dtype {
+	case "Float32":
+		o := make([]float32, n)
+		for i := range o {
+			o[i] = math.Float32frombits(binary.BigEndian.Uint32(b[i*4:]))
+		}
+		return o, nil
+	case "Float64":
+		o := make([]float64, n)
+		for i := range o {
+			o[i] = math.Float64frombits(binary.BigEndian.Uint64(b[i*8:]))
+		}
+		return o, nil
+	case "Int32":
+		o := make([]int32, n)
+		for i := range o {
+			o[i] = int32(binary.BigEndian.Uint32(b[i*4:]))
+		}
+		return o, nil
+	case "Int16":
+		// 16-bit integers are sent as 32-bit integers.
+		o := make([]int16, n)
+		for i := range o {
+			o[i] = int16(int32(binary.BigEndian.Uint32(b[i*4:])))
+		}
+		return o, nil
+	case "UInt16", "UInt32":
+		o := make([]float64, n)
+		for i := range o {
+			o[i] = float64(binary.BigEndian.Uint32(b[i*4:]))
+		}
+		return o, nil
+	case "Byte":
+		o := make([]float64, n)
+		for i := range o {
+			o[i] = float64(b[i])
+		}
+		return o, nil
+	default:
+		return nil, fmt.Errorf("data type %s is not supported", dtype)
+	}
+}
+
+// dapTokens splits a DDS or DAS document into tokens.
+func dapTokens(s string) []string {
+	var o []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case strings.IndexByte("{}[];=,:", c) >= 0:
+			o = append(o, s[i:i+1])
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j < len(s) {
+				j++
+			}
+			o = append(o, s[i:j])
+			i = j
+		default:
+			j := i
+			for ; j < len(s) && !unicode.IsSpace(rune(s[j])) && strings.IndexByte("{}[];=,:\"", s[j]) < 0; j++ {
+			}
+			o = append(o, s[i:j])
+			i = j
+		}
+	}
+	return o
+}
+
+// dapParser parses DAP documents.
+type dapParser struct {
+	tokens []string
+	i      int
+}
+
+func (p *dapParser) next() string {
+	if p.i >= len(p.tokens) {
+		return ""
+	}
+	t := p.tokens[p.i]
+	p.i++
+	return t
+}
+
+func (p *dapParser) peek() string {
+	if p.i >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.i]
+}
+
+func (p *dapParser) expect(t string) error {
+	if tt := p.next(); tt != t {
+		return fmt.Errorf("expected '%s' but found '%s'", t, tt)
+	}
+	return nil
+}
+
+// parseDDS parses a Dataset Descriptor Structure, returning the array
+// variables it contains. The arrays in Grids are included, but
+// the contents of Structures and Sequences are not.
+func parseDDS(dds string) (map[string]*dapVar, error) {
+	p := &dapParser{tokens: dapTokens(dds)}
+	if err := p.expect("Dataset"); err != nil {
+		return nil, fmt.Errorf("parsing DDS: %v", err)
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, fmt.Errorf("parsing DDS: %v", err)
+	}
+	vars := make(map[string]*dapVar)
+	for p.peek() != "}" && p.peek() != "" {
+		name, v, err := p.declaration()
+		if err != nil {
+			return nil, fmt.Errorf("parsing DDS: %v", err)
+		}
+		if v != nil {
+			vars[name] = v
+		}
+	}
+	if err := p.expect("}"); err != nil {
+		return nil, fmt.Errorf("parsing DDS: %v", err)
+	}
+	return vars, nil
+}
+
+// declaration parses a DDS declaration, returning the variable name and
+// the variable, which is nil if it is not an array or Grid.
+func (p *dapParser) declaration() (string, *dapVar, error) {
+	switch t := p.next(); t {
+	case "Structure", "Sequence":
+		if err := p.expect("{"); err != nil {
+			return "", nil, err
+		}
+		for p.peek() != "}" && p.peek() != "" {
+			if _, _, err := p.declaration(); err != nil {
+				return "", nil, err
+			}
+		}
+		p.next()
+		name := p.next()
+		return name, nil, p.expect(";")
+	case "Grid":
+		if err := p.expect("{"); err != nil {
+			return "", nil, err
+		}
+		if err := p.expect("ARRAY"); err != nil {
+			return "", nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return "", nil, err
+		}
+		_, v, err := p.declaration()
+		if err != nil {
+			return "", nil, err
+		}
+		if err := p.expect("MAPS"); err != nil {
+			return "", nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return "", nil, err
+		}
+		for p.peek() != "}" && p.peek() != "" {
+			if _, _, err := p.declaration(); err != nil {
+				return "", nil, err
+			}
+		}
+		p.next()
+		name := p.next()
+		return name, v, p.expect(";")
+	case "":
+		return "", nil, fmt.Errorf("unexpected end of DDS")
+	default:
+		v := &dapVar{dtype: t}
+		name := p.next()
+		for p.peek() == "[" {
+			p.next()
+			dim := ""
+			if p.i+1 < len(p.tokens) && p.tokens[p.i+1] == "=" {
+				dim = p.next()
+				p.next()
+			}
+			n, err := strconv.Atoi(p.next())
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid dimension length for %s: %v", name, err)
+			}
+			if err := p.expect("]"); err != nil {
+				return "", nil, err
+			}
+			v.dims = append(v.dims, dim)
+			v.shape = append(v.shape, n)
+		}
+		if err := p.expect(";"); err != nil {
+			return "", nil, err
+		}
+		if len(v.shape) == 0 {
+			// Scalars are treated as arrays of length one.
+			v.shape = []int{1}
+			v.dims = []string{""}
+		}
+		return name, v, nil
+	}
+}
+
+// parseDAS parses a Dataset Attribute Structure, returning
+// the attributes of each attribute container (variable). Numeric
+// attributes are returned as slices of the corresponding type,
+// and string attributes are returned as strings.
+func parseDAS(das string) (map[string]map[string]interface{}, error) {
+	p := &dapParser{tokens: dapTokens(das)}
+	if err := p.expect("Attributes"); err != nil {
+		return nil, fmt.Errorf("parsing DAS: %v", err)
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, fmt.Errorf("parsing DAS: %v", err)
+	}
+	o := make(map[string]map[string]interface{})
+	for p.peek() != "}" && p.peek() != "" {
+		name := p.next()
+		attrs, err := p.attributes()
+		if err != nil {
+			return nil, fmt.Errorf("parsing DAS for %s: %v", name, err)
+		}
+		o[name] = attrs
+	}
+	return o, p.expect("}")
+}
+
+// attributes parses an attribute container. Nested containers are ignored.
+func (p *dapParser) attributes() (map[string]interface{}, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	o := make(map[string]interface{})
+	for p.peek() != "}" && p.peek() != "" {
+		dtype := p.next()
+		name := p.next()
+		if name == "{" { // A nested container.
+			p.i--
+			if _, err := p.attributes(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var vals []string
+		for {
+			vals = append(vals, p.next())
+			if t := p.next(); t == ";" {
+				break
+			} else if t != "," {
+				return nil, fmt.Errorf("attribute %s: expected ',' or ';' but found '%s'", name, t)
+			}
+		}
+		v, err := dapAttribute(dtype, vals)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %v", name, err)
+		}
+		o[name] = v
+	}
+	return o, p.expect("}")
+}
+
+// dapAttribute converts attribute values to the given type.
+func dapAttribute(dtype string, vals []string) (interface{}, error) {
+	switch strings.ToLower(dtype) {
+	case "string", "url":
+		s := make([]string, len(vals))
+		for i, v := range vals {
+			uq, err := strconv.Unquote(v)
+			if err != nil {
+				uq = strings.Trim(v, `"`)
+			}
+			s[i] = uq
+		}
+		return strings.Join(s, "\n"), nil
+	case "float32":
+		o := make([]float32, len(vals))
+		for i, v := range vals {
+			f, err := strconv.ParseFloat(v, 32)
+			if err != nil {
+				return nil, err
+			}
+			o[i] = float32(f)
+		}
+		return o, nil
+	case "float64":
+		o := make([]float64, len(vals))
+		for i, v := range vals {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, err
+			}
+			o[i] = f
+		}
+		return o, nil
+	case "uint32":
+		o := make([]float64, len(vals))
+		for i, v := range vals {
+			f, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			o[i] = float64(f)
+		}
+		return o, nil
+	case "int32", "int16", "uint16", "byte":
+		o := make([]int32, len(vals))
+		for i, v := range vals {
+			f, err := strconv.ParseInt(v, 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			o[i] = int32(f)
+		}
+		return o, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %s", dtype)
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDDS = `Dataset {
+    Float32 PBLH[Time = 2][south_north = 3][west_east = 4];
+    Grid {
+     ARRAY:
+        Int32 LU_INDEX[south_north = 3][west_east = 4];
+     MAPS:
+        Float64 south_north[south_north = 3];
+        Float64 west_east[west_east = 4];
+    } LU_INDEX;
+    Structure {
+        Int32 x;
+    } s;
+} wrfout_d01_2005-01-01;
+`
+
+const testDAS = `Attributes {
+    PBLH {
+        String units "m";
+        Float32 _FillValue -999.0;
+    }
+    LU_INDEX {
+    }
+    NC_GLOBAL {
+        Float32 DX 12000.0;
+        Int32 NUM_LAND_CAT 24, 25;
+        String TITLE "OUTPUT FROM \"WRF\"";
+        DODS_EXTRA {
+            String Unlimited_Dimension "Time";
+        }
+    }
+}
+`
+
+// dapTestServer is an OPeNDAP server for a dataset where the value of
+// PBLH at each index is t*100 + j*10 + i and the value of LU_INDEX is j*10 + i.
+func dapTestServer(t *testing.T) *httptest.Server {
+	rangeRE := regexp.MustCompile(`\[(\d+):1:(\d+)\]`)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, ".dds"):
+			fmt.Fprint(w, testDDS)
+		case strings.HasSuffix(r.URL.Path, ".das"):
+			fmt.Fprint(w, testDAS)
+		case strings.HasSuffix(r.URL.Path, ".dods"):
+			q, err := url.PathUnescape(r.URL.RawQuery)
+			if err != nil {
+				t.Error(err)
+			}
+			var lo, hi []int
+			for _, m := range rangeRE.FindAllStringSubmatch(q, -1) {
+				l, _ := strconv.Atoi(m[1])
+				h, _ := strconv.Atoi(m[2])
+				lo, hi = append(lo, l), append(hi, h)
+			}
+			b := new(bytes.Buffer)
+			fmt.Fprintf(b, "Dataset {\n    ...\n} x;\nData:\n")
+			var vals []int
+			if strings.HasPrefix(q, "PBLH") {
+				for k := lo[0]; k <= hi[0]; k++ {
+					for j := lo[1]; j <= hi[1]; j++ {
+						for i := lo[2]; i <= hi[2]; i++ {
+							vals = append(vals, k*100+j*10+i)
+						}
+					}
+				}
+			} else {
+				for j := lo[0]; j <= hi[0]; j++ {
+					for i := lo[1]; i <= hi[1]; i++ {
+						vals = append(vals, j*10+i)
+					}
+				}
+			}
+			binary.Write(b, binary.BigEndian, []uint32{uint32(len(vals)), uint32(len(vals))})
+			for _, v := range vals {
+				if strings.HasPrefix(q, "PBLH") {
+					binary.Write(b, binary.BigEndian, float32(v))
+				} else {
+					binary.Write(b, binary.BigEndian, int32(v))
+				}
+			}
+			w.Write(b.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestDAP(t *testing.T) {
+	srv := dapTestServer(t)
+	defer srv.Close()
+
+	f, err := ncfFromTemplate(srv.URL+"/thredds/dodsC/wrfout_d01_[DATE]", "2006-01-02",
+		time.Date(2005, time.January, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if have, want := f.Variables(), []string{"LU_INDEX", "PBLH"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("variables: have %v, want %v", have, want)
+	}
+	if have, want := f.Lengths("PBLH"), []int{2, 3, 4}; !reflect.DeepEqual(have, want) {
+		t.Errorf("lengths: have %v, want %v", have, want)
+	}
+	if have, want := f.Dimensions("LU_INDEX"), []string{"south_north", "west_east"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("dimensions: have %v, want %v", have, want)
+	}
+	for _, test := range []struct {
+		varName, attr string
+		want          interface{}
+	}{
+		{"", "DX", []float32{12000}},
+		{"", "NUM_LAND_CAT", []int32{24, 25}},
+		{"", "TITLE", `OUTPUT FROM "WRF"`},
+		{"PBLH", "units", "m"},
+		{"PBLH", "_FillValue", []float32{-999}},
+	} {
+		if have := f.Attribute(test.varName, test.attr); !reflect.DeepEqual(have, test.want) {
+			t.Errorf("attribute %s: have %#v, want %#v", test.attr, have, test.want)
+		}
+	}
+
+	data, err := readNCF("PBLH", f, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []float64{100, 101, 102, 103, 110, 111, 112, 113, 120, 121, 122, 123}
+	if !reflect.DeepEqual(data.Elements, want) {
+		t.Errorf("readNCF: have %v, want %v", data.Elements, want)
+	}
+	data, err = readNCFNoHour("LU_INDEX", f, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []float64{0, 1, 2, 3, 10, 11, 12, 13, 20, 21, 22, 23}
+	if !reflect.DeepEqual(data.Elements, want) {
+		t.Errorf("readNCFNoHour: have %v, want %v", data.Elements, want)
+	}
+	if _, err = f.Read("PBLH", []int{0, 0, 0}, []int{1, 4, 4}); err == nil {
+		t.Error("expected an out of bounds error")
+	}
+}
+
+func TestParseDDSError(t *testing.T) {
+	if _, err := parseDDS("Dataset { Float32 x[y = z]; } a;"); err == nil {
+		t.Error("expected an error for an invalid dimension length")
+	}
+	if _, err := parseDDS("Attributes {}"); err == nil {
+		t.Error("expected an error for a document that is not a DDS")
+	}
+}
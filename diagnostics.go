@@ -0,0 +1,150 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ctessum/sparse"
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/palette"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+)
+
+// WriteDiagnostics writes a quick-look map of each variable in d to
+// a PNG file named after the variable in directory dir, which is created
+// if it does not exist. Each map shows the mean of the variable over the
+// vertical layers, and the title gives its range, so that obviously wrong
+// fields (e.g., secondary organic aerosol concentrations that are all
+// zero) can be found before running a simulation.
+func (d *CTMData) WriteDiagnostics(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("inmap: writing diagnostics: %v", err)
+	}
+	names := make([]string, 0, len(d.Data))
+	for n := range d.Data {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := d.writeDiagnostic(filepath.Join(dir, name+".png"), name); err != nil {
+			return fmt.Errorf("inmap: writing diagnostics for %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// writeDiagnostic writes a map of the column mean of the named variable
+// to the PNG file at path.
+func (d *CTMData) writeDiagnostic(path, name string) error {
+	dd := d.Data[name]
+	g := &diagnosticGrid{
+		data: columnMean(dd.Data),
+		xo:   d.xo + d.dx/2,
+		yo:   d.yo + d.dy/2,
+		dx:   d.dx,
+		dy:   d.dy,
+	}
+	for _, dim := range dd.Dims {
+		// Staggered variables are at the grid cell edges.
+		switch dim {
+		case "xStagger":
+			g.xo = d.xo
+		case "yStagger":
+			g.yo = d.yo
+		}
+	}
+
+	hm := plotter.NewHeatMap(g, palette.Heat(255, 1))
+	hm.NaN = color.Black
+	min, mean, max := g.stats()
+	if math.IsInf(min, 0) { // All values are NaN.
+		min, max = 0, 0
+	}
+	hm.Min, hm.Max = min, max
+	if max == min {
+		hm.Max = min + 1 // Avoid an empty color range for uniform fields.
+	}
+
+	p, err := plot.New()
+	if err != nil {
+		return err
+	}
+	p.Title.Text = fmt.Sprintf("%s [%s]\nmin=%.4g, mean=%.4g, max=%.4g", name, dd.Units, min, mean, max)
+	p.X.Label.Text = "x"
+	p.Y.Label.Text = "y"
+	p.Add(hm)
+	return p.Save(6*vg.Inch, 5*vg.Inch, path)
+}
+
+// columnMean returns the mean of data over its first (vertical)
+// dimension if it has three dimensions, or data itself otherwise.
+func columnMean(data *sparse.DenseArray) *sparse.DenseArray {
+	if len(data.Shape) != 3 {
+		return data
+	}
+	o := sparse.ZerosDense(data.Shape[1], data.Shape[2])
+	for k := 0; k < data.Shape[0]; k++ {
+		for j := 0; j < data.Shape[1]; j++ {
+			for i := 0; i < data.Shape[2]; i++ {
+				o.AddVal(data.Get(k, j, i)/float64(data.Shape[0]), j, i)
+			}
+		}
+	}
+	return o
+}
+
+// diagnosticGrid fulfills the plotter.GridXYZ interface for a
+// two-dimensional [y, x] array on a regular grid.
+type diagnosticGrid struct {
+	data           *sparse.DenseArray
+	xo, yo, dx, dy float64
+}
+
+func (g *diagnosticGrid) Dims() (c, r int) { return g.data.Shape[1], g.data.Shape[0] }
+func (g *diagnosticGrid) Z(c, r int) float64 {
+	return g.data.Get(r, c)
+}
+func (g *diagnosticGrid) X(c int) float64 { return g.xo + g.dx*float64(c) }
+func (g *diagnosticGrid) Y(r int) float64 { return g.yo + g.dy*float64(r) }
+
+// stats returns the minimum, mean, and maximum of the non-NaN values in g.
+func (g *diagnosticGrid) stats() (min, mean, max float64) {
+	min, max = math.Inf(1), math.Inf(-1)
+	var n int
+	for _, v := range g.data.Elements {
+		if math.IsNaN(v) {
+			continue
+		}
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+		mean += v
+		n++
+	}
+	if n > 0 {
+		mean /= float64(n)
+	}
+	return min, mean, max
+}
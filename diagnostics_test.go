@@ -0,0 +1,47 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteDiagnostics(t *testing.T) {
+	_, ctmdata := CreateTestCTMData()
+	dir, err := os.MkdirTemp("", "inmap_diagnostics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ctmdata.WriteDiagnostics(dir); err != nil {
+		t.Fatal(err)
+	}
+	for name := range ctmdata.Data {
+		fi, err := os.Stat(filepath.Join(dir, name+".png"))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fi.Size() == 0 {
+			t.Errorf("%s: empty diagnostic map", name)
+		}
+	}
+}
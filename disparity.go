@@ -0,0 +1,93 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Disparity specifies demographic disparity metrics of exposure to be
+// calculated (see DisparityOutputVariables).
+type Disparity struct {
+	// Variable is an output expression for the exposure whose disparities
+	// are calculated, for example "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA".
+	Variable string
+
+	// Reference is the population that the groups are compared to, for
+	// example "TotalPop".
+	Reference string
+
+	// Groups are the demographic groups, as short names (as keys) and
+	// population variables (as values); for example,
+	// {"Black": "Black", "Wht": "WhiteNoLat"}. The names are used as the
+	// prefixes of the output variables, so they can be no longer than
+	// 5 characters.
+	Groups map[string]string
+
+	// Epsilon is the inequality aversion parameter of the Atkinson index,
+	// which should be negative for undesirable quantities such as exposure.
+	Epsilon float64
+
+	// Rank is optionally a variable that the Reference population is ranked
+	// by to calculate the concentration index of the exposure, for
+	// example per capita income.
+	Rank string
+}
+
+// DisparityOutputVariables returns output variable expressions (see
+// NewOutputter) for the demographic disparities in exposure specified
+// by d. The variables are calculated across the whole domain, so they
+// have the same value in each grid cell:
+//
+// "PopExp" and "PopAtk" are the population-weighted mean exposure and the
+// Atkinson index of exposure of the Reference population.
+//
+// "<group>Exp", "<group>Diff", "<group>Ratio", and "<group>Atk" are the
+// population-weighted mean exposure of each group, its difference from and
+// ratio to "PopExp", and the Atkinson index of exposure within the group.
+//
+// "ConcIndex" is the concentration index of exposure among the Reference
+// population ranked by Rank, if Rank is specified.
+func DisparityOutputVariables(d *Disparity) (map[string]string, error) {
+	if len(d.Groups) == 0 && d.Rank == "" {
+		return nil, nil
+	}
+	if d.Variable == "" || d.Reference == "" {
+		return nil, fmt.Errorf("inmap: disparity metrics need an exposure variable and a reference population")
+	}
+	eps := strconv.FormatFloat(d.Epsilon, 'f', -1, 64)
+	o := map[string]string{
+		"PopExp": fmt.Sprintf("{weightedmean(%s, %s)}", d.Variable, d.Reference),
+		"PopAtk": fmt.Sprintf("{atkinson(%s, %s, %s)}", d.Variable, d.Reference, eps),
+	}
+	for name, pop := range d.Groups {
+		if len(name) > 5 {
+			return nil, fmt.Errorf("inmap: disparity group name '%s' is longer than 5 characters", name)
+		}
+		o[name+"Exp"] = fmt.Sprintf("{weightedmean(%s, %s)}", d.Variable, pop)
+		o[name+"Diff"] = fmt.Sprintf("%sExp - PopExp", name)
+		o[name+"Ratio"] = fmt.Sprintf("%sExp / PopExp", name)
+		o[name+"Atk"] = fmt.Sprintf("{atkinson(%s, %s, %s)}", d.Variable, pop, eps)
+	}
+	if d.Rank != "" {
+		o["ConcIndex"] = fmt.Sprintf("{concindex(%s, %s, %s)}", d.Variable, d.Reference, d.Rank)
+	}
+	return o, nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDisparityOutputVariables(t *testing.T) {
+	d := &Disparity{
+		Variable:  "TotalPM25",
+		Reference: "TotalPop",
+		Groups:    map[string]string{"Wht": "WhiteNoLat"},
+		Epsilon:   -0.5,
+		Rank:      "Income",
+	}
+	vars, err := DisparityOutputVariables(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"PopExp":    "{weightedmean(TotalPM25, TotalPop)}",
+		"PopAtk":    "{atkinson(TotalPM25, TotalPop, -0.5)}",
+		"WhtExp":    "{weightedmean(TotalPM25, WhiteNoLat)}",
+		"WhtDiff":   "WhtExp - PopExp",
+		"WhtRatio":  "WhtExp / PopExp",
+		"WhtAtk":    "{atkinson(TotalPM25, WhiteNoLat, -0.5)}",
+		"ConcIndex": "{concindex(TotalPM25, TotalPop, Income)}",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("have %v, want %v", vars, want)
+	}
+
+	// The expressions within braces should be valid aggregate expressions.
+	modelVals := map[string]interface{}{
+		"TotalPM25":  []float64{1, 2, 3, 4},
+		"TotalPop":   []float64{4, 3, 2, 1},
+		"WhiteNoLat": []float64{4, 0, 0, 0},
+		"Income":     []float64{1, 2, 3, 4},
+	}
+	funcs := defaultOutputFunctions()
+	for v, w := range map[string]float64{"PopExp": 2, "WhtExp": 1, "ConcIndex": 0.27, "WhtAtk": 0} {
+		e := vars[v]
+		have, err := evaluateAggregates(e[1:len(e)-1], modelVals, 4, funcs)
+		if err != nil {
+			t.Fatalf("%s: %v", v, err)
+		}
+		if math.Abs(have-w) > 1.e-10 {
+			t.Errorf("%s: have %g, want %g", v, have, w)
+		}
+	}
+	if _, err := NewOutputter("", false, vars, nil, nil); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := DisparityOutputVariables(&Disparity{Variable: "x", Reference: "y", Groups: map[string]string{"TooLong": "x"}}); err == nil {
+		t.Error("long group names should cause an error")
+	}
+	if vars, err := DisparityOutputVariables(&Disparity{}); vars != nil || err != nil {
+		t.Errorf("no groups: have %v, %v", vars, err)
+	}
+}
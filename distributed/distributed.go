@@ -0,0 +1,288 @@
+/*
+Copyright © 2018 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package distributed
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/distributed/distributedrpc"
+	"google.golang.org/grpc"
+)
+
+// Comm is an inmap.Communicator that passes messages among the workers
+// in a distributed simulation over gRPC.
+type Comm struct {
+	// Timeout is the longest time that an exchange waits for the
+	// messages from the other workers. If it is zero, there is no limit.
+	Timeout time.Duration
+
+	rank    int
+	server  *grpc.Server
+	conns   []*grpc.ClientConn
+	clients []distributedrpc.WorkerClient
+
+	mu sync.Mutex
+
+	// changed is closed and replaced whenever a message is received or
+	// the Comm is closed.
+	changed chan struct{}
+	closed  bool
+
+	// sequence is the number of exchanges that have been started.
+	sequence int64
+
+	// inbox holds the messages that have been received but not yet used.
+	inbox map[messageKey]*distributedrpc.Message
+}
+
+var _ inmap.Communicator = &Comm{}
+
+// messageKey identifies a message by the rank of the worker that sent it
+// and its sequence number.
+type messageKey struct {
+	from     int
+	sequence int64
+}
+
+// New returns a Comm for the worker with the given rank, where addrs are
+// the network addresses ("host:port") of all of the workers in order of
+// rank. It listens for messages from the other workers at addrs[rank].
+// The other workers do not need to be running yet.
+func New(rank int, addrs []string) (*Comm, error) {
+	if rank < 0 || rank >= len(addrs) {
+		return nil, fmt.Errorf("distributed: rank %d is not valid for %d workers", rank, len(addrs))
+	}
+	lis, err := net.Listen("tcp", addrs[rank])
+	if err != nil {
+		return nil, fmt.Errorf("distributed: %v", err)
+	}
+	return NewWithListener(rank, lis, addrs)
+}
+
+// NewWithListener is the same as New, except that it listens for
+// messages on lis rather than at addrs[rank].
+func NewWithListener(rank int, lis net.Listener, addrs []string) (*Comm, error) {
+	if rank < 0 || rank >= len(addrs) {
+		return nil, fmt.Errorf("distributed: rank %d is not valid for %d workers", rank, len(addrs))
+	}
+	c := &Comm{
+		rank:    rank,
+		changed: make(chan struct{}),
+		inbox:   make(map[messageKey]*distributedrpc.Message),
+		conns:   make([]*grpc.ClientConn, len(addrs)),
+		clients: make([]distributedrpc.WorkerClient, len(addrs)),
+	}
+	for i, addr := range addrs {
+		if i == rank {
+			continue
+		}
+		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("distributed: connecting to worker %d: %v", i, err)
+		}
+		c.conns[i] = conn
+		c.clients[i] = distributedrpc.NewWorkerClient(conn)
+	}
+	c.server = grpc.NewServer(grpc.MaxRecvMsgSize(math.MaxInt32))
+	distributedrpc.RegisterWorkerServer(c.server, rpcServer{c})
+	go c.server.Serve(lis)
+	return c, nil
+}
+
+// Rank implements inmap.Communicator.
+func (c *Comm) Rank() int { return c.rank }
+
+// Size implements inmap.Communicator.
+func (c *Comm) Size() int { return len(c.clients) }
+
+// ExchangeIDs implements inmap.Communicator.
+func (c *Comm) ExchangeIDs(ids [][]int64) ([][]int64, error) {
+	if len(ids) != c.Size() {
+		return nil, fmt.Errorf("distributed: have IDs for %d workers but there are %d", len(ids), c.Size())
+	}
+	got, err := c.exchange(func(m *distributedrpc.Message, rank int) { m.IDs = ids[rank] })
+	if err != nil {
+		return nil, err
+	}
+	o := make([][]int64, len(got))
+	for rank, m := range got {
+		if rank == c.rank {
+			o[rank] = ids[rank]
+		} else {
+			o[rank] = m.IDs
+		}
+	}
+	return o, nil
+}
+
+// Exchange implements inmap.Communicator.
+func (c *Comm) Exchange(vals [][]float64) ([][]float64, error) {
+	if len(vals) != c.Size() {
+		return nil, fmt.Errorf("distributed: have values for %d workers but there are %d", len(vals), c.Size())
+	}
+	got, err := c.exchange(func(m *distributedrpc.Message, rank int) { m.Values = vals[rank] })
+	if err != nil {
+		return nil, err
+	}
+	o := make([][]float64, len(got))
+	for rank, m := range got {
+		if rank == c.rank {
+			o[rank] = vals[rank]
+		} else {
+			o[rank] = m.Values
+		}
+	}
+	return o, nil
+}
+
+// exchange sends a message, whose contents are set by fill, to each of the
+// other workers, and returns the messages received from each of them in
+// the same exchange. The element for this worker is nil.
+func (c *Comm) exchange(fill func(m *distributedrpc.Message, rank int)) ([]*distributedrpc.Message, error) {
+	c.mu.Lock()
+	c.sequence++
+	sequence := c.sequence
+	c.mu.Unlock()
+
+	ctx := context.Background()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	errs := make([]error, c.Size())
+	var wg sync.WaitGroup
+	for rank, client := range c.clients {
+		if rank == c.rank {
+			continue
+		}
+		m := &distributedrpc.Message{From: int32(c.rank), Sequence: sequence}
+		fill(m, rank)
+		wg.Add(1)
+		go func(rank int, client distributedrpc.WorkerClient) {
+			defer wg.Done()
+			// Wait for workers that have not started yet.
+			_, errs[rank] = client.Send(ctx, m, grpc.WaitForReady(true))
+		}(rank, client)
+	}
+	wg.Wait()
+	for rank, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("distributed: sending to worker %d: %v", rank, err)
+		}
+	}
+
+	received := func() bool {
+		for rank := range c.clients {
+			if rank != c.rank && c.inbox[messageKey{rank, sequence}] == nil {
+				return false
+			}
+		}
+		return true
+	}
+	if err := c.wait(ctx, received); err != nil {
+		return nil, fmt.Errorf("distributed: waiting for the other workers: %v", err)
+	}
+	defer c.mu.Unlock()
+	got := make([]*distributedrpc.Message, c.Size())
+	for rank := range c.clients {
+		if rank != c.rank {
+			k := messageKey{rank, sequence}
+			got[rank] = c.inbox[k]
+			delete(c.inbox, k)
+		}
+	}
+	return got, nil
+}
+
+// notify signals that the state of c has changed. The caller must
+// hold the lock.
+func (c *Comm) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait waits until ready returns true or ctx is canceled. If it returns
+// without an error, the lock is held and must be released by the caller.
+func (c *Comm) wait(ctx context.Context, ready func() bool) error {
+	for {
+		c.mu.Lock()
+		if ready() {
+			return nil
+		}
+		if c.closed {
+			c.mu.Unlock()
+			return fmt.Errorf("distributed: communicator is closed")
+		}
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close stops listening for messages from the other workers and closes
+// the connections to them. Exchanges that are waiting for messages
+// return an error.
+func (c *Comm) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.notify()
+	c.mu.Unlock()
+	if c.server != nil {
+		c.server.Stop()
+	}
+	var err error
+	for _, conn := range c.conns {
+		if conn != nil {
+			if err2 := conn.Close(); err2 != nil && err == nil {
+				err = err2
+			}
+		}
+	}
+	return err
+}
+
+// rpcServer implements distributedrpc.WorkerServer.
+type rpcServer struct {
+	c *Comm
+}
+
+// Send implements the Send gRPC method.
+func (r rpcServer) Send(ctx context.Context, m *distributedrpc.Message) (*distributedrpc.Received, error) {
+	if from := int(m.From); from < 0 || from >= r.c.Size() || from == r.c.rank {
+		return nil, fmt.Errorf("distributed: worker %d received a message from invalid worker %d", r.c.rank, from)
+	}
+	r.c.mu.Lock()
+	defer r.c.mu.Unlock()
+	r.c.inbox[messageKey{int(m.From), m.Sequence}] = m
+	r.c.notify()
+	return &distributedrpc.Received{}, nil
+}
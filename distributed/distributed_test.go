@@ -0,0 +1,123 @@
+/*
+Copyright © 2018 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package distributed_test
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yuzhou-wang/inmap/distributed"
+)
+
+// newComms returns communicators for n workers on the local computer.
+func newComms(t *testing.T, n int) []*distributed.Comm {
+	lis := make([]net.Listener, n)
+	addrs := make([]string, n)
+	for i := range lis {
+		var err error
+		if lis[i], err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = lis[i].Addr().String()
+	}
+	comms := make([]*distributed.Comm, n)
+	for i := range comms {
+		var err error
+		if comms[i], err = distributed.NewWithListener(i, lis[i], addrs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return comms
+}
+
+func TestComm_Exchange(t *testing.T) {
+	const n, exchanges = 3, 5
+	comms := newComms(t, n)
+	defer func() {
+		for _, c := range comms {
+			c.Close()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, c := range comms {
+		wg.Add(1)
+		go func(c *distributed.Comm) {
+			defer wg.Done()
+			if c.Size() != n {
+				t.Errorf("size: have %d, want %d", c.Size(), n)
+			}
+			ids := make([][]int64, n)
+			for to := range ids {
+				ids[to] = []int64{int64(c.Rank()), int64(to)}
+			}
+			got, err := c.ExchangeIDs(ids)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for from, g := range got {
+				if want := []int64{int64(from), int64(c.Rank())}; !reflect.DeepEqual(g, want) {
+					t.Errorf("worker %d IDs from %d: have %v, want %v", c.Rank(), from, g, want)
+				}
+			}
+			// Messages from different exchanges should not be mixed up.
+			for e := 0; e < exchanges; e++ {
+				vals := make([][]float64, n)
+				for to := range vals {
+					vals[to] = []float64{float64(e), float64(c.Rank()), float64(to)}
+				}
+				got, err := c.Exchange(vals)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for from, g := range got {
+					if want := []float64{float64(e), float64(from), float64(c.Rank())}; !reflect.DeepEqual(g, want) {
+						t.Errorf("worker %d exchange %d values from %d: have %v, want %v", c.Rank(), e, from, g, want)
+					}
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+}
+
+func TestComm_Timeout(t *testing.T) {
+	comms := newComms(t, 2)
+	defer comms[0].Close()
+	defer comms[1].Close()
+	comms[0].Timeout = 100 * time.Millisecond
+
+	// Worker 1 never takes part in the exchange.
+	_, err := comms[0].Exchange(make([][]float64, 2))
+	if err == nil || !strings.Contains(err.Error(), "waiting for the other workers") {
+		t.Errorf("exchange should have timed out but has error %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := distributed.New(2, []string{"127.0.0.1:0", "127.0.0.1:0"}); err == nil {
+		t.Error("invalid rank should cause an error")
+	}
+}
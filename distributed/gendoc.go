@@ -0,0 +1,30 @@
+/*
+Copyright © 2018 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Install the code generation dependencies.
+// go get -u github.com/golang/protobuf/protoc-gen-go
+
+// Generate the gRPC client/server code. (Information at https://grpc.io/docs/quickstart/go.html)
+//go:generate protoc distributed.proto --go_out=plugins=grpc,paths=source_relative:distributedrpc
+
+// Package distributed runs InMAP simulations on several computers, each
+// of which simulates one partition of the variable resolution grid (see
+// inmap.LoadPartition) and exchanges the concentrations in the cells
+// along the edges of its partition with the others over gRPC, so that
+// grids that are too large for one computer can be simulated.
+package distributed
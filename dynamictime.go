@@ -0,0 +1,148 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import "fmt"
+
+// SetCTMData returns a function that replaces the meteorology and
+// baseline concentrations in the cells of an existing grid with those
+// in data, so that a simulation can be stepped through time-resolved
+// meteorology (e.g., one file for each day). The grid and the pollutant
+// concentrations are not changed. The emissions flux is cleared, because
+// plume rise depends on the meteorology, so the emissions must be set
+// again (e.g., with SetEmissionsFlux) before the simulation continues.
+// The time step should also be set again using SetTimestepCFL.
+func SetCTMData(data *CTMData) DomainManipulator {
+	return func(d *InMAP) error {
+		if nz := data.Data["UAvg"].Data.Shape[0]; nz < d.nlayers {
+			return fmt.Errorf("inmap: setting CTM data: the data has %d layers but the grid has %d", nz, d.nlayers)
+		}
+		for _, c := range *d.cells {
+			c.clearData()
+			if err := c.loadData(data, c.Layer); err != nil {
+				return err
+			}
+			c.Volume = c.Dx * c.Dy * c.Dz
+			c.EmisFlux = nil
+		}
+		for _, c := range *d.cells {
+			// Boundary cells are copies of the cells they border.
+			for _, l := range []*cellList{&c.west, &c.east, &c.south, &c.north, &c.above} {
+				for _, b := range *l {
+					if b.boundary {
+						b.copyData(c.Cell)
+					}
+				}
+			}
+		}
+		for _, c := range *d.cells {
+			c.updateNeighborInfo()
+		}
+		return nil
+	}
+}
+
+// clearData sets the variables that are loaded from CTM data to zero.
+func (c *Cell) clearData() {
+	c.UAvg, c.VAvg, c.WAvg = 0, 0, 0
+	c.UDeviation, c.VDeviation = 0, 0
+	c.AOrgPartitioning, c.BOrgPartitioning = 0, 0
+	c.NOPartitioning, c.SPartitioning, c.NHPartitioning = 0, 0, 0
+	c.SO2oxidation = 0
+	c.BaselineO3, c.O3NOxSensitivity, c.NOxOxidation, c.VOCOxidation = 0, 0, 0, 0
+	c.SeasonalTemperature, c.SeasonalRH = [4]float64{}, [4]float64{}
+	c.ParticleDryDep, c.SO2DryDep, c.NOxDryDep, c.NH3DryDep, c.VOCDryDep = 0, 0, 0, 0, 0
+	c.CoarseParticleDryDep = 0
+	c.Kxxyy, c.Kzz = 0, 0
+	c.LayerHeight, c.Dz = 0, 0
+	c.ParticleWetDep, c.SO2WetDep, c.OtherGasWetDep = 0, 0, 0
+	c.M2u, c.M2d = 0, 0
+	c.WindSpeed, c.WindSpeedInverse = 0, 0
+	c.WindSpeedMinusThird, c.WindSpeedMinusOnePointFour = 0, 0
+	c.Temperature, c.S1, c.SClass = 0, 0, 0
+	for i := range c.CBaseline {
+		c.CBaseline[i] = 0
+	}
+}
+
+// copyData copies the variables that boundaryCopy copies from another
+// cell to the receiver, which is a boundary cell.
+func (c *Cell) copyData(from *Cell) {
+	c.Dz = from.Dz
+	c.UAvg, c.VAvg, c.WAvg = from.UAvg, from.VAvg, from.WAvg
+	c.UDeviation, c.VDeviation = from.UDeviation, from.VDeviation
+	c.Kxxyy, c.Kzz = from.Kxxyy, from.Kzz
+	c.M2u, c.M2d = from.M2u, from.M2d
+	c.LayerHeight = from.LayerHeight
+	c.Volume = c.Dx * c.Dy * c.Dz
+}
+
+// updateNeighborInfo recalculates the parts of the information about the
+// relationships between c and its neighbors that depend on the
+// meteorology. The results are the same as those of the neighborInfo
+// functions, including for boundary cells, which have the same
+// properties as c.
+func (c *Cell) updateNeighborInfo() {
+	for _, l := range []cellList{c.west, c.east, c.south, c.north} {
+		for i := range l {
+			n := &l[i]
+			n.info.diff = harmonicMean(n.Kxxyy, c.Kxxyy)
+		}
+	}
+	for _, l := range []cellList{c.above, c.below} {
+		for i := range l {
+			n := &l[i]
+			n.info.centerDistance = (n.Dz + c.Dz) / 2
+			n.info.diff = harmonicMean(n.Kzz, c.Kzz)
+		}
+	}
+}
+
+// ResetEmissionsFlux returns a function that replaces the emissions flux
+// in all the cells of an existing grid with the flux from emis, for example
+// to change the emissions rate over the course of a time-resolved
+// simulation. m is the chemical mechanism.
+func ResetEmissionsFlux(emis *Emissions, m Mechanism) DomainManipulator {
+	return func(d *InMAP) error {
+		for _, c := range *d.cells {
+			c.EmisFlux = nil
+		}
+		return d.SetEmissionsFlux(emis, m)
+	}
+}
+
+// RunFor returns a function that ends the simulation after the given
+// amount of simulated time in seconds by setting d.Done to true.
+// The last time step is shortened so that the simulated time is exact,
+// so RunFor should be the first of the RunFuncs, and the time step should
+// be set again before the simulation is continued.
+func RunFor(period float64) DomainManipulator {
+	var t float64
+	return func(d *InMAP) error {
+		if d.Dt == 0 {
+			return fmt.Errorf("timestep is zero")
+		}
+		if remaining := period - t; d.Dt >= remaining {
+			d.Dt = remaining
+			d.Done = true
+		}
+		t += d.Dt
+		return nil
+	}
+}
@@ -0,0 +1,162 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/sparse"
+)
+
+func TestSetCTMData(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	var m Mech
+
+	// Create CTM data for a different time period by scaling some
+	// of the variables.
+	data2 := *ctmdata
+	data2.Data = make(map[string]struct {
+		Dims        []string
+		Description string
+		Units       string
+		Data        *sparse.DenseArray
+	})
+	for name, v := range ctmdata.Data {
+		switch name {
+		case "Kzz", "Kxxyy", "Dz", "UAvg", "TotalPM25", "Temperature":
+			v.Data = v.Data.Copy()
+			v.Data.Scale(2)
+		}
+		data2.Data[name] = v
+	}
+
+	newGrid := func(data *CTMData) *InMAP {
+		d := &InMAP{
+			InitFuncs: []DomainManipulator{
+				cfg.RegularGrid(data, pop, popIndices, mr, mortIndices, nil, m),
+			},
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	d := newGrid(ctmdata)
+	for _, c := range d.Cells() {
+		c.Cf[0] = float64(c.Layer + 1)
+	}
+	if err := SetCTMData(&data2)(d); err != nil {
+		t.Fatal(err)
+	}
+	want := newGrid(&data2)
+
+	summary := func(d *InMAP) map[string]string {
+		o := make(map[string]string)
+		for _, c := range d.Cells() {
+			var neighbors []string
+			for _, l := range []*cellList{&c.west, &c.east, &c.south, &c.north, &c.above, &c.below} {
+				var n []string
+				for _, r := range *l {
+					n = append(n, fmt.Sprintf("%.6g,%.6g,%.6g,%.6g", r.info.diff, r.info.centerDistance, r.Kzz, r.Volume))
+				}
+				sort.Strings(n)
+				neighbors = append(neighbors, fmt.Sprint(n))
+			}
+			o[fmt.Sprint(c.Index, c.Layer)] = fmt.Sprintf("%.6g %.6g %.6g %.6g %.6g %.6g %v %v",
+				c.Kzz, c.Kxxyy, c.Dz, c.UAvg, c.Temperature, c.Volume, c.CBaseline, neighbors)
+		}
+		return o
+	}
+	have, wantSummary := summary(d), summary(want)
+	if len(have) != len(wantSummary) {
+		t.Fatalf("have %d cells, want %d", len(have), len(wantSummary))
+	}
+	for k, w := range wantSummary {
+		if h := have[k]; h != w {
+			t.Errorf("cell %s:\nhave %s\nwant %s", k, h, w)
+		}
+	}
+	for _, c := range d.Cells() {
+		if c.Cf[0] != float64(c.Layer+1) {
+			t.Errorf("concentration changed: have %g, want %d", c.Cf[0], c.Layer+1)
+		}
+		if c.EmisFlux != nil {
+			t.Error("emissions flux should be cleared")
+		}
+	}
+}
+
+func TestResetEmissionsFlux(t *testing.T) {
+	const tol = 1.e-8
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	m := Mech{}
+
+	emissions := func(pm25 float64) *Emissions {
+		emis := NewEmissions()
+		emis.Add(&EmisRecord{
+			Geom: geom.Point{X: -1000, Y: -1000},
+			PM25: pm25,
+		})
+		return emis
+	}
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emissions(1000), m),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ResetEmissionsFlux(emissions(250), m)(d); err != nil {
+		t.Fatal(err)
+	}
+	var total float64
+	for _, c := range d.Cells() {
+		total += c.EmisFlux[iPM2_5] * c.Volume
+	}
+	if different(total, 250, tol) {
+		t.Errorf("total emissions should be 250 but are %g", total)
+	}
+}
+
+func TestRunFor(t *testing.T) {
+	var iterations int
+	var totalTime float64
+	d := &InMAP{
+		Dt: 30,
+		RunFuncs: []DomainManipulator{
+			RunFor(100),
+			func(d *InMAP) error {
+				iterations++
+				totalTime += d.Dt
+				return nil
+			},
+		},
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if iterations != 4 || totalTime != 100 || d.Dt != 10 {
+		t.Errorf("have %d iterations, %g s, and Dt=%g; want 4 iterations, 100 s, and Dt=10",
+			iterations, totalTime, d.Dt)
+	}
+}
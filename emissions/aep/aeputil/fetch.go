@@ -0,0 +1,236 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package aeputil
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Fetch makes the emissions data file at location, which can be an
+// HTTP(S) URL or a local path, available in the directory cacheDir and
+// returns the paths to the files it contains. It is meant for retrieving
+// the files of an emissions modeling platform, such as the inventory
+// files and spatial surrogate shapefiles that the U.S. EPA distributes
+// with each National Emissions Inventory (NEI) year.
+//
+// Files at URLs are downloaded to cacheDir the first time they are
+// requested and reused afterwards. Archives (.zip, .tar, .tar.gz, and
+// .tgz files) are extracted to a subdirectory of cacheDir named after
+// the archive, and the paths of all of the regular files in the archive
+// are returned, unless location ends with "#" followed by a pattern
+// (as in path.Match; e.g., "inputs.zip#*/ptegu/*.csv"), in which case only
+// the paths of the files in the archive that match the pattern are
+// returned. Other files are returned as they are.
+func Fetch(ctx context.Context, location, cacheDir string) ([]string, error) {
+	var pattern string
+	if i := strings.LastIndex(location, "#"); i >= 0 {
+		location, pattern = location[:i], location[i+1:]
+	}
+	if err := os.MkdirAll(cacheDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("aeputil: creating emissions data cache: %v", err)
+	}
+	file := location
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		file = filepath.Join(cacheDir, path.Base(location))
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			if err := download(ctx, location, file); err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	name, archive := archiveName(file)
+	if !archive {
+		if pattern != "" {
+			return nil, fmt.Errorf("aeputil: %s is not an archive but a pattern (%s) is specified", location, pattern)
+		}
+		return []string{file}, nil
+	}
+	dir := filepath.Join(cacheDir, name)
+	done := filepath.Join(dir, ".extracted")
+	if _, err := os.Stat(done); os.IsNotExist(err) {
+		if err := extract(file, dir); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(done, nil, 0644); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	var files []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || p == done {
+			return err
+		}
+		if pattern != "" {
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			if ok, err := path.Match(pattern, filepath.ToSlash(rel)); err != nil {
+				return err
+			} else if !ok {
+				return nil
+			}
+		}
+		files = append(files, p)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("aeputil: listing files extracted from %s: %v", location, err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("aeputil: no files in %s match pattern '%s'", location, pattern)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// archiveName returns the name of file without its archive extension and
+// whether file is an archive that can be extracted.
+func archiveName(file string) (string, bool) {
+	base := filepath.Base(file)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar", ".zip"} {
+		if strings.HasSuffix(strings.ToLower(base), ext) {
+			return base[:len(base)-len(ext)], true
+		}
+	}
+	return base, false
+}
+
+// download downloads url to file. The data is first written to a
+// temporary file so that an interrupted download is not mistaken for
+// a complete one.
+func download(ctx context.Context, url, file string) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("aeputil: downloading %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("aeputil: downloading %s: %s", url, resp.Status)
+	}
+	tmp := file + ".part"
+	w, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		w.Close()
+		return fmt.Errorf("aeputil: downloading %s: %v", url, err)
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// extract extracts the contents of the archive file to dir.
+func extract(file, dir string) error {
+	lower := strings.ToLower(file)
+	if strings.HasSuffix(lower, ".zip") {
+		r, err := zip.OpenReader(file)
+		if err != nil {
+			return fmt.Errorf("aeputil: extracting %s: %v", file, err)
+		}
+		defer r.Close()
+		for _, zf := range r.File {
+			if zf.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				return fmt.Errorf("aeputil: extracting %s: %v", file, err)
+			}
+			err = extractFile(rc, dir, zf.Name)
+			rc.Close()
+			if err != nil {
+				return fmt.Errorf("aeputil: extracting %s: %v", file, err)
+			}
+		}
+		return nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if !strings.HasSuffix(lower, ".tar") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("aeputil: extracting %s: %v", file, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("aeputil: extracting %s: %v", file, err)
+		}
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if err = extractFile(tr, dir, h.Name); err != nil {
+			return fmt.Errorf("aeputil: extracting %s: %v", file, err)
+		}
+	}
+}
+
+// extractFile writes the contents of r to the file with the given name,
+// which is relative to dir.
+func extractFile(r io.Reader, dir, name string) error {
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	if !strings.HasPrefix(p, filepath.Clean(dir)+string(os.PathSeparator)) {
+		return fmt.Errorf("invalid file name %s", name)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+	w, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
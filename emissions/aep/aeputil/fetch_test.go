@@ -0,0 +1,113 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package aeputil
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFetch(t *testing.T) {
+	var zipData bytes.Buffer
+	zw := zip.NewWriter(&zipData)
+	for _, name := range []string{"inputs/ptegu/ptegu.csv", "inputs/nonpt/nonpt.csv", "README.txt"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/2017/inputs.zip":
+			w.Write(zipData.Bytes())
+		case "/2017/gridref.txt":
+			w.Write([]byte("gridref"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := os.MkdirTemp("", "fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		files, err := Fetch(ctx, server.URL+"/2017/inputs.zip#*/ptegu/*.csv", dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{filepath.Join(dir, "inputs", "inputs", "ptegu", "ptegu.csv")}
+		if !reflect.DeepEqual(files, want) {
+			t.Errorf("have %v, want %v", files, want)
+		}
+		b, err := os.ReadFile(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "inputs/ptegu/ptegu.csv" {
+			t.Errorf("wrong file contents %q", b)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("the archive should be downloaded once but was downloaded %d times", requests)
+	}
+
+	files, err := Fetch(ctx, server.URL+"/2017/inputs.zip", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("there should be 3 files but there are %d: %v", len(files), files)
+	}
+
+	files, err = Fetch(ctx, server.URL+"/2017/gridref.txt", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join(dir, "gridref.txt")}; !reflect.DeepEqual(files, want) {
+		t.Errorf("have %v, want %v", files, want)
+	}
+
+	if _, err = Fetch(ctx, server.URL+"/2017/missing.csv", dir); err == nil {
+		t.Error("a missing file should cause an error")
+	}
+	if _, err = Fetch(ctx, server.URL+"/2017/inputs.zip#*/onroad/*", dir); err == nil {
+		t.Error("a pattern without matches should cause an error")
+	}
+}
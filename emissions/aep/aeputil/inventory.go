@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/ctessum/unit"
@@ -33,10 +34,15 @@ type InventoryConfig struct {
 	// NEIFiles lists National Emissions Inventory emissions files.
 	// The file names can include environment variables.
 	// The format is map[sector name][list of files].
+	// SMOKE FF10 (point, daily point, nonpoint, nonroad, and onroad),
+	// ORL, and IDA files are supported; the format of each file is
+	// detected from its header. Records without point locations are
+	// allocated within their FIPS codes using spatial surrogates.
 	NEIFiles map[string][]string
 
-	// COARDSFiles lists COARDS-compliant NetCDF emission files
-	// (NetCDF 4 and greater not supported).
+	// COARDSFiles lists COARDS- or CF-compliant NetCDF emission files
+	// (NetCDF 4 and greater not supported), such as those of the
+	// EDGAR, CEDS, and HTAP inventories.
 	// Information regarding the COARDS NetCDF conventions are
 	// available here: https://ferret.pmel.noaa.gov/Ferret/documentation/coards-netcdf-conventions.
 	// The file names can include environment variables.
@@ -46,10 +52,37 @@ type InventoryConfig struct {
 	COARDSFiles map[string][]string
 
 	// COARDSYear specifies the year of emissions for COARDS emissions files.
-	// COARDS emissions are assumed to be in units of mass of emissions per year.
+	// COARDS emissions are assumed to be in units of mass of emissions per year,
+	// except for variables with units of kg m-2 s-1, which are converted
+	// to mass using the areas of the grid cells.
 	// The year will not be used for NEI emissions files.
 	COARDSYear int
 
+	// ScenarioRules gives the location of a CSV file with rules for
+	// scaling the emissions in NEIFiles and COARDSFiles, for example to
+	// represent an emissions control strategy (see ReadScenarioRules).
+	// If it is empty, the emissions are not scaled.
+	ScenarioRules string
+
+	// DeltaFiles lists emissions files in the same format as NEIFiles
+	// whose emissions are added to the emissions in NEIFiles and
+	// COARDSFiles after the ScenarioRules have been applied,
+	// for example to represent new sources.
+	// The format is map[sector name][list of files].
+	DeltaFiles map[string][]string
+
+	// SpeciationRef gives the location of a file in the SMOKE gsref
+	// format that assigns speciation profile codes to emissions records
+	// by SCC and pollutant. If it and SpeciationProfiles are set,
+	// the emissions are split into species using the profiles after the
+	// DeltaFiles have been read (see ApplySpeciationProfiles).
+	SpeciationRef string
+
+	// SpeciationProfiles gives the location of a CSV file with the
+	// speciation profiles referred to in SpeciationRef
+	// (see ReadSpeciationProfiles).
+	SpeciationProfiles string
+
 	// PolsToKeep lists pollutants from the NEI that should be kept.
 	PolsToKeep aep.Speciation
 
@@ -98,8 +131,9 @@ type InventoryConfig struct {
 }
 
 // ReadEmissions returns emissions records for the files specified
-// in the NEIFiles field in the receiver. The returned records are
-// split up by sector.
+// in the NEIFiles, COARDSFiles, and DeltaFiles fields in the receiver,
+// after applying the ScenarioRules and speciation profiles.
+// The returned records are split up by sector.
 func (c *InventoryConfig) ReadEmissions() (map[string][]aep.Record, *aep.InventoryReport, error) {
 	srgSpecs, err := readSrgSpec(c.SrgSpecSMOKE, c.SrgSpecOSM, c.PostGISURL, c.SrgShapefileDirectory, c.SCCExactMatch, "", 0)
 	if err != nil {
@@ -124,28 +158,8 @@ func (c *InventoryConfig) ReadEmissions() (map[string][]aep.Record, *aep.Invento
 
 	records := make(map[string][]aep.Record)
 	inventoryReport := new(aep.InventoryReport)
-	for sector, fileTemplates := range c.NEIFiles {
-		r.Group = sector
-
-		var files []*aep.InventoryFile
-		for _, filetemplate := range fileTemplates {
-			tempFiles, err := r.OpenFilesFromTemplate(filetemplate)
-			if err != nil {
-				return nil, nil, err
-			}
-			files = append(files, tempFiles...)
-		}
-
-		recs, sectorReport, err := r.ReadFiles(files, c.FilterFunc)
-		if err != nil {
-			return nil, nil, err
-		}
-		for _, f := range files { // Close files.
-			f.ReadSeeker.(*os.File).Close()
-		}
-		inventoryReport.AddData(sectorReport.Data...)
-
-		records[sector] = append(records[sector], recs...)
+	if err := c.readNEI(r, c.NEIFiles, records, inventoryReport); err != nil {
+		return nil, nil, err
 	}
 
 	// Read COARDS files.
@@ -186,9 +200,91 @@ func (c *InventoryConfig) ReadEmissions() (map[string][]aep.Record, *aep.Invento
 			inventoryReport.AddData(t)
 		}
 	}
+
+	if c.ScenarioRules != "" {
+		f, err := os.Open(os.ExpandEnv(c.ScenarioRules))
+		if err != nil {
+			return nil, nil, fmt.Errorf("aeputil: opening scenario rules: %v", err)
+		}
+		rules, err := ReadScenarioRules(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := ApplyScenario(records, rules); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := c.readNEI(r, c.DeltaFiles, records, inventoryReport); err != nil {
+		return nil, nil, err
+	}
+
+	if c.SpeciationRef != "" || c.SpeciationProfiles != "" {
+		if err := c.speciate(records); err != nil {
+			return nil, nil, err
+		}
+	}
 	return records, inventoryReport, nil
 }
 
+// speciate splits the emissions in records into species using the
+// SpeciationRef and SpeciationProfiles files.
+func (c *InventoryConfig) speciate(records map[string][]aep.Record) error {
+	if c.SpeciationRef == "" || c.SpeciationProfiles == "" {
+		return fmt.Errorf("aeputil: both SpeciationRef and SpeciationProfiles must be set to speciate emissions")
+	}
+	f, err := os.Open(os.ExpandEnv(c.SpeciationRef))
+	if err != nil {
+		return fmt.Errorf("aeputil: opening speciation reference: %v", err)
+	}
+	ref, err := aep.NewSpecRef(f, strings.NewReader(""))
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("aeputil: reading speciation reference: %v", err)
+	}
+	f, err = os.Open(os.ExpandEnv(c.SpeciationProfiles))
+	if err != nil {
+		return fmt.Errorf("aeputil: opening speciation profiles: %v", err)
+	}
+	profiles, err := ReadSpeciationProfiles(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return ApplySpeciationProfiles(records, ref, profiles, !c.SCCExactMatch)
+}
+
+// readNEI reads the NEI-format emissions files in fileTemplates, which
+// are grouped by sector, using r and adds the records to records and
+// a summary to report.
+func (c *InventoryConfig) readNEI(r *aep.EmissionsReader, fileTemplates map[string][]string, records map[string][]aep.Record, report *aep.InventoryReport) error {
+	for sector, templates := range fileTemplates {
+		r.Group = sector
+
+		var files []*aep.InventoryFile
+		for _, filetemplate := range templates {
+			tempFiles, err := r.OpenFilesFromTemplate(filetemplate)
+			if err != nil {
+				return err
+			}
+			files = append(files, tempFiles...)
+		}
+
+		recs, sectorReport, err := r.ReadFiles(files, c.FilterFunc)
+		if err != nil {
+			return err
+		}
+		for _, f := range files { // Close files.
+			f.ReadSeeker.(*os.File).Close()
+		}
+		report.AddData(sectorReport.Data...)
+
+		records[sector] = append(records[sector], recs...)
+	}
+	return nil
+}
+
 // A recordTotaler stores information about records.
 type recordTotaler struct {
 
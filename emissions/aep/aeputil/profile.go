@@ -0,0 +1,145 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package aeputil
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yuzhou-wang/inmap/emissions/aep"
+)
+
+// SpeciationProfiles holds the fractions of the emissions of pollutants
+// that speciation profiles assign to species, for example to split total
+// VOC emissions into the fraction that forms secondary organic aerosol,
+// or total PM2.5 emissions into elemental carbon, organic carbon, and
+// other primary PM2.5. The format is
+// map[profile code][pollutant][species]fraction.
+type SpeciationProfiles map[string]map[string]map[string]float64
+
+// ReadSpeciationProfiles reads speciation profiles from a CSV file with
+// the columns "profile", "pollutant", "species", and "fraction", in that
+// order, in the style of the profiles in the EPA SPECIATE database.
+// The first row is a header and lines that start with '#' are ignored.
+// The fractions of a profile do not need to sum to one: the remainder of
+// the emissions is dropped. For example, the following file assigns 20%
+// of VOC emissions to the SOA-forming VOC species used by InMAP for
+// profile 2487, and splits PM2.5 emissions into elemental carbon,
+// organic carbon, and other PM2.5 for profile 91112:
+//
+//	profile,pollutant,species,fraction
+//	2487,VOC,VOC,0.2
+//	91112,PM2_5,EC,0.1
+//	91112,PM2_5,OC,0.3
+//	91112,PM2_5,PM2_5,0.6
+func ReadSpeciationProfiles(r io.Reader) (SpeciationProfiles, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = 4
+	cr.TrimLeadingSpace = true
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("aeputil: reading speciation profiles: %v", err)
+	}
+	p := make(SpeciationProfiles)
+	if len(records) == 0 {
+		return p, nil
+	}
+	for i, rec := range records[1:] {
+		code := strings.TrimSpace(rec[0])
+		pol := strings.TrimSpace(rec[1])
+		species := strings.TrimSpace(rec[2])
+		frac, err := strconv.ParseFloat(strings.TrimSpace(rec[3]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("aeputil: reading speciation profile row %d: %v", i+1, err)
+		}
+		if frac < 0 {
+			return nil, fmt.Errorf("aeputil: speciation profile row %d: fraction must not be negative but is %g", i+1, frac)
+		}
+		if _, ok := p[code]; !ok {
+			p[code] = make(map[string]map[string]float64)
+		}
+		if _, ok := p[code][pol]; !ok {
+			p[code][pol] = make(map[string]float64)
+		}
+		if _, ok := p[code][pol][species]; ok {
+			return nil, fmt.Errorf("aeputil: speciation profile %s has more than one fraction for pollutant %s and species %s", code, pol, species)
+		}
+		p[code][pol][species] = frac
+	}
+	return p, nil
+}
+
+// pollutants returns the pollutants that are speciated by at least one
+// of the profiles in p.
+func (p SpeciationProfiles) pollutants() map[string]bool {
+	pols := make(map[string]bool)
+	for _, profile := range p {
+		for pol := range profile {
+			pols[pol] = true
+		}
+	}
+	return pols
+}
+
+// ApplySpeciationProfiles splits the emissions in emis, which are grouped
+// by sector, into species using profiles. The profile codes of each
+// record and pollutant are looked up in ref, and if ref
+// assigns more than one profile, the results are weighted by their
+// fractions. Pollutants that are not in any of the profiles are not
+// changed. If partialMatch is true, records whose SCC codes are not in
+// ref are assigned the profiles of more general SCC codes.
+func ApplySpeciationProfiles(emis map[string][]aep.Record, ref *aep.SpecRef, profiles SpeciationProfiles, partialMatch bool) error {
+	pols := profiles.pollutants()
+	if len(pols) == 0 {
+		return nil
+	}
+	for _, recs := range emis {
+		for _, rec := range recs {
+			f := func(p aep.Pollutant, begin, end time.Time) (map[string]float64, error) {
+				if !pols[p.Name] {
+					return nil, nil
+				}
+				codes, err := ref.Codes(rec.GetSCC(), p, begin, end, rec.GetCountry(), rec.GetFIPS(), partialMatch)
+				if err != nil {
+					return nil, fmt.Errorf("aeputil: speciating %s: %v", rec.Key(), err)
+				}
+				fracs := make(map[string]float64)
+				for code, codeFrac := range codes {
+					profile, ok := profiles[code][p.Name]
+					if !ok {
+						return nil, fmt.Errorf("aeputil: speciating %s: no profile %s for pollutant %s", rec.Key(), code, p.Name)
+					}
+					for species, frac := range profile {
+						fracs[species] += codeFrac * frac
+					}
+				}
+				return fracs, nil
+			}
+			if err := rec.GetEmissions().Split(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
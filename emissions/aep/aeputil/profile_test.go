@@ -0,0 +1,104 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package aeputil
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadSpeciationProfiles(t *testing.T) {
+	const profiles = `# Example profiles.
+profile,pollutant,species,fraction
+2487,VOC,VOC,0.2
+91112,PM2_5,EC,0.1
+91112, PM2_5, OC, 0.3
+`
+	have, err := ReadSpeciationProfiles(strings.NewReader(profiles))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SpeciationProfiles{
+		"2487":  {"VOC": {"VOC": 0.2}},
+		"91112": {"PM2_5": {"EC": 0.1, "OC": 0.3}},
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	for _, bad := range []string{
+		"profile,pollutant,species,fraction\n2487,VOC,VOC,-0.2\n",
+		"profile,pollutant,species,fraction\n2487,VOC,VOC,0.2\n2487,VOC,VOC,0.3\n",
+	} {
+		if _, err := ReadSpeciationProfiles(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q should cause an error", bad)
+		}
+	}
+}
+
+func TestInventory_speciation(t *testing.T) {
+	base := sccPollutantTotals(t, func(*InventoryConfig) {})
+
+	profileFile := filepath.Join(t.TempDir(), "profiles.csv")
+	const profiles = `profile,pollutant,species,fraction
+2487,VOC,VOC,0.2
+91112,PM2_5,EC,0.1
+91112,PM2_5,OC,0.3
+91112,PM2_5,PM2_5,0.6
+`
+	if err := os.WriteFile(profileFile, []byte(profiles), 0644); err != nil {
+		t.Fatal(err)
+	}
+	speciated := sccPollutantTotals(t, func(c *InventoryConfig) {
+		c.SpeciationRef = "testdata/specref.txt"
+		c.SpeciationProfiles = profileFile
+	})
+
+	want := make(map[string]float64)
+	for k, v := range base {
+		scc := strings.Fields(k)[0]
+		switch {
+		case strings.HasSuffix(k, " VOC"):
+			want[k] = 0.2 * v
+		case strings.HasSuffix(k, " PM2_5"):
+			want[k] = 0.6 * v
+			want[scc+" EC"] = 0.1 * v
+			want[scc+" OC"] = 0.3 * v
+		default:
+			want[k] = v
+		}
+	}
+	if len(speciated) != len(want) {
+		t.Errorf("have %d SCC-species combinations, want %d", len(speciated), len(want))
+	}
+	for k, w := range want {
+		if have := speciated[k]; math.Abs(have-w) > 1.e-8*w {
+			t.Errorf("%s: have %g, want %g", k, have, w)
+		}
+	}
+
+	c := &InventoryConfig{SpeciationRef: "testdata/specref.txt"}
+	if err := c.speciate(nil); err == nil {
+		t.Error("speciation without SpeciationProfiles should cause an error")
+	}
+}
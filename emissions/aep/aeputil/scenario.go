@@ -0,0 +1,158 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package aeputil
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/yuzhou-wang/inmap/emissions/aep"
+)
+
+// ScenarioRule specifies a factor by which the emissions that match all
+// of its non-empty criteria should be multiplied, for example to
+// represent an emissions control strategy. A Factor of zero removes the
+// matching emissions.
+type ScenarioRule struct {
+	// Sector is the name of the sector (i.e., the key in
+	// InventoryConfig.NEIFiles or InventoryConfig.COARDSFiles).
+	Sector string
+
+	// SCC is the source classification code or the first characters of it.
+	SCC string
+
+	// FIPS is the FIPS code of the location of the emissions or the first
+	// characters of it, e.g. "06" for California or "06037" for
+	// Los Angeles County.
+	FIPS string
+
+	// FacilityID is the facility (plant) identifier of point sources.
+	FacilityID string
+
+	// Pollutant is the name of the pollutant.
+	Pollutant string
+
+	// Factor is the scaling factor.
+	Factor float64
+}
+
+// matches returns whether the emissions of pollutant pol in record rec
+// in the given sector match the criteria of r.
+func (r *ScenarioRule) matches(sector string, rec aep.Record, pol aep.Pollutant) bool {
+	if r.Sector != "" && r.Sector != sector {
+		return false
+	}
+	if r.SCC != "" && !strings.HasPrefix(rec.GetSCC(), r.SCC) {
+		return false
+	}
+	if r.FIPS != "" && !strings.HasPrefix(rec.GetFIPS(), r.FIPS) {
+		return false
+	}
+	if r.FacilityID != "" && facilityID(rec) != r.FacilityID {
+		return false
+	}
+	if r.Pollutant != "" && r.Pollutant != pol.Name {
+		return false
+	}
+	return true
+}
+
+// facilityID returns the facility identifier of rec, or "" if rec is not
+// a point source.
+func facilityID(rec aep.Record) string {
+	if p, ok := rec.(interface{ PointData() *aep.PointSourceData }); ok {
+		if pd := p.PointData(); pd != nil {
+			return pd.PlantID
+		}
+	}
+	return ""
+}
+
+// ReadScenarioRules reads emissions scenario rules from a CSV file with
+// the columns "sector", "SCC", "FIPS", "facility", "pollutant", and
+// "factor", in that order. The first row is a header, lines that start
+// with '#' are ignored, and empty fields match all emissions.
+// For example, the following file scales NOx emissions from the
+// "ptegu" sector in California by 0.7 and removes the emissions from
+// facility 12345:
+//
+//	sector,SCC,FIPS,facility,pollutant,factor
+//	ptegu,,06,,NOx,0.7
+//	,,,12345,,0
+func ReadScenarioRules(r io.Reader) ([]ScenarioRule, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = 6
+	cr.TrimLeadingSpace = true
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("aeputil: reading scenario rules: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	rules := make([]ScenarioRule, len(records)-1)
+	for i, rec := range records[1:] {
+		factor, err := strconv.ParseFloat(strings.TrimSpace(rec[5]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("aeputil: reading scenario rule %d: %v", i+1, err)
+		}
+		if factor < 0 {
+			return nil, fmt.Errorf("aeputil: scenario rule %d: factor must not be negative but is %g", i+1, factor)
+		}
+		rules[i] = ScenarioRule{
+			Sector:     strings.TrimSpace(rec[0]),
+			SCC:        strings.TrimSpace(rec[1]),
+			FIPS:       strings.TrimSpace(rec[2]),
+			FacilityID: strings.TrimSpace(rec[3]),
+			Pollutant:  strings.TrimSpace(rec[4]),
+			Factor:     factor,
+		}
+	}
+	return rules, nil
+}
+
+// ApplyScenario scales the given emissions records, which are
+// grouped by sector, according to rules. When more than one rule matches
+// the same emissions, the factors are multiplied together.
+func ApplyScenario(emis map[string][]aep.Record, rules []ScenarioRule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	for sector, recs := range emis {
+		for _, rec := range recs {
+			f := func(p aep.Pollutant) (float64, error) {
+				factor := 1.
+				for i := range rules {
+					if rules[i].matches(sector, rec, p) {
+						factor *= rules[i].Factor
+					}
+				}
+				return factor, nil
+			}
+			if err := rec.GetEmissions().Scale(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
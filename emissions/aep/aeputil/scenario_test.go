@@ -0,0 +1,160 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package aeputil
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ctessum/unit"
+	"github.com/yuzhou-wang/inmap/emissions/aep"
+)
+
+func TestReadScenarioRules(t *testing.T) {
+	const rules = `# A control strategy.
+sector,SCC,FIPS,facility,pollutant,factor
+ptegu,,06,,NOx,0.7
+, , ,12345, ,0
+`
+	have, err := ReadScenarioRules(strings.NewReader(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ScenarioRule{
+		{Sector: "ptegu", FIPS: "06", Pollutant: "NOx", Factor: 0.7},
+		{FacilityID: "12345", Factor: 0},
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have %+v, want %+v", have, want)
+	}
+
+	if _, err := ReadScenarioRules(strings.NewReader("sector,SCC,FIPS,facility,pollutant,factor\n,,,,,-1\n")); err == nil {
+		t.Error("a negative factor should cause an error")
+	}
+}
+
+func TestApplyScenario(t *testing.T) {
+	begin := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+	newRecord := func(scc, fips, plant string) *aep.PointRecord {
+		r := &aep.PointRecord{
+			SourceData:      aep.SourceData{SCC: scc, FIPS: fips, Country: aep.USA},
+			PointSourceData: aep.PointSourceData{PlantID: plant},
+		}
+		r.Emissions.Add(begin, end, "NOx", "", unit.New(1, unit.Dimensions{unit.MassDim: 1, unit.TimeDim: -1}))
+		r.Emissions.Add(begin, end, "SOx", "", unit.New(1, unit.Dimensions{unit.MassDim: 1, unit.TimeDim: -1}))
+		return r
+	}
+	emis := map[string][]aep.Record{
+		"ptegu": {newRecord("0010100101", "06037", "1"), newRecord("0010100101", "36061", "12345")},
+		"other": {newRecord("2280003010", "06037", "2")},
+	}
+	rules := []ScenarioRule{
+		{Sector: "ptegu", FIPS: "06", Pollutant: "NOx", Factor: 0.7},
+		{FacilityID: "12345", Factor: 0},
+		{SCC: "228", Factor: 2},
+		{SCC: "2280003010", Pollutant: "SOx", Factor: 0.5},
+	}
+	if err := ApplyScenario(emis, rules); err != nil {
+		t.Fatal(err)
+	}
+	secPerYear := end.Sub(begin).Seconds()
+	for _, test := range []struct {
+		rec      aep.Record
+		nox, sox float64 // Scaling factors
+	}{
+		{rec: emis["ptegu"][0], nox: 0.7, sox: 1},
+		{rec: emis["ptegu"][1], nox: 0, sox: 0},
+		{rec: emis["other"][0], nox: 2, sox: 1},
+	} {
+		totals := test.rec.Totals()
+		nox := totals[aep.Pollutant{Name: "NOx"}].Value() / secPerYear
+		sox := totals[aep.Pollutant{Name: "SOx"}].Value() / secPerYear
+		if math.Abs(nox-test.nox) > 1.e-10 || math.Abs(sox-test.sox) > 1.e-10 {
+			t.Errorf("%s: have NOx %g and SOx %g, want %g and %g", test.rec.Key(), nox, sox, test.nox, test.sox)
+		}
+	}
+}
+
+// sccPollutantTotals returns the total emissions of each SCC and
+// pollutant in the example configuration after it has been modified by
+// setup.
+func sccPollutantTotals(t *testing.T, setup func(*InventoryConfig)) map[string]float64 {
+	type config struct {
+		Inventory InventoryConfig
+	}
+	cfg := new(config)
+	if _, err := toml.DecodeFile("testdata/example_config.toml", cfg); err != nil {
+		t.Fatal(err)
+	}
+	setup(&cfg.Inventory)
+	emis, _, err := cfg.Inventory.ReadEmissions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	totals := make(map[string]float64)
+	for _, recs := range emis {
+		for _, rec := range recs {
+			for pol, v := range rec.Totals() {
+				totals[rec.GetSCC()+" "+pol.Name] += v.Value()
+			}
+		}
+	}
+	return totals
+}
+
+func TestInventory_scenario(t *testing.T) {
+	base := sccPollutantTotals(t, func(*InventoryConfig) {})
+
+	rulesFile := filepath.Join(t.TempDir(), "rules.csv")
+	const rules = `sector,SCC,FIPS,facility,pollutant,factor
+,2280003010,,,NOX,0.5
+othar,,36,,SO2,0
+`
+	if err := os.WriteFile(rulesFile, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	scenario := sccPollutantTotals(t, func(c *InventoryConfig) {
+		c.ScenarioRules = rulesFile
+		c.DeltaFiles = map[string][]string{"othar": {"testdata/testemis.csv"}}
+	})
+
+	if len(scenario) != len(base) {
+		t.Fatalf("have %d SCC-pollutant combinations, want %d", len(scenario), len(base))
+	}
+	for k, b := range base {
+		// The delta inventory is the same as the base inventory.
+		want := 2 * b
+		switch {
+		case k == "2280003010 NOX":
+			want = 1.5 * b
+		case strings.HasSuffix(k, " SO2"):
+			want = b
+		}
+		if have := scenario[k]; math.Abs(have-want) > 1.e-8*want {
+			t.Errorf("%s: have %g, want %g", k, have, want)
+		}
+	}
+}
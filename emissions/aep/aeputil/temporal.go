@@ -0,0 +1,214 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package aeputil
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TemporalProfiles holds monthly, day-of-week, and hour-of-day profiles
+// that disaggregate annual emissions totals in time in the style of the
+// SMOKE temporal allocation. Each profile is keyed by an SCC code (or the
+// first characters of one) or by a sector name, and the empty key
+// holds the default profile for emissions that do not match any other key.
+type TemporalProfiles struct {
+	// Monthly holds the fraction of annual emissions in each month,
+	// starting with January.
+	Monthly map[string][12]float64
+
+	// Weekly holds the fraction of weekly emissions on each day of the
+	// week, starting with Monday.
+	Weekly map[string][7]float64
+
+	// Diurnal holds the fraction of daily emissions in each hour of the
+	// day, starting with the hour beginning at midnight.
+	Diurnal map[string][24]float64
+}
+
+// ReadTemporalProfiles reads temporal profiles from a CSV file where the
+// first column is the key (an SCC code, the first characters of one, or a
+// sector name; empty for the default profile), the second column is the
+// profile type ("monthly", "weekly", or "diurnal"), and the remaining
+// columns are the 12, 7, or 24 factors of the profile. The factors are
+// normalized so that they sum to one. Lines that start with '#' are
+// ignored, and there is no header. For example, the following file
+// assigns more emissions to winter months for residential wood
+// combustion (SCC 2104008...) and a weekday-heavy profile to the
+// "onroad" sector:
+//
+//	2104008,monthly,20,15,10,5,3,2,2,2,3,8,12,18
+//	onroad,weekly,1.1,1.1,1.1,1.1,1.1,0.8,0.7
+func ReadTemporalProfiles(r io.Reader) (*TemporalProfiles, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("aeputil: reading temporal profiles: %v", err)
+	}
+	p := &TemporalProfiles{
+		Monthly: make(map[string][12]float64),
+		Weekly:  make(map[string][7]float64),
+		Diurnal: make(map[string][24]float64),
+	}
+	for i, rec := range records {
+		if len(rec) < 2 {
+			return nil, fmt.Errorf("aeputil: temporal profile row %d: too few columns", i+1)
+		}
+		key := strings.TrimSpace(rec[0])
+		typ := strings.ToLower(strings.TrimSpace(rec[1]))
+		factors, err := normalizeTemporalFactors(rec[2:])
+		if err != nil {
+			return nil, fmt.Errorf("aeputil: temporal profile row %d: %v", i+1, err)
+		}
+		var n int
+		var exists bool
+		switch typ {
+		case "monthly":
+			n = 12
+			_, exists = p.Monthly[key]
+		case "weekly":
+			n = 7
+			_, exists = p.Weekly[key]
+		case "diurnal":
+			n = 24
+			_, exists = p.Diurnal[key]
+		default:
+			return nil, fmt.Errorf("aeputil: temporal profile row %d: invalid profile type %q", i+1, rec[1])
+		}
+		if len(factors) != n {
+			return nil, fmt.Errorf("aeputil: temporal profile row %d: %s profile has %d factors but should have %d", i+1, typ, len(factors), n)
+		}
+		if exists {
+			return nil, fmt.Errorf("aeputil: there is more than one %s temporal profile for %q", typ, key)
+		}
+		switch typ {
+		case "monthly":
+			var v [12]float64
+			copy(v[:], factors)
+			p.Monthly[key] = v
+		case "weekly":
+			var v [7]float64
+			copy(v[:], factors)
+			p.Weekly[key] = v
+		case "diurnal":
+			var v [24]float64
+			copy(v[:], factors)
+			p.Diurnal[key] = v
+		}
+	}
+	return p, nil
+}
+
+// normalizeTemporalFactors parses the factors in s and normalizes them
+// so that they sum to one.
+func normalizeTemporalFactors(s []string) ([]float64, error) {
+	o := make([]float64, len(s))
+	var sum float64
+	for i, v := range s {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, err
+		}
+		if f < 0 {
+			return nil, fmt.Errorf("factors must not be negative but factor %d is %g", i+1, f)
+		}
+		o[i] = f
+		sum += f
+	}
+	if sum == 0 {
+		return nil, fmt.Errorf("factors must not all be zero")
+	}
+	for i := range o {
+		o[i] /= sum
+	}
+	return o, nil
+}
+
+// matchTemporalKey returns the key among keys that matches scc and sector.
+// SCC codes are matched first, using the longest key that scc starts with,
+// then the sector name, and then the default (empty) key. ok is false
+// if no key matches.
+func matchTemporalKey(keys func(string) bool, sector, scc string) (key string, ok bool) {
+	for i := len(scc); i > 0; i-- {
+		if keys(scc[:i]) {
+			return scc[:i], true
+		}
+	}
+	if sector != "" && keys(sector) {
+		return sector, true
+	}
+	if keys("") {
+		return "", true
+	}
+	return "", false
+}
+
+// Key returns an identifier for the combination of monthly, weekly, and
+// diurnal profiles that apply to emissions with the given sector
+// and SCC code. Emissions with the same key have the same temporal
+// variation.
+func (p *TemporalProfiles) Key(sector, scc string) string {
+	m, mok := matchTemporalKey(func(k string) bool { _, ok := p.Monthly[k]; return ok }, sector, scc)
+	w, wok := matchTemporalKey(func(k string) bool { _, ok := p.Weekly[k]; return ok }, sector, scc)
+	d, dok := matchTemporalKey(func(k string) bool { _, ok := p.Diurnal[k]; return ok }, sector, scc)
+	f := func(k string, ok bool) string {
+		if !ok {
+			return "-"
+		}
+		return strconv.Quote(k)
+	}
+	return f(m, mok) + "," + f(w, wok) + "," + f(d, dok)
+}
+
+// Factor returns the factor by which the annual average emissions rate
+// of emissions with the given sector and SCC code should be multiplied
+// to get the emissions rate at time t. The month, day of the week, and
+// hour of t are used as they are, so t should be in the time zone of
+// the emissions. The monthly factors account for the number of days in
+// each month, so the annual total is not changed; the weekly and diurnal
+// factors keep the total of each full week and day, respectively.
+// Emissions that do not match any profile of a given type are constant
+// in time at that scale.
+func (p *TemporalProfiles) Factor(sector, scc string, t time.Time) float64 {
+	factor := 1.
+	if k, ok := matchTemporalKey(func(k string) bool { _, ok := p.Monthly[k]; return ok }, sector, scc); ok {
+		year := t.Year()
+		daysInYear := time.Date(year+1, 1, 1, 0, 0, 0, 0, time.UTC).Sub(time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)).Hours() / 24
+		daysInMonth := float64(time.Date(year, t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day())
+		factor *= p.Monthly[k][t.Month()-1] * daysInYear / daysInMonth
+	}
+	if k, ok := matchTemporalKey(func(k string) bool { _, ok := p.Weekly[k]; return ok }, sector, scc); ok {
+		// time.Weekday starts with Sunday.
+		factor *= p.Weekly[k][(t.Weekday()+6)%7] * 7
+	}
+	if k, ok := matchTemporalKey(func(k string) bool { _, ok := p.Diurnal[k]; return ok }, sector, scc); ok {
+		factor *= p.Diurnal[k][t.Hour()] * 24
+	}
+	return factor
+}
+
+// HasDiurnal returns whether any of the profiles vary by hour of day.
+func (p *TemporalProfiles) HasDiurnal() bool { return len(p.Diurnal) > 0 }
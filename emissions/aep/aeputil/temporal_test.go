@@ -0,0 +1,88 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package aeputil
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTemporalProfiles(t *testing.T) {
+	const profiles = `# Example profiles.
+2104008,monthly,2,1,1,1,1,1,1,1,1,1,1,2
+onroad,weekly,1,1,1,1,1,0.5,0.5
+,diurnal,0,0,0,0,0,0,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,0,0
+`
+	p, err := ReadTemporalProfiles(strings.NewReader(profiles))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.HasDiurnal() {
+		t.Error("profiles should vary by hour")
+	}
+
+	// Monday, January 6, 2014, at noon.
+	noon := time.Date(2014, time.January, 6, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		sector, scc string
+		t           time.Time
+		want        float64
+	}{
+		{"nonpt", "2104008100", noon, 2. / 14 * 365 / 31 * 24. / 16},
+		{"onroad", "2201001000", noon, 7. / 6 * 24. / 16},
+		{"onroad", "2201001000", noon.Add(5 * 24 * time.Hour), 3.5 / 6 * 24. / 16},
+		{"onroad", "2201001000", noon.Add(-12 * time.Hour), 0},
+		{"ptegu", "", noon, 24. / 16},
+	}
+	for _, test := range tests {
+		if have := p.Factor(test.sector, test.scc, test.t); math.Abs(have-test.want) > 1.e-10 {
+			t.Errorf("%s %s %v: have %g, want %g", test.sector, test.scc, test.t, have, test.want)
+		}
+	}
+
+	// The monthly factors should not change the annual total.
+	var total float64
+	for d := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC); d.Year() == 2014; d = d.Add(time.Hour) {
+		total += p.Factor("nonpt", "2104008100", d)
+	}
+	if want := 365. * 24; math.Abs(total-want) > 1.e-6 {
+		t.Errorf("annual total: have %g, want %g", total, want)
+	}
+
+	if p.Key("nonpt", "2104008100") == p.Key("nonpt", "2104009000") {
+		t.Error("keys should be different")
+	}
+	if p.Key("nonpt", "2104009000") != p.Key("ptegu", "") {
+		t.Error("keys should be the same")
+	}
+
+	for _, bad := range []string{
+		"x,monthly,1,1,1\n",
+		"x,yearly,1\n",
+		"x,weekly,1,1,1,1,1,1,-1\n",
+		"x,weekly,0,0,0,0,0,0,0\n",
+		"x,weekly,1,1,1,1,1,1,1\nx,weekly,1,1,1,1,1,1,1\n",
+	} {
+		if _, err := ReadTemporalProfiles(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q should cause an error", bad)
+		}
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"math"
 	"os"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/ctessum/cdf"
@@ -44,9 +45,18 @@ func gridPointsToGridSpacing(gridPoints []float64, i int) float64 {
 
 // readCOARDSVar eads a floating point variable from a COARDS file.
 // It will return nil if the variable is not floating point.
-func readCOARDSVar(nc *cdf.File, v string) ([]float64, error) {
-	r := nc.Reader(v, nil, nil)
-	dataI := r.Zero(-1)
+// end is the index of the last element to read, which is required
+// for record variables; it can be nil for other variables.
+func readCOARDSVar(nc *cdf.File, v string, end []int) ([]float64, error) {
+	r := nc.Reader(v, nil, end)
+	n := -1 // The length of a non-record variable.
+	if end != nil {
+		n = 1
+		for _, e := range end {
+			n *= e + 1
+		}
+	}
+	dataI := r.Zero(n)
 	switch dataI.(type) {
 	case []float32, []float64:
 	default:
@@ -90,6 +100,10 @@ func readCOARDSVar(nc *cdf.File, v string) ([]float64, error) {
 	return data, nil
 }
 
+// earthRadius is the mean radius of the Earth [m], which is used to
+// calculate the areas of grid cells for emissions fluxes.
+const earthRadius = 6371000.
+
 // Raster is a holder for gridded data.
 type Raster struct {
 	units      InputUnits
@@ -97,6 +111,19 @@ type Raster struct {
 	sourceData SourceData
 	lats, lons []float64
 	variables  map[string][]float64
+
+	// flux specifies the variables that are emissions fluxes
+	// [kg m-2 s-1] rather than amounts in units.
+	flux map[string]bool
+}
+
+// cellArea returns the area [m²] of the longitude-latitude grid cell
+// with the given bounds [degrees].
+func cellArea(b *geom.Bounds) float64 {
+	const degToRad = math.Pi / 180
+	lat := func(y float64) float64 { return math.Max(-90, math.Min(90, y)) * degToRad }
+	return earthRadius * earthRadius * (b.Max.X - b.Min.X) * degToRad *
+		math.Abs(math.Sin(lat(b.Max.Y))-math.Sin(lat(b.Min.Y)))
 }
 
 // Bounds returns the bounding box of the grid.
@@ -107,6 +134,19 @@ func (r *Raster) Bounds() *geom.Bounds {
 	}
 }
 
+// cellBounds returns the bounds of the grid cell at latitude index j
+// and longitude index i.
+func (r *Raster) cellBounds(j, i int) *geom.Bounds {
+	dy := gridPointsToGridSpacing(r.lats, j)
+	dx := gridPointsToGridSpacing(r.lons, i)
+	y := r.lats[j]
+	x := r.lons[i]
+	return &geom.Bounds{
+		Min: geom.Point{X: x - dx/2, Y: y - math.Abs(dy/2)},
+		Max: geom.Point{X: x + dx/2, Y: y + math.Abs(dy/2)},
+	}
+}
+
 // RecordGenerator returns a function that generates the emissions
 // records from the receiver within the given bounding box.
 // The generator will return io.EOF after the last record.
@@ -133,15 +173,8 @@ func (r *Raster) RecordGenerator(b *geom.Bounds) func() (Record, error) {
 		if j >= jEnd {
 			return nil, io.EOF
 		}
-		dy := gridPointsToGridSpacing(r.lats, j)
-		dx := gridPointsToGridSpacing(r.lons, i)
-		y := r.lats[j]
-		x := r.lons[i]
-		min := geom.Point{X: x - dx/2, Y: y - math.Abs(dy/2)}
-		max := geom.Point{X: x + dx/2, Y: y + math.Abs(dy/2)}
-
 		rec := &basicPolygonRecord{
-			Polygonal:    &geom.Bounds{Min: min, Max: max},
+			Polygonal:    r.cellBounds(j, i),
 			SourceData:   r.sourceData,
 			SR:           sr,
 			LocationName: fmt.Sprintf("%d_%d", j, i),
@@ -149,10 +182,18 @@ func (r *Raster) RecordGenerator(b *geom.Bounds) func() (Record, error) {
 
 		e := new(Emissions)
 		for name, data := range r.variables {
-			rate := unit.Div(
-				convert(data[len(r.lons)*j+i]),
-				duration,
-			)
+			var rate *unit.Unit
+			if r.flux[name] {
+				rate = unit.Div(
+					unit.New(data[len(r.lons)*j+i]*cellArea(rec.Polygonal.(*geom.Bounds)), unit.Kilogram),
+					unit.New(1, unit.Second),
+				)
+			} else {
+				rate = unit.Div(
+					convert(data[len(r.lons)*j+i]),
+					duration,
+				)
+			}
 			e.Add(r.begin, r.end, name, "", rate)
 		}
 		rec.Emissions = *e
@@ -167,16 +208,25 @@ func (r *Raster) RecordGenerator(b *geom.Bounds) func() (Record, error) {
 	return generator
 }
 
-// ReadCOARDSFile reads a COARDS-compliant NetCDF file
+// ReadCOARDSFile reads a COARDS- or CF-compliant NetCDF file
 // (NetCDF 4 and greater not supported) and returns a record generator.
 // The generator will return io.EOF after the last record.
-// All floating point variables that have dimensions [lat, lon] are
-// assumed to be emissions variables.
+// The latitude and longitude dimensions are identified by their names
+// ("lat" or "latitude" and "lon" or "longitude") or by the units of
+// their coordinate variables ("degrees_north" and "degrees_east").
+// All floating point variables that have dimensions [lat, lon] or
+// [time, lat, lon] are assumed to be emissions variables; variables
+// with a time dimension are averaged over time.
 // begin and end specify the time period when the emissions occur.
-// units represents the input units of the emissions.
+// units represents the input units of the emissions, except for variables
+// whose "units" attribute is an emissions flux in kg m-2 s-1, as is
+// typical for global inventories such as EDGAR, CEDS, and HTAP, which
+// are converted to emissions amounts using the areas of the grid cells.
 // SourceData specifies additional information to be included in each
 // emissions record.
 // Data in the COARDS file are assumed to be row-major (i.e., latitude-major).
+// Latitudes can be in decreasing order, and longitudes between 180 and
+// 360 degrees are shifted to between -180 and 0 degrees.
 // Information regarding the COARDS NetCDF conventions are
 // available here: https://ferret.pmel.noaa.gov/Ferret/documentation/coards-netcdf-conventions.
 func ReadCOARDSFile(file string, begin, end time.Time, units InputUnits, sourceData SourceData) (*Raster, error) {
@@ -189,34 +239,73 @@ func ReadCOARDSFile(file string, begin, end time.Time, units InputUnits, sourceD
 	if err != nil {
 		return nil, fmt.Errorf("aep: opening COARDS file %s: %v", file, err)
 	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("aep: opening COARDS file %s: %v", file, err)
+	}
+	latDim, lonDim, err := coardsLatLonDims(nc)
+	if err != nil {
+		return nil, fmt.Errorf("aep: reading COARDS file %s: %v", file, err)
+	}
+
+	lons, err := readCOARDSVar(nc, lonDim, nil)
+	if err != nil {
+		return nil, fmt.Errorf("aep: reading variable %s from COARDS file %s: %v", lonDim, file, err)
+	}
+	lats, err := readCOARDSVar(nc, latDim, nil)
+	if err != nil {
+		return nil, fmt.Errorf("aep: reading variable %s from COARDS file %s: %v", latDim, file, err)
+	}
+	if len(lons) < 2 || len(lats) < 2 {
+		return nil, fmt.Errorf("aep: reading from COARDS file %s: lat and lon variables must be length >= 2 but are %d and %d", file, len(lats), len(lons))
+	}
+	nLatLon := len(lats) * len(lons)
 
 	// Read in emissions variables.
 	variables := make(map[string][]float64)
+	flux := make(map[string]bool)
 	for _, v := range nc.Header.Variables() {
 		dims := nc.Header.Dimensions(v)
-		if len(dims) != 2 || dims[0] != "lat" || dims[1] != "lon" {
+		var last []int // The index of the last element of a record variable.
+		nt := 1
+		switch {
+		case len(dims) == 2 && dims[0] == latDim && dims[1] == lonDim:
+		case len(dims) == 3 && dims[1] == latDim && dims[2] == lonDim:
+			nt = nc.Header.Lengths(v)[0]
+			if nc.Header.IsRecordVariable(v) {
+				nt = int(nc.Header.NumRecs(fi.Size()))
+				last = []int{nt - 1, len(lats) - 1, len(lons) - 1}
+			}
+			if nt == 0 {
+				continue
+			}
+		default:
 			continue
 		}
-		data, err := readCOARDSVar(nc, v)
+		data, err := readCOARDSVar(nc, v, last)
 		if err != nil {
 			return nil, fmt.Errorf("aep: reading variable %s from COARDS file %s: %v", v, file, err)
 		}
-		if data != nil {
-			variables[v] = data
+		if data == nil {
+			continue
+		}
+		if nt > 1 { // Average over time.
+			avg := make([]float64, nLatLon)
+			for t := 0; t < nt; t++ {
+				for i, d := range data[t*nLatLon : (t+1)*nLatLon] {
+					avg[i] += d / float64(nt)
+				}
+			}
+			data = avg
+		}
+		variables[v] = data
+		if u, ok := nc.Header.GetAttribute(v, "units").(string); ok && isFluxUnits(u) {
+			flux[v] = true
 		}
-	}
-	lons, err := readCOARDSVar(nc, "lon")
-	if err != nil {
-		return nil, fmt.Errorf("aep: reading variable %s from COARDS file %s: %v", "lon", file, err)
-	}
-	lats, err := readCOARDSVar(nc, "lat")
-	if err != nil {
-		return nil, fmt.Errorf("aep: reading variable %s from COARDS file %s: %v", "lat", file, err)
-	}
-	if len(lons) < 2 || len(lats) < 2 {
-		return nil, fmt.Errorf("aep: reading from COARDS file %s: lat and lon variables must be length >= 2 but are %d and %d", file, len(lats), len(lons))
 	}
 
+	lats, lons = normalizeLatLon(lats, lons, variables)
+
 	return &Raster{
 		units:      units,
 		begin:      begin,
@@ -225,9 +314,84 @@ func ReadCOARDSFile(file string, begin, end time.Time, units InputUnits, sourceD
 		lats:       lats,
 		lons:       lons,
 		variables:  variables,
+		flux:       flux,
 	}, nil
 }
 
+// coardsLatLonDims returns the names of the latitude and longitude
+// dimensions in nc.
+func coardsLatLonDims(nc *cdf.File) (lat, lon string, err error) {
+	for _, d := range nc.Header.Dimensions("") {
+		u, _ := nc.Header.GetAttribute(d, "units").(string)
+		switch u = strings.ToLower(strings.TrimSpace(u)); {
+		case d == "lat" || d == "latitude" || u == "degrees_north" || u == "degree_north" || u == "degrees_n" || u == "degree_n":
+			if lat == "" {
+				lat = d
+			}
+		case d == "lon" || d == "longitude" || u == "degrees_east" || u == "degree_east" || u == "degrees_e" || u == "degree_e":
+			if lon == "" {
+				lon = d
+			}
+		}
+	}
+	if lat == "" || lon == "" {
+		return "", "", fmt.Errorf("could not find latitude and longitude dimensions")
+	}
+	return lat, lon, nil
+}
+
+// isFluxUnits returns whether u represents an emissions flux in
+// kg m-2 s-1.
+func isFluxUnits(u string) bool {
+	u = strings.Join(strings.Fields(u), " ")
+	u = strings.NewReplacer("**", "", "^", "", "(", "", ")", "").Replace(u)
+	switch u {
+	case "kg m-2 s-1", "kg s-1 m-2", "kg/m2/s", "kg/s/m2", "kg/m2 s", "kg/s m2":
+		return true
+	}
+	return false
+}
+
+// normalizeLatLon returns lats in increasing order and lons between
+// -180 and 180 degrees in increasing order, and reorders the values of
+// variables to match.
+func normalizeLatLon(lats, lons []float64, variables map[string][]float64) ([]float64, []float64) {
+	nx := len(lons)
+	if lats[0] > lats[len(lats)-1] {
+		for j, k := 0, len(lats)-1; j < k; j, k = j+1, k-1 {
+			lats[j], lats[k] = lats[k], lats[j]
+			for _, data := range variables {
+				for i := 0; i < nx; i++ {
+					data[j*nx+i], data[k*nx+i] = data[k*nx+i], data[j*nx+i]
+				}
+			}
+		}
+	}
+	if lons[nx-1] <= 180 {
+		return lats, lons
+	}
+	// Move longitudes greater than 180 to the beginning of each row.
+	shift := sort.SearchFloat64s(lons, 180+1.e-10)
+	newLons := make([]float64, nx)
+	for i := range lons {
+		ii := (i + shift) % nx
+		newLons[i] = lons[ii]
+		if newLons[i] > 180 {
+			newLons[i] -= 360
+		}
+	}
+	for _, data := range variables {
+		row := make([]float64, nx)
+		for j := range lats {
+			for i := range row {
+				row[i] = data[j*nx+(i+shift)%nx]
+			}
+			copy(data[j*nx:(j+1)*nx], row)
+		}
+	}
+	return lats, newLons
+}
+
 func maxInt(a, b int) int {
 	if a > b {
 		return a
@@ -19,10 +19,13 @@ package aep
 
 import (
 	"io"
+	"math"
+	"os"
 	"reflect"
 	"testing"
 	"time"
 
+	"github.com/ctessum/cdf"
 	"github.com/ctessum/geom"
 	"github.com/ctessum/unit"
 )
@@ -87,3 +90,109 @@ func TestReadCOARDSFile(t *testing.T) {
 		t.Errorf("%v != %v", emisHave, emisWant)
 	}
 }
+
+func TestReadCOARDSFile_cf(t *testing.T) {
+	const flux = 2.e-9 // kg m-2 s-1
+	file := "testdata/emis_cf_test.nc"
+	lats := []float32{10, 0}          // decreasing
+	lons := []float32{0, 10, 350}     // 0-360
+	pm := []float32{1, 2, 3, 4, 5, 6} // [lat, lon]
+
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file)
+	h := cdf.NewHeader([]string{"time", "latitude", "longitude"}, []int{0, len(lats), len(lons)})
+	h.AddVariable("latitude", []string{"latitude"}, []float32{0})
+	h.AddAttribute("latitude", "units", "degrees_north")
+	h.AddVariable("longitude", []string{"longitude"}, []float32{0})
+	h.AddAttribute("longitude", "units", "degrees_east")
+	h.AddVariable("NOx", []string{"time", "latitude", "longitude"}, []float32{0})
+	h.AddAttribute("NOx", "units", "kg m-2 s-1")
+	h.AddVariable("PM2_5", []string{"latitude", "longitude"}, []float32{0})
+	h.AddAttribute("PM2_5", "units", "kg")
+	h.Define()
+	nc, err := cdf.Create(f, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		name       string
+		begin, end []int
+		data       []float32
+	}{
+		{"latitude", []int{0}, []int{len(lats)}, lats},
+		{"longitude", []int{0}, []int{len(lons)}, lons},
+		{"PM2_5", []int{0, 0}, []int{len(lats), len(lons)}, pm},
+	} {
+		if _, err := nc.Writer(v.name, v.begin, v.end).Write(v.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nox := make([]float32, 2*len(pm))
+	for i := range pm {
+		nox[i], nox[len(pm)+i] = flux/2, flux*3/2 // The average is flux.
+	}
+	if _, err := nc.Writer("NOx", []int{0, 0, 0}, []int{2, len(lats), len(lons)}).Write(nox); err != nil {
+		t.Fatal(err)
+	}
+	if err := cdf.UpdateNumRecs(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	begin := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+	emis, err := ReadCOARDSFile(file, begin, end, Kg, SourceData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	generator := emis.RecordGenerator(emis.Bounds())
+	totalEmis := new(Emissions)
+	var area float64
+	var i int
+	for {
+		rec, err := generator()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		b := rec.(*basicPolygonRecord).Polygonal.(*geom.Bounds)
+		if i == 0 {
+			want := &geom.Bounds{Min: geom.Point{X: -15, Y: -5}, Max: geom.Point{X: -5, Y: 5}}
+			if !reflect.DeepEqual(b, want) {
+				t.Errorf("first record geometry: %v != %v", b, want)
+			}
+			// The southwestern cell is the last longitude of the last latitude in the file.
+			if pm := rec.Totals()[Pollutant{Name: "PM2_5"}].Value(); math.Abs(pm-6) > 1.e-10 {
+				t.Errorf("first record PM2_5: %g != 6", pm)
+			}
+		}
+		area += cellArea(b)
+		totalEmis.CombineEmissions(rec)
+		i++
+	}
+	totals := totalEmis.Totals()
+	if have, want := totals[Pollutant{Name: "NOx"}].Value(), flux*area*end.Sub(begin).Seconds(); math.Abs(have-want) > 1.e-6*want {
+		t.Errorf("NOx: %g != %g", have, want)
+	}
+	if have := totals[Pollutant{Name: "PM2_5"}].Value(); math.Abs(have-21) > 1.e-10 {
+		t.Errorf("PM2_5: %g != 21", have)
+	}
+}
+
+func TestIsFluxUnits(t *testing.T) {
+	for u, want := range map[string]bool{
+		"kg m-2 s-1":     true,
+		"kg m**-2 s**-1": true,
+		"kg/m2/s":        true,
+		"kg":             false,
+		"tons/year":      false,
+	} {
+		if have := isFluxUnits(u); have != want {
+			t.Errorf("%s: %v != %v", u, have, want)
+		}
+	}
+}
@@ -20,6 +20,7 @@ package aep
 import (
 	"fmt"
 	"reflect"
+	"sort"
 	"time"
 
 	"github.com/ctessum/unit"
@@ -288,3 +289,53 @@ func (e *Emissions) Scale(f func(Pollutant) (float64, error)) error {
 	}
 	return nil
 }
+
+// Split replaces the emissions of each pollutant with the emissions of
+// the species that they are split into by f, which returns the fraction
+// of the emissions of pollutant p during the period from begin to end
+// that should be attributed to each species. The species keep the prefix
+// of p, and fractions that do not sum to one change the total amount of
+// emissions. If f returns nil, the emissions of p are not changed.
+func (e *Emissions) Split(f func(p Pollutant, begin, end time.Time) (map[string]float64, error)) error {
+	var periods []*emissionsPeriod
+	units := make(map[Pollutant]unit.Dimensions)
+	addUnits := func(p Pollutant, d unit.Dimensions) error {
+		if dd, ok := units[p]; ok && !dd.Matches(d) {
+			return fmt.Errorf("aep: splitting emissions: incompatible units '%s' and '%s' for %s", dd, d, p)
+		}
+		units[p] = d
+		return nil
+	}
+	for _, ee := range e.e {
+		fracs, err := f(ee.Pollutant, ee.begin, ee.end)
+		if err != nil {
+			return err
+		}
+		if fracs == nil {
+			periods = append(periods, ee)
+			if err := addUnits(ee.Pollutant, e.units[ee.Pollutant]); err != nil {
+				return err
+			}
+			continue
+		}
+		species := make([]string, 0, len(fracs))
+		for s := range fracs {
+			species = append(species, s)
+		}
+		sort.Strings(species)
+		for _, s := range species {
+			p := Pollutant{Name: s, Prefix: ee.Pollutant.Prefix}
+			periods = append(periods, &emissionsPeriod{
+				begin:     ee.begin,
+				end:       ee.end,
+				Pollutant: p,
+				rate:      ee.rate * fracs[s],
+			})
+			if err := addUnits(p, e.units[ee.Pollutant]); err != nil {
+				return err
+			}
+		}
+	}
+	e.e, e.units = periods, units
+	return nil
+}
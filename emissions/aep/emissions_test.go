@@ -240,3 +240,31 @@ func TestEmissions_Clone(t *testing.T) {
 		t.Errorf("e2 = %v, want %v", e2.Totals(), e2Want)
 	}
 }
+
+func TestEmissions_Split(t *testing.T) {
+	e := new(Emissions)
+	begin, _ := time.Parse("Jan 2006", "Jan 2005")
+	end, _ := time.Parse("Jan 2006", "Jan 2006")
+	rate := unit.New(1, map[unit.Dimension]int{unit.MassDim: 1, unit.TimeDim: -1})
+	e.Add(begin, end, "PM2_5", "BRK", rate)
+	e.Add(begin, end, "NOx", "", rate)
+
+	splitFunc := func(p Pollutant, _, _ time.Time) (map[string]float64, error) {
+		if p.Name != "PM2_5" {
+			return nil, nil
+		}
+		return map[string]float64{"EC": 0.25, "OC": 0.5}, nil
+	}
+	if err := e.Split(splitFunc); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[Pollutant]*unit.Unit{
+		{Name: "EC", Prefix: "BRK"}: unit.New(3.1536e+07/4, unit.Dimensions{4: 1}),
+		{Name: "OC", Prefix: "BRK"}: unit.New(3.1536e+07/2, unit.Dimensions{4: 1}),
+		{Name: "NOx", Prefix: ""}:   unit.New(3.1536e+07, unit.Dimensions{4: 1}),
+	}
+	if !reflect.DeepEqual(e.Totals(), want) {
+		t.Errorf("have %v, want %v", e.Totals(), want)
+	}
+}
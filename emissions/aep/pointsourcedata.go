@@ -195,3 +195,6 @@ func (r *PointSourceData) GroundLevel() bool {
 	}
 	return false
 }
+
+// PointData returns the receiver.
+func (r *PointSourceData) PointData() *PointSourceData { return r }
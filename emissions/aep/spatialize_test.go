@@ -21,11 +21,13 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/ctessum/cdf"
 	"github.com/ctessum/geom"
 	"github.com/ctessum/geom/op"
 	"github.com/ctessum/geom/proj"
@@ -488,3 +490,110 @@ func TestSpatializeRecord_srgCache(t *testing.T) {
 		}
 	}
 }
+
+func TestCreateSurrogates_raster(t *testing.T) {
+	// The raster has a single populated cell, which is in Brooklyn (FIPS 36047).
+	const rasterFile = "testdata/srg_raster_test.nc"
+	source := geom.Point{X: -73.95, Y: 40.65}
+	var lats, lons []float32
+	for y := 40.45; y < 40.86; y += 0.02 {
+		lats = append(lats, float32(y))
+	}
+	for x := -74.35; x < -73.64; x += 0.02 {
+		lons = append(lons, float32(x))
+	}
+	pop := make([]float32, len(lats)*len(lons))
+	for j, y := range lats {
+		for i, x := range lons {
+			if math.Abs(float64(y)-source.Y) < 0.01 && math.Abs(float64(x)-source.X) < 0.01 {
+				pop[j*len(lons)+i] = 1000
+			}
+		}
+	}
+	f, err := os.Create(rasterFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(rasterFile)
+	h := cdf.NewHeader([]string{"lat", "lon"}, []int{len(lats), len(lons)})
+	h.AddVariable("lat", []string{"lat"}, []float32{0})
+	h.AddVariable("lon", []string{"lon"}, []float32{0})
+	h.AddVariable("POP", []string{"lat", "lon"}, []float32{0})
+	h.Define()
+	nc, err := cdf.Create(f, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		name       string
+		begin, end []int
+		data       []float32
+	}{
+		{"lat", []int{0}, []int{len(lats)}, lats},
+		{"lon", []int{0}, []int{len(lons)}, lons},
+		{"POP", []int{0, 0}, []int{len(lats), len(lons)}, pop},
+	} {
+		if _, err := nc.Writer(v.name, v.begin, v.end).Write(v.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	const srgSpec = `"REGION","SURROGATE","SURROGATE CODE","DATA SHAPEFILE","DATA ATTRIBUTE","WEIGHT SHAPEFILE","WEIGHT ATTRIBUTE","WEIGHT FUNCTION","FILTER FUNCTION","MERGE FUNCTION","SECONDARY SURROGATE","TERTIARY SURROGATE","QUARTERNARY SURROGATE","DETAILS","COMMENTS"
+"USA","Population Raster",900,"cty_pophu2k_revised","FIPSSTCO","srg_raster_test.nc","POP",,,,,,,"Gridded population",
+`
+	srgSpecs, err := ReadSrgSpecSMOKE(strings.NewReader(srgSpec), "testdata", true, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputSR, err := proj.Parse("+proj=longlat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grid, err := createGrid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := NewSpatialProcessor(srgSpecs, []*GridDef{grid}, nil, inputSR, false)
+	srg, err := srgSpecs.GetByCode(USA, "900")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputShapes, err := srg.(*SrgSpecSMOKE).InputShapes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lonLat, err := proj.Parse("+proj=longlat +datum=WGS84")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err := lonLat.NewTransform(grid.SR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceCell, err := (&geom.Bounds{
+		Min: geom.Point{X: source.X - 0.01, Y: source.Y - 0.01},
+		Max: geom.Point{X: source.X + 0.01, Y: source.Y + 0.01},
+	}).Polygons()[0].Transform(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for fips, wantSum := range map[string]float64{"36047": 1, "36085": 0} {
+		sg := &srgGrid{srg: srg, gridData: grid, loc: inputShapes[fips], sp: sp}
+		gs := new(GriddedSrgData)
+		if err := sg.Run(context.Background(), nil, (*griddedSrgDataHolder)(gs)); err != nil {
+			t.Fatalf("FIPS %s: %v", fips, err)
+		}
+		var sum float64
+		for _, c := range gs.Cells {
+			sum += c.Weight
+			if c.Weight > 0 && !c.Polygonal.Bounds().Overlaps(sourceCell.Bounds()) {
+				t.Errorf("FIPS %s: cell (%d, %d) does not contain the populated raster cell but has weight %g", fips, c.Row, c.Col, c.Weight)
+			}
+		}
+		if math.Abs(sum-wantSum) > 1.e-6 {
+			t.Errorf("FIPS %s: surrogate sum %g != %g", fips, sum, wantSum)
+		}
+	}
+}
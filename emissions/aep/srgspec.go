@@ -31,10 +31,12 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ctessum/geom"
 	"github.com/ctessum/geom/encoding/shp"
 	"github.com/ctessum/geom/index/rtree"
+	"github.com/ctessum/geom/proj"
 	"github.com/ctessum/requestcache/v2"
 )
 
@@ -50,6 +52,9 @@ type SrgSpec interface {
 
 // SrgSpecSMOKE holds SMOKE-formatted spatial surrogate specification information.
 // See the SMOKE emissions model technical documentation for additional information.
+// Unlike in SMOKE, WEIGHTSHAPEFILE can also be a NetCDF raster file with
+// a ".nc" extension, in which case WeightColumns are raster variables
+// (see ReadCOARDSFile) and FilterFunction is not supported.
 type SrgSpecSMOKE struct {
 	Region          Country
 	Name            string
@@ -224,7 +229,7 @@ func ReadSrgSpecSMOKE(fid io.Reader, shapefileDir string, checkShapefiles bool,
 				}
 			}
 			if srg.WEIGHTSHAPEFILE != "" {
-				srg.WEIGHTSHAPEFILE, err = findFile(shapefileDir, srg.WEIGHTSHAPEFILE+".shp")
+				srg.WEIGHTSHAPEFILE, err = findFile(shapefileDir, weightFileName(srg.WEIGHTSHAPEFILE))
 				if err != nil {
 					return nil, err
 				}
@@ -234,7 +239,7 @@ func ReadSrgSpecSMOKE(fid io.Reader, shapefileDir string, checkShapefiles bool,
 				srg.DATASHAPEFILE = filepath.Join(shapefileDir, srg.DATASHAPEFILE+".shp")
 			}
 			if srg.WEIGHTSHAPEFILE != "" {
-				srg.WEIGHTSHAPEFILE = filepath.Join(shapefileDir, srg.WEIGHTSHAPEFILE+".shp")
+				srg.WEIGHTSHAPEFILE = filepath.Join(shapefileDir, weightFileName(srg.WEIGHTSHAPEFILE))
 			}
 		}
 
@@ -246,7 +251,7 @@ func ReadSrgSpecSMOKE(fid io.Reader, shapefileDir string, checkShapefiles bool,
 				}
 				shpf.Close()
 			}
-			if srg.WEIGHTSHAPEFILE != "" {
+			if srg.WEIGHTSHAPEFILE != "" && !srg.rasterWeights() {
 				shpf, err := shp.NewDecoder(srg.WEIGHTSHAPEFILE)
 				if err != nil {
 					return nil, err
@@ -260,6 +265,24 @@ func ReadSrgSpecSMOKE(fid io.Reader, shapefileDir string, checkShapefiles bool,
 	return srgs, nil
 }
 
+// weightFileName returns the name of the surrogate weight file
+// specified by name: a NetCDF raster file if name has a ".nc" extension,
+// or otherwise a shapefile.
+func weightFileName(name string) string {
+	if isRasterFile(name) {
+		return name
+	}
+	return name + ".shp"
+}
+
+// isRasterFile returns whether the named surrogate weight file is a
+// NetCDF raster file.
+func isRasterFile(name string) bool { return strings.EqualFold(filepath.Ext(name), ".nc") }
+
+// rasterWeights returns whether the surrogate weights are in a NetCDF
+// raster file rather than a shapefile.
+func (srg *SrgSpecSMOKE) rasterWeights() bool { return isRasterFile(srg.WEIGHTSHAPEFILE) }
+
 func (srg *SrgSpecSMOKE) backupSurrogateNames() []string { return srg.BackupSurrogateNames }
 func (srg *SrgSpecSMOKE) region() Country                { return srg.Region }
 func (srg *SrgSpecSMOKE) code() string                   { return srg.Code }
@@ -353,6 +376,10 @@ func (input *readSrgDataSMOKEInput) Run(ctx context.Context) (interface{}, error
 	srg := input.srg
 	log.Printf("processing surrogate `%s` spatial data", srg.Name)
 
+	if srg.rasterWeights() {
+		return input.runRaster()
+	}
+
 	srgShp, err := shp.NewDecoder(srg.WEIGHTSHAPEFILE)
 	if err != nil {
 		return nil, err
@@ -491,3 +518,73 @@ func (input *readSrgDataSMOKEInput) Run(ctx context.Context) (interface{}, error
 	}
 	return srgs, nil
 }
+
+// runRaster returns all of the spatial surrogate information for a
+// surrogate whose weights are in a COARDS- or CF-compliant NetCDF raster
+// file in longitude-latitude coordinates (see ReadCOARDSFile), such as
+// gridded population, road density, or land use. The weight of each
+// raster cell is the sum of the WeightColumns variables times their
+// WeightFactors, or one if there are no WeightColumns, so the
+// variables should be amounts per raster cell rather than densities.
+func (input *readSrgDataSMOKEInput) runRaster() (interface{}, error) {
+	srg := input.srg
+	if srg.FilterFunction != nil {
+		return nil, fmt.Errorf("aep: surrogate %s: filter functions are not supported for raster file %s", srg.Name, srg.WEIGHTSHAPEFILE)
+	}
+	r, err := ReadCOARDSFile(srg.WEIGHTSHAPEFILE, time.Time{}, time.Time{}, Kg, SourceData{})
+	if err != nil {
+		return nil, err
+	}
+	weights := make([][]float64, len(srg.WeightColumns))
+	for i, name := range srg.WeightColumns {
+		var ok bool
+		if weights[i], ok = r.variables[name]; !ok {
+			return nil, fmt.Errorf("aep.getSrgData: raster file %s does not have variable %s", srg.WEIGHTSHAPEFILE, name)
+		}
+	}
+
+	srgSR, err := proj.Parse("+proj=longlat +datum=WGS84")
+	if err != nil {
+		return nil, err
+	}
+	srgCT, err := srgSR.NewTransform(input.gridData.SR)
+	if err != nil {
+		return nil, err
+	}
+
+	srgs := readSrgDataOutput{
+		index: rtree.NewTree(25, 50),
+	}
+	for j := range r.lats {
+		for i := range r.lons {
+			weightval := 1.
+			if len(weights) != 0 {
+				weightval = 0
+				for k, w := range weights {
+					if v := w[len(r.lons)*j+i]; !math.IsNaN(v) {
+						weightval += math.Max(v, 0) * srg.WeightFactors[k] // Get rid of any negative weights.
+					}
+				}
+			}
+			if weightval == 0 {
+				continue
+			}
+			srgH := new(srgHolder)
+			srgH.Geom, err = r.cellBounds(j, i).Polygons()[0].Transform(srgCT)
+			if err != nil {
+				return nil, err
+			}
+			size := srgH.Geom.(geom.Polygonal).Area()
+			if size <= 0 {
+				continue
+			}
+			srgH.Weight = weightval / size
+			if math.IsInf(srgH.Weight, 0) || math.IsNaN(srgH.Weight) {
+				return nil, fmt.Errorf("Surrogate weight is %v, which is not acceptable.", srgH.Weight)
+			}
+			srgs.srgs = append(srgs.srgs, srgH)
+			srgs.index.Insert(srgH)
+		}
+	}
+	return srgs, nil
+}
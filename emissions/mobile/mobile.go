@@ -0,0 +1,310 @@
+/*
+Copyright © 2018 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package mobile
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ctessum/geom"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/emissions/mobile/mobilerpc"
+	"google.golang.org/grpc"
+)
+
+// Link holds the emissions from a road link.
+type Link struct {
+	// ID is the identifier of the link.
+	ID string
+
+	// LineString is the location of the link, in the spatial reference
+	// of the InMAP grid.
+	geom.LineString
+
+	VOC, NOx, NH3, SOx, PM25 float64 // emissions [μg/s]
+}
+
+// emisRecord returns the emissions from l as an InMAP emissions record.
+func (l *Link) emisRecord() *inmap.EmisRecord {
+	return &inmap.EmisRecord{
+		Geom: l.LineString,
+		VOC:  l.VOC,
+		NOx:  l.NOx,
+		NH3:  l.NH3,
+		SOx:  l.SOx,
+		PM25: l.PM25,
+	}
+}
+
+// Concentrations holds the concentrations at each link, in the form
+// map[link ID][species]concentration [μg/m³].
+type Concentrations map[string]map[string]float64
+
+// Model is the interface that a mobile-source emissions model
+// implements to be coupled to an InMAP simulation in the same process.
+type Model interface {
+	// LinkEmissions returns the emissions from each link for the next
+	// simulation period, given the concentrations at each link from
+	// the previous period, which are nil for the first period.
+	// It returns io.EOF when there are no more periods to simulate.
+	LinkEmissions(ctx context.Context, conc Concentrations) ([]*Link, error)
+}
+
+// Server receives link-level emissions from a mobile-source emissions
+// model and makes them available to a running simulation, and makes the
+// resulting concentrations available to the emissions model. The model
+// can either be connected through the gRPC service registered by
+// Register or run in the same process using RunModel.
+type Server struct {
+	// Species are the names of the chemical species whose
+	// concentrations are reported at each link. If it is empty, all of
+	// the species in the chemical mechanism are reported.
+	Species []string
+
+	mu sync.Mutex
+
+	// changed is closed and replaced whenever the state of the server
+	// changes.
+	changed chan struct{}
+	closed  bool
+
+	links   []*Link
+	version int64
+
+	conc        Concentrations
+	concVersion int64
+}
+
+// NewServer initializes a new server.
+func NewServer() *Server {
+	return &Server{changed: make(chan struct{})}
+}
+
+// notify signals that the state of s has changed. The caller must
+// hold the lock.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait waits until ready returns true or ctx is canceled. If it returns
+// without an error, the lock is held and must be released by the caller.
+func (s *Server) wait(ctx context.Context, ready func() bool) error {
+	for {
+		s.mu.Lock()
+		if ready() {
+			return nil
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return fmt.Errorf("mobile: server is closed")
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Update replaces the link emissions with links and returns the version
+// number of the new set of links.
+func (s *Server) Update(links []*Link) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.links = links
+	s.version++
+	s.notify()
+	return s.version
+}
+
+// NextLinks waits until there is a set of link emissions with a version
+// number greater than after and then returns the links and their
+// version number.
+func (s *Server) NextLinks(ctx context.Context, after int64) ([]*Link, int64, error) {
+	if err := s.wait(ctx, func() bool { return s.version > after }); err != nil {
+		return nil, 0, err
+	}
+	defer s.mu.Unlock()
+	return s.links, s.version, nil
+}
+
+// Concentrations waits until the concentrations that result from the
+// set of links with the given version number, or a later version, are
+// available and then returns them.
+func (s *Server) Concentrations(ctx context.Context, version int64) (Concentrations, error) {
+	if err := s.wait(ctx, func() bool { return s.concVersion >= version }); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	return s.conc, nil
+}
+
+// Close closes s, so that any callers that are waiting for links or
+// concentrations return an error.
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.notify()
+}
+
+// Emissions returns emissions that combine the records in base, which
+// may be nil, with the emissions from links. The returned emissions use
+// the same mask, plume-in-grid distance, and near-road zone width as base.
+func Emissions(base *inmap.Emissions, links []*Link) *inmap.Emissions {
+	emis := inmap.NewEmissions()
+	if base != nil {
+		emis.Mask = base.Mask
+		emis.PlumeDistance = base.PlumeDistance
+		emis.NearRoadWidth = base.NearRoadWidth
+		for _, e := range base.EmisRecords() {
+			emis.Add(e)
+		}
+	}
+	for _, l := range links {
+		emis.Add(l.emisRecord())
+	}
+	return emis
+}
+
+// SaveConcentrations returns a function that calculates the
+// ground-level concentrations along each of the given links, which
+// should have the given version number, and makes them available to
+// callers of Concentrations. The concentration at each link is the
+// average over the grid cells that it passes through, weighted by the
+// length of the link in each cell. m is the chemical mechanism.
+func (s *Server) SaveConcentrations(links []*Link, version int64, m inmap.Mechanism) inmap.DomainManipulator {
+	return func(d *inmap.InMAP) error {
+		species := s.Species
+		if len(species) == 0 {
+			species = m.Species()
+		}
+		conc := make(Concentrations, len(links))
+		for _, l := range links {
+			vals := make(map[string]float64, len(species))
+			cells, fractions := d.CellIntersections(l.LineString)
+			var total float64
+			for i, c := range cells {
+				if c.Layer != 0 {
+					continue
+				}
+				for _, sp := range species {
+					v, err := m.Value(c, sp)
+					if err != nil {
+						return err
+					}
+					vals[sp] += v * fractions[i]
+				}
+				total += fractions[i]
+			}
+			if total > 0 {
+				for sp := range vals {
+					vals[sp] /= total
+				}
+			}
+			conc[l.ID] = vals
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.conc = conc
+		s.concVersion = version
+		s.notify()
+		return nil
+	}
+}
+
+// RunModel couples model to the simulation that is using s: it
+// repeatedly gets the link emissions for the next period from model,
+// passes them to the simulation, and waits for the resulting
+// concentrations, until model returns io.EOF or an error occurs.
+func (s *Server) RunModel(ctx context.Context, model Model) error {
+	var conc Concentrations
+	for {
+		links, err := model.LinkEmissions(ctx, conc)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		version := s.Update(links)
+		if conc, err = s.Concentrations(ctx, version); err != nil {
+			return err
+		}
+	}
+}
+
+// Register registers s as the MobileEmissions service of g.
+func (s *Server) Register(g *grpc.Server) {
+	mobilerpc.RegisterMobileEmissionsServer(g, rpcServer{s})
+}
+
+// rpcServer implements mobilerpc.MobileEmissionsServer.
+type rpcServer struct {
+	s *Server
+}
+
+// SetLinks implements the SetLinks gRPC method.
+func (r rpcServer) SetLinks(stream mobilerpc.MobileEmissions_SetLinksServer) error {
+	var links []*Link
+	for {
+		l, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if len(l.X) != len(l.Y) || len(l.X) < 2 {
+			return fmt.Errorf("mobile: link %s must have at least two vertices and the same number of X and Y coordinates", l.ID)
+		}
+		ls := make(geom.LineString, len(l.X))
+		for i := range l.X {
+			ls[i] = geom.Point{X: l.X[i], Y: l.Y[i]}
+		}
+		links = append(links, &Link{
+			ID:         l.ID,
+			LineString: ls,
+			VOC:        l.VOC,
+			NOx:        l.NOx,
+			NH3:        l.NH3,
+			SOx:        l.SOx,
+			PM25:       l.PM25,
+		})
+	}
+	version := r.s.Update(links)
+	return stream.SendAndClose(&mobilerpc.LinkSet{Version: version, NumLinks: int32(len(links))})
+}
+
+// Concentrations implements the Concentrations gRPC method.
+func (r rpcServer) Concentrations(req *mobilerpc.LinkSet, stream mobilerpc.MobileEmissions_ConcentrationsServer) error {
+	conc, err := r.s.Concentrations(stream.Context(), req.Version)
+	if err != nil {
+		return err
+	}
+	for id, vals := range conc {
+		if err := stream.Send(&mobilerpc.LinkConcentrations{ID: id, Values: vals}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+/*
+Copyright © 2018 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package mobile_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/emissions/mobile"
+	"github.com/yuzhou-wang/inmap/emissions/mobile/mobilerpc"
+	"github.com/yuzhou-wang/inmap/science/chem/simplechem"
+	"google.golang.org/grpc"
+)
+
+// simulate runs a simulation for the given number of one-hour periods,
+// getting link emissions from s at the beginning of each period and
+// saving the concentrations at the end.
+func simulate(s *mobile.Server, periods int) error {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := inmap.VarGridTestData()
+	var m simplechem.Mechanism
+	d := &inmap.InMAP{
+		InitFuncs: []inmap.DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, nil, m),
+		},
+	}
+	if err := d.Init(); err != nil {
+		return err
+	}
+	var version int64
+	for i := 0; i < periods; i++ {
+		links, v, err := s.NextLinks(context.Background(), version)
+		if err != nil {
+			return err
+		}
+		version = v
+		if err = inmap.ResetEmissionsFlux(mobile.Emissions(nil, links), m)(d); err != nil {
+			return err
+		}
+		if err = inmap.SetTimestepCFL()(d); err != nil {
+			return err
+		}
+		d.Done = false
+		d.RunFuncs = []inmap.DomainManipulator{
+			inmap.RunFor(3600),
+			inmap.Calculations(inmap.AddEmissionsFlux()),
+		}
+		if err = d.Run(); err != nil {
+			return err
+		}
+		if err = s.SaveConcentrations(links, version, m)(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestServer_gRPC(t *testing.T) {
+	s := mobile.NewServer()
+	s.Species = []string{"PrimaryPM25"}
+	defer s.Close()
+	g := grpc.NewServer()
+	s.Register(g)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go g.Serve(lis)
+	defer g.Stop()
+
+	simErr := make(chan error)
+	go func() { simErr <- simulate(s, 1) }()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := mobilerpc.NewMobileEmissionsClient(conn)
+	ctx := context.Background()
+
+	stream, err := client.SetLinks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := []*mobilerpc.Link{
+		{ID: "a", X: []float64{-3000, 3000}, Y: []float64{-3000, 2000}, PM25: 1.e6},
+		{ID: "b", X: []float64{-20000, -19000}, Y: []float64{0, 0}, NOx: 1.e6},
+	}
+	for _, l := range links {
+		if err = stream.Send(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.NumLinks != 2 || set.Version != 1 {
+		t.Errorf("link set: %+v", set)
+	}
+
+	concStream, err := client.Concentrations(ctx, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conc := make(map[string]map[string]float64)
+	for {
+		c, err := concStream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		conc[c.ID] = c.Values
+	}
+	if err = <-simErr; err != nil {
+		t.Fatal(err)
+	}
+	if len(conc) != 2 {
+		t.Fatalf("there should be concentrations for 2 links but there are %d", len(conc))
+	}
+	if !(conc["a"]["PrimaryPM25"] > 0) {
+		t.Errorf("link a: PrimaryPM25 should be > 0 but is %g", conc["a"]["PrimaryPM25"])
+	}
+	if conc["b"]["PrimaryPM25"] != 0 {
+		t.Errorf("link b: PrimaryPM25 should be 0 but is %g", conc["b"]["PrimaryPM25"])
+	}
+
+	stream, err = client.SetLinks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = stream.Send(&mobilerpc.Link{ID: "c", X: []float64{0}, Y: []float64{0}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stream.CloseAndRecv(); err == nil {
+		t.Error("a link with one vertex should cause an error")
+	}
+}
+
+// model is a mobile-source emissions model that reduces emissions in
+// each period in proportion to the concentration in the previous period.
+type model struct {
+	periods int
+	pm25    []float64
+}
+
+func (m *model) LinkEmissions(ctx context.Context, conc mobile.Concentrations) ([]*mobile.Link, error) {
+	if conc != nil {
+		m.pm25 = append(m.pm25, conc["a"]["PrimaryPM25"])
+	}
+	if len(m.pm25) == m.periods {
+		return nil, io.EOF
+	}
+	emis := 1.e6
+	if conc != nil {
+		emis /= 2
+	}
+	return []*mobile.Link{{
+		ID:         "a",
+		LineString: geom.LineString{{X: -3000, Y: -3000}, {X: 3000, Y: 2000}},
+		PM25:       emis,
+	}}, nil
+}
+
+func TestServer_RunModel(t *testing.T) {
+	const periods = 2
+	s := mobile.NewServer()
+	defer s.Close()
+	simErr := make(chan error)
+	go func() { simErr <- simulate(s, periods) }()
+
+	m := &model{periods: periods}
+	if err := s.RunModel(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-simErr; err != nil {
+		t.Fatal(err)
+	}
+	if len(m.pm25) != periods {
+		t.Fatalf("the model should have received concentrations %d times but received them %d times", periods, len(m.pm25))
+	}
+	for i, c := range m.pm25 {
+		if !(c > 0) {
+			t.Errorf("period %d: concentration should be > 0 but is %g", i, c)
+		}
+	}
+}
@@ -0,0 +1,580 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.27.1
+// 	protoc        v3.17.3
+// source: mobile.proto
+
+package mobilerpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Link holds the emissions from a road link.
+type Link struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// ID is the identifier of the link.
+	ID string `protobuf:"bytes,1,opt,name=ID,proto3" json:"ID,omitempty"`
+	// X and Y are the coordinates of the vertices of the link, in the
+	// spatial reference of the InMAP grid.
+	X []float64 `protobuf:"fixed64,2,rep,packed,name=X,proto3" json:"X,omitempty"`
+	Y []float64 `protobuf:"fixed64,3,rep,packed,name=Y,proto3" json:"Y,omitempty"`
+	// VOC, NOx, NH3, SOx, and PM25 are the emissions rates from
+	// the link [μg/s].
+	VOC  float64 `protobuf:"fixed64,4,opt,name=VOC,proto3" json:"VOC,omitempty"`
+	NOx  float64 `protobuf:"fixed64,5,opt,name=NOx,proto3" json:"NOx,omitempty"`
+	NH3  float64 `protobuf:"fixed64,6,opt,name=NH3,proto3" json:"NH3,omitempty"`
+	SOx  float64 `protobuf:"fixed64,7,opt,name=SOx,proto3" json:"SOx,omitempty"`
+	PM25 float64 `protobuf:"fixed64,8,opt,name=PM25,proto3" json:"PM25,omitempty"`
+}
+
+func (x *Link) Reset() {
+	*x = Link{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_mobile_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Link) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Link) ProtoMessage() {}
+
+func (x *Link) ProtoReflect() protoreflect.Message {
+	mi := &file_mobile_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Link.ProtoReflect.Descriptor instead.
+func (*Link) Descriptor() ([]byte, []int) {
+	return file_mobile_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Link) GetID() string {
+	if x != nil {
+		return x.ID
+	}
+	return ""
+}
+
+func (x *Link) GetX() []float64 {
+	if x != nil {
+		return x.X
+	}
+	return nil
+}
+
+func (x *Link) GetY() []float64 {
+	if x != nil {
+		return x.Y
+	}
+	return nil
+}
+
+func (x *Link) GetVOC() float64 {
+	if x != nil {
+		return x.VOC
+	}
+	return 0
+}
+
+func (x *Link) GetNOx() float64 {
+	if x != nil {
+		return x.NOx
+	}
+	return 0
+}
+
+func (x *Link) GetNH3() float64 {
+	if x != nil {
+		return x.NH3
+	}
+	return 0
+}
+
+func (x *Link) GetSOx() float64 {
+	if x != nil {
+		return x.SOx
+	}
+	return 0
+}
+
+func (x *Link) GetPM25() float64 {
+	if x != nil {
+		return x.PM25
+	}
+	return 0
+}
+
+// LinkSet identifies a set of link emissions.
+type LinkSet struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Version is the version number of the set of links, which increases
+	// each time the links are replaced.
+	Version int64 `protobuf:"varint,1,opt,name=Version,proto3" json:"Version,omitempty"`
+	// NumLinks is the number of links in the set.
+	NumLinks int32 `protobuf:"varint,2,opt,name=NumLinks,proto3" json:"NumLinks,omitempty"`
+}
+
+func (x *LinkSet) Reset() {
+	*x = LinkSet{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_mobile_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *LinkSet) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LinkSet) ProtoMessage() {}
+
+func (x *LinkSet) ProtoReflect() protoreflect.Message {
+	mi := &file_mobile_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LinkSet.ProtoReflect.Descriptor instead.
+func (*LinkSet) Descriptor() ([]byte, []int) {
+	return file_mobile_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *LinkSet) GetVersion() int64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *LinkSet) GetNumLinks() int32 {
+	if x != nil {
+		return x.NumLinks
+	}
+	return 0
+}
+
+// LinkConcentrations holds the concentrations at a link.
+type LinkConcentrations struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// ID is the identifier of the link.
+	ID string `protobuf:"bytes,1,opt,name=ID,proto3" json:"ID,omitempty"`
+	// Values holds the length-weighted average ground-level concentration
+	// of each chemical species along the link [μg/m³].
+	Values map[string]float64 `protobuf:"bytes,2,rep,name=Values,proto3" json:"Values,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"fixed64,2,opt,name=value,proto3"`
+}
+
+func (x *LinkConcentrations) Reset() {
+	*x = LinkConcentrations{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_mobile_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *LinkConcentrations) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LinkConcentrations) ProtoMessage() {}
+
+func (x *LinkConcentrations) ProtoReflect() protoreflect.Message {
+	mi := &file_mobile_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LinkConcentrations.ProtoReflect.Descriptor instead.
+func (*LinkConcentrations) Descriptor() ([]byte, []int) {
+	return file_mobile_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *LinkConcentrations) GetID() string {
+	if x != nil {
+		return x.ID
+	}
+	return ""
+}
+
+func (x *LinkConcentrations) GetValues() map[string]float64 {
+	if x != nil {
+		return x.Values
+	}
+	return nil
+}
+
+var File_mobile_proto protoreflect.FileDescriptor
+
+var file_mobile_proto_rawDesc = []byte{
+	0x0a, 0x0c, 0x6d, 0x6f, 0x62, 0x69, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x09,
+	0x6d, 0x6f, 0x62, 0x69, 0x6c, 0x65, 0x72, 0x70, 0x63, 0x22, 0x8e, 0x01, 0x0a, 0x04, 0x4c, 0x69,
+	0x6e, 0x6b, 0x12, 0x0e, 0x0a, 0x02, 0x49, 0x44, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02,
+	0x49, 0x44, 0x12, 0x0c, 0x0a, 0x01, 0x58, 0x18, 0x02, 0x20, 0x03, 0x28, 0x01, 0x52, 0x01, 0x58,
+	0x12, 0x0c, 0x0a, 0x01, 0x59, 0x18, 0x03, 0x20, 0x03, 0x28, 0x01, 0x52, 0x01, 0x59, 0x12, 0x10,
+	0x0a, 0x03, 0x56, 0x4f, 0x43, 0x18, 0x04, 0x20, 0x01, 0x28, 0x01, 0x52, 0x03, 0x56, 0x4f, 0x43,
+	0x12, 0x10, 0x0a, 0x03, 0x4e, 0x4f, 0x78, 0x18, 0x05, 0x20, 0x01, 0x28, 0x01, 0x52, 0x03, 0x4e,
+	0x4f, 0x78, 0x12, 0x10, 0x0a, 0x03, 0x4e, 0x48, 0x33, 0x18, 0x06, 0x20, 0x01, 0x28, 0x01, 0x52,
+	0x03, 0x4e, 0x48, 0x33, 0x12, 0x10, 0x0a, 0x03, 0x53, 0x4f, 0x78, 0x18, 0x07, 0x20, 0x01, 0x28,
+	0x01, 0x52, 0x03, 0x53, 0x4f, 0x78, 0x12, 0x12, 0x0a, 0x04, 0x50, 0x4d, 0x32, 0x35, 0x18, 0x08,
+	0x20, 0x01, 0x28, 0x01, 0x52, 0x04, 0x50, 0x4d, 0x32, 0x35, 0x22, 0x3f, 0x0a, 0x07, 0x4c, 0x69,
+	0x6e, 0x6b, 0x53, 0x65, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12,
+	0x1a, 0x0a, 0x08, 0x4e, 0x75, 0x6d, 0x4c, 0x69, 0x6e, 0x6b, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x05, 0x52, 0x08, 0x4e, 0x75, 0x6d, 0x4c, 0x69, 0x6e, 0x6b, 0x73, 0x22, 0xa2, 0x01, 0x0a, 0x12,
+	0x4c, 0x69, 0x6e, 0x6b, 0x43, 0x6f, 0x6e, 0x63, 0x65, 0x6e, 0x74, 0x72, 0x61, 0x74, 0x69, 0x6f,
+	0x6e, 0x73, 0x12, 0x0e, 0x0a, 0x02, 0x49, 0x44, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02,
+	0x49, 0x44, 0x12, 0x41, 0x0a, 0x06, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x18, 0x02, 0x20, 0x03,
+	0x28, 0x0b, 0x32, 0x29, 0x2e, 0x6d, 0x6f, 0x62, 0x69, 0x6c, 0x65, 0x72, 0x70, 0x63, 0x2e, 0x4c,
+	0x69, 0x6e, 0x6b, 0x43, 0x6f, 0x6e, 0x63, 0x65, 0x6e, 0x74, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e,
+	0x73, 0x2e, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x06, 0x56,
+	0x61, 0x6c, 0x75, 0x65, 0x73, 0x1a, 0x39, 0x0a, 0x0b, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x45,
+	0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x01, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01,
+	0x32, 0x8f, 0x01, 0x0a, 0x0f, 0x4d, 0x6f, 0x62, 0x69, 0x6c, 0x65, 0x45, 0x6d, 0x69, 0x73, 0x73,
+	0x69, 0x6f, 0x6e, 0x73, 0x12, 0x33, 0x0a, 0x08, 0x53, 0x65, 0x74, 0x4c, 0x69, 0x6e, 0x6b, 0x73,
+	0x12, 0x0f, 0x2e, 0x6d, 0x6f, 0x62, 0x69, 0x6c, 0x65, 0x72, 0x70, 0x63, 0x2e, 0x4c, 0x69, 0x6e,
+	0x6b, 0x1a, 0x12, 0x2e, 0x6d, 0x6f, 0x62, 0x69, 0x6c, 0x65, 0x72, 0x70, 0x63, 0x2e, 0x4c, 0x69,
+	0x6e, 0x6b, 0x53, 0x65, 0x74, 0x22, 0x00, 0x28, 0x01, 0x12, 0x47, 0x0a, 0x0e, 0x43, 0x6f, 0x6e,
+	0x63, 0x65, 0x6e, 0x74, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x12, 0x12, 0x2e, 0x6d, 0x6f,
+	0x62, 0x69, 0x6c, 0x65, 0x72, 0x70, 0x63, 0x2e, 0x4c, 0x69, 0x6e, 0x6b, 0x53, 0x65, 0x74, 0x1a,
+	0x1d, 0x2e, 0x6d, 0x6f, 0x62, 0x69, 0x6c, 0x65, 0x72, 0x70, 0x63, 0x2e, 0x4c, 0x69, 0x6e, 0x6b,
+	0x43, 0x6f, 0x6e, 0x63, 0x65, 0x6e, 0x74, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x22, 0x00,
+	0x30, 0x01, 0x42, 0x39, 0x5a, 0x37, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d,
+	0x2f, 0x79, 0x75, 0x7a, 0x68, 0x6f, 0x75, 0x2d, 0x77, 0x61, 0x6e, 0x67, 0x2f, 0x69, 0x6e, 0x6d,
+	0x61, 0x70, 0x2f, 0x65, 0x6d, 0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x73, 0x2f, 0x6d, 0x6f, 0x62,
+	0x69, 0x6c, 0x65, 0x2f, 0x6d, 0x6f, 0x62, 0x69, 0x6c, 0x65, 0x72, 0x70, 0x63, 0x62, 0x06, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_mobile_proto_rawDescOnce sync.Once
+	file_mobile_proto_rawDescData = file_mobile_proto_rawDesc
+)
+
+func file_mobile_proto_rawDescGZIP() []byte {
+	file_mobile_proto_rawDescOnce.Do(func() {
+		file_mobile_proto_rawDescData = protoimpl.X.CompressGZIP(file_mobile_proto_rawDescData)
+	})
+	return file_mobile_proto_rawDescData
+}
+
+var file_mobile_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_mobile_proto_goTypes = []interface{}{
+	(*Link)(nil),               // 0: mobilerpc.Link
+	(*LinkSet)(nil),            // 1: mobilerpc.LinkSet
+	(*LinkConcentrations)(nil), // 2: mobilerpc.LinkConcentrations
+	nil,                        // 3: mobilerpc.LinkConcentrations.ValuesEntry
+}
+var file_mobile_proto_depIdxs = []int32{
+	3, // 0: mobilerpc.LinkConcentrations.Values:type_name -> mobilerpc.LinkConcentrations.ValuesEntry
+	0, // 1: mobilerpc.MobileEmissions.SetLinks:input_type -> mobilerpc.Link
+	1, // 2: mobilerpc.MobileEmissions.Concentrations:input_type -> mobilerpc.LinkSet
+	1, // 3: mobilerpc.MobileEmissions.SetLinks:output_type -> mobilerpc.LinkSet
+	2, // 4: mobilerpc.MobileEmissions.Concentrations:output_type -> mobilerpc.LinkConcentrations
+	3, // [3:5] is the sub-list for method output_type
+	1, // [1:3] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_mobile_proto_init() }
+func file_mobile_proto_init() {
+	if File_mobile_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_mobile_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Link); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_mobile_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*LinkSet); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_mobile_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*LinkConcentrations); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_mobile_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_mobile_proto_goTypes,
+		DependencyIndexes: file_mobile_proto_depIdxs,
+		MessageInfos:      file_mobile_proto_msgTypes,
+	}.Build()
+	File_mobile_proto = out.File
+	file_mobile_proto_rawDesc = nil
+	file_mobile_proto_goTypes = nil
+	file_mobile_proto_depIdxs = nil
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// MobileEmissionsClient is the client API for MobileEmissions service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type MobileEmissionsClient interface {
+	// SetLinks replaces the link-level emissions in the running
+	// simulation with the streamed links. The new emissions are used
+	// starting with the next simulation period.
+	SetLinks(ctx context.Context, opts ...grpc.CallOption) (MobileEmissions_SetLinksClient, error)
+	// Concentrations waits until the simulation period that used the
+	// requested set of link emissions has finished and then returns the
+	// concentrations at each link.
+	Concentrations(ctx context.Context, in *LinkSet, opts ...grpc.CallOption) (MobileEmissions_ConcentrationsClient, error)
+}
+
+type mobileEmissionsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMobileEmissionsClient(cc grpc.ClientConnInterface) MobileEmissionsClient {
+	return &mobileEmissionsClient{cc}
+}
+
+func (c *mobileEmissionsClient) SetLinks(ctx context.Context, opts ...grpc.CallOption) (MobileEmissions_SetLinksClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_MobileEmissions_serviceDesc.Streams[0], "/mobilerpc.MobileEmissions/SetLinks", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &mobileEmissionsSetLinksClient{stream}
+	return x, nil
+}
+
+type MobileEmissions_SetLinksClient interface {
+	Send(*Link) error
+	CloseAndRecv() (*LinkSet, error)
+	grpc.ClientStream
+}
+
+type mobileEmissionsSetLinksClient struct {
+	grpc.ClientStream
+}
+
+func (x *mobileEmissionsSetLinksClient) Send(m *Link) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *mobileEmissionsSetLinksClient) CloseAndRecv() (*LinkSet, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(LinkSet)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *mobileEmissionsClient) Concentrations(ctx context.Context, in *LinkSet, opts ...grpc.CallOption) (MobileEmissions_ConcentrationsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_MobileEmissions_serviceDesc.Streams[1], "/mobilerpc.MobileEmissions/Concentrations", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &mobileEmissionsConcentrationsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type MobileEmissions_ConcentrationsClient interface {
+	Recv() (*LinkConcentrations, error)
+	grpc.ClientStream
+}
+
+type mobileEmissionsConcentrationsClient struct {
+	grpc.ClientStream
+}
+
+func (x *mobileEmissionsConcentrationsClient) Recv() (*LinkConcentrations, error) {
+	m := new(LinkConcentrations)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MobileEmissionsServer is the server API for MobileEmissions service.
+type MobileEmissionsServer interface {
+	// SetLinks replaces the link-level emissions in the running
+	// simulation with the streamed links. The new emissions are used
+	// starting with the next simulation period.
+	SetLinks(MobileEmissions_SetLinksServer) error
+	// Concentrations waits until the simulation period that used the
+	// requested set of link emissions has finished and then returns the
+	// concentrations at each link.
+	Concentrations(*LinkSet, MobileEmissions_ConcentrationsServer) error
+}
+
+// UnimplementedMobileEmissionsServer can be embedded to have forward compatible implementations.
+type UnimplementedMobileEmissionsServer struct {
+}
+
+func (*UnimplementedMobileEmissionsServer) SetLinks(MobileEmissions_SetLinksServer) error {
+	return status.Errorf(codes.Unimplemented, "method SetLinks not implemented")
+}
+func (*UnimplementedMobileEmissionsServer) Concentrations(*LinkSet, MobileEmissions_ConcentrationsServer) error {
+	return status.Errorf(codes.Unimplemented, "method Concentrations not implemented")
+}
+
+func RegisterMobileEmissionsServer(s *grpc.Server, srv MobileEmissionsServer) {
+	s.RegisterService(&_MobileEmissions_serviceDesc, srv)
+}
+
+func _MobileEmissions_SetLinks_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(MobileEmissionsServer).SetLinks(&mobileEmissionsSetLinksServer{stream})
+}
+
+type MobileEmissions_SetLinksServer interface {
+	SendAndClose(*LinkSet) error
+	Recv() (*Link, error)
+	grpc.ServerStream
+}
+
+type mobileEmissionsSetLinksServer struct {
+	grpc.ServerStream
+}
+
+func (x *mobileEmissionsSetLinksServer) SendAndClose(m *LinkSet) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *mobileEmissionsSetLinksServer) Recv() (*Link, error) {
+	m := new(Link)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _MobileEmissions_Concentrations_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(LinkSet)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MobileEmissionsServer).Concentrations(m, &mobileEmissionsConcentrationsServer{stream})
+}
+
+type MobileEmissions_ConcentrationsServer interface {
+	Send(*LinkConcentrations) error
+	grpc.ServerStream
+}
+
+type mobileEmissionsConcentrationsServer struct {
+	grpc.ServerStream
+}
+
+func (x *mobileEmissionsConcentrationsServer) Send(m *LinkConcentrations) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _MobileEmissions_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "mobilerpc.MobileEmissions",
+	HandlerType: (*MobileEmissionsServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SetLinks",
+			Handler:       _MobileEmissions_SetLinks_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Concentrations",
+			Handler:       _MobileEmissions_Concentrations_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "mobile.proto",
+}
@@ -0,0 +1,167 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.*/
+
+package eieio
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"gonum.org/v1/gonum/mat"
+
+	"github.com/yuzhou-wang/inmap/emissions/slca"
+)
+
+// ReadFinalDemand reads a user-specified final demand vector, such as the
+// purchases of a single firm, from r. The data must be in CSV format with a
+// header row, where the first column holds commodity names (see
+// Commodities) and the second column holds the amount of demand for each
+// commodity in dollars. Commodities that are not included have zero demand
+// and the amounts for commodities that are included more than once are
+// added together.
+func (e *EIO) ReadFinalDemand(r io.Reader) (*mat.VecDense, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	if _, err := cr.Read(); err != nil {
+		return nil, fmt.Errorf("eieio: reading final demand header: %v", err)
+	}
+	v := mat.NewVecDense(len(e.commodities), nil)
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("eieio: reading final demand: %v", err)
+		}
+		i, err := e.CommodityIndex(strings.TrimSpace(rec[0]))
+		if err != nil {
+			return nil, fmt.Errorf("eieio: reading final demand line %d: %v", line, err)
+		}
+		amount, err := strconv.ParseFloat(strings.TrimSpace(rec[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("eieio: reading final demand line %d: %v", line, err)
+		}
+		v.SetVec(i, v.AtVec(i)+amount)
+	}
+	return v, nil
+}
+
+// Attribution holds the spatially-explicit impacts that are attributable
+// to a final demand vector, where each vector has one element for each
+// air quality model grid cell.
+type Attribution struct {
+	// Emissions holds the emissions of each pollutant.
+	Emissions map[slca.Pollutant]*mat.VecDense
+
+	// Concentrations holds the concentrations of each pollutant [μg/m³].
+	Concentrations map[Pollutant]*mat.VecDense
+
+	// Health holds the air quality-related deaths caused by each pollutant.
+	Health map[Pollutant]*mat.VecDense
+}
+
+// Attribute returns the emissions, concentrations, and health impacts
+// caused by demand, which is an arbitrary final demand vector
+// (e.g., from ReadFinalDemand or FinalDemandSingle), in the given year.
+// aqm is the air quality model to use, pop is the population type to
+// calculate health impacts for, hr is the name of a registered hazard
+// ratio function, and loc specifies whether domestic, imported, or total
+// demand should be included.
+func (e *SpatialEIO) Attribute(ctx context.Context, demand *mat.VecDense, aqm, pop, hr string, year Year, loc Location) (*Attribution, error) {
+	if demand.Len() != len(e.commodities) {
+		return nil, fmt.Errorf("eieio: final demand has %d commodities but should have %d", demand.Len(), len(e.commodities))
+	}
+	HR, ok := e.hr[hr]
+	if !ok {
+		return nil, fmt.Errorf("eieio: hazard ratio function `%s` is not registered", hr)
+	}
+	a := &Attribution{
+		Emissions:      make(map[slca.Pollutant]*mat.VecDense),
+		Concentrations: make(map[Pollutant]*mat.VecDense),
+		Health:         make(map[Pollutant]*mat.VecDense),
+	}
+	for _, pol := range []slca.Pollutant{slca.PM25, slca.NH3, slca.NOx, slca.SOx, slca.VOC} {
+		v, err := e.emissions(ctx, demand, nil, aqm, pol, year, loc)
+		if err != nil {
+			return nil, err
+		}
+		a.Emissions[pol] = v
+	}
+	for _, pol := range []Pollutant{PNH4, PNO3, PSO4, SOA, PrimaryPM25, TotalPM25} {
+		v, err := e.concentrations(ctx, demand, nil, aqm, pol, year, loc)
+		if err != nil {
+			return nil, err
+		}
+		a.Concentrations[pol] = v
+		v, err = e.health(ctx, demand, nil, aqm, pol, pop, year, loc, HR)
+		if err != nil {
+			return nil, err
+		}
+		a.Health[pol] = v
+	}
+	return a, nil
+}
+
+// WriteCSV writes a to w in CSV format, with a header row and one row for
+// each air quality model grid cell. The columns hold the emissions
+// ("Emis_" followed by the pollutant name), concentrations ("Conc_"), and
+// health impacts ("Health_") of each pollutant.
+func (a *Attribution) WriteCSV(w io.Writer) error {
+	var header []string
+	var cols []*mat.VecDense
+	for _, pol := range []slca.Pollutant{slca.PM25, slca.NH3, slca.NOx, slca.SOx, slca.VOC} {
+		if v, ok := a.Emissions[pol]; ok {
+			header = append(header, "Emis_"+pol.String())
+			cols = append(cols, v)
+		}
+	}
+	for _, pol := range []Pollutant{PNH4, PNO3, PSO4, SOA, PrimaryPM25, TotalPM25} {
+		if v, ok := a.Concentrations[pol]; ok {
+			header = append(header, "Conc_"+pol.String())
+			cols = append(cols, v)
+		}
+	}
+	for _, pol := range []Pollutant{PNH4, PNO3, PSO4, SOA, PrimaryPM25, TotalPM25} {
+		if v, ok := a.Health[pol]; ok {
+			header = append(header, "Health_"+pol.String())
+			cols = append(cols, v)
+		}
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	var n int
+	if len(cols) > 0 {
+		n = cols[0].Len()
+	}
+	row := make([]string, len(cols))
+	for i := 0; i < n; i++ {
+		for j, c := range cols {
+			row[j] = strconv.FormatFloat(c.AtVec(i), 'g', -1, 64)
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
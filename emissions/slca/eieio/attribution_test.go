@@ -0,0 +1,96 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.*/
+
+package eieio
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"strings"
+	"testing"
+
+	"github.com/yuzhou-wang/inmap/emissions/slca/eieio/eieiorpc"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestAttribute(t *testing.T) {
+	s := loadSpatial(t)
+
+	demand, err := s.ReadFinalDemand(strings.NewReader("Commodity,Amount\nCoal mining,5e5\nOilseed farming,2e5\nCoal mining,5e5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	coal, err := s.FinalDemandSingle("Coal mining", 1.0e6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oilseed, err := s.FinalDemandSingle("Oilseed farming", 2.0e5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := new(mat.VecDense)
+	want.AddVec(coal, oilseed)
+	if !mat.Equal(demand, want) {
+		t.Errorf("final demand: have %v, want %v", demand, want)
+	}
+
+	ctx := context.Background()
+	a, err := s.Attribute(ctx, demand, "isrm", "TotalPop", "NasariACS", 2011, Domestic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	health, err := s.Health(ctx, &eieiorpc.HealthInput{
+		Demand:     vec2rpc(demand),
+		Pollutant:  eieiorpc.Pollutant_TotalPM25,
+		Population: "TotalPop",
+		Year:       2011,
+		Location:   eieiorpc.Location_Domestic,
+		HR:         "NasariACS",
+		AQM:        "isrm",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	haveHealth, wantHealth := mat.Sum(a.Health[TotalPM25]), mat.Sum(array2vec(health.Data))
+	if wantHealth == 0 || different(haveHealth, wantHealth) {
+		t.Errorf("health: have %g, want %g", haveHealth, wantHealth)
+	}
+	if len(a.Emissions) != 5 || len(a.Concentrations) != 6 || len(a.Health) != 6 {
+		t.Errorf("wrong number of pollutants: %d emissions, %d concentrations, %d health", len(a.Emissions), len(a.Concentrations), len(a.Health))
+	}
+
+	var b bytes.Buffer
+	if err := a.WriteCSV(&b); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != a.Health[TotalPM25].Len()+1 || len(recs[0]) != 17 || recs[0][16] != "Health_TotalPM25" {
+		t.Errorf("invalid CSV output: %v", recs[0])
+	}
+
+	if _, err := s.ReadFinalDemand(strings.NewReader("Commodity,Amount\nxxx,1\n")); err == nil {
+		t.Error("invalid commodity should cause an error")
+	}
+	if _, err := s.Attribute(ctx, demand, "isrm", "TotalPop", "xxx", 2011, Domestic); err == nil {
+		t.Error("unregistered hazard ratio function should cause an error")
+	}
+}
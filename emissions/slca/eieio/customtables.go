@@ -0,0 +1,218 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.*/
+
+package eieio
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// CustomTables specifies user-supplied input-output tables for one year
+// in CSV format, which can be used instead of the BEA tables, for example
+// to model newer benchmark years or the economies of other countries.
+// In each table, the first row holds the column names after an initial
+// label cell and the first column holds the row names. The paths can
+// include environment variables.
+type CustomTables struct {
+	// TotalRequirements and DomesticRequirements are the paths to the
+	// industry-by-commodity tables of the total (direct and indirect)
+	// requirements of each industry per dollar of final demand for
+	// each commodity, including and excluding imports, respectively.
+	// The rows are industries and the columns are commodities.
+	TotalRequirements, DomesticRequirements string
+
+	// FinalDemand and ImportFinalDemand are the paths to the
+	// commodity-by-final-demand-type tables of total and imported final
+	// demand in dollars. The rows are commodities, in the same order as
+	// the columns of the requirements tables, and the columns are final
+	// demand types, such as "F010" for personal consumption (see
+	// FinalDemand). Negative demand is set to zero.
+	FinalDemand, ImportFinalDemand string
+}
+
+// newCustom initializes a new EIO object from the custom tables in cfg.
+func newCustom(cfg *Config) (*EIO, error) {
+	eio := new(EIO)
+	eio.years = cfg.Years
+	eio.totalRequirements = make(map[Year]*mat.Dense)
+	eio.domesticRequirements = make(map[Year]*mat.Dense)
+	eio.importRequirements = make(map[Year]*mat.Dense)
+	eio.totalFinalDemand = make(map[Year]map[FinalDemand]*mat.VecDense)
+	eio.importFinalDemand = make(map[Year]map[FinalDemand]*mat.VecDense)
+
+	tables := make(map[Year]CustomTables)
+	for ys, t := range cfg.CustomTables {
+		y, err := strconv.Atoi(ys)
+		if err != nil {
+			return nil, fmt.Errorf("eieio: CustomTables year '%s' is not valid: %v", ys, err)
+		}
+		tables[Year(y)] = CustomTables{
+			TotalRequirements:    os.ExpandEnv(t.TotalRequirements),
+			DomesticRequirements: os.ExpandEnv(t.DomesticRequirements),
+			FinalDemand:          os.ExpandEnv(t.FinalDemand),
+			ImportFinalDemand:    os.ExpandEnv(t.ImportFinalDemand),
+		}
+	}
+
+	for _, year := range cfg.Years {
+		t, ok := tables[year]
+		if !ok {
+			return nil, fmt.Errorf("eieio: missing CustomTables for year %d", year)
+		}
+		total, industries, commodities, err := readCustomTable(t.TotalRequirements)
+		if err != nil {
+			return nil, err
+		}
+		if eio.industries == nil {
+			eio.industries, eio.commodities = industries, commodities
+		} else if err := sameSectors(t.TotalRequirements, "industries", industries, eio.industries); err != nil {
+			return nil, err
+		} else if err := sameSectors(t.TotalRequirements, "commodities", commodities, eio.commodities); err != nil {
+			return nil, err
+		}
+		domestic, industries, commodities, err := readCustomTable(t.DomesticRequirements)
+		if err != nil {
+			return nil, err
+		}
+		if err := sameSectors(t.DomesticRequirements, "industries", industries, eio.industries); err != nil {
+			return nil, err
+		}
+		if err := sameSectors(t.DomesticRequirements, "commodities", commodities, eio.commodities); err != nil {
+			return nil, err
+		}
+		imports := new(mat.Dense)
+		imports.Sub(total, domestic)
+		eio.totalRequirements[year] = total
+		eio.domesticRequirements[year] = domestic
+		eio.importRequirements[year] = imports
+
+		eio.totalFinalDemand[year], err = readCustomFinalDemand(t.FinalDemand, eio.commodities)
+		if err != nil {
+			return nil, err
+		}
+		eio.importFinalDemand[year], err = readCustomFinalDemand(t.ImportFinalDemand, eio.commodities)
+		if err != nil {
+			return nil, err
+		}
+	}
+	eio.industryIndices = indexLookup(eio.industries)
+	eio.commodityIndices = indexLookup(eio.commodities)
+	return eio, nil
+}
+
+// readCustomTable reads a table from the CSV file fileName, returning
+// the values and the row and column names.
+func readCustomTable(fileName string) (m *mat.Dense, rows, cols []string, err error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("eieio: opening custom table: %v", err)
+	}
+	defer f.Close()
+	recs, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("eieio: reading custom table %s: %v", fileName, err)
+	}
+	if len(recs) < 2 || len(recs[0]) < 2 {
+		return nil, nil, nil, fmt.Errorf("eieio: custom table %s is empty", fileName)
+	}
+	for _, c := range recs[0][1:] {
+		cols = append(cols, strings.TrimSpace(c))
+	}
+	m = mat.NewDense(len(recs)-1, len(cols), nil)
+	for i, rec := range recs[1:] {
+		rows = append(rows, strings.TrimSpace(rec[0]))
+		for j, v := range rec[1:] {
+			x, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("eieio: custom table %s row %d: %v", fileName, i+2, err)
+			}
+			m.Set(i, j, x)
+		}
+	}
+	return m, rows, cols, nil
+}
+
+// sameSectors returns an error if the sectors in have, which were read
+// from fileName, are not the same as the sectors in want.
+func sameSectors(fileName, kind string, have, want []string) error {
+	if len(have) != len(want) {
+		return fmt.Errorf("eieio: custom table %s has %d %s but should have %d", fileName, len(have), kind, len(want))
+	}
+	for i, h := range have {
+		if h != want[i] {
+			return fmt.Errorf("eieio: custom table %s: %s %d is `%s` but should be `%s`", fileName, kind, i, h, want[i])
+		}
+	}
+	return nil
+}
+
+// readCustomFinalDemand reads the final demand for each of the given
+// commodities from the CSV file fileName, setting negative numbers to
+// zero, and adds the aggregate demand types AllDemand and NonExport.
+func readCustomFinalDemand(fileName string, commodities []string) (map[FinalDemand]*mat.VecDense, error) {
+	m, rows, types, err := readCustomTable(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if err := sameSectors(fileName, "commodities", rows, commodities); err != nil {
+		return nil, err
+	}
+	o := make(map[FinalDemand]*mat.VecDense)
+	all := mat.NewVecDense(len(commodities), nil)
+	nonExport := mat.NewVecDense(len(commodities), nil)
+	for j, t := range types {
+		v := mat.NewVecDense(len(commodities), nil)
+		for i := range commodities {
+			if x := m.At(i, j); x > 0 {
+				v.SetVec(i, x)
+			}
+		}
+		o[FinalDemand(t)] = v
+		all.AddVec(all, v)
+		if FinalDemand(t) != Export {
+			nonExport.AddVec(nonExport, v)
+		}
+	}
+	o[AllDemand] = all
+	o[NonExport] = nonExport
+	return o, nil
+}
+
+// UnmappedIndustries returns the input-output industries that are not
+// mapped to any SCC code in the SCC map, whose emissions are therefore
+// not accounted for.
+func (s *SpatialEIO) UnmappedIndustries() []string {
+	mapped := make([]bool, len(s.industries))
+	for _, ioRows := range s.sccMap {
+		for _, i := range ioRows {
+			mapped[i] = true
+		}
+	}
+	var o []string
+	for i, industry := range s.industries {
+		if !mapped[i] {
+			o = append(o, industry)
+		}
+	}
+	return o
+}
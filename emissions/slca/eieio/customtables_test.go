@@ -0,0 +1,119 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.*/
+
+package eieio
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/yuzhou-wang/inmap/emissions/slca/eieio/eieiorpc"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestNewCustom(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"total.csv":    "Industry,Steel,Bread\nMills,1.2,0.1\nBakeries,0.05,1.1\n",
+		"domestic.csv": "Industry,Steel,Bread\nMills,1.0,0.1\nBakeries,0.05,1.0\n",
+		"fd.csv":       "Commodity,F010,F040\nSteel,100,50\nBread,200,-10\n",
+		"imports.csv":  "Commodity,F010,F040\nSteel,10,0\nBread,20,0\n",
+		"bad.csv":      "Industry,Steel,Bread\nMills,1.0,0.1\nFarms,0.05,1.0\n",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tables := CustomTables{
+		TotalRequirements:    filepath.Join(dir, "total.csv"),
+		DomesticRequirements: filepath.Join(dir, "domestic.csv"),
+		FinalDemand:          filepath.Join(dir, "fd.csv"),
+		ImportFinalDemand:    filepath.Join(dir, "imports.csv"),
+	}
+	e, err := New(&Config{
+		Years:        []Year{2020},
+		CustomTables: map[string]CustomTables{"2020": tables},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	industries, _ := e.Industries(context.Background(), nil)
+	if !reflect.DeepEqual(industries.List, []string{"Mills", "Bakeries"}) {
+		t.Errorf("industries: %v", industries.List)
+	}
+	demand, err := e.FinalDemand(context.Background(), &eieiorpc.FinalDemandInput{
+		FinalDemandType: eieiorpc.FinalDemandType_AllDemand,
+		Year:            2020,
+		Location:        eieiorpc.Location_Domestic,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Negative demand is set to zero.
+	if want := []float64{140, 180}; !reflect.DeepEqual(demand.Data, want) {
+		t.Errorf("domestic demand: have %v, want %v", demand.Data, want)
+	}
+	demand, err = e.FinalDemand(context.Background(), &eieiorpc.FinalDemandInput{
+		FinalDemandType: eieiorpc.FinalDemandType_NonExport,
+		Year:            2020,
+		Location:        eieiorpc.Location_Total,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []float64{100, 200}; !reflect.DeepEqual(demand.Data, want) {
+		t.Errorf("non-export demand: have %v, want %v", demand.Data, want)
+	}
+
+	steel, err := e.FinalDemandSingle("Steel", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imports, err := e.EconomicImpacts(steel, 2020, Imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mat.NewVecDense(2, []float64{0.2, 0}); !mat.EqualApprox(imports, want, 1.e-10) {
+		t.Errorf("import impacts: have %v, want %v", mat.Formatted(imports.T()), mat.Formatted(want.T()))
+	}
+
+	s := &SpatialEIO{sccMap: [][]int{{0}}}
+	s.industries = e.industries
+	if u := s.UnmappedIndustries(); !reflect.DeepEqual(u, []string{"Bakeries"}) {
+		t.Errorf("unmapped industries: %v", u)
+	}
+
+	tables.DomesticRequirements = filepath.Join(dir, "bad.csv")
+	if _, err := New(&Config{
+		Years:        []Year{2020},
+		CustomTables: map[string]CustomTables{"2020": tables},
+	}); err == nil {
+		t.Error("mismatched sectors should cause an error")
+	}
+	if _, err := New(&Config{
+		Years:        []Year{2021},
+		CustomTables: map[string]CustomTables{"2020": tables},
+	}); err == nil {
+		t.Error("missing year should cause an error")
+	}
+}
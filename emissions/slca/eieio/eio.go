@@ -62,6 +62,11 @@ type Config struct {
 	// the locations of the BEA total requirements and domestic requirements
 	// files (Industry x Commodity) at the detailed level of detail.
 	TotalRequirementsDetail, DomesticRequirementsDetail string
+
+	// CustomTables holds user-supplied input-output tables for each
+	// year in Years. If it is specified, the BEA files above are
+	// not used.
+	CustomTables map[string]CustomTables
 }
 
 // Year specifies the year of the analysis.
@@ -111,6 +116,9 @@ type EIO struct {
 // New initializes a new EIO object based on the given
 // configuration.
 func New(cfg *Config) (*EIO, error) {
+	if len(cfg.CustomTables) > 0 {
+		return newCustom(cfg)
+	}
 	eio := new(EIO)
 	eio.years = cfg.Years
 	eio.totalRequirements = make(map[Year]*mat.Dense)
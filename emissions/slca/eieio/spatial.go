@@ -21,8 +21,10 @@ import (
 	"bytes"
 	"context"
 	"encoding/gob"
+	"fmt"
 	"os"
 	"reflect"
+	"strings"
 	"sync"
 
 	"github.com/ctessum/requestcache"
@@ -111,6 +113,11 @@ type SpatialConfig struct {
 	SCCMapFile         string
 	SCCDescriptionFile string
 
+	// RequireCompleteSCCMap specifies whether it is an error for any
+	// input-output industry not to be mapped to an SCC code in SCCMapFile,
+	// which is useful for checking custom input-output tables.
+	RequireCompleteSCCMap bool
+
 	Config     Config
 	SpatialEIO SpatialEIO
 }
@@ -132,6 +139,9 @@ func NewSpatial(c *SpatialConfig, hr ...epi.HRer) (*SpatialEIO, error) {
 		return nil, err
 	}
 	s := &c.SpatialEIO
+	if u := s.UnmappedIndustries(); c.RequireCompleteSCCMap && len(u) > 0 {
+		return nil, fmt.Errorf("eieio: industries are not mapped to any SCC codes: %s", strings.Join(u, "; "))
+	}
 
 	s.totalRequirementsSCC = make(map[Year]*mat.Dense)
 	s.domesticRequirementsSCC = make(map[Year]*mat.Dense)
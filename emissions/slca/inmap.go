@@ -442,7 +442,7 @@ func (c *CSTConfig) evaluationEmissions(ctx context.Context, aqmYearI interface{
 	for _, e := range emisGridded {
 		aepRecs = append(aepRecs, e...)
 	}
-	spatialEmis, err := inmap.FromAEP(aepRecs, sp.Grids, 0, VOC, NOx, NH3, SOx, PM25)
+	spatialEmis, err := inmap.FromAEP(aepRecs, sp.Grids, 0, VOC, NOx, NH3, SOx, PM25, nil, nil, nil)
 	if err != nil {
 		return nil, err
 	}
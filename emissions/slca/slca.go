@@ -345,11 +345,8 @@ func (c *CSTConfig) srSetup(aqm string) (*aeputil.SpatialConfig, *sr.Reader, *rt
 		return nil, nil, nil, fmt.Errorf("air quality model `%s` is not included in config.SRFiles; valid aqms include %v", aqm, c.SRFiles)
 	}
 
-	f, err := os.Open(srFile)
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("slca: opening sr matrix file: %w", err)
-	}
-	c.srCache.sr, err = sr.NewReader(f)
+	var err error
+	c.srCache.sr, err = sr.Open(context.TODO(), srFile)
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("slca: opening sr matrix file: %w", err)
 	}
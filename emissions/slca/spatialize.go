@@ -264,7 +264,7 @@ func (c *CSTConfig) neiEmisSrg(spatialRef *SpatialRef) ([]*inmap.EmisRecord, err
 	if err != nil {
 		return nil, err
 	}
-	outData, err := inmap.FromAEP(aepRecs, sp.Grids, 0, VOC, NOx, NH3, SOx, PM25)
+	outData, err := inmap.FromAEP(aepRecs, sp.Grids, 0, VOC, NOx, NH3, SOx, PM25, nil, nil, nil)
 	if err != nil {
 		return nil, err
 	}
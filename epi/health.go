@@ -124,6 +124,159 @@ var Lepeule2012 = Cox{
 	Label:     "Lepeule2012",
 }
 
+// Turner2016 is a Cox proportional-hazards model for all-cause mortality
+// caused by long-term exposure to ozone (O3) from the study:
+//
+// Turner, M. C., Jerrett, M., Pope, C. A., Krewski, D., Gapstur, S. M.,
+// Diver, W. R., … Burnett, R. T. (2016). Long-Term Ozone Exposure and
+// Mortality in a Large Prospective Study. American Journal of Respiratory
+// and Critical Care Medicine, 193(10), 1134–1142.
+// http://doi.org/10.1164/rccm.201508-1633OC
+//
+// The study reports hazard ratios per 10 ppb of the annual average daily
+// maximum 8-hour O3 concentration; the coefficient here is per μg/m³,
+// using 1.962 μg/m³ per ppb at 25 °C and 1 atm.
+var Turner2016 = Cox{
+	Beta:      0.001009308221, // ln(1.02) / (10 * 1.962)
+	Threshold: 0,
+	Label:     "Turner2016",
+}
+
+// Turner2016Respiratory is a Cox proportional-hazards model for
+// respiratory mortality caused by long-term exposure to ozone from the
+// same study and with the same units as Turner2016.
+var Turner2016Respiratory = Cox{
+	Beta:      0.005776181718, // ln(1.12) / (10 * 1.962)
+	Threshold: 0,
+	Label:     "Turner2016Respiratory",
+}
+
+// Mar2010AsthmaER is a log-linear model for emergency room visits for
+// asthma caused by short-term exposure to PM2.5 from the study:
+//
+// Mar, T. F., Koenig, J. Q., & Primomo, J. (2010). Associations between
+// asthma emergency visits and particulate matter sources, including diesel
+// emissions from stationary generators in Tacoma, Washington. Inhalation
+// Toxicology, 22(6), 445–448. http://doi.org/10.3109/08958370903575774
+//
+// The study reports a relative risk of 1.04 per 6.5 μg/m³ increase in
+// PM2.5. When used with annual average concentrations, it assumes that
+// daily changes in concentrations are proportional to the annual average
+// change.
+var Mar2010AsthmaER = Cox{
+	Beta:      0.006033955870, // ln(1.04) / 6.5
+	Threshold: 0,
+	Label:     "Mar2010AsthmaER",
+}
+
+// Sun2015PretermBirth is a log-linear model for preterm birth caused by
+// exposure to PM2.5 during pregnancy from the meta-analysis:
+//
+// Sun, X., Luo, X., Zhao, C., Ng, R. W. C., Lim, C. E. D., Zhang, B., &
+// Liu, T. (2015). The association between fine particulate matter exposure
+// during pregnancy and preterm birth: a meta-analysis. BMC Pregnancy and
+// Childbirth, 15, 300. http://doi.org/10.1186/s12884-015-0738-2
+//
+// The coefficient is from the pooled odds ratio of 1.13 per 10 μg/m³
+// for exposure during the entire pregnancy.
+var Sun2015PretermBirth = Cox{
+	Beta:      0.01222176327, // ln(1.13) / 10
+	Threshold: 0,
+	Label:     "Sun2015PretermBirth",
+}
+
+// Kioumourtzoglou2016Dementia is a Cox proportional-hazards model for first
+// hospital admissions for dementia caused by long-term exposure to PM2.5
+// from the study:
+//
+// Kioumourtzoglou, M.-A., Schwartz, J. D., Weisskopf, M. G., Melly, S. J.,
+// Wang, Y., Dominici, F., & Zanobetti, A. (2016). Long-term PM2.5 Exposure
+// and Neurological Hospital Admissions in the Northeastern United States.
+// Environmental Health Perspectives, 124(1), 23–29.
+// http://doi.org/10.1289/ehp.1408973
+//
+// The study population is people aged 65 and over, so the population
+// and baseline incidence rate that it is used with should be for that
+// age group.
+var Kioumourtzoglou2016Dementia = Cox{
+	Beta:      0.07696104114, // ln(1.08)
+	Threshold: 0,
+	Label:     "Kioumourtzoglou2016Dementia",
+}
+
+// GEMM implements the Global Exposure Mortality Model described in:
+//
+// Burnett R, Chen H, Szyszkowicz M, Fann N, Hubbell B, Pope CA, … Spadaro JV.
+// (2018). Global estimates of mortality associated with long-term exposure
+// to outdoor fine particulate matter. Proceedings of the National Academy
+// of Sciences, 115(38), 9592–9597. http://doi.org/10.1073/pnas.1803222115
+type GEMM struct {
+	// Theta, Alpha, Mu, and Nu are the model parameters, where Theta is
+	// the coefficient, Alpha controls the curvature, and Mu and Nu control
+	// the shape of the logistic weighting function.
+	Theta, Alpha, Mu, Nu float64
+
+	// CF is the counterfactual concentration below which health
+	// effects are assumed to be zero.
+	CF float64
+
+	// Label is the name of the function.
+	Label string
+}
+
+// HR calculates the hazard ratio caused by concentration z.
+func (g GEMM) HR(z float64) float64 {
+	z = math.Max(0, z-g.CF)
+	return math.Exp(g.Theta * math.Log(z/g.Alpha+1) / (1 + math.Exp(-(z-g.Mu)/g.Nu)))
+}
+
+// Name returns the label for this function.
+func (g GEMM) Name() string { return g.Label }
+
+// GEMMNCDLRI is the GEMM model for deaths from non-communicable diseases
+// and lower respiratory infections, fit to cohorts that include
+// the Chinese Male cohort, from Table S2 of the study described for GEMM.
+var GEMMNCDLRI = GEMM{
+	Theta: 0.1430,
+	Alpha: 1.6,
+	Mu:    15.5,
+	Nu:    36.8,
+	CF:    2.4,
+	Label: "GEMMNCDLRI",
+}
+
+// IER implements an integrated exposure-response model as described in:
+//
+// Burnett RT, Pope CA III, Ezzati M, Olives C, Lim SS, Mehta S, … Cohen A.
+// (2014). An Integrated Risk Function for Estimating the Global Burden of
+// Disease Attributable to Ambient Fine Particulate Matter Exposure.
+// Environmental Health Perspectives, 122(4), 397–403.
+// http://doi.org/10.1289/ehp.1307049
+//
+// The parameters differ among causes of death and age groups.
+type IER struct {
+	// Alpha, Gamma, and Delta are the model parameters.
+	Alpha, Gamma, Delta float64
+
+	// ZCF is the counterfactual concentration below which health
+	// effects are assumed to be zero.
+	ZCF float64
+
+	// Label is the name of the function.
+	Label string
+}
+
+// HR calculates the hazard ratio caused by concentration z.
+func (r IER) HR(z float64) float64 {
+	if z <= r.ZCF {
+		return 1
+	}
+	return 1 + r.Alpha*(1-math.Exp(-r.Gamma*math.Pow(z-r.ZCF, r.Delta)))
+}
+
+// Name returns the label for this function.
+func (r IER) Name() string { return r.Label }
+
 // HRer is an interface for any type that can calculate the hazard ratio
 // caused by concentration z.
 type HRer interface {
@@ -20,6 +20,7 @@ package epi
 
 import (
 	"fmt"
+	"math"
 	"testing"
 )
 
@@ -139,3 +140,72 @@ func TestKrewski2009(t *testing.T) {
 		t.Errorf("for z=%g: %g != %g", 15.0, c, cWant)
 	}
 }
+
+func TestTurner2016(t *testing.T) {
+	const ugPerPPB = 1.962 // μg/m³ O3 per ppb
+	for _, test := range []struct {
+		hr   Cox
+		want float64
+	}{
+		{hr: Turner2016, want: 1.02},
+		{hr: Turner2016Respiratory, want: 1.12},
+	} {
+		t.Run(test.hr.Name(), func(t *testing.T) {
+			if have := test.hr.HR(10 * ugPerPPB); math.Abs(have-test.want) > 1.e-6 {
+				t.Errorf("HR for 10 ppb = %g, want %g", have, test.want)
+			}
+			if have := test.hr.HR(0); have != 1 {
+				t.Errorf("HR for 0 ppb = %g, want 1", have)
+			}
+		})
+	}
+}
+
+func TestMorbidity(t *testing.T) {
+	for _, test := range []struct {
+		hr   Cox
+		z    float64
+		want float64
+	}{
+		{hr: Mar2010AsthmaER, z: 6.5, want: 1.04},
+		{hr: Sun2015PretermBirth, z: 10, want: 1.13},
+		{hr: Kioumourtzoglou2016Dementia, z: 1, want: 1.08},
+	} {
+		t.Run(test.hr.Name(), func(t *testing.T) {
+			if have := test.hr.HR(test.z); math.Abs(have-test.want) > 1.e-9 {
+				t.Errorf("HR(%g) = %g, want %g", test.z, have, test.want)
+			}
+		})
+	}
+}
+
+func TestGEMM(t *testing.T) {
+	g := GEMMNCDLRI
+	if have := g.HR(g.CF); have != 1 {
+		t.Errorf("HR at counterfactual = %g, want 1", have)
+	}
+	prev := 1.
+	for z := 5.; z <= 100; z += 5 {
+		hr := g.HR(z)
+		if hr <= prev {
+			t.Errorf("HR should increase with concentration: HR(%g) = %g", z, hr)
+		}
+		prev = hr
+	}
+	// Calculated by hand.
+	const want = 1.218299559140952
+	if have := g.HR(22.4); math.Abs(have-want) > 1.e-12 {
+		t.Errorf("HR(22.4) = %v, want %v", have, want)
+	}
+}
+
+func TestIER(t *testing.T) {
+	r := IER{Alpha: 0.5, Gamma: 0.01, Delta: 1, ZCF: 5}
+	if have := r.HR(3); have != 1 {
+		t.Errorf("HR below counterfactual = %g, want 1", have)
+	}
+	want := 1 + 0.5*(1-math.Exp(-0.01*10))
+	if have := r.HR(15); have != want {
+		t.Errorf("HR(15) = %g, want %g", have, want)
+	}
+}
@@ -187,9 +187,10 @@ func TestAnimation_logo(t *testing.T) {
 
 	if err := inmaputil.Run(nil, "animation_logo/logoOut.log", "animation_logo/logoOut.shp", false,
 		map[string]string{"TotalPM25": "TotalPM25"}, cfg.GetString("EmissionUnits"),
-		[]string{"animation_logo/logo.shp"}, nil,
-		vgc, nil, nil, cfg.GetString("InMAPData"), cfg.GetString("VariableGridData"), cfg.GetInt("NumIterations"),
-		dynamic, createGrid, inmaputil.DefaultScienceFuncs, nil,
+		[]string{"animation_logo/logo.shp"}, nil, 0, 0,
+		vgc, nil, nil, cfg.GetString("InMAPData"), nil, "", cfg.GetString("VariableGridData"), "", "", cfg.GetInt("NumIterations"), nil, nil,
+		"", 0, false,
+		dynamic, createGrid, false, nil, nil, inmaputil.DefaultScienceFuncs, nil,
 		[]inmap.DomainManipulator{inmap.RunPeriodically(framePeriod, saveConc(dataChan))}, nil, simplechem.Mechanism{}); err != nil {
 		t.Fatal(err)
 	}
@@ -242,9 +243,10 @@ func TestAnimation_nei(t *testing.T) {
 
 	if err := inmaputil.Run(nil, "animation_nei/results.log", "animation_nei/results.shp", false,
 		inmaputil.GetStringMapString("OutputVariables", cfg.Viper), cfg.GetString("EmissionUnits"),
-		cfg.GetStringSlice("EmissionsShapefiles"), nil,
-		vgc, nil, nil, cfg.GetString("InMAPData"), cfg.GetString("VariableGridData"), cfg.GetInt("NumIterations"),
-		dynamic, createGrid, inmaputil.DefaultScienceFuncs, nil,
+		cfg.GetStringSlice("EmissionsShapefiles"), nil, 0, 0,
+		vgc, nil, nil, cfg.GetString("InMAPData"), nil, "", cfg.GetString("VariableGridData"), "", "", cfg.GetInt("NumIterations"), nil, nil,
+		"", 0, false,
+		dynamic, createGrid, false, nil, nil, inmaputil.DefaultScienceFuncs, nil,
 		[]inmap.DomainManipulator{inmap.RunPeriodically(framePeriod, saveConc(dataChan))}, nil, simplechem.Mechanism{}); err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,89 @@
+package eval
+
+import (
+	"os"
+	"testing"
+
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/inmaputil"
+	"github.com/yuzhou-wang/inmap/science/chem/simplechem"
+)
+
+// BenchmarkScience_nei2005 measures the speed of the transport
+// calculations on the continental US grid used for the NEI 2005
+// evaluation, one cell at a time and in batches
+// (see inmap.BatchedTransport).
+func BenchmarkScience_nei2005(b *testing.B) {
+	evalData := os.Getenv(evalDataEnv)
+	if evalData == "" {
+		b.Fatalf("please set the '%s' environment variable to the location of the "+
+			"downloaded evaluation data and try again", evalDataEnv)
+	}
+
+	cfg := inmaputil.InitializeConfig()
+	cfg.SetConfigFile("nei2005Config.toml")
+	if err := cfg.ReadInConfig(); err != nil {
+		b.Fatal(err)
+	}
+	vgc, err := inmaputil.VarGridConfig(cfg.Viper)
+	if err != nil {
+		b.Fatal(err)
+	}
+	r, err := os.Open(os.ExpandEnv(cfg.GetString("VariableGridData")))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer r.Close()
+
+	var m simplechem.Mechanism
+	d := &inmap.InMAP{
+		InitFuncs: []inmap.DomainManipulator{
+			inmap.Load(r, vgc, nil, m),
+			inmap.SetTimestepCFL(),
+		},
+	}
+	if err := d.Init(); err != nil {
+		b.Fatal(err)
+	}
+	cells := d.Cells()
+	b.Logf("%d grid cells", len(cells))
+
+	for _, f := range []struct {
+		name string
+		f    inmap.CellManipulator
+	}{
+		{name: "UpwindAdvection", f: inmap.UpwindAdvection()},
+		{name: "Mixing", f: inmap.Mixing()},
+		{name: "MeanderMixing", f: inmap.MeanderMixing()},
+	} {
+		b.Run(f.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, c := range cells {
+					f.f(c, d.Dt)
+				}
+			}
+			b.ReportMetric(float64(b.N*len(cells))/b.Elapsed().Seconds(), "cells/s")
+		})
+	}
+
+	batch := inmap.NewBatchedTransport(inmap.UpwindAdvection(), inmap.Mixing(), inmap.MeanderMixing())
+	if err := batch.Init()(d); err != nil {
+		b.Fatal(err)
+	}
+	for _, f := range []struct {
+		name string
+		f    inmap.DomainManipulator
+	}{
+		{name: "Calculations", f: inmap.Calculations(inmap.UpwindAdvection(), inmap.Mixing(), inmap.MeanderMixing())},
+		{name: "Batched", f: batch.Calculate()},
+	} {
+		b.Run(f.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := f.f(d); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N*len(cells))/b.Elapsed().Seconds(), "cells/s")
+		})
+	}
+}
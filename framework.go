@@ -56,6 +56,29 @@ type InMAP struct {
 	// simulation has completed.
 	CleanupFuncs []DomainManipulator
 
+	// Deterministic specifies whether the calculations returned by
+	// Calculations should be performed on one grid cell at a time in a
+	// fixed order, so that repeated simulations give exactly the same
+	// results. Otherwise, the grid cells are processed concurrently,
+	// which is faster, but because the calculations in each cell also
+	// change the concentrations in neighboring cells, the order in
+	// which the cells happen to be processed can cause small
+	// differences among simulations.
+	Deterministic bool
+
+	// CellStorageDir is a directory where the concentrations in the grid
+	// cells are stored in memory-mapped files rather than in memory,
+	// which allows grids that are larger than the available memory to
+	// be simulated, although more slowly. If CellStorageDir is empty,
+	// the concentrations are stored in memory. If it is not empty, the
+	// concentrations are no longer available after Cleanup has run:
+	// the concentration arrays of the cells are set to nil, and Results
+	// and the other functions that return results return an error.
+	CellStorageDir string
+
+	// cellStore holds the concentration arrays of the grid cells.
+	cellStore cellStore
+
 	cells   *cellList // One data holder for each grid cell
 	Dt      float64   // seconds
 	nlayers int       // number of model layers
@@ -87,6 +110,19 @@ type InMAP struct {
 	// index is a spatial index of Cells.
 	index *rtree.Rtree
 
+	// global holds the bounds of the grid if it is a global grid
+	// (see VarGridConfig.globalBounds), and is nil otherwise.
+	global *geom.Bounds
+
+	// progress records how far the simulation has progressed. It is
+	// updated by ConvergenceCheck and saved in checkpoints
+	// (see SaveCheckpoint).
+	progress progress
+
+	// partition is the part of the grid simulated by this worker in a
+	// distributed simulation (see LoadPartition), and is nil otherwise.
+	partition *partition
+
 	cellLock sync.Mutex
 }
 
@@ -109,6 +145,7 @@ func (d *InMAP) init() {
 	d.southBoundary = new(cellList)
 	d.topBoundary = new(cellList)
 	d.index = rtree.NewTree(25, 50)
+	d.cellStore.dir = d.CellStorageDir
 }
 
 // Run carries out the simulation by running d.RunFuncs until d.Done is true.
@@ -123,14 +160,16 @@ func (d *InMAP) Run() error {
 	return nil
 }
 
-// Cleanup finishes the simulation by running d.CleanupFuncs.
+// Cleanup finishes the simulation by running d.CleanupFuncs and
+// then releasing the files in d.CellStorageDir, if any.
 func (d *InMAP) Cleanup() error {
 	for _, f := range d.CleanupFuncs {
 		if err := f(d); err != nil {
 			return err
 		}
 	}
-	return nil
+	return d.cellStore.unmap(d.cells, d.westBoundary, d.eastBoundary,
+		d.northBoundary, d.southBoundary, d.topBoundary)
 }
 
 // Cell holds the state of a single grid cell.
@@ -151,11 +190,28 @@ type Cell struct {
 	NHPartitioning   float64 `desc:"Ammonium particle partitioning" units:"fraction particles"`
 	SO2oxidation     float64 `desc:"SO2 oxidation to SO4 by HO and H2O2" units:"1/s"`
 
+	// Variables used for modeling ozone, which are zero unless the
+	// CTM data was preprocessed with the Ozone option.
+	BaselineO3       float64 `desc:"Baseline ozone concentration" units:"μg/m³"`
+	O3NOxSensitivity float64 `desc:"Fraction of ozone formation that is NOx-limited" units:"fraction"`
+	NOxOxidation     float64 `desc:"NOx oxidation to HNO3 by HO" units:"1/s"`
+	VOCOxidation     float64 `desc:"VOC oxidation by HO" units:"1/s"`
+
+	// Average temperature [K] and relative humidity [fraction] in each
+	// of Seasons, which are zero unless the CTM data was preprocessed
+	// with the NitrateEquilibrium option.
+	SeasonalTemperature [4]float64
+	SeasonalRH          [4]float64
+
 	ParticleWetDep float64 `desc:"Particle wet deposition" units:"1/s"`
 	SO2WetDep      float64 `desc:"SO2 wet deposition" units:"1/s"`
 	OtherGasWetDep float64 `desc:"Wet deposition: other gases" units:"1/s"`
 	ParticleDryDep float64 `desc:"Particle dry deposition" units:"m/s"`
 
+	// CoarseParticleDryDep is zero unless the CTM data was
+	// preprocessed with the CoarsePM option.
+	CoarseParticleDryDep float64 `desc:"Coarse (PM10-2.5) particle dry deposition" units:"m/s"`
+
 	NH3DryDep float64 `desc:"Ammonia dry deposition" units:"m/s"`
 	SO2DryDep float64 `desc:"SO2 dry deposition" units:"m/s"`
 	VOCDryDep float64 `desc:"VOC dry deposition" units:"m/s"`
@@ -180,14 +236,14 @@ type Cell struct {
 	EmisFlux  []float64 // emissions [μg/m³/s]
 	CBaseline []float64 // Total baseline PM2.5 concentration.
 
-	west        *cellList // Neighbors to the East
-	east        *cellList // Neighbors to the West
-	south       *cellList // Neighbors to the South
-	north       *cellList // Neighbors to the North
-	below       *cellList // Neighbors below
-	above       *cellList // Neighbors above
-	groundLevel *cellList // Neighbors at ground level
-	boundary    bool      // Does this cell represent a boundary condition?
+	west        cellList // Neighbors to the East
+	east        cellList // Neighbors to the West
+	south       cellList // Neighbors to the South
+	north       cellList // Neighbors to the North
+	below       cellList // Neighbors below
+	above       cellList // Neighbors above
+	groundLevel cellList // Neighbors at ground level
+	boundary    bool     // Does this cell represent a boundary condition?
 
 	Layer       int     `desc:"Vertical layer index" units:"-"`
 	LayerHeight float64 `desc:"Height at layer bottom" units:"m"`
@@ -200,10 +256,18 @@ type Cell struct {
 	S1                         float64 `desc:"Stability parameter" units:"?"`
 	SClass                     float64 `desc:"Stability class" units:"0=Unstable; 1=Stable"`
 
+	// NearRoadEnhancement is the ratio of the primary PM2.5 concentration
+	// next to line emissions sources to the average concentration in the
+	// cell. It is only calculated for ground-level cells when
+	// Emissions.NearRoadWidth is set (see (*Cell).SetEmissionsFlux).
+	NearRoadEnhancement float64 `desc:"Near-road primary PM2.5 enhancement factor" units:"-"`
+
 	mutex sync.RWMutex // Avoid cell being written by one subroutine and read by another at the same time.
 
 	Index                 [][2]int // Index gives this cell's place in the nest structure.
 	AboveDensityThreshold bool
+
+	inStore bool // Was this cell allocated by a cellStore?
 }
 
 func (c *Cell) String() string {
@@ -244,17 +308,11 @@ func (c *Cell) make(m Mechanism) {
 	c.Ci = make([]float64, m.Len())
 	c.Cf = make([]float64, m.Len())
 	c.CBaseline = make([]float64, len(PolNames))
-	c.west = new(cellList)
-	c.east = new(cellList)
-	c.south = new(cellList)
-	c.north = new(cellList)
-	c.below = new(cellList)
-	c.above = new(cellList)
-	c.groundLevel = new(cellList)
 }
 
-func (c *Cell) boundaryCopy(m Mechanism) *Cell {
-	c2 := new(Cell)
+// boundaryCopy sets c2 to a boundary cell with the same geometry and
+// meteorology as c and returns it.
+func (c *Cell) boundaryCopy(c2 *Cell, m Mechanism) *Cell {
 	c2.Polygonal = c.Polygonal
 	c2.Dx, c2.Dy, c2.Dz = c.Dx, c.Dy, c.Dz
 	c2.UAvg, c2.VAvg, c2.WAvg = c.UAvg, c.VAvg, c.WAvg
@@ -272,7 +330,8 @@ func (c *Cell) boundaryCopy(m Mechanism) *Cell {
 
 // addWestBoundary adds a cell to the western boundary of the domain.
 func (d *InMAP) addWestBoundary(cell *Cell, m Mechanism) {
-	c := cell.boundaryCopy(m)
+	c := cell.boundaryCopy(d.cellStore.newCell(), m)
+	d.cellStore.store(c)
 	ref := cell.west.add(c)
 	d.westBoundary.add(c)
 	neighborInfoBoundaryEastWest(ref)
@@ -280,7 +339,8 @@ func (d *InMAP) addWestBoundary(cell *Cell, m Mechanism) {
 
 // addEastBoundary adds a cell to the eastern boundary of the domain.
 func (d *InMAP) addEastBoundary(cell *Cell, m Mechanism) {
-	c := cell.boundaryCopy(m)
+	c := cell.boundaryCopy(d.cellStore.newCell(), m)
+	d.cellStore.store(c)
 	ref := cell.east.add(c)
 	d.eastBoundary.add(c)
 	neighborInfoBoundaryEastWest(ref)
@@ -288,7 +348,8 @@ func (d *InMAP) addEastBoundary(cell *Cell, m Mechanism) {
 
 // addSouthBoundary adds a cell to the southern boundary of the domain.
 func (d *InMAP) addSouthBoundary(cell *Cell, m Mechanism) {
-	c := cell.boundaryCopy(m)
+	c := cell.boundaryCopy(d.cellStore.newCell(), m)
+	d.cellStore.store(c)
 	ref := cell.south.add(c)
 	d.southBoundary.add(c)
 	neighborInfoBoundarySouthNorth(ref)
@@ -296,7 +357,8 @@ func (d *InMAP) addSouthBoundary(cell *Cell, m Mechanism) {
 
 // addNorthBoundary adds a cell to the northern boundary of the domain.
 func (d *InMAP) addNorthBoundary(cell *Cell, m Mechanism) {
-	c := cell.boundaryCopy(m)
+	c := cell.boundaryCopy(d.cellStore.newCell(), m)
+	d.cellStore.store(c)
 	ref := cell.north.add(c)
 	d.northBoundary.add(c)
 	neighborInfoBoundarySouthNorth(ref)
@@ -304,7 +366,8 @@ func (d *InMAP) addNorthBoundary(cell *Cell, m Mechanism) {
 
 // addTopBoundary adds a cell to the top boundary of the domain.
 func (d *InMAP) addTopBoundary(cell *Cell, m Mechanism) {
-	c := cell.boundaryCopy(m)
+	c := cell.boundaryCopy(d.cellStore.newCell(), m)
+	d.cellStore.store(c)
 	ref := cell.above.add(c)
 	d.topBoundary.add(c)
 	neighborInfoBoundaryTopBottom(ref)
@@ -314,7 +377,9 @@ func (d *InMAP) addTopBoundary(cell *Cell, m Mechanism) {
 // Courant–Friedrichs–Lewy (CFL) condition
 // for advection or Von Neumann stability analysis
 // (http://en.wikipedia.org/wiki/Von_Neumann_stability_analysis) for
-// diffusion, whichever one yields a smaller time step.
+// diffusion, whichever one yields a smaller time step. In a distributed
+// simulation (see LoadPartition), the time step is the smallest one
+// across all of the partitions.
 func SetTimestepCFL() DomainManipulator {
 	sqrt3 := math.Pow(3., 0.5)
 	return func(d *InMAP) error {
@@ -339,6 +404,13 @@ func SetTimestepCFL() DomainManipulator {
 
 			d.Dt = amin(d.Dt, dt1) // seconds
 		}
+		if d.partition != nil {
+			// All of the workers use the same time step.
+			var err error
+			if d.Dt, err = d.partition.min(d.Dt); err != nil {
+				return fmt.Errorf("inmap: setting time step: %v", err)
+			}
+		}
 		if !(d.Dt > 0) {
 			return fmt.Errorf("invalid timestep %g; check InMAP input data", d.Dt)
 		}
@@ -452,7 +524,7 @@ func (d *InMAP) VerticalProfile(variable string, p geom.Point, m Mechanism) (hei
 	for !c.boundary {
 		vals[i] = c.getValue(variable, d.PopIndices, d.mortIndices, m)
 		height[i] = c.LayerHeight + c.Dz/2.
-		c = (*c.above)[0].Cell
+		c = c.above[0].Cell
 		i++
 	}
 	return
@@ -0,0 +1,225 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/ctessum/geom/index/rtree"
+	"github.com/ctessum/geom/proj"
+)
+
+// projectionRegion holds the factors for projecting population and
+// mortality rates to a future year within a region, such as a county.
+type projectionRegion struct {
+	geom.Polygonal
+
+	// factors are the scaling factors for each population and mortality
+	// rate column.
+	factors map[string]float64
+}
+
+// projectionFactors holds the regions that population and mortality rates
+// are projected within.
+type projectionFactors struct {
+	regions *rtree.Rtree
+}
+
+// loadProjection loads the factors for config.ProjectionYear from
+// config.ProjectionFile and the regions they apply to from
+// config.ProjectionRegionFile, converting the regions to spatial
+// reference sr. It returns nil if config.ProjectionFile is not specified.
+func (config *VarGridConfig) loadProjection(sr *proj.SR) (*projectionFactors, error) {
+	if config.ProjectionFile == "" {
+		return nil, nil
+	}
+	factors, err := config.readProjectionFactors()
+	if err != nil {
+		return nil, err
+	}
+
+	regionShp, err := shp.NewDecoder(config.ProjectionRegionFile)
+	if err != nil {
+		return nil, err
+	}
+	defer regionShp.Close()
+	regionSR, err := regionShp.SR()
+	if err != nil {
+		return nil, err
+	}
+	trans, err := regionSR.NewTransform(sr)
+	if err != nil {
+		return nil, err
+	}
+	p := &projectionFactors{regions: rtree.NewTree(25, 50)}
+	for {
+		g, fields, more := regionShp.DecodeRowFields(config.ProjectionIDColumn)
+		if !more {
+			break
+		}
+		id, ok := fields[config.ProjectionIDColumn]
+		if !ok {
+			return nil, fmt.Errorf("inmap: loading ProjectionRegionFile: missing attribute column %s", config.ProjectionIDColumn)
+		}
+		f, ok := factors[strings.Trim(id, "\x00 ")]
+		if !ok {
+			continue
+		}
+		gg, err := g.Transform(trans)
+		if err != nil {
+			return nil, err
+		}
+		poly, ok := gg.(geom.Polygonal)
+		if !ok {
+			return nil, fmt.Errorf("inmap: loadProjection: projection region shapes need to be polygons")
+		}
+		p.regions.Insert(&projectionRegion{Polygonal: poly, factors: f})
+	}
+	if err := regionShp.Error(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// readProjectionFactors reads the scaling factors for each region for
+// config.ProjectionYear from config.ProjectionFile, which is a CSV file
+// with a header row and the columns ProjectionIDColumn, "Year", and
+// any of the CensusPopColumns and MortalityRateColumns. Empty values are
+// treated as missing factors.
+func (config *VarGridConfig) readProjectionFactors() (map[string]map[string]float64, error) {
+	f, err := os.Open(config.ProjectionFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading ProjectionFile header: %w", err)
+	}
+	idCol, yearCol := -1, -1
+	for i, h := range header {
+		header[i] = strings.TrimSpace(h)
+		switch header[i] {
+		case config.ProjectionIDColumn:
+			idCol = i
+		case "Year":
+			yearCol = i
+		}
+	}
+	if idCol < 0 || yearCol < 0 {
+		return nil, fmt.Errorf("inmap: ProjectionFile must have the columns %s and Year", config.ProjectionIDColumn)
+	}
+
+	factors := make(map[string]map[string]float64)
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("inmap: reading ProjectionFile: %w", err)
+		}
+		year, err := strconv.Atoi(strings.TrimSpace(rec[yearCol]))
+		if err != nil {
+			return nil, fmt.Errorf("inmap: reading ProjectionFile year: %w", err)
+		}
+		if year != config.ProjectionYear {
+			continue
+		}
+		id := strings.TrimSpace(rec[idCol])
+		if _, ok := factors[id]; ok {
+			return nil, fmt.Errorf("inmap: ProjectionFile has more than one row for region %s and year %d", id, year)
+		}
+		factors[id] = make(map[string]float64)
+		for i, h := range header {
+			if i == idCol || i == yearCol || strings.TrimSpace(rec[i]) == "" {
+				continue
+			}
+			v, err := s2f(rec[i])
+			if err != nil {
+				return nil, fmt.Errorf("inmap: reading ProjectionFile %s for region %s: %w", h, id, err)
+			}
+			if v < 0 {
+				return nil, fmt.Errorf("inmap: ProjectionFile %s for region %s is negative", h, id)
+			}
+			factors[id][h] = v
+		}
+	}
+	if len(factors) == 0 {
+		return nil, fmt.Errorf("inmap: ProjectionFile has no factors for year %d", config.ProjectionYear)
+	}
+	return factors, nil
+}
+
+// factors returns the scaling factors of the region that contains the
+// centroid of g, or nil if there is no such region.
+func (p *projectionFactors) factors(g geom.Polygonal) map[string]float64 {
+	c := g.Centroid()
+	for _, r := range p.regions.SearchIntersect(c.Bounds()) {
+		region := r.(*projectionRegion)
+		if c.Within(region.Polygonal) != geom.Outside {
+			return region.factors
+		}
+	}
+	return nil
+}
+
+// scale returns a copy of data where each value whose column in indices
+// has a factor in the region of g has been multiplied by the factor.
+// Values in columns without factors are not changed. If p is nil, data is
+// returned unchanged.
+func (p *projectionFactors) scale(g geom.Polygonal, data []float64, indices map[string]int) []float64 {
+	if p == nil {
+		return data
+	}
+	f := p.factors(g)
+	if f == nil {
+		return data
+	}
+	o := make([]float64, len(data))
+	copy(o, data)
+	for col, i := range indices {
+		if v, ok := f[col]; ok {
+			o[i] *= v
+		}
+	}
+	return o
+}
+
+// projectPopulation returns a version of the population generator tree
+// where the population has been projected using p.
+func projectPopulation(tree func(*geom.Bounds) func() (*population, error), p *projectionFactors, popIndices map[string]int) func(*geom.Bounds) func() (*population, error) {
+	return func(b *geom.Bounds) func() (*population, error) {
+		gen := tree(b)
+		return func() (*population, error) {
+			pop, err := gen()
+			if err != nil || pop == nil {
+				return pop, err
+			}
+			return &population{Polygonal: pop.Polygonal, PopData: p.scale(pop.Polygonal, pop.PopData, popIndices)}, nil
+		}
+	}
+}
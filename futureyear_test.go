@@ -0,0 +1,63 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"os"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestLoadPopMort_projection(t *testing.T) {
+	cfg, data, cleanup := rasterTestData(t)
+	defer cleanup()
+	cfg.ProjectionFile = "tempProjection.csv"
+	cfg.ProjectionRegionFile = "tempProjectionRegions.shp"
+	cfg.ProjectionIDColumn = "GEOID"
+	cfg.ProjectionYear = 2050
+	err := os.WriteFile(cfg.ProjectionFile, []byte(`GEOID,Year,TotalPop,AllCause
+East,2035,1.5,0.8
+East,2050,2,0.5
+West,2050,,
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(cfg.ProjectionFile)
+	writeRegions(t, cfg.ProjectionRegionFile, "GEOID", map[string]geom.Polygon{
+		"East": lonLatRect(0, -90, 180, 90),
+		"West": lonLatRect(-180, -90, 0, 90),
+	})
+	defer DeleteShapefile(cfg.ProjectionRegionFile)
+
+	totalPop, deaths := popMortTotals(t, cfg, data)
+	// Only the eastern population and mortality rates are projected in 2050.
+	if different(totalPop, 100*2+50, 1.e-10) {
+		t.Errorf("total population: have %g, want 250", totalPop)
+	}
+	if want := 100.*2*400*0.5 + 50*800; different(deaths, want, 1.e-10) {
+		t.Errorf("population-weighted mortality: have %g, want %g", deaths, want)
+	}
+
+	cfg.ProjectionYear = 2100
+	if _, _, _, _, err := cfg.LoadPopMort(); err == nil {
+		t.Error("a year without factors should cause an error")
+	}
+}
@@ -0,0 +1,392 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/ctessum/sparse"
+)
+
+// gchpFormat is the format of the dates in GCHP output file names.
+const gchpFormat = "20060102_1504"
+
+// NewGCHP initializes a preprocessor for output from GEOS-Chem High
+// Performance (GCHP), which is on a cubed-sphere grid. The chemistry
+// output is regridded to the latitude-longitude grid of the GEOS
+// meteorology files, which are the same as those used by GEOS-Chem Classic.
+// Grid cells are set to the average of the cubed-sphere cells whose
+// centers are within them, or, if there are none, to the value of the
+// nearest cubed-sphere cell.
+//
+// GCHPOut is the location of GCHP output files that contain the
+// species concentrations (e.g., the SpeciesConc collection), which must
+// include the species used by the GEOS-Chem preprocessor, including OH and
+// H2O2, and the cubed-sphere grid cell center coordinates ("lons" and "lats").
+// [DATE] should be used as a wild card for the date and time in the
+// format "YYYYMMDD_hhmm", e.g. "GCHP.SpeciesConc.[DATE]z.nc4".
+//
+// GEOSApBp is required because GCHP output does not include the
+// hybrid pressure grid parameters.
+// chemRecordStr and chemFileStr are the intervals between GCHP output
+// records and files, respectively, e.g. "3h" and "24h". Because OH and
+// H2O2 are read along with the 3-hourly meteorology, the record interval
+// should be "3h".
+// The other arguments are the same as for NewGEOSChem.
+func NewGCHP(GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GCHPOut, OlsonLandMap, startDate, endDate string, chemRecordStr, chemFileStr string, msgChan chan string) (*GEOSChem, error) {
+	return newGEOSChem(GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GCHPOut, OlsonLandMap, startDate, endDate, false, chemRecordStr, chemFileStr, false, true, msgChan)
+}
+
+// setGCHP sets up gc to read GCHP output, renaming the chemical species
+// variables to their GCHP names.
+func (gc *GEOSChem) setGCHP() error {
+	if gc.geosApBp == "" {
+		return fmt.Errorf("inmap: GCHP preprocessor: the GEOS Ap and Bp file must be specified")
+	}
+	gc.gchp = true
+	gc.chemFormat = gchpFormat
+	ff, err := ncfFromTemplate(gc.geosChem, gc.chemFormat, gc.start)
+	if err != nil {
+		return fmt.Errorf("inmap: GCHP preprocessor: %v", err)
+	}
+	defer ff.Close()
+	// Species concentrations are named SpeciesConcVV_xxx in newer
+	// versions of GCHP and SpeciesConc_xxx in older versions.
+	gc.gchpPrefix = "SpeciesConc_"
+	if ff.Lengths("SpeciesConcVV_SO2") != nil {
+		gc.gchpPrefix = "SpeciesConcVV_"
+	}
+	for _, m := range []*map[string]float64{&gc.aVOC, &gc.bVOC, &gc.aSOA, &gc.bSOA, &gc.nox,
+		&gc.no, &gc.no2, &gc.pNO, &gc.sox, &gc.pS, &gc.nh3, &gc.pNH, &gc.totalPM25} {
+		*m = gc.gchpSpecies(*m)
+	}
+	return nil
+}
+
+// gchpSpecies converts a map of GEOS-Chem Classic variable names and
+// conversion factors from ppbv to a map of GCHP variable names and
+// conversion factors from mol/mol.
+func (gc *GEOSChem) gchpSpecies(m map[string]float64) map[string]float64 {
+	if m == nil {
+		return nil
+	}
+	const ppbvPerMolMol = 1.0e9
+	prefix := "IJ" + gc.dash + "AVG" + gc.dash + "S__"
+	o := make(map[string]float64, len(m))
+	for name, factor := range m {
+		o[gc.gchpPrefix+strings.TrimPrefix(name, prefix)] = factor * ppbvPerMolMol
+	}
+	return o
+}
+
+// metFirstValues returns the values of variable v in the first
+// GEOS dynamical parameter file.
+func (gc *GEOSChem) metFirstValues(v string) ([]float64, error) {
+	ff, err := ncfFromTemplate(gc.geosA3Dyn, geosFormat, gc.start)
+	if err != nil {
+		return nil, err
+	}
+	defer ff.Close()
+	data, err := readNCFNoHour(v, ff, 0)
+	if err != nil {
+		return nil, err
+	}
+	return data.Elements, nil
+}
+
+// metSpacing returns the spacing of the GEOS grid
+// coordinate variable v ("lon" or "lat").
+func (gc *GEOSChem) metSpacing(v string) (float64, error) {
+	vals, err := gc.metFirstValues(v)
+	if err != nil {
+		return math.NaN(), err
+	}
+	if len(vals) < 2 {
+		return math.NaN(), fmt.Errorf("inmap: GCHP preprocessor: variable %s has fewer than 2 values", v)
+	}
+	if len(vals) > 2 {
+		// The cells at the poles are sometimes half-sized.
+		return vals[2] - vals[1], nil
+	}
+	return vals[1] - vals[0], nil
+}
+
+// regrid returns a function that reads data using readFunc and
+// regrids it from the cubed-sphere grid if the chemistry output is
+// from GCHP.
+func (gc *GEOSChem) regrid(readFunc readNCFFunc) readNCFFunc {
+	if !gc.gchp {
+		return readFunc
+	}
+	return func(varName string, ff ncfFile, index int) (*sparse.DenseArray, error) {
+		data, err := readFunc(varName, ff, index)
+		if err != nil {
+			return nil, err
+		}
+		return gc.cs.regrid(data)
+	}
+}
+
+// gchpALT returns inverse air density [m3/kg], which is calculated from
+// the GEOS temperature and pressure because it is not included
+// in the GCHP species concentration output.
+func (gc *GEOSChem) gchpALT() NextData {
+	return geosALT(gc.T(), gc.P())
+}
+
+// gchpHO returns hydroxyl radical concentration [ppmv].
+func (gc *GEOSChem) gchpHO() NextData {
+	HOFunc := gc.readChem(gc.gchpPrefix + "OH") // [mol/mol]
+	return func() (*sparse.DenseArray, error) {
+		HO, err := HOFunc()
+		if err != nil {
+			return nil, err
+		}
+		return HO.ScaleCopy(1.0e6), nil
+	}
+}
+
+// gchpH2O2 returns hydrogen peroxide concentration [ppmv].
+func (gc *GEOSChem) gchpH2O2() NextData {
+	H2O2Func := gc.readChem(gc.gchpPrefix + "H2O2") // [mol/mol]
+	return func() (*sparse.DenseArray, error) {
+		H2O2, err := H2O2Func()
+		if err != nil {
+			return nil, err
+		}
+		return H2O2.ScaleCopy(1.0e6), nil
+	}
+}
+
+// cubedSphereRegridder regrids data from a cubed-sphere grid
+// to a latitude-longitude grid.
+type cubedSphereRegridder struct {
+	nx, ny int
+
+	// ns is the number of cubed-sphere grid cells.
+	ns int
+
+	// index is the indices of the cubed-sphere grid cells
+	// that are averaged together for each lat-lon grid cell.
+	index [][]int
+
+	// flip specifies that the vertical layers of the cubed-sphere
+	// data are ordered from top to bottom.
+	flip bool
+}
+
+// newCubedSphereRegridder creates a regridder from the cubed-sphere
+// grid in the first GCHP output file to the GEOS grid.
+func (gc *GEOSChem) newCubedSphereRegridder() (*cubedSphereRegridder, error) {
+	ff, err := ncfFromTemplate(gc.geosChem, gc.chemFormat, gc.start)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: GCHP preprocessor: %v", err)
+	}
+	defer ff.Close()
+	coords := make(map[string][]float64)
+	for _, v := range []string{"lons", "lats"} {
+		if len(ff.Lengths(v)) != 3 {
+			return nil, fmt.Errorf("inmap: GCHP preprocessor: variable %s with dimensions [nf, Ydim, Xdim] is not in the output file", v)
+		}
+		vals, err := ff.Read(v, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: GCHP preprocessor: reading %s: %v", v, err)
+		}
+		if coords[v], err = ncfFloats(vals); err != nil {
+			return nil, fmt.Errorf("inmap: GCHP preprocessor: reading %s: %v", v, err)
+		}
+	}
+	r := newCubedSphereRegridderFromCenters(coords["lons"], coords["lats"], gc.xCenters, gc.yCenters)
+	if positive, ok := ff.Attribute("lev", "positive").(string); ok && positive == "down" {
+		r.flip = true
+	}
+	return r, nil
+}
+
+// newCubedSphereRegridderFromCenters creates a regridder from the
+// grid cells with the given center longitudes and latitudes [degrees]
+// to the latitude-longitude grid with the given cell centers [degrees],
+// which must be evenly spaced in the longitude direction
+// and increasing in both directions.
+func newCubedSphereRegridderFromCenters(lons, lats, xCenters, yCenters []float64) *cubedSphereRegridder {
+	nx, ny := len(xCenters), len(yCenters)
+	r := &cubedSphereRegridder{
+		nx:    nx,
+		ny:    ny,
+		ns:    len(lons),
+		index: make([][]int, nx*ny),
+	}
+	dx := 360.0 / float64(nx)
+	if nx > 1 {
+		dx = xCenters[1] - xCenters[0]
+	}
+	west := xCenters[0] - dx/2
+	for s, lon := range lons {
+		i := int(math.Floor(math.Mod(math.Mod(lon-west, 360)+360, 360) / dx))
+		if i >= nx {
+			continue // Outside of a regional grid.
+		}
+		// Find the nearest latitude.
+		lat := lats[s]
+		j := sort.SearchFloat64s(yCenters, lat)
+		if j == ny || j > 0 && lat-yCenters[j-1] < yCenters[j]-lat {
+			j--
+		}
+		if j == 0 && ny > 1 && lat < yCenters[0]-(yCenters[1]-yCenters[0]) ||
+			j == ny-1 && ny > 1 && lat > yCenters[ny-1]+(yCenters[ny-1]-yCenters[ny-2]) {
+			continue // Outside of a regional grid.
+		}
+		r.index[j*nx+i] = append(r.index[j*nx+i], s)
+	}
+
+	// Use the nearest cubed-sphere cell for lat-lon cells
+	// that do not contain any cubed-sphere cell centers.
+	var index *sphereIndex
+	for j, y := range yCenters {
+		for i, x := range xCenters {
+			if len(r.index[j*nx+i]) > 0 {
+				continue
+			}
+			if index == nil {
+				index = newSphereIndex(lons, lats)
+			}
+			r.index[j*nx+i] = []int{index.nearest(x, y)}
+		}
+	}
+	return r
+}
+
+// regrid regrids data with dimensions [nf, Ydim, Xdim] or
+// [nLevels, nf, Ydim, Xdim] to dimensions [ny, nx] or [nLevels, ny, nx],
+// respectively.
+func (r *cubedSphereRegridder) regrid(data *sparse.DenseArray) (*sparse.DenseArray, error) {
+	nd := len(data.Shape)
+	if nd != 3 && nd != 4 || data.Shape[nd-3]*data.Shape[nd-2]*data.Shape[nd-1] != r.ns {
+		return nil, fmt.Errorf("inmap: GCHP preprocessor: invalid variable shape %v for cubed-sphere grid with %d cells", data.Shape, r.ns)
+	}
+	var out *sparse.DenseArray
+	nLev := 1
+	if nd == 3 {
+		out = sparse.ZerosDense(r.ny, r.nx)
+	} else {
+		nLev = data.Shape[0]
+		out = sparse.ZerosDense(nLev, r.ny, r.nx)
+	}
+	n := r.nx * r.ny
+	for k := 0; k < nLev; k++ {
+		kIn := k
+		if r.flip {
+			kIn = nLev - 1 - k
+		}
+		for ii, idx := range r.index {
+			var v float64
+			for _, s := range idx {
+				v += data.Elements[kIn*r.ns+s]
+			}
+			out.Elements[k*n+ii] = v / float64(len(idx))
+		}
+	}
+	return out, nil
+}
+
+// sphereIndex is a spatial index for finding the nearest of a set of
+// points on the surface of a sphere. The points are binned in three
+// Cartesian dimensions, which avoids the convergence of meridians
+// near the poles.
+type sphereIndex struct {
+	xyz     [][3]float64
+	binSize float64
+	n       int
+	bins    map[[3]int][]int
+}
+
+// newSphereIndex creates a spatial index for the points with the given
+// longitudes and latitudes [degrees].
+func newSphereIndex(lons, lats []float64) *sphereIndex {
+	// Choose the bin size so that there are a few points in each bin.
+	binSize := math.Sqrt(4*math.Pi/float64(len(lons))) * 2
+	s := &sphereIndex{
+		xyz:     make([][3]float64, len(lons)),
+		binSize: binSize,
+		n:       int(math.Ceil(2 / binSize)),
+		bins:    make(map[[3]int][]int),
+	}
+	for i := range lons {
+		s.xyz[i] = unitVector(lons[i], lats[i])
+		b := s.bin(s.xyz[i])
+		s.bins[b] = append(s.bins[b], i)
+	}
+	return s
+}
+
+// unitVector returns the Cartesian coordinates of the given
+// longitude and latitude [degrees] on the unit sphere.
+func unitVector(lon, lat float64) [3]float64 {
+	lon, lat = lon*math.Pi/180, lat*math.Pi/180
+	return [3]float64{math.Cos(lat) * math.Cos(lon), math.Cos(lat) * math.Sin(lon), math.Sin(lat)}
+}
+
+func (s *sphereIndex) bin(p [3]float64) [3]int {
+	var b [3]int
+	for d, v := range p {
+		b[d] = int((v + 1) / s.binSize)
+		if b[d] >= s.n {
+			b[d] = s.n - 1
+		}
+	}
+	return b
+}
+
+// nearest returns the index of the point that is closest to
+// the given longitude and latitude [degrees].
+func (s *sphereIndex) nearest(lon, lat float64) int {
+	p := unitVector(lon, lat)
+	b := s.bin(p)
+	best, bestDist := -1, math.Inf(1)
+	for ring := 0; ring <= s.n; ring++ {
+		// Check the bins that are ring bins away in any dimension.
+		for i := b[0] - ring; i <= b[0]+ring; i++ {
+			for j := b[1] - ring; j <= b[1]+ring; j++ {
+				for k := b[2] - ring; k <= b[2]+ring; k++ {
+					if i-b[0] != ring && b[0]-i != ring && j-b[1] != ring && b[1]-j != ring &&
+						k-b[2] != ring && b[2]-k != ring {
+						continue
+					}
+					for _, c := range s.bins[[3]int{i, j, k}] {
+						q := s.xyz[c]
+						d := (p[0]-q[0])*(p[0]-q[0]) + (p[1]-q[1])*(p[1]-q[1]) + (p[2]-q[2])*(p[2]-q[2])
+						if d < bestDist {
+							best, bestDist = c, d
+						}
+					}
+				}
+			}
+		}
+		// Any points that haven't been checked yet are at least
+		// this far away.
+		minUnchecked := float64(ring) * s.binSize
+		if best >= 0 && bestDist <= minUnchecked*minUnchecked {
+			break
+		}
+	}
+	return best
+}
@@ -0,0 +1,261 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/batchatco/go-native-netcdf/netcdf"
+	ncapi "github.com/batchatco/go-native-netcdf/netcdf/api"
+	"github.com/batchatco/go-native-netcdf/netcdf/util"
+	"github.com/ctessum/sparse"
+)
+
+// cubedSphereCenters returns the center longitudes and latitudes [degrees]
+// of the cells of a gnomonic equiangular cubed-sphere grid with n×n
+// cells on each face, in [nf, Ydim, Xdim] order.
+func cubedSphereCenters(n int) (lons, lats []float64) {
+	for f := 0; f < 6; f++ {
+		for j := 0; j < n; j++ {
+			for i := 0; i < n; i++ {
+				a := math.Tan((float64(i)+0.5)*math.Pi/2/float64(n) - math.Pi/4)
+				b := math.Tan((float64(j)+0.5)*math.Pi/2/float64(n) - math.Pi/4)
+				var x, y, z float64
+				switch f {
+				case 0:
+					x, y, z = 1, a, b
+				case 1:
+					x, y, z = -a, 1, b
+				case 2:
+					x, y, z = -1, -a, b
+				case 3:
+					x, y, z = a, -1, b
+				case 4:
+					x, y, z = -b, a, 1
+				case 5:
+					x, y, z = b, a, -1
+				}
+				lons = append(lons, math.Atan2(y, x)*180/math.Pi)
+				lats = append(lats, math.Atan2(z, math.Hypot(x, y))*180/math.Pi)
+			}
+		}
+	}
+	return lons, lats
+}
+
+func TestCubedSphereRegridder(t *testing.T) {
+	lons, lats := cubedSphereCenters(48)
+	f := func(lon, lat float64) float64 {
+		return 2 + math.Cos(lat*math.Pi/180)*math.Sin(lon*math.Pi/180)
+	}
+	for _, test := range []struct {
+		name   string
+		dx, dy float64
+	}{
+		{name: "coarse", dx: 5, dy: 4},
+		{name: "fine", dx: 0.625, dy: 0.5},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var xCenters, yCenters []float64
+			for x := -180.0; x < 180; x += test.dx {
+				xCenters = append(xCenters, x)
+			}
+			for y := -90 + test.dy; y < 90; y += test.dy {
+				yCenters = append(yCenters, y)
+			}
+			r := newCubedSphereRegridderFromCenters(lons, lats, xCenters, yCenters)
+
+			// Two vertical levels, with the second level twice the first.
+			data := sparse.ZerosDense(2, 6, 48, 48)
+			for s := range lons {
+				data.Elements[s] = f(lons[s], lats[s])
+				data.Elements[len(lons)+s] = 2 * f(lons[s], lats[s])
+			}
+			out, err := r.regrid(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(out.Shape) != 3 || out.Shape[0] != 2 || out.Shape[1] != len(yCenters) || out.Shape[2] != len(xCenters) {
+				t.Fatalf("invalid shape %v", out.Shape)
+			}
+			var maxDiff float64
+			for j, y := range yCenters {
+				for i, x := range xCenters {
+					want := f(x, y)
+					maxDiff = math.Max(maxDiff, math.Abs(out.Get(0, j, i)-want))
+					if have := out.Get(1, j, i); math.Abs(have-2*out.Get(0, j, i)) > 1e-10 {
+						t.Fatalf("level 2 (%g, %g): have %g, want %g", x, y, have, 2*out.Get(0, j, i))
+					}
+				}
+			}
+			// The grid cells are about 2 degrees across.
+			if maxDiff > 0.05 {
+				t.Errorf("maximum difference %g is too large", maxDiff)
+			}
+		})
+	}
+
+	if _, err := newCubedSphereRegridderFromCenters(lons, lats, []float64{0}, []float64{0}).regrid(sparse.ZerosDense(6, 4, 4)); err == nil {
+		t.Error("expected an error for the wrong grid size")
+	}
+}
+
+// writeGCHP writes a daily GCHP species concentration file with
+// 3-hourly records on a C12 grid where each species has a uniform
+// concentration.
+func writeGCHP(path string, conc map[string]float32) error {
+	const n, nz, nt = 12, 72, 8
+	w, err := netcdf.OpenWriter(path, netcdf.KindHDF5)
+	if err != nil {
+		return err
+	}
+	lons, lats := cubedSphereCenters(n)
+	lon3, lat3 := make([][][]float64, 6), make([][][]float64, 6)
+	for f := 0; f < 6; f++ {
+		lon3[f], lat3[f] = make([][]float64, n), make([][]float64, n)
+		for j := 0; j < n; j++ {
+			lon3[f][j] = lons[(f*n+j)*n : (f*n+j+1)*n]
+			lat3[f][j] = lats[(f*n+j)*n : (f*n+j+1)*n]
+		}
+	}
+	dims := []string{"nf", "Ydim", "Xdim"}
+	if err = w.AddVar("lons", ncapi.Variable{Values: lon3, Dimensions: dims}); err != nil {
+		return err
+	}
+	if err = w.AddVar("lats", ncapi.Variable{Values: lat3, Dimensions: dims}); err != nil {
+		return err
+	}
+	lev := make([]float64, nz)
+	for k := range lev {
+		lev[k] = float64(k + 1)
+	}
+	attrs, err := util.NewOrderedMap([]string{"positive"}, map[string]interface{}{"positive": "up"})
+	if err != nil {
+		return err
+	}
+	if err = w.AddVar("lev", ncapi.Variable{Values: lev, Dimensions: []string{"lev"}, Attributes: attrs}); err != nil {
+		return err
+	}
+	for species, c := range conc {
+		v := make([][][][][]float32, nt)
+		for t := range v {
+			v[t] = make([][][][]float32, nz)
+			for k := range v[t] {
+				v[t][k] = make([][][]float32, 6)
+				for f := range v[t][k] {
+					v[t][k][f] = make([][]float32, n)
+					for j := range v[t][k][f] {
+						v[t][k][f][j] = make([]float32, n)
+						for i := range v[t][k][f][j] {
+							v[t][k][f][j][i] = c
+						}
+					}
+				}
+			}
+		}
+		err = w.AddVar("SpeciesConcVV_"+species, ncapi.Variable{
+			Values:     v,
+			Dimensions: []string{"time", "lev", "nf", "Ydim", "Xdim"},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+func TestGCHP(t *testing.T) {
+	dir, err := os.MkdirTemp("", "gchp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conc := map[string]float32{
+		"BENZ": 1e-10, "ISOP": 1e-9, "ASOA1": 1e-11, "TSOA0": 1e-11, "NO": 1e-10, "NO2": 1e-9,
+		"NIT": 1e-10, "SO2": 2e-9, "SO4": 1e-9, "NH3": 1e-9, "NH4": 1e-9, "OH": 1e-13, "H2O2": 1e-9,
+	}
+	for _, date := range []string{"20130102", "20130103"} {
+		if err = writeGCHP(filepath.Join(dir, "GCHP.SpeciesConc."+date+"_0000z.nc4"), conc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gc, err := NewGCHP(
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A1.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A3cld.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A3dyn.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].I3.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A3mstE.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.ApBp.nc",
+		filepath.Join(dir, "GCHP.SpeciesConc.[DATE]z.nc4"),
+		"cmd/inmap/testdata/preproc/geoschem-new/Olson_2001_Land_Map.025x025.generic.nc",
+		"20130102",
+		"20130104",
+		"3h",
+		"24h",
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nz, err := gc.Nz(); err != nil || nz != 72 {
+		t.Errorf("nz: have %d, want 72 (%v)", nz, err)
+	}
+	so2, err := gc.readChem("SpeciesConcVV_SO2")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(so2.Shape) != 3 || so2.Shape[0] != 72 || so2.Shape[1] != 2 || so2.Shape[2] != 2 {
+		t.Errorf("SO2 shape: have %v, want [72 2 2]", so2.Shape)
+	}
+	for _, v := range so2.Elements {
+		if math.Abs(v-2e-9)/2e-9 > 1e-6 {
+			t.Fatalf("SO2: have %g, want 2e-9", v)
+		}
+	}
+	ho, err := gc.HO()()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := ho.Elements[0]; math.Abs(v-1e-7)/1e-7 > 1e-6 {
+		t.Errorf("HO: have %g, want 1e-7", v)
+	}
+
+	data, err := Preprocess(gc, -2.5, 50, 2.5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"gS", "gNO", "pNH", "alt"} {
+		d := data.Data[v].Data
+		if d.Max() <= 0 {
+			t.Errorf("%s is not positive", v)
+		}
+	}
+	// Inverse density from temperature and pressure should be similar to
+	// that at sea level near the surface.
+	if alt := data.Data["alt"].Data.Get(0, 0, 0); alt < 0.7 || alt > 1 {
+		t.Errorf("alt: have %g, want about 0.8", alt)
+	}
+
+	if _, err = NewGCHP("", "", "", "", "", "", "", "", "20130102", "20130104", "24h", "24h", nil); err == nil {
+		t.Error("expected an error for a missing Ap and Bp file")
+	}
+}
@@ -0,0 +1,367 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/wkb"
+	"github.com/ctessum/geom/proj"
+)
+
+// isGeoParquet returns whether fileName has the extension of a GeoParquet
+// file.
+func isGeoParquet(fileName string) bool {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".parquet", ".geoparquet":
+		return true
+	}
+	return false
+}
+
+// Parquet physical types, encodings, and other constants
+// (see https://github.com/apache/parquet-format).
+const (
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetRequired = 0
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetDataPage = 0
+
+	parquetUncompressed = 0
+
+	parquetMagic = "PAR1"
+)
+
+// writeGeoParquet saves the given results, which are in the form of
+// map[variable][row]value, for the given cells to the GeoParquet
+// (version 1.0.0) file fileName. The cell geometries are converted from
+// spatial reference sr to longitude-latitude coordinates, which is the
+// default coordinate reference system of GeoParquet, and are stored
+// in WKB format in the column "geometry". The results are stored
+// in double-precision columns named after the variables.
+//
+// The file has a single row group and is not compressed, so that it can be
+// written without external dependencies.
+func writeGeoParquet(fileName string, sr *proj.SR, cells []*Cell, results map[string][]float64) error {
+	vars := make([]string, 0, len(results))
+	for v := range results {
+		vars = append(vars, v)
+	}
+	sort.Strings(vars)
+
+	lonLat, err := proj.Parse("+proj=longlat")
+	if err != nil {
+		return err
+	}
+	var t proj.Transformer
+	if sr != nil {
+		if t, err = sr.NewTransform(lonLat); err != nil {
+			return fmt.Errorf("inmap: writing GeoParquet output: %v", err)
+		}
+	}
+	geoms := make([][]byte, len(cells))
+	bounds := geom.NewBounds()
+	for i, c := range cells {
+		var g geom.Geom = c.Polygonal
+		if t != nil {
+			if g, err = g.Transform(t); err != nil {
+				return fmt.Errorf("inmap: writing GeoParquet output: %v", err)
+			}
+		}
+		bounds.Extend(g.Bounds())
+		if geoms[i], err = wkb.Encode(g, binary.LittleEndian); err != nil {
+			return fmt.Errorf("inmap: writing GeoParquet output: %v", err)
+		}
+	}
+	geomColumn := map[string]interface{}{
+		"encoding":       "WKB",
+		"geometry_types": []string{"Polygon"},
+	}
+	if len(cells) > 0 {
+		geomColumn["bbox"] = []float64{bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Max.Y}
+	}
+	geoJSON, err := json.Marshal(map[string]interface{}{
+		"version":        "1.0.0",
+		"primary_column": "geometry",
+		"columns":        map[string]interface{}{"geometry": geomColumn},
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("inmap: creating GeoParquet output: %v", err)
+	}
+	w := &parquetWriter{w: bufio.NewWriter(f)}
+	w.write([]byte(parquetMagic))
+	w.writeColumn("geometry", parquetByteArray, len(cells), func(b *bytes.Buffer) {
+		for _, g := range geoms {
+			binary.Write(b, binary.LittleEndian, uint32(len(g)))
+			b.Write(g)
+		}
+	})
+	for _, v := range vars {
+		vals := results[v][:len(cells)]
+		w.writeColumn(v, parquetDouble, len(cells), func(b *bytes.Buffer) {
+			for _, val := range vals {
+				binary.Write(b, binary.LittleEndian, math.Float64bits(val))
+			}
+		})
+	}
+	w.writeFooter(len(cells), map[string]string{"geo": string(geoJSON)})
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	if err := f.Close(); w.err == nil {
+		w.err = err
+	}
+	if w.err != nil {
+		return fmt.Errorf("inmap: writing GeoParquet output: %v", w.err)
+	}
+	return nil
+}
+
+// parquetColumn holds the information about a column chunk that is
+// stored in the footer of a Parquet file.
+type parquetColumn struct {
+	name       string
+	typ        int32
+	offset     int64
+	size       int64
+	dataValues int64
+}
+
+// parquetWriter writes a Parquet file with REQUIRED (non-null) columns,
+// each of which is stored as a single PLAIN-encoded, uncompressed data page.
+type parquetWriter struct {
+	w       *bufio.Writer
+	offset  int64
+	columns []parquetColumn
+	err     error
+}
+
+func (w *parquetWriter) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	var n int
+	n, w.err = w.w.Write(b)
+	w.offset += int64(n)
+}
+
+// writeColumn writes a column chunk with the given name, type, and
+// number of values, whose PLAIN-encoded data is written by data.
+func (w *parquetWriter) writeColumn(name string, typ int32, numValues int, data func(*bytes.Buffer)) {
+	var page bytes.Buffer
+	data(&page)
+
+	var h thriftWriter
+	h.i32(1, parquetDataPage)
+	h.i32(2, int32(page.Len()))
+	h.i32(3, int32(page.Len()))
+	h.beginStruct(5) // DataPageHeader
+	h.i32(1, int32(numValues))
+	h.i32(2, parquetPlain)
+	h.i32(3, parquetRLE)
+	h.i32(4, parquetRLE)
+	h.endStruct()
+	h.stop()
+
+	c := parquetColumn{
+		name:       name,
+		typ:        typ,
+		offset:     w.offset,
+		size:       int64(h.Len() + page.Len()),
+		dataValues: int64(numValues),
+	}
+	w.write(h.Bytes())
+	w.write(page.Bytes())
+	w.columns = append(w.columns, c)
+}
+
+// writeFooter writes the file metadata, which describes the schema and
+// the location of the column chunks, and the end of the file.
+func (w *parquetWriter) writeFooter(numRows int, keyValues map[string]string) {
+	var m thriftWriter
+	m.i32(1, 1) // version
+	m.beginList(2, thriftStruct, len(w.columns)+1)
+	m.listStruct() // The root of the schema.
+	m.binary(4, "schema")
+	m.i32(5, int32(len(w.columns)))
+	m.endStruct()
+	for _, c := range w.columns {
+		m.listStruct()
+		m.i32(1, c.typ)
+		m.i32(3, parquetRequired)
+		m.binary(4, c.name)
+		m.endStruct()
+	}
+	m.i64(3, int64(numRows))
+
+	var totalSize int64
+	for _, c := range w.columns {
+		totalSize += c.size
+	}
+	m.beginList(4, thriftStruct, 1)
+	m.listStruct() // RowGroup
+	m.beginList(1, thriftStruct, len(w.columns))
+	for _, c := range w.columns {
+		m.listStruct() // ColumnChunk
+		m.i64(2, c.offset)
+		m.beginStruct(3) // ColumnMetaData
+		m.i32(1, c.typ)
+		m.beginList(2, thriftI32, 2)
+		m.listI32(parquetPlain)
+		m.listI32(parquetRLE)
+		m.beginList(3, thriftBinary, 1)
+		m.listBinary(c.name)
+		m.i32(4, parquetUncompressed)
+		m.i64(5, c.dataValues)
+		m.i64(6, c.size)
+		m.i64(7, c.size)
+		m.i64(9, c.offset)
+		m.endStruct()
+		m.endStruct()
+	}
+	m.i64(2, totalSize)
+	m.i64(3, int64(numRows))
+	m.endStruct()
+
+	keys := make([]string, 0, len(keyValues))
+	for k := range keyValues {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	m.beginList(5, thriftStruct, len(keys))
+	for _, k := range keys {
+		m.listStruct() // KeyValue
+		m.binary(1, k)
+		m.binary(2, keyValues[k])
+		m.endStruct()
+	}
+	m.binary(6, "InMAP")
+	m.stop()
+
+	w.write(m.Bytes())
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(m.Len()))
+	w.write(n[:])
+	w.write([]byte(parquetMagic))
+}
+
+// Thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structures using the Thrift compact protocol,
+// which is used for Parquet metadata.
+type thriftWriter struct {
+	bytes.Buffer
+	lastID  int16
+	idStack []int16
+}
+
+func (t *thriftWriter) fieldHeader(id int16, typ byte) {
+	if d := id - t.lastID; d > 0 && d <= 15 {
+		t.WriteByte(byte(d)<<4 | typ)
+	} else {
+		t.WriteByte(typ)
+		t.varint(uint64(uint16(id)<<1 ^ uint16(id>>15)))
+	}
+	t.lastID = id
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (t *thriftWriter) zigzag(v int64) { t.varint(uint64(v<<1 ^ v>>63)) }
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.fieldHeader(id, thriftI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) binary(id int16, v string) {
+	t.fieldHeader(id, thriftBinary)
+	t.listBinary(v)
+}
+
+func (t *thriftWriter) beginStruct(id int16) {
+	t.fieldHeader(id, thriftStruct)
+	t.listStruct()
+}
+
+// listStruct begins a struct that is an element of a list.
+func (t *thriftWriter) listStruct() {
+	t.idStack = append(t.idStack, t.lastID)
+	t.lastID = 0
+}
+
+func (t *thriftWriter) endStruct() {
+	t.stop()
+	t.lastID = t.idStack[len(t.idStack)-1]
+	t.idStack = t.idStack[:len(t.idStack)-1]
+}
+
+func (t *thriftWriter) stop() { t.WriteByte(0) }
+
+func (t *thriftWriter) beginList(id int16, elemType byte, size int) {
+	t.fieldHeader(id, thriftList)
+	if size < 15 {
+		t.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		t.WriteByte(0xf0 | elemType)
+		t.varint(uint64(size))
+	}
+}
+
+func (t *thriftWriter) listI32(v int32) { t.zigzag(int64(v)) }
+
+func (t *thriftWriter) listBinary(v string) {
+	t.varint(uint64(len(v)))
+	t.WriteString(v)
+}
@@ -0,0 +1,193 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/wkb"
+	"github.com/ctessum/geom/proj"
+)
+
+// thriftReader decodes Thrift compact protocol structs into maps of
+// field IDs to values, which is enough to check Parquet metadata.
+type thriftReader struct {
+	*bytes.Reader
+}
+
+func (r thriftReader) varint() int64 {
+	v, err := binary.ReadUvarint(r)
+	if err != nil {
+		panic(err)
+	}
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftI32, thriftI64:
+		return r.varint()
+	case thriftBinary:
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			panic(err)
+		}
+		b := make([]byte, n)
+		r.Read(b)
+		return string(b)
+	case thriftList:
+		h, _ := r.ReadByte()
+		n := int(h >> 4)
+		if n == 15 {
+			u, _ := binary.ReadUvarint(r)
+			n = int(u)
+		}
+		l := make([]interface{}, n)
+		for i := range l {
+			l[i] = r.value(h & 0x0f)
+		}
+		return l
+	case thriftStruct:
+		s := make(map[int16]interface{})
+		var id int16
+		for {
+			h, _ := r.ReadByte()
+			if h == 0 {
+				return s
+			}
+			if d := int16(h >> 4); d != 0 {
+				id += d
+			} else {
+				id = int16(r.varint())
+			}
+			s[id] = r.value(h & 0x0f)
+		}
+	default:
+		panic(fmt.Errorf("unsupported thrift type %d", typ))
+	}
+}
+
+func TestWriteGeoParquet(t *testing.T) {
+	dir, err := os.MkdirTemp("", "geoparquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var cells []*Cell
+	for i := 0; i < 20; i++ {
+		x := float64(i) * 1000
+		cells = append(cells, &Cell{Polygonal: geom.Polygon{{
+			{X: x, Y: 0}, {X: x + 1000, Y: 0}, {X: x + 1000, Y: 1000}, {X: x, Y: 1000}, {X: x, Y: 0},
+		}}})
+	}
+	results := map[string][]float64{"TotalPM25": make([]float64, len(cells)), "BPM25": make([]float64, len(cells))}
+	for i := range cells {
+		results["TotalPM25"][i] = float64(i)
+		results["BPM25"][i] = -float64(i) / 3
+	}
+	sr, err := proj.Parse("+proj=lcc +lat_1=33.000000 +lat_2=45.000000 +lat_0=40.000000 +lon_0=-97.000000 +x_0=0 +y_0=0 +a=6370997.000000 +b=6370997.000000 +to_meter=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(dir, "output.parquet")
+	if err := writeGeoParquet(fileName, sr, cells, results); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:4]) != parquetMagic || string(b[len(b)-4:]) != parquetMagic {
+		t.Fatal("missing Parquet magic number")
+	}
+	footerLen := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	meta := thriftReader{bytes.NewReader(b[len(b)-8-footerLen : len(b)-8])}.value(thriftStruct).(map[int16]interface{})
+
+	if meta[3].(int64) != int64(len(cells)) {
+		t.Errorf("num_rows: have %d, want %d", meta[3], len(cells))
+	}
+	var names []string
+	for _, s := range meta[2].([]interface{})[1:] {
+		names = append(names, s.(map[int16]interface{})[4].(string))
+	}
+	if want := []string{"geometry", "BPM25", "TotalPM25"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("columns: have %v, want %v", names, want)
+	}
+
+	kv := meta[5].([]interface{})[0].(map[int16]interface{})
+	if kv[1] != "geo" {
+		t.Fatalf("key-value metadata key: have %v, want geo", kv[1])
+	}
+	var geo struct {
+		Version       string `json:"version"`
+		PrimaryColumn string `json:"primary_column"`
+		Columns       map[string]struct {
+			Encoding string    `json:"encoding"`
+			BBox     []float64 `json:"bbox"`
+		} `json:"columns"`
+	}
+	if err := json.Unmarshal([]byte(kv[2].(string)), &geo); err != nil {
+		t.Fatal(err)
+	}
+	if geo.Version != "1.0.0" || geo.PrimaryColumn != "geometry" || geo.Columns["geometry"].Encoding != "WKB" {
+		t.Errorf("invalid geo metadata: %+v", geo)
+	}
+	if bbox := geo.Columns["geometry"].BBox; len(bbox) != 4 || bbox[0] < -98 || bbox[2] > -96 || bbox[1] < 39 || bbox[3] > 41 {
+		t.Errorf("bounding box should be in longitude-latitude coordinates near (-97, 40): %v", bbox)
+	}
+
+	columns := meta[4].([]interface{})[0].(map[int16]interface{})[1].([]interface{})
+	readPage := func(i int) []byte {
+		cm := columns[i].(map[int16]interface{})[3].(map[int16]interface{})
+		r := thriftReader{bytes.NewReader(b[cm[9].(int64):])}
+		h := r.value(thriftStruct).(map[int16]interface{})
+		page := make([]byte, h[3].(int64))
+		r.Read(page)
+		return page
+	}
+
+	page := readPage(0)
+	n := binary.LittleEndian.Uint32(page)
+	g, err := wkb.Decode(page[4 : 4+n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := g.(geom.Polygon).Centroid(); math.Abs(c.X+96.99) > 0.01 || math.Abs(c.Y-40) > 0.01 {
+		t.Errorf("wrong first geometry centroid %v", c)
+	}
+
+	page = readPage(2)
+	for i := range cells {
+		v := math.Float64frombits(binary.LittleEndian.Uint64(page[i*8:]))
+		if v != results["TotalPM25"][i] {
+			t.Errorf("TotalPM25 row %d: have %g, want %g", i, v, results["TotalPM25"][i])
+		}
+	}
+}
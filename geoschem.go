@@ -22,14 +22,12 @@ import (
 	"fmt"
 	"io"
 	"math"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ctessum/atmos/seinfeld"
 	"github.com/ctessum/atmos/wesely1989"
-	"github.com/ctessum/cdf"
 	"github.com/ctessum/geom"
 	"github.com/ctessum/geom/index/rtree"
 
@@ -51,6 +49,19 @@ type GEOSChem struct {
 
 	noChemHour bool
 
+	// gchp specifies that the chemistry output is from GEOS-Chem High
+	// Performance (GCHP) on a cubed-sphere grid, which is
+	// regridded by cs to the lat-lon grid of the meteorology.
+	gchp bool
+	cs   *cubedSphereRegridder
+
+	// gchpPrefix is the prefix of GCHP species concentration variable
+	// names, e.g., "SpeciesConc_".
+	gchpPrefix string
+
+	// chemFormat is the format of the dates in the chemistry file names.
+	chemFormat string
+
 	start, end time.Time
 
 	chemRecordDeltaInterval, chemFileDeltaInterval time.Duration
@@ -129,11 +140,19 @@ type GEOSChem struct {
 // (chemRecordStr), e.g. "3h" for 3 hours.
 //
 // chemFileInterval is the time interval of each file. It is specified
-// as a string (chemFileStr), e.g. "3h" for 3 hours.
+// as a string (chemFileStr), e.g. "3h" for 3 hours, or "monthly".
+// Either interval can be "auto" to detect it from the time coordinate
+// of the first GEOS-Chem output file.
 //
 // If noChemHour is true, then the GEOS-Chem output files will be
 // assumed to not contain a time dimension.
 func NewGEOSChem(GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GEOSChemOut, OlsonLandMap, startDate, endDate string, dash bool, chemRecordStr, chemFileStr string, noChemHour bool, msgChan chan string) (*GEOSChem, error) {
+	return newGEOSChem(GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GEOSChemOut, OlsonLandMap, startDate, endDate, dash, chemRecordStr, chemFileStr, noChemHour, false, msgChan)
+}
+
+// newGEOSChem initializes a GEOS-Chem preprocessor for GEOS-Chem Classic
+// output or, if gchp is true, for GCHP output.
+func newGEOSChem(GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GEOSChemOut, OlsonLandMap, startDate, endDate string, dash bool, chemRecordStr, chemFileStr string, noChemHour, gchp bool, msgChan chan string) (*GEOSChem, error) {
 	var d string
 	if dash {
 		d = "-"
@@ -263,6 +282,7 @@ func NewGEOSChem(GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GEO
 		dash:       d,
 		msgChan:    msgChan,
 		noChemHour: noChemHour,
+		chemFormat: geosChemFormat,
 	}
 
 	var err error
@@ -281,10 +301,6 @@ func NewGEOSChem(GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GEO
 		}
 	}
 
-	gc.chemRecordDeltaInterval, err = time.ParseDuration(chemRecordStr)
-	if err != nil {
-		return nil, fmt.Errorf("inmap: GEOS-Chem preprocessor recordDelta: %v", err)
-	}
 	gc.recordDelta1h, err = time.ParseDuration("1h")
 	if err != nil {
 		return nil, fmt.Errorf("inmap: GEOS-Chem preprocessor recordDelta: %v", err)
@@ -293,10 +309,6 @@ func NewGEOSChem(GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GEO
 	if err != nil {
 		return nil, fmt.Errorf("inmap: GEOS-Chem preprocessor recordDelta: %v", err)
 	}
-	gc.chemFileDeltaInterval, err = time.ParseDuration(chemFileStr)
-	if err != nil {
-		return nil, fmt.Errorf("inmap: GEOS-Chem preprocessor fileDelta: %v", err)
-	}
 	gc.fileDelta24h, err = time.ParseDuration("24h")
 	if err != nil {
 		return nil, fmt.Errorf("inmap: GEOS-Chem preprocessor fileDelta: %v", err)
@@ -306,6 +318,21 @@ func NewGEOSChem(GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GEO
 		return nil, fmt.Errorf("inmap: GEOS-Chem preprocessor fileDelta: %v", err)
 	}
 
+	if gchp {
+		if err = gc.setGCHP(); err != nil {
+			return nil, err
+		}
+	}
+	if chemRecordStr == "" || chemFileStr == "" {
+		return nil, fmt.Errorf("inmap: GEOS-Chem preprocessor: chemRecordStr and chemFileStr must be specified")
+	}
+	gc.chemRecordDeltaInterval, gc.chemFileDeltaInterval, err = timeIntervals(chemRecordStr, chemFileStr, 0, 0, func() (ncfFile, error) {
+		return ncfFromTemplate(gc.geosChem, gc.chemFormat, gc.start)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("inmap: GEOS-Chem preprocessor: %v", err)
+	}
+
 	gc.nz, err = gc.Nz()
 	if err != nil {
 		return nil, err
@@ -326,16 +353,17 @@ func NewGEOSChem(GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GEO
 	if err != nil {
 		return nil, err
 	}
-
-	file, err := os.Open(OlsonLandMap)
-	if err != nil {
-		return nil, err
+	if gchp {
+		if gc.cs, err = gc.newCubedSphereRegridder(); err != nil {
+			return nil, err
+		}
 	}
-	defer file.Close()
-	cfile, err := cdf.Open(file)
+
+	cfile, err := openNCF(OlsonLandMap)
 	if err != nil {
 		return nil, fmt.Errorf("inmap: Olson land use file: %v", err)
 	}
+	defer cfile.Close()
 	gc.landUse, err = gc.largestLandUse(cfile)
 	if err != nil {
 		return nil, err
@@ -387,23 +415,23 @@ func (gc *GEOSChem) readI3(varName string) NextData {
 
 func (gc *GEOSChem) readChem(varName string) NextData {
 	if gc.noChemHour {
-		return nextDataNCF(gc.geosChem, geosChemFormat, varName, gc.start, gc.end, gc.chemRecordDeltaInterval, gc.chemFileDeltaInterval, readNCFNoHour, gc.msgChan)
+		return nextDataNCF(gc.geosChem, gc.chemFormat, varName, gc.start, gc.end, gc.chemRecordDeltaInterval, gc.chemFileDeltaInterval, gc.regrid(readNCFNoHour), gc.msgChan)
 	}
-	return nextDataNCF(gc.geosChem, geosChemFormat, varName, gc.start, gc.end, gc.chemRecordDeltaInterval, gc.chemFileDeltaInterval, readNCF, gc.msgChan)
+	return nextDataNCF(gc.geosChem, gc.chemFormat, varName, gc.start, gc.end, gc.chemRecordDeltaInterval, gc.chemFileDeltaInterval, gc.regrid(readNCF), gc.msgChan)
 }
 
 func (gc *GEOSChem) readApBp(varName string) NextData {
 	if gc.geosApBp != "" {
 		return nextDataConstantNCF(strings.ToLower(varName), gc.geosApBp)
 	}
-	return nextDataNCF(gc.geosChem, geosChemFormat, varName, gc.start, gc.end, gc.recordDelta3h, gc.fileDelta3h, readNCFNoHour, gc.msgChan)
+	return nextDataNCF(gc.geosChem, gc.chemFormat, varName, gc.start, gc.end, gc.recordDelta3h, gc.fileDelta3h, readNCFNoHour, gc.msgChan)
 }
 
 func (gc *GEOSChem) readChemGroupAlt(varGroup map[string]float64) NextData {
 	if gc.noChemHour {
-		return nextDataGroupAltNCF(gc.geosChem, geosChemFormat, varGroup, gc.ALT(), gc.start, gc.end, gc.chemRecordDeltaInterval, gc.chemFileDeltaInterval, readNCFNoHour, gc.msgChan)
+		return nextDataGroupAltNCF(gc.geosChem, gc.chemFormat, varGroup, gc.ALT(), gc.start, gc.end, gc.chemRecordDeltaInterval, gc.chemFileDeltaInterval, gc.regrid(readNCFNoHour), gc.msgChan)
 	}
-	return nextDataGroupAltNCF(gc.geosChem, geosChemFormat, varGroup, gc.ALT(), gc.start, gc.end, gc.chemRecordDeltaInterval, gc.chemFileDeltaInterval, readNCF, gc.msgChan)
+	return nextDataGroupAltNCF(gc.geosChem, gc.chemFormat, varGroup, gc.ALT(), gc.start, gc.end, gc.chemRecordDeltaInterval, gc.chemFileDeltaInterval, gc.regrid(readNCF), gc.msgChan)
 }
 
 var geosLayerConvert = func(nz int) func(NextData) NextData {
@@ -513,13 +541,13 @@ func geosLayerConvertStaggered(in *sparse.DenseArray, staggeredLayerMap map[int]
 // Nx helps fulfill the Preprocessor interface by returning
 // the number of grid cells in the West-East direction.
 func (gc *GEOSChem) Nx() (int, error) {
-	f, ff, err := ncfFromTemplate(gc.geosA3Dyn, geosFormat, gc.start)
+	ff, err := ncfFromTemplate(gc.geosA3Dyn, geosFormat, gc.start)
 	if err != nil {
 		return -1, err
 	}
-	defer f.Close()
+	defer ff.Close()
 	v := "RH"
-	dims := ff.Header.Lengths(v)
+	dims := ff.Lengths(v)
 	if len(dims) == 0 {
 		return -1, fmt.Errorf("geos: missing variable %s", v)
 	}
@@ -529,13 +557,13 @@ func (gc *GEOSChem) Nx() (int, error) {
 // Ny helps fulfill the Preprocessor interface by returning
 // the number of grid cells in the South-North direction.
 func (gc *GEOSChem) Ny() (int, error) {
-	f, ff, err := ncfFromTemplate(gc.geosA3Dyn, geosFormat, gc.start)
+	ff, err := ncfFromTemplate(gc.geosA3Dyn, geosFormat, gc.start)
 	if err != nil {
 		return -1, err
 	}
-	defer f.Close()
+	defer ff.Close()
 	v := "RH"
-	dims := ff.Header.Lengths(v)
+	dims := ff.Lengths(v)
 	if len(dims) == 0 {
 		return -1, fmt.Errorf("geos: missing variable %s", v)
 	}
@@ -547,28 +575,33 @@ func (gc *GEOSChem) Ny() (int, error) {
 func (gc *GEOSChem) Nz() (int, error) {
 	// We get Nz from the GEOS-Chem output to make sure we're using the
 	// GEOS-Chem number of layers rather than the GEOS number of layers.
-	f, ff, err := ncfFromTemplate(gc.geosChem, geosChemFormat, gc.start)
+	ff, err := ncfFromTemplate(gc.geosChem, gc.chemFormat, gc.start)
 	if err != nil {
 		return -1, err
 	}
-	defer f.Close()
+	defer ff.Close()
 	v := "IJ" + gc.dash + "AVG" + gc.dash + "S__SO2"
-	dims := ff.Header.Lengths(v)
+	if gc.gchp {
+		v = gc.gchpPrefix + "SO2"
+	}
+	dims := ff.Lengths(v)
 	if len(dims) == 0 {
 		return -1, fmt.Errorf("geoschem: missing variable %s", v)
-	} else if len(dims) == 4 {
-		dims = dims[1:4] // Sometimes GEOS-Chem files also have a time dimension.
+	} else if len(dims) == 4 && !gc.gchp || len(dims) == 5 {
+		// Sometimes GEOS-Chem files also have a time dimension, and
+		// GCHP files also have cube face dimensions.
+		dims = dims[1:]
 	}
 	return dims[0], nil
 }
 
 // Return the first set of values of a variable from a chemistry file.
 func (gc *GEOSChem) chemFirstValues(v string) ([]float64, error) {
-	f, ff, err := ncfFromTemplate(gc.geosChem, geosChemFormat, gc.start)
+	ff, err := ncfFromTemplate(gc.geosChem, gc.chemFormat, gc.start)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	defer ff.Close()
 	data, err := readNCFNoHour(v, ff, 0)
 	if err != nil {
 		// If variable not in file, try all lowercase.
@@ -582,26 +615,46 @@ func (gc *GEOSChem) chemFirstValues(v string) ([]float64, error) {
 
 // Return an attribute from a chemistry file.
 func (gc *GEOSChem) chemAttribute(a string) (float64, error) {
-	f, ff, err := ncfFromTemplate(gc.geosChem, geosChemFormat, gc.start)
+	ff, err := ncfFromTemplate(gc.geosChem, gc.chemFormat, gc.start)
 	if err != nil {
 		return math.NaN(), err
 	}
-	defer f.Close()
-	attr := ff.Header.GetAttribute("", a)
+	defer ff.Close()
+	attr := ff.Attribute("", a)
 	return float64(attr.([]float32)[0]), nil
 }
 
 // XCenters returns the x-coordinates of the grid points.
-func (gc *GEOSChem) XCenters() ([]float64, error) { return gc.chemFirstValues("LON") }
+func (gc *GEOSChem) XCenters() ([]float64, error) {
+	if gc.gchp {
+		return gc.metFirstValues("lon")
+	}
+	return gc.chemFirstValues("LON")
+}
 
 // YCenters returns the y-coordinates of the grid points.
-func (gc *GEOSChem) YCenters() ([]float64, error) { return gc.chemFirstValues("LAT") }
+func (gc *GEOSChem) YCenters() ([]float64, error) {
+	if gc.gchp {
+		return gc.metFirstValues("lat")
+	}
+	return gc.chemFirstValues("LAT")
+}
 
 // DX returns the longitude grid spacing.
-func (gc *GEOSChem) DX() (float64, error) { return gc.chemAttribute("Delta_Lon") }
+func (gc *GEOSChem) DX() (float64, error) {
+	if gc.gchp {
+		return gc.metSpacing("lon")
+	}
+	return gc.chemAttribute("Delta_Lon")
+}
 
 // DY returns the latitude grid spacing.
-func (gc *GEOSChem) DY() (float64, error) { return gc.chemAttribute("Delta_Lat") }
+func (gc *GEOSChem) DY() (float64, error) {
+	if gc.gchp {
+		return gc.metSpacing("lat")
+	}
+	return gc.chemAttribute("Delta_Lat")
+}
 
 // PBLH helps fulfill the Preprocessor interface.
 func (gc *GEOSChem) PBLH() NextData { return gc.readA1("PBLH") }
@@ -609,8 +662,12 @@ func (gc *GEOSChem) PBLH() NextData { return gc.readA1("PBLH") }
 // Height returns a functions that calculates layer heights at each
 // time step using the hyposometric equation.
 func (gc *GEOSChem) Height() NextData {
-	TFunc := gc.T() // Temperature [K]
-	PFunc := gc.P() // Pressure [Pa]
+	return geosHeight(gc.T(), gc.P())
+}
+
+// geosHeight calculates layer heights from temperature [K] at layer
+// centers and pressure [Pa] at layer edges using the hyposometric equation.
+func geosHeight(TFunc, PFunc NextData) NextData {
 	return func() (*sparse.DenseArray, error) {
 		T, err := TFunc()
 		if err != nil {
@@ -640,6 +697,9 @@ func (gc *GEOSChem) Height() NextData {
 // ALT helps fulfill the Preprocessor interface, returning
 // inverse air density [m3/kg].
 func (gc *GEOSChem) ALT() NextData {
+	if gc.gchp {
+		return gc.gchpALT()
+	}
 	densityFunc1 := gc.readChem("TIME" + gc.dash + "SER__AIRDEN") // Air density in molec/cm3.
 	densityFunc2 := gc.readChem("BXHGHT_S__AIRNUMDE")             // Alternate: Dry air density in molec/cm3.
 	return func() (*sparse.DenseArray, error) {
@@ -665,17 +725,81 @@ func (gc *GEOSChem) ALT() NextData {
 	}
 }
 
-// U helps fulfill the Preprocessor interface.
-func (gc *GEOSChem) U() NextData { return stagger(gc.readA3Dyn("U"), 2) } // (unstaggered)
+// geosALT calculates inverse air density [m3/kg] from temperature [K]
+// at layer centers and pressure [Pa] at layer edges.
+func geosALT(TFunc, PFunc NextData) NextData {
+	return func() (*sparse.DenseArray, error) {
+		T, err := TFunc()
+		if err != nil {
+			return nil, err
+		}
+		P, err := PFunc()
+		if err != nil {
+			return nil, err
+		}
+		alt := sparse.ZerosDense(T.Shape...)
+		for k := 0; k < T.Shape[0]; k++ {
+			for j := 0; j < T.Shape[1]; j++ {
+				for i := 0; i < T.Shape[2]; i++ {
+					p := (P.Get(k, j, i) + P.Get(k+1, j, i)) / 2 // Layer center pressure [Pa]
+					alt.Set(rr*T.Get(k, j, i)/p, k, j, i)
+				}
+			}
+		}
+		return alt, nil
+	}
+}
+
+// U helps fulfill the Preprocessor interface. If the GEOS-Chem grid
+// is global, the winds at its western and eastern edges are calculated
+// from the grid cells on both sides of the edge, which are neighbors.
+func (gc *GEOSChem) U() NextData {
+	u := stagger(gc.readA3Dyn("U"), 2) // (unstaggered)
+	var global *bool
+	return func() (*sparse.DenseArray, error) {
+		data, err := u()
+		if err != nil {
+			return nil, err
+		}
+		if global == nil {
+			g, err := gc.global()
+			if err != nil {
+				return nil, err
+			}
+			global = &g
+		}
+		if *global {
+			periodicStaggerX(data)
+		}
+		return data, nil
+	}
+}
+
+// global returns whether the GEOS-Chem grid spans 360° of longitude.
+func (gc *GEOSChem) global() (bool, error) {
+	x, err := gc.XCenters()
+	if err != nil {
+		return false, err
+	}
+	dx, err := gc.DX()
+	if err != nil {
+		return false, err
+	}
+	const tolerance = 1.e-3
+	return math.Abs(float64(len(x))*dx-360) < tolerance, nil
+}
 
 // V helps fulfill the Preprocessor interface.
 func (gc *GEOSChem) V() NextData { return stagger(gc.readA3Dyn("V"), 1) } // (unstaggered)
 
 // W helps fulfill the Preprocessor interface.
 func (gc *GEOSChem) W() NextData {
-	omegaFunc := gc.readA3Dyn("OMEGA") // Vertical pressure velocity [Pa/s] (unstaggered).
-	PFunc := gc.P()
-	TFunc := gc.T()
+	return geosW(gc.readA3Dyn("OMEGA"), gc.P(), gc.T())
+}
+
+// geosW calculates vertical wind speed [m/s] from vertical pressure
+// velocity [Pa/s], pressure at layer edges [Pa], and temperature [K].
+func geosW(omegaFunc, PFunc, TFunc NextData) NextData {
 	return func() (*sparse.DenseArray, error) {
 		omega, err := omegaFunc()
 		if err != nil {
@@ -781,6 +905,9 @@ func (gc *GEOSChem) P() NextData {
 // HO helps fulfill the Preprocessor interface by returning hydroxyl
 // radical concentration [ppmv].
 func (gc *GEOSChem) HO() NextData {
+	if gc.gchp {
+		return gc.gchpHO()
+	}
 	HOFunc1 := gc.readChem("TIME" + gc.dash + "SER__OH") // OH density (molec / cm3)
 	f := gc.readChem("CHEM_L_S__OH")                     // Alternate OH density (molec / cm3)
 	HOFunc2 := func() (*sparse.DenseArray, error) {
@@ -833,6 +960,9 @@ func (gc *GEOSChem) HO() NextData {
 // H2O2 helps fulfill the Preprocessor interface by returning
 // hydrogen peroxide concentration [ppmv].
 func (gc *GEOSChem) H2O2() NextData {
+	if gc.gchp {
+		return gc.gchpH2O2()
+	}
 	H2O2Func := gc.readChem("IJ" + gc.dash + "AVG" + gc.dash + "S__H2O2") // H2O2 concentration [ppbv].
 	return func() (*sparse.DenseArray, error) {
 		H2O2, err := H2O2Func()
@@ -843,6 +973,40 @@ func (gc *GEOSChem) H2O2() NextData {
 	}
 }
 
+// O3 helps fulfill the Preprocessor interface by returning
+// ozone concentration [ppmv].
+func (gc *GEOSChem) O3() NextData { return gc.readChemPPMV("O3") }
+
+// HNO3 helps fulfill the Preprocessor interface by returning
+// nitric acid concentration [ppmv].
+func (gc *GEOSChem) HNO3() NextData { return gc.readChemPPMV("HNO3") }
+
+// RH helps fulfill the Preprocessor interface by returning
+// relative humidity [fraction].
+func (gc *GEOSChem) RH() NextData { return gc.readA3Dyn("RH") }
+
+// readChemPPMV returns the concentration [ppmv] of the given species,
+// which is in units of ppbv in GEOS-Chem output and mol/mol in
+// GCHP output.
+func (gc *GEOSChem) readChemPPMV(species string) NextData {
+	var f NextData
+	var scale float64
+	if gc.gchp {
+		f = gc.readChem(gc.gchpPrefix + species) // [mol/mol]
+		scale = 1.0e6
+	} else {
+		f = gc.readChem("IJ" + gc.dash + "AVG" + gc.dash + "S__" + species) // [ppbv]
+		scale = 1.0e-3
+	}
+	return func() (*sparse.DenseArray, error) {
+		data, err := f()
+		if err != nil {
+			return nil, err
+		}
+		return data.ScaleCopy(scale), nil
+	}
+}
+
 // Z0 helps fulfill the Preprocessor interface by returning
 // momentum roughness length [m].
 func (gc *GEOSChem) Z0() NextData { return gc.readA1("Z0M") }
@@ -1074,7 +1238,13 @@ var geosChemWesely = []wesely1989.LandUseCategory{
 func (gc *GEOSChem) QRain() NextData {
 	PFLCUFunc := gc.readA3MstE("PFLCU")     // 3d flux of liquid convective precipitation [kg m-2 s-1]
 	PFLLSanFunc := gc.readA3MstE("PFLLSAN") // 3d flux of liquid non-convective precipitation [kg m-2 s-1]
-	altFunc := gc.ALT()                     // m3 kg-1
+	return geosNonNegative(geosQRain(PFLCUFunc, PFLLSanFunc, gc.ALT()))
+}
+
+// geosQRain calculates rain mass fraction from the GEOS liquid convective
+// and non-convective precipitation fluxes at layer edges [kg m-2 s-1]
+// and inverse air density [m3 kg-1].
+func geosQRain(PFLCUFunc, PFLLSanFunc, altFunc NextData) NextData {
 	return func() (*sparse.DenseArray, error) {
 		pflcu, err := PFLCUFunc()
 		if err != nil {
@@ -1116,7 +1286,25 @@ func (gc *GEOSChem) CloudFrac() NextData { return gc.readA3Cld("CLOUD") }
 
 // QCloud helps fulfill the Preprocessor interface by returning
 // the cloud mass fraction.
-func (gc *GEOSChem) QCloud() NextData { return gc.readA3Cld("QL") }
+func (gc *GEOSChem) QCloud() NextData { return geosNonNegative(gc.readA3Cld("QL")) }
+
+// geosNonNegative sets negative values returned by f to zero. The GEOS
+// moisture fields contain small negative values caused by round-off
+// errors.
+func geosNonNegative(f NextData) NextData {
+	return func() (*sparse.DenseArray, error) {
+		data, err := f()
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range data.Elements {
+			if v < 0 {
+				data.Elements[i] = 0
+			}
+		}
+		return data, nil
+	}
+}
 
 // RadiationDown helps fulfill the Preprocessor interface by
 // returning downwelling radiation [W m-2].
@@ -1155,13 +1343,17 @@ type olsonGridCell struct {
 // http://wiki.seas.harvard.edu/geos-chem/index.php/Olson_land_map.
 // It may be downlaodable from:
 // ftp://ftp.as.harvard.edu/gcgrid/geos-chem/data/ExtData/CHEM_INPUTS/Olson_Land_Map_201203/
-// The file must be converted from netcdf version 4 to version 3 before
-// use by this function.
-// This can be done using the command:
-// nccopy -k classic Olson_2001_Land_Map.025x025.generic.nc Olson_2001_Land_Map.025x025.generic.nc
-func readOlsonLandMap(file *cdf.File) (*olsonLandMap, error) {
-	dxStr := file.Header.GetAttribute("", "delta_lon").(string)
-	dyStr := file.Header.GetAttribute("", "delta_lat").(string)
+// Both the original NetCDF-4 version of the file and versions
+// converted to the classic NetCDF format can be used.
+func readOlsonLandMap(file ncfFile) (*olsonLandMap, error) {
+	dxStr, ok := file.Attribute("", "delta_lon").(string)
+	if !ok {
+		return nil, fmt.Errorf("inmap: Olson land map: missing attribute delta_lon")
+	}
+	dyStr, ok := file.Attribute("", "delta_lat").(string)
+	if !ok {
+		return nil, fmt.Errorf("inmap: Olson land map: missing attribute delta_lat")
+	}
 	dx, err := strconv.ParseFloat(dxStr, 64)
 	if err != nil {
 		return nil, fmt.Errorf("inmap: parsing Olson land map dx: %v", err)
@@ -1171,12 +1363,21 @@ func readOlsonLandMap(file *cdf.File) (*olsonLandMap, error) {
 		return nil, fmt.Errorf("inmap: parsing Olson land map dy: %v", err)
 	}
 
-	dims := file.Header.Lengths("OLSON")
+	dims := file.Lengths("OLSON")
+	if len(dims) != 3 {
+		return nil, fmt.Errorf("inmap: Olson land map: missing variable OLSON")
+	}
 	ny := dims[1]
 	nx := dims[2]
 
-	r := file.Reader("OLSON", nil, nil)
-	buf := r.Zero(-1).([]int32)
+	vals, err := file.Read("OLSON", nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading Olson land map: %v", err)
+	}
+	buf, err := ncfFloats(vals)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading Olson land map: %v", err)
+	}
 	o := &olsonLandMap{
 		data: rtree.NewTree(25, 50),
 		xo:   -180,
@@ -1187,10 +1388,6 @@ func readOlsonLandMap(file *cdf.File) (*olsonLandMap, error) {
 		ny:   ny,
 	}
 
-	if _, err := r.Read(buf); err != nil {
-		return nil, fmt.Errorf("inmap: reading Olson land map: %v", err)
-	}
-
 	for iy := 0; iy < o.ny; iy++ {
 		for ix := 0; ix < o.nx; ix++ {
 			x0 := o.xo + o.dx*float64(ix)
@@ -1231,28 +1428,35 @@ func (o *olsonLandMap) fractions(p geom.Polygon) map[int]float64 {
 
 // largestLandUse returns the land use index with the largest area
 // in each grid cell when given a Olson land map file.
-func (gc *GEOSChem) largestLandUse(olsonLandMapFile *cdf.File) (*sparse.DenseArray, error) {
+func (gc *GEOSChem) largestLandUse(olsonLandMapFile ncfFile) (*sparse.DenseArray, error) {
+	return largestOlsonLandUse(olsonLandMapFile, gc.xCenters, gc.yCenters, gc.dx, gc.dy)
+}
+
+// largestOlsonLandUse returns the land use index with the largest area
+// in each cell of the latitude-longitude grid with the given cell
+// centers and spacing [degrees] when given a Olson land map file.
+func largestOlsonLandUse(olsonLandMapFile ncfFile, xCenters, yCenters []float64, gridDX, gridDY float64) (*sparse.DenseArray, error) {
 	o, err := readOlsonLandMap(olsonLandMapFile)
 	if err != nil {
 		return nil, err
 	}
 
-	out := sparse.ZerosDense(len(gc.yCenters), len(gc.xCenters))
-	for j, y := range gc.yCenters {
-		dy := gc.dy
+	out := sparse.ZerosDense(len(yCenters), len(xCenters))
+	for j, y := range yCenters {
+		dy := gridDY
 		if j == 0 {
-			dy = ((gc.yCenters[j+1] - y) - gc.dy/2) * 2
+			dy = ((yCenters[j+1] - y) - gridDY/2) * 2
 		}
-		if j == len(gc.yCenters)-1 {
-			dy = ((y - gc.yCenters[j-1]) - gc.dy/2) * 2
+		if j == len(yCenters)-1 {
+			dy = ((y - yCenters[j-1]) - gridDY/2) * 2
 		}
-		for i, x := range gc.xCenters {
-			dx := gc.dx
+		for i, x := range xCenters {
+			dx := gridDX
 			if i == 0 {
-				dx = ((gc.xCenters[i+1] - x) - gc.dx/2) * 2
+				dx = ((xCenters[i+1] - x) - gridDX/2) * 2
 			}
-			if i == len(gc.xCenters)-1 {
-				dx = ((x - gc.xCenters[i-1]) - gc.dx/2) * 2
+			if i == len(xCenters)-1 {
+				dx = ((x - xCenters[i-1]) - gridDX/2) * 2
 			}
 			x0 := x - dx/2
 			x1 := x + dx/2
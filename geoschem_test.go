@@ -20,23 +20,18 @@ package inmap
 
 import (
 	"math"
-	"os"
 	"reflect"
 	"testing"
 
-	"github.com/ctessum/cdf"
 	"github.com/ctessum/geom"
 )
 
 func TestReadOlsonLandMap(t *testing.T) {
-	f, err := os.Open("cmd/inmap/testdata/preproc/geoschem-new/Olson_2001_Land_Map.025x025.generic.nc")
-	if err != nil {
-		t.Fatal(err)
-	}
-	cf, err := cdf.Open(f)
+	cf, err := openNCF("cmd/inmap/testdata/preproc/geoschem-new/Olson_2001_Land_Map.025x025.generic.nc")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer cf.Close()
 
 	o, err := readOlsonLandMap(cf)
 	if err != nil {
@@ -0,0 +1,230 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"io"
+	"math"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+)
+
+const (
+	// earthRadius is the mean radius of the Earth [m].
+	earthRadius = 6371000.
+
+	// poleLatitude is the latitude of the north pole [°].
+	poleLatitude = 90.
+
+	// webMapMaxLatitude is the maximum latitude [°] that can be
+	// represented in the web mapping projection.
+	webMapMaxLatitude = 85.0511287798
+)
+
+// gridUnits are the units of the grid coordinates.
+type gridUnits int
+
+const (
+	meterUnits  gridUnits = iota
+	degreeUnits           // longitude and latitude
+	otherUnits
+)
+
+// globalBounds returns the bounds of the grid specified by config if
+// it is a global grid, and nil otherwise. A global grid is one in the
+// longitude-latitude projection whose outermost nest spans 360° in the
+// x direction, so that the western and eastern edges of the grid are
+// neighbors. The edges of the grid do not need to be at the date line,
+// and the y extent of the grid can extend beyond the poles, for example
+// to match a CTM grid with half-sized polar cells.
+func (config *VarGridConfig) globalBounds() *geom.Bounds {
+	sr, err := proj.Parse(config.GridProj)
+	if err != nil || sr.Name != "longlat" || len(config.Xnests) == 0 {
+		return nil
+	}
+	const tolerance = 1.e-6
+	if math.Abs(config.VariableGridDx*float64(config.Xnests[0])-360) > tolerance {
+		return nil
+	}
+	return config.bounds()
+}
+
+// wrap returns box shifted by 360° in the x direction if d is a global
+// grid and box is beyond its western or eastern edge, so that the cells
+// at the edges of the grid are neighbors. Otherwise it returns box.
+func (d *InMAP) wrap(box *geom.Bounds) *geom.Bounds {
+	if d.global == nil {
+		return box
+	}
+	var shift float64
+	if box.Max.X < d.global.Min.X {
+		shift = 360
+	} else if box.Min.X > d.global.Max.X {
+		shift = -360
+	} else {
+		return box
+	}
+	return &geom.Bounds{
+		Min: geom.Point{X: box.Min.X + shift, Y: box.Min.Y},
+		Max: geom.Point{X: box.Max.X + shift, Y: box.Max.Y},
+	}
+}
+
+// atPole returns whether the northern (if north is true) or southern
+// edge of cell c in global grid d is at or beyond a pole. There is no
+// transport across the poles, so polar cells do not have neighbors or
+// boundary cells on their polar edges.
+func (d *InMAP) atPole(c *Cell, north bool) bool {
+	if d.global == nil {
+		return false
+	}
+	const tolerance = 1.e-8
+	b := c.Bounds()
+	if north {
+		return b.Max.Y >= poleLatitude-tolerance
+	}
+	return b.Min.Y <= -poleLatitude+tolerance
+}
+
+// lonLatCellSize returns the east-west and north-south dimensions [m]
+// of a grid cell with bounds b in longitude and latitude [°], on a
+// spherical Earth. The north-south dimension is the distance between
+// the edges of the cell, and the east-west dimension is set so that
+// the product of the two is the area of the cell, so it converges
+// towards the poles. Latitudes beyond the poles are treated as being at
+// the poles.
+func lonLatCellSize(b *geom.Bounds) (dx, dy float64) {
+	const deg2rad = math.Pi / 180
+	lat0 := math.Max(b.Min.Y, -poleLatitude) * deg2rad
+	lat1 := math.Min(b.Max.Y, poleLatitude) * deg2rad
+	dLon := (b.Max.X - b.Min.X) * deg2rad
+	dy = earthRadius * (lat1 - lat0)
+	if dy <= 0 {
+		return 0, 0
+	}
+	dx = earthRadius * dLon * (math.Sin(lat1) - math.Sin(lat0)) / (lat1 - lat0)
+	return dx, dy
+}
+
+// webMapBounds returns b, which is in longitude and latitude [°],
+// limited to the area that can be represented in the web mapping
+// projection.
+func webMapBounds(b *geom.Bounds) *geom.Bounds {
+	clamp := func(v, limit float64) float64 {
+		return math.Max(-limit, math.Min(v, limit))
+	}
+	return &geom.Bounds{
+		Min: geom.Point{X: clamp(b.Min.X, 180), Y: clamp(b.Min.Y, webMapMaxLatitude)},
+		Max: geom.Point{X: clamp(b.Max.X, 180), Y: clamp(b.Max.Y, webMapMaxLatitude)},
+	}
+}
+
+// wrappedCopies returns copies of g shifted by 360° in the x direction
+// that overlap global grid bounds b, for use with input data whose
+// longitudes are not in the same range as the grid. For example, the
+// copies of a population shape that crosses the eastern edge of the
+// grid overlap its western edge, so that all of the population is in
+// the grid.
+func wrappedCopies(g geom.Geom, b *geom.Bounds) ([]geom.Geom, error) {
+	var copies []geom.Geom
+	gb := g.Bounds()
+	for _, shift := range []float64{-360, 360} {
+		if gb.Min.X+shift >= b.Max.X || gb.Max.X+shift <= b.Min.X {
+			continue
+		}
+		gg, err := g.Transform(shiftX(shift))
+		if err != nil {
+			return nil, err
+		}
+		copies = append(copies, gg)
+	}
+	return copies, nil
+}
+
+// shiftX returns a transformer that shifts coordinates by the given
+// amount in the x direction.
+func shiftX(shift float64) proj.Transformer {
+	return func(x, y float64) (float64, float64, error) {
+		return x + shift, y, nil
+	}
+}
+
+// wrapPopulation returns a version of population search function tree
+// that also finds the population shapes 360° to the east and west of
+// the search bounds, shifted to overlap them, so that population data
+// whose longitudes are not in the same range as a global grid are
+// all within the grid.
+func wrapPopulation(tree func(*geom.Bounds) func() (*population, error)) func(*geom.Bounds) func() (*population, error) {
+	shifts := []float64{0, -360, 360}
+	return func(sb *geom.Bounds) func() (*population, error) {
+		var i int
+		var gen func() (*population, error)
+		return func() (*population, error) {
+			for {
+				if gen == nil {
+					if i >= len(shifts) {
+						return nil, io.EOF
+					}
+					s := shifts[i]
+					gen = tree(&geom.Bounds{
+						Min: geom.Point{X: sb.Min.X + s, Y: sb.Min.Y},
+						Max: geom.Point{X: sb.Max.X + s, Y: sb.Max.Y},
+					})
+				}
+				p, err := gen()
+				if err == io.EOF {
+					gen = nil
+					i++
+					continue
+				} else if err != nil || p == nil || shifts[i] == 0 {
+					return p, err
+				}
+				g, err := p.Polygonal.Transform(shiftX(-shifts[i]))
+				if err != nil {
+					return nil, err
+				}
+				return &population{Polygonal: g.(geom.Polygonal), PopData: p.PopData}, nil
+			}
+		}
+	}
+}
+
+// wrap adds copies of the emissions records in e that are beyond the
+// western or eastern edge of global grid bounds b to the spatial index of
+// e, shifted by 360° so that they are in the grid. It only needs to be
+// called once for a given grid.
+func (e *Emissions) wrap(b *geom.Bounds) error {
+	if e.wrapped != nil && *e.wrapped == *b {
+		return nil
+	}
+	for _, er := range e.dataSlice {
+		copies, err := wrappedCopies(er.Geom, b)
+		if err != nil {
+			return err
+		}
+		for _, g := range copies {
+			erCopy := *er
+			erCopy.Geom = g
+			e.data.Insert(&erCopy)
+		}
+	}
+	e.wrapped = b
+	return nil
+}
@@ -0,0 +1,190 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+)
+
+const lonLatWKT = `GEOGCS["GCS_WGS_1984",DATUM["D_WGS_1984",SPHEROID["WGS_1984",6378137,298.257223563]],PRIMEM["Greenwich",0],UNIT["Degree",0.017453292519943295]]`
+
+// globalTestData returns test data for a global grid whose western and
+// eastern edges are at 185°W and 175°E, with population and mortality
+// rate data in longitudes between 180°W and 180°E.
+func globalTestData(t *testing.T) (*VarGridConfig, *CTMData, *Population, PopIndices, *MortalityRates, MortIndices) {
+	cfg, data := CreateTestCTMData()
+	cfg.VariableGridXo = -185
+	cfg.VariableGridYo = -90
+	cfg.VariableGridDx = 90
+	cfg.VariableGridDy = 45
+	cfg.Xnests = []int{4, 2}
+	cfg.Ynests = []int{4, 2}
+	cfg.GridProj = "+proj=longlat +datum=WGS84"
+	cfg.CensusFile = "tempGlobalPop.shp"
+	cfg.CensusPopColumns = []string{"TotalPop"}
+	cfg.PopGridColumn = "TotalPop"
+	cfg.MortalityRateFile = "tempGlobalMort.shp"
+	cfg.MortalityRateColumns = map[string]string{"AllCause": "TotalPop"}
+
+	data.xo, data.yo = -185, -90
+	data.dx, data.dy = 180, 90
+	data.makeCTMgrid(10)
+
+	type pop struct {
+		geom.Polygon
+		TotalPop float64
+	}
+	type mort struct {
+		geom.Polygon
+		AllCause float64
+	}
+	rect := func(x0, y0, x1, y1 float64) geom.Polygon {
+		return geom.Polygon{{{X: x0, Y: y0}, {X: x1, Y: y0}, {X: x1, Y: y1}, {X: x0, Y: y1}, {X: x0, Y: y0}}}
+	}
+	write := func(fname string, v interface{}) {
+		e, err := shp.NewEncoder(fname, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = e.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		e.Close()
+		if err := os.WriteFile(strings.TrimSuffix(fname, ".shp")+".prj", []byte(lonLatWKT), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The population crosses the eastern edge of the grid.
+	write(cfg.CensusFile, pop{Polygon: rect(170, 0, 180, 10), TotalPop: 100})
+	write(cfg.MortalityRateFile, mort{Polygon: rect(-180, -90, 180, 90), AllCause: 800})
+	defer DeleteShapefile(cfg.CensusFile)
+	defer DeleteShapefile(cfg.MortalityRateFile)
+
+	p, pi, mr, mi, err := cfg.LoadPopMort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cfg, data, p, pi, mr, mi
+}
+
+func TestGlobalGrid(t *testing.T) {
+	cfg, data, pop, popIndices, mr, mortIndices := globalTestData(t)
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{Geom: geom.Point{X: 178, Y: 5}, PM25: 1})
+	var m Mech
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(data, pop, popIndices, mr, mortIndices, emis, m),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range []*cellList{d.westBoundary, d.eastBoundary, d.northBoundary, d.southBoundary} {
+		if b.len() != 0 {
+			t.Errorf("there should be no horizontal boundary cells but there are %d", b.len())
+		}
+	}
+	if d.topBoundary.len() != 16 {
+		t.Errorf("there should be 16 top boundary cells but there are %d", d.topBoundary.len())
+	}
+
+	var area, totalPop, emisFlux float64
+	for _, c := range d.cells.array() {
+		if c.west.len() != 1 || c.east.len() != 1 {
+			t.Errorf("cell %v should have one western and one eastern neighbor", c.Polygonal)
+		}
+		b := c.Bounds()
+		if b.Min.X == -185 && c.west[0].Bounds().Max.X != 175 {
+			t.Errorf("cell %v should have a neighbor across the western edge of the grid", c.Polygonal)
+		}
+		if b.Max.Y == 90 && c.north.len() != 0 || b.Min.Y == -90 && c.south.len() != 0 {
+			t.Errorf("polar cell %v should not have neighbors across the pole", c.Polygonal)
+		}
+		if c.Layer != 0 {
+			continue
+		}
+		area += c.Dx * c.Dy
+		totalPop += c.PopData[popIndices["TotalPop"]]
+		if c.PopData[popIndices["TotalPop"]] > 0 {
+			if have := c.MortData[mortIndices["AllCause"]]; different(have, 800, 1.e-10) {
+				t.Errorf("cell %v mortality rate: have %g, want 800", c.Polygonal, have)
+			}
+			if b.Min.X != -185 && b.Max.X != 175 {
+				t.Errorf("cell %v should not have population", c.Polygonal)
+			}
+		}
+		if c.EmisFlux[iPM2_5] > 0 {
+			if b.Min.X != -185 || b.Min.Y != 0 {
+				t.Errorf("cell %v should not have emissions", c.Polygonal)
+			}
+			emisFlux += c.EmisFlux[iPM2_5] * c.Volume
+		}
+	}
+	if want := 4 * math.Pi * earthRadius * earthRadius; different(area, want, 1.e-10) {
+		t.Errorf("grid area: have %g, want %g", area, want)
+	}
+	if different(totalPop, 100, 1.e-10) {
+		t.Errorf("total population: have %g, want 100", totalPop)
+	}
+	if different(emisFlux, 1, 1.e-10) {
+		t.Errorf("total emissions: have %g, want 1", emisFlux)
+	}
+}
+
+func TestGlobalBounds(t *testing.T) {
+	cfg, _ := CreateTestCTMData()
+	if cfg.globalBounds() != nil {
+		t.Error("a projected grid should not be global")
+	}
+	cfg.GridProj = "+proj=longlat +datum=WGS84"
+	cfg.VariableGridXo, cfg.VariableGridDx, cfg.Xnests = -180, 2.5, []int{144, 2}
+	if cfg.globalBounds() == nil {
+		t.Error("the grid should be global")
+	}
+	cfg.Xnests = []int{100, 2}
+	if cfg.globalBounds() != nil {
+		t.Error("a regional longitude-latitude grid should not be global")
+	}
+}
+
+func TestLonLatCellSize(t *testing.T) {
+	const tolerance = 1.e-10
+	dx, dy := lonLatCellSize(&geom.Bounds{Max: geom.Point{X: 1, Y: 1}})
+	if want := earthRadius * math.Pi / 180; different(dx, want, 1.e-4) || different(dy, want, tolerance) {
+		t.Errorf("equatorial cell: have %g × %g, want %g × %g", dx, dy, want, want)
+	}
+	// Cells that extend beyond the pole are the same size as those that
+	// end at the pole, and converge towards it.
+	dx1, dy1 := lonLatCellSize(&geom.Bounds{Min: geom.Point{Y: 89}, Max: geom.Point{X: 1, Y: 91}})
+	dx2, dy2 := lonLatCellSize(&geom.Bounds{Min: geom.Point{Y: 89}, Max: geom.Point{X: 1, Y: 90}})
+	if dx1 != dx2 || dy1 != dy2 {
+		t.Errorf("polar cells: %g × %g != %g × %g", dx1, dy1, dx2, dy2)
+	}
+	if dx2 > dx/100 {
+		t.Errorf("polar cell width %g should be much less than equatorial width %g", dx2, dx)
+	}
+}
@@ -0,0 +1,366 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/ctessum/geom/index/rtree"
+	"github.com/ctessum/geom/proj"
+)
+
+// asciiGrid holds a raster in the ESRI ASCII grid format, which is one of
+// the formats that global gridded population datasets such as the
+// Gridded Population of the World (GPW) and WorldPop are distributed in.
+type asciiGrid struct {
+	nCols, nRows int
+
+	// xll and yll are the coordinates of the lower-left corner of the grid.
+	xll, yll float64
+	cellSize float64
+
+	// data holds the values of the grid cells, starting with the
+	// northernmost row. Cells with no data are NaN.
+	data []float64
+}
+
+// readASCIIGrid reads an ESRI ASCII grid file.
+func readASCIIGrid(fname string) (*asciiGrid, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 1024*1024), 1024*1024)
+	s.Split(bufio.ScanWords)
+
+	g := new(asciiGrid)
+	noData := math.NaN()
+	var xCenter, yCenter bool
+	var token string
+	// Read the header, which is a list of keys and values.
+	for s.Scan() {
+		token = s.Text()
+		if !unicode.IsLetter([]rune(token)[0]) || strings.EqualFold(token, "nan") {
+			break
+		}
+		key := strings.ToLower(token)
+		token = ""
+		if !s.Scan() {
+			break
+		}
+		v, err := strconv.ParseFloat(s.Text(), 64)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: reading ASCII grid %s header value %s: %w", fname, key, err)
+		}
+		switch key {
+		case "ncols":
+			g.nCols = int(v)
+		case "nrows":
+			g.nRows = int(v)
+		case "xllcorner":
+			g.xll = v
+		case "xllcenter":
+			g.xll, xCenter = v, true
+		case "yllcorner":
+			g.yll = v
+		case "yllcenter":
+			g.yll, yCenter = v, true
+		case "cellsize":
+			g.cellSize = v
+		case "nodata_value":
+			noData = v
+		default:
+			return nil, fmt.Errorf("inmap: reading ASCII grid %s: invalid header key %s", fname, key)
+		}
+	}
+	if g.nCols <= 0 || g.nRows <= 0 || !(g.cellSize > 0) {
+		return nil, fmt.Errorf("inmap: reading ASCII grid %s: ncols, nrows, and cellsize must be greater than zero", fname)
+	}
+	if xCenter {
+		g.xll -= g.cellSize / 2
+	}
+	if yCenter {
+		g.yll -= g.cellSize / 2
+	}
+
+	g.data = make([]float64, 0, g.nCols*g.nRows)
+	for {
+		if token != "" {
+			v, err := strconv.ParseFloat(token, 64)
+			if err != nil {
+				return nil, fmt.Errorf("inmap: reading ASCII grid %s: %w", fname, err)
+			}
+			if v == noData {
+				v = math.NaN()
+			}
+			g.data = append(g.data, v)
+		}
+		if !s.Scan() {
+			break
+		}
+		token = s.Text()
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("inmap: reading ASCII grid %s: %w", fname, err)
+	}
+	if len(g.data) != g.nCols*g.nRows {
+		return nil, fmt.Errorf("inmap: reading ASCII grid %s: there are %d values but there should be %d", fname, len(g.data), g.nCols*g.nRows)
+	}
+	return g, nil
+}
+
+// sameGrid returns whether g and g2 have the same dimensions and location.
+func (g *asciiGrid) sameGrid(g2 *asciiGrid) bool {
+	return g.nCols == g2.nCols && g.nRows == g2.nRows && g.xll == g2.xll && g.yll == g2.yll && g.cellSize == g2.cellSize
+}
+
+// cellRange returns the range of the rows and columns of the grid cells
+// that overlap b, where the end of the range is not included.
+func (g *asciiGrid) cellRange(b *geom.Bounds) (row0, row1, col0, col1 int) {
+	clamp := func(i, max int) int {
+		if i < 0 {
+			return 0
+		} else if i > max {
+			return max
+		}
+		return i
+	}
+	yTop := g.yll + float64(g.nRows)*g.cellSize
+	col0 = clamp(int(math.Floor((b.Min.X-g.xll)/g.cellSize)), g.nCols)
+	col1 = clamp(int(math.Floor((b.Max.X-g.xll)/g.cellSize))+1, g.nCols)
+	row0 = clamp(int(math.Floor((yTop-b.Max.Y)/g.cellSize)), g.nRows)
+	row1 = clamp(int(math.Floor((yTop-b.Min.Y)/g.cellSize))+1, g.nRows)
+	return
+}
+
+// cellPolygon returns the shape of the grid cell at the given row and column.
+func (g *asciiGrid) cellPolygon(row, col int) geom.Polygon {
+	x0 := g.xll + float64(col)*g.cellSize
+	y1 := g.yll + float64(g.nRows-row)*g.cellSize
+	x1, y0 := x0+g.cellSize, y1-g.cellSize
+	return geom.Polygon{{{X: x0, Y: y0}, {X: x1, Y: y0}, {X: x1, Y: y1}, {X: x0, Y: y1}, {X: x0, Y: y0}}}
+}
+
+// loadPopulationRasters loads population information from the ESRI ASCII
+// grid files in config.PopulationRasters, which must be in
+// longitude-latitude coordinates, converting it to spatial reference sr.
+// Each raster grid cell with population becomes a population shape,
+// which is allocated to the InMAP grid cells by area in the same way as
+// population from a census shapefile.
+// The function outputs an index holding the population
+// information and a map giving the array index of each population type.
+func (config *VarGridConfig) loadPopulationRasters(sr *proj.SR) (func(*geom.Bounds) func() (*population, error), map[string]int, error) {
+	rasters := make([]*asciiGrid, len(config.CensusPopColumns))
+	popIndex := make(map[string]int)
+	for i, p := range config.CensusPopColumns {
+		popIndex[p] = i
+		f, ok := config.PopulationRasters[p]
+		if !ok {
+			return nil, nil, fmt.Errorf("inmap: missing PopulationRasters file for CensusPopColumn %s", p)
+		}
+		r, err := readASCIIGrid(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i > 0 && !r.sameGrid(rasters[0]) {
+			return nil, nil, fmt.Errorf("inmap: the PopulationRasters file for %s has a different grid than the file for %s", p, config.CensusPopColumns[0])
+		}
+		rasters[i] = r
+	}
+
+	inputSR, err := proj.Parse("+proj=longlat")
+	if err != nil {
+		panic(err)
+	}
+	ct, err := inputSR.NewTransform(sr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("inmap: loading population rasters: %w", err)
+	}
+	inverseCT, err := sr.NewTransform(inputSR)
+	if err != nil {
+		return nil, nil, fmt.Errorf("inmap: loading population rasters: %w", err)
+	}
+
+	return func(b *geom.Bounds) func() (*population, error) {
+		gb, err := densePolygonFromBounds(b).Transform(inverseCT)
+		if err != nil {
+			return func() (*population, error) { return nil, err }
+		}
+		grid := rasters[0]
+		row0, row1, col0, col1 := grid.cellRange(gb.Bounds())
+		row, col := row0, col0-1
+		return func() (*population, error) {
+			for {
+				col++
+				if col >= col1 {
+					col = col0
+					row++
+				}
+				if row >= row1 || col0 >= col1 {
+					return nil, io.EOF
+				}
+				i := row*grid.nCols + col
+				pops := make([]float64, len(rasters))
+				var nonZero bool
+				for j, r := range rasters {
+					if v := r.data[i]; !math.IsNaN(v) && v != 0 {
+						pops[j] = v
+						nonZero = true
+					}
+				}
+				if !nonZero {
+					continue
+				}
+				g, err := grid.cellPolygon(row, col).Transform(ct)
+				if err != nil {
+					return nil, err
+				}
+				return &population{Polygonal: g.(geom.Polygonal), PopData: pops}, nil
+			}
+		}
+	}, popIndex, nil
+}
+
+// readCountryMortality reads the baseline mortality rates for each country
+// from config.CountryMortalityFile, which is a CSV file with a header row.
+// It returns the rates in each of the given columns, by country identifier.
+func (config *VarGridConfig) readCountryMortality(columns []string) (map[string][]float64, error) {
+	f, err := os.Open(config.CountryMortalityFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading CountryMortalityFile header: %w", err)
+	}
+	colIndex := make(map[string]int)
+	for i, h := range header {
+		colIndex[strings.TrimSpace(h)] = i
+	}
+	idCol, ok := colIndex[config.CountryIDColumn]
+	if !ok {
+		return nil, fmt.Errorf("inmap: CountryMortalityFile is missing the CountryIDColumn %s", config.CountryIDColumn)
+	}
+	cols := make([]int, len(columns))
+	for i, c := range columns {
+		if cols[i], ok = colIndex[c]; !ok {
+			return nil, fmt.Errorf("inmap: CountryMortalityFile is missing column %s", c)
+		}
+	}
+
+	rates := make(map[string][]float64)
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("inmap: reading CountryMortalityFile: %w", err)
+		}
+		id := strings.TrimSpace(rec[idCol])
+		if _, ok := rates[id]; ok {
+			return nil, fmt.Errorf("inmap: CountryMortalityFile has more than one row for country %s", id)
+		}
+		v := make([]float64, len(cols))
+		for i, c := range cols {
+			if v[i], err = s2f(rec[c]); err != nil {
+				return nil, fmt.Errorf("inmap: reading CountryMortalityFile %s for country %s: %w", columns[i], id, err)
+			}
+		}
+		rates[id] = v
+	}
+	return rates, nil
+}
+
+// loadMortalityCountries loads country-level baseline mortality rates,
+// such as those from the Global Burden of Disease (GBD) study, from
+// config.CountryMortalityFile and assigns them to the country boundaries
+// in config.CountryFile, converting them to spatial reference sr.
+// The rates are allocated to the InMAP grid cells by population-weighted
+// averaging in the same way as those from a mortality rate shapefile.
+// Countries that are not in CountryMortalityFile are skipped. The rates are
+// projected using p if it is not nil.
+func (config *VarGridConfig) loadMortalityCountries(sr *proj.SR, p *projectionFactors) (*rtree.Rtree, map[string]int, error) {
+	mortRateColumns, mortIndices := config.mortalityColumns()
+	rates, err := config.readCountryMortality(mortRateColumns)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	countryShp, err := shp.NewDecoder(config.CountryFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer countryShp.Close()
+	countrySR, err := countryShp.SR()
+	if err != nil {
+		return nil, nil, err
+	}
+	trans, err := countrySR.NewTransform(sr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mortRates := rtree.NewTree(25, 50)
+	global := config.globalBounds()
+	for {
+		g, fields, more := countryShp.DecodeRowFields(config.CountryIDColumn)
+		if !more {
+			break
+		}
+		id, ok := fields[config.CountryIDColumn]
+		if !ok {
+			return nil, nil, fmt.Errorf("inmap: loading CountryFile: missing attribute column %s", config.CountryIDColumn)
+		}
+		r, ok := rates[strings.Trim(id, "\x00 ")]
+		if !ok {
+			continue
+		}
+		gg, err := g.Transform(trans)
+		if err != nil {
+			return nil, nil, err
+		}
+		poly, ok := gg.(geom.Polygonal)
+		if !ok {
+			return nil, nil, fmt.Errorf("inmap: loadMortalityCountries: country shapes need to be polygons")
+		}
+		m := &mortality{Polygonal: poly, MortData: p.scale(poly, r, mortIndices)}
+		if err := insertMortality(mortRates, m, global); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := countryShp.Error(); err != nil {
+		return nil, nil, err
+	}
+	return mortRates, mortIndices, nil
+}
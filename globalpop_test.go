@@ -0,0 +1,195 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	goshp "github.com/jonas-p/go-shp"
+)
+
+func TestReadASCIIGrid(t *testing.T) {
+	const fname = "tempPop.asc"
+	err := os.WriteFile(fname, []byte(`ncols 3
+nrows 2
+xllcenter -5
+yllcenter 0.5
+cellsize 1
+NODATA_value -9999
+1 2 -9999
+4 5 6
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fname)
+	g, err := readASCIIGrid(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.nCols != 3 || g.nRows != 2 || g.xll != -5.5 || g.yll != 0 || g.cellSize != 1 {
+		t.Errorf("invalid header: %+v", g)
+	}
+	if len(g.data) != 6 || g.data[0] != 1 || g.data[2] == g.data[2] || g.data[5] != 6 {
+		t.Errorf("invalid data: %v", g.data)
+	}
+	row0, row1, col0, col1 := g.cellRange(&geom.Bounds{Min: geom.Point{X: -4.5, Y: 1.5}, Max: geom.Point{X: 10, Y: 10}})
+	if row0 != 0 || row1 != 1 || col0 != 1 || col1 != 3 {
+		t.Errorf("cell range: %d, %d, %d, %d", row0, row1, col0, col1)
+	}
+	want := geom.Polygon{{{X: -4.5, Y: 0}, {X: -3.5, Y: 0}, {X: -3.5, Y: 1}, {X: -4.5, Y: 1}, {X: -4.5, Y: 0}}}
+	if p := g.cellPolygon(1, 1); !reflect.DeepEqual(p, want) {
+		t.Errorf("cell polygon: have %v, want %v", p, want)
+	}
+
+	if err := os.WriteFile(fname, []byte("ncols 3\nnrows 2\nxllcorner 0\nyllcorner 0\ncellsize 1\n1 2 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readASCIIGrid(fname); err == nil {
+		t.Error("missing values should cause an error")
+	}
+}
+
+// rasterTestData returns test data for a global grid with population from
+// an ESRI ASCII grid file and country-level mortality rates. The
+// returned function deletes the files that were created.
+func rasterTestData(t *testing.T) (*VarGridConfig, *CTMData, func()) {
+	cfg, data := CreateTestCTMData()
+	cfg.VariableGridXo = -185
+	cfg.VariableGridYo = -90
+	cfg.VariableGridDx = 90
+	cfg.VariableGridDy = 45
+	cfg.Xnests = []int{4, 2}
+	cfg.Ynests = []int{4, 2}
+	cfg.GridProj = "+proj=longlat +datum=WGS84"
+	cfg.CensusFile = ""
+	cfg.CensusPopColumns = []string{"TotalPop"}
+	cfg.PopGridColumn = "TotalPop"
+	cfg.PopulationRasters = map[string]string{"TotalPop": "tempGlobalPop.asc"}
+	cfg.MortalityRateFile = ""
+	cfg.MortalityRateColumns = map[string]string{"AllCause": "TotalPop"}
+	cfg.CountryMortalityFile = "tempCountryMort.csv"
+	cfg.CountryFile = "tempCountries.shp"
+	cfg.CountryIDColumn = "ISO3"
+
+	data.xo, data.yo = -185, -90
+	data.dx, data.dy = 180, 90
+	data.makeCTMgrid(10)
+
+	cleanup := func() {
+		os.Remove(cfg.PopulationRasters["TotalPop"])
+		os.Remove(cfg.CountryMortalityFile)
+		DeleteShapefile(cfg.CountryFile)
+	}
+	err := os.WriteFile(cfg.PopulationRasters["TotalPop"], []byte(`ncols 4
+nrows 2
+xllcorner -180
+yllcorner -90
+cellsize 90
+NODATA_value -9999
+0 0 0 100
+-9999 50 0 0
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(cfg.CountryMortalityFile, []byte("ISO3,AllCause\nAAA,800\nBBB,400\n"), 0644)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	writeRegions(t, cfg.CountryFile, "ISO3", map[string]geom.Polygon{
+		"AAA": lonLatRect(-180, -90, 0, 90),
+		"BBB": lonLatRect(0, -90, 180, 90),
+		"CCC": lonLatRect(-10, -10, 10, 10), // Not in the mortality file.
+	})
+	return &cfg, data, cleanup
+}
+
+func lonLatRect(x0, y0, x1, y1 float64) geom.Polygon {
+	return geom.Polygon{{{X: x0, Y: y0}, {X: x1, Y: y0}, {X: x1, Y: y1}, {X: x0, Y: y1}, {X: x0, Y: y0}}}
+}
+
+// writeRegions writes the given regions to a longitude-latitude
+// shapefile with their identifiers in the field idField.
+func writeRegions(t *testing.T, fname, idField string, regions map[string]geom.Polygon) {
+	ids := make([]string, 0, len(regions))
+	for id := range regions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	e, err := shp.NewEncoderFromFields(fname, goshp.POLYGON, goshp.StringField(idField, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if err = e.EncodeFields(regions[id], id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.Close()
+	if err := os.WriteFile(strings.TrimSuffix(fname, ".shp")+".prj", []byte(lonLatWKT), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// popMortTotals returns the total population and the total of the
+// population times the mortality rate in the ground-level grid cells.
+func popMortTotals(t *testing.T, cfg *VarGridConfig, data *CTMData) (totalPop, deaths float64) {
+	pop, popIndices, mr, mortIndices, err := cfg.LoadPopMort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(data, pop, popIndices, mr, mortIndices, NewEmissions(), Mech{}),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range d.cells.array() {
+		if c.Layer != 0 {
+			continue
+		}
+		p := c.PopData[popIndices["TotalPop"]]
+		totalPop += p
+		deaths += p * c.MortData[mortIndices["AllCause"]]
+	}
+	return totalPop, deaths
+}
+
+func TestLoadPopMort_global(t *testing.T) {
+	cfg, data, cleanup := rasterTestData(t)
+	defer cleanup()
+	totalPop, deaths := popMortTotals(t, cfg, data)
+	if different(totalPop, 150, 1.e-10) {
+		t.Errorf("total population: have %g, want 150", totalPop)
+	}
+	// The population in each raster cell is within a single country.
+	if want := 100.*400 + 50*800; different(deaths, want, 1.e-10) {
+		t.Errorf("population-weighted mortality: have %g, want %g", deaths, want)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/ctessum/geom/proj"
+)
+
+// InfiltrationArea is an area, such as a county or a grid cell, where the
+// housing stock lets a given fraction of outdoor pollution into buildings.
+type InfiltrationArea struct {
+	// Factor is the ratio of the indoor concentration of pollution
+	// from outdoor sources to the outdoor concentration.
+	Factor float64
+
+	// Polygonal is the shape of the area in the spatial reference
+	// of the model grid.
+	geom.Polygonal
+}
+
+// ReadInfiltrationAreas reads infiltration areas from the polygons in
+// shapefile, converting them to gridSR, the spatial reference of the model
+// grid. The infiltration factors are taken from the factorColumn attribute.
+func ReadInfiltrationAreas(shapefile, factorColumn string, gridSR *proj.SR) ([]InfiltrationArea, error) {
+	f, err := shp.NewDecoder(shapefile)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: opening infiltration shapefile: %v", err)
+	}
+	defer f.Close()
+	sr, err := f.SR()
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading projection of infiltration shapefile: %v", err)
+	}
+	trans, err := sr.NewTransform(gridSR)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading infiltration shapefile: %v", err)
+	}
+	var areas []InfiltrationArea
+	for {
+		g, fields, more := f.DecodeRowFields(factorColumn)
+		if !more {
+			break
+		}
+		v, ok := fields[factorColumn]
+		if !ok {
+			return nil, fmt.Errorf("inmap: infiltration shapefile %s does not have column '%s'", shapefile, factorColumn)
+		}
+		factor, err := s2f(strings.Trim(v, "\x00 "))
+		if err != nil {
+			return nil, fmt.Errorf("inmap: infiltration shapefile %s: %v", shapefile, err)
+		}
+		if factor < 0 {
+			return nil, fmt.Errorf("inmap: infiltration shapefile %s: factor %g is negative", shapefile, factor)
+		}
+		p, ok := g.(geom.Polygonal)
+		if !ok {
+			return nil, fmt.Errorf("inmap: infiltration shapefile %s: geometry is %T but should be polygonal", shapefile, g)
+		}
+		gT, err := p.Transform(trans)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: reading infiltration shapefile: %v", err)
+		}
+		areas = append(areas, InfiltrationArea{Factor: factor, Polygonal: gT.(geom.Polygonal)})
+	}
+	if err := f.Error(); err != nil {
+		return nil, fmt.Errorf("inmap: reading infiltration shapefile: %v", err)
+	}
+	return areas, nil
+}
+
+// infiltrationFactors returns the infiltration factor of each of the
+// ground-level grid cells in rows, which is the average of the factors of
+// the areas that overlap the cell, weighted by the area of overlap.
+// defaultFactor is used for the parts of cells that are not in any of the
+// areas.
+func (d *InMAP) infiltrationFactors(areas []InfiltrationArea, defaultFactor float64, rows map[*Cell]int) []float64 {
+	sums := make([]float64, len(rows))
+	covered := make([]float64, len(rows))
+	for _, a := range areas {
+		for _, cI := range d.index.SearchIntersect(a.Bounds()) {
+			c := cI.(*Cell)
+			row, ok := rows[c]
+			if !ok {
+				continue
+			}
+			intersection := a.Intersection(c.Polygonal)
+			if intersection == nil {
+				continue
+			}
+			w := intersection.Area()
+			sums[row] += a.Factor * w
+			covered[row] += w
+		}
+	}
+	factors := make([]float64, len(rows))
+	for c, row := range rows {
+		area := c.Area()
+		if covered[row] > area {
+			// Overlapping areas.
+			area = covered[row]
+		}
+		factors[row] = (sums[row] + defaultFactor*(area-covered[row])) / area
+	}
+	return factors
+}
+
+// InfiltrationResults returns the values of the output variables of o in
+// the ground-level grid cells, in the form of map[variable][row]value,
+// where the pollutant concentrations are the concentrations that people
+// are exposed to, accounting for infiltration of outdoor pollution into
+// buildings. In each grid cell, the exposure concentrations are
+//
+//	C * (indoorFraction * F + 1 - indoorFraction)
+//
+// where C is the outdoor concentration, F is the infiltration factor of
+// the cell, which is the area-weighted average of the factors of the
+// given areas that overlap the cell (defaultFactor is used where there
+// are no areas), and indoorFraction is the fraction of time that people
+// spend indoors. The infiltration factors are included in the results as
+// the variable "InfFactor". Population, mortality rates, and other
+// variables are not adjusted.
+func (d *InMAP) InfiltrationResults(o *Outputter, areas []InfiltrationArea, defaultFactor, indoorFraction float64) (map[string][]float64, error) {
+	if indoorFraction < 0 || indoorFraction > 1 {
+		return nil, fmt.Errorf("inmap: indoor fraction %g is not between 0 and 1", indoorFraction)
+	}
+	ground := *o
+	ground.allLayers = false
+	modelVals, nCells, err := d.modelValues(&ground)
+	if err != nil {
+		return nil, err
+	}
+
+	// rows holds the index of each ground-level cell in the results.
+	rows := make(map[*Cell]int)
+	for i, c := range d.cells.array() {
+		if c.Layer == 0 {
+			rows[c] = i
+		}
+	}
+	factors := d.infiltrationFactors(areas, defaultFactor, rows)
+
+	concentrations := concentrationVariables(o.m)
+	for name, v := range modelVals {
+		if _, ok := concentrations[name]; !ok {
+			continue
+		}
+		x := v.([]float64)
+		adjusted := make([]float64, len(x))
+		for i, c := range x {
+			adjusted[i] = c * (indoorFraction*factors[i] + 1 - indoorFraction)
+		}
+		modelVals[name] = adjusted
+	}
+	results, err := ground.evaluate(modelVals, nCells)
+	if err != nil {
+		return nil, err
+	}
+	results["InfFactor"] = factors
+	return results, nil
+}
+
+// OutputInfiltration returns a function that writes the
+// infiltration-adjusted values of the output variables of o
+// (see InfiltrationResults) in the ground-level grid cells to fileName,
+// which can be any of the file types supported by Output. SR is the
+// spatial reference of the model grid.
+func (o *Outputter) OutputInfiltration(sr *proj.SR, areas []InfiltrationArea, defaultFactor, indoorFraction float64, fileName string) DomainManipulator {
+	return func(d *InMAP) error {
+		results, err := d.InfiltrationResults(o, areas, defaultFactor, indoorFraction)
+		if err != nil {
+			return err
+		}
+		cells := d.cells.array()[0:len(results["InfFactor"])]
+		if !IsPostGISURL(fileName) && !isGeoParquet(fileName) && !isKML(fileName) {
+			fileName = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".shp"
+		}
+		return writeGridResults(fileName, sr, cells, results)
+	}
+}
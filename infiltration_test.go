@@ -0,0 +1,137 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap_test
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/ctessum/geom/proj"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/science/chem/simplechem"
+)
+
+func TestInfiltrationResults(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := inmap.VarGridTestData()
+	emis := inmap.NewEmissions()
+	var m simplechem.Mechanism
+
+	d := &inmap.InMAP{
+		InitFuncs: []inmap.DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	o, err := inmap.NewOutputter("", false, map[string]string{
+		"PM":       "PrimaryPM25",
+		"TotalPop": "TotalPop",
+	}, nil, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells := d.Cells()
+	for _, c := range cells {
+		for i := range c.Cf {
+			c.Cf[i] = 10
+		}
+	}
+
+	rect := func(b *geom.Bounds) geom.Polygon {
+		return geom.Polygon{{b.Min, {X: b.Max.X, Y: b.Min.Y}, b.Max, {X: b.Min.X, Y: b.Max.Y}}}
+	}
+	// The first area covers the first cell and the second area covers
+	// half of the second cell.
+	half := cells[1].Bounds().Copy()
+	half.Max.X = (half.Min.X + half.Max.X) / 2
+
+	dir, err := os.MkdirTemp("", "infiltration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	type area struct {
+		geom.Polygon
+		Finf float64
+	}
+	shpFile := filepath.Join(dir, "areas.shp")
+	e, err := shp.NewEncoder(shpFile, area{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []area{
+		{Polygon: rect(cells[0].Bounds()), Finf: 0.5},
+		{Polygon: rect(half), Finf: 0.2},
+	} {
+		if err := e.Encode(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.Close()
+	if err := os.WriteFile(filepath.Join(dir, "areas.prj"), []byte(inmap.TestGridSR), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sr, err := proj.Parse(inmap.TestGridSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	areas, err := inmap.ReadInfiltrationAreas(shpFile, "Finf", sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(areas) != 2 || areas[0].Factor != 0.5 {
+		t.Fatalf("invalid areas %+v", areas)
+	}
+
+	r, err := d.InfiltrationResults(o, areas, 1, 0.8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []struct{ factor, pm float64 }{
+		{factor: 0.5, pm: 10 * (0.8*0.5 + 0.2)},
+		{factor: 0.6, pm: 10 * (0.8*0.6 + 0.2)},
+		{factor: 1, pm: 10},
+	} {
+		if math.Abs(r["InfFactor"][i]-want.factor) > 1.e-10 {
+			t.Errorf("cell %d factor: have %g, want %g", i, r["InfFactor"][i], want.factor)
+		}
+		if math.Abs(r["PM"][i]-want.pm) > 1.e-10 {
+			t.Errorf("cell %d PM: have %g, want %g", i, r["PM"][i], want.pm)
+		}
+	}
+	if want := cells[0].PopData[popIndices["TotalPop"]]; r["TotalPop"][0] != want {
+		t.Errorf("population should not change: have %g, want %g", r["TotalPop"][0], want)
+	}
+
+	if _, err := d.InfiltrationResults(o, areas, 1, 2); err == nil {
+		t.Error("invalid indoor fraction should cause an error")
+	}
+
+	if err := o.OutputInfiltration(sr, areas, 1, 0.8, filepath.Join(dir, "out.shp"))(d); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.dbf")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,291 @@
+/*
+Copyright © 2020 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ctessum/geom/encoding/shp"
+	goshp "github.com/jonas-p/go-shp"
+	"github.com/yuzhou-wang/inmap/emissions/aep/aeputil"
+)
+
+// acsStates are the FIPS codes of the U.S. states and the District of
+// Columbia, which are the default states retrieved by ACS.
+var acsStates = []string{
+	"01", "02", "04", "05", "06", "08", "09", "10", "11", "12", "13", "15",
+	"16", "17", "18", "19", "20", "21", "22", "23", "24", "25", "26", "27",
+	"28", "29", "30", "31", "32", "33", "34", "35", "36", "37", "38", "39",
+	"40", "41", "42", "44", "45", "46", "47", "48", "49", "50", "51", "53",
+	"54", "55", "56",
+}
+
+// acsMaxVariables is the maximum number of variables that can be requested
+// from the Census API at once.
+const acsMaxVariables = 50
+
+// ACS retrieves block-group population data for the given year (vintage)
+// of the American Community Survey (ACS) from the U.S. Census Bureau API,
+// joins it to the block group boundaries, and writes it to OutputFile,
+// which is a shapefile that can be used with the VarGrid.CensusFile
+// configuration option.
+//
+// Variables is a map of the names of the output shapefile fields, which
+// can be no longer than 10 characters, to the ACS variables they contain,
+// such as "B03002_001E" for the total population. Several ACS variables
+// can be added together by separating them with "+".
+// States are the FIPS codes of the states to retrieve; if empty, all of
+// the states and the District of Columbia are retrieved.
+//
+// In APIURL and BoundaryURL, the text "[YEAR]" is replaced by year and
+// "[STATE]" by the FIPS code of each state. BoundaryURL is the location of
+// the block group boundary shapefile for each state, which has the
+// block group identifiers in the field GEOID. The API responses and
+// boundary files are stored in the subdirectory of CacheDir for year so
+// that they only need to be downloaded once. APIKey is optional, but the
+// Census API limits the number of requests without one.
+func ACS(ctx context.Context, year int, States []string, Variables map[string]string, APIURL, BoundaryURL, APIKey, CacheDir, OutputFile string, outChan chan string) error {
+	if len(Variables) == 0 {
+		return fmt.Errorf("inmap: no ACS variables are specified")
+	}
+	if len(States) == 0 {
+		States = acsStates
+	}
+	if CacheDir == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return fmt.Errorf("inmap: finding ACS cache directory: %v", err)
+		}
+		CacheDir = filepath.Join(dir, "inmap", "acs")
+	}
+	yearDir := filepath.Join(CacheDir, strconv.Itoa(year))
+
+	// Find the ACS variables that make up each output field.
+	fieldNames := make([]string, 0, len(Variables))
+	for f := range Variables {
+		if len(f) > 10 {
+			return fmt.Errorf("inmap: ACS output field name %s is longer than 10 characters", f)
+		}
+		fieldNames = append(fieldNames, f)
+	}
+	sort.Strings(fieldNames)
+	terms := make([][]string, len(fieldNames))
+	varIndex := make(map[string]int)
+	var acsVars []string
+	for i, f := range fieldNames {
+		for _, v := range strings.Split(Variables[f], "+") {
+			v = strings.TrimSpace(v)
+			if v == "" {
+				return fmt.Errorf("inmap: invalid ACS variable expression '%s' for %s", Variables[f], f)
+			}
+			if _, ok := varIndex[v]; !ok {
+				varIndex[v] = len(acsVars)
+				acsVars = append(acsVars, v)
+			}
+			terms[i] = append(terms[i], v)
+		}
+	}
+	if len(acsVars) > acsMaxVariables {
+		return fmt.Errorf("inmap: %d ACS variables are specified but the Census API allows at most %d", len(acsVars), acsMaxVariables)
+	}
+
+	fields := make([]goshp.Field, len(fieldNames))
+	for i, f := range fieldNames {
+		fields[i] = goshp.FloatField(f, 18, 2)
+	}
+	fileBase := strings.TrimSuffix(OutputFile, filepath.Ext(OutputFile))
+	enc, err := shp.NewEncoderFromFields(fileBase+".shp", goshp.POLYGON, fields...)
+	if err != nil {
+		return fmt.Errorf("inmap: creating ACS output shapefile: %v", err)
+	}
+	defer enc.Close()
+
+	expand := func(location, state string) string {
+		location = strings.Replace(os.ExpandEnv(location), "[YEAR]", strconv.Itoa(year), -1)
+		return strings.Replace(location, "[STATE]", state, -1)
+	}
+	var prj string
+	for _, state := range States {
+		outChan <- fmt.Sprintf("retrieving ACS data for state %s", state)
+		data, err := acsData(ctx, expand(APIURL, state), state, acsVars, APIKey, yearDir)
+		if err != nil {
+			return err
+		}
+
+		boundaryLocation := expand(BoundaryURL, state)
+		outChan <- fmt.Sprintf("retrieving %s", boundaryLocation)
+		files, err := aeputil.Fetch(ctx, boundaryLocation, yearDir)
+		if err != nil {
+			return err
+		}
+		var shpFile string
+		for _, f := range files {
+			if strings.ToLower(filepath.Ext(f)) == ".shp" {
+				shpFile = f
+			}
+		}
+		if shpFile == "" {
+			return fmt.Errorf("inmap: there is no shapefile in %s", boundaryLocation)
+		}
+		if prj == "" {
+			b, err := os.ReadFile(strings.TrimSuffix(shpFile, filepath.Ext(shpFile)) + ".prj")
+			if err != nil {
+				return fmt.Errorf("inmap: reading ACS boundary projection: %v", err)
+			}
+			prj = string(b)
+		}
+
+		dec, err := shp.NewDecoder(shpFile)
+		if err != nil {
+			return err
+		}
+		var missing int
+		for {
+			g, rowFields, more := dec.DecodeRowFields("GEOID")
+			if !more {
+				break
+			}
+			vals, ok := data[strings.TrimSpace(rowFields["GEOID"])]
+			if !ok {
+				missing++
+				continue
+			}
+			out := make([]interface{}, len(fieldNames))
+			for i, t := range terms {
+				var sum float64
+				for _, v := range t {
+					sum += vals[varIndex[v]]
+				}
+				out[i] = sum
+			}
+			if err := enc.EncodeFields(g, out...); err != nil {
+				dec.Close()
+				return fmt.Errorf("inmap: writing ACS output shapefile: %v", err)
+			}
+		}
+		err = dec.Error()
+		dec.Close()
+		if err != nil {
+			return err
+		}
+		if missing > 0 {
+			outChan <- fmt.Sprintf("%d block groups in state %s have no ACS data and were skipped", missing, state)
+		}
+	}
+	outChan <- fmt.Sprintf("writing ACS population to %s", fileBase+".shp")
+	return os.WriteFile(fileBase+".prj", []byte(prj), 0644)
+}
+
+// acsData returns the values of the given ACS variables for each block
+// group in state, by block group GEOID, retrieving them from the Census API
+// at apiURL or from cacheDir if they have been retrieved before.
+// Values that are not available, which the API reports as negative
+// numbers, are set to zero.
+func acsData(ctx context.Context, apiURL, state string, vars []string, apiKey, cacheDir string) (map[string][]float64, error) {
+	h := sha256.Sum256([]byte(apiURL + strings.Join(vars, ",")))
+	cacheFile := filepath.Join(cacheDir, fmt.Sprintf("acs_%s_%x.json", state, h[:8]))
+
+	var table [][]string
+	if b, err := os.ReadFile(cacheFile); err == nil {
+		if err := json.Unmarshal(b, &table); err != nil {
+			return nil, fmt.Errorf("inmap: reading cached ACS data %s: %v", cacheFile, err)
+		}
+	} else {
+		q := url.Values{}
+		q.Set("get", strings.Join(vars, ","))
+		q.Set("for", "block group:*")
+		q.Add("in", "state:"+state)
+		q.Add("in", "county:*")
+		if apiKey != "" {
+			q.Set("key", apiKey)
+		}
+		req, err := http.NewRequest(http.MethodGet, apiURL+"?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("inmap: retrieving ACS data for state %s: %v", state, err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inmap: retrieving ACS data for state %s: %v", state, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("inmap: retrieving ACS data for state %s: %s: %s", state, resp.Status, strings.TrimSpace(string(b)))
+		}
+		if err := json.Unmarshal(b, &table); err != nil {
+			return nil, fmt.Errorf("inmap: parsing ACS data for state %s: %v", state, err)
+		}
+		if err := os.MkdirAll(cacheDir, os.ModePerm); err != nil {
+			return nil, fmt.Errorf("inmap: creating ACS data cache: %v", err)
+		}
+		if err := os.WriteFile(cacheFile, b, 0644); err != nil {
+			return nil, fmt.Errorf("inmap: caching ACS data: %v", err)
+		}
+	}
+	if len(table) == 0 {
+		return nil, fmt.Errorf("inmap: no ACS data for state %s", state)
+	}
+
+	col := make(map[string]int)
+	for i, h := range table[0] {
+		col[h] = i
+	}
+	for _, c := range append([]string{"state", "county", "tract", "block group"}, vars...) {
+		if _, ok := col[c]; !ok {
+			return nil, fmt.Errorf("inmap: ACS data for state %s is missing column %s", state, c)
+		}
+	}
+	data := make(map[string][]float64, len(table)-1)
+	for _, row := range table[1:] {
+		if len(row) != len(table[0]) {
+			return nil, fmt.Errorf("inmap: invalid ACS data row for state %s: %v", state, row)
+		}
+		geoid := row[col["state"]] + row[col["county"]] + row[col["tract"]] + row[col["block group"]]
+		vals := make([]float64, len(vars))
+		for i, v := range vars {
+			s := row[col[v]]
+			if s == "" {
+				continue
+			}
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("inmap: parsing ACS variable %s for block group %s: %v", v, geoid, err)
+			}
+			if f > 0 {
+				vals[i] = f
+			}
+		}
+		data[geoid] = vals
+	}
+	return data, nil
+}
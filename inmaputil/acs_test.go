@@ -0,0 +1,161 @@
+/*
+Copyright © 2020 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+)
+
+func TestACS(t *testing.T) {
+	dir, err := os.MkdirTemp("", "acs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Create a zipped block group boundary shapefile.
+	type blockGroup struct {
+		geom.Polygon
+		GEOID string
+	}
+	bgFile := filepath.Join(dir, "tl_2019_06_bg.shp")
+	e, err := shp.NewEncoder(bgFile, blockGroup{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range []string{"060010001001", "060010001002", "060010002001"} {
+		x := float64(i)
+		err = e.Encode(blockGroup{
+			Polygon: geom.Polygon{{{X: x, Y: 0}, {X: x + 1, Y: 0}, {X: x + 1, Y: 1}, {X: x, Y: 1}, {X: x, Y: 0}}},
+			GEOID:   id,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.Close()
+	if err := os.WriteFile(filepath.Join(dir, "tl_2019_06_bg.prj"), []byte(`GEOGCS["GCS_North_American_1983",DATUM["D_North_American_1983",SPHEROID["GRS_1980",6378137,298.257222101]],PRIMEM["Greenwich",0],UNIT["Degree",0.017453292519943295]]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	serveDir := filepath.Join(dir, "serve")
+	if err := os.Mkdir(serveDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	zf, err := os.Create(filepath.Join(serveDir, "tl_2019_06_bg.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(zf)
+	for _, ext := range []string{".shp", ".shx", ".dbf", ".prj"} {
+		w, err := zw.Create("tl_2019_06_bg" + ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(filepath.Join(dir, "tl_2019_06_bg"+ext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(w, f); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	zw.Close()
+	zf.Close()
+
+	var apiRequests int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/data/2019/acs/acs5", func(w http.ResponseWriter, r *http.Request) {
+		apiRequests++
+		q := r.URL.Query()
+		if q.Get("get") != "B03002_004E,B01001_020E,B01001_021E,B03002_001E" || q.Get("for") != "block group:*" ||
+			!reflect.DeepEqual(q["in"], []string{"state:06", "county:*"}) || q.Get("key") != "testkey" {
+			http.Error(w, fmt.Sprintf("invalid query %v", q), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `[["B03002_001E","B03002_004E","B01001_020E","B01001_021E","state","county","tract","block group"],
+["1000","200","30","20","06","001","000100","1"],
+["500","-666666666","5",null,"06","001","000100","2"]]`)
+	})
+	mux.Handle("/bg/", http.StripPrefix("/bg/", http.FileServer(http.Dir(serveDir))))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	outFile := filepath.Join(dir, "census.shp")
+	cfg := InitializeConfig()
+	cfg.Set("ACS.States", []string{"06"})
+	cfg.Set("ACS.Variables", map[string]string{"TotalPop": "B03002_001E", "Black": "B03002_004E", "Pop65": "B01001_020E + B01001_021E"})
+	cfg.Set("ACS.APIURL", server.URL+"/data/[YEAR]/acs/acs5")
+	cfg.Set("ACS.BoundaryURL", server.URL+"/bg/tl_[YEAR]_[STATE]_bg.zip")
+	cfg.Set("ACS.APIKey", "testkey")
+	cfg.Set("ACS.CacheDir", filepath.Join(dir, "cache"))
+	cfg.Set("ACS.OutputFile", outFile)
+	for i := 0; i < 2; i++ {
+		cfg.Root.SetArgs([]string{"population", "acs"})
+		if err := cfg.Root.Execute(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if apiRequests != 1 {
+		t.Errorf("the API data should be cached but there were %d requests", apiRequests)
+	}
+
+	type censusRec struct {
+		geom.Polygon
+		TotalPop, Black, Pop65 float64
+	}
+	d, err := shp.NewDecoder(outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	var have []censusRec
+	for {
+		var r censusRec
+		if !d.DecodeRow(&r) {
+			break
+		}
+		r.Polygon = nil
+		have = append(have, r)
+	}
+	if err := d.Error(); err != nil {
+		t.Fatal(err)
+	}
+	want := []censusRec{
+		{TotalPop: 1000, Black: 200, Pop65: 50},
+		{TotalPop: 500, Black: 0, Pop65: 5},
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have %+v, want %+v", have, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "census.prj")); err != nil {
+		t.Error(err)
+	}
+}
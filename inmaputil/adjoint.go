@@ -0,0 +1,170 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ctessum/geom"
+	"github.com/spf13/cobra"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/science/chem/simplechem"
+)
+
+// RunAdjoint runs an adjoint simulation, which calculates the sensitivity
+// of an exposure metric to the emissions in every grid cell in a single
+// simulation. The metric is the population-weighted average of the sum
+// of the concentration variables ReceptorVariables (e.g., "PrimaryPM25",
+// "pNH4", "pSO4", "pNO3", and "SOA" for total PM2.5) at ground level
+// within Receptor, or within the whole domain if Receptor is nil, using
+// the population type VarGrid.PopGridColumn. The sensitivities to the
+// emissions of each of Pollutants (e.g., "PM2_5") in each grid cell,
+// in units of the metric per μg/s of emissions, are saved in the
+// shapefile OutputFile.
+//
+// The simulation uses a static grid. If createGrid is true, the grid
+// is created using the data in InMAPData; otherwise it is read from
+// VariableGridData. The chemistry must be linear in the concentrations,
+// so m.NitrateEquilibrium can not be used.
+//
+// The other arguments are the same as for Run.
+func RunAdjoint(CobraCommand *cobra.Command, LogFile string, OutputFile string, OutputAllLayers bool, VarGrid *inmap.VarGridConfig,
+	InMAPData, VariableGridData, CTMDataCacheDir, CellStorageDir string, NumIterations int, convergence inmap.ConvergenceCriterion, acceleration inmap.DomainManipulator,
+	Receptor geom.Polygon, ReceptorVariables, Pollutants []string, createGrid, deterministic bool, m simplechem.Mechanism) error {
+
+	startTime := time.Now()
+
+	if m.NitrateEquilibrium {
+		return fmt.Errorf("inmap: adjoint simulations can not be used with NitrateEquilibrium because it is not linear")
+	}
+	if len(ReceptorVariables) == 0 {
+		return fmt.Errorf("inmap: no adjoint receptor variables")
+	}
+	if len(Pollutants) == 0 {
+		return fmt.Errorf("inmap: no adjoint pollutants")
+	}
+
+	var upload uploader
+
+	l, err := newRunLogger(CobraCommand, upload.maybeUpload(LogFile), NumIterations)
+	if err != nil {
+		return err
+	}
+	defer l.close()
+
+	outputFile := upload.maybeUpload(OutputFile)
+	if upload.err != nil {
+		return upload.err
+	}
+
+	sr, err := spatialRef(VarGrid)
+	if err != nil {
+		return err
+	}
+
+	if convergence == nil {
+		convergence = inmap.MassAndPopulationChange{PopGridColumn: VarGrid.PopGridColumn, Tolerance: 0.001}
+	}
+	dryDep, err := m.DryDep("simple")
+	if err != nil {
+		return err
+	}
+	wetDep, err := m.WetDep("emep")
+	if err != nil {
+		return err
+	}
+
+	var initFuncs []inmap.DomainManipulator
+	if createGrid {
+		log.Println("Loading CTM data...")
+		ctm := newCTMDataLoader(CTMDataCacheDir)
+		defer ctm.close()
+		ctmData, err := ctm.load(InMAPData, VarGrid)
+		if err != nil {
+			return err
+		}
+		log.Println("Loading population and mortality rate data...")
+		pop, popIndices, mr, mortIndices, err := VarGrid.LoadPopMort()
+		if err != nil {
+			return err
+		}
+		mutator, err := VarGrid.RefinementMutator(popIndices, nil)
+		if err != nil {
+			return err
+		}
+		initFuncs = []inmap.DomainManipulator{
+			VarGrid.RegularGrid(ctmData, pop, popIndices, mr, mortIndices, nil, m),
+			VarGrid.MutateGrid(mutator, ctmData, pop, mr, nil, m, l.msgLog),
+		}
+	} else {
+		r, err := os.Open(VariableGridData)
+		if err != nil {
+			return fmt.Errorf("problem opening file to load VariableGridData: %v", err)
+		}
+		defer r.Close()
+		initFuncs = []inmap.DomainManipulator{inmap.Load(r, VarGrid, nil, m)}
+	}
+
+	transport := inmap.NewAdjointTransport(inmap.UpwindAdvection(), inmap.Mixing(), inmap.MeanderMixing())
+	initFuncs = append(initFuncs,
+		inmap.SetTimestepCFL(),
+		transport.Init(),
+		inmap.SetAdjointReceptor(Receptor, VarGrid.PopGridColumn, ReceptorVariables, m),
+	)
+	runFuncs := []inmap.DomainManipulator{
+		inmap.Log(l.cLog),
+		simulationMetrics(),
+		inmap.Calculations(inmap.AddEmissionsFlux(), inmap.AdjointChemistry(m.Chemistry())),
+		inmap.Calculations(transport.Calculate(), dryDep, wetDep),
+	}
+	if acceleration != nil {
+		runFuncs = append(runFuncs, acceleration)
+	}
+	runFuncs = append(runFuncs, inmap.ConvergenceCheck(NumIterations, convergence, m, l.cConverge))
+
+	d := &inmap.InMAP{
+		InitFuncs: initFuncs,
+		RunFuncs:  runFuncs,
+		CleanupFuncs: []inmap.DomainManipulator{
+			inmap.OutputEmissionsSensitivity(outputFile, OutputAllLayers, sr, m, Pollutants...),
+			upload.uploadOutput,
+		},
+		Deterministic:  deterministic,
+		CellStorageDir: CellStorageDir,
+	}
+
+	log.Println("Initializing model...")
+	if err = d.Init(); err != nil {
+		return fmt.Errorf("InMAP: problem initializing model: %v\n", err)
+	}
+	if err = d.Run(); err != nil {
+		return fmt.Errorf("InMAP: problem running simulation: %v\n", err)
+	}
+	if err = d.Cleanup(); err != nil {
+		return fmt.Errorf("InMAP: problem shutting down model: %v\n", err)
+	}
+
+	elapsedTime := time.Since(startTime)
+	log.Printf("Elapsed time: %f hours", elapsedTime.Hours())
+
+	return nil
+}
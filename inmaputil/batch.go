@@ -0,0 +1,372 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cast"
+	"github.com/yuzhou-wang/inmap/cloud/cloudrpc"
+)
+
+// BatchScenario is a variation of the model configuration that is run
+// as part of a batch.
+type BatchScenario struct {
+	// Name is the name of the scenario, which is also the name
+	// of the subdirectory that it is run in.
+	Name string
+
+	// Config is the path to the configuration file of the scenario.
+	Config string
+
+	// Flags are configuration options that are passed as command-line
+	// flags, which override the options in Config.
+	Flags map[string]string
+}
+
+// BatchResult holds information about the run of a BatchScenario.
+type BatchResult struct {
+	BatchScenario
+
+	// Status is one of "Complete" or "Failed".
+	Status string
+
+	// Message holds the error message if the run failed.
+	Message string
+
+	StartTime, CompletionTime time.Time
+
+	// Outputs are the names of the files created in the
+	// working directory of the scenario.
+	Outputs []string
+}
+
+// BatchSweep is a parameter sweep specification, which is read from
+// a TOML file in the format:
+//
+//	Config = "base_config.toml"
+//	[Parameters]
+//	"EmissionsShapefiles" = ["a.shp", "b.shp"]
+//	"VarGrid.PopDensityThreshold" = [0.0055, 0.011]
+//
+// A scenario is created for each combination of the parameter values.
+type BatchSweep struct {
+	// Config is the path to the base configuration file. Relative paths
+	// are relative to the directory of the sweep file.
+	Config string
+
+	// Parameters holds the values of each configuration option
+	// that are to be swept over. Values that are lists are passed
+	// as comma-separated lists.
+	Parameters map[string][]interface{}
+}
+
+// ReadBatchDir returns a scenario for each configuration file in dir,
+// which is named after the file.
+func ReadBatchDir(dir string) ([]BatchScenario, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading batch directory: %v", err)
+	}
+	var scenarios []BatchScenario
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		switch strings.ToLower(ext) {
+		case ".toml", ".json", ".yaml", ".yml":
+		default:
+			continue
+		}
+		if e.IsDir() {
+			continue
+		}
+		path, err := filepath.Abs(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		scenarios = append(scenarios, BatchScenario{
+			Name:   strings.TrimSuffix(e.Name(), ext),
+			Config: path,
+		})
+	}
+	if len(scenarios) == 0 {
+		return nil, fmt.Errorf("inmap: no configuration files in batch directory %s", dir)
+	}
+	return scenarios, nil
+}
+
+// ReadBatchSweep returns a scenario for each combination of parameter
+// values in the sweep specification file (see BatchSweep). The scenarios
+// are named "scenario_" followed by their index.
+func ReadBatchSweep(file string) ([]BatchScenario, error) {
+	var s BatchSweep
+	if _, err := toml.DecodeFile(file, &s); err != nil {
+		return nil, fmt.Errorf("inmap: reading batch sweep file: %v", err)
+	}
+	var config string
+	if s.Config != "" {
+		config = os.ExpandEnv(s.Config)
+		if !filepath.IsAbs(config) {
+			config = filepath.Join(filepath.Dir(file), config)
+		}
+		var err error
+		if config, err = filepath.Abs(config); err != nil {
+			return nil, err
+		}
+	}
+
+	names := make([]string, 0, len(s.Parameters))
+	for name, vals := range s.Parameters {
+		if len(vals) == 0 {
+			return nil, fmt.Errorf("inmap: batch sweep parameter %s has no values", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	combinations := []map[string]string{{}}
+	for _, name := range names {
+		var next []map[string]string
+		for _, c := range combinations {
+			for _, v := range s.Parameters[name] {
+				val, err := sweepValue(v)
+				if err != nil {
+					return nil, fmt.Errorf("inmap: batch sweep parameter %s: %v", name, err)
+				}
+				flags := make(map[string]string, len(c)+1)
+				for k, vv := range c {
+					flags[k] = vv
+				}
+				flags[name] = val
+				next = append(next, flags)
+			}
+		}
+		combinations = next
+	}
+
+	scenarios := make([]BatchScenario, len(combinations))
+	digits := len(fmt.Sprint(len(combinations)))
+	for i, flags := range combinations {
+		scenarios[i] = BatchScenario{
+			Name:   fmt.Sprintf("scenario_%0*d", digits, i+1),
+			Config: config,
+			Flags:  flags,
+		}
+	}
+	return scenarios, nil
+}
+
+// sweepValue converts a parameter value in a sweep specification
+// to a command-line flag value.
+func sweepValue(v interface{}) (string, error) {
+	if l, ok := v.([]interface{}); ok {
+		s := make([]string, len(l))
+		for i, vv := range l {
+			var err error
+			if s[i], err = cast.ToStringE(vv); err != nil {
+				return "", err
+			}
+		}
+		return strings.Join(s, ","), nil
+	}
+	return cast.ToStringE(v)
+}
+
+// RunBatch runs the given command (e.g., ["run", "steady"]) for each
+// of the scenarios using up to procs simultaneous processes, each in
+// its own subdirectory of dir. If procs is zero, the number of processors
+// is used. The runs use the InMAP executable executable, which can include
+// initial arguments; if it is empty, the executable of the current process
+// is used. Progress is reported to the log, and an index of the scenarios,
+// their configuration options, status, and output files is written to
+// index.csv in dir. An error is returned if any of the scenarios fail.
+func RunBatch(ctx context.Context, dir string, executable, command []string, scenarios []BatchScenario, procs int) ([]BatchResult, error) {
+	if len(executable) == 0 {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("inmap: finding executable for batch: %v", err)
+		}
+		executable = []string{exe}
+	}
+	if procs <= 0 {
+		procs = runtime.GOMAXPROCS(-1)
+	}
+	names := make(map[string]bool)
+	for _, s := range scenarios {
+		if names[s.Name] {
+			return nil, fmt.Errorf("inmap: batch scenario name %s is used more than once", s.Name)
+		}
+		names[s.Name] = true
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("inmap: creating batch directory: %v", err)
+	}
+
+	results := make([]BatchResult, len(scenarios))
+	idx := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var finished, failed int
+	queued, running := metricBatchScenarios.WithLabelValues("queued"), metricBatchScenarios.WithLabelValues("running")
+	queued.Add(float64(len(scenarios)))
+	for p := 0; p < procs; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				log.Printf("batch: starting scenario %s", scenarios[i].Name)
+				queued.Dec()
+				running.Inc()
+				results[i] = runBatchScenario(ctx, filepath.Join(dir, scenarios[i].Name), executable, command, scenarios[i])
+				running.Dec()
+				mu.Lock()
+				finished++
+				if results[i].Status == cloudrpc.Status_Failed.String() {
+					failed++
+					logProgress("batch", fmt.Sprintf("batch [%d/%d]: scenario %s failed: %s", finished, len(scenarios), scenarios[i].Name, results[i].Message),
+						finished, len(scenarios), "scenario", scenarios[i].Name, "status", results[i].Status)
+				} else {
+					logProgress("batch", fmt.Sprintf("batch [%d/%d]: scenario %s complete in %v", finished, len(scenarios), scenarios[i].Name,
+						results[i].CompletionTime.Sub(results[i].StartTime).Round(time.Second)),
+						finished, len(scenarios), "scenario", scenarios[i].Name, "status", results[i].Status)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range scenarios {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+
+	if err := writeBatchIndex(filepath.Join(dir, "index.csv"), results); err != nil {
+		return results, err
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("inmap: %d of %d batch scenarios failed; see the server.log file in the directory of each scenario", failed, len(scenarios))
+	}
+	return results, nil
+}
+
+// runBatchScenario runs the command for scenario s in dir.
+func runBatchScenario(ctx context.Context, dir string, executable, command []string, s BatchScenario) BatchResult {
+	r := BatchResult{BatchScenario: s, StartTime: time.Now()}
+	fail := func(err error) BatchResult {
+		r.Status = cloudrpc.Status_Failed.String()
+		r.Message = err.Error()
+		r.CompletionTime = time.Now()
+		return r
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fail(err)
+	}
+	args := append(append([]string{}, executable[1:]...), command...)
+	if s.Config != "" {
+		args = append(args, "--config="+s.Config)
+	}
+	flags := make([]string, 0, len(s.Flags))
+	for name, val := range s.Flags {
+		flags = append(flags, fmt.Sprintf("--%s=%s", name, val))
+	}
+	sort.Strings(flags)
+	args = append(args, flags...)
+
+	logFile, err := os.Create(filepath.Join(dir, logFileName))
+	if err != nil {
+		return fail(err)
+	}
+	defer logFile.Close()
+	cmd := exec.CommandContext(ctx, executable[0], args...)
+	cmd.Dir = dir
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Run(); err != nil {
+		return fail(err)
+	}
+	r.CompletionTime = time.Now()
+	r.Status = cloudrpc.Status_Complete.String()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fail(err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() && e.Name() != logFileName {
+			r.Outputs = append(r.Outputs, e.Name())
+		}
+	}
+	return r
+}
+
+// writeBatchIndex writes a CSV file with a row for each of the results.
+func writeBatchIndex(file string, results []BatchResult) error {
+	paramMap := make(map[string]bool)
+	for _, r := range results {
+		for name := range r.Flags {
+			paramMap[name] = true
+		}
+	}
+	params := make([]string, 0, len(paramMap))
+	for name := range paramMap {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+
+	f, err := os.Create(file)
+	if err != nil {
+		return fmt.Errorf("inmap: writing batch index: %v", err)
+	}
+	w := csv.NewWriter(f)
+	header := append([]string{"Scenario", "Status", "Message", "StartTime", "CompletionTime", "Config"}, params...)
+	header = append(header, "Outputs")
+	if err := w.Write(header); err != nil {
+		f.Close()
+		return err
+	}
+	for _, r := range results {
+		row := []string{r.Name, r.Status, r.Message,
+			r.StartTime.Format(time.RFC3339), r.CompletionTime.Format(time.RFC3339), r.Config}
+		for _, p := range params {
+			row = append(row, r.Flags[p])
+		}
+		row = append(row, strings.Join(r.Outputs, ";"))
+		if err := w.Write(row); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
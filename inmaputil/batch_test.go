@@ -0,0 +1,113 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadBatchSweep(t *testing.T) {
+	dir := t.TempDir()
+	sweep := filepath.Join(dir, "sweep.toml")
+	err := os.WriteFile(sweep, []byte(`Config = "base.toml"
+[Parameters]
+"VarGrid.PopDensityThreshold" = [0.01, 0.02]
+"layers" = [[0, 2], [4]]
+"static" = [true]
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scenarios, err := ReadBatchSweep(sweep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BatchScenario{
+		{Name: "scenario_1", Flags: map[string]string{"VarGrid.PopDensityThreshold": "0.01", "layers": "0,2", "static": "true"}},
+		{Name: "scenario_2", Flags: map[string]string{"VarGrid.PopDensityThreshold": "0.01", "layers": "4", "static": "true"}},
+		{Name: "scenario_3", Flags: map[string]string{"VarGrid.PopDensityThreshold": "0.02", "layers": "0,2", "static": "true"}},
+		{Name: "scenario_4", Flags: map[string]string{"VarGrid.PopDensityThreshold": "0.02", "layers": "4", "static": "true"}},
+	}
+	for i := range want {
+		want[i].Config = filepath.Join(dir, "base.toml")
+	}
+	if !reflect.DeepEqual(scenarios, want) {
+		t.Errorf("have %+v, want %+v", scenarios, want)
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	const script = `echo "$@" > out.txt
+if [ "$2" = "--config=fail" ]; then exit 3; fi`
+	dir := t.TempDir()
+	scenarios := []BatchScenario{
+		{Name: "a", Config: "a.toml", Flags: map[string]string{"x": "1"}},
+		{Name: "b", Config: "b.toml", Flags: map[string]string{"x": "2"}},
+		{Name: "c", Config: "fail"},
+	}
+	results, err := RunBatch(context.Background(), dir, []string{"sh", "-c", script, "inmap"}, []string{"run"}, scenarios, 2)
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 batch scenarios failed") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, s := range []string{"Complete", "Complete", "Failed"} {
+		if results[i].Status != s {
+			t.Errorf("scenario %s: have status %s, want %s", results[i].Name, results[i].Status, s)
+		}
+	}
+	args, err := os.ReadFile(filepath.Join(dir, "b", "out.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := strings.TrimSpace(string(args)), "run --config=b.toml --x=2"; have != want {
+		t.Errorf("arguments: have %q, want %q", have, want)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "index.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	index, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := index[0], []string{"Scenario", "Status", "Message", "StartTime", "CompletionTime", "Config", "x", "Outputs"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("index header: have %v, want %v", have, want)
+	}
+	if len(index) != 4 {
+		t.Fatalf("index should have 4 rows, has %d", len(index))
+	}
+	if have, want := []string{index[1][0], index[1][1], index[1][6], index[1][7]}, []string{"a", "Complete", "1", "out.txt"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("index row: have %v, want %v", have, want)
+	}
+}
+
+func TestRunBatch_duplicateName(t *testing.T) {
+	scenarios := []BatchScenario{{Name: "a"}, {Name: "a"}}
+	_, err := RunBatch(context.Background(), t.TempDir(), []string{"true"}, nil, scenarios, 1)
+	if err == nil {
+		t.Error("expected an error for duplicate scenario names")
+	}
+}
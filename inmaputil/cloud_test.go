@@ -77,7 +77,7 @@ func TestCloud(t *testing.T) {
 		}
 		wantFiles := map[string]int64{
 			"OutputFile.dbf": 465,
-			"OutputFile.prj": 431,
+			"OutputFile.prj": 418,
 			"OutputFile.shp": 2276,
 			"OutputFile.shx": 228,
 			"LogFile":        94169,
@@ -0,0 +1,50 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"github.com/yuzhou-wang/inmap"
+)
+
+// columnOutput returns a function that writes the vertical integrals
+// of outputVariables over each column of grid cells to outputFile
+// at the end of a simulation (see inmap.Outputter.OutputColumns).
+func columnOutput(outputFile string, outputVariables map[string]string, VarGrid *inmap.VarGridConfig, m inmap.Mechanism) (inmap.DomainManipulator, error) {
+	sr, err := spatialRef(VarGrid)
+	if err != nil {
+		return nil, err
+	}
+	o, err := inmap.NewOutputter("", true, outputVariables, nil, m)
+	if err != nil {
+		return nil, err
+	}
+	// The output is uploaded if outputFile is in blob storage.
+	var upload uploader
+	outputFile = upload.maybeUpload(outputFile)
+	if upload.err != nil {
+		return nil, upload.err
+	}
+	write := o.OutputColumns(sr, outputFile)
+	return func(d *inmap.InMAP) error {
+		if err := write(d); err != nil {
+			return err
+		}
+		return upload.uploadOutput(d)
+	}, nil
+}
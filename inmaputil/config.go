@@ -27,17 +27,20 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/ctessum/geom"
 	"github.com/ctessum/geom/encoding/geojson"
 	"github.com/ctessum/geom/proj"
 	"github.com/lnashier/viper"
+	"github.com/spf13/cast"
 	"github.com/yuzhou-wang/inmap"
 	"github.com/yuzhou-wang/inmap/cloud"
 	"github.com/yuzhou-wang/inmap/emissions/aep"
 	"github.com/yuzhou-wang/inmap/emissions/aep/aeputil"
-	"github.com/spf13/cast"
 )
 
 // checkOutputVars removes end lines and expands environment
@@ -55,6 +58,261 @@ func checkOutputVars(vars map[string]string) (map[string]string, error) {
 	return vars, nil
 }
 
+// outputVariables returns the OutputVariables in cfg, after checking them
+// using checkOutputVars, adding the impacts in each of the
+// VarGrid.AgeGroups and VarGrid.MorbidityEndpoints (see
+// inmap.AgeGroupOutputVariables and inmap.MorbidityOutputVariables) and
+// the monetary damages in Valuation.Damages and the Disparity metrics (see
+// inmap.DamageOutputVariables and inmap.DisparityOutputVariables), and expanding calls to the
+// concentration-response functions defined in HealthFunctions
+// (see expandHealthFunctions).
+func outputVariables(cfg *viper.Viper) (map[string]string, error) {
+	vars, err := checkOutputVars(GetStringMapString("OutputVariables", cfg))
+	if err != nil {
+		return nil, err
+	}
+	groups, err := ageGroups(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ageVars, err := inmap.AgeGroupOutputVariables(groups, cfg.GetString("AgeGroupHazardRatio"))
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := morbidityEndpoints(cfg)
+	if err != nil {
+		return nil, err
+	}
+	morbidityVars, err := inmap.MorbidityOutputVariables(endpoints)
+	if err != nil {
+		return nil, err
+	}
+	for _, generated := range []map[string]string{ageVars, morbidityVars} {
+		for k, v := range generated {
+			if _, ok := vars[k]; !ok {
+				vars[k] = v
+			}
+		}
+	}
+	damages := GetStringMapString("Valuation.Damages", cfg)
+	for name, deaths := range damages {
+		if _, ok := vars[deaths]; !ok {
+			return nil, fmt.Errorf("inmaputil: Valuation.Damages %s: %s is not an output variable", name, deaths)
+		}
+	}
+	v, err := valuation(cfg)
+	if err != nil {
+		return nil, err
+	}
+	damageVars, err := inmap.DamageOutputVariables(v, damages)
+	if err != nil {
+		return nil, err
+	}
+	disparityVars, err := inmap.DisparityOutputVariables(&inmap.Disparity{
+		Variable:  os.ExpandEnv(cfg.GetString("Disparity.Variable")),
+		Reference: os.ExpandEnv(cfg.GetString("Disparity.Reference")),
+		Groups:    GetStringMapString("Disparity.Groups", cfg),
+		Epsilon:   cfg.GetFloat64("Disparity.Epsilon"),
+		Rank:      os.ExpandEnv(cfg.GetString("Disparity.Rank")),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, generated := range []map[string]string{damageVars, disparityVars} {
+		for k, v := range generated {
+			if _, ok := vars[k]; !ok {
+				vars[k] = v
+			}
+		}
+	}
+	funcs, err := getStringMapStringMap("HealthFunctions", cfg)
+	if err != nil {
+		return nil, err
+	}
+	return expandHealthFunctions(vars, funcs)
+}
+
+// healthFunctionParams lists the parameters of each type of
+// concentration-response function that can be defined in the
+// HealthFunctions configuration variable, in the order that the output
+// function of the same name takes them (see inmap.NewOutputter).
+var healthFunctionParams = map[string][]string{
+	"loglinear": {"Beta", "Threshold"},
+	"gemm":      {"Theta", "Alpha", "Mu", "Nu", "CF"},
+	"ier":       {"Alpha", "Gamma", "Delta", "ZCF"},
+}
+
+// getStringMapStringMap returns a map of tables, such as
+// HealthFunctions, from a viper configuration, accounting for the fact
+// that it might be a json object if it was set from a command line argument.
+func getStringMapStringMap(varName string, cfg *viper.Viper) (map[string]map[string]interface{}, error) {
+	o := make(map[string]map[string]interface{})
+	switch v := cfg.Get(varName).(type) {
+	case nil:
+	case string:
+		if strings.TrimSpace(v) == "" {
+			break
+		}
+		if err := json.Unmarshal([]byte(v), &o); err != nil {
+			return nil, fmt.Errorf("inmaputil: parsing %s: %v", varName, err)
+		}
+	case map[string]string:
+		if len(v) != 0 {
+			return nil, fmt.Errorf("inmaputil: invalid %s: %v", varName, v)
+		}
+	case map[string]interface{}:
+		for name, params := range v {
+			p, err := cast.ToStringMapE(params)
+			if err != nil {
+				return nil, fmt.Errorf("inmaputil: invalid %s entry %s: %v", varName, name, err)
+			}
+			o[name] = p
+		}
+	default:
+		return nil, fmt.Errorf("inmaputil: invalid type for %s: %T", varName, v)
+	}
+	return o, nil
+}
+
+// valuation returns the valuation of health impacts specified by the
+// Valuation configuration variables.
+func valuation(cfg *viper.Viper) (*inmap.Valuation, error) {
+	lag, err := toFloat64SliceE(cfg.Get("Valuation.CessationLag"))
+	if err != nil {
+		return nil, fmt.Errorf("Valuation.CessationLag: %v", err)
+	}
+	return &inmap.Valuation{
+		VSL:              cfg.GetFloat64("Valuation.VSL"),
+		IncomeColumn:     os.ExpandEnv(cfg.GetString("VarGrid.IncomeColumn")),
+		BaseIncome:       cfg.GetFloat64("Valuation.BaseIncome"),
+		IncomeElasticity: cfg.GetFloat64("Valuation.IncomeElasticity"),
+		CessationLag:     lag,
+		DiscountRate:     cfg.GetFloat64("Valuation.DiscountRate"),
+	}, nil
+}
+
+// morbidityEndpoints returns the morbidity endpoints specified by the
+// VarGrid.MorbidityEndpoints configuration variable, sorted by name.
+// Endpoints with the same name as one of the predefined endpoints
+// (see inmap.MorbidityEndpoints) start from its fields, so only the
+// fields that are different need to be specified.
+func morbidityEndpoints(cfg *viper.Viper) ([]inmap.MorbidityEndpoint, error) {
+	endpoints, err := getStringMapStringMap("VarGrid.MorbidityEndpoints", cfg)
+	if err != nil {
+		return nil, err
+	}
+	predefined := make(map[string]inmap.MorbidityEndpoint)
+	for _, e := range inmap.MorbidityEndpoints() {
+		predefined[strings.ToLower(e.Name)] = e
+	}
+	o := make([]inmap.MorbidityEndpoint, 0, len(endpoints))
+	for name, fields := range endpoints {
+		e := predefined[strings.ToLower(name)]
+		e.Name = name
+		for k, v := range fields {
+			switch strings.ToLower(k) {
+			case "hazardratio":
+				e.HazardRatio = os.ExpandEnv(cast.ToString(v))
+			case "popcolumn":
+				e.PopColumn = os.ExpandEnv(cast.ToString(v))
+			case "incidencecolumn":
+				e.IncidenceColumn = os.ExpandEnv(cast.ToString(v))
+			default:
+				return nil, fmt.Errorf("inmaputil: VarGrid.MorbidityEndpoints %s: invalid field %s", name, k)
+			}
+		}
+		if e.HazardRatio == "" || e.PopColumn == "" || e.IncidenceColumn == "" {
+			return nil, fmt.Errorf("inmaputil: VarGrid.MorbidityEndpoints %s needs HazardRatio, PopColumn, and IncidenceColumn", name)
+		}
+		o = append(o, e)
+	}
+	sort.Slice(o, func(i, j int) bool { return o[i].Name < o[j].Name })
+	return o, nil
+}
+
+// ageGroups returns the age groups specified by the VarGrid.AgeGroups
+// configuration variable, sorted by name.
+func ageGroups(cfg *viper.Viper) ([]inmap.AgeGroup, error) {
+	groups, err := getStringMapStringMap("VarGrid.AgeGroups", cfg)
+	if err != nil {
+		return nil, err
+	}
+	o := make([]inmap.AgeGroup, 0, len(groups))
+	for name, fields := range groups {
+		g := inmap.AgeGroup{Name: name}
+		for k, v := range fields {
+			var err error
+			switch strings.ToLower(k) {
+			case "popcolumn":
+				g.PopColumn = os.ExpandEnv(cast.ToString(v))
+			case "mortalitycolumn":
+				g.MortalityColumn = os.ExpandEnv(cast.ToString(v))
+			case "lifeexpectancy":
+				g.LifeExpectancy, err = cast.ToFloat64E(v)
+			default:
+				err = fmt.Errorf("invalid field %s", k)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("inmaputil: VarGrid.AgeGroups %s: %v", name, err)
+			}
+		}
+		if g.PopColumn == "" || g.MortalityColumn == "" {
+			return nil, fmt.Errorf("inmaputil: VarGrid.AgeGroups %s needs PopColumn and MortalityColumn", name)
+		}
+		o = append(o, g)
+	}
+	sort.Slice(o, func(i, j int) bool { return o[i].Name < o[j].Name })
+	return o, nil
+}
+
+// expandHealthFunctions replaces the calls in the output variable
+// expressions vars to the named concentration-response functions defined
+// in funcs, such as 'MyGEMM(TotalPM25)', with calls to the output function
+// of the corresponding type with the parameters of the named function,
+// such as 'gemm(0.143, 1.6, 15.5, 36.8, 2.4, TotalPM25)'. Each function
+// in funcs has a "Type" key, which is one of the keys of
+// healthFunctionParams, and a key for each of the parameters of that type.
+func expandHealthFunctions(vars map[string]string, funcs map[string]map[string]interface{}) (map[string]string, error) {
+	for name, params := range funcs {
+		var typ string
+		values := make(map[string]float64)
+		for k, v := range params {
+			if strings.EqualFold(k, "Type") {
+				typ = strings.ToLower(cast.ToString(v))
+				continue
+			}
+			f, err := cast.ToFloat64E(v)
+			if err != nil {
+				return nil, fmt.Errorf("inmaputil: HealthFunctions %s parameter %s: %v", name, k, err)
+			}
+			values[strings.ToLower(k)] = f
+		}
+		paramNames, ok := healthFunctionParams[typ]
+		if !ok {
+			return nil, fmt.Errorf("inmaputil: HealthFunctions %s has invalid type '%s'; valid types are loglinear, gemm, and ier", name, typ)
+		}
+		if len(values) != len(paramNames) {
+			return nil, fmt.Errorf("inmaputil: HealthFunctions %s of type %s should have parameters %v", name, typ, paramNames)
+		}
+		call := typ + "("
+		for _, p := range paramNames {
+			v, ok := values[strings.ToLower(p)]
+			if !ok {
+				return nil, fmt.Errorf("inmaputil: HealthFunctions %s of type %s is missing parameter %s", name, typ, p)
+			}
+			call += strconv.FormatFloat(v, 'f', -1, 64) + ", "
+		}
+		re, err := regexp.Compile(`\b` + regexp.QuoteMeta(name) + `\s*\(`)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range vars {
+			vars[k] = re.ReplaceAllLiteralString(v, call)
+		}
+	}
+	return vars, nil
+}
+
 // expandStringSlice expands the environment variables in a slice of strings.
 func expandStringSlice(s []string) []string {
 	for i := 0; i < len(s); i++ {
@@ -82,6 +340,9 @@ func checkOutputFile(f string) (string, error) {
 		return "", fmt.Errorf(`you need to specify an output file configuration variable (for example: OutputFile="output.shp"`)
 	}
 	f = os.ExpandEnv(f)
+	if inmap.IsPostGISURL(f) {
+		return f, nil
+	}
 	if IsBlob(f) {
 		url, err := url.Parse(f)
 		if err != nil {
@@ -103,7 +364,9 @@ func checkOutputFile(f string) (string, error) {
 // checkLogFile fills in a default value for the log file path if one isn't
 // specified.
 func checkLogFile(logFile, outputFile string) string {
-	if logFile == "" {
+	if logFile == "" && inmap.IsPostGISURL(outputFile) {
+		logFile = "inmap.log"
+	} else if logFile == "" {
 		logFile = strings.TrimSuffix(outputFile, filepath.Ext(outputFile)) + ".log"
 	}
 	return logFile
@@ -146,6 +409,10 @@ func VarGridConfig(cfg *viper.Viper) (*inmap.VarGridConfig, error) {
 	if err != nil {
 		return nil, fmt.Errorf("VarGrid.Ynests: %v", err)
 	}
+	layerHeights, err := toFloat64SliceE(cfg.Get("VarGrid.LayerHeights"))
+	if err != nil {
+		return nil, fmt.Errorf("VarGrid.LayerHeights: %v", err)
+	}
 	ctx := context.TODO()
 	c := inmap.VarGridConfig{
 		VariableGridXo:       cfg.GetFloat64("VarGrid.VariableGridXo"),
@@ -155,15 +422,27 @@ func VarGridConfig(cfg *viper.Viper) (*inmap.VarGridConfig, error) {
 		Xnests:               xNests,
 		Ynests:               yNests,
 		HiResLayers:          cfg.GetInt("VarGrid.HiResLayers"),
+		LayerHeights:         layerHeights,
 		PopDensityThreshold:  cfg.GetFloat64("VarGrid.PopDensityThreshold"),
 		PopThreshold:         cfg.GetFloat64("VarGrid.PopThreshold"),
 		PopConcThreshold:     cfg.GetFloat64("VarGrid.PopConcThreshold"),
-		CensusFile:           maybeDownload(ctx, os.ExpandEnv(cfg.GetString("VarGrid.CensusFile")), outChan()),
+		CensusFile:           maybeDownload(ctx, os.ExpandEnv(cfg.GetString("VarGrid.CensusFile")), outChan("config")),
 		CensusPopColumns:     expandStringSlice(cfg.GetStringSlice("VarGrid.CensusPopColumns")),
 		PopGridColumn:        os.ExpandEnv(cfg.GetString("VarGrid.PopGridColumn")),
-		MortalityRateFile:    maybeDownload(ctx, os.ExpandEnv(cfg.GetString("VarGrid.MortalityRateFile")), outChan()),
+		MortalityRateFile:    maybeDownload(ctx, os.ExpandEnv(cfg.GetString("VarGrid.MortalityRateFile")), outChan("config")),
 		MortalityRateColumns: GetStringMapString("VarGrid.MortalityRateColumns", cfg),
 		GridProj:             os.ExpandEnv(cfg.GetString("VarGrid.GridProj")),
+		RefinementCriteria:   cfg.GetStringSlice("VarGrid.RefinementCriteria"),
+		EmisDensityThreshold: cfg.GetFloat64("VarGrid.EmisDensityThreshold"),
+		LandUseFile:          maybeDownload(ctx, os.ExpandEnv(cfg.GetString("VarGrid.LandUseFile")), outChan("config")),
+		LandUseColumn:        cfg.GetString("VarGrid.LandUseColumn"),
+		LandUseCategories:    cfg.GetStringSlice("VarGrid.LandUseCategories"),
+		ImportanceFile:       maybeDownload(ctx, os.ExpandEnv(cfg.GetString("VarGrid.ImportanceFile")), outChan("config")),
+		ImportanceColumn:     cfg.GetString("VarGrid.ImportanceColumn"),
+		ImportanceThreshold:  cfg.GetFloat64("VarGrid.ImportanceThreshold"),
+		GradientFile:         maybeDownload(ctx, os.ExpandEnv(cfg.GetString("VarGrid.GradientFile")), outChan("config")),
+		GradientColumn:       cfg.GetString("VarGrid.GradientColumn"),
+		GradientThreshold:    cfg.GetFloat64("VarGrid.GradientThreshold"),
 	}
 
 	vars := []float64{c.VariableGridDx, c.VariableGridDy}
@@ -189,12 +468,48 @@ func VarGridConfig(cfg *viper.Viper) (*inmap.VarGridConfig, error) {
 		c.MortalityRateColumns[os.ExpandEnv(k)] = os.ExpandEnv(v)
 	}
 
+	if c.AgeGroups, err = ageGroups(cfg); err != nil {
+		return nil, err
+	}
+	if c.MorbidityEndpoints, err = morbidityEndpoints(cfg); err != nil {
+		return nil, err
+	}
+	c.IncomeColumn = os.ExpandEnv(cfg.GetString("VarGrid.IncomeColumn"))
+
+	rasters := GetStringMapString("VarGrid.PopulationRasters", cfg)
+	if len(rasters) > 0 {
+		c.PopulationRasters = make(map[string]string)
+		for k, v := range rasters {
+			c.PopulationRasters[os.ExpandEnv(k)] = maybeDownload(ctx, os.ExpandEnv(v), outChan("config"))
+		}
+	}
+	if f := os.ExpandEnv(cfg.GetString("VarGrid.CountryMortalityFile")); f != "" {
+		countryFile := os.ExpandEnv(cfg.GetString("VarGrid.CountryFile"))
+		c.CountryIDColumn = os.ExpandEnv(cfg.GetString("VarGrid.CountryIDColumn"))
+		if countryFile == "" || c.CountryIDColumn == "" {
+			return nil, fmt.Errorf("parsing grid configuration: VarGrid.CountryFile and VarGrid.CountryIDColumn are required when VarGrid.CountryMortalityFile is specified")
+		}
+		c.CountryMortalityFile = maybeDownload(ctx, f, outChan("config"))
+		c.CountryFile = maybeDownload(ctx, countryFile, outChan("config"))
+	}
+
+	if f := os.ExpandEnv(cfg.GetString("VarGrid.ProjectionFile")); f != "" {
+		regionFile := os.ExpandEnv(cfg.GetString("VarGrid.ProjectionRegionFile"))
+		c.ProjectionIDColumn = os.ExpandEnv(cfg.GetString("VarGrid.ProjectionIDColumn"))
+		c.ProjectionYear = cfg.GetInt("VarGrid.ProjectionYear")
+		if regionFile == "" || c.ProjectionIDColumn == "" || c.ProjectionYear == 0 {
+			return nil, fmt.Errorf("parsing grid configuration: VarGrid.ProjectionRegionFile, VarGrid.ProjectionIDColumn, and VarGrid.ProjectionYear are required when VarGrid.ProjectionFile is specified")
+		}
+		c.ProjectionFile = maybeDownload(ctx, f, outChan("config"))
+		c.ProjectionRegionFile = maybeDownload(ctx, regionFile, outChan("config"))
+	}
+
 	return &c, nil
 }
 
 // aeputilConfig unmarshals an aeputil inventory and spatial configuration.
 func aeputilConfig(cfg *viper.Viper) (*aeputil.InventoryConfig, *aeputil.SpatialConfig, error) {
-	outChan := outChan()
+	outChan := outChan("config")
 
 	neiFiles, err := getStringMapStringSlice("aep.InventoryConfig.NEIFiles", cfg)
 	if err != nil {
@@ -216,6 +531,27 @@ func aeputilConfig(cfg *viper.Viper) (*aeputil.InventoryConfig, *aeputil.Spatial
 		}
 	}
 
+	deltaFiles, err := getStringMapStringSlice("aep.InventoryConfig.DeltaFiles", cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("inmaputil: parsing config variable aep.InventoryConfig.DeltaFiles: %v", err)
+	}
+	for k, vs := range deltaFiles {
+		for i, v := range vs {
+			deltaFiles[k][i] = maybeDownload(context.TODO(), os.ExpandEnv(v), outChan)
+		}
+	}
+	var scenarioRules string
+	if r := cfg.GetString("aep.InventoryConfig.ScenarioRules"); r != "" {
+		scenarioRules = maybeDownload(context.TODO(), os.ExpandEnv(r), outChan)
+	}
+	var speciationRef, speciationProfiles string
+	if r := cfg.GetString("aep.InventoryConfig.SpeciationRef"); r != "" {
+		speciationRef = maybeDownload(context.TODO(), os.ExpandEnv(r), outChan)
+	}
+	if r := cfg.GetString("aep.InventoryConfig.SpeciationProfiles"); r != "" {
+		speciationProfiles = maybeDownload(context.TODO(), os.ExpandEnv(r), outChan)
+	}
+
 	srgSpecSMOKE := maybeDownload(context.TODO(), os.ExpandEnv(cfg.GetString("aep.SrgSpecSMOKE")), outChan)
 	srgSpecOSM := maybeDownload(context.TODO(), os.ExpandEnv(cfg.GetString("aep.SrgSpecOSM")), outChan)
 	var gridRef []string
@@ -227,6 +563,10 @@ func aeputilConfig(cfg *viper.Viper) (*aeputil.InventoryConfig, *aeputil.Spatial
 		NEIFiles:              neiFiles,
 		COARDSFiles:           coardsFiles,
 		COARDSYear:            cfg.GetInt("aep.InventoryConfig.COARDSYear"),
+		ScenarioRules:         scenarioRules,
+		DeltaFiles:            deltaFiles,
+		SpeciationRef:         speciationRef,
+		SpeciationProfiles:    speciationProfiles,
 		InputUnits:            cfg.GetString("aep.InventoryConfig.InputUnits"),
 		SrgSpecSMOKE:          srgSpecSMOKE,
 		SrgSpecOSM:            srgSpecOSM,
@@ -241,6 +581,9 @@ func aeputilConfig(cfg *viper.Viper) (*aeputil.InventoryConfig, *aeputil.Spatial
 		"NH3":   {},
 		"SOx":   {},
 		"PM2_5": {},
+		"EC":    {},
+		"OC":    {},
+		"PM10":  {},
 	}
 
 	s := &aeputil.SpatialConfig{
@@ -261,6 +604,92 @@ func aeputilConfig(cfg *viper.Viper) (*aeputil.InventoryConfig, *aeputil.Spatial
 	return i, s, nil
 }
 
+// convergenceConfig returns the steady-state convergence criterion and
+// the convergence acceleration, which is nil if none is used, specified
+// by the configuration. popGridColumn is the population type used by
+// population-weighted criteria.
+func convergenceConfig(cfg *viper.Viper, popGridColumn string) (inmap.ConvergenceCriterion, inmap.DomainManipulator, error) {
+	tol := cfg.GetFloat64("ConvergenceTolerance")
+	if tol <= 0 {
+		return nil, nil, fmt.Errorf("inmaputil: ConvergenceTolerance must be > 0 but is %g", tol)
+	}
+	var criterion inmap.ConvergenceCriterion
+	switch c := cfg.GetString("ConvergenceCriterion"); c {
+	case "mass":
+		criterion = inmap.MassAndPopulationChange{PopGridColumn: popGridColumn, Tolerance: tol}
+	case "population":
+		criterion = inmap.PopulationWeightedChange{PopGridColumn: popGridColumn, Tolerance: tol}
+	case "maxcell":
+		criterion = inmap.MaxCellChange{Tolerance: tol}
+	case "l2":
+		criterion = inmap.L2NormChange{Tolerance: tol}
+	default:
+		return nil, nil, fmt.Errorf("inmaputil: ConvergenceCriterion needs to be set to either mass, population, maxcell, or l2, but is currently set to `%s`", c)
+	}
+
+	var acceleration inmap.DomainManipulator
+	switch a := cfg.GetString("Acceleration"); a {
+	case "":
+	case "relaxation":
+		ω := cfg.GetFloat64("RelaxationFactor")
+		if ω <= 0 || ω >= 2 {
+			return nil, nil, fmt.Errorf("inmaputil: RelaxationFactor must be between 0 and 2 but is %g", ω)
+		}
+		acceleration = inmap.Relaxation(ω)
+	case "anderson":
+		depth := cfg.GetInt("AndersonDepth")
+		if depth < 1 {
+			return nil, nil, fmt.Errorf("inmaputil: AndersonDepth must be >= 1 but is %d", depth)
+		}
+		acceleration = inmap.AndersonAcceleration(depth)
+	default:
+		return nil, nil, fmt.Errorf("inmaputil: Acceleration needs to be set to either relaxation, anderson, or left empty, but is currently set to `%s`", a)
+	}
+	return criterion, acceleration, nil
+}
+
+// temporalProfilesConfig returns the temporal profiles specified by the
+// configuration, or nil if none are specified.
+func temporalProfilesConfig(cfg *viper.Viper) (*aeputil.TemporalProfiles, error) {
+	file := cfg.GetString("DynamicTime.TemporalProfiles")
+	if file == "" {
+		return nil, nil
+	}
+	f, err := os.Open(maybeDownload(context.TODO(), os.ExpandEnv(file), outChan("config")))
+	if err != nil {
+		return nil, fmt.Errorf("inmaputil: opening temporal profiles: %v", err)
+	}
+	defer f.Close()
+	return aeputil.ReadTemporalProfiles(f)
+}
+
+// advectionConfig returns the advection scheme specified by the
+// configuration.
+func advectionConfig(cfg *viper.Viper) (inmap.CellManipulator, error) {
+	switch a := cfg.GetString("Advection"); a {
+	case "upwind":
+		return inmap.UpwindAdvection(), nil
+	case "vanleer":
+		return inmap.VanLeerAdvection(), nil
+	default:
+		return nil, fmt.Errorf("inmaputil: Advection needs to be set to either upwind or vanleer, but is currently set to `%s`", a)
+	}
+}
+
+// backendConfig returns the backend specified by the configuration for
+// the transport calculations with the given advection scheme.
+func backendConfig(cfg *viper.Viper, advection inmap.CellManipulator) (inmap.Backend, error) {
+	b := cfg.GetString("Backend")
+	if b == "batched" && cfg.GetString("Advection") == "vanleer" {
+		return nil, fmt.Errorf("inmaputil: the batched Backend requires linear transport calculations and can not be used with vanleer Advection")
+	}
+	backend, err := inmap.NewBackend(b, transportFuncs(advection)...)
+	if err != nil {
+		return nil, fmt.Errorf("inmaputil: Backend: %v", err)
+	}
+	return backend, nil
+}
+
 func toIntSliceE(s interface{}) ([]int, error) {
 	if v, ok := s.([]interface{}); ok {
 		o := make([]int, len(v))
@@ -276,6 +705,44 @@ func toIntSliceE(s interface{}) ([]int, error) {
 	return o, nil
 }
 
+// toFloat64SliceE converts s, which is either a slice from a
+// configuration file or a string from a command line argument or
+// environment variable such as "[0,50,100]" or "0,50,100", to a
+// []float64.
+func toFloat64SliceE(s interface{}) ([]float64, error) {
+	switch v := s.(type) {
+	case []float64:
+		return v, nil
+	case []interface{}:
+		o := make([]float64, len(v))
+		for i, val := range v {
+			f, err := cast.ToFloat64E(val)
+			if err != nil {
+				return nil, err
+			}
+			o[i] = f
+		}
+		return o, nil
+	case string:
+		v = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(v), "["), "]")
+		if v == "" {
+			return nil, nil
+		}
+		parts := strings.Split(v, ",")
+		o := make([]float64, len(parts))
+		for i, p := range parts {
+			f, err := cast.ToFloat64E(strings.TrimSpace(p))
+			if err != nil {
+				return nil, err
+			}
+			o[i] = f
+		}
+		return o, nil
+	default:
+		return nil, fmt.Errorf("invalid type for a list of numbers: %T", s)
+	}
+}
+
 // GetStringMapString returns a map[string]string from a viper configuration,
 // accounting for the fact that it might be a json object if it was set
 // from a command line argument.
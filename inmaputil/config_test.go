@@ -19,12 +19,16 @@ along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
 package inmaputil
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"os"
 	"reflect"
 	"testing"
 
 	"github.com/ctessum/geom"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/sr"
 )
 
 func TestParseMask(t *testing.T) {
@@ -65,3 +69,195 @@ func TestParseMask(t *testing.T) {
 	})
 
 }
+
+func TestOutputVariables_healthFunctions(t *testing.T) {
+	cfg := InitializeConfig()
+	cfg.Set("OutputVariables", `{"TotalPopD": "(MyGEMM(TotalPM25) - 1) * TotalPop * AllCause / 100000",
+"Krewski": "MyCox (TotalPM25) + MyGEMM2(TotalPM25)"}`)
+	cfg.Set("HealthFunctions", `{"MyGEMM": {"Type": "gemm", "Theta": 0.143, "Alpha": 1.6, "Mu": 15.5, "Nu": 36.8, "CF": 2.4},
+"MyCox": {"type": "loglinear", "beta": 0.0075, "threshold": 5}}`)
+	vars, err := outputVariables(cfg.Viper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"TotalPopD": "(gemm(0.143, 1.6, 15.5, 36.8, 2.4, TotalPM25) - 1) * TotalPop * AllCause / 100000",
+		"Krewski":   "loglinear(0.0075, 5, TotalPM25) + MyGEMM2(TotalPM25)",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("have %v, want %v", vars, want)
+	}
+
+	cfg.Set("HealthFunctions", map[string]interface{}{
+		"Bad": map[string]interface{}{"Type": "gemm", "Theta": 0.143},
+	})
+	if _, err := outputVariables(cfg.Viper); err == nil {
+		t.Error("missing parameters should cause an error")
+	}
+	cfg.Set("HealthFunctions", map[string]interface{}{
+		"Bad": map[string]interface{}{"Type": "xxx"},
+	})
+	if _, err := outputVariables(cfg.Viper); err == nil {
+		t.Error("invalid type should cause an error")
+	}
+}
+
+func TestOutputVariables_ageGroups(t *testing.T) {
+	cfg := InitializeConfig()
+	cfg.Set("OutputVariables", `{"TotalPM25": "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA"}`)
+	cfg.Set("HealthFunctions", `{"MyCox": {"Type": "loglinear", "Beta": 0.0058, "Threshold": 0}}`)
+	cfg.Set("AgeGroupHazardRatio", "MyCox(TotalPM25)")
+	cfg.Set("VarGrid.AgeGroups", `{"Over65": {"PopColumn": "Pop65", "MortalityColumn": "Mort65", "LifeExpectancy": 18.5},
+"Under65": {"popcolumn": "PopU65", "mortalitycolumn": "MortU65", "lifeexpectancy": 45}}`)
+	vars, err := outputVariables(cfg.Viper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"TotalPM25":  "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA",
+		"Over65D":    "(loglinear(0.0058, 0, TotalPM25) - 1) * Pop65 * Mort65 / 100000",
+		"Over65YLL":  "Over65D * 18.5",
+		"Under65D":   "(loglinear(0.0058, 0, TotalPM25) - 1) * PopU65 * MortU65 / 100000",
+		"Under65YLL": "Under65D * 45",
+		"TotalAgeD":  "Over65D + Under65D",
+		"TotalYLL":   "Over65YLL + Under65YLL",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("have %v, want %v", vars, want)
+	}
+
+	c, err := VarGridConfig(cfg.Viper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantGroups := []inmap.AgeGroup{
+		{Name: "Over65", PopColumn: "Pop65", MortalityColumn: "Mort65", LifeExpectancy: 18.5},
+		{Name: "Under65", PopColumn: "PopU65", MortalityColumn: "MortU65", LifeExpectancy: 45},
+	}
+	if !reflect.DeepEqual(c.AgeGroups, wantGroups) {
+		t.Errorf("have %v, want %v", c.AgeGroups, wantGroups)
+	}
+
+	cfg.Set("VarGrid.AgeGroups", map[string]interface{}{
+		"Bad": map[string]interface{}{"PopColumn": "Pop65"},
+	})
+	if _, err := outputVariables(cfg.Viper); err == nil {
+		t.Error("missing mortality column should cause an error")
+	}
+}
+
+func TestOutputVariables_morbidity(t *testing.T) {
+	cfg := InitializeConfig()
+	cfg.Set("OutputVariables", `{"TotalPM25": "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA"}`)
+	cfg.Set("VarGrid.MorbidityEndpoints", `{"Dementia": {"PopColumn": "Pop65Plus"},
+"Stroke": {"HazardRatio": "loglinear(0.01, 0, TotalPM25)", "PopColumn": "TotalPop", "IncidenceColumn": "StrokeRate"}}`)
+	vars, err := outputVariables(cfg.Viper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"TotalPM25": "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA",
+		"Dementia":  "(Kioumourtzoglou2016Dementia(PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA) - 1) * Pop65Plus * DementInc / 100000",
+		"Stroke":    "(loglinear(0.01, 0, TotalPM25) - 1) * TotalPop * StrokeRate / 100000",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("have %v, want %v", vars, want)
+	}
+
+	c, err := VarGridConfig(cfg.Viper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.MorbidityEndpoints) != 2 || c.MorbidityEndpoints[0].IncidenceColumn != "DementInc" {
+		t.Errorf("endpoints: %+v", c.MorbidityEndpoints)
+	}
+
+	cfg.Set("VarGrid.MorbidityEndpoints", `{"Stroke": {"PopColumn": "TotalPop"}}`)
+	if _, err := outputVariables(cfg.Viper); err == nil {
+		t.Error("missing fields should cause an error")
+	}
+}
+
+func TestOutputVariables_disparity(t *testing.T) {
+	cfg := InitializeConfig()
+	cfg.Set("OutputVariables", `{"TotalPM25": "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA"}`)
+	cfg.Set("Disparity.Groups", `{"Blk": "Black", "Wht": "WhiteNoLat"}`)
+	vars, err := outputVariables(cfg.Viper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"PopExp", "PopAtk", "BlkExp", "BlkDiff", "BlkRatio", "BlkAtk", "WhtExp", "WhtDiff", "WhtRatio", "WhtAtk"} {
+		if _, ok := vars[v]; !ok {
+			t.Errorf("missing output variable %s", v)
+		}
+	}
+	if _, ok := vars["ConcIndex"]; ok {
+		t.Error("ConcIndex should only be included if Disparity.Rank is set")
+	}
+
+	r, err := sr.Open(context.Background(), "../cmd/inmap/testdata/testSR_golden.ncf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	c, err := r.Concentrations(&inmap.EmisRecord{Geom: geom.Point{}, PM25: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetConcentrations(c); err != nil {
+		t.Fatal(err)
+	}
+	results, err := r.Results(vars, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// All of the population in the test SR matrix is in the same grid
+	// cell, so there are no disparities.
+	for i, v := range results["BlkRatio"] {
+		if math.Abs(v-1) > 1.e-10 || math.Abs(results["WhtDiff"][i]) > 1.e-10 || math.Abs(results["PopAtk"][i]) > 1.e-10 {
+			t.Errorf("cell %d: BlkRatio %g, WhtDiff %g, PopAtk %g", i, v, results["WhtDiff"][i], results["PopAtk"][i])
+		}
+	}
+	if results["PopExp"][0] <= 0 {
+		t.Errorf("PopExp should be positive but is %g", results["PopExp"][0])
+	}
+}
+
+func TestVarGridConfig_global(t *testing.T) {
+	cfg := InitializeConfig()
+	cfg.Set("VarGrid.PopulationRasters", `{"TotalPop": "gpw.asc"}`)
+	cfg.Set("VarGrid.CountryMortalityFile", "gbd.csv")
+	cfg.Set("VarGrid.CountryFile", "countries.shp")
+	c, err := VarGridConfig(cfg.Viper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.PopulationRasters, map[string]string{"TotalPop": "gpw.asc"}) {
+		t.Errorf("PopulationRasters: %v", c.PopulationRasters)
+	}
+	if c.CountryMortalityFile != "gbd.csv" || c.CountryFile != "countries.shp" || c.CountryIDColumn != "ISO_A3" {
+		t.Errorf("country mortality: %s, %s, %s", c.CountryMortalityFile, c.CountryFile, c.CountryIDColumn)
+	}
+
+	cfg.Set("VarGrid.CountryFile", "")
+	if _, err := VarGridConfig(cfg.Viper); err == nil {
+		t.Error("a missing CountryFile should cause an error")
+	}
+}
+
+func TestVarGridConfig_projection(t *testing.T) {
+	cfg := InitializeConfig()
+	cfg.Set("VarGrid.ProjectionFile", "factors.csv")
+	cfg.Set("VarGrid.ProjectionRegionFile", "counties.shp")
+	if _, err := VarGridConfig(cfg.Viper); err == nil {
+		t.Error("a missing ProjectionYear should cause an error")
+	}
+	cfg.Set("VarGrid.ProjectionYear", 2050)
+	c, err := VarGridConfig(cfg.Viper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ProjectionFile != "factors.csv" || c.ProjectionRegionFile != "counties.shp" || c.ProjectionIDColumn != "GEOID" || c.ProjectionYear != 2050 {
+		t.Errorf("projection: %s, %s, %s, %d", c.ProjectionFile, c.ProjectionRegionFile, c.ProjectionIDColumn, c.ProjectionYear)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ctessum/geom/proj"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/science/chem/simplechem"
+)
+
+// CheckConfig checks the configuration of the command at path, for
+// example []string{"run", "steady"}, for problems that would cause the
+// command to fail, without running it. It checks that the input files
+// exist, that the shapefile inputs have projections that can be
+// converted to the grid projection, that the CTM data includes the
+// required variables and covers the grid (see
+// inmap.VarGridConfig.CheckCTMData), and that the output variable
+// expressions are valid. It returns each problem that is found.
+func (cfg *Cfg) CheckConfig(path []string) ([]error, error) {
+	cmd, rest, err := cfg.Root.Find(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("inmap: unknown command %q", strings.Join(path, " "))
+	}
+	has := func(name string) bool {
+		return cmd.Flags().Lookup(name) != nil || cmd.InheritedFlags().Lookup(name) != nil
+	}
+
+	var problems []error
+	add := func(name string, err error) {
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %v", name, err))
+		}
+	}
+
+	// The variable grid data is only read when the grid is static and
+	// not created before the simulation.
+	staticGrid := !has("static") || (cfg.GetBool("static") && !cfg.GetBool("creategrid"))
+	shapefiles := make(map[string][]string)
+	for _, option := range options {
+		if !option.isInputFile || option.name == "config" || !has(option.name) {
+			continue
+		}
+		if option.name == "VariableGridData" && !staticGrid {
+			continue
+		}
+		paths := inputFilePaths(cfg.Get(option.name))
+		if _, ok := option.defaultVal.(map[string][]string); ok {
+			m, err := getStringMapStringSlice(option.name, cfg.Viper)
+			if err != nil {
+				add(option.name, err)
+				continue
+			}
+			paths = inputFilePaths(m)
+		}
+		for _, f := range paths {
+			if f = os.ExpandEnv(f); f == "" || f == "no_default" || strings.Contains(f, "://") {
+				continue // Remote files are not checked.
+			}
+			if _, err := os.Stat(f); err != nil {
+				add(option.name, fmt.Errorf("input file %s does not exist", f))
+				continue
+			}
+			if strings.ToLower(filepath.Ext(f)) == ".shp" {
+				shapefiles[option.name] = append(shapefiles[option.name], f)
+			}
+		}
+	}
+
+	if has("EmissionUnits") {
+		_, err := checkEmissionUnits(cfg.GetString("EmissionUnits"))
+		add("EmissionUnits", err)
+	}
+	if has("OutputVariables") {
+		if vars, err := outputVariables(cfg.Viper); err != nil {
+			add("OutputVariables", err)
+		} else {
+			m := simplechem.Mechanism{
+				Ozone:              cfg.GetBool("Ozone"),
+				NitrateEquilibrium: cfg.GetBool("NitrateEquilibrium"),
+				PrimaryCarbon:      cfg.GetBool("PrimaryCarbon"),
+				CoarsePM:           cfg.GetBool("CoarsePM"),
+			}
+			_, err = inmap.NewOutputter("", false, vars, nil, m)
+			add("OutputVariables", err)
+		}
+	}
+
+	if !has("VarGrid.GridProj") {
+		return problems, nil
+	}
+	vgc, err := VarGridConfig(cfg.Viper)
+	if err != nil {
+		problems = append(problems, err)
+		return problems, nil
+	}
+	gridSR, err := proj.Parse(vgc.GridProj)
+	if err != nil {
+		add("VarGrid.GridProj", err)
+		return problems, nil
+	}
+
+	names := make([]string, 0, len(shapefiles))
+	for name := range shapefiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, f := range shapefiles[name] {
+			add(name, checkShapefileProjection(f, gridSR))
+		}
+	}
+
+	if has("InMAPData") {
+		if f := os.ExpandEnv(cfg.GetString("InMAPData")); f != "" && !strings.Contains(f, "://") {
+			if r, err := os.Open(f); err == nil {
+				add("InMAPData", vgc.CheckCTMData(r))
+				r.Close()
+			}
+		}
+	}
+	return problems, nil
+}
+
+// checkShapefileProjection checks that the projection of shapefile f
+// can be converted to the grid projection gridSR.
+func checkShapefileProjection(f string, gridSR *proj.SR) error {
+	prjFile := strings.TrimSuffix(f, filepath.Ext(f)) + ".prj"
+	b, err := os.ReadFile(prjFile)
+	if err != nil {
+		return fmt.Errorf("shapefile %s has no projection (.prj) file", f)
+	}
+	sr, err := proj.Parse(string(b))
+	if err != nil {
+		return fmt.Errorf("parsing the projection of shapefile %s: %v", f, err)
+	}
+	if _, err := sr.NewTransform(gridSR); err != nil {
+		return fmt.Errorf("the projection of shapefile %s cannot be converted to the grid projection: %v", f, err)
+	}
+	return nil
+}
+
+// inputFilePaths returns the file paths in the value v of a
+// configuration option, which can be a path, a list of paths, or a map
+// of paths or lists of paths.
+func inputFilePaths(v interface{}) []string {
+	switch t := v.(type) {
+	case string:
+		return []string{t}
+	case []string:
+		return t
+	case []interface{}:
+		var o []string
+		for _, vv := range t {
+			o = append(o, inputFilePaths(vv)...)
+		}
+		return o
+	case map[string]string:
+		var o []string
+		for _, vv := range t {
+			o = append(o, vv)
+		}
+		sort.Strings(o)
+		return o
+	case map[string][]string:
+		var o []string
+		for _, vv := range t {
+			o = append(o, vv...)
+		}
+		sort.Strings(o)
+		return o
+	case map[string]interface{}:
+		var o []string
+		for _, vv := range t {
+			o = append(o, inputFilePaths(vv)...)
+		}
+		sort.Strings(o)
+		return o
+	default:
+		return nil
+	}
+}
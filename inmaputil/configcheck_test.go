@@ -0,0 +1,64 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	cfg := InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	if err := setConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := cfg.CheckConfig([]string{"run", "steady"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("the example configuration should not have problems: %v", problems)
+	}
+
+	cfg.Set("EmissionsShapefiles", []string{"../cmd/inmap/testdata/missing.shp"})
+	cfg.Set("VarGrid.VariableGridXo", -1.e7)
+	cfg.Set("OutputVariables", map[string]string{"TotalPM25": "PrimaryPM25 +"})
+	problems, err = cfg.CheckConfig([]string{"run", "steady"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"EmissionsShapefiles: input file ../cmd/inmap/testdata/missing.shp does not exist",
+		"OutputVariables: ",
+		"InMAPData: inmap: the variable resolution grid",
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("have %d problems, want %d: %v", len(problems), len(want), problems)
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(problems[i].Error(), w) {
+			t.Errorf("problem %d: have %q, want prefix %q", i, problems[i], w)
+		}
+	}
+
+	if _, err := cfg.CheckConfig([]string{"run", "xyz"}); err == nil {
+		t.Error("expected an error for an unknown command")
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lnashier/viper"
+	"sigs.k8s.io/yaml"
+)
+
+// configData is the contents of a configuration file.
+type configData struct {
+	typ  string // The file type, e.g., "toml".
+	data []byte
+}
+
+// readConfig reads the configuration file at path into v, replacing
+// any configuration that was read before. The file can be in TOML,
+// YAML, or JSON format, and references to environment variables in it
+// are expanded (see expandConfigEnv). If the file has an "include" key
+// with a list of other configuration files, which can be relative to
+// the directory of the file, those files are read first, so that
+// settings in the file override those in the files it includes.
+// Tables are merged, so a file can override individual settings in a
+// table from an included file.
+func readConfig(v *viper.Viper, path string) error {
+	files, err := readConfigFiles(path, nil)
+	if err != nil {
+		return err
+	}
+	for i, f := range files {
+		v.SetConfigType(f.typ)
+		if i == 0 {
+			err = v.ReadConfig(bytes.NewReader(f.data))
+		} else {
+			err = v.MergeConfig(bytes.NewReader(f.data))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	v.SetConfigType("")
+	return nil
+}
+
+// readConfigFiles returns the contents of the configuration file at
+// path, preceded by the contents of the files it includes. parents
+// holds the files that include this one, to detect include cycles.
+func readConfigFiles(path string, parents []string) ([]configData, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range parents {
+		if p == abs {
+			return nil, fmt.Errorf("configuration file %s includes itself", path)
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b = expandConfigEnv(b)
+
+	f := configData{typ: strings.ToLower(strings.TrimPrefix(filepath.Ext(path), ".")), data: b}
+	switch f.typ {
+	case "yaml", "yml":
+		// Convert YAML to JSON so that nested tables are read as
+		// map[string]interface{}, the same as in the other formats.
+		if f.data, err = yaml.YAMLToJSON(b); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		f.typ = "json"
+	case "toml", "json":
+	default:
+		return nil, fmt.Errorf("%s: unsupported configuration file type %q; it must be toml, yaml, or json", path, f.typ)
+	}
+
+	v := viper.New()
+	v.SetConfigType(f.typ)
+	if err := v.ReadConfig(bytes.NewReader(f.data)); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	var files []configData
+	for _, inc := range v.GetStringSlice("include") {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(path), inc)
+		}
+		incFiles, err := readConfigFiles(inc, append(parents, abs))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, incFiles...)
+	}
+	return append(files, f), nil
+}
+
+// expandConfigEnv replaces references to environment variables in the
+// contents of a configuration file, in the form $VAR or ${VAR}, with
+// their values. References in the form ${VAR:-default} are replaced
+// with default if VAR is unset or empty, which allows, for example,
+// numeric settings to be specified by environment variables in
+// containerized deployments.
+func expandConfigEnv(b []byte) []byte {
+	return []byte(os.Expand(string(b), func(s string) string {
+		if name, def, ok := strings.Cut(s, ":-"); ok {
+			if v := os.Getenv(name); v != "" {
+				return v
+			}
+			return def
+		}
+		return os.Getenv(s)
+	}))
+}
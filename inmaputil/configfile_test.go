@@ -0,0 +1,131 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadConfig_yaml(t *testing.T) {
+	dir := t.TempDir()
+	example, err := filepath.Abs("../cmd/inmap/configExample.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	common := `include: [` + example + `]
+NumIterations: ${TEST_NUM_ITERATIONS:-7}
+VarGrid:
+  VariableGridXo: -3000
+OutputVariables:
+  TotalPM25: PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA
+  TotalPop: TotalPop
+`
+	if err := os.WriteFile(filepath.Join(dir, "common.yml"), []byte(common), 0644); err != nil {
+		t.Fatal(err)
+	}
+	scenario := `include: [common.yml]
+EmissionUnits: ${TEST_EMISSION_UNITS}
+`
+	scenarioPath := filepath.Join(dir, "scenario.yaml")
+	if err := os.WriteFile(scenarioPath, []byte(scenario), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_EMISSION_UNITS", "kg/year")
+
+	tomlCfg := InitializeConfig()
+	tomlCfg.Set("config", example)
+	if err := setConfig(tomlCfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg := InitializeConfig()
+	cfg.Set("config", scenarioPath)
+	if err := setConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if have := cfg.GetInt("NumIterations"); have != 7 {
+		t.Errorf("NumIterations: have %d, want 7", have)
+	}
+	if have := cfg.GetString("EmissionUnits"); have != "kg/year" {
+		t.Errorf("EmissionUnits: have %q, want kg/year", have)
+	}
+	if have, want := cfg.GetStringSlice("EmissionsShapefiles"), tomlCfg.GetStringSlice("EmissionsShapefiles"); !reflect.DeepEqual(have, want) {
+		t.Errorf("EmissionsShapefiles: have %v, want %v", have, want)
+	}
+	// Tables are merged with the tables in the included files.
+	wantOutputVars := GetStringMapString("OutputVariables", tomlCfg.Viper)
+	wantOutputVars["TotalPM25"] = "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA"
+	wantOutputVars["TotalPop"] = "TotalPop"
+	if have := GetStringMapString("OutputVariables", cfg.Viper); !reflect.DeepEqual(have, wantOutputVars) {
+		t.Errorf("OutputVariables: have %v, want %v", have, wantOutputVars)
+	}
+
+	have, err := VarGridConfig(cfg.Viper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := VarGridConfig(tomlCfg.Viper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.VariableGridXo = -3000
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("VarGrid:\nhave %+v\nwant %+v", have, want)
+	}
+}
+
+func TestReadConfig_env(t *testing.T) {
+	t.Setenv("INMAP_NUMITERATIONS", "3")
+	t.Setenv("INMAP_VARGRID_VARIABLEGRIDXO", "-1000")
+	cfg := InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	if err := setConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if have := cfg.GetInt("NumIterations"); have != 3 {
+		t.Errorf("NumIterations: have %d, want 3", have)
+	}
+	vgc, err := VarGridConfig(cfg.Viper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vgc.VariableGridXo != -1000 {
+		t.Errorf("VariableGridXo: have %g, want -1000", vgc.VariableGridXo)
+	}
+}
+
+func TestReadConfig_includeCycle(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.toml"), []byte(`include = ["b.yaml"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b.yaml"), []byte(`include: [a.toml]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := InitializeConfig()
+	cfg.Set("config", filepath.Join(dir, "a.toml"))
+	err := setConfig(cfg)
+	if err == nil || !strings.Contains(err.Error(), "includes itself") {
+		t.Errorf("have error %v, want include cycle error", err)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/edsrzf/mmap-go"
+	"github.com/yuzhou-wang/inmap"
+)
+
+// ctmDataLoader loads CTM data for a simulation. If cacheDir is not
+// empty, the data is cached there after it is loaded, so that
+// simulations, including those in other processes, that use the same
+// data can load it from the cache instead (see cachedCTMData).
+// Data loaded from the cache refers to memory-mapped files, so it can
+// only be used until close is called.
+type ctmDataLoader struct {
+	cacheDir string
+
+	mu   sync.Mutex
+	maps []mmap.MMap // The cache files that have been mapped.
+}
+
+// newCTMDataLoader returns a loader that caches CTM data in cacheDir.
+// If cacheDir is empty, CTM data is not cached.
+func newCTMDataLoader(cacheDir string) *ctmDataLoader {
+	return &ctmDataLoader{cacheDir: cacheDir}
+}
+
+// load loads the CTM data at path.
+func (l *ctmDataLoader) load(path string, VarGrid *inmap.VarGridConfig) (*inmap.CTMData, error) {
+	if l.cacheDir == "" {
+		return loadCTMData(path, VarGrid)
+	}
+	ctmData, m, err := cachedCTMData(l.cacheDir, path, VarGrid)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		l.mu.Lock()
+		l.maps = append(l.maps, m)
+		l.mu.Unlock()
+	}
+	return ctmData, nil
+}
+
+// close unmaps the cache files that the data loaded by l refers to.
+// The data can not be used afterwards.
+func (l *ctmDataLoader) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var err error
+	for _, m := range l.maps {
+		if err2 := m.Unmap(); err2 != nil && err == nil {
+			err = fmt.Errorf("inmap: releasing cached CTM data: %v", err2)
+		}
+	}
+	l.maps = nil
+	return err
+}
+
+// cachedCTMData loads the CTM data at path from the cache in dir,
+// or loads it from path and adds it to the cache if it is not in the
+// cache. The cached data is in the binary layout written by
+// inmap.CTMData.WriteRaw and is memory-mapped rather than read, so
+// simulations running at the same time share the memory it uses.
+// Problems writing to the cache are logged rather than returned.
+// If the data was loaded from the cache, the mapped memory is also
+// returned; it must be unmapped once the data is no longer needed.
+func cachedCTMData(dir, path string, VarGrid *inmap.VarGridConfig) (*inmap.CTMData, mmap.MMap, error) {
+	key, err := ctmDataCacheKey(path, VarGrid)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Problem loading input data: %v\n", err)
+	}
+	cacheFile := filepath.Join(dir, key+".ctm")
+	if ctmData, m, err := mapCTMData(cacheFile); err == nil {
+		log.Printf("Loaded input data %s from cache %s", path, cacheFile)
+		return ctmData, m, nil
+	} else if !os.IsNotExist(err) {
+		log.Printf("Problem loading input data from cache: %v", err)
+	}
+
+	ctmData, err := loadCTMData(path, VarGrid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeCTMDataCache(cacheFile, ctmData); err != nil {
+		log.Printf("Problem caching input data: %v", err)
+	}
+	return ctmData, nil, nil
+}
+
+// ctmDataCacheKey returns the name that the CTM data at path is cached
+// under. It changes when the file changes, and also depends on the
+// layer heights that the data is regridded to.
+func ctmDataCacheKey(path string, VarGrid *inmap.VarGridConfig) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	// Write each field on its own line, with the strings quoted, so that
+	// different inputs can't run together into the same key.
+	fmt.Fprintf(h, "%q\n%d\n%d\n%v\n%q\n", abs, fi.Size(), fi.ModTime().UnixNano(),
+		VarGrid.LayerHeights, inmap.InMAPDataVersion)
+	return hex.EncodeToString(h.Sum(nil))[:32], nil
+}
+
+// mapCTMData memory-maps the cached CTM data in file. The returned data
+// refers to the returned memory, so it can't be used after the memory
+// is unmapped.
+func mapCTMData(file string) (*inmap.CTMData, mmap.MMap, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	// The mapping is copy-on-write so that changes to the data
+	// don't affect the cache.
+	m, err := mmap.Map(f, mmap.COPY, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", file, err)
+	}
+	ctmData, err := inmap.ReadRawCTMData(m)
+	if err != nil {
+		m.Unmap()
+		return nil, nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return ctmData, m, nil
+}
+
+// writeCTMDataCache writes ctmData to file. It writes to a temporary
+// file first, so that other processes never read an incomplete file.
+func writeCTMDataCache(file string, ctmData *inmap.CTMData) error {
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := ctmData.WriteRaw(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
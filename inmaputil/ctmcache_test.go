@@ -0,0 +1,124 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yuzhou-wang/inmap"
+)
+
+func TestCTMDataCache(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "cache")
+
+	cfg := InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	if err := setConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	vgc, err := VarGridConfig(cfg.Viper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inmapData := os.ExpandEnv(cfg.GetString("InMAPData"))
+	want, err := loadCTMData(inmapData, vgc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctm := newCTMDataLoader(cacheDir)
+	for i := 0; i < 2; i++ { // The second time, the data is read from the cache.
+		have, err := ctm.load(inmapData, vgc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(have.Data, want.Data) {
+			t.Errorf("load %d: cached data is different from the original", i)
+		}
+		files, err := filepath.Glob(filepath.Join(cacheDir, "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 || filepath.Ext(files[0]) != ".ctm" {
+			t.Errorf("load %d: have cache files %v, want one .ctm file", i, files)
+		}
+	}
+	if len(ctm.maps) != 1 {
+		t.Errorf("have %d mapped cache files, want 1", len(ctm.maps))
+	}
+	if err := ctm.close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(ctm.maps) != 0 {
+		t.Errorf("have %d mapped cache files after closing, want 0", len(ctm.maps))
+	}
+
+	// Simulations using cached data should give the same results.
+	run := func(name, cache string) []byte {
+		cfg := InitializeConfig()
+		cfg.Set("static", true)
+		cfg.Set("creategrid", true)
+		cfg.Set("Deterministic", true)
+		cfg.Set("config", "../cmd/inmap/configExample.toml")
+		cfg.Set("CTMDataCacheDir", cache)
+		cfg.Set("OutputFile", filepath.Join(dir, name+".shp"))
+		cfg.Root.SetArgs([]string{"run", "steady"})
+		if err := cfg.Root.Execute(); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(filepath.Join(dir, name+".dbf"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	if !bytes.Equal(run("uncached", ""), run("cached", cacheDir)) {
+		t.Error("the results using cached data are different")
+	}
+}
+
+func TestCTMDataCacheKey(t *testing.T) {
+	// Files whose paths and sizes would run together into the same
+	// string should have different keys.
+	dir := t.TempDir()
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	key := func(name string, size int) string {
+		f := filepath.Join(dir, name)
+		if err := os.WriteFile(f, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(f, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		k, err := ctmDataCacheKey(f, &inmap.VarGridConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	if k1, k2 := key("x1", 23), key("x12", 3); k1 == k2 {
+		t.Errorf("x1 (23 bytes) and x12 (3 bytes) have the same key %s", k1)
+	}
+}
@@ -0,0 +1,453 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ctessum/geom"
+	"github.com/gorilla/websocket"
+	"github.com/yuzhou-wang/inmap"
+)
+
+// dashboard is an HTTP handler that shows the progress of a running
+// simulation in a web browser. The page at / is updated over a websocket
+// at /ws, and the current state is also available in JSON format at /state.
+type dashboard struct {
+	popColumn string
+	m         inmap.Mechanism
+
+	// interval is the minimum wall time between updates of the
+	// concentration summaries, which take longer to calculate
+	// than a time step for large grids.
+	interval time.Duration
+
+	// mapSize is the number of rows and columns in the concentration map.
+	mapSize int
+
+	o          *inmap.Outputter
+	start      time.Time
+	lastUpdate time.Time
+
+	mu    sync.Mutex
+	state dashboardState
+
+	// updated is closed and replaced each time the state is updated.
+	updated chan struct{}
+}
+
+// dashboardState is the state of a simulation shown in the dashboard.
+type dashboardState struct {
+	Iteration      int
+	SimulationDays float64
+	Walltime       float64 // [s]
+	Dt             float64 // [s]
+
+	// HeapMB and SysMB are the memory used by Go heap objects and
+	// the total memory obtained from the operating system [MB].
+	HeapMB, SysMB float64
+
+	// History holds the population-weighted concentrations at
+	// each update.
+	History []dashboardPoint
+
+	// Change holds the percent change in each population-weighted
+	// concentration since the previous update.
+	Change map[string]float64
+
+	// Map is a coarse map of the ground-level TotalPM25 concentrations.
+	Map *dashboardMap `json:",omitempty"`
+}
+
+// dashboardPoint holds the population-weighted concentrations [μg/m³]
+// at a point in a simulation.
+type dashboardPoint struct {
+	Iteration      int
+	SimulationDays float64
+	PopWeighted    map[string]float64
+}
+
+// dashboardMap is a map of concentrations on a regular grid, where
+// Values[row*Nx+col] is the average of the grid cells whose centroids
+// are within the map cell, with row zero at the bottom of the map.
+// Values are nil in map cells without any grid cell centroids.
+type dashboardMap struct {
+	Bounds *geom.Bounds
+	Nx, Ny int
+	Values []*float64
+}
+
+// pm25Species are the species that are summed to calculate TotalPM25.
+var pm25Species = []string{"PrimaryPM25", "pNH4", "pSO4", "pNO3", "SOA"}
+
+// newDashboard returns a dashboard for a simulation using mechanism m,
+// where popColumn is the population type used for population weighting.
+func newDashboard(popColumn string, m inmap.Mechanism) *dashboard {
+	return &dashboard{
+		popColumn: popColumn,
+		m:         m,
+		interval:  5 * time.Second,
+		mapSize:   100,
+		start:     time.Now(),
+		updated:   make(chan struct{}),
+		state:     dashboardState{History: []dashboardPoint{}},
+	}
+}
+
+// update returns a function that updates the state of the dashboard
+// after each time step.
+func (db *dashboard) update() inmap.DomainManipulator {
+	return func(d *inmap.InMAP) error {
+		db.mu.Lock()
+		db.state.Iteration++
+		db.state.SimulationDays += d.Dt / 3600 / 24
+		db.state.Dt = d.Dt
+		db.state.Walltime = time.Since(db.start).Seconds()
+		db.mu.Unlock()
+
+		if time.Since(db.lastUpdate) >= db.interval {
+			db.lastUpdate = time.Now()
+			if err := db.summarize(d); err != nil {
+				return err
+			}
+		}
+		db.mu.Lock()
+		close(db.updated)
+		db.updated = make(chan struct{})
+		db.mu.Unlock()
+		return nil
+	}
+}
+
+// summarize calculates the population-weighted concentrations,
+// the concentration map, and the memory use.
+func (db *dashboard) summarize(d *inmap.InMAP) error {
+	if db.o == nil {
+		vars := map[string]string{
+			"Pop":       db.popColumn,
+			"TotalPM25": strings.Join(pm25Species, " + "),
+		}
+		for _, s := range db.m.Species() {
+			vars[s] = s
+		}
+		o, err := inmap.NewOutputter("", false, vars, nil, db.m)
+		if err != nil {
+			return fmt.Errorf("inmap: creating dashboard: %v", err)
+		}
+		db.o = o
+	}
+	results, err := d.Results(db.o)
+	if err != nil {
+		return fmt.Errorf("inmap: updating dashboard: %v", err)
+	}
+	pop := results["Pop"]
+	var popSum float64
+	for _, p := range pop {
+		popSum += p
+	}
+	popWeighted := make(map[string]float64, len(results)-1)
+	for name, vals := range results {
+		if name == "Pop" {
+			continue
+		}
+		var sum float64
+		for i, v := range vals {
+			sum += v * pop[i]
+		}
+		if popSum > 0 {
+			popWeighted[name] = sum / popSum
+		}
+	}
+	m := rasterize(d.GetGeometry(0, false), results["TotalPM25"], db.mapSize)
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	s := &db.state
+	if n := len(s.History); n > 0 {
+		s.Change = make(map[string]float64, len(popWeighted))
+		for name, v := range popWeighted {
+			prev := s.History[n-1].PopWeighted[name]
+			if prev != 0 {
+				s.Change[name] = (v - prev) / prev * 100
+			}
+		}
+	}
+	s.History = append(s.History, dashboardPoint{
+		Iteration:      s.Iteration,
+		SimulationDays: s.SimulationDays,
+		PopWeighted:    popWeighted,
+	})
+	s.Map = m
+	s.HeapMB = float64(mem.HeapAlloc) / 1024 / 1024
+	s.SysMB = float64(mem.Sys) / 1024 / 1024
+	return nil
+}
+
+// rasterize averages vals, which correspond to the polygons in g, onto
+// a regular grid with up to size rows and columns over the bounds of g,
+// keeping the aspect ratio of the bounds.
+func rasterize(g []geom.Polygonal, vals []float64, size int) *dashboardMap {
+	if len(g) == 0 {
+		return nil
+	}
+	b := geom.NewBounds()
+	for _, p := range g {
+		b.Extend(p.Bounds())
+	}
+	dx, dy := b.Max.X-b.Min.X, b.Max.Y-b.Min.Y
+	nx, ny := size, size
+	if dx > dy {
+		ny = max(1, int(math.Round(float64(size)*dy/dx)))
+	} else {
+		nx = max(1, int(math.Round(float64(size)*dx/dy)))
+	}
+	sums := make([]float64, nx*ny)
+	counts := make([]int, nx*ny)
+	for i, p := range g {
+		c := p.Centroid()
+		col := min(nx-1, int(float64(nx)*(c.X-b.Min.X)/dx))
+		row := min(ny-1, int(float64(ny)*(c.Y-b.Min.Y)/dy))
+		sums[row*nx+col] += vals[i]
+		counts[row*nx+col]++
+	}
+	m := &dashboardMap{Bounds: b, Nx: nx, Ny: ny, Values: make([]*float64, nx*ny)}
+	for i, n := range counts {
+		if n > 0 {
+			v := sums[i] / float64(n)
+			m.Values[i] = &v
+		}
+	}
+	return m
+}
+
+// snapshot returns the current state in JSON format and a channel
+// that is closed when the state is next updated.
+func (db *dashboard) snapshot() ([]byte, <-chan struct{}, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	b, err := json.Marshal(db.state)
+	return b, db.updated, err
+}
+
+var dashboardUpgrader = websocket.Upgrader{}
+
+// ServeHTTP implements http.Handler.
+func (db *dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, dashboardPage)
+	case "/state":
+		b, _, err := db.snapshot()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	case "/ws":
+		db.serveWebsocket(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveWebsocket sends the state to the client each time it is
+// updated, at most once per second.
+func (db *dashboard) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := dashboardUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade has already responded to the client.
+	}
+	defer conn.Close()
+
+	// Read from the connection to process control messages and to
+	// find out when the client disconnects.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		b, updated, err := db.snapshot()
+		if err != nil {
+			return
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+			return
+		}
+		select {
+		case <-updated:
+		case <-closed:
+			return
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-closed:
+			return
+		}
+	}
+}
+
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>InMAP simulation</title>
+	<style>
+		html, body {padding: 0; margin: 1% 0; font-family: sans-serif;}
+		.container { max-width: 1000px; margin: 0 auto; padding: 10px; }
+		.panel { display: inline-block; vertical-align: top; margin: 10px; }
+		table { border-collapse: collapse; }
+		td, th { padding: 2px 8px; text-align: right; }
+		canvas { border: 1px solid #bbb; }
+		#connection { color: #888; }
+	</style>
+</head>
+<body>
+<div class="container">
+	<h1>InMAP simulation</h1>
+	<p id="connection">Connecting...</p>
+	<div class="panel">
+		<h3>Status</h3>
+		<table>
+			<tr><td>Iteration</td><td id="iteration"></td></tr>
+			<tr><td>Simulation days</td><td id="days"></td></tr>
+			<tr><td>Wall time</td><td id="walltime"></td></tr>
+			<tr><td>Time step</td><td id="dt"></td></tr>
+			<tr><td>Heap memory</td><td id="heap"></td></tr>
+			<tr><td>System memory</td><td id="sys"></td></tr>
+		</table>
+		<h3>Population-weighted concentrations</h3>
+		<table id="conc"></table>
+	</div>
+	<div class="panel">
+		<h3>Population-weighted TotalPM25 (μg/m³)</h3>
+		<canvas id="chart" width="450" height="250"></canvas>
+		<h3>Ground-level TotalPM25</h3>
+		<canvas id="map" width="450" height="450"></canvas>
+		<div id="maprange"></div>
+	</div>
+</div>
+<script>
+function fmt(v) { return v === undefined || v === null ? "" : Number(v).toPrecision(4); }
+function set(id, v) { document.getElementById(id).textContent = v; }
+
+function drawChart(history) {
+	var c = document.getElementById("chart"), ctx = c.getContext("2d");
+	ctx.clearRect(0, 0, c.width, c.height);
+	if (history.length === 0) return;
+	var xs = history.map(function(p) { return p.SimulationDays; });
+	var ys = history.map(function(p) { return p.PopWeighted.TotalPM25; });
+	var xmax = Math.max.apply(null, xs) || 1, ymax = Math.max.apply(null, ys) || 1;
+	var pad = 40;
+	ctx.strokeStyle = "#888";
+	ctx.strokeRect(pad, 10, c.width - pad - 10, c.height - pad - 10);
+	ctx.fillStyle = "#333";
+	ctx.fillText(fmt(ymax), 2, 16);
+	ctx.fillText("0", 2, c.height - pad);
+	ctx.fillText(fmt(xmax) + " days", c.width - 70, c.height - pad + 15);
+	ctx.strokeStyle = "#35c";
+	ctx.beginPath();
+	for (var i = 0; i < xs.length; i++) {
+		var x = pad + xs[i] / xmax * (c.width - pad - 10);
+		var y = c.height - pad - ys[i] / ymax * (c.height - pad - 10);
+		if (i === 0) ctx.moveTo(x, y); else ctx.lineTo(x, y);
+	}
+	ctx.stroke();
+}
+
+function color(f) {
+	// Interpolate from light yellow to dark red.
+	var r = Math.round(255 - 100 * f), g = Math.round(255 - 235 * f), b = Math.round(200 - 180 * f);
+	return "rgb(" + r + "," + g + "," + b + ")";
+}
+
+function drawMap(m) {
+	var c = document.getElementById("map"), ctx = c.getContext("2d");
+	ctx.clearRect(0, 0, c.width, c.height);
+	if (!m) return;
+	var vals = m.Values.filter(function(v) { return v !== null; });
+	var vmin = Math.min.apply(null, vals), vmax = Math.max.apply(null, vals);
+	var w = c.width / Math.max(m.Nx, m.Ny), h = w;
+	for (var row = 0; row < m.Ny; row++) {
+		for (var col = 0; col < m.Nx; col++) {
+			var v = m.Values[row * m.Nx + col];
+			if (v === null) continue;
+			ctx.fillStyle = color(vmax > vmin ? (v - vmin) / (vmax - vmin) : 0);
+			ctx.fillRect(col * w, (m.Ny - row - 1) * h, Math.ceil(w), Math.ceil(h));
+		}
+	}
+	set("maprange", "Range: " + fmt(vmin) + " to " + fmt(vmax) + " μg/m³");
+}
+
+function render(s) {
+	set("iteration", s.Iteration);
+	set("days", fmt(s.SimulationDays));
+	set("walltime", fmt(s.Walltime / 3600) + " h");
+	set("dt", fmt(s.Dt) + " s");
+	set("heap", fmt(s.HeapMB) + " MB");
+	set("sys", fmt(s.SysMB) + " MB");
+	var t = document.getElementById("conc");
+	t.innerHTML = "<tr><th>Species</th><th>μg/m³</th><th>% change</th></tr>";
+	if (s.History.length > 0) {
+		var last = s.History[s.History.length - 1].PopWeighted;
+		Object.keys(last).sort().forEach(function(k) {
+			var tr = document.createElement("tr");
+			[k, fmt(last[k]), s.Change ? fmt(s.Change[k]) : ""].forEach(function(v) {
+				var td = document.createElement("td");
+				td.textContent = v;
+				tr.appendChild(td);
+			});
+			t.appendChild(tr);
+		});
+	}
+	drawChart(s.History);
+	drawMap(s.Map);
+}
+
+function connect() {
+	var ws = new WebSocket((location.protocol === "https:" ? "wss://" : "ws://") + location.host + "/ws");
+	ws.onopen = function() { set("connection", "Connected"); };
+	ws.onmessage = function(e) { render(JSON.parse(e.data)); };
+	ws.onclose = function() {
+		set("connection", "Disconnected; the simulation may have finished. Reconnecting...");
+		setTimeout(connect, 5000);
+	};
+}
+connect();
+</script>
+</body>
+</html>
+`
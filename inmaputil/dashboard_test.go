@@ -0,0 +1,150 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/gorilla/websocket"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/science/chem/simplechem"
+)
+
+func TestDashboard(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := inmap.VarGridTestData()
+	var m simplechem.Mechanism
+	emis := inmap.NewEmissions()
+	emis.Add(&inmap.EmisRecord{PM25: 1, Geom: geom.Point{X: -3999, Y: -3999}})
+
+	db := newDashboard(cfg.PopGridColumn, m)
+	db.interval = 0
+	d := &inmap.InMAP{
+		InitFuncs: []inmap.DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+			inmap.SetTimestepCFL(),
+		},
+		RunFuncs: []inmap.DomainManipulator{
+			inmap.Calculations(inmap.AddEmissionsFlux(), inmap.UpwindAdvection(), inmap.Mixing()),
+			inmap.SteadyStateConvergenceCheck(3, cfg.PopGridColumn, m, nil),
+			db.update(),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(db)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s dashboardState
+	err = json.NewDecoder(resp.Body).Decode(&s)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Iteration != 3 {
+		t.Errorf("iteration: have %d, want 3", s.Iteration)
+	}
+	if len(s.History) != 3 {
+		t.Fatalf("history: have %d points, want 3", len(s.History))
+	}
+	last := s.History[2].PopWeighted
+	if last["PrimaryPM25"] <= 0 || last["TotalPM25"] != last["PrimaryPM25"] {
+		t.Errorf("population-weighted concentrations: %v", last)
+	}
+	if _, ok := s.Change["TotalPM25"]; !ok {
+		t.Errorf("missing change in TotalPM25: %v", s.Change)
+	}
+	if s.Map == nil || s.Map.Nx*s.Map.Ny != len(s.Map.Values) {
+		t.Fatalf("invalid map: %+v", s.Map)
+	}
+	var filled int
+	for _, v := range s.Map.Values {
+		if v != nil {
+			filled++
+		}
+	}
+	if filled == 0 {
+		t.Error("map has no values")
+	}
+	if s.SysMB <= 0 {
+		t.Error("missing memory use")
+	}
+
+	resp, err = http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(page), "new WebSocket") {
+		t.Error("dashboard page does not connect to the websocket")
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var ws dashboardState
+	if err := conn.ReadJSON(&ws); err != nil {
+		t.Fatal(err)
+	}
+	if ws.Iteration != s.Iteration {
+		t.Errorf("websocket iteration: have %d, want %d", ws.Iteration, s.Iteration)
+	}
+}
+
+func TestRasterize(t *testing.T) {
+	g := []geom.Polygonal{
+		geom.Polygon{{{X: 0, Y: 0}, {X: 1, Y: 0}, {X: 1, Y: 1}, {X: 0, Y: 1}}},
+		geom.Polygon{{{X: 1, Y: 0}, {X: 2, Y: 0}, {X: 2, Y: 1}, {X: 1, Y: 1}}},
+		geom.Polygon{{{X: 3, Y: 0}, {X: 4, Y: 0}, {X: 4, Y: 1}, {X: 3, Y: 1}}},
+	}
+	m := rasterize(g, []float64{1, 3, 5}, 4)
+	if m.Nx != 4 || m.Ny != 1 {
+		t.Fatalf("map size: have %dx%d, want 4x1", m.Nx, m.Ny)
+	}
+	want := []float64{1, 3, -1, 5}
+	for i, v := range m.Values {
+		if want[i] < 0 {
+			if v != nil {
+				t.Errorf("value %d: have %g, want nil", i, *v)
+			}
+		} else if v == nil || *v != want[i] {
+			t.Errorf("value %d: have %v, want %g", i, v, want[i])
+		}
+	}
+}
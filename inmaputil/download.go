@@ -49,10 +49,23 @@ func maybeDownload(ctx context.Context, path string, c chan string) string {
 	// If the path starts with one of these prefixes, download the file and
 	// return the location it was downloaded to.
 	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		if isDAP(path) {
+			// OPeNDAP datasets are read directly from the server.
+			return path
+		}
 		return downloadHTTP(path, c)
 	}
 
 	if IsBlob(path) {
+		if isZarr(path) {
+			// Zarr stores are read directly from the bucket.
+			return path
+		}
+		if isTemplate(path) && !strings.HasPrefix(path, "file://") {
+			// Files for each date are downloaded as they are needed
+			// by the preprocessor.
+			return path
+		}
 		return downloadBlob(ctx, path, c)
 	}
 
@@ -97,6 +110,30 @@ func IsBlob(path string) bool {
 	return strings.HasPrefix(path, "gs://") || strings.HasPrefix(path, "s3://") || strings.HasPrefix(path, "file://")
 }
 
+// isDAP returns whether path is the URL of an OPeNDAP dataset
+// on a THREDDS ("/dodsC/"), Hyrax ("/opendap/"), or GrADS Data Server
+// ("/dods/").
+func isDAP(path string) bool {
+	for _, s := range []string{"/dodsC/", "/opendap/", "/dods/"} {
+		if strings.Contains(path, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTemplate returns whether path is a file name template
+// containing a wild card such as [DATE].
+func isTemplate(path string) bool {
+	return strings.Contains(path, "[DATE]")
+}
+
+// isZarr returns whether path is a Zarr store, which is
+// indicated by the ".zarr" extension.
+func isZarr(path string) bool {
+	return filepath.Ext(strings.TrimSuffix(path, "/")) == ".zarr"
+}
+
 // downloadBlob download the specified file from blob storage.
 func downloadBlob(ctx context.Context, path string, c chan string) string {
 	url, err := url.Parse(path)
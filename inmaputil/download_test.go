@@ -36,7 +36,7 @@ func helperLog(t *testing.T) chan string {
 	go func() {
 		for {
 			msg := <-outChan
-			t.Logf(msg)
+			t.Log(msg)
 		}
 	}()
 	return outChan
@@ -93,3 +93,24 @@ func TestMaybeDownload_bucket(t *testing.T) {
 		t.Errorf("inproperly downloaded: %s", path)
 	}
 }
+
+func TestMaybeDownload_zarr(t *testing.T) {
+	const path = "s3://bucket/wrfout_[DATE].zarr"
+	if k := maybeDownload(context.Background(), path, helperLog(t)); k != path {
+		t.Errorf("Expected %s, got %s", path, k)
+	}
+}
+
+func TestMaybeDownload_dap(t *testing.T) {
+	const path = "https://server/thredds/dodsC/wrfout_d01_[DATE]"
+	if k := maybeDownload(context.Background(), path, helperLog(t)); k != path {
+		t.Errorf("Expected %s, got %s", path, k)
+	}
+}
+
+func TestMaybeDownload_template(t *testing.T) {
+	const path = "gs://bucket/wrfout_d01_[DATE]"
+	if k := maybeDownload(context.Background(), path, helperLog(t)); k != path {
+		t.Errorf("Expected %s, got %s", path, k)
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/yuzhou-wang/inmap"
+)
+
+// These are the approximate sizes in bytes of the parts of an output
+// shapefile, used to estimate its size.
+const (
+	shpHeaderSize   = 100 // The header of the .shp and .shx files.
+	shpRecordSize   = 136 // A .shp record for a grid cell polygon with 5 points.
+	shxRecordSize   = 8   // A .shx record.
+	dbfFieldSize    = 20  // A typical output variable value in the .dbf file.
+	dbfHeaderSize   = 33  // The .dbf header, excluding the field descriptors.
+	dbfFieldDescLen = 32  // A .dbf field descriptor.
+)
+
+// resourceEstimate holds an estimate of the resources a simulation
+// will use.
+type resourceEstimate struct {
+	// Cells is the number of grid cells, and GroundCells is the number
+	// of those cells that are in the lowest layer.
+	Cells, GroundCells int
+
+	// EmissionsRecords is the number of records in the emissions
+	// shapefiles.
+	EmissionsRecords int
+
+	// Memory is the estimated memory use in bytes.
+	Memory uint64
+
+	// Iterations is the number of iterations the estimated Runtime
+	// is for.
+	Iterations int
+
+	// Runtime is the estimated wall time of the simulation.
+	Runtime time.Duration
+
+	// OutputSize is the estimated size in bytes of the output
+	// shapefile. It is zero if the output is not a shapefile.
+	OutputSize int64
+}
+
+// estimateResources estimates the resources that a steady-state simulation
+// with the given configuration (see Run) will use, without running it.
+// It builds the grid and reads the headers of the emissions shapefiles.
+// The emissions are only read if they are used to refine the grid.
+// The memory estimate is the memory in use after building the grid,
+// plus the size of the emissions shapefiles. The run time is estimated
+// from the number of grid cells and cellsPerSecond, the number of grid
+// cell time steps that are calculated per second, which can be
+// obtained from the inmap_cells_processed_per_second metric of previous
+// runs. If numIterations < 1, the simulation is assumed to converge
+// after defaultIterations iterations. For dynamic grids, the
+// estimates are for the initial grid.
+func estimateResources(OutputFile string, OutputAllLayers bool, OutputVariables map[string]string,
+	EmissionUnits string, EmissionsShapefiles []string, EmissionsMask geom.Polygon, VarGrid *inmap.VarGridConfig,
+	InMAPData string, InMAPDataPeriods []string, VariableGridData, CTMDataCacheDir string, NumIterations int,
+	dynamic, createGrid bool, m inmap.Mechanism, cellsPerSecond float64, defaultIterations int) (*resourceEstimate, error) {
+
+	if cellsPerSecond <= 0 {
+		return nil, fmt.Errorf("inmap: the cell processing rate for estimating the run time must be > 0 but is %g", cellsPerSecond)
+	}
+	est := new(resourceEstimate)
+
+	var emisFileSize int64
+	for _, f := range EmissionsShapefiles {
+		d, err := shp.NewDecoder(f)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: reading emissions shapefile header: %v", err)
+		}
+		est.EmissionsRecords += d.AttributeCount()
+		d.Close()
+		for _, ext := range []string{".shp", ".dbf"} {
+			if fi, err := os.Stat(strings.TrimSuffix(f, ".shp") + ext); err == nil {
+				emisFileSize += fi.Size()
+			}
+		}
+	}
+
+	var initFuncs []inmap.DomainManipulator
+	if dynamic || createGrid {
+		if len(InMAPDataPeriods) > 0 {
+			InMAPData = InMAPDataPeriods[0]
+		}
+		ctm := newCTMDataLoader(CTMDataCacheDir)
+		defer ctm.close()
+		ctmData, err := ctm.load(InMAPData, VarGrid)
+		if err != nil {
+			return nil, err
+		}
+		pop, popIndices, mr, mortIndices, err := VarGrid.LoadPopMort()
+		if err != nil {
+			return nil, err
+		}
+		initFuncs = append(initFuncs, VarGrid.RegularGrid(ctmData, pop, popIndices, mr, mortIndices, nil, m))
+		if !dynamic {
+			var emis *inmap.Emissions
+			for _, c := range VarGrid.RefinementCriteria {
+				if strings.EqualFold(c, "emissions") {
+					sr, err := spatialRef(VarGrid)
+					if err != nil {
+						return nil, err
+					}
+					emis, err = inmap.ReadEmissionShapefiles(sr, EmissionUnits, nil, EmissionsMask, EmissionsShapefiles...)
+					if err != nil {
+						return nil, err
+					}
+					break
+				}
+			}
+			mutator, err := VarGrid.RefinementMutator(popIndices, emis)
+			if err != nil {
+				return nil, err
+			}
+			initFuncs = append(initFuncs, VarGrid.MutateGrid(mutator, ctmData, pop, mr, nil, m, nil))
+		}
+	} else {
+		f, err := os.Open(VariableGridData)
+		if err != nil {
+			return nil, fmt.Errorf("problem opening file to load VariableGridData: %v", err)
+		}
+		defer f.Close()
+		initFuncs = append(initFuncs, inmap.Load(f, VarGrid, nil, m))
+	}
+	d := &inmap.InMAP{InitFuncs: initFuncs}
+	if err := d.Init(); err != nil {
+		return nil, fmt.Errorf("inmap: problem building grid: %v", err)
+	}
+
+	var mem runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&mem)
+	est.Memory = mem.HeapAlloc + uint64(emisFileSize)
+
+	cells := d.Cells()
+	est.Cells = len(cells)
+	for _, c := range cells {
+		if c.Layer == 0 {
+			est.GroundCells++
+		}
+	}
+
+	est.Iterations = NumIterations
+	if est.Iterations < 1 {
+		est.Iterations = defaultIterations
+	}
+	est.Runtime = time.Duration(float64(est.Cells) * float64(est.Iterations) / cellsPerSecond * float64(time.Second))
+
+	switch strings.ToLower(filepath.Ext(OutputFile)) {
+	case ".parquet", ".geoparquet", ".kml":
+	default:
+		if inmap.IsPostGISURL(OutputFile) {
+			break
+		}
+		rows, fields := int64(est.GroundCells), int64(len(OutputVariables))
+		if OutputAllLayers {
+			rows = int64(est.Cells)
+			fields += 3 // Layer, LayerHeight, and Dz.
+		}
+		est.OutputSize = 2*shpHeaderSize + rows*(shpRecordSize+shxRecordSize) +
+			dbfHeaderSize + fields*dbfFieldDescLen + rows*(1+fields*dbfFieldSize)
+	}
+	return est, nil
+}
+
+// String returns a report of the estimate.
+func (est *resourceEstimate) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Grid cells: %d (%d in the lowest layer)\n", est.Cells, est.GroundCells)
+	fmt.Fprintf(&b, "Emissions shapefile records: %d\n", est.EmissionsRecords)
+	fmt.Fprintf(&b, "Estimated memory: %s\n", formatBytes(int64(est.Memory)))
+	fmt.Fprintf(&b, "Estimated run time for %d iterations: %s\n", est.Iterations, est.Runtime.Round(time.Second))
+	if est.OutputSize > 0 {
+		fmt.Fprintf(&b, "Estimated output shapefile size: %s\n", formatBytes(est.OutputSize))
+	}
+	return b.String()
+}
+
+// formatBytes formats n bytes using binary prefixes, for example "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
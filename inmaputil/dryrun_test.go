@@ -0,0 +1,78 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDryRun(t *testing.T) {
+	cfg := InitializeConfig()
+	cfg.Set("static", true)
+	cfg.Set("creategrid", true)
+	cfg.Set("dry-run", true)
+	cfg.Set("NumIterations", 10)
+	cfg.Set("DryRun.CellsPerSecond", 4.6)
+	os.Setenv("InMAPRunType", "dryrun")
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Root.SetArgs([]string{"run", "steady"})
+	var out bytes.Buffer
+	cfg.Root.SetOutput(&out)
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(os.ExpandEnv("$INMAP_ROOT_DIR/cmd/inmap/testdata/output_dryrun.shp")); !os.IsNotExist(err) {
+		t.Errorf("a dry run should not write output: %v", err)
+	}
+	for _, want := range []string{
+		"Grid cells: 46 (10 in the lowest layer)\n",
+		"Emissions shapefile records: 5\n",
+		"Estimated run time for 10 iterations: 1m40s\n",
+		"Estimated output shapefile size: 3.9 KiB\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output %q does not contain %q", out.String(), want)
+		}
+	}
+}
+
+func TestResourceEstimate(t *testing.T) {
+	est := &resourceEstimate{
+		Cells:            1000,
+		GroundCells:      100,
+		EmissionsRecords: 20,
+		Memory:           3 << 30,
+		Iterations:       500,
+		Runtime:          90 * time.Minute,
+		OutputSize:       1536,
+	}
+	want := `Grid cells: 1000 (100 in the lowest layer)
+Emissions shapefile records: 20
+Estimated memory: 3.0 GiB
+Estimated run time for 500 iterations: 1h30m0s
+Estimated output shapefile size: 1.5 KiB
+`
+	if have := est.String(); have != want {
+		t.Errorf("have:\n%s\nwant:\n%s", have, want)
+	}
+}
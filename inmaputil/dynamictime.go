@@ -0,0 +1,431 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/ctessum/geom"
+	"github.com/spf13/cobra"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/emissions/aep"
+	"github.com/yuzhou-wang/inmap/emissions/aep/aeputil"
+	"github.com/yuzhou-wang/inmap/emissions/mobile"
+	"google.golang.org/grpc"
+)
+
+// dailyPeriods returns the names of the daily periods (e.g., "20050101")
+// between startDate and endDate, in the format used by preprocPeriods.
+func dailyPeriods(startDate, endDate string) ([]string, error) {
+	const format = "20060102"
+	start, err := time.Parse(format, startDate)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: parsing dynamic-time StartDate: %v", err)
+	}
+	end, err := time.Parse(format, endDate)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: parsing dynamic-time EndDate: %v", err)
+	}
+	var o []string
+	for _, p := range dayPeriods(start, end) {
+		o = append(o, p[0].Format(format))
+	}
+	return o, nil
+}
+
+// temporalEmissionsGroup holds emissions that have the same temporal
+// profiles.
+type temporalEmissionsGroup struct {
+	sector, scc string // representative sector and SCC code.
+	recs        map[string][]aep.Record
+	gridded     []*inmap.EmisRecord
+}
+
+// temporalEmissionsAEP returns a function that allocates AEP-processed
+// emissions, along with extraEmis if it is not nil, to the grid cells in d
+// and scales them to the emissions rate at time t using profiles.
+// The emissions in extraEmis use the default profiles. The grid is
+// assumed not to change after the first call. The returned emissions use
+// the given plume-in-grid distance and near-road zone width.
+func temporalEmissionsAEP(inventoryConfig *aeputil.InventoryConfig, spatialConfig *aeputil.SpatialConfig, extraEmis *inmap.Emissions, mask geom.Polygon, plumeDistance, nearRoadWidth float64, profiles *aeputil.TemporalProfiles) func(d *inmap.InMAP, t time.Time) (*inmap.Emissions, error) {
+	recs, err := readEmissionsAEP(inventoryConfig, mask) // Remember to check error below.
+
+	// Group the records by their temporal profiles so that each group
+	// only needs to be allocated to the grid once.
+	groups := make(map[string]*temporalEmissionsGroup)
+	for sector, srecs := range recs {
+		for _, r := range srecs {
+			key := profiles.Key(sector, r.GetSCC())
+			g, ok := groups[key]
+			if !ok {
+				g = &temporalEmissionsGroup{sector: sector, scc: r.GetSCC(), recs: make(map[string][]aep.Record)}
+				groups[key] = g
+			}
+			g.recs[sector] = append(g.recs[sector], r)
+		}
+	}
+	var gridded bool
+
+	return func(d *inmap.InMAP, t time.Time) (*inmap.Emissions, error) {
+		if err != nil { // Check error from ReadEmissions
+			return nil, err
+		}
+		if !gridded {
+			for _, g := range groups {
+				if g.gridded, err = gridEmissionsAEP(g.recs, spatialConfig, d); err != nil {
+					return nil, err
+				}
+			}
+			gridded = true
+		}
+		emis := inmap.NewEmissions()
+		emis.Mask = mask
+		emis.PlumeDistance = plumeDistance
+		emis.NearRoadWidth = nearRoadWidth
+		for _, g := range groups {
+			f := profiles.Factor(g.sector, g.scc, t)
+			for _, e := range g.gridded {
+				emis.Add(scaleEmisRecord(e, f))
+			}
+		}
+		if extraEmis != nil { // Add in extra emissions.
+			f := profiles.Factor("", "", t)
+			for _, e := range extraEmis.EmisRecords() {
+				emis.Add(scaleEmisRecord(e, f))
+			}
+		}
+		return emis, nil
+	}
+}
+
+// scaleEmisRecord returns a copy of e with the emissions multiplied by f.
+func scaleEmisRecord(e *inmap.EmisRecord, f float64) *inmap.EmisRecord {
+	o := *e
+	o.VOC *= f
+	o.NOx *= f
+	o.NH3 *= f
+	o.SOx *= f
+	o.PM25 *= f
+	o.EC *= f
+	o.OC *= f
+	o.PM10 *= f
+	return &o
+}
+
+// startMobileServer starts a gRPC server that listens on address for
+// link-level emissions from a mobile-source emissions model. The returned
+// function stops the server.
+func startMobileServer(address string) (*mobile.Server, func(), error) {
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("inmap: starting mobile-source emissions server: %v", err)
+	}
+	s := mobile.NewServer()
+	g := grpc.NewServer()
+	s.Register(g)
+	go g.Serve(lis)
+	log.Printf("Listening for mobile-source link emissions at %s", lis.Addr())
+	return s, func() {
+		s.Close()
+		g.Stop()
+	}, nil
+}
+
+// RunDynamicTime runs the model through a series of time periods in
+// order, changing the meteorology and baseline concentrations at the
+// beginning of each period, and saves the concentrations at the end of
+// each period. Unlike Run, the simulation is not run to steady state;
+// it starts with zero concentrations and the concentrations at the end
+// of each period are the starting concentrations for the next one.
+// If TemporalProfiles is nil, the emissions are the same in every period;
+// otherwise the emissions are scaled by the monthly, day-of-week, and
+// hour-of-day profiles in it, using the start time of each period, which
+// requires that the period names are dates in the format "YYYYMMDD".
+// If any of the profiles vary by hour of day, the emissions are updated
+// every hour.
+//
+// If Mobile is not nil, the simulation is coupled to a mobile-source
+// emissions model: at the beginning of each period it waits for a new
+// set of link emissions from Mobile and adds them to the other
+// emissions, and at the end of each period it saves the concentrations
+// at each link to Mobile.
+//
+// Periods are the names of the periods (e.g., "20050101", as created by
+// Preproc with OutputPeriods="daily") and PeriodData are the paths to the
+// corresponding baseline meteorology and pollutant data. Each period is
+// simulated for PeriodLength, and the results for each period are saved
+// in the file named by PeriodFile(OutputFile, period).
+//
+// If StreamFile is not empty, the results are also appended to the NetCDF
+// file StreamFile (see inmap.OutputStream) every StreamInterval of
+// simulation time as the simulation progresses, or at the end of each
+// period if StreamInterval is zero. StreamInterval must divide evenly
+// into PeriodLength or be a multiple of it. Times in StreamFile are
+// relative to the start of the first period, which is taken from its name
+// if it is a date in the format "YYYYMMDD".
+//
+// The simulation uses a static grid. If createGrid is true, the grid
+// is created using the data in InMAPData (e.g., the average over the
+// whole simulation period); otherwise it is read from VariableGridData.
+//
+// The other arguments are the same as for Run.
+func RunDynamicTime(CobraCommand *cobra.Command, LogFile string, OutputFile string, OutputAllLayers bool, OutputVariables map[string]string,
+	EmissionUnits string, EmissionsShapefiles []string, EmissionsMask geom.Polygon, PlumeInGridDistance, NearRoadWidth float64, VarGrid *inmap.VarGridConfig,
+	inventoryConfig *aeputil.InventoryConfig, spatialConfig *aeputil.SpatialConfig, TemporalProfiles *aeputil.TemporalProfiles, Mobile *mobile.Server,
+	InMAPData string, Periods, PeriodData []string, PeriodLength time.Duration, StreamFile string, StreamInterval time.Duration, VariableGridData, CTMDataCacheDir, CellStorageDir string,
+	createGrid, deterministic bool, scienceFuncs []inmap.CellManipulator, m inmap.Mechanism) error {
+
+	startTime := time.Now()
+
+	if len(Periods) == 0 {
+		return fmt.Errorf("inmap: no time periods to simulate")
+	}
+	if len(PeriodData) != len(Periods) {
+		return fmt.Errorf("inmap: %d data files for %d time periods", len(PeriodData), len(Periods))
+	}
+	if PeriodLength <= 0 {
+		return fmt.Errorf("inmap: invalid time period length %v", PeriodLength)
+	}
+	if StreamInterval < 0 || (StreamInterval > 0 && PeriodLength%StreamInterval != 0 && StreamInterval%PeriodLength != 0) {
+		return fmt.Errorf("inmap: stream output interval %v must divide evenly into the time period length %v or be a multiple of it", StreamInterval, PeriodLength)
+	}
+
+	var upload uploader
+
+	l, err := newRunLogger(CobraCommand, upload.maybeUpload(LogFile), 0)
+	if err != nil {
+		return err
+	}
+	defer l.close()
+
+	log.Println("Parsing output variable expressions...")
+	outputters := make([]*inmap.Outputter, len(Periods))
+	for i, p := range Periods {
+		outputters[i], err = inmap.NewOutputter(upload.maybeUpload(PeriodFile(OutputFile, p)), OutputAllLayers, OutputVariables, nil, m)
+		if err != nil {
+			return err
+		}
+	}
+	var streamOutputter *inmap.Outputter
+	if StreamFile != "" {
+		streamOutputter, err = inmap.NewOutputter("", OutputAllLayers, OutputVariables, nil, m)
+		if err != nil {
+			return err
+		}
+		StreamFile = upload.maybeUpload(StreamFile)
+	}
+	if upload.err != nil {
+		return upload.err
+	}
+
+	sr, err := spatialRef(VarGrid)
+	if err != nil {
+		return err
+	}
+	var stream *inmap.OutputStream
+	var streamStart time.Time
+	if streamOutputter != nil {
+		// If the period names aren't dates, times are relative to
+		// the zero time.
+		streamStart, _ = time.Parse("20060102", Periods[0])
+		stream = streamOutputter.NewOutputStream(StreamFile, sr, streamStart)
+		defer stream.Close()
+	}
+	emis, err := inmap.ReadEmissionShapefiles(sr, EmissionUnits, l.msgLog, EmissionsMask, EmissionsShapefiles...)
+	if err != nil {
+		return err
+	}
+
+	// The grid does not change, so the emissions only need to be
+	// allocated to it once, but they need to be set again in each
+	// period because plume rise depends on the meteorology.
+	var emissionsAt func(d *inmap.InMAP, t time.Time) (*inmap.Emissions, error)
+	step := PeriodLength
+	if TemporalProfiles == nil {
+		emissions := emissionsAEP(inventoryConfig, spatialConfig, emis, EmissionsMask, PlumeInGridDistance, NearRoadWidth)
+		var gridEmis *inmap.Emissions
+		emissionsAt = func(d *inmap.InMAP, _ time.Time) (*inmap.Emissions, error) {
+			if gridEmis == nil {
+				var err error
+				if gridEmis, err = emissions(d); err != nil {
+					return nil, err
+				}
+			}
+			return gridEmis, nil
+		}
+	} else {
+		emissionsAt = temporalEmissionsAEP(inventoryConfig, spatialConfig, emis, EmissionsMask, PlumeInGridDistance, NearRoadWidth, TemporalProfiles)
+		if TemporalProfiles.HasDiurnal() && step > time.Hour {
+			step = time.Hour
+		}
+	}
+	if StreamInterval > 0 {
+		step = gcdDuration(step, StreamInterval)
+	}
+
+	ctm := newCTMDataLoader(CTMDataCacheDir)
+	defer ctm.close()
+
+	var initFuncs []inmap.DomainManipulator
+	if createGrid {
+		log.Println("Loading CTM data...")
+		ctmData, err := ctm.load(InMAPData, VarGrid)
+		if err != nil {
+			return err
+		}
+		log.Println("Loading population and mortality rate data...")
+		pop, popIndices, mr, mortIndices, err := VarGrid.LoadPopMort()
+		if err != nil {
+			return err
+		}
+		mutator, err := VarGrid.RefinementMutator(popIndices, emis)
+		if err != nil {
+			return err
+		}
+		initFuncs = []inmap.DomainManipulator{
+			VarGrid.RegularGrid(ctmData, pop, popIndices, mr, mortIndices, nil, m),
+			VarGrid.MutateGrid(mutator, ctmData, pop, mr, nil, m, l.msgLog),
+		}
+	} else {
+		r, err := os.Open(VariableGridData)
+		if err != nil {
+			return fmt.Errorf("problem opening file to load VariableGridData: %v", err)
+		}
+		defer r.Close()
+		initFuncs = []inmap.DomainManipulator{inmap.Load(r, VarGrid, nil, m)}
+	}
+
+	d := &inmap.InMAP{
+		InitFuncs:      append(initFuncs, outputters[0].CheckOutputVars(m)),
+		CleanupFuncs:   []inmap.DomainManipulator{upload.uploadOutput},
+		Deterministic:  deterministic,
+		CellStorageDir: CellStorageDir,
+	}
+	log.Println("Initializing model...")
+	if err = d.Init(); err != nil {
+		return fmt.Errorf("InMAP: problem initializing model: %v\n", err)
+	}
+
+	scienceCalcs := inmap.Calculations(scienceFuncs...)
+	var linkVersion int64
+	for i, p := range Periods {
+		logProgress("inmap", fmt.Sprintf("Simulating period %s (%d of %d)...", p, i+1, len(Periods)), i, len(Periods))
+		var start time.Time
+		if TemporalProfiles != nil {
+			if start, err = time.Parse("20060102", p); err != nil {
+				return fmt.Errorf("inmap: temporal profiles require period names in the format YYYYMMDD: %v", err)
+			}
+		}
+		ctmData, err := ctm.load(PeriodData[i], VarGrid)
+		if err != nil {
+			return err
+		}
+		if err = inmap.SetCTMData(ctmData)(d); err != nil {
+			return fmt.Errorf("InMAP: problem setting up period %s: %v", p, err)
+		}
+		// The data has been copied into the grid cells, so any cached
+		// data doesn't need to stay mapped.
+		if err = ctm.close(); err != nil {
+			return err
+		}
+		var links []*mobile.Link
+		if Mobile != nil {
+			log.Printf("Waiting for mobile-source link emissions for period %s...", p)
+			if links, linkVersion, err = Mobile.NextLinks(context.Background(), linkVersion); err != nil {
+				return fmt.Errorf("InMAP: problem getting link emissions for period %s: %v", p, err)
+			}
+		}
+		for offset := time.Duration(0); offset < PeriodLength; offset += step {
+			length := step
+			if remaining := PeriodLength - offset; remaining < length {
+				length = remaining
+			}
+			gridEmis, err := emissionsAt(d, start.Add(offset))
+			if err != nil {
+				return fmt.Errorf("InMAP: problem setting up period %s: %v", p, err)
+			}
+			if Mobile != nil {
+				gridEmis = mobile.Emissions(gridEmis, links)
+			}
+			if err = inmap.ResetEmissionsFlux(gridEmis, m)(d); err != nil {
+				return fmt.Errorf("InMAP: problem setting up period %s: %v", p, err)
+			}
+			if err = inmap.SetTimestepCFL()(d); err != nil {
+				return fmt.Errorf("InMAP: problem setting up period %s: %v", p, err)
+			}
+			d.Done = false
+			d.RunFuncs = []inmap.DomainManipulator{
+				inmap.RunFor(length.Seconds()),
+				inmap.Log(l.cLog),
+				simulationMetrics(),
+				inmap.Calculations(inmap.AddEmissionsFlux()),
+				scienceCalcs,
+			}
+			if err = d.Run(); err != nil {
+				return fmt.Errorf("InMAP: problem running simulation: %v\n", err)
+			}
+			elapsed := time.Duration(i)*PeriodLength + offset + length
+			if stream != nil && StreamInterval > 0 && elapsed%StreamInterval == 0 {
+				if err = stream.Write(streamStart.Add(elapsed))(d); err != nil {
+					return err
+				}
+			}
+		}
+		if stream != nil && StreamInterval == 0 {
+			if err = stream.Write(streamStart.Add(time.Duration(i+1) * PeriodLength))(d); err != nil {
+				return err
+			}
+		}
+		if err = outputters[i].Output(sr)(d); err != nil {
+			return err
+		}
+		if Mobile != nil {
+			if err = Mobile.SaveConcentrations(links, linkVersion, m)(d); err != nil {
+				return err
+			}
+		}
+	}
+
+	if stream != nil {
+		// The stream needs to be closed before it is uploaded.
+		if err = stream.Close(); err != nil {
+			return err
+		}
+	}
+	if err = d.Cleanup(); err != nil {
+		return fmt.Errorf("InMAP: problem shutting down model: %v\n", err)
+	}
+
+	elapsedTime := time.Since(startTime)
+	log.Printf("Elapsed time: %f hours", elapsedTime.Hours())
+	return nil
+}
+
+// gcdDuration returns the greatest common divisor of a and b.
+func gcdDuration(a, b time.Duration) time.Duration {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
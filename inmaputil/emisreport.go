@@ -0,0 +1,444 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/ctessum/geom/proj"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/emissions/aep/aeputil"
+)
+
+// reportSpecies are the emitted species that are included in emissions
+// reports, named as in emissions shapefiles.
+var reportSpecies = []string{"VOC", "NOx", "NH3", "SOx", "PM2_5"}
+
+// speciesAliases are the names of emissions shapefile fields or inventory
+// pollutants that are probably meant to be one of the reportSpecies but
+// are not used by InMAP under those names.
+var speciesAliases = map[string]string{
+	"pm25":      "PM2_5",
+	"pm2.5":     "PM2_5",
+	"pm25_pri":  "PM2_5",
+	"pm25-pri":  "PM2_5",
+	"pm2_5_pri": "PM2_5",
+	"so2":       "SOx",
+	"no2":       "NOx",
+	"no":        "NOx",
+	"rog":       "VOC",
+	"tog":       "VOC",
+	"nmog":      "VOC",
+	"nmvoc":     "VOC",
+	"nmhc":      "VOC",
+}
+
+const (
+	// tonsPerUgPerS converts emissions from μg/s to short tons/year.
+	tonsPerUgPerS = 3600. * 8760. / 907184740000.
+
+	// maxRecordTons is the largest plausible emissions rate
+	// [short tons/year] of a single pollutant from a single emissions
+	// record, which is about ten times the emissions of the largest
+	// individual sources in the U.S. Larger values usually mean that the
+	// emissions units are wrong.
+	maxRecordTons = 1.e6
+
+	// mapWidth is the maximum width in characters of emissions maps.
+	mapWidth = 60
+
+	// mapShades are the characters used for increasing emissions in
+	// emissions maps.
+	mapShades = " .:-=+*#%@"
+)
+
+// emisReport accumulates the information in an emissions report.
+type emisReport struct {
+	sectors []string
+	totals  map[string]*[5]float64 // by sector [short tons/year]
+	outside [5]float64             // outside of the grid or mask [short tons/year]
+
+	mask   geom.Polygon
+	bounds *geom.Bounds
+	nx, ny int
+	maps   [5][]float64
+
+	warnings, problems []string
+}
+
+// newEmisReport initializes an emissions report for the grid specified
+// by VarGrid.
+func newEmisReport(VarGrid *inmap.VarGridConfig, mask geom.Polygon) *emisReport {
+	r := &emisReport{totals: make(map[string]*[5]float64), mask: mask}
+	if len(VarGrid.Xnests) > 0 && len(VarGrid.Ynests) > 0 {
+		r.bounds = &geom.Bounds{
+			Min: geom.Point{X: VarGrid.VariableGridXo, Y: VarGrid.VariableGridYo},
+			Max: geom.Point{
+				X: VarGrid.VariableGridXo + VarGrid.VariableGridDx*float64(VarGrid.Xnests[0]),
+				Y: VarGrid.VariableGridYo + VarGrid.VariableGridDy*float64(VarGrid.Ynests[0]),
+			},
+		}
+		w, h := r.bounds.Max.X-r.bounds.Min.X, r.bounds.Max.Y-r.bounds.Min.Y
+		if w > 0 && h > 0 {
+			r.nx = mapWidth
+			// Characters are about twice as tall as they are wide.
+			r.ny = int(math.Max(1, math.Round(mapWidth*h/w/2)))
+			for i := range r.maps {
+				r.maps[i] = make([]float64, r.nx*r.ny)
+			}
+		}
+	}
+	return r
+}
+
+// sectorCounts holds the number of records in a sector that have
+// each type of issue.
+type sectorCounts struct {
+	noGeom, invalid, outside, large int
+}
+
+// add adds the emissions vals [short tons/year] at location g, which is in
+// the grid spatial reference, to sector.
+func (r *emisReport) add(sector string, g geom.Geom, vals [5]float64, counts *sectorCounts) {
+	t, ok := r.totals[sector]
+	if !ok {
+		t = new([5]float64)
+		r.totals[sector] = t
+		r.sectors = append(r.sectors, sector)
+	}
+	if g == nil {
+		counts.noGeom++
+		return
+	}
+	for _, v := range vals {
+		if math.IsNaN(v) || math.IsInf(v, 0) || v < 0 {
+			counts.invalid++
+			return
+		}
+	}
+	for _, v := range vals {
+		if v > maxRecordTons {
+			counts.large++
+			break
+		}
+	}
+	// Records are located by the centers of their bounding boxes.
+	p := g.Bounds().Centroid()
+	in := r.bounds == nil || (p.X >= r.bounds.Min.X && p.X < r.bounds.Max.X && p.Y >= r.bounds.Min.Y && p.Y < r.bounds.Max.Y)
+	if in && r.mask != nil && p.Within(r.mask) == geom.Outside {
+		in = false
+	}
+	if !in {
+		counts.outside++
+		for i, v := range vals {
+			r.outside[i] += v
+		}
+		return
+	}
+	for i, v := range vals {
+		t[i] += v
+	}
+	if r.nx > 0 {
+		ix := int((p.X - r.bounds.Min.X) / (r.bounds.Max.X - r.bounds.Min.X) * float64(r.nx))
+		iy := int((p.Y - r.bounds.Min.Y) / (r.bounds.Max.Y - r.bounds.Min.Y) * float64(r.ny))
+		for i, v := range vals {
+			r.maps[i][iy*r.nx+ix] += v
+		}
+	}
+}
+
+// finishSector adds warnings and problems for the issues in counts.
+func (r *emisReport) finishSector(sector string, counts *sectorCounts) {
+	if counts.noGeom > 0 {
+		r.warnings = append(r.warnings, fmt.Sprintf("%s: %d records have no geometry and are ignored", sector, counts.noGeom))
+	}
+	if counts.invalid > 0 {
+		r.problems = append(r.problems, fmt.Sprintf("%s: %d records have negative or invalid emissions", sector, counts.invalid))
+	}
+	if counts.outside > 0 {
+		r.warnings = append(r.warnings, fmt.Sprintf("%s: %d records are outside of the grid or the emissions mask and are ignored", sector, counts.outside))
+	}
+	if counts.large > 0 {
+		r.warnings = append(r.warnings, fmt.Sprintf("%s: %d records have more than %g short tons/year of a single pollutant; check that the emissions units are correct", sector, counts.large, maxRecordTons))
+	}
+}
+
+// addShapefile adds the emissions in the shapefile fname, which are in
+// the given units, to the report.
+func (r *emisReport) addShapefile(fname, units string, gridSR *proj.SR) error {
+	var conv float64
+	switch units {
+	case "tons/year":
+		conv = 1
+	case "kg/year":
+		conv = 1 / 907.18474
+	case "ug/s", "μg/s":
+		conv = tonsPerUgPerS
+	default:
+		return fmt.Errorf("inmap: invalid emissions units '%s'", units)
+	}
+	sector := filepath.Base(strings.TrimSuffix(fname, ".shp"))
+	f, err := shp.NewDecoder(fname)
+	if err != nil {
+		r.problems = append(r.problems, fmt.Sprintf("%s: %v", sector, err))
+		return nil
+	}
+	defer f.Close()
+	sr, err := f.SR()
+	if err != nil {
+		r.problems = append(r.problems, fmt.Sprintf("%s: reading the spatial reference (.prj) file: %v", sector, err))
+		return nil
+	}
+	trans, err := sr.NewTransform(gridSR)
+	if err != nil {
+		r.problems = append(r.problems, fmt.Sprintf("%s: %v", sector, err))
+		return nil
+	}
+
+	// Check the fields.
+	fields := make(map[string]bool)
+	for _, fld := range f.Fields() {
+		fields[strings.ToLower(strings.TrimRight(string(fld.Name[:]), "\x00"))] = true
+	}
+	var found int
+	for _, s := range reportSpecies {
+		if fields[strings.ToLower(s)] {
+			found++
+			continue
+		}
+		var alias []string
+		for a, s2 := range speciesAliases {
+			if s2 == s && fields[a] {
+				alias = append(alias, a)
+			}
+		}
+		sort.Strings(alias)
+		if len(alias) > 0 {
+			r.warnings = append(r.warnings, fmt.Sprintf("%s: there is no %s field, but field(s) %v, which are ignored, may be meant to be %s", sector, s, alias, s))
+		} else {
+			r.warnings = append(r.warnings, fmt.Sprintf("%s: there is no %s field, so the %s emissions are zero", sector, s, s))
+		}
+	}
+	if found == 0 {
+		r.problems = append(r.problems, fmt.Sprintf("%s: there are no emissions fields; the fields should be named %v", sector, reportSpecies))
+	}
+
+	var counts sectorCounts
+	for {
+		var e inmap.EmisRecord
+		if ok := f.DecodeRow(&e); !ok {
+			break
+		}
+		var g geom.Geom
+		if e.Geom != nil {
+			if g, err = e.Transform(trans); err != nil {
+				r.problems = append(r.problems, fmt.Sprintf("%s: %v", sector, err))
+				return nil
+			}
+		}
+		if e.Height < 0 {
+			counts.invalid++
+			continue
+		}
+		r.add(sector, g, [5]float64{e.VOC * conv, e.NOx * conv, e.NH3 * conv, e.SOx * conv, e.PM25 * conv}, &counts)
+	}
+	if err := f.Error(); err != nil {
+		r.problems = append(r.problems, fmt.Sprintf("%s: %v", sector, err))
+	}
+	r.finishSector(sector, &counts)
+	return nil
+}
+
+// addInventory adds the emissions in the inventory files specified by
+// inventoryConfig to the report, grouped by sector.
+func (r *emisReport) addInventory(inventoryConfig *aeputil.InventoryConfig, gridSR *proj.SR) error {
+	if len(inventoryConfig.NEIFiles) == 0 && len(inventoryConfig.COARDSFiles) == 0 && len(inventoryConfig.DeltaFiles) == 0 {
+		return nil
+	}
+	recs, _, err := inventoryConfig.ReadEmissions()
+	if err != nil {
+		return err
+	}
+	sectors := make([]string, 0, len(recs))
+	for sector := range recs {
+		sectors = append(sectors, sector)
+	}
+	sort.Strings(sectors)
+	index := make(map[string]int)
+	for i, s := range reportSpecies {
+		index[s] = i
+	}
+	for _, sector := range sectors {
+		var counts sectorCounts
+		unused := make(map[string]bool)
+		for _, rec := range recs[sector] {
+			var vals [5]float64
+			for pol, v := range rec.Totals() {
+				i, ok := index[pol.Name]
+				if !ok {
+					if pol.Name != "EC" && pol.Name != "OC" && pol.Name != "PM10" {
+						unused[pol.Name] = true
+					}
+					continue
+				}
+				vals[i] += v.Value() / 907.18474 // kg/year to short tons/year
+			}
+			g, err := rec.Location().Reproject(gridSR)
+			if err != nil {
+				return err
+			}
+			r.add(sector, g, vals, &counts)
+		}
+		r.finishSector(sector, &counts)
+		if len(unused) > 0 {
+			var pols []string
+			for p := range unused {
+				if s, ok := speciesAliases[strings.ToLower(p)]; ok {
+					p += " (" + s + "?)"
+				}
+				pols = append(pols, p)
+			}
+			sort.Strings(pols)
+			r.warnings = append(r.warnings, fmt.Sprintf("%s: pollutant(s) %v are not used by InMAP; see the aep.InventoryConfig.PolsToKeep and speciation options", sector, pols))
+		}
+	}
+	return nil
+}
+
+// write writes the report to w.
+func (r *emisReport) write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Total emissions (short tons/year):")
+	fmt.Fprintf(tw, "Sector\t%s\t\n", strings.Join(reportSpecies, "\t"))
+	row := func(name string, vals [5]float64) {
+		fmt.Fprintf(tw, "%s\t", name)
+		for _, v := range vals {
+			fmt.Fprintf(tw, "%.4g\t", v)
+		}
+		fmt.Fprintln(tw)
+	}
+	var total [5]float64
+	for _, s := range r.sectors {
+		row(s, *r.totals[s])
+		for i, v := range r.totals[s] {
+			total[i] += v
+		}
+	}
+	row("Total", total)
+	row("Outside grid or mask", r.outside)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if r.nx > 0 {
+		for i, s := range reportSpecies {
+			if total[i] == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "\n%s emissions in the grid (from %q to %q over four orders of magnitude; north is up):\n", s, mapShades[1:2], mapShades[len(mapShades)-1:])
+			fmt.Fprintf(w, "+%s+\n", strings.Repeat("-", r.nx))
+			var max float64
+			for _, v := range r.maps[i] {
+				max = math.Max(max, v)
+			}
+			for y := r.ny - 1; y >= 0; y-- {
+				line := make([]byte, r.nx)
+				for x := range line {
+					line[x] = mapShade(r.maps[i][y*r.nx+x], max)
+				}
+				fmt.Fprintf(w, "|%s|\n", line)
+			}
+			fmt.Fprintf(w, "+%s+\n", strings.Repeat("-", r.nx))
+		}
+	}
+
+	for _, list := range []struct {
+		title string
+		msgs  []string
+	}{{"Warnings", r.warnings}, {"Problems", r.problems}} {
+		if len(list.msgs) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s:\n", list.title)
+		for _, m := range list.msgs {
+			fmt.Fprintf(w, "  - %s\n", m)
+		}
+	}
+	return nil
+}
+
+// mapShade returns the map character for emissions v, where max is the
+// largest value in the map. The levels cover four orders of magnitude.
+func mapShade(v, max float64) byte {
+	if !(v > 0) || !(max > 0) {
+		return mapShades[0]
+	}
+	n := len(mapShades) - 1
+	level := int(math.Ceil(float64(n) * (math.Log10(v/max) + 4) / 4))
+	if level < 1 {
+		level = 1
+	} else if level > n {
+		level = n
+	}
+	return mapShades[level]
+}
+
+// EmissionsReport reads the emissions in EmissionsShapefiles, which are in
+// the units EmissionUnits, and the emissions inventory files specified
+// by inventoryConfig, checks them for problems, and writes a report to
+// w with the total emissions of each pollutant from each sector (each
+// shapefile or inventory sector), maps of the emissions in the grid
+// specified by VarGrid, and any warnings and problems that were found.
+// Warnings include missing or misnamed pollutant fields and records with
+// emissions that are implausibly large, which usually means that the
+// emissions units are wrong. Emissions outside of the grid or
+// EmissionsMask are reported separately. An error is returned if any
+// problems were found, such as negative emissions or shapefiles that
+// cannot be read.
+func EmissionsReport(w io.Writer, EmissionUnits string, EmissionsShapefiles []string, EmissionsMask geom.Polygon,
+	VarGrid *inmap.VarGridConfig, inventoryConfig *aeputil.InventoryConfig) error {
+	gridSR, err := spatialRef(VarGrid)
+	if err != nil {
+		return err
+	}
+	r := newEmisReport(VarGrid, EmissionsMask)
+	for _, f := range EmissionsShapefiles {
+		if err := r.addShapefile(f, EmissionUnits, gridSR); err != nil {
+			return err
+		}
+	}
+	if err := r.addInventory(inventoryConfig, gridSR); err != nil {
+		return err
+	}
+	if err := r.write(w); err != nil {
+		return err
+	}
+	if len(r.problems) > 0 {
+		return fmt.Errorf("inmap: found %d problem(s) with the emissions", len(r.problems))
+	}
+	return nil
+}
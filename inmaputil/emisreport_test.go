@@ -0,0 +1,112 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/emissions/aep/aeputil"
+)
+
+func TestEmissionsReportCmd(t *testing.T) {
+	cfg := InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	var b bytes.Buffer
+	cfg.Root.SetOutput(&b)
+	cfg.Root.SetArgs([]string{"emissions", "report"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"testEmis", "Total", "SOx emissions in the grid"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("report should contain %q:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestEmissionsReport(t *testing.T) {
+	dir, err := os.MkdirTemp("", "emisreport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	type record struct {
+		geom.Point
+		SOx  float64
+		PM25 float64
+	}
+	fname := filepath.Join(dir, "badEmis.shp")
+	e, err := shp.NewEncoder(fname, record{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []record{
+		{Point: geom.Point{X: -3000, Y: -3000}, SOx: 1, PM25: 1},
+		{Point: geom.Point{X: 3000, Y: 3000}, SOx: 5.e6},
+		{Point: geom.Point{X: 0, Y: 0}, SOx: -1},
+		{Point: geom.Point{X: 100000, Y: 0}, SOx: 1},
+	} {
+		if err = e.Encode(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.Close()
+	prj, err := os.ReadFile("../cmd/inmap/testdata/testEmis.prj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "badEmis.prj"), prj, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	vgc := &inmap.VarGridConfig{
+		VariableGridXo: -4000,
+		VariableGridYo: -4000,
+		VariableGridDx: 4000,
+		VariableGridDy: 4000,
+		Xnests:         []int{2},
+		Ynests:         []int{2},
+		GridProj:       "+proj=lcc +lat_1=33.000000 +lat_2=45.000000 +lat_0=40.000000 +lon_0=-97.000000 +x_0=0 +y_0=0 +a=6370997.000000 +b=6370997.000000 +to_meter=1",
+	}
+	var b bytes.Buffer
+	err = EmissionsReport(&b, "tons/year", []string{fname}, nil, vgc, &aeputil.InventoryConfig{})
+	if err == nil {
+		t.Error("negative emissions should cause an error")
+	}
+	for _, want := range []string{
+		"there is no PM2_5 field, but field(s) [pm25]",
+		"there is no VOC field",
+		"1 records have negative or invalid emissions",
+		"1 records are outside of the grid",
+		"1 records have more than 1e+06 short tons/year",
+		"5e+06",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("report should contain %q:\n%s", want, b.String())
+		}
+	}
+}
@@ -0,0 +1,413 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/ctessum/geom/index/rtree"
+	"github.com/ctessum/geom/proj"
+	"github.com/yuzhou-wang/inmap/emissions/aep/aeputil"
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+)
+
+// aqsMassUnits are the units of measure in AQS monitor files that
+// are mass concentrations in μg/m³.
+var aqsMassUnits = map[string]bool{
+	"Micrograms/cubic meter (LC)":   true,
+	"Micrograms/cubic meter (25 C)": true,
+}
+
+// monitor is the annual average concentration measured at a monitoring
+// site.
+type monitor struct {
+	Site     string
+	Lon, Lat float64
+	Value    float64
+	n        int
+}
+
+// EvalStats holds statistics comparing modeled and measured
+// concentrations.
+type EvalStats struct {
+	// N is the number of monitors.
+	N int
+
+	// MeanObs and MeanModel are the average measured and modeled
+	// concentrations.
+	MeanObs, MeanModel float64
+
+	// MB is the mean bias, and NMB is the normalized mean bias,
+	// i.e., Σ(model - obs) / Σ(obs).
+	MB, NMB float64
+
+	// ME is the mean error, and NME is the normalized mean error,
+	// i.e., Σ|model - obs| / Σ(obs).
+	ME, NME float64
+
+	// RMSE is the root-mean-square error.
+	RMSE float64
+
+	// R2 is the square of the Pearson correlation coefficient.
+	R2 float64
+}
+
+// evalStatistics calculates statistics comparing the modeled concentrations
+// mod to the measured concentrations obs.
+func evalStatistics(obs, mod []float64) EvalStats {
+	s := EvalStats{N: len(obs)}
+	if len(obs) == 0 {
+		nan := math.NaN()
+		s.MeanObs, s.MeanModel, s.MB, s.NMB, s.ME, s.NME, s.RMSE, s.R2 = nan, nan, nan, nan, nan, nan, nan, nan
+		return s
+	}
+	var sumObs, sumMod, sumDiff, sumAbsDiff, sumSqDiff float64
+	for i, o := range obs {
+		d := mod[i] - o
+		sumObs += o
+		sumMod += mod[i]
+		sumDiff += d
+		sumAbsDiff += math.Abs(d)
+		sumSqDiff += d * d
+	}
+	n := float64(len(obs))
+	s.MeanObs = sumObs / n
+	s.MeanModel = sumMod / n
+	s.MB = sumDiff / n
+	s.NMB = sumDiff / sumObs
+	s.ME = sumAbsDiff / n
+	s.NME = sumAbsDiff / sumObs
+	s.RMSE = math.Sqrt(sumSqDiff / n)
+
+	var cov, varObs, varMod float64
+	for i, o := range obs {
+		cov += (o - s.MeanObs) * (mod[i] - s.MeanModel)
+		varObs += (o - s.MeanObs) * (o - s.MeanObs)
+		varMod += (mod[i] - s.MeanModel) * (mod[i] - s.MeanModel)
+	}
+	s.R2 = cov * cov / (varObs * varMod)
+	return s
+}
+
+// readAQSMonitors reads the annual average concentrations of the given
+// AQS parameters (e.g., "PM2.5 - Local Conditions") from the AQS annual
+// concentration by monitor files (annual_conc_by_monitor_YYYY.csv),
+// returning them in the form map[parameter][]monitor. Values measured with
+// different instruments or for different standards at the same site are
+// averaged, values that include exceptional events are skipped when values
+// that exclude them are available, and values that are not in units of
+// μg/m³ are skipped.
+func readAQSMonitors(files []string, parameters map[string]bool) (map[string][]*monitor, error) {
+	sites := make(map[string]map[string]*monitor)
+	for p := range parameters {
+		sites[p] = make(map[string]*monitor)
+	}
+	for _, file := range files {
+		if !strings.EqualFold(filepath.Ext(file), ".csv") {
+			continue
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: opening AQS monitor file: %v", err)
+		}
+		r := csv.NewReader(f)
+		r.ReuseRecord = true
+		header, err := r.Read()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("inmap: reading AQS monitor file %s: %v", file, err)
+		}
+		col := make(map[string]int)
+		for i, h := range header {
+			col[strings.TrimSpace(h)] = i
+		}
+		for _, c := range []string{"State Code", "County Code", "Site Num", "Latitude", "Longitude",
+			"Parameter Name", "Units of Measure", "Event Type", "Arithmetic Mean"} {
+			if _, ok := col[c]; !ok {
+				f.Close()
+				return nil, fmt.Errorf("inmap: AQS monitor file %s is missing column '%s'", file, c)
+			}
+		}
+		for {
+			rec, err := r.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("inmap: reading AQS monitor file %s: %v", file, err)
+			}
+			p := rec[col["Parameter Name"]]
+			if !parameters[p] || !aqsMassUnits[rec[col["Units of Measure"]]] ||
+				rec[col["Event Type"]] == "Events Included" {
+				continue
+			}
+			v, err := strconv.ParseFloat(rec[col["Arithmetic Mean"]], 64)
+			if err != nil {
+				continue
+			}
+			lat, err := strconv.ParseFloat(rec[col["Latitude"]], 64)
+			if err != nil {
+				return nil, fmt.Errorf("inmap: AQS monitor file %s: invalid latitude: %v", file, err)
+			}
+			lon, err := strconv.ParseFloat(rec[col["Longitude"]], 64)
+			if err != nil {
+				return nil, fmt.Errorf("inmap: AQS monitor file %s: invalid longitude: %v", file, err)
+			}
+			site := rec[col["State Code"]] + "-" + rec[col["County Code"]] + "-" + rec[col["Site Num"]]
+			m, ok := sites[p][site]
+			if !ok {
+				m = &monitor{Site: site, Lon: lon, Lat: lat}
+				sites[p][site] = m
+			}
+			m.Value += v
+			m.n++
+		}
+		f.Close()
+	}
+	out := make(map[string][]*monitor, len(sites))
+	for p, s := range sites {
+		for _, m := range s {
+			m.Value /= float64(m.n)
+			out[p] = append(out[p], m)
+		}
+		sort.Slice(out[p], func(i, j int) bool { return out[p][i].Site < out[p][j].Site })
+	}
+	return out, nil
+}
+
+// modelCell is a grid cell in a model output shapefile.
+type modelCell struct {
+	geom.Polygonal
+	vals map[string]float64
+}
+
+// readModelCells reads the given variables from the model output
+// shapefile fileName into an index and returns the index along with the
+// spatial reference of the shapefile.
+func readModelCells(fileName string, vars []string) (*rtree.Rtree, *proj.SR, error) {
+	dec, err := shp.NewDecoder(fileName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("inmap: opening model output file: %v", err)
+	}
+	defer dec.Close()
+	sr, err := dec.SR()
+	if err != nil {
+		return nil, nil, fmt.Errorf("inmap: reading projection of model output file: %v", err)
+	}
+	index := rtree.NewTree(25, 50)
+	for {
+		g, fields, more := dec.DecodeRowFields(vars...)
+		if !more {
+			break
+		}
+		p, ok := g.(geom.Polygonal)
+		if !ok {
+			return nil, nil, fmt.Errorf("inmap: model output file %s has %T geometry but should be polygonal", fileName, g)
+		}
+		c := &modelCell{Polygonal: p, vals: make(map[string]float64, len(vars))}
+		for _, v := range vars {
+			s, ok := fields[v]
+			if !ok {
+				return nil, nil, fmt.Errorf("inmap: model output file %s does not have variable '%s'", fileName, v)
+			}
+			if c.vals[v], err = strconv.ParseFloat(strings.TrimSpace(s), 64); err != nil {
+				return nil, nil, fmt.Errorf("inmap: model output file %s: variable '%s': %v", fileName, v, err)
+			}
+		}
+		index.Insert(c)
+	}
+	if err := dec.Error(); err != nil {
+		return nil, nil, fmt.Errorf("inmap: reading model output file: %v", err)
+	}
+	return index, sr, nil
+}
+
+// Evaluate compares the modeled concentrations in the InMAP output
+// shapefile ModelFile to annual average concentrations measured at
+// U.S. EPA Air Quality System (AQS) monitors in the given year.
+//
+// MonitorFile is the location of the AQS annual concentration by monitor
+// file (annual_conc_by_monitor_YYYY.zip or .csv), which can be a URL or a
+// local path, where the text "[YEAR]" is replaced by year. Files at
+// URLs are downloaded to CacheDir the first time they are needed
+// (see aeputil.Fetch).
+//
+// Pollutants maps the names of the variables in ModelFile to the
+// corresponding AQS parameter names, for example
+// {"TotalPM25": "PM2.5 - Local Conditions"}. Each monitor is paired with
+// the grid cell that contains it.
+//
+// The statistics for each pollutant (see EvalStats) are written to
+// OutputFile in CSV format and to w. The paired measured and modeled
+// values are written to a CSV file whose name is OutputFile with "_pairs"
+// added before the extension, and scatter plots of the pairs are written
+// to PNG files whose names are OutputFile with "_" and the name of each
+// variable added before the extension.
+func Evaluate(ctx context.Context, w io.Writer, year int, MonitorFile, CacheDir, ModelFile string, Pollutants map[string]string, OutputFile string, outChan chan string) error {
+	if len(Pollutants) == 0 {
+		return fmt.Errorf("inmap: no pollutants are specified for evaluation")
+	}
+	if CacheDir == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return fmt.Errorf("inmap: finding AQS cache directory: %v", err)
+		}
+		CacheDir = filepath.Join(dir, "inmap", "aqs")
+	}
+	location := strings.Replace(os.ExpandEnv(MonitorFile), "[YEAR]", strconv.Itoa(year), -1)
+	outChan <- fmt.Sprintf("retrieving %s\n", location)
+	files, err := aeputil.Fetch(ctx, location, CacheDir)
+	if err != nil {
+		return err
+	}
+
+	vars := make([]string, 0, len(Pollutants))
+	parameters := make(map[string]bool)
+	for v, p := range Pollutants {
+		vars = append(vars, v)
+		parameters[p] = true
+	}
+	sort.Strings(vars)
+	monitors, err := readAQSMonitors(files, parameters)
+	if err != nil {
+		return err
+	}
+	cells, sr, err := readModelCells(ModelFile, vars)
+	if err != nil {
+		return err
+	}
+	lonLat, err := proj.Parse("+proj=longlat")
+	if err != nil {
+		return err
+	}
+	t, err := lonLat.NewTransform(sr)
+	if err != nil {
+		return fmt.Errorf("inmap: evaluation: %v", err)
+	}
+
+	base := strings.TrimSuffix(OutputFile, filepath.Ext(OutputFile))
+	pairsFile, err := os.Create(base + "_pairs.csv")
+	if err != nil {
+		return fmt.Errorf("inmap: creating evaluation output file: %v", err)
+	}
+	defer pairsFile.Close()
+	pairs := csv.NewWriter(pairsFile)
+	pairs.Write([]string{"Variable", "Parameter", "Site", "Lon", "Lat", "Measured", "Modeled"})
+
+	statsFile, err := os.Create(OutputFile)
+	if err != nil {
+		return fmt.Errorf("inmap: creating evaluation output file: %v", err)
+	}
+	defer statsFile.Close()
+	stats := csv.NewWriter(statsFile)
+	stats.Write([]string{"Variable", "Parameter", "N", "MeanObs", "MeanModel", "MB", "NMB", "ME", "NME", "RMSE", "R2"})
+	fmt.Fprintf(w, "%-15s %6s %10s %10s %10s %8s %10s %10s %6s\n", "Variable", "N", "MeanObs", "MeanModel", "MB", "NMB", "ME", "RMSE", "R²")
+
+	f := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+	for _, v := range vars {
+		p := Pollutants[v]
+		var obs, mod []float64
+		for _, m := range monitors[p] {
+			gI, err := geom.Point{X: m.Lon, Y: m.Lat}.Transform(t)
+			if err != nil {
+				return fmt.Errorf("inmap: evaluation: %v", err)
+			}
+			pt := gI.(geom.Point)
+			var cell *modelCell
+			for _, cI := range cells.SearchIntersect(pt.Bounds()) {
+				if c := cI.(*modelCell); pt.Within(c.Polygonal) != geom.Outside {
+					cell = c
+					break
+				}
+			}
+			if cell == nil {
+				continue // The monitor is outside of the model domain.
+			}
+			obs = append(obs, m.Value)
+			mod = append(mod, cell.vals[v])
+			pairs.Write([]string{v, p, m.Site, f(m.Lon), f(m.Lat), f(m.Value), f(cell.vals[v])})
+		}
+		s := evalStatistics(obs, mod)
+		stats.Write([]string{v, p, strconv.Itoa(s.N), f(s.MeanObs), f(s.MeanModel), f(s.MB), f(s.NMB),
+			f(s.ME), f(s.NME), f(s.RMSE), f(s.R2)})
+		fmt.Fprintf(w, "%-15s %6d %10.4g %10.4g %10.4g %7.1f%% %10.4g %10.4g %6.3f\n",
+			v, s.N, s.MeanObs, s.MeanModel, s.MB, s.NMB*100, s.ME, s.RMSE, s.R2)
+		if s.N == 0 {
+			outChan <- fmt.Sprintf("no %s monitors are within the model domain\n", p)
+			continue
+		}
+		if err := scatterPlot(base+"_"+v+".png", v, p, obs, mod, s); err != nil {
+			return err
+		}
+	}
+	pairs.Flush()
+	if err := pairs.Error(); err != nil {
+		return fmt.Errorf("inmap: writing evaluation output file: %v", err)
+	}
+	stats.Flush()
+	if err := stats.Error(); err != nil {
+		return fmt.Errorf("inmap: writing evaluation output file: %v", err)
+	}
+	return nil
+}
+
+// scatterPlot writes a scatter plot of the modeled versus measured
+// concentrations of variable v, which corresponds to AQS parameter p,
+// to fileName.
+func scatterPlot(fileName, v, p string, obs, mod []float64, s EvalStats) error {
+	plt, err := plot.New()
+	if err != nil {
+		return err
+	}
+	plt.Title.Text = fmt.Sprintf("%s (N = %d, NMB = %.0f%%, R² = %.2f)", v, s.N, s.NMB*100, s.R2)
+	plt.X.Label.Text = "Measured " + p + " (μg/m³)"
+	plt.Y.Label.Text = "Modeled " + v + " (μg/m³)"
+	xys := make(plotter.XYs, len(obs))
+	maxVal := 0.
+	for i := range obs {
+		xys[i].X, xys[i].Y = obs[i], mod[i]
+		maxVal = math.Max(maxVal, math.Max(obs[i], mod[i]))
+	}
+	scatter, err := plotter.NewScatter(xys)
+	if err != nil {
+		return err
+	}
+	oneToOne := plotter.NewFunction(func(x float64) float64 { return x })
+	oneToOne.Dashes = []vg.Length{vg.Points(2), vg.Points(2)}
+	plt.Add(scatter, oneToOne)
+	plt.X.Min, plt.Y.Min = 0, 0
+	plt.X.Max, plt.Y.Max = maxVal*1.05, maxVal*1.05
+	if err := plt.Save(5*vg.Inch, 5*vg.Inch, fileName); err != nil {
+		return fmt.Errorf("inmap: writing evaluation plot: %v", err)
+	}
+	return nil
+}
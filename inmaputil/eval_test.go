@@ -0,0 +1,244 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"bytes"
+	"encoding/csv"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ctessum/cdf"
+	"github.com/ctessum/geom/encoding/shp"
+)
+
+func TestEvalStatistics(t *testing.T) {
+	s := evalStatistics([]float64{1, 2, 3, 4}, []float64{2, 3, 4, 5})
+	want := EvalStats{N: 4, MeanObs: 2.5, MeanModel: 3.5, MB: 1, NMB: 0.4, ME: 1, NME: 0.4, RMSE: 1, R2: 1}
+	if s != want {
+		t.Errorf("have %+v, want %+v", s, want)
+	}
+	s = evalStatistics([]float64{1, 2, 3}, []float64{3, 2, 1})
+	if s.MB != 0 || math.Abs(s.R2-1) > 1.e-12 || math.Abs(s.RMSE-math.Sqrt(8./3)) > 1.e-12 {
+		t.Errorf("invalid statistics %+v", s)
+	}
+	if s := evalStatistics(nil, nil); s.N != 0 || !math.IsNaN(s.NMB) {
+		t.Errorf("invalid statistics without data %+v", s)
+	}
+}
+
+func TestEvalCmd(t *testing.T) {
+	dir, err := os.MkdirTemp("", "eval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := InitializeConfig()
+	cfg.Set("static", true)
+	cfg.Set("createGrid", true)
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	out := filepath.Join(dir, "output.shp")
+	cfg.Set("OutputFile", out)
+	cfg.Set("LogFile", filepath.Join(dir, "output.log"))
+	cfg.Set("OutputVariables", map[string]string{"TotalPM25": "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA", "SOx": "SOx"})
+	cfg.Root.SetArgs([]string{"run", "steady"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first two monitors are at the same site, the third is
+	// outside of the domain, and the fourth is a different pollutant.
+	monitors := `"State Code","County Code","Site Num","Parameter Code","POC","Latitude","Longitude","Datum","Parameter Name","Event Type","Units of Measure","Arithmetic Mean"
+"01","001","0001","88101",1,40.0,-97.0,"WGS84","PM2.5 - Local Conditions","No Events","Micrograms/cubic meter (LC)",8.0
+"01","001","0001","88101",2,40.0,-97.0,"WGS84","PM2.5 - Local Conditions","No Events","Micrograms/cubic meter (LC)",10.0
+"01","001","0002","88101",1,45.0,-80.0,"WGS84","PM2.5 - Local Conditions","No Events","Micrograms/cubic meter (LC)",5.0
+"01","001","0001","42401",1,40.0,-97.0,"WGS84","Sulfur dioxide","No Events","Parts per billion",1.0
+`
+	monitorFile := filepath.Join(dir, "annual_conc_by_monitor_[YEAR].csv")
+	if err := os.WriteFile(strings.Replace(monitorFile, "[YEAR]", "2011", 1), []byte(monitors), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg = InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("Eval.ModelFile", out)
+	cfg.Set("Eval.Year", 2011)
+	cfg.Set("Eval.MonitorFile", monitorFile)
+	cfg.Set("Eval.CacheDir", filepath.Join(dir, "cache"))
+	cfg.Set("Eval.Pollutants", map[string]string{"TotalPM25": "PM2.5 - Local Conditions", "SOx": "Sulfur dioxide"})
+	evalFile := filepath.Join(dir, "eval.csv")
+	cfg.Set("Eval.OutputFile", evalFile)
+	var b bytes.Buffer
+	cfg.Root.SetOutput(&b)
+	cfg.Root.SetArgs([]string{"eval"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "TotalPM25") {
+		t.Errorf("the statistics should be printed:\n%s", b.String())
+	}
+
+	read := func(f string) [][]string {
+		r, err := os.Open(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		recs, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return recs
+	}
+	stats := read(evalFile)
+	if len(stats) != 3 || stats[2][0] != "TotalPM25" || stats[2][2] != "1" || stats[2][3] != "9" {
+		t.Errorf("invalid statistics: %v", stats)
+	}
+	if stats[1][0] != "SOx" || stats[1][2] != "0" {
+		t.Errorf("measurements that are not in μg/m³ should be skipped: %v", stats)
+	}
+	pairs := read(filepath.Join(dir, "eval_pairs.csv"))
+	if len(pairs) != 2 || pairs[1][2] != "01-001-0001" {
+		t.Errorf("invalid pairs: %v", pairs)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "eval_TotalPM25.png")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEvalCmd_surface(t *testing.T) {
+	dir, err := os.MkdirTemp("", "eval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := InitializeConfig()
+	cfg.Set("static", true)
+	cfg.Set("createGrid", true)
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	out := filepath.Join(dir, "output.shp")
+	cfg.Set("OutputFile", out)
+	cfg.Set("LogFile", filepath.Join(dir, "output.log"))
+	cfg.Root.SetArgs([]string{"run", "steady"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a surface covering the domain with a concentration of 5 μg/m³.
+	var lats, lons []float64
+	for lat := 20.5; lat < 60; lat++ {
+		lats = append(lats, lat)
+	}
+	for lon := -139.5; lon < -50; lon++ {
+		lons = append(lons, lon)
+	}
+	h := cdf.NewHeader([]string{"lat", "lon"}, []int{len(lats), len(lons)})
+	h.AddVariable("lat", []string{"lat"}, []float64{0})
+	h.AddVariable("lon", []string{"lon"}, []float64{0})
+	h.AddVariable("GWRPM25", []string{"lat", "lon"}, []float32{0})
+	h.Define()
+	surfaceFile := filepath.Join(dir, "surface.nc")
+	w, err := os.Create(surfaceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := cdf.Create(w, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := make([]float32, len(lats)*len(lons))
+	for i := range pm {
+		pm[i] = 5
+	}
+	if _, err := f.Writer("lat", []int{0}, []int{len(lats)}).Write(lats); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Writer("lon", []int{0}, []int{len(lons)}).Write(lons); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Writer("GWRPM25", []int{0, 0}, []int{len(lats), len(lons)}).Write(pm); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	cfg = InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("Eval.ModelFile", out)
+	cfg.Set("Eval.MonitorFile", "")
+	cfg.Set("Eval.SurfaceFile", surfaceFile)
+	evalFile := filepath.Join(dir, "surface_eval.shp")
+	cfg.Set("Eval.SurfaceOutputFile", evalFile)
+	var b bytes.Buffer
+	cfg.Root.SetOutput(&b)
+	cfg.Root.SetArgs([]string{"eval"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "TotalPM25") {
+		t.Errorf("the statistics should be printed:\n%s", b.String())
+	}
+
+	r, err := os.Open(filepath.Join(dir, "surface_eval_stats.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stats, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[1][0] != "TotalPM25" || stats[1][1] != "GWRPM25" || stats[1][2] == "0" || stats[1][3] != "5" {
+		t.Errorf("invalid statistics: %v", stats)
+	}
+
+	dec, err := shp.NewDecoder(evalFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	var n int
+	for {
+		_, fields, more := dec.DecodeRowFields("Model", "Surface", "Diff")
+		if !more {
+			break
+		}
+		var v [3]float64
+		for i, name := range []string{"Model", "Surface", "Diff"} {
+			if v[i], err = strconv.ParseFloat(strings.TrimSpace(fields[name]), 64); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if v[1] != 5 || math.Abs(v[2]-(v[0]-5)) > 1e-6 {
+			t.Errorf("invalid difference map row %d: %v", n, v)
+		}
+		n++
+	}
+	if err := dec.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if strconv.Itoa(n) != stats[1][2] {
+		t.Errorf("difference map has %d rows but %s cells were compared", n, stats[1][2])
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/yuzhou-wang/inmap"
+)
+
+// surfaceRecord is a grid cell in the difference map written by
+// EvaluateSurface.
+type surfaceRecord struct {
+	geom.Polygon
+	Model, Surface, Diff, Ratio float64
+}
+
+// EvaluateSurface compares the modeled concentrations of variable
+// ModelVariable in the InMAP output shapefile ModelFile to the
+// concentrations of variable SurfaceVariable in SurfaceFile, which is a
+// NetCDF file containing a raster on a regular longitude-latitude grid,
+// such as the satellite-derived PM2.5 surfaces of van Donkelaar et al.
+// This is useful in regions where there are few monitors. The raster is
+// regridded to the model grid cells (see inmap.RegridRaster), and grid
+// cells without surface values are not included in the comparison.
+//
+// The statistics (see EvalStats), in which the surface is treated as the
+// observations and each grid cell counts equally, are written to w and in
+// CSV format to a file whose name is OutputFile with "_stats.csv"
+// replacing the extension. A shapefile with the modeled and surface
+// concentrations, their difference (Model - Surface), and their ratio
+// (Model / Surface) in each grid cell is written to OutputFile.
+func EvaluateSurface(w io.Writer, ModelFile, ModelVariable, SurfaceFile, SurfaceVariable, OutputFile string, outChan chan string) error {
+	dec, err := shp.NewDecoder(ModelFile)
+	if err != nil {
+		return fmt.Errorf("inmap: opening model output file: %v", err)
+	}
+	sr, err := dec.SR()
+	if err != nil {
+		dec.Close()
+		return fmt.Errorf("inmap: reading projection of model output file: %v", err)
+	}
+	var polygons []geom.Polygonal
+	var model []float64
+	for {
+		g, fields, more := dec.DecodeRowFields(ModelVariable)
+		if !more {
+			break
+		}
+		p, ok := g.(geom.Polygonal)
+		if !ok {
+			dec.Close()
+			return fmt.Errorf("inmap: model output file %s has %T geometry but should be polygonal", ModelFile, g)
+		}
+		s, ok := fields[ModelVariable]
+		if !ok {
+			dec.Close()
+			return fmt.Errorf("inmap: model output file %s does not have variable '%s'", ModelFile, ModelVariable)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			dec.Close()
+			return fmt.Errorf("inmap: model output file %s: variable '%s': %v", ModelFile, ModelVariable, err)
+		}
+		polygons = append(polygons, p)
+		model = append(model, v)
+	}
+	dec.Close()
+	if err := dec.Error(); err != nil {
+		return fmt.Errorf("inmap: reading model output file: %v", err)
+	}
+
+	outChan <- fmt.Sprintf("regridding %s\n", SurfaceFile)
+	surface, err := inmap.RegridRaster(SurfaceFile, SurfaceVariable, polygons, sr)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(OutputFile), os.ModePerm); err != nil {
+		return err
+	}
+	e, err := shp.NewEncoder(OutputFile, surfaceRecord{})
+	if err != nil {
+		return fmt.Errorf("inmap: creating surface evaluation output file: %v", err)
+	}
+	var obs, mod []float64
+	for i, p := range polygons {
+		r := surfaceRecord{Model: model[i], Surface: surface[i]}
+		for _, pp := range p.Polygons() {
+			r.Polygon = append(r.Polygon, pp...)
+		}
+		r.Diff = r.Model - r.Surface
+		r.Ratio = r.Model / r.Surface
+		if !math.IsNaN(r.Surface) {
+			obs = append(obs, r.Surface)
+			mod = append(mod, r.Model)
+		}
+		if err = e.Encode(r); err != nil {
+			e.Close()
+			return fmt.Errorf("inmap: writing surface evaluation output file: %v", err)
+		}
+	}
+	e.Close()
+	base := strings.TrimSuffix(OutputFile, filepath.Ext(OutputFile))
+	prj, err := os.ReadFile(strings.TrimSuffix(ModelFile, filepath.Ext(ModelFile)) + ".prj")
+	if err != nil {
+		return fmt.Errorf("inmap: reading projection of model output file: %v", err)
+	}
+	if err := os.WriteFile(base+".prj", prj, 0644); err != nil {
+		return fmt.Errorf("inmap: writing surface evaluation output file: %v", err)
+	}
+
+	s := evalStatistics(obs, mod)
+	if s.N == 0 {
+		outChan <- fmt.Sprintf("no grid cells have %s values\n", SurfaceVariable)
+	}
+	statsFile, err := os.Create(base + "_stats.csv")
+	if err != nil {
+		return fmt.Errorf("inmap: creating surface evaluation output file: %v", err)
+	}
+	defer statsFile.Close()
+	stats := csv.NewWriter(statsFile)
+	f := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+	stats.Write([]string{"Variable", "Surface", "N", "MeanObs", "MeanModel", "MB", "NMB", "ME", "NME", "RMSE", "R2"})
+	stats.Write([]string{ModelVariable, SurfaceVariable, strconv.Itoa(s.N), f(s.MeanObs), f(s.MeanModel), f(s.MB), f(s.NMB),
+		f(s.ME), f(s.NME), f(s.RMSE), f(s.R2)})
+	fmt.Fprintf(w, "%-15s %6s %10s %10s %10s %8s %10s %10s %6s\n", "Variable", "N", "MeanSurf", "MeanModel", "MB", "NMB", "ME", "RMSE", "R²")
+	fmt.Fprintf(w, "%-15s %6d %10.4g %10.4g %10.4g %7.1f%% %10.4g %10.4g %6.3f\n",
+		ModelVariable, s.N, s.MeanObs, s.MeanModel, s.MB, s.NMB*100, s.ME, s.RMSE, s.R2)
+	stats.Flush()
+	if err := stats.Error(); err != nil {
+		return fmt.Errorf("inmap: writing surface evaluation output file: %v", err)
+	}
+	return nil
+}
@@ -36,7 +36,13 @@ import (
 // InMAP data should be created.
 //
 // VarGrid provides information for specifying the variable resolution grid.
-func Grid(InMAPData, VariableGridData string, VarGrid *inmap.VarGridConfig) error {
+//
+// CTMDataCacheDir is a directory where InMAPData is cached after it is
+// loaded, and CellStorageDir is a directory where the concentrations in
+// the grid cells are stored while the grid is created (see Run). If they
+// are empty, the data is not cached and the concentrations are stored in
+// memory.
+func Grid(InMAPData, VariableGridData string, VarGrid *inmap.VarGridConfig, CTMDataCacheDir, CellStorageDir string) error {
 	// Start a function to receive and print log messages.
 	msgLog := make(chan string)
 	go func() {
@@ -45,7 +51,9 @@ func Grid(InMAPData, VariableGridData string, VarGrid *inmap.VarGridConfig) erro
 		}
 	}()
 
-	ctmData, err := getCTMData(InMAPData, VarGrid)
+	ctm := newCTMDataLoader(CTMDataCacheDir)
+	defer ctm.close()
+	ctmData, err := ctm.load(InMAPData, VarGrid)
 	if err != nil {
 		return err
 	}
@@ -64,7 +72,7 @@ func Grid(InMAPData, VariableGridData string, VarGrid *inmap.VarGridConfig) erro
 
 	msgLog <- "Creating grid"
 
-	mutator, err := inmap.PopulationMutator(VarGrid, popIndices)
+	mutator, err := VarGrid.RefinementMutator(popIndices, nil)
 	if err != nil {
 		return err
 	}
@@ -75,10 +83,14 @@ func Grid(InMAPData, VariableGridData string, VarGrid *inmap.VarGridConfig) erro
 			VarGrid.MutateGrid(mutator, ctmData, pop, mr, nil, m, msgLog),
 			inmap.Save(w),
 		},
+		CellStorageDir: CellStorageDir,
 	}
 	if err := d.Init(); err != nil {
 		return err
 	}
+	if err := d.Cleanup(); err != nil {
+		return err
+	}
 	msgLog <- fmt.Sprintf("Grid successfully created at %s", VariableGridData)
 	return nil
 }
@@ -22,9 +22,11 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"math"
 	"os"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 
@@ -36,7 +38,8 @@ import (
 	"github.com/spf13/cobra"
 )
 
-func getCTMData(inmapData string, VarGrid *inmap.VarGridConfig) (*inmap.CTMData, error) {
+// loadCTMData loads the CTM data at inmapData.
+func loadCTMData(inmapData string, VarGrid *inmap.VarGridConfig) (*inmap.CTMData, error) {
 	log.Println("Reading input data...")
 
 	f, err := os.Open(inmapData)
@@ -61,18 +64,61 @@ func scienceMust(c inmap.CellManipulator, err error) inmap.CellManipulator {
 
 // DefaultScienceFuncs are the science functions that are run in
 // typical simulations.
-var DefaultScienceFuncs = []inmap.CellManipulator{
-	inmap.UpwindAdvection(),
-	inmap.Mixing(),
-	inmap.MeanderMixing(),
-	scienceMust(m.DryDep("simple")),
-	scienceMust(m.WetDep("emep")),
-	m.Chemistry(),
+var DefaultScienceFuncs = ScienceFuncs(m)
+
+// ScienceFuncs returns the science functions that are run in
+// typical simulations with chemical mechanism m.
+func ScienceFuncs(m simplechem.Mechanism) []inmap.CellManipulator {
+	return scienceFuncs(inmap.UpwindAdvection(), m, nil)
+}
+
+// scienceFuncs returns the science functions that are run in typical
+// simulations with the given advection scheme and chemical mechanism m.
+// If budget is not nil, the emissions, deposition, and chemistry are
+// added to it.
+func scienceFuncs(advection inmap.CellManipulator, m simplechem.Mechanism, budget *inmap.MassBudget) []inmap.CellManipulator {
+	return append(transportFuncs(advection), cellFuncs(m, budget)...)
+}
+
+// transportFuncs returns the transport calculations that are run in
+// typical simulations with the given advection scheme.
+func transportFuncs(advection inmap.CellManipulator) []inmap.CellManipulator {
+	return []inmap.CellManipulator{
+		advection,
+		inmap.Mixing(),
+		inmap.MeanderMixing(),
+	}
+}
+
+// cellFuncs returns the science functions that are run after the
+// transport calculations in typical simulations with chemical mechanism
+// m, which only use the concentrations in each cell.
+// If budget is not nil, the emissions, deposition, and chemistry are
+// added to it.
+func cellFuncs(m simplechem.Mechanism, budget *inmap.MassBudget) []inmap.CellManipulator {
+	dryDep := scienceMust(m.DryDep("simple"))
+	wetDep := scienceMust(m.WetDep("emep"))
+	chem := m.Chemistry()
+	if budget == nil {
+		return []inmap.CellManipulator{
+			dryDep,
+			wetDep,
+			chem,
+		}
+	}
+	return []inmap.CellManipulator{
+		budget.Emissions(),
+		budget.DryDeposition(dryDep),
+		budget.WetDeposition(wetDep),
+		budget.Chemistry(chem),
+	}
 }
 
 // Run runs the model. dynamic and createGrid specify whether the variable
 // resolution grid should be created dynamically and whether the static
-// grid should be created or read from a file, respectively.
+// grid should be created or read from a file, respectively. deterministic
+// specifies whether the grid cells should be processed in a fixed order so
+// that the results are exactly reproducible (see inmap.InMAP.Deterministic).
 //
 // CobraCommand is the cobra.Command instance where Run is called from.
 // It is needed to print certain outputs to the web interface.
@@ -104,80 +150,104 @@ var DefaultScienceFuncs = []inmap.CellManipulator{
 // to use the same spatial reference as VarGrid. It will
 // be ignored if it is nil.
 //
+// PlumeInGridDistance specifies the downwind distance, in the units of
+// VarGrid, that emissions from elevated sources are transported as a
+// Gaussian plume before they are added to the grid (see
+// inmap.Emissions.PlumeDistance). Plume-in-grid treatment is not used
+// if it is zero.
+//
+// NearRoadWidth specifies the width [m] of the zone next to line emissions
+// sources that the near-road concentration enhancement is estimated for
+// (see inmap.Emissions.NearRoadWidth). The enhancement is not estimated
+// if it is zero.
+//
 // VarGrid provides information for specifying the variable resolution grid.
 //
 // InMAPData is the path to location of baseline meteorology and pollutant data.
 //
+// InMAPDataPeriods are optional paths to baseline meteorology and pollutant
+// data for several periods (e.g., seasons, as created by Preproc with
+// OutputPeriods="seasonal"). If any are specified, InMAPData is ignored,
+// a separate simulation is run for each period, and the resulting
+// concentrations are averaged together, giving each period equal weight.
+// This requires a static grid that is created at run time
+// (dynamic=false and createGrid=true), so that all of the
+// periods share the same grid. Only concentrations are averaged; other
+// output variables are from the last period.
+//
+// BoundaryData is the path to optional baseline meteorology and pollutant
+// data, in the same format as InMAPData, whose baseline concentrations
+// are used as the concentrations outside the domain, so that pollution
+// transported into the domain is accounted for (see
+// inmap.SetBoundaryConcentrations). If it is empty, the concentrations
+// outside the domain are zero.
+//
 // VariableGridData is the path to the location of the variable-resolution gridded
 // InMAP data, or the location where it should be created if it doesn't already
 // exist.
 //
+// CTMDataCacheDir is a directory where InMAPData, InMAPDataPeriods, and
+// BoundaryData are cached after they are loaded, so that later simulations
+// can load them more quickly (see the CTMDataCacheDir configuration option).
+// If it is empty, the data is not cached.
+//
+// CellStorageDir is a directory where the concentrations in the grid cells
+// are stored in memory-mapped files while the simulation is running (see
+// inmap.InMAP.CellStorageDir). If it is empty, they are stored in memory.
+//
 // NumIterations is the number of iterations to calculate. If < 1, convergence
-// is automatically calculated.
+// is automatically calculated using convergence, or with the criterion used
+// by inmap.SteadyStateConvergenceCheck if convergence is nil.
+//
+// acceleration, if it is not nil, is run after the science calculations in
+// each time step to reduce the number of iterations needed to converge
+// (e.g., inmap.AndersonAcceleration).
+//
+// CheckpointFile is the path where the state of the simulation is saved
+// every CheckpointInterval of wall time so that an interrupted simulation
+// can be resumed. If it is empty, no checkpoints are saved. If resume is
+// true and CheckpointFile exists, the simulation continues from the saved
+// state rather than starting over. Checkpoints can not be used with
+// InMAPDataPeriods.
 //
 // If dynamic is
 // true, createGrid is ignored. scienceFuncs specifies the science functions
-// to perform in each cell at each time step. addInit, addRun, and addCleanup
+// to perform in each cell at each time step. If transport is not nil, it
+// carries out the transport calculations at each time step before
+// scienceFuncs are run, and scienceFuncs should not include them.
+//
+// If comm is not nil, this is one of the workers in a distributed
+// simulation, where comm passes messages among them: it only simulates
+// its partition of the grid loaded from VariableGridData (see
+// inmap.LoadPartition) and only writes the results for that partition.
+// This requires a pre-created static grid (dynamic=false and
+// createGrid=false), and can not be used with InMAPDataPeriods,
+// checkpoints, or acceleration.
+// addInit, addRun, and addCleanup
 // specifies functions beyond the default functions to run at initialization,
 // runtime, and cleanup, respectively.
 //
 // notMeters should be set to true if the units of the grid are not meters
 // (e.g., if the grid is in degrees latitude/longitude.)
 func Run(CobraCommand *cobra.Command, LogFile string, OutputFile string, OutputAllLayers bool, OutputVariables map[string]string,
-	EmissionUnits string, EmissionsShapefiles []string, EmissionsMask geom.Polygon, VarGrid *inmap.VarGridConfig,
+	EmissionUnits string, EmissionsShapefiles []string, EmissionsMask geom.Polygon, PlumeInGridDistance, NearRoadWidth float64, VarGrid *inmap.VarGridConfig,
 	inventoryConfig *aeputil.InventoryConfig, spatialConfig *aeputil.SpatialConfig,
-	InMAPData, VariableGridData string, NumIterations int,
-	dynamic, createGrid bool, scienceFuncs []inmap.CellManipulator, addInit, addRun, addCleanup []inmap.DomainManipulator,
+	InMAPData string, InMAPDataPeriods []string, BoundaryData string, VariableGridData, CTMDataCacheDir, CellStorageDir string, NumIterations int,
+	convergence inmap.ConvergenceCriterion, acceleration inmap.DomainManipulator,
+	CheckpointFile string, CheckpointInterval time.Duration, resume bool,
+	dynamic, createGrid, deterministic bool, transport inmap.Backend, comm inmap.Communicator, scienceFuncs []inmap.CellManipulator, addInit, addRun, addCleanup []inmap.DomainManipulator,
 	m inmap.Mechanism) error {
 
 	startTime := time.Now()
 
 	var upload uploader
 
-	// Start a function to receive and print log messages.
-	logfile, err := os.Create(upload.maybeUpload(LogFile))
+	l, err := newRunLogger(CobraCommand, upload.maybeUpload(LogFile), NumIterations)
 	if err != nil {
-		return fmt.Errorf("inmap: problem creating log file: %v", err)
+		return err
 	}
-	mw := io.MultiWriter(CobraCommand.OutOrStdout(), logfile)
-	log.SetOutput(mw)
-	cConverge := make(chan inmap.ConvergenceStatus)
-	cLog := make(chan *inmap.SimulationStatus)
-	cLogTick := time.Tick(2 * time.Second)
-	msgLog := make(chan string)
-	var wg sync.WaitGroup
-	wg.Add(3)
-	go func() {
-		for msg := range cConverge {
-			log.Println(msg.String())
-		}
-		wg.Done()
-	}()
-	go func() {
-		for msg := range cLog {
-			select {
-			case <-cLogTick:
-				log.Println(msg.String())
-			default:
-				runtime.Gosched()
-			}
-		}
-		wg.Done()
-	}()
-	go func() {
-		for msg := range msgLog {
-			log.Println(msg)
-		}
-		wg.Done()
-	}()
-
-	defer func() { // Wait for the logging to finish.
-		close(cConverge)
-		close(cLog)
-		close(msgLog)
-		wg.Wait()
-		logfile.Close()
-	}()
+	defer l.close()
+	cConverge, cLog, msgLog := l.cConverge, l.cLog, l.msgLog
 
 	o, err := inmap.NewOutputter(upload.maybeUpload(OutputFile), OutputAllLayers, OutputVariables, nil, m)
 	if err != nil {
@@ -198,7 +268,10 @@ func Run(CobraCommand *cobra.Command, LogFile string, OutputFile string, OutputA
 		return err
 	}
 
-	aepSetEmis := setEmissionsAEP(inventoryConfig, spatialConfig, emis, EmissionsMask)
+	aepSetEmis := setEmissionsAEP(inventoryConfig, spatialConfig, emis, EmissionsMask, PlumeInGridDistance, NearRoadWidth, m)
+
+	ctm := newCTMDataLoader(CTMDataCacheDir)
+	defer ctm.close()
 
 	// Only load the population if we're creating the grid.
 	var pop *inmap.Population
@@ -207,10 +280,12 @@ func Run(CobraCommand *cobra.Command, LogFile string, OutputFile string, OutputA
 	var mortIndices inmap.MortIndices
 	var ctmData *inmap.CTMData
 	if dynamic || createGrid {
-		log.Println("Loading CTM data...")
-		ctmData, err = getCTMData(InMAPData, VarGrid)
-		if err != nil {
-			return err
+		if len(InMAPDataPeriods) == 0 {
+			log.Println("Loading CTM data...")
+			ctmData, err = ctm.load(InMAPData, VarGrid)
+			if err != nil {
+				return err
+			}
 		}
 		log.Println("Loading population and mortality rate data...")
 		pop, popIndices, mr, mortIndices, err = VarGrid.LoadPopMort()
@@ -218,108 +293,221 @@ func Run(CobraCommand *cobra.Command, LogFile string, OutputFile string, OutputA
 			return err
 		}
 	}
+	if len(InMAPDataPeriods) > 0 && (dynamic || !createGrid) {
+		return fmt.Errorf("inmap: InMAPDataPeriods can only be used with a static grid that is created at run time")
+	}
+	if len(InMAPDataPeriods) > 0 && CheckpointFile != "" {
+		return fmt.Errorf("inmap: checkpoints can not be used with InMAPDataPeriods")
+	}
 
-	scienceCalcs := inmap.Calculations(scienceFuncs...)
+	if comm != nil {
+		if dynamic || createGrid {
+			return fmt.Errorf("inmap: distributed simulations require a static grid that is loaded from VariableGridData")
+		}
+		if len(InMAPDataPeriods) > 0 || CheckpointFile != "" || acceleration != nil {
+			return fmt.Errorf("inmap: InMAPDataPeriods, checkpoints, and acceleration can not be used in distributed simulations")
+		}
+	}
 
-	var initFuncs, runFuncs []inmap.DomainManipulator
-	if !dynamic {
-		if createGrid {
-			var mutator inmap.GridMutator
-			mutator, err = inmap.PopulationMutator(VarGrid, popIndices)
-			if err != nil {
+	if convergence == nil {
+		convergence = inmap.MassAndPopulationChange{PopGridColumn: VarGrid.PopGridColumn, Tolerance: 0.001}
+	}
+
+	// setBoundary sets the concentrations outside the domain.
+	setBoundary := func(*inmap.InMAP) error { return nil }
+	if BoundaryData != "" {
+		log.Println("Loading boundary concentration data...")
+		boundaryData, err := ctm.load(BoundaryData, VarGrid)
+		if err != nil {
+			return err
+		}
+		setBoundary = inmap.SetBoundaryConcentrations(boundaryData, m)
+	}
+
+	scienceCalcs := inmap.Calculations(scienceFuncs...)
+	initTransport := func(*inmap.InMAP) error { return nil }
+	if transport != nil {
+		initTransport = transport.Init()
+		transportCalcs, cellCalcs := transport.Calculate(), scienceCalcs
+		scienceCalcs = func(d *inmap.InMAP) error {
+			if err := transportCalcs(d); err != nil {
 				return err
 			}
-			initFuncs = []inmap.DomainManipulator{
-				VarGrid.RegularGrid(ctmData, pop, popIndices, mr, mortIndices, nil, m),
-				VarGrid.MutateGrid(mutator, ctmData, pop, mr, nil, m, msgLog),
-				aepSetEmis,
-				inmap.SetTimestepCFL(),
-				o.CheckOutputVars(m),
+			return cellCalcs(d)
+		}
+	}
+
+	// runDomain runs a simulation using ctmData and then runs cleanupFuncs.
+	runDomain := func(ctmData *inmap.CTMData, cleanupFuncs []inmap.DomainManipulator) error {
+		var initFuncs, runFuncs []inmap.DomainManipulator
+		if !dynamic {
+			if createGrid {
+				var mutator inmap.GridMutator
+				mutator, err = VarGrid.RefinementMutator(popIndices, emis)
+				if err != nil {
+					return err
+				}
+				initFuncs = []inmap.DomainManipulator{
+					VarGrid.RegularGrid(ctmData, pop, popIndices, mr, mortIndices, nil, m),
+					VarGrid.MutateGrid(mutator, ctmData, pop, mr, nil, m, msgLog),
+					setBoundary,
+					aepSetEmis,
+					inmap.SetTimestepCFL(),
+					o.CheckOutputVars(m),
+				}
+			} else { // pre-created static grid
+				var r io.Reader
+				r, err = os.Open(VariableGridData)
+				if err != nil {
+					return fmt.Errorf("problem opening file to load VariableGridData: %v", err)
+				}
+				load := inmap.Load(r, VarGrid, nil, m)
+				if comm != nil {
+					load = inmap.LoadPartition(r, VarGrid, nil, m, comm)
+				}
+				initFuncs = []inmap.DomainManipulator{
+					load,
+					setBoundary,
+					aepSetEmis,
+					inmap.SetTimestepCFL(),
+					o.CheckOutputVars(m),
+				}
 			}
-		} else { // pre-created static grid
-			var r io.Reader
-			r, err = os.Open(VariableGridData)
-			if err != nil {
-				return fmt.Errorf("problem opening file to load VariableGridData: %v", err)
+			runFuncs = []inmap.DomainManipulator{
+				inmap.Log(cLog),
+				simulationMetrics(),
+				inmap.Calculations(inmap.AddEmissionsFlux()),
+				inmap.HaloExchange(),
+				scienceCalcs,
+			}
+			if acceleration != nil {
+				runFuncs = append(runFuncs, acceleration)
 			}
+			runFuncs = append(runFuncs, inmap.ConvergenceCheck(NumIterations, convergence, m, cConverge))
+		} else { // dynamic grid
 			initFuncs = []inmap.DomainManipulator{
-				inmap.Load(r, VarGrid, nil, m),
+				VarGrid.RegularGrid(ctmData, pop, popIndices, mr, mortIndices, nil, m),
+				setBoundary,
 				aepSetEmis,
 				inmap.SetTimestepCFL(),
 				o.CheckOutputVars(m),
 			}
-		}
-		runFuncs = []inmap.DomainManipulator{
-			inmap.Log(cLog),
-			inmap.Calculations(inmap.AddEmissionsFlux()),
-			scienceCalcs,
-			inmap.SteadyStateConvergenceCheck(NumIterations,
-				VarGrid.PopGridColumn, m, cConverge),
-		}
-	} else { // dynamic grid
-		initFuncs = []inmap.DomainManipulator{
-			VarGrid.RegularGrid(ctmData, pop, popIndices, mr, mortIndices, nil, m),
-			aepSetEmis,
-			inmap.SetTimestepCFL(),
-			o.CheckOutputVars(m),
-		}
-
-		// Set up a domain manipulator that mutates the grid, sets the emissions,
-		// the sets the timestep.
-		popConcMutator := inmap.NewPopConcMutator(VarGrid, popIndices)
-		const gridMutateInterval = 3 * 60 * 60 // every 3 hours in seconds
-		mg := VarGrid.MutateGrid(popConcMutator.Mutate(), ctmData, pop, mr, nil, m, msgLog)
-		setTS := inmap.SetTimestepCFL()
-		mutateThenAddEmis := func(d *inmap.InMAP) error {
-			if err := mg(d); err != nil {
-				return err
+
+			// Set up a domain manipulator that mutates the grid, sets the emissions,
+			// the sets the timestep.
+			popConcMutator := inmap.NewPopConcMutator(VarGrid, popIndices)
+			const gridMutateInterval = 3 * 60 * 60 // every 3 hours in seconds
+			mg := VarGrid.MutateGrid(popConcMutator.Mutate(), ctmData, pop, mr, nil, m, msgLog)
+			setTS := inmap.SetTimestepCFL()
+			mutateThenAddEmis := func(d *inmap.InMAP) error {
+				if err := mg(d); err != nil {
+					return err
+				}
+				if err := setBoundary(d); err != nil {
+					return err
+				}
+				if err := aepSetEmis(d); err != nil {
+					return err
+				}
+				if err := setTS(d); err != nil {
+					return err
+				}
+				return initTransport(d)
 			}
-			if err := aepSetEmis(d); err != nil {
-				return err
+
+			runFuncs = []inmap.DomainManipulator{
+				inmap.Log(cLog),
+				simulationMetrics(),
+				inmap.Calculations(inmap.AddEmissionsFlux()),
+				scienceCalcs,
 			}
-			return setTS(d)
+			if acceleration != nil {
+				runFuncs = append(runFuncs, acceleration)
+			}
+			runFuncs = append(runFuncs,
+				inmap.RunPeriodically(gridMutateInterval, mutateThenAddEmis),
+				inmap.ConvergenceCheck(NumIterations, convergence, m, cConverge))
 		}
 
-		runFuncs = []inmap.DomainManipulator{
-			inmap.Log(cLog),
-			inmap.Calculations(inmap.AddEmissionsFlux()),
-			scienceCalcs,
-			inmap.RunPeriodically(gridMutateInterval, mutateThenAddEmis),
-			inmap.SteadyStateConvergenceCheck(NumIterations, VarGrid.PopGridColumn, m, cConverge),
+		if CheckpointFile != "" {
+			if resume {
+				if f, err := os.Open(CheckpointFile); err == nil {
+					defer f.Close()
+					log.Printf("Resuming simulation from checkpoint %s...", CheckpointFile)
+					initFuncs = []inmap.DomainManipulator{
+						inmap.LoadCheckpoint(f, VarGrid, nil, m),
+						setBoundary,
+						aepSetEmis,
+						inmap.SetTimestepCFL(),
+						o.CheckOutputVars(m),
+					}
+				} else if !os.IsNotExist(err) {
+					return fmt.Errorf("inmap: opening checkpoint: %v", err)
+				}
+			}
+			runFuncs = append(runFuncs, inmap.SaveCheckpoint(CheckpointFile, CheckpointInterval))
+		}
+		initFuncs = append(initFuncs, initTransport)
+
+		d := &inmap.InMAP{
+			InitFuncs:      append(initFuncs, addInit...),
+			RunFuncs:       append(runFuncs, addRun...),
+			CleanupFuncs:   cleanupFuncs,
+			Deterministic:  deterministic,
+			CellStorageDir: CellStorageDir,
 		}
-	}
 
-	d := &inmap.InMAP{
-		InitFuncs: append(initFuncs, addInit...),
-		RunFuncs:  append(runFuncs, addRun...),
-		CleanupFuncs: append([]inmap.DomainManipulator{
-			o.Output(sr),
-			upload.uploadOutput,
-		}, addCleanup...),
-	}
+		log.Println("Initializing model...")
+		if err = d.Init(); err != nil {
+			return fmt.Errorf("InMAP: problem initializing model: %v\n", err)
+		}
 
-	log.Println("Initializing model...")
-	if err = d.Init(); err != nil {
-		return fmt.Errorf("InMAP: problem initializing model: %v\n", err)
-	}
+		emisTotals := make([]float64, len(d.Cells()[0].Cf))
+		for _, c := range d.Cells() {
+			for i, val := range c.EmisFlux {
+				emisTotals[i] += val * c.Volume
+			}
+		}
+		log.Println("Emission totals:")
+		for i, pol := range inmap.PolNames {
+			log.Printf("%v, %g μg/s\n", pol, emisTotals[i])
+		}
 
-	emisTotals := make([]float64, len(d.Cells()[0].Cf))
-	for _, c := range d.Cells() {
-		for i, val := range c.EmisFlux {
-			emisTotals[i] += val * c.Volume
+		if err = d.Run(); err != nil {
+			return fmt.Errorf("InMAP: problem running simulation: %v\n", err)
 		}
-	}
-	log.Println("Emission totals:")
-	for i, pol := range inmap.PolNames {
-		log.Printf("%v, %g μg/s\n", pol, emisTotals[i])
-	}
 
-	if err = d.Run(); err != nil {
-		return fmt.Errorf("InMAP: problem running simulation: %v\n", err)
+		if err = d.Cleanup(); err != nil {
+			return fmt.Errorf("InMAP: problem shutting down model: %v\n", err)
+		}
+		return nil
 	}
 
-	if err = d.Cleanup(); err != nil {
-		return fmt.Errorf("InMAP: problem shutting down model: %v\n", err)
+	cleanupFuncs := append([]inmap.DomainManipulator{
+		o.Output(sr),
+		upload.uploadOutput,
+	}, addCleanup...)
+	if len(InMAPDataPeriods) == 0 {
+		if err = runDomain(ctmData, cleanupFuncs); err != nil {
+			return err
+		}
+	} else {
+		avg := &concentrationAverager{n: len(InMAPDataPeriods)}
+		for i, f := range InMAPDataPeriods {
+			logProgress("inmap", fmt.Sprintf("Simulating period %d of %d...", i+1, len(InMAPDataPeriods)), i, len(InMAPDataPeriods))
+			ctmData, err = ctm.load(f, VarGrid)
+			if err != nil {
+				return err
+			}
+			cleanup := []inmap.DomainManipulator{avg.add}
+			if i == len(InMAPDataPeriods)-1 {
+				cleanup = append(cleanup, avg.set)
+				cleanup = append(cleanup, cleanupFuncs...)
+			}
+			if err = runDomain(ctmData, cleanup); err != nil {
+				return err
+			}
+		}
 	}
 
 	elapsedTime := time.Since(startTime)
@@ -328,16 +516,144 @@ func Run(CobraCommand *cobra.Command, LogFile string, OutputFile string, OutputA
 	return nil
 }
 
+// runLogger receives and prints the log messages from a simulation.
+type runLogger struct {
+	cConverge chan inmap.ConvergenceStatus
+	cLog      chan *inmap.SimulationStatus
+	msgLog    chan string
+
+	wg      sync.WaitGroup
+	logfile *os.File
+}
+
+// newRunLogger starts printing log messages to the output of
+// CobraCommand and to LogFile. If numIterations > 0, it is the
+// number of iterations in the simulation, which is used to report
+// the percent complete.
+func newRunLogger(CobraCommand *cobra.Command, LogFile string, numIterations int) (*runLogger, error) {
+	logfile, err := os.Create(LogFile)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: problem creating log file: %v", err)
+	}
+	mw := io.MultiWriter(CobraCommand.OutOrStdout(), logfile)
+	setLogOutput(mw)
+	l := &runLogger{
+		cConverge: make(chan inmap.ConvergenceStatus),
+		cLog:      make(chan *inmap.SimulationStatus),
+		msgLog:    make(chan string),
+		logfile:   logfile,
+	}
+	logger := slog.With("module", "inmap")
+	cLogTick := time.Tick(2 * time.Second)
+	l.wg.Add(3)
+	go func() {
+		for msg := range l.cConverge {
+			change := msg.PercentChanges()
+			for n, v := range change {
+				if math.IsNaN(v) || math.IsInf(v, 0) {
+					delete(change, n) // Not representable in JSON.
+				}
+			}
+			logger.Info(msg.String(), "event", "convergence", "change", change)
+		}
+		l.wg.Done()
+	}()
+	go func() {
+		for msg := range l.cLog {
+			select {
+			case <-cLogTick:
+				args := []any{"event", "status", "iteration", msg.Iteration,
+					"walltime", msg.Walltime.Seconds(), "step_walltime", msg.StepWalltime.Seconds(),
+					"dt", msg.Dt, "simulation_days", msg.SimulationDays}
+				if numIterations > 0 {
+					args = append(args, "percent", 100*float64(msg.Iteration)/float64(numIterations))
+				}
+				logger.Info(msg.String(), args...)
+			default:
+				runtime.Gosched()
+			}
+		}
+		l.wg.Done()
+	}()
+	go func() {
+		for msg := range l.msgLog {
+			logger.Info(strings.TrimSpace(msg))
+		}
+		l.wg.Done()
+	}()
+	return l, nil
+}
+
+// close waits for the logging to finish.
+func (l *runLogger) close() {
+	close(l.cConverge)
+	close(l.cLog)
+	close(l.msgLog)
+	l.wg.Wait()
+	l.logfile.Close()
+}
+
 // setEmissionsAEP adds AEP-processed emissions flux to an existing grid.
 // The returned DomainManipulator must be run after each time the grid changes.
 // extraEmis specifies any extra emissions that should be added. It is ignored
-// if nil.
-func setEmissionsAEP(inventoryConfig *aeputil.InventoryConfig, spatialConfig *aeputil.SpatialConfig, extraEmis *inmap.Emissions, mask geom.Polygon) func(d *inmap.InMAP) error {
+// if nil. plumeDistance is the plume-in-grid distance (see
+// inmap.Emissions.PlumeDistance) and nearRoadWidth is the width of the
+// near-road zone (see inmap.Emissions.NearRoadWidth). m is the chemical
+// mechanism.
+func setEmissionsAEP(inventoryConfig *aeputil.InventoryConfig, spatialConfig *aeputil.SpatialConfig, extraEmis *inmap.Emissions, mask geom.Polygon, plumeDistance, nearRoadWidth float64, m inmap.Mechanism) func(d *inmap.InMAP) error {
+	emissions := emissionsAEP(inventoryConfig, spatialConfig, extraEmis, mask, plumeDistance, nearRoadWidth)
+	return func(d *inmap.InMAP) error {
+		emis, err := emissions(d)
+		if err != nil {
+			return err
+		}
+		return d.SetEmissionsFlux(emis, m)
+	}
+}
+
+// emissionsAEP returns a function that allocates AEP-processed emissions,
+// along with extraEmis if it is not nil, to the grid cells in d.
+// The returned emissions use the given plume-in-grid distance and
+// near-road zone width.
+func emissionsAEP(inventoryConfig *aeputil.InventoryConfig, spatialConfig *aeputil.SpatialConfig, extraEmis *inmap.Emissions, mask geom.Polygon, plumeDistance, nearRoadWidth float64) func(d *inmap.InMAP) (*inmap.Emissions, error) {
+	recs, err := readEmissionsAEP(inventoryConfig, mask) // Remember to check error below.
+
+	return func(d *inmap.InMAP) (*inmap.Emissions, error) {
+		if err != nil { // Check error from ReadEmissions
+			return nil, err
+		}
+		emisRecs, err := gridEmissionsAEP(recs, spatialConfig, d)
+		if err != nil {
+			return nil, err
+		}
+		emis := inmap.NewEmissions()
+		emis.Mask = mask
+		emis.PlumeDistance = plumeDistance
+		emis.NearRoadWidth = nearRoadWidth
+		for _, e := range emisRecs {
+			emis.Add(e)
+		}
+		if extraEmis != nil { // Add in extra emissions.
+			for _, e := range extraEmis.EmisRecords() {
+				emis.Add(e)
+			}
+		}
+		return emis, nil
+	}
+}
+
+// readEmissionsAEP reads the emissions records specified in inventoryConfig,
+// grouped by sector, and removes the records that do not overlap with
+// mask if it is not nil.
+func readEmissionsAEP(inventoryConfig *aeputil.InventoryConfig, mask geom.Polygon) (map[string][]aep.Record, error) {
 	// Read in emissions records and save in memory.
 	recs := make(map[string][]aep.Record)
-	var err error
-	if len(inventoryConfig.NEIFiles) > 0 || len(inventoryConfig.COARDSFiles) > 0 {
-		recs, _, err = inventoryConfig.ReadEmissions() // Remember to check error below.
+	if len(inventoryConfig.NEIFiles) > 0 || len(inventoryConfig.COARDSFiles) > 0 || len(inventoryConfig.DeltaFiles) > 0 {
+		var err error
+		recs, _, err = inventoryConfig.ReadEmissions()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if mask != nil { // Remove records that do not overlap with mask.
@@ -359,67 +675,73 @@ func setEmissionsAEP(inventoryConfig *aeputil.InventoryConfig, spatialConfig *ae
 			recs[s] = srecs
 		}
 	}
+	return recs, nil
+}
 
-	return func(d *inmap.InMAP) error {
-		if err != nil { // Check error from ReadEmissions
-			return err
+// gridEmissionsAEP allocates the emissions records in recs, which are
+// grouped by sector, to the ground-level grid cells in d.
+func gridEmissionsAEP(recs map[string][]aep.Record, spatialConfig *aeputil.SpatialConfig, d *inmap.InMAP) ([]*inmap.EmisRecord, error) {
+	// Specify the grid cells we want to allocate to.
+	cells := d.Cells()
+	gridCells := make([]geom.Polygonal, 0, len(cells))
+	for _, c := range cells {
+		if c.Layer == 0 {
+			gridCells = append(gridCells, c)
 		}
+	}
+	return gridEmissionsAEPCells(recs, spatialConfig, gridCells, aepPollutants)
+}
 
-		// Specify the grid cells we want to allocate to.
-		cells := d.Cells()
-		spatialConfig.GridCells = make([]geom.Polygonal, 0, len(cells))
-		for _, c := range cells {
-			if c.Layer == 0 {
-				spatialConfig.GridCells = append(spatialConfig.GridCells, c)
-			}
-		}
+// aepPollutants are the names of the pollutants in AEP emissions records
+// that correspond to the InMAP VOC, NOx, NH3, SOx, PM2.5, EC, OC, and PM10
+// emissions.
+var aepPollutants = [8][]aep.Pollutant{
+	{{Name: "VOC"}},
+	{{Name: "NOx"}},
+	{{Name: "NH3"}},
+	{{Name: "SOx"}},
+	{{Name: "PM2_5"}},
+	{{Name: "EC"}},
+	{{Name: "OC"}},
+	{{Name: "PM10"}},
+}
 
-		iter := spatialConfig.Iterator(aeputil.IteratorFromMap(recs), 0)
-		var spatialRecs []aep.RecordGridded
-		for {
-			rec, err := iter.Next()
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				return err
-			}
-			var totalEmis float64
-			for _, v := range rec.Totals() {
-				totalEmis += math.Abs(v.Value())
-			}
-			if totalEmis == 0 {
-				continue
-			}
-			spatialRecs = append(spatialRecs, rec.(aep.RecordGridded))
+// gridEmissionsAEPCells allocates the emissions records in recs, which are
+// grouped by sector, to gridCells. pols are the names of the pollutants
+// in recs that correspond to each InMAP species, as in aepPollutants.
+func gridEmissionsAEPCells(recs map[string][]aep.Record, spatialConfig *aeputil.SpatialConfig, gridCells []geom.Polygonal, pols [8][]aep.Pollutant) ([]*inmap.EmisRecord, error) {
+	spatialConfig.GridCells = gridCells
+
+	iter := spatialConfig.Iterator(aeputil.IteratorFromMap(recs), 0)
+	var spatialRecs []aep.RecordGridded
+	for {
+		rec, err := iter.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
 		}
-
-		var emisRecs []*inmap.EmisRecord
-		if len(spatialRecs) > 0 {
-			sp, err := spatialConfig.SpatialProcessor()
-			if err != nil {
-				return err
-			}
-			emisRecs, err = inmap.FromAEP(spatialRecs, sp.Grids, 0,
-				[]aep.Pollutant{{Name: "VOC"}},
-				[]aep.Pollutant{{Name: "NOx"}},
-				[]aep.Pollutant{{Name: "NH3"}},
-				[]aep.Pollutant{{Name: "SOx"}},
-				[]aep.Pollutant{{Name: "PM2_5"}},
-			)
-			if err != nil {
-				return err
-			}
+		var totalEmis float64
+		for _, v := range rec.Totals() {
+			totalEmis += math.Abs(v.Value())
 		}
-		emis := inmap.NewEmissions()
-		emis.Mask = mask
-		for _, e := range emisRecs {
-			emis.Add(e)
+		if totalEmis == 0 {
+			continue
 		}
-		if extraEmis != nil { // Add in extra emissions.
-			for _, e := range extraEmis.EmisRecords() {
-				emis.Add(e)
-			}
+		spatialRecs = append(spatialRecs, rec.(aep.RecordGridded))
+	}
+
+	var emisRecs []*inmap.EmisRecord
+	if len(spatialRecs) > 0 {
+		sp, err := spatialConfig.SpatialProcessor()
+		if err != nil {
+			return nil, err
+		}
+		emisRecs, err = inmap.FromAEP(spatialRecs, sp.Grids, 0,
+			pols[0], pols[1], pols[2], pols[3], pols[4], pols[5], pols[6], pols[7])
+		if err != nil {
+			return nil, err
 		}
-		return d.SetEmissionsFlux(emis, m)
 	}
+	return emisRecs, nil
 }
@@ -20,13 +20,22 @@ package inmaputil
 
 import (
 	"context"
+	"encoding/csv"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/ctessum/cdf"
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
 	"github.com/yuzhou-wang/inmap"
 	"github.com/yuzhou-wang/inmap/internal/postgis"
 )
@@ -59,6 +68,786 @@ func TestInMAPStaticCreateGrid(t *testing.T) {
 	}
 }
 
+func TestInMAPStaticCreateGridPeriods(t *testing.T) {
+	dir, err := os.MkdirTemp("", "periods")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := os.ReadFile("../cmd/inmap/testdata/testInMAPInputData.ncf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inmapData := filepath.Join(dir, "inmapData.ncf")
+	for _, p := range []string{"DJF", "JJA"} {
+		if err = os.WriteFile(PeriodFile(inmapData, p), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := InitializeConfig()
+	cfg.Set("static", true)
+	cfg.Set("creategrid", true)
+	os.Setenv("InMAPRunType", "static")
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("InMAPData", inmapData)
+	cfg.Set("InMAPDataPeriods", []string{"DJF", "JJA"})
+	cfg.Root.SetArgs([]string{"run", "steady"})
+	defer os.Remove(os.ExpandEnv("$INMAP_ROOT_DIR/cmd/inmap/testdata/output_static.log"))
+	defer inmap.DeleteShapefile(os.ExpandEnv("$INMAP_ROOT_DIR/cmd/inmap/testdata/output_static.shp"))
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg = InitializeConfig()
+	cfg.Set("static", false)
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("InMAPData", inmapData)
+	cfg.Set("InMAPDataPeriods", []string{"DJF", "JJA"})
+	cfg.Root.SetArgs([]string{"run", "steady"})
+	defer os.Remove(os.ExpandEnv("$INMAP_ROOT_DIR/cmd/inmap/testdata/output_${InMAPRunType}.log"))
+	if err := cfg.Root.Execute(); err == nil {
+		t.Error("expected an error for periods with a dynamic grid")
+	}
+}
+
+func TestInMAPStaticCheckpoint(t *testing.T) {
+	dir, err := os.MkdirTemp("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpoint := filepath.Join(dir, "checkpoint.gob")
+	defer os.Remove(os.ExpandEnv("$INMAP_ROOT_DIR/cmd/inmap/testdata/output_static.log"))
+	defer inmap.DeleteShapefile(os.ExpandEnv("$INMAP_ROOT_DIR/cmd/inmap/testdata/output_static.shp"))
+
+	for _, resume := range []bool{false, true} {
+		cfg := InitializeConfig()
+		cfg.Set("static", true)
+		cfg.Set("createGrid", true)
+		os.Setenv("InMAPRunType", "static")
+		cfg.Set("config", "../cmd/inmap/configExample.toml")
+		cfg.Set("CheckpointFile", checkpoint)
+		cfg.Set("CheckpointInterval", "0s")
+		cfg.Set("resume", resume)
+		cfg.Root.SetArgs([]string{"run", "steady"})
+		if err := cfg.Root.Execute(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(checkpoint); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInMAPStaticAcceleration(t *testing.T) {
+	defer os.Remove(os.ExpandEnv("$INMAP_ROOT_DIR/cmd/inmap/testdata/output_static.log"))
+	defer inmap.DeleteShapefile(os.ExpandEnv("$INMAP_ROOT_DIR/cmd/inmap/testdata/output_static.shp"))
+	for _, test := range []struct {
+		criterion, acceleration string
+	}{
+		{criterion: "l2", acceleration: "anderson"},
+		{criterion: "maxcell", acceleration: "relaxation"},
+		{criterion: "population", acceleration: ""},
+	} {
+		cfg := InitializeConfig()
+		cfg.Set("static", true)
+		cfg.Set("createGrid", true)
+		os.Setenv("InMAPRunType", "static")
+		cfg.Set("config", "../cmd/inmap/configExample.toml")
+		cfg.Set("ConvergenceCriterion", test.criterion)
+		cfg.Set("Acceleration", test.acceleration)
+		cfg.Root.SetArgs([]string{"run", "steady"})
+		if err := cfg.Root.Execute(); err != nil {
+			t.Errorf("%s, %s: %v", test.criterion, test.acceleration, err)
+		}
+	}
+
+	cfg := InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("Acceleration", "chebyshev")
+	cfg.Root.SetArgs([]string{"run", "steady"})
+	if err := cfg.Root.Execute(); err == nil {
+		t.Error("expected an error for an unknown acceleration method")
+	}
+}
+
+func TestInMAPStaticVanLeer(t *testing.T) {
+	cfg := InitializeConfig()
+	cfg.Set("static", true)
+	cfg.Set("createGrid", true)
+	os.Setenv("InMAPRunType", "staticVanLeer")
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("Advection", "vanleer")
+	cfg.Root.SetArgs([]string{"run", "steady"})
+	defer os.Remove(os.ExpandEnv("$INMAP_ROOT_DIR/cmd/inmap/testdata/output_staticVanLeer.log"))
+	defer inmap.DeleteShapefile(os.ExpandEnv("$INMAP_ROOT_DIR/cmd/inmap/testdata/output_staticVanLeer.shp"))
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg = InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("Advection", "lax-wendroff")
+	cfg.Root.SetArgs([]string{"run", "steady"})
+	if err := cfg.Root.Execute(); err == nil {
+		t.Error("expected an error for an unknown advection scheme")
+	}
+}
+
+func TestInMAPBackend(t *testing.T) {
+	defer os.Remove(os.ExpandEnv("$INMAP_ROOT_DIR/cmd/inmap/testdata/output_batched.log"))
+	defer inmap.DeleteShapefile(os.ExpandEnv("$INMAP_ROOT_DIR/cmd/inmap/testdata/output_batched.shp"))
+	for _, static := range []bool{true, false} {
+		cfg := InitializeConfig()
+		cfg.Set("static", static)
+		cfg.Set("createGrid", true)
+		os.Setenv("InMAPRunType", "batched")
+		cfg.Set("config", "../cmd/inmap/configExample.toml")
+		cfg.Set("Backend", "batched")
+		cfg.Root.SetArgs([]string{"run", "steady"})
+		if err := cfg.Root.Execute(); err != nil {
+			t.Errorf("static=%v: %v", static, err)
+		}
+	}
+
+	for _, test := range []struct {
+		backend, advection string
+	}{
+		{backend: "gpu", advection: "upwind"},
+		{backend: "batched", advection: "vanleer"},
+	} {
+		cfg := InitializeConfig()
+		cfg.Set("config", "../cmd/inmap/configExample.toml")
+		cfg.Set("Backend", test.backend)
+		cfg.Set("Advection", test.advection)
+		cfg.Root.SetArgs([]string{"run", "steady"})
+		if err := cfg.Root.Execute(); err == nil {
+			t.Errorf("%s, %s: expected an error", test.backend, test.advection)
+		}
+	}
+}
+
+func TestInMAPStaticBudget(t *testing.T) {
+	dir, err := os.MkdirTemp("", "budget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := InitializeConfig()
+	cfg.Set("static", true)
+	cfg.Set("createGrid", true)
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("OutputFile", filepath.Join(dir, "output.shp"))
+	cfg.Set("LogFile", filepath.Join(dir, "output.log"))
+	budgetFile := filepath.Join(dir, "budget.csv")
+	cfg.Set("BudgetFile", budgetFile)
+	cfg.Root.SetArgs([]string{"run", "steady"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(budgetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) < 2 {
+		t.Errorf("budget file should have a header and at least one row but has %d rows", len(rows))
+	}
+}
+
+func TestInMAPStaticReceptors(t *testing.T) {
+	dir, err := os.MkdirTemp("", "receptors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	receptorFile := filepath.Join(dir, "receptors.csv")
+	if err := os.WriteFile(receptorFile, []byte("name,x,y\na,-2000,-2000\nb,1000,3000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := InitializeConfig()
+	cfg.Set("static", true)
+	cfg.Set("createGrid", true)
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("OutputFile", filepath.Join(dir, "output.shp"))
+	cfg.Set("LogFile", filepath.Join(dir, "output.log"))
+	cfg.Set("ReceptorFile", receptorFile)
+	receptorOutputFile := filepath.Join(dir, "receptors_out.csv")
+	cfg.Set("ReceptorOutputFile", receptorOutputFile)
+	cfg.Root.SetArgs([]string{"run", "steady"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(receptorOutputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[1][0] != "a" || rows[2][0] != "b" {
+		t.Fatalf("receptor file should have a header and a row for each receptor: %v", rows)
+	}
+	for i, name := range rows[0] {
+		if name == "TotalPM25" && (rows[1][i] == "NaN" || rows[1][i] == "0") {
+			t.Errorf("invalid receptor concentration %s", rows[1][i])
+		}
+	}
+}
+
+func TestInMAPStaticAggregation(t *testing.T) {
+	dir, err := os.MkdirTemp("", "aggregation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := InitializeConfig()
+	cfg.Set("static", true)
+	cfg.Set("createGrid", true)
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("OutputFile", filepath.Join(dir, "output.shp"))
+	cfg.Set("LogFile", filepath.Join(dir, "output.log"))
+	// Use the census polygons as aggregation units.
+	cfg.Set("Aggregation.File", "../cmd/inmap/testdata/testPopulation.shp")
+	cfg.Set("Aggregation.IDColumn", "TotalPop")
+	cfg.Set("Aggregation.Weight", "TotalPop")
+	aggregationFile := filepath.Join(dir, "aggregated.csv")
+	cfg.Set("Aggregation.OutputFile", aggregationFile)
+	cfg.Root.SetArgs([]string{"run", "steady"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(aggregationFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) < 2 || rows[0][0] != "ID" {
+		t.Errorf("aggregation file should have a header and a row for each polygon: %v", rows)
+	}
+}
+
+func TestInMAPStaticColumns(t *testing.T) {
+	dir, err := os.MkdirTemp("", "columns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := InitializeConfig()
+	cfg.Set("static", true)
+	cfg.Set("createGrid", true)
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	out := filepath.Join(dir, "output.shp")
+	cfg.Set("OutputFile", out)
+	cfg.Set("LogFile", filepath.Join(dir, "output.log"))
+	cfg.Set("OutputVariables", map[string]string{"SO2": "SOx"})
+	cfg.Set("OutputAllLayers", true)
+	cfg.Set("OutputColumns", true)
+	columnFile := filepath.Join(dir, "columns.shp")
+	cfg.Set("ColumnOutputFile", columnFile)
+	cfg.Root.SetArgs([]string{"run", "steady"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	// count returns the number of rows in the given shapefile and
+	// the sum of the SO2 column.
+	count := func(f string) (int, float64) {
+		dec, err := shp.NewDecoder(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dec.Close()
+		var n int
+		var total float64
+		for {
+			var rec struct {
+				geom.Polygon
+				SO2 float64
+			}
+			if more := dec.DecodeRow(&rec); !more {
+				break
+			}
+			n++
+			total += rec.SO2
+		}
+		if err := dec.Error(); err != nil {
+			t.Fatal(err)
+		}
+		return n, total
+	}
+	nAll, _ := count(out)
+	nColumns, total := count(columnFile)
+	if nColumns == 0 || nColumns >= nAll {
+		t.Errorf("have %d columns and %d cells in all layers", nColumns, nAll)
+	}
+	if !(total > 0) {
+		t.Errorf("total SO2 column density should be positive but is %g", total)
+	}
+}
+
+func TestInMAPStaticBoundaryData(t *testing.T) {
+	dir, err := os.MkdirTemp("", "boundary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// totalSO2 returns the total SO2 concentration when the simulation
+	// is run with the given boundary data.
+	totalSO2 := func(boundaryData string) float64 {
+		cfg := InitializeConfig()
+		cfg.Set("static", true)
+		cfg.Set("createGrid", true)
+		cfg.Set("config", "../cmd/inmap/configExample.toml")
+		out := filepath.Join(dir, "output.shp")
+		cfg.Set("OutputFile", out)
+		cfg.Set("LogFile", filepath.Join(dir, "output.log"))
+		cfg.Set("OutputVariables", map[string]string{"SO2": "SOx"})
+		cfg.Set("BoundaryData", boundaryData)
+		cfg.Root.SetArgs([]string{"run", "steady"})
+		if err := cfg.Root.Execute(); err != nil {
+			t.Fatal(err)
+		}
+		dec, err := shp.NewDecoder(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dec.Close()
+		var total float64
+		for {
+			var rec struct {
+				geom.Polygon
+				SO2 float64
+			}
+			if more := dec.DecodeRow(&rec); !more {
+				break
+			}
+			total += rec.SO2
+		}
+		if err := dec.Error(); err != nil {
+			t.Fatal(err)
+		}
+		return total
+	}
+	without := totalSO2("")
+	with := totalSO2("../cmd/inmap/testdata/testInMAPInputData.ncf")
+	if with <= without {
+		t.Errorf("SO2 with boundary concentrations (%g) should be greater than without (%g)", with, without)
+	}
+}
+
+func TestInMAPStaticRefinement(t *testing.T) {
+	dir, err := os.MkdirTemp("", "refinement")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// nCells returns the number of ground-level grid cells when the
+	// grid is created using the given refinement criteria.
+	nCells := func(criteria []string, emisDensityThreshold float64) (int, error) {
+		cfg := InitializeConfig()
+		cfg.Set("static", true)
+		cfg.Set("creategrid", true)
+		cfg.Set("config", "../cmd/inmap/configExample.toml")
+		out := filepath.Join(dir, "output.shp")
+		cfg.Set("OutputFile", out)
+		cfg.Set("LogFile", filepath.Join(dir, "output.log"))
+		cfg.Set("VarGrid.RefinementCriteria", criteria)
+		cfg.Set("VarGrid.EmisDensityThreshold", emisDensityThreshold)
+		cfg.Set("NumIterations", 1)
+		cfg.Root.SetArgs([]string{"run", "steady"})
+		if err := cfg.Root.Execute(); err != nil {
+			return 0, err
+		}
+		dec, err := shp.NewDecoder(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dec.Close()
+		return int(dec.AttributeCount()), nil
+	}
+
+	population, err := nCells([]string{"population"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emissions, err := nCells([]string{"emissions"}, 1.e30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emissions != 4 {
+		t.Errorf("with an emissions threshold that is never exceeded, the grid should have 4 cells but has %d", emissions)
+	}
+	if population <= emissions {
+		t.Errorf("the population criterion (%d cells) should divide more cells than the emissions criterion (%d)", population, emissions)
+	}
+	if _, err := nCells([]string{"elevation"}, 0); err == nil {
+		t.Error("expected an error for an invalid refinement criterion")
+	}
+}
+
+func TestInMAPDynamicTime(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dynamictime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := os.ReadFile("../cmd/inmap/testdata/testInMAPInputData.ncf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inmapData := filepath.Join(dir, "inmapData.ncf")
+	days := []string{"20050101", "20050102"}
+	for _, f := range []string{inmapData, PeriodFile(inmapData, days[0]), PeriodFile(inmapData, days[1])} {
+		if err = os.WriteFile(f, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := InitializeConfig()
+	cfg.Set("creategrid", true)
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("InMAPData", inmapData)
+	cfg.Set("OutputVariables", map[string]string{"TotalPM25": "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA"})
+	cfg.Set("DynamicTime.StartDate", days[0])
+	cfg.Set("DynamicTime.EndDate", "20050103")
+	out := filepath.Join(dir, "output.shp")
+	cfg.Set("OutputFile", out)
+	cfg.Root.SetArgs([]string{"run", "dynamic-time"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The meteorology does not change, so the concentrations should
+	// reach the same steady state as in a steady-state simulation,
+	// to within the convergence tolerance of the steady-state simulation.
+	cfg = InitializeConfig()
+	cfg.Set("static", true)
+	cfg.Set("creategrid", true)
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("InMAPData", inmapData)
+	cfg.Set("OutputVariables", map[string]string{"TotalPM25": "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA"})
+	steady := filepath.Join(dir, "steady.shp")
+	cfg.Set("OutputFile", steady)
+	cfg.Root.SetArgs([]string{"run", "steady"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	total := func(f string) float64 {
+		dec, err := shp.NewDecoder(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dec.Close()
+		var total float64
+		for {
+			var rec struct {
+				geom.Polygon
+				TotalPM25 float64
+			}
+			if more := dec.DecodeRow(&rec); !more {
+				break
+			}
+			total += rec.TotalPM25
+		}
+		if err := dec.Error(); err != nil {
+			t.Fatal(err)
+		}
+		return total
+	}
+	want := total(steady)
+	for _, p := range days {
+		if have := total(PeriodFile(out, p)); math.Abs(have-want) > 0.02*want {
+			t.Errorf("%s: have total TotalPM25 %g, want %g", p, have, want)
+		}
+	}
+}
+
+func TestInMAPDynamicTime_temporalProfiles(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dynamictime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := os.ReadFile("../cmd/inmap/testdata/testInMAPInputData.ncf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inmapData := filepath.Join(dir, "inmapData.ncf")
+	days := []string{"20050101", "20050102"} // Saturday and Sunday.
+	for _, f := range []string{inmapData, PeriodFile(inmapData, days[0]), PeriodFile(inmapData, days[1])} {
+		if err = os.WriteFile(f, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// There are no emissions on Saturdays.
+	profiles := filepath.Join(dir, "profiles.csv")
+	if err = os.WriteFile(profiles, []byte(",weekly,1,1,1,1,1,0,1\n,diurnal,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1,1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := InitializeConfig()
+	cfg.Set("creategrid", true)
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("InMAPData", inmapData)
+	cfg.Set("OutputVariables", map[string]string{"TotalPM25": "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA"})
+	cfg.Set("DynamicTime.StartDate", days[0])
+	cfg.Set("DynamicTime.EndDate", "20050103")
+	cfg.Set("DynamicTime.TemporalProfiles", profiles)
+	out := filepath.Join(dir, "output.shp")
+	cfg.Set("OutputFile", out)
+	cfg.Root.SetArgs([]string{"run", "dynamic-time"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	total := func(f string) float64 {
+		dec, err := shp.NewDecoder(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dec.Close()
+		var total float64
+		for {
+			var rec struct {
+				geom.Polygon
+				TotalPM25 float64
+			}
+			if more := dec.DecodeRow(&rec); !more {
+				break
+			}
+			total += rec.TotalPM25
+		}
+		if err := dec.Error(); err != nil {
+			t.Fatal(err)
+		}
+		return total
+	}
+	if have := total(PeriodFile(out, days[0])); have != 0 {
+		t.Errorf("%s: have total TotalPM25 %g, want 0", days[0], have)
+	}
+	if have := total(PeriodFile(out, days[1])); !(have > 0) {
+		t.Errorf("%s: have total TotalPM25 %g, want > 0", days[1], have)
+	}
+}
+
+func TestInMAPDynamicTime_stream(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dynamictime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := os.ReadFile("../cmd/inmap/testdata/testInMAPInputData.ncf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inmapData := filepath.Join(dir, "inmapData.ncf")
+	days := []string{"20050101", "20050102"}
+	for _, f := range []string{inmapData, PeriodFile(inmapData, days[0]), PeriodFile(inmapData, days[1])} {
+		if err = os.WriteFile(f, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := InitializeConfig()
+	cfg.Set("creategrid", true)
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("InMAPData", inmapData)
+	cfg.Set("OutputVariables", map[string]string{"TotalPM25": "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA"})
+	cfg.Set("DynamicTime.StartDate", days[0])
+	cfg.Set("DynamicTime.EndDate", "20050103")
+	cfg.Set("OutputFile", filepath.Join(dir, "output.shp"))
+	stream := filepath.Join(dir, "stream.ncf")
+	cfg.Set("DynamicTime.StreamFile", stream)
+	cfg.Set("DynamicTime.StreamInterval", "12h")
+	cfg.Root.SetArgs([]string{"run", "dynamic-time"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ff, err := cdf.Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := ff.Header.NumRecs(fi.Size()); n != 4 {
+		t.Fatalf("have %d records, want 4", n)
+	}
+	times := make([]float64, 4)
+	if _, err := ff.Reader("time", []int{0}, []int{4}).Read(times); err != nil {
+		t.Fatal(err)
+	}
+	if want := []float64{12, 24, 36, 48}; !reflect.DeepEqual(times, want) {
+		t.Errorf("times: have %v, want %v", times, want)
+	}
+}
+
+func TestInMAPAdjoint(t *testing.T) {
+	dir, err := os.MkdirTemp("", "adjoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := InitializeConfig()
+	cfg.Set("creategrid", true)
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	out := filepath.Join(dir, "adjoint.shp")
+	cfg.Set("OutputFile", out)
+	cfg.Set("LogFile", filepath.Join(dir, "adjoint.log"))
+	cfg.Root.SetArgs([]string{"run", "adjoint"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	dec, err := shp.NewDecoder(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	var n, positive int
+	for {
+		var rec struct {
+			geom.Polygon
+			PM2_5, SOx float64
+		}
+		if more := dec.DecodeRow(&rec); !more {
+			break
+		}
+		n++
+		if rec.PM2_5 < 0 || rec.SOx < 0 {
+			t.Errorf("sensitivities should not be negative: PM2_5=%g, SOx=%g", rec.PM2_5, rec.SOx)
+		}
+		if rec.PM2_5 > 0 {
+			positive++
+		}
+	}
+	if err := dec.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 || positive == 0 {
+		t.Errorf("have %d cells with %d positive PM2_5 sensitivities", n, positive)
+	}
+
+	cfg = InitializeConfig()
+	cfg.Set("creategrid", true)
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("OutputFile", out)
+	cfg.Set("NitrateEquilibrium", true)
+	cfg.Root.SetArgs([]string{"run", "adjoint"})
+	if err := cfg.Root.Execute(); err == nil {
+		t.Error("expected an error for nonlinear chemistry")
+	}
+}
+
+func TestInMAPNested(t *testing.T) {
+	dir, err := os.MkdirTemp("", "nested")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The nested domain covers the southwest quarter of the main domain
+	// at four times the resolution.
+	b, err := os.ReadFile("../cmd/inmap/configExample.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	innerOut := filepath.Join(dir, "inner.shp")
+	innerCfg := string(b)
+	for _, r := range [][2]string{
+		{"VariableGridDx= 4000.0", "VariableGridDx= 1000.0"},
+		{"VariableGridDy= 4000.0", "VariableGridDy= 1000.0"},
+		{"Xnests= [2, 2, 2]", "Xnests= [4]"},
+		{"Ynests= [2, 2, 2]", "Ynests= [4]"},
+		{`OutputFile = "${INMAP_ROOT_DIR}/cmd/inmap/testdata/output_${InMAPRunType}.shp"`,
+			fmt.Sprintf("creategrid = true\nOutputFile = %q", innerOut)},
+	} {
+		if !strings.Contains(innerCfg, r[0]) {
+			t.Fatalf("configuration file does not contain %q", r[0])
+		}
+		innerCfg = strings.Replace(innerCfg, r[0], r[1], 1)
+	}
+	innerCfgFile := filepath.Join(dir, "inner.toml")
+	if err := os.WriteFile(innerCfgFile, []byte(innerCfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := InitializeConfig()
+	cfg.Set("creategrid", true)
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	out := filepath.Join(dir, "outer.shp")
+	cfg.Set("OutputFile", out)
+	cfg.Set("LogFile", filepath.Join(dir, "outer.log"))
+	cfg.Set("Nest.Config", innerCfgFile)
+	cfg.Root.SetArgs([]string{"run", "nested"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []string{out, innerOut} {
+		dec, err := shp.NewDecoder(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n, positive int
+		for {
+			var rec struct {
+				geom.Polygon
+				TotalPM25 float64
+			}
+			if more := dec.DecodeRow(&rec); !more {
+				break
+			}
+			n++
+			if rec.TotalPM25 < 0 {
+				t.Errorf("%s: negative concentration %g", f, rec.TotalPM25)
+			} else if rec.TotalPM25 > 0 {
+				positive++
+			}
+		}
+		if err := dec.Error(); err != nil {
+			t.Fatal(err)
+		}
+		dec.Close()
+		if n == 0 || positive == 0 {
+			t.Errorf("%s: have %d cells with %d positive concentrations", f, n, positive)
+		}
+	}
+
+	cfg = InitializeConfig()
+	cfg.Set("creategrid", true)
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("OutputFile", out)
+	cfg.Set("LogFile", filepath.Join(dir, "outer.log"))
+	cfg.Root.SetArgs([]string{"run", "nested"})
+	if err := cfg.Root.Execute(); err == nil {
+		t.Error("expected an error for a missing nested domain configuration")
+	}
+}
+
 func TestInMAPStaticLoadGrid(t *testing.T) {
 	cfg := InitializeConfig()
 	cfg.Set("static", true)
@@ -73,6 +862,105 @@ func TestInMAPStaticLoadGrid(t *testing.T) {
 	}
 }
 
+func TestInMAPStaticDistributed(t *testing.T) {
+	dir, err := os.MkdirTemp("", "distributed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var workers []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		workers = append(workers, l.Addr().String())
+		l.Close()
+	}
+
+	// run runs the simulation as the worker with the given rank and
+	// returns the number of ground-level grid cells in the output and
+	// the total PM2.5 concentration in them.
+	run := func(rank int, workers []string) (int, float64, error) {
+		cfg := InitializeConfig()
+		cfg.Set("static", true)
+		cfg.Set("creategrid", false)
+		cfg.Set("config", "../cmd/inmap/configExample.toml")
+		out := filepath.Join(dir, fmt.Sprintf("output_%d_%d.shp", len(workers), rank))
+		cfg.Set("OutputFile", out)
+		cfg.Set("LogFile", filepath.Join(dir, fmt.Sprintf("output_%d_%d.log", len(workers), rank)))
+		cfg.Set("OutputVariables", map[string]string{"PM25": "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA"})
+		cfg.Set("NumIterations", 20)
+		cfg.Set("Distributed.Workers", workers)
+		cfg.Set("Distributed.Rank", rank)
+		cfg.Root.SetArgs([]string{"run", "steady"})
+		if err := cfg.Root.Execute(); err != nil {
+			return 0, 0, err
+		}
+		dec, err := shp.NewDecoder(out)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer dec.Close()
+		var n int
+		var total float64
+		for {
+			var rec struct {
+				geom.Polygon
+				PM25 float64
+			}
+			if more := dec.DecodeRow(&rec); !more {
+				break
+			}
+			n++
+			total += rec.PM25
+		}
+		return n, total, dec.Error()
+	}
+
+	wantN, wantTotal, err := run(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := make([]int, len(workers))
+	total := make([]float64, len(workers))
+	errs := make([]error, len(workers))
+	var wg sync.WaitGroup
+	for rank := range workers {
+		wg.Add(1)
+		go func(rank int) {
+			defer wg.Done()
+			n[rank], total[rank], errs[rank] = run(rank, workers)
+		}(rank)
+	}
+	wg.Wait()
+	for rank, err := range errs {
+		if err != nil {
+			t.Fatalf("worker %d: %v", rank, err)
+		}
+		if n[rank] == 0 || n[rank] == wantN {
+			t.Errorf("worker %d: partition has %d of %d cells", rank, n[rank], wantN)
+		}
+	}
+	if n[0]+n[1] != wantN {
+		t.Errorf("the partitions have %d cells but the grid has %d", n[0]+n[1], wantN)
+	}
+	if have := total[0] + total[1]; wantTotal == 0 || math.Abs(have-wantTotal) > 1.e-10*wantTotal {
+		t.Errorf("total PM2.5: have %g, want %g", have, wantTotal)
+	}
+
+	cfg := InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("static", true)
+	cfg.Set("creategrid", true)
+	cfg.Set("Distributed.Workers", workers)
+	cfg.Root.SetArgs([]string{"run", "steady"})
+	if err := cfg.Root.Execute(); err == nil {
+		t.Error("expected an error for a distributed simulation with a grid that is created at run time")
+	}
+}
+
 func TestInMAPDynamic(t *testing.T) {
 	cfg := InitializeConfig()
 	cfg.Set("static", false)
@@ -203,3 +1091,39 @@ func TestGetStringMapString(t *testing.T) {
 	}
 	cfg.Set("VarGrid.MortalityRateColumns", save)
 }
+
+func TestInMAPCellStorageDir(t *testing.T) {
+	dir := t.TempDir()
+	storageDir := filepath.Join(dir, "cells")
+	if err := os.Mkdir(storageDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	run := func(name, storage string) []byte {
+		cfg := InitializeConfig()
+		cfg.Set("static", true)
+		cfg.Set("creategrid", true)
+		cfg.Set("Deterministic", true)
+		cfg.Set("config", "../cmd/inmap/configExample.toml")
+		cfg.Set("CellStorageDir", storage)
+		cfg.Set("OutputFile", filepath.Join(dir, name+".shp"))
+		cfg.Root.SetArgs([]string{"run", "steady"})
+		if err := cfg.Root.Execute(); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(filepath.Join(dir, name+".dbf"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	want := run("memory", "")
+	have := run("storage", storageDir)
+	if !reflect.DeepEqual(have, want) {
+		t.Error("the results using cell storage files are different")
+	}
+	if files, err := os.ReadDir(storageDir); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 0 {
+		t.Errorf("cell storage files %v were not deleted", files)
+	}
+}
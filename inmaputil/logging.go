@@ -0,0 +1,131 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Log formats that can be specified using the LogFormat option.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logConfig holds the log format and minimum log level
+// specified by the LogFormat and LogLevel options.
+var logConfig = struct {
+	sync.Mutex
+	format string
+	level  slog.Level
+}{format: logFormatText, level: slog.LevelInfo}
+
+// setLogging sets the format and minimum level of log messages
+// and directs them to standard error.
+func setLogging(format, level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("inmap: invalid LogLevel %q; it must be debug, info, warn, or error", level)
+	}
+	switch format {
+	case logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("inmap: invalid LogFormat %q; it must be %s or %s", format, logFormatText, logFormatJSON)
+	}
+	logConfig.Lock()
+	logConfig.format, logConfig.level = format, l
+	logConfig.Unlock()
+	setLogOutput(os.Stderr)
+	return nil
+}
+
+// setLogOutput directs log messages, including those written using
+// the standard log package, to w using the configured log format.
+func setLogOutput(w io.Writer) {
+	logConfig.Lock()
+	h := newLogHandler(w, logConfig.format, logConfig.level)
+	logConfig.Unlock()
+	slog.SetDefault(slog.New(h))
+}
+
+// newLogHandler returns a handler that writes log messages in the
+// given format to w.
+func newLogHandler(w io.Writer, format string, level slog.Level) slog.Handler {
+	if format == logFormatJSON {
+		return slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})
+	}
+	return &textHandler{w: w, level: level, mu: new(sync.Mutex)}
+}
+
+// textHandler writes log messages in the same human-readable format as
+// the standard log package. Structured attributes are omitted, except
+// for the percent complete of progress messages.
+type textHandler struct {
+	w     io.Writer
+	level slog.Level
+	mu    *sync.Mutex
+}
+
+func (h *textHandler) Enabled(_ context.Context, l slog.Level) bool { return l >= h.level }
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var prefix, suffix string
+	if r.Level != slog.LevelInfo {
+		prefix = r.Level.String() + ": "
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "percent" {
+			suffix = fmt.Sprintf(" (%.0f%%)", a.Value.Float64())
+			return false
+		}
+		return true
+	})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := fmt.Fprintf(h.w, "%s %s%s%s\n", r.Time.Format("2006/01/02 15:04:05"), prefix, r.Message, suffix)
+	return err
+}
+
+func (h *textHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *textHandler) WithGroup(string) slog.Handler      { return h }
+
+// logProgress logs msg from module as a progress message
+// for step done of total steps.
+func logProgress(module, msg string, done, total int, args ...any) {
+	args = append([]any{"module", module, "event", "progress", "percent", 100 * float64(done) / float64(total)}, args...)
+	slog.Info(msg, args...)
+}
+
+// outChan returns a channel that logs the messages it receives as
+// information from module.
+func outChan(module string) chan string {
+	outChan := make(chan string)
+	go func() {
+		for msg := range outChan {
+			slog.Info(strings.TrimSpace(msg), "module", module)
+		}
+	}()
+	return outChan
+}
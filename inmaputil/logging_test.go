@@ -0,0 +1,72 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"regexp"
+	"testing"
+)
+
+func TestLogHandler_text(t *testing.T) {
+	var b bytes.Buffer
+	l := slog.New(newLogHandler(&b, logFormatText, slog.LevelInfo))
+	l.Debug("hidden")
+	l.Info("running", "module", "inmap")
+	l.Info("period 1 of 4", "module", "inmap", "percent", 25.0)
+	l.Warn("careful")
+	want := regexp.MustCompile(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d running
+\d{4}/\d\d/\d\d \d\d:\d\d:\d\d period 1 of 4 \(25%\)
+\d{4}/\d\d/\d\d \d\d:\d\d:\d\d WARN: careful
+$`)
+	if !want.Match(b.Bytes()) {
+		t.Errorf("invalid log output %q", b.String())
+	}
+}
+
+func TestLogHandler_json(t *testing.T) {
+	var b bytes.Buffer
+	l := slog.New(newLogHandler(&b, logFormatJSON, slog.LevelWarn)).With("module", "batch")
+	l.Info("hidden")
+	l.Warn("scenario failed", "event", "progress", "percent", 50.0)
+	var msg struct {
+		Level, Msg, Module, Event string
+		Percent                   float64
+	}
+	if err := json.Unmarshal(b.Bytes(), &msg); err != nil {
+		t.Fatalf("%v: %q", err, b.String())
+	}
+	if msg.Level != "WARN" || msg.Msg != "scenario failed" || msg.Module != "batch" || msg.Event != "progress" || msg.Percent != 50 {
+		t.Errorf("invalid message %+v", msg)
+	}
+}
+
+func TestSetLogging(t *testing.T) {
+	if err := setLogging("xml", "info"); err == nil {
+		t.Error("expected an error for an invalid format")
+	}
+	if err := setLogging(logFormatText, "loud"); err == nil {
+		t.Error("expected an error for an invalid level")
+	}
+	if err := setLogging(logFormatText, "info"); err != nil {
+		t.Error(err)
+	}
+}
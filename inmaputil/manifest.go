@@ -0,0 +1,168 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yuzhou-wang/inmap"
+)
+
+// runManifest records what is needed to reproduce and audit a simulation.
+type runManifest struct {
+	// Command is the command that was run, e.g., "inmap run steady".
+	Command string `json:"command"`
+
+	// Created is the time the simulation was started.
+	Created time.Time `json:"created"`
+
+	// Version is the InMAP version and Build holds information about
+	// the build of the program, including the source code revision if
+	// it was built from a version control checkout.
+	Version string            `json:"version"`
+	Build   map[string]string `json:"build"`
+
+	// Config holds the value of each configuration option that applies
+	// to Command.
+	Config map[string]interface{} `json:"config"`
+
+	// Inputs are the input files of the simulation.
+	Inputs []manifestInput `json:"inputs"`
+}
+
+// manifestInput is an input file of a simulation.
+type manifestInput struct {
+	// Option is the name of the configuration option that specifies
+	// the file.
+	Option string `json:"option"`
+
+	Path string `json:"path"`
+
+	// SHA256 is the hex-encoded SHA-256 hash of the contents of the
+	// file. It is empty for remote files.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// shapefileParts are the extensions of the files, in addition to
+// the .shp file, that make up a shapefile.
+var shapefileParts = []string{".shx", ".dbf", ".prj"}
+
+// writeManifest writes a manifest of the simulation run by cmd to
+// the JSON file at path, recording the InMAP version and build, the
+// configuration, and hashes of the input files, so that the results
+// can be reproduced and audited. Input files that do not exist are not
+// included.
+func (cfg *Cfg) writeManifest(cmd *cobra.Command, path string) error {
+	has := func(name string) bool {
+		return cmd.Flags().Lookup(name) != nil || cmd.InheritedFlags().Lookup(name) != nil
+	}
+	m := runManifest{
+		Command: cmd.CommandPath(),
+		Created: time.Now().UTC(),
+		Version: inmap.Version,
+		Build: map[string]string{
+			"go":   runtime.Version(),
+			"os":   runtime.GOOS,
+			"arch": runtime.GOARCH,
+		},
+		Config: make(map[string]interface{}),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if strings.HasPrefix(s.Key, "vcs") {
+				m.Build[s.Key] = s.Value
+			}
+		}
+	}
+	for _, option := range options {
+		if !has(option.name) {
+			continue
+		}
+		m.Config[option.name] = cfg.Get(option.name)
+		if !option.isInputFile {
+			continue
+		}
+		for _, f := range inputFilePaths(cfg.Get(option.name)) {
+			if f = os.ExpandEnv(f); strings.Contains(f, "://") {
+				m.Inputs = append(m.Inputs, manifestInput{Option: option.name, Path: f})
+				continue
+			}
+			files := []string{f}
+			if strings.ToLower(filepath.Ext(f)) == ".shp" {
+				for _, ext := range shapefileParts {
+					files = append(files, strings.TrimSuffix(f, filepath.Ext(f))+ext)
+				}
+			}
+			for _, ff := range files {
+				hash, err := fileSHA256(ff)
+				if os.IsNotExist(err) {
+					continue
+				} else if err != nil {
+					return fmt.Errorf("inmap: writing manifest: %v", err)
+				}
+				m.Inputs = append(m.Inputs, manifestInput{Option: option.name, Path: ff, SHA256: hash})
+			}
+		}
+	}
+	sort.Slice(m.Inputs, func(i, j int) bool {
+		if m.Inputs[i].Option != m.Inputs[j].Option {
+			return m.Inputs[i].Option < m.Inputs[j].Option
+		}
+		return m.Inputs[i].Path < m.Inputs[j].Path
+	})
+
+	w, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("inmap: writing manifest: %v", err)
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	if err = e.Encode(m); err != nil {
+		w.Close()
+		return fmt.Errorf("inmap: writing manifest: %v", err)
+	}
+	return w.Close()
+}
+
+// fileSHA256 returns the hex-encoded SHA-256 hash of the contents of
+// the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,92 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yuzhou-wang/inmap"
+)
+
+func TestDeterministicManifest(t *testing.T) {
+	dir := t.TempDir()
+	run := func(name string) []byte {
+		cfg := InitializeConfig()
+		cfg.Set("static", true)
+		cfg.Set("creategrid", true)
+		cfg.Set("Deterministic", true)
+		cfg.Set("config", "../cmd/inmap/configExample.toml")
+		cfg.Set("OutputFile", filepath.Join(dir, name+".shp"))
+		cfg.Set("ManifestFile", filepath.Join(dir, name+".json"))
+		cfg.Root.SetArgs([]string{"run", "steady"})
+		if err := cfg.Root.Execute(); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(filepath.Join(dir, name+".dbf"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	if !bytes.Equal(run("run1"), run("run2")) {
+		t.Error("deterministic simulations have different results")
+	}
+
+	f, err := os.Open(filepath.Join(dir, "run1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var m runManifest
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Command != "inmap run steady" {
+		t.Errorf("command: have %q, want %q", m.Command, "inmap run steady")
+	}
+	if m.Version != inmap.Version {
+		t.Errorf("version: have %q, want %q", m.Version, inmap.Version)
+	}
+	if m.Config["Deterministic"] != true {
+		t.Errorf("Deterministic: have %v, want true", m.Config["Deterministic"])
+	}
+	if _, ok := m.Config["Preproc.CTMType"]; ok {
+		t.Error("the manifest should not include options for other commands")
+	}
+	wantHash, err := fileSHA256(os.ExpandEnv("${INMAP_ROOT_DIR}/cmd/inmap/testdata/testEmis.dbf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, in := range m.Inputs {
+		if in.Option == "EmissionsShapefiles" && filepath.Base(in.Path) == "testEmis.dbf" {
+			found = true
+			if in.SHA256 != wantHash {
+				t.Errorf("hash of %s: have %s, want %s", in.Path, in.SHA256, wantHash)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("the manifest inputs do not include the emissions: %+v", m.Inputs)
+	}
+}
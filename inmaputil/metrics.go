@@ -0,0 +1,160 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/yuzhou-wang/inmap"
+)
+
+// metricsRegistry holds the metrics that are served in the Prometheus
+// format when the Metrics.Address option is set. In addition to the
+// metrics below, it includes the memory use and other statistics of the
+// Go runtime and the process.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	metricIterations = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "inmap_iterations_total",
+		Help: "Number of simulation time steps that have been calculated.",
+	})
+	metricCells = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "inmap_cells",
+		Help: "Number of grid cells in the simulation domain.",
+	})
+	metricCellsProcessed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "inmap_cells_processed_total",
+		Help: "Number of grid cell time steps that have been calculated.",
+	})
+	metricCellsPerSecond = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "inmap_cells_processed_per_second",
+		Help: "Number of grid cells processed per second of wall time during the most recent time step.",
+	})
+	metricSimulationTime = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "inmap_simulation_time_seconds_total",
+		Help: "Simulation time that has been calculated.",
+	})
+	metricPreprocFileReads = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "inmap_preproc_file_reads_total",
+		Help: "Number of times the preprocessor has finished reading a variable from a chemical transport model output file.",
+	})
+	metricPreprocRecords = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "inmap_preproc_records_read_total",
+		Help: "Number of variable records that have been read from chemical transport model output files by the preprocessor.",
+	})
+	metricBatchScenarios = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "inmap_batch_scenarios",
+		Help: "Number of batch scenarios that are queued or running.",
+	}, []string{"state"})
+	metricServerRuns = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "inmap_server_runs_running",
+		Help: "Number of runs of the run server that are running.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		metricIterations,
+		metricCells,
+		metricCellsProcessed,
+		metricCellsPerSecond,
+		metricSimulationTime,
+		metricPreprocFileReads,
+		metricPreprocRecords,
+		metricBatchScenarios,
+		metricServerRuns,
+	)
+}
+
+// metricsServer is the address that the metrics are being served at.
+var metricsServer struct {
+	sync.Mutex
+	addr string
+}
+
+// serveMetrics starts serving the metrics in metricsRegistry at the
+// path /metrics of addr, unless addr is empty or they are already being
+// served there.
+func serveMetrics(addr string) error {
+	metricsServer.Lock()
+	defer metricsServer.Unlock()
+	if addr == "" || addr == metricsServer.addr {
+		return nil
+	}
+	if metricsServer.addr != "" {
+		return fmt.Errorf("inmap: metrics are already being served at %s", metricsServer.addr)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("inmap: serving metrics: %v", err)
+	}
+	metricsServer.addr = addr
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	go http.Serve(l, mux)
+	return nil
+}
+
+// simulationMetrics returns a DomainManipulator that updates the
+// simulation metrics after each time step.
+func simulationMetrics() inmap.DomainManipulator {
+	var last time.Time
+	return func(d *inmap.InMAP) error {
+		n := float64(len(d.Cells()))
+		now := time.Now()
+		if !last.IsZero() {
+			metricCellsPerSecond.Set(n / now.Sub(last).Seconds())
+		}
+		last = now
+		metricIterations.Inc()
+		metricCells.Set(n)
+		metricCellsProcessed.Add(n)
+		metricSimulationTime.Add(d.Dt)
+		return nil
+	}
+}
+
+// preprocReadMessage matches the message the preprocessor sends after
+// reading a variable from a file.
+var preprocReadMessage = regexp.MustCompile(`^Read (\d+) records of \S+ from `)
+
+// preprocMetrics updates the preprocessor metrics from message msg.
+func preprocMetrics(msg string) {
+	m := preprocReadMessage.FindStringSubmatch(msg)
+	if m == nil {
+		return
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return
+	}
+	metricPreprocFileReads.Inc()
+	metricPreprocRecords.Add(float64(n))
+}
@@ -0,0 +1,89 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/science/chem/simplechem"
+)
+
+func TestSimulationMetrics(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := inmap.VarGridTestData()
+	var m simplechem.Mechanism
+
+	iterations := testutil.ToFloat64(metricIterations)
+	processed := testutil.ToFloat64(metricCellsProcessed)
+	d := &inmap.InMAP{
+		InitFuncs: []inmap.DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, nil, m),
+			inmap.SetTimestepCFL(),
+		},
+		RunFuncs: []inmap.DomainManipulator{
+			inmap.Calculations(inmap.UpwindAdvection(), inmap.Mixing()),
+			inmap.SteadyStateConvergenceCheck(3, cfg.PopGridColumn, m, nil),
+			simulationMetrics(),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	n := float64(len(d.Cells()))
+	if have := testutil.ToFloat64(metricIterations) - iterations; have != 3 {
+		t.Errorf("iterations: have %g, want 3", have)
+	}
+	if have := testutil.ToFloat64(metricCells); have != n {
+		t.Errorf("cells: have %g, want %g", have, n)
+	}
+	if have := testutil.ToFloat64(metricCellsProcessed) - processed; have != 3*n {
+		t.Errorf("cells processed: have %g, want %g", have, 3*n)
+	}
+	if testutil.ToFloat64(metricCellsPerSecond) <= 0 {
+		t.Error("cells processed per second should be positive")
+	}
+
+	w := httptest.NewRecorder()
+	promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, name := range []string{"inmap_iterations_total", "inmap_cells_processed_per_second", "go_memstats_heap_alloc_bytes"} {
+		if !strings.Contains(w.Body.String(), name) {
+			t.Errorf("metrics should include %s", name)
+		}
+	}
+}
+
+func TestPreprocMetrics(t *testing.T) {
+	reads := testutil.ToFloat64(metricPreprocFileReads)
+	records := testutil.ToFloat64(metricPreprocRecords)
+	preprocMetrics("Read 24 records of T from wrfout_d01_2005-01-01_00_00_00")
+	preprocMetrics("Processing PM2.5")
+	if have := testutil.ToFloat64(metricPreprocFileReads) - reads; have != 1 {
+		t.Errorf("file reads: have %g, want 1", have)
+	}
+	if have := testutil.ToFloat64(metricPreprocRecords) - records; have != 24 {
+		t.Errorf("records: have %g, want 24", have)
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/emissions/aep"
+	"github.com/yuzhou-wang/inmap/emissions/aep/aeputil"
+)
+
+// neiPollutants are the names of the pollutants in National Emissions
+// Inventory files, as well as the InMAP names in case the files have
+// already been processed, that correspond to the InMAP VOC, NOx, NH3, SOx,
+// PM2.5, EC, OC, and PM10 emissions.
+var neiPollutants = [8][]aep.Pollutant{
+	{{Name: "VOC"}},
+	{{Name: "NOX"}, {Name: "NOx"}},
+	{{Name: "NH3"}},
+	{{Name: "SO2"}, {Name: "SOx"}},
+	{{Name: "PM25-PRI"}, {Name: "PM2_5"}},
+	{{Name: "EC"}},
+	{{Name: "OC"}},
+	{{Name: "PM10-PRI"}, {Name: "PM10"}},
+}
+
+// neiRecord is an emissions shapefile record.
+type neiRecord struct {
+	geom.Polygon
+	VOC, NOx, NH3, SOx float64 // emissions [short tons/year]
+	PM25               float64 `shp:"PM2_5"` // emissions [short tons/year]
+	EC, OC, PM10       float64 // emissions [short tons/year]
+	Height             float64 // stack height [m]
+	Diam               float64 // stack diameter [m]
+	Temp               float64 // stack temperature [K]
+	Velocity           float64 // stack velocity [m/s]
+}
+
+// NEI retrieves the National Emissions Inventory (NEI) files for the
+// given year, allocates the emissions to the grid cells of the outermost
+// nest of the grid specified by VarGrid using the surrogates specified
+// in inventoryConfig and spatialConfig, and writes them to OutputFile,
+// which is a shapefile with emissions in units of short tons/year that
+// can be used with the EmissionsShapefiles configuration option.
+//
+// Files is a map of sector names to the locations of the inventory files
+// for each sector, and AncillaryFiles are the locations of other files,
+// such as gridding references and surrogate shapefiles, that are
+// needed to process the inventory. Locations can be URLs or local paths,
+// and the text "[YEAR]" in each location is replaced by year. Files at
+// URLs are downloaded to the subdirectory of CacheDir for year the
+// first time they are needed and archives are extracted (see
+// aeputil.Fetch). So that other configuration options, such as
+// aep.GridRef and aep.SrgShapefileDirectory, can refer to the
+// downloaded files, the environment variable NEIDir is set to
+// the directory where the files for year are stored.
+func NEI(ctx context.Context, year int, Files map[string][]string, AncillaryFiles []string, CacheDir, OutputFile string,
+	VarGrid *inmap.VarGridConfig, inventoryConfig *aeputil.InventoryConfig, spatialConfig *aeputil.SpatialConfig,
+	outChan chan string) error {
+	if len(Files) == 0 {
+		return fmt.Errorf("inmap: no NEI files are specified for %d", year)
+	}
+	if CacheDir == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return fmt.Errorf("inmap: finding NEI cache directory: %v", err)
+		}
+		CacheDir = filepath.Join(dir, "inmap", "nei")
+	}
+	yearDir := filepath.Join(CacheDir, strconv.Itoa(year))
+	os.Setenv("NEIDir", yearDir)
+
+	fetch := func(location string) ([]string, error) {
+		location = strings.Replace(os.ExpandEnv(location), "[YEAR]", strconv.Itoa(year), -1)
+		outChan <- fmt.Sprintf("retrieving %s", location)
+		return aeputil.Fetch(ctx, location, yearDir)
+	}
+	for _, f := range AncillaryFiles {
+		if _, err := fetch(f); err != nil {
+			return err
+		}
+	}
+	inventoryConfig.NEIFiles = make(map[string][]string)
+	for sector, locations := range Files {
+		for _, l := range locations {
+			files, err := fetch(l)
+			if err != nil {
+				return err
+			}
+			inventoryConfig.NEIFiles[sector] = append(inventoryConfig.NEIFiles[sector], files...)
+		}
+	}
+	if inventoryConfig.PolsToKeep == nil {
+		inventoryConfig.PolsToKeep = make(aep.Speciation)
+	}
+	for p, s := range (aep.Speciation{"NOX": {}, "SO2": {}, "PM25-PRI": {}, "PM10-PRI": {}}) {
+		if _, ok := inventoryConfig.PolsToKeep[p]; !ok {
+			inventoryConfig.PolsToKeep[p] = s
+		}
+	}
+
+	outChan <- "reading NEI emissions"
+	recs, err := readEmissionsAEP(inventoryConfig, nil)
+	if err != nil {
+		return err
+	}
+	outChan <- "allocating NEI emissions to grid"
+	gridCells := make([]geom.Polygonal, 0, VarGrid.Xnests[0]*VarGrid.Ynests[0])
+	for iy := 0; iy < VarGrid.Ynests[0]; iy++ {
+		for ix := 0; ix < VarGrid.Xnests[0]; ix++ {
+			x := VarGrid.VariableGridXo + float64(ix)*VarGrid.VariableGridDx
+			y := VarGrid.VariableGridYo + float64(iy)*VarGrid.VariableGridDy
+			gridCells = append(gridCells, geom.Polygon{{
+				{X: x, Y: y}, {X: x + VarGrid.VariableGridDx, Y: y},
+				{X: x + VarGrid.VariableGridDx, Y: y + VarGrid.VariableGridDy},
+				{X: x, Y: y + VarGrid.VariableGridDy}, {X: x, Y: y},
+			}})
+		}
+	}
+	emisRecs, err := gridEmissionsAEPCells(recs, spatialConfig, gridCells, neiPollutants)
+	if err != nil {
+		return err
+	}
+	outChan <- fmt.Sprintf("writing NEI emissions to %s", OutputFile)
+	return writeNEIShapefile(OutputFile, emisRecs, VarGrid.GridProj)
+}
+
+// writeNEIShapefile writes emisRecs to the shapefile fname in units of
+// short tons/year. Ground-level emissions in the same grid cell are
+// combined into a single record.
+func writeNEIShapefile(fname string, emisRecs []*inmap.EmisRecord, gridProj string) error {
+	type cellKey struct{ x, y float64 }
+	var out []*neiRecord
+	ground := make(map[cellKey]*neiRecord)
+	for _, e := range emisRecs {
+		p, ok := e.Geom.(geom.Polygon)
+		if !ok {
+			return fmt.Errorf("inmap: invalid NEI emissions geometry type %T", e.Geom)
+		}
+		r := &neiRecord{
+			Polygon: p,
+			VOC:     e.VOC * tonsPerUgPerS,
+			NOx:     e.NOx * tonsPerUgPerS,
+			NH3:     e.NH3 * tonsPerUgPerS,
+			SOx:     e.SOx * tonsPerUgPerS,
+			PM25:    e.PM25 * tonsPerUgPerS,
+			EC:      e.EC * tonsPerUgPerS,
+			OC:      e.OC * tonsPerUgPerS,
+			PM10:    e.PM10 * tonsPerUgPerS,
+		}
+		if e.Height != 0 {
+			r.Height, r.Diam, r.Temp, r.Velocity = e.Height, e.Diam, e.Temp, e.Velocity
+			out = append(out, r)
+			continue
+		}
+		b := p.Bounds()
+		k := cellKey{x: b.Min.X, y: b.Min.Y}
+		if g, ok := ground[k]; ok {
+			g.VOC += r.VOC
+			g.NOx += r.NOx
+			g.NH3 += r.NH3
+			g.SOx += r.SOx
+			g.PM25 += r.PM25
+			g.EC += r.EC
+			g.OC += r.OC
+			g.PM10 += r.PM10
+			continue
+		}
+		ground[k] = r
+		out = append(out, r)
+	}
+	// Sort the records so the output is the same every time.
+	sort.SliceStable(out, func(i, j int) bool {
+		bi, bj := out[i].Bounds(), out[j].Bounds()
+		if bi.Min.Y != bj.Min.Y {
+			return bi.Min.Y < bj.Min.Y
+		}
+		return bi.Min.X < bj.Min.X
+	})
+
+	if err := os.MkdirAll(filepath.Dir(fname), os.ModePerm); err != nil {
+		return err
+	}
+	e, err := shp.NewEncoder(fname, neiRecord{})
+	if err != nil {
+		return fmt.Errorf("inmap: writing NEI emissions: %v", err)
+	}
+	for _, r := range out {
+		if err = e.Encode(r); err != nil {
+			e.Close()
+			return fmt.Errorf("inmap: writing NEI emissions: %v", err)
+		}
+	}
+	e.Close()
+	prj := strings.TrimSuffix(fname, filepath.Ext(fname)) + ".prj"
+	return os.WriteFile(prj, []byte(gridProj), 0644)
+}
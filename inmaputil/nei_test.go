@@ -0,0 +1,88 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yuzhou-wang/inmap"
+)
+
+func TestNEI(t *testing.T) {
+	server := httptest.NewServer(http.StripPrefix("/2016/", http.FileServer(http.Dir("../emissions/aep/aeputil/testdata"))))
+	defer server.Close()
+
+	dir, err := os.MkdirTemp("", "nei")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outFile := filepath.Join(dir, "nei.shp")
+
+	cfg := InitializeConfig()
+	cfg.Set("NEI.Year", 2016)
+	cfg.Set("NEI.Files", map[string][]string{"othar": {server.URL + "/[YEAR]/testemis.csv"}})
+	cfg.Set("NEI.AncillaryFiles", []string{server.URL + "/[YEAR]/gridref.txt"})
+	cfg.Set("NEI.CacheDir", dir)
+	cfg.Set("NEI.OutputFile", outFile)
+	cfg.Set("aep.InventoryConfig.InputUnits", "tons")
+	cfg.Set("aep.SrgSpecSMOKE", "../emissions/aep/aeputil/testdata/surrogate_specification.csv")
+	cfg.Set("aep.SrgShapefileDirectory", "../emissions/aep/testdata")
+	cfg.Set("aep.GridRef", []string{"${NEIDir}/gridref.txt"})
+	cfg.Set("aep.SCCExactMatch", false)
+	cfg.Set("VarGrid.GridProj", "+proj=lcc +lat_1=33.000000 +lat_2=45.000000 +lat_0=40.000000 +lon_0=-97.000000 +x_0=0 +y_0=0 +a=6370997.000000 +b=6370997.000000 +to_meter=1")
+	cfg.Set("VarGrid.VariableGridXo", -2736000.0)
+	cfg.Set("VarGrid.VariableGridYo", -2088000.0)
+	cfg.Set("VarGrid.VariableGridDx", 48000.0)
+	cfg.Set("VarGrid.VariableGridDy", 48000.0)
+	cfg.Set("VarGrid.Xnests", "[111]")
+	cfg.Set("VarGrid.Ynests", "[84]")
+	cfg.Root.SetArgs([]string{"emissions", "nei"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "2016", "testemis.csv")); err != nil {
+		t.Errorf("the inventory file should be cached: %v", err)
+	}
+	vgc, err := VarGridConfig(cfg.Viper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, err := spatialRef(vgc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emis, err := inmap.ReadEmissionShapefiles(sr, "tons/year", nil, nil, outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nox, sox float64
+	for _, e := range emis.EmisRecords() {
+		nox += e.NOx
+		sox += e.SOx
+	}
+	if !(nox > 0) || !(sox > 0) {
+		t.Errorf("NOx (%g) and SOx (%g) emissions should be > 0", nox, sox)
+	}
+}
@@ -0,0 +1,245 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ctessum/geom"
+	"github.com/lnashier/viper"
+	"github.com/spf13/cobra"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/emissions/aep/aeputil"
+)
+
+// NestedDomain holds the configuration of one of the domains of a
+// nested simulation. The fields have the same meanings as the
+// corresponding arguments to Run.
+type NestedDomain struct {
+	OutputFile          string
+	OutputAllLayers     bool
+	OutputVariables     map[string]string
+	EmissionUnits       string
+	EmissionsShapefiles []string
+	EmissionsMask       geom.Polygon
+	PlumeInGridDistance float64
+	NearRoadWidth       float64
+	VarGrid             *inmap.VarGridConfig
+	InventoryConfig     *aeputil.InventoryConfig
+	SpatialConfig       *aeputil.SpatialConfig
+	InMAPData           string
+	VariableGridData    string
+	CreateGrid          bool
+}
+
+// nestedDomainConfig returns the configuration of a nested simulation
+// domain from the options in cfg, downloading any input files that
+// are in blob storage.
+func nestedDomainConfig(cfg *viper.Viper, outChan chan string) (*NestedDomain, error) {
+	d := new(NestedDomain)
+	var err error
+	if d.VarGrid, err = VarGridConfig(cfg); err != nil {
+		return nil, err
+	}
+	if d.OutputFile, err = checkOutputFile(cfg.GetString("OutputFile")); err != nil {
+		return nil, err
+	}
+	if d.OutputVariables, err = outputVariables(cfg); err != nil {
+		return nil, err
+	}
+	if d.EmissionUnits, err = checkEmissionUnits(cfg.GetString("EmissionUnits")); err != nil {
+		return nil, err
+	}
+	d.EmissionsShapefiles = removeShpSupportFiles(expandStringSlice(cfg.GetStringSlice("EmissionsShapefiles")))
+	for i := range d.EmissionsShapefiles {
+		d.EmissionsShapefiles[i] = maybeDownload(context.TODO(), d.EmissionsShapefiles[i], outChan)
+	}
+	if d.EmissionsMask, err = parseMask(maybeDownload(context.Background(), cfg.GetString("EmissionMaskGeoJSON"), outChan)); err != nil {
+		return nil, err
+	}
+	if d.InventoryConfig, d.SpatialConfig, err = aeputilConfig(cfg); err != nil {
+		return nil, err
+	}
+	d.OutputAllLayers = cfg.GetBool("OutputAllLayers")
+	d.PlumeInGridDistance = cfg.GetFloat64("PlumeInGridDistance")
+	d.NearRoadWidth = cfg.GetFloat64("NearRoadWidth")
+	d.InMAPData = maybeDownload(context.TODO(), os.ExpandEnv(cfg.GetString("InMAPData")), outChan)
+	d.VariableGridData = maybeDownload(context.TODO(), os.ExpandEnv(cfg.GetString("VariableGridData")), outChan)
+	d.CreateGrid = cfg.GetBool("creategrid")
+	return d, nil
+}
+
+// init returns a simulation for the domain with a static grid and the
+// emissions and time step set, which still needs to be initialized,
+// and a function that saves the results.
+func (nd *NestedDomain) init(upload *uploader, ctm *ctmDataLoader, msgLog chan string, m inmap.Mechanism) (*inmap.InMAP, inmap.DomainManipulator, error) {
+	o, err := inmap.NewOutputter(upload.maybeUpload(nd.OutputFile), nd.OutputAllLayers, nd.OutputVariables, nil, m)
+	if err != nil {
+		return nil, nil, err
+	}
+	if upload.err != nil {
+		return nil, nil, upload.err
+	}
+	sr, err := spatialRef(nd.VarGrid)
+	if err != nil {
+		return nil, nil, err
+	}
+	emis, err := inmap.ReadEmissionShapefiles(sr, nd.EmissionUnits, msgLog, nd.EmissionsMask, nd.EmissionsShapefiles...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var initFuncs []inmap.DomainManipulator
+	if nd.CreateGrid {
+		log.Println("Loading CTM data...")
+		ctmData, err := ctm.load(nd.InMAPData, nd.VarGrid)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Println("Loading population and mortality rate data...")
+		pop, popIndices, mr, mortIndices, err := nd.VarGrid.LoadPopMort()
+		if err != nil {
+			return nil, nil, err
+		}
+		mutator, err := nd.VarGrid.RefinementMutator(popIndices, emis)
+		if err != nil {
+			return nil, nil, err
+		}
+		initFuncs = []inmap.DomainManipulator{
+			nd.VarGrid.RegularGrid(ctmData, pop, popIndices, mr, mortIndices, nil, m),
+			nd.VarGrid.MutateGrid(mutator, ctmData, pop, mr, nil, m, msgLog),
+		}
+	} else {
+		var r io.Reader
+		r, err = os.Open(nd.VariableGridData)
+		if err != nil {
+			return nil, nil, fmt.Errorf("problem opening file to load VariableGridData: %v", err)
+		}
+		initFuncs = []inmap.DomainManipulator{inmap.Load(r, nd.VarGrid, nil, m)}
+	}
+	d := &inmap.InMAP{
+		InitFuncs: append(initFuncs,
+			setEmissionsAEP(nd.InventoryConfig, nd.SpatialConfig, emis, nd.EmissionsMask, nd.PlumeInGridDistance, nd.NearRoadWidth, m),
+			inmap.SetTimestepCFL(),
+			o.CheckOutputVars(m),
+		),
+	}
+	return d, o.Output(sr), nil
+}
+
+// RunNested runs a steady-state simulation of the domain outer with the
+// finer-resolution domain inner nested within it, so that a small
+// region can be simulated at high resolution while pollution that is
+// transported into it from the larger domain is accounted for.
+// The concentrations at the edges of inner are taken from outer at each
+// time step and, if feedback is true, the concentrations in the
+// overlapping part of outer are replaced by those in inner (two-way
+// nesting). The results for outer and inner are saved in their
+// respective output files.
+//
+// Both domains use static grids, which must be created from the same
+// vertical layers, and inner should be within outer. The simulation
+// ends when outer reaches steady state. The other arguments are the
+// same as for Run.
+func RunNested(CobraCommand *cobra.Command, LogFile string, outer, inner *NestedDomain, CTMDataCacheDir, CellStorageDir string, NumIterations int,
+	convergence inmap.ConvergenceCriterion, acceleration inmap.DomainManipulator, feedback, deterministic bool,
+	scienceFuncs []inmap.CellManipulator, m inmap.Mechanism) (err error) {
+
+	startTime := time.Now()
+
+	var upload uploader
+
+	l, err := newRunLogger(CobraCommand, upload.maybeUpload(LogFile), NumIterations)
+	if err != nil {
+		return err
+	}
+	defer l.close()
+
+	if convergence == nil {
+		convergence = inmap.MassAndPopulationChange{PopGridColumn: outer.VarGrid.PopGridColumn, Tolerance: 0.001}
+	}
+	scienceCalcs := inmap.Calculations(scienceFuncs...)
+
+	ctm := newCTMDataLoader(CTMDataCacheDir)
+	defer ctm.close()
+
+	log.Println("Initializing nested domain...")
+	innerD, innerOutput, err := inner.init(&upload, ctm, l.msgLog, m)
+	if err != nil {
+		return err
+	}
+	innerD.Deterministic = deterministic
+	innerD.CellStorageDir = CellStorageDir
+	innerD.RunFuncs = []inmap.DomainManipulator{
+		inmap.Calculations(inmap.AddEmissionsFlux()),
+		scienceCalcs,
+	}
+	if err = innerD.Init(); err != nil {
+		return fmt.Errorf("InMAP: problem initializing nested domain: %v\n", err)
+	}
+	// The nested domain is run and output by the outer domain, so it is
+	// only released after the outer domain has been cleaned up.
+	defer func() {
+		if cerr := innerD.Cleanup(); cerr != nil && err == nil {
+			err = fmt.Errorf("InMAP: problem shutting down nested domain: %v\n", cerr)
+		}
+	}()
+
+	log.Println("Initializing model...")
+	d, outerOutput, err := outer.init(&upload, ctm, l.msgLog, m)
+	if err != nil {
+		return err
+	}
+	d.Deterministic = deterministic
+	d.CellStorageDir = CellStorageDir
+	d.RunFuncs = []inmap.DomainManipulator{
+		inmap.Log(l.cLog),
+		simulationMetrics(),
+		inmap.Calculations(inmap.AddEmissionsFlux()),
+		scienceCalcs,
+		inmap.RunNested(innerD, feedback),
+	}
+	if acceleration != nil {
+		d.RunFuncs = append(d.RunFuncs, acceleration)
+	}
+	d.RunFuncs = append(d.RunFuncs, inmap.ConvergenceCheck(NumIterations, convergence, m, l.cConverge))
+	d.CleanupFuncs = []inmap.DomainManipulator{
+		outerOutput,
+		func(*inmap.InMAP) error { return innerOutput(innerD) },
+		upload.uploadOutput,
+	}
+	if err = d.Init(); err != nil {
+		return fmt.Errorf("InMAP: problem initializing model: %v\n", err)
+	}
+	if err = d.Run(); err != nil {
+		return fmt.Errorf("InMAP: problem running simulation: %v\n", err)
+	}
+	if err = d.Cleanup(); err != nil {
+		return fmt.Errorf("InMAP: problem shutting down model: %v\n", err)
+	}
+
+	elapsedTime := time.Since(startTime)
+	log.Printf("Elapsed time: %f hours", elapsedTime.Hours())
+	return nil
+}
@@ -0,0 +1,219 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/yuzhou-wang/inmap"
+)
+
+// PeriodFile returns the name of the file where the preprocessed data
+// for the given period (e.g., "DJF" or "Jan") is stored, where path is
+// the name of the file containing the annual average data.
+// For example, the data for period "DJF" with path "inmapData.ncf" is
+// stored in "inmapData_DJF.ncf".
+func PeriodFile(path, period string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "_" + period + ext
+}
+
+// periodFiles returns the files named by PeriodFile for each of the
+// given periods, downloading them if necessary.
+func periodFiles(ctx context.Context, path string, periods []string, c chan string) []string {
+	o := make([]string, len(periods))
+	for i, p := range periods {
+		o[i] = maybeDownload(ctx, PeriodFile(path, p), c)
+	}
+	return o
+}
+
+// season returns the name of the meteorological season that
+// month m is in.
+func season(m time.Month) string {
+	switch m {
+	case time.December, time.January, time.February:
+		return "DJF"
+	case time.March, time.April, time.May:
+		return "MAM"
+	case time.June, time.July, time.August:
+		return "JJA"
+	default:
+		return "SON"
+	}
+}
+
+// monthPeriods splits the period between start and end at the
+// beginning of each month.
+func monthPeriods(start, end time.Time) [][2]time.Time {
+	var o [][2]time.Time
+	for t := start; t.Before(end); {
+		next := time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		if next.After(end) {
+			next = end
+		}
+		o = append(o, [2]time.Time{t, next})
+		t = next
+	}
+	return o
+}
+
+// dayPeriods splits the period between start and end at the
+// beginning of each day.
+func dayPeriods(start, end time.Time) [][2]time.Time {
+	var o [][2]time.Time
+	for t := start; t.Before(end); {
+		next := time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		if next.After(end) {
+			next = end
+		}
+		o = append(o, [2]time.Time{t, next})
+		t = next
+	}
+	return o
+}
+
+// preprocPeriods preprocesses the period between startDate and endDate
+// one month (or, for daily periods, one day) at a time using preprocess
+// and saves the averages for each of the requested periods ("seasonal",
+// "monthly", or "daily") as well as the annual average, using write to
+// save them. Daily periods are named by their date (e.g., "20050101").
+func preprocPeriods(startDate, endDate, periods, inmapData string, preprocess func(startDate, endDate string) (*inmap.CTMData, error),
+	write func(path string, ctmData *inmap.CTMData) error) error {
+	const format = "20060102"
+	var key func(time.Time) string
+	split := monthPeriods
+	switch periods {
+	case "seasonal":
+		key = func(t time.Time) string { return season(t.Month()) }
+	case "monthly":
+		key = func(t time.Time) string { return t.Month().String()[0:3] }
+	case "daily":
+		key = func(t time.Time) string { return t.Format(format) }
+		split = dayPeriods
+	default:
+		return fmt.Errorf("inmap preprocessor: invalid OutputPeriods '%s'; valid options are annual, seasonal, monthly, and daily", periods)
+	}
+	start, err := time.Parse(format, startDate)
+	if err != nil {
+		return fmt.Errorf("inmap preprocessor: parsing StartDate: %v", err)
+	}
+	end, err := time.Parse(format, endDate)
+	if err != nil {
+		return fmt.Errorf("inmap preprocessor: parsing EndDate: %v", err)
+	}
+
+	periodList := split(start, end)
+	// remaining holds the number of periods that have not been
+	// preprocessed yet for each key, so that the average for each key
+	// can be saved and released as soon as it is complete.
+	remaining := make(map[string]int)
+	for _, p := range periodList {
+		remaining[key(p[0])]++
+	}
+	var all *inmap.CTMData
+	var allWeight float64
+	data := make(map[string]*inmap.CTMData)
+	weights := make(map[string]float64)
+	for _, p := range periodList {
+		d, err := preprocess(p[0].Format(format), p[1].Format(format))
+		if err != nil {
+			return err
+		}
+		k := key(p[0])
+		w := p[1].Sub(p[0]).Hours()
+		if data[k], err = addAverage(data[k], weights[k], d, w); err != nil {
+			return err
+		}
+		weights[k] += w
+		if all, err = addAverage(all, allWeight, d, w); err != nil {
+			return err
+		}
+		allWeight += w
+		if remaining[k]--; remaining[k] == 0 {
+			if err = write(PeriodFile(inmapData, k), data[k]); err != nil {
+				return err
+			}
+			delete(data, k)
+		}
+	}
+	return write(inmapData, all)
+}
+
+// addAverage returns the weighted average of avg, which has weight
+// avgWeight, and d, which has weight w. If avg is nil, d is returned.
+func addAverage(avg *inmap.CTMData, avgWeight float64, d *inmap.CTMData, w float64) (*inmap.CTMData, error) {
+	if avg == nil {
+		return d, nil
+	}
+	return inmap.AverageCTMData([]*inmap.CTMData{avg, d}, []float64{avgWeight, w})
+}
+
+// concentrationAverager averages the concentrations in the cells of
+// simulations of several periods that share the same grid.
+type concentrationAverager struct {
+	n                 int // number of periods
+	ci, cf, cBaseline [][]float64
+}
+
+// add is a DomainManipulator that adds the concentrations in d to the average.
+func (a *concentrationAverager) add(d *inmap.InMAP) error {
+	cells := d.Cells()
+	if a.cf == nil {
+		a.ci = make([][]float64, len(cells))
+		a.cf = make([][]float64, len(cells))
+		a.cBaseline = make([][]float64, len(cells))
+		for i, c := range cells {
+			a.ci[i] = make([]float64, len(c.Ci))
+			a.cf[i] = make([]float64, len(c.Cf))
+			a.cBaseline[i] = make([]float64, len(c.CBaseline))
+		}
+	} else if len(cells) != len(a.cf) {
+		return fmt.Errorf("inmap: averaging periods: grids do not match: %d cells vs. %d cells", len(cells), len(a.cf))
+	}
+	for i, c := range cells {
+		for j := range c.Cf {
+			a.ci[i][j] += c.Ci[j] / float64(a.n)
+			a.cf[i][j] += c.Cf[j] / float64(a.n)
+		}
+		for j := range c.CBaseline {
+			a.cBaseline[i][j] += c.CBaseline[j] / float64(a.n)
+		}
+	}
+	return nil
+}
+
+// set is a DomainManipulator that replaces the concentrations in d with
+// the average.
+func (a *concentrationAverager) set(d *inmap.InMAP) error {
+	cells := d.Cells()
+	if len(cells) != len(a.cf) {
+		return fmt.Errorf("inmap: averaging periods: grids do not match: %d cells vs. %d cells", len(cells), len(a.cf))
+	}
+	for i, c := range cells {
+		copy(c.Ci, a.ci[i])
+		copy(c.Cf, a.cf[i])
+		copy(c.CBaseline, a.cBaseline[i])
+	}
+	return nil
+}
@@ -22,6 +22,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/yuzhou-wang/inmap"
 )
@@ -38,7 +40,8 @@ import (
 //
 // CTMType specifies what type of chemical transport
 // model we are going to be reading data from. Valid
-// options are "GEOS-Chem" and "WRF-Chem".
+// options are "WRF-Cmaq", "WRF-Chem", "CAMx", "MPAS", "GEOS-Chem",
+// "GCHP", and "MERRA2".
 //
 // WRFOut is the location of WRF-Chem output files.
 // [DATE] should be used as a wild card for the simulation date.
@@ -63,15 +66,17 @@ import (
 // the simulation date.
 //
 // GEOSApBp is the location of the pressure level variable file.
-// It is optional; if it is not specified the Ap and Bp information
-// will be extracted from the GEOSChem files.
+// It is optional for GEOS-Chem; if it is not specified the Ap and Bp
+// information will be extracted from the GEOSChem files. It is required
+// for GCHP.
 //
-// GEOSChem is the location of GEOS-Chem output files.
+// GEOSChem is the location of GEOS-Chem output files or, if CTMType
+// is "GCHP", of GCHP cubed-sphere species concentration files.
 // [DATE] should be used as a wild card for the simulation date.
 //
-// VegTypeGlobal is the location of the GEOS-Chem vegtype.global file,
+// OlsonLandMap is the location of the GEOS-Chem Olson land use map file,
 // which is described here:
-// http://wiki.seas.harvard.edu/geos-chem/index.php/Olson_land_map#Structure_of_the_vegtype.global_file
+// http://wiki.seas.harvard.edu/geos-chem/index.php/Olson_land_map
 //
 // InMAPData is the path where the preprocessed baseline meteorology and pollutant
 // data should be written.
@@ -86,44 +91,379 @@ import (
 //
 // dash indicates whether GEOS-Chem variable names are in the form 'IJ-AVG-S__xxx'
 // as opposed to 'IJ_AVG_S_xxx'.
+//
+// ChemRecordInterval and ChemFileInterval are the time durations
+// represented by each GEOS-Chem or GCHP output record and file,
+// respectively, and NoChemHourIndex indicates whether GEOS-Chem output
+// files lack a time dimension.
+//
+// CAMxAvrg is the location of CAMx average concentration files, in
+// either UAM-IV or NetCDF format.
+// [DATE] should be used as a wild card for the simulation date.
+//
+// CAMxWRFOut is the location of the WRF output files that were used to
+// create the CAMx meteorological inputs.
+// [DATE] should be used as a wild card for the simulation date.
+//
+// MPASOut is the location of MPAS-A output files.
+// [DATE] should be used as a wild card for the simulation date.
+//
+// WRFOut, CAMxWRFOut, MPASOut, and the GEOS and GEOS-Chem file locations
+// can also refer to Zarr stores, in local directories or in storage
+// buckets (e.g., "s3://bucket/wrfout_[DATE].zarr"). Zarr stores in storage
+// buckets are read directly rather than being downloaded first. These
+// locations and CAMxAvrg can also refer to NetCDF or UAM-IV files in
+// storage buckets (e.g., "gs://bucket/wrfout_d01_[DATE]"), which are
+// downloaded as they are needed and cached in inmap.BlobCacheDir.
+// They can also be OPeNDAP dataset URLs on THREDDS, Hyrax, or GrADS Data
+// servers (e.g., "https://server/thredds/dodsC/wrfout_d01_[DATE]"), in
+// which case only the required variables and time steps are downloaded.
+//
+// MPASInterpolation is the method used to regrid MPAS output to the
+// CTM grid, either "nearest" or "idw".
+//
+// GridProj is the spatial reference of the CTM grid, and MPASNx and MPASNy
+// are the number of CTM grid cells in the x and y directions; they are
+// only used for MPAS output.
+//
+// MPASRecordInterval and MPASFileInterval are the time durations
+// represented by each MPAS output record and file, respectively.
+//
+// OutputPeriods specifies whether to additionally save separate
+// averages for each "seasonal", "monthly", or "daily" period, in files
+// named by PeriodFile. If it is "annual" or empty, only the average over the
+// whole simulation period is saved.
+//
+// LandUseTable is the table used to convert WRF-Cmaq, WRF-Chem, CAMx, or MPAS
+// land use categories to deposition parameters. It can be the name of a
+// registered table ("NLCD", "USGS", "MODIS", "CORINE", or "ESAWorldCover") or the path to
+// a CSV file in the format read by inmap.ReadLandUseTable. If it is empty,
+// the default table for the CTMType is used.
+//
+// FractionalLandUse specifies whether to use the fraction of each grid
+// cell covered by each land use category (WRF variable LANDUSEF) rather
+// than only the dominant category, for WRF-Cmaq and CAMx output.
+//
+// OutputFormat is the format of the InMAPData file. It can be "inmap"
+// (or empty) for the standard format, or "cf" for a NetCDF file following
+// the Climate and Forecast (CF) metadata conventions, with coordinate
+// variables in the GridProj spatial reference, which can be inspected in
+// tools such as Panoply or xarray and can also be used as InMAP input.
+//
+// Diagnostics specifies whether to write a quick-look map of the column
+// mean of each preprocessed variable to a PNG file after preprocessing,
+// in a directory named after each output file with the suffix
+// "_diagnostics".
+//
+// RecordInterval and FileInterval are the time durations represented by
+// each WRF-Cmaq or CAMx output record and file, respectively. They can
+// be "auto" to detect them from the WRF output files, or empty to use the
+// defaults of one hour and one day.
+//
+// MissingData specifies how WRF-Cmaq and CAMx output files that are
+// missing and time steps that cannot be read are handled: "fail" (or
+// empty) stops preprocessing with an error, "skip" leaves missing files
+// out of the averages, and "interpolate" fills missing time steps by
+// interpolating between the nearest available ones. A summary of the
+// missing data is logged after preprocessing.
+//
+// WRFChemOut is the location of WRF-Chem output files, and
+// WRFChemMechanism is the chemical mechanism of the WRF-Chem simulation,
+// either "RADM2-MADE/VBS" or "MOZART-MOSAIC".
+//
+// MERRA2Asm, MERRA2Flx, MERRA2Rad, MERRA2Lnd, and MERRA2Mst are the
+// locations of the MERRA-2 collections described by inmap.NewMERRA2,
+// and MERRA2OlsonLandMap is the location of the GEOS-Chem Olson land use
+// map file to use with them. MERRA2Chemistry is the source of the
+// chemical concentrations for MERRA-2 meteorology: "climatology" (or
+// empty) for climatological defaults, or "GEOS-Chem" or "GCHP" for the
+// output of a simulation on the MERRA-2 grid whose files are specified
+// in the same way as for the GEOS-Chem and GCHP CTMTypes.
+//
+// Domains are the names of nested WRF domains (e.g., "d01", "d02", "d03"),
+// ordered from the outermost to the innermost, to preprocess for
+// WRF-Cmaq, WRF-Chem, or CAMx output. Each name is substituted for the
+// wild card [DOMAIN] in WRFOut, WRFChemOut, CAMxAvrg, and CAMxWRFOut, and
+// the data from each inner domain overrides the data from its parent
+// domain. The locations and grid cell sizes of the nested domains are read
+// from the WRF output, so CtmGridDx and CtmGridDy are not used, and
+// CtmGridXo and CtmGridYo refer to the outermost domain. If Domains is
+// empty, a single domain is preprocessed.
 func Preproc(StartDate, EndDate, CTMType, WRFOut, GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp,
-	GEOSChem, VegTypeGlobal, InMAPData string, CtmGridXo, CtmGridYo, CtmGridDx, CtmGridDy float64, dash bool) error {
+	GEOSChem, OlsonLandMap, InMAPData string, CtmGridXo, CtmGridYo, CtmGridDx, CtmGridDy float64, dash bool, ChemRecordInterval, ChemFileInterval string, NoChemHourIndex bool, CAMxAvrg, CAMxWRFOut string,
+	MPASOut, MPASInterpolation, GridProj string, MPASNx, MPASNy int, MPASRecordInterval, MPASFileInterval, OutputPeriods, LandUseTable string, FractionalLandUse bool, OutputFormat string, Diagnostics bool, RecordInterval, FileInterval, MissingData, WRFChemOut, WRFChemMechanism string,
+	MERRA2Asm, MERRA2Flx, MERRA2Rad, MERRA2Lnd, MERRA2Mst, MERRA2OlsonLandMap, MERRA2Chemistry string, Domains []string, opts ...inmap.PreprocessOption) error {
 	msgChan := make(chan string)
 	go func() {
 		for {
-			log.Println(<-msgChan)
+			msg := <-msgChan
+			preprocMetrics(msg)
+			log.Println(msg)
 		}
 	}()
-	var ctm inmap.Preprocessor
-	switch CTMType {
-	case "WRF-Cmaq":
-		vars := []string{StartDate, EndDate, CTMType, WRFOut}
-		varNames := []string{"StartDate", "EndDate", "CTMType", "WRFOut"}
-		for i, v := range vars {
-			if v == "" {
-				return fmt.Errorf("inmap preprocessor: configuration variable %s is not specified", varNames[i])
+	var write func(path string, ctmData *inmap.CTMData) error
+	switch OutputFormat {
+	case "", "inmap":
+		write = writeCTMData
+	case "cf":
+		write = func(path string, ctmData *inmap.CTMData) error {
+			return writeCFCTMData(path, ctmData, GridProj)
+		}
+	default:
+		return fmt.Errorf("inmap preprocessor: invalid OutputFormat '%s'; valid options are inmap and cf", OutputFormat)
+	}
+	if Diagnostics {
+		writeData := write
+		write = func(path string, ctmData *inmap.CTMData) error {
+			if err := writeData(path, ctmData); err != nil {
+				return err
 			}
+			dir := strings.TrimSuffix(path, filepath.Ext(path)) + "_diagnostics"
+			log.Printf("writing diagnostic maps to %s", dir)
+			return ctmData.WriteDiagnostics(dir)
 		}
+	}
+	var landUse inmap.LandUseTable
+	if LandUseTable != "" {
 		var err error
-		ctm, err = inmap.NewWRFCmaq(WRFOut, StartDate, EndDate, msgChan)
+		if landUse, err = inmap.LoadLandUseTable(LandUseTable); err != nil {
+			return err
+		}
+	}
+	// domainPath substitutes the given domain name for the [DOMAIN] wild card.
+	domainPath := func(path, domain string) string {
+		return strings.Replace(path, "[DOMAIN]", domain, -1)
+	}
+	newPreprocessor := func(startDate, endDate, domain string) (inmap.Preprocessor, error) {
+		WRFOut, WRFChemOut := domainPath(WRFOut, domain), domainPath(WRFChemOut, domain)
+		CAMxAvrg, CAMxWRFOut := domainPath(CAMxAvrg, domain), domainPath(CAMxWRFOut, domain)
+		switch CTMType {
+		case "WRF-Cmaq":
+			vars := []string{StartDate, EndDate, CTMType, WRFOut}
+			varNames := []string{"StartDate", "EndDate", "CTMType", "WRFOut"}
+			for i, v := range vars {
+				if v == "" {
+					return nil, fmt.Errorf("inmap preprocessor: configuration variable %s is not specified", varNames[i])
+				}
+			}
+			return inmap.NewWRFCmaq(WRFOut, startDate, endDate, msgChan)
+		case "CAMx":
+			vars := []string{StartDate, EndDate, CTMType, CAMxAvrg, CAMxWRFOut}
+			varNames := []string{"StartDate", "EndDate", "CTMType", "CAMxAvrg", "CAMxWRFOut"}
+			for i, v := range vars {
+				if v == "" {
+					return nil, fmt.Errorf("inmap preprocessor: configuration variable %s is not specified", varNames[i])
+				}
+			}
+			return inmap.NewCAMx(CAMxAvrg, CAMxWRFOut, startDate, endDate, msgChan)
+		case "WRF-Chem":
+			vars := []string{StartDate, EndDate, CTMType, WRFChemOut}
+			varNames := []string{"StartDate", "EndDate", "CTMType", "WRFChemOut"}
+			for i, v := range vars {
+				if v == "" {
+					return nil, fmt.Errorf("inmap preprocessor: configuration variable %s is not specified", varNames[i])
+				}
+			}
+			w, err := inmap.NewWRFChem(WRFChemOut, startDate, endDate, msgChan)
+			if err != nil {
+				return nil, err
+			}
+			if WRFChemMechanism != "" {
+				if err = w.SetMechanism(WRFChemMechanism); err != nil {
+					return nil, err
+				}
+			}
+			return w, nil
+		case "MPAS":
+			vars := []string{StartDate, EndDate, CTMType, MPASOut, GridProj}
+			varNames := []string{"StartDate", "EndDate", "CTMType", "MPASOut", "GridProj"}
+			for i, v := range vars {
+				if v == "" {
+					return nil, fmt.Errorf("inmap preprocessor: configuration variable %s is not specified", varNames[i])
+				}
+			}
+			return inmap.NewMPAS(MPASOut, GridProj, CtmGridXo, CtmGridYo, CtmGridDx, CtmGridDy,
+				MPASNx, MPASNy, MPASInterpolation, startDate, endDate, MPASRecordInterval, MPASFileInterval, msgChan)
+		case "GEOS-Chem":
+			vars := []string{StartDate, EndDate, CTMType, GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSChem, OlsonLandMap}
+			varNames := []string{"StartDate", "EndDate", "CTMType", "GEOSA1", "GEOSA3Cld", "GEOSA3Dyn", "GEOSI3", "GEOSA3MstE", "GEOSChem", "OlsonLandMap"}
+			for i, v := range vars {
+				if v == "" {
+					return nil, fmt.Errorf("inmap preprocessor: configuration variable %s is not specified", varNames[i])
+				}
+			}
+			return inmap.NewGEOSChem(GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GEOSChem, OlsonLandMap,
+				startDate, endDate, dash, ChemRecordInterval, ChemFileInterval, NoChemHourIndex, msgChan)
+		case "GCHP":
+			vars := []string{StartDate, EndDate, CTMType, GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GEOSChem, OlsonLandMap}
+			varNames := []string{"StartDate", "EndDate", "CTMType", "GEOSA1", "GEOSA3Cld", "GEOSA3Dyn", "GEOSI3", "GEOSA3MstE", "GEOSApBp", "GEOSChem", "OlsonLandMap"}
+			for i, v := range vars {
+				if v == "" {
+					return nil, fmt.Errorf("inmap preprocessor: configuration variable %s is not specified", varNames[i])
+				}
+			}
+			return inmap.NewGCHP(GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GEOSChem, OlsonLandMap,
+				startDate, endDate, ChemRecordInterval, ChemFileInterval, msgChan)
+		case "MERRA2":
+			vars := []string{StartDate, EndDate, CTMType, MERRA2Asm, MERRA2Flx, MERRA2Rad, MERRA2Lnd, MERRA2Mst, MERRA2OlsonLandMap}
+			varNames := []string{"StartDate", "EndDate", "CTMType", "MERRA2Asm", "MERRA2Flx", "MERRA2Rad", "MERRA2Lnd", "MERRA2Mst", "MERRA2OlsonLandMap"}
+			for i, v := range vars {
+				if v == "" {
+					return nil, fmt.Errorf("inmap preprocessor: configuration variable %s is not specified", varNames[i])
+				}
+			}
+			var chem inmap.ChemistrySource
+			switch MERRA2Chemistry {
+			case "", "climatology":
+			case "GEOS-Chem":
+				gc, err := inmap.NewGEOSChem(GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GEOSChem, OlsonLandMap,
+					startDate, endDate, dash, ChemRecordInterval, ChemFileInterval, NoChemHourIndex, msgChan)
+				if err != nil {
+					return nil, err
+				}
+				chem = gc
+			case "GCHP":
+				gc, err := inmap.NewGCHP(GEOSA1, GEOSA3Cld, GEOSA3Dyn, GEOSI3, GEOSA3MstE, GEOSApBp, GEOSChem, OlsonLandMap,
+					startDate, endDate, ChemRecordInterval, ChemFileInterval, msgChan)
+				if err != nil {
+					return nil, err
+				}
+				chem = gc
+			default:
+				return nil, fmt.Errorf("inmap preprocessor: invalid MERRA2Chemistry '%s'; valid options are climatology, GEOS-Chem, and GCHP", MERRA2Chemistry)
+			}
+			return inmap.NewMERRA2(MERRA2Asm, MERRA2Flx, MERRA2Rad, MERRA2Lnd, MERRA2Mst, MERRA2OlsonLandMap,
+				startDate, endDate, chem, msgChan)
+		default:
+			return nil, fmt.Errorf("inmap preprocessor: the CTMType you specified, '%s', is invalid. Valid options are WRF-Cmaq, WRF-Chem, CAMx, MPAS, GEOS-Chem, GCHP, and MERRA2", CTMType)
+		}
+	}
+
+	newCTM := func(startDate, endDate, domain string) (inmap.Preprocessor, error) {
+		ctm, err := newPreprocessor(startDate, endDate, domain)
+		if err != nil {
+			return nil, err
+		}
+		if landUse != nil {
+			l, ok := ctm.(interface {
+				SetLandUseTable(inmap.LandUseTable)
+			})
+			if !ok {
+				return nil, fmt.Errorf("inmap preprocessor: LandUseTable is not supported for CTMType %s", CTMType)
+			}
+			l.SetLandUseTable(landUse)
+		}
+		if FractionalLandUse {
+			f, ok := ctm.(interface {
+				SetFractionalLandUse(bool)
+			})
+			if !ok {
+				return nil, fmt.Errorf("inmap preprocessor: FractionalLandUse is not supported for CTMType %s", CTMType)
+			}
+			f.SetFractionalLandUse(true)
+		}
+		if RecordInterval != "" || FileInterval != "" {
+			t, ok := ctm.(interface {
+				SetTimeIntervals(recordDelta, fileDelta string) error
+			})
+			if !ok {
+				return nil, fmt.Errorf("inmap preprocessor: RecordInterval and FileInterval are not supported for CTMType %s", CTMType)
+			}
+			if err := t.SetTimeIntervals(RecordInterval, FileInterval); err != nil {
+				return nil, err
+			}
+		}
+		if MissingData != "" && MissingData != string(inmap.MissingDataFail) {
+			m, ok := ctm.(interface {
+				SetMissingDataPolicy(string) error
+			})
+			if !ok {
+				return nil, fmt.Errorf("inmap preprocessor: MissingData is not supported for CTMType %s", CTMType)
+			}
+			if err := m.SetMissingDataPolicy(MissingData); err != nil {
+				return nil, err
+			}
+		}
+		return ctm, nil
+	}
+
+	// reportMissing logs the missing input data of ctm, if any.
+	reportMissing := func(ctm inmap.Preprocessor, startDate, endDate, domain string) {
+		r, ok := ctm.(interface {
+			MissingDataReport() string
+		})
+		if !ok {
+			return
+		}
+		if report := r.MissingDataReport(); report != "" {
+			if domain != "" {
+				log.Printf("missing input data for domain %s, %s–%s:\n%s", domain, startDate, endDate, report)
+			} else {
+				log.Printf("missing input data for %s–%s:\n%s", startDate, endDate, report)
+			}
+		}
+	}
+
+	preprocess := func(startDate, endDate string) (*inmap.CTMData, error) {
+		if len(Domains) > 0 {
+			if CTMType != "WRF-Cmaq" && CTMType != "WRF-Chem" && CTMType != "CAMx" {
+				return nil, fmt.Errorf("inmap preprocessor: Domains is not supported for CTMType %s", CTMType)
+			}
+			ctms := make([]inmap.Preprocessor, len(Domains))
+			for i, domain := range Domains {
+				var err error
+				if ctms[i], err = newCTM(startDate, endDate, domain); err != nil {
+					return nil, err
+				}
+			}
+			ctmData, err := inmap.PreprocessWRFNests(ctms, CtmGridXo, CtmGridYo, opts...)
+			for i, ctm := range ctms {
+				reportMissing(ctm, startDate, endDate, Domains[i])
+			}
+			return ctmData, err
+		}
+		ctm, err := newCTM(startDate, endDate, "")
+		if err != nil {
+			return nil, err
+		}
+		ctmData, err := inmap.Preprocess(ctm, CtmGridXo, CtmGridYo, CtmGridDx, CtmGridDy, opts...)
+		reportMissing(ctm, startDate, endDate, "")
+		return ctmData, err
+	}
+
+	if OutputPeriods == "" || OutputPeriods == "annual" {
+		ctmData, err := preprocess(StartDate, EndDate)
 		if err != nil {
 			return err
 		}
-	default:
-		return fmt.Errorf("inmap preprocessor: the CTMType you specified, '%s', is invalid. Valid options are WRF-Chem and GEOS-Chem", CTMType)
+		return write(InMAPData, ctmData)
 	}
-	ctmData, err := inmap.Preprocess(ctm, CtmGridXo, CtmGridYo, CtmGridDx, CtmGridDy)
+	return preprocPeriods(StartDate, EndDate, OutputPeriods, InMAPData, preprocess, write)
+}
+
+// writeCTMData writes ctmData to the file at path.
+func writeCTMData(path string, ctmData *inmap.CTMData) error {
+	ff, err := os.Create(path)
 	if err != nil {
-		return err
+		return fmt.Errorf("inmap: preprocessor writing output file: %v", err)
+	}
+	if err = ctmData.Write(ff); err != nil {
+		ff.Close()
+		return fmt.Errorf("inmap: preprocessor writing output file: %v", err)
 	}
+	return ff.Close()
+}
 
-	// Write out the result.
-	ff, err := os.Create(InMAPData)
+// writeCFCTMData writes ctmData to the file at path following the
+// CF conventions, where gridProj is the spatial reference of the grid.
+func writeCFCTMData(path string, ctmData *inmap.CTMData, gridProj string) error {
+	ff, err := os.Create(path)
 	if err != nil {
 		return fmt.Errorf("inmap: preprocessor writing output file: %v", err)
 	}
-	ctmData.Write(ff)//, CtmGridXo, CtmGridYo, CtmGridDx, CtmGridDy)
-	ff.Close()
-
-	return nil
+	if err = ctmData.WriteCF(ff, gridProj); err != nil {
+		ff.Close()
+		return fmt.Errorf("inmap: preprocessor writing output file: %v", err)
+	}
+	return ff.Close()
 }
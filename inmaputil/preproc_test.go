@@ -20,7 +20,12 @@ package inmaputil
 
 import (
 	"os"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/ctessum/cdf"
+	"github.com/yuzhou-wang/inmap"
 )
 
 func TestPreprocWRFChem(t *testing.T) {
@@ -47,6 +52,32 @@ func TestPreprocGEOSChem(t *testing.T) {
 	}
 }
 
+func TestPreprocGCHP(t *testing.T) {
+	cfg := InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExampleGEOSChem.toml")
+	cfg.Set("Preproc.CTMType", "GCHP")
+	cfg.Root.SetArgs([]string{"preproc"})
+	defer os.Remove("../cmd/inmap/testdata/preproc/inmapData_GEOSChem.ncf")
+	// GCHP output does not include the hybrid pressure grid parameters.
+	err := cfg.Root.Execute()
+	want := "inmap preprocessor: configuration variable GEOSApBp is not specified"
+	if err == nil || err.Error() != want {
+		t.Errorf("have error %v, want %s", err, want)
+	}
+}
+
+func TestPreprocMERRA2(t *testing.T) {
+	cfg := InitializeConfig()
+	// Here we only test whether the program runs. We
+	// check whether the output is correct elsewhere.
+	cfg.Set("config", "../cmd/inmap/configExampleMERRA2.toml")
+	cfg.Root.SetArgs([]string{"preproc"})
+	defer os.Remove("../cmd/inmap/testdata/preproc/inmapData_MERRA2.ncf")
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestPreprocCombine(t *testing.T) {
 	cfg := InitializeConfig()
 	// Here we only test whether the program runs. We
@@ -62,3 +93,117 @@ func TestPreprocCombine(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestPreprocCAMx(t *testing.T) {
+	cfg := InitializeConfig()
+	// Here we only test whether the program runs. We
+	// check whether the output is correct elsewhere.
+	cfg.Set("config", "../cmd/inmap/configExampleCAMx.toml")
+	cfg.Root.SetArgs([]string{"preproc"})
+	defer os.Remove("../cmd/inmap/testdata/preproc/inmapData_CAMx.ncf")
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPreprocCAMxMonthly(t *testing.T) {
+	cfg := InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExampleCAMx.toml")
+	cfg.Set("Preproc.OutputPeriods", "monthly")
+	cfg.Root.SetArgs([]string{"preproc"})
+	const out = "../cmd/inmap/testdata/preproc/inmapData_CAMx.ncf"
+	defer os.Remove(out)
+	defer os.Remove(PeriodFile(out, "Jan"))
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{out, PeriodFile(out, "Jan")} {
+		if _, err := os.Stat(f); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPreprocCAMxDaily(t *testing.T) {
+	cfg := InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExampleCAMx.toml")
+	cfg.Set("Preproc.OutputPeriods", "daily")
+	cfg.Root.SetArgs([]string{"preproc"})
+	const out = "../cmd/inmap/testdata/preproc/inmapData_CAMx.ncf"
+	files := []string{out, PeriodFile(out, "20050101"), PeriodFile(out, "20050102")}
+	for _, f := range files {
+		defer os.Remove(f)
+	}
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPreprocCAMxCF(t *testing.T) {
+	cfg := InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExampleCAMx.toml")
+	cfg.Set("Preproc.OutputFormat", "cf")
+	cfg.Root.SetArgs([]string{"preproc"})
+	const out = "../cmd/inmap/testdata/preproc/inmapData_CAMx.ncf"
+	defer os.Remove(out)
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	nc, err := cdf.Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := nc.Header.GetAttribute("", "Conventions"); c != "CF-1.8" {
+		t.Errorf("Conventions: have %v, want CF-1.8", c)
+	}
+	var vgc inmap.VarGridConfig
+	if _, err = vgc.LoadCTMData(f); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMonthPeriods(t *testing.T) {
+	start := time.Date(2005, time.November, 15, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2006, time.January, 10, 0, 0, 0, 0, time.UTC)
+	have := monthPeriods(start, end)
+	want := [][2]time.Time{
+		{start, time.Date(2005, time.December, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2005, time.December, 1, 0, 0, 0, 0, time.UTC), time.Date(2006, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2006, time.January, 1, 0, 0, 0, 0, time.UTC), end},
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+	for m, s := range map[time.Month]string{time.January: "DJF", time.April: "MAM", time.August: "JJA", time.November: "SON"} {
+		if season(m) != s {
+			t.Errorf("%v: have %s, want %s", m, season(m), s)
+		}
+	}
+	if have := PeriodFile("a/inmapData.ncf", "DJF"); have != "a/inmapData_DJF.ncf" {
+		t.Errorf("have %s, want a/inmapData_DJF.ncf", have)
+	}
+}
+
+func TestDailyPeriods(t *testing.T) {
+	have, err := dailyPeriods("20041230", "20050102")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"20041230", "20041231", "20050101"}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+	if _, err := dailyPeriods("2004-12-30", "20050102"); err == nil {
+		t.Error("an invalid date should cause an error")
+	}
+}
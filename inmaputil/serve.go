@@ -0,0 +1,435 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuzhou-wang/inmap/cloud/cloudrpc"
+)
+
+// RunServer is an HTTP handler that runs InMAP simulations and other
+// commands on behalf of clients such as web front-ends and workflow
+// managers, and reports on their progress. Each run is executed in a
+// separate process in its own working directory, so relative output paths
+// are created there. Requests and responses are in JSON format.
+// The endpoints are:
+//
+//	POST   /runs: start a run (see RunRequest); returns its RunStatus.
+//	GET    /runs: the RunStatus of each run.
+//	GET    /runs/{id}: the RunStatus of a run.
+//	GET    /runs/{id}/progress: the log messages of a run, which are
+//	       streamed until the run finishes. They are in plain text unless
+//	       the run was started with the LogFormat flag set to "json".
+//	GET    /runs/{id}/convergence: the convergence checks of a run so far
+//	       (see ConvergenceCheck), from logs in either format.
+//	GET    /runs/{id}/outputs: the names of the files in the working
+//	       directory of a run.
+//	GET    /runs/{id}/outputs/{file}: download a file from the working
+//	       directory of a run.
+//	DELETE /runs/{id}: stop a run if it is running and delete its
+//	       working directory.
+type RunServer struct {
+	dir     string
+	command []string
+
+	mu   sync.Mutex
+	runs map[string]*serverRun
+	next int
+
+	// pollInterval is how often new log messages are checked for
+	// when streaming progress.
+	pollInterval time.Duration
+
+	mux *http.ServeMux
+}
+
+// RunRequest is the body of a request to start a run.
+type RunRequest struct {
+	// Command is the InMAP command to run, e.g., ["run", "steady"].
+	Command []string
+
+	// Config is the contents of a configuration file in TOML format,
+	// which is used as the --config argument of the command if it is
+	// not empty.
+	Config string
+
+	// Flags are configuration options that are passed as command-line
+	// flags, which override the options in Config.
+	Flags map[string]string
+}
+
+// RunStatus holds information about a run.
+type RunStatus struct {
+	ID      string
+	Command []string
+
+	// Status is one of "Running", "Complete", or "Failed".
+	Status string
+
+	// Message holds the error message if the run failed.
+	Message string `json:",omitempty"`
+
+	// StartTime and CompletionTime are Unix times in seconds.
+	StartTime, CompletionTime int64
+}
+
+// ConvergenceCheck holds the percent change in each convergence
+// variable since the previous check during a simulation.
+type ConvergenceCheck map[string]float64
+
+// serverRun is a run of a RunServer.
+type serverRun struct {
+	dir string
+	cmd *exec.Cmd
+
+	mu     sync.Mutex
+	status RunStatus
+	done   chan struct{}
+}
+
+// logFileName is the name of the file in the working directory of each
+// run that the output of the command is written to.
+const logFileName = "server.log"
+
+// NewRunServer returns a new RunServer that creates the working directories
+// of runs within dir, and runs commands using the InMAP executable
+// command, which can include initial arguments. If command is empty, the
+// executable of the current process is used.
+func NewRunServer(dir string, command []string) (*RunServer, error) {
+	if len(command) == 0 {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("inmap: finding executable for run server: %v", err)
+		}
+		command = []string{exe}
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("inmap: creating run server directory: %v", err)
+	}
+	s := &RunServer{
+		dir:          dir,
+		command:      command,
+		runs:         make(map[string]*serverRun),
+		pollInterval: time.Second,
+		mux:          http.NewServeMux(),
+	}
+	s.mux.HandleFunc("POST /runs", s.start)
+	s.mux.HandleFunc("GET /runs", s.list)
+	s.mux.HandleFunc("GET /runs/{id}", s.withRun(s.status))
+	s.mux.HandleFunc("GET /runs/{id}/progress", s.withRun(s.progress))
+	s.mux.HandleFunc("GET /runs/{id}/convergence", s.withRun(s.convergence))
+	s.mux.HandleFunc("GET /runs/{id}/outputs", s.withRun(s.outputs))
+	s.mux.HandleFunc("GET /runs/{id}/outputs/{file}", s.withRun(s.output))
+	s.mux.HandleFunc("DELETE /runs/{id}", s.withRun(s.delete))
+	return s, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (s *RunServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// withRun returns a handler that calls h with the run specified in
+// the request path.
+func (s *RunServer) withRun(h func(http.ResponseWriter, *http.Request, *serverRun)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		run, ok := s.runs[r.PathValue("id")]
+		s.mu.Unlock()
+		if !ok {
+			http.Error(w, fmt.Sprintf("run %s does not exist", r.PathValue("id")), http.StatusNotFound)
+			return
+		}
+		h(w, r, run)
+	}
+}
+
+func (s *RunServer) start(w http.ResponseWriter, r *http.Request) {
+	var req RunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Command) == 0 {
+		http.Error(w, "invalid request: missing command", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.next++
+	id := strconv.Itoa(s.next)
+	s.mu.Unlock()
+	dir := filepath.Join(s.dir, id)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	args := append(append([]string{}, s.command[1:]...), req.Command...)
+	if req.Config != "" {
+		const configFile = "config.toml"
+		if err := os.WriteFile(filepath.Join(dir, configFile), []byte(req.Config), 0644); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		args = append(args, "--config="+configFile)
+	}
+	flags := make([]string, 0, len(req.Flags))
+	for name, val := range req.Flags {
+		flags = append(flags, fmt.Sprintf("--%s=%s", name, val))
+	}
+	sort.Strings(flags)
+	args = append(args, flags...)
+
+	logFile, err := os.Create(filepath.Join(dir, logFileName))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cmd := exec.Command(s.command[0], args...)
+	cmd.Dir = dir
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	run := &serverRun{
+		dir: dir,
+		cmd: cmd,
+		status: RunStatus{
+			ID:        id,
+			Command:   req.Command,
+			Status:    cloudrpc.Status_Running.String(),
+			StartTime: time.Now().Unix(),
+		},
+		done: make(chan struct{}),
+	}
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		http.Error(w, fmt.Sprintf("starting run: %v", err), http.StatusInternalServerError)
+		return
+	}
+	s.mu.Lock()
+	s.runs[id] = run
+	s.mu.Unlock()
+	metricServerRuns.Inc()
+
+	go func() {
+		err := cmd.Wait()
+		metricServerRuns.Dec()
+		logFile.Close()
+		run.mu.Lock()
+		run.status.CompletionTime = time.Now().Unix()
+		if err != nil {
+			run.status.Status = cloudrpc.Status_Failed.String()
+			run.status.Message = err.Error()
+		} else {
+			run.status.Status = cloudrpc.Status_Complete.String()
+		}
+		run.mu.Unlock()
+		close(run.done)
+	}()
+	writeJSON(w, run.getStatus())
+}
+
+// getStatus returns the current status of the run.
+func (run *serverRun) getStatus() RunStatus {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	return run.status
+}
+
+func (s *RunServer) list(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	statuses := make([]RunStatus, 0, len(s.runs))
+	for _, run := range s.runs {
+		statuses = append(statuses, run.getStatus())
+	}
+	s.mu.Unlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		a, _ := strconv.Atoi(statuses[i].ID)
+		b, _ := strconv.Atoi(statuses[j].ID)
+		return a < b
+	})
+	writeJSON(w, statuses)
+}
+
+func (s *RunServer) status(w http.ResponseWriter, r *http.Request, run *serverRun) {
+	writeJSON(w, run.getStatus())
+}
+
+// progress streams the log file of the run until the run is finished
+// or the client disconnects.
+func (s *RunServer) progress(w http.ResponseWriter, r *http.Request, run *serverRun) {
+	f, err := os.Open(filepath.Join(run.dir, logFileName))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	flusher, _ := w.(http.Flusher)
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+	for {
+		// Check whether the run is finished before copying, so that
+		// all of the output is copied after it finishes.
+		var finished bool
+		select {
+		case <-run.done:
+			finished = true
+		default:
+		}
+		if _, err := io.Copy(w, f); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if finished {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-run.done:
+		case <-ticker.C:
+		}
+	}
+}
+
+// convergenceLine matches the lines in the log that hold the percent
+// change in a convergence variable (see inmap.ConvergenceStatus).
+var convergenceLine = regexp.MustCompile(`^\s*(.+?):\s+(\S+)%$`)
+
+func (s *RunServer) convergence(w http.ResponseWriter, r *http.Request, run *serverRun) {
+	f, err := os.Open(filepath.Join(run.dir, logFileName))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	checks := []ConvergenceCheck{}
+	var check ConvergenceCheck
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "{") {
+			// A message in the JSON log format.
+			var msg struct {
+				Event  string
+				Change ConvergenceCheck
+			}
+			if json.Unmarshal([]byte(line), &msg) == nil && msg.Event == "convergence" {
+				checks = append(checks, msg.Change)
+			}
+			check = nil
+			continue
+		}
+		if strings.HasSuffix(line, "Percent change since last convergence check:") {
+			check = make(ConvergenceCheck)
+			checks = append(checks, check)
+			continue
+		}
+		m := convergenceLine.FindStringSubmatch(line)
+		if check == nil || m == nil {
+			check = nil
+			continue
+		}
+		v, err := strconv.ParseFloat(m[2], 64)
+		if err != nil {
+			check = nil
+			continue
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue // Not representable in JSON.
+		}
+		check[m[1]] = v
+	}
+	if err := scanner.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, checks)
+}
+
+func (s *RunServer) outputs(w http.ResponseWriter, r *http.Request, run *serverRun) {
+	entries, err := os.ReadDir(run.dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	files := []string{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			files = append(files, e.Name())
+		}
+	}
+	writeJSON(w, files)
+}
+
+func (s *RunServer) output(w http.ResponseWriter, r *http.Request, run *serverRun) {
+	name := r.PathValue("file")
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		http.Error(w, fmt.Sprintf("invalid file name %s", name), http.StatusBadRequest)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(run.dir, name))
+}
+
+func (s *RunServer) delete(w http.ResponseWriter, r *http.Request, run *serverRun) {
+	select {
+	case <-run.done:
+	default:
+		if err := run.cmd.Process.Kill(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		<-run.done
+	}
+	status := run.getStatus()
+	s.mu.Lock()
+	delete(s.runs, status.ID)
+	s.mu.Unlock()
+	if err := os.RemoveAll(run.dir); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, status)
+}
+
+// writeJSON writes v to w in JSON format.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmaputil
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunServer(t *testing.T) {
+	const script = `echo "$@" > args.txt
+echo "2026/01/01 00:00:00 Percent change since last convergence check:"
+printf 'pNH4:\t1.5%%\npNH4 pop-wtd:\t-2%%\n'
+echo '{"time":"2026-01-01T00:00:00Z","level":"INFO","msg":"","module":"inmap","event":"convergence","change":{"pNH4":0.5}}'
+echo finished
+if [ "$1" = "fail" ]; then exit 3; fi`
+	dir := t.TempDir()
+	s, err := NewRunServer(dir, []string{"sh", "-c", script, "inmap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.pollInterval = 10 * time.Millisecond
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	get := func(path string, v interface{}) string {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: %s: %s", path, resp.Status, b)
+		}
+		if v != nil {
+			if err := json.Unmarshal(b, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return string(b)
+	}
+	start := func(req RunRequest) RunStatus {
+		t.Helper()
+		b, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(ts.URL+"/runs", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var status RunStatus
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	status := start(RunRequest{
+		Command: []string{"run", "steady"},
+		Config:  "OutputFile = \"out.shp\"\n",
+		Flags:   map[string]string{"NumIterations": "1"},
+	})
+	if status.ID != "1" || status.Status != "Running" {
+		t.Errorf("invalid status %+v", status)
+	}
+
+	// The progress is streamed until the run is finished.
+	if progress := get("/runs/1/progress", nil); !strings.HasSuffix(progress, "finished\n") {
+		t.Errorf("invalid progress %q", progress)
+	}
+	get("/runs/1", &status)
+	if status.Status != "Complete" || status.CompletionTime < status.StartTime {
+		t.Errorf("invalid status %+v", status)
+	}
+
+	var checks []ConvergenceCheck
+	get("/runs/1/convergence", &checks)
+	if want := []ConvergenceCheck{{"pNH4": 1.5, "pNH4 pop-wtd": -2}, {"pNH4": 0.5}}; !reflect.DeepEqual(checks, want) {
+		t.Errorf("convergence: have %v, want %v", checks, want)
+	}
+
+	var files []string
+	get("/runs/1/outputs", &files)
+	if want := []string{"args.txt", "config.toml", "server.log"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("outputs: have %v, want %v", files, want)
+	}
+	if args := get("/runs/1/outputs/args.txt", nil); args != "run steady --config=config.toml --NumIterations=1\n" {
+		t.Errorf("invalid args %q", args)
+	}
+
+	status = start(RunRequest{Command: []string{"fail"}})
+	get("/runs/2/progress", nil)
+	get("/runs/2", &status)
+	if status.Status != "Failed" || status.Message == "" {
+		t.Errorf("invalid status %+v", status)
+	}
+
+	var statuses []RunStatus
+	get("/runs", &statuses)
+	if len(statuses) != 2 || statuses[0].ID != "1" || statuses[1].ID != "2" {
+		t.Errorf("invalid statuses %+v", statuses)
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, ts.URL+"/runs/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, err := os.Stat(filepath.Join(dir, "1")); !os.IsNotExist(err) {
+		t.Errorf("run directory should have been deleted: %v", err)
+	}
+	resp, err = http.Get(ts.URL + "/runs/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deleted run: have status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
@@ -20,9 +20,15 @@ package inmaputil
 
 import (
 	"context"
+	"encoding/csv"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/ctessum/geom"
 	"github.com/yuzhou-wang/inmap"
@@ -49,8 +55,18 @@ import (
 // layers specifies which vertical layers to process.
 //
 // client is a client of the cluster that will run the simulations.
-func StartSR(ctx context.Context, jobName string, cmds []string, memoryGB int32, VariableGridData string, VarGrid *inmap.VarGridConfig, begin, end int, layers []int, client cloudrpc.CloudRPCClient, cfg *Cfg) error {
-	outChan := outChan()
+//
+// If resumeFile is not empty, it is the path to the SR matrix being created,
+// and simulations are not started for the source grid cells whose results have
+// already been saved to it.
+//
+// realization specifies which realization of the SR matrix the simulations
+// are for, where zero is the central estimate (see sr.SR.Realization).
+//
+// The simulations are run by SR.Workers workers taking them from a work
+// queue, and are retried SR.Retries times if they fail.
+func StartSR(ctx context.Context, jobName string, cmds []string, memoryGB int32, VariableGridData string, VarGrid *inmap.VarGridConfig, begin, end int, layers []int, client cloudrpc.CloudRPCClient, resumeFile string, realization int, cfg *Cfg) error {
+	outChan := outChan("sr")
 	varGridReader, err := os.Open(maybeDownload(ctx, VariableGridData, outChan))
 	if err != nil {
 		return fmt.Errorf("starting SR matrix---can't open variable grid data file: %v", err)
@@ -59,6 +75,14 @@ func StartSR(ctx context.Context, jobName string, cmds []string, memoryGB int32,
 	if err != nil {
 		return err
 	}
+	sr.Realization = realization
+	sr.Workers = int32(cfg.GetInt("SR.Workers"))
+	sr.Retries = cfg.GetInt("SR.Retries")
+	if resumeFile != "" {
+		if err = sr.Resume(resumeFile, layers); err != nil {
+			return err
+		}
+	}
 	version := cfg.GetString("version")
 	if err = sr.Start(ctx, jobName, version, layers, begin, end, cfg.Root, cfg.Viper, cmds, cfg.InputFiles(), memoryGB); err != nil {
 		return err
@@ -83,7 +107,15 @@ func StartSR(ctx context.Context, jobName string, cmds []string, memoryGB int32,
 // layers specifies which vertical layers to save.
 //
 // client is a client of the cluster that will run the simulations.
-func SaveSR(ctx context.Context, jobName, OutputFile string, VariableGridData string, VarGrid *inmap.VarGridConfig, begin, end int, layers []int, client cloudrpc.CloudRPCClient) error {
+//
+// If resume is true, the results of source grid cells that have already
+// been saved to OutputFile are not retrieved again.
+//
+// realization specifies which realization of the SR matrix the results
+// are for, where zero is the central estimate, and realizations specifies
+// the number of additional realizations that there is room for if
+// OutputFile is created (see sr.SR).
+func SaveSR(ctx context.Context, jobName, OutputFile string, VariableGridData string, VarGrid *inmap.VarGridConfig, begin, end int, layers []int, client cloudrpc.CloudRPCClient, resume bool, realization, realizations int) error {
 	varGridReader, err := os.Open(VariableGridData)
 	if err != nil {
 		return fmt.Errorf("saving SR matrix---can't open variable grid data file: %v", err)
@@ -92,11 +124,39 @@ func SaveSR(ctx context.Context, jobName, OutputFile string, VariableGridData st
 	if err != nil {
 		return err
 	}
+	sr.Realization, sr.Realizations = realization, realizations
+	if resume {
+		if err = sr.Resume(OutputFile, layers); err != nil {
+			return err
+		}
+	}
 	return sr.Save(ctx, OutputFile, jobName, layers, begin, end)
 }
 
-// CleanSR cleans up remote data created during the SR matrix creation simulations.
-func CleanSR(ctx context.Context, jobName, VariableGridData string, VarGrid *inmap.VarGridConfig, begin, end int, layers []int, client cloudrpc.CloudRPCClient) error {
+// ExtendSR creates a new SR matrix in OutputFile for the variable
+// resolution grid specified by VariableGridData and VarGrid, copying the
+// results for the source grid cells that are also in the existing SR
+// matrix PreviousFile, for example after the grid has been refined.
+// layers specifies which vertical layers to include, and realizations
+// specifies the number of additional realizations that the new SR matrix
+// has room for. The remaining source grid cells can then be added using
+// StartSR and SaveSR with resume enabled.
+func ExtendSR(PreviousFile, OutputFile, VariableGridData string, VarGrid *inmap.VarGridConfig, layers []int, realizations int) error {
+	varGridReader, err := os.Open(VariableGridData)
+	if err != nil {
+		return fmt.Errorf("extending SR matrix---can't open variable grid data file: %v", err)
+	}
+	sr, err := sr.NewSR(varGridReader, VarGrid, nil)
+	if err != nil {
+		return err
+	}
+	sr.Realizations = realizations
+	return sr.Extend(PreviousFile, OutputFile, layers)
+}
+
+// CleanSR cleans up remote data created during the SR matrix creation simulations
+// for the given realization.
+func CleanSR(ctx context.Context, jobName, VariableGridData string, VarGrid *inmap.VarGridConfig, client cloudrpc.CloudRPCClient, realization int) error {
 	varGridReader, err := os.Open(VariableGridData)
 	if err != nil {
 		return fmt.Errorf("saving SR matrix---can't open variable grid data file: %v", err)
@@ -105,17 +165,86 @@ func CleanSR(ctx context.Context, jobName, VariableGridData string, VarGrid *inm
 	if err != nil {
 		return err
 	}
-	return sr.Clean(ctx, jobName, layers, begin, end)
+	sr.Realization = realization
+	return sr.Clean(ctx, jobName)
+}
+
+// ConvertSR converts the NetCDF SR matrix in OutputFile to a compressed,
+// chunked Zarr store in ZarrFile (see sr.WriteZarr). If ZarrFile is empty,
+// it is OutputFile with the extension replaced by ".zarr".
+func ConvertSR(ctx context.Context, OutputFile, ZarrFile string) error {
+	if ZarrFile == "" {
+		ZarrFile = strings.TrimSuffix(OutputFile, filepath.Ext(OutputFile)) + ".zarr"
+	}
+	r, err := sr.Open(ctx, OutputFile)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return sr.WriteZarr(r, ZarrFile)
+}
+
+// FitSRSurrogate fits a sr.Surrogate of the given rank to the SR matrix
+// in SROutputFile, which can be a local or remote NetCDF file or Zarr store
+// (see sr.Open), and writes it to SurrogateFile. The surrogate can be used
+// to make faster, approximate predictions with SRPredict and SRServe.
+func FitSRSurrogate(ctx context.Context, SROutputFile, SurrogateFile string, rank int) error {
+	r, err := sr.Open(ctx, SROutputFile)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	s, err := r.FitSurrogate(rank)
+	if err != nil {
+		return err
+	}
+	log.Printf("fit rank %d SR surrogate with maximum relative error %.3g", s.Rank, s.MaxError())
+	f, err := os.Create(SurrogateFile)
+	if err != nil {
+		return fmt.Errorf("inmap: creating SR surrogate file: %v", err)
+	}
+	if err = s.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
-// SRPredict uses the SR matrix specified in SROutputFile
+// setSRSurrogate sets r to use the sr.Surrogate in SurrogateFile, if
+// SurrogateFile is not empty.
+func setSRSurrogate(r *sr.Reader, SurrogateFile string) error {
+	if SurrogateFile == "" {
+		return nil
+	}
+	f, err := os.Open(SurrogateFile)
+	if err != nil {
+		return fmt.Errorf("inmap: opening SR surrogate file: %v", err)
+	}
+	defer f.Close()
+	s, err := sr.ReadSurrogate(f)
+	if err != nil {
+		return err
+	}
+	log.Printf("using SR surrogate with maximum relative error %.3g", s.MaxError())
+	return r.SetSurrogate(s)
+}
+
+// SRPredict uses the SR matrix specified in SROutputFile, which can
+// be a local or remote NetCDF file or Zarr store (see sr.Open),
 // to predict concentrations resulting
 // from the emissions in EmissionsShapefiles (optionally
 // masked by emissionMask), outputting the
 // results specified by outputVaraibles in OutputFile.
 // EmissionUnits specifies the units
 // of the emissions. VarGrid specifies the variable resolution grid.
-func SRPredict(EmissionUnits, SROutputFile, OutputFile string, outputVariables map[string]string, EmissionsShapefiles []string, emissionMask geom.Polygon, VarGrid *inmap.VarGridConfig) error {
+// The SR matrix is queried for the emissions sources using nprocs
+// processors in parallel; if nprocs is zero, all available processors
+// are used. If SurrogateFile is not empty, the surrogate of the SR matrix
+// in it (see FitSRSurrogate) is used to make faster, approximate predictions.
+// If SourceOutputFile is not empty, the sum of each output variable caused
+// by each emissions source separately is written to it in CSV format
+// (see sr.Reader.SourceResults).
+func SRPredict(EmissionUnits, SROutputFile, OutputFile string, outputVariables map[string]string, EmissionsShapefiles []string, emissionMask geom.Polygon, VarGrid *inmap.VarGridConfig, nprocs int, SurrogateFile, SourceOutputFile string) error {
 	msgLog := make(chan string)
 	go func() {
 		for {
@@ -132,15 +261,15 @@ func SRPredict(EmissionUnits, SROutputFile, OutputFile string, outputVariables m
 	if err != nil {
 		return err
 	}
-	f, err := os.Open(SROutputFile)
+	r, err := sr.Open(context.TODO(), SROutputFile)
 	if err != nil {
 		return err
 	}
-	r, err := sr.NewReader(f)
-	if err != nil {
+	defer r.Close()
+	if err = setSRSurrogate(r, SurrogateFile); err != nil {
 		return err
 	}
-	conc, err := r.Concentrations(emis.EmisRecords()...)
+	conc, err := r.ConcentrationsParallel(nprocs, emis.EmisRecords()...)
 	if err != nil {
 		if _, ok := err.(sr.AboveTopErr); ok {
 			log.Printf("%v; calculating concentrations for emissions in SR matrix top layer.", err)
@@ -162,9 +291,91 @@ func SRPredict(EmissionUnits, SROutputFile, OutputFile string, outputVariables m
 		return err
 	}
 
+	if SourceOutputFile != "" {
+		f := upload.maybeUpload(SourceOutputFile)
+		if upload.err != nil {
+			return upload.err
+		}
+		if err = writeSRSourceResults(r, f, outputVariables, emis.EmisRecords()); err != nil {
+			return err
+		}
+	}
+
 	if err := upload.uploadOutput(nil); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// writeSRSourceResults writes the sum of each of the outputVariables
+// caused by each of the emissions sources in emis separately to fileName
+// in CSV format. The file has columns for the index of each source, the
+// location of its center ("X" and "Y"), and each output variable.
+func writeSRSourceResults(r *sr.Reader, fileName string, outputVariables map[string]string, emis []*inmap.EmisRecord) error {
+	results, err := r.SourceResults(outputVariables, nil, emis...)
+	if err != nil {
+		if _, ok := err.(sr.AboveTopErr); !ok {
+			return err
+		}
+	}
+	vars := make([]string, 0, len(outputVariables))
+	for v := range outputVariables {
+		if !strings.HasPrefix(v, "[") {
+			vars = append(vars, v)
+		}
+	}
+	sort.Strings(vars)
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("inmap: creating SR source output file: %v", err)
+	}
+	w := csv.NewWriter(f)
+	w.Write(append([]string{"Source", "X", "Y"}, vars...))
+	format := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+	for i, e := range emis {
+		b := e.Geom.Bounds()
+		row := []string{strconv.Itoa(i), format((b.Min.X + b.Max.X) / 2), format((b.Min.Y + b.Max.Y) / 2)}
+		for _, v := range vars {
+			row = append(row, format(results[i][v]))
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return fmt.Errorf("inmap: writing SR source output: %v", err)
+	}
+	return f.Close()
+}
+
+// SRServe starts an HTTP server at address (e.g., ":8080") that answers
+// queries of the SR matrix in SROutputFile (see sr.Server). The SR matrix
+// can be a local or remote NetCDF file or Zarr store (see sr.Open); only
+// the parts of remote SR matrices that are needed to answer queries are
+// downloaded. outputVariables specifies the results that are returned for
+// predictions, and VarGrid specifies the variable resolution grid.
+// If SurrogateFile is not empty, the surrogate of the SR matrix in it
+// (see FitSRSurrogate) is used to make faster, approximate predictions.
+// SRServe does not return unless there is an error.
+func SRServe(ctx context.Context, SROutputFile, address string, outputVariables map[string]string, VarGrid *inmap.VarGridConfig, SurrogateFile string) error {
+	vgsr, err := spatialRef(VarGrid)
+	if err != nil {
+		return err
+	}
+	r, err := sr.Open(ctx, SROutputFile)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err = setSRSurrogate(r, SurrogateFile); err != nil {
+		return err
+	}
+	s, err := sr.NewServer(r, vgsr, outputVariables)
+	if err != nil {
+		return err
+	}
+	log.Printf("serving SR matrix %s at %s", SROutputFile, address)
+	return http.ListenAndServe(address, s)
+}
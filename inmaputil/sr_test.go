@@ -20,11 +20,22 @@ package inmaputil
 
 import (
 	"context"
+	"encoding/csv"
+	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/gonum/floats"
+
 	"github.com/yuzhou-wang/inmap"
 	"github.com/yuzhou-wang/inmap/cloud"
+	"github.com/yuzhou-wang/inmap/sr"
 )
 
 func TestSR(t *testing.T) {
@@ -51,16 +62,54 @@ func TestSR(t *testing.T) {
 
 	err = StartSR(ctx, "test_sr", cmds, 1,
 		os.ExpandEnv(cfg.GetString("VariableGridData")),
-		vgc, begin, end, layers, c, cfg)
+		vgc, begin, end, layers, c, "", 0, cfg)
 	if err != nil {
 		t.Fatal(err)
 	}
 	err = SaveSR(ctx, "test_sr", output,
 		os.ExpandEnv(cfg.GetString("VariableGridData")),
-		vgc, begin, end, layers, c)
+		vgc, begin, end, layers, c, false, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSRExtend(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sr_extend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "extended.ncf")
+
+	cfg := InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("SR.PreviousFile", "../cmd/inmap/testdata/testSR_golden.ncf")
+	cfg.Set("SR.OutputFile", output)
+	cfg.Set("layers", "0")
+	cfg.Root.SetArgs([]string{"sr", "extend"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := sr.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first source grid cell is the same in both grids, so its
+	// results should have been copied.
+	c, err := r.Source("PrimaryPM25", 0, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if floats.Sum(c) <= 0 {
+		t.Errorf("results should have been copied: %v", c)
+	}
 }
 
 func TestSRPredict(t *testing.T) {
@@ -80,6 +129,150 @@ func TestSRPredict(t *testing.T) {
 	}
 }
 
+func TestSRConvert(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sr_convert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	zarrFile := filepath.Join(dir, "sr.zarr")
+
+	cfg := InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("SR.OutputFile", "../cmd/inmap/testdata/testSR_golden.ncf")
+	cfg.Set("SR.ZarrFile", zarrFile)
+	cfg.Root.SetArgs([]string{"sr", "convert"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The converted SR matrix should be usable for predictions.
+	cfg = InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("SR.OutputFile", zarrFile)
+	cfg.Set("OutputFile", filepath.Join(dir, "output_SRPredict.shp"))
+	cfg.Set("OutputVariables", `{"TotalPM25": "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA"}`)
+	cfg.Set("EmissionsShapefiles", []string{"../cmd/inmap/testdata/testEmisSR.shp"})
+	cfg.Root.SetArgs([]string{"srpredict"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSRPredictBatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sr_predict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	emisFile := filepath.Join(dir, "emis.csv")
+	var b strings.Builder
+	b.WriteString("Lon,Lat,PM2_5,SOx,Height\n")
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&b, "%g,%g,1,0.5,%d\n", -97.04+float64(i%20)*0.004, 39.97+float64(i/20)*0.0024, i%3*50)
+	}
+	if err := os.WriteFile(emisFile, []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outputFile := filepath.Join(dir, "output.shp")
+
+	cfg := InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("SR.OutputFile", "../cmd/inmap/testdata/testSR_golden.ncf")
+	cfg.Set("SR.Procs", 4)
+	cfg.Set("OutputFile", outputFile)
+	cfg.Set("OutputVariables", `{"TotalPM25": "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA",
+"TotalPopD": "(exp(log(1.078)/10 * TotalPM25) - 1) * TotalPop * allcause / 100000"}`)
+	cfg.Set("EmissionsShapefiles", []string{emisFile})
+	cfg.Root.SetArgs([]string{"sr", "predict"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	dec, err := shp.NewDecoder(outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	var pm25 float64
+	for {
+		_, fields, more := dec.DecodeRowFields("TotalPM25")
+		if !more {
+			break
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(fields["TotalPM25"]), 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pm25 += v
+	}
+	if err := dec.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if pm25 <= 0 {
+		t.Errorf("TotalPM25 should be positive but is %g", pm25)
+	}
+}
+
+func TestSRPredictSources(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sr_predict_sources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	emisFile := filepath.Join(dir, "emis.csv")
+	emis := "Lon,Lat,PM2_5,SOx,Height\n-97,40,1,0.5,0\n-97.02,40.01,2,0,50\n-96.98,39.99,0,1,0\n"
+	if err := os.WriteFile(emisFile, []byte(emis), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sourceFile := filepath.Join(dir, "sources.csv")
+
+	cfg := InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("SR.OutputFile", "../cmd/inmap/testdata/testSR_golden.ncf")
+	cfg.Set("OutputFile", filepath.Join(dir, "output.shp"))
+	cfg.Set("SR.SourceOutputFile", sourceFile)
+	cfg.Set("OutputVariables", `{"TotalPM25": "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA",
+"TotalPopD": "(exp(log(1.078)/10 * TotalPM25) - 1) * TotalPop * allcause / 100000"}`)
+	cfg.Set("Valuation.Damages", `{"TotalDmg": "TotalPopD"}`)
+	cfg.Set("Valuation.VSL", 1.e6)
+	cfg.Set("EmissionsShapefiles", []string{emisFile})
+	cfg.Root.SetArgs([]string{"sr", "predict"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(sourceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantHeader := []string{"Source", "X", "Y", "TotalDmg", "TotalPM25", "TotalPopD"}
+	if !reflect.DeepEqual(rows[0], wantHeader) {
+		t.Fatalf("header: have %v, want %v", rows[0], wantHeader)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("have %d rows, want 4", len(rows))
+	}
+	for _, row := range rows[1:] {
+		deaths, err := strconv.ParseFloat(row[5], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		damages, err := strconv.ParseFloat(row[3], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deaths <= 0 || math.Abs(damages-deaths*1.e6) > 1.e-6*damages {
+			t.Errorf("source %s: deaths %g, damages %g", row[0], deaths, damages)
+		}
+	}
+}
+
 func TestSRPredictAboveTop(t *testing.T) {
 	cfg := InitializeConfig()
 	cfg.Set("config", "../cmd/inmap/configExample.toml")
@@ -106,7 +299,38 @@ func TestSRPredictAboveTop(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := SRPredict(cfg.GetString("EmissionUnits"), cfg.GetString("SR.OutputFile"), cfg.GetString("OutputFile"), outputVars, cfg.GetStringSlice("EmissionsShapefiles"), mask, vcfg); err != nil {
+	if err := SRPredict(cfg.GetString("EmissionUnits"), cfg.GetString("SR.OutputFile"), cfg.GetString("OutputFile"), outputVars, cfg.GetStringSlice("EmissionsShapefiles"), mask, vcfg, 0, "", ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSRSurrogate(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sr_surrogate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	surrogateFile := filepath.Join(dir, "surrogate.gob")
+
+	cfg := InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("SR.OutputFile", "../cmd/inmap/testdata/testSR_golden.ncf")
+	cfg.Set("SR.SurrogateFile", surrogateFile)
+	cfg.Set("SR.SurrogateRank", 5)
+	cfg.Root.SetArgs([]string{"sr", "surrogate"})
+	if err := cfg.Root.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg = InitializeConfig()
+	cfg.Set("config", "../cmd/inmap/configExample.toml")
+	cfg.Set("SR.OutputFile", "../cmd/inmap/testdata/testSR_golden.ncf")
+	cfg.Set("SR.SurrogateFile", surrogateFile)
+	cfg.Set("OutputFile", filepath.Join(dir, "output_SRPredict.shp"))
+	cfg.Set("OutputVariables", `{"TotalPM25": "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA"}`)
+	cfg.Set("EmissionsShapefiles", []string{"../cmd/inmap/testdata/testEmisSR.shp"})
+	cfg.Root.SetArgs([]string{"sr", "predict"})
+	if err := cfg.Root.Execute(); err != nil {
 		t.Fatal(err)
 	}
 }
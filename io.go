@@ -19,7 +19,10 @@ along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
 package inmap
 
 import (
+	"context"
+	"encoding/csv"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"os"
@@ -38,7 +41,6 @@ import (
 	"github.com/ctessum/unit"
 	goshp "github.com/jonas-p/go-shp"
 	"github.com/yuzhou-wang/inmap/emissions/aep"
-	"gonum.org/v1/gonum/floats"
 )
 
 // AddEmissionsFlux adds emissions to c.Cf and sets c.Ci equal to c.Cf.
@@ -64,6 +66,24 @@ type Emissions struct {
 	// to. It is assumed to use the same spatial reference as the
 	// InMAP computational grid. It is ignored if nil.
 	Mask geom.Polygon
+
+	// PlumeDistance specifies the downwind distance, in the units of the
+	// InMAP computational grid, that emissions from elevated sources
+	// are transported as a Gaussian plume before they are added to
+	// the grid. If it is zero, emissions are added to the grid cell
+	// that the plume rises to.
+	PlumeDistance float64
+
+	// NearRoadWidth specifies the width [m] of the zone next to line
+	// emissions sources, such as roads, that the near-road concentration
+	// enhancement in each ground-level grid cell is estimated for (see
+	// Cell.NearRoadEnhancement). The enhancement is not estimated
+	// if it is zero.
+	NearRoadWidth float64
+
+	// wrapped holds the bounds of the global grid that copies of the
+	// emissions records have been added for, if any (see wrap).
+	wrapped *geom.Bounds
 }
 
 // EmisRecord is a holder for an emissions record.
@@ -75,6 +95,37 @@ type EmisRecord struct {
 	Diam               float64 // stack diameter [m]
 	Temp               float64 // stack temperature [K]
 	Velocity           float64 // stack velocity [m/s]
+
+	// PlumeRise is the name of the plume rise model to use for
+	// elevated emissions (see PlumeRiseModelByName). If it is empty,
+	// the default plume rise calculation of (*Cell).IsPlumeIn is used.
+	PlumeRise string
+
+	// BldgHeight and BldgWidth are the height and width [m] of the
+	// building next to a stack, which are used to account for building
+	// downwash (see (*Cell).IsPlumeInRecord). Building downwash is
+	// not calculated if either is zero.
+	BldgHeight, BldgWidth float64
+
+	// ReleaseBottom and ReleaseTop are the heights above ground [m] of
+	// the bottom and top of the altitude range that emissions without a
+	// stack, such as aircraft emissions, are released within. The
+	// emissions are distributed evenly by height across the range, and
+	// plume rise is not calculated. If ReleaseBottom is not less than
+	// ReleaseTop, the emissions are released at height ReleaseTop.
+	// If ReleaseTop is zero, the emissions are not released within an
+	// altitude range (see (*Cell).ReleaseFraction).
+	ReleaseBottom float64 `shp:"RelBottom"`
+	ReleaseTop    float64 `shp:"RelTop"`
+
+	// EC and OC are the parts of PM25 that are elemental carbon
+	// and organic carbon [μg/s]. They are included in PM25, so
+	// PM25 - EC - OC is the emissions of other primary PM2.5.
+	EC, OC float64
+
+	// PM10 is the total primary PM10 emissions [μg/s], including
+	// PM25, so PM10 - PM25 is the emissions of coarse particles.
+	PM10 float64
 }
 
 // add adds the emissions in o to the receiver.
@@ -84,6 +135,9 @@ func (e *EmisRecord) add(o *EmisRecord) {
 	e.NH3 += o.NH3
 	e.SOx += o.SOx
 	e.PM25 += o.PM25
+	e.EC += o.EC
+	e.OC += o.OC
+	e.PM10 += o.PM10
 }
 
 // NewEmissions Initializes a new emissions holder.
@@ -133,6 +187,9 @@ func (e *Emissions) Add(er *EmisRecord) {
 		er2.NH3 *= frac
 		er2.SOx *= frac
 		er2.PM25 *= frac
+		er2.EC *= frac
+		er2.OC *= frac
+		er2.PM10 *= frac
 		e.data.Insert(er2)
 		e.dataSlice = append(e.dataSlice, er2)
 	}
@@ -142,9 +199,9 @@ func (e *Emissions) Add(er *EmisRecord) {
 // receiver.
 func (e *Emissions) EmisRecords() []*EmisRecord { return e.dataSlice }
 
-// emisConversionFactor returns the conversion factor to μg/s
-// for the given units.
-func emisConversionFactor(units string) (float64, error) {
+// EmisConversionFactor returns the conversion factor to μg/s
+// for the given units; options are tons/year, kg/year, ug/s, and μg/s.
+func EmisConversionFactor(units string) (float64, error) {
 	var emisConv float64
 	switch units {
 	case "tons/year":
@@ -169,13 +226,15 @@ func emisConversionFactor(units string) (float64, error) {
 // ReadEmissionShapefiles returns the emissions data in the specified shapefiles,
 // and converts them to the spatial reference gridSR. Input units are specified
 // by units; options are tons/year, kg/year, ug/s, and μg/s. Output units = μg/s.
+// Files with the extension ".csv" are read as CSV files of point
+// sources instead (see ReadEmissionCSV).
 // c is a channel over which status updates will be sent. If c is nil,
 // no updates will be sent.
 // mask specifies the region that emissions should be clipped to, assumed to
 // use the same spatial reference as the InMAP grid. If mask is nil
 // it will be ignored.
 func ReadEmissionShapefiles(gridSR *proj.SR, units string, c chan string, mask geom.Polygon, shapefiles ...string) (*Emissions, error) {
-	emisConv, err := emisConversionFactor(units)
+	emisConv, err := EmisConversionFactor(units)
 	if err != nil {
 		return nil, err
 	}
@@ -184,6 +243,20 @@ func ReadEmissionShapefiles(gridSR *proj.SR, units string, c chan string, mask g
 	emis := NewEmissions()
 	emis.Mask = mask
 	for _, fname := range shapefiles {
+		if strings.EqualFold(filepath.Ext(fname), ".csv") {
+			if c != nil {
+				c <- fmt.Sprintf("Loading emissions CSV file: %s.", fname)
+			}
+			records, err := ReadEmissionCSV(fname, gridSR)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range records {
+				e.convertUnits(emisConv)
+				emis.Add(e)
+			}
+			continue
+		}
 		if c != nil {
 			c <- fmt.Sprintf("Loading emissions shapefile: %s.", fname)
 		}
@@ -219,24 +292,7 @@ func ReadEmissionShapefiles(gridSR *proj.SR, units string, c chan string, mask g
 					"emissions file %s. The error message was %v", fname, err)
 			}
 
-			e.VOC *= emisConv
-			e.NOx *= emisConv
-			e.NH3 *= emisConv
-			e.SOx *= emisConv
-			e.PM25 *= emisConv
-
-			if math.IsNaN(e.Height) {
-				e.Height = 0.
-			}
-			if math.IsNaN(e.Diam) {
-				e.Diam = 0.
-			}
-			if math.IsNaN(e.Temp) {
-				e.Temp = 0.
-			}
-			if math.IsNaN(e.Velocity) {
-				e.Velocity = 0.
-			}
+			e.convertUnits(emisConv)
 			emis.Add(&e)
 		}
 		f.Close()
@@ -248,13 +304,151 @@ func ReadEmissionShapefiles(gridSR *proj.SR, units string, c chan string, mask g
 	return emis, nil
 }
 
+// convertUnits multiplies the emissions in e by emisConv and
+// replaces missing values with zeros.
+func (e *EmisRecord) convertUnits(emisConv float64) {
+	e.VOC *= emisConv
+	e.NOx *= emisConv
+	e.NH3 *= emisConv
+	e.SOx *= emisConv
+	e.PM25 *= emisConv
+	if math.IsNaN(e.EC) {
+		e.EC = 0.
+	}
+	if math.IsNaN(e.OC) {
+		e.OC = 0.
+	}
+	e.EC *= emisConv
+	e.OC *= emisConv
+	if math.IsNaN(e.PM10) {
+		e.PM10 = 0.
+	}
+	e.PM10 *= emisConv
+
+	if math.IsNaN(e.Height) {
+		e.Height = 0.
+	}
+	if math.IsNaN(e.Diam) {
+		e.Diam = 0.
+	}
+	if math.IsNaN(e.Temp) {
+		e.Temp = 0.
+	}
+	if math.IsNaN(e.Velocity) {
+		e.Velocity = 0.
+	}
+	if math.IsNaN(e.BldgHeight) {
+		e.BldgHeight = 0.
+	}
+	if math.IsNaN(e.BldgWidth) {
+		e.BldgWidth = 0.
+	}
+	if math.IsNaN(e.ReleaseBottom) {
+		e.ReleaseBottom = 0.
+	}
+	if math.IsNaN(e.ReleaseTop) {
+		e.ReleaseTop = 0.
+	}
+}
+
+// ReadEmissionCSV reads point emissions sources from the CSV file fname,
+// which is useful for inventories with many stacks that are not
+// available as shapefiles. The first line of the file is a header,
+// and each following line is one source. Columns "Lon" and "Lat" hold
+// the longitude and latitude of each source in decimal degrees, which
+// are converted to the spatial reference gridSR. The other columns can
+// have the same names as the columns of emissions shapefiles (e.g.,
+// "VOC", "PM2_5", "Height", "Temp", or "PlumeRise"; see EmisRecord);
+// column names are not case-sensitive, empty values are treated as zero,
+// and unrecognized columns are ignored. The emissions are not converted
+// to μg/s.
+func ReadEmissionCSV(fname string, gridSR *proj.SR) ([]*EmisRecord, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading emissions CSV file: %v", err)
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading emissions CSV file %s: %v", fname, err)
+	}
+	cols := make(map[string]int)
+	for i, h := range header {
+		cols[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	lonCol, ok := cols["lon"]
+	if !ok {
+		return nil, fmt.Errorf("inmap: emissions CSV file %s does not have a 'Lon' column", fname)
+	}
+	latCol, ok := cols["lat"]
+	if !ok {
+		return nil, fmt.Errorf("inmap: emissions CSV file %s does not have a 'Lat' column", fname)
+	}
+	lonLat, err := proj.Parse("+proj=longlat")
+	if err != nil {
+		return nil, err
+	}
+	trans, err := lonLat.NewTransform(gridSR)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: emissions CSV file %s: %v", fname, err)
+	}
+
+	var records []*EmisRecord
+	for line := 2; ; line++ {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("inmap: reading emissions CSV file %s: %v", fname, err)
+		}
+		e := new(EmisRecord)
+		var p geom.Point
+		values := map[string]*float64{
+			"lon": &p.X, "lat": &p.Y,
+			"voc": &e.VOC, "nox": &e.NOx, "nh3": &e.NH3, "sox": &e.SOx,
+			"pm2_5": &e.PM25, "pm25": &e.PM25, "ec": &e.EC, "oc": &e.OC, "pm10": &e.PM10,
+			"height": &e.Height, "diam": &e.Diam, "temp": &e.Temp, "velocity": &e.Velocity,
+			"bldgheight": &e.BldgHeight, "bldgwidth": &e.BldgWidth,
+			"relbottom": &e.ReleaseBottom, "reltop": &e.ReleaseTop,
+		}
+		for name, v := range values {
+			i, ok := cols[name]
+			if !ok {
+				continue
+			}
+			s := strings.TrimSpace(row[i])
+			if s == "" {
+				if i == lonCol || i == latCol {
+					return nil, fmt.Errorf("inmap: emissions CSV file %s line %d: missing location", fname, line)
+				}
+				continue
+			}
+			if *v, err = strconv.ParseFloat(s, 64); err != nil {
+				return nil, fmt.Errorf("inmap: emissions CSV file %s line %d: column '%s': %v", fname, line, header[i], err)
+			}
+		}
+		if i, ok := cols["plumerise"]; ok {
+			e.PlumeRise = strings.TrimSpace(row[i])
+		}
+		if e.Geom, err = p.Transform(trans); err != nil {
+			return nil, fmt.Errorf("inmap: emissions CSV file %s line %d: %v", fname, line, err)
+		}
+		records = append(records, e)
+	}
+	return records, nil
+}
+
 // FromAEP converts the given AEP (github.com/yuzhou-wang/inmap/emissions/aep) records to
 // EmisRecords using the given grid definitions and
-// grid index gi. VOC, NOx, NH3, SOx, and PM25 are lists of
+// grid index gi. VOC, NOx, NH3, SOx, PM25, EC, OC, and PM10 are lists of
 // AEP Polluants that should be mapped to those InMAP species.
+// EC and OC emissions are parts of PM2.5 that are also added
+// to the PM25 total. PM10 emissions should include PM2.5.
 // The returned EmisRecords will be grouped as much as possible to minimize
 // the number of records.
-func FromAEP(r []aep.RecordGridded, grids []*aep.GridDef, gi int, VOC, NOx, NH3, SOx, PM25 []aep.Pollutant) ([]*EmisRecord, error) {
+func FromAEP(r []aep.RecordGridded, grids []*aep.GridDef, gi int, VOC, NOx, NH3, SOx, PM25, EC, OC, PM10 []aep.Pollutant) ([]*EmisRecord, error) {
 	if gi < 0 || len(grids) <= gi {
 		return nil, fmt.Errorf("inmap: converting AEP record to EmisRecord: invalid gi (%d)", gi)
 	}
@@ -344,6 +538,39 @@ func FromAEP(r []aep.RecordGridded, grids []*aep.GridDef, gi int, VOC, NOx, NH3,
 						break
 					}
 				}
+				if found {
+					continue
+				}
+				for _, p := range EC {
+					if pRec.Name == p.Name {
+						v := checkDim(e[pRec]) * frac * kgPerYearToUgPerS
+						er.EC += v
+						er.PM25 += v
+						found = true
+						break
+					}
+				}
+				if found {
+					continue
+				}
+				for _, p := range OC {
+					if pRec.Name == p.Name {
+						v := checkDim(e[pRec]) * frac * kgPerYearToUgPerS
+						er.OC += v
+						er.PM25 += v
+						found = true
+						break
+					}
+				}
+				if found {
+					continue
+				}
+				for _, p := range PM10 {
+					if pRec.Name == p.Name {
+						er.PM10 += checkDim(e[pRec]) * frac * kgPerYearToUgPerS
+						break
+					}
+				}
 			}
 
 			if ptRec, ok := rec.Parent().(aep.RecordElevated); ok && !ptRec.GroundLevel() {
@@ -407,13 +634,8 @@ func calcWeightFactor(e geom.Geom, c *Cell) float64 {
 		}
 		weightFactor = intersection.Area() / poly.Area()
 	case geom.Linear:
-		intersection := e.(geom.Linear).Clip(c.Polygonal)
-		if intersection == nil {
-			return 0.
-		}
 		el := e.(geom.Linear)
-		il := intersection
-		weightFactor = il.Length() / el.Length()
+		weightFactor = lineLengthIn(el, c) / el.Length()
 	default:
 		log.Fatalf("unsupported geometry type: %#v in emissions file", e)
 	}
@@ -421,13 +643,28 @@ func calcWeightFactor(e geom.Geom, c *Cell) float64 {
 }
 
 // SetEmissionsFlux sets the emissions flux for the receiver based on the emissions in e.
+// If e.PlumeDistance is greater than zero, emissions from elevated sources are
+// not included; they are added by (*InMAP).SetEmissionsFlux instead.
+// Emissions that are released within an altitude range are always included.
 func (c *Cell) SetEmissionsFlux(e *Emissions, m Mechanism) error {
 	c.EmisFlux = make([]float64, m.Len())
+	plumeInGrid := e.PlumeDistance > 0
+	nearRoadWidth := e.NearRoadWidth
+	var nr nearRoad
 	for _, eTemp := range e.data.SearchIntersect(c.Bounds()) {
 		e := eTemp.(*EmisRecord)
-		if e.Height > 0. {
+		layerFrac := 1.
+		if e.ReleaseTop > 0 {
+			// Figure out how much of the altitude range is in this cell.
+			if layerFrac, _ = c.ReleaseFraction(e); layerFrac == 0 {
+				continue
+			}
+		} else if e.Height > 0. {
+			if plumeInGrid {
+				continue
+			}
 			// Figure out if this cell is at the right hight for the plume.
-			in, _, err := c.IsPlumeIn(e.Height, e.Diam, e.Temp, e.Velocity)
+			in, _, err := c.IsPlumeInRecord(e)
 			if err != nil {
 				panic(err)
 			}
@@ -437,24 +674,58 @@ func (c *Cell) SetEmissionsFlux(e *Emissions, m Mechanism) error {
 		} else if c.Layer != 0 {
 			continue
 		}
-		weightFactor := calcWeightFactor(e.Geom, c)
+		weightFactor := calcWeightFactor(e.Geom, c) * layerFrac
 		if weightFactor == 0 {
 			continue
 		}
-
-		if err := m.AddEmisFlux(c, "VOC", e.VOC*weightFactor); err != nil {
+		if err := c.addEmisFlux(e, weightFactor, m); err != nil {
 			return err
 		}
-		if err := m.AddEmisFlux(c, "NOx", e.NOx*weightFactor); err != nil {
-			return err
+		if nearRoadWidth > 0 && c.Layer == 0 {
+			nr.add(e, weightFactor)
 		}
-		if err := m.AddEmisFlux(c, "NH3", e.NH3*weightFactor); err != nil {
+	}
+	c.NearRoadEnhancement = 0
+	if nearRoadWidth > 0 && c.Layer == 0 {
+		c.NearRoadEnhancement = nr.enhancement(nearRoadWidth, c.Dx*c.Dy)
+	}
+	return nil
+}
+
+// addEmisFlux adds the emissions in e, multiplied by weightFactor,
+// to the emissions flux of c.
+func (c *Cell) addEmisFlux(e *EmisRecord, weightFactor float64, m Mechanism) error {
+	if err := m.AddEmisFlux(c, "VOC", e.VOC*weightFactor); err != nil {
+		return err
+	}
+	if err := m.AddEmisFlux(c, "NOx", e.NOx*weightFactor); err != nil {
+		return err
+	}
+	if err := m.AddEmisFlux(c, "NH3", e.NH3*weightFactor); err != nil {
+		return err
+	}
+	if err := m.AddEmisFlux(c, "SOx", e.SOx*weightFactor); err != nil {
+		return err
+	}
+	if err := m.AddEmisFlux(c, "PM2_5", e.PM25*weightFactor); err != nil {
+		return err
+	}
+	// Only mechanisms that track primary carbon separately
+	// need to handle EC and OC, which are parts of PM2.5.
+	if e.EC != 0 {
+		if err := m.AddEmisFlux(c, "EC", e.EC*weightFactor); err != nil {
 			return err
 		}
-		if err := m.AddEmisFlux(c, "SOx", e.SOx*weightFactor); err != nil {
+	}
+	if e.OC != 0 {
+		if err := m.AddEmisFlux(c, "OC", e.OC*weightFactor); err != nil {
 			return err
 		}
-		if err := m.AddEmisFlux(c, "PM2_5", e.PM25*weightFactor); err != nil {
+	}
+	// Likewise, only mechanisms that track coarse PM need to
+	// handle the part of PM10 that is larger than PM2.5.
+	if coarse := e.PM10 - e.PM25; coarse > 0 {
+		if err := m.AddEmisFlux(c, "PMCoarse", coarse*weightFactor); err != nil {
 			return err
 		}
 	}
@@ -466,7 +737,9 @@ func (c *Cell) SetEmissionsFlux(e *Emissions, m Mechanism) error {
 // fileName contains the path where the output will be saved.
 //
 // If allLayers is true, output will contain data for all of the vertical
-// layers, otherwise only the ground-level layer is returned.
+// layers, otherwise only the ground-level layer is returned. Output for all
+// layers also includes the layer index ("Layer") and the height of the
+// bottom ("LayerHeight") and the thickness ("Dz") of each cell in meters.
 //
 // outputVariables maps the names of the variables for which data
 // should be returned to expressions that define how the
@@ -495,34 +768,63 @@ type Outputter struct {
 //
 // 'log10(x)' which applies the base-10 logarithm function log10(e).
 //
-// 'sum(x)' which sums a variable across all grid cells.
+// 'sqrt(x)', 'abs(x)', and 'pow(x, y)' which calculate the square root,
+// the absolute value, and x raised to the power y, respectively.
+//
+// 'min(x, y, ...)' and 'max(x, y, ...)' which return the smallest and largest
+// of their arguments in each grid cell.
+//
+// 'if(condition, x, y)' which returns x where condition (e.g., 'x > y') is
+// true or nonzero and y otherwise.
+//
+// Concentration-response functions, which return the hazard ratio caused by
+// concentration z:
+// 'loglinear(beta, threshold, z)', the log-linear (Cox proportional
+// hazards) form (see epi.Cox);
+// 'gemm(theta, alpha, mu, nu, cf, z)', the Global Exposure Mortality Model
+// (see epi.GEMM); and
+// 'ier(alpha, gamma, delta, zcf, z)', the integrated exposure-response
+// model (see epi.IER).
+// The predefined functions in package epi are also available by name,
+// for example 'Krewski2009Ecologic(z)', 'GEMMNCDLRI(z)', and the morbidity
+// function 'Mar2010AsthmaER(z)'.
+// For example, '(GEMMNCDLRI(TotalPM25) - 1) * TotalPop * allcause / 100000'
+// approximates the number of deaths caused by PM2.5.
+//
+// Segments of expressions that are surrounded by braces ('{}') are evaluated
+// across all grid cells, and can contain the following aggregate functions,
+// whose arguments are evaluated in each grid cell:
+//
+// 'sum(x)' which sums x across all grid cells.
+//
+// 'mean(x)' which calculates the mean of x across all grid cells.
+//
+// 'weightedmean(x, w)' which calculates the mean of x across all grid cells
+// weighted by w, e.g., 'weightedmean(TotalPM25, TotalPop)' calculates
+// the population-weighted average PM2.5 concentration.
+//
+// 'min(x)' and 'max(x)' which find the minimum and maximum of x across all
+// grid cells.
+//
+// 'atkinson(x, w, epsilon)' which calculates the Atkinson index of the
+// inequality of x among the population w, with inequality aversion
+// parameter epsilon, which should be negative for undesirable quantities
+// such as concentrations, e.g., 'atkinson(TotalPM25, Black, -0.5)'.
+//
+// 'concindex(x, w, rank)' which calculates the concentration index of x
+// among the population w ranked by rank, which is negative if x is
+// concentrated among people with low ranks, e.g.,
+// 'concindex(TotalPM25, TotalPop, Income)'.
+//
+// Keys of outputVariables that are surrounded by square brackets
+// (e.g., '[PopPM]') define named intermediate expressions that can be used
+// in other expressions by their name without brackets (e.g., 'PopPM') but are
+// not included in the output.
+//
+// An error is returned if any of the expressions are invalid, including if
+// an expression depends on itself.
 func NewOutputter(fileName string, allLayers bool, outputVariables map[string]string, outputFunctions map[string]govaluate.ExpressionFunction, m Mechanism) (*Outputter, error) {
-	defaultOutputFuncs := map[string]govaluate.ExpressionFunction{
-		"exp": func(arg ...interface{}) (interface{}, error) {
-			if len(arg) != 1 {
-				return nil, fmt.Errorf("inmap: got %d arguments for function 'exp', but need 1", len(arg))
-			}
-			return (float64)(math.Exp(arg[0].(float64))), nil
-		},
-		"log": func(arg ...interface{}) (interface{}, error) {
-			if len(arg) != 1 {
-				return nil, fmt.Errorf("inmap: got %d arguments for function 'exp', but need 1", len(arg))
-			}
-			return (float64)(math.Log(arg[0].(float64))), nil
-		},
-		"log10": func(arg ...interface{}) (interface{}, error) {
-			if len(arg) != 1 {
-				return nil, fmt.Errorf("inmap: got %d arguments for function 'exp', but need 1", len(arg))
-			}
-			return (float64)(math.Log(arg[0].(float64))), nil
-		},
-		"sum": func(arg ...interface{}) (interface{}, error) {
-			if len(arg) != 1 {
-				return nil, fmt.Errorf("inmap: got %d arguments for function 'sum', but need 1", len(arg))
-			}
-			return floats.Sum(arg[0].([]float64)), nil
-		},
-	}
+	defaultOutputFuncs := defaultOutputFunctions()
 
 	for key, val := range outputFunctions {
 		defaultOutputFuncs[key] = val
@@ -531,14 +833,31 @@ func NewOutputter(fileName string, allLayers bool, outputVariables map[string]st
 	o := Outputter{
 		fileName:        fileName,
 		allLayers:       allLayers,
-		outputVariables: outputVariables,
+		outputVariables: make(map[string]string, len(outputVariables)),
 		outputFunctions: defaultOutputFuncs,
 		m:               m,
 	}
 
+	intermediates := make(map[string]struct{})
+	for key, val := range outputVariables {
+		if err := checkAggregates(val); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(key, "[") && strings.HasSuffix(key, "]") {
+			key = key[1 : len(key)-1]
+			if _, ok := outputVariables[key]; ok {
+				return nil, fmt.Errorf("inmap: intermediate expression '%s' has the same name as an output variable", key)
+			}
+			intermediates[key] = struct{}{}
+		}
+		o.outputVariables[key] = val
+	}
+	if err := checkForCycles(o.outputVariables, o.outputFunctions); err != nil {
+		return nil, err
+	}
+
 	for _, val := range o.outputVariables {
-		regx := regexp.MustCompile(`{(.*?)}`)
-		matches := regx.FindAllString(val, -1)
+		matches := braces.FindAllString(val, -1)
 		if len(matches) > 0 {
 			for _, m := range matches {
 				if strings.Count(m, "{") > 1 || strings.Count(m, "}") > 1 {
@@ -561,10 +880,67 @@ func NewOutputter(fileName string, allLayers bool, outputVariables map[string]st
 			delete(o.outputVariables, k1)
 		}
 	}
+	for k := range intermediates {
+		delete(o.outputVariables, k)
+	}
 
 	return &o, err
 }
 
+// checkForCycles returns an error if any of the given output variable
+// expressions depend on themselves, either directly or through other
+// output variables.
+func checkForCycles(outputVariables map[string]string, funcs map[string]govaluate.ExpressionFunction) error {
+	deps := make(map[string][]string, len(outputVariables))
+	for key, val := range outputVariables {
+		val = strings.NewReplacer("{", "", "}", "").Replace(val)
+		expression, err := govaluate.NewEvaluableExpressionWithFunctions(val, funcs)
+		if err != nil {
+			return fmt.Errorf("inmap o.outputVariables: %v", err)
+		}
+		for _, v := range removeDuplicates(expression.Vars()) {
+			// An output variable that is defined as a model variable of the same
+			// name (e.g., "TotalPM25": "TotalPM25") does not depend on itself.
+			if _, ok := outputVariables[v]; ok && outputVariables[v] != v {
+				deps[key] = append(deps[key], v)
+			}
+		}
+	}
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := make(map[string]int, len(outputVariables))
+	var visit func(key string) error
+	visit = func(key string) error {
+		switch state[key] {
+		case visiting:
+			return fmt.Errorf("inmap: output variable expression '%s' depends on itself", key)
+		case visited:
+			return nil
+		}
+		state[key] = visiting
+		for _, d := range deps[key] {
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		state[key] = visited
+		return nil
+	}
+	keys := make([]string, 0, len(outputVariables))
+	for key := range outputVariables {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := visit(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // removeDuplicates removes all duplicated strings from a slice, returning a
 // slice that contains only unique strings.
 func removeDuplicates(s []string) []string {
@@ -717,31 +1093,15 @@ func (o *Outputter) CheckOutputVars(m Mechanism) DomainManipulator {
 	}
 }
 
-// Output writes the simulation results to a shapefile.
+// Output writes the simulation results to a shapefile, or to a GeoParquet
+// file if the output file name has the extension ".parquet" or
+// ".geoparquet", or to a KML file for viewing in Google Earth if the
+// output file name has the extension ".kml" (see writeKML), or to a
+// PostGIS table if the output file name is a PostgreSQL URL (see
+// IsPostGISURL and writePostGIS).
 // SR is the spatial reference of the model grid.
 func (o *Outputter) Output(sr *proj.SR) DomainManipulator {
 	return func(d *InMAP) error {
-		// Projection definition. This may need to be changed for a different
-		// spatial domain.
-		// TODO: Make this settable by the user, or at least check to make sure it
-		// matches the InMAPProj configuration variable.
-		var wkt string
-		switch sr.Name {
-		case "lcc":
-			wkt = fmt.Sprintf("PROJCS[\"Lambert_Conformal_Conic\",GEOGCS[\"GCS_unnamed ellipse\","+
-				"DATUM[\"D_unknown\",SPHEROID[\"Unknown\",%f,0]],PRIMEM[\"Greenwich\",0],"+
-				"UNIT[\"Degree\",0.017453292519943295]],PROJECTION[\"Lambert_Conformal_Conic\"],"+
-				"PARAMETER[\"standard_parallel_1\",%g],PARAMETER[\"standard_parallel_2\",%g],"+
-				"PARAMETER[\"latitude_of_origin\",%g],PARAMETER[\"central_meridian\",%g],"+
-				"PARAMETER[\"false_easting\",0],PARAMETER[\"false_northing\",0],UNIT[\"Meter\",1]]",
-				sr.A, sr.Lat1/math.Pi*180, sr.Lat2/math.Pi*180, sr.Lat0/math.Pi*180,
-				sr.Long0/math.Pi*180)
-		case "longlat":
-			wkt = `GEOGCS["GCS_WGS_1984",DATUM["D_WGS_1984",SPHEROID["WGS_1984",6378137,298.257223563]],PRIMEM["Greenwich",0],UNIT["Degree",0.017453292519943295]]`
-		default:
-			return fmt.Errorf("only `lcc` and `longlat` projections are supported, not %s", sr.Name)
-		}
-
 		// Create slice of output variable names
 		outputVariableNames := make([]string, len(o.outputVariables))
 		i := 0
@@ -755,46 +1115,88 @@ func (o *Outputter) Output(sr *proj.SR) DomainManipulator {
 			return err
 		}
 
-		vars := make([]string, 0, len(results))
-		for v := range results {
-			vars = append(vars, v)
-		}
-		sort.Strings(vars)
-		fields := make([]goshp.Field, len(vars))
-		for i, v := range vars {
-			fields[i] = shpFieldFromArray(v, results[v])
-		}
-
-		// remove extension and replace it with .shp
-		fileBase := strings.TrimSuffix(o.fileName, filepath.Ext(o.fileName))
-		o.fileName = fileBase + ".shp"
-		shape, err := shp.NewEncoderFromFields(o.fileName, goshp.POLYGON, fields...)
-		if err != nil {
-			return fmt.Errorf("error creating output shapefile: %v", err)
-		}
 		cells := d.cells.array()
-		for i, c := range cells[0:len(results[outputVariableNames[0]])] {
-			outFields := make([]interface{}, len(vars))
-			for j, v := range vars {
-				outFields[j] = results[v][i]
-			}
-			err = shape.EncodeFields(c.Polygonal, outFields...)
-			if err != nil {
-				return fmt.Errorf("error writing output shapefile: %v", err)
+		cells = cells[0:len(results[outputVariableNames[0]])]
+		if o.allLayers {
+			// Add the vertical coordinates so that the rows in
+			// each layer can be distinguished.
+			for _, v := range verticalCoordinates {
+				if _, ok := results[v]; !ok {
+					results[v] = d.toArray(v, -1, o.m)
+				}
 			}
 		}
-		shape.Close()
+		if !IsPostGISURL(o.fileName) && !isGeoParquet(o.fileName) && !isKML(o.fileName) {
+			// remove extension and replace it with .shp
+			o.fileName = strings.TrimSuffix(o.fileName, filepath.Ext(o.fileName)) + ".shp"
+		}
+		return writeGridResults(o.fileName, sr, cells, results)
+	}
+}
 
-		// Create .prj file
-		f, err := os.Create(fileBase + ".prj")
+// writeGridResults saves the given results, which are in the form of
+// map[variable][row]value, for the given cells to fileName, which can be
+// a shapefile, a GeoParquet file, a KML file, or a PostGIS table, as described
+// for Output.
+func writeGridResults(fileName string, sr *proj.SR, cells []*Cell, results map[string][]float64) error {
+	if IsPostGISURL(fileName) {
+		return writePostGIS(context.TODO(), fileName, sr, cells, results)
+	}
+	if isGeoParquet(fileName) {
+		return writeGeoParquet(fileName, sr, cells, results)
+	}
+	if isKML(fileName) {
+		return writeKML(fileName, sr, cells, results)
+	}
+	return writeShapefile(fileName, sr, cells, results)
+}
+
+// writeShapefile saves the given results, which are in the form of
+// map[variable][row]value, for the given cells to the shapefile fileName
+// using spatial reference sr, along with a .prj file.
+func writeShapefile(fileName string, sr *proj.SR, cells []*Cell, results map[string][]float64) error {
+	wkt, err := projectionWKT(sr)
+	if err != nil {
+		return err
+	}
+
+	vars := make([]string, 0, len(results))
+	for v := range results {
+		vars = append(vars, v)
+	}
+	sort.Strings(vars)
+	fields := make([]goshp.Field, len(vars))
+	for i, v := range vars {
+		fields[i] = shpFieldFromArray(v, results[v])
+	}
+
+	// remove extension and replace it with .shp
+	fileBase := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	shape, err := shp.NewEncoderFromFields(fileBase+".shp", goshp.POLYGON, fields...)
+	if err != nil {
+		return fmt.Errorf("error creating output shapefile: %v", err)
+	}
+	for i, c := range cells {
+		outFields := make([]interface{}, len(vars))
+		for j, v := range vars {
+			outFields[j] = results[v][i]
+		}
+		err = shape.EncodeFields(c.Polygonal, outFields...)
 		if err != nil {
-			return fmt.Errorf("error creating output prj file: %v", err)
+			return fmt.Errorf("error writing output shapefile: %v", err)
 		}
-		fmt.Fprint(f, wkt)
-		f.Close()
+	}
+	shape.Close()
 
-		return nil
+	// Create .prj file
+	f, err := os.Create(fileBase + ".prj")
+	if err != nil {
+		return fmt.Errorf("error creating output prj file: %v", err)
 	}
+	fmt.Fprint(f, wkt)
+	f.Close()
+
+	return nil
 }
 
 // shpFieldFromArray creates a shapefile field from the given array,
@@ -844,11 +1246,20 @@ func shpFieldFromArray(name string, d []float64) goshp.Field {
 // Results returns the simulation results.
 // Output is in the form of map[variable][row]concentration.
 func (d *InMAP) Results(o *Outputter) (map[string][]float64, error) {
+	modelVals, nCells, err := d.modelValues(o)
+	if err != nil {
+		return nil, err
+	}
+	return o.evaluate(modelVals, nCells)
+}
 
-	// Prepare output data.
+// modelValues returns the values of the model variables that are used in
+// the output variables of o in each grid cell, and the number of grid cells.
+func (d *InMAP) modelValues(o *Outputter) (map[string]interface{}, int, error) {
+	if err := d.cellStore.available(); err != nil {
+		return nil, 0, err
+	}
 	modelVals := make(map[string]interface{})
-	valByRow := make(map[string]interface{})
-	output := make(map[string][]float64)
 	var nCells int
 
 	// Get the model variables that are to be used in the output.
@@ -863,30 +1274,32 @@ func (d *InMAP) Results(o *Outputter) (map[string][]float64, error) {
 			nCells = len(data)
 		}
 	}
+	return modelVals, nCells, nil
+}
+
+// evaluate calculates the values of the output variables of o in each of
+// the nCells grid cells, where modelVals holds the values of the model
+// variables in each cell.
+func (o *Outputter) evaluate(modelVals map[string]interface{}, nCells int) (map[string][]float64, error) {
+	valByRow := make(map[string]interface{})
+	output := make(map[string][]float64)
 
-	// Identify segments of output variable expressions that are surrounded by braces.
+	// Identify segments of output variable expressions that are surrounded by
+	// braces and evaluate them across all grid cells.
+	outputVariables := make(map[string]string, len(o.outputVariables))
 	for k, v := range o.outputVariables {
-		regx, _ := regexp.Compile("\\{(.*?)\\}")
-		matches := regx.FindAllString(v, -1)
-		if len(matches) > 0 {
-			// For each segment of an expression that is surrounded by braces, evaluate
-			// across all grid cells.
-			for _, m := range matches {
-				expression, err := govaluate.NewEvaluableExpressionWithFunctions(m[1:len(m)-1], o.outputFunctions)
-				if err != nil {
-					return nil, err
-				}
-				result, err := expression.Evaluate(modelVals)
-				if err != nil {
-					return nil, err
-				}
-				// Replace segments surrounded by braces with corresponding result
-				// calculated above.
-				o.outputVariables[k] = strings.Replace(o.outputVariables[k], m, strconv.FormatFloat(result.(float64), 'f', -1, 64), 1)
+		for _, m := range braces.FindAllString(v, -1) {
+			result, err := evaluateAggregates(m[1:len(m)-1], modelVals, nCells, o.outputFunctions)
+			if err != nil {
+				return nil, err
 			}
+			// Replace segments surrounded by braces with corresponding result
+			// calculated above.
+			v = strings.Replace(v, m, "("+strconv.FormatFloat(result, 'f', -1, 64)+")", 1)
 		}
+		outputVariables[k] = v
 	}
-	for k, v := range o.outputVariables {
+	for k, v := range outputVariables {
 		expression, err := govaluate.NewEvaluableExpressionWithFunctions(v, o.outputFunctions)
 		if err != nil {
 			return nil, err
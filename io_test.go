@@ -851,6 +851,19 @@ func TestFromAEP(t *testing.T) {
 		},
 		Emissions: *e1,
 	}
+	e3 := new(aep.Emissions)
+	e3.Add(begin, end, "pm25", "", rate)
+	e3.Add(begin, end, "ec", "", rate)
+	e3.Add(begin, end, "pm10", "", rate)
+	r3 := &aep.PointRecord{
+		PointSourceData: aep.PointSourceData{
+			StackHeight:   unit.New(0, unit.Meter),
+			StackVelocity: unit.New(0, unit.MeterPerSecond),
+			Point:         geom.Point{X: -97.01, Y: 40.01},
+			SR:            inputSR,
+		},
+		Emissions: *e3,
+	}
 
 	const kgPerSecondToUgPerSecond = 1.0e9
 
@@ -967,6 +980,18 @@ func TestFromAEP(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "r3", // EC is part of PM2.5, but PM10 is separate.
+			recs: []aep.Record{r3},
+			result: []*EmisRecord{
+				{
+					Geom: &geom.Bounds{Min: geom.Point{X: -4000, Y: 0}, Max: geom.Point{X: 0, Y: 4000}},
+					PM25: 2 * kgPerSecondToUgPerSecond,
+					EC:   kgPerSecondToUgPerSecond,
+					PM10: kgPerSecondToUgPerSecond,
+				},
+			},
+		},
 		{
 			name: "r2, r1, r2",
 			recs: []aep.Record{r2, r1, r2},
@@ -999,6 +1024,9 @@ func TestFromAEP(t *testing.T) {
 				[]aep.Pollutant{{Name: "nh3"}},
 				[]aep.Pollutant{{Name: "sox"}},
 				[]aep.Pollutant{{Name: "pm25"}},
+				[]aep.Pollutant{{Name: "ec"}},
+				[]aep.Pollutant{{Name: "oc"}},
+				[]aep.Pollutant{{Name: "pm10"}},
 			)
 			if err != nil {
 				t.Error(err)
@@ -1119,6 +1147,7 @@ func BenchmarkFromAEP(b *testing.B) {
 					[]aep.Pollutant{{Name: "nh3"}},
 					[]aep.Pollutant{{Name: "sox"}},
 					[]aep.Pollutant{{Name: "pm25"}},
+					nil, nil, nil,
 				)
 				if err != nil {
 					b.Error(err)
@@ -1258,3 +1287,54 @@ func TestShpFieldFromArray(t *testing.T) {
 		})
 	}
 }
+
+func TestReadEmissionCSV(t *testing.T) {
+	dir, err := os.MkdirTemp("", "emis_csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "emis.csv")
+	const data = `Name,Lon,Lat,pm2_5,SOx,Height,Temp,PlumeRise
+a,-97,40,1,2,,,
+b,-96.5,40.5,3,,100,400,briggs
+`
+	if err := os.WriteFile(fname, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lonLat, err := proj.Parse("+proj=longlat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	emis, err := ReadEmissionShapefiles(lonLat, "ug/s", nil, nil, fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := emis.EmisRecords()
+	want := []*EmisRecord{
+		{Geom: geom.Point{X: -97, Y: 40}, PM25: 1, SOx: 2},
+		{Geom: geom.Point{X: -96.5, Y: 40.5}, PM25: 3, Height: 100, Temp: 400, PlumeRise: "briggs"},
+	}
+	if len(have) != len(want) {
+		t.Fatalf("have %d records, want %d", len(have), len(want))
+	}
+	for i := range want {
+		p := have[i].Geom.(geom.Point)
+		wp := want[i].Geom.(geom.Point)
+		if different(p.X, wp.X, 1e-10) || different(p.Y, wp.Y, 1e-10) {
+			t.Errorf("record %d location: have %v, want %v", i, p, wp)
+		}
+		have[i].Geom = nil
+		want[i].Geom = nil
+		if !reflect.DeepEqual(have[i], want[i]) {
+			t.Errorf("record %d: have %+v, want %+v", i, have[i], want[i])
+		}
+	}
+
+	if err := os.WriteFile(fname, []byte("X,Y,PM2_5\n1,2,3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadEmissionCSV(fname, lonLat); err == nil {
+		t.Error("missing location columns should cause an error")
+	}
+}
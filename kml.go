@@ -0,0 +1,213 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+)
+
+// kmlMaxHeight is the height [m] that cells with the largest value
+// of a variable are extruded to in KML output.
+const kmlMaxHeight = 20000.
+
+// kmlColors are the colors of the color scale used in KML output,
+// from the lowest to the highest value.
+var kmlColors = []color.NRGBA{
+	{R: 68, G: 1, B: 84, A: 255},
+	{R: 59, G: 82, B: 139, A: 255},
+	{R: 33, G: 145, B: 140, A: 255},
+	{R: 94, G: 201, B: 98, A: 255},
+	{R: 253, G: 231, B: 37, A: 255},
+}
+
+// isKML returns whether fileName has the extension of a KML file.
+func isKML(fileName string) bool {
+	return strings.ToLower(filepath.Ext(fileName)) == ".kml"
+}
+
+// writeKML saves the given results, which are in the form of
+// map[variable][row]value, for the given cells to the KML file fileName,
+// which can be opened in viewers such as Google Earth. The cell geometries
+// are converted from spatial reference sr to longitude-latitude coordinates.
+// There is a folder for each variable, in which each ground-level cell
+// is extruded to a height proportional to its value and colored according
+// to its value, and all of the variables are included in the data of
+// each cell. Only the folder for the first variable in alphabetical
+// order is initially visible. Cells above ground level are not included.
+func writeKML(fileName string, sr *proj.SR, cells []*Cell, results map[string][]float64) error {
+	vars := make([]string, 0, len(results))
+	for v := range results {
+		vars = append(vars, v)
+	}
+	sort.Strings(vars)
+
+	lonLat, err := proj.Parse("+proj=longlat")
+	if err != nil {
+		return err
+	}
+	var t proj.Transformer
+	if sr != nil {
+		if t, err = sr.NewTransform(lonLat); err != nil {
+			return fmt.Errorf("inmap: writing KML output: %v", err)
+		}
+	}
+	var rows []int
+	var polygons [][]geom.Polygon
+	for i, c := range cells {
+		if c.Layer != 0 {
+			continue
+		}
+		var polys []geom.Polygon
+		for _, p := range c.Polygons() {
+			g, err := p.Transform(t)
+			if err != nil {
+				return fmt.Errorf("inmap: writing KML output: %v", err)
+			}
+			polys = append(polys, g.(geom.Polygon))
+		}
+		rows = append(rows, i)
+		polygons = append(polygons, polys)
+	}
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("inmap: creating KML output file: %v", err)
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprint(w, xml.Header)
+	fmt.Fprintln(w, `<kml xmlns="http://www.opengis.net/kml/2.2">`)
+	fmt.Fprintln(w, "<Document>")
+	fmt.Fprintln(w, "<name>InMAP output</name>")
+	for vi, v := range vars {
+		visibility := 0
+		if vi == 0 {
+			visibility = 1
+		}
+		minVal, maxVal := math.Inf(1), math.Inf(-1)
+		for _, row := range rows {
+			if val := results[v][row]; !math.IsNaN(val) {
+				minVal = math.Min(minVal, val)
+				maxVal = math.Max(maxVal, val)
+			}
+		}
+		fmt.Fprintf(w, "<Folder>\n<name>%s</name>\n<visibility>%d</visibility>\n", kmlEscape(v), visibility)
+		fmt.Fprintf(w, "<description>%s: %g to %g</description>\n", kmlEscape(v), minVal, maxVal)
+		for i, row := range rows {
+			val := results[v][row]
+			if math.IsNaN(val) {
+				continue
+			}
+			frac := 0.
+			if maxVal > minVal {
+				frac = (val - minVal) / (maxVal - minVal)
+			}
+			height := strconv.FormatFloat(math.Max(frac*kmlMaxHeight, 1), 'f', 1, 64)
+
+			fmt.Fprintf(w, "<Placemark>\n<name>%s = %g</name>\n<visibility>%d</visibility>\n", kmlEscape(v), val, visibility)
+			fmt.Fprintln(w, "<ExtendedData>")
+			for _, v2 := range vars {
+				fmt.Fprintf(w, "<Data name=\"%s\"><value>%g</value></Data>\n", kmlEscape(v2), results[v2][row])
+			}
+			fmt.Fprintln(w, "</ExtendedData>")
+			fmt.Fprintf(w, "<Style><LineStyle><width>0</width></LineStyle><PolyStyle><color>%s</color><outline>0</outline></PolyStyle></Style>\n",
+				kmlColor(kmlColorScale(frac)))
+			if len(polygons[i]) > 1 {
+				fmt.Fprintln(w, "<MultiGeometry>")
+			}
+			for _, p := range polygons[i] {
+				fmt.Fprintln(w, "<Polygon><extrude>1</extrude><altitudeMode>relativeToGround</altitudeMode>")
+				for j, ring := range p {
+					if j == 0 {
+						fmt.Fprint(w, "<outerBoundaryIs>")
+					} else {
+						fmt.Fprint(w, "<innerBoundaryIs>")
+					}
+					fmt.Fprint(w, "<LinearRing><coordinates>")
+					for _, pt := range ring {
+						fmt.Fprintf(w, "%g,%g,%s ", pt.X, pt.Y, height)
+					}
+					if len(ring) > 0 && ring[0] != ring[len(ring)-1] {
+						// KML rings must be closed.
+						fmt.Fprintf(w, "%g,%g,%s", ring[0].X, ring[0].Y, height)
+					}
+					fmt.Fprint(w, "</coordinates></LinearRing>")
+					if j == 0 {
+						fmt.Fprintln(w, "</outerBoundaryIs>")
+					} else {
+						fmt.Fprintln(w, "</innerBoundaryIs>")
+					}
+				}
+				fmt.Fprintln(w, "</Polygon>")
+			}
+			if len(polygons[i]) > 1 {
+				fmt.Fprintln(w, "</MultiGeometry>")
+			}
+			fmt.Fprintln(w, "</Placemark>")
+		}
+		fmt.Fprintln(w, "</Folder>")
+	}
+	fmt.Fprintln(w, "</Document>")
+	fmt.Fprintln(w, "</kml>")
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("inmap: writing KML output: %v", err)
+	}
+	return f.Close()
+}
+
+// kmlColorScale returns the color at position frac, between 0 and 1,
+// of the KML color scale.
+func kmlColorScale(frac float64) color.NRGBA {
+	frac = math.Max(0, math.Min(1, frac)) * float64(len(kmlColors)-1)
+	i := int(frac)
+	if i >= len(kmlColors)-1 {
+		return kmlColors[len(kmlColors)-1]
+	}
+	f := frac - float64(i)
+	interp := func(a, b uint8) uint8 {
+		return uint8(math.Round(float64(a) + f*(float64(b)-float64(a))))
+	}
+	c1, c2 := kmlColors[i], kmlColors[i+1]
+	return color.NRGBA{R: interp(c1.R, c2.R), G: interp(c1.G, c2.G), B: interp(c1.B, c2.B), A: 255}
+}
+
+// kmlColor returns c in the hexadecimal alpha-blue-green-red format
+// used by KML.
+func kmlColor(c color.NRGBA) string {
+	return fmt.Sprintf("%02x%02x%02x%02x", c.A, c.B, c.G, c.R)
+}
+
+// kmlEscape escapes s for use in XML text and attributes.
+func kmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
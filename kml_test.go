@@ -0,0 +1,122 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/xml"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+)
+
+func TestWriteKML(t *testing.T) {
+	dir, err := os.MkdirTemp("", "kml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var cells []*Cell
+	for i := 0; i < 10; i++ {
+		x := float64(i) * 1000
+		cells = append(cells, &Cell{Polygonal: &geom.Bounds{Min: geom.Point{X: x, Y: 0}, Max: geom.Point{X: x + 1000, Y: 1000}}})
+	}
+	// Cells above ground level are not included.
+	cells = append(cells, &Cell{Polygonal: &geom.Bounds{Max: geom.Point{X: 1000, Y: 1000}}, Layer: 1})
+	results := map[string][]float64{"TotalPM25": make([]float64, len(cells)), "BPM25": make([]float64, len(cells))}
+	for i := range cells {
+		results["TotalPM25"][i] = float64(i)
+		results["BPM25"][i] = -float64(i) / 3
+	}
+	sr, err := proj.Parse("+proj=lcc +lat_1=33.000000 +lat_2=45.000000 +lat_0=40.000000 +lon_0=-97.000000 +x_0=0 +y_0=0 +a=6370997.000000 +b=6370997.000000 +to_meter=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(dir, "output.kml")
+	if !isKML(fileName) {
+		t.Fatal("should be KML")
+	}
+	if err := writeKML(fileName, sr, cells, results); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var doc struct {
+		Folders []struct {
+			Name       string `xml:"name"`
+			Visibility int    `xml:"visibility"`
+			Placemarks []struct {
+				Color       string `xml:"Style>PolyStyle>color"`
+				Coordinates string `xml:"Polygon>outerBoundaryIs>LinearRing>coordinates"`
+			} `xml:"Placemark"`
+		} `xml:"Document>Folder"`
+	}
+	if err := xml.NewDecoder(f).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Folders) != 2 || doc.Folders[0].Name != "BPM25" || doc.Folders[1].Name != "TotalPM25" {
+		t.Fatalf("invalid folders: %+v", doc.Folders)
+	}
+	if doc.Folders[0].Visibility != 1 || doc.Folders[1].Visibility != 0 {
+		t.Errorf("only the first folder should be visible")
+	}
+	pm := doc.Folders[1].Placemarks
+	if len(pm) != 10 {
+		t.Fatalf("have %d placemarks, want 10", len(pm))
+	}
+	if pm[0].Color != kmlColor(kmlColors[0]) || pm[9].Color != kmlColor(kmlColors[len(kmlColors)-1]) {
+		t.Errorf("invalid colors %s and %s", pm[0].Color, pm[9].Color)
+	}
+	for i, p := range []int{0, 9} {
+		points := strings.Fields(pm[p].Coordinates)
+		if len(points) != 5 {
+			t.Fatalf("placemark %d: ring should be closed: %s", p, pm[p].Coordinates)
+		}
+		c := strings.Split(points[0], ",")
+		lon, _ := strconv.ParseFloat(c[0], 64)
+		lat, _ := strconv.ParseFloat(c[1], 64)
+		height, _ := strconv.ParseFloat(c[2], 64)
+		if math.Abs(lon+97) > 0.2 || math.Abs(lat-40) > 0.2 {
+			t.Errorf("placemark %d: coordinates should be longitude-latitude: %s", p, points[0])
+		}
+		if want := []float64{1, kmlMaxHeight}[i]; height != want {
+			t.Errorf("placemark %d: have height %g, want %g", p, height, want)
+		}
+	}
+}
+
+func TestKMLColorScale(t *testing.T) {
+	if c := kmlColorScale(0.5); c != kmlColors[2] {
+		t.Errorf("have %v, want %v", c, kmlColors[2])
+	}
+	if c := kmlColor(color.NRGBA{R: 1, G: 2, B: 3, A: 255}); c != "ff030201" {
+		t.Errorf("have %s, want ff030201", c)
+	}
+}
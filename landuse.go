@@ -0,0 +1,456 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ctessum/atmos/seinfeld"
+	"github.com/ctessum/atmos/wesely1989"
+	"github.com/ctessum/sparse"
+)
+
+// LandUseClass holds the deposition parameters for a single category of
+// a land use classification.
+type LandUseClass struct {
+	// Name is the name of the land use category.
+	Name string
+
+	// Seinfeld is the category used for particle dry deposition.
+	Seinfeld seinfeld.LandUseCategory
+
+	// Wesely is the category used for gas dry deposition.
+	Wesely wesely1989.LandUseCategory
+
+	// Z0 is the roughness length [m].
+	Z0 float64
+}
+
+// LandUseTable converts the categories of a land use classification,
+// indexed by their category codes, to deposition parameters.
+type LandUseTable map[int]LandUseClass
+
+// class returns the land use class for category code lu, which is
+// rounded to the nearest integer.
+func (t LandUseTable) class(lu float64) (LandUseClass, error) {
+	c, ok := t[f2i(lu)]
+	if !ok {
+		return LandUseClass{}, fmt.Errorf("inmap: land use category %d is not in the land use table", f2i(lu))
+	}
+	return c, nil
+}
+
+// landUseFraction is the fraction of a grid cell covered by a
+// land use category.
+type landUseFraction struct {
+	category int
+	fraction float64
+}
+
+// landUseFractions returns the land use categories in grid cell (j, i)
+// of lu and the fractions of the cell that they cover, which sum to one.
+// lu can either have dimensions [y, x], in which case it holds the
+// dominant category of each grid cell, or dimensions [category, y, x],
+// in which case it holds the fraction of each grid cell covered by each
+// category.
+func landUseFractions(lu *sparse.DenseArray, j, i int) []landUseFraction {
+	if len(lu.Shape) == 2 {
+		return []landUseFraction{{category: f2i(lu.Get(j, i)), fraction: 1}}
+	}
+	var o []landUseFraction
+	var sum float64
+	for c := 0; c < lu.Shape[0]; c++ {
+		if f := lu.Get(c, j, i); f > 0 {
+			o = append(o, landUseFraction{category: c, fraction: f})
+			sum += f
+		}
+	}
+	for k := range o {
+		o[k].fraction /= sum
+	}
+	return o
+}
+
+// landUseCategoryFractions converts luf, the fraction of each grid cell
+// covered by each category in t with dimensions [category, y, x] where
+// category index c holds the category with code c+1, to the fraction of
+// each grid cell covered by each of the n categories returned by
+// category.
+func landUseCategoryFractions(luf *sparse.DenseArray, t LandUseTable, n int, category func(LandUseClass) int) (*sparse.DenseArray, error) {
+	if len(luf.Shape) != 3 {
+		return nil, fmt.Errorf("inmap: land use fraction has %d dimensions; it should have 3", len(luf.Shape))
+	}
+	o := sparse.ZerosDense(n, luf.Shape[1], luf.Shape[2])
+	for j := 0; j < luf.Shape[1]; j++ {
+		for i := 0; i < luf.Shape[2]; i++ {
+			var sum float64
+			for c := 0; c < luf.Shape[0]; c++ {
+				f := luf.Get(c, j, i)
+				if f <= 0 {
+					continue
+				}
+				lu, err := t.class(float64(c + 1))
+				if err != nil {
+					return nil, err
+				}
+				o.AddVal(f, category(lu), j, i)
+				sum += f
+			}
+			if sum <= 0 {
+				return nil, fmt.Errorf("inmap: grid cell (%d, %d) has no land use", j, i)
+			}
+		}
+	}
+	return o, nil
+}
+
+// landUseZ0 returns the roughness length [m] of each grid cell,
+// averaged by area over the land use categories in t, where luf is the
+// fraction of each grid cell covered by each category as described for
+// landUseCategoryFractions.
+func landUseZ0(luf *sparse.DenseArray, t LandUseTable) (*sparse.DenseArray, error) {
+	if len(luf.Shape) != 3 {
+		return nil, fmt.Errorf("inmap: land use fraction has %d dimensions; it should have 3", len(luf.Shape))
+	}
+	o := sparse.ZerosDense(luf.Shape[1], luf.Shape[2])
+	for j := 0; j < luf.Shape[1]; j++ {
+		for i := 0; i < luf.Shape[2]; i++ {
+			var z0, sum float64
+			for c := 0; c < luf.Shape[0]; c++ {
+				f := luf.Get(c, j, i)
+				if f <= 0 {
+					continue
+				}
+				lu, err := t.class(float64(c + 1))
+				if err != nil {
+					return nil, err
+				}
+				z0 += f * lu.Z0
+				sum += f
+			}
+			if sum <= 0 {
+				return nil, fmt.Errorf("inmap: grid cell (%d, %d) has no land use", j, i)
+			}
+			o.Set(z0/sum, j, i)
+		}
+	}
+	return o, nil
+}
+
+var (
+	landUseTablesMx sync.RWMutex
+	landUseTables   = map[string]LandUseTable{
+		"NLCD":          nlcdLandUse(),
+		"USGS":          usgsLandUse(),
+		"MODIS":         modisLandUse,
+		"CORINE":        corineLandUse,
+		"ESAWorldCover": esaWorldCoverLandUse,
+	}
+)
+
+// RegisterLandUseTable makes land use table t available under the given
+// name, replacing any table already registered with that name.
+// The "NLCD", "USGS", "MODIS", "CORINE", and "ESAWorldCover" tables are
+// registered by default.
+func RegisterLandUseTable(name string, t LandUseTable) {
+	landUseTablesMx.Lock()
+	defer landUseTablesMx.Unlock()
+	landUseTables[name] = t
+}
+
+// LoadLandUseTable returns the land use table registered with the given
+// name. If no table is registered with that name, name is assumed to be
+// the path to a file in the format read by ReadLandUseTable.
+func LoadLandUseTable(name string) (LandUseTable, error) {
+	landUseTablesMx.RLock()
+	t, ok := landUseTables[name]
+	landUseTablesMx.RUnlock()
+	if ok {
+		return t, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("inmap: land use table `%s` is not registered and is not a file; registered tables are %s",
+				name, strings.Join(landUseTableNames(), ", "))
+		}
+		return nil, fmt.Errorf("inmap: opening land use table: %v", err)
+	}
+	defer f.Close()
+	return ReadLandUseTable(f)
+}
+
+// landUseTableNames returns the names of the registered land use tables.
+func landUseTableNames() []string {
+	landUseTablesMx.RLock()
+	defer landUseTablesMx.RUnlock()
+	var names []string
+	for name := range landUseTables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ReadLandUseTable reads a land use table in CSV format. The first row
+// must be a header with the columns "code", "name", "seinfeld", "wesely",
+// and "z0", in any order. Each subsequent row specifies the integer
+// category code, the category name, the
+// github.com/ctessum/atmos/seinfeld and
+// github.com/ctessum/atmos/wesely1989 categories it corresponds to
+// (e.g., "Evergreen" and "Coniferous"), and the roughness length [m].
+// Lines beginning with "#" are ignored.
+func ReadLandUseTable(r io.Reader) (LandUseTable, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading land use table header: %v", err)
+	}
+	cols := make(map[string]int)
+	for i, h := range header {
+		cols[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	for _, c := range []string{"code", "name", "seinfeld", "wesely", "z0"} {
+		if _, ok := cols[c]; !ok {
+			return nil, fmt.Errorf("inmap: land use table is missing column `%s`", c)
+		}
+	}
+	t := make(LandUseTable)
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("inmap: reading land use table: %v", err)
+		}
+		line, _ := cr.FieldPos(0)
+		code, err := strconv.Atoi(strings.TrimSpace(rec[cols["code"]]))
+		if err != nil {
+			return nil, fmt.Errorf("inmap: land use table line %d: code: %v", line, err)
+		}
+		if _, ok := t[code]; ok {
+			return nil, fmt.Errorf("inmap: land use table line %d: duplicate code %d", line, code)
+		}
+		s, ok := seinfeldCategories[strings.ToLower(strings.TrimSpace(rec[cols["seinfeld"]]))]
+		if !ok {
+			return nil, fmt.Errorf("inmap: land use table line %d: invalid Seinfeld category `%s`", line, rec[cols["seinfeld"]])
+		}
+		w, ok := weselyCategories[strings.ToLower(strings.TrimSpace(rec[cols["wesely"]]))]
+		if !ok {
+			return nil, fmt.Errorf("inmap: land use table line %d: invalid Wesely category `%s`", line, rec[cols["wesely"]])
+		}
+		z0, err := strconv.ParseFloat(strings.TrimSpace(rec[cols["z0"]]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: land use table line %d: z0: %v", line, err)
+		}
+		t[code] = LandUseClass{
+			Name:     strings.TrimSpace(rec[cols["name"]]),
+			Seinfeld: s,
+			Wesely:   w,
+			Z0:       z0,
+		}
+	}
+	if len(t) == 0 {
+		return nil, fmt.Errorf("inmap: land use table has no categories")
+	}
+	return t, nil
+}
+
+// seinfeldCategories holds the names of the particle dry deposition
+// land use categories.
+var seinfeldCategories = map[string]seinfeld.LandUseCategory{
+	"evergreen": seinfeld.Evergreen,
+	"deciduous": seinfeld.Deciduous,
+	"grass":     seinfeld.Grass,
+	"desert":    seinfeld.Desert,
+	"shrubs":    seinfeld.Shrubs,
+}
+
+// weselyCategories holds the names of the gas dry deposition
+// land use categories.
+var weselyCategories = map[string]wesely1989.LandUseCategory{
+	"urban":        wesely1989.Urban,
+	"agricultural": wesely1989.Agricultural,
+	"range":        wesely1989.Range,
+	"deciduous":    wesely1989.Deciduous,
+	"coniferous":   wesely1989.Coniferous,
+	"mixedforest":  wesely1989.MixedForest,
+	"water":        wesely1989.Water,
+	"barren":       wesely1989.Barren,
+	"wetland":      wesely1989.Wetland,
+	"rangeag":      wesely1989.RangeAg,
+	"rockyshrubs":  wesely1989.RockyShrubs,
+}
+
+// nlcdNames holds the names of the land use categories used in
+// NLCDseinfeld, NLCDwesely, and NLCDz0.
+var nlcdNames = []string{
+	"Evergreen Needleleaf Forest", "Evergreen Broadleaf Forest", "Deciduous Needleleaf Forest",
+	"Deciduous Broadleaf Forest", "Mixed Forest", "Closed Shrubland", "Open Shrubland",
+	"Woody Savanna", "Savanna", "Grassland", "Permanent Wetland", "Cropland",
+	"Urban and Built-Up", "Cropland / Natural Veg. Mosaic", "Permanent Snow",
+	"Barren / Sparsely Vegetated", "IGBP Water", "Unclassified", "Fill Value", "Unclassified",
+	"Open Water", "Perennial Ice/Snow", "Developed Open Space", "Developed Low Intensity",
+	"Developed Medium Intensity", "Developed High Intensity", "Barren Land", "Deciduous Forest",
+	"Evergreen Forest", "Mixed Forest", "Dwarf Scrub", "Shrub/Scrub", "Grassland/Herbaceous",
+	"Sedge/Herbaceous", "Lichens", "Moss", "Pasture/Hay", "Cultivated Crops", "Woody Wetland",
+	"Emergent Herbaceous Wetland",
+}
+
+// nlcdLandUse returns the 40-category MODIS and NLCD land use table
+// used by WRF-Cmaq.
+func nlcdLandUse() LandUseTable {
+	t := make(LandUseTable)
+	for i, name := range nlcdNames {
+		t[i+1] = LandUseClass{
+			Name:     name,
+			Seinfeld: NLCDseinfeld[i],
+			Wesely:   NLCDwesely[i],
+			Z0:       NLCDz0[i],
+		}
+	}
+	return t
+}
+
+// usgsNames holds the names of the land use categories used in
+// USGSseinfeld, USGSwesely, and USGSz0.
+var usgsNames = []string{
+	"Urban and Built-Up Land", "Dryland Cropland and Pasture", "Irrigated Cropland and Pasture",
+	"Mixed Dryland/Irrigated Cropland and Pasture", "Cropland/Grassland Mosaic",
+	"Cropland/Woodland Mosaic", "Grassland", "Shrubland", "Mixed Shrubland/Grassland",
+	"Savanna", "Deciduous Broadleaf Forest", "Deciduous Needleleaf Forest",
+	"Evergreen Broadleaf Forest", "Evergreen Needleleaf Forest", "Mixed Forest",
+	"Water Bodies", "Herbaceous Wetland", "Wooded Wetland", "Barren or Sparsely Vegetated",
+	"Herbaceous Tundra", "Wooded Tundra", "Mixed Tundra", "Bare Ground Tundra",
+	"Snow or Ice", "Playa", "Lava", "White Sand",
+}
+
+// usgsLandUse returns the 24-category USGS land use table used by
+// WRF-Chem, plus the three categories added in WRF version 3.
+func usgsLandUse() LandUseTable {
+	t := make(LandUseTable)
+	for i, name := range usgsNames {
+		t[i+1] = LandUseClass{
+			Name:     name,
+			Seinfeld: USGSseinfeld[i],
+			Wesely:   USGSwesely[i],
+			Z0:       USGSz0[i],
+		}
+	}
+	return t
+}
+
+// modisLandUse is the 20-category MODIS IGBP land use table used by
+// WRF and MPAS. Roughness lengths are from the MODIFIED_IGBP_MODIS_NOAH
+// section of WRF file VEGPARM.TBL.
+var modisLandUse = LandUseTable{
+	1:  {"Evergreen Needleleaf Forest", seinfeld.Evergreen, wesely1989.Coniferous, .50},
+	2:  {"Evergreen Broadleaf Forest", seinfeld.Deciduous, wesely1989.Deciduous, .50},
+	3:  {"Deciduous Needleleaf Forest", seinfeld.Evergreen, wesely1989.Coniferous, .50},
+	4:  {"Deciduous Broadleaf Forest", seinfeld.Deciduous, wesely1989.Deciduous, .50},
+	5:  {"Mixed Forest", seinfeld.Deciduous, wesely1989.MixedForest, .35},
+	6:  {"Closed Shrubland", seinfeld.Shrubs, wesely1989.RockyShrubs, .03},
+	7:  {"Open Shrubland", seinfeld.Shrubs, wesely1989.RockyShrubs, .035},
+	8:  {"Woody Savanna", seinfeld.Shrubs, wesely1989.RockyShrubs, .03},
+	9:  {"Savanna", seinfeld.Grass, wesely1989.Range, .15},
+	10: {"Grassland", seinfeld.Grass, wesely1989.Range, .11},
+	11: {"Permanent Wetland", seinfeld.Grass, wesely1989.Wetland, .30},
+	12: {"Cropland", seinfeld.Grass, wesely1989.RangeAg, .10},
+	13: {"Urban and Built-Up", seinfeld.Desert, wesely1989.Urban, .50},
+	14: {"Cropland / Natural Veg. Mosaic", seinfeld.Grass, wesely1989.RangeAg, .095},
+	15: {"Snow and Ice", seinfeld.Desert, wesely1989.Barren, .001},
+	16: {"Barren / Sparsely Vegetated", seinfeld.Desert, wesely1989.Barren, .01},
+	17: {"Water", seinfeld.Desert, wesely1989.Water, .0001},
+	18: {"Wooded Tundra", seinfeld.Shrubs, wesely1989.RockyShrubs, .30},
+	19: {"Mixed Tundra", seinfeld.Grass, wesely1989.Range, .15},
+	20: {"Barren Tundra", seinfeld.Desert, wesely1989.Barren, .05},
+}
+
+// corineLandUse is the 44-category CORINE Land Cover table, indexed
+// by the raster grid codes of the level 3 classes.
+var corineLandUse = LandUseTable{
+	1:  {"Continuous urban fabric", seinfeld.Desert, wesely1989.Urban, 1.5},
+	2:  {"Discontinuous urban fabric", seinfeld.Desert, wesely1989.Urban, .70},
+	3:  {"Industrial or commercial units", seinfeld.Desert, wesely1989.Urban, .70},
+	4:  {"Road and rail networks and associated land", seinfeld.Desert, wesely1989.Urban, .10},
+	5:  {"Port areas", seinfeld.Desert, wesely1989.Urban, .50},
+	6:  {"Airports", seinfeld.Desert, wesely1989.Urban, .10},
+	7:  {"Mineral extraction sites", seinfeld.Desert, wesely1989.Barren, .05},
+	8:  {"Dump sites", seinfeld.Desert, wesely1989.Barren, .05},
+	9:  {"Construction sites", seinfeld.Desert, wesely1989.Barren, .05},
+	10: {"Green urban areas", seinfeld.Grass, wesely1989.Urban, .50},
+	11: {"Sport and leisure facilities", seinfeld.Grass, wesely1989.Urban, .10},
+	12: {"Non-irrigated arable land", seinfeld.Grass, wesely1989.Agricultural, .10},
+	13: {"Permanently irrigated land", seinfeld.Grass, wesely1989.Agricultural, .10},
+	14: {"Rice fields", seinfeld.Grass, wesely1989.Agricultural, .06},
+	15: {"Vineyards", seinfeld.Shrubs, wesely1989.RangeAg, .20},
+	16: {"Fruit trees and berry plantations", seinfeld.Deciduous, wesely1989.RangeAg, .30},
+	17: {"Olive groves", seinfeld.Shrubs, wesely1989.RangeAg, .30},
+	18: {"Pastures", seinfeld.Grass, wesely1989.RangeAg, .10},
+	19: {"Annual crops associated with permanent crops", seinfeld.Grass, wesely1989.RangeAg, .10},
+	20: {"Complex cultivation patterns", seinfeld.Grass, wesely1989.RangeAg, .10},
+	21: {"Land principally occupied by agriculture with significant areas of natural vegetation", seinfeld.Grass, wesely1989.RangeAg, .095},
+	22: {"Agro-forestry areas", seinfeld.Deciduous, wesely1989.RangeAg, .30},
+	23: {"Broad-leaved forest", seinfeld.Deciduous, wesely1989.Deciduous, .50},
+	24: {"Coniferous forest", seinfeld.Evergreen, wesely1989.Coniferous, .50},
+	25: {"Mixed forest", seinfeld.Deciduous, wesely1989.MixedForest, .35},
+	26: {"Natural grasslands", seinfeld.Grass, wesely1989.Range, .11},
+	27: {"Moors and heathland", seinfeld.Shrubs, wesely1989.RockyShrubs, .03},
+	28: {"Sclerophyllous vegetation", seinfeld.Shrubs, wesely1989.RockyShrubs, .03},
+	29: {"Transitional woodland-shrub", seinfeld.Shrubs, wesely1989.RockyShrubs, .15},
+	30: {"Beaches, dunes, sands", seinfeld.Desert, wesely1989.Barren, .01},
+	31: {"Bare rocks", seinfeld.Desert, wesely1989.Barren, .01},
+	32: {"Sparsely vegetated areas", seinfeld.Desert, wesely1989.Barren, .01},
+	33: {"Burnt areas", seinfeld.Desert, wesely1989.Barren, .01},
+	34: {"Glaciers and perpetual snow", seinfeld.Desert, wesely1989.Barren, .001},
+	35: {"Inland marshes", seinfeld.Grass, wesely1989.Wetland, .20},
+	36: {"Peat bogs", seinfeld.Grass, wesely1989.Wetland, .20},
+	37: {"Salt marshes", seinfeld.Grass, wesely1989.Wetland, .20},
+	38: {"Salines", seinfeld.Desert, wesely1989.Barren, .01},
+	39: {"Intertidal flats", seinfeld.Desert, wesely1989.Wetland, .01},
+	40: {"Water courses", seinfeld.Desert, wesely1989.Water, .0001},
+	41: {"Water bodies", seinfeld.Desert, wesely1989.Water, .0001},
+	42: {"Coastal lagoons", seinfeld.Desert, wesely1989.Water, .0001},
+	43: {"Estuaries", seinfeld.Desert, wesely1989.Water, .0001},
+	44: {"Sea and ocean", seinfeld.Desert, wesely1989.Water, .0001},
+}
+
+// esaWorldCoverLandUse is the ESA WorldCover land use table.
+var esaWorldCoverLandUse = LandUseTable{
+	10:  {"Tree cover", seinfeld.Deciduous, wesely1989.MixedForest, .50},
+	20:  {"Shrubland", seinfeld.Shrubs, wesely1989.RockyShrubs, .03},
+	30:  {"Grassland", seinfeld.Grass, wesely1989.Range, .11},
+	40:  {"Cropland", seinfeld.Grass, wesely1989.RangeAg, .10},
+	50:  {"Built-up", seinfeld.Desert, wesely1989.Urban, .50},
+	60:  {"Bare / sparse vegetation", seinfeld.Desert, wesely1989.Barren, .01},
+	70:  {"Snow and ice", seinfeld.Desert, wesely1989.Barren, .001},
+	80:  {"Permanent water bodies", seinfeld.Desert, wesely1989.Water, .0001},
+	90:  {"Herbaceous wetland", seinfeld.Grass, wesely1989.Wetland, .20},
+	95:  {"Mangroves", seinfeld.Deciduous, wesely1989.Wetland, .40},
+	100: {"Moss and lichen", seinfeld.Desert, wesely1989.Barren, .01},
+}
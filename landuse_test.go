@@ -0,0 +1,323 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ctessum/atmos/seinfeld"
+	"github.com/ctessum/atmos/wesely1989"
+	"github.com/ctessum/sparse"
+)
+
+func TestLandUseTableNLCD(t *testing.T) {
+	lu := sparse.ZerosDense(1, len(NLCDz0))
+	for i := range lu.Elements {
+		lu.Elements[i] = float64(i + 1)
+	}
+	next := func() NextData {
+		return func() (*sparse.DenseArray, error) { return lu, nil }
+	}
+	table, err := LoadLandUseTable("NLCD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := cmaqSeinfeldLandUse(next(), table)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := cmaqWeselyLandUse(next(), table)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	z0, err := cmaqZ0(next(), table)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range NLCDz0 {
+		if s.Elements[i] != float64(NLCDseinfeld[i]) {
+			t.Errorf("seinfeld %d: have %g, want %d", i+1, s.Elements[i], NLCDseinfeld[i])
+		}
+		if w.Elements[i] != float64(NLCDwesely[i]) {
+			t.Errorf("wesely %d: have %g, want %d", i+1, w.Elements[i], NLCDwesely[i])
+		}
+		if z0.Elements[i] != NLCDz0[i] {
+			t.Errorf("z0 %d: have %g, want %g", i+1, z0.Elements[i], NLCDz0[i])
+		}
+	}
+
+	lu.Elements[0] = 41
+	if _, err = cmaqZ0(next(), table)(); err == nil {
+		t.Error("expected an error for a category that is not in the table")
+	}
+}
+
+func TestLandUseTableRegistered(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		code     int
+		seinfeld seinfeld.LandUseCategory
+		wesely   wesely1989.LandUseCategory
+	}{
+		{name: "USGS", code: 16, seinfeld: seinfeld.Desert, wesely: wesely1989.Water},
+		{name: "MODIS", code: 18, seinfeld: seinfeld.Shrubs, wesely: wesely1989.RockyShrubs},
+		{name: "CORINE", code: 24, seinfeld: seinfeld.Evergreen, wesely: wesely1989.Coniferous},
+		{name: "ESAWorldCover", code: 80, seinfeld: seinfeld.Desert, wesely: wesely1989.Water},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			table, err := LoadLandUseTable(test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := table.class(float64(test.code))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Seinfeld != test.seinfeld || c.Wesely != test.wesely {
+				t.Errorf("have %d and %d, want %d and %d", c.Seinfeld, c.Wesely, test.seinfeld, test.wesely)
+			}
+		})
+	}
+
+	RegisterLandUseTable("test", LandUseTable{1: {Name: "x", Z0: 0.2}})
+	if table, err := LoadLandUseTable("test"); err != nil || table[1].Z0 != 0.2 {
+		t.Errorf("registered table: have %v (%v)", table, err)
+	}
+	if _, err := LoadLandUseTable("xxx"); err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Errorf("expected a registration error but have %v", err)
+	}
+}
+
+func TestReadLandUseTable(t *testing.T) {
+	const table = `# A custom table.
+code,name,z0,seinfeld,wesely
+1, Forest, 0.5, Evergreen, Coniferous
+2, "Crops, irrigated", 0.1, grass, RangeAg
+`
+	dir, err := os.MkdirTemp("", "landuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "landuse.csv")
+	if err = os.WriteFile(path, []byte(table), 0644); err != nil {
+		t.Fatal(err)
+	}
+	have, err := LoadLandUseTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := LandUseTable{
+		1: {Name: "Forest", Seinfeld: seinfeld.Evergreen, Wesely: wesely1989.Coniferous, Z0: 0.5},
+		2: {Name: "Crops, irrigated", Seinfeld: seinfeld.Grass, Wesely: wesely1989.RangeAg, Z0: 0.1},
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	for _, bad := range []string{
+		"code,name,seinfeld,wesely\n1,a,Grass,Range\n",
+		"code,name,seinfeld,wesely,z0\n1,a,Trees,Range,0.1\n",
+		"code,name,seinfeld,wesely,z0\n1,a,Grass,Forest,0.1\n",
+		"code,name,seinfeld,wesely,z0\nx,a,Grass,Range,0.1\n",
+		"code,name,seinfeld,wesely,z0\n1,a,Grass,Range,0.1\n1,b,Grass,Range,0.1\n",
+		"code,name,seinfeld,wesely,z0\n",
+	} {
+		if _, err := ReadLandUseTable(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected an error for table %q", bad)
+		}
+	}
+}
+
+// luFractions returns a land use fraction array with dimensions
+// [40, 1, len(cells)], where each cell is covered by the given
+// fractions of the given categories codes.
+func luFractions(cells ...map[int]float64) *sparse.DenseArray {
+	o := sparse.ZerosDense(40, 1, len(cells))
+	for i, cell := range cells {
+		for code, f := range cell {
+			o.Set(f, code-1, 0, i)
+		}
+	}
+	return o
+}
+
+func TestLandUseFraction(t *testing.T) {
+	table, err := LoadLandUseTable("NLCD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func(d *sparse.DenseArray) NextData {
+		return func() (*sparse.DenseArray, error) { return d, nil }
+	}
+	// Cell 0 is all evergreen needleleaf forest, and cell 1 is
+	// half grassland and half open water.
+	luf := luFractions(map[int]float64{1: 1}, map[int]float64{10: 0.5, 21: 0.5})
+
+	s, err := cmaqSeinfeldLandUseFraction(next(luf), table)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sWant := sparse.ZerosDense(5, 1, 2)
+	sWant.Set(1, int(seinfeld.Evergreen), 0, 0)
+	sWant.Set(0.5, int(seinfeld.Grass), 0, 1)
+	sWant.Set(0.5, int(seinfeld.Desert), 0, 1)
+	if !reflect.DeepEqual(s, sWant) {
+		t.Errorf("seinfeld: have %v, want %v", s.Elements, sWant.Elements)
+	}
+
+	w, err := cmaqWeselyLandUseFraction(next(luf), table)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wWant := sparse.ZerosDense(11, 1, 2)
+	wWant.Set(1, int(wesely1989.Coniferous), 0, 0)
+	wWant.Set(0.5, int(wesely1989.Range), 0, 1)
+	wWant.Set(0.5, int(wesely1989.Water), 0, 1)
+	if !reflect.DeepEqual(w, wWant) {
+		t.Errorf("wesely: have %v, want %v", w.Elements, wWant.Elements)
+	}
+
+	z0, err := cmaqZ0Fraction(next(luf), table)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []float64{.50, (.11 + .0001) / 2} {
+		if math.Abs(z0.Elements[i]-want) > 1e-12 {
+			t.Errorf("z0 %d: have %g, want %g", i, z0.Elements[i], want)
+		}
+	}
+
+	if _, err = cmaqZ0Fraction(next(luFractions(map[int]float64{})), table)(); err == nil {
+		t.Error("expected an error for a cell without land use")
+	}
+	if _, err = cmaqSeinfeldLandUseFraction(next(luf), LandUseTable{1: {}})(); err == nil {
+		t.Error("expected an error for a category that is not in the table")
+	}
+}
+
+func TestStabilityMixingChemistryLandUseFraction(t *testing.T) {
+	table, err := LoadLandUseTable("NLCD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerHeights := geopotentialToHeight(PH[0], PHB[0])
+	// dryDep returns the particle, SO2, NOx, NH3, and VOC dry deposition
+	// velocities calculated from the given land use and roughness length.
+	dryDep := func(seinfeldLU, weselyLU, z0 []*sparse.DenseArray) []*sparse.DenseArray {
+		pFunc := cmaqPressureConvert(testNextData(P), testNextData(PB))
+		tempFunc := cmaqTemperatureConvert(testNextData(T), cmaqPressureConvert(testNextData(P), testNextData(PB)))
+		_, _, _, _, _, _, particleDryDep, _, SO2DryDep, NOxDryDep, NH3DryDep, VOCDryDep, _, err := stabilityMixingChemistry(layerHeights,
+			testNextData(PBLH), testNextData(UST), testNextData(ALT), tempFunc, pFunc, testNextData(HFX),
+			testNextData(ho), testNextData(h2o2), testNextData(z0), testNextData(seinfeldLU), testNextData(weselyLU),
+			testNextData(QCLOUD), cmaqRadiationDown(testNextData(SWDOWN), testNextData(GLW)), testNextData(QRAIN), nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []*sparse.DenseArray{particleDryDep, SO2DryDep, NOxDryDep, NH3DryDep, VOCDryDep}
+	}
+	// convert applies f to each of the time steps in data.
+	convert := func(f func(NextData, LandUseTable) NextData, data []*sparse.DenseArray) []*sparse.DenseArray {
+		next := f(testNextData(data), table)
+		var o []*sparse.DenseArray
+		for range data {
+			d, err := next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			o = append(o, d)
+		}
+		return o
+	}
+	// fractions returns land use fractions where each cell is covered
+	// by the given fractions of the given category codes, with the
+	// same shape as LUIndex.
+	fractions := func(cell map[int]float64) []*sparse.DenseArray {
+		o := make([]*sparse.DenseArray, len(LUIndex))
+		for i := range o {
+			o[i] = sparse.ZerosDense(40, 2, 2)
+			for code, f := range cell {
+				for j := 0; j < 2; j++ {
+					for ii := 0; ii < 2; ii++ {
+						o[i].Set(f, code-1, j, ii)
+					}
+				}
+			}
+		}
+		return o
+	}
+
+	// Fractional land use where each cell only has its dominant category
+	// should give the same result as the dominant category.
+	z0 := convert(cmaqZ0, LUIndex)
+	dominant := dryDep(convert(cmaqSeinfeldLandUse, LUIndex), convert(cmaqWeselyLandUse, LUIndex), z0)
+	oneHot := make([]*sparse.DenseArray, len(LUIndex))
+	for i, lu := range LUIndex {
+		oneHot[i] = sparse.ZerosDense(40, 2, 2)
+		for j := 0; j < 2; j++ {
+			for ii := 0; ii < 2; ii++ {
+				oneHot[i].Set(1, f2i(lu.Get(j, ii))-1, j, ii)
+			}
+		}
+	}
+	fractional := dryDep(convert(cmaqSeinfeldLandUseFraction, oneHot), convert(cmaqWeselyLandUseFraction, oneHot), z0)
+	for i := range dominant {
+		arrayCompare(fractional[i], dominant[i], 1e-12, fmt.Sprintf("one category %d", i), t)
+	}
+
+	// With the same roughness length, the deposition velocity of a cell
+	// that is half grassland and half deciduous forest should be the average of
+	// the deposition velocities of the two categories.
+	grass := fractions(map[int]float64{10: 1})
+	forest := fractions(map[int]float64{4: 1})
+	mixed := fractions(map[int]float64{10: 0.5, 4: 0.5})
+	grassDep := dryDep(convert(cmaqSeinfeldLandUseFraction, grass), convert(cmaqWeselyLandUseFraction, grass), z0)
+	forestDep := dryDep(convert(cmaqSeinfeldLandUseFraction, forest), convert(cmaqWeselyLandUseFraction, forest), z0)
+	mixedDep := dryDep(convert(cmaqSeinfeldLandUseFraction, mixed), convert(cmaqWeselyLandUseFraction, mixed), z0)
+	for i := range mixedDep {
+		want := grassDep[i].Copy()
+		want.AddDense(forestDep[i])
+		want.Scale(0.5)
+		arrayCompare(mixedDep[i], want, 1e-10, fmt.Sprintf("mixed %d", i), t)
+	}
+}
+
+func TestUSGSLandUse(t *testing.T) {
+	// USGS land use categories are numbered from 1.
+	table := usgsLandUse()
+	for code, want := range map[int]string{
+		1:  "Urban and Built-Up Land",
+		15: "Mixed Forest",
+		16: "Water Bodies",
+		27: "White Sand",
+	} {
+		if have := table[code].Name; have != want {
+			t.Errorf("category %d: have %q, want %q", code, have, want)
+		}
+	}
+	if _, ok := table[0]; ok {
+		t.Error("there should not be a category 0")
+	}
+}
@@ -0,0 +1,273 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/ctessum/sparse"
+)
+
+// Layers specifies the heights above ground [m] of the edges of the
+// vertical layers of the preprocessed output, starting with zero. If it
+// is not used or layerHeights is empty, the output has the vertical
+// layers of the chemical transport model. See (*CTMData).RegridLayers for how the data are
+// regridded.
+func Layers(layerHeights []float64) PreprocessOption {
+	return func(o *preprocessOptions) {
+		o.layerHeights = layerHeights
+	}
+}
+
+// checkLayerHeights returns an error if layerHeights are not valid
+// layer edge heights.
+func checkLayerHeights(layerHeights []float64) error {
+	if len(layerHeights) < 2 {
+		return fmt.Errorf("inmap: there must be at least 2 layer heights but there are %d", len(layerHeights))
+	}
+	if layerHeights[0] != 0 {
+		return fmt.Errorf("inmap: the first layer height must be 0 but it is %g", layerHeights[0])
+	}
+	for k := 1; k < len(layerHeights); k++ {
+		if !(layerHeights[k] > layerHeights[k-1]) {
+			return fmt.Errorf("inmap: layer heights must increase but layer height %d (%g) is not greater than layer height %d (%g)",
+				k, layerHeights[k], k-1, layerHeights[k-1])
+		}
+	}
+	return nil
+}
+
+// surfaceVariables are the variables that only have values in the
+// lowest layer.
+var surfaceVariables = map[string]bool{
+	"ParticleDryDep":       true,
+	"CoarseParticleDryDep": true,
+	"SO2DryDep":            true,
+	"NOxDryDep":            true,
+	"NH3DryDep":            true,
+	"VOCDryDep":            true,
+}
+
+// RegridLayers returns a copy of d with the data regridded to vertical
+// layers whose edges are at layerHeights, which are heights above ground
+// [m] starting with zero.
+//
+// Variables on the layer centers are averaged over the overlap between the
+// existing and new layers, weighted by the thickness of the overlap.
+// Variables on the layer edges are linearly interpolated to the new edges.
+// The dry deposition velocities, which only apply to the lowest layer, are
+// not changed. The convective mixing rates, M2u and M2d, are recalculated
+// from the mass flux at the layer edges so that they still conserve mass.
+// Where the new layers extend above the top of the existing layers, the
+// values in the top existing layer are used.
+func (d *CTMData) RegridLayers(layerHeights []float64) (*CTMData, error) {
+	if err := checkLayerHeights(layerHeights); err != nil {
+		return nil, err
+	}
+	lh, ok := d.Data["LayerHeights"]
+	if !ok {
+		return nil, fmt.Errorf("inmap: regridding layers: missing variable LayerHeights")
+	}
+	m := len(layerHeights) - 1 // number of new layers
+
+	o := &CTMData{xo: d.xo, yo: d.yo, dx: d.dx, dy: d.dy, nx: d.nx, ny: d.ny}
+	for name, v := range d.Data {
+		if len(v.Dims) != 3 || (v.Dims[0] != "z" && v.Dims[0] != "zStagger") {
+			o.AddVariable(name, v.Dims, v.Description, v.Units, v.Data.Copy())
+			continue
+		}
+		shape := append([]int{}, v.Data.Shape...)
+		if v.Dims[0] == "z" {
+			shape[0] = m
+		} else {
+			shape[0] = m + 1
+		}
+		o.AddVariable(name, v.Dims, v.Description, v.Units, sparse.ZerosDense(shape...))
+	}
+
+	out := func(name string) *sparse.DenseArray { return o.Data[name].Data }
+	dz := make([]float64, m)
+	for k := range dz {
+		dz[k] = layerHeights[k+1] - layerHeights[k]
+	}
+	for name, v := range d.Data {
+		if len(v.Dims) != 3 || (v.Dims[0] != "z" && v.Dims[0] != "zStagger") ||
+			name == "LayerHeights" || name == "Dz" || name == "M2u" {
+			continue
+		}
+		ny, nx := v.Data.Shape[1], v.Data.Shape[2]
+		for j := 0; j < ny; j++ {
+			for i := 0; i < nx; i++ {
+				edges := columnEdges(lh.Data, v.Dims, j, i)
+				switch {
+				case name == "M2d":
+					m2u, m2d := regridConvection(edges, layerHeights, columnValues(v.Data, j, i))
+					for k := 0; k < m; k++ {
+						out("M2u").Set(m2u[k], k, j, i)
+						out("M2d").Set(m2d[k], k, j, i)
+					}
+				case surfaceVariables[name]:
+					out(name).Set(v.Data.Get(0, j, i), 0, j, i)
+				case v.Dims[0] == "z":
+					vals := regridCenters(edges, layerHeights, columnValues(v.Data, j, i))
+					for k, val := range vals {
+						out(name).Set(val, k, j, i)
+					}
+				default:
+					vals := regridEdges(edges, layerHeights, columnValues(v.Data, j, i))
+					for k, val := range vals {
+						out(name).Set(val, k, j, i)
+					}
+				}
+			}
+		}
+	}
+	for j := 0; j < d.ny; j++ {
+		for i := 0; i < d.nx; i++ {
+			for k, h := range layerHeights {
+				out("LayerHeights").Set(h, k, j, i)
+			}
+			if _, ok := o.Data["Dz"]; ok {
+				for k, h := range dz {
+					out("Dz").Set(h, k, j, i)
+				}
+			}
+		}
+	}
+	if d.gridTree != nil {
+		o.makeCTMgrid(m)
+	}
+	return o, nil
+}
+
+// columnValues returns the values of the vertical column (j, i) of a.
+func columnValues(a *sparse.DenseArray, j, i int) []float64 {
+	o := make([]float64, a.Shape[0])
+	for k := range o {
+		o[k] = a.Get(k, j, i)
+	}
+	return o
+}
+
+// columnEdges returns the heights of the layer edges of the vertical
+// column (j, i) of a variable with the given dimensions, where
+// layerHeights are the layer edge heights at the grid cell centers.
+// The edge heights of columns on staggered horizontal grids are the
+// averages of the heights of the adjacent cell centers.
+func columnEdges(layerHeights *sparse.DenseArray, dims []string, j, i int) []float64 {
+	ny, nx := layerHeights.Shape[1], layerHeights.Shape[2]
+	j0, j1, i0, i1 := j, j, i, i
+	if dims[1] == "yStagger" {
+		j0, j1 = clampIndex(j-1, ny), clampIndex(j, ny)
+	}
+	if dims[2] == "xStagger" {
+		i0, i1 = clampIndex(i-1, nx), clampIndex(i, nx)
+	}
+	o := make([]float64, layerHeights.Shape[0])
+	for k := range o {
+		o[k] = (layerHeights.Get(k, j0, i0) + layerHeights.Get(k, j0, i1) +
+			layerHeights.Get(k, j1, i0) + layerHeights.Get(k, j1, i1)) / 4
+	}
+	return o
+}
+
+// clampIndex returns i limited to between 0 and n-1.
+func clampIndex(i, n int) int {
+	if i < 0 {
+		return 0
+	}
+	if i >= n {
+		return n - 1
+	}
+	return i
+}
+
+// regridCenters averages the values on the layer centers of the layers
+// with edges at from to the layers with edges at to, weighted by the
+// thickness of the overlap of the layers. The top layer of from is
+// extended upward if necessary.
+func regridCenters(from, to, vals []float64) []float64 {
+	o := make([]float64, len(to)-1)
+	for k := range o {
+		var sum, weight float64
+		for kk, v := range vals {
+			top := from[kk+1]
+			if kk == len(vals)-1 {
+				top = math.Max(top, to[len(to)-1])
+			}
+			if w := math.Min(top, to[k+1]) - math.Max(from[kk], to[k]); w > 0 {
+				sum += v * w
+				weight += w
+			}
+		}
+		o[k] = sum / weight
+	}
+	return o
+}
+
+// regridEdges linearly interpolates the values on the layer edges at
+// heights from to heights to, using the value at the top edge above it.
+func regridEdges(from, to, vals []float64) []float64 {
+	o := make([]float64, len(to))
+	for k, z := range to {
+		o[k] = interpolateEdges(from, vals, z)
+	}
+	return o
+}
+
+// interpolateEdges linearly interpolates vals, which are at heights
+// from, to height z, using the value at the highest height above it.
+func interpolateEdges(from, vals []float64, z float64) float64 {
+	n := len(from) - 1
+	if z >= from[n] {
+		return vals[n]
+	}
+	for kk := 0; kk < n; kk++ {
+		if z < from[kk+1] {
+			f := (z - from[kk]) / (from[kk+1] - from[kk])
+			return vals[kk] + f*(vals[kk+1]-vals[kk])
+		}
+	}
+	return vals[n]
+}
+
+// regridConvection returns the convective mixing rates M2u and M2d [1/s]
+// on the layers with edges at to, given M2d on the layers with edges at
+// from.
+// The downward mass flux into each layer from the layer above, per unit
+// of concentration, is m2d times the thickness of the layer. It is
+// linearly interpolated to the new layer edges and is zero at the top
+// of the existing layers, and the new rates are calculated from it so
+// that the upward and downward mixing are in balance (Pleim, 2007).
+func regridConvection(from, to, m2d []float64) (m2uNew, m2dNew []float64) {
+	flux := make([]float64, len(from))
+	for k := range m2d {
+		flux[k] = m2d[k] * (from[k+1] - from[k])
+	}
+	fluxNew := regridEdges(from, to, flux)
+	m := len(to) - 1
+	m2uNew, m2dNew = make([]float64, m), make([]float64, m)
+	for k := 0; k < m; k++ {
+		dz := to[k+1] - to[k]
+		m2dNew[k] = fluxNew[k] / dz
+		m2uNew[k] = (fluxNew[k] - fluxNew[k+1]) / dz
+	}
+	return m2uNew, m2dNew
+}
@@ -0,0 +1,160 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"testing"
+
+	"github.com/ctessum/sparse"
+)
+
+// layersTestData returns CTM data with 2×2 grid cells and 3 layers with
+// edges at 0, 100, 300, and 600 m, and a boundary layer height of 300 m.
+func layersTestData() *CTMData {
+	d := &CTMData{nx: 2, ny: 2, dx: 1, dy: 1}
+	edges := []float64{0, 100, 300, 600}
+	// fill returns an array with the given shape where the values in
+	// each layer are vals.
+	fill := func(vals []float64, shape ...int) *sparse.DenseArray {
+		a := sparse.ZerosDense(shape...)
+		for k, v := range vals {
+			for j := 0; j < shape[1]; j++ {
+				for i := 0; i < shape[2]; i++ {
+					a.Set(v, k, j, i)
+				}
+			}
+		}
+		return a
+	}
+	const m2u = 1.e-3
+	d.AddVariable("LayerHeights", []string{"zStagger", "y", "x"}, "", "m", fill(edges, 4, 2, 2))
+	d.AddVariable("Dz", []string{"z", "y", "x"}, "", "m", fill([]float64{100, 200, 300}, 3, 2, 2))
+	d.AddVariable("Temperature", []string{"z", "y", "x"}, "", "K", fill([]float64{10, 20, 30}, 3, 2, 2))
+	d.AddVariable("WAvg", []string{"zStagger", "y", "x"}, "", "m/s", fill([]float64{0, 1, 2, 3}, 4, 2, 2))
+	d.AddVariable("UAvg", []string{"z", "y", "xStagger"}, "", "m/s", fill([]float64{1, 2, 3}, 3, 2, 3))
+	d.AddVariable("ParticleDryDep", []string{"z", "y", "x"}, "", "m/s", fill([]float64{0.01}, 3, 2, 2))
+	d.AddVariable("M2u", []string{"z", "y", "x"}, "", "1/s", fill([]float64{m2u, m2u}, 3, 2, 2))
+	d.AddVariable("M2d", []string{"z", "y", "x"}, "", "1/s", fill([]float64{m2u * 300 / 100, m2u * 200 / 200}, 3, 2, 2))
+	pblh := sparse.ZerosDense(2, 2)
+	for i := range pblh.Elements {
+		pblh.Elements[i] = 300
+	}
+	d.AddVariable("Pblh", []string{"y", "x"}, "", "m", pblh)
+	return d
+}
+
+func TestRegridLayers(t *testing.T) {
+	const tol = 1.e-10
+	d := layersTestData()
+	layerHeights := []float64{0, 50, 100, 200, 300, 600, 1000}
+	o, err := d.RegridLayers(layerHeights)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// column returns the values in column (0, 1) of variable name.
+	column := func(name string) []float64 { return columnValues(o.Data[name].Data, 0, 1) }
+	for _, test := range []struct {
+		name string
+		want []float64
+	}{
+		{name: "LayerHeights", want: layerHeights},
+		{name: "Dz", want: []float64{50, 50, 100, 100, 300, 400}},
+		{name: "Temperature", want: []float64{10, 10, 20, 20, 30, 30}},
+		{name: "WAvg", want: []float64{0, 0.5, 1, 1.5, 2, 3, 3}},
+		{name: "UAvg", want: []float64{1, 1, 2, 2, 3, 3}},
+		{name: "ParticleDryDep", want: []float64{0.01, 0, 0, 0, 0, 0}},
+		{name: "M2u", want: []float64{1.e-3, 1.e-3, 1.e-3, 1.e-3, 0, 0}},
+		{name: "M2d", want: []float64{1.e-3 * 300 / 50, 1.e-3 * 250 / 50, 1.e-3 * 200 / 100, 1.e-3 * 100 / 100, 0, 0}},
+	} {
+		have := column(test.name)
+		if len(have) != len(test.want) {
+			t.Errorf("%s: have %v, want %v", test.name, have, test.want)
+			continue
+		}
+		for k := range have {
+			if different(have[k], test.want[k], tol) {
+				t.Errorf("%s: have %v, want %v", test.name, have, test.want)
+				break
+			}
+		}
+	}
+	if o.Data["Pblh"].Data.Get(1, 1) != 300 {
+		t.Errorf("2-D variables should not be changed")
+	}
+
+	// Layers that do not line up with the original layers.
+	o, err = d.RegridLayers([]float64{0, 200, 600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := column("Temperature"), []float64{15, 27.5}; different(have[0], want[0], tol) || different(have[1], want[1], tol) {
+		t.Errorf("Temperature: have %v, want %v", have, want)
+	}
+	// The convective mixing should be in balance (see stabilityMixingChemistry).
+	m2u, m2d, dz := column("M2u"), column("M2d"), column("Dz")
+	if val := m2u[0] - m2d[0] + m2d[1]*dz[1]/dz[0]; different(val, 0, tol) {
+		t.Errorf("M2u and M2d don't match: %g", val)
+	}
+
+	for _, heights := range [][]float64{nil, {0}, {10, 20}, {0, 100, 100}} {
+		if _, err := d.RegridLayers(heights); err == nil {
+			t.Errorf("layer heights %v should cause an error", heights)
+		}
+	}
+}
+
+func TestGEOSChemLayers(t *testing.T) {
+	gc, err := NewGEOSChem(
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A1.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A3cld.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A3dyn.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].I3.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A3mstE.2x25.nc",
+		"",
+		"cmd/inmap/testdata/preproc/gc_output.[DATE].nc",
+		"cmd/inmap/testdata/preproc/geoschem-new/Olson_2001_Land_Map.025x025.generic.nc",
+		"20130102",
+		"20130104",
+		true,
+		"3h",
+		"3h",
+		true,
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerHeights := []float64{0, 100, 500, 2000, 10000}
+	data, err := Preprocess(gc, -2.5, 50, 2.5, 2, Layers(layerHeights))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, v := range data.Data {
+		switch v.Dims[0] {
+		case "z":
+			if v.Data.Shape[0] != len(layerHeights)-1 {
+				t.Errorf("%s has %d layers; it should have %d", name, v.Data.Shape[0], len(layerHeights)-1)
+			}
+		case "zStagger":
+			if v.Data.Shape[0] != len(layerHeights) {
+				t.Errorf("%s has %d layer edges; it should have %d", name, v.Data.Shape[0], len(layerHeights))
+			}
+		}
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+
+	"github.com/ctessum/geom"
+)
+
+// lineLengthIn returns the length of the parts of l, such as a road link,
+// rail line, or shipping lane, that are within grid cell c. Parts of l
+// that lie along an edge of c are counted half, because the cell shares
+// the edge with a neighbor, so that the lengths in all the cells add up
+// to the length of l.
+func lineLengthIn(l geom.Linear, c *Cell) float64 {
+	ring, ok := convexRing(c)
+	if !ok {
+		// Fall back to clipping for cells that are not convex polygons.
+		intersection := l.Clip(c.Polygonal)
+		if intersection == nil {
+			return 0
+		}
+		return intersection.Length()
+	}
+	var lines []geom.LineString
+	switch t := l.(type) {
+	case geom.LineString:
+		lines = []geom.LineString{t}
+	case geom.MultiLineString:
+		lines = t
+	default:
+		intersection := l.Clip(c.Polygonal)
+		if intersection == nil {
+			return 0
+		}
+		return intersection.Length()
+	}
+	var length float64
+	for _, ls := range lines {
+		for i := 1; i < len(ls); i++ {
+			length += segmentLengthIn(ls[i-1], ls[i], ring)
+		}
+	}
+	return length
+}
+
+// convexRing returns the outer ring of c in counter-clockwise order, and
+// whether c is a single convex polygon without holes.
+func convexRing(c *Cell) ([]geom.Point, bool) {
+	polys := c.Polygons()
+	if len(polys) != 1 || len(polys[0]) != 1 {
+		return nil, false
+	}
+	ring := polys[0][0]
+	if n := len(ring); n > 1 && ring[0].Equals(ring[n-1]) {
+		ring = ring[:n-1]
+	}
+	if len(ring) < 3 {
+		return nil, false
+	}
+	var area float64
+	for i := range ring {
+		a, b := ring[i], ring[(i+1)%len(ring)]
+		area += a.X*b.Y - b.X*a.Y
+	}
+	if area < 0 {
+		r := make([]geom.Point, len(ring))
+		for i, p := range ring {
+			r[len(ring)-1-i] = p
+		}
+		ring = r
+	}
+	for i := range ring {
+		a, b, cc := ring[i], ring[(i+1)%len(ring)], ring[(i+2)%len(ring)]
+		if (b.X-a.X)*(cc.Y-b.Y)-(b.Y-a.Y)*(cc.X-b.X) < 0 {
+			return nil, false
+		}
+	}
+	return ring, true
+}
+
+// segmentLengthIn returns the length of the part of the line segment from
+// p0 to p1 that is within the convex polygon with the given
+// counter-clockwise ring, using the Cyrus-Beck algorithm. Parts that lie
+// along an edge of the polygon are counted half.
+func segmentLengthIn(p0, p1 geom.Point, ring []geom.Point) float64 {
+	dx, dy := p1.X-p0.X, p1.Y-p0.Y
+	segLength := math.Hypot(dx, dy)
+	if segLength == 0 {
+		return 0
+	}
+	tEnter, tLeave := 0., 1.
+	onEdge := false
+	for i := range ring {
+		a, b := ring[i], ring[(i+1)%len(ring)]
+		// n is the inward-pointing normal of the edge from a to b.
+		nx, ny := -(b.Y - a.Y), b.X-a.X
+		edgeLength := math.Hypot(nx, ny)
+		if edgeLength == 0 {
+			continue
+		}
+		// dist is the distance of p0 inside of the edge.
+		dist := (nx*(p0.X-a.X) + ny*(p0.Y-a.Y)) / edgeLength
+		rate := (nx*dx + ny*dy) / edgeLength
+		tol := 1.e-10 * math.Max(edgeLength, segLength)
+		if math.Abs(rate) <= 1.e-10*segLength {
+			// The segment is parallel to the edge.
+			if dist < -tol {
+				return 0
+			}
+			if dist <= tol {
+				onEdge = true
+			}
+			continue
+		}
+		t := -dist / rate
+		if rate > 0 {
+			tEnter = math.Max(tEnter, t)
+		} else {
+			tLeave = math.Min(tLeave, t)
+		}
+	}
+	if tLeave <= tEnter {
+		return 0
+	}
+	length := (tLeave - tEnter) * segLength
+	if onEdge {
+		return length / 2
+	}
+	return length
+}
+
+// nearRoad accumulates the information about the line emissions sources
+// in a grid cell that is needed to estimate the near-road concentration
+// enhancement.
+type nearRoad struct {
+	// roadLength is the length of line sources in the cell, in the units
+	// of the grid.
+	roadLength float64
+
+	// linePM25 and totalPM25 are the primary PM2.5 emissions [μg/s] from
+	// line sources and from all sources in the cell.
+	linePM25, totalPM25 float64
+}
+
+// add adds the fraction weightFactor of the emissions in e.
+func (nr *nearRoad) add(e *EmisRecord, weightFactor float64) {
+	nr.totalPM25 += e.PM25 * weightFactor
+	if l, ok := e.Geom.(geom.Linear); ok {
+		nr.roadLength += l.Length() * weightFactor
+		nr.linePM25 += e.PM25 * weightFactor
+	}
+}
+
+// enhancement returns the ratio of the primary PM2.5 concentration within
+// a zone of the given width next to the line sources to the average
+// concentration in a cell with the given area. It assumes that the
+// emissions from line sources in the cell are initially mixed within
+// the near-road zone, while other emissions are mixed evenly within the
+// cell, so it is a screening estimate that does not account for
+// pollution transported in from other cells.
+func (nr *nearRoad) enhancement(width, area float64) float64 {
+	if nr.roadLength == 0 || nr.totalPM25 == 0 || area == 0 {
+		return 1
+	}
+	zoneFrac := math.Min(nr.roadLength*width/area, 1)
+	lineFrac := nr.linePM25 / nr.totalPM25
+	return 1 + lineFrac*(1/zoneFrac-1)
+}
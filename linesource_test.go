@@ -0,0 +1,82 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestLineEmissions(t *testing.T) {
+	const (
+		tol = 1.e-8
+		E   = 1000. // emissions [μg/s]
+	)
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	m := Mech{}
+
+	for _, line := range []geom.LineString{
+		{{X: -3000, Y: -3000}, {X: 3000, Y: 2000}},
+		// Along the edges between grid cells.
+		{{X: -4000, Y: 0}, {X: 4000, Y: 0}, {X: 0, Y: 0}, {X: 0, Y: -4000}},
+		{{X: -3500, Y: 0}, {X: 0, Y: 0}, {X: 0, Y: 3500}, {X: 2000, Y: 3500}},
+	} {
+		emis := NewEmissions()
+		emis.NearRoadWidth = 50
+		emis.Add(&EmisRecord{Geom: line, PM25: E})
+		d := &InMAP{
+			InitFuncs: []DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+			},
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		var total, length float64
+		for _, c := range d.Cells() {
+			if c.Layer != 0 {
+				continue
+			}
+			total += c.EmisFlux[iPM2_5] * c.Volume
+			length += lineLengthIn(line, c)
+			if c.EmisFlux[iPM2_5] > 0 && !(c.NearRoadEnhancement > 1) {
+				t.Errorf("%v: near-road enhancement should be > 1 but is %g", line, c.NearRoadEnhancement)
+			}
+		}
+		if different(total, E, tol) {
+			t.Errorf("%v: total emissions should be %g but are %g", line, E, total)
+		}
+		if different(length, line.Length(), tol) {
+			t.Errorf("%v: total length should be %g but is %g", line, line.Length(), length)
+		}
+	}
+}
+
+func TestNearRoadEnhancement(t *testing.T) {
+	nr := nearRoad{roadLength: 1000, linePM25: 1, totalPM25: 4}
+	// The near-road zone covers 1/20 of the cell, and 1/4 of the
+	// emissions are from line sources.
+	if have, want := nr.enhancement(50, 1000*1000), 1+0.25*19; different(have, want, 1.e-10) {
+		t.Errorf("have %g, want %g", have, want)
+	}
+	if have := (&nearRoad{}).enhancement(50, 1000*1000); have != 1 {
+		t.Errorf("without line sources, have %g, want 1", have)
+	}
+}
@@ -23,16 +23,18 @@ import (
 	"sort"
 )
 
-// cellRefs holds a cell, a reference to the next and previous
-// adjacent cells in a cellList, and potentially information about the
+// cellRef holds a cell and potentially information about the
 // cell's relationship to a neighbor.
 type cellRef struct {
 	*Cell
-	info *neighborInfo
+	info neighborInfo
 }
 
-// cellList is a list of cells.
-type cellList []*cellRef
+// cellList is a list of cells. The references are held by value, so
+// that a list is a single contiguous array rather than a separate heap
+// object for each neighbor. Pointers to the references in a list are
+// only valid until the list is next modified.
+type cellList []cellRef
 
 func (l *cellList) len() int {
 	return len(*l)
@@ -47,11 +49,6 @@ func (l *cellList) array() []*Cell {
 	return o
 }
 
-// delete deletes this cellRef from the list.
-func (l *cellList) delete(c *cellRef) {
-	l.deleteCell(c.Cell)
-}
-
 // deleteCell deletes this Cell from the list
 func (l *cellList) deleteCell(c *Cell) {
 
@@ -66,25 +63,38 @@ func (l *cellList) deleteCell(c *Cell) {
 	}
 
 	copy((*l)[i:], (*l)[i+1:])
-	(*l)[len(*l)-1] = nil
+	(*l)[len(*l)-1] = cellRef{}
 	(*l) = (*l)[:len(*l)-1]
 }
 
-// addToList adds the cell to the beginning of the list.
-func (l *cellList) add(c *Cell) *cellRef {
-	cc := &cellRef{Cell: c}
+// filter removes the cells for which keep returns false from the list,
+// keeping the others in the same order.
+func (l *cellList) filter(keep func(*Cell) bool) {
+	kept := (*l)[:0]
+	for _, c := range *l {
+		if keep(c.Cell) {
+			kept = append(kept, c)
+		}
+	}
+	for i := len(kept); i < len(*l); i++ {
+		(*l)[i] = cellRef{}
+	}
+	*l = kept
+}
 
+// add adds the cell to the list and returns its reference.
+func (l *cellList) add(c *Cell) *cellRef {
 	// Find the correct location to insert the cell
 	i := sort.Search(len(*l), func(i int) bool {
 		return c.before((*l)[i].Cell)
 	})
 
 	// Insert the cell.
-	(*l) = append((*l), nil)
+	(*l) = append((*l), cellRef{})
 	copy((*l)[i+1:], (*l)[i:])
-	(*l)[i] = cc
+	(*l)[i] = cellRef{Cell: c}
 
-	return cc
+	return &(*l)[i]
 }
 
 // index returns the index of c and whether it was found
@@ -108,7 +118,7 @@ func (l *cellList) ref(c *Cell) *cellRef {
 		return c.before((*l)[i].Cell)
 	})
 
-	cref := (*l)[i]
+	cref := &(*l)[i]
 	if cref.Cell != c {
 		panic("tried to retrieve cell that is not in list")
 	}
@@ -59,8 +59,8 @@ func TestList(t *testing.T) {
 	l3 := new(cellList)
 	l3.add(c0)
 	l3.add(c1)
-	l3.delete((*l3)[0])
-	if l3.len() == 1 && (*l3)[0] == nil {
+	l3.deleteCell((*l3)[0].Cell)
+	if l3.len() == 1 && (*l3)[0].Cell == nil {
 		t.Errorf("improperly formed list")
 	}
 
@@ -0,0 +1,535 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ctessum/sparse"
+)
+
+// merra2Format is the date format used in MERRA-2 file names.
+const merra2Format = "20060102"
+
+// ChemistrySource provides the chemical concentrations that InMAP
+// requires. Any Preprocessor is a ChemistrySource.
+type ChemistrySource interface {
+	// AVOC is total concentration of anthropogenic
+	// secondary organic aerosol precursors (VOCs) [μg/m3].
+	AVOC() NextData
+	// BVOC is total concentration of biogenic
+	// secondary organic aerosol precursors (VOCs) [μg/m3].
+	BVOC() NextData
+	// ASOA is total concentration of anthropogenic
+	// secondary organic aerosol [μg/m3].
+	ASOA() NextData
+	// BSOA is total concentration of biogenic
+	// secondary organic aerosol [μg/m3].
+	BSOA() NextData
+	// NOx is concentration of oxides of Nitrogen [μg/m3].
+	NOx() NextData
+	// PNO is concentration of particulate nitrate [μg/m3].
+	PNO() NextData
+	// SOx is concentration of oxides of Sulfur [μg/m3].
+	SOx() NextData
+	// PS is concentration of particulate sulfate [μg/m3].
+	PS() NextData
+	// NH3 is ammonia concentration [μg/m3].
+	NH3() NextData
+	// PNH is concentration of particulate ammonium [μg/m3].
+	PNH() NextData
+	// TotalPM25 is total concentration of fine particulate matter [μg/m3].
+	TotalPM25() NextData
+	// HO is hydroxyl radical concentration [ppmv].
+	HO() NextData
+	// H2O2 is hydrogen peroxide concentration [ppmv].
+	H2O2() NextData
+	// O3 is ozone concentration [ppmv].
+	O3() NextData
+	// HNO3 is nitric acid concentration [ppmv].
+	HNO3() NextData
+}
+
+// MERRA2 is an InMAP preprocessor that derives the meteorology directly
+// from collections of the NASA Modern-Era Retrospective analysis for
+// Research and Applications, Version 2 (MERRA-2) reanalysis, which are
+// described at https://gmao.gsfc.nasa.gov/pubs/docs/Bosilovich785.pdf.
+// Chemical concentrations are taken from a separate ChemistrySource or,
+// if none is given, from climatological defaults.
+type MERRA2 struct {
+	merra2Asm, merra2Flx, merra2Rad, merra2Lnd, merra2Mst string
+
+	chem ChemistrySource
+	clim *merra2Climatology
+
+	start, end time.Time
+
+	landUse *sparse.DenseArray
+
+	nx, ny, nz int
+
+	dx, dy float64
+
+	xCenters, yCenters []float64
+
+	msgChan chan string
+}
+
+// NewMERRA2 initializes a MERRA-2 preprocessor from the given
+// configuration information. In all of the file locations below,
+// [DATE] should be used as a wild card for the simulation date, in the
+// format "YYYYMMDD", and each file should contain one day of data.
+//
+// MERRA2Asm is the location of the 3-hourly instantaneous assimilated
+// meteorological fields on model levels (inst3_3d_asm_Nv; M2I3NVASM).
+//
+// MERRA2Flx is the location of the hourly average surface flux
+// diagnostics (tavg1_2d_flx_Nx; M2T1NXFLX).
+//
+// MERRA2Rad is the location of the hourly average radiation
+// diagnostics (tavg1_2d_rad_Nx; M2T1NXRAD).
+//
+// MERRA2Lnd is the location of the hourly average land surface
+// diagnostics (tavg1_2d_lnd_Nx; M2T1NXLND).
+//
+// MERRA2Mst is the location of the 3-hourly average moist processes
+// diagnostics on model layer edges (tavg3_3d_mst_Ne; M2T3NEMST).
+//
+// OlsonLandMap is the location of the GEOS-Chem Olson land use map file,
+// which is described here:
+// http://wiki.seas.harvard.edu/geos-chem/index.php/Olson_land_map
+//
+// startDate and endDate are the dates of the beginning and end of the
+// simulation, respectively, in the format "YYYYMMDD".
+//
+// chem is the source of chemical concentrations, for example a GEOSChem
+// preprocessor for a simulation on the same grid with 3-hourly
+// output records. Its concentrations must be on the MERRA-2 grid with
+// layers ordered from bottom to top. If chem is nil, the concentrations
+// are instead calculated from climatological mixing ratios, which is
+// adequate for simulations where the dispersion of primary pollutants
+// is of main interest but not for secondary particle formation.
+//
+// If msgChan is not nil, status messages will be sent to it.
+func NewMERRA2(MERRA2Asm, MERRA2Flx, MERRA2Rad, MERRA2Lnd, MERRA2Mst, OlsonLandMap, startDate, endDate string, chem ChemistrySource, msgChan chan string) (*MERRA2, error) {
+	m := MERRA2{
+		merra2Asm: MERRA2Asm,
+		merra2Flx: MERRA2Flx,
+		merra2Rad: MERRA2Rad,
+		merra2Lnd: MERRA2Lnd,
+		merra2Mst: MERRA2Mst,
+		chem:      chem,
+		msgChan:   msgChan,
+	}
+	if chem == nil {
+		m.clim = &merra2Climatology{m: &m}
+	}
+
+	var err error
+	m.start, err = time.Parse(inDateFormat, startDate)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: MERRA-2 preprocessor start time: %v", err)
+	}
+	m.end, err = time.Parse(inDateFormat, endDate)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: MERRA-2 preprocessor end time: %v", err)
+	}
+	if !m.end.After(m.start) {
+		return nil, fmt.Errorf("inmap: MERRA-2 preprocessor end time %v is not after start time %v", m.end, m.start)
+	}
+
+	ff, err := ncfFromTemplate(m.merra2Asm, merra2Format, m.start)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: MERRA-2 preprocessor: %v", err)
+	}
+	defer ff.Close()
+	dims := ff.Lengths("T")
+	if len(dims) != 4 {
+		return nil, fmt.Errorf("inmap: MERRA-2 preprocessor: variable T not in file")
+	}
+	m.nz, m.ny, m.nx = dims[1], dims[2], dims[3]
+	for _, v := range []struct {
+		name    string
+		centers *[]float64
+		delta   *float64
+	}{
+		{name: "lon", centers: &m.xCenters, delta: &m.dx},
+		{name: "lat", centers: &m.yCenters, delta: &m.dy},
+	} {
+		data, err := readNCFNoHour(v.name, ff, 0)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: MERRA-2 preprocessor: %v", err)
+		}
+		if len(data.Elements) < 2 {
+			return nil, fmt.Errorf("inmap: MERRA-2 preprocessor: variable %s has fewer than 2 values", v.name)
+		}
+		*v.centers = data.Elements
+		*v.delta = data.Elements[1] - data.Elements[0]
+	}
+
+	cfile, err := openNCF(OlsonLandMap)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: Olson land use file: %v", err)
+	}
+	defer cfile.Close()
+	m.landUse, err = largestOlsonLandUse(cfile, m.xCenters, m.yCenters, m.dx, m.dy)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// read reads a variable from a MERRA-2 collection with one file
+// per day and the given interval between records. The vertical
+// layers of 3-D variables, which are ordered from top to bottom
+// in MERRA-2, are reversed.
+func (m *MERRA2) read(fileTemplate, varName string, recordDelta time.Duration) NextData {
+	return nextDataNCF(fileTemplate, merra2Format, varName, m.start, m.end, recordDelta, 24*time.Hour,
+		func(varName string, ff ncfFile, index int) (*sparse.DenseArray, error) {
+			data, err := readNCF(varName, ff, index)
+			if err != nil {
+				return nil, err
+			}
+			if len(data.Shape) != 3 {
+				return data, nil
+			}
+			out := sparse.ZerosDense(data.Shape...)
+			n := data.Shape[1] * data.Shape[2]
+			nz := data.Shape[0]
+			for k := 0; k < nz; k++ {
+				copy(out.Elements[k*n:(k+1)*n], data.Elements[(nz-1-k)*n:(nz-k)*n])
+			}
+			return out, nil
+		}, m.msgChan)
+}
+
+func (m *MERRA2) readAsm(varName string) NextData { return m.read(m.merra2Asm, varName, 3*time.Hour) }
+func (m *MERRA2) readFlx(varName string) NextData { return m.read(m.merra2Flx, varName, time.Hour) }
+func (m *MERRA2) readRad(varName string) NextData { return m.read(m.merra2Rad, varName, time.Hour) }
+func (m *MERRA2) readLnd(varName string) NextData { return m.read(m.merra2Lnd, varName, time.Hour) }
+func (m *MERRA2) readMst(varName string) NextData { return m.read(m.merra2Mst, varName, 3*time.Hour) }
+
+// Nx helps fulfill the Preprocessor interface by returning
+// the number of grid cells in the West-East direction.
+func (m *MERRA2) Nx() (int, error) { return m.nx, nil }
+
+// Ny helps fulfill the Preprocessor interface by returning
+// the number of grid cells in the South-North direction.
+func (m *MERRA2) Ny() (int, error) { return m.ny, nil }
+
+// Nz helps fulfill the Preprocessor interface by returning
+// the number of grid cells in the below-above direction.
+func (m *MERRA2) Nz() (int, error) { return m.nz, nil }
+
+// PBLH helps fulfill the Preprocessor interface by returning
+// planetary boundary layer height [m].
+func (m *MERRA2) PBLH() NextData { return m.readFlx("PBLH") }
+
+// Height helps fulfill the Preprocessor interface by returning
+// layer heights above ground level, calculated using the
+// hypsometric equation.
+func (m *MERRA2) Height() NextData { return geosHeight(m.T(), m.P()) }
+
+// ALT helps fulfill the Preprocessor interface by returning
+// inverse air density [m3/kg].
+func (m *MERRA2) ALT() NextData { return geosALT(m.T(), m.P()) }
+
+// T helps fulfill the Preprocessor interface by returning temperature [K].
+func (m *MERRA2) T() NextData { return m.readAsm("T") }
+
+// RH helps fulfill the Preprocessor interface by returning
+// relative humidity [fraction].
+func (m *MERRA2) RH() NextData { return m.readAsm("RH") }
+
+// P helps fulfill the Preprocessor interface by returning pressure [Pa]
+// at layer edges, calculated from the pressure thickness of each layer
+// starting from the pressure at the top of the model.
+func (m *MERRA2) P() NextData {
+	const pTop = 1.0              // Pressure at the top of the model [Pa]
+	DELPFunc := m.readAsm("DELP") // Pressure thickness [Pa]
+	return func() (*sparse.DenseArray, error) {
+		DELP, err := DELPFunc()
+		if err != nil {
+			return nil, err
+		}
+		nz := DELP.Shape[0]
+		p := sparse.ZerosDense(nz+1, DELP.Shape[1], DELP.Shape[2])
+		for j := 0; j < DELP.Shape[1]; j++ {
+			for i := 0; i < DELP.Shape[2]; i++ {
+				p.Set(pTop, nz, j, i)
+				for k := nz - 1; k >= 0; k-- {
+					p.Set(p.Get(k+1, j, i)+DELP.Get(k, j, i), k, j, i)
+				}
+			}
+		}
+		return p, nil
+	}
+}
+
+// UStar helps fulfill the Preprocessor interface by returning
+// friction velocity [m/s].
+func (m *MERRA2) UStar() NextData { return m.readFlx("USTAR") }
+
+// SeinfeldLandUse helps fulfill the Preprocessor interface by
+// returning land use categories as
+// specified in github.com/ctessum/atmos/seinfeld.
+func (m *MERRA2) SeinfeldLandUse() NextData {
+	return geosChemSeinfeldLandUse(m.snowFraction(), m.landUse)
+}
+
+// WeselyLandUse helps fulfill the Preprocessor interface by
+// returning land use categories as
+// specified in github.com/ctessum/atmos/wesely1989.
+func (m *MERRA2) WeselyLandUse() NextData {
+	return geosChemWeselyLandUse(m.snowFraction(), m.landUse)
+}
+
+// snowFraction returns the fraction of land covered by snow.
+// The land surface diagnostics are undefined over water, where
+// the fraction is set to zero.
+func (m *MERRA2) snowFraction() NextData {
+	snowFunc := m.readLnd("FRSNO")
+	return func() (*sparse.DenseArray, error) {
+		snow, err := snowFunc()
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range snow.Elements {
+			if v > 1 { // Fill value
+				snow.Elements[i] = 0
+			}
+		}
+		return snow, nil
+	}
+}
+
+// Z0 helps fulfill the Preprocessor interface by returning
+// momentum roughness length [m].
+func (m *MERRA2) Z0() NextData { return m.readFlx("Z0M") }
+
+// QRain helps fulfill the Preprocessor interface by returning
+// rain mass fraction based on the MERRA-2 liquid precipitation
+// fluxes [kg m-2 s-1] and the assumption (from the EMEP model wet
+// deposition algorithm) that raindrops are falling at 5 m/s.
+func (m *MERRA2) QRain() NextData {
+	return geosNonNegative(geosQRain(m.readMst("PFLCU"), m.readMst("PFLLSAN"), m.ALT()))
+}
+
+// QCloud helps fulfill the Preprocessor interface by returning
+// the cloud liquid water mass fraction.
+func (m *MERRA2) QCloud() NextData { return geosNonNegative(m.readAsm("QL")) }
+
+// CloudFrac helps fulfill the Preprocessor interface by returning
+// the cloud volume fraction.
+func (m *MERRA2) CloudFrac() NextData { return m.readAsm("CLOUD") }
+
+// SurfaceHeatFlux helps fulfill the Preprocessor interface by returning
+// sensible heat flux from turbulence [W/m2].
+func (m *MERRA2) SurfaceHeatFlux() NextData { return m.readFlx("HFLUX") }
+
+// RadiationDown helps fulfill the Preprocessor interface by
+// returning downwelling radiation at ground level [W m-2], which is the
+// sum of the incoming shortwave and absorbed longwave radiation.
+func (m *MERRA2) RadiationDown() NextData {
+	return cmaqRadiationDown(m.readRad("SWGDN"), m.readRad("LWGAB"))
+}
+
+// U helps fulfill the Preprocessor interface.
+func (m *MERRA2) U() NextData { return stagger(m.readAsm("U"), 2) } // (unstaggered)
+
+// V helps fulfill the Preprocessor interface.
+func (m *MERRA2) V() NextData { return stagger(m.readAsm("V"), 1) } // (unstaggered)
+
+// W helps fulfill the Preprocessor interface.
+func (m *MERRA2) W() NextData { return geosW(m.readAsm("OMEGA"), m.P(), m.T()) }
+
+// chemistry returns the source of the chemical concentrations.
+func (m *MERRA2) chemistry() ChemistrySource {
+	if m.chem == nil {
+		return m.clim
+	}
+	return m.chem
+}
+
+// checkChem checks that the concentrations returned by f are on the
+// MERRA-2 grid.
+func (m *MERRA2) checkChem(f NextData) NextData {
+	return func() (*sparse.DenseArray, error) {
+		data, err := f()
+		if err != nil {
+			return nil, err
+		}
+		if len(data.Shape) != 3 || data.Shape[0] != m.nz || data.Shape[1] != m.ny || data.Shape[2] != m.nx {
+			return nil, fmt.Errorf("inmap: MERRA-2 preprocessor: chemistry shape %v does not match "+
+				"meteorology shape [%d %d %d]", data.Shape, m.nz, m.ny, m.nx)
+		}
+		return data, nil
+	}
+}
+
+// AVOC helps fulfill the Preprocessor interface.
+func (m *MERRA2) AVOC() NextData { return m.checkChem(m.chemistry().AVOC()) }
+
+// BVOC helps fulfill the Preprocessor interface.
+func (m *MERRA2) BVOC() NextData { return m.checkChem(m.chemistry().BVOC()) }
+
+// ASOA helps fulfill the Preprocessor interface.
+func (m *MERRA2) ASOA() NextData { return m.checkChem(m.chemistry().ASOA()) }
+
+// BSOA helps fulfill the Preprocessor interface.
+func (m *MERRA2) BSOA() NextData { return m.checkChem(m.chemistry().BSOA()) }
+
+// NOx helps fulfill the Preprocessor interface.
+func (m *MERRA2) NOx() NextData { return m.checkChem(m.chemistry().NOx()) }
+
+// PNO helps fulfill the Preprocessor interface.
+func (m *MERRA2) PNO() NextData { return m.checkChem(m.chemistry().PNO()) }
+
+// SOx helps fulfill the Preprocessor interface.
+func (m *MERRA2) SOx() NextData { return m.checkChem(m.chemistry().SOx()) }
+
+// PS helps fulfill the Preprocessor interface.
+func (m *MERRA2) PS() NextData { return m.checkChem(m.chemistry().PS()) }
+
+// NH3 helps fulfill the Preprocessor interface.
+func (m *MERRA2) NH3() NextData { return m.checkChem(m.chemistry().NH3()) }
+
+// PNH helps fulfill the Preprocessor interface.
+func (m *MERRA2) PNH() NextData { return m.checkChem(m.chemistry().PNH()) }
+
+// TotalPM25 helps fulfill the Preprocessor interface.
+func (m *MERRA2) TotalPM25() NextData { return m.checkChem(m.chemistry().TotalPM25()) }
+
+// HO helps fulfill the Preprocessor interface by returning hydroxyl
+// radical concentration [ppmv].
+func (m *MERRA2) HO() NextData { return m.checkChem(m.chemistry().HO()) }
+
+// H2O2 helps fulfill the Preprocessor interface by returning
+// hydrogen peroxide concentration [ppmv].
+func (m *MERRA2) H2O2() NextData { return m.checkChem(m.chemistry().H2O2()) }
+
+// O3 helps fulfill the Preprocessor interface by returning
+// ozone concentration [ppmv].
+func (m *MERRA2) O3() NextData { return m.checkChem(m.chemistry().O3()) }
+
+// HNO3 helps fulfill the Preprocessor interface by returning
+// nitric acid concentration [ppmv].
+func (m *MERRA2) HNO3() NextData { return m.checkChem(m.chemistry().HNO3()) }
+
+// Climatological mixing ratios used by the MERRA-2 preprocessor when
+// no chemistry source is given. Concentrations of particles and their
+// precursors [μg/kg dry air] are typical of the continental background
+// boundary layer; nitrogen and sulfur species are expressed as the
+// mass of N and S, respectively. HO and H2O2 [ppmv] correspond to
+// about 1×10⁶ molecules cm⁻³ and 1 ppbv, respectively, and O3 and
+// HNO3 [ppmv] correspond to 30 ppbv and 1 ppbv.
+const (
+	climAVOC      = 1.0
+	climBVOC      = 1.0
+	climASOA      = 0.3
+	climBSOA      = 0.5
+	climNOx       = 1.0
+	climPNO       = 0.3
+	climSOx       = 0.5
+	climPS        = 0.5
+	climNH3       = 0.8
+	climPNH       = 0.5
+	climTotalPM25 = 5.0
+	climHO        = 4.0e-8
+	climH2O2      = 1.0e-3
+	climO3        = 3.0e-2
+	climHNO3      = 1.0e-3
+)
+
+// merra2Climatology is a ChemistrySource of climatological
+// concentrations on the grid of a MERRA-2 preprocessor.
+//
+// Because the concentrations do not change over time, concentrations
+// of particles and their precursors are only returned for a single
+// time step, so that the marginal gas-particle partitioning is the
+// same as the ratio of the concentrations. HO, H2O2, O3, and HNO3
+// are returned for each 3-hour meteorology time step.
+type merra2Climatology struct {
+	m *MERRA2
+
+	// alt is the average inverse air density [m3/kg] over the
+	// simulation period.
+	alt     *sparse.DenseArray
+	altErr  error
+	altOnce sync.Once
+}
+
+// mixingRatio returns a function that returns the concentration [μg/m3]
+// of a species with the given mixing ratio [μg/kg] for a single
+// time step, using the average air density.
+func (c *merra2Climatology) mixingRatio(mr float64) NextData {
+	done := false
+	return func() (*sparse.DenseArray, error) {
+		if done {
+			return nil, io.EOF
+		}
+		c.altOnce.Do(func() { c.alt, c.altErr = average(c.m.ALT()) })
+		if c.altErr != nil {
+			return nil, c.altErr
+		}
+		alt := c.alt
+		done = true
+		out := sparse.ZerosDense(alt.Shape...)
+		for i, v := range alt.Elements {
+			out.Elements[i] = mr / v
+		}
+		return out, nil
+	}
+}
+
+// constant returns a function that returns the value v
+// for each 3-hour time step.
+func (c *merra2Climatology) constant(v float64) NextData {
+	date := c.m.start
+	return func() (*sparse.DenseArray, error) {
+		if !date.Before(c.m.end) {
+			return nil, io.EOF
+		}
+		date = date.Add(3 * time.Hour)
+		out := sparse.ZerosDense(c.m.nz, c.m.ny, c.m.nx)
+		for i := range out.Elements {
+			out.Elements[i] = v
+		}
+		return out, nil
+	}
+}
+
+func (c *merra2Climatology) AVOC() NextData      { return c.mixingRatio(climAVOC) }
+func (c *merra2Climatology) BVOC() NextData      { return c.mixingRatio(climBVOC) }
+func (c *merra2Climatology) ASOA() NextData      { return c.mixingRatio(climASOA) }
+func (c *merra2Climatology) BSOA() NextData      { return c.mixingRatio(climBSOA) }
+func (c *merra2Climatology) NOx() NextData       { return c.mixingRatio(climNOx) }
+func (c *merra2Climatology) PNO() NextData       { return c.mixingRatio(climPNO) }
+func (c *merra2Climatology) SOx() NextData       { return c.mixingRatio(climSOx) }
+func (c *merra2Climatology) PS() NextData        { return c.mixingRatio(climPS) }
+func (c *merra2Climatology) NH3() NextData       { return c.mixingRatio(climNH3) }
+func (c *merra2Climatology) PNH() NextData       { return c.mixingRatio(climPNH) }
+func (c *merra2Climatology) TotalPM25() NextData { return c.mixingRatio(climTotalPM25) }
+func (c *merra2Climatology) HO() NextData        { return c.constant(climHO) }
+func (c *merra2Climatology) H2O2() NextData      { return c.constant(climH2O2) }
+func (c *merra2Climatology) O3() NextData        { return c.constant(climO3) }
+func (c *merra2Climatology) HNO3() NextData      { return c.constant(climHNO3) }
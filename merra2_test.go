@@ -0,0 +1,403 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/batchatco/go-native-netcdf/netcdf"
+	ncapi "github.com/batchatco/go-native-netcdf/netcdf/api"
+)
+
+// merra2TestVar is a variable in a MERRA-2 test file.
+type merra2TestVar struct {
+	vals  []float64
+	shape []int
+}
+
+// readGEOSFPTest reads variable v from the GEOS-FP test file
+// for the given date and collection.
+func readGEOSFPTest(date, collection, v string) (merra2TestVar, error) {
+	path := "cmd/inmap/testdata/preproc/GEOSFP.ApBp.nc"
+	if collection != "" {
+		path = fmt.Sprintf("cmd/inmap/testdata/preproc/GEOSFP.%s.%s.2x25.nc", date, collection)
+	}
+	ff, err := openNCF(path)
+	if err != nil {
+		return merra2TestVar{}, err
+	}
+	defer ff.Close()
+	buf, err := ff.Read(v, nil, nil)
+	if err != nil {
+		return merra2TestVar{}, err
+	}
+	vals, err := ncfFloats(buf)
+	return merra2TestVar{vals: vals, shape: ff.Lengths(v)}, err
+}
+
+// flip reverses the order of the vertical layers of a
+// variable with dimensions [time, lev, lat, lon].
+func (v merra2TestVar) flip() merra2TestVar {
+	nt, nz, n := v.shape[0], v.shape[1], v.shape[2]*v.shape[3]
+	o := merra2TestVar{vals: make([]float64, len(v.vals)), shape: v.shape}
+	for t := 0; t < nt; t++ {
+		for k := 0; k < nz; k++ {
+			copy(o.vals[(t*nz+k)*n:(t*nz+k+1)*n], v.vals[(t*nz+nz-1-k)*n:(t*nz+nz-k)*n])
+		}
+	}
+	return o
+}
+
+// values returns the values of v as nested float32 slices.
+func (v merra2TestVar) values() interface{} {
+	switch len(v.shape) {
+	case 1:
+		o := make([]float32, v.shape[0])
+		for i := range o {
+			o[i] = float32(v.vals[i])
+		}
+		return o
+	case 3:
+		o := make([][][]float32, v.shape[0])
+		for t := range o {
+			o[t] = make([][]float32, v.shape[1])
+			for j := range o[t] {
+				o[t][j] = make([]float32, v.shape[2])
+				for i := range o[t][j] {
+					o[t][j][i] = float32(v.vals[(t*v.shape[1]+j)*v.shape[2]+i])
+				}
+			}
+		}
+		return o
+	case 4:
+		o := make([][][][]float32, v.shape[0])
+		for t := range o {
+			o[t] = make([][][]float32, v.shape[1])
+			for k := range o[t] {
+				o[t][k] = make([][]float32, v.shape[2])
+				for j := range o[t][k] {
+					o[t][k][j] = make([]float32, v.shape[3])
+					for i := range o[t][k][j] {
+						o[t][k][j][i] = float32(v.vals[((t*v.shape[1]+k)*v.shape[2]+j)*v.shape[3]+i])
+					}
+				}
+			}
+		}
+		return o
+	}
+	panic(fmt.Errorf("invalid shape %v", v.shape))
+}
+
+// writeMERRA2Test writes a NetCDF-4 file with the given variables.
+func writeMERRA2Test(path string, vars map[string]merra2TestVar) error {
+	w, err := netcdf.OpenWriter(path, netcdf.KindHDF5)
+	if err != nil {
+		return err
+	}
+	for name, v := range vars {
+		var dims []string
+		switch len(v.shape) {
+		case 1:
+			dims = []string{name}
+		case 3:
+			dims = []string{"time", "lat", "lon"}
+		case 4:
+			dims = []string{"time", "lev", "lat", "lon"}
+			if v.shape[1] == 73 {
+				dims[1] = "edge"
+			}
+		}
+		if err = w.AddVar(name, ncapi.Variable{Values: v.values(), Dimensions: dims}); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// writeMERRA2 converts the GEOS-FP test files to files with the
+// names, variables, units, and layer order of the MERRA-2 collections.
+func writeMERRA2(dir string) error {
+	for _, date := range []string{"20130102", "20130103"} {
+		collections := map[string]map[string]merra2TestVar{
+			"inst3_3d_asm_Nv": {}, "tavg1_2d_flx_Nx": {}, "tavg1_2d_rad_Nx": {},
+			"tavg1_2d_lnd_Nx": {}, "tavg3_3d_mst_Ne": {},
+		}
+		for _, v := range []struct {
+			collection, geosCollection, name string
+			flip                             bool
+		}{
+			{"inst3_3d_asm_Nv", "I3", "lat", false},
+			{"inst3_3d_asm_Nv", "I3", "lon", false},
+			{"inst3_3d_asm_Nv", "I3", "T", true},
+			{"inst3_3d_asm_Nv", "A3dyn", "U", true},
+			{"inst3_3d_asm_Nv", "A3dyn", "V", true},
+			{"inst3_3d_asm_Nv", "A3dyn", "OMEGA", true},
+			{"inst3_3d_asm_Nv", "A3cld", "QL", true},
+			{"inst3_3d_asm_Nv", "A3cld", "CLOUD", true},
+			{"tavg1_2d_flx_Nx", "A1", "PBLH", false},
+			{"tavg1_2d_flx_Nx", "A1", "USTAR", false},
+			{"tavg1_2d_flx_Nx", "A1", "HFLUX", false},
+			{"tavg1_2d_flx_Nx", "A1", "Z0M", false},
+			{"tavg1_2d_rad_Nx", "A1", "SWGDN", false},
+			{"tavg1_2d_lnd_Nx", "A1", "FRSNO", false},
+			{"tavg3_3d_mst_Ne", "A3mstE", "PFLCU", true},
+			{"tavg3_3d_mst_Ne", "A3mstE", "PFLLSAN", true},
+		} {
+			data, err := readGEOSFPTest(date, v.geosCollection, v.name)
+			if err != nil {
+				return err
+			}
+			if v.flip {
+				data = data.flip()
+			}
+			collections[v.collection][v.name] = data
+		}
+
+		// Absorbed longwave radiation is the sum of the net and
+		// emitted radiation.
+		lwgnt, err := readGEOSFPTest(date, "A1", "LWGNT")
+		if err != nil {
+			return err
+		}
+		lwtup, err := readGEOSFPTest(date, "A1", "LWTUP")
+		if err != nil {
+			return err
+		}
+		for i := range lwgnt.vals {
+			lwgnt.vals[i] += lwtup.vals[i]
+		}
+		collections["tavg1_2d_rad_Nx"]["LWGAB"] = lwgnt
+
+		// The land surface diagnostics are undefined over water.
+		collections["tavg1_2d_lnd_Nx"]["FRSNO"].vals[0] = 1.e15
+
+		// MERRA-2 surface pressure is in Pa and includes the
+		// pressure thickness of each layer rather than the hybrid
+		// grid parameters.
+		ps, err := readGEOSFPTest(date, "I3", "PS")
+		if err != nil {
+			return err
+		}
+		ap, err := readGEOSFPTest(date, "", "ap")
+		if err != nil {
+			return err
+		}
+		bp, err := readGEOSFPTest(date, "", "bp")
+		if err != nil {
+			return err
+		}
+		nt, nz, n := ps.shape[0], 72, ps.shape[1]*ps.shape[2]
+		delp := merra2TestVar{vals: make([]float64, nt*nz*n), shape: []int{nt, nz, ps.shape[1], ps.shape[2]}}
+		for t := 0; t < nt; t++ {
+			for k := 0; k < nz; k++ {
+				for i := 0; i < n; i++ {
+					s := ps.vals[t*n+i]
+					delp.vals[(t*nz+k)*n+i] = ((ap.vals[k] + bp.vals[k]*s) - (ap.vals[k+1] + bp.vals[k+1]*s)) * 100
+				}
+			}
+		}
+		collections["inst3_3d_asm_Nv"]["DELP"] = delp.flip()
+		for i := range ps.vals {
+			ps.vals[i] *= 100
+		}
+		collections["inst3_3d_asm_Nv"]["PS"] = ps
+
+		for collection, vars := range collections {
+			path := filepath.Join(dir, fmt.Sprintf("MERRA2_400.%s.%s.nc4", collection, date))
+			if err := writeMERRA2Test(path, vars); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func newMERRA2Test(dir string, chem ChemistrySource) (*MERRA2, error) {
+	return NewMERRA2(
+		filepath.Join(dir, "MERRA2_400.inst3_3d_asm_Nv.[DATE].nc4"),
+		filepath.Join(dir, "MERRA2_400.tavg1_2d_flx_Nx.[DATE].nc4"),
+		filepath.Join(dir, "MERRA2_400.tavg1_2d_rad_Nx.[DATE].nc4"),
+		filepath.Join(dir, "MERRA2_400.tavg1_2d_lnd_Nx.[DATE].nc4"),
+		filepath.Join(dir, "MERRA2_400.tavg3_3d_mst_Ne.[DATE].nc4"),
+		"cmd/inmap/testdata/preproc/geoschem-new/Olson_2001_Land_Map.025x025.generic.nc",
+		"20130102",
+		"20130104",
+		chem,
+		nil,
+	)
+}
+
+func TestMERRA2(t *testing.T) {
+	dir, err := os.MkdirTemp("", "merra2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = writeMERRA2(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	conc := map[string]float32{
+		"BENZ": 1e-10, "ISOP": 1e-9, "ASOA1": 1e-11, "TSOA0": 1e-11, "NO": 1e-10, "NO2": 1e-9,
+		"NIT": 1e-10, "SO2": 2e-9, "SO4": 1e-9, "NH3": 1e-9, "NH4": 1e-9, "OH": 1e-13, "H2O2": 1e-9,
+	}
+	for _, date := range []string{"20130102", "20130103"} {
+		if err = writeGCHP(filepath.Join(dir, "GCHP.SpeciesConc."+date+"_0000z.nc4"), conc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gc, err := NewGCHP(
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A1.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A3cld.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A3dyn.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].I3.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A3mstE.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.ApBp.nc",
+		filepath.Join(dir, "GCHP.SpeciesConc.[DATE]z.nc4"),
+		"cmd/inmap/testdata/preproc/geoschem-new/Olson_2001_Land_Map.025x025.generic.nc",
+		"20130102",
+		"20130104",
+		"3h",
+		"24h",
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newMERRA2Test(dir, gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nz, _ := m.Nz(); nz != 72 {
+		t.Errorf("nz: have %d, want 72", nz)
+	}
+
+	want, err := Preprocess(gc, -2.5, 50, 2.5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := Preprocess(m, -2.5, 50, 2.5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The meteorology is the same as for the GCHP preprocessor, which
+	// reads the same meteorology from the GEOS-FP files.
+	for _, v := range []string{"UAvg", "VAvg", "WAvg", "LayerHeights", "Dz", "Pblh", "Temperature",
+		"WindSpeed", "alt", "Kzz", "ParticleWetDep", "SO2oxidation", "ParticleDryDep",
+		"gS", "pS", "aOrgPartitioning", "NOPartitioning", "TotalPM25"} {
+		w, h := want.Data[v].Data, have.Data[v].Data
+		for i, wv := range w.Elements {
+			if d := math.Abs(h.Elements[i] - wv); d > 1.e-4*math.Abs(wv) && d > 1.e-10 {
+				t.Errorf("%s[%d]: have %g, want %g", v, i, h.Elements[i], wv)
+				break
+			}
+		}
+	}
+
+	// Chemistry on a different grid causes an error.
+	gc47, err := NewGEOSChem(
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A1.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A3cld.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A3dyn.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].I3.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A3mstE.2x25.nc",
+		"",
+		"cmd/inmap/testdata/preproc/gc_output.[DATE].nc",
+		"cmd/inmap/testdata/preproc/geoschem-new/Olson_2001_Land_Map.025x025.generic.nc",
+		"20130102",
+		"20130104",
+		true,
+		"3h",
+		"3h",
+		true,
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.chem = gc47
+	if _, err = m.SOx()(); err == nil {
+		t.Error("expected an error for chemistry with 47 layers")
+	}
+	if parts := m.SplitTime(2); len(parts) != 1 {
+		t.Errorf("SplitTime: have %d periods, want 1", len(parts))
+	}
+
+	snow, err := m.snowFraction()()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snow.Elements[0] != 0 {
+		t.Errorf("snow fraction fill value: have %g, want 0", snow.Elements[0])
+	}
+}
+
+func TestMERRA2Climatology(t *testing.T) {
+	dir, err := os.MkdirTemp("", "merra2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = writeMERRA2(dir); err != nil {
+		t.Fatal(err)
+	}
+	m, err := newMERRA2Test(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Preprocess(m, -2.5, 50, 2.5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alt := data.Data["alt"].Data
+	// Near-surface inverse density should be approximately that at sea level.
+	if v := alt.Get(0, 0, 0); v < 0.7 || v > 1 {
+		t.Errorf("alt: have %g, want about 0.8", v)
+	}
+	for _, test := range []struct {
+		v    string
+		want float64
+	}{
+		{v: "gS", want: climSOx},
+		{v: "pNH", want: climPNH},
+		{v: "TotalPM25", want: climTotalPM25},
+	} {
+		d := data.Data[test.v].Data
+		for i, a := range alt.Elements {
+			if want := test.want / a; math.Abs(d.Elements[i]-want) > 1.e-8*want {
+				t.Errorf("%s[%d]: have %g, want %g", test.v, i, d.Elements[i], want)
+				break
+			}
+		}
+	}
+	if have, want := data.Data["aOrgPartitioning"].Data.Get(0, 0, 0), climASOA/(climASOA+climAVOC); math.Abs(have-want) > 1.e-10 {
+		t.Errorf("aOrgPartitioning: have %g, want %g", have, want)
+	}
+	if data.Data["SO2oxidation"].Data.Max() <= 0 {
+		t.Error("SO2oxidation should be positive")
+	}
+
+	if parts := m.SplitTime(2); len(parts) != 2 {
+		t.Errorf("SplitTime: have %d periods, want 2", len(parts))
+	}
+}
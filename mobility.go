@@ -0,0 +1,326 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+)
+
+// Commute is a flow of workers from the places where they live to the
+// places where they work, which is used to calculate exposure that
+// accounts for the time that people spend away from home
+// (see MobilityResults).
+type Commute struct {
+	// Home and Work are the locations where the workers live and work,
+	// in the spatial reference of the model grid.
+	Home, Work geom.Point
+
+	// Workers is the number of workers.
+	Workers float64
+}
+
+// ReadLODES reads commutes from a LEHD Origin-Destination Employment
+// Statistics (LODES) origin-destination file, which has the columns
+// "w_geocode" and "h_geocode" with the census blocks where people work
+// and live and "S000" with the number of jobs, and locates the blocks
+// using the LODES geography crosswalk file, which has a column with the
+// block codes (e.g., "tabblk2020") and the columns "blklatdd" and
+// "blklondd" with the latitude and longitude of each block. The locations
+// are converted to gridSR, the spatial reference of the model grid.
+// Either file may be compressed with gzip, as indicated by the extension
+// ".gz".
+func ReadLODES(odFile, crosswalkFile string, gridSR *proj.SR) ([]Commute, error) {
+	type pair struct{ home, work string }
+	jobs := make(map[pair]float64)
+	blocks := make(map[string]geom.Point)
+	err := readCSVFile(odFile, func(header []string) ([]int, error) {
+		return findColumns(header, "h_geocode", "w_geocode", "S000")
+	}, func(rec []string, cols []int) error {
+		n, err := strconv.ParseFloat(rec[cols[2]], 64)
+		if err != nil {
+			return err
+		}
+		p := pair{home: rec[cols[0]], work: rec[cols[1]]}
+		jobs[p] += n
+		blocks[p.home] = geom.Point{}
+		blocks[p.work] = geom.Point{}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading LODES origin-destination file: %v", err)
+	}
+
+	lonLatSR, err := proj.Parse("+proj=longlat")
+	if err != nil {
+		return nil, err
+	}
+	t, err := lonLatSR.NewTransform(gridSR)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading LODES crosswalk file: %v", err)
+	}
+	found := make(map[string]bool, len(blocks))
+	err = readCSVFile(crosswalkFile, func(header []string) ([]int, error) {
+		var blockCol string
+		for _, h := range header {
+			if strings.HasPrefix(h, "tabblk") {
+				blockCol = h
+				break
+			}
+		}
+		if blockCol == "" {
+			return nil, fmt.Errorf("missing block code column (e.g., 'tabblk2020')")
+		}
+		return findColumns(header, blockCol, "blklondd", "blklatdd")
+	}, func(rec []string, cols []int) error {
+		id := rec[cols[0]]
+		if _, ok := blocks[id]; !ok {
+			return nil
+		}
+		lon, err := strconv.ParseFloat(rec[cols[1]], 64)
+		if err != nil {
+			return err
+		}
+		lat, err := strconv.ParseFloat(rec[cols[2]], 64)
+		if err != nil {
+			return err
+		}
+		x, y, err := t(lon, lat)
+		if err != nil {
+			return err
+		}
+		blocks[id] = geom.Point{X: x, Y: y}
+		found[id] = true
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading LODES crosswalk file: %v", err)
+	}
+
+	pairs := make([]pair, 0, len(jobs))
+	for p := range jobs {
+		for _, id := range []string{p.home, p.work} {
+			if !found[id] {
+				return nil, fmt.Errorf("inmap: census block %s in the LODES origin-destination file is not in the crosswalk file", id)
+			}
+		}
+		pairs = append(pairs, p)
+	}
+	// Sort the commutes so the results are the same every time.
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].home != pairs[j].home {
+			return pairs[i].home < pairs[j].home
+		}
+		return pairs[i].work < pairs[j].work
+	})
+	commutes := make([]Commute, len(pairs))
+	for i, p := range pairs {
+		commutes[i] = Commute{Home: blocks[p.home], Work: blocks[p.work], Workers: jobs[p]}
+	}
+	return commutes, nil
+}
+
+// readCSVFile reads the CSV file fileName, which is decompressed if it has
+// the extension ".gz". The columns function is called with the header row
+// and returns the indices of the columns that are needed, and the row
+// function is called with each of the other rows and those indices.
+func readCSVFile(fileName string, columns func(header []string) ([]int, error), row func(rec []string, cols []int) error) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.ToLower(filepath.Ext(fileName)) == ".gz" {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	for i, h := range header {
+		header[i] = strings.TrimSpace(h)
+	}
+	cols, err := columns(header)
+	if err != nil {
+		return err
+	}
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := row(rec, cols); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+}
+
+// findColumns returns the indices of the given column names in header.
+func findColumns(header []string, names ...string) ([]int, error) {
+	cols := make([]int, len(names))
+	for i, n := range names {
+		cols[i] = -1
+		for j, h := range header {
+			if h == n {
+				cols[i] = j
+				break
+			}
+		}
+		if cols[i] < 0 {
+			return nil, fmt.Errorf("missing column '%s'", n)
+		}
+	}
+	return cols, nil
+}
+
+// concentrationVariables returns the names of the model variables
+// that are pollutant concentrations.
+func concentrationVariables(m Mechanism) map[string]struct{} {
+	o := make(map[string]struct{})
+	for _, s := range m.Species() {
+		if !strings.Contains(s, "Emissions") {
+			o[s] = struct{}{}
+		}
+	}
+	for s := range baselinePolLabels {
+		o[s] = struct{}{}
+	}
+	return o
+}
+
+// MobilityResults returns the values of the output variables of o in the
+// ground-level grid cells, in the form of map[variable][row]value, where
+// the pollutant concentrations that people are exposed to account for
+// the time that they spend at work, so that the health impacts are
+// mobility-adjusted. For the residents of each grid cell, the
+// concentrations are
+//
+//	C_home + workFraction * Σ_work (workers / population) * (C_work - C_home)
+//
+// where workers are the numbers of the residents that commute to each
+// other grid cell according to commutes, population is the number of
+// residents in population type popColumn, and workFraction is the
+// fraction of time that workers spend at work. The number of commuters
+// is limited to the number of residents. Population, mortality rates,
+// and other variables are not adjusted.
+func (d *InMAP) MobilityResults(o *Outputter, commutes []Commute, popColumn string, workFraction float64) (map[string][]float64, error) {
+	if _, ok := d.PopIndices[popColumn]; !ok {
+		return nil, fmt.Errorf("inmap: mobility population type '%s' is not one of the population types", popColumn)
+	}
+	ground := *o
+	ground.allLayers = false
+	modelVals, nCells, err := d.modelValues(&ground)
+	if err != nil {
+		return nil, err
+	}
+
+	// rows holds the index of each ground-level cell in the results.
+	rows := make(map[*Cell]int)
+	for i, c := range d.cells.array() {
+		if c.Layer == 0 {
+			rows[c] = i
+		}
+	}
+	// flows holds the number of workers that live in each grid cell and
+	// work in each other grid cell.
+	flows := make(map[int]map[int]float64)
+	for _, c := range commutes {
+		home, work := d.cellAt(c.Home, rows), d.cellAt(c.Work, rows)
+		if home == nil || work == nil || home == work {
+			continue
+		}
+		h, w := rows[home], rows[work]
+		if flows[h] == nil {
+			flows[h] = make(map[int]float64)
+		}
+		flows[h][w] += c.Workers
+	}
+
+	pop := d.toArray(popColumn, 0, o.m)
+	concentrations := concentrationVariables(o.m)
+	for name, v := range modelVals {
+		if _, ok := concentrations[name]; !ok {
+			continue
+		}
+		x := v.([]float64)
+		adjusted := make([]float64, len(x))
+		copy(adjusted, x)
+		for h, work := range flows {
+			if pop[h] <= 0 {
+				continue
+			}
+			var workers float64
+			for _, n := range work {
+				workers += n
+			}
+			residents := pop[h]
+			if workers > residents {
+				residents = workers
+			}
+			for w, n := range work {
+				adjusted[h] += workFraction * n / residents * (x[w] - x[h])
+			}
+		}
+		modelVals[name] = adjusted
+	}
+	return ground.evaluate(modelVals, nCells)
+}
+
+// OutputMobility returns a function that writes the mobility-adjusted
+// values of the output variables of o (see MobilityResults) in the
+// ground-level grid cells to fileName, which can be any of the file types
+// supported by Output. SR is the spatial reference of the model grid.
+func (o *Outputter) OutputMobility(sr *proj.SR, commutes []Commute, popColumn string, workFraction float64, fileName string) DomainManipulator {
+	return func(d *InMAP) error {
+		results, err := d.MobilityResults(o, commutes, popColumn, workFraction)
+		if err != nil {
+			return err
+		}
+		var nCells int
+		for _, r := range results {
+			nCells = len(r)
+			break
+		}
+		cells := d.cells.array()[0:nCells]
+		if !IsPostGISURL(fileName) && !isGeoParquet(fileName) && !isKML(fileName) {
+			fileName = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".shp"
+		}
+		return writeGridResults(fileName, sr, cells, results)
+	}
+}
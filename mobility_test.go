@@ -0,0 +1,185 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap_test
+
+import (
+	"compress/gzip"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/science/chem/simplechem"
+)
+
+func TestReadLODES(t *testing.T) {
+	dir, err := os.MkdirTemp("", "lodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sr, err := proj.Parse(inmap.TestGridSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	odFile := filepath.Join(dir, "od.csv")
+	od := "w_geocode,h_geocode,S000,SA01\n" +
+		"2,1,10,5\n" +
+		"2,1,5,1\n" +
+		"1,2,3,1\n"
+	if err := os.WriteFile(odFile, []byte(od), 0644); err != nil {
+		t.Fatal(err)
+	}
+	crosswalkFile := filepath.Join(dir, "xwalk.csv.gz")
+	f, err := os.Create(crosswalkFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gzip.NewWriter(f)
+	if _, err := w.Write([]byte("tabblk2020,blklatdd,blklondd\n1,40,-97\n2,40,-96\n3,41,-97\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	commutes, err := inmap.ReadLODES(odFile, crosswalkFile, sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commutes) != 2 {
+		t.Fatalf("have %d commutes, want 2", len(commutes))
+	}
+	c := commutes[0]
+	if c.Workers != 15 || math.Abs(c.Home.X) > 1.e-6 || math.Abs(c.Home.Y) > 1.e-6 || !(c.Work.X > 0) {
+		t.Errorf("invalid commute %+v", c)
+	}
+	if commutes[1].Workers != 3 || commutes[1].Work != c.Home || commutes[1].Home != c.Work {
+		t.Errorf("invalid commute %+v", commutes[1])
+	}
+
+	// Blocks that are not in the crosswalk are an error.
+	if err := os.WriteFile(odFile, []byte(od+"4,1,1,1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inmap.ReadLODES(odFile, crosswalkFile, sr); err == nil {
+		t.Error("missing block should cause an error")
+	}
+}
+
+func TestMobilityResults(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := inmap.VarGridTestData()
+	emis := inmap.NewEmissions()
+	var m simplechem.Mechanism
+
+	d := &inmap.InMAP{
+		InitFuncs: []inmap.DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	o, err := inmap.NewOutputter("", false, map[string]string{
+		"PM":       "PrimaryPM25",
+		"TotalPop": "TotalPop",
+	}, nil, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	residential, err := d.Results(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Find a populated ground-level cell to live in and another
+	// ground-level cell to work in, which has a higher concentration.
+	home, work := -1, -1
+	cells := d.Cells()
+	for i, p := range residential["TotalPop"] {
+		if cells[i].Layer != 0 {
+			continue
+		}
+		if home < 0 && p > 0 {
+			home = i
+		} else if work < 0 {
+			work = i
+		}
+	}
+	if home < 0 || work < 0 {
+		t.Fatal("not enough ground-level cells")
+	}
+	for i := range cells[work].Cf {
+		cells[work].Cf[i] = 10
+	}
+	homePop := residential["TotalPop"][home]
+
+	commutes := []inmap.Commute{
+		{Home: cells[home].Centroid(), Work: cells[work].Centroid(), Workers: homePop / 2},
+		{Home: cells[home].Centroid(), Work: geom.Point{X: 1.e8, Y: 1.e8}, Workers: homePop},
+	}
+	r, err := d.MobilityResults(o, commutes, "TotalPop", 0.24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 0.24 * 0.5 * 10; math.Abs(r["PM"][home]-want) > 1.e-10 {
+		t.Errorf("home: have %g, want %g", r["PM"][home], want)
+	}
+	if r["PM"][work] != 10 {
+		t.Errorf("work: have %g, want 10", r["PM"][work])
+	}
+	if r["TotalPop"][home] != homePop {
+		t.Errorf("population should not change: have %g, want %g", r["TotalPop"][home], homePop)
+	}
+
+	// The number of commuters is limited to the number of residents.
+	commutes[0].Workers = 4 * homePop
+	r, err = d.MobilityResults(o, commutes, "TotalPop", 0.24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 0.24 * 10; math.Abs(r["PM"][home]-want) > 1.e-10 {
+		t.Errorf("home: have %g, want %g", r["PM"][home], want)
+	}
+
+	if _, err := d.MobilityResults(o, commutes, "xxx", 0.24); err == nil {
+		t.Error("invalid population type should cause an error")
+	}
+
+	dir, err := os.MkdirTemp("", "mobility")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sr, err := proj.Parse(inmap.TestGridSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.OutputMobility(sr, commutes, "TotalPop", 0.24, filepath.Join(dir, "mobility.shp"))(d); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "mobility.dbf")); err != nil {
+		t.Error(err)
+	}
+}
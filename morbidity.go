@@ -0,0 +1,92 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import "fmt"
+
+// MorbidityEndpoint specifies a health endpoint other than premature
+// mortality, such as asthma emergency room visits, preterm births, or
+// dementia hospital admissions, for which the number of cases caused by
+// the change in concentrations is calculated
+// (see MorbidityOutputVariables).
+type MorbidityEndpoint struct {
+	// Name is the name of the endpoint, such as "Asthma". It is also
+	// the name of the output variable with the number of cases of the
+	// endpoint, so it can be no longer than 10 characters.
+	Name string
+
+	// HazardRatio is an output expression for the relative risk of the
+	// endpoint caused by the change in concentrations, which usually
+	// uses one of the concentration-response functions for the endpoint,
+	// for example "Mar2010AsthmaER(PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA)".
+	HazardRatio string
+
+	// PopColumn is the field in the census file that contains the
+	// population at risk, for example the number of children for an
+	// endpoint that only affects children.
+	PopColumn string
+
+	// IncidenceColumn is the field in the mortality rate file that
+	// contains the baseline incidence rate of the endpoint, in units of
+	// cases per year per 100,000 people in PopColumn.
+	IncidenceColumn string
+}
+
+// addMorbidityColumns adds the population and incidence rate columns of
+// the morbidity endpoints in c to CensusPopColumns and
+// MortalityRateColumns, if they are not already included, so that they
+// are loaded into the grid.
+func (c *VarGridConfig) addMorbidityColumns() {
+	for _, e := range c.MorbidityEndpoints {
+		c.addRateColumn(e.IncidenceColumn, e.PopColumn)
+	}
+}
+
+// MorbidityOutputVariables returns output variable expressions (see
+// NewOutputter) for the number of cases per year of each of the given
+// morbidity endpoints, named after the endpoints.
+func MorbidityOutputVariables(endpoints []MorbidityEndpoint) (map[string]string, error) {
+	if len(endpoints) == 0 {
+		return nil, nil
+	}
+	o := make(map[string]string)
+	for i, e := range endpoints {
+		if e.Name == "" || e.HazardRatio == "" || e.PopColumn == "" || e.IncidenceColumn == "" {
+			return nil, fmt.Errorf("inmap: morbidity endpoint %d is missing its name, hazard ratio, population column, or incidence column", i)
+		}
+		o[e.Name] = fmt.Sprintf("(%s - 1) * %s * %s / 100000", e.HazardRatio, e.PopColumn, e.IncidenceColumn)
+	}
+	return o, nil
+}
+
+// MorbidityEndpoints returns the predefined morbidity endpoints, whose
+// hazard ratios are calculated from total PM2.5 concentrations using
+// the morbidity concentration-response functions in package epi:
+// "Asthma" (asthma emergency room visits), "Dementia" (dementia hospital
+// admissions), and "Preterm" (preterm births). They use the "TotalPop"
+// population column and the incidence rate columns "AsthmaInc",
+// "DementInc", and "PretermInc", which can be changed as needed.
+func MorbidityEndpoints() []MorbidityEndpoint {
+	const pm25 = "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA"
+	return []MorbidityEndpoint{
+		{Name: "Asthma", HazardRatio: "Mar2010AsthmaER(" + pm25 + ")", PopColumn: "TotalPop", IncidenceColumn: "AsthmaInc"},
+		{Name: "Dementia", HazardRatio: "Kioumourtzoglou2016Dementia(" + pm25 + ")", PopColumn: "TotalPop", IncidenceColumn: "DementInc"},
+		{Name: "Preterm", HazardRatio: "Sun2015PretermBirth(" + pm25 + ")", PopColumn: "TotalPop", IncidenceColumn: "PretermInc"},
+	}
+}
@@ -0,0 +1,65 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Knetic/govaluate"
+)
+
+func TestMorbidityOutputVariables(t *testing.T) {
+	endpoints := MorbidityEndpoints()
+	endpoints[1].PopColumn = "Pop65Plus"
+	vars, err := MorbidityOutputVariables(endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"Asthma":   "(Mar2010AsthmaER(PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA) - 1) * TotalPop * AsthmaInc / 100000",
+		"Dementia": "(Kioumourtzoglou2016Dementia(PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA) - 1) * Pop65Plus * DementInc / 100000",
+		"Preterm":  "(Sun2015PretermBirth(PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA) - 1) * TotalPop * PretermInc / 100000",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("have %v, want %v", vars, want)
+	}
+
+	// The expressions should only use functions that are available.
+	funcs := defaultOutputFunctions()
+	for k, v := range vars {
+		if _, err := govaluate.NewEvaluableExpressionWithFunctions(v, funcs); err != nil {
+			t.Errorf("%s: %v", k, err)
+		}
+	}
+
+	if _, err := MorbidityOutputVariables([]MorbidityEndpoint{{Name: "x", HazardRatio: "1"}}); err == nil {
+		t.Error("missing columns should cause an error")
+	}
+
+	c := VarGridConfig{MorbidityEndpoints: endpoints}
+	c.addMorbidityColumns()
+	wantPop := []string{"TotalPop", "Pop65Plus"}
+	if !reflect.DeepEqual(c.CensusPopColumns, wantPop) {
+		t.Errorf("pop columns: have %v, want %v", c.CensusPopColumns, wantPop)
+	}
+	if c.MortalityRateColumns["DementInc"] != "Pop65Plus" {
+		t.Errorf("mortality columns: %v", c.MortalityRateColumns)
+	}
+}
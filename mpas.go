@@ -0,0 +1,665 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/ctessum/geom/proj"
+	"github.com/ctessum/sparse"
+)
+
+// mpasFormat is the date format used in MPAS output file names.
+const mpasFormat = "2006-01-02_15.04.05"
+
+// MPAS is an InMAP preprocessor for output from the atmospheric component
+// of the Model for Prediction Across Scales (MPAS-A). The unstructured
+// Voronoi mesh is regridded to a regular grid with nx by ny cells of size
+// dx by dy, with its lower-left corner at (xo, yo) in the
+// spatial reference gridProj.
+//
+// Chemical variables are expected to be in the MPAS output with the same
+// names and units as in the WRF-Cmaq preprocessor (e.g., aVOC, gS, pNO,
+// TotalPM25, oh, h2o2).
+type MPAS struct {
+	mpasOut string
+
+	start, end time.Time
+
+	recordDelta, fileDelta time.Duration
+
+	regrid *mpasRegridder
+
+	// landUse converts the ivgtyp land use categories to
+	// deposition categories.
+	landUse LandUseTable
+
+	msgChan chan string
+}
+
+// NewMPAS initializes an MPAS preprocessor from the given
+// configuration information.
+// MPASOut is the location of MPAS output files.
+// [DATE] should be used as a wild card for the simulation date,
+// in the format "YYYY-MM-DD_hh.mm.ss".
+// gridProj, xo, yo, dx, dy, nx, and ny define the regular grid that the
+// MPAS mesh should be regridded to.
+// interpolation is the method used to regrid continuous variables.
+// It can be "nearest" for nearest-neighbor interpolation or "idw"
+// for inverse-distance weighting of the nearest mesh cells. Categorical
+// variables such as land use are always regridded using the nearest
+// neighbor.
+// startDate and endDate are the dates of the beginning and end of the
+// simulation, respectively, in the format "YYYYMMDD".
+// recordDelta and fileDelta are the time intervals between output records
+// and output files, respectively, e.g. "6h". fileDelta can also be
+// "monthly", and either can be "auto" to detect it from the xtime
+// variable in the first output file.
+// If msgChan is not nil, status messages will be sent to it.
+func NewMPAS(MPASOut, gridProj string, xo, yo, dx, dy float64, nx, ny int, interpolation,
+	startDate, endDate, recordDelta, fileDelta string, msgChan chan string) (*MPAS, error) {
+	m := MPAS{
+		mpasOut: MPASOut,
+		landUse: modisLandUse,
+		msgChan: msgChan,
+	}
+
+	var err error
+	m.start, err = time.Parse(inDateFormat, startDate)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: MPAS preprocessor start time: %v", err)
+	}
+	m.end, err = time.Parse(inDateFormat, endDate)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: MPAS preprocessor end time: %v", err)
+	}
+	if recordDelta == "" || fileDelta == "" {
+		return nil, fmt.Errorf("inmap: MPAS preprocessor: recordDelta and fileDelta must be specified")
+	}
+	m.recordDelta, m.fileDelta, err = timeIntervals(recordDelta, fileDelta, 0, 0, func() (ncfFile, error) {
+		return ncfFromTemplate(m.mpasOut, mpasFormat, m.start)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("inmap: MPAS preprocessor: %v", err)
+	}
+
+	ff, err := ncfFromTemplate(m.mpasOut, mpasFormat, m.start)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: MPAS preprocessor: %v", err)
+	}
+	defer ff.Close()
+	latCell, err := readMPASRaw("latCell", ff, 0)
+	if err != nil {
+		return nil, err
+	}
+	lonCell, err := readMPASRaw("lonCell", ff, 0)
+	if err != nil {
+		return nil, err
+	}
+	nz := ff.Lengths("theta")
+	if len(nz) != 3 {
+		return nil, fmt.Errorf("inmap: MPAS preprocessor: variable theta not in file")
+	}
+	m.regrid, err = newMPASRegridder(latCell.Elements, lonCell.Elements, gridProj,
+		xo, yo, dx, dy, nx, ny, nz[2], interpolation)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// SetLandUseTable sets the table used to convert the ivgtyp land use
+// categories to deposition categories. By default, the 20-category
+// "MODIS" table is used.
+func (m *MPAS) SetLandUseTable(t LandUseTable) { m.landUse = t }
+
+// readMPASRaw reads variable varName from MPAS output file ff at the given
+// time index, without regridding. Variables without a time dimension
+// are read in their entirety.
+func readMPASRaw(varName string, ff ncfFile, index int) (*sparse.DenseArray, error) {
+	dims := ff.Lengths(varName)
+	if len(dims) == 0 {
+		return nil, fmt.Errorf("inmap: preprocessor read MPAS: variable %v not in file", varName)
+	}
+	dimNames := ff.Dimensions(varName)
+	start, end := make([]int, len(dims)), make([]int, len(dims))
+	copy(end, dims)
+	if dimNames[0] == "Time" {
+		start[0], end[0] = index, index+1
+		dims = dims[1:]
+	}
+	buf, err := ff.Read(varName, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: preprocessor read MPAS variable %s: %v", varName, err)
+	}
+	vals, err := ncfFloats(buf)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: preprocessor read MPAS variable %s: %v", varName, err)
+	}
+	data := sparse.ZerosDense(dims...)
+	copy(data.Elements, vals)
+	return data, nil
+}
+
+func (m *MPAS) read(varName string) NextData {
+	return nextDataNCF(m.mpasOut, mpasFormat, varName, m.start, m.end, m.recordDelta, m.fileDelta,
+		func(varName string, ff ncfFile, index int) (*sparse.DenseArray, error) {
+			data, err := readMPASRaw(varName, ff, index)
+			if err != nil {
+				return nil, err
+			}
+			return m.regrid.regrid(data, false)
+		}, m.msgChan)
+}
+
+// readCategory reads a categorical variable, which is regridded
+// using the nearest neighbor.
+func (m *MPAS) readCategory(varName string) NextData {
+	return nextDataNCF(m.mpasOut, mpasFormat, varName, m.start, m.end, m.recordDelta, m.fileDelta,
+		func(varName string, ff ncfFile, index int) (*sparse.DenseArray, error) {
+			data, err := readMPASRaw(varName, ff, index)
+			if err != nil {
+				return nil, err
+			}
+			return m.regrid.regrid(data, true)
+		}, m.msgChan)
+}
+
+// Nx helps fulfill the Preprocessor interface by returning
+// the number of grid cells in the West-East direction.
+func (m *MPAS) Nx() (int, error) { return m.regrid.nx, nil }
+
+// Ny helps fulfill the Preprocessor interface by returning
+// the number of grid cells in the South-North direction.
+func (m *MPAS) Ny() (int, error) { return m.regrid.ny, nil }
+
+// Nz helps fulfill the Preprocessor interface by returning
+// the number of grid cells in the below-above direction.
+func (m *MPAS) Nz() (int, error) { return m.regrid.nz, nil }
+
+// PBLH helps fulfill the Preprocessor interface by returning
+// planetary boundary layer height [m].
+func (m *MPAS) PBLH() NextData { return m.read("hpbl") }
+
+// Height helps fulfill the Preprocessor interface by returning
+// layer heights above ground level, calculated
+// from the geometric height of layer interfaces.
+func (m *MPAS) Height() NextData {
+	zFunc := m.read("zgrid") // height of layer interfaces above sea level [m]
+	return func() (*sparse.DenseArray, error) {
+		z, err := zFunc()
+		if err != nil {
+			return nil, err
+		}
+		h := sparse.ZerosDense(z.Shape...)
+		for k := 0; k < z.Shape[0]; k++ {
+			for j := 0; j < z.Shape[1]; j++ {
+				for i := 0; i < z.Shape[2]; i++ {
+					h.Set(z.Get(k, j, i)-z.Get(0, j, i), k, j, i)
+				}
+			}
+		}
+		return h, nil
+	}
+}
+
+// ALT helps fulfill the Preprocessor interface by returning
+// inverse air density [m3/kg].
+func (m *MPAS) ALT() NextData {
+	rhoFunc := m.read("rho") // dry air density [kg/m3]
+	return func() (*sparse.DenseArray, error) {
+		rho, err := rhoFunc()
+		if err != nil {
+			return nil, err
+		}
+		alt := sparse.ZerosDense(rho.Shape...)
+		for i, v := range rho.Elements {
+			alt.Elements[i] = 1 / v
+		}
+		return alt, nil
+	}
+}
+
+// U helps fulfill the Preprocessor interface by returning
+// West-East wind speed [m/s], relative to the output grid.
+func (m *MPAS) U() NextData {
+	return stagger(m.gridWind(true), 2)
+}
+
+// V helps fulfill the Preprocessor interface by returning
+// South-North wind speed [m/s], relative to the output grid.
+func (m *MPAS) V() NextData {
+	return stagger(m.gridWind(false), 1)
+}
+
+// gridWind returns a horizontal wind component at cell centers,
+// rotated from true east and north to the output grid x (if x is true)
+// or y direction.
+func (m *MPAS) gridWind(x bool) NextData {
+	zonalFunc := m.read("uReconstructZonal")
+	meridionalFunc := m.read("uReconstructMeridional")
+	return func() (*sparse.DenseArray, error) {
+		zonal, err := zonalFunc()
+		if err != nil {
+			return nil, err
+		}
+		meridional, err := meridionalFunc()
+		if err != nil {
+			return nil, err
+		}
+		u, v := m.regrid.rotate(zonal, meridional)
+		if x {
+			return u, nil
+		}
+		return v, nil
+	}
+}
+
+// W helps fulfill the Preprocessor interface by returning
+// below-above wind speed [m/s].
+func (m *MPAS) W() NextData { return m.read("w") }
+
+// AVOC helps fulfill the Preprocessor interface.
+func (m *MPAS) AVOC() NextData { return m.read("aVOC") }
+
+// BVOC helps fulfill the Preprocessor interface.
+func (m *MPAS) BVOC() NextData { return m.read("bVOC") }
+
+// NOx helps fulfill the Preprocessor interface.
+func (m *MPAS) NOx() NextData { return m.read("gNO") }
+
+// SOx helps fulfill the Preprocessor interface.
+func (m *MPAS) SOx() NextData { return m.read("gS") }
+
+// NH3 helps fulfill the Preprocessor interface.
+func (m *MPAS) NH3() NextData { return m.read("gNH") }
+
+// ASOA helps fulfill the Preprocessor interface.
+func (m *MPAS) ASOA() NextData { return m.read("aSOA") }
+
+// BSOA helps fulfill the Preprocessor interface.
+func (m *MPAS) BSOA() NextData { return m.read("bSOA") }
+
+// PNO helps fulfill the Preprocessor interface.
+func (m *MPAS) PNO() NextData { return m.read("pNO") }
+
+// PS helps fulfill the Preprocessor interface.
+func (m *MPAS) PS() NextData { return m.read("pS") }
+
+// PNH helps fulfill the Preprocessor interface.
+func (m *MPAS) PNH() NextData { return m.read("pNH") }
+
+// TotalPM25 helps fulfill the Preprocessor interface.
+func (m *MPAS) TotalPM25() NextData { return m.read("TotalPM25") }
+
+// SurfaceHeatFlux helps fulfill the Preprocessor interface
+// by returning heat flux at the surface [W/m2].
+func (m *MPAS) SurfaceHeatFlux() NextData { return m.read("hfx") }
+
+// UStar helps fulfill the Preprocessor interface
+// by returning friction velocity [m/s].
+func (m *MPAS) UStar() NextData { return m.read("ust") }
+
+// T helps fulfill the Preprocessor interface by
+// returning temperature [K].
+func (m *MPAS) T() NextData {
+	thetaFunc := m.read("theta") // potential temperature [K]
+	pFunc := m.P()
+	return func() (*sparse.DenseArray, error) {
+		theta, err := thetaFunc()
+		if err != nil {
+			return nil, err
+		}
+		p, err := pFunc()
+		if err != nil {
+			return nil, err
+		}
+		const (
+			po    = 100000. // Pa, reference pressure
+			kappa = 0.2854
+		)
+		T := sparse.ZerosDense(theta.Shape...)
+		for i, θ := range theta.Elements {
+			T.Elements[i] = θ * math.Pow(p.Elements[i]/po, kappa)
+		}
+		return T, nil
+	}
+}
+
+// P helps fulfill the Preprocessor interface
+// by returning pressure [Pa].
+func (m *MPAS) P() NextData { return m.read("pressure") }
+
+// HO helps fulfill the Preprocessor interface
+// by returning hydroxyl radical concentration [ppmv].
+func (m *MPAS) HO() NextData { return m.read("oh") }
+
+// H2O2 helps fulfill the Preprocessor interface
+// by returning hydrogen peroxide concentration [ppmv].
+func (m *MPAS) H2O2() NextData { return m.read("h2o2") }
+
+// O3 helps fulfill the Preprocessor interface
+// by returning ozone concentration [ppmv].
+func (m *MPAS) O3() NextData { return m.read("o3") }
+
+// HNO3 helps fulfill the Preprocessor interface
+// by returning nitric acid concentration [ppmv].
+func (m *MPAS) HNO3() NextData { return m.read("hno3") }
+
+// RH helps fulfill the Preprocessor interface
+// by returning relative humidity [fraction].
+func (m *MPAS) RH() NextData { return relativeHumidity(m.read("qv"), m.T(), m.P()) }
+
+// SeinfeldLandUse helps fulfill the Preprocessor interface
+// by returning land use categories as
+// specified in github.com/ctessum/atmos/seinfeld.
+func (m *MPAS) SeinfeldLandUse() NextData {
+	return cmaqSeinfeldLandUse(m.readCategory("ivgtyp"), m.landUse)
+}
+
+// WeselyLandUse helps fulfill the Preprocessor interface
+// by returning land use categories as
+// specified in github.com/ctessum/atmos/wesely1989.
+func (m *MPAS) WeselyLandUse() NextData {
+	return cmaqWeselyLandUse(m.readCategory("ivgtyp"), m.landUse)
+}
+
+// Z0 helps fulfill the Preprocessor interface by
+// returning surface roughness length [m].
+func (m *MPAS) Z0() NextData { return m.read("znt") }
+
+// QRain helps fulfill the Preprocessor interface by
+// returning rain mass fraction [kg/kg].
+func (m *MPAS) QRain() NextData { return m.read("qr") }
+
+// CloudFrac helps fulfill the Preprocessor interface
+// by returning the fraction of each grid cell filled
+// with clouds [volume/volume].
+func (m *MPAS) CloudFrac() NextData { return m.read("cldfrac") }
+
+// QCloud helps fulfill the Preprocessor interface by returning
+// cloud water mixing ratio [kg/kg].
+func (m *MPAS) QCloud() NextData { return m.read("qc") }
+
+// RadiationDown helps fulfill the Preprocessor interface by returning
+// total downwelling radiation at ground level [W/m2].
+func (m *MPAS) RadiationDown() NextData {
+	return cmaqRadiationDown(m.read("swdnb"), m.read("lwdnb"))
+}
+
+// mpasRegridder regrids data from an unstructured MPAS mesh
+// to a regular grid.
+type mpasRegridder struct {
+	nx, ny, nz int
+
+	// nearest is the index of the nearest mesh cell to each grid cell.
+	nearest []int
+
+	// index and weight are the mesh cell indices and interpolation
+	// weights for each grid cell.
+	index  [][]int
+	weight [][]float64
+
+	// sinAngle and cosAngle are the sine and cosine of the angle between
+	// true north and the grid y-axis at each grid cell.
+	sinAngle, cosAngle []float64
+}
+
+// mpasIDWNeighbors is the number of mesh cells used for
+// inverse distance weighted interpolation.
+const mpasIDWNeighbors = 4
+
+// newMPASRegridder creates a regridder from the mesh
+// with cell centers at latCell and lonCell [radians] to the
+// specified grid.
+func newMPASRegridder(latCell, lonCell []float64, gridProj string, xo, yo, dx, dy float64,
+	nx, ny, nz int, interpolation string) (*mpasRegridder, error) {
+	var k int
+	switch interpolation {
+	case "nearest":
+		k = 1
+	case "idw":
+		k = mpasIDWNeighbors
+	default:
+		return nil, fmt.Errorf("inmap: MPAS preprocessor: invalid interpolation method '%s'; "+
+			"valid options are 'nearest' and 'idw'", interpolation)
+	}
+	if nx <= 0 || ny <= 0 {
+		return nil, fmt.Errorf("inmap: MPAS preprocessor: invalid grid size %dx%d", nx, ny)
+	}
+	gridSR, err := proj.Parse(gridProj)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: MPAS preprocessor: parsing grid projection: %v", err)
+	}
+	lonLatSR, err := proj.Parse("+proj=longlat")
+	if err != nil {
+		return nil, err
+	}
+	toLonLat, err := gridSR.NewTransform(lonLatSR)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: MPAS preprocessor: %v", err)
+	}
+	fromLonLat, err := lonLatSR.NewTransform(gridSR)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: MPAS preprocessor: %v", err)
+	}
+	if toLonLat == nil { // The grid is already in longitude-latitude coordinates.
+		toLonLat = func(x, y float64) (float64, float64, error) { return x, y, nil }
+		fromLonLat = toLonLat
+	}
+
+	r := &mpasRegridder{
+		nx: nx, ny: ny, nz: nz,
+		nearest:  make([]int, nx*ny),
+		index:    make([][]int, nx*ny),
+		weight:   make([][]float64, nx*ny),
+		sinAngle: make([]float64, nx*ny),
+		cosAngle: make([]float64, nx*ny),
+	}
+	mesh := newMPASMesh(latCell, lonCell)
+	for j := 0; j < ny; j++ {
+		for i := 0; i < nx; i++ {
+			ii := j*nx + i
+			x, y := xo+(float64(i)+0.5)*dx, yo+(float64(j)+0.5)*dy
+			lon, lat, err := toLonLat(x, y)
+			if err != nil {
+				return nil, fmt.Errorf("inmap: MPAS preprocessor: %v", err)
+			}
+			// Find the direction of true north on the grid.
+			const δ = 0.01 // degrees
+			x2, y2, err := fromLonLat(lon, math.Min(lat+δ, 90))
+			if err != nil {
+				return nil, fmt.Errorf("inmap: MPAS preprocessor: %v", err)
+			}
+			a := math.Atan2(x2-x, y2-y)
+			r.sinAngle[ii], r.cosAngle[ii] = math.Sin(a), math.Cos(a)
+
+			idx, dist := mesh.nearest(lat*math.Pi/180, lon*math.Pi/180, k)
+			r.nearest[ii] = idx[0]
+			r.index[ii] = idx
+			r.weight[ii] = make([]float64, len(idx))
+			if dist[0] == 0 {
+				r.weight[ii][0] = 1
+				continue
+			}
+			var sum float64
+			for n, d := range dist {
+				r.weight[ii][n] = 1 / (d * d)
+				sum += r.weight[ii][n]
+			}
+			for n := range dist {
+				r.weight[ii][n] /= sum
+			}
+		}
+	}
+	return r, nil
+}
+
+// regrid regrids data with dimensions [nCells] or [nCells, nLevels]
+// to dimensions [ny, nx] or [nLevels, ny, nx], respectively.
+// If nearest is true, nearest-neighbor interpolation is used regardless
+// of the configured interpolation method.
+func (r *mpasRegridder) regrid(data *sparse.DenseArray, nearest bool) (*sparse.DenseArray, error) {
+	nLev := 1
+	if len(data.Shape) == 2 {
+		nLev = data.Shape[1]
+	} else if len(data.Shape) != 1 {
+		return nil, fmt.Errorf("inmap: MPAS preprocessor: invalid variable shape %v", data.Shape)
+	}
+	var out *sparse.DenseArray
+	if len(data.Shape) == 1 {
+		out = sparse.ZerosDense(r.ny, r.nx)
+	} else {
+		out = sparse.ZerosDense(nLev, r.ny, r.nx)
+	}
+	n := r.nx * r.ny
+	for ii := 0; ii < n; ii++ {
+		for k := 0; k < nLev; k++ {
+			var v float64
+			if nearest {
+				v = data.Elements[r.nearest[ii]*nLev+k]
+			} else {
+				for m, c := range r.index[ii] {
+					v += data.Elements[c*nLev+k] * r.weight[ii][m]
+				}
+			}
+			out.Elements[k*n+ii] = v
+		}
+	}
+	return out, nil
+}
+
+// rotate rotates regridded eastward and northward wind components
+// to the directions of the grid x and y axes.
+func (r *mpasRegridder) rotate(east, north *sparse.DenseArray) (u, v *sparse.DenseArray) {
+	u = sparse.ZerosDense(east.Shape...)
+	v = sparse.ZerosDense(east.Shape...)
+	n := r.nx * r.ny
+	for i, e := range east.Elements {
+		nn := north.Elements[i]
+		ii := i % n
+		u.Elements[i] = e*r.cosAngle[ii] + nn*r.sinAngle[ii]
+		v.Elements[i] = -e*r.sinAngle[ii] + nn*r.cosAngle[ii]
+	}
+	return u, v
+}
+
+// mpasMesh is a spatial index of MPAS mesh cell centers, which are binned
+// by latitude and longitude.
+type mpasMesh struct {
+	lat, lon []float64 // radians
+	binSize  float64   // radians
+	nLat     int
+	nLon     int
+	bins     map[[2]int][]int
+}
+
+func newMPASMesh(lat, lon []float64) *mpasMesh {
+	// Choose the bin size so that there are a few cells in each bin.
+	binSize := math.Sqrt(4*math.Pi/float64(len(lat))) * 2
+	m := &mpasMesh{
+		lat:     lat,
+		lon:     lon,
+		binSize: binSize,
+		nLat:    int(math.Ceil(math.Pi / binSize)),
+		nLon:    int(math.Ceil(2 * math.Pi / binSize)),
+		bins:    make(map[[2]int][]int),
+	}
+	for i := range lat {
+		b := m.bin(lat[i], lon[i])
+		m.bins[b] = append(m.bins[b], i)
+	}
+	return m
+}
+
+func (m *mpasMesh) bin(lat, lon float64) [2]int {
+	j := int((lat + math.Pi/2) / m.binSize)
+	lon = math.Mod(lon, 2*math.Pi)
+	if lon < 0 {
+		lon += 2 * math.Pi
+	}
+	i := int(lon / m.binSize)
+	if j >= m.nLat {
+		j = m.nLat - 1
+	}
+	if i >= m.nLon {
+		i = m.nLon - 1
+	}
+	return [2]int{j, i}
+}
+
+// nearest returns the indices of and great-circle distances [radians] to
+// the k mesh cells that are closest to the given location,
+// sorted by distance.
+func (m *mpasMesh) nearest(lat, lon float64, k int) ([]int, []float64) {
+	type candidate struct {
+		i int
+		d float64
+	}
+	var c []candidate
+	visited := make(map[[2]int]bool)
+	b := m.bin(lat, lon)
+	for ring := 0; ring <= m.nLat+m.nLon; ring++ {
+		for j := b[0] - ring; j <= b[0]+ring; j++ {
+			if j < 0 || j >= m.nLat {
+				continue
+			}
+			for i := b[1] - ring; i <= b[1]+ring; i++ {
+				bb := [2]int{j, ((i % m.nLon) + m.nLon) % m.nLon}
+				if visited[bb] {
+					continue
+				}
+				visited[bb] = true
+				for _, cell := range m.bins[bb] {
+					c = append(c, candidate{i: cell, d: greatCircle(lat, lon, m.lat[cell], m.lon[cell])})
+				}
+			}
+		}
+		// Any cells that haven't been checked yet are at least this
+		// far away.
+		minUnchecked := float64(ring) * m.binSize * math.Cos(math.Min(math.Abs(lat)+float64(ring+1)*m.binSize, math.Pi/2))
+		if len(c) >= k {
+			sort.Slice(c, func(a, b int) bool { return c[a].d < c[b].d })
+			if c[k-1].d <= minUnchecked {
+				break
+			}
+		}
+	}
+	sort.Slice(c, func(a, b int) bool { return c[a].d < c[b].d })
+	if len(c) > k {
+		c = c[:k]
+	}
+	idx, dist := make([]int, len(c)), make([]float64, len(c))
+	for i, cc := range c {
+		idx[i], dist[i] = cc.i, cc.d
+	}
+	return idx, dist
+}
+
+// greatCircle returns the great-circle distance
+// between two points on a unit sphere, with coordinates in radians.
+func greatCircle(lat1, lon1, lat2, lon2 float64) float64 {
+	sinLat := math.Sin((lat2 - lat1) / 2)
+	sinLon := math.Sin((lon2 - lon1) / 2)
+	a := sinLat*sinLat + math.Cos(lat1)*math.Cos(lat2)*sinLon*sinLon
+	return 2 * math.Asin(math.Min(math.Sqrt(a), 1))
+}
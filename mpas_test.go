@@ -0,0 +1,177 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ctessum/cdf"
+	"github.com/ctessum/sparse"
+)
+
+func mpasDense(v []float64) *sparse.DenseArray {
+	d := sparse.ZerosDense(len(v))
+	copy(d.Elements, v)
+	return d
+}
+
+// mpasTestMesh returns the cell centers [radians] of a test mesh
+// with cells every degree between 30°N and 50°N and 110°W and 90°W.
+func mpasTestMesh() (lat, lon []float64) {
+	for la := 30; la <= 50; la++ {
+		for lo := -110; lo <= -90; lo++ {
+			lat = append(lat, float64(la)*math.Pi/180)
+			lon = append(lon, float64(lo)*math.Pi/180)
+		}
+	}
+	return
+}
+
+// mpasTestField is a field that varies linearly in space.
+func mpasTestField(lat, lon float64) float64 {
+	return lat*180/math.Pi + 2*lon*180/math.Pi
+}
+
+func TestMPASRegrid(t *testing.T) {
+	lat, lon := mpasTestMesh()
+	data := make([]float64, len(lat))
+	for i := range lat {
+		data[i] = mpasTestField(lat[i], lon[i])
+	}
+	for _, interp := range []string{"nearest", "idw"} {
+		t.Run(interp, func(t *testing.T) {
+			// The output grid cell centers are on top of the mesh cell centers.
+			r, err := newMPASRegridder(lat, lon, "+proj=longlat", -105.5, 35.5, 1, 1, 5, 4, 1, interp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			in := mpasDense(data)
+			out, err := r.regrid(in, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j := 0; j < 4; j++ {
+				for i := 0; i < 5; i++ {
+					want := float64(36+j) + 2*float64(-105+i)
+					if have := out.Get(j, i); different(have, want, 1.e-8) {
+						t.Errorf("(%d, %d): have %g, want %g", j, i, have, want)
+					}
+				}
+			}
+			if r.cosAngle[0] != 1 || r.sinAngle[0] != 0 {
+				t.Errorf("grid should not be rotated: sin=%g, cos=%g", r.sinAngle[0], r.cosAngle[0])
+			}
+		})
+	}
+
+	t.Run("idw_between", func(t *testing.T) {
+		// The output grid cell center is equidistant from four mesh cells
+		// in latitude-longitude space.
+		r, err := newMPASRegridder(lat, lon, "+proj=longlat", -105, 40, 1, 1, 1, 1, 1, "idw")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.index[0]) != mpasIDWNeighbors {
+			t.Fatalf("have %d neighbors, want %d", len(r.index[0]), mpasIDWNeighbors)
+		}
+		out, err := r.regrid(mpasDense(data), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 40.5 + 2*-104.5
+		if have := out.Elements[0]; different(have, want, 1.e-3) {
+			t.Errorf("have %g, want %g", have, want)
+		}
+	})
+
+	if _, err := newMPASRegridder(lat, lon, "+proj=longlat", 0, 0, 1, 1, 1, 1, 1, "xxx"); err == nil {
+		t.Errorf("expected an error for an invalid interpolation method")
+	}
+}
+
+func TestMPASRead(t *testing.T) {
+	lat, lon := mpasTestMesh()
+	const nz, nsteps = 2, 2
+	dir, err := os.MkdirTemp("", "mpas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := cdf.NewHeader([]string{"Time", "nCells", "nVertLevels"}, []int{0, len(lat), nz})
+	h.AddVariable("latCell", []string{"nCells"}, []float64{0})
+	h.AddVariable("lonCell", []string{"nCells"}, []float64{0})
+	h.AddVariable("theta", []string{"Time", "nCells", "nVertLevels"}, []float32{0})
+	h.AddVariable("hpbl", []string{"Time", "nCells"}, []float32{0})
+	h.Define()
+	f, err := os.Create(filepath.Join(dir, "history.2016-01-01_00.00.00.nc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ff, err := cdf.Create(f, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ff.Writer("latCell", []int{0}, []int{len(lat)}).Write(lat); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ff.Writer("lonCell", []int{0}, []int{len(lon)}).Write(lon); err != nil {
+		t.Fatal(err)
+	}
+	theta := make([]float32, nsteps*len(lat)*nz)
+	if _, err = ff.Writer("theta", []int{0, 0, 0}, []int{nsteps, len(lat), nz}).Write(theta); err != nil {
+		t.Fatal(err)
+	}
+	pblh := make([]float32, nsteps*len(lat))
+	for step := 0; step < nsteps; step++ {
+		for i := range lat {
+			pblh[step*len(lat)+i] = float32(mpasTestField(lat[i], lon[i]) + 1000*float64(step))
+		}
+	}
+	if _, err = ff.Writer("hpbl", []int{0, 0}, []int{nsteps, len(lat)}).Write(pblh); err != nil {
+		t.Fatal(err)
+	}
+	if err = cdf.UpdateNumRecs(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	m, err := NewMPAS(filepath.Join(dir, "history.[DATE].nc"), "+proj=longlat", -105.5, 35.5, 1, 1, 5, 4,
+		"nearest", "20160101", "20160102", "12h", "24h", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nz, _ := m.Nz(); nz != 2 {
+		t.Errorf("nz: have %d, want 2", nz)
+	}
+	pblhFunc := m.PBLH()
+	for step := 0; step < nsteps; step++ {
+		data, err := pblhFunc()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 36 + 2*-105. + 1000*float64(step)
+		if have := data.Get(0, 0); different(have, want, 1.e-4) {
+			t.Errorf("step %d: have %g, want %g", step, have, want)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+
+	ncapi "github.com/batchatco/go-native-netcdf/netcdf/api"
+	"github.com/batchatco/go-native-netcdf/netcdf/hdf5"
+	"github.com/ctessum/cdf"
+)
+
+// ncfFile is a NetCDF file in either the classic (NetCDF-3) format or
+// the HDF5-based NetCDF-4 format, a Zarr store, or an OPeNDAP dataset.
+type ncfFile interface {
+	// Variables returns the names of the variables in the file.
+	Variables() []string
+
+	// Lengths returns the dimension lengths of variable varName,
+	// or nil if the variable is not in the file.
+	Lengths(varName string) []int
+
+	// Dimensions returns the dimension names of variable varName.
+	Dimensions(varName string) []string
+
+	// Attribute returns the specified attribute of variable varName,
+	// or the specified global attribute if varName is empty.
+	// Attribute values are returned as slices (e.g., []float32).
+	Attribute(varName, attribute string) interface{}
+
+	// Read reads the values of variable varName between the
+	// start and end indices, which are returned as a flat slice
+	// (e.g., []float32). If start and end are nil, the
+	// whole variable is read.
+	Read(varName string, start, end []int) (interface{}, error)
+
+	// Close closes the file.
+	Close() error
+}
+
+// openNCF opens the NetCDF file at the given path. If path is a
+// directory or a storage bucket URL with the extension ".zarr", it is
+// opened as a Zarr store, other storage bucket URLs are read from the
+// local cache in BlobCacheDir, and if it is an HTTP URL it is opened
+// as an OPeNDAP dataset.
+func openNCF(path string) (ncfFile, error) {
+	if isDAP(path) {
+		return openDAP(path)
+	}
+	if isZarr(path) {
+		return openZarr(path)
+	}
+	if isBucket(path) {
+		return openBlobNCF(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	ff, err := newNCF(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("inmap: opening NetCDF file %s: %v", path, err)
+	}
+	return ff, nil
+}
+
+// newNCF returns a ncfFile that reads from f, determining whether
+// it is in classic or NetCDF-4 format. If it does not return an error,
+// closing the returned ncfFile closes f.
+func newNCF(f *os.File) (ncfFile, error) {
+	magic := make([]byte, 4)
+	if _, err := f.ReadAt(magic, 0); err != nil {
+		return nil, err
+	}
+	switch {
+	case string(magic[0:3]) == "CDF":
+		ff, err := cdf.Open(f)
+		if err != nil {
+			return nil, err
+		}
+		return ncf3{f: f, File: ff}, nil
+	case string(magic) == "\x89HDF":
+		g, err := hdf5.New(f)
+		if err != nil {
+			return nil, err
+		}
+		return ncf4{g}, nil
+	default:
+		return nil, fmt.Errorf("not a NetCDF file")
+	}
+}
+
+// ncf3 is a classic format NetCDF file.
+type ncf3 struct {
+	f *os.File
+	*cdf.File
+}
+
+func (n ncf3) Variables() []string                { return n.Header.Variables() }
+func (n ncf3) Lengths(varName string) []int       { return n.Header.Lengths(varName) }
+func (n ncf3) Dimensions(varName string) []string { return n.Header.Dimensions(varName) }
+func (n ncf3) Close() error                       { return n.f.Close() }
+
+func (n ncf3) Attribute(varName, attribute string) interface{} {
+	return n.Header.GetAttribute(varName, attribute)
+}
+
+func (n ncf3) Read(varName string, start, end []int) (interface{}, error) {
+	r := n.Reader(varName, start, end)
+	nread := -1
+	if start != nil {
+		nread = 1
+		for i := range start {
+			nread *= end[i] - start[i]
+		}
+	}
+	buf := r.Zero(nread)
+	if _, err := r.Read(buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// ncf4 is a NetCDF-4 format file. Chunked and compressed variables
+// are supported.
+type ncf4 struct {
+	ncapi.Group
+}
+
+func (n ncf4) Variables() []string { return n.ListVariables() }
+
+func (n ncf4) Lengths(varName string) []int {
+	v, err := n.GetVarGetter(varName)
+	if err != nil {
+		return nil
+	}
+	shape := v.Shape()
+	o := make([]int, len(shape))
+	for i, s := range shape {
+		o[i] = int(s)
+	}
+	return o
+}
+
+func (n ncf4) Dimensions(varName string) []string {
+	v, err := n.GetVarGetter(varName)
+	if err != nil {
+		return nil
+	}
+	return v.Dimensions()
+}
+
+func (n ncf4) Close() error {
+	n.Group.Close()
+	return nil
+}
+
+func (n ncf4) Attribute(varName, attribute string) interface{} {
+	var attrs ncapi.AttributeMap
+	if varName == "" {
+		attrs = n.Attributes()
+	} else {
+		v, err := n.GetVarGetter(varName)
+		if err != nil {
+			return nil
+		}
+		attrs = v.Attributes()
+	}
+	val, ok := attrs.Get(attribute)
+	if !ok {
+		return nil
+	}
+	rv := reflect.ValueOf(val)
+	if rv.Kind() == reflect.Slice || rv.Kind() == reflect.String {
+		return val
+	}
+	// Return scalars as slices for consistency with classic format files.
+	s := reflect.MakeSlice(reflect.SliceOf(rv.Type()), 1, 1)
+	s.Index(0).Set(rv)
+	return s.Interface()
+}
+
+func (n ncf4) Read(varName string, start, end []int) (interface{}, error) {
+	v, err := n.GetVarGetter(varName)
+	if err != nil {
+		return nil, err
+	}
+	var vals interface{}
+	if start == nil {
+		vals, err = v.Values()
+	} else {
+		begin64, end64 := make([]int64, len(start)), make([]int64, len(end))
+		for i := range start {
+			begin64[i], end64[i] = int64(start[i]), int64(end[i])
+		}
+		vals, err = v.GetSliceMD(begin64, end64)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return flatten(vals), nil
+}
+
+// flatten converts a nested slice (e.g., [][]float32) into a
+// flat slice (e.g., []float32).
+func flatten(vals interface{}) interface{} {
+	rv := reflect.ValueOf(vals)
+	if rv.Kind() != reflect.Slice {
+		s := reflect.MakeSlice(reflect.SliceOf(rv.Type()), 1, 1)
+		s.Index(0).Set(rv)
+		return s.Interface()
+	}
+	t := rv.Type()
+	for t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if rv.Type().Elem() == t {
+		return vals // Already flat.
+	}
+	o := reflect.MakeSlice(reflect.SliceOf(t), 0, 0)
+	var f func(v reflect.Value)
+	f = func(v reflect.Value) {
+		if v.Type().Elem() == t {
+			o = reflect.AppendSlice(o, v)
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			f(v.Index(i))
+		}
+	}
+	f(rv)
+	return o.Interface()
+}
+
+// ncfFloats converts values read from a NetCDF file into float64s.
+func ncfFloats(vals interface{}) ([]float64, error) {
+	switch v := vals.(type) {
+	case []float32:
+		o := make([]float64, len(v))
+		for i, val := range v {
+			o[i] = float64(val)
+		}
+		return o, nil
+	case []float64:
+		return v, nil
+	case []int32:
+		o := make([]float64, len(v))
+		for i, val := range v {
+			o[i] = float64(val)
+		}
+		return o, nil
+	case []int16:
+		o := make([]float64, len(v))
+		for i, val := range v {
+			o[i] = float64(val)
+		}
+		return o, nil
+	case []int8:
+		o := make([]float64, len(v))
+		for i, val := range v {
+			o[i] = float64(val)
+		}
+		return o, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %T", vals)
+	}
+}
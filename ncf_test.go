@@ -0,0 +1,111 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/batchatco/go-native-netcdf/netcdf"
+	ncapi "github.com/batchatco/go-native-netcdf/netcdf/api"
+	"github.com/batchatco/go-native-netcdf/netcdf/util"
+)
+
+// writeNCF4 writes a NetCDF-4 file with a variable with dimensions
+// (Time, south_north, west_east) and a global attribute.
+func writeNCF4(path string) error {
+	w, err := netcdf.OpenWriter(path, netcdf.KindHDF5)
+	if err != nil {
+		return err
+	}
+	attrs, err := util.NewOrderedMap([]string{"DX"}, map[string]interface{}{"DX": float32(12000)})
+	if err != nil {
+		return err
+	}
+	if err = w.AddAttributes(attrs); err != nil {
+		return err
+	}
+	err = w.AddVar("PBLH", ncapi.Variable{
+		Values: [][][]float32{
+			{{1, 2, 3}, {4, 5, 6}},
+			{{7, 8, 9}, {10, 11, 12}},
+		},
+		Dimensions: []string{"Time", "south_north", "west_east"},
+	})
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func TestNCF4(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ncf4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "wrfout.nc")
+	if err = writeNCF4(path); err != nil {
+		t.Fatal(err)
+	}
+	f, err := openNCF(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if have, want := f.Lengths("PBLH"), []int{2, 2, 3}; !reflect.DeepEqual(have, want) {
+		t.Errorf("lengths: have %v, want %v", have, want)
+	}
+	if have, want := f.Dimensions("PBLH"), []string{"Time", "south_north", "west_east"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("dimensions: have %v, want %v", have, want)
+	}
+	if have, want := f.Attribute("", "DX"), []float32{12000}; !reflect.DeepEqual(have, want) {
+		t.Errorf("attribute: have %v, want %v", have, want)
+	}
+	data, err := readNCF("PBLH", f, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []float64{7, 8, 9, 10, 11, 12}; !reflect.DeepEqual(data.Elements, want) {
+		t.Errorf("readNCF: have %v, want %v", data.Elements, want)
+	}
+	if !reflect.DeepEqual(data.Shape, []int{2, 3}) {
+		t.Errorf("readNCF shape: have %v, want [2 3]", data.Shape)
+	}
+	if _, err = readNCF("XXX", f, 0); err == nil {
+		t.Error("expected an error for a missing variable")
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	for _, test := range []struct {
+		in, want interface{}
+	}{
+		{in: []float32{1, 2}, want: []float32{1, 2}},
+		{in: [][]int32{{1, 2}, {3, 4}}, want: []int32{1, 2, 3, 4}},
+		{in: float64(1), want: []float64{1}},
+	} {
+		if have := flatten(test.in); !reflect.DeepEqual(have, test.want) {
+			t.Errorf("have %v, want %v", have, test.want)
+		}
+	}
+}
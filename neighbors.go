@@ -36,10 +36,10 @@ func (d *InMAP) setBoundaryNeighbors(c *Cell, m Mechanism) {
 	if c.east.len() == 0 {
 		d.addEastBoundary(c, m)
 	}
-	if c.north.len() == 0 {
+	if c.north.len() == 0 && !d.atPole(c, true) {
 		d.addNorthBoundary(c, m)
 	}
-	if c.south.len() == 0 {
+	if c.south.len() == 0 && !d.atPole(c, false) {
 		d.addSouthBoundary(c, m)
 	}
 	if c.above.len() == 0 {
@@ -51,23 +51,29 @@ func (d *InMAP) neighbors(c *Cell) {
 	b := c.Bounds()
 
 	// Horizontal
-	westbox := newNeighborRect(b, west)
+	westbox := d.wrap(newNeighborRect(b, west))
 	c.west = getCells(d.index, westbox, c.Layer)
-	for _, w := range *c.west {
-		if w.east.len() == 1 && (*w.east)[0].boundary {
-			d.eastBoundary.delete((*w.east)[0])
-			w.east.delete((*w.east)[0])
+	for i := range c.west {
+		w := &c.west[i]
+		if w.east.len() == 1 && w.east[0].boundary {
+			bc := w.east[0].Cell
+			d.eastBoundary.deleteCell(bc)
+			w.east.deleteCell(bc)
+			d.cellStore.release(bc)
 		}
 		w.east.add(c)
 		neighborInfoEastWest(w, w.Cell.east.ref(c))
 	}
 
-	eastbox := newNeighborRect(b, east)
+	eastbox := d.wrap(newNeighborRect(b, east))
 	c.east = getCells(d.index, eastbox, c.Layer)
-	for _, e := range *c.east {
-		if e.west.len() == 1 && (*e.west)[0].boundary {
-			d.westBoundary.delete((*e.west)[0])
-			e.west.delete((*e.west)[0])
+	for i := range c.east {
+		e := &c.east[i]
+		if e.west.len() == 1 && e.west[0].boundary {
+			bc := e.west[0].Cell
+			d.westBoundary.deleteCell(bc)
+			e.west.deleteCell(bc)
+			d.cellStore.release(bc)
 		}
 		e.west.add(c)
 		neighborInfoEastWest(e, e.Cell.west.ref(c))
@@ -75,10 +81,13 @@ func (d *InMAP) neighbors(c *Cell) {
 
 	southbox := newNeighborRect(b, south)
 	c.south = getCells(d.index, southbox, c.Layer)
-	for _, s := range *c.south {
-		if s.north.len() == 1 && (*s.north)[0].boundary {
-			d.northBoundary.delete((*s.north)[0])
-			s.north.delete((*s.north)[0])
+	for i := range c.south {
+		s := &c.south[i]
+		if s.north.len() == 1 && s.north[0].boundary {
+			bc := s.north[0].Cell
+			d.northBoundary.deleteCell(bc)
+			s.north.deleteCell(bc)
+			d.cellStore.release(bc)
 		}
 		s.north.add(c)
 		neighborInfoSouthNorth(s, s.Cell.north.ref(c))
@@ -86,10 +95,13 @@ func (d *InMAP) neighbors(c *Cell) {
 
 	northbox := newNeighborRect(b, north)
 	c.north = getCells(d.index, northbox, c.Layer)
-	for _, n := range *c.north {
-		if n.south.len() == 1 && (*n.south)[0].boundary {
-			d.southBoundary.delete((*n.south)[0])
-			n.south.delete((*n.south)[0])
+	for i := range c.north {
+		n := &c.north[i]
+		if n.south.len() == 1 && n.south[0].boundary {
+			bc := n.south[0].Cell
+			d.southBoundary.deleteCell(bc)
+			n.south.deleteCell(bc)
+			d.cellStore.release(bc)
 		}
 		n.south.add(c)
 		neighborInfoSouthNorth(n, n.Cell.south.ref(c))
@@ -98,9 +110,10 @@ func (d *InMAP) neighbors(c *Cell) {
 	// Above
 	abovebelowbox := newNeighborRect(b, aboveBelow)
 	c.above = getCells(d.index, abovebelowbox, c.Layer+1)
-	for _, a := range *c.above {
-		if a.below.len() == 1 && (*a.below)[0] == a {
-			a.below.delete((*a.below)[0])
+	for i := range c.above {
+		a := &c.above[i]
+		if a.below.len() == 1 && a.below[0].Cell == a.Cell {
+			a.below.deleteCell(a.below[0].Cell)
 		}
 		a.below.add(c)
 		neighborInfoAboveBelow(a, a.Cell.below.ref(c))
@@ -108,23 +121,26 @@ func (d *InMAP) neighbors(c *Cell) {
 
 	// Below
 	c.below = getCells(d.index, abovebelowbox, c.Layer-1)
-	for _, b := range *c.below {
-		if b.above.len() == 1 && (*b.above)[0].boundary {
-			d.topBoundary.delete((*b.above)[0])
-			b.above.delete((*b.above)[0])
+	for i := range c.below {
+		b := &c.below[i]
+		if b.above.len() == 1 && b.above[0].boundary {
+			bc := b.above[0].Cell
+			d.topBoundary.deleteCell(bc)
+			b.above.deleteCell(bc)
+			d.cellStore.release(bc)
 		}
 		b.above.add(c)
 		neighborInfoAboveBelow(b, b.Cell.above.ref(c))
 	}
 	if c.Layer == 0 {
-		ref := (*c).below.add(c) // Reflective boundary at ground level.
+		ref := c.below.add(c) // Reflective boundary at ground level.
 		neighborInfoBoundaryTopBottom(ref)
 	}
 
 	// Ground level.
 	c.groundLevel = getCells(d.index, abovebelowbox, 0)
-	for _, g := range *c.groundLevel {
-		neighborInfoGroundLevel(c, g)
+	for i := range c.groundLevel {
+		neighborInfoGroundLevel(c, &c.groundLevel[i])
 	}
 	// Find the cells that this cell is the ground level for.
 	if c.Layer == 0 {
@@ -143,12 +159,12 @@ func (d *InMAP) neighbors(c *Cell) {
 // cr1 is the first cell's reference to the second cell, and
 // cr2 is the second cell's reference to the first cell.
 func neighborInfoEastWest(cr1, cr2 *cellRef) {
-	cr1.info = &neighborInfo{
+	cr1.info = neighborInfo{
 		centerDistance: (cr2.Dx + cr1.Dx) / 2,
 		coverFrac:      min(cr1.Dy/cr2.Dy, 1.),
 		diff:           harmonicMean(cr2.Kxxyy, cr1.Kxxyy),
 	}
-	cr2.info = &neighborInfo{
+	cr2.info = neighborInfo{
 		centerDistance: cr1.info.centerDistance,
 		coverFrac:      min(cr2.Dy/cr1.Dy, 1.),
 		diff:           cr1.info.diff,
@@ -158,7 +174,7 @@ func neighborInfoEastWest(cr1, cr2 *cellRef) {
 // neighborInfoBoundaryEastWest holds information about the relationship
 // between a cell on the east-west edge of the domain and the boundary.
 func neighborInfoBoundaryEastWest(cr *cellRef) {
-	cr.info = &neighborInfo{
+	cr.info = neighborInfo{
 		centerDistance: cr.Dx,
 		coverFrac:      1.,
 		diff:           cr.Kxxyy,
@@ -170,12 +186,12 @@ func neighborInfoBoundaryEastWest(cr *cellRef) {
 // cr1 is the first cell's reference to the second cell, and
 // cr2 is the second cell's reference to the first cell.
 func neighborInfoSouthNorth(cr1, cr2 *cellRef) {
-	cr1.info = &neighborInfo{
+	cr1.info = neighborInfo{
 		centerDistance: (cr2.Dy + cr1.Dy) / 2,
 		coverFrac:      min(cr1.Dx/cr2.Dx, 1.),
 		diff:           harmonicMean(cr2.Kxxyy, cr1.Kxxyy),
 	}
-	cr2.info = &neighborInfo{
+	cr2.info = neighborInfo{
 		centerDistance: cr1.info.centerDistance,
 		coverFrac:      min(cr2.Dx/cr1.Dx, 1.),
 		diff:           cr1.info.diff,
@@ -185,7 +201,7 @@ func neighborInfoSouthNorth(cr1, cr2 *cellRef) {
 // neighborInfoBoundaryEastWest holds information about the relationship
 // between a cell on the north-south edge of the domain and the boundary.
 func neighborInfoBoundarySouthNorth(cr *cellRef) {
-	cr.info = &neighborInfo{
+	cr.info = neighborInfo{
 		centerDistance: cr.Dy,
 		coverFrac:      1.,
 		diff:           cr.Kxxyy,
@@ -197,12 +213,12 @@ func neighborInfoBoundarySouthNorth(cr *cellRef) {
 // cr1 is the first cell's reference to the second cell, and
 // cr2 is the second cell's reference to the first cell.
 func neighborInfoAboveBelow(cr1, cr2 *cellRef) {
-	cr1.info = &neighborInfo{
+	cr1.info = neighborInfo{
 		centerDistance: (cr2.Dz + cr1.Dz) / 2,
 		coverFrac:      min((cr1.Dx*cr1.Dy)/(cr2.Dx*cr2.Dy), 1.),
 		diff:           harmonicMean(cr2.Kzz, cr1.Kzz),
 	}
-	cr2.info = &neighborInfo{
+	cr2.info = neighborInfo{
 		centerDistance: cr1.info.centerDistance,
 		coverFrac:      min((cr2.Dx*cr2.Dy)/(cr1.Dx*cr1.Dy), 1.),
 		diff:           cr1.info.diff,
@@ -212,7 +228,7 @@ func neighborInfoAboveBelow(cr1, cr2 *cellRef) {
 // neighborInfoBoundaryEastWest holds information about the relationship
 // between a cell on the Top edge of the domain and the boundary.
 func neighborInfoBoundaryTopBottom(cr *cellRef) {
-	cr.info = &neighborInfo{
+	cr.info = neighborInfo{
 		centerDistance: cr.Dz,
 		coverFrac:      1.,
 		diff:           cr.Kzz,
@@ -223,7 +239,7 @@ func neighborInfoBoundaryTopBottom(cr *cellRef) {
 // between two cells where cr is a reference to a cell that
 // is above c when c is at ground level.
 func neighborInfoGroundLevel(c *Cell, cr *cellRef) {
-	cr.info = &neighborInfo{
+	cr.info = neighborInfo{
 		coverFrac: min((cr.Dx*cr.Dy)/(c.Dx*c.Dy), 1.),
 	}
 }
@@ -231,42 +247,47 @@ func neighborInfoGroundLevel(c *Cell, cr *cellRef) {
 // dereferenceNeighbors removes any references to this cell that exist in its
 // neighbors.
 func (c *Cell) dereferenceNeighbors(d *InMAP) {
-	for _, w := range *c.west {
+	for _, w := range c.west {
 		if w.boundary {
 			d.westBoundary.deleteCell(w.Cell)
+			d.cellStore.release(w.Cell)
 		} else {
 			w.east.deleteCell(c)
 		}
 	}
-	for _, e := range *c.east {
+	for _, e := range c.east {
 		if e.boundary {
 			d.eastBoundary.deleteCell(e.Cell)
+			d.cellStore.release(e.Cell)
 		} else {
 			e.west.deleteCell(c)
 		}
 	}
-	for _, s := range *c.south {
+	for _, s := range c.south {
 		if s.boundary {
 			d.southBoundary.deleteCell(s.Cell)
+			d.cellStore.release(s.Cell)
 		} else {
 			s.north.deleteCell(c)
 		}
 	}
-	for _, n := range *c.north {
+	for _, n := range c.north {
 		if n.boundary {
 			d.northBoundary.deleteCell(n.Cell)
+			d.cellStore.release(n.Cell)
 		} else {
 			n.south.deleteCell(c)
 		}
 	}
 	if c.Layer != 0 { // We don't worry about dereferencing below ground level cells.
-		for _, b := range *c.below {
+		for _, b := range c.below {
 			b.above.deleteCell(c)
 		}
 	}
-	for _, a := range *c.above {
+	for _, a := range c.above {
 		if a.boundary {
 			d.topBoundary.deleteCell(a.Cell)
+			d.cellStore.release(a.Cell)
 		} else {
 			a.below.deleteCell(c)
 		}
@@ -0,0 +1,183 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/ctessum/geom"
+)
+
+// RunNested returns a function that runs the simulation in inner, whose
+// domain is nested within the domain of the simulation that the
+// function is run in (the outer domain), for the length of the outer
+// time step, so that a fine grid can be used for part of a larger
+// domain without a single very large variable grid. The function should
+// be one of the outer RunFuncs, after the science calculations and
+// before the convergence check, and inner should already be initialized.
+//
+// Each time the function is run, the concentrations in the boundary
+// cells of inner are set to the average concentrations in the outer
+// domain just outside of the inner grid cells that they border, so that
+// pollution is transported into the inner domain from the outer domain.
+// inner is then run for as many time steps no longer than inner.Dt as
+// are needed to cover the outer time step. inner.RunFuncs should not
+// include a convergence check: the nested simulation continues for as
+// long as the outer simulation does. If feedback is true, the
+// concentrations in the outer grid cells that overlap the inner domain
+// are then replaced by the average concentrations in the inner grid
+// cells that they overlap (two-way nesting); otherwise the outer
+// simulation is not affected by inner (one-way nesting).
+//
+// Grid cells with the same layer index in the two domains are assumed
+// to be in the same vertical layer, so both grids should be created
+// from the same CTM data, and the two domains must use the same
+// chemical mechanism.
+func RunNested(inner *InMAP, feedback bool) DomainManipulator {
+	return func(d *InMAP) error {
+		if d.Dt == 0 || inner.Dt == 0 {
+			return fmt.Errorf("inmap: nested simulation: timestep is zero")
+		}
+		if inner.nlayers > d.nlayers {
+			return fmt.Errorf("inmap: nested simulation: the inner grid has %d layers but the outer grid has %d", inner.nlayers, d.nlayers)
+		}
+		inner.setNestedBoundary(d)
+
+		dt := inner.Dt
+		n := math.Ceil(d.Dt / dt)
+		inner.Dt = d.Dt / n
+		for i := 0; i < int(n); i++ {
+			for _, f := range inner.RunFuncs {
+				if err := f(inner); err != nil {
+					inner.Dt = dt
+					return fmt.Errorf("inmap: nested simulation: %v", err)
+				}
+			}
+		}
+		inner.Dt = dt
+
+		if feedback {
+			d.nestedFeedback(inner)
+		}
+		return nil
+	}
+}
+
+// setNestedBoundary sets the concentrations in the boundary cells of d
+// to the average concentrations in outer over the area that each boundary
+// cell covers, found by shifting the grid cell that it borders outward by
+// one cell width or, for the top boundary, up by one layer.
+func (d *InMAP) setNestedBoundary(outer *InMAP) {
+	for _, c := range *d.cells {
+		b := c.Bounds()
+		boxes := []struct {
+			l      *cellList
+			box    *geom.Bounds
+			dLayer int
+		}{
+			{l: &c.west, box: &geom.Bounds{Min: geom.Point{X: b.Min.X - c.Dx, Y: b.Min.Y}, Max: geom.Point{X: b.Min.X, Y: b.Max.Y}}},
+			{l: &c.east, box: &geom.Bounds{Min: geom.Point{X: b.Max.X, Y: b.Min.Y}, Max: geom.Point{X: b.Max.X + c.Dx, Y: b.Max.Y}}},
+			{l: &c.south, box: &geom.Bounds{Min: geom.Point{X: b.Min.X, Y: b.Min.Y - c.Dy}, Max: geom.Point{X: b.Max.X, Y: b.Min.Y}}},
+			{l: &c.north, box: &geom.Bounds{Min: geom.Point{X: b.Min.X, Y: b.Max.Y}, Max: geom.Point{X: b.Max.X, Y: b.Max.Y + c.Dy}}},
+			{l: &c.above, box: b, dLayer: 1},
+		}
+		for _, bx := range boxes {
+			for _, n := range *bx.l {
+				if !n.boundary {
+					continue
+				}
+				if n.Ci == nil {
+					n.Ci = make([]float64, len(c.Ci))
+				}
+				outer.meanConcentrations(bx.box, c.Layer+bx.dLayer, n.Ci)
+			}
+		}
+	}
+}
+
+// meanConcentrations sets conc to the area-weighted average
+// concentrations in the grid cells of d in the given layer that
+// overlap b. The parts of b that are outside of the domain are
+// assumed to have concentrations of zero.
+func (d *InMAP) meanConcentrations(b *geom.Bounds, layer int, conc []float64) {
+	for i := range conc {
+		conc[i] = 0
+	}
+	area := (b.Max.X - b.Min.X) * (b.Max.Y - b.Min.Y)
+	if area == 0 {
+		return
+	}
+	for _, c := range getCells(d.index, b, layer) {
+		w := overlapArea(b, c.Bounds()) / area
+		if w == 0 {
+			continue
+		}
+		for i := range conc {
+			if i < len(c.Cf) {
+				conc[i] += c.Cf[i] * w
+			}
+		}
+	}
+}
+
+// nestedFeedback replaces the concentrations in the grid cells of d
+// that overlap the domain of inner with the area-weighted average of
+// the concentrations in the inner grid cells in the same layer and, for
+// outer cells that only partly overlap the inner domain, the original
+// concentrations in the remainder of the cell.
+func (d *InMAP) nestedFeedback(inner *InMAP) {
+	for _, c := range *d.cells {
+		b := c.Bounds()
+		area := c.Dx * c.Dy
+		cells := getCells(inner.index, b, c.Layer)
+		if len(cells) == 0 {
+			continue
+		}
+		var f float64
+		conc := make([]float64, len(c.Cf))
+		for _, ic := range cells {
+			w := overlapArea(b, ic.Bounds()) / area
+			f += w
+			for i := range conc {
+				if i < len(ic.Cf) {
+					conc[i] += ic.Cf[i] * w
+				}
+			}
+		}
+		if f == 0 {
+			continue
+		}
+		f = math.Min(f, 1)
+		for i := range c.Cf {
+			c.Cf[i] = (1-f)*c.Cf[i] + conc[i]
+			c.Ci[i] = c.Cf[i]
+		}
+	}
+}
+
+// overlapArea returns the area of the intersection of a and b.
+func overlapArea(a, b *geom.Bounds) float64 {
+	dx := math.Min(a.Max.X, b.Max.X) - math.Max(a.Min.X, b.Min.X)
+	dy := math.Min(a.Max.Y, b.Max.Y) - math.Max(a.Min.Y, b.Min.Y)
+	if dx <= 0 || dy <= 0 {
+		return 0
+	}
+	return dx * dy
+}
@@ -0,0 +1,165 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestRunNested(t *testing.T) {
+	const (
+		tol = 1.e-10
+		E   = 1000000. // emissions [μg/s]
+		n   = 10       // number of time steps
+	)
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	m := Mech{}
+
+	// The inner domain covers the southwest quarter of the outer domain
+	// with cells that are one quarter of the width of the outer cells.
+	innerCfg := *cfg
+	innerCfg.VariableGridDx, innerCfg.VariableGridDy = 1000, 1000
+	innerCfg.Xnests, innerCfg.Ynests = []int{4}, []int{4}
+
+	// The outer domain has emissions to the east of the inner domain,
+	// and the inner domain has none.
+	newOuter := func(nest ...DomainManipulator) *InMAP {
+		emis := NewEmissions()
+		emis.Add(&EmisRecord{
+			SOx:  E,
+			PM25: E,
+			Geom: geom.Point{X: 2000, Y: -2000},
+		})
+		runFuncs := []DomainManipulator{
+			Calculations(AddEmissionsFlux()),
+			Calculations(UpwindAdvection(), Mixing(), MeanderMixing(), m.Chemistry()),
+		}
+		runFuncs = append(runFuncs, nest...)
+		runFuncs = append(runFuncs, SteadyStateConvergenceCheck(n, cfg.PopGridColumn, m, nil))
+		d := &InMAP{
+			InitFuncs: []DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+				SetTimestepCFL(),
+			},
+			RunFuncs: runFuncs,
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	newInner := func() *InMAP {
+		d := &InMAP{
+			InitFuncs: []DomainManipulator{
+				innerCfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, NewEmissions(), m),
+				SetTimestepCFL(),
+			},
+			RunFuncs: []DomainManipulator{
+				Calculations(AddEmissionsFlux()),
+				Calculations(UpwindAdvection(), Mixing(), MeanderMixing(), m.Chemistry()),
+			},
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	alone := newOuter()
+	if err := alone.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("one-way", func(t *testing.T) {
+		inner := newInner()
+		dt := inner.Dt
+		outer := newOuter(RunNested(inner, false))
+		if err := outer.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if inner.Dt != dt {
+			t.Errorf("inner timestep changed from %g to %g", dt, inner.Dt)
+		}
+		for i, c := range *outer.cells {
+			for ii, v := range c.Cf {
+				if want := (*alone.cells)[i].Cf[ii]; v != want {
+					t.Errorf("cell %v, species %d: the outer domain should not be affected by the inner domain: have %g, want %g", c, ii, v, want)
+				}
+			}
+		}
+		// There are no emissions in the inner domain, so all of the
+		// pollution in it has been transported in from the outer domain.
+		var total float64
+		for _, c := range *inner.cells {
+			if c.Cf[iPM2_5] < 0 {
+				t.Errorf("cell %v: negative concentration %g", c, c.Cf[iPM2_5])
+			}
+			total += c.Cf[iPM2_5]
+		}
+		if !(total > 0) {
+			t.Errorf("pollution should have been transported into the inner domain, but the total concentration is %g", total)
+		}
+	})
+
+	t.Run("two-way", func(t *testing.T) {
+		inner := newInner()
+		outer := newOuter(RunNested(inner, true))
+		if err := outer.Run(); err != nil {
+			t.Fatal(err)
+		}
+		// The outer cells that overlap the inner domain should have the
+		// average concentrations of the inner cells.
+		var checked int
+		for _, c := range *outer.cells {
+			b := c.Bounds()
+			if b.Max.X > 0 || b.Max.Y > 0 {
+				continue
+			}
+			var want float64
+			for _, ic := range getCells(inner.index, b, c.Layer) {
+				want += ic.Cf[iPM2_5] * overlapArea(b, ic.Bounds()) / (c.Dx * c.Dy)
+			}
+			if different(c.Cf[iPM2_5], want, tol) {
+				t.Errorf("cell %v: have %g, want %g", c, c.Cf[iPM2_5], want)
+			}
+			checked++
+		}
+		if checked == 0 {
+			t.Error("no outer cells overlap the inner domain")
+		}
+	})
+}
+
+func TestOverlapArea(t *testing.T) {
+	a := &geom.Bounds{Min: geom.Point{X: 0, Y: 0}, Max: geom.Point{X: 2, Y: 2}}
+	for _, test := range []struct {
+		b    *geom.Bounds
+		want float64
+	}{
+		{b: &geom.Bounds{Min: geom.Point{X: 1, Y: 1}, Max: geom.Point{X: 3, Y: 3}}, want: 1},
+		{b: &geom.Bounds{Min: geom.Point{X: -1, Y: -1}, Max: geom.Point{X: 3, Y: 3}}, want: 4},
+		{b: &geom.Bounds{Min: geom.Point{X: 2, Y: 0}, Max: geom.Point{X: 3, Y: 2}}, want: 0},
+	} {
+		if have := overlapArea(a, test.b); have != test.want {
+			t.Errorf("%v: have %g, want %g", test.b, have, test.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/ctessum/sparse"
+)
+
+// NitrateEquilibrium specifies whether the variables needed to calculate
+// ammonium nitrate gas-particle equilibrium during the simulation should
+// be included in the preprocessed output. When it is true, the
+// preprocessor's T and RH methods are used to calculate the average
+// temperature and relative humidity in each season (e.g.,
+// "TemperatureDJF" and "RHDJF" for December–February), so that the
+// partitioning of nitrate and ammonium can depend on seasonal
+// meteorology rather than only on the annual average partitioning.
+//
+// The seasonal averages are calculated from each input file separately,
+// and each file is assigned to the season that it starts in. Seasons
+// that are not included in the simulation period are given the averages
+// over the whole period, as are all seasons if the preprocessor cannot
+// be split into separate files (see TimeSplitter).
+func NitrateEquilibrium(nitrateEquilibrium bool) PreprocessOption {
+	return func(o *preprocessOptions) {
+		o.nitrateEquilibrium = nitrateEquilibrium
+	}
+}
+
+// Seasons are the names of the seasons that seasonal meteorology is
+// calculated for: December–February, March–May, June–August,
+// and September–November.
+var Seasons = [4]string{"DJF", "MAM", "JJA", "SON"}
+
+// season returns the index in Seasons of the season that t is in.
+func season(t time.Time) int { return int(t.Month()) % 12 / 3 }
+
+// addSeasonalMeteorology adds the seasonal average temperature and
+// relative humidity from p to data.
+func (o *preprocessOptions) addSeasonalMeteorology(data *CTMData, p Preprocessor) error {
+	periods := []Preprocessor{p}
+	if ts, ok := p.(TimeSplitter); ok {
+		periods = ts.SplitTime(math.MaxInt32)
+	}
+
+	// Hour-weighted sums of the averages for each period.
+	var T, RH [len(Seasons)]*sparse.DenseArray
+	var hours [len(Seasons)]float64
+	var allT, allRH *sparse.DenseArray
+	var allHours float64
+	add := func(sum **sparse.DenseArray, v *sparse.DenseArray, weight float64) {
+		if *sum == nil {
+			*sum = sparse.ZerosDense(v.Shape...)
+		}
+		for i, e := range v.Elements {
+			(*sum).Elements[i] += e * weight
+		}
+	}
+	for _, pp := range periods {
+		start, end := periodBounds(pp)
+		h := end.Sub(start).Hours()
+		if h <= 0 {
+			h = 1 // The length of the period is unknown.
+		}
+		pw := o.wrap(pp)
+		t, err := average(pw.T())
+		if err != nil {
+			return fmt.Errorf("inmap: preprocessing seasonal temperature: %v", err)
+		}
+		rh, err := average(pw.RH())
+		if err != nil {
+			return fmt.Errorf("inmap: preprocessing seasonal relative humidity: %v", err)
+		}
+		s := season(start)
+		add(&T[s], t, h)
+		add(&RH[s], rh, h)
+		hours[s] += h
+		add(&allT, t, h)
+		add(&allRH, rh, h)
+		allHours += h
+	}
+
+	for s, name := range Seasons {
+		t, rh, h := T[s], RH[s], hours[s]
+		if h == 0 {
+			t, rh, h = allT, allRH, allHours
+		}
+		data.AddVariable("Temperature"+name, []string{"z", "y", "x"},
+			fmt.Sprintf("Average temperature in %s", name), "K", t.ScaleCopy(1/h))
+		data.AddVariable("RH"+name, []string{"z", "y", "x"},
+			fmt.Sprintf("Average relative humidity in %s", name), "fraction", rh.ScaleCopy(1/h))
+	}
+	return nil
+}
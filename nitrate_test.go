@@ -0,0 +1,79 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeason(t *testing.T) {
+	for month, want := range map[time.Month]string{
+		time.December: "DJF", time.January: "DJF", time.February: "DJF",
+		time.March: "MAM", time.May: "MAM", time.June: "JJA",
+		time.August: "JJA", time.September: "SON", time.November: "SON",
+	} {
+		if have := Seasons[season(time.Date(2005, month, 15, 0, 0, 0, 0, time.UTC))]; have != want {
+			t.Errorf("%v: have %s, want %s", month, have, want)
+		}
+	}
+}
+
+func TestGEOSChemNitrateEquilibrium(t *testing.T) {
+	gc, err := NewGEOSChem(
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A1.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A3cld.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A3dyn.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].I3.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A3mstE.2x25.nc",
+		"",
+		"cmd/inmap/testdata/preproc/gc_output.[DATE].nc",
+		"cmd/inmap/testdata/preproc/geoschem-new/Olson_2001_Land_Map.025x025.generic.nc",
+		"20130102",
+		"20130104",
+		true,
+		"3h",
+		"3h",
+		true,
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Preprocess(gc, -2.5, 50, 2.5, 2, NitrateEquilibrium(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The simulation period is in January, so the seasonal temperatures
+	// should all be the same as the average temperature.
+	for _, s := range Seasons {
+		arrayCompare(data.Data["Temperature"+s].Data,
+			data.Data["Temperature"].Data, 1.e-8, "Temperature"+s, t)
+		rh, ok := data.Data["RH"+s]
+		if !ok {
+			t.Errorf("missing variable RH%s", s)
+			continue
+		}
+		for _, v := range rh.Data.Elements {
+			if v < 0 || v > 1.5 {
+				t.Errorf("RH%s = %g is outside of [0, 1.5]", s, v)
+			}
+		}
+	}
+}
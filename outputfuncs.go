@@ -0,0 +1,410 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Knetic/govaluate"
+	"github.com/yuzhou-wang/inmap/epi"
+	"gonum.org/v1/gonum/floats"
+)
+
+// aggregateFunctions are the output functions that combine the values of
+// a per-cell expression across all grid cells. They can only be used
+// within braces ("{}") in output expressions.
+var aggregateFunctions = map[string]func(args [][]float64) (float64, error){
+	"sum": func(args [][]float64) (float64, error) {
+		if len(args) != 1 {
+			return math.NaN(), fmt.Errorf("got %d arguments for function 'sum', but need 1", len(args))
+		}
+		return floats.Sum(args[0]), nil
+	},
+	"mean": func(args [][]float64) (float64, error) {
+		if len(args) != 1 {
+			return math.NaN(), fmt.Errorf("got %d arguments for function 'mean', but need 1", len(args))
+		}
+		return floats.Sum(args[0]) / float64(len(args[0])), nil
+	},
+	"weightedmean": func(args [][]float64) (float64, error) {
+		if len(args) != 2 {
+			return math.NaN(), fmt.Errorf("got %d arguments for function 'weightedmean', but need 2", len(args))
+		}
+		return floats.Dot(args[0], args[1]) / floats.Sum(args[1]), nil
+	},
+	"min": func(args [][]float64) (float64, error) {
+		if len(args) != 1 {
+			return math.NaN(), fmt.Errorf("got %d arguments for function 'min' within braces, but need 1", len(args))
+		}
+		return floats.Min(args[0]), nil
+	},
+	"max": func(args [][]float64) (float64, error) {
+		if len(args) != 1 {
+			return math.NaN(), fmt.Errorf("got %d arguments for function 'max' within braces, but need 1", len(args))
+		}
+		return floats.Max(args[0]), nil
+	},
+	"atkinson": func(args [][]float64) (float64, error) {
+		if len(args) != 3 {
+			return math.NaN(), fmt.Errorf("got %d arguments for function 'atkinson', but need 3", len(args))
+		}
+		return atkinson(args[0], args[1], args[2][0]), nil
+	},
+	"concindex": func(args [][]float64) (float64, error) {
+		if len(args) != 3 {
+			return math.NaN(), fmt.Errorf("got %d arguments for function 'concindex', but need 3", len(args))
+		}
+		return concentrationIndex(args[0], args[1], args[2]), nil
+	},
+}
+
+// atkinson returns the Atkinson index of inequality of x among the
+// population w, with inequality aversion parameter epsilon. For
+// undesirable quantities such as exposure to pollution, epsilon should be
+// negative so that the index is more sensitive to high values of x.
+// The index is 0 if x is the same for everyone and increases with
+// inequality.
+func atkinson(x, w []float64, epsilon float64) float64 {
+	var wSum, mean, ede float64
+	for i, wi := range w {
+		if wi == 0 {
+			continue
+		}
+		wSum += wi
+		mean += wi * x[i]
+		if epsilon == 1 {
+			ede += wi * math.Log(x[i])
+		} else {
+			ede += wi * math.Pow(x[i], 1-epsilon)
+		}
+	}
+	mean /= wSum
+	// ede is the equally-distributed equivalent value of x.
+	if epsilon == 1 {
+		ede = math.Exp(ede / wSum)
+	} else {
+		ede = math.Pow(ede/wSum, 1/(1-epsilon))
+	}
+	// The equally-distributed equivalent is greater than the mean
+	// if epsilon is negative and less than the mean if it is positive.
+	return math.Abs(1 - ede/mean)
+}
+
+// concentrationIndex returns the concentration index of x among the
+// population w ranked by rank, for example income. It is twice the area
+// between the concentration curve, which is the cumulative fraction of x
+// against the cumulative fraction of the population ranked from lowest to
+// highest rank, and the line of equality. It ranges from -1 to 1 and is
+// negative if x is concentrated among people with low ranks.
+func concentrationIndex(x, w, rank []float64) float64 {
+	idx := make([]int, 0, len(w))
+	var wSum, mean float64
+	for i, wi := range w {
+		if wi != 0 {
+			idx = append(idx, i)
+			wSum += wi
+			mean += wi * x[i]
+		}
+	}
+	mean /= wSum
+	sort.SliceStable(idx, func(a, b int) bool { return rank[idx[a]] < rank[idx[b]] })
+	var cum, cov float64
+	for _, i := range idx {
+		// r is the fractional rank of the population in cell i.
+		r := (cum + w[i]/2) / wSum
+		cum += w[i]
+		cov += w[i] * (x[i] - mean) * (r - 0.5)
+	}
+	return 2 * cov / wSum / mean
+}
+
+// aggregateCall matches the beginning of a call to one of the
+// aggregateFunctions.
+var aggregateCall = regexp.MustCompile(`\b(sum|mean|weightedmean|min|max|atkinson|concindex)\s*\(`)
+
+// aggregateOnly matches the beginning of a call to one of the
+// aggregateFunctions that can not be used outside of braces.
+var aggregateOnly = regexp.MustCompile(`\b(sum|mean|weightedmean|atkinson|concindex)\s*\(`)
+
+// braces matches segments of output expressions that are surrounded by
+// braces.
+var braces = regexp.MustCompile(`\{(.*?)\}`)
+
+// scalarArgs checks that the arguments to the function with the
+// given name are numbers and returns them.
+func scalarArgs(name string, n int, arg []interface{}) ([]float64, error) {
+	if n >= 0 && len(arg) != n {
+		return nil, fmt.Errorf("inmap: got %d arguments for function '%s', but need %d", len(arg), name, n)
+	}
+	if len(arg) == 0 {
+		return nil, fmt.Errorf("inmap: function '%s' needs at least one argument", name)
+	}
+	v := make([]float64, len(arg))
+	for i, a := range arg {
+		f, ok := a.(float64)
+		if !ok {
+			return nil, fmt.Errorf("inmap: argument %d of function '%s' is not a number", i+1, name)
+		}
+		v[i] = f
+	}
+	return v, nil
+}
+
+// unaryFunction returns an output function that applies f to its
+// single argument.
+func unaryFunction(name string, f func(float64) float64) govaluate.ExpressionFunction {
+	return func(arg ...interface{}) (interface{}, error) {
+		v, err := scalarArgs(name, 1, arg)
+		if err != nil {
+			return nil, err
+		}
+		return f(v[0]), nil
+	}
+}
+
+// healthFunction returns an output function that calculates the hazard
+// ratio of the concentration-response function created by newHR from the
+// first nParams arguments, at the concentration given by the last argument.
+func healthFunction(name string, nParams int, newHR func(params []float64) epi.HRer) govaluate.ExpressionFunction {
+	return func(arg ...interface{}) (interface{}, error) {
+		v, err := scalarArgs(name, nParams+1, arg)
+		if err != nil {
+			return nil, err
+		}
+		return newHR(v[:nParams]).HR(v[nParams]), nil
+	}
+}
+
+// healthFunctions are the predefined concentration-response functions
+// that are available by name in output expressions.
+var healthFunctions = []epi.HRer{
+	epi.NasariACS,
+	epi.Krewski2009,
+	epi.Krewski2009Ecologic,
+	epi.Lepeule2012,
+	epi.Turner2016,
+	epi.Turner2016Respiratory,
+	epi.GEMMNCDLRI,
+	epi.Mar2010AsthmaER,
+	epi.Sun2015PretermBirth,
+	epi.Kioumourtzoglou2016Dementia,
+}
+
+// defaultOutputFunctions returns the functions that are available for
+// use in output expressions (see NewOutputter).
+func defaultOutputFunctions() map[string]govaluate.ExpressionFunction {
+	f := map[string]govaluate.ExpressionFunction{
+		"exp":   unaryFunction("exp", math.Exp),
+		"log":   unaryFunction("log", math.Log),
+		"log10": unaryFunction("log10", math.Log10),
+		"sqrt":  unaryFunction("sqrt", math.Sqrt),
+		"abs":   unaryFunction("abs", math.Abs),
+		"pow": func(arg ...interface{}) (interface{}, error) {
+			v, err := scalarArgs("pow", 2, arg)
+			if err != nil {
+				return nil, err
+			}
+			return math.Pow(v[0], v[1]), nil
+		},
+		"min": func(arg ...interface{}) (interface{}, error) {
+			v, err := scalarArgs("min", -1, arg)
+			if err != nil {
+				return nil, err
+			}
+			return floats.Min(v), nil
+		},
+		"max": func(arg ...interface{}) (interface{}, error) {
+			v, err := scalarArgs("max", -1, arg)
+			if err != nil {
+				return nil, err
+			}
+			return floats.Max(v), nil
+		},
+		"if": func(arg ...interface{}) (interface{}, error) {
+			if len(arg) != 3 {
+				return nil, fmt.Errorf("inmap: got %d arguments for function 'if', but need 3", len(arg))
+			}
+			var cond bool
+			switch c := arg[0].(type) {
+			case bool:
+				cond = c
+			case float64:
+				cond = c != 0
+			default:
+				return nil, fmt.Errorf("inmap: the first argument of function 'if' is not a condition")
+			}
+			if cond {
+				return arg[1], nil
+			}
+			return arg[2], nil
+		},
+	}
+	f["loglinear"] = healthFunction("loglinear", 2, func(p []float64) epi.HRer {
+		return epi.Cox{Beta: p[0], Threshold: p[1]}
+	})
+	f["gemm"] = healthFunction("gemm", 5, func(p []float64) epi.HRer {
+		return epi.GEMM{Theta: p[0], Alpha: p[1], Mu: p[2], Nu: p[3], CF: p[4]}
+	})
+	f["ier"] = healthFunction("ier", 4, func(p []float64) epi.HRer {
+		return epi.IER{Alpha: p[0], Gamma: p[1], Delta: p[2], ZCF: p[3]}
+	})
+	for _, hr := range healthFunctions {
+		f[hr.Name()] = unaryFunction(hr.Name(), hr.HR)
+	}
+	// The aggregate functions are evaluated separately (see
+	// evaluateAggregates) but they need to be defined so that expressions
+	// that use them can be parsed.
+	for name := range aggregateFunctions {
+		if _, ok := f[name]; !ok {
+			name := name
+			f[name] = func(arg ...interface{}) (interface{}, error) {
+				return nil, fmt.Errorf("inmap: function '%s' can only be used within braces", name)
+			}
+		}
+	}
+	return f
+}
+
+// checkAggregates checks that the aggregate functions that can only be
+// used within braces are not used elsewhere in expression.
+func checkAggregates(expression string) error {
+	if m := aggregateOnly.FindStringSubmatch(braces.ReplaceAllString(expression, "")); m != nil {
+		return fmt.Errorf("inmap: function '%s' can only be used within braces, as in '{%s(...)}'", m[1], m[1])
+	}
+	return nil
+}
+
+// evaluateAggregates evaluates expression, which is the contents of a
+// segment of an output expression that was surrounded by braces.
+// Each call to an aggregate function in expression is replaced by the
+// result of the function applied to the values of its arguments,
+// which are per-cell expressions, in all of the grid cells, and the
+// result is evaluated. modelVals holds the values of the model
+// variables in each of the nCells grid cells.
+func evaluateAggregates(expression string, modelVals map[string]interface{}, nCells int, funcs map[string]govaluate.ExpressionFunction) (float64, error) {
+	// Evaluate the last call first, so that any calls within its
+	// arguments have already been evaluated. Calls to 'min' and 'max' with
+	// more than one argument are left to be evaluated as regular functions.
+	for limit := len(expression); ; {
+		locs := aggregateCall.FindAllStringSubmatchIndex(expression[:limit], -1)
+		if len(locs) == 0 {
+			break
+		}
+		loc := locs[len(locs)-1]
+		limit = loc[0]
+		name := expression[loc[2]:loc[3]]
+		args, end, err := splitArgs(expression, loc[1])
+		if err != nil {
+			return math.NaN(), fmt.Errorf("inmap: in '%s': %v", expression, err)
+		}
+		if (name == "min" || name == "max") && len(args) > 1 {
+			continue
+		}
+		vals := make([][]float64, len(args))
+		for i, a := range args {
+			if vals[i], err = evaluatePerCell(a, modelVals, nCells, funcs); err != nil {
+				return math.NaN(), err
+			}
+		}
+		result, err := aggregateFunctions[name](vals)
+		if err != nil {
+			return math.NaN(), fmt.Errorf("inmap: %v", err)
+		}
+		expression = expression[:loc[0]] + "(" + strconv.FormatFloat(result, 'f', -1, 64) + ")" + expression[end:]
+	}
+	e, err := govaluate.NewEvaluableExpressionWithFunctions(expression, funcs)
+	if err != nil {
+		return math.NaN(), err
+	}
+	if vars := e.Vars(); len(vars) > 0 {
+		return math.NaN(), fmt.Errorf("inmap: variable(s) %v within braces must be arguments of an aggregate function such as sum", vars)
+	}
+	result, err := e.Evaluate(nil)
+	if err != nil {
+		return math.NaN(), err
+	}
+	v, ok := result.(float64)
+	if !ok {
+		return math.NaN(), fmt.Errorf("inmap: expression '%s' does not result in a number", expression)
+	}
+	return v, nil
+}
+
+// splitArgs splits the comma-separated function arguments that begin at
+// index start of expression, just after the opening parenthesis, and
+// returns them along with the index just after the closing parenthesis.
+func splitArgs(expression string, start int) (args []string, end int, err error) {
+	depth := 0
+	argStart := start
+	for i := start; i < len(expression); i++ {
+		switch expression[i] {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				args = append(args, strings.TrimSpace(expression[argStart:i]))
+				return args, i + 1, nil
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				args = append(args, strings.TrimSpace(expression[argStart:i]))
+				argStart = i + 1
+			}
+		}
+	}
+	return nil, -1, fmt.Errorf("unbalanced parentheses")
+}
+
+// evaluatePerCell returns the value of expression in each of the nCells
+// grid cells, where modelVals holds the values of the model variables in
+// each cell.
+func evaluatePerCell(expression string, modelVals map[string]interface{}, nCells int, funcs map[string]govaluate.ExpressionFunction) ([]float64, error) {
+	e, err := govaluate.NewEvaluableExpressionWithFunctions(expression, funcs)
+	if err != nil {
+		return nil, err
+	}
+	vars := e.Vars()
+	valByRow := make(map[string]interface{}, len(vars))
+	o := make([]float64, nCells)
+	for i := range o {
+		for _, name := range vars {
+			v, ok := modelVals[name]
+			if !ok {
+				return nil, fmt.Errorf("inmap: undefined variable name '%s'", name)
+			}
+			valByRow[name] = v.([]float64)[i]
+		}
+		result, err := e.Evaluate(valByRow)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := result.(float64)
+		if !ok {
+			return nil, fmt.Errorf("inmap: expression '%s' does not result in a number", expression)
+		}
+		o[i] = r
+	}
+	return o, nil
+}
@@ -0,0 +1,141 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"testing"
+
+	"github.com/Knetic/govaluate"
+)
+
+func TestOutputFunctions(t *testing.T) {
+	funcs := defaultOutputFunctions()
+	for _, test := range []struct {
+		expression string
+		want       float64
+	}{
+		{expression: "log10(1000)", want: 3},
+		{expression: "log(exp(2))", want: 2},
+		{expression: "sqrt(16) + abs(-1)", want: 5},
+		{expression: "pow(2, 10)", want: 1024},
+		{expression: "min(3, 1, 2)", want: 1},
+		{expression: "max(3, 1, 2)", want: 3},
+		{expression: "if(2 > 1, 10, 20)", want: 10},
+		{expression: "if(0, 10, 20)", want: 20},
+		{expression: "loglinear(log(1.078)/10, 5, 15)", want: 1.078},
+		{expression: "Krewski2009Ecologic(15)", want: 1.078},
+		{expression: "gemm(0.143, 1.6, 15.5, 36.8, 2.4, 22.4)", want: 1.218299559140952},
+		{expression: "GEMMNCDLRI(22.4)", want: 1.218299559140952},
+		{expression: "Sun2015PretermBirth(10)", want: 1.13},
+		{expression: "ier(0.5, 0.01, 1, 5, 3)", want: 1},
+	} {
+		e, err := govaluate.NewEvaluableExpressionWithFunctions(test.expression, funcs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := e.Evaluate(nil)
+		if err != nil {
+			t.Fatalf("%s: %v", test.expression, err)
+		}
+		if math.Abs(result.(float64)-test.want) > 1.e-10 {
+			t.Errorf("%s: have %g, want %g", test.expression, result, test.want)
+		}
+	}
+}
+
+func TestEvaluateAggregates(t *testing.T) {
+	funcs := defaultOutputFunctions()
+	modelVals := map[string]interface{}{
+		"TotalPM25": []float64{1, 2, 3, 4},
+		"TotalPop":  []float64{4, 3, 2, 1},
+	}
+	for _, test := range []struct {
+		expression string
+		want       float64
+	}{
+		{expression: "sum(TotalPop)", want: 10},
+		{expression: "mean(TotalPM25)", want: 2.5},
+		{expression: "weightedmean(TotalPM25, TotalPop)", want: 2},
+		{expression: "sum(TotalPM25 * TotalPop) / sum(TotalPop)", want: 2},
+		{expression: "max(TotalPM25) - min(TotalPM25)", want: 3},
+		{expression: "max(sum(TotalPop), 2 * sum(TotalPM25))", want: 20},
+		{expression: "sum(if(TotalPM25 > 2, TotalPop, 0))", want: 3},
+		{expression: "atkinson(TotalPM25, TotalPop, -1)", want: math.Sqrt(5)/2 - 1},
+		{expression: "atkinson(TotalPM25, TotalPop, 1)", want: 1 - math.Pow(2*2*2*3*3*4, 0.1)/2},
+		{expression: "atkinson(TotalPop / TotalPop, TotalPop, -1)", want: 0},
+		{expression: "concindex(TotalPM25, TotalPop, TotalPM25)", want: 0.27},
+		{expression: "concindex(TotalPM25, TotalPop, TotalPop)", want: -0.27},
+	} {
+		result, err := evaluateAggregates(test.expression, modelVals, 4, funcs)
+		if err != nil {
+			t.Fatalf("%s: %v", test.expression, err)
+		}
+		if math.Abs(result-test.want) > 1.e-10 {
+			t.Errorf("%s: have %g, want %g", test.expression, result, test.want)
+		}
+	}
+	if _, err := evaluateAggregates("sum(TotalPop) * TotalPM25", modelVals, 4, funcs); err == nil {
+		t.Error("variables outside of aggregate functions should cause an error")
+	}
+}
+
+func TestNewOutputter_validation(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		vars map[string]string
+	}{
+		{
+			name: "self reference",
+			vars: map[string]string{"A": "B + 1", "B": "A * 2"},
+		},
+		{
+			name: "aggregate outside braces",
+			vars: map[string]string{"A": "sum(TotalPop)"},
+		},
+		{
+			name: "duplicate intermediate",
+			vars: map[string]string{"[A]": "TotalPop", "A": "TotalPM25"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewOutputter("", false, test.vars, nil, nil); err == nil {
+				t.Error("should have caused an error")
+			}
+		})
+	}
+}
+
+func TestNewOutputter_intermediates(t *testing.T) {
+	o, err := NewOutputter("", false, map[string]string{
+		"[PopPM]":   "TotalPop * TotalPM25",
+		"[PWAvg]":   "{sum(PopPM) / sum(TotalPop)}",
+		"PWRatio":   "TotalPM25 / PWAvg",
+		"TotalPM25": "TotalPM25",
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(o.outputVariables) != 2 {
+		t.Errorf("intermediate expressions should not be output: %v", o.outputVariables)
+	}
+	if want := "TotalPM25 / ({sum((TotalPop * TotalPM25)) / sum(TotalPop)})"; o.outputVariables["PWRatio"] != want {
+		t.Errorf("have %s, want %s", o.outputVariables["PWRatio"], want)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+
+	"github.com/ctessum/atmos/acm2"
+	"github.com/ctessum/atmos/seinfeld"
+	"github.com/ctessum/atmos/wesely1989"
+)
+
+// OverWater specifies whether the surface layer over water should be
+// parameterized separately from the surface layer over land. When it is
+// true, the friction velocity, roughness length, and Monin-Obukhov
+// length over the water in each grid cell are calculated from the wind
+// speed using COARE-style bulk surface flux relationships (see
+// overWaterSurfaceLayer) rather than taken from the meteorological
+// input, and they are used to calculate the dry deposition velocities
+// for the part of the cell that is covered by water. In cells that are
+// mostly water, they are also used to calculate the atmospheric
+// stability and vertical mixing. Water is identified by the Wesely
+// (1989) "Water" land use category. This can improve the accuracy of
+// simulations of emissions from ports and shipping lanes.
+func OverWater(overWater bool) PreprocessOption {
+	return func(o *preprocessOptions) {
+		o.overWater = overWater
+	}
+}
+
+// waterFraction returns the fraction of a grid cell that is covered by
+// water, given the fractions of Wesely (1989) land use categories in it.
+func waterFraction(weselyLU []landUseFraction) float64 {
+	var f float64
+	for _, lu := range weselyLU {
+		if wesely1989.LandUseCategory(lu.category) == wesely1989.Water {
+			f += lu.fraction
+		}
+	}
+	return f
+}
+
+// overWaterSurfaceLayer returns the friction velocity (ustar [m/s]),
+// roughness length (z0 [m]), and Monin-Obukhov length (L [m]) over water
+// when the wind speed is U [m/s] at height z [m], the surface heat flux
+// is hfx [W/m2], the air density is ρ [kg/m3], and the boundary layer
+// average potential temperature is To [K].
+//
+// It follows the bulk algorithm of COARE 3.0 (Fairall et al., 2003,
+// doi:10.1175/1520-0442(2003)016<0571:BPOASF>2.0.CO;2): the roughness
+// length is the sum of the Charnock relationship, with a Charnock
+// parameter that increases from 0.011 at wind speeds of 10 m/s and below
+// to 0.018 at 18 m/s and above, and a smooth-flow term, and the friction
+// velocity is calculated from Monin-Obukhov similarity with the
+// Businger-Dyer stability functions, iterating because the roughness
+// length and the Monin-Obukhov length depend on the friction velocity.
+// A gustiness velocity of 0.5 m/s is added to the wind speed so that
+// there is turbulence in calm conditions. L is calculated in the same way
+// as the Monin-Obukhov length over land (acm2.ObukhovLen), so it has the
+// same sign convention.
+func overWaterSurfaceLayer(U, z, hfx, ρ, To float64) (ustar, z0, L float64) {
+	const (
+		κ  = 0.4     // von Kármán constant
+		g  = 9.80665 // m/s2
+		ν  = 1.5e-5  // kinematic viscosity of air [m2/s]
+		ug = 0.5     // gustiness velocity [m/s]
+	)
+	S := math.Hypot(U, ug)
+	α := 0.011 + (0.018-0.011)*math.Max(0, math.Min(1, (U-10)/(18-10))) // Charnock parameter
+
+	ustar = 0.035 * S
+	for i := 0; i < 10; i++ {
+		z0 = α*ustar*ustar/g + 0.11*ν/ustar
+		L = acm2.ObukhovLen(hfx, ρ, To, ustar)
+		ustar = κ * S / (math.Log(z/z0) - psiM(z/L))
+	}
+	z0 = α*ustar*ustar/g + 0.11*ν/ustar
+	L = acm2.ObukhovLen(hfx, ρ, To, ustar)
+	return ustar, z0, L
+}
+
+// psiM returns the integrated Businger-Dyer stability function for
+// momentum for stability parameter ζ = z/L, which is limited to
+// between -5 and 1, where the functions are valid.
+func psiM(ζ float64) float64 {
+	switch {
+	case math.IsNaN(ζ), ζ == 0:
+		return 0
+	case ζ > 0:
+		return -5 * math.Min(ζ, 1)
+	default:
+		x := math.Pow(1-16*math.Max(ζ, -5), 0.25)
+		return 2*math.Log((1+x)/2) + math.Log((1+x*x)/2) - 2*math.Atan(x) + math.Pi/2
+	}
+}
+
+// withoutWater returns the Seinfeld and Pandis (2006) land use fractions
+// in seinfeldLU after removing the fraction fWater of the grid cell that
+// is covered by water, which is included in the Desert category. The
+// remaining fractions are scaled so that they add up to 1-fWater.
+func withoutWater(seinfeldLU []landUseFraction, fWater float64) []landUseFraction {
+	if fWater <= 0 {
+		return seinfeldLU
+	}
+	o := make([]landUseFraction, 0, len(seinfeldLU))
+	var sum float64
+	for _, lu := range seinfeldLU {
+		if seinfeld.LandUseCategory(lu.category) == seinfeld.Desert {
+			lu.fraction = math.Max(0, lu.fraction-fWater)
+		}
+		if lu.fraction > 0 {
+			o = append(o, lu)
+			sum += lu.fraction
+		}
+	}
+	for i := range o {
+		o[i].fraction *= (1 - fWater) / sum
+	}
+	return o
+}
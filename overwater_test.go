@@ -0,0 +1,162 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ctessum/atmos/seinfeld"
+	"github.com/ctessum/sparse"
+)
+
+func TestOverWaterSurfaceLayer(t *testing.T) {
+	ρ := 1.2
+	const To = 290.
+	// Neutral conditions at 10 m/s, where COARE gives a friction
+	// velocity of about 0.36 m/s and a roughness length of about 0.2 mm.
+	ustar, z0, L := overWaterSurfaceLayer(10, 10, 0, ρ, To)
+	if ustar < 0.3 || ustar > 0.45 {
+		t.Errorf("neutral ustar = %g m/s", ustar)
+	}
+	if z0 < 5.e-5 || z0 > 5.e-4 {
+		t.Errorf("neutral z0 = %g m", z0)
+	}
+	if !math.IsInf(L, 0) {
+		t.Errorf("neutral L should be infinite but is %g", L)
+	}
+
+	uLow, z0Low, _ := overWaterSurfaceLayer(5, 10, 0, ρ, To)
+	uHigh, z0High, _ := overWaterSurfaceLayer(20, 10, 0, ρ, To)
+	if uLow >= ustar || uHigh <= ustar || z0Low >= z0 || z0High <= z0 {
+		t.Errorf("ustar and z0 should increase with wind speed: ustar = %g, %g, %g; z0 = %g, %g, %g",
+			uLow, ustar, uHigh, z0Low, z0, z0High)
+	}
+
+	// Heat fluxes with opposite signs should give Monin-Obukhov lengths
+	// with opposite signs, and the friction velocity should be larger
+	// when L is negative (unstable) than when it is positive (stable).
+	u1, _, L1 := overWaterSurfaceLayer(5, 10, 50, ρ, To)
+	u2, _, L2 := overWaterSurfaceLayer(5, 10, -50, ρ, To)
+	if L1*L2 >= 0 {
+		t.Errorf("L should have opposite signs: %g, %g", L1, L2)
+	}
+	if L1 > 0 {
+		u1, u2 = u2, u1
+	}
+	if u1 <= uLow || u2 >= uLow {
+		t.Errorf("ustar should be larger when unstable and smaller when stable: %g, %g, %g", u1, uLow, u2)
+	}
+
+	if u, _, _ := overWaterSurfaceLayer(0, 10, 0, ρ, To); u <= 0 || math.IsNaN(u) {
+		t.Errorf("calm ustar should be positive but is %g", u)
+	}
+}
+
+func TestWithoutWater(t *testing.T) {
+	lu := []landUseFraction{
+		{category: int(seinfeld.Grass), fraction: 0.25},
+		{category: int(seinfeld.Desert), fraction: 0.75},
+	}
+	have := withoutWater(lu, 0.5)
+	want := []landUseFraction{
+		{category: int(seinfeld.Grass), fraction: 0.25},
+		{category: int(seinfeld.Desert), fraction: 0.25},
+	}
+	if len(have) != len(want) {
+		t.Fatalf("have %v, want %v", have, want)
+	}
+	for i := range want {
+		if have[i].category != want[i].category || different(have[i].fraction, want[i].fraction, 1.e-12) {
+			t.Errorf("have %v, want %v", have, want)
+		}
+	}
+	if have := withoutWater(lu, 0); len(have) != 2 || have[1].fraction != 0.75 {
+		t.Errorf("with no water, the fractions should not change: %v", have)
+	}
+}
+
+func TestStabilityMixingChemistryOverWater(t *testing.T) {
+	table, err := LoadLandUseTable("NLCD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerHeights := geopotentialToHeight(PH[0], PHB[0])
+	windSpeed := sparse.ZerosDense(T[0].Shape...)
+	for i := range windSpeed.Elements {
+		windSpeed.Elements[i] = 8
+	}
+	// water is land use fractions where each cell is all open water.
+	water := make([]*sparse.DenseArray, len(LUIndex))
+	for i := range water {
+		water[i] = sparse.ZerosDense(40, 2, 2)
+		for j := 0; j < 2; j++ {
+			for ii := 0; ii < 2; ii++ {
+				water[i].Set(1, 21-1, j, ii) // code 21: open water
+			}
+		}
+	}
+	convert := func(f func(NextData, LandUseTable) NextData) []*sparse.DenseArray {
+		next := f(testNextData(water), table)
+		var o []*sparse.DenseArray
+		for range water {
+			d, err := next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			o = append(o, d)
+		}
+		return o
+	}
+	seinfeldLU := convert(cmaqSeinfeldLandUseFraction)
+	weselyLU := convert(cmaqWeselyLandUseFraction)
+	z0 := convert(cmaqZ0Fraction)
+
+	// dryDep returns the particle, coarse particle, SO2, and NOx dry
+	// deposition velocities and Kzz.
+	dryDep := func(overWater bool) []*sparse.DenseArray {
+		pFunc := cmaqPressureConvert(testNextData(P), testNextData(PB))
+		tempFunc := cmaqTemperatureConvert(testNextData(T), cmaqPressureConvert(testNextData(P), testNextData(PB)))
+		_, _, Kzz, _, _, _, particleDryDep, coarseParticleDryDep, SO2DryDep, NOxDryDep, _, _, _, err := stabilityMixingChemistry(layerHeights,
+			testNextData(PBLH), testNextData(UST), testNextData(ALT), tempFunc, pFunc, testNextData(HFX),
+			testNextData(ho), testNextData(h2o2), testNextData(z0), testNextData(seinfeldLU), testNextData(weselyLU),
+			testNextData(QCLOUD), cmaqRadiationDown(testNextData(SWDOWN), testNextData(GLW)), testNextData(QRAIN),
+			windSpeed, overWater)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []*sparse.DenseArray{particleDryDep, coarseParticleDryDep, SO2DryDep, NOxDryDep, Kzz}
+	}
+	land := dryDep(false)
+	over := dryDep(true)
+	for i := range over {
+		var changed bool
+		for j, v := range over[i].Elements {
+			if v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+				t.Errorf("variable %d, element %d: invalid value %g", i, j, v)
+			}
+			if different(v, land[i].Elements[j], 1.e-6) {
+				changed = true
+			}
+		}
+		if !changed {
+			t.Errorf("variable %d should be changed by the over-water treatment", i)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"io"
+	"math"
+
+	"github.com/ctessum/sparse"
+)
+
+// Ozone specifies whether the variables needed by a reduced-form ozone
+// (O3) formation scheme should be included in the preprocessed output.
+// When it is true, the preprocessor's O3 and HNO3 methods are used to
+// calculate the average baseline O3 concentration ("O3"), the
+// fraction of ozone formation that is NOx-limited rather than VOC-limited
+// ("O3NOxSensitivity"), and the rates of NOx and VOC oxidation by the
+// hydroxyl radical ("NOxOxidation" and "VOCOxidation").
+func Ozone(ozone bool) PreprocessOption {
+	return func(o *preprocessOptions) {
+		o.ozone = ozone
+	}
+}
+
+const (
+	mwO3 = 47.9982 // g/mol, molar mass of ozone
+
+	// o3RegimeThreshold is the ratio of H2O2 to HNO3 concentrations
+	// above which ozone formation is NOx-limited and below which it is
+	// VOC-limited (Sillman, 1995, doi:10.1029/94JD02953).
+	o3RegimeThreshold = 0.35
+
+	// kVOCHO is a lumped rate constant for the reaction of
+	// secondary organic aerosol precursors with the hydroxyl radical
+	// [cm3/molec/s], typical of aromatic compounds (Atkinson and Arey, 2003).
+	kVOCHO = 1.e-11
+)
+
+// ozoneChemistry calculates the variables needed by a reduced-form ozone
+// formation scheme. Inputs are inverse density (alt [m3/kg]),
+// temperature (T [K]), and HO, H2O2, O3, and HNO3 mixing ratios [ppmv].
+// The outputs are the average O3 concentration [μg/m3], the fraction of
+// ozone formation that is NOx-limited, and the rates of NOx and VOC
+// oxidation by HO [1/s].
+//
+// Ozone formation is considered to be NOx-limited when the ratio of H2O2
+// to HNO3 is above o3RegimeThreshold. Because ozone is only formed when
+// NOx and VOCs are being oxidized, the fraction of ozone formation that
+// is NOx-limited is weighted by the rate of NOx oxidation in each time step.
+func ozoneChemistry(altFunc, TFunc, hoFunc, h2o2Func, o3Func, hno3Func NextData) (O3, NOxSensitivity, NOxOxidation, VOCOxidation *sparse.DenseArray, err error) {
+	var o3, noxLimited, noxOxidation, vocOxidation meanAccumulator
+	for {
+		alt, err := altFunc() // inverse density [m3/kg]
+		if err != nil {
+			if err == io.EOF { // done reading data: return results
+				sensitivity := sparse.ZerosDense(noxLimited.mean.Shape...)
+				for i, v := range noxLimited.mean.Elements {
+					if k := noxOxidation.mean.Elements[i]; k > 0 {
+						sensitivity.Elements[i] = v / k
+					}
+				}
+				return o3.mean, sensitivity, noxOxidation.mean, vocOxidation.mean, nil
+			}
+			return nil, nil, nil, nil, err
+		}
+		T, err := TFunc() // ambient temperature [K]
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		ho, err := hoFunc() // ppmv
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		h2o2, err := h2o2Func() // ppmv
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		o3Conc, err := o3Func() // ppmv
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		hno3, err := hno3Func() // ppmv
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		for _, acc := range []*meanAccumulator{&o3, &noxLimited, &noxOxidation, &vocOxidation} {
+			acc.next(T.Shape...)
+		}
+		for i, t := range T.Elements {
+			const cm3perm3 = 100. * 100. * 100.
+			const airFactor = MWa / 1000. / avNum * cm3perm3 // kg/molec.* cm3/m3
+			M := 1. / (alt.Elements[i] * airFactor)          // molec. air / cm3
+			hoConc := ho.Elements[i] * 1.e-6 * M             // molec. HO / cm3
+
+			// NO2 + HO rate (Stockwell 1997, Table 2d)
+			ko := 2.6e-30 * math.Pow(t/300., -3.2)
+			kinf := 2.4e-11 * math.Pow(t/300., -1.3)
+			NO2rate := (ko * M / (1 + ko*M/kinf)) * math.Pow(0.6,
+				1./(1+math.Pow(math.Log10(ko*M/kinf), 2.))) // cm3/molec/s
+			knox := NO2rate * hoConc
+			noxOxidation.addElement(i, knox)          // 1/s
+			vocOxidation.addElement(i, kVOCHO*hoConc) // 1/s
+
+			if h := hno3.Elements[i]; h2o2.Elements[i] > o3RegimeThreshold*h {
+				noxLimited.addElement(i, knox)
+			}
+
+			// Convert ppmv to μg/m3.
+			o3.addElement(i, o3Conc.Elements[i]*mwO3/(MWa*alt.Elements[i])*1000.)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"testing"
+
+	"github.com/ctessum/sparse"
+)
+
+func TestOzoneChemistry(t *testing.T) {
+	const tolerance = 1.0e-8
+
+	constant := func(v ...float64) NextData {
+		a := sparse.ZerosDense(1, 1, len(v))
+		copy(a.Elements, v)
+		return testNextData([]*sparse.DenseArray{a, a})
+	}
+	// The first grid cell is NOx-limited in both time steps,
+	// the second is VOC-limited in both time steps, and the third
+	// is NOx-limited in the first time step only.
+	hno3 := []*sparse.DenseArray{sparse.ZerosDense(1, 1, 3), sparse.ZerosDense(1, 1, 3)}
+	hno3[0].Elements = []float64{1.e-3, 1.e-2, 1.e-3}
+	hno3[1].Elements = []float64{1.e-3, 1.e-2, 1.e-2}
+
+	o3, sensitivity, noxOxidation, vocOxidation, err := ozoneChemistry(
+		constant(0.85, 0.85, 0.85), constant(298, 298, 298), constant(4.e-8, 4.e-8, 4.e-8),
+		constant(1.e-3, 1.e-3, 1.e-3), constant(0.04, 0.04, 0.04), testNextData(hno3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o3Want := sparse.ZerosDense(1, 1, 3)
+	for i := range o3Want.Elements {
+		o3Want.Elements[i] = 0.04 * mwO3 / (MWa * 0.85) * 1000
+	}
+	arrayCompare(o3, o3Want, tolerance, "O3", t)
+
+	sensitivityWant := sparse.ZerosDense(1, 1, 3)
+	sensitivityWant.Elements = []float64{1, 0, 0.5}
+	arrayCompare(sensitivity, sensitivityWant, tolerance, "O3NOxSensitivity", t)
+
+	// About 1×10⁶ molecules HO cm⁻³.
+	hoConc := 4.e-8 * 1.e-6 / (0.85 * MWa / 1000 / avNum * 1.e6)
+	for i, v := range vocOxidation.Elements {
+		if want := kVOCHO * hoConc; different(v, want, tolerance) {
+			t.Errorf("VOC oxidation %d: have %g, want %g", i, v, want)
+		}
+	}
+	// The NO2 + HO rate constant is about 1×10⁻¹¹ cm³ molecule⁻¹ s⁻¹
+	// at the surface.
+	for i, v := range noxOxidation.Elements {
+		if k := v / hoConc; k < 0.8e-11 || k > 1.5e-11 {
+			t.Errorf("NO2 + HO rate constant %d: have %g", i, k)
+		}
+	}
+}
+
+func TestGEOSChemOzone(t *testing.T) {
+	gc, err := NewGEOSChem(
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A1.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A3cld.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A3dyn.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].I3.2x25.nc",
+		"cmd/inmap/testdata/preproc/GEOSFP.[DATE].A3mstE.2x25.nc",
+		"",
+		"cmd/inmap/testdata/preproc/gc_output.[DATE].nc",
+		"cmd/inmap/testdata/preproc/geoschem-new/Olson_2001_Land_Map.025x025.generic.nc",
+		"20130102",
+		"20130104",
+		true,
+		"3h",
+		"3h",
+		true,
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Preprocess(gc, -2.5, 50, 2.5, 2, Ozone(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, r := range map[string]validRange{
+		"O3":               {1, 500}, // μg/m³
+		"O3NOxSensitivity": {0, 1},
+		"NOxOxidation":     {0, 1.e-3},
+		"VOCOxidation":     {0, 1.e-3},
+	} {
+		v, ok := data.Data[name]
+		if !ok {
+			t.Errorf("missing variable %s", name)
+			continue
+		}
+		// Check the ground level.
+		for _, val := range v.Data.Elements[:v.Data.Shape[1]*v.Data.Shape[2]] {
+			if val < r.min || val > r.max {
+				t.Errorf("%s = %g is outside of [%g, %g]", name, val, r.min, r.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,337 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/ctessum/geom/index/rtree"
+)
+
+// A Communicator passes messages among the workers in a distributed
+// simulation, each of which simulates one partition of the grid (see
+// LoadPartition). Every worker must call ExchangeIDs and Exchange the
+// same number of times and in the same order, and each call returns
+// after the corresponding message has been received from every other
+// worker.
+type Communicator interface {
+	// Rank returns the index of this worker, from 0 to Size()-1.
+	Rank() int
+
+	// Size returns the number of workers.
+	Size() int
+
+	// ExchangeIDs sends ids[i] to the worker with rank i and returns the
+	// IDs sent to this worker by each of the workers, where the IDs for
+	// this worker are ids[Rank()].
+	ExchangeIDs(ids [][]int64) ([][]int64, error)
+
+	// Exchange is the same as ExchangeIDs, but for floating-point values.
+	Exchange(vals [][]float64) ([][]float64, error)
+}
+
+// partition holds the information that a worker in a distributed
+// simulation needs to exchange concentrations with the other workers.
+type partition struct {
+	comm Communicator
+
+	// send holds, for each worker, the cells in this partition that are
+	// in the halo of that worker's partition, and recv holds the cells
+	// in the halo of this partition that are in that worker's partition.
+	// Both are in the order of the cell IDs requested by the receiving
+	// worker.
+	send, recv [][]*Cell
+}
+
+// LoadPartition is the same as Load, except that it only loads the
+// part of the grid that is simulated by this worker in a distributed
+// simulation, where comm passes messages among the workers, so that grids
+// that are too large to be simulated on one computer can be simulated
+// on several. Every worker must load the same grid, which can not be a
+// global grid.
+//
+// The grid is divided into strips from west to east with about the same
+// number of grid cells in each, and each cell belongs to the worker whose
+// strip contains the center of the cell. Each worker simulates the cells
+// that belong to it, and keeps the neighbors of those cells that belong to
+// other workers as a halo, whose concentrations are received from the
+// other workers in each time step by HaloExchange. Each worker decodes the
+// whole grid, but only the cells that overlap its strip in the east-west
+// direction are kept when the neighbors, the spatial index, and the
+// concentration storage are set up, so the memory used during the
+// simulation depends on the size of the partition. The results, such as
+// those from Results and the Outputter, are for the cells in the
+// partition.
+//
+// Transport calculations that change the concentrations in neighboring
+// cells or use the concentrations in the neighbors of neighboring
+// cells, such as VanLeerAdvection, give different results next to the
+// edges of the partitions than in a simulation that is not distributed.
+func LoadPartition(r io.Reader, config *VarGridConfig, emis *Emissions, m Mechanism, comm Communicator) DomainManipulator {
+	return func(d *InMAP) error {
+		var data versionCells
+		if err := gob.NewDecoder(r).Decode(&data); err != nil {
+			return fmt.Errorf("inmap: loading partition: %v", err)
+		}
+		if data.DataVersion != VarGridDataVersion {
+			return fmt.Errorf("InMAP variable grid data version %s is not compatible with "+
+				"the required version %s", data.DataVersion, VarGridDataVersion)
+		}
+		if config.globalBounds() != nil {
+			return fmt.Errorf("inmap: global grids can not be partitioned")
+		}
+		rank := comm.Rank()
+		owners, err := stripOwners(data.Cells, comm.Size())
+		if err != nil {
+			return err
+		}
+
+		// Keep the cells that overlap the cells in this partition in the
+		// east-west direction, which include all of their neighbors.
+		xmin, xmax := math.Inf(1), math.Inf(-1)
+		for i, c := range data.Cells {
+			if owners[i] == rank {
+				b := c.Bounds()
+				xmin, xmax = math.Min(xmin, b.Min.X), math.Max(xmax, b.Max.X)
+			}
+		}
+		var cells []*Cell
+		ids := make(map[*Cell]int64)
+		for i, c := range data.Cells {
+			if b := c.Bounds(); b.Max.X >= xmin && b.Min.X <= xmax {
+				cells = append(cells, c)
+				ids[c] = int64(i)
+			}
+		}
+		data.Cells = nil
+
+		if err := d.initFromCells(cells, nil, config, m); err != nil {
+			return err
+		}
+		p := &partition{comm: comm}
+		p.prune(d, func(c *Cell) int { return owners[ids[c]] }, ids)
+		if err := p.connect(d, ids); err != nil {
+			return err
+		}
+		d.partition = p
+		return d.SetEmissionsFlux(emis, m)
+	}
+}
+
+// stripOwners divides cells among n workers in strips from west to east
+// with about the same number of cells in each, and returns the rank of
+// the worker that each cell belongs to.
+func stripOwners(cells []*Cell, n int) ([]int, error) {
+	x := make([]float64, len(cells))
+	for i, c := range cells {
+		b := c.Bounds()
+		x[i] = (b.Min.X + b.Max.X) / 2
+	}
+	sorted := append([]float64{}, x...)
+	sort.Float64s(sorted)
+	// edges[i] is the western edge of strip i+1.
+	edges := make([]float64, n-1)
+	for i := range edges {
+		edges[i] = sorted[(i+1)*len(sorted)/n]
+	}
+	owners := make([]int, len(cells))
+	count := make([]int, n)
+	for i, v := range x {
+		owners[i] = sort.Search(len(edges), func(j int) bool { return v < edges[j] })
+		count[owners[i]]++
+	}
+	for rank, c := range count {
+		if c == 0 {
+			return nil, fmt.Errorf("inmap: partition %d has no grid cells; the grid is too small to be divided among %d workers", rank, n)
+		}
+	}
+	return owners, nil
+}
+
+// prune removes the grid cells that do not belong to this worker, as
+// determined by owner, from the cells that are simulated in d, and
+// finds the neighbors of the cells that do belong to it, which are the
+// halo of the partition.
+func (p *partition) prune(d *InMAP, owner func(*Cell) int, ids map[*Cell]int64) {
+	rank := p.comm.Rank()
+	owned := func(c *Cell) bool { return !c.boundary && owner(c) == rank }
+
+	halo := make(map[*Cell]bool)
+	boundary := make(map[*Cell]bool)
+	for _, c := range *d.cells {
+		if !owned(c.Cell) {
+			continue
+		}
+		for _, l := range []cellList{c.west, c.east, c.south, c.north, c.below, c.above, c.groundLevel} {
+			for _, n := range l {
+				if n.boundary {
+					boundary[n.Cell] = true
+				} else if !owned(n.Cell) {
+					halo[n.Cell] = true
+				}
+			}
+		}
+	}
+
+	p.recv = make([][]*Cell, p.comm.Size())
+	d.cells.filter(func(c *Cell) bool {
+		if owned(c) {
+			return true
+		}
+		if halo[c] {
+			// The concentrations in halo cells are received from the
+			// workers they belong to. The other cells that are not in
+			// the partition are kept because the halo cells refer to them,
+			// for example when finding the grid cells in a column.
+			for i := range c.Ci {
+				c.Ci[i], c.Cf[i] = 0, 0
+			}
+			p.recv[owner(c)] = append(p.recv[owner(c)], c)
+		}
+		return false
+	})
+	for _, l := range []*cellList{d.westBoundary, d.eastBoundary,
+		d.northBoundary, d.southBoundary, d.topBoundary} {
+		l.filter(func(c *Cell) bool { return boundary[c] })
+	}
+	for _, cells := range p.recv {
+		sort.Slice(cells, func(i, j int) bool { return ids[cells[i]] < ids[cells[j]] })
+	}
+
+	d.index = rtree.NewTree(25, 50)
+	for _, c := range *d.cells {
+		d.index.Insert(c.Cell)
+	}
+}
+
+// connect requests the concentrations of the cells in the halo of this
+// partition from the workers they belong to, and receives the requests
+// of the other workers for the cells in this partition, where ids gives
+// the ID of each cell, which is the same for all of the workers.
+func (p *partition) connect(d *InMAP, ids map[*Cell]int64) error {
+	req := make([][]int64, len(p.recv))
+	for rank, cells := range p.recv {
+		for _, c := range cells {
+			req[rank] = append(req[rank], ids[c])
+		}
+	}
+	got, err := p.comm.ExchangeIDs(req)
+	if err != nil {
+		return fmt.Errorf("inmap: setting up halo exchange: %v", err)
+	}
+	byID := make(map[int64]*Cell, d.cells.len())
+	for _, c := range *d.cells {
+		byID[ids[c.Cell]] = c.Cell
+	}
+	p.send = make([][]*Cell, len(got))
+	for rank, rankIDs := range got {
+		if rank == p.comm.Rank() {
+			continue
+		}
+		for _, id := range rankIDs {
+			c, ok := byID[id]
+			if !ok {
+				return fmt.Errorf("inmap: worker %d requested grid cell %d, which is not in partition %d; "+
+					"check that all of the workers are using the same grid", rank, id, p.comm.Rank())
+			}
+			p.send[rank] = append(p.send[rank], c)
+		}
+	}
+	return nil
+}
+
+// exchangeHalo sends the concentrations of the cells in this partition
+// that are in the halos of other partitions to the workers they are
+// needed by, and sets the concentrations of the cells in the halo of
+// this partition to the ones received from the other workers.
+func (p *partition) exchangeHalo() error {
+	vals := make([][]float64, len(p.send))
+	for rank, cells := range p.send {
+		for _, c := range cells {
+			vals[rank] = append(vals[rank], c.Ci...)
+		}
+	}
+	got, err := p.comm.Exchange(vals)
+	if err != nil {
+		return fmt.Errorf("inmap: exchanging halo concentrations: %v", err)
+	}
+	for rank, cells := range p.recv {
+		v := got[rank]
+		n := 0
+		for _, c := range cells {
+			n += len(c.Ci)
+		}
+		if len(v) != n {
+			return fmt.Errorf("inmap: received %d halo concentrations from worker %d but expected %d", len(v), rank, n)
+		}
+		for _, c := range cells {
+			v = v[copy(c.Ci, v):]
+		}
+	}
+	return nil
+}
+
+// min returns the smallest of the values of v on all of the workers,
+// or NaN if any of them is NaN.
+func (p *partition) min(v float64) (float64, error) {
+	vals := make([][]float64, p.comm.Size())
+	for i := range vals {
+		vals[i] = []float64{v}
+	}
+	got, err := p.comm.Exchange(vals)
+	if err != nil {
+		return math.NaN(), err
+	}
+	for rank, g := range got {
+		if len(g) != 1 {
+			return math.NaN(), fmt.Errorf("inmap: received %d values from worker %d but expected 1", len(g), rank)
+		}
+		v = math.Min(v, g[0])
+	}
+	return v, nil
+}
+
+// all returns whether b is true on all of the workers.
+func (p *partition) all(b bool) (bool, error) {
+	v := 0.
+	if b {
+		v = 1
+	}
+	v, err := p.min(v)
+	return v == 1, err
+}
+
+// HaloExchange returns a function that, in a distributed simulation (see
+// LoadPartition), sets the concentrations in the cells in the halo of
+// this worker's partition to the ones in the partitions they belong to.
+// It must be run in each time step after the concentrations at the
+// beginning of the time step are set by AddEmissionsFlux and before the
+// transport calculations. It does nothing if the grid is not partitioned.
+func HaloExchange() DomainManipulator {
+	return func(d *InMAP) error {
+		if d.partition == nil {
+			return nil
+		}
+		return d.partition.exchangeHalo()
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap_test
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/distributed"
+	"github.com/yuzhou-wang/inmap/science/chem/simplechem"
+)
+
+func TestLoadPartition(t *testing.T) {
+	const (
+		E             = 1000000. // emissions [μg/s]
+		numIterations = 50
+		workers       = 3
+	)
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := inmap.VarGridTestData()
+	emis := inmap.NewEmissions()
+	for _, x := range []float64{-35000, -3999, 0, 12000} {
+		emis.Add(&inmap.EmisRecord{
+			SOx:  E,
+			NOx:  E,
+			PM25: E,
+			VOC:  E,
+			NH3:  E,
+			Geom: geom.Point{X: x, Y: -3999.},
+		})
+	}
+	var m simplechem.Mechanism
+	mutator, err := inmap.PopulationMutator(cfg, popIndices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var grid bytes.Buffer
+	d := &inmap.InMAP{
+		InitFuncs: []inmap.DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, nil, m),
+			cfg.MutateGrid(mutator, ctmdata, pop, mr, nil, m, nil),
+			inmap.Save(&grid),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	nCells := len(d.Cells())
+
+	// run runs a simulation initialized with load and returns the
+	// concentrations in each cell and the number of iterations.
+	run := func(load inmap.DomainManipulator, numIterations int) (map[string][]float64, int, error) {
+		iterations := 0
+		d := &inmap.InMAP{
+			InitFuncs: []inmap.DomainManipulator{load, inmap.SetTimestepCFL()},
+			RunFuncs: []inmap.DomainManipulator{
+				inmap.Calculations(inmap.AddEmissionsFlux()),
+				inmap.HaloExchange(),
+				inmap.Calculations(inmap.UpwindAdvection(), inmap.Mixing(),
+					inmap.MeanderMixing(), m.Chemistry()),
+				inmap.SteadyStateConvergenceCheck(numIterations, cfg.PopGridColumn, m, nil),
+				func(*inmap.InMAP) error { iterations++; return nil },
+			},
+		}
+		if err := d.Init(); err != nil {
+			return nil, 0, err
+		}
+		if err := d.Run(); err != nil {
+			return nil, 0, err
+		}
+		o := make(map[string][]float64)
+		for _, c := range d.Cells() {
+			o[fmt.Sprintf("%v %d", c.Bounds(), c.Layer)] = c.Cf
+		}
+		return o, iterations, nil
+	}
+
+	// runDistributed runs the simulation on the given number of workers
+	// and returns the concentrations in all of their partitions.
+	runDistributed := func(workers, numIterations int) (map[string][]float64, []int) {
+		lis := make([]net.Listener, workers)
+		addrs := make([]string, workers)
+		for i := range lis {
+			if lis[i], err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				t.Fatal(err)
+			}
+			addrs[i] = lis[i].Addr().String()
+		}
+		results := make([]map[string][]float64, workers)
+		iterations := make([]int, workers)
+		errs := make([]error, workers)
+		var wg sync.WaitGroup
+		for rank := range lis {
+			comm, err := distributed.NewWithListener(rank, lis[rank], addrs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer comm.Close()
+			wg.Add(1)
+			go func(rank int) {
+				defer wg.Done()
+				load := inmap.LoadPartition(bytes.NewReader(grid.Bytes()), cfg, emis, m, comm)
+				results[rank], iterations[rank], errs[rank] = run(load, numIterations)
+			}(rank)
+		}
+		wg.Wait()
+		o := make(map[string][]float64)
+		for rank, r := range results {
+			if errs[rank] != nil {
+				t.Fatalf("worker %d: %v", rank, errs[rank])
+			}
+			if len(r) == 0 || len(r) == nCells {
+				t.Errorf("worker %d: partition has %d of %d cells", rank, len(r), nCells)
+			}
+			for k, v := range r {
+				if _, ok := o[k]; ok {
+					t.Errorf("cell %s is in more than one partition", k)
+				}
+				o[k] = v
+			}
+		}
+		return o, iterations
+	}
+
+	load := func() inmap.DomainManipulator {
+		return func(d *inmap.InMAP) error {
+			return inmap.Load(bytes.NewReader(grid.Bytes()), cfg, emis, m)(d)
+		}
+	}
+
+	t.Run("iterations", func(t *testing.T) {
+		want, _, err := run(load(), numIterations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, _ := runDistributed(workers, numIterations)
+		if len(have) != len(want) {
+			t.Fatalf("have %d cells, want %d", len(have), len(want))
+		}
+		var sum float64
+		for k, w := range want {
+			h, ok := have[k]
+			if !ok {
+				t.Fatalf("missing cell %s", k)
+			}
+			for i := range w {
+				if different(h[i], w[i], 1.e-10) {
+					t.Errorf("cell %s species %d: have %g, want %g", k, i, h[i], w[i])
+				}
+				sum += w[i]
+			}
+		}
+		if sum == 0 {
+			t.Error("there should be pollution in the domain")
+		}
+	})
+
+	t.Run("convergence", func(t *testing.T) {
+		_, iterations := runDistributed(2, -1)
+		if iterations[0] != iterations[1] || iterations[0] < 2 {
+			t.Errorf("the workers should have converged at the same iteration: %v", iterations)
+		}
+	})
+
+	t.Run("too many workers", func(t *testing.T) {
+		comm := &singleComm{size: nCells + 1}
+		_, _, err := run(inmap.LoadPartition(bytes.NewReader(grid.Bytes()), cfg, emis, m, comm), 1)
+		if err == nil {
+			t.Error("there should be an error when there are more workers than grid cells")
+		}
+	})
+}
+
+// singleComm is an inmap.Communicator for the first of size workers
+// that does not communicate with the others.
+type singleComm struct {
+	size int
+}
+
+func (c *singleComm) Rank() int { return 0 }
+func (c *singleComm) Size() int { return c.size }
+func (c *singleComm) ExchangeIDs(ids [][]int64) ([][]int64, error) {
+	return make([][]int64, c.size), nil
+}
+func (c *singleComm) Exchange(vals [][]float64) ([][]float64, error) {
+	return make([][]float64, c.size), nil
+}
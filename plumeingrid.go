@@ -0,0 +1,140 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/ctessum/geom"
+)
+
+// addPlumeInGridEmissions adds the emissions of the elevated sources in
+// emis to the cells in d using a Gaussian plume sub-model, which is used
+// when emis.PlumeDistance is greater than zero.
+//
+// Rather than being added to the grid cell that the plume rises to,
+// the emissions are transported downwind by the wind in that cell for
+// a distance of emis.PlumeDistance as a Gaussian plume, and are then
+// added to the grid cells that the plume overlaps at that distance.
+// This avoids the instantaneous dilution of large point sources into
+// coarse grid cells. The horizontal and vertical dispersion of the plume
+// are calculated from the fraction of the time that the atmosphere is
+// stable in the cell that the plume rises to, and the plume is reflected
+// at the ground. Chemistry and deposition are not calculated within the
+// plume, and all of the emitted mass is added to the grid. Emissions
+// from sources in cells with no wind, or whose plumes are transported
+// out of the grid, are added to the cell the plume rises to.
+func (d *InMAP) addPlumeInGridEmissions(emis *Emissions, m Mechanism) error {
+	for _, e := range emis.dataSlice {
+		if e.Height <= 0 || e.ReleaseTop > 0 {
+			continue
+		}
+		sources, fractions := d.CellIntersections(e.Geom)
+		for i, c := range sources {
+			in, plumeHeight, err := c.IsPlumeInRecord(e)
+			if err != nil {
+				return fmt.Errorf("inmap: calculating plume-in-grid emissions: %v", err)
+			}
+			if !in {
+				continue
+			}
+			cells, weights := d.plumeCells(c, plumeSource(e.Geom, c), plumeHeight, emis.PlumeDistance)
+			for j, cc := range cells {
+				if err := cc.addEmisFlux(e, fractions[i]*weights[j], m); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// plumeSource returns the location of the source of emissions with
+// geometry g in cell c: g itself if it is a point, or otherwise the
+// center of c.
+func plumeSource(g geom.Geom, c *Cell) geom.Point {
+	if p, ok := g.(geom.Point); ok {
+		return p
+	}
+	return c.Centroid()
+}
+
+// plumeCells returns the cells that a plume from point p at height h [m]
+// in cell c overlaps after it has been transported downwind for
+// distance x, and the fraction of the plume mass in each cell.
+func (d *InMAP) plumeCells(c *Cell, p geom.Point, h, x float64) ([]*Cell, []float64) {
+	u := math.Hypot(c.UAvg, c.VAvg)
+	if u == 0 {
+		return []*Cell{c}, []float64{1}
+	}
+	p = geom.Point{X: p.X + x*c.UAvg/u, Y: p.Y + x*c.VAvg/u}
+	σy, σz := plumeDispersion(x, c.SClass)
+
+	const nσ = 4. // Include the cells within 4 standard deviations.
+	b := &geom.Bounds{
+		Min: geom.Point{X: p.X - nσ*σy, Y: p.Y - nσ*σy},
+		Max: geom.Point{X: p.X + nσ*σy, Y: p.Y + nσ*σy},
+	}
+	var cells []*Cell
+	var weights []float64
+	var total float64
+	for _, cI := range d.index.SearchIntersect(b) {
+		cc := cI.(*Cell)
+		cb := cc.Bounds()
+		w := gaussianFraction(cb.Min.X, cb.Max.X, p.X, σy) *
+			gaussianFraction(cb.Min.Y, cb.Max.Y, p.Y, σy) *
+			(gaussianFraction(cc.LayerHeight, cc.LayerHeight+cc.Dz, h, σz) +
+				gaussianFraction(cc.LayerHeight, cc.LayerHeight+cc.Dz, -h, σz)) // reflection at the ground
+		if w > 0 {
+			cells = append(cells, cc)
+			weights = append(weights, w)
+			total += w
+		}
+	}
+	if total == 0 {
+		return []*Cell{c}, []float64{1}
+	}
+	for i := range weights {
+		weights[i] /= total
+	}
+	return cells, weights
+}
+
+// gaussianFraction returns the fraction of a normal distribution with
+// mean μ and standard deviation σ that is between a and b.
+func gaussianFraction(a, b, μ, σ float64) float64 {
+	return 0.5 * (math.Erf((b-μ)/(math.Sqrt2*σ)) - math.Erf((a-μ)/(math.Sqrt2*σ)))
+}
+
+// plumeDispersion returns the horizontal and vertical standard
+// deviations [m] of the concentrations in a plume at downwind distance
+// x [m], interpolated between the values for Pasquill-Gifford stability
+// classes B (unstable) and E (stable) according to the fraction of the
+// time that the atmosphere is stable, sClass. It uses the open-country
+// formulas of Briggs (1973), as given in Seinfeld and Pandis (2006)
+// Table 18.4.
+func plumeDispersion(x, sClass float64) (σy, σz float64) {
+	σyUnstable := 0.16 * x / math.Sqrt(1+0.0001*x)
+	σzUnstable := 0.12 * x
+	σyStable := 0.06 * x / math.Sqrt(1+0.0001*x)
+	σzStable := 0.03 * x / (1 + 0.0003*x)
+	return (1-sClass)*σyUnstable + sClass*σyStable,
+		(1-sClass)*σzUnstable + sClass*σzStable
+}
@@ -0,0 +1,111 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestPlumeInGrid(t *testing.T) {
+	const (
+		tol = 1.e-8
+		E   = 1000. // emissions [μg/s]
+	)
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	m := Mech{}
+
+	// emisFlux returns the emissions in each cell [μg/s] when the
+	// emissions are transported for the given plume distance.
+	emisFlux := func(plumeDistance float64) []float64 {
+		emis := NewEmissions()
+		emis.PlumeDistance = plumeDistance
+		emis.Add(&EmisRecord{
+			Geom:   geom.Point{X: -1000, Y: -1000},
+			PM25:   E,
+			Height: 150, // Layer 2
+		})
+		d := &InMAP{
+			InitFuncs: []DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+			},
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		cells := d.cells.array()
+		e := make([]float64, len(cells))
+		for i, c := range cells {
+			e[i] = c.EmisFlux[iPM2_5] * c.Volume
+		}
+		return e
+	}
+
+	const sourceCell = 2 * 4 // layer 2, 4 cells per layer
+	noPlume := emisFlux(0)
+	if different(noPlume[sourceCell], E, tol) {
+		t.Errorf("without plume-in-grid, source cell emissions should be %g but are %g", E, noPlume[sourceCell])
+	}
+
+	plume := emisFlux(3000)
+	var total float64
+	var nonzero int
+	for _, e := range plume {
+		total += e
+		if e < 0 {
+			t.Errorf("emissions should not be negative: %g", e)
+		} else if e > 0 {
+			nonzero++
+		}
+	}
+	if different(total, E, tol) {
+		t.Errorf("with plume-in-grid, total emissions should be %g but are %g", E, total)
+	}
+	if nonzero < 2 {
+		t.Errorf("with plume-in-grid, emissions should be in more than one cell but are in %d", nonzero)
+	}
+	if plume[sourceCell] >= E {
+		t.Errorf("with plume-in-grid, source cell emissions %g should be less than %g", plume[sourceCell], E)
+	}
+}
+
+func TestPlumeCells_noWind(t *testing.T) {
+	d := new(InMAP)
+	c := &Cell{Polygonal: &geom.Bounds{Max: geom.Point{X: 1, Y: 1}}}
+	cells, weights := d.plumeCells(c, geom.Point{X: 0.5, Y: 0.5}, 100, 1000)
+	if len(cells) != 1 || cells[0] != c || weights[0] != 1 {
+		t.Errorf("with no wind, all emissions should be in the source cell, but have %v, %v", cells, weights)
+	}
+}
+
+func TestGaussianFraction(t *testing.T) {
+	for _, test := range []struct {
+		a, b, want float64
+	}{
+		{a: math.Inf(-1), b: math.Inf(1), want: 1},
+		{a: 0, b: math.Inf(1), want: 0.5},
+		{a: -1, b: 1, want: 0.682689492137086},
+	} {
+		if have := gaussianFraction(test.a, test.b, 0, 1); math.Abs(have-test.want) > 1.e-12 {
+			t.Errorf("(%g, %g): have %g, want %g", test.a, test.b, have, test.want)
+		}
+	}
+}
@@ -19,6 +19,11 @@ along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
 package inmap
 
 import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
 	"github.com/ctessum/atmos/plumerise"
 )
 
@@ -29,20 +34,7 @@ import (
 // the height of the plume rise in meters, and whether there was an error.
 func (c *Cell) IsPlumeIn(stackHeight, stackDiam, stackTemp, stackVel float64) (bool, float64, error) {
 
-	// Find the cells in the vertical column below c.
-	var cellStack []*Cell
-	cc := c
-	for {
-		cellStack = append(cellStack, cc)
-		if (*cc.groundLevel)[0].Cell == cc {
-			break
-		}
-		cc = (*cc.below)[0].Cell
-	}
-	// reverse the order of the stack so it starts at ground level.
-	for left, right := 0, len(cellStack)-1; left < right; left, right = left+1, right-1 {
-		cellStack[left], cellStack[right] = cellStack[right], cellStack[left]
-	}
+	cellStack := c.column()
 
 	layerHeights := make([]float64, len(cellStack)+1)
 	temperature := make([]float64, len(cellStack))
@@ -71,14 +63,7 @@ func (c *Cell) IsPlumeIn(stackHeight, stackDiam, stackTemp, stackVel float64) (b
 
 	if err != nil {
 		if err == plumerise.ErrAboveModelTop {
-			// If the plume is above the top of our stack, return true if c is
-			// in the top model layer (because we want to put the plume in the
-			// top layer even if it should technically go above it),
-			//  otherwise return false.
-			if (*c.above)[0].boundary {
-				return true, plumeHeight, nil
-			}
-			return false, plumeHeight, nil
+			return c.plumeInTop(), plumeHeight, nil
 		}
 		return false, plumeHeight, err
 	}
@@ -90,3 +75,326 @@ func (c *Cell) IsPlumeIn(stackHeight, stackDiam, stackTemp, stackVel float64) (b
 	}
 	return false, plumeHeight, nil
 }
+
+// IsPlumeInModel is the same as IsPlumeIn except that it calculates the
+// plume rise using the given model. If model is nil, the result is the
+// same as that of IsPlumeIn.
+func (c *Cell) IsPlumeInModel(model PlumeRiseModel, stackHeight, stackDiam, stackTemp, stackVel float64) (bool, float64, error) {
+	if model == nil {
+		return c.IsPlumeIn(stackHeight, stackDiam, stackTemp, stackVel)
+	}
+	cellStack := c.column()
+	layerHeights := make([]float64, len(cellStack)+1)
+	for i, cell := range cellStack {
+		layerHeights[i+1] = layerHeights[i] + cell.Dz
+	}
+	stackLayer, err := findLayer(layerHeights, stackHeight)
+	if err != nil {
+		return c.plumeInTop(), stackHeight, nil
+	}
+	sc := cellStack[stackLayer]
+	plumeHeight, err := model.PlumeHeight(
+		Stack{Height: stackHeight, Diam: stackDiam, Temp: stackTemp, Velocity: stackVel},
+		StackMeteorology{
+			Temperature:                sc.Temperature,
+			WindSpeed:                  sc.WindSpeed,
+			WindSpeedInverse:           sc.WindSpeedInverse,
+			WindSpeedMinusThird:        sc.WindSpeedMinusThird,
+			WindSpeedMinusOnePointFour: sc.WindSpeedMinusOnePointFour,
+			SClass:                     sc.SClass,
+			S1:                         sc.S1,
+		})
+	if err != nil {
+		return false, plumeHeight, err
+	}
+	plumeLayer, err := findLayer(layerHeights, plumeHeight)
+	if err != nil {
+		return c.plumeInTop(), plumeHeight, nil
+	}
+	return plumeLayer == c.Layer, plumeHeight, nil
+}
+
+// IsPlumeInRecord returns whether the plume from the emissions in e
+// ends within c, and the height of the plume in meters, using the plume
+// rise model specified in e. If the dimensions of the building next to
+// the stack are specified in e, the plume height is adjusted for
+// building downwash (see buildingDownwash).
+func (c *Cell) IsPlumeInRecord(e *EmisRecord) (bool, float64, error) {
+	model, err := PlumeRiseModelByName(e.PlumeRise)
+	if err != nil {
+		return false, 0, err
+	}
+	in, plumeHeight, err := c.IsPlumeInModel(model, e.Height, e.Diam, e.Temp, e.Velocity)
+	if err != nil {
+		return in, plumeHeight, err
+	}
+	h := buildingDownwash(plumeHeight, e.Height, e.BldgHeight, e.BldgWidth)
+	if h == plumeHeight {
+		return in, plumeHeight, nil
+	}
+	return c.isHeightIn(h), h, nil
+}
+
+// isHeightIn returns whether height h [m] is within c, where heights
+// above the top of the grid are in the top layer.
+func (c *Cell) isHeightIn(h float64) bool {
+	cellStack := c.column()
+	layerHeights := make([]float64, len(cellStack)+1)
+	for i, cell := range cellStack {
+		layerHeights[i+1] = layerHeights[i] + cell.Dz
+	}
+	layer, err := findLayer(layerHeights, h)
+	if err != nil {
+		return c.plumeInTop()
+	}
+	return layer == c.Layer
+}
+
+// buildingDownwash returns the effective release height [m] of a plume
+// with height h [m] from a stack with height hs [m] next to a building
+// with height hb [m] and width wb [m], after accounting for building
+// downwash. It is a simplification of the PRIME model (Schulman et al.,
+// 2000, doi:10.1080/10473289.2000.10464017): the building wake extends
+// to the good engineering practice height, hb + 1.5L, where L is the
+// lesser of hb and wb, and the recirculation cavity extends to
+// hb + 0.5L. Plumes that are below the top of the cavity are completely
+// captured by the wake, plumes between the top of the cavity and the top
+// of the wake are partially captured, with the captured fraction
+// decreasing linearly with height, and the captured part of the plume
+// is mixed through the depth of the wake. There is no downwash if the
+// building dimensions are not positive or if the stack is at least as
+// tall as the wake.
+func buildingDownwash(h, hs, hb, wb float64) float64 {
+	if hb <= 0 || wb <= 0 {
+		return h
+	}
+	l := math.Min(hb, wb)
+	wakeTop := hb + 1.5*l
+	if hs >= wakeTop || h >= wakeTop {
+		return h
+	}
+	cavityTop := hb + 0.5*l
+	f := 1. // fraction of the plume captured by the wake
+	if h > cavityTop {
+		f = (wakeTop - h) / (wakeTop - cavityTop)
+	}
+	return (1-f)*h + f*wakeTop/2
+}
+
+// column returns the cells in the vertical column below c, including c,
+// starting at ground level.
+func (c *Cell) column() []*Cell {
+	var cellStack []*Cell
+	cc := c
+	for {
+		cellStack = append(cellStack, cc)
+		if cc.groundLevel[0].Cell == cc {
+			break
+		}
+		cc = cc.below[0].Cell
+	}
+	// reverse the order of the stack so it starts at ground level.
+	for left, right := 0, len(cellStack)-1; left < right; left, right = left+1, right-1 {
+		cellStack[left], cellStack[right] = cellStack[right], cellStack[left]
+	}
+	return cellStack
+}
+
+// plumeInTop returns whether a plume that is above the top of the
+// grid should be put in c. If the plume is above the top of our stack,
+// we return true if c is in the top model layer (because we want to put
+// the plume in the top layer even if it should technically go above it),
+// otherwise return false.
+func (c *Cell) plumeInTop() bool {
+	return c.above[0].boundary
+}
+
+// findLayer returns the index of the layer that contains height h
+// given the heights of the layer edges. It is the same as the method
+// used by github.com/ctessum/atmos/plumerise, and an error is returned
+// if h is above the top layer.
+func findLayer(layerHeights []float64, h float64) (int, error) {
+	layer := sort.SearchFloat64s(layerHeights, h)
+	if layer == len(layerHeights) {
+		return layer - 2, plumerise.ErrAboveModelTop
+	}
+	if layer != 0 {
+		layer--
+	}
+	return layer, nil
+}
+
+// Stack holds the parameters of an emissions stack.
+type Stack struct {
+	Height   float64 // stack height [m]
+	Diam     float64 // stack diameter [m]
+	Temp     float64 // stack gas temperature [K]
+	Velocity float64 // stack gas velocity [m/s]
+}
+
+// StackMeteorology holds the meteorology at the top of a stack, with
+// the same meanings and units as the corresponding Cell fields.
+type StackMeteorology struct {
+	Temperature                float64 // [K]
+	WindSpeed                  float64 // [m/s]
+	WindSpeedInverse           float64 // [(m/s)^(-1)]
+	WindSpeedMinusThird        float64 // [(m/s)^(-1/3)]
+	WindSpeedMinusOnePointFour float64 // [(m/s)^(-1.4)]
+	SClass                     float64 // fraction of the time that the atmosphere is stable
+	S1                         float64 // stability parameter, (dθ/dz)/θ [1/m]
+}
+
+// PlumeRiseModel is a formulation of the rise of the plume from a stack.
+type PlumeRiseModel interface {
+	// PlumeHeight returns the final height of the plume [m] from
+	// stack s given the meteorology met at the top of the stack.
+	PlumeHeight(s Stack, met StackMeteorology) (float64, error)
+}
+
+// PlumeRiseModelByName returns the plume rise model with the given name,
+// which can be "ASME", "Briggs", "Concawe", or "Auto" (the case does
+// not matter). It returns nil if name is empty, which means that the
+// default plume rise calculation of IsPlumeIn should be used.
+func PlumeRiseModelByName(name string) (PlumeRiseModel, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "":
+		return nil, nil
+	case "asme":
+		return ASMEPlumeRise{}, nil
+	case "briggs":
+		return BriggsPlumeRise{}, nil
+	case "concawe":
+		return ConcawePlumeRise{}, nil
+	case "auto":
+		return AutoPlumeRise{}, nil
+	default:
+		return nil, fmt.Errorf("inmap: invalid plume rise model %q; valid options are ASME, Briggs, Concawe, and Auto", name)
+	}
+}
+
+const (
+	// minPlumeWindSpeed is the minimum wind speed [m/s] used in the
+	// plume rise calculations of the models that use the wind speed
+	// directly, to avoid infinite plume rise in calm conditions.
+	minPlumeWindSpeed = 1.
+
+	// heatFluxPerBuoyancyFlux is the ratio of the heat emission rate
+	// [W] to the buoyancy flux [m4/s3] of a stack, π cp ρs Ts / g,
+	// where ρs Ts = 353 kg K/m3 for stack gas at a pressure of 1 atm.
+	heatFluxPerBuoyancyFlux = math.Pi * 1005. * 353. / 9.80665
+)
+
+// buoyancyFlux returns the buoyancy flux [m4/s3] of the plume from
+// stack s when the air temperature is Ta [K].
+func buoyancyFlux(s Stack, Ta float64) float64 {
+	if s.Temp <= Ta {
+		return 0
+	}
+	const g = 9.80665 // m/s2
+	return g * s.Velocity * s.Diam * s.Diam / 4 * (s.Temp - Ta) / s.Temp
+}
+
+// stackTipDownwash returns the height of stack s adjusted for stack-tip
+// downwash when the wind speed is u [m/s], which lowers the plume when
+// the stack exit velocity is less than 1.5 times the wind speed
+// (Briggs, 1974).
+func stackTipDownwash(s Stack, u float64) float64 {
+	if s.Velocity >= 1.5*u {
+		return s.Height
+	}
+	return math.Max(0, s.Height+2*s.Diam*(s.Velocity/u-1.5))
+}
+
+// momentumDominated returns whether the plume from stack s is dominated
+// by momentum rather than buoyancy, using the criteria of ASME (1973).
+func momentumDominated(s Stack, met StackMeteorology) bool {
+	return s.Temp-met.Temperature < 50 && s.Velocity > met.WindSpeed && s.Velocity > 10
+}
+
+// stable returns whether the atmosphere is stable according to met.
+func (met StackMeteorology) stable() bool {
+	return met.SClass > 0.5 && met.S1 > 0
+}
+
+// ASMEPlumeRise is the plume rise formulation of ASME (1973), as described
+// in Seinfeld and Pandis (2006), which is also used by IsPlumeIn, except
+// that stack-tip downwash is included.
+type ASMEPlumeRise struct{}
+
+// PlumeHeight implements the PlumeRiseModel interface.
+func (ASMEPlumeRise) PlumeHeight(s Stack, met StackMeteorology) (float64, error) {
+	s.Height = stackTipDownwash(s, math.Max(met.WindSpeed, minPlumeWindSpeed))
+	_, h, err := plumerise.ASMEPrecomputed(s.Height, s.Diam, s.Temp, s.Velocity,
+		[]float64{0, math.Inf(1)}, []float64{met.Temperature}, []float64{met.WindSpeed},
+		[]float64{met.SClass}, []float64{met.S1}, []float64{met.WindSpeedMinusOnePointFour},
+		[]float64{met.WindSpeedMinusThird}, []float64{met.WindSpeedInverse})
+	return h, err
+}
+
+// BriggsPlumeRise is the final plume rise formulation of Briggs (1975),
+// for buoyant plumes in neutral or unstable and in stable conditions,
+// or the rise of a momentum jet if it is larger, including stack-tip
+// downwash.
+type BriggsPlumeRise struct{}
+
+// PlumeHeight implements the PlumeRiseModel interface.
+func (BriggsPlumeRise) PlumeHeight(s Stack, met StackMeteorology) (float64, error) {
+	u := math.Max(met.WindSpeed, minPlumeWindSpeed)
+	h := stackTipDownwash(s, u)
+	F := buoyancyFlux(s, met.Temperature)
+	var Δh float64
+	switch {
+	case F <= 0:
+	case met.stable():
+		const g = 9.80665 // m/s2
+		Δh = 2.6 * math.Cbrt(F/(u*g*met.S1))
+	case F < 55:
+		Δh = 21.425 * math.Pow(F, 0.75) / u
+	default:
+		Δh = 38.71 * math.Pow(F, 0.6) / u
+	}
+	// Use the momentum rise if it is larger than the buoyant rise.
+	Δh = math.Max(Δh, 3*s.Diam*s.Velocity/u)
+	if math.IsNaN(Δh) {
+		return h, fmt.Errorf("inmap: Briggs plume rise is NaN; F: %g, u: %g, s1: %g", F, u, met.S1)
+	}
+	return h + Δh, nil
+}
+
+// ConcawePlumeRise is the plume rise formulation of CONCAWE (1966),
+// Δh = 0.071 Qh^0.444 u^-0.694, where Qh is the heat emission rate [W],
+// including stack-tip downwash. It does not depend on the atmospheric
+// stability.
+type ConcawePlumeRise struct{}
+
+// PlumeHeight implements the PlumeRiseModel interface.
+func (ConcawePlumeRise) PlumeHeight(s Stack, met StackMeteorology) (float64, error) {
+	u := math.Max(met.WindSpeed, minPlumeWindSpeed)
+	h := stackTipDownwash(s, u)
+	Qh := heatFluxPerBuoyancyFlux * buoyancyFlux(s, met.Temperature)
+	Δh := 0.071 * math.Pow(Qh, 0.444) * math.Pow(u, -0.694)
+	if math.IsNaN(Δh) {
+		return h, fmt.Errorf("inmap: Concawe plume rise is NaN; Qh: %g, u: %g", Qh, u)
+	}
+	return h + Δh, nil
+}
+
+// AutoPlumeRise chooses a plume rise formulation based on the stack
+// parameters and the atmospheric stability: ASMEPlumeRise for
+// momentum-dominated plumes, BriggsPlumeRise for buoyant plumes in
+// stable conditions or with a heat emission rate of at least 20 MW,
+// and ConcawePlumeRise for other buoyant plumes.
+type AutoPlumeRise struct{}
+
+// PlumeHeight implements the PlumeRiseModel interface.
+func (AutoPlumeRise) PlumeHeight(s Stack, met StackMeteorology) (float64, error) {
+	const largeHeatFlux = 20.e6 // W
+	switch {
+	case momentumDominated(s, met):
+		return ASMEPlumeRise{}.PlumeHeight(s, met)
+	case met.stable() || heatFluxPerBuoyancyFlux*buoyancyFlux(s, met.Temperature) >= largeHeatFlux:
+		return BriggsPlumeRise{}.PlumeHeight(s, met)
+	default:
+		return ConcawePlumeRise{}.PlumeHeight(s, met)
+	}
+}
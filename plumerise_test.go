@@ -0,0 +1,233 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPlumeRiseModelByName(t *testing.T) {
+	for name, want := range map[string]PlumeRiseModel{
+		"":        nil,
+		"ASME":    ASMEPlumeRise{},
+		"briggs":  BriggsPlumeRise{},
+		"Concawe": ConcawePlumeRise{},
+		" auto ":  AutoPlumeRise{},
+	} {
+		have, err := PlumeRiseModelByName(name)
+		if err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+		if have != want {
+			t.Errorf("%q: have %#v, want %#v", name, have, want)
+		}
+	}
+	if _, err := PlumeRiseModelByName("xxx"); err == nil {
+		t.Error("invalid model name should cause an error")
+	}
+}
+
+func TestStackTipDownwash(t *testing.T) {
+	s := Stack{Height: 50, Diam: 2, Velocity: 3}
+	if h := stackTipDownwash(s, 1); h != 50 {
+		t.Errorf("without downwash, height should be 50 but is %g", h)
+	}
+	if h, want := stackTipDownwash(s, 4), 50+2*2*(3./4-1.5); different(h, want, 1.e-10) {
+		t.Errorf("with downwash, height should be %g but is %g", want, h)
+	}
+	if h := stackTipDownwash(Stack{Height: 1, Diam: 10}, 10); h != 0 {
+		t.Errorf("height should not be negative but is %g", h)
+	}
+}
+
+func TestPlumeRiseModels(t *testing.T) {
+	s := Stack{Height: 100, Diam: 3, Temp: 400, Velocity: 15}
+	const u = 5.
+	unstable := StackMeteorology{
+		Temperature:                290,
+		WindSpeed:                  u,
+		WindSpeedInverse:           1 / u,
+		WindSpeedMinusThird:        math.Pow(u, -1./3),
+		WindSpeedMinusOnePointFour: math.Pow(u, -1.4),
+		SClass:                     0,
+		S1:                         0,
+	}
+	stable := unstable
+	stable.SClass, stable.S1 = 1, 1.e-4
+
+	// The plume is buoyancy dominated, unstable, and there is no
+	// stack-tip downwash, so ASMEPlumeRise should be the same as the
+	// ASME (1973) unstable formula.
+	F := 9.80665 * 2 * (s.Temp - unstable.Temperature) / (s.Temp + unstable.Temperature) *
+		s.Velocity * s.Diam * s.Diam / 4
+	wantASME := s.Height + 7.4*math.Cbrt(F*s.Height*s.Height)/u
+	h, err := ASMEPlumeRise{}.PlumeHeight(s, unstable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if different(h, wantASME, 1.e-6) {
+		t.Errorf("ASME: have %g, want %g", h, wantASME)
+	}
+
+	for _, test := range []struct {
+		name  string
+		model PlumeRiseModel
+	}{
+		{name: "ASME", model: ASMEPlumeRise{}},
+		{name: "Briggs", model: BriggsPlumeRise{}},
+		{name: "Concawe", model: ConcawePlumeRise{}},
+		{name: "Auto", model: AutoPlumeRise{}},
+	} {
+		hu, err := test.model.PlumeHeight(s, unstable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hs, err := test.model.PlumeHeight(s, stable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hu <= s.Height || hs <= s.Height || math.IsInf(hu, 0) || math.IsInf(hs, 0) {
+			t.Errorf("%s: plume heights (%g unstable, %g stable) should be finite and above the stack height", test.name, hu, hs)
+		}
+	}
+
+	// Auto should choose Briggs in stable conditions and Concawe for small,
+	// unstable buoyant plumes.
+	for _, test := range []struct {
+		met  StackMeteorology
+		want PlumeRiseModel
+	}{
+		{met: stable, want: BriggsPlumeRise{}},
+		{met: unstable, want: ConcawePlumeRise{}},
+	} {
+		have, _ := AutoPlumeRise{}.PlumeHeight(s, test.met)
+		want, _ := test.want.PlumeHeight(s, test.met)
+		if have != want {
+			t.Errorf("Auto: have %g, want %g", have, want)
+		}
+	}
+}
+
+func TestIsPlumeInModel(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, NewEmissions(), Mech{}),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	var column []*Cell
+	for _, c := range d.cells.array() {
+		if b := c.Bounds(); b.Min.X < -1000 && b.Max.X > -1000 && b.Min.Y < -1000 && b.Max.Y > -1000 {
+			column = append(column, c)
+		}
+	}
+	s := Stack{Height: 100, Diam: 3, Temp: 400, Velocity: 15}
+	for _, model := range []PlumeRiseModel{nil, ASMEPlumeRise{}, BriggsPlumeRise{}, ConcawePlumeRise{}, AutoPlumeRise{}} {
+		var n int
+		for _, c := range column {
+			in, h, err := c.IsPlumeInModel(model, s.Height, s.Diam, s.Temp, s.Velocity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if in {
+				n++
+				// Plumes above the top of the grid are put in the top layer.
+				if h < c.LayerHeight || (h > c.LayerHeight+c.Dz && c.Layer != len(column)-1) {
+					t.Errorf("%T: plume height %g is not in layer %d", model, h, c.Layer)
+				}
+			}
+			if model == nil {
+				in2, h2, err := c.IsPlumeIn(s.Height, s.Diam, s.Temp, s.Velocity)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if in != in2 || h != h2 {
+					t.Errorf("nil model should be the same as IsPlumeIn")
+				}
+			}
+		}
+		if n != 1 {
+			t.Errorf("%T: the plume should be in 1 cell but is in %d", model, n)
+		}
+	}
+}
+
+func TestBuildingDownwash(t *testing.T) {
+	for _, test := range []struct {
+		name                string
+		h, hs, hb, wb, want float64
+	}{
+		{name: "no building", h: 50, hs: 20, want: 50},
+		{name: "tall stack", h: 80, hs: 60, hb: 20, wb: 40, want: 80},
+		{name: "plume above wake", h: 60, hs: 30, hb: 20, wb: 40, want: 60},
+		{name: "plume in cavity", h: 22, hs: 20, hb: 20, wb: 40, want: 25},
+		{name: "plume in cavity, wide building", h: 20, hs: 20, hb: 40, wb: 80, want: 50},
+		{name: "partially captured", h: 40, hs: 30, hb: 20, wb: 40, want: 0.5*40 + 0.5*25},
+		{name: "narrow building", h: 60, hs: 30, hb: 40, wb: 10, want: 60},
+	} {
+		if have := buildingDownwash(test.h, test.hs, test.hb, test.wb); different(have, test.want, 1.e-10) {
+			t.Errorf("%s: have %g, want %g", test.name, have, test.want)
+		}
+	}
+}
+
+func TestIsPlumeInRecord_downwash(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, NewEmissions(), Mech{}),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	var column []*Cell
+	for _, c := range d.cells.array() {
+		if b := c.Bounds(); b.Min.X < -1000 && b.Max.X > -1000 && b.Min.Y < -1000 && b.Max.Y > -1000 {
+			column = append(column, c)
+		}
+	}
+	// The stack has no plume rise, so the plume height without
+	// downwash is the stack height.
+	e := &EmisRecord{Height: 150, BldgHeight: 100, BldgWidth: 150}
+	want := buildingDownwash(e.Height, e.Height, e.BldgHeight, e.BldgWidth)
+	var layer, layerDownwash int
+	for _, c := range column {
+		in, h, err := c.IsPlumeInRecord(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if different(h, want, 1.e-10) {
+			t.Errorf("plume height should be %g but is %g", want, h)
+		}
+		if in {
+			layerDownwash = c.Layer
+		}
+		if in, _, _ := c.IsPlumeIn(e.Height, e.Diam, e.Temp, e.Velocity); in {
+			layer = c.Layer
+		}
+	}
+	if layerDownwash >= layer {
+		t.Errorf("downwash should lower the plume from layer %d but it is in layer %d", layer, layerDownwash)
+	}
+}
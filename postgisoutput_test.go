@@ -0,0 +1,110 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/jackc/pgx/v4"
+	"github.com/yuzhou-wang/inmap/internal/postgis"
+)
+
+func TestParsePostGISURL(t *testing.T) {
+	for _, test := range []struct {
+		url, dbURL string
+		table      pgx.Identifier
+		srid       int
+	}{
+		{
+			url:   "postgres://user@localhost:5432/db",
+			dbURL: "postgres://user@localhost:5432/db",
+			table: pgx.Identifier{"inmap_output"},
+		},
+		{
+			url:   "postgresql://user@localhost/db?sslmode=disable&table=results.pm25&srid=4326",
+			dbURL: "postgresql://user@localhost/db?sslmode=disable",
+			table: pgx.Identifier{"results", "pm25"},
+			srid:  4326,
+		},
+	} {
+		dbURL, table, srid, err := parsePostGISURL(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dbURL != test.dbURL || !reflect.DeepEqual(table, test.table) || srid != test.srid {
+			t.Errorf("%s: have (%s, %v, %d), want (%s, %v, %d)", test.url, dbURL, table, srid, test.dbURL, test.table, test.srid)
+		}
+	}
+	if _, _, _, err := parsePostGISURL("postgres://localhost/db?srid=x"); err == nil {
+		t.Error("an invalid SRID should cause an error")
+	}
+}
+
+func TestToEWKB(t *testing.T) {
+	b, err := toEWKB(geom.Point{X: 1, Y: 2}, 4326)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The EWKB representation of SRID=4326;POINT(1 2), as returned by
+	// the PostGIS function ST_AsEWKB.
+	want, _ := hex.DecodeString("0101000020E6100000000000000000F03F0000000000000040")
+	if !bytes.Equal(b, want) {
+		t.Errorf("have %X, want %X", []byte(b), want)
+	}
+}
+
+func TestWritePostGIS(t *testing.T) {
+	ctx := context.Background()
+	postGISURL, postgresC := postgis.SetupTestDB(ctx, t, "emissions/aep/testdata")
+	defer postgresC.Terminate(ctx)
+
+	cells := []*Cell{
+		{Polygonal: geom.Polygon{{{X: 0, Y: 0}, {X: 1, Y: 0}, {X: 1, Y: 1}, {X: 0, Y: 1}, {X: 0, Y: 0}}}},
+		{Polygonal: geom.Polygon{{{X: 1, Y: 0}, {X: 2, Y: 0}, {X: 2, Y: 1}, {X: 1, Y: 1}, {X: 1, Y: 0}}}},
+	}
+	results := map[string][]float64{"TotalPM25": {1, 2}, "TotalPop": {3, 4}}
+	if err := writePostGIS(ctx, postGISURL+"?table=results&srid=5070", nil, cells, results); err != nil {
+		t.Fatal(err)
+	}
+	// Writing again should replace the table.
+	if err := writePostGIS(ctx, postGISURL+"?table=results&srid=5070", nil, cells, results); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := pgx.Connect(ctx, postGISURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	var n, srid int
+	var pm25, area float64
+	err = conn.QueryRow(ctx, `SELECT count(*), max(ST_SRID(geom)), sum("TotalPM25"), sum(ST_Area(geom)) FROM results`).Scan(&n, &srid, &pm25, &area)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || srid != 5070 || pm25 != 3 || math.Abs(area-2) > 1.e-10 {
+		t.Errorf("have %d rows, SRID %d, total PM2.5 %g, and area %g; want 2, 5070, 3, and 2", n, srid, pm25, area)
+	}
+}
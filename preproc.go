@@ -23,7 +23,6 @@ import (
 	"io"
 	"log"
 	"math"
-	"os"
 	"strings"
 	"time"
 
@@ -32,7 +31,6 @@ import (
 	"github.com/ctessum/atmos/seinfeld"
 	"github.com/ctessum/atmos/wesely1989"
 
-	"github.com/ctessum/cdf"
 	"github.com/ctessum/sparse"
 )
 
@@ -99,9 +97,13 @@ type Preprocessor interface {
 	UStar() NextData
 	// SeinfeldLandUse is land use categories as
 	// specified in github.com/ctessum/atmos/seinfeld.
+	// It can either have dimensions [y, x] and hold the dominant
+	// category of each grid cell, or have dimensions [category, y, x]
+	// and hold the fraction of each grid cell covered by each category.
 	SeinfeldLandUse() NextData
 	// WeselyLandUse is land use categories as
-	// specified in github.com/ctessum/atmos/wesely1989.
+	// specified in github.com/ctessum/atmos/wesely1989,
+	// in either of the forms described for SeinfeldLandUse.
 	WeselyLandUse() NextData
 	// Z0 is surface roughness length [m].
 	Z0() NextData
@@ -155,35 +157,105 @@ type Preprocessor interface {
 	HO() NextData
 	// H2O2 is hydrogen peroxide concentration [ppmv].
 	H2O2() NextData
+	// O3 is ozone concentration [ppmv]. It is only used when
+	// preprocessing with the Ozone option.
+	O3() NextData
+	// HNO3 is nitric acid concentration [ppmv]. It is only used when
+	// preprocessing with the Ozone option.
+	HNO3() NextData
+	// RH is relative humidity [fraction]. It is only used when
+	// preprocessing with the NitrateEquilibrium option.
+	RH() NextData
 }
 
 // Preprocess returns preprocessed InMAP input data
 // based on the information available from the given
 // preprocessor. x0 and y0 are the left and y coordinates of the
 // lower-left corner of the domain, and dx and dy are the x and y edge
-// lengths of the grid cells, respectively.
-func Preprocess(p Preprocessor, xo, yo, dx, dy float64) (*CTMData, error) {
+// lengths of the grid cells, respectively. opts can be used to
+// specify optional settings such as Parallel, Checkpoint, Validate, Ozone,
+// NitrateEquilibrium, and Layers.
+func Preprocess(p Preprocessor, xo, yo, dx, dy float64, opts ...PreprocessOption) (*CTMData, error) {
+	o := new(preprocessOptions)
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o.preprocess(p, xo, yo, dx, dy)
+}
+
+// CoarsePM specifies whether the dry deposition velocity of coarse
+// (PM10-2.5) particles ("CoarseParticleDryDep") should be included in
+// the preprocessed output. The velocity is calculated for particles
+// with a diameter of 5 μm and the density of mineral dust, which are
+// typical of the dust and road dust that make up most coarse PM.
+func CoarsePM(coarsePM bool) PreprocessOption {
+	return func(o *preprocessOptions) {
+		o.coarsePM = coarsePM
+	}
+}
+
+// preprocess preprocesses p according to the options.
+func (o *preprocessOptions) preprocess(p Preprocessor, xo, yo, dx, dy float64) (*CTMData, error) {
+	var data *CTMData
+	var err error
+	if ts, ok := p.(TimeSplitter); ok && (o.workers > 1 || o.checkpointDir != "") {
+		data, err = preprocessPeriods(ts, o, xo, yo, dx, dy)
+	} else {
+		data, err = preprocess(o.wrap(p), xo, yo, dx, dy, o.memoryLimit, o.ozone, o.coarsePM, o.overWater)
+	}
+	if err != nil {
+		return data, err
+	}
+	if o.nitrateEquilibrium {
+		if err = o.addSeasonalMeteorology(data, p); err != nil {
+			return nil, err
+		}
+	}
+	if len(o.layerHeights) > 0 {
+		return data.RegridLayers(o.layerHeights)
+	}
+	return data, nil
+}
+
+// preprocess preprocesses the full simulation period of p at once.
+// The calculations are run concurrently as long as the memory they
+// use stays within memoryLimit bytes; if memoryLimit is zero or less,
+// memory use is not limited. If ozone is true, the variables needed
+// to model ozone are also calculated, and if coarsePM is true, the
+// coarse particle dry deposition velocity is included in the output.
+// overWater specifies whether to use the OverWater surface layer.
+func preprocess(p Preprocessor, xo, yo, dx, dy, memoryLimit float64, ozone, coarsePM, overWater bool) (*CTMData, error) {
 	var pblh, layerHeights, windSpeed, windSpeedInverse, windSpeedMinusThird, windSpeedMinusOnePointFour, uAvg, vAvg, wAvg *sparse.DenseArray
 
+	budget := newMemoryBudget(memoryLimit)
+	var arrayBytes float64
+	if memoryLimit > 0 {
+		var err error
+		if arrayBytes, err = preprocessArrayBytes(p); err != nil {
+			return nil, fmt.Errorf("inmap: preprocessing: %v", err)
+		}
+	}
 	errChan := make(chan error)
 
-	go func() {
+	// The arguments to budget.run are the numbers of 3-D working
+	// arrays and results of each calculation.
+	budget.run(1, 0, arrayBytes, errChan, func() error {
 		var err error
 		pblh, err = average(p.PBLH())
-		errChan <- err
-	}()
+		return err
+	})
 
-	go func() {
+	budget.run(2, 1, arrayBytes, errChan, func() error {
 		var err error
 		layerHeights, err = average(p.Height())
-		errChan <- err
-	}()
+		return err
+	})
 
-	go func() {
+	budget.run(4, 7, arrayBytes, errChan, func() error {
 		var err error
 		windSpeed, windSpeedInverse, windSpeedMinusThird, windSpeedMinusOnePointFour, uAvg, vAvg, wAvg, err = calcWindSpeed(p.U(), p.V(), p.W())
-		errChan <- err
-	}()
+		return err
+	})
 
 	for i := 0; i < 3; i++ {
 		err := <-errChan
@@ -196,88 +268,101 @@ func Preprocess(p Preprocessor, xo, yo, dx, dy float64) (*CTMData, error) {
 
 	var uDeviation, vDeviation, aOrgPartitioning, aVOC, aSOA, bOrgPartitioning, bVOC, bSOA,
 		NOPartitioning, gNO, pNO, SPartitioning, gS, pS, NHPartitioning, gNH, pNH, totalpm25,
-		alt, particleWetDep, SO2WetDep, otherGasWetDep, temperature, Sclass, S1, Kzz, M2u, M2d, SO2oxidation, particleDryDep, SO2DryDep,
+		alt, particleWetDep, SO2WetDep, otherGasWetDep, temperature, Sclass, S1, Kzz, M2u, M2d, SO2oxidation, particleDryDep, coarseParticleDryDep, SO2DryDep,
 		NOxDryDep, NH3DryDep, VOCDryDep, Kxxyy *sparse.DenseArray
 
-	go func() {
+	budget.run(2, 1, arrayBytes, errChan, func() error {
 		var err error
 		// calculate deviation from average wind speed.
 		// Only calculate horizontal deviations.
 		uDeviation, err = windDeviation(uAvg, p.U())
-		errChan <- err
-	}()
-	go func() {
+		return err
+	})
+	budget.run(2, 1, arrayBytes, errChan, func() error {
 		var err error
 		vDeviation, err = windDeviation(vAvg, p.V())
-		errChan <- err
-	}()
+		return err
+	})
 
-	go func() {
+	budget.run(6, 3, arrayBytes, errChan, func() error {
 		var err error
 		// calculate gas/particle partitioning
 		aOrgPartitioning, aVOC, aSOA, err = marginalPartitioning(p.AVOC(), p.ASOA())
-		errChan <- err
-	}()
-	go func() {
+		return err
+	})
+	budget.run(6, 3, arrayBytes, errChan, func() error {
 		var err error
 		bOrgPartitioning, bVOC, bSOA, err = marginalPartitioning(p.BVOC(), p.BSOA())
-		errChan <- err
-	}()
-	go func() {
+		return err
+	})
+	budget.run(6, 3, arrayBytes, errChan, func() error {
 		var err error
 		NOPartitioning, gNO, pNO, err = marginalPartitioning(p.NOx(), p.PNO())
-		errChan <- err
-	}()
-	go func() {
+		return err
+	})
+	budget.run(6, 3, arrayBytes, errChan, func() error {
 		var err error
 		SPartitioning, gS, pS, err = marginalPartitioning(p.SOx(), p.PS())
-		errChan <- err
-	}()
-	go func() {
+		return err
+	})
+	budget.run(6, 3, arrayBytes, errChan, func() error {
 		var err error
 		NHPartitioning, gNH, pNH, err = marginalPartitioning(p.NH3(), p.PNH())
-		errChan <- err
-	}()
+		return err
+	})
 
-	go func() {
+	budget.run(3, 1, arrayBytes, errChan, func() error {
 		var err error
 		// Get total PM2.5 averages for performance eval.
 		totalpm25, err = average(p.TotalPM25())
-		errChan <- err
-	}()
+		return err
+	})
 
-	go func() {
+	budget.run(2, 1, arrayBytes, errChan, func() error {
 		var err error
 		// average inverse density
 		alt, err = average(p.ALT())
-		errChan <- err
-	}()
+		return err
+	})
 
-	go func() {
+	budget.run(4, 3, arrayBytes, errChan, func() error {
 		var err error
 		// Calculate wet deposition.
 		particleWetDep, SO2WetDep, otherGasWetDep, err = wetDeposition(Dz, p.QRain(), p.CloudFrac(), p.ALT())
-		errChan <- err
-	}()
+		return err
+	})
 
-	go func() {
+	budget.run(2, 1, arrayBytes, errChan, func() error {
 		var err error
 		temperature, err = average(p.T())
-		errChan <- err
-	}()
+		return err
+	})
 
-	go func() {
+	budget.run(preprocessMaxTaskArrays, 13, arrayBytes, errChan, func() error {
 		var err error
 		// Calculate stability for plume rise, vertical mixing,
 		// and chemical reaction rates.
-		Sclass, S1, Kzz, M2u, M2d, SO2oxidation, particleDryDep, SO2DryDep,
+		Sclass, S1, Kzz, M2u, M2d, SO2oxidation, particleDryDep, coarseParticleDryDep, SO2DryDep,
 			NOxDryDep, NH3DryDep, VOCDryDep, Kxxyy, err = stabilityMixingChemistry(layerHeights, p.PBLH(),
 			p.UStar(), p.ALT(), p.T(), p.P(), p.SurfaceHeatFlux(), p.HO(), p.H2O2(),
-			p.Z0(), p.SeinfeldLandUse(), p.WeselyLandUse(), p.QCloud(), p.RadiationDown(), p.QRain())
-		errChan <- err
-	}()
+			p.Z0(), p.SeinfeldLandUse(), p.WeselyLandUse(), p.QCloud(), p.RadiationDown(), p.QRain(),
+			windSpeed, overWater)
+		return err
+	})
+
+	var o3, o3NOxSensitivity, NOxOxidation, VOCOxidation *sparse.DenseArray
+	nTasks := 12
+	if ozone {
+		nTasks++
+		budget.run(6, 4, arrayBytes, errChan, func() error {
+			var err error
+			o3, o3NOxSensitivity, NOxOxidation, VOCOxidation, err = ozoneChemistry(p.ALT(),
+				p.T(), p.HO(), p.H2O2(), p.O3(), p.HNO3())
+			return err
+		})
+	}
 
-	for i := 0; i < 12; i++ {
+	for i := 0; i < nTasks; i++ {
 		err := <-errChan
 		if err != nil {
 			return nil, err
@@ -394,6 +479,21 @@ func Preprocess(p Preprocessor, xo, yo, dx, dy float64) (*CTMData, error) {
 		"Inverse density", "m3 kg-1", alt)
 	data.AddVariable("TotalPM25", []string{"z", "y", "x"},
 		"Total PM2.5 concentration", "ug m-3", totalpm25)
+	if coarsePM {
+		data.AddVariable("CoarseParticleDryDep", []string{"z", "y", "x"},
+			"Dry deposition velocity for coarse (PM10-2.5) particles", "m s-1", coarseParticleDryDep)
+	}
+	if ozone {
+		data.AddVariable("O3", []string{"z", "y", "x"},
+			"Average ozone concentration", "ug m-3", o3)
+		data.AddVariable("O3NOxSensitivity", []string{"z", "y", "x"},
+			"Fraction of ozone formation that is NOx-limited {vs. VOC-limited}",
+			"fraction", o3NOxSensitivity)
+		data.AddVariable("NOxOxidation", []string{"z", "y", "x"},
+			"Rate of NOx oxidation to HNO3 by hydroxyl radical", "s-1", NOxOxidation)
+		data.AddVariable("VOCOxidation", []string{"z", "y", "x"},
+			"Rate of VOC oxidation by hydroxyl radical", "s-1", VOCOxidation)
+	}
 
 	return data, nil
 }
@@ -408,15 +508,15 @@ func Preprocess(p Preprocessor, xo, yo, dx, dy float64) (*CTMData, error) {
 // between zero and one. Both gas phase and particle phase concentration
 // should be in units of [mass/volume].
 func marginalPartitioning(gasFunc, particleFunc NextData) (partitioning, gasConc, particleConc *sparse.DenseArray, err error) {
-	var gas, particle, oldgas, oldparticle *sparse.DenseArray
-	firstData := true
-	var n int
+	var part, gas, particle meanAccumulator
+	// The gas and particle concentrations at the previous time step, which
+	// are zero before the first time step.
+	var oldgas, oldparticle *sparse.DenseArray
 	for {
 		gasdata, err := gasFunc()
 		if err != nil {
 			if err == io.EOF {
-				// Divide the arrays by the total number of timesteps and return.
-				return arrayAverage(partitioning, n), arrayAverage(gas, n), arrayAverage(particle, n), nil
+				return part.mean, gas.mean, particle.mean, nil
 			}
 			return nil, nil, nil, err
 		}
@@ -424,55 +524,44 @@ func marginalPartitioning(gasFunc, particleFunc NextData) (partitioning, gasConc
 		if err != nil {
 			return nil, nil, nil, err
 		}
-		if firstData {
-			partitioning = sparse.ZerosDense(gasdata.Shape...)
-			gas = sparse.ZerosDense(gasdata.Shape...)
-			particle = sparse.ZerosDense(gasdata.Shape...)
-			oldgas = sparse.ZerosDense(gasdata.Shape...)
-			oldparticle = sparse.ZerosDense(gasdata.Shape...)
-			firstData = false
-		}
-		gas.AddDense(gasdata)
-		particle.AddDense(particledata)
+		gas.add(gasdata)
+		particle.add(particledata)
 
+		part.next(gasdata.Shape...)
 		for i, particleval := range particledata.Elements {
-			particlechange := particleval - oldparticle.Elements[i]
-			totalchange := particlechange + (gasdata.Elements[i] - oldgas.Elements[i])
+			gasval := gasdata.Elements[i]
+			if oldgas != nil {
+				particleval -= oldparticle.Elements[i]
+				gasval -= oldgas.Elements[i]
+			}
 			// Calculate the marginal partitioning coefficient, which is the
 			// change in particle concentration divided by the change in overall
 			// concentration. Force the coefficient to be between zero and
 			// one.
-			part := math.Min(math.Max(particlechange/totalchange, 0), 1)
-			if !math.IsNaN(part) {
-				partitioning.Elements[i] += part
+			p := math.Min(math.Max(particleval/(particleval+gasval), 0), 1)
+			if !math.IsNaN(p) {
+				part.addElement(i, p)
 			}
 		}
-		oldgas = gasdata.Copy()
-		oldparticle = particledata.Copy()
-		n++
+		// The arrays returned by NextData functions are not modified
+		// after they are returned, so they can be kept without copying.
+		oldgas, oldparticle = gasdata, particledata
 	}
 }
 
 // average calculates the arithmatic mean of a
 // set of arrays.
 func average(dataFunc NextData) (*sparse.DenseArray, error) {
-	var avgdata *sparse.DenseArray
-	firstData := true
-	var n int
+	var avg meanAccumulator
 	for {
 		data, err := dataFunc()
 		if err != nil {
 			if err == io.EOF {
-				return arrayAverage(avgdata, n), nil
+				return avg.mean, nil
 			}
 			return nil, err
 		}
-		if firstData {
-			avgdata = sparse.ZerosDense(data.Shape...)
-			firstData = false
-		}
-		avgdata.AddDense(data)
-		n++
+		avg.add(data)
 	}
 }
 
@@ -495,13 +584,12 @@ func layerThickness(heights *sparse.DenseArray) *sparse.DenseArray {
 // mass fraction of rain in the grid cells, fraction of the grid cells
 // filled with clouds, and inverse density.
 func wetDeposition(Δz *sparse.DenseArray, qrainFunc, cloudFracFunc, altFunc NextData) (wdParticle, wdSO2, wdOtherGas *sparse.DenseArray, err error) {
-	firstData := true
-	var n int
+	var particle, so2, otherGas meanAccumulator // units = 1/s
 	for {
 		qrain, err := qrainFunc() // mass frac
 		if err != nil {
 			if err == io.EOF {
-				return arrayAverage(wdParticle, n), arrayAverage(wdSO2, n), arrayAverage(wdOtherGas, n), nil
+				return particle.mean, so2.mean, otherGas.mean, nil
 			}
 			return nil, nil, nil, err
 		}
@@ -513,61 +601,50 @@ func wetDeposition(Δz *sparse.DenseArray, qrainFunc, cloudFracFunc, altFunc Nex
 		if err != nil {
 			return nil, nil, nil, err
 		}
-		if firstData {
-			wdParticle = sparse.ZerosDense(qrain.Shape...) // units = 1/s
-			wdSO2 = sparse.ZerosDense(qrain.Shape...)      // units = 1/s
-			wdOtherGas = sparse.ZerosDense(qrain.Shape...) // units = 1/s
-			firstData = false
-		}
+		particle.next(qrain.Shape...)
+		so2.next(qrain.Shape...)
+		otherGas.next(qrain.Shape...)
 		for i := 0; i < len(qrain.Elements); i++ {
 			wdp, wds, wdo := emep.WetDeposition(cloudFrac.Elements[i],
 				qrain.Elements[i], 1/alt.Elements[i], Δz.Elements[i])
-			wdParticle.Elements[i] += wdp
-			wdSO2.Elements[i] += wds
-			wdOtherGas.Elements[i] += wdo
+			particle.addElement(i, wdp)
+			so2.addElement(i, wds)
+			otherGas.addElement(i, wdo)
 		}
-		n++
 	}
 }
 
 // windDeviation calculates the average absolute deviation of the wind velocity.
 // Output is based on a staggered grid.
 func windDeviation(uAvg *sparse.DenseArray, uFunc NextData) (*sparse.DenseArray, error) {
-	var uDeviation *sparse.DenseArray
-	var n int
-	firstData := true
+	var uDeviation meanAccumulator
 	for {
 		u, err := uFunc()
 		if err != nil {
 			if err == io.EOF {
-				return arrayAverage(uDeviation, n), nil
+				return uDeviation.mean, nil
 			}
 			return nil, err
 		}
-		if firstData {
-			uDeviation = sparse.ZerosDense(u.Shape...)
-			firstData = false
-		}
+		uDeviation.next(u.Shape...)
 		for i, uV := range u.Elements {
 			avgV := uAvg.Elements[i]
-			uDeviation.Elements[i] += math.Abs(uV - avgV)
+			uDeviation.addElement(i, math.Abs(uV-avgV))
 		}
-		n++
 	}
 }
 
 // calcWindSpeed calculates RMS wind speed as well as average speeds in each
 // direction.
 func calcWindSpeed(uFunc, vFunc, wFunc NextData) (speed, speedInverse, speedMinusThird, speedMinusOnePointFour, uAvg, vAvg, wAvg *sparse.DenseArray, err error) {
-	var n int
-	firstData := true
+	var s, sInverse, sMinusThird, sMinusOnePointFour, uMean, vMean, wMean meanAccumulator
 	var dims []int
 	for {
 		u, err := uFunc()
 		if err != nil {
 			if err == io.EOF {
-				return arrayAverage(speed, n), arrayAverage(speedInverse, n), arrayAverage(speedMinusThird, n),
-					arrayAverage(speedMinusOnePointFour, n), arrayAverage(uAvg, n), arrayAverage(vAvg, n), arrayAverage(wAvg, n), nil
+				return s.mean, sInverse.mean, sMinusThird.mean, sMinusOnePointFour.mean,
+					uMean.mean, vMean.mean, wMean.mean, nil
 			}
 			return nil, nil, nil, nil, nil, nil, nil, err
 		}
@@ -579,10 +656,7 @@ func calcWindSpeed(uFunc, vFunc, wFunc NextData) (speed, speedInverse, speedMinu
 		if err != nil {
 			return nil, nil, nil, nil, nil, nil, nil, err
 		}
-		if firstData {
-			uAvg = sparse.ZerosDense(u.Shape...)
-			vAvg = sparse.ZerosDense(v.Shape...)
-			wAvg = sparse.ZerosDense(w.Shape...)
+		if dims == nil {
 			// get unstaggered grid sizes
 			dims = make([]int, len(u.Shape))
 			for i, ulen := range u.Shape {
@@ -590,15 +664,14 @@ func calcWindSpeed(uFunc, vFunc, wFunc NextData) (speed, speedInverse, speedMinu
 				wlen := w.Shape[i]
 				dims[i] = minInt(ulen, vlen, wlen)
 			}
-			speed = sparse.ZerosDense(dims...)
-			speedInverse = sparse.ZerosDense(dims...)
-			speedMinusThird = sparse.ZerosDense(dims...)
-			speedMinusOnePointFour = sparse.ZerosDense(dims...)
-			firstData = false
 		}
-		uAvg.AddDense(u)
-		vAvg.AddDense(v)
-		wAvg.AddDense(w)
+		uMean.add(u)
+		vMean.add(v)
+		wMean.add(w)
+		s.next(dims...)
+		sInverse.next(dims...)
+		sMinusThird.next(dims...)
+		sMinusOnePointFour.next(dims...)
 		for k := 0; k < dims[0]; k++ {
 			for j := 0; j < dims[1]; j++ {
 				for i := 0; i < dims[2]; i++ {
@@ -608,16 +681,15 @@ func calcWindSpeed(uFunc, vFunc, wFunc NextData) (speed, speedInverse, speedMinu
 						math.Abs(v.Get(k, j+1, i))) / 2.
 					wcenter := (math.Abs(w.Get(k, j, i)) +
 						math.Abs(w.Get(k+1, j, i))) / 2.
-					s := math.Pow(math.Pow(ucenter, 2.)+
+					speed := math.Pow(math.Pow(ucenter, 2.)+
 						math.Pow(vcenter, 2.)+math.Pow(wcenter, 2.), 0.5)
-					speed.AddVal(s, k, j, i)
-					speedInverse.AddVal(1./s, k, j, i)
-					speedMinusThird.AddVal(math.Pow(s, -1./3.), k, j, i)
-					speedMinusOnePointFour.AddVal(math.Pow(s, -1.4), k, j, i)
+					s.addVal(speed, k, j, i)
+					sInverse.addVal(1./speed, k, j, i)
+					sMinusThird.addVal(math.Pow(speed, -1./3.), k, j, i)
+					sMinusOnePointFour.addVal(math.Pow(speed, -1.4), k, j, i)
 				}
 			}
 		}
-		n++
 	}
 }
 
@@ -647,21 +719,23 @@ func minInt(vals ...int) int {
 // planetary boundary layer height (pblh [m]), inverse density (alt, [m3/kg]),
 // temperature (T [K]), Pressure (P [Pa]),
 // surface heat flux [W/m2], HO mixing ratio [ppmv], and USGS land use index
-// (luIndex).
+// (luIndex). If overWater is true, the surface layer over water is
+// calculated from the average wind speed in the lowest layer
+// (windSpeed [m/s]) as described in OverWater; otherwise windSpeed is
+// not used and can be nil.
 func stabilityMixingChemistry(LayerHeights *sparse.DenseArray, pblhFunc, ustarFunc, altFunc, TFunc, PFunc, surfaceHeatFluxFunc, hoFunc, h2o2Func, z0Func, seinfeldLandUseFunc, weselyLandUseFunc,
-	qCloudFunc, radiationDownFunc, qrainFunc NextData) (Sclass, S1, KzzUnstaggered, M2u, M2d, SO2oxidation, particleDryDep, SO2DryDep, NOxDryDep, NH3DryDep, VOCDryDep, Kyy *sparse.DenseArray, err error) {
+	qCloudFunc, radiationDownFunc, qrainFunc NextData, windSpeed *sparse.DenseArray, overWater bool) (Sclass, S1, KzzUnstaggered, M2u, M2d, SO2oxidation, particleDryDep, coarseParticleDryDep, SO2DryDep, NOxDryDep, NH3DryDep, VOCDryDep, Kyy *sparse.DenseArray, err error) {
 	const (
 		Cp = 1006. // m2/s2-K; specific heat of air
 	)
 
-	var Kzz *sparse.DenseArray
-	var n int
-	firstData := true
+	var sclass, s1, kzz, m2u, m2d, so2oxidation, vdParticle, vdCoarse, vdSO2, vdNOx, vdNH3, vdVOC, kyy meanAccumulator
 	for {
 		T, err := TFunc() // ambient temperature [K]
 		if err != nil {
 			if err == io.EOF { // done reading data: return results
 				// Check for mass balance in convection coefficients
+				M2u, M2d = m2u.mean, m2d.mean
 				for k := 0; k < M2u.Shape[0]-2; k++ {
 					for j := 0; j < M2u.Shape[1]; j++ {
 						for i := 0; i < M2u.Shape[2]; i++ {
@@ -683,6 +757,7 @@ func stabilityMixingChemistry(LayerHeights *sparse.DenseArray, pblhFunc, ustarFu
 					}
 				}
 				// convert Kzz to unstaggered grid
+				Kzz := kzz.mean
 				KzzUnstaggered := sparse.ZerosDense(Kzz.Shape[0]-1, Kzz.Shape[1], Kzz.Shape[2])
 				for j := 0; j < KzzUnstaggered.Shape[1]; j++ {
 					for i := 0; i < KzzUnstaggered.Shape[2]; i++ {
@@ -693,81 +768,68 @@ func stabilityMixingChemistry(LayerHeights *sparse.DenseArray, pblhFunc, ustarFu
 						}
 					}
 				}
-				return arrayAverage(Sclass, n), arrayAverage(S1, n),
-					arrayAverage(KzzUnstaggered, n), arrayAverage(M2u, n), arrayAverage(M2d, n),
-					arrayAverage(SO2oxidation, n), arrayAverage(particleDryDep, n),
-					arrayAverage(SO2DryDep, n), arrayAverage(NOxDryDep, n), arrayAverage(NH3DryDep, n),
-					arrayAverage(VOCDryDep, n), arrayAverage(Kyy, n), nil
+				return sclass.mean, s1.mean, KzzUnstaggered, M2u, M2d, so2oxidation.mean,
+					vdParticle.mean, vdCoarse.mean, vdSO2.mean, vdNOx.mean, vdNH3.mean, vdVOC.mean, kyy.mean, nil
 			}
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
 		}
 		P, err := PFunc() // pressure [Pa]
 		if err != nil {
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
 		}
 		hfx, err := surfaceHeatFluxFunc() // W/m2
 		if err != nil {
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
 		}
 		ho, err := hoFunc() // ppmv
 		if err != nil {
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
 		}
 		h2o2, err := h2o2Func() // ppmv
 		if err != nil {
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
 		}
 		z0, err := z0Func() // roughness length [m]
 		if err != nil {
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
 		}
 		seinfeldLandUse, err := seinfeldLandUseFunc() // seinfeld land use index
 		if err != nil {
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
 		}
 		weselyLandUse, err := weselyLandUseFunc() // wesely land use index
 		if err != nil {
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
 		}
 		ustar, err := ustarFunc() // friction velocity (m/s)
 		if err != nil {
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
 		}
 		pblh, err := pblhFunc() // current boundary layer height (m)
 		if err != nil {
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
 		}
 		alt, err := altFunc() // inverse density (m3/kg)
 		if err != nil {
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
 		}
 		qCloud, err := qCloudFunc() // cloud water mixing ratio (kg/kg)
 		if err != nil {
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
 		}
 		radiationDown, err := radiationDownFunc() // Downwelling radiation at ground level (W/m2)
 		if err != nil {
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
 		}
 		qrain, err := qrainFunc() // mass fraction rain
 		if err != nil {
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, err
 		}
-		if firstData {
-			S1 = sparse.ZerosDense(T.Shape...)
-			Sclass = sparse.ZerosDense(T.Shape...)
-			Kzz = sparse.ZerosDense(LayerHeights.Shape...) // units = m2/s
-			M2u = sparse.ZerosDense(T.Shape...)            // units = 1/s
-			M2d = sparse.ZerosDense(T.Shape...)            // units = 1/s
-			SO2oxidation = sparse.ZerosDense(T.Shape...)   // units = 1/s
-			particleDryDep = sparse.ZerosDense(T.Shape...) // units = m/s
-			SO2DryDep = sparse.ZerosDense(T.Shape...)      // units = m/s
-			NOxDryDep = sparse.ZerosDense(T.Shape...)      // units = m/s
-			NH3DryDep = sparse.ZerosDense(T.Shape...)      // units = m/s
-			VOCDryDep = sparse.ZerosDense(T.Shape...)      // units = m/s
-			Kyy = sparse.ZerosDense(T.Shape...)            // units = m2/s
-			firstData = false
+		for _, acc := range []*meanAccumulator{&sclass, &s1, &m2u, &m2d, &so2oxidation, &vdParticle,
+			&vdCoarse, &vdSO2, &vdNOx, &vdNH3, &vdVOC, &kyy} {
+			acc.next(T.Shape...)
 		}
+		kzz.next(LayerHeights.Shape...) // units = m2/s
 		type empty struct{}
 		sem := make(chan empty, T.Shape[1]) // semaphore pattern
 		for j := 0; j < T.Shape[1]; j++ {
@@ -796,20 +858,39 @@ func stabilityMixingChemistry(LayerHeights *sparse.DenseArray, pblhFunc, ustarFu
 					hflux := hfx.Get(j, i)                // heat flux [W m-2]
 					ρ := 1 / alt.Get(0, j, i)             // density [kg/m3]
 					L := acm2.ObukhovLen(hflux, ρ, To, u) // Monin-Obukhov length [m]
+					weselyLU := landUseFractions(weselyLandUse, j, i)
+
+					// Calculate the surface layer over water, which
+					// is also used for mixing in cells that are mostly water.
+					uLand, LLand := u, L
+					var fWater, uWater, z0Water, LWater float64
+					if overWater {
+						if fWater = waterFraction(weselyLU); fWater > 0 {
+							zWater := LayerHeights.Get(1, j, i) / 2 // center of the lowest layer [m]
+							uWater, z0Water, LWater = overWaterSurfaceLayer(windSpeed.Get(0, j, i), zWater, hflux, ρ, To)
+							if fWater > 0.5 {
+								u, L = uWater, LWater
+							}
+						}
+					}
 					fconv := acm2.ConvectiveFraction(L, h)
-					m2u := acm2.M2u(LayerHeights.Get(1, j, i),
+					m2uVal := acm2.M2u(LayerHeights.Get(1, j, i),
 						LayerHeights.Get(2, j, i), h, L, u, fconv)
 
 					// Calculate dry deposition
 					p := P.Get(0, j, i) // Pressure [Pa]
 					//z: [m] surface layer; assumed to be 10% of boundary layer.
 					z := h / 10.
-					seinfeldLU := seinfeld.LandUseCategory(f2i(seinfeldLandUse.Get(j, i)))
-					weselyLU := wesely1989.LandUseCategory(f2i(weselyLandUse.Get(j, i)))
+					seinfeldLU := landUseFractions(seinfeldLandUse, j, i)
 					zo := z0.Get(j, i)       // roughness length [m]
 					const dParticle = 0.3e-6 // [m], Seinfeld & Pandis fig 8.11
 					const ρparticle = 1830.  // [kg/m3] Jacobson (2005) Ex. 13.5
-					const Θsurface = 0.      // surface slope [rad]; Assume surface is flat.
+					// Coarse particles (PM10-2.5), which are mostly dust,
+					// are represented by the diameter of the middle of the
+					// coarse size range and the density of mineral dust.
+					const dCoarse = 5.e-6 // [m]
+					const ρcoarse = 2650. // [kg/m3] density of quartz
+					const Θsurface = 0.   // surface slope [rad]; Assume surface is flat.
 
 					// This is not the best way to tell what season it is.
 					var iSeasonP seinfeld.SeasonalCategory // for particles
@@ -832,32 +913,63 @@ func stabilityMixingChemistry(LayerHeights *sparse.DenseArray, pblhFunc, ustarFu
 					rain := qrain.Get(0, j, i) > 1.e-6
 
 					G := radiationDown.Get(j, i) // irradiation [W/m2]
-					particleDryDep.AddVal(
-						//gocart.ParticleDryDep(gocartObk, u, To, h,
-						//	zo, dParticle/2., ρparticle, p), 0, j, i)
-						seinfeld.DryDepParticle(z, zo, u, L, dParticle,
-							To, p, ρparticle,
-							ρ, iSeasonP, seinfeldLU), 0, j, i)
-					SO2DryDep.AddVal(
-						seinfeld.DryDepGas(z, zo, u, L, To, ρ,
-							G, Θsurface,
-							wesely1989.So2Data, iSeasonG,
-							weselyLU, rain, dew, true, false), 0, j, i)
-					NOxDryDep.AddVal(
-						seinfeld.DryDepGas(z, zo, u, L, To, ρ,
-							G, Θsurface,
-							wesely1989.No2Data, iSeasonG,
-							weselyLU, rain, dew, false, false), 0, j, i)
-					NH3DryDep.AddVal(
-						seinfeld.DryDepGas(z, zo, u, L, To, ρ,
-							G, Θsurface,
-							wesely1989.Nh3Data, iSeasonG,
-							weselyLU, rain, dew, false, false), 0, j, i)
-					VOCDryDep.AddVal(
-						seinfeld.DryDepGas(z, zo, u, L, To, ρ,
-							G, Θsurface,
-							wesely1989.OraData, iSeasonG,
-							weselyLU, rain, dew, false, false), 0, j, i)
+					// Average the deposition velocities of the land use
+					// categories in the grid cell by area.
+					var vdp, vdc, vds, vdn, vdh, vdv float64
+					for _, lu := range withoutWater(seinfeldLU, fWater) {
+						u, L := uLand, LLand
+						vdp += lu.fraction *
+							//gocart.ParticleDryDep(gocartObk, u, To, h,
+							//	zo, dParticle/2., ρparticle, p)
+							seinfeld.DryDepParticle(z, zo, u, L, dParticle,
+								To, p, ρparticle,
+								ρ, iSeasonP, seinfeld.LandUseCategory(lu.category))
+						vdc += lu.fraction *
+							seinfeld.DryDepParticle(z, zo, u, L, dCoarse,
+								To, p, ρcoarse,
+								ρ, iSeasonP, seinfeld.LandUseCategory(lu.category))
+					}
+					if fWater > 0 {
+						// Seinfeld and Pandis (2006) treat water as a
+						// smooth surface, the same as desert.
+						vdp += fWater * seinfeld.DryDepParticle(z, z0Water, uWater, LWater,
+							dParticle, To, p, ρparticle, ρ, iSeasonP, seinfeld.Desert)
+						vdc += fWater * seinfeld.DryDepParticle(z, z0Water, uWater, LWater,
+							dCoarse, To, p, ρcoarse, ρ, iSeasonP, seinfeld.Desert)
+					}
+					for _, lu := range weselyLU {
+						weselyLU := wesely1989.LandUseCategory(lu.category)
+						zo, u, L := zo, uLand, LLand
+						if fWater > 0 && weselyLU == wesely1989.Water {
+							zo, u, L = z0Water, uWater, LWater
+						}
+						vds += lu.fraction *
+							seinfeld.DryDepGas(z, zo, u, L, To, ρ,
+								G, Θsurface,
+								wesely1989.So2Data, iSeasonG,
+								weselyLU, rain, dew, true, false)
+						vdn += lu.fraction *
+							seinfeld.DryDepGas(z, zo, u, L, To, ρ,
+								G, Θsurface,
+								wesely1989.No2Data, iSeasonG,
+								weselyLU, rain, dew, false, false)
+						vdh += lu.fraction *
+							seinfeld.DryDepGas(z, zo, u, L, To, ρ,
+								G, Θsurface,
+								wesely1989.Nh3Data, iSeasonG,
+								weselyLU, rain, dew, false, false)
+						vdv += lu.fraction *
+							seinfeld.DryDepGas(z, zo, u, L, To, ρ,
+								G, Θsurface,
+								wesely1989.OraData, iSeasonG,
+								weselyLU, rain, dew, false, false)
+					}
+					vdParticle.addVal(vdp, 0, j, i)
+					vdCoarse.addVal(vdc, 0, j, i)
+					vdSO2.addVal(vds, 0, j, i)
+					vdNOx.addVal(vdn, 0, j, i)
+					vdNH3.addVal(vdh, 0, j, i)
+					vdVOC.addVal(vdv, 0, j, i)
 
 					for k := 0; k < T.Shape[0]; k++ {
 						p := P.Get(k, j, i) // Pa
@@ -874,14 +986,13 @@ func stabilityMixingChemistry(LayerHeights *sparse.DenseArray, pblhFunc, ustarFu
 						}
 
 						// Stability parameter
-						s1 := dthetaDz / theta
-						S1.AddVal(s1, k, j, i)
+						s1.addVal(dthetaDz/theta, k, j, i)
 
 						// Stability class
 						if dthetaDz < 0.005 {
-							Sclass.AddVal(0., k, j, i)
+							sclass.addVal(0., k, j, i)
 						} else {
-							Sclass.AddVal(1., k, j, i)
+							sclass.addVal(1., k, j, i)
 						}
 
 						// Mixing
@@ -893,17 +1004,17 @@ func stabilityMixingChemistry(LayerHeights *sparse.DenseArray, pblhFunc, ustarFu
 
 						const freeAtmKzz = 3. // [m2 s-1]
 						if k >= pblTop {      // free atmosphere (unstaggered grid)
-							Kzz.AddVal(freeAtmKzz, k, j, i)
-							Kyy.AddVal(freeAtmKzz, k, j, i)
+							kzz.addVal(freeAtmKzz, k, j, i)
+							kyy.addVal(freeAtmKzz, k, j, i)
 							if k == T.Shape[0]-1 { // Top Layer
-								Kzz.AddVal(freeAtmKzz, k+1, j, i)
+								kzz.addVal(freeAtmKzz, k+1, j, i)
 							}
 						} else { // Boundary layer (unstaggered grid)
-							Kzz.AddVal(acm2.Kzz(z, h, L, u, fconv), k, j, i)
-							M2d.AddVal(acm2.M2d(m2u, z, Δz, h), k, j, i)
-							M2u.AddVal(m2u, k, j, i)
+							kzz.addVal(acm2.Kzz(z, h, L, u, fconv), k, j, i)
+							m2d.addVal(acm2.M2d(m2uVal, z, Δz, h), k, j, i)
+							m2u.addVal(m2uVal, k, j, i)
 							kmyy := acm2.CalculateKm(zcenter, h, L, u)
-							Kyy.AddVal(kmyy, k, j, i)
+							kyy.addVal(kmyy, k, j, i)
 						}
 
 						// Gas phase sulfur chemistry
@@ -930,24 +1041,24 @@ func stabilityMixingChemistry(LayerHeights *sparse.DenseArray, pblhFunc, ustarFu
 								h2o2.Get(k, j, i)*1000., pH, t, p*atmPerPa,
 								qCloudVal)
 						}
-						SO2oxidation.AddVal(kso2, k, j, i) // 1/s
+						so2oxidation.addVal(kso2, k, j, i) // 1/s
 					}
 
 					// Check for mass balance in convection coefficients
-					for k := 0; k < M2u.Shape[0]-2; k++ {
+					for k := 0; k < m2u.mean.Shape[0]-2; k++ {
 						z := LayerHeights.Get(k, j, i)
 						zabove := LayerHeights.Get(k+1, j, i)
 						z2above := LayerHeights.Get(k+2, j, i)
 						Δzratio := (z2above - zabove) / (zabove - z)
-						m2u := M2u.Get(k, j, i)
-						val := m2u - M2d.Get(k, j, i) +
-							M2d.Get(k+1, j, i)*Δzratio
-						if math.Abs(val/m2u) > 1.e-8 {
+						m2uMean := m2u.get(k, j, i)
+						val := m2uMean - m2d.get(k, j, i) +
+							m2d.get(k+1, j, i)*Δzratio
+						if math.Abs(val/m2uMean) > 1.e-8 {
 							panic(fmt.Errorf("M2u and M2d don't match: "+
 								"(k,j,i)=(%v,%v,%v); val=%v; m2u=%v; "+
 								"m2d=%v, m2dAbove=%v; kpbl=%v",
-								k, j, i, val, m2u, M2d.Get(k, j, i),
-								M2d.Get(k+1, j, i), pblTop))
+								k, j, i, val, m2uMean, m2d.get(k, j, i),
+								m2d.get(k+1, j, i), pblTop))
 						}
 					}
 				}
@@ -957,7 +1068,6 @@ func stabilityMixingChemistry(LayerHeights *sparse.DenseArray, pblhFunc, ustarFu
 		for j := 0; j < T.Shape[1]; j++ { // wait for routines to finish
 			<-sem
 		}
-		n++
 	}
 }
 
@@ -975,33 +1085,26 @@ func f2i(f float64) int {
 	return int(f + 0.5)
 }
 
-func arrayAverage(s *sparse.DenseArray, numTsteps int) *sparse.DenseArray {
-	n := float64(numTsteps)
-	for i, val := range s.Elements {
-		s.Elements[i] = val / n
-	}
-	return s
-}
-
 // nextDataNCF returns a function that sequentially retrieves time series data
 // for the specified variable (varName) from a series of NetCDF files
 // with the given file name template between the given start and end times.
-// recordDelta and fileDelta specify the length of time between each file
-// and each record within a file, respectively. dateFormat is the format
-// in which dates appear in the filename.
+// recordDelta and fileDelta specify the length of time between each record
+// within a file and each file, respectively; fileDelta can be calendarMonth
+// for monthly files. dateFormat is the format in which dates appear in
+// the filename.
 func nextDataNCF(fileTemplate string, dateFormat string, varName string, start, end time.Time, recordDelta, fileDelta time.Duration, readFunc readNCFFunc, msgChan chan string) NextData {
-	recordsPerFile := int(fileDelta / recordDelta)
+	recordsPerFile := fileRecords(start, recordDelta, fileDelta)
 	var i int
 	date := start
 	return func() (*sparse.DenseArray, error) {
 		if !date.Before(end) {
 			return nil, io.EOF
 		}
-		f, ff, err := ncfFromTemplate(fileTemplate, dateFormat, date)
+		ff, err := ncfFromTemplate(fileTemplate, dateFormat, date)
 		if err != nil {
 			return nil, err
 		}
-		defer f.Close()
+		defer ff.Close()
 		data, err := readFunc(varName, ff, i)
 		if err != nil {
 			return nil, err
@@ -1009,11 +1112,12 @@ func nextDataNCF(fileTemplate string, dateFormat string, varName string, start,
 		i++
 		if i == recordsPerFile {
 			if msgChan != nil {
-				fileName := strings.Replace(fileTemplate, "[DATE]", date.Format(dateFormat), -1)
+				fileName := templateFile(fileTemplate, dateFormat, date)
 				msgChan <- fmt.Sprintf("Read %d records of %s from %s", i, varName, fileName)
 			}
 			i = 0
-			date = date.Add(fileDelta)
+			date = addInterval(date, fileDelta)
+			recordsPerFile = fileRecords(date, recordDelta, fileDelta)
 		}
 		return data, err
 	}
@@ -1021,67 +1125,61 @@ func nextDataNCF(fileTemplate string, dateFormat string, varName string, start,
 
 // readNCFFunc is a function that can read information from a
 // NetCDF file.
-type readNCFFunc func(varName string, file *cdf.File, index int) (*sparse.DenseArray, error)
+type readNCFFunc func(varName string, file ncfFile, index int) (*sparse.DenseArray, error)
 
 // readNCF reads variable pol out of netcdf file ff at the index 0 value
 // specified by hour.
-func readNCF(pol string, ff *cdf.File, hour int) (*sparse.DenseArray, error) {
-	dims := ff.Header.Lengths(pol)
+func readNCF(pol string, ff ncfFile, hour int) (*sparse.DenseArray, error) {
+	dims := ff.Lengths(pol)
 	if len(dims) == 0 {
 		return nil, fmt.Errorf("inmap: preprocessor read netcdf: variable %v not in file", pol)
 	}
+	start, end := make([]int, len(dims)), make([]int, len(dims))
+	copy(end, dims)
+	start[0], end[0] = hour, hour+1
 	dims = dims[1:]
-	nread := 1
-	for _, dim := range dims {
-		nread *= dim
+	buf, err := ff.Read(pol, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: preprocessor read netcdf variable %s: %v", pol, err)
 	}
-	start, end := make([]int, len(dims)+1), make([]int, len(dims)+1)
-	start[0], end[0] = hour, hour+1
-	r := ff.Reader(pol, start, end)
-	buf := r.Zero(nread)
-	_, err := r.Read(buf)
+	vals, err := ncfFloats(buf)
 	if err != nil {
 		return nil, fmt.Errorf("inmap: preprocessor read netcdf variable %s: %v", pol, err)
 	}
 	data := sparse.ZerosDense(dims...)
-	for i, val := range buf.([]float32) {
-		data.Elements[i] = float64(val)
-	}
+	copy(data.Elements, vals)
 	return data, nil
 }
 
 // readNCFNoHour reads variable pol out of netcdf file ff.
-func readNCFNoHour(pol string, ff *cdf.File, _ int) (*sparse.DenseArray, error) {
-	dims := ff.Header.Lengths(pol)
+func readNCFNoHour(pol string, ff ncfFile, _ int) (*sparse.DenseArray, error) {
+	dims := ff.Lengths(pol)
 	if len(dims) == 0 {
 		return nil, fmt.Errorf("inmap: preprocessor read netcdf: variable %v not in file", pol)
 	} else if dims[0] == 0 {
 		dims = dims[1:4] // TODO: This doesn't seem like a good solution here.
 	}
-	r := ff.Reader(pol, nil, nil)
-	buf := r.Zero(-1)
-	_, err := r.Read(buf)
+	buf, err := ff.Read(pol, nil, nil)
 	if err != nil {
 		return nil, fmt.Errorf("inmap: preprocessor read netcdf variable %s: %v", pol, err)
 	}
-	data := sparse.ZerosDense(dims...)
-	for i, val := range buf.([]float32) {
-		data.Elements[i] = float64(val)
+	vals, err := ncfFloats(buf)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: preprocessor read netcdf variable %s: %v", pol, err)
 	}
+	data := sparse.ZerosDense(dims...)
+	copy(data.Elements, vals)
 	return data, nil
 }
 
 // nextDataConstantNCF is a NetCDF file iterator for constant data.
 // It always returns the same array.
 func nextDataConstantNCF(pol, filename string) func() (*sparse.DenseArray, error) {
-	f, err := os.Open(filename)
-	var ff *cdf.File
+	ff, err := openNCF(filename)
 	var data *sparse.DenseArray
 	if err == nil {
-		ff, err = cdf.Open(f)
-		if err == nil {
-			data, err = readNCFNoHour(pol, ff, 0)
-		}
+		data, err = readNCFNoHour(pol, ff, 0)
+		ff.Close()
 	}
 	return func() (*sparse.DenseArray, error) {
 		return data, err
@@ -1095,8 +1193,15 @@ func nextDataGroupNCF(fileTemplate string, dateFormat string, varNames map[strin
 	for v := range varNames {
 		dataFuncs[v] = nextDataNCF(fileTemplate, dateFormat, v, start, end, recordDelta, fileDelta, readFunc, msgChan)
 	}
+	return nextDataGroup(dataFuncs, varNames)
+}
+
+// nextDataGroup sums the results of dataFuncs, multiplying each by the
+// factor in varNames that corresponds to the same key.
+func nextDataGroup(dataFuncs map[string]NextData, varNames map[string]float64) NextData {
 	return func() (*sparse.DenseArray, error) {
 		var out *sparse.DenseArray
+		var lastErr error
 		firstData := true
 		for varName, f := range dataFuncs {
 			data, err := f()
@@ -1105,6 +1210,7 @@ func nextDataGroupNCF(fileTemplate string, dateFormat string, varNames map[strin
 					return nil, err
 				}
 				log.Println(err) // Sometimes not all tracers are written out. TODO: How big of a problem is this?
+				lastErr = err
 				continue
 			}
 			if firstData {
@@ -1116,6 +1222,10 @@ func nextDataGroupNCF(fileTemplate string, dateFormat string, varNames map[strin
 				out.Elements[i] += val * factor
 			}
 		}
+		if firstData {
+			// None of the variables could be read.
+			return nil, lastErr
+		}
 		return out, nil
 	}
 }
@@ -1124,6 +1234,11 @@ func nextDataGroupNCF(fileTemplate string, dateFormat string, varNames map[strin
 // and divides the result by inverse density (alt), as specified by altVar.
 func nextDataGroupAltNCF(fileTemplate string, dateFormat string, varNames map[string]float64, altFunc NextData, start, end time.Time, recordDelta, fileDelta time.Duration, readFunc readNCFFunc, msgChan chan string) NextData {
 	f := nextDataGroupNCF(fileTemplate, dateFormat, varNames, start, end, recordDelta, fileDelta, readFunc, msgChan)
+	return divideByAlt(f, altFunc)
+}
+
+// divideByAlt divides the results of f by inverse density (alt).
+func divideByAlt(f, altFunc NextData) NextData {
 	return func() (*sparse.DenseArray, error) {
 		alt, err := altFunc()
 		if err != nil {
@@ -1133,6 +1248,10 @@ func nextDataGroupAltNCF(fileTemplate string, dateFormat string, varNames map[st
 		if err != nil {
 			return nil, err
 		}
+		if len(data.Elements) != len(alt.Elements) {
+			return nil, fmt.Errorf("inmap: preprocessor: chemistry shape %v does not match meteorology shape %v",
+				data.Shape, alt.Shape)
+		}
 		out := sparse.ZerosDense(data.Shape...)
 		for i, val := range data.Elements {
 			out.Elements[i] = val / alt.Elements[i]
@@ -1143,19 +1262,22 @@ func nextDataGroupAltNCF(fileTemplate string, dateFormat string, varNames map[st
 
 // ncfFromTemplate opens a NetCDF file from the given template, where
 // the [DATE] wildcard in the given fileTemplate is replaced by the given
-// date, formatted as the given dateFormat.
-func ncfFromTemplate(fileTemplate, dateFormat string, date time.Time) (*os.File, *cdf.File, error) {
-	d := date.Format(dateFormat)
-	file := strings.Replace(fileTemplate, "[DATE]", d, -1)
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, nil, err
-	}
-	ff, err := cdf.Open(f)
-	if err != nil {
-		return nil, nil, err
-	}
-	return f, ff, err
+// date, formatted as the given dateFormat. Classic and NetCDF-4
+// format files, Zarr stores, and OPeNDAP dataset URLs are supported.
+func ncfFromTemplate(fileTemplate, dateFormat string, date time.Time) (ncfFile, error) {
+	return openNCF(templateFile(fileTemplate, dateFormat, date))
+}
+
+// templateFile returns the name of the file for the given date from the
+// given template, where [DATE] is replaced by the date in the given format
+// and [HOUR] and [MINUTE] are replaced by the two-digit hour and minute
+// of the date, as is required for files that each cover less than a day.
+func templateFile(fileTemplate, dateFormat string, date time.Time) string {
+	return strings.NewReplacer(
+		"[DATE]", date.Format(dateFormat),
+		"[HOUR]", date.Format("15"),
+		"[MINUTE]", date.Format("04"),
+	).Replace(fileTemplate)
 }
 
 // stagger converts an unstaggered grid to a grid that
@@ -1170,6 +1292,22 @@ func stagger(inFunc NextData, staggerDim int) NextData {
 	}
 }
 
+// periodicStaggerX sets the values at the western and eastern edges of
+// data, which is staggered in the x direction, to the average of the
+// values at the two edges, for grids where the western and eastern edges
+// are the same location. The values at the edges are otherwise those of
+// the cells next to them (see staggerWorker).
+func periodicStaggerX(data *sparse.DenseArray) {
+	nx := data.Shape[2] - 1
+	for k := 0; k < data.Shape[0]; k++ {
+		for j := 0; j < data.Shape[1]; j++ {
+			v := (data.Get(k, j, 0) + data.Get(k, j, nx)) / 2
+			data.Set(v, k, j, 0)
+			data.Set(v, k, j, nx)
+		}
+	}
+}
+
 // staggerWorker converts an unstaggered grid to a grid that
 // is staggered with regard to the given dimension.
 func staggerWorker(in *sparse.DenseArray, staggerDim int) *sparse.DenseArray {
@@ -220,6 +220,48 @@ func TestGEOSChemToInMAP_new(t *testing.T) {
 	compareCTMData(goldenData, newData, tolerance, t)
 }
 
+func TestGEOSChemCoarsePM(t *testing.T) {
+	gc, err := NewGEOSChem(
+		"cmd/inmap/testdata/preproc/geoschem-new/MERRA2.[DATE].A1.2x25.nc3",
+		"cmd/inmap/testdata/preproc/geoschem-new/MERRA2.[DATE].A3cld.2x25.nc3",
+		"cmd/inmap/testdata/preproc/geoschem-new/MERRA2.[DATE].A3dyn.2x25.nc3",
+		"cmd/inmap/testdata/preproc/geoschem-new/MERRA2.[DATE].I3.2x25.nc3",
+		"cmd/inmap/testdata/preproc/geoschem-new/MERRA2.[DATE].A3mstE.2x25.nc3",
+		"cmd/inmap/testdata/preproc/geoschem-new/GEOSFP.ApBp.nc",
+		"cmd/inmap/testdata/preproc/geoschem-new/ts.[DATE].nc",
+		"cmd/inmap/testdata/preproc/geoschem-new/Olson_2001_Land_Map.025x025.generic.nc",
+		"20160102",
+		"20160103",
+		false,
+		"3h",
+		"24h",
+		false,
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Preprocess(gc, -2.5, 50, 2.5, 2, CoarsePM(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	coarse, ok := data.Data["CoarseParticleDryDep"]
+	if !ok {
+		t.Fatal("missing variable CoarseParticleDryDep")
+	}
+	if !reflect.DeepEqual(coarse.Data.Shape, data.Data["ParticleDryDep"].Data.Shape) {
+		t.Errorf("shape: have %v, want %v", coarse.Data.Shape, data.Data["ParticleDryDep"].Data.Shape)
+	}
+	// Dry deposition only occurs in the ground-level layer.
+	for j := 0; j < coarse.Data.Shape[1]; j++ {
+		for i := 0; i < coarse.Data.Shape[2]; i++ {
+			if v := coarse.Data.Get(0, j, i); !(v > 0) || math.IsInf(v, 0) {
+				t.Errorf("(%d, %d): coarse particle dry deposition velocity is %g", j, i, v)
+			}
+		}
+	}
+}
+
 func compareCTMData(goldenData, newData *CTMData, tolerance float64, t *testing.T) {
 	if len(goldenData.Data) != len(newData.Data) {
 		t.Errorf("new and old ctmdata have different number of variables (%d vs. %d)",
@@ -386,7 +428,7 @@ func TestWindSpeed(t *testing.T) {
 
 func TestTemperature(t *testing.T) {
 	const tolerance = 1.0e-8
-	tempFunc := wrfTemperatureConvert(testNextData(T), wrfPressureConvert(testNextData(P), testNextData(PB)))
+	tempFunc := cmaqTemperatureConvert(testNextData(T), cmaqPressureConvert(testNextData(P), testNextData(PB)))
 	Temp, err := average(tempFunc)
 	if err != nil {
 		t.Error(err)
@@ -411,17 +453,17 @@ func TestStabilityMixingChemistry(t *testing.T) {
 	qCloudFunc := testNextData(QCLOUD)
 	qrainFunc := testNextData(QRAIN)
 
-	pFunc := wrfPressureConvert(testNextData(P), testNextData(PB))
-	tempFunc := wrfTemperatureConvert(testNextData(T), wrfPressureConvert(testNextData(P), testNextData(PB)))
+	pFunc := cmaqPressureConvert(testNextData(P), testNextData(PB))
+	tempFunc := cmaqTemperatureConvert(testNextData(T), cmaqPressureConvert(testNextData(P), testNextData(PB)))
 
-	radiationDownFunc := wrfRadiationDown(testNextData(SWDOWN), testNextData(GLW))
+	radiationDownFunc := cmaqRadiationDown(testNextData(SWDOWN), testNextData(GLW))
 
-	z0Func := wrfZ0(testNextData(LUIndex))
-	seinfeldLandUseFunc := wrfSeinfeldLandUse(testNextData(LUIndex))
-	weselyLandUseFunc := wrfWeselyLandUse(testNextData(LUIndex))
+	z0Func := cmaqZ0(testNextData(LUIndex), usgsLandUse())
+	seinfeldLandUseFunc := cmaqSeinfeldLandUse(testNextData(LUIndex), usgsLandUse())
+	weselyLandUseFunc := cmaqWeselyLandUse(testNextData(LUIndex), usgsLandUse())
 
-	Sclass, S1, KzzUnstaggered, M2u, M2d, SO2oxidation, particleDryDep, SO2DryDep, NOxDryDep, NH3DryDep, VOCDryDep, Kyy, err := stabilityMixingChemistry(layerHeights, pblhFunc, ustarFunc, altFunc, tempFunc,
-		pFunc, surfaceHeatFluxFunc, hoFunc, h2o2Func, z0Func, seinfeldLandUseFunc, weselyLandUseFunc, qCloudFunc, radiationDownFunc, qrainFunc)
+	Sclass, S1, KzzUnstaggered, M2u, M2d, SO2oxidation, particleDryDep, _, SO2DryDep, NOxDryDep, NH3DryDep, VOCDryDep, Kyy, err := stabilityMixingChemistry(layerHeights, pblhFunc, ustarFunc, altFunc, tempFunc,
+		pFunc, surfaceHeatFluxFunc, hoFunc, h2o2Func, z0Func, seinfeldLandUseFunc, weselyLandUseFunc, qCloudFunc, radiationDownFunc, qrainFunc, nil, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -440,15 +482,15 @@ func TestStabilityMixingChemistry(t *testing.T) {
 	SO2oxidationWant := sparse.ZerosDense([]int{10, 2, 2}...)
 	SO2oxidationWant.Elements = []float64{1.721657225308307e-07, 2.81397237473639e-07, 2.407546336659953e-07, 2.61349340908674e-07, 1.657502677072367e-07, 2.6616347667235814e-07, 1.965803268391172e-07, 2.68991898227076e-07, 1.7287147453981165e-07, 2.3699094049610386e-07, 1.915248452652225e-07, 2.5193332436575475e-07, 1.8623149968362105e-07, 0.2528135843303613, 1.970548982458274e-07, 2.3530268601622454e-07, 2.926399319434474e-07, 2.1665156133438385e-07, 2.1729669290828353e-07, 2.0962361619205938e-07, 2.6956563786526554e-07, 2.093463026377419e-07, 3.626047816640662e-07, 1.6288422079864346e-07, 5.345276052707975e-07, 2.1937229945140494e-07, 8.698723439241161e-07, 1.5580791448153274e-07, 1.9863750471240534e-06, 3.599331457411426e-07, 5.001428803731995e-07, 6.339050075943203e-07, 4.831824472501523e-07, 4.477029865692818e-07, 4.622916727421153e-07, 3.603982632752272e-07, 2.0642162959544838e-07, 3.965027082274449e-07, 2.3196340932676016e-07, 3.6686577403379013e-07}
 	particleDryDepWant := sparse.ZerosDense([]int{10, 2, 2}...)
-	particleDryDepWant.Elements = []float64{0.010162865526722476, 0.0017065693477232012, 0.0023751725529831532, 0.0017312970049009032, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	particleDryDepWant.Elements = []float64{0.01402799454820931, 0.001702627253959511, 0.0023691300495348126, 0.0017271545033763342, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
 	SO2DryDepWant := sparse.ZerosDense([]int{10, 2, 2}...)
-	SO2DryDepWant.Elements = []float64{0.0006568912613621955, 0.0015159703284781817, 0.0019091511896542302, 0.0013656110424365697, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	SO2DryDepWant.Elements = []float64{0.0017106294752094885, 0.001282933963751644, 0.0016036874226029343, 0.0011491617386600243, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
 	NOxDryDepWant := sparse.ZerosDense([]int{10, 2, 2}...)
-	NOxDryDepWant.Elements = []float64{0.0005026924483343035, 0.0005932331015299358, 0.0007109444200385571, 0.0005316489167541452, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	NOxDryDepWant.Elements = []float64{0.0006441862561590866, 0.0005583052811605828, 0.0006679703620554021, 0.0005013066736660902, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
 	NH3DryDepWant := sparse.ZerosDense([]int{10, 2, 2}...)
-	NH3DryDepWant.Elements = []float64{0.0007134287459725018, 0.0005291881365846268, 0.0010781565788536144, 0.00047609893335600543, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	NH3DryDepWant.Elements = []float64{0.0008723452225274528, 0.0004256044166435117, 0.0009794473165619846, 0.00038631986297550056, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
 	VOCDryDepWant := sparse.ZerosDense([]int{10, 2, 2}...)
-	VOCDryDepWant.Elements = []float64{0.004007289236558869, 0.004335934482798151, 0.005862160692304825, 0.004142667516734282, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	VOCDryDepWant.Elements = []float64{0.006330181022160765, 0.004129059860869817, 0.005610579567997984, 0.0039353809406156666, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
 	KyyWant := sparse.ZerosDense([]int{10, 2, 2}...)
 	KyyWant.Elements = []float64{3.314078249333397, 1.6963492952810897, 2.2043457151327797, 1.7755557553414636, 5.81661362886252, 2.4524110263991976, 4.127658827070609, 3.2998877771882564, 5.178982032133868, 2.163232562976917, 4.133745757981916, 3.4080629388484924, 3.0245935106815245, 1.4093207475370766, 3.0880710514206777, 2.764735389058494, 0.5030066407522406, 0.6084716233029834, 1.8236003202595226, 1.8249670827324578, 3, 0.07489190318322451, 1.8373335564537299, 0.8183546621141308, 3, 3, 3, 1.6039803699322372, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3}
 
@@ -0,0 +1,285 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ctessum/sparse"
+)
+
+// MissingDataPolicy specifies how a preprocessor handles input files
+// that are missing and time steps that cannot be read.
+type MissingDataPolicy string
+
+const (
+	// MissingDataFail stops preprocessing with an error.
+	MissingDataFail MissingDataPolicy = "fail"
+
+	// MissingDataSkip leaves the time steps in missing input files
+	// out of the averages. Time steps that cannot be read from input
+	// files that do exist are interpolated, because skipping them for only
+	// some variables would misalign variables that are combined with each
+	// other.
+	MissingDataSkip MissingDataPolicy = "skip"
+
+	// MissingDataInterpolate replaces missing or unreadable time steps
+	// by linear interpolation in time between the nearest time steps
+	// that could be read.
+	MissingDataInterpolate MissingDataPolicy = "interpolate"
+)
+
+// gapTracker applies a MissingDataPolicy to the variables read by a
+// preprocessor and keeps track of the data that was missing.
+type gapTracker struct {
+	policy MissingDataPolicy
+
+	// checks return an error if any of the input files for
+	// the given file date cannot be opened.
+	checks []func(date time.Time) error
+
+	mx sync.Mutex
+
+	// files holds the result of checks for each file date.
+	files map[time.Time]error
+
+	// records holds the variables whose records could not be read
+	// at each time.
+	records map[time.Time]map[string]error
+}
+
+// newGapTracker returns a gapTracker for the given policy, or nil if
+// the policy is MissingDataFail or empty.
+func newGapTracker(policy string, checks ...func(date time.Time) error) (*gapTracker, error) {
+	switch MissingDataPolicy(policy) {
+	case "", MissingDataFail:
+		return nil, nil
+	case MissingDataSkip, MissingDataInterpolate:
+		return &gapTracker{
+			policy:  MissingDataPolicy(policy),
+			checks:  checks,
+			files:   make(map[time.Time]error),
+			records: make(map[time.Time]map[string]error),
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid missing data policy '%s'; valid options are %s, %s, and %s",
+			policy, MissingDataFail, MissingDataSkip, MissingDataInterpolate)
+	}
+}
+
+// fileErr returns an error if the input files for the given date
+// cannot be opened. The result is the same for all variables.
+func (g *gapTracker) fileErr(date time.Time) error {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	if err, ok := g.files[date]; ok {
+		return err
+	}
+	var err error
+	for _, check := range g.checks {
+		if err = check(date); err != nil {
+			break
+		}
+	}
+	g.files[date] = err
+	return err
+}
+
+// recordErr records that the given variable could not be read at time t.
+func (g *gapTracker) recordErr(varName string, t time.Time, err error) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	if g.records[t] == nil {
+		g.records[t] = make(map[string]error)
+	}
+	g.records[t][varName] = err
+}
+
+// report returns a summary of the missing data, or an empty string
+// if no data was missing.
+func (g *gapTracker) report() string {
+	if g == nil {
+		return ""
+	}
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	var missing, unreadable []time.Time
+	for t, err := range g.files {
+		if err != nil {
+			missing = append(missing, t)
+		}
+	}
+	for t := range g.records {
+		unreadable = append(unreadable, t)
+	}
+	if len(missing) == 0 && len(unreadable) == 0 {
+		return ""
+	}
+	sortTimes := func(t []time.Time) {
+		sort.Slice(t, func(i, j int) bool { return t[i].Before(t[j]) })
+	}
+	sortTimes(missing)
+	sortTimes(unreadable)
+	b := new(bytes.Buffer)
+	action := "skipped"
+	if g.policy == MissingDataInterpolate {
+		action = "interpolated"
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(b, "%d input file period(s) were missing and %s:\n", len(missing), action)
+		for _, t := range missing {
+			fmt.Fprintf(b, "\t%v: %v\n", t, g.files[t])
+		}
+	}
+	if len(unreadable) > 0 {
+		fmt.Fprintf(b, "%d time step(s) could not be read and were interpolated:\n", len(unreadable))
+		for _, t := range unreadable {
+			vars := make([]string, 0, len(g.records[t]))
+			for v := range g.records[t] {
+				vars = append(vars, v)
+			}
+			sort.Strings(vars)
+			fmt.Fprintf(b, "\t%v: %s (%v)\n", t, strings.Join(vars, ", "), g.records[t][vars[0]])
+		}
+	}
+	return b.String()
+}
+
+// recordFunc reads the record with the given index from the
+// input file for the given file date.
+type recordFunc func(date time.Time, index int) (*sparse.DenseArray, error)
+
+// nextData is analogous to nextDataNCF, except that missing input files
+// and unreadable records of variable varName are handled according to the
+// policy of g.
+func (g *gapTracker) nextData(varName string, start, end time.Time, recordDelta, fileDelta time.Duration, read recordFunc, msgChan chan string) NextData {
+	date := start
+	recordsPerFile := fileRecords(start, recordDelta, fileDelta)
+	var i, nRead int
+	nextFile := func() {
+		i = 0
+		date = addInterval(date, fileDelta)
+		recordsPerFile = fileRecords(date, recordDelta, fileDelta)
+	}
+
+	// next returns the next record, or nil if it is missing.
+	next := func() (*sparse.DenseArray, error) {
+		for {
+			if !date.Before(end) {
+				return nil, io.EOF
+			}
+			if g.fileErr(date) != nil {
+				if g.policy == MissingDataSkip {
+					nextFile()
+					continue
+				}
+				if i++; i == recordsPerFile {
+					nextFile()
+				}
+				return nil, nil
+			}
+			t := date.Add(time.Duration(i) * recordDelta)
+			data, err := read(date, i)
+			if err == nil && !finite(data) {
+				err = fmt.Errorf("non-finite values")
+			}
+			if err != nil {
+				g.recordErr(varName, t, err)
+				data = nil
+			}
+			if i++; i == recordsPerFile {
+				if msgChan != nil {
+					msgChan <- fmt.Sprintf("Read %d records of %s for %v", i, varName, date)
+				}
+				nextFile()
+			}
+			return data, nil
+		}
+	}
+
+	var prev *sparse.DenseArray
+	var queue []*sparse.DenseArray
+	var gap int // The number of missing records since prev.
+	return func() (*sparse.DenseArray, error) {
+		for len(queue) == 0 {
+			data, err := next()
+			if err == io.EOF {
+				if gap == 0 {
+					if nRead == 0 {
+						return nil, fmt.Errorf("inmap: preprocessor: no data could be read for variable %s", varName)
+					}
+					return nil, io.EOF
+				}
+				if prev == nil {
+					return nil, fmt.Errorf("inmap: preprocessor: no data could be read for variable %s", varName)
+				}
+				for ; gap > 0; gap-- {
+					queue = append(queue, prev.Copy())
+				}
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if data == nil {
+				gap++
+				continue
+			}
+			for k := 1; k <= gap; k++ {
+				queue = append(queue, interpolateRecords(prev, data, float64(k)/float64(gap+1)))
+			}
+			gap = 0
+			prev = data.Copy()
+			queue = append(queue, data)
+		}
+		data := queue[0]
+		queue = queue[1:]
+		nRead++
+		return data, nil
+	}
+}
+
+// interpolateRecords returns the linear interpolation between a and b at
+// fraction w of the way from a to b. If a is nil, a copy of b is returned.
+func interpolateRecords(a, b *sparse.DenseArray, w float64) *sparse.DenseArray {
+	o := b.Copy()
+	if a == nil {
+		return o
+	}
+	for i, v := range a.Elements {
+		o.Elements[i] = v*(1-w) + b.Elements[i]*w
+	}
+	return o
+}
+
+// finite returns whether all of the values in data are finite.
+func finite(data *sparse.DenseArray) bool {
+	for _, v := range data.Elements {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ctessum/sparse"
+)
+
+func TestGapTrackerNextData(t *testing.T) {
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(72 * time.Hour)
+	missingDay := start.Add(24 * time.Hour)
+	badRecord := start.Add(60 * time.Hour)
+
+	// There are two records per day, and the value of each record is
+	// the number of hours since start.
+	read := func(date time.Time, index int) (*sparse.DenseArray, error) {
+		tt := date.Add(time.Duration(index) * 12 * time.Hour)
+		if tt.Equal(badRecord) {
+			return nil, fmt.Errorf("corrupted record")
+		}
+		o := sparse.ZerosDense(1)
+		o.Elements[0] = tt.Sub(start).Hours()
+		return o, nil
+	}
+	check := func(date time.Time) error {
+		if date.Equal(missingDay) {
+			return fmt.Errorf("missing file")
+		}
+		return nil
+	}
+
+	for policy, want := range map[string][]float64{
+		"skip":        {0, 12, 48, 48},
+		"interpolate": {0, 12, 24, 36, 48, 48},
+	} {
+		g, err := newGapTracker(policy, check)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := g.nextData("x", start, end, 12*time.Hour, 24*time.Hour, read, nil)
+		var have []float64
+		for {
+			d, err := f()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			have = append(have, d.Elements[0])
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("%s: have %v, want %v", policy, have, want)
+		}
+		if g.report() == "" {
+			t.Errorf("%s: missing report", policy)
+		}
+	}
+
+	if g, err := newGapTracker("fail", check); g != nil || err != nil {
+		t.Errorf("fail: have %v, %v; want nil, nil", g, err)
+	}
+	if _, err := newGapTracker("xxx", check); err == nil {
+		t.Error("expected an error for an invalid policy")
+	}
+}
+
+func TestCAMxMissingDataSkip(t *testing.T) {
+	newCAMx := func(end string) *CAMx {
+		c, err := NewCAMx("cmd/inmap/testdata/preproc/camx.avrg.grd01.[DATE]",
+			"cmd/inmap/testdata/preproc/wrfout_d01_[DATE]_00_00_00", "20050101", end, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	want, err := Preprocess(newCAMx("20050103"), -2004000, -540000, 12000, 12000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// There are no input files for 20050103.
+	c := newCAMx("20050104")
+	if _, err = Preprocess(c, -2004000, -540000, 12000, 12000); err == nil {
+		t.Fatal("expected an error for missing input files")
+	}
+	if err = c.SetMissingDataPolicy("skip"); err != nil {
+		t.Fatal(err)
+	}
+	have, err := Preprocess(c, -2004000, -540000, 12000, 12000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"TotalPM25", "alt", "Temperature", "UAvg", "pNO"} {
+		for i, w := range want.Data[v].Data.Elements {
+			if h := have.Data[v].Data.Elements[i]; different(h, w, 1.e-8) {
+				t.Errorf("%s[%d]: have %g, want %g", v, i, h, w)
+			}
+		}
+	}
+	if c.MissingDataReport() == "" {
+		t.Error("missing report")
+	}
+}
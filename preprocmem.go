@@ -0,0 +1,183 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ctessum/sparse"
+)
+
+// meanAccumulator calculates the running mean of a variable over a series
+// of time steps without keeping a running sum or any of the earlier
+// time steps, so that only one array per variable is held in memory.
+type meanAccumulator struct {
+	mean *sparse.DenseArray
+	n    int
+}
+
+// add adds data as a new time step, updating the mean in place
+// using Welford's algorithm.
+func (a *meanAccumulator) add(data *sparse.DenseArray) {
+	if a.mean == nil {
+		a.mean = sparse.ZerosDense(data.Shape...)
+	}
+	a.n++
+	n := float64(a.n)
+	for i, v := range data.Elements {
+		a.mean.Elements[i] += (v - a.mean.Elements[i]) / n
+	}
+}
+
+// next starts a new time step whose values are added one at a time using
+// addVal and addElement; values that are not added count as zero.
+// The mean is allocated with the given shape if necessary.
+func (a *meanAccumulator) next(shape ...int) {
+	if a.mean == nil {
+		a.mean = sparse.ZerosDense(shape...)
+	}
+	a.n++
+	if a.n > 1 {
+		a.mean.Scale(float64(a.n-1) / float64(a.n))
+	}
+}
+
+// addVal adds v to the current time step at the given index.
+func (a *meanAccumulator) addVal(v float64, index ...int) {
+	a.mean.AddVal(v/float64(a.n), index...)
+}
+
+// addElement adds v to the current time step at the given
+// one-dimensional index.
+func (a *meanAccumulator) addElement(i int, v float64) {
+	a.mean.Elements[i] += v / float64(a.n)
+}
+
+// get returns the value of the current mean at the given index.
+func (a *meanAccumulator) get(index ...int) float64 {
+	return a.mean.Get(index...)
+}
+
+// Numbers of 3-D arrays held in memory by each step of preprocessing,
+// including the input time steps that are being read, the
+// accumulators, and the results, which are held until preprocessing
+// is complete.
+const (
+	// preprocessOutputArrays is the number of 3-D variables in the
+	// preprocessed output.
+	preprocessOutputArrays = 45
+
+	// preprocessMaxTaskArrays is the number of arrays held by the
+	// largest single calculation (stabilityMixingChemistry), in addition
+	// to its results.
+	preprocessMaxTaskArrays = 12
+)
+
+// memoryBudget limits the memory used by concurrent calculations.
+type memoryBudget struct {
+	limit float64 // bytes; zero or less means no limit.
+
+	mx      sync.Mutex
+	cond    *sync.Cond
+	used    float64
+	running int
+}
+
+// newMemoryBudget returns a new budget with the given memory limit in bytes,
+// where a limit of zero or less means memory use is not limited.
+func newMemoryBudget(limit float64) *memoryBudget {
+	b := &memoryBudget{limit: limit}
+	b.cond = sync.NewCond(&b.mx)
+	return b
+}
+
+// acquire waits until the given number of bytes are available and
+// reserves them. If no other calculations are running, the memory is
+// reserved even if it is more than is available, so that calculations
+// that do not fit within the budget run one at a time rather than
+// not at all.
+func (b *memoryBudget) acquire(bytes float64) {
+	if b.limit <= 0 {
+		return
+	}
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	for b.running > 0 && b.used+bytes > b.limit {
+		b.cond.Wait()
+	}
+	b.used += bytes
+	b.running++
+}
+
+// release releases the given number of bytes of the memory reserved by a
+// calculation that has finished; the remainder of its reservation stays
+// in use by its results.
+func (b *memoryBudget) release(bytes float64) {
+	if b.limit <= 0 {
+		return
+	}
+	b.mx.Lock()
+	b.used -= bytes
+	b.running--
+	b.mx.Unlock()
+	b.cond.Broadcast()
+}
+
+// run runs f in a new goroutine once enough memory is available for
+// working arrays and results 3-D arrays of arrayBytes each, and then sends
+// the result of f to errChan. The memory used by the working arrays is
+// released when f returns.
+func (b *memoryBudget) run(working, results int, arrayBytes float64, errChan chan error, f func() error) {
+	go func() {
+		b.acquire(float64(working+results) * arrayBytes)
+		err := f()
+		b.release(float64(working) * arrayBytes)
+		errChan <- err
+	}()
+}
+
+// ctmDataAccumulator calculates the weighted running mean of a series
+// of CTMData with the same grid and variables.
+type ctmDataAccumulator struct {
+	mean   *CTMData
+	weight float64
+}
+
+// add adds d with weight w (e.g., the number of hours in the period
+// it represents) to the mean. The first data added becomes the mean
+// and is modified in place as more data is added.
+func (a *ctmDataAccumulator) add(d *CTMData, w float64) error {
+	if a.mean == nil {
+		a.mean, a.weight = d, w
+		return nil
+	}
+	a.weight += w
+	f := w / a.weight
+	for name, v := range a.mean.Data {
+		dv, ok := d.Data[name]
+		if !ok || len(dv.Data.Elements) != len(v.Data.Elements) {
+			return fmt.Errorf("inmap: averaging CTM data: inconsistent variable %s", name)
+		}
+		for i, val := range dv.Data.Elements {
+			v.Data.Elements[i] += (val - v.Data.Elements[i]) * f
+		}
+	}
+	return nil
+}
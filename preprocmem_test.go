@@ -0,0 +1,144 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"testing"
+
+	"github.com/ctessum/sparse"
+)
+
+func TestMeanAccumulator(t *testing.T) {
+	steps := [][]float64{{1, 2, 3}, {4, 0, 6}, {7, 8, -1}, {10, 2, 5}}
+	want := []float64{5.5, 3, 3.25}
+
+	var whole, byElement meanAccumulator
+	for _, step := range steps {
+		data := sparse.ZerosDense(3)
+		copy(data.Elements, step)
+		whole.add(data)
+
+		byElement.next(3)
+		for i, v := range step {
+			if v != 0 { // Values that are not added count as zero.
+				byElement.addVal(v, i)
+			}
+		}
+	}
+	for i, w := range want {
+		if h := whole.mean.Elements[i]; different(h, w, 1.e-14) {
+			t.Errorf("add [%d]: have %g, want %g", i, h, w)
+		}
+		if h := byElement.get(i); different(h, w, 1.e-14) {
+			t.Errorf("addVal [%d]: have %g, want %g", i, h, w)
+		}
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	const (
+		arrayBytes = 100
+		tasks      = 8
+	)
+	b := newMemoryBudget(3 * arrayBytes)
+	var maxUsed float64
+	errChan := make(chan error)
+	for i := 0; i < tasks; i++ {
+		b.run(1, 0, arrayBytes, errChan, func() error {
+			b.mx.Lock()
+			if b.used > maxUsed {
+				maxUsed = b.used
+			}
+			b.mx.Unlock()
+			return nil
+		})
+	}
+	for i := 0; i < tasks; i++ {
+		if err := <-errChan; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if maxUsed > 3*arrayBytes {
+		t.Errorf("%g bytes were used at the same time; the limit is %d", maxUsed, 3*arrayBytes)
+	}
+
+	// A task that does not fit in the budget should still run by itself,
+	// and the memory held by its results should count against later tasks.
+	b.run(2, 2, arrayBytes, errChan, func() error { return nil })
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	if b.used != 2*arrayBytes || b.running != 0 {
+		t.Errorf("have %g bytes used by %d tasks, want 200 bytes used by 0 tasks", b.used, b.running)
+	}
+}
+
+func TestCTMDataAccumulator(t *testing.T) {
+	newData := func(v float64) *CTMData {
+		d := new(CTMData)
+		a := sparse.ZerosDense(2)
+		a.Elements[0], a.Elements[1] = v, 2*v
+		d.AddVariable("x", []string{"x"}, "", "", a)
+		return d
+	}
+	var avg ctmDataAccumulator
+	for _, w := range []struct{ v, weight float64 }{{1, 1}, {4, 2}, {10, 3}} {
+		if err := avg.add(newData(w.v), w.weight); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// (1*1 + 4*2 + 10*3) / 6 = 6.5
+	have := avg.mean.Data["x"].Data.Elements
+	if different(have[0], 6.5, 1.e-14) || different(have[1], 13, 1.e-14) {
+		t.Errorf("have %v, want [6.5 13]", have)
+	}
+	if err := avg.add(new(CTMData), 1); err == nil {
+		t.Error("inconsistent variables should cause an error")
+	}
+}
+
+func TestPreprocessMemoryLimit(t *testing.T) {
+	newCAMx := func() *CAMx {
+		c, err := NewCAMx("cmd/inmap/testdata/preproc/camx.avrg.grd01.[DATE]",
+			"cmd/inmap/testdata/preproc/wrfout_d01_[DATE]_00_00_00", "20050101", "20050102", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	want, err := Preprocess(newCAMx(), -2004000, -540000, 12000, 12000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With a very small limit, the calculations run one at a time.
+	have, err := Preprocess(newCAMx(), -2004000, -540000, 12000, 12000, Parallel(1, 1.e-9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, w := range want.Data {
+		for i, v := range w.Data.Elements {
+			// Species are summed in random order, so the results
+			// are not exactly the same.
+			if h := have.Data[name].Data.Elements[i]; h != v && different(h, v, 1.e-12) {
+				t.Errorf("%s[%d]: have %g, want %g", name, i, h, v)
+				break
+			}
+		}
+	}
+}
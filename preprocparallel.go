@@ -0,0 +1,391 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PreprocessOption is an optional setting for Preprocess.
+type PreprocessOption func(*preprocessOptions)
+
+// preprocessOptions holds the settings specified by PreprocessOptions.
+type preprocessOptions struct {
+	workers     int
+	memoryLimit float64 // bytes
+
+	checkpointDir string
+	resume        bool
+
+	validate bool
+
+	ozone bool
+
+	nitrateEquilibrium bool
+
+	coarsePM bool
+
+	overWater bool
+
+	layerHeights []float64
+}
+
+// wrap returns p wrapped according to the options.
+func (o *preprocessOptions) wrap(p Preprocessor) Preprocessor {
+	if o.validate {
+		return validatePreprocessor{Preprocessor: p}
+	}
+	return p
+}
+
+// Parallel specifies that the simulation period should be split up into
+// separate periods that are preprocessed concurrently by the given number of
+// workers and then averaged together. Splitting only happens at
+// file boundaries and only works with preprocessors that implement
+// TimeSplitter; others will be preprocessed serially.
+// memoryLimitGB is the approximate maximum amount of memory in gigabytes
+// to be used by preprocessing. The number of concurrent workers is
+// reduced to stay within the limit, and the calculations within each
+// worker (including with only one worker) are run one after another
+// rather than concurrently when running them at the same time would
+// exceed it. If it is zero or less, memory use will not be limited.
+//
+// Averages of the meteorological and chemical variables are the same
+// as for serial preprocessing, but derived values that depend on
+// differences between time steps (e.g., gas-particle partitioning)
+// or on deviations from the average (e.g., wind speed deviation) are
+// calculated separately for each period and may differ slightly.
+func Parallel(workers int, memoryLimitGB float64) PreprocessOption {
+	return func(o *preprocessOptions) {
+		o.workers = workers
+		o.memoryLimit = memoryLimitGB * 1.e9
+	}
+}
+
+// TimeSplitter is implemented by preprocessors whose simulation period
+// can be split into shorter periods.
+type TimeSplitter interface {
+	Preprocessor
+
+	// SplitTime returns up to n preprocessors that each cover a consecutive
+	// part of the simulation period, where each period includes at least
+	// one whole input file.
+	SplitTime(n int) []Preprocessor
+}
+
+// splitPeriod splits the period between start and end into up to n
+// consecutive periods that each start at a file boundary.
+func splitPeriod(start, end time.Time, fileDelta time.Duration, n int) [][2]time.Time {
+	var files []time.Time // The start time of each file.
+	for t := start; t.Before(end); t = addInterval(t, fileDelta) {
+		files = append(files, t)
+	}
+	nFiles := len(files)
+	if n > nFiles {
+		n = nFiles
+	}
+	if n < 1 {
+		return [][2]time.Time{{start, end}}
+	}
+	o := make([][2]time.Time, n)
+	for i := range o {
+		o[i][0] = files[nFiles*i/n]
+		if i == n-1 {
+			o[i][1] = end
+		} else {
+			o[i][1] = files[nFiles*(i+1)/n]
+		}
+	}
+	return o
+}
+
+// SplitTime helps fulfill the TimeSplitter interface.
+func (w *WRFCmaq) SplitTime(n int) []Preprocessor {
+	var o []Preprocessor
+	for _, p := range splitPeriod(w.start, w.end, w.fileDelta, n) {
+		ww := *w
+		ww.start, ww.end = p[0], p[1]
+		o = append(o, &ww)
+	}
+	return o
+}
+
+// SplitTime helps fulfill the TimeSplitter interface.
+func (c *CAMx) SplitTime(n int) []Preprocessor {
+	var o []Preprocessor
+	for _, p := range c.WRFCmaq.SplitTime(n) {
+		cc := *c
+		cc.WRFCmaq = p.(*WRFCmaq)
+		o = append(o, &cc)
+	}
+	return o
+}
+
+// SplitTime helps fulfill the TimeSplitter interface.
+func (w *WRFChem) SplitTime(n int) []Preprocessor {
+	var o []Preprocessor
+	for _, p := range w.WRFCmaq.SplitTime(n) {
+		ww := *w
+		ww.WRFCmaq = p.(*WRFCmaq)
+		o = append(o, &ww)
+	}
+	return o
+}
+
+// SplitTime helps fulfill the TimeSplitter interface.
+func (m *MPAS) SplitTime(n int) []Preprocessor {
+	var o []Preprocessor
+	for _, p := range splitPeriod(m.start, m.end, m.fileDelta, n) {
+		mm := *m
+		mm.start, mm.end = p[0], p[1]
+		o = append(o, &mm)
+	}
+	return o
+}
+
+// SplitTime helps fulfill the TimeSplitter interface.
+func (gc *GEOSChem) SplitTime(n int) []Preprocessor {
+	var o []Preprocessor
+	for _, p := range splitPeriod(gc.start, gc.end, gc.fileDelta24h, n) {
+		g := *gc
+		g.start, g.end = p[0], p[1]
+		o = append(o, &g)
+	}
+	return o
+}
+
+// SplitTime helps fulfill the TimeSplitter interface. The simulation
+// period is only split if the chemistry is climatological, because
+// the given chemistry source cannot be split.
+func (m *MERRA2) SplitTime(n int) []Preprocessor {
+	if m.chem != nil {
+		return []Preprocessor{m}
+	}
+	var o []Preprocessor
+	for _, p := range splitPeriod(m.start, m.end, 24*time.Hour, n) {
+		mm := *m
+		mm.start, mm.end = p[0], p[1]
+		mm.clim = &merra2Climatology{m: &mm}
+		o = append(o, &mm)
+	}
+	return o
+}
+
+// preprocessMemory returns the approximate minimum number of bytes
+// of memory needed to preprocess p, when the largest calculation
+// runs by itself.
+func preprocessMemory(p Preprocessor) (float64, error) {
+	arrayBytes, err := preprocessArrayBytes(p)
+	if err != nil {
+		return 0, err
+	}
+	return arrayBytes * (preprocessOutputArrays + preprocessMaxTaskArrays), nil
+}
+
+// preprocessArrayBytes returns the number of bytes of memory used by
+// a 3-D array on the vertically staggered grid of p.
+func preprocessArrayBytes(p Preprocessor) (float64, error) {
+	nx, err := p.Nx()
+	if err != nil {
+		return 0, err
+	}
+	ny, err := p.Ny()
+	if err != nil {
+		return 0, err
+	}
+	nz, err := p.Nz()
+	if err != nil {
+		return 0, err
+	}
+	return float64(nx*ny*(nz+1)) * 8, nil
+}
+
+// Checkpoint specifies that the preprocessed data for each input file
+// should be saved in directory dir as soon as it is completed, so that
+// an interrupted preprocessing run can be restarted. If resume is true,
+// files that have already been preprocessed will be loaded from
+// dir rather than being preprocessed again. Checkpointing only works with
+// preprocessors that implement TimeSplitter, and the same caveats
+// about derived values that apply to Parallel also apply here.
+func Checkpoint(dir string, resume bool) PreprocessOption {
+	return func(o *preprocessOptions) {
+		o.checkpointDir = dir
+		o.resume = resume
+	}
+}
+
+// preprocessPeriods preprocesses the periods in p concurrently
+// and averages the results. The results are added to the average in the
+// order of the periods, so that the average is always exactly the same,
+// and each is added as soon as it and the results of the preceding
+// periods are complete. A worker does not start preprocessing another
+// period until its result has been added, so at most one result per
+// worker is held in memory.
+func preprocessPeriods(p TimeSplitter, o *preprocessOptions, xo, yo, dx, dy float64) (*CTMData, error) {
+	workers := o.workers
+	if workers < 1 {
+		workers = 1
+	}
+	var periods []Preprocessor
+	if o.checkpointDir != "" {
+		// Checkpoint after every file.
+		periods = p.SplitTime(math.MaxInt32)
+		if err := os.MkdirAll(o.checkpointDir, os.ModePerm); err != nil {
+			return nil, fmt.Errorf("inmap: preprocessing checkpoint: %v", err)
+		}
+	} else {
+		periods = p.SplitTime(workers)
+	}
+	if len(periods) < workers {
+		workers = len(periods)
+	}
+	var workerMemory float64 // The memory limit for each worker.
+	if o.memoryLimit > 0 {
+		mem, err := preprocessMemory(p)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: preprocessing: %v", err)
+		}
+		arrayBytes, err := preprocessArrayBytes(p)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: preprocessing: %v", err)
+		}
+		// The average of the results is also held in memory.
+		available := o.memoryLimit - arrayBytes*preprocessOutputArrays
+		if maxWorkers := int(available / mem); maxWorkers < workers {
+			workers = maxWorkers
+		}
+		if workers < 1 {
+			workers = 1
+		}
+		workerMemory = available / float64(workers)
+	}
+
+	type result struct {
+		data *CTMData
+		err  error
+	}
+	sem := make(chan struct{}, workers)
+	results := make([]chan result, len(periods))
+	for i := range results {
+		results[i] = make(chan result)
+	}
+	go func() {
+		for i, pp := range periods {
+			sem <- struct{}{}
+			go func(i int, pp Preprocessor) {
+				data, err := o.preprocessPeriod(pp, xo, yo, dx, dy, workerMemory)
+				results[i] <- result{data: data, err: err}
+				<-sem
+			}(i, pp)
+		}
+	}()
+	var avg ctmDataAccumulator
+	var err error
+	for i := range periods {
+		r := <-results[i]
+		if r.err != nil && err == nil {
+			err = r.err
+		}
+		if err != nil {
+			continue
+		}
+		start, end := periodBounds(periods[i])
+		err = avg.add(r.data, end.Sub(start).Hours())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return avg.mean, nil
+}
+
+// preprocessPeriod preprocesses a single period, loading it from or
+// saving it to a checkpoint file if requested. memoryLimit is the
+// memory limit in bytes for preprocessing the period.
+func (o *preprocessOptions) preprocessPeriod(p Preprocessor, xo, yo, dx, dy, memoryLimit float64) (*CTMData, error) {
+	start, end := periodBounds(p)
+	if o.checkpointDir == "" {
+		data, err := preprocess(o.wrap(p), xo, yo, dx, dy, memoryLimit, o.ozone, o.coarsePM, o.overWater)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: preprocessing period %v to %v: %v", start, end, err)
+		}
+		return data, nil
+	}
+	const format = "20060102T1504"
+	path := filepath.Join(o.checkpointDir, fmt.Sprintf("inmap_preproc_%s_%s.ncf",
+		start.Format(format), end.Format(format)))
+	if o.resume {
+		if f, err := os.Open(path); err == nil {
+			defer f.Close()
+			data, err := new(VarGridConfig).LoadCTMData(f)
+			if err != nil {
+				return nil, fmt.Errorf("inmap: loading preprocessing checkpoint %s: %v", path, err)
+			}
+			if data.xo != xo || data.yo != yo || data.dx != dx || data.dy != dy {
+				return nil, fmt.Errorf("inmap: preprocessing checkpoint %s is for a different grid", path)
+			}
+			return data, nil
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("inmap: loading preprocessing checkpoint: %v", err)
+		}
+	}
+	data, err := preprocess(o.wrap(p), xo, yo, dx, dy, memoryLimit, o.ozone, o.coarsePM, o.overWater)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: preprocessing period %v to %v: %v", start, end, err)
+	}
+	// Write to a temporary file first so that an interrupted write
+	// is not mistaken for a completed checkpoint.
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, fmt.Errorf("inmap: writing preprocessing checkpoint: %v", err)
+	}
+	if err = data.Write(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("inmap: writing preprocessing checkpoint: %v", err)
+	}
+	if err = f.Close(); err != nil {
+		return nil, fmt.Errorf("inmap: writing preprocessing checkpoint: %v", err)
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return nil, fmt.Errorf("inmap: writing preprocessing checkpoint: %v", err)
+	}
+	return data, nil
+}
+
+// periodBounds returns the beginning and end of the simulation period of p.
+func periodBounds(p Preprocessor) (start, end time.Time) {
+	switch pp := p.(type) {
+	case *WRFCmaq:
+		return pp.start, pp.end
+	case *CAMx:
+		return pp.start, pp.end
+	case *WRFChem:
+		return pp.start, pp.end
+	case *MPAS:
+		return pp.start, pp.end
+	case *GEOSChem:
+		return pp.start, pp.end
+	case *MERRA2:
+		return pp.start, pp.end
+	}
+	return
+}
@@ -0,0 +1,144 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitPeriod(t *testing.T) {
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	for _, test := range []struct {
+		end  time.Time
+		n    int
+		want [][2]time.Time
+	}{
+		{
+			end:  start.Add(3 * day),
+			n:    2,
+			want: [][2]time.Time{{start, start.Add(day)}, {start.Add(day), start.Add(3 * day)}},
+		},
+		{
+			end:  start.Add(36 * time.Hour),
+			n:    4,
+			want: [][2]time.Time{{start, start.Add(day)}, {start.Add(day), start.Add(36 * time.Hour)}},
+		},
+		{
+			end:  start.Add(day),
+			n:    0,
+			want: [][2]time.Time{{start, start.Add(day)}},
+		},
+	} {
+		if have := splitPeriod(start, test.end, day, test.n); !reflect.DeepEqual(have, test.want) {
+			t.Errorf("end %v, n %d: have %v, want %v", test.end, test.n, have, test.want)
+		}
+	}
+	feb, apr := time.Date(2016, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2016, 4, 1, 0, 0, 0, 0, time.UTC)
+	want := [][2]time.Time{{start, feb}, {feb, apr}}
+	if have := splitPeriod(start, apr, calendarMonth, 2); !reflect.DeepEqual(have, want) {
+		t.Errorf("monthly: have %v, want %v", have, want)
+	}
+}
+
+func TestPreprocessParallel(t *testing.T) {
+	newCAMx := func() *CAMx {
+		c, err := NewCAMx("cmd/inmap/testdata/preproc/camx.avrg.grd01.[DATE]",
+			"cmd/inmap/testdata/preproc/wrfout_d01_[DATE]_00_00_00", "20050101", "20050103", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	serial, err := Preprocess(newCAMx(), -2004000, -540000, 12000, 12000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parallel, err := Preprocess(newCAMx(), -2004000, -540000, 12000, 12000, Parallel(2, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parallel.Data) != len(serial.Data) {
+		t.Fatalf("number of variables: have %d, want %d", len(parallel.Data), len(serial.Data))
+	}
+	// These variables are linear averages, so they should be the same
+	// regardless of how the simulation period is split.
+	for _, v := range []string{"TotalPM25", "alt", "Temperature", "UAvg", "VAvg", "pNO", "LayerHeights"} {
+		s, p := serial.Data[v].Data, parallel.Data[v].Data
+		if !reflect.DeepEqual(s.Shape, p.Shape) {
+			t.Fatalf("%s shape: have %v, want %v", v, p.Shape, s.Shape)
+		}
+		for i, want := range s.Elements {
+			if have := p.Elements[i]; different(have, want, 1.e-8) {
+				t.Errorf("%s[%d]: have %g, want %g", v, i, have, want)
+			}
+		}
+	}
+}
+
+func TestPreprocessCheckpoint(t *testing.T) {
+	dir, err := os.MkdirTemp("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCAMx("cmd/inmap/testdata/preproc/camx.avrg.grd01.[DATE]",
+		"cmd/inmap/testdata/preproc/wrfout_d01_[DATE]_00_00_00", "20050101", "20050103", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Preprocess(c, -2004000, -540000, 12000, 12000, Checkpoint(dir, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.ncf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("have %d checkpoint files, want 2", len(files))
+	}
+
+	// When resuming, the input files should not be read again.
+	c.camxOut = filepath.Join(dir, "missing.[DATE]")
+	if _, err = Preprocess(c, -2004000, -540000, 12000, 12000, Checkpoint(dir, false)); err == nil {
+		t.Fatal("expected an error for missing input files without resume")
+	}
+	have, err := Preprocess(c, -2004000, -540000, 12000, 12000, Checkpoint(dir, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"TotalPM25", "alt", "Kzz"} {
+		for i, w := range want.Data[v].Data.Elements {
+			// Checkpoints are saved with single precision.
+			if h := have.Data[v].Data.Elements[i]; different(h, w, 1.e-6) {
+				t.Errorf("%s[%d]: have %g, want %g", v, i, h, w)
+			}
+		}
+	}
+
+	if _, err = Preprocess(c, -2004000, -540000, 24000, 24000, Checkpoint(dir, true)); err == nil {
+		t.Error("expected an error for a checkpoint with a different grid")
+	}
+}
@@ -0,0 +1,276 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// calendarMonth is a file interval that represents one file per
+// calendar month, which cannot be represented as a fixed time.Duration.
+const calendarMonth time.Duration = -1
+
+// autoInterval is the interval specification that requests that
+// the interval be detected from the time coordinate of the input files.
+const autoInterval = "auto"
+
+// parseInterval parses a record or file time interval, which can be either
+// a duration such as "10m" or "6h" or, for file intervals, "monthly".
+func parseInterval(s string, file bool) (time.Duration, error) {
+	if file && s == "monthly" {
+		return calendarMonth, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("time interval %s is not positive", s)
+	}
+	return d, nil
+}
+
+// timeIntervals parses the given record and file time intervals. If either
+// is "auto", it is detected from the time coordinate of the file returned
+// by firstFile. If either is empty, the corresponding default value is
+// returned.
+func timeIntervals(recordStr, fileStr string, defaultRecord, defaultFile time.Duration, firstFile func() (ncfFile, error)) (recordDelta, fileDelta time.Duration, err error) {
+	recordDelta, fileDelta = defaultRecord, defaultFile
+	if recordStr == autoInterval || fileStr == autoInterval {
+		f, err := firstFile()
+		if err != nil {
+			return 0, 0, err
+		}
+		defer f.Close()
+		r, fd, err := detectIntervals(f)
+		if err != nil {
+			return 0, 0, fmt.Errorf("detecting time intervals: %v", err)
+		}
+		if recordStr == autoInterval {
+			recordDelta = r
+		}
+		if fileStr == autoInterval {
+			fileDelta = fd
+		}
+	}
+	if recordStr != "" && recordStr != autoInterval {
+		if recordDelta, err = parseInterval(recordStr, false); err != nil {
+			return 0, 0, fmt.Errorf("recordDelta: %v", err)
+		}
+	}
+	if fileStr != "" && fileStr != autoInterval {
+		if fileDelta, err = parseInterval(fileStr, true); err != nil {
+			return 0, 0, fmt.Errorf("fileDelta: %v", err)
+		}
+	}
+	if fileDelta != calendarMonth && fileDelta%recordDelta != 0 {
+		return 0, 0, fmt.Errorf("fileDelta %v is not a multiple of recordDelta %v", fileDelta, recordDelta)
+	}
+	return recordDelta, fileDelta, nil
+}
+
+// addInterval returns the time one file interval after t.
+func addInterval(t time.Time, fileDelta time.Duration) time.Time {
+	if fileDelta == calendarMonth {
+		return t.AddDate(0, 1, 0)
+	}
+	return t.Add(fileDelta)
+}
+
+// fileRecords returns the number of records in the file that starts at
+// the given date.
+func fileRecords(date time.Time, recordDelta, fileDelta time.Duration) int {
+	return int(addInterval(date, fileDelta).Sub(date) / recordDelta)
+}
+
+// detectIntervals determines the time interval between records and the time
+// interval covered by the given file from its time coordinate. The
+// records must be evenly spaced, and there must be at least two of them.
+func detectIntervals(f ncfFile) (recordDelta, fileDelta time.Duration, err error) {
+	times, err := ncfTimes(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(times) < 2 {
+		return 0, 0, fmt.Errorf("the time interval cannot be detected from a file with %d time step(s)", len(times))
+	}
+	recordDelta = times[1].Sub(times[0])
+	if recordDelta <= 0 {
+		return 0, 0, fmt.Errorf("times %v and %v are not increasing", times[0], times[1])
+	}
+	for i := 2; i < len(times); i++ {
+		if d := times[i].Sub(times[i-1]); d != recordDelta {
+			return 0, 0, fmt.Errorf("time steps are not evenly spaced: %v and %v", recordDelta, d)
+		}
+	}
+	fileDelta = recordDelta * time.Duration(len(times))
+	// Files covering a whole month are assumed to be monthly files.
+	monthStart := time.Date(times[0].Year(), times[0].Month(), 1, 0, 0, 0, 0, time.UTC)
+	if fileDelta >= 28*24*time.Hour && addInterval(monthStart, calendarMonth).Sub(monthStart) == fileDelta {
+		fileDelta = calendarMonth
+	}
+	return recordDelta, fileDelta, nil
+}
+
+// ncfTimes returns the times of the records in f. Times are read from
+// the "Times" (WRF), "xtime" (MPAS), or "TFLAG" (IOAPI) variables, or a
+// "time" (Climate and Forecast conventions) coordinate variable.
+func ncfTimes(f ncfFile) ([]time.Time, error) {
+	for _, v := range []string{"Times", "xtime"} {
+		if f.Lengths(v) == nil {
+			continue
+		}
+		l := f.Lengths(v)
+		if len(l) != 2 {
+			return nil, fmt.Errorf("variable %s has %d dimensions; it should have 2", v, len(l))
+		}
+		vals, err := f.Read(v, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		strs, err := ncfStrings(vals, l[0], l[1])
+		if err != nil {
+			return nil, fmt.Errorf("variable %s: %v", v, err)
+		}
+		o := make([]time.Time, len(strs))
+		for i, s := range strs {
+			if o[i], err = time.Parse("2006-01-02_15:04:05", strings.TrimSpace(s)); err != nil {
+				return nil, fmt.Errorf("variable %s: %v", v, err)
+			}
+		}
+		return o, nil
+	}
+	if l := f.Lengths("TFLAG"); l != nil {
+		return ioapiTimes(f, l)
+	}
+	if f.Lengths("time") != nil {
+		return cfTimes(f)
+	}
+	return nil, fmt.Errorf("no time coordinate variable")
+}
+
+// ncfStrings converts a character array with n rows of length
+// strLen into strings.
+func ncfStrings(vals interface{}, n, strLen int) ([]string, error) {
+	var s string
+	switch v := vals.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case []string:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %T", vals)
+	}
+	if len(s) != n*strLen {
+		return nil, fmt.Errorf("%d characters is not %d times %d", len(s), n, strLen)
+	}
+	o := make([]string, n)
+	for i := range o {
+		o[i] = strings.TrimRight(s[i*strLen:(i+1)*strLen], "\x00")
+	}
+	return o, nil
+}
+
+// ioapiTimes reads the times from an IOAPI TFLAG variable with
+// dimensions [TSTEP, VAR, DATE-TIME] and dates in the format
+// YYYYDDD and times in the format HHMMSS.
+func ioapiTimes(f ncfFile, l []int) ([]time.Time, error) {
+	if len(l) != 3 || l[2] != 2 {
+		return nil, fmt.Errorf("variable TFLAG has dimensions %v; it should be [TSTEP, VAR, 2]", l)
+	}
+	vals, err := f.Read("TFLAG", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	flags, err := ncfFloats(vals)
+	if err != nil {
+		return nil, fmt.Errorf("variable TFLAG: %v", err)
+	}
+	o := make([]time.Time, l[0])
+	for i := range o {
+		date, hms := int(flags[i*l[1]*2]), int(flags[i*l[1]*2+1])
+		o[i] = time.Date(date/1000, 1, date%1000, hms/10000, hms/100%100, hms%100, 0, time.UTC)
+	}
+	return o, nil
+}
+
+// cfTimes reads the times from a "time" coordinate variable with
+// units in the form "<unit> since <reference time>".
+func cfTimes(f ncfFile) ([]time.Time, error) {
+	units, ok := f.Attribute("time", "units").(string)
+	if !ok {
+		return nil, fmt.Errorf("variable time does not have a units attribute")
+	}
+	parts := strings.SplitN(units, " since ", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid time units '%s'", units)
+	}
+	var unit time.Duration
+	switch strings.TrimSpace(strings.ToLower(parts[0])) {
+	case "seconds", "second", "s":
+		unit = time.Second
+	case "minutes", "minute", "min":
+		unit = time.Minute
+	case "hours", "hour", "h":
+		unit = time.Hour
+	case "days", "day", "d":
+		unit = 24 * time.Hour
+	default:
+		return nil, fmt.Errorf("unsupported time unit '%s'", parts[0])
+	}
+	ref, err := parseReferenceTime(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	vals, err := f.Read("time", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := ncfFloats(vals)
+	if err != nil {
+		return nil, fmt.Errorf("variable time: %v", err)
+	}
+	o := make([]time.Time, len(offsets))
+	for i, v := range offsets {
+		o[i] = ref.Add(time.Duration(v * float64(unit)))
+	}
+	return o, nil
+}
+
+// parseReferenceTime parses the reference time of Climate and Forecast
+// conventions time units, e.g. "2013-01-02 00:00:00.0".
+func parseReferenceTime(s string) (time.Time, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "Z")
+	if i := strings.Index(s, "."); i > 0 {
+		if _, err := strconv.Atoi(s[i+1:]); err == nil {
+			s = s[:i] // Remove fractional seconds.
+		}
+	}
+	for _, layout := range []string{"2006-1-2 15:4:5", "2006-1-2T15:4:5", "2006-1-2 15:4", "2006-1-2"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid reference time '%s'", s)
+}
@@ -0,0 +1,137 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ctessum/cdf"
+)
+
+// writeTimesFile writes a NetCDF file with a WRF-style Times variable
+// containing the given times.
+func writeTimesFile(t *testing.T, path string, times []time.Time) {
+	h := cdf.NewHeader([]string{"Time", "DateStrLen"}, []int{len(times), 19})
+	h.AddVariable("Times", []string{"Time", "DateStrLen"}, "")
+	h.Define()
+	w, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	f, err := cdf.Create(w, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s []byte
+	for _, tt := range times {
+		s = append(s, tt.Format("2006-01-02_15:04:05")...)
+	}
+	if _, err = f.Writer("Times", []int{0, 0}, []int{len(times), 19}).Write(s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTimeIntervals(t *testing.T) {
+	dir, err := os.MkdirTemp("", "inmap_timeintervals")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var subHourly, monthly []time.Time
+	for i := 0; i < 36; i++ {
+		subHourly = append(subHourly, start.Add(time.Duration(i)*10*time.Minute))
+	}
+	for i := 0; i < 31*24; i++ {
+		monthly = append(monthly, start.Add(time.Duration(i)*time.Hour))
+	}
+	writeTimesFile(t, filepath.Join(dir, "subhourly.nc"), subHourly)
+	writeTimesFile(t, filepath.Join(dir, "monthly.nc"), monthly)
+	writeTimesFile(t, filepath.Join(dir, "single.nc"), subHourly[0:1])
+
+	for _, test := range []struct {
+		file, record, fileInterval string
+		wantRecord, wantFile       time.Duration
+		wantErr                    bool
+	}{
+		{file: "subhourly.nc", wantRecord: time.Hour, wantFile: 24 * time.Hour},
+		{file: "subhourly.nc", record: "auto", fileInterval: "auto", wantRecord: 10 * time.Minute, wantFile: 6 * time.Hour},
+		{file: "subhourly.nc", record: "auto", fileInterval: "24h", wantRecord: 10 * time.Minute, wantFile: 24 * time.Hour},
+		{file: "monthly.nc", record: "auto", fileInterval: "auto", wantRecord: time.Hour, wantFile: calendarMonth},
+		{file: "monthly.nc", record: "3h", fileInterval: "monthly", wantRecord: 3 * time.Hour, wantFile: calendarMonth},
+		{file: "single.nc", record: "auto", wantErr: true},
+		{file: "single.nc", record: "7h", wantErr: true},
+		{file: "single.nc", record: "-1h", wantErr: true},
+	} {
+		r, f, err := timeIntervals(test.record, test.fileInterval, time.Hour, 24*time.Hour, func() (ncfFile, error) {
+			return openNCF(filepath.Join(dir, test.file))
+		})
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s %q %q: expected an error", test.file, test.record, test.fileInterval)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %q %q: %v", test.file, test.record, test.fileInterval, err)
+			continue
+		}
+		if r != test.wantRecord || f != test.wantFile {
+			t.Errorf("%s %q %q: have %v, %v; want %v, %v", test.file, test.record, test.fileInterval, r, f, test.wantRecord, test.wantFile)
+		}
+	}
+}
+
+func TestDetectIntervalsCF(t *testing.T) {
+	f, err := openNCF("cmd/inmap/testdata/preproc/GEOSFP.20130102.A1.2x25.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, fd, err := detectIntervals(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != time.Hour || fd != 24*time.Hour {
+		t.Errorf("have %v, %v; want 1h, 24h", r, fd)
+	}
+}
+
+func TestFileRecords(t *testing.T) {
+	feb := time.Date(2016, 2, 1, 0, 0, 0, 0, time.UTC)
+	if have, want := fileRecords(feb, time.Hour, calendarMonth), 29*24; have != want {
+		t.Errorf("monthly: have %d, want %d", have, want)
+	}
+	if have, want := fileRecords(feb, 10*time.Minute, 6*time.Hour), 36; have != want {
+		t.Errorf("6h: have %d, want %d", have, want)
+	}
+}
+
+func TestTemplateFile(t *testing.T) {
+	date := time.Date(2016, 2, 1, 6, 30, 0, 0, time.UTC)
+	have := templateFile("wrfout_d01_[DATE]_[HOUR]:[MINUTE]:00", cmaqFormat, date)
+	if want := "wrfout_d01_2016-02-01_06:30:00"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
@@ -0,0 +1,221 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/ctessum/sparse"
+)
+
+// Validate specifies whether each variable read by the preprocessor
+// should be checked for missing or physically implausible values
+// (e.g., negative boundary layer heights, temperatures outside of
+// 150–350 K, or NaNs). If a check fails, preprocessing stops with an error
+// describing the variable, time step, and grid cell where the problem
+// occurred.
+func Validate(validate bool) PreprocessOption {
+	return func(o *preprocessOptions) {
+		o.validate = validate
+	}
+}
+
+// validRange is the range of physically plausible values of a variable.
+type validRange struct {
+	min, max float64
+}
+
+// validRanges are the physically plausible ranges of the variables
+// returned by a Preprocessor, in the units documented by the
+// Preprocessor interface.
+var validRanges = map[string]validRange{
+	"PBLH":            {0, 1.e4},
+	"Height":          {0, 1.e5},
+	"ALT":             {1.e-3, 1.e7}, // Global models extend into the mesosphere.
+	"T":               {150, 350},
+	"P":               {0, 1.2e5},
+	"UStar":           {0, 10},
+	"SeinfeldLandUse": {0, 100},
+	"WeselyLandUse":   {0, 100},
+	"Z0":              {0, 10},
+	"QRain":           {0, 0.1},
+	"QCloud":          {0, 0.1},
+	"CloudFrac":       {0, 1},
+	"SurfaceHeatFlux": {-1000, 2000},
+	"RadiationDown":   {0, 3000},
+	"U":               {-200, 200},
+	"V":               {-200, 200},
+	"W":               {-100, 100},
+	"AVOC":            {0, 1.e6},
+	"BVOC":            {0, 1.e6},
+	"ASOA":            {0, 1.e6},
+	"BSOA":            {0, 1.e6},
+	"NOx":             {0, 1.e6},
+	"PNO":             {0, 1.e6},
+	"SOx":             {0, 1.e6},
+	"PS":              {0, 1.e6},
+	"NH3":             {0, 1.e6},
+	"PNH":             {0, 1.e6},
+	"TotalPM25":       {0, 1.e6},
+	"HO":              {0, 1},
+	"H2O2":            {0, 1},
+	"O3":              {0, 1},
+	"HNO3":            {0, 1},
+	"RH":              {0, 2}, // Supersaturation is possible in clouds.
+}
+
+// validatePreprocessor wraps a Preprocessor so that the values
+// of each variable it returns are checked against validRanges.
+type validatePreprocessor struct {
+	Preprocessor
+}
+
+// validate checks the values returned by f against the valid
+// range of the named variable.
+func validate(name string, f NextData) NextData {
+	r := validRanges[name]
+	var step int
+	return func() (*sparse.DenseArray, error) {
+		data, err := f()
+		if err != nil {
+			return data, err
+		}
+		for i, v := range data.Elements {
+			if math.IsNaN(v) || math.IsInf(v, 0) || v < r.min || v > r.max {
+				return nil, fmt.Errorf("inmap: preprocessor validation: variable %s at time step %d and "+
+					"index %v has value %g, which is outside of the plausible range [%g, %g]",
+					name, step, data.IndexNd(i), v, r.min, r.max)
+			}
+		}
+		step++
+		return data, nil
+	}
+}
+
+// PBLH helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) PBLH() NextData { return validate("PBLH", p.Preprocessor.PBLH()) }
+
+// Height helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) Height() NextData { return validate("Height", p.Preprocessor.Height()) }
+
+// ALT helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) ALT() NextData { return validate("ALT", p.Preprocessor.ALT()) }
+
+// T helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) T() NextData { return validate("T", p.Preprocessor.T()) }
+
+// P helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) P() NextData { return validate("P", p.Preprocessor.P()) }
+
+// UStar helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) UStar() NextData { return validate("UStar", p.Preprocessor.UStar()) }
+
+// SeinfeldLandUse helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) SeinfeldLandUse() NextData {
+	return validate("SeinfeldLandUse", p.Preprocessor.SeinfeldLandUse())
+}
+
+// WeselyLandUse helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) WeselyLandUse() NextData {
+	return validate("WeselyLandUse", p.Preprocessor.WeselyLandUse())
+}
+
+// Z0 helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) Z0() NextData { return validate("Z0", p.Preprocessor.Z0()) }
+
+// QRain helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) QRain() NextData { return validate("QRain", p.Preprocessor.QRain()) }
+
+// QCloud helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) QCloud() NextData { return validate("QCloud", p.Preprocessor.QCloud()) }
+
+// CloudFrac helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) CloudFrac() NextData {
+	return validate("CloudFrac", p.Preprocessor.CloudFrac())
+}
+
+// SurfaceHeatFlux helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) SurfaceHeatFlux() NextData {
+	return validate("SurfaceHeatFlux", p.Preprocessor.SurfaceHeatFlux())
+}
+
+// RadiationDown helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) RadiationDown() NextData {
+	return validate("RadiationDown", p.Preprocessor.RadiationDown())
+}
+
+// U helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) U() NextData { return validate("U", p.Preprocessor.U()) }
+
+// V helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) V() NextData { return validate("V", p.Preprocessor.V()) }
+
+// W helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) W() NextData { return validate("W", p.Preprocessor.W()) }
+
+// AVOC helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) AVOC() NextData { return validate("AVOC", p.Preprocessor.AVOC()) }
+
+// BVOC helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) BVOC() NextData { return validate("BVOC", p.Preprocessor.BVOC()) }
+
+// ASOA helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) ASOA() NextData { return validate("ASOA", p.Preprocessor.ASOA()) }
+
+// BSOA helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) BSOA() NextData { return validate("BSOA", p.Preprocessor.BSOA()) }
+
+// NOx helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) NOx() NextData { return validate("NOx", p.Preprocessor.NOx()) }
+
+// PNO helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) PNO() NextData { return validate("PNO", p.Preprocessor.PNO()) }
+
+// SOx helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) SOx() NextData { return validate("SOx", p.Preprocessor.SOx()) }
+
+// PS helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) PS() NextData { return validate("PS", p.Preprocessor.PS()) }
+
+// NH3 helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) NH3() NextData { return validate("NH3", p.Preprocessor.NH3()) }
+
+// PNH helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) PNH() NextData { return validate("PNH", p.Preprocessor.PNH()) }
+
+// TotalPM25 helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) TotalPM25() NextData {
+	return validate("TotalPM25", p.Preprocessor.TotalPM25())
+}
+
+// HO helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) HO() NextData { return validate("HO", p.Preprocessor.HO()) }
+
+// H2O2 helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) H2O2() NextData { return validate("H2O2", p.Preprocessor.H2O2()) }
+
+// O3 helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) O3() NextData { return validate("O3", p.Preprocessor.O3()) }
+
+// HNO3 helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) HNO3() NextData { return validate("HNO3", p.Preprocessor.HNO3()) }
+
+// RH helps fulfill the Preprocessor interface.
+func (p validatePreprocessor) RH() NextData { return validate("RH", p.Preprocessor.RH()) }
@@ -0,0 +1,75 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"io"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/ctessum/sparse"
+)
+
+func TestValidate(t *testing.T) {
+	next := func(steps ...[]float64) NextData {
+		return func() (*sparse.DenseArray, error) {
+			if len(steps) == 0 {
+				return nil, io.EOF
+			}
+			d := sparse.ZerosDense(1, 1, len(steps[0]))
+			copy(d.Elements, steps[0])
+			steps = steps[1:]
+			return d, nil
+		}
+	}
+	for _, test := range []struct {
+		name, want string
+		steps      [][]float64
+	}{
+		{name: "T", steps: [][]float64{{280, 290}, {300, 310}}},
+		{name: "T", steps: [][]float64{{280, 290}, {300, 400}}, want: "variable T at time step 1 and index [0 0 1] has value 400"},
+		{name: "PBLH", steps: [][]float64{{-1}}, want: "variable PBLH at time step 0 and index [0 0 0] has value -1"},
+		{name: "NOx", steps: [][]float64{{1, math.NaN()}}, want: "value NaN"},
+	} {
+		f := validate(test.name, next(test.steps...))
+		var err error
+		for err == nil {
+			_, err = f()
+		}
+		if test.want == "" {
+			if err != io.EOF {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+		} else if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: have error %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestPreprocessValidate(t *testing.T) {
+	c, err := NewCAMx("cmd/inmap/testdata/preproc/camx.avrg.grd01.[DATE]",
+		"cmd/inmap/testdata/preproc/wrfout_d01_[DATE]_00_00_00", "20050101", "20050103", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Preprocess(c, -2004000, -540000, 12000, 12000, Validate(true)); err != nil {
+		t.Fatal(err)
+	}
+}
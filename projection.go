@@ -0,0 +1,211 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/ctessum/geom/proj"
+)
+
+// secToRad converts arc seconds to radians.
+const secToRad = math.Pi / 180 / 3600
+
+// projectionWKT returns a well-known text (WKT) representation of sr,
+// which can be written to the .prj file of a shapefile. sr can be in
+// any of the Lambert conformal conic, transverse Mercator (including
+// UTM), Mercator, Albers equal area, equidistant conic, and
+// longitude-latitude projections, on any ellipsoid or datum, so that
+// shapefiles can be written for grids that are not in the default
+// Lambert conformal projection.
+func projectionWKT(sr *proj.SR) (string, error) {
+	toMeter := sr.ToMeter
+	if math.IsNaN(toMeter) || toMeter == 0 {
+		toMeter = 1
+	}
+	geogcs := geographicWKT(sr)
+	var projection string
+	type parameter struct {
+		name string
+		val  float64
+	}
+	var params []parameter
+	add := func(name string, v float64) {
+		params = append(params, parameter{name: name, val: v})
+	}
+	addDeg := func(name string, v float64) {
+		add(name, orZero(v)*180/math.Pi)
+	}
+	falseOrigin := func(x0, y0 float64) {
+		add("false_easting", orZero(x0)/toMeter)
+		add("false_northing", orZero(y0)/toMeter)
+	}
+	k0 := sr.K0
+	if math.IsNaN(k0) {
+		k0 = 1
+	}
+
+	switch strings.ToLower(sr.Name) {
+	case "longlat", "identity":
+		return geogcs, nil
+	case "lcc", "lambert_conformal_conic", "lambert_conformal_conic_2sp",
+		"lambert tangential conformal conic projection":
+		projection = "Lambert_Conformal_Conic_2SP"
+		lat2 := sr.Lat2
+		if math.IsNaN(lat2) {
+			lat2 = sr.Lat1
+		}
+		addDeg("standard_parallel_1", sr.Lat1)
+		addDeg("standard_parallel_2", lat2)
+		addDeg("latitude_of_origin", sr.Lat0)
+		addDeg("central_meridian", sr.Long0)
+		falseOrigin(sr.X0, sr.Y0)
+	case "tmerc", "transverse_mercator", "transverse mercator":
+		projection = "Transverse_Mercator"
+		addDeg("latitude_of_origin", sr.Lat0)
+		addDeg("central_meridian", sr.Long0)
+		add("scale_factor", k0)
+		falseOrigin(sr.X0, sr.Y0)
+	case "utm", "universal transverse mercator system":
+		if math.IsNaN(sr.Zone) {
+			return "", fmt.Errorf("inmap: UTM projection does not specify a zone")
+		}
+		projection = "Transverse_Mercator"
+		y0 := 0.
+		if sr.UTMSouth {
+			y0 = 10000000
+		}
+		addDeg("latitude_of_origin", 0)
+		addDeg("central_meridian", (6*math.Abs(sr.Zone)-183)*math.Pi/180)
+		add("scale_factor", 0.9996)
+		falseOrigin(500000, y0)
+	case "merc", "mercator":
+		projection = "Mercator"
+		if !math.IsNaN(sr.LatTS) {
+			// WKT has no latitude of true scale, so it is converted to
+			// the equivalent scale factor.
+			k0 = math.Cos(sr.LatTS)
+			if sr.Es != 0 {
+				k0 /= math.Sqrt(1 - sr.Es*math.Sin(sr.LatTS)*math.Sin(sr.LatTS))
+			}
+		}
+		addDeg("central_meridian", sr.Long0)
+		add("scale_factor", k0)
+		falseOrigin(sr.X0, sr.Y0)
+	case "aea", "albers", "albers_conic_equal_area":
+		projection = "Albers_Conic_Equal_Area"
+		addDeg("standard_parallel_1", sr.Lat1)
+		addDeg("standard_parallel_2", sr.Lat2)
+		addDeg("latitude_of_origin", sr.Lat0)
+		addDeg("central_meridian", sr.Long0)
+		falseOrigin(sr.X0, sr.Y0)
+	case "eqdc", "equidistant_conic":
+		projection = "Equidistant_Conic"
+		lat2 := sr.Lat2
+		if math.IsNaN(lat2) {
+			lat2 = sr.Lat1
+		}
+		addDeg("standard_parallel_1", sr.Lat1)
+		addDeg("standard_parallel_2", lat2)
+		addDeg("latitude_of_origin", sr.Lat0)
+		addDeg("central_meridian", sr.Long0)
+		falseOrigin(sr.X0, sr.Y0)
+	default:
+		return "", fmt.Errorf("inmap: writing projection information: unsupported projection %s", sr.Name)
+	}
+
+	unit := "Meter"
+	if toMeter != 1 {
+		unit = "unknown"
+	}
+	s := fmt.Sprintf("PROJCS[\"%s\",%s,PROJECTION[\"%s\"]", projection, geogcs, projection)
+	for _, p := range params {
+		s += fmt.Sprintf(",PARAMETER[\"%s\",%.15g]", p.name, p.val)
+	}
+	s += fmt.Sprintf(",UNIT[\"%s\",%.15g]]", unit, toMeter)
+	return s, nil
+}
+
+// geographicWKT returns the WKT GEOGCS section for the ellipsoid and
+// datum of sr.
+func geographicWKT(sr *proj.SR) string {
+	datumCode := sr.DatumCode
+	if datumCode == "" {
+		if len(sr.DatumParams) > 0 {
+			datumCode = "unknown"
+		} else {
+			// "none" is the only way to specify a grid without a datum
+			// in WKT, which prevents datum shifts during reprojection,
+			// as with a Proj4 definition without a datum.
+			datumCode = "none"
+		}
+	}
+	datum, gcs := "D_"+datumCode, "GCS_"+datumCode
+	if strings.ToLower(datumCode) == "wgs84" {
+		datum, gcs = "D_WGS_1984", "GCS_WGS_1984"
+	}
+	ellps := sr.Ellps
+	if ellps == "" {
+		ellps = "Unknown"
+	}
+	// An inverse flattening of zero signifies a sphere.
+	var rf float64
+	if sr.A != sr.B {
+		rf = sr.A / (sr.A - sr.B)
+	}
+	var towgs84 string
+	if p := datumParams(sr.DatumParams); len(p) > 0 {
+		v := make([]string, len(p))
+		for i, pp := range p {
+			v[i] = fmt.Sprintf("%.15g", pp)
+		}
+		towgs84 = fmt.Sprintf(",TOWGS84[%s]", strings.Join(v, ","))
+	}
+	return fmt.Sprintf("GEOGCS[\"%s\",DATUM[\"%s\",SPHEROID[\"%s\",%.15g,%.15g]%s],"+
+		"PRIMEM[\"Greenwich\",0],UNIT[\"Degree\",0.017453292519943295]]",
+		gcs, datum, ellps, sr.A, rf, towgs84)
+}
+
+// datumParams returns the datum transformation parameters in p in the
+// units of a Proj4 or WKT definition. When a spatial reference is parsed,
+// the rotations of 7-parameter transformations are converted to radians
+// and the scale (in parts per million) is converted to a multiplier, so
+// the conversions are reversed here.
+func datumParams(p []float64) []float64 {
+	if len(p) < 7 || (p[3] == 0 && p[4] == 0 && p[5] == 0 && p[6] == 0) {
+		return p
+	}
+	o := make([]float64, len(p))
+	copy(o, p)
+	for i := 3; i < 6; i++ {
+		o[i] /= secToRad
+	}
+	o[6] = (o[6] - 1) * 1.e6
+	return o
+}
+
+// orZero returns v, or zero if v is not a number.
+func orZero(v float64) float64 {
+	if math.IsNaN(v) {
+		return 0
+	}
+	return v
+}
@@ -0,0 +1,163 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"os"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/ctessum/geom/proj"
+)
+
+func TestProjectionWKT(t *testing.T) {
+	lonLat, err := proj.Parse("+proj=longlat +datum=WGS84")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name, proj4 string
+		points      []geom.Point // longitude, latitude
+	}{
+		{
+			name:   "lcc",
+			proj4:  "+proj=lcc +lat_1=33.000000 +lat_2=45.000000 +lat_0=40.000000 +lon_0=-97.000000 +x_0=0 +y_0=0 +a=6370997.000000 +b=6370997.000000 +to_meter=1",
+			points: []geom.Point{{X: -97, Y: 40}, {X: -120, Y: 35}, {X: -75, Y: 45}},
+		},
+		{
+			name:   "bng",
+			proj4:  "+proj=tmerc +lat_0=49 +lon_0=-2 +k=0.9996012717 +x_0=400000 +y_0=-100000 +ellps=airy +towgs84=446.448,-125.157,542.06,0.15,0.247,0.842,-20.489 +units=m +no_defs",
+			points: []geom.Point{{X: -2, Y: 49}, {X: -0.1, Y: 51.5}, {X: -4.3, Y: 55.9}},
+		},
+		{
+			name:   "utm south",
+			proj4:  "+proj=utm +zone=56 +south +ellps=WGS84 +datum=WGS84 +units=m +no_defs",
+			points: []geom.Point{{X: 151.2, Y: -33.9}, {X: 153, Y: -27.5}},
+		},
+		{
+			name:   "merc",
+			proj4:  "+proj=merc +lon_0=100 +lat_ts=10 +x_0=0 +y_0=0 +ellps=WGS84 +datum=WGS84 +units=m +no_defs",
+			points: []geom.Point{{X: 100, Y: 0}, {X: 105, Y: 20}},
+		},
+		{
+			name:   "aea",
+			proj4:  "+proj=aea +lat_1=29.5 +lat_2=45.5 +lat_0=23 +lon_0=-96 +x_0=0 +y_0=0 +ellps=GRS80 +towgs84=0,0,0,0,0,0,0 +units=m +no_defs",
+			points: []geom.Point{{X: -96, Y: 23}, {X: -110, Y: 40}},
+		},
+		{
+			name:   "km",
+			proj4:  "+proj=lcc +lat_1=33 +lat_2=45 +lat_0=40 +lon_0=-97 +x_0=1000 +y_0=2000 +a=6370997 +b=6370997 +to_meter=1000",
+			points: []geom.Point{{X: -97, Y: 40}, {X: -120, Y: 35}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			want, err := proj.Parse(test.proj4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wkt, err := projectionWKT(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			have, err := proj.Parse(wkt)
+			if err != nil {
+				t.Fatalf("%v: %s", err, wkt)
+			}
+			wantTrans, err := lonLat.NewTransform(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			haveTrans, err := lonLat.NewTransform(have)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range test.points {
+				w, err := p.Transform(wantTrans)
+				if err != nil {
+					t.Fatal(err)
+				}
+				h, err := p.Transform(haveTrans)
+				if err != nil {
+					t.Fatal(err)
+				}
+				wp, hp := w.(geom.Point), h.(geom.Point)
+				if d := math.Hypot(wp.X-hp.X, wp.Y-hp.Y); d > 1.e-3 {
+					t.Errorf("%v: have %v, want %v (%s)", p, hp, wp, wkt)
+				}
+			}
+		})
+	}
+}
+
+func TestProjectionWKT_unsupported(t *testing.T) {
+	sr, err := proj.Parse("+proj=krovak +lat_0=49.5 +lon_0=24.83333333333333 +alpha=30.28813972222222 +k=0.9999 +x_0=0 +y_0=0 +ellps=bessel +units=m +no_defs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := projectionWKT(sr); err == nil {
+		t.Error("should return an error for an unsupported projection")
+	}
+}
+
+func TestWriteShapefile_projection(t *testing.T) {
+	const fileName = "testProjection.shp"
+	sr, err := proj.Parse("+proj=utm +zone=30 +ellps=WGS84 +datum=WGS84 +units=m +no_defs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells := []*Cell{{Polygonal: &geom.Bounds{
+		Min: geom.Point{X: 500000, Y: 5700000},
+		Max: geom.Point{X: 501000, Y: 5701000},
+	}}}
+	if err := writeShapefile(fileName, sr, cells, map[string][]float64{"A": {1}}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, ext := range []string{".dbf", ".prj", ".shp", ".shx"} {
+			os.Remove("testProjection" + ext)
+		}
+	}()
+	dec, err := shp.NewDecoder(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	decSR, err := dec.SR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lonLat, err := proj.Parse("+proj=longlat +datum=WGS84")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trans, err := decSR.NewTransform(lonLat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := geom.Point{X: 500000, Y: 5700000}.Transform(trans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Zone 30 has a central meridian of 3°W.
+	if pp := p.(geom.Point); math.Abs(pp.X+3) > 1.e-8 || math.Abs(pp.Y-51.45) > 0.01 {
+		t.Errorf("point should be at (-3, 51.45) but is at %v", pp)
+	}
+}
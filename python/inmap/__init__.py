@@ -0,0 +1,139 @@
+# Copyright © 2026 the InMAP authors.
+# This file is part of InMAP.
+#
+# InMAP is free software: you can redistribute it and/or modify
+# it under the terms of the GNU General Public License as published by
+# the Free Software Foundation, either version 3 of the License, or
+# (at your option) any later version.
+#
+# InMAP is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU General Public License for more details.
+#
+# You should have received a copy of the GNU General Public License
+# along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+
+"""Python bindings for the InMAP air quality model.
+
+The bindings use the InMAP C shared library, which can be built using:
+
+    go build -buildmode=c-shared -o libinmap.so ./cmd/libinmap
+
+The library is loaded from the path in the INMAP_LIBRARY environment
+variable, or else from the directory of this package or the system
+library path.
+"""
+
+import ctypes
+import ctypes.util
+import json
+import os
+
+__all__ = ["run", "SR", "InMAPError"]
+
+
+class InMAPError(Exception):
+    """An error returned by the InMAP library."""
+
+
+def _load():
+    path = os.environ.get("INMAP_LIBRARY")
+    if not path:
+        local = os.path.join(os.path.dirname(__file__), "libinmap.so")
+        path = local if os.path.exists(local) else ctypes.util.find_library("inmap")
+    if not path:
+        raise OSError("the InMAP library could not be found; set INMAP_LIBRARY")
+    lib = ctypes.CDLL(path)
+
+    err = ctypes.c_void_p  # Returned strings must be freed by the library.
+    h = ctypes.c_int64
+    dp = ctypes.POINTER(ctypes.c_double)
+    sigs = {
+        "inmap_free": (None, [ctypes.c_void_p]),
+        "inmap_run": (err, [ctypes.c_char_p]),
+        "inmap_sr_open": (err, [ctypes.c_char_p, ctypes.POINTER(h)]),
+        "inmap_sr_close": (err, [h]),
+        "inmap_sr_ncells": (err, [h, ctypes.POINTER(ctypes.c_int)]),
+        "inmap_sr_source": (err, [h, ctypes.c_char_p, ctypes.c_int, ctypes.c_int, dp, ctypes.c_int]),
+        "inmap_sr_concentrations": (err, [h, ctypes.c_char_p, ctypes.c_char_p, dp, ctypes.c_int]),
+    }
+    for name, (restype, argtypes) in sigs.items():
+        f = getattr(lib, name)
+        f.restype = restype
+        f.argtypes = argtypes
+    return lib
+
+
+_lib = None
+
+
+def _call(name, *args):
+    """Call the library function name and raise an error if it fails."""
+    global _lib
+    if _lib is None:
+        _lib = _load()
+    msg = getattr(_lib, name)(*args)
+    if msg:
+        try:
+            raise InMAPError(ctypes.string_at(msg).decode("utf-8"))
+        finally:
+            _lib.inmap_free(msg)
+
+
+def run(*args):
+    """Run the InMAP command-line interface with the given arguments,
+    e.g., run("run", "steady", "--config=config.toml")."""
+    _call("inmap_run", json.dumps(list(args)).encode("utf-8"))
+
+
+class SR(object):
+    """A source-receptor (SR) matrix.
+
+    path can be a local NetCDF file or Zarr store, or a URL to one.
+    SR objects can be used as context managers so that they are closed
+    after use. Results are lists with one value per grid cell, which can
+    be converted to NumPy arrays using numpy.asarray.
+    """
+
+    def __init__(self, path):
+        self._handle = ctypes.c_int64()
+        _call("inmap_sr_open", path.encode("utf-8"), ctypes.byref(self._handle))
+        n = ctypes.c_int()
+        _call("inmap_sr_ncells", self._handle, ctypes.byref(n))
+        self.ncells = n.value
+
+    def close(self):
+        """Close the SR matrix."""
+        if self._handle is not None:
+            _call("inmap_sr_close", self._handle)
+            self._handle = None
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *exc):
+        self.close()
+
+    def source(self, pol, layer, index):
+        """Return the change in concentration of pollutant pol
+        [μg/m³ per μg/s] in each grid cell caused by emissions in the grid
+        cell with the given layer and index. pol is one of "pNH4", "pNO3",
+        "pSO4", "SOA", or "PrimaryPM25"."""
+        out = (ctypes.c_double * self.ncells)()
+        _call("inmap_sr_source", self._handle, pol.encode("utf-8"),
+              layer, index, out, self.ncells)
+        return list(out)
+
+    def concentrations(self, emis, pol="TotalPM25"):
+        """Return the change in the concentration of pollutant pol [μg/m³]
+        in each grid cell caused by the emissions in emis, which is a list
+        of dicts with the keys X and Y (the location in the spatial reference
+        of the SR matrix), VOC, NOx, NH3, SOx, PM25 (emissions in μg/s),
+        and optionally Height, Diam, Temp, and Velocity. pol is "TotalPM25"
+        or one of the pollutants accepted by source."""
+        out = (ctypes.c_double * self.ncells)()
+        _call("inmap_sr_concentrations", self._handle,
+              json.dumps(list(emis)).encode("utf-8"), pol.encode("utf-8"),
+              out, self.ncells)
+        return list(out)
@@ -0,0 +1,270 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/index/rtree"
+	"github.com/ctessum/geom/proj"
+)
+
+// rasterPolygon is a polygon that raster values are averaged within.
+type rasterPolygon struct {
+	geom.Polygonal
+	i int
+}
+
+// RegridRaster reads the variable varName from fileName, which is a
+// NetCDF file (or any of the other formats supported by the preprocessor)
+// containing a raster on a regular longitude-latitude grid, such as the
+// satellite-derived PM2.5 concentrations of van Donkelaar et al., and
+// returns the average of the raster values within each of the given
+// polygons, which are in spatial reference sr.
+//
+// The raster must have one-dimensional "lat" and "lon" (or "latitude"
+// and "longitude") coordinate variables, which give the centers of the
+// raster cells, and varName must have the dimensions (lat, lon) or
+// (lon, lat), optionally preceded by dimensions of length one. Values that
+// are NaN or equal to the _FillValue or missing_value attributes of varName
+// are ignored. The average within each polygon is calculated from the
+// raster cells whose centers are within the polygon, weighted by the
+// cosine of the latitude to account for the smaller area of raster cells
+// near the poles. For polygons that are smaller than the raster cells and
+// do not contain any cell centers, the value of the raster cell that
+// contains the center of the polygon is used. The result is NaN for
+// polygons that are outside of the raster or that only contain
+// missing values.
+func RegridRaster(fileName, varName string, polygons []geom.Polygonal, sr *proj.SR) ([]float64, error) {
+	f, err := openNCF(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: opening raster file: %v", err)
+	}
+	defer f.Close()
+
+	coord := func(names ...string) (string, []float64, error) {
+		for _, n := range names {
+			if f.Lengths(n) == nil {
+				continue
+			}
+			vals, err := f.Read(n, nil, nil)
+			if err != nil {
+				return "", nil, fmt.Errorf("inmap: reading raster coordinate %s: %v", n, err)
+			}
+			c, err := ncfFloats(vals)
+			if err != nil {
+				return "", nil, fmt.Errorf("inmap: reading raster coordinate %s: %v", n, err)
+			}
+			return n, c, nil
+		}
+		return "", nil, fmt.Errorf("inmap: raster file %s does not have a %s coordinate variable", fileName, names[0])
+	}
+	latName, lats, err := coord("lat", "latitude")
+	if err != nil {
+		return nil, err
+	}
+	lonName, lons, err := coord("lon", "longitude")
+	if err != nil {
+		return nil, err
+	}
+	if len(lats) < 2 || len(lons) < 2 {
+		return nil, fmt.Errorf("inmap: raster file %s must have at least two rows and columns", fileName)
+	}
+
+	lengths := f.Lengths(varName)
+	dims := f.Dimensions(varName)
+	if lengths == nil {
+		return nil, fmt.Errorf("inmap: raster file %s does not have variable %s", fileName, varName)
+	}
+	latDim, lonDim := -1, -1
+	for i, d := range dims {
+		switch {
+		case d == latName:
+			latDim = i
+		case d == lonName:
+			lonDim = i
+		case lengths[i] != 1:
+			return nil, fmt.Errorf("inmap: raster variable %s has unsupported dimension %s", varName, d)
+		}
+	}
+	if latDim < 0 || lonDim < 0 {
+		return nil, fmt.Errorf("inmap: raster variable %s must have latitude and longitude dimensions, but it has %v", varName, dims)
+	}
+
+	lonLat, err := proj.Parse("+proj=longlat")
+	if err != nil {
+		return nil, err
+	}
+	toLonLat, err := sr.NewTransform(lonLat)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: regridding raster: %v", err)
+	}
+	fromLonLat, err := lonLat.NewTransform(sr)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: regridding raster: %v", err)
+	}
+
+	// Find the part of the raster that covers the polygons.
+	index := rtree.NewTree(25, 50)
+	bounds := geom.NewBounds()
+	centers := make([]geom.Point, len(polygons))
+	for i, p := range polygons {
+		index.Insert(&rasterPolygon{Polygonal: p, i: i})
+		g, err := p.Bounds().Transform(toLonLat)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: regridding raster: %v", err)
+		}
+		bounds.Extend(g.Bounds())
+		c, err := p.Centroid().Transform(toLonLat)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: regridding raster: %v", err)
+		}
+		centers[i] = c.(geom.Point)
+	}
+	// Only the outer dimension is subset so that the data to be read
+	// is contiguous.
+	latRange := coordRange(lats, bounds.Min.Y, bounds.Max.Y)
+	lonRange := coordRange(lons, bounds.Min.X, bounds.Max.X)
+	if latDim < lonDim && latRange[1] > latRange[0] {
+		lonRange = [2]int{0, len(lons)}
+	} else if lonDim < latDim && lonRange[1] > lonRange[0] {
+		latRange = [2]int{0, len(lats)}
+	}
+
+	sums := make([]float64, len(polygons))
+	weights := make([]float64, len(polygons))
+	var vals []float64
+	if latRange[1] > latRange[0] && lonRange[1] > lonRange[0] {
+		start, end := make([]int, len(dims)), make([]int, len(dims))
+		for i := range dims {
+			end[i] = 1
+		}
+		start[latDim], end[latDim] = latRange[0], latRange[1]
+		start[lonDim], end[lonDim] = lonRange[0], lonRange[1]
+		v, err := f.Read(varName, start, end)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: reading raster variable %s: %v", varName, err)
+		}
+		if vals, err = ncfFloats(v); err != nil {
+			return nil, fmt.Errorf("inmap: reading raster variable %s: %v", varName, err)
+		}
+		missing := make(map[float64]bool)
+		for _, a := range []string{"_FillValue", "missing_value"} {
+			if av, err := ncfFloats(f.Attribute(varName, a)); err == nil {
+				for _, m := range av {
+					missing[m] = true
+				}
+			}
+		}
+		nLat, nLon := latRange[1]-latRange[0], lonRange[1]-lonRange[0]
+		for i, v := range vals {
+			if math.IsNaN(v) || missing[v] {
+				vals[i] = math.NaN()
+				continue
+			}
+			var iLat, iLon int
+			if latDim < lonDim {
+				iLat, iLon = i/nLon, i%nLon
+			} else {
+				iLon, iLat = i/nLat, i%nLat
+			}
+			lat, lon := lats[latRange[0]+iLat], lons[lonRange[0]+iLon]
+			g, err := geom.Point{X: lon, Y: lat}.Transform(fromLonLat)
+			if err != nil {
+				return nil, fmt.Errorf("inmap: regridding raster: %v", err)
+			}
+			p := g.(geom.Point)
+			w := math.Cos(lat * math.Pi / 180)
+			for _, pI := range index.SearchIntersect(p.Bounds()) {
+				rp := pI.(*rasterPolygon)
+				if p.Within(rp.Polygonal) != geom.Outside {
+					sums[rp.i] += v * w
+					weights[rp.i] += w
+				}
+			}
+		}
+	}
+
+	out := make([]float64, len(polygons))
+	for i := range polygons {
+		if weights[i] > 0 {
+			out[i] = sums[i] / weights[i]
+			continue
+		}
+		// Use the raster cell that contains the center of the polygon.
+		out[i] = math.NaN()
+		iLat, okLat := nearestCoord(lats, centers[i].Y)
+		iLon, okLon := nearestCoord(lons, centers[i].X)
+		if !okLat || !okLon || iLat < latRange[0] || iLat >= latRange[1] ||
+			iLon < lonRange[0] || iLon >= lonRange[1] {
+			continue
+		}
+		iLat -= latRange[0]
+		iLon -= lonRange[0]
+		if latDim < lonDim {
+			out[i] = vals[iLat*(lonRange[1]-lonRange[0])+iLon]
+		} else {
+			out[i] = vals[iLon*(latRange[1]-latRange[0])+iLat]
+		}
+	}
+	return out, nil
+}
+
+// coordRange returns the range of indices [start, end) of the coordinates
+// c, which are regularly spaced in ascending or descending order, of the
+// cells that overlap the interval between min and max.
+func coordRange(c []float64, min, max float64) [2]int {
+	half := math.Abs(c[1]-c[0]) / 2
+	start, end := len(c), 0
+	for i, v := range c {
+		if v+half >= min && v-half <= max {
+			if i < start {
+				start = i
+			}
+			if i+1 > end {
+				end = i + 1
+			}
+		}
+	}
+	if start > end {
+		return [2]int{0, 0}
+	}
+	return [2]int{start, end}
+}
+
+// nearestCoord returns the index of the cell among coordinates c, which
+// are regularly spaced in ascending or descending order, that contains v,
+// and whether v is within the cells.
+func nearestCoord(c []float64, v float64) (int, bool) {
+	half := math.Abs(c[1]-c[0]) / 2
+	ascending := c[1] > c[0]
+	i := sort.Search(len(c), func(i int) bool {
+		if ascending {
+			return c[i]+half >= v
+		}
+		return c[i]-half <= v
+	})
+	if i == len(c) || math.Abs(c[i]-v) > half {
+		return 0, false
+	}
+	return i, true
+}
@@ -0,0 +1,164 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ctessum/cdf"
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+)
+
+// writeTestRaster writes a 4×4 raster with cell centers at longitudes
+// -1.5 to 1.5 and latitudes 0.5 to 3.5, where the value in each cell is
+// 10×(latitude index) + (longitude index), except that the first cell is
+// missing. Variable "pm" has dimensions (lat, lon) and variable "pmT" has
+// dimensions (time, lon, lat).
+func writeTestRaster(fileName string) error {
+	lats := []float64{0.5, 1.5, 2.5, 3.5}
+	lons := []float64{-1.5, -0.5, 0.5, 1.5}
+	h := cdf.NewHeader([]string{"time", "lat", "lon"}, []int{1, len(lats), len(lons)})
+	h.AddVariable("lat", []string{"lat"}, []float64{0})
+	h.AddVariable("lon", []string{"lon"}, []float64{0})
+	h.AddVariable("pm", []string{"lat", "lon"}, []float32{0})
+	h.AddAttribute("pm", "_FillValue", []float32{-999})
+	h.AddVariable("pmT", []string{"time", "lon", "lat"}, []float32{0})
+	h.AddAttribute("pmT", "_FillValue", []float32{-999})
+	h.Define()
+	w, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	f, err := cdf.Create(w, h)
+	if err != nil {
+		return err
+	}
+	pm := make([]float32, len(lats)*len(lons))
+	pmT := make([]float32, len(lats)*len(lons))
+	for i := range lats {
+		for j := range lons {
+			v := float32(10*i + j)
+			if i == 0 && j == 0 {
+				v = -999
+			}
+			pm[i*len(lons)+j] = v
+			pmT[j*len(lats)+i] = v
+		}
+	}
+	for _, d := range []struct {
+		v          string
+		begin, end []int
+		data       interface{}
+	}{
+		{"lat", []int{0}, []int{len(lats)}, lats},
+		{"lon", []int{0}, []int{len(lons)}, lons},
+		{"pm", []int{0, 0}, []int{len(lats), len(lons)}, pm},
+		{"pmT", []int{0, 0, 0}, []int{1, len(lons), len(lats)}, pmT},
+	} {
+		if _, err := f.Writer(d.v, d.begin, d.end).Write(d.data); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+func TestRegridRaster(t *testing.T) {
+	dir, err := os.MkdirTemp("", "raster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "raster.nc")
+	if err := writeTestRaster(fileName); err != nil {
+		t.Fatal(err)
+	}
+	sr, err := proj.Parse("+proj=longlat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	box := func(xmin, ymin, xmax, ymax float64) geom.Polygonal {
+		return geom.Polygon{{{X: xmin, Y: ymin}, {X: xmax, Y: ymin}, {X: xmax, Y: ymax}, {X: xmin, Y: ymax}}}
+	}
+	polygons := []geom.Polygonal{
+		box(-2, 0, 0, 2),         // Four cell centers, one of which is missing.
+		box(0.9, 2.4, 1.1, 2.6),  // Smaller than a raster cell.
+		box(10, 10, 11, 11),      // Outside of the raster.
+		box(-2, 0, -1, 1),        // Only contains the missing cell.
+		box(-0.3, 3, 0.1, 4.1),   // Spans two cells but contains no centers.
+		box(-1, 2.9, 1.9, 3.9),   // Three cell centers.
+		box(-2.1, -0.1, 2, 4.05), // The whole raster.
+	}
+	w0, w1 := math.Cos(0.5*math.Pi/180), math.Cos(1.5*math.Pi/180)
+	w3 := math.Cos(3.5 * math.Pi / 180)
+	var all, allW float64
+	for i, lat := range []float64{0.5, 1.5, 2.5, 3.5} {
+		for j := 0; j < 4; j++ {
+			if i == 0 && j == 0 {
+				continue
+			}
+			w := math.Cos(lat * math.Pi / 180)
+			all += float64(10*i+j) * w
+			allW += w
+		}
+	}
+	want := []float64{
+		(1*w0 + (10+11)*w1) / (w0 + 2*w1),
+		22,
+		math.NaN(),
+		math.NaN(),
+		31, // The cell that contains the center of the polygon.
+		(31*w3 + 32*w3 + 33*w3) / (3 * w3),
+		all / allW,
+	}
+	for _, v := range []string{"pm", "pmT"} {
+		t.Run(v, func(t *testing.T) {
+			have, err := RegridRaster(fileName, v, polygons, sr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(have) != len(want) {
+				t.Fatalf("length: have %d, want %d", len(have), len(want))
+			}
+			for i := range want {
+				if math.IsNaN(want[i]) != math.IsNaN(have[i]) || (!math.IsNaN(want[i]) && math.Abs(have[i]-want[i]) > 1e-10) {
+					t.Errorf("polygon %d: have %g, want %g", i, have[i], want[i])
+				}
+			}
+		})
+	}
+
+	// Only part of the raster is needed for these polygons.
+	for _, v := range []string{"pm", "pmT"} {
+		have, err := RegridRaster(fileName, v, []geom.Polygonal{polygons[1], polygons[4]}, sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have[0] != want[1] || have[1] != want[4] {
+			t.Errorf("%s subset: have %v, want [%g %g]", v, have, want[1], want[4])
+		}
+	}
+
+	if _, err := RegridRaster(fileName, "xxx", polygons, sr); err == nil {
+		t.Error("missing variable should cause an error")
+	}
+}
@@ -0,0 +1,330 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/geojson"
+	"github.com/ctessum/geom/proj"
+)
+
+// Receptor is a location, such as an air quality monitor, school, or
+// hospital, where model results are requested.
+type Receptor struct {
+	// Name identifies the receptor.
+	Name string
+
+	// Point is the location of the receptor in the spatial reference
+	// of the model grid.
+	geom.Point
+}
+
+// ReadReceptors reads receptor locations from fileName and converts
+// them to gridSR, the spatial reference of the model grid. If fileName
+// has the extension ".geojson" or ".json", it should contain a GeoJSON
+// FeatureCollection of Point features with coordinates in
+// longitude-latitude, and the receptor names are taken from the "name"
+// property of the features. Otherwise, fileName should be a CSV file with
+// a header row and either "lon" and "lat" (or "longitude" and "latitude")
+// columns with longitude-latitude coordinates or "x" and "y" columns with
+// coordinates in gridSR. An optional "name" (or "id") column holds the
+// receptor names. Receptors without names are named after their
+// position in the file, starting at 1.
+func ReadReceptors(fileName string, gridSR *proj.SR) ([]Receptor, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: opening receptor file: %v", err)
+	}
+	defer f.Close()
+
+	var receptors []Receptor
+	var lonLat []bool
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".geojson", ".json":
+		receptors, err = readReceptorsGeoJSON(f)
+		lonLat = make([]bool, len(receptors))
+		for i := range lonLat {
+			lonLat[i] = true
+		}
+	default:
+		receptors, lonLat, err = readReceptorsCSV(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("inmap: reading receptor file %s: %v", fileName, err)
+	}
+
+	var t proj.Transformer
+	for i, r := range receptors {
+		if r.Name == "" {
+			receptors[i].Name = strconv.Itoa(i + 1)
+		}
+		if !lonLat[i] {
+			continue
+		}
+		if t == nil {
+			lonLatSR, err := proj.Parse("+proj=longlat")
+			if err != nil {
+				return nil, err
+			}
+			if t, err = lonLatSR.NewTransform(gridSR); err != nil {
+				return nil, fmt.Errorf("inmap: reading receptor file: %v", err)
+			}
+		}
+		x, y, err := t(r.X, r.Y)
+		if err != nil {
+			return nil, fmt.Errorf("inmap: reading receptor file: %v", err)
+		}
+		receptors[i].Point = geom.Point{X: x, Y: y}
+	}
+	return receptors, nil
+}
+
+// readReceptorsGeoJSON reads receptors from a GeoJSON FeatureCollection.
+func readReceptorsGeoJSON(r io.Reader) ([]Receptor, error) {
+	var fc struct {
+		Features []struct {
+			Geometry   geojson.Geometry       `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.NewDecoder(r).Decode(&fc); err != nil {
+		return nil, err
+	}
+	receptors := make([]Receptor, len(fc.Features))
+	for i, f := range fc.Features {
+		g, err := geojson.FromGeoJSON(&f.Geometry)
+		if err != nil {
+			return nil, fmt.Errorf("feature %d: %v", i+1, err)
+		}
+		p, ok := g.(geom.Point)
+		if !ok {
+			return nil, fmt.Errorf("feature %d: geometry type is %s but should be Point", i+1, f.Geometry.Type)
+		}
+		receptors[i].Point = p
+		if name, ok := f.Properties["name"]; ok {
+			receptors[i].Name = fmt.Sprint(name)
+		}
+	}
+	return receptors, nil
+}
+
+// readReceptorsCSV reads receptors from a CSV file and returns them
+// along with whether the coordinates of each receptor are in
+// longitude-latitude.
+func readReceptorsCSV(r io.Reader) ([]Receptor, []bool, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+	cols := make(map[string]int)
+	for i, h := range header {
+		cols[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	find := func(names ...string) int {
+		for _, n := range names {
+			if i, ok := cols[n]; ok {
+				return i
+			}
+		}
+		return -1
+	}
+	nameCol := find("name", "id")
+	xCol, yCol := find("lon", "longitude"), find("lat", "latitude")
+	lonLat := xCol >= 0 && yCol >= 0
+	if !lonLat {
+		xCol, yCol = find("x"), find("y")
+	}
+	if xCol < 0 || yCol < 0 {
+		return nil, nil, fmt.Errorf("the header must contain 'lon' and 'lat' or 'x' and 'y' columns")
+	}
+
+	var receptors []Receptor
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		var p Receptor
+		if p.X, err = strconv.ParseFloat(strings.TrimSpace(rec[xCol]), 64); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if p.Y, err = strconv.ParseFloat(strings.TrimSpace(rec[yCol]), 64); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if nameCol >= 0 {
+			p.Name = rec[nameCol]
+		}
+		receptors = append(receptors, p)
+	}
+	isLonLat := make([]bool, len(receptors))
+	for i := range isLonLat {
+		isLonLat[i] = lonLat
+	}
+	return receptors, isLonLat, nil
+}
+
+// ReceptorResults returns the values of the output variables of o at
+// each of the given receptors, in the form of map[variable][receptor]value.
+// The values are interpolated from the ground-level grid cells using
+// inverse-distance-squared weighting of the values in the cell that
+// contains the receptor and its horizontal neighbors, so that the value
+// at the center of a cell equals the value in that cell. The value is
+// NaN for receptors that are outside of the model domain.
+func (d *InMAP) ReceptorResults(o *Outputter, receptors []Receptor) (map[string][]float64, error) {
+	ground := *o
+	ground.allLayers = false
+	results, err := d.Results(&ground)
+	if err != nil {
+		return nil, err
+	}
+	// rows holds the index of each ground-level cell in the results.
+	rows := make(map[*Cell]int)
+	for i, c := range d.cells.array() {
+		if c.Layer == 0 {
+			rows[c] = i
+		}
+	}
+
+	output := make(map[string][]float64, len(results))
+	for v := range results {
+		output[v] = make([]float64, len(receptors))
+	}
+	for i, r := range receptors {
+		cell := d.cellAt(r.Point, rows)
+		if cell == nil {
+			for v := range output {
+				output[v][i] = math.NaN()
+			}
+			continue
+		}
+		cells := []*Cell{cell}
+		for _, neighbors := range []*cellList{&cell.west, &cell.east, &cell.south, &cell.north} {
+			for _, n := range *neighbors {
+				if _, ok := rows[n.Cell]; ok {
+					cells = append(cells, n.Cell)
+				}
+			}
+		}
+		weights := make([]float64, len(cells))
+		var sum float64
+		for j, c := range cells {
+			center := c.Polygonal.Centroid()
+			d2 := (center.X-r.X)*(center.X-r.X) + (center.Y-r.Y)*(center.Y-r.Y)
+			if d2 == 0 {
+				weights = make([]float64, len(cells))
+				weights[j], sum = 1, 1
+				break
+			}
+			weights[j] = 1 / d2
+			sum += weights[j]
+		}
+		for v, vals := range results {
+			var val float64
+			for j, c := range cells {
+				val += vals[rows[c]] * weights[j] / sum
+			}
+			output[v][i] = val
+		}
+	}
+	return output, nil
+}
+
+// cellAt returns the cell in rows that contains p, or nil if there is
+// no such cell.
+func (d *InMAP) cellAt(p geom.Point, rows map[*Cell]int) *Cell {
+	for _, cI := range d.index.SearchIntersect(p.Bounds()) {
+		c := cI.(*Cell)
+		if _, ok := rows[c]; ok {
+			if in := p.Within(c.Polygonal); in == geom.Inside || in == geom.OnEdge {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// OutputReceptors returns a function that writes the values of the
+// output variables of o at the given receptors to fileName in CSV format.
+// The file has columns for the receptor name, its location in the grid
+// spatial reference sr ("X" and "Y") and in longitude-latitude
+// ("Lon" and "Lat"), and each output variable. See ReceptorResults
+// for how the values are calculated.
+func (o *Outputter) OutputReceptors(sr *proj.SR, receptors []Receptor, fileName string) DomainManipulator {
+	return func(d *InMAP) error {
+		results, err := d.ReceptorResults(o, receptors)
+		if err != nil {
+			return err
+		}
+		lonLatSR, err := proj.Parse("+proj=longlat")
+		if err != nil {
+			return err
+		}
+		t, err := sr.NewTransform(lonLatSR)
+		if err != nil {
+			return fmt.Errorf("inmap: writing receptor output: %v", err)
+		}
+
+		vars := make([]string, 0, len(results))
+		for v := range results {
+			vars = append(vars, v)
+		}
+		sort.Strings(vars)
+
+		f, err := os.Create(fileName)
+		if err != nil {
+			return fmt.Errorf("inmap: creating receptor output file: %v", err)
+		}
+		w := csv.NewWriter(f)
+		w.Write(append([]string{"Name", "X", "Y", "Lon", "Lat"}, vars...))
+		format := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+		for i, r := range receptors {
+			lon, lat, err := t(r.X, r.Y)
+			if err != nil {
+				f.Close()
+				return fmt.Errorf("inmap: writing receptor output: %v", err)
+			}
+			row := []string{r.Name, format(r.X), format(r.Y), format(lon), format(lat)}
+			for _, v := range vars {
+				row = append(row, format(results[v][i]))
+			}
+			w.Write(row)
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			f.Close()
+			return fmt.Errorf("inmap: writing receptor output: %v", err)
+		}
+		return f.Close()
+	}
+}
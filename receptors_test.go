@@ -0,0 +1,141 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap_test
+
+import (
+	"encoding/csv"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/science/chem/simplechem"
+)
+
+func TestReadReceptors(t *testing.T) {
+	dir, err := os.MkdirTemp("", "receptors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sr, err := proj.Parse(inmap.TestGridSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"lonlat.csv": "Name,Lon,Lat\nschool,-97,40\n",
+		"xy.csv":     "x, y\n1000, -2000\n",
+		"points.geojson": `{"type": "FeatureCollection", "features": [
+			{"type": "Feature", "geometry": {"type": "Point", "coordinates": [-97, 40]}, "properties": {"name": "monitor"}}]}`,
+	}
+	want := map[string]inmap.Receptor{
+		"lonlat.csv":     {Name: "school", Point: geom.Point{X: 0, Y: 0}},
+		"xy.csv":         {Name: "1", Point: geom.Point{X: 1000, Y: -2000}},
+		"points.geojson": {Name: "monitor", Point: geom.Point{X: 0, Y: 0}},
+	}
+	for name, contents := range files {
+		fileName := filepath.Join(dir, name)
+		if err := os.WriteFile(fileName, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		r, err := inmap.ReadReceptors(fileName, sr)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(r) != 1 {
+			t.Fatalf("%s: have %d receptors, want 1", name, len(r))
+		}
+		w := want[name]
+		if r[0].Name != w.Name || math.Abs(r[0].X-w.X) > 1.e-6 || math.Abs(r[0].Y-w.Y) > 1.e-6 {
+			t.Errorf("%s: have %+v, want %+v", name, r[0], w)
+		}
+	}
+}
+
+func TestOutputReceptors(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := inmap.VarGridTestData()
+	emis := inmap.NewEmissions()
+	var m simplechem.Mechanism
+
+	d := &inmap.InMAP{
+		InitFuncs: []inmap.DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	o, err := inmap.NewOutputter("", false, map[string]string{"WindSpeed": "WindSpeed"}, nil, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grid, err := d.Results(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	center := d.Cells()[0].Centroid()
+	receptors := []inmap.Receptor{
+		{Name: "center", Point: center},
+		{Name: "between", Point: geom.Point{X: center.X + 400, Y: center.Y}},
+		{Name: "outside", Point: geom.Point{X: 1.e8, Y: 1.e8}},
+	}
+	r, err := d.ReceptorResults(o, receptors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r["WindSpeed"][0] != grid["WindSpeed"][0] {
+		t.Errorf("the value at a cell center should equal the cell value: have %g, want %g", r["WindSpeed"][0], grid["WindSpeed"][0])
+	}
+	if v := r["WindSpeed"][1]; math.IsNaN(v) || v <= 0 {
+		t.Errorf("invalid interpolated value %g", v)
+	}
+	if !math.IsNaN(r["WindSpeed"][2]) {
+		t.Errorf("the value outside of the domain should be NaN, not %g", r["WindSpeed"][2])
+	}
+
+	f, err := os.CreateTemp("", "receptors*.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	sr, err := proj.Parse(inmap.TestGridSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.OutputReceptors(sr, receptors, f.Name())(d); err != nil {
+		t.Fatal(err)
+	}
+	f, err = os.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	recs, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 4 || len(recs[0]) != 6 || recs[0][5] != "WindSpeed" || recs[1][0] != "center" {
+		t.Errorf("invalid receptor output: %v", recs)
+	}
+}
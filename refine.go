@@ -0,0 +1,293 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+	"github.com/ctessum/geom/index/rtree"
+	"github.com/ctessum/geom/proj"
+)
+
+// RefinementMutator returns a function that determines whether a grid
+// cell should be split according to config.RefinementCriteria, which
+// divides the cell if the criteria of any of the following mutators are
+// met:
+//
+//	"population": PopulationMutator
+//	"emissions":  EmissionsMutator
+//	"landuse":    LandUseMutator
+//	"importance": ImportanceMutator
+//	"gradient":   GradientMutator
+//
+// If config.RefinementCriteria is empty, the population criterion is used.
+// popIndices are only needed for the population criterion and emis
+// is only needed for the emissions criterion.
+func (config *VarGridConfig) RefinementMutator(popIndices PopIndices, emis *Emissions) (GridMutator, error) {
+	criteria := config.RefinementCriteria
+	if len(criteria) == 0 {
+		criteria = []string{"population"}
+	}
+	var mutators []GridMutator
+	for _, c := range criteria {
+		var m GridMutator
+		var err error
+		switch strings.ToLower(c) {
+		case "population":
+			m, err = PopulationMutator(config, popIndices)
+		case "emissions":
+			m, err = EmissionsMutator(config, emis)
+		case "landuse":
+			m, err = LandUseMutator(config)
+		case "importance":
+			m, err = ImportanceMutator(config)
+		case "gradient":
+			m, err = GradientMutator(config)
+		default:
+			return nil, fmt.Errorf("inmap: invalid grid refinement criterion '%s'; valid options are "+
+				"'population', 'emissions', 'landuse', 'importance', and 'gradient'", c)
+		}
+		if err != nil {
+			return nil, err
+		}
+		mutators = append(mutators, m)
+	}
+	return AnyMutator(mutators...), nil
+}
+
+// AnyMutator returns a function that determines that a grid cell should
+// be split if any of mutators determine that it should be.
+func AnyMutator(mutators ...GridMutator) GridMutator {
+	return func(cell *Cell, totalMass, totalPopulation float64) bool {
+		for _, m := range mutators {
+			if m(cell, totalMass, totalPopulation) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// EmissionsMutator returns a function that determines whether a grid cell
+// should be split by determining whether the total emissions of all
+// pollutants in emis at all heights within the horizontal area of the
+// cell, divided by the area of the cell, are above
+// config.EmisDensityThreshold.
+func EmissionsMutator(config *VarGridConfig, emis *Emissions) (GridMutator, error) {
+	if emis == nil {
+		return nil, fmt.Errorf("inmap: the emissions grid refinement criterion requires emissions")
+	}
+	if config.EmisDensityThreshold <= 0 {
+		return nil, fmt.Errorf("EmisDensityThreshold=%g. It needs to be set to a positive value.",
+			config.EmisDensityThreshold)
+	}
+	return func(cell *Cell, _, _ float64) bool {
+		if cell.Layer >= config.HiResLayers {
+			return false
+		}
+		var total float64
+		for _, eI := range emis.data.SearchIntersect(cell.Bounds()) {
+			e := eI.(*EmisRecord)
+			total += (e.VOC + e.NOx + e.NH3 + e.SOx + e.PM25) * calcWeightFactor(e.Geom, cell)
+		}
+		return total/(cell.Dx*cell.Dy) > config.EmisDensityThreshold
+	}, nil
+}
+
+// LandUseMutator returns a function that determines whether a grid cell
+// should be split by determining whether the cell overlaps any of the
+// shapes in config.LandUseFile whose category in config.LandUseColumn is
+// one of config.LandUseCategories.
+func LandUseMutator(config *VarGridConfig) (GridMutator, error) {
+	if len(config.LandUseCategories) == 0 {
+		return nil, fmt.Errorf("inmap: the land use grid refinement criterion requires LandUseCategories")
+	}
+	categories := make(map[string]bool)
+	for _, c := range config.LandUseCategories {
+		categories[c] = true
+	}
+	shapes, err := config.loadRefinementShapes(config.LandUseFile, config.LandUseColumn, func(s string) (float64, error) {
+		if categories[strings.Trim(s, "\x00 ")] {
+			return 1, nil
+		}
+		return 0, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("inmap: loading LandUseFile: %v", err)
+	}
+	return func(cell *Cell, _, _ float64) bool {
+		if cell.Layer >= config.HiResLayers {
+			return false
+		}
+		for _, s := range shapes.overlapping(cell) {
+			if s.value > 0 {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// ImportanceMutator returns a function that determines whether a grid
+// cell should be split by determining whether the average of the
+// importance values in config.ImportanceFile over the area of the cell,
+// weighted by the area of overlap with each shape, is above
+// config.ImportanceThreshold. Parts of the cell that are not covered by
+// any shape have an importance of zero.
+func ImportanceMutator(config *VarGridConfig) (GridMutator, error) {
+	shapes, err := config.loadRefinementShapes(config.ImportanceFile, config.ImportanceColumn, s2f)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: loading ImportanceFile: %v", err)
+	}
+	return func(cell *Cell, _, _ float64) bool {
+		if cell.Layer >= config.HiResLayers {
+			return false
+		}
+		var importance float64
+		for _, s := range shapes.overlapping(cell) {
+			importance += s.value * s.area
+		}
+		return importance/cell.Area() > config.ImportanceThreshold
+	}, nil
+}
+
+// GradientMutator returns a function that determines whether a grid cell
+// should be split by determining whether the difference between the
+// highest and lowest concentrations in config.GradientFile among the
+// shapes that overlap the cell, divided by the highest absolute
+// concentration in the file, is above config.GradientThreshold. It can
+// be used to increase the resolution where the concentrations in a
+// previous simulation changed quickly.
+func GradientMutator(config *VarGridConfig) (GridMutator, error) {
+	shapes, err := config.loadRefinementShapes(config.GradientFile, config.GradientColumn, s2f)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: loading GradientFile: %v", err)
+	}
+	if shapes.maxAbs == 0 {
+		return func(*Cell, float64, float64) bool { return false }, nil
+	}
+	return func(cell *Cell, _, _ float64) bool {
+		if cell.Layer >= config.HiResLayers {
+			return false
+		}
+		lo, hi := math.Inf(1), math.Inf(-1)
+		for _, s := range shapes.overlapping(cell) {
+			lo = math.Min(lo, s.value)
+			hi = math.Max(hi, s.value)
+		}
+		return (hi-lo)/shapes.maxAbs > config.GradientThreshold
+	}, nil
+}
+
+// refinementShape is a shape with a value used by a grid refinement
+// criterion.
+type refinementShape struct {
+	geom.Polygonal
+	value float64
+}
+
+// refinementShapes holds the shapes used by a grid refinement criterion.
+type refinementShapes struct {
+	index  *rtree.Rtree
+	maxAbs float64 // maximum absolute value
+}
+
+// loadRefinementShapes loads the shapes in the shapefile named file,
+// converting them to the spatial reference of the grid and the values in
+// column to numbers using parse.
+func (config *VarGridConfig) loadRefinementShapes(file, column string, parse func(string) (float64, error)) (*refinementShapes, error) {
+	if file == "" || column == "" {
+		return nil, fmt.Errorf("the file and column must both be specified")
+	}
+	gridSR, err := proj.Parse(config.GridProj)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing GridProj: %v", err)
+	}
+	dec, err := shp.NewDecoder(file)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	sr, err := dec.SR()
+	if err != nil {
+		return nil, err
+	}
+	trans, err := sr.NewTransform(gridSR)
+	if err != nil {
+		return nil, err
+	}
+	o := &refinementShapes{index: rtree.NewTree(25, 50)}
+	bounds := config.bounds()
+	for {
+		g, fields, more := dec.DecodeRowFields(column)
+		if !more {
+			break
+		}
+		s, ok := fields[column]
+		if !ok {
+			return nil, fmt.Errorf("missing attribute column %s", column)
+		}
+		v, err := parse(s)
+		if err != nil {
+			return nil, err
+		}
+		gg, err := g.Transform(trans)
+		if err != nil {
+			return nil, err
+		}
+		p, ok := gg.(geom.Polygonal)
+		if !ok {
+			return nil, fmt.Errorf("shapes need to be polygons")
+		}
+		if bounds.Overlaps(p.Bounds()) {
+			o.index.Insert(&refinementShape{Polygonal: p, value: v})
+			o.maxAbs = math.Max(o.maxAbs, math.Abs(v))
+		}
+	}
+	if err := dec.Error(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// overlap is a shape that overlaps a grid cell and the area of overlap.
+type overlap struct {
+	*refinementShape
+	area float64
+}
+
+// overlapping returns the shapes in s that overlap the area of cell.
+func (s *refinementShapes) overlapping(cell *Cell) []overlap {
+	var o []overlap
+	for _, sI := range s.index.SearchIntersect(cell.Bounds()) {
+		rs := sI.(*refinementShape)
+		intersection := rs.Intersection(cell.Polygonal)
+		if intersection == nil {
+			continue
+		}
+		if a := intersection.Area(); a > 0 {
+			o = append(o, overlap{refinementShape: rs, area: a})
+		}
+	}
+	return o
+}
@@ -0,0 +1,149 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/shp"
+)
+
+// writeRefinementShapefile writes a shapefile for testing the grid
+// refinement criteria, with a value and a category for each polygon.
+func writeRefinementShapefile(t *testing.T, file string, shapes []geom.Polygon, values []float64, categories []string) {
+	type rec struct {
+		geom.Polygon
+		Value    float64
+		Category string
+	}
+	e, err := shp.NewEncoder(file, rec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range shapes {
+		if err := e.Encode(rec{Polygon: s, Value: values[i], Category: categories[i]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.Close()
+	if err := os.WriteFile(strings.TrimSuffix(file, ".shp")+".prj", []byte(TestGridSR), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func square(xMin, yMin, xMax, yMax float64) geom.Polygon {
+	return geom.Polygon{{{X: xMin, Y: yMin}, {X: xMax, Y: yMin}, {X: xMax, Y: yMax}, {X: xMin, Y: yMax}, {X: xMin, Y: yMin}}}
+}
+
+func TestRefinementMutator(t *testing.T) {
+	dir, err := os.MkdirTemp("", "refine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	m := Mech{}
+
+	// The northeast quarter of the domain is important.
+	importanceFile := filepath.Join(dir, "importance.shp")
+	writeRefinementShapefile(t, importanceFile, []geom.Polygon{
+		square(0, 0, 4000, 4000), square(-4000, -4000, 0, 0),
+	}, []float64{1, 0.1}, []string{"", ""})
+
+	// There is a small urban area in the northeast quarter.
+	landUseFile := filepath.Join(dir, "landuse.shp")
+	writeRefinementShapefile(t, landUseFile, []geom.Polygon{
+		square(1000, 1000, 1500, 1500), square(-4000, -4000, 0, 0),
+	}, []float64{0, 0}, []string{"urban", "forest"})
+
+	// The concentrations change at x=3000 in the southeast quarter.
+	gradientFile := filepath.Join(dir, "gradient.shp")
+	writeRefinementShapefile(t, gradientFile, []geom.Polygon{
+		square(0, -4000, 3000, 0), square(3000, -4000, 4000, 0),
+	}, []float64{0, 1}, []string{"", ""})
+
+	// There is a large source in the northwest quarter.
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{SOx: 1.e6, Geom: geom.Point{X: -3500, Y: 2500}})
+
+	for _, test := range []struct {
+		name     string
+		criteria []string
+		// nCells is the expected number of ground-level cells. Without
+		// refinement there are 4; a 4000 m cell divided to the finest
+		// resolution in only one corner becomes 7 cells, along one edge
+		// 10 cells, and everywhere 16 cells.
+		nCells int
+	}{
+		{name: "default", nCells: 3 + 7},
+		{name: "gradient", criteria: []string{"gradient"}, nCells: 3 + 10},
+		{name: "importance", criteria: []string{"importance"}, nCells: 3 + 16},
+		{name: "landuse", criteria: []string{"landuse"}, nCells: 3 + 7},
+		{name: "emissions", criteria: []string{"emissions"}, nCells: 3 + 7},
+		{name: "combined", criteria: []string{"importance", "emissions"}, nCells: 2 + 16 + 7},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := *cfg
+			c.GridProj = TestGridSR // The same as the shapefiles.
+			c.RefinementCriteria = test.criteria
+			c.EmisDensityThreshold = 0.01
+			c.LandUseFile, c.LandUseColumn, c.LandUseCategories = landUseFile, "Category", []string{"urban"}
+			c.ImportanceFile, c.ImportanceColumn, c.ImportanceThreshold = importanceFile, "Value", 0.5
+			c.GradientFile, c.GradientColumn, c.GradientThreshold = gradientFile, "Value", 0.5
+			mutator, err := c.RefinementMutator(popIndices, emis)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := &InMAP{
+				InitFuncs: []DomainManipulator{
+					c.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+					c.MutateGrid(mutator, ctmdata, pop, mr, emis, m, nil),
+				},
+			}
+			if err := d.Init(); err != nil {
+				t.Fatal(err)
+			}
+			var n int
+			for _, cell := range *d.cells {
+				if cell.Layer == 0 {
+					n++
+				}
+			}
+			if n != test.nCells {
+				t.Errorf("have %d ground-level cells, want %d", n, test.nCells)
+			}
+		})
+	}
+
+	c := *cfg
+	c.RefinementCriteria = []string{"elevation"}
+	if _, err := c.RefinementMutator(popIndices, emis); err == nil {
+		t.Error("expected an error for an invalid criterion")
+	}
+	c.RefinementCriteria = []string{"emissions"}
+	c.EmisDensityThreshold = 0.01
+	if _, err := c.RefinementMutator(popIndices, nil); err == nil {
+		t.Error("expected an error for missing emissions")
+	}
+}
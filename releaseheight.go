@@ -0,0 +1,45 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import "math"
+
+// ReleaseFraction returns the fraction of the emissions in e that are
+// released within the vertical extent of c, and the average height [m]
+// of the emissions that are released within c, for emissions that are
+// released within an altitude range (see EmisRecord.ReleaseBottom).
+// The emissions are distributed evenly by height across the range, and
+// emissions above the top of the grid are released in the top layer.
+func (c *Cell) ReleaseFraction(e *EmisRecord) (float64, float64) {
+	if e.ReleaseBottom >= e.ReleaseTop {
+		if c.isHeightIn(e.ReleaseTop) {
+			return 1, e.ReleaseTop
+		}
+		return 0, 0
+	}
+	bottom, top := c.LayerHeight, c.LayerHeight+c.Dz
+	if c.plumeInTop() {
+		top = math.Inf(1)
+	}
+	lo, hi := math.Max(bottom, e.ReleaseBottom), math.Min(top, e.ReleaseTop)
+	if hi <= lo {
+		return 0, 0
+	}
+	return (hi - lo) / (e.ReleaseTop - e.ReleaseBottom), (lo + hi) / 2
+}
@@ -0,0 +1,101 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ctessum/geom"
+)
+
+func TestReleaseFraction(t *testing.T) {
+	const (
+		tol = 1.e-6 // The layer heights in the test data are single precision.
+		E   = 1000. // emissions [μg/s]
+	)
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	m := Mech{}
+
+	// emisFlux returns the emissions in each cell [μg/s] and the
+	// cells themselves for emissions released between bottom and
+	// top [m].
+	emisFlux := func(bottom, top, plumeDistance float64) ([]float64, []*Cell) {
+		emis := NewEmissions()
+		emis.PlumeDistance = plumeDistance
+		emis.Add(&EmisRecord{
+			Geom:          geom.Point{X: -1000, Y: -1000},
+			PM25:          E,
+			ReleaseBottom: bottom,
+			ReleaseTop:    top,
+		})
+		d := &InMAP{
+			InitFuncs: []DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+			},
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		cells := d.cells.array()
+		e := make([]float64, len(cells))
+		for i, c := range cells {
+			e[i] = c.EmisFlux[iPM2_5] * c.Volume
+		}
+		return e, cells
+	}
+
+	for _, test := range []struct {
+		name                       string
+		bottom, top, plumeDistance float64
+	}{
+		{name: "range", bottom: 0, top: 1000},
+		{name: "elevated range", bottom: 100, top: 600},
+		{name: "above top", bottom: 5000, top: 6000},
+		{name: "single height", bottom: 150, top: 150},
+		{name: "plume in grid", bottom: 0, top: 1000, plumeDistance: 3000},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			e, cells := emisFlux(test.bottom, test.top, test.plumeDistance)
+			var total float64
+			for i, c := range cells {
+				total += e[i]
+				if e[i] == 0 {
+					continue
+				}
+				bottom, top := c.LayerHeight, c.LayerHeight+c.Dz
+				if c.plumeInTop() {
+					top = math.Inf(1)
+				}
+				var want float64
+				if test.bottom == test.top {
+					want = E
+				} else {
+					want = E * (math.Min(top, test.top) - math.Max(bottom, test.bottom)) / (test.top - test.bottom)
+				}
+				if different(e[i], want, tol) {
+					t.Errorf("layer %d: have %g, want %g", c.Layer, e[i], want)
+				}
+			}
+			if different(total, E, tol) {
+				t.Errorf("total emissions should be %g but are %g", E, total)
+			}
+		})
+	}
+}
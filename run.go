@@ -66,8 +66,8 @@ func ResetCells() DomainManipulator {
 		for _, g := range []*cellList{d.cells, d.westBoundary, d.eastBoundary,
 			d.northBoundary, d.southBoundary, d.topBoundary} {
 			for _, c := range *g {
-				c.Ci = make([]float64, len(PolNames))
-				c.Cf = make([]float64, len(PolNames))
+				c.Ci = resetArray(c.Ci, len(PolNames))
+				c.Cf = resetArray(c.Cf, len(PolNames))
 				c.EmisFlux = make([]float64, len(PolNames))
 			}
 		}
@@ -75,13 +75,30 @@ func ResetCells() DomainManipulator {
 	}
 }
 
+// resetArray returns a with all of its values set to zero, or a new
+// array of length n if a doesn't have length n. Arrays are zeroed
+// rather than replaced so that they stay in the cell storage.
+func resetArray(a []float64, n int) []float64 {
+	if len(a) != n {
+		return make([]float64, n)
+	}
+	for i := range a {
+		a[i] = 0
+	}
+	return a
+}
+
 // Calculations returns a function that concurrently runs a series of calculations
-// on all of the model grid cells.
+// on all of the model grid cells, or runs them on one cell at a time if
+// d.Deterministic is true.
 func Calculations(calculators ...CellManipulator) DomainManipulator {
-	nprocs := runtime.GOMAXPROCS(0) // number of processors
 	var wg sync.WaitGroup
 
 	return func(d *InMAP) error {
+		nprocs := runtime.GOMAXPROCS(0) // number of processors
+		if d.Deterministic {
+			nprocs = 1
+		}
 		// Concurrently run all of the calculators on all of the cells.
 		wg.Add(nprocs)
 		for pp := 0; pp < nprocs; pp++ {
@@ -120,24 +137,33 @@ func RunPeriodically(period float64, f DomainManipulator) DomainManipulator {
 	}
 }
 
-// ConvergenceStatus holds the percent difference for each pollutant between
-// the last convergence check and this one.
+// ConvergenceStatus holds the percent difference for each quantity checked
+// by a ConvergenceCriterion between the last convergence check and this one.
 type ConvergenceStatus struct {
-	data []float64
-	m    Mechanism
+	data  []float64
+	names []string
 }
 
 func (c ConvergenceStatus) String() string {
 	b := bytes.NewBufferString("Percent change since last convergence check:")
 	w := tabwriter.NewWriter(b, 0, 8, 1, '\t', 0)
-	for i, n := range c.m.Species() {
-		fmt.Fprintf(w, "\n%s:\t%.2g%%", n, c.data[i*2]*100)
-		fmt.Fprintf(w, "\n%s pop-wtd:\t%.2g%%", n, c.data[i*2+1]*100)
+	for i, n := range c.names {
+		fmt.Fprintf(w, "\n%s:\t%.2g%%", n, c.data[i]*100)
 	}
 	w.Flush()
 	return b.String()
 }
 
+// PercentChanges returns the percent change in each quantity since the
+// last convergence check, keyed by the name of the quantity.
+func (c ConvergenceStatus) PercentChanges() map[string]float64 {
+	o := make(map[string]float64, len(c.names))
+	for i, n := range c.names {
+		o[n] = c.data[i] * 100
+	}
+	return o
+}
+
 // SteadyStateConvergenceCheck checks whether a steady-state
 // simulation is finished and sets the Done
 // flag if it is. If numIterations > 0, the simulation is finished after
@@ -151,68 +177,56 @@ func (c ConvergenceStatus) String() string {
 // c is a channel over which the percent change between checks is
 // sent. If c is nil, no status updates will be sent.
 func SteadyStateConvergenceCheck(numIterations int, popGridColumn string, m Mechanism, c chan ConvergenceStatus) DomainManipulator {
-	const tolerance = 0.001         // tolerance for convergence
-	const checkPeriod = 60 * 60 * 3 // seconds, how often to check for convergence
-
-	// oldSum is the sum of mass or population-weighted concentration
-	// in the domain at the last check.
-	oldSum := make([]float64, m.Len()*2)
+	const tolerance = 0.001 // tolerance for convergence
+	return ConvergenceCheck(numIterations, MassAndPopulationChange{
+		PopGridColumn: popGridColumn,
+		Tolerance:     tolerance,
+	}, m, c)
+}
 
-	timeSinceLastCheck := 0.
-	iteration := 0
+// ConvergenceCheck is the same as SteadyStateConvergenceCheck, except
+// that when numIterations < 1, criterion is used to determine whether the
+// simulation has converged. In a distributed simulation (see
+// LoadPartition), the criterion is checked separately in the partition
+// simulated by each worker, and the simulation has converged when it is
+// met in all of the partitions. For each of the criteria in this package,
+// as long as the concentrations are not negative, this means that it is
+// also met for the domain as a whole. The changes sent to c are for this
+// worker's partition.
+func ConvergenceCheck(numIterations int, criterion ConvergenceCriterion, m Mechanism, c chan ConvergenceStatus) DomainManipulator {
+	const checkPeriod = 60 * 60 * 3 // seconds, how often to check for convergence
 
 	return func(d *InMAP) error {
-		popIndex := d.PopIndices[popGridColumn]
-
 		if d.Dt == 0 {
 			return fmt.Errorf("inmap: timestep is zero")
 		}
 
-		timeSinceLastCheck += d.Dt
-		iteration++
+		p := &d.progress
+		p.TimeSinceLastCheck += d.Dt
+		p.SimulationTime += d.Dt
+		p.Iteration++
 		// If NumIterations has been set, used it to determine when to
 		// stop the model.
 		if numIterations > 0 {
-			if iteration >= numIterations {
+			if p.Iteration >= numIterations {
 				d.Done = true
 			}
 			// Otherwise, occasionally check to see if the pollutant
 			// concentrations have converged
-		} else if timeSinceLastCheck >= checkPeriod {
-			timeToQuit := true
-			timeSinceLastCheck = 0.
-
-			status := ConvergenceStatus{
-				data: make([]float64, m.Len()*2),
-				m:    m,
+		} else if p.TimeSinceLastCheck >= checkPeriod {
+			p.TimeSinceLastCheck = 0.
+			state, change, converged := criterion.Check(d, m, p.Previous)
+			p.Previous = state
+			if c != nil {
+				c <- ConvergenceStatus{data: change, names: criterion.Names(m)}
 			}
-			for ii := 0; ii < m.Len(); ii++ {
-				var sum, bias float64
-				var converged bool
-				// calculate total mass.
-				for _, c := range *d.cells {
-					sum += c.Cf[ii] * c.Volume
-				}
-				if bias, converged = checkConvergence(sum, oldSum[ii*2], tolerance); !converged {
-					timeToQuit = false
-				}
-				status.data[ii*2] = bias
-				oldSum[ii*2] = sum
-				sum = 0
-				// Calculate population-weighted concentration.
-				for _, c := range *d.cells {
-					sum += c.Cf[ii] * c.PopData[popIndex]
+			if d.partition != nil {
+				var err error
+				if converged, err = d.partition.all(converged); err != nil {
+					return fmt.Errorf("inmap: checking convergence: %v", err)
 				}
-				if bias, converged = checkConvergence(sum, oldSum[ii*2+1], tolerance); !converged {
-					timeToQuit = false
-				}
-				status.data[ii*2+1] = bias
-				oldSum[ii*2+1] = sum
-			}
-			if c != nil {
-				c <- status
 			}
-			if timeToQuit {
+			if converged {
 				d.Done = true
 			}
 		}
@@ -220,6 +234,25 @@ func SteadyStateConvergenceCheck(numIterations int, popGridColumn string, m Mech
 	}
 }
 
+// progress holds the counters that record the progress of a
+// simulation.
+type progress struct {
+	// Iteration is the number of time steps that have been completed.
+	Iteration int
+
+	// SimulationTime is the simulated time [s] since the start of the
+	// simulation.
+	SimulationTime float64
+
+	// TimeSinceLastCheck is the simulated time [s] since the last
+	// convergence check.
+	TimeSinceLastCheck float64
+
+	// Previous holds the state of the simulation at the last
+	// convergence check, as returned by ConvergenceCriterion.Check.
+	Previous []float64
+}
+
 func checkConvergence(newSum, oldSum, tolerance float64) (float64, bool) {
 	bias := (newSum - oldSum) / oldSum
 	if math.Abs(bias) > tolerance || math.IsInf(bias, 0) {
@@ -263,7 +296,16 @@ func Log(c chan *SimulationStatus) DomainManipulator {
 
 	const daysPerSecond = 1. / 3600. / 24.
 
+	first := true
+
 	return func(d *InMAP) error {
+		if first {
+			// Continue counting from where a simulation that was
+			// resumed from a checkpoint left off.
+			iteration = d.progress.Iteration
+			nDaysRun = d.progress.SimulationTime * daysPerSecond
+			first = false
+		}
 		iteration++
 		nDaysRun += d.Dt * daysPerSecond
 
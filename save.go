@@ -22,7 +22,9 @@ import (
 	"encoding/gob"
 	"fmt"
 	"io"
+	"os"
 	"sort"
+	"time"
 
 	"github.com/ctessum/geom"
 )
@@ -89,6 +91,77 @@ func Load(r io.Reader, config *VarGridConfig, emis *Emissions, m Mechanism) Doma
 	}
 }
 
+// checkpoint holds the state of a simulation that is saved by
+// SaveCheckpoint.
+type checkpoint struct {
+	// DataVersion is the same as in versionCells.
+	DataVersion string
+	Cells       []*Cell
+	Progress    progress
+}
+
+// SaveCheckpoint returns a function that periodically saves the full
+// state of the simulation in d, including the grid, the pollutant
+// concentrations, and the progress toward convergence, to the file at
+// path, so that an interrupted simulation can be resumed using
+// LoadCheckpoint. A checkpoint is saved when the wall time since the
+// last one is at least interval, so SaveCheckpoint should be the last
+// of the RunFuncs. The checkpoint is first written to a temporary file,
+// so an interruption while it is being saved does not affect the
+// previous checkpoint.
+func SaveCheckpoint(path string, interval time.Duration) DomainManipulator {
+	lastSave := time.Now()
+	return func(d *InMAP) error {
+		if time.Since(lastSave) < interval {
+			return nil
+		}
+		tmp := path + ".tmp"
+		f, err := os.Create(tmp)
+		if err != nil {
+			return fmt.Errorf("inmap: saving checkpoint: %v", err)
+		}
+		data := checkpoint{
+			DataVersion: VarGridDataVersion,
+			Cells:       d.cells.array(),
+			Progress:    d.progress,
+		}
+		if err := gob.NewEncoder(f).Encode(data); err != nil {
+			f.Close()
+			return fmt.Errorf("inmap: saving checkpoint: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("inmap: saving checkpoint: %v", err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return fmt.Errorf("inmap: saving checkpoint: %v", err)
+		}
+		lastSave = time.Now()
+		return nil
+	}
+}
+
+// LoadCheckpoint returns a function that loads the state of a simulation
+// from a checkpoint saved by SaveCheckpoint into an InMAP object, so that
+// the simulation continues from where the checkpoint was saved. It is used
+// in place of the functions that create or load the grid.
+func LoadCheckpoint(r io.Reader, config *VarGridConfig, emis *Emissions, m Mechanism) DomainManipulator {
+	return func(d *InMAP) error {
+		var data checkpoint
+		if err := gob.NewDecoder(r).Decode(&data); err != nil {
+			return fmt.Errorf("inmap: loading checkpoint: %v", err)
+		}
+		if data.DataVersion != VarGridDataVersion {
+			return fmt.Errorf("inmap: loading checkpoint: variable grid data version %s is not compatible with "+
+				"the required version %s", data.DataVersion, VarGridDataVersion)
+		}
+		if err := d.initFromCells(data.Cells, emis, config, m); err != nil {
+			return err
+		}
+		d.progress = data.Progress
+		return nil
+	}
+}
+
 func (d *InMAP) initFromCells(cells []*Cell, emis *Emissions, config *VarGridConfig, m Mechanism) error {
 	d.init()
 	// Create a list of array indices for each population type.
@@ -107,9 +180,19 @@ func (d *InMAP) initFromCells(cells []*Cell, emis *Emissions, config *VarGridCon
 	for i, m := range mortRateColumns {
 		d.mortIndices[m] = i
 	}
+	d.global = config.globalBounds()
 	for _, c := range cells {
+		if len(c.Ci) != m.Len() {
+			// The grid was saved with a mechanism with a
+			// different number of species.
+			c.Ci = make([]float64, m.Len())
+			c.Cf = make([]float64, m.Len())
+		}
 		d.InsertCell(c, m)
 	}
+	if err := d.cellStore.error(); err != nil {
+		return err
+	}
 
 	// Add emissions to new cells.
 	// This needs to be called after setNeighbors.
@@ -20,8 +20,13 @@ package inmap_test
 
 import (
 	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/ctessum/geom"
 	"github.com/yuzhou-wang/inmap"
 	"github.com/yuzhou-wang/inmap/science/chem/simplechem"
 )
@@ -60,3 +65,95 @@ func TestSaveLoad(t *testing.T) {
 	d2.TestCellAlignment1(t)
 	d2.TestCellAlignment2(t)
 }
+
+func TestCheckpoint(t *testing.T) {
+	const (
+		E             = 1000000. // emissions [μg/s]
+		numIterations = 10
+	)
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := inmap.VarGridTestData()
+	emis := inmap.NewEmissions()
+	emis.Add(&inmap.EmisRecord{
+		SOx:  E,
+		NOx:  E,
+		PM25: E,
+		VOC:  E,
+		NH3:  E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	})
+	var m simplechem.Mechanism
+	dir, err := os.MkdirTemp("", "inmap_checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.gob")
+
+	// run runs a simulation for numIterations time steps and returns
+	// the resulting concentrations in each cell.
+	run := func(init inmap.DomainManipulator, numIterations int, addRun ...inmap.DomainManipulator) map[string][]float64 {
+		d := &inmap.InMAP{
+			InitFuncs: []inmap.DomainManipulator{init, inmap.SetTimestepCFL()},
+			RunFuncs: append([]inmap.DomainManipulator{
+				inmap.Calculations(inmap.AddEmissionsFlux()),
+				inmap.Calculations(inmap.UpwindAdvection(), inmap.Mixing(), m.Chemistry()),
+				inmap.SteadyStateConvergenceCheck(numIterations, cfg.PopGridColumn, m, nil),
+			}, addRun...),
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Run(); err != nil {
+			t.Fatal(err)
+		}
+		o := make(map[string][]float64)
+		for _, c := range d.Cells() {
+			o[fmt.Sprintf("%v %d", c.Bounds(), c.Layer)] = c.Cf
+		}
+		return o
+	}
+
+	want := run(cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m), numIterations)
+
+	run(cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m), numIterations/2,
+		inmap.SaveCheckpoint(path, 0))
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	have := run(inmap.LoadCheckpoint(f, cfg, emis, m), numIterations)
+
+	if len(have) != len(want) {
+		t.Fatalf("have %d cells, want %d", len(have), len(want))
+	}
+	for key, w := range want {
+		h, ok := have[key]
+		if !ok {
+			t.Fatalf("missing cell %s", key)
+		}
+		for i := range w {
+			if h[i] != w[i] {
+				t.Errorf("cell %s species %d: have %g, want %g", key, i, h[i], w[i])
+			}
+		}
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary checkpoint file should not exist: %v", err)
+	}
+}
+
+func TestSaveCheckpoint_interval(t *testing.T) {
+	dir, err := os.MkdirTemp("", "inmap_checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.gob")
+	if err := inmap.SaveCheckpoint(path, time.Hour)(new(inmap.InMAP)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("checkpoint should not be saved before the interval has elapsed: %v", err)
+	}
+}
@@ -22,6 +22,7 @@ package simplechem
 import (
 	"fmt"
 	"math"
+	"strings"
 
 	"github.com/yuzhou-wang/inmap"
 	"github.com/yuzhou-wang/inmap/science/drydep/simpledrydep"
@@ -30,7 +31,37 @@ import (
 
 // Mechanism fulfils the github.com/yuzhou-wang/inmap.Mechanism
 // interface.
-type Mechanism struct{}
+type Mechanism struct {
+	// Ozone specifies whether ozone (O3) is included as a pollutant,
+	// using a reduced-form ozone formation scheme. It requires CTM data
+	// preprocessed with the github.com/yuzhou-wang/inmap.Ozone option.
+	Ozone bool
+
+	// NitrateEquilibrium specifies whether the partitioning of ammonium
+	// and nitrate between the gas and particle phases is calculated
+	// from the thermodynamic equilibrium of ammonium nitrate and
+	// ammonium sulfates in each season, rather than from the annual
+	// average partitioning in the baseline data. It requires CTM data
+	// preprocessed with the
+	// github.com/yuzhou-wang/inmap.NitrateEquilibrium option.
+	NitrateEquilibrium bool
+
+	// PrimaryCarbon specifies whether primary elemental carbon (EC)
+	// and organic carbon (OC) are tracked separately from the rest of
+	// primary PM2.5, so that their concentrations are available as
+	// the "PrimaryEC" and "PrimaryOC" output variables. EC and OC
+	// emissions are parts of PM2.5 emissions; if PrimaryCarbon is
+	// false, they are only included in primary PM2.5.
+	PrimaryCarbon bool
+
+	// CoarsePM specifies whether primary coarse particulate matter
+	// (PM10-2.5), such as dust, is included as a pollutant, so that
+	// the "PrimaryCoarsePM", "PrimaryPM10", and "TotalPM10" output
+	// variables are available. Coarse PM is chemically inert and is
+	// deposited using the coarse particle dry deposition velocity
+	// in the CTM data, if it is present.
+	CoarsePM bool
+}
 
 // physical constants
 const (
@@ -43,6 +74,7 @@ const (
 	mwS   = 32.0655 // g/mol, molar mass of sulfur
 	mwSO2 = 64.0644
 	mwSO4 = 96.0632
+	mwO3  = 47.9982
 
 	// Chemical mass conversions [ratios]
 	NOxToN = mwN / mwNOx
@@ -64,11 +96,40 @@ const (
 	ipS
 	igNO
 	ipNO
+	iO3
 )
 
-// Len returns the number of chemical species in this mechanism (9).
+// Len returns the number of chemical species in this mechanism
+// (9, plus 1 if ozone is included, 2 if primary carbon is
+// tracked separately, and 1 if coarse PM is included).
 func (m Mechanism) Len() int {
-	return 9
+	n := 9
+	if m.Ozone {
+		n++
+	}
+	if m.PrimaryCarbon {
+		n += 2
+	}
+	if m.CoarsePM {
+		n++
+	}
+	return n
+}
+
+// carbonIndices returns the array indices of primary elemental carbon
+// and primary organic carbon, which follow the other species.
+func (m Mechanism) carbonIndices() (iEC, iOC int) {
+	iEC = iO3
+	if m.Ozone {
+		iEC++
+	}
+	return iEC, iEC + 1
+}
+
+// coarseIndex returns the array index of primary coarse PM, which is
+// the last species.
+func (m Mechanism) coarseIndex() int {
+	return m.Len() - 1
 }
 
 // emisConv lists the accepted names for emissions species, the array
@@ -92,12 +153,34 @@ var emisConv = map[string]struct {
 func (m Mechanism) AddEmisFlux(c *inmap.Cell, name string, val float64) error {
 	fluxScale := 1. / c.Dx / c.Dy / c.Dz // μg/s /m/m/m = μg/m3/s
 	conv, ok := emisConv[name]
-	if !ok {
-		return fmt.Errorf("simplechem: '%s' is not a valid emissions species; valid options are VOC, NOx, NH3, SOx, and PM2_5", name)
+	if !ok && name != "EC" && name != "OC" && name != "PMCoarse" {
+		return fmt.Errorf("simplechem: '%s' is not a valid emissions species; valid options are VOC, NOx, NH3, SOx, PM2_5, EC, OC, and PMCoarse", name)
 	}
 	if c.EmisFlux == nil {
 		c.EmisFlux = make([]float64, m.Len())
 	}
+	if name == "PMCoarse" {
+		// Coarse PM emissions are ignored unless coarse PM is included.
+		if m.CoarsePM {
+			c.EmisFlux[m.coarseIndex()] += val * fluxScale
+		}
+		return nil
+	}
+	if !ok {
+		// EC and OC emissions are also included in the PM2.5
+		// emissions, so they are moved out of primary PM2.5 if
+		// they are tracked separately.
+		if m.PrimaryCarbon {
+			iEC, iOC := m.carbonIndices()
+			i := iEC
+			if name == "OC" {
+				i = iOC
+			}
+			c.EmisFlux[i] += val * fluxScale
+			c.EmisFlux[iPM2_5] -= val * fluxScale
+		}
+		return nil
+	}
 	c.EmisFlux[conv.i] += val * conv.conv * fluxScale
 	return nil
 }
@@ -107,12 +190,43 @@ func simpleDryDepIndices() (simpledrydep.SOx, simpledrydep.NH3, simpledrydep.NOx
 	return simpledrydep.SOx{igS}, simpledrydep.NH3{igNH}, simpledrydep.NOx{igNO}, simpledrydep.VOC{igOrg}, simpledrydep.PM25{ipOrg, iPM2_5, ipNH, ipS, ipNO}
 }
 
+// dryDepIndices provides array indices for use with package
+// simpledrydep, including the optional species. Ozone is deposited at
+// the same rate as NOx, as the two have similar deposition velocities
+// (Wesely, 1989), and primary carbon is deposited as PM2.5.
+func (m Mechanism) dryDepIndices() (simpledrydep.SOx, simpledrydep.NH3, simpledrydep.NOx, simpledrydep.VOC, simpledrydep.PM25) {
+	sox, nh3, nox, voc, pm25 := simpleDryDepIndices()
+	if m.Ozone {
+		nox = append(nox, iO3)
+	}
+	if m.PrimaryCarbon {
+		iEC, iOC := m.carbonIndices()
+		pm25 = append(pm25, iEC, iOC)
+	}
+	return sox, nh3, nox, voc, pm25
+}
+
+// coarseDryDepIndices provides the coarse PM array index for use with
+// package simpledrydep.
+func (m Mechanism) coarseDryDepIndices() simpledrydep.CoarsePM {
+	return simpledrydep.CoarsePM{m.coarseIndex()}
+}
+
 // DryDep returns a dry deposition function of the type indicated by
 // name that is compatible with this chemical mechanism.
 // Currently, the only valid option is "simple".
 func (m Mechanism) DryDep(name string) (inmap.CellManipulator, error) {
+	simple := simpledrydep.DryDeposition(m.dryDepIndices)
+	if m.CoarsePM {
+		fine := simple
+		coarse := simpledrydep.CoarseDryDeposition(m.coarseDryDepIndices)
+		simple = func(c *inmap.Cell, Δt float64) {
+			fine(c, Δt)
+			coarse(c, Δt)
+		}
+	}
 	options := map[string]inmap.CellManipulator{
-		"simple": simpledrydep.DryDeposition(simpleDryDepIndices),
+		"simple": simple,
 	}
 	f, ok := options[name]
 	if !ok {
@@ -126,12 +240,30 @@ func emepWetDepIndices() (emepwetdep.SO2, emepwetdep.OtherGas, emepwetdep.PM25)
 	return emepwetdep.SO2{igS}, emepwetdep.OtherGas{igNH, igNO, igOrg}, emepwetdep.PM25{ipOrg, iPM2_5, ipNH, ipS, ipNO}
 }
 
+// wetDepIndices provides array indices for use with package
+// emepwetdep, including the optional species.
+func (m Mechanism) wetDepIndices() (emepwetdep.SO2, emepwetdep.OtherGas, emepwetdep.PM25) {
+	so2, otherGas, pm25 := emepWetDepIndices()
+	if m.Ozone {
+		otherGas = append(otherGas, iO3)
+	}
+	if m.PrimaryCarbon {
+		iEC, iOC := m.carbonIndices()
+		pm25 = append(pm25, iEC, iOC)
+	}
+	if m.CoarsePM {
+		// Coarse particles are scavenged at the same rate as PM2.5.
+		pm25 = append(pm25, m.coarseIndex())
+	}
+	return so2, otherGas, pm25
+}
+
 // WetDep returns a dry deposition function of the type indicated by
 // name that is compatible with this chemical mechanism.
 // Currently, the only valid option is "emep".
 func (m Mechanism) WetDep(name string) (inmap.CellManipulator, error) {
 	options := map[string]inmap.CellManipulator{
-		"emep": emepwetdep.WetDeposition(emepWetDepIndices),
+		"emep": emepwetdep.WetDeposition(m.wetDepIndices),
 	}
 	f, ok := options[name]
 	if !ok {
@@ -143,7 +275,7 @@ func (m Mechanism) WetDep(name string) (inmap.CellManipulator, error) {
 // Species returns the names of the emission and concentration pollutant
 // species that are used by this chemical mechanism.
 func (m Mechanism) Species() []string {
-	return []string{
+	s := []string{
 		/*"VOCEmissions",
 		"NOxEmissions",
 		"NH3Emissions",
@@ -160,6 +292,16 @@ func (m Mechanism) Species() []string {
 		"NOx",
 		"pNO3",
 	}
+	if m.Ozone {
+		s = append(s, "O3")
+	}
+	if m.PrimaryCarbon {
+		s = append(s, "PrimaryEC", "PrimaryOC")
+	}
+	if m.CoarsePM {
+		s = append(s, "PrimaryCoarsePM", "PrimaryPM10")
+	}
+	return s
 }
 
 var emisLabels = map[string]int{
@@ -170,11 +312,15 @@ var emisLabels = map[string]int{
 	"PM25Emissions": iPM2_5,
 }
 
-// polLabels are labels and conversions for InMAP pollutants.
-var polLabels = map[string]struct {
+// polConversion specifies how to calculate the concentration of
+// a pollutant from the concentration array.
+type polConversion struct {
 	index      []int     // index in concentration array
 	conversion []float64 // conversion from N to NH4, S to SO4, etc...
-}{
+}
+
+// polLabels are labels and conversions for InMAP pollutants.
+var polLabels = map[string]polConversion{
 	"TotalPM25": {[]int{iPM2_5, ipOrg, ipNH, ipS, ipNO},
 		[]float64{1, 1, NtoNH4, StoSO4, NtoNO3}},
 	"VOC":         {[]int{igOrg}, []float64{1.}},
@@ -186,6 +332,47 @@ var polLabels = map[string]struct {
 	"pSO4":        {[]int{ipS}, []float64{StoSO4}},
 	"NOx":         {[]int{igNO}, []float64{1. / NOxToN}},
 	"pNO3":        {[]int{ipNO}, []float64{NtoNO3}},
+	"O3":          {[]int{iO3}, []float64{1.}},
+}
+
+// polLabel returns the label and conversion for the given
+// pollutant, and whether it is valid for this mechanism.
+func (m Mechanism) polLabel(variable string) (polConversion, bool) {
+	if m.CoarsePM {
+		iCoarse := m.coarseIndex()
+		switch variable {
+		case "PrimaryCoarsePM":
+			return polConversion{[]int{iCoarse}, []float64{1}}, true
+		case "PrimaryPM10", "TotalPM10":
+			// PM10 is PM2.5 plus coarse PM.
+			conv, _ := m.polLabel(strings.Replace(variable, "PM10", "PM25", 1))
+			return polConversion{
+				index:      append([]int{iCoarse}, conv.index...),
+				conversion: append([]float64{1}, conv.conversion...),
+			}, true
+		}
+	}
+	if m.PrimaryCarbon {
+		iEC, iOC := m.carbonIndices()
+		switch variable {
+		case "PrimaryEC":
+			return polConversion{[]int{iEC}, []float64{1}}, true
+		case "PrimaryOC":
+			return polConversion{[]int{iOC}, []float64{1}}, true
+		case "TotalPM25", "PrimaryPM25":
+			// Primary PM2.5 includes primary carbon.
+			conv := polLabels[variable]
+			return polConversion{
+				index:      append([]int{iEC, iOC}, conv.index...),
+				conversion: append([]float64{1, 1}, conv.conversion...),
+			}, true
+		}
+	}
+	conv, ok := polLabels[variable]
+	if variable == "O3" && !m.Ozone {
+		ok = false
+	}
+	return conv, ok
 }
 
 // Value returns the concentration or emissions value of
@@ -194,12 +381,16 @@ var polLabels = map[string]struct {
 func (m Mechanism) Value(c *inmap.Cell, variable string) (float64, error) {
 	i, ok := emisLabels[variable]
 	if ok {
-		if c.EmisFlux != nil {
-			return c.EmisFlux[i], nil
+		if c.EmisFlux == nil {
+			return 0, nil
 		}
-		return 0, nil
+		if i == iPM2_5 && m.PrimaryCarbon {
+			iEC, iOC := m.carbonIndices()
+			return c.EmisFlux[i] + c.EmisFlux[iEC] + c.EmisFlux[iOC], nil
+		}
+		return c.EmisFlux[i], nil
 	}
-	conv, ok := polLabels[variable]
+	conv, ok := m.polLabel(variable)
 	if !ok {
 		return math.NaN(), fmt.Errorf("simplechem: invalid variable name %s; valid names are %v", variable, m.Species())
 	}
@@ -216,12 +407,31 @@ func (m Mechanism) Units(variable string) (string, error) {
 	if _, ok := emisLabels[variable]; ok {
 		return "μg/m³/s", nil
 	}
-	if _, ok := polLabels[variable]; !ok {
+	if _, ok := m.polLabel(variable); !ok {
 		return "", fmt.Errorf("simplechem: invalid variable name %s; valid names are %v", variable, m.Species())
 	}
 	return "μg/m³", nil
 }
 
+// Parameters of the reduced-form ozone formation scheme.
+const (
+	// opeNOxLimited is the ozone production efficiency (molecules of
+	// O3 formed per molecule of NOx oxidized) when ozone formation is
+	// NOx-limited (Trainer et al., 1993, doi:10.1029/93JD01440).
+	opeNOxLimited = 8.
+
+	// titrationVOCLimited is the number of molecules of O3 destroyed
+	// per molecule of NOx oxidized when ozone formation is
+	// VOC-limited, where additional NOx titrates O3 and removes the
+	// radicals that would otherwise form it (Sillman, 1999,
+	// doi:10.1016/S1352-2310(98)00345-8).
+	titrationVOCLimited = 1.
+
+	// vocO3Yield is the mass of O3 formed per mass of VOC oxidized
+	// when ozone formation is VOC-limited.
+	vocO3Yield = 1.
+)
+
 // Chemistry returns a function that calculates the secondary formation of PM2.5.
 // It explicitly calculates formation of particulate sulfate
 // from gaseous and aqueous SO2.
@@ -230,22 +440,50 @@ func (m Mechanism) Units(variable string) (string, error) {
 // "pNH) between gaseous and particulate phase
 // based on the spatially explicit partioning present in the baseline data.
 // The function arguments represent the array indices of each chemical species.
+//
+// If the NitrateEquilibrium option is used, the nitrogen in nitrate and
+// ammonia is instead partitioned according to the change in the
+// equilibrium amounts of ammonium sulfates and ammonium nitrate caused by
+// adding the modeled concentrations to the baseline concentrations,
+// averaged over the seasonal temperatures and relative humidities
+// in the baseline data.
+//
+// If ozone is included, it also calculates the change in O3 caused by
+// the oxidation of NOx and VOC. Where ozone formation is NOx-limited,
+// oxidized NOx forms O3 and VOC has no effect; where it is VOC-limited,
+// oxidized NOx destroys O3 and oxidized VOC forms it. The fraction of
+// formation that is NOx-limited in each grid cell is from the baseline data.
 func (m Mechanism) Chemistry() inmap.CellManipulator {
 	return func(c *inmap.Cell, Δt float64) {
+		if m.Ozone {
+			// Ozone formation, calculated first so that it depends
+			// on the NOx and VOC at the beginning of the time step.
+			ΔNOx := c.Cf[igNO] * (1 - math.Exp(-c.NOxOxidation*Δt))  // μg N/m3
+			ΔVOC := c.Cf[igOrg] * (1 - math.Exp(-c.VOCOxidation*Δt)) // μg/m3
+			s := c.O3NOxSensitivity
+			c.Cf[iO3] += ΔNOx/mwN*mwO3*(s*opeNOxLimited-(1-s)*titrationVOCLimited) +
+				ΔVOC*(1-s)*vocO3Yield
+		}
+
 		// All SO4 forms particles, so sulfur particle formation is limited by the
 		// SO2 -> SO4 reaction.
 		ΔS := c.Cf[igS] - c.Cf[igS]*math.Exp(-c.SO2oxidation*Δt)
 		c.Cf[ipS] += ΔS
 		c.Cf[igS] -= ΔS
-		// NH3 / pNH4 partitioning
 		totalNH := c.Cf[igNH] + c.Cf[ipNH]
-		c.Cf[ipNH] = totalNH * c.NHPartitioning
-		c.Cf[igNH] = totalNH * (1 - c.NHPartitioning)
-
-		// NOx / pN0 partitioning
 		totalNO := c.Cf[igNO] + c.Cf[ipNO]
-		c.Cf[ipNO] = totalNO * c.NOPartitioning
-		c.Cf[igNO] = totalNO * (1 - c.NOPartitioning)
+		if pNH, pNO, ok := m.nitrateEquilibrium(c, totalNH, totalNO, c.Cf[ipS]); ok {
+			c.Cf[ipNH], c.Cf[igNH] = pNH, totalNH-pNH
+			c.Cf[ipNO], c.Cf[igNO] = pNO, totalNO-pNO
+		} else {
+			// NH3 / pNH4 partitioning
+			c.Cf[ipNH] = totalNH * c.NHPartitioning
+			c.Cf[igNH] = totalNH * (1 - c.NHPartitioning)
+
+			// NOx / pN0 partitioning
+			c.Cf[ipNO] = totalNO * c.NOPartitioning
+			c.Cf[igNO] = totalNO * (1 - c.NOPartitioning)
+		}
 
 		// VOC/SOA partitioning
 		totalOrg := c.Cf[igOrg] + c.Cf[ipOrg]
@@ -107,12 +107,240 @@ func TestChemistry(t *testing.T) {
 
 }
 
+func TestOzoneChemistry(t *testing.T) {
+	const tolerance = 1.e-8
+	m := Mechanism{Ozone: true}
+	if m.Len() != 10 {
+		t.Errorf("have %d species, want 10", m.Len())
+	}
+	const Δt = 100.
+	for _, test := range []struct {
+		name        string
+		sensitivity float64
+		voc         float64
+		want        float64
+	}{
+		{
+			name:        "NOx-limited",
+			sensitivity: 1,
+			voc:         1,
+			want:        (1 - math.Exp(-1.e-5*Δt)) / mwN * mwO3 * opeNOxLimited,
+		},
+		{
+			name:        "VOC-limited",
+			sensitivity: 0,
+			want:        -(1 - math.Exp(-1.e-5*Δt)) / mwN * mwO3 * titrationVOCLimited,
+		},
+		{
+			name:        "VOC-limited with VOC",
+			sensitivity: 0,
+			voc:         10,
+			want: -(1-math.Exp(-1.e-5*Δt))/mwN*mwO3*titrationVOCLimited +
+				10*(1-math.Exp(-2.e-5*Δt))*vocO3Yield,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := &inmap.Cell{
+				Cf:               make([]float64, m.Len()),
+				O3NOxSensitivity: test.sensitivity,
+				NOxOxidation:     1.e-5,
+				VOCOxidation:     2.e-5,
+			}
+			c.Cf[igNO] = 1
+			c.Cf[igOrg] = test.voc
+			m.Chemistry()(c, Δt)
+			have, err := m.Value(c, "O3")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if different(have, test.want, tolerance) {
+				t.Errorf("have %g, want %g", have, test.want)
+			}
+		})
+	}
+
+	if _, err := (Mechanism{}).Value(&inmap.Cell{}, "O3"); err == nil {
+		t.Error("O3 should not be valid without the Ozone option")
+	}
+}
+
+func TestNitrateEquilibrium(t *testing.T) {
+	const tolerance = 1.e-8
+
+	t.Run("Kp", func(t *testing.T) {
+		const T = 298.15
+		ppbToμgN := 1.e-9 * 101325. / (8.314462 * T) * 1.e6 * mwN
+		// Mozurkewich (1993) gives 43 ppb² at 298 K for dry particles.
+		if have := ammoniumNitrateKp(T, 0) / (ppbToμgN * ppbToμgN); math.Abs(have-43.1) > 0.1 {
+			t.Errorf("have %g ppb², want 43.1 ppb²", have)
+		}
+		// The constant should be continuous at the deliquescence
+		// relative humidity.
+		drh := math.Exp(723.7/T+1.6954) / 100.
+		if dry, wet := ammoniumNitrateKp(T, drh-1.e-6), ammoniumNitrateKp(T, drh+1.e-6); different(dry, wet, 0.05) {
+			t.Errorf("Kp is discontinuous at DRH: %g and %g", dry, wet)
+		}
+		// Aqueous particles hold more nitrate.
+		if ammoniumNitrateKp(T, 0.9) >= ammoniumNitrateKp(T, drh) {
+			t.Error("Kp should decrease with relative humidity above the DRH")
+		}
+	})
+
+	t.Run("ammonia-poor", func(t *testing.T) {
+		// All of the ammonia is neutralized by the sulfate.
+		pNH, pNO := ammoniumNitrate(1, 1, 10, 270, 0.5)
+		if pNH != 1 || pNO != 0 {
+			t.Errorf("have pNH=%g and pNO=%g; want 1 and 0", pNH, pNO)
+		}
+	})
+
+	m := Mechanism{NitrateEquilibrium: true}
+	newCell := func(T float64) *inmap.Cell {
+		c := &inmap.Cell{
+			Cf:                  make([]float64, m.Len()),
+			CBaseline:           make([]float64, m.Len()),
+			NOPartitioning:      0.5,
+			NHPartitioning:      0.5,
+			SeasonalTemperature: [4]float64{T, T, T, T},
+			SeasonalRH:          [4]float64{0.5, 0.5, 0.5, 0.5},
+		}
+		c.CBaseline[igNH], c.CBaseline[igNO], c.CBaseline[ipS] = 3, 2, 0.5
+		c.Cf[igNO], c.Cf[igNH] = 1, 0.5
+		return c
+	}
+	checkMass := func(t *testing.T, c *inmap.Cell) {
+		if nh := c.Cf[igNH] + c.Cf[ipNH]; different(nh, 0.5, tolerance) {
+			t.Errorf("ammonia mass not conserved: have %g, want 0.5", nh)
+		}
+		if no := c.Cf[igNO] + c.Cf[ipNO]; different(no, 1, tolerance) {
+			t.Errorf("nitrate mass not conserved: have %g, want 1", no)
+		}
+	}
+
+	winter, summer := newCell(270), newCell(300)
+	m.Chemistry()(winter, 1)
+	m.Chemistry()(summer, 1)
+	checkMass(t, winter)
+	checkMass(t, summer)
+	if winter.Cf[ipNO] <= summer.Cf[ipNO] {
+		t.Errorf("winter nitrate (%g) should be greater than summer nitrate (%g)",
+			winter.Cf[ipNO], summer.Cf[ipNO])
+	}
+	if winter.Cf[ipNO] <= 0 || winter.Cf[ipNO] > 1 {
+		t.Errorf("winter nitrate %g is outside of (0, 1]", winter.Cf[ipNO])
+	}
+
+	// Without seasonal meteorology, the baseline partitioning is used.
+	c := newCell(0)
+	m.Chemistry()(c, 1)
+	if c.Cf[ipNO] != 0.5 || c.Cf[ipNH] != 0.25 {
+		t.Errorf("have pNO=%g and pNH=%g; want 0.5 and 0.25", c.Cf[ipNO], c.Cf[ipNH])
+	}
+}
+
+func TestPrimaryCarbon(t *testing.T) {
+	newCell := func(m Mechanism) *inmap.Cell {
+		c := &inmap.Cell{Dx: 1, Dy: 1, Dz: 1}
+		for name, v := range map[string]float64{"PM2_5": 10, "EC": 3, "OC": 2} {
+			if err := m.AddEmisFlux(c, name, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c.Cf = c.EmisFlux
+		return c
+	}
+	value := func(m Mechanism, c *inmap.Cell, name string) float64 {
+		v, err := m.Value(c, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	m := Mechanism{Ozone: true, PrimaryCarbon: true}
+	if m.Len() != 12 {
+		t.Errorf("have %d species, want 12", m.Len())
+	}
+	c := newCell(m)
+	for name, want := range map[string]float64{
+		"PrimaryEC":     3,
+		"PrimaryOC":     2,
+		"PrimaryPM25":   10,
+		"TotalPM25":     10,
+		"PM25Emissions": 10,
+		"O3":            0,
+	} {
+		if have := value(m, c, name); have != want {
+			t.Errorf("%s: have %g, want %g", name, have, want)
+		}
+	}
+
+	// Without the PrimaryCarbon option, EC and OC are only
+	// included in primary PM2.5.
+	m = Mechanism{}
+	c = newCell(m)
+	if have := value(m, c, "PrimaryPM25"); have != 10 {
+		t.Errorf("PrimaryPM25: have %g, want 10", have)
+	}
+	if _, err := m.Value(c, "PrimaryEC"); err == nil {
+		t.Error("PrimaryEC should not be valid without the PrimaryCarbon option")
+	}
+}
+
+func TestCoarsePM(t *testing.T) {
+	m := Mechanism{PrimaryCarbon: true, CoarsePM: true}
+	if m.Len() != 12 {
+		t.Errorf("have %d species, want 12", m.Len())
+	}
+	c := &inmap.Cell{Dx: 1, Dy: 1, Dz: 1}
+	for name, v := range map[string]float64{"PM2_5": 10, "EC": 3, "PMCoarse": 4} {
+		if err := m.AddEmisFlux(c, name, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Cf = c.EmisFlux
+	for name, want := range map[string]float64{
+		"PrimaryCoarsePM": 4,
+		"PrimaryPM25":     10,
+		"PrimaryPM10":     14,
+		"TotalPM10":       14,
+		"PrimaryEC":       3,
+	} {
+		have, err := m.Value(c, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != want {
+			t.Errorf("%s: have %g, want %g", name, have, want)
+		}
+	}
+
+	// Without the CoarsePM option, coarse PM emissions are ignored.
+	m = Mechanism{}
+	c = &inmap.Cell{Dx: 1, Dy: 1, Dz: 1}
+	if err := m.AddEmisFlux(c, "PMCoarse", 4); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range c.EmisFlux {
+		if v != 0 {
+			t.Errorf("species %d: have %g, want 0", i, v)
+		}
+	}
+	if _, err := m.Value(c, "PrimaryPM10"); err == nil {
+		t.Error("PrimaryPM10 should not be valid without the CoarsePM option")
+	}
+}
+
 func TestDryDep(t *testing.T) {
 	m := Mechanism{}
 	_, err := m.DryDep("simple")
 	if err != nil {
 		t.Fatal(err)
 	}
+	_, err = Mechanism{CoarsePM: true}.DryDep("simple")
+	if err != nil {
+		t.Fatal(err)
+	}
 	_, err = m.DryDep("XXX")
 	if err == nil {
 		t.Fatal("should be an error")
@@ -0,0 +1,106 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package simplechem
+
+import (
+	"math"
+
+	"github.com/yuzhou-wang/inmap"
+)
+
+// ammoniumNitrateKp returns the equilibrium constant of the reaction
+// NH3(g) + HNO3(g) <-> NH4NO3(s,aq) [(μg N/m3)²] at temperature T [K]
+// and relative humidity rh [fraction]. Below the deliquescence relative
+// humidity of NH4NO3, the constant is for dry particles (Mozurkewich,
+// 1993, doi:10.1016/0960-1686(93)90180-2); above it, it is adjusted
+// for aqueous particles (Seinfeld and Pandis, 2006, eq. 10.97).
+// The conversion from mixing ratios assumes a pressure of 1 atm.
+func ammoniumNitrateKp(T, rh float64) float64 {
+	kp := math.Exp(118.87 - 24084/T - 6.025*math.Log(T)) // ppb²
+	drh := math.Exp(723.7/T+1.6954) / 100.               // deliquescence relative humidity [fraction]
+	if rh > drh {
+		const maxRH = 0.99 // The adjustment is not valid at saturation.
+		a := 1 - math.Min(rh, maxRH)
+		p1 := math.Exp(-135.94 + 8763/T + 19.12*math.Log(T))
+		p2 := math.Exp(-122.65 + 9969/T + 16.22*math.Log(T))
+		p3 := math.Exp(-182.61 + 13875/T + 24.46*math.Log(T))
+		kp *= (p1 - p2*a + p3*a*a) * math.Pow(a, 1.75)
+	}
+	const (
+		R = 8.314462 // J/mol/K
+		P = 101325.  // Pa
+	)
+	ppbToμgN := 1.e-9 * P / (R * T) * 1.e6 * mwN // μg N/m3 per ppb
+	return kp * ppbToμgN * ppbToμgN
+}
+
+// ammoniumNitrate returns the particulate ammonium and nitrate
+// [μg N/m3] in equilibrium with the given total (gas + particle)
+// ammonia and nitrate [μg N/m3] and particulate sulfate [μg S/m3]
+// at temperature T [K] and relative humidity rh [fraction].
+// Sulfate is neutralized first, forming NH4HSO4 and (NH4)2SO4, and only
+// the ammonia that remains is available to form NH4NO3.
+func ammoniumNitrate(totalNH, totalNO, pS, T, rh float64) (pNH, pNO float64) {
+	sulfateNH := math.Min(totalNH, 2*pS/mwS*mwN) // ammonium in ammonium sulfates
+	a := totalNH - sulfateNH                     // free ammonia
+	b := totalNO
+	kp := ammoniumNitrateKp(T, rh)
+	if a*b <= kp {
+		return sulfateNH, 0
+	}
+	// Solve (a-x)(b-x) = kp for x, the ammonium nitrate concentration.
+	x := (a + b - math.Sqrt((a-b)*(a-b)+4*kp)) / 2
+	return sulfateNH + x, x
+}
+
+// nitrateEquilibrium returns the particulate ammonium and nitrate
+// [μg N/m3] that are added to the baseline amounts in c by the given
+// total ammonia and nitrate [μg N/m3] and particulate sulfate [μg S/m3].
+// It is the average over the seasons of the difference between the
+// equilibrium amounts with and without the additional pollution.
+// The results are limited to between zero and the total amounts.
+// ok is false if the NitrateEquilibrium option is not used or if c does
+// not have seasonal meteorology, in which case the baseline
+// partitioning should be used instead.
+func (m Mechanism) nitrateEquilibrium(c *inmap.Cell, totalNH, totalNO, pS float64) (pNH, pNO float64, ok bool) {
+	if !m.NitrateEquilibrium {
+		return 0, 0, false
+	}
+	baseNH := c.CBaseline[igNH] + c.CBaseline[ipNH]
+	baseNO := c.CBaseline[igNO] + c.CBaseline[ipNO]
+	baseS := c.CBaseline[ipS]
+	var n float64
+	for s, T := range c.SeasonalTemperature {
+		if T <= 0 {
+			continue
+		}
+		rh := c.SeasonalRH[s]
+		nh0, no0 := ammoniumNitrate(baseNH, baseNO, baseS, T, rh)
+		nh1, no1 := ammoniumNitrate(baseNH+totalNH, baseNO+totalNO, baseS+pS, T, rh)
+		pNH += nh1 - nh0
+		pNO += no1 - no0
+		n++
+	}
+	if n == 0 {
+		return 0, 0, false
+	}
+	pNH = math.Max(0, math.Min(totalNH, pNH/n))
+	pNO = math.Max(0, math.Min(totalNO, pNO/n))
+	return pNH, pNO, true
+}
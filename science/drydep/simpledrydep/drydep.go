@@ -72,3 +72,28 @@ func DryDeposition(indices func() (SOx, NH3, NOx, VOC, PM25)) inmap.CellManipula
 		}
 	}
 }
+
+// CoarsePM specifies array indicies that hold coarse (PM10-2.5)
+// particulate matter concentrations.
+type CoarsePM []int
+
+// CoarseDryDeposition returns a function that calculates coarse particle
+// removal by dry deposition. The function argument represents the array
+// indices of coarse particulate matter. If the CTM data does not include
+// a coarse particle dry deposition velocity, the PM2.5 velocity is used
+// instead.
+func CoarseDryDeposition(indices func() CoarsePM) inmap.CellManipulator {
+	coarse := indices()
+	return func(c *inmap.Cell, Δt float64) {
+		if c.Layer == 0 {
+			vd := c.CoarseParticleDryDep
+			if vd == 0 {
+				vd = c.ParticleDryDep
+			}
+			fac := math.Exp(-vd / c.Dz * Δt)
+			for _, i := range coarse {
+				c.Cf[i] -= c.Ci[i] - c.Ci[i]*fac
+			}
+		}
+	}
+}
@@ -19,6 +19,7 @@ along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
 package simpledrydep_test
 
 import (
+	"math"
 	"testing"
 
 	"github.com/yuzhou-wang/inmap"
@@ -89,3 +90,33 @@ func TestDryDeposition(t *testing.T) {
 		}
 	}
 }
+
+func TestCoarseDryDeposition(t *testing.T) {
+	f := simpledrydep.CoarseDryDeposition(func() simpledrydep.CoarsePM { return simpledrydep.CoarsePM{1} })
+	for _, test := range []struct {
+		name       string
+		vd, vdWant float64
+	}{
+		{name: "coarse", vd: 0.01, vdWant: 0.01},
+		{name: "missing", vd: 0, vdWant: 0.001}, // Falls back to the PM2.5 velocity.
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := &inmap.Cell{
+				Ci:                   []float64{1, 1},
+				Cf:                   []float64{1, 1},
+				Dz:                   50,
+				ParticleDryDep:       0.001,
+				CoarseParticleDryDep: test.vd,
+			}
+			const Δt = 100.
+			f(c, Δt)
+			if c.Cf[0] != 1 {
+				t.Errorf("fine particles: have %g, want 1", c.Cf[0])
+			}
+			want := math.Exp(-test.vdWant / c.Dz * Δt)
+			if math.Abs(c.Cf[1]-want) > 1.e-12 {
+				t.Errorf("coarse particles: have %g, want %g", c.Cf[1], want)
+			}
+		})
+	}
+}
@@ -49,9 +49,9 @@ func TestConvectiveMixing(t *testing.T) {
 	}
 
 	for _, c := range d.Cells() {
-		val := c.M2u - c.M2d + (*c.above)[0].M2d*(*c.above)[0].Dz/c.Dz
+		val := c.M2u - c.M2d + c.above[0].M2d*c.above[0].Dz/c.Dz
 		if absDifferent(val, 0, testTolerance) {
-			t.Error(c.Layer, val, c.M2u, c.M2d, (*c.above)[0].M2d)
+			t.Error(c.Layer, val, c.M2u, c.M2d, c.above[0].M2d)
 		}
 	}
 }
@@ -177,6 +177,138 @@ func TestAdvection(t *testing.T) {
 	}
 }
 
+// Test whether mass is conserved and concentrations stay positive during
+// second-order advection.
+func TestVanLeerAdvection(t *testing.T) {
+	const tolerance = 1.e-8
+	nsteps := 10
+
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	emis := NewEmissions()
+
+	mutator, err := PopulationMutator(cfg, popIndices)
+	if err != nil {
+		t.Error(err)
+	}
+	var m Mech
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+			cfg.MutateGrid(mutator, ctmdata, pop, mr, emis, m, nil),
+			SetTimestepCFL(),
+		},
+		RunFuncs: []DomainManipulator{
+			Calculations(AddEmissionsFlux()),
+			Calculations(VanLeerAdvection()),
+			SteadyStateConvergenceCheck(nsteps, cfg.PopGridColumn, m, nil),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Error(err)
+	}
+
+	var cellGroups = []*cellList{d.cells, d.westBoundary, d.eastBoundary,
+		d.northBoundary, d.southBoundary, d.topBoundary}
+	for _, testCell := range *d.cells {
+		for _, group := range cellGroups {
+			for _, c := range *group {
+				c.Ci[0] = 0
+				c.Cf[0] = 0
+			}
+		}
+		ResetCells()(d)
+		for tt := 0; tt < nsteps; tt++ {
+			testCell.Ci[0] += E / testCell.Dz / testCell.Dy / testCell.Dx
+			testCell.Cf[0] += E / testCell.Dz / testCell.Dy / testCell.Dx
+
+			if err := d.Run(); err != nil {
+				t.Error(err)
+			}
+		}
+		sum := 0.
+		for _, group := range cellGroups {
+			for _, c := range *group {
+				val := c.Cf[0] * c.Dy * c.Dx * c.Dz
+				if val < 0 {
+					t.Fatalf("cell %v emis: negative concentration", testCell)
+				}
+				sum += val
+			}
+		}
+		if different(sum, E*float64(nsteps), tolerance) {
+			t.Errorf("cell %v emis: sum=%.12g (it should equal %v)\n", testCell, sum, E*float64(nsteps))
+		}
+	}
+}
+
+func TestVanLeerFace(t *testing.T) {
+	for _, test := range []struct {
+		name              string
+		cuu, cu, cd, ν, w float64
+	}{
+		{name: "uniform gradient", cuu: 1, cu: 2, cd: 3, ν: 0, w: 2.5},
+		{name: "Courant number", cuu: 1, cu: 2, cd: 3, ν: 0.5, w: 2.25},
+		{name: "Courant number 1", cuu: 1, cu: 2, cd: 3, ν: 1, w: 2},
+		{name: "steep downwind", cuu: 1, cu: 2, cd: 5, ν: 0, w: 2.75},
+		{name: "maximum", cuu: 1, cu: 2, cd: 1, ν: 0, w: 2},
+		{name: "minimum", cuu: 2, cu: 1, cd: 2, ν: 0, w: 1},
+		{name: "flat", cuu: 2, cu: 2, cd: 3, ν: 0, w: 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if have := vanLeerFace(test.cuu, test.cu, test.cd, test.ν); different(have, test.w, 1.e-12) {
+				t.Errorf("have %g, want %g", have, test.w)
+			}
+		})
+	}
+}
+
+// Second-order advection should be less diffusive than upwind advection,
+// so the emitted mass should be spread across fewer cells, and the
+// mass-weighted average concentration should be higher.
+func TestVanLeerAdvectionDiffusion(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		Geom: geom.Point{X: -3999, Y: -3999},
+		PM25: E,
+	})
+	mutator, err := PopulationMutator(cfg, popIndices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Mech
+	meanConc := func(advection CellManipulator) float64 {
+		d := &InMAP{
+			InitFuncs: []DomainManipulator{
+				cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+				cfg.MutateGrid(mutator, ctmdata, pop, mr, emis, m, nil),
+				SetTimestepCFL(),
+			},
+			RunFuncs: []DomainManipulator{
+				Calculations(AddEmissionsFlux()),
+				Calculations(advection),
+				SteadyStateConvergenceCheck(50, cfg.PopGridColumn, m, nil),
+			},
+		}
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Run(); err != nil {
+			t.Fatal(err)
+		}
+		var mass, weighted float64
+		for _, c := range *d.cells {
+			mass += c.Cf[iPM2_5] * c.Volume
+			weighted += c.Cf[iPM2_5] * c.Cf[iPM2_5] * c.Volume
+		}
+		return weighted / mass
+	}
+	upwind, vanLeer := meanConc(UpwindAdvection()), meanConc(VanLeerAdvection())
+	if vanLeer <= upwind {
+		t.Errorf("mass-weighted concentration with van Leer advection (%g) should be greater than with upwind advection (%g)", vanLeer, upwind)
+	}
+}
+
 // Test whether mass is conserved during meander mixing.
 func TestMeanderMixing(t *testing.T) {
 	const tolerance = 1.e-8
@@ -249,3 +381,59 @@ func absDifferent(a, b, tolerance float64) bool {
 	}
 	return false
 }
+
+// BenchmarkScience measures the speed of the transport calculations
+// on the test grid.
+func BenchmarkScience(b *testing.B) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	emis := NewEmissions()
+	emis.Add(&EmisRecord{
+		SOx:  E,
+		NOx:  E,
+		PM25: E,
+		VOC:  E,
+		NH3:  E,
+		Geom: geom.Point{X: -3999, Y: -3999.},
+	}) // ground level emissions
+
+	mutator, err := PopulationMutator(cfg, popIndices)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var m Mech
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+			cfg.MutateGrid(mutator, ctmdata, pop, mr, emis, m, nil),
+			SetTimestepCFL(),
+		},
+		RunFuncs: []DomainManipulator{
+			Calculations(AddEmissionsFlux()),
+			Calculations(UpwindAdvection(), Mixing(), MeanderMixing()),
+			SteadyStateConvergenceCheck(10, cfg.PopGridColumn, m, nil),
+		},
+	}
+	if err := d.Init(); err != nil {
+		b.Fatal(err)
+	}
+	if err := d.Run(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, f := range []struct {
+		name string
+		f    CellManipulator
+	}{
+		{name: "UpwindAdvection", f: UpwindAdvection()},
+		{name: "Mixing", f: Mixing()},
+		{name: "MeanderMixing", f: MeanderMixing()},
+	} {
+		b.Run(f.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, c := range *d.cells {
+					f.f(c.Cell, d.Dt)
+				}
+			}
+		})
+	}
+}
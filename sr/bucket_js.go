@@ -0,0 +1,32 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sr
+
+import (
+	"context"
+	"fmt"
+
+	"gocloud.dev/blob"
+)
+
+// openBucket returns an error because storage buckets are not supported
+// in WebAssembly builds, where SR matrices must be read over HTTP.
+func openBucket(ctx context.Context, bucketName string) (*blob.Bucket, error) {
+	return nil, fmt.Errorf("sr: storage bucket %s cannot be opened in a WebAssembly build; use an HTTP URL instead", bucketName)
+}
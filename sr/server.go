@@ -0,0 +1,346 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sr
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+	"github.com/yuzhou-wang/inmap"
+)
+
+// Server is an HTTP handler that answers queries of an SR matrix, so that
+// web tools and clients in other languages can use it interactively.
+// Requests and responses are in JSON format. The endpoints are:
+//
+//	GET  /info: information about the SR matrix (see ServerInfo).
+//	GET  /source?pollutant=<p>&layer=<l>&index=<i>[&realization=<r>]: the
+//	     concentrations [μg/m³] caused by 1 μg/s of emissions of pollutant
+//	     p from SR layer index l and grid cell index i, optionally for
+//	     realization r (see Reader.SourceRealization).
+//	POST /predict: the concentrations and other output variables
+//	     resulting from the emissions in the request body, with their
+//	     uncertainty ranges if the SR matrix has additional realizations
+//	     (see PredictRequest and PredictResponse).
+//
+// If a Surrogate has been set for the Reader (see Reader.SetSurrogate),
+// predictions are made using it, which is faster but approximate.
+type Server struct {
+	r               *Reader
+	trans           proj.Transformer
+	outputVariables map[string]string
+
+	// mu prevents concurrent predictions, because setting the
+	// concentrations in the Reader is not concurrency-safe.
+	mu sync.Mutex
+
+	mux *http.ServeMux
+}
+
+// NewServer returns a new Server for the SR matrix in r. gridSR is the
+// spatial reference of the SR matrix grid, and outputVariables specifies
+// the results that are returned by the predict endpoint, in the same
+// format as for Reader.Output.
+func NewServer(r *Reader, gridSR *proj.SR, outputVariables map[string]string) (*Server, error) {
+	lonLat, err := proj.Parse("+proj=longlat")
+	if err != nil {
+		return nil, err
+	}
+	trans, err := lonLat.NewTransform(gridSR)
+	if err != nil {
+		return nil, fmt.Errorf("sr: creating server: %v", err)
+	}
+	// Check that the output variables are valid before any requests are made.
+	zero, err := r.Concentrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.SetConcentrations(zero); err != nil {
+		return nil, err
+	}
+	if _, err := r.Results(outputVariables, nil); err != nil {
+		return nil, fmt.Errorf("sr: creating server: %v", err)
+	}
+	s := &Server{
+		r:               r,
+		trans:           trans,
+		outputVariables: outputVariables,
+		mux:             http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/info", s.info)
+	s.mux.HandleFunc("/source", s.source)
+	s.mux.HandleFunc("/predict", s.predict)
+	return s, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ServerInfo is the response to a request to the info endpoint of a Server.
+type ServerInfo struct {
+	// Layers are the vertical layers in the SR matrix, in the order
+	// of the layer indices used by the source endpoint.
+	Layers []int
+
+	// NumCells is the number of ground-level grid cells.
+	NumCells int
+
+	// Realizations is the number of additional realizations in the
+	// SR matrix (see Reader.Realizations).
+	Realizations int
+
+	// Pollutants are the pollutants that can be queried.
+	Pollutants []string
+
+	// OutputVariables are the output variables returned by the
+	// predict endpoint.
+	OutputVariables map[string]string
+
+	// SurrogateError is the approximation error of each pollutant in
+	// each layer if predictions are made using a Surrogate
+	// (see Surrogate.Error).
+	SurrogateError map[string][]float64 `json:",omitempty"`
+}
+
+func (s *Server) info(w http.ResponseWriter, r *http.Request) {
+	info := ServerInfo{
+		Layers:          s.r.layers,
+		NumCells:        s.r.nCellsGroundLevel,
+		Realizations:    s.r.realizations,
+		Pollutants:      polNames,
+		OutputVariables: s.outputVariables,
+	}
+	if sg := s.r.surrogate; sg != nil {
+		info.SurrogateError = sg.Error
+	}
+	writeJSON(w, info)
+}
+
+func (s *Server) source(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	layer, err := strconv.Atoi(q.Get("layer"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid layer: %v", err), http.StatusBadRequest)
+		return
+	}
+	index, err := strconv.Atoi(q.Get("index"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid index: %v", err), http.StatusBadRequest)
+		return
+	}
+	if layer < 0 || index < 0 {
+		http.Error(w, "layer and index must not be negative", http.StatusBadRequest)
+		return
+	}
+	var realization int
+	if rs := q.Get("realization"); rs != "" {
+		if realization, err = strconv.Atoi(rs); err != nil {
+			http.Error(w, fmt.Sprintf("invalid realization: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	c, err := s.r.SourceRealization(q.Get("pollutant"), realization, layer, index)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, c)
+}
+
+// PredictRequest is the body of a request to the predict endpoint of
+// a Server.
+type PredictRequest struct {
+	// Units are the units of the emissions; options are tons/year,
+	// kg/year, ug/s, and μg/s. The default is μg/s.
+	Units string
+
+	// Emissions are the emissions sources.
+	Emissions []PointEmissions
+}
+
+// PointEmissions are the emissions from a point source.
+type PointEmissions struct {
+	// Lon and Lat are the location of the source in decimal degrees.
+	Lon, Lat float64
+
+	VOC, NOx, NH3, SOx, PM25 float64
+
+	// Height, Diam, Temp, and Velocity are the stack height [m],
+	// diameter [m], temperature [K], and exit velocity [m/s]. Emissions
+	// are at ground level if Height is zero.
+	Height, Diam, Temp, Velocity float64
+
+	// EffectiveHeight is the effective release height [m], including
+	// plume rise. If it is not zero, it is used instead of calculating
+	// plume rise from the stack parameters, and the results are
+	// interpolated between the SR matrix layers above and below it.
+	EffectiveHeight float64 `json:",omitempty"`
+}
+
+// PredictResponse is the response to a request to the predict endpoint
+// of a Server.
+type PredictResponse struct {
+	// Results holds the value of each output variable in each
+	// ground-level grid cell.
+	Results map[string][]float64
+
+	// Sums holds the sum of each output variable across all grid cells,
+	// for example the total number of deaths.
+	Sums map[string]float64
+
+	// Low and High hold the minimum and maximum of each output variable
+	// in each grid cell among the central estimate and the additional
+	// realizations in the SR matrix (see Reader.Realizations), and
+	// SumsLow and SumsHigh hold the minimum and maximum of the sums.
+	// They are empty if the SR matrix does not have additional realizations.
+	Low, High         map[string][]float64 `json:",omitempty"`
+	SumsLow, SumsHigh map[string]float64   `json:",omitempty"`
+
+	// SurrogateError is the largest approximation error of the Surrogate
+	// that was used to calculate Results and Sums, if any
+	// (see Surrogate.MaxError).
+	SurrogateError float64 `json:",omitempty"`
+
+	// Warning is not empty if the results may be inaccurate, for example
+	// because some emissions were above the top layer of the SR matrix.
+	Warning string `json:",omitempty"`
+}
+
+func (s *Server) predict(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "predict requests must use the POST method", http.StatusMethodNotAllowed)
+		return
+	}
+	var req PredictRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Units == "" {
+		req.Units = "μg/s"
+	}
+	conv, err := inmap.EmisConversionFactor(req.Units)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	emis := make([]*inmap.EmisRecord, len(req.Emissions))
+	for i, e := range req.Emissions {
+		g, err := geom.Point{X: e.Lon, Y: e.Lat}.Transform(s.trans)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("emissions source %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		emis[i] = &inmap.EmisRecord{
+			Geom:     g,
+			VOC:      e.VOC * conv,
+			NOx:      e.NOx * conv,
+			NH3:      e.NH3 * conv,
+			SOx:      e.SOx * conv,
+			PM25:     e.PM25 * conv,
+			Height:   e.Height,
+			Diam:     e.Diam,
+			Temp:     e.Temp,
+			Velocity: e.Velocity,
+		}
+		if e.EffectiveHeight != 0 {
+			emis[i].ReleaseBottom = e.EffectiveHeight
+			emis[i].ReleaseTop = e.EffectiveHeight
+		}
+	}
+
+	var resp PredictResponse
+	if sg := s.r.surrogate; sg != nil {
+		resp.SurrogateError = sg.MaxError()
+	}
+	conc, err := s.r.ConcentrationRealizations(0, emis...)
+	if err != nil {
+		if _, ok := err.(AboveTopErr); !ok {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.Warning = fmt.Sprintf("%v; calculating concentrations for emissions in SR matrix top layer", err)
+	}
+
+	results := make([]map[string][]float64, len(conc))
+	s.mu.Lock()
+	for i, c := range conc {
+		if err = s.r.SetConcentrations(c); err != nil {
+			break
+		}
+		if results[i], err = s.r.Results(s.outputVariables, nil); err != nil {
+			break
+		}
+	}
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Results, resp.Sums = results[0], sums(results[0])
+	if len(results) > 1 {
+		resp.Low, resp.High = make(map[string][]float64), make(map[string][]float64)
+		resp.SumsLow, resp.SumsHigh = make(map[string]float64), make(map[string]float64)
+		for i, r := range results {
+			rSums := sums(r)
+			for k, v := range r {
+				if i == 0 {
+					resp.Low[k] = append([]float64{}, v...)
+					resp.High[k] = append([]float64{}, v...)
+					resp.SumsLow[k], resp.SumsHigh[k] = rSums[k], rSums[k]
+					continue
+				}
+				for j, vv := range v {
+					resp.Low[k][j] = math.Min(resp.Low[k][j], vv)
+					resp.High[k][j] = math.Max(resp.High[k][j], vv)
+				}
+				resp.SumsLow[k] = math.Min(resp.SumsLow[k], rSums[k])
+				resp.SumsHigh[k] = math.Max(resp.SumsHigh[k], rSums[k])
+			}
+		}
+	}
+	writeJSON(w, resp)
+}
+
+// sums returns the sum of each of the results across all grid cells.
+func sums(results map[string][]float64) map[string]float64 {
+	o := make(map[string]float64, len(results))
+	for k, v := range results {
+		for _, vv := range v {
+			o[k] += vv
+		}
+	}
+	return o
+}
+
+// writeJSON writes v to w in JSON format.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
+	"github.com/yuzhou-wang/inmap"
+)
+
+func TestServer(t *testing.T) {
+	r, err := Open(context.Background(), goldenSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	gridSR, err := proj.Parse("+proj=lcc +lat_1=33.000000 +lat_2=45.000000 +lat_0=40.000000 +lon_0=-97.000000 +x_0=0 +y_0=0 +a=6370997.000000 +b=6370997.000000 +to_meter=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(r, gridSR, map[string]string{
+		"TotalPM25": "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA",
+		"TotalPopD": "(exp(log(1.078)/10 * TotalPM25) - 1) * TotalPop * allcause / 100000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	t.Run("info", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/info")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var info ServerInfo
+		if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(info.Layers, []int{0, 2, 4}) || info.NumCells != 10 {
+			t.Errorf("info: %+v", info)
+		}
+	})
+
+	t.Run("source", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/source?pollutant=pSO4&layer=1&index=4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var have []float64
+		if err := json.NewDecoder(resp.Body).Decode(&have); err != nil {
+			t.Fatal(err)
+		}
+		want, err := r.Source("pSO4", 1, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("have %v, want %v", have, want)
+		}
+
+		resp, err = http.Get(server.URL + "/source?pollutant=xxx&layer=1&index=4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("invalid pollutant status: %s", resp.Status)
+		}
+	})
+
+	t.Run("predict", func(t *testing.T) {
+		// (-97, 40) is the origin of the grid projection.
+		body, err := json.Marshal(PredictRequest{
+			Units:     "ug/s",
+			Emissions: []PointEmissions{{Lon: -97, Lat: 40, PM25: 1, SOx: 2}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(server.URL+"/predict", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal(resp.Status)
+		}
+		var have PredictResponse
+		if err := json.NewDecoder(resp.Body).Decode(&have); err != nil {
+			t.Fatal(err)
+		}
+		c, err := r.Concentrations(&inmap.EmisRecord{Geom: geom.Point{}, PM25: 1, SOx: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sum float64
+		for i, w := range c.TotalPM25() {
+			v := have.Results["TotalPM25"][i]
+			if math.Abs(w-v)*2/(w+v) > 1.e-10 {
+				t.Errorf("row %d: want %v but have %v", i, w, v)
+			}
+			sum += v
+		}
+		if math.Abs(have.Sums["TotalPM25"]-sum) > 1.e-20 {
+			t.Errorf("sum: have %g, want %g", have.Sums["TotalPM25"], sum)
+		}
+		if have.Sums["TotalPopD"] <= 0 {
+			t.Errorf("TotalPopD should be positive but is %g", have.Sums["TotalPopD"])
+		}
+
+		resp, err = http.Get(server.URL + "/predict")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("GET status: %s", resp.Status)
+		}
+	})
+
+	t.Run("effective height", func(t *testing.T) {
+		body, err := json.Marshal(PredictRequest{
+			Emissions: []PointEmissions{{Lon: -97, Lat: 40, PM25: 1, EffectiveHeight: 100}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(server.URL+"/predict", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var have PredictResponse
+		if err := json.NewDecoder(resp.Body).Decode(&have); err != nil {
+			t.Fatal(err)
+		}
+		c, err := r.Concentrations(&inmap.EmisRecord{Geom: geom.Point{}, PM25: 1, ReleaseBottom: 100, ReleaseTop: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, w := range c.TotalPM25() {
+			v := have.Results["TotalPM25"][i]
+			if math.Abs(w-v)*2/(w+v) > 1.e-10 {
+				t.Errorf("row %d: want %v but have %v", i, w, v)
+			}
+		}
+	})
+
+	if _, err := NewServer(r, gridSR, map[string]string{"x": "xxx"}); err == nil {
+		t.Error("invalid output variables should cause an error")
+	}
+}
@@ -1,3 +1,5 @@
+//go:build !js
+
 /*
 Copyright © 2013 the InMAP authors.
 This file is part of InMAP.
@@ -59,6 +61,31 @@ type SR struct {
 
 	// tempDir is a temporary directory for staging input and output files.
 	tempDir string
+
+	// skip holds the indices of source grid cells that have already
+	// been completed and should be skipped by Start and Save.
+	skip map[int]bool
+
+	// Realizations is the number of additional realizations of the
+	// source-receptor relationships, such as from simulations with
+	// perturbed parameters or with meteorology from different seasons,
+	// that new SR matrix files have room for in addition to the central
+	// estimate. It is used to estimate the uncertainty in the results
+	// (see Reader.ConcentrationRealizations).
+	Realizations int
+
+	// Realization is the realization that Start, Save, Resume, and Clean
+	// operate on. Zero is the central estimate, and 1 through Realizations
+	// are the additional realizations. The simulations for each
+	// realization are started separately, with the configuration for
+	// that realization.
+	Realization int
+
+	// Workers is the number of simulations that Start runs at the same
+	// time, and Retries is the number of times that each simulation is
+	// retried if it fails or is interrupted (see cloud.Queue).
+	Workers int32
+	Retries int
 }
 
 // NewSR initializes an SR object.
@@ -118,6 +145,9 @@ func (sr *SR) layerGridCells(layers []int) (int, error) {
 // grid where the computations should begin and end. if end<0, then end will
 // be set to the last grid cell in the static grid.
 // Version is the version of the InMAP docker container to use, e.g. "latest" or "v1.7.2".
+// The simulations are the tasks of a single work queue job
+// (see cloud.Queue) that is run by sr.Workers workers, and their results are
+// written to the storage bucket of the cluster.
 func (sr *SR) Start(ctx context.Context, jobName, version string, layers []int, begin, end int, root *cobra.Command, config *viper.Viper, cmdArgs, inputFiles []string, memoryGB int32) error {
 	// Set mandatory configuration variables.
 	config.Set("OutputVariables", outputVarsStr)
@@ -137,15 +167,16 @@ func (sr *SR) Start(ctx context.Context, jobName, version string, layers []int,
 	if l := len(sr.d.Cells()); end < 0 || end > l {
 		end = l
 	}
+	q := cloud.NewQueue(sr.queueName(jobName), version, memoryGB)
+	q.Workers, q.Retries = sr.Workers, sr.Retries
 	for i := 0; i < len(sr.d.Cells()); i++ {
 		cell := sr.d.Cells()[i]
 		_, layerok := layersMap[cell.Layer]
 		if i >= end || cell.Layer > maxLayer {
 			break
-		} else if i < begin || !layerok {
+		} else if i < begin || !layerok || sr.skip[i] {
 			continue
 		}
-		log.Println("starting", i)
 
 		// Create emissions shapefile for this source location.
 		fname, err := sr.writeEmisShapefile(i, cell)
@@ -154,38 +185,56 @@ func (sr *SR) Start(ctx context.Context, jobName, version string, layers []int,
 		}
 		config.Set("EmissionsShapefiles", []string{fname})
 
-		js, err := cloud.JobSpec(root, config, version, sr.jobName(jobName, i, cell), cmdArgs, inputFiles, memoryGB)
+		js, err := cloud.JobSpec(root, config, version, taskName(i, cell), cmdArgs, inputFiles, memoryGB)
 		if err != nil {
 			return err
 		}
-
-		err = backoff.RetryNotify(
-			func() error {
-				// Start the simulation.
-				_, err = sr.client.RunJob(ctx, js)
-				if err != nil {
-					if strings.Contains(err.Error(), "already exists") {
-						log.Println(err)
-					} else {
-						return fmt.Errorf("sr: starting index %d layer %d: %v", i, cell.Layer, err)
-					}
-				}
-				return nil
-			},
-			backoff.NewExponentialBackOff(),
-			func(err error, d time.Duration) {
-				log.Printf("%v: retrying in %v", err, d)
-			},
-		)
-		if err != nil {
+		if err := q.Add(js); err != nil {
 			return err
 		}
 	}
-	return nil
+	if q.Len() == 0 {
+		return nil
+	}
+	js, err := q.JobSpec()
+	if err != nil {
+		return err
+	}
+	log.Printf("starting %d simulations", q.Len())
+
+	return backoff.RetryNotify(
+		func() error {
+			// Start the simulations.
+			_, err = sr.client.RunJob(ctx, js)
+			if err != nil {
+				if strings.Contains(err.Error(), "already exists") {
+					log.Println(err)
+				} else {
+					return fmt.Errorf("sr: starting simulations: %v", err)
+				}
+			}
+			return nil
+		},
+		backoff.NewExponentialBackOff(),
+		func(err error, d time.Duration) {
+			log.Printf("%v: retrying in %v", err, d)
+		},
+	)
+}
+
+// queueName returns the name of the work queue job that runs the
+// simulations for the current realization.
+func (sr *SR) queueName(jobName string) string {
+	if sr.Realization > 0 {
+		return fmt.Sprintf("%s-r%d", jobName, sr.Realization)
+	}
+	return jobName
 }
 
-func (sr *SR) jobName(jobName string, i int, cell *inmap.Cell) string {
-	return fmt.Sprintf("%s-%d-%d", jobName, i, cell.Layer)
+// taskName returns the name of the simulation for SR index i in the
+// work queue job.
+func taskName(i int, cell *inmap.Cell) string {
+	return fmt.Sprintf("%d-%d", i, cell.Layer)
 }
 
 // writeEmisShapefile writes an emissions input shapefile for SR index i
@@ -266,6 +315,9 @@ func (sr *SR) Save(ctx context.Context, outfile, jobName string, layers []int, b
 	}
 	defer ff.Close()
 	defer os.RemoveAll(sr.tempDir)
+	if v := realizationVar("PrimaryPM25", sr.Realization); f.Header.Lengths(v) == nil {
+		return fmt.Errorf("sr: SR netcdf file %s does not have room for realization %d", outfile, sr.Realization)
+	}
 
 	var maxLayer int
 	for _, l := range layers {
@@ -274,17 +326,7 @@ func (sr *SR) Save(ctx context.Context, outfile, jobName string, layers []int, b
 		}
 	}
 	cells := sr.d.Cells()
-
-	// Figure out the starting index for each layer.
-	layerStarts := make(map[int]int)
-	var il = -1
-	for i, c := range cells {
-		l := c.Layer
-		if il != l {
-			il = l
-			layerStarts[l] = i
-		}
-	}
+	layerStarts := sr.layerStarts()
 
 	// Make a map between the model layers and the SR layers.
 	layerMap := make(map[int]int)
@@ -308,6 +350,7 @@ func (sr *SR) Save(ctx context.Context, outfile, jobName string, layers []int, b
 				result, err := sr.results(ctx, jobName, i, cell)
 				if err != nil {
 					errChan <- err
+					continue
 				}
 				for name, species := range outputVars {
 					data, ok := result[name]
@@ -329,7 +372,7 @@ func (sr *SR) Save(ctx context.Context, outfile, jobName string, layers []int, b
 					begin := []int{l, row, 0}
 					end := []int{l, row, len(data32)}
 					lock.Lock()
-					w := f.Writer(species, begin, end)
+					w := f.Writer(realizationVar(species, sr.Realization), begin, end)
 					if _, err := w.Write(data32); err != nil {
 						lock.Unlock()
 						errChan <- fmt.Errorf("sr: writing results for for row=%v, layer=%v: %v", i, cell.Layer, err)
@@ -347,7 +390,7 @@ func (sr *SR) Save(ctx context.Context, outfile, jobName string, layers []int, b
 		_, layerok := layerMap[cell.Layer]
 		if i >= end || cell.Layer > maxLayer {
 			break
-		} else if i < begin || !layerok {
+		} else if i < begin || !layerok || sr.skip[i] {
 			continue
 		}
 		jobChan <- i
@@ -366,6 +409,202 @@ func (sr *SR) Save(ctx context.Context, outfile, jobName string, layers []int, b
 	return nil
 }
 
+// layerStarts returns the index of the first grid cell in each layer.
+func (sr *SR) layerStarts() map[int]int {
+	layerStarts := make(map[int]int)
+	var il = -1
+	for i, c := range sr.d.Cells() {
+		l := c.Layer
+		if il != l {
+			il = l
+			layerStarts[l] = i
+		}
+	}
+	return layerStarts
+}
+
+// Completed returns the indices in the static variable grid of the source
+// grid cells whose results have already been saved to the SR matrix in
+// outfile, which is expected to have been created for the given layers.
+// Source grid cells are considered complete if any of their
+// source-receptor relationships are non-zero. If outfile does not exist,
+// no grid cells are complete.
+func (sr *SR) Completed(outfile string, layers []int) (map[int]bool, error) {
+	completed := make(map[int]bool)
+	ff, err := os.Open(outfile)
+	if os.IsNotExist(err) {
+		return completed, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("sr: opening SR netcdf file: %v", err)
+	}
+	defer ff.Close()
+	f, err := cdf.Open(ff)
+	if err != nil {
+		return nil, fmt.Errorf("sr: opening SR netcdf file: %v", err)
+	}
+	nGridCells, err := sr.layerGridCells(layers)
+	if err != nil {
+		return nil, err
+	}
+	if l := f.Header.Lengths("layers"); len(l) != 1 || l[0] != len(layers) {
+		return nil, fmt.Errorf("sr: SR netcdf file %s has a different number of layers than %v", outfile, layers)
+	}
+	r := f.Reader("layers", nil, nil)
+	buf := r.Zero(-1)
+	if _, err = r.Read(buf); err != nil {
+		return nil, fmt.Errorf("sr: reading SR netcdf layers: %v", err)
+	}
+	for i, l := range buf.([]int32) {
+		if int(l) != layers[i] {
+			return nil, fmt.Errorf("sr: SR netcdf file %s was created for layers %v, not %v", outfile, buf, layers)
+		}
+	}
+	if l := f.Header.Lengths("PrimaryPM25"); len(l) != 3 || l[1] != nGridCells {
+		return nil, fmt.Errorf("sr: SR netcdf file %s was created for a different grid", outfile)
+	}
+	pmVar := realizationVar("PrimaryPM25", sr.Realization)
+	if f.Header.Lengths(pmVar) == nil {
+		return nil, fmt.Errorf("sr: SR netcdf file %s does not have room for realization %d", outfile, sr.Realization)
+	}
+
+	layerStarts := sr.layerStarts()
+	for i, c := range sr.d.Cells() {
+		for l, layer := range layers {
+			if c.Layer != layer {
+				continue
+			}
+			row := i - layerStarts[c.Layer]
+			r := f.Reader(pmVar, []int{l, row, 0}, []int{l, row, nGridCells - 1})
+			buf := r.Zero(-1)
+			if _, err := r.Read(buf); err != nil {
+				return nil, fmt.Errorf("sr: reading SR netcdf file: %v", err)
+			}
+			for _, v := range buf.([]float32) {
+				if v != 0 {
+					completed[i] = true
+					break
+				}
+			}
+		}
+	}
+	return completed, nil
+}
+
+// Resume prepares the receiver to continue creating the SR matrix in
+// outfile after an interruption, for example when some of the simulations
+// have failed or only some of the results have been saved. Afterwards,
+// Start and Save will skip the source grid cells that have already been
+// saved to outfile (see Completed). layers specifies the grid layers
+// that the SR matrix is calculated for.
+func (sr *SR) Resume(outfile string, layers []int) error {
+	completed, err := sr.Completed(outfile, layers)
+	if err != nil {
+		return err
+	}
+	log.Printf("sr: %d source grid cells have already been completed", len(completed))
+	sr.skip = completed
+	return nil
+}
+
+// Extend creates a new SR matrix in outfile for the current variable grid
+// from the existing SR matrix in oldfile, which was created for a previous
+// version of the grid, for example before some grid cells were refined.
+// The results for source grid cells that are in the same location and
+// layer in both grids are copied from oldfile, with the concentrations
+// at the receptors regridded to the current grid if the ground-level grid
+// has changed. Afterwards, Resume can be used so that Start and Save only
+// run simulations for the new source grid cells. layers specifies the grid
+// layers that the new SR matrix should be calculated for. The additional
+// realizations in oldfile are also copied, if the new SR matrix has room
+// for them. outfile must not already exist.
+func (sr *SR) Extend(oldfile, outfile string, layers []int) error {
+	if _, err := os.Stat(outfile); err == nil {
+		return fmt.Errorf("sr: extending SR matrix: %s already exists", outfile)
+	}
+	oldf, err := os.Open(oldfile)
+	if err != nil {
+		return fmt.Errorf("sr: opening SR netcdf file: %v", err)
+	}
+	defer oldf.Close()
+	old, err := NewReader(oldf)
+	if err != nil {
+		return fmt.Errorf("sr: opening SR netcdf file: %v", err)
+	}
+
+	// Find the source grid cells in the old SR matrix.
+	type source struct {
+		layer int
+		b     geom.Bounds
+	}
+	oldLayers := make(map[int]int)
+	for i, l := range old.layers {
+		oldLayers[l] = i
+	}
+	oldSources := make(map[source]int)
+	for _, c := range old.d.Cells() {
+		if _, ok := oldLayers[c.Layer]; ok {
+			oldSources[source{layer: c.Layer, b: *c.Bounds()}] = old.indices[c]
+		}
+	}
+
+	// Check whether the receptors need to be regridded.
+	oldGrid := old.Geometry()
+	regrid := len(oldGrid) != len(sr.grid)
+	for i := 0; !regrid && i < len(oldGrid); i++ {
+		regrid = *oldGrid[i].Bounds() != *sr.grid[i].Bounds()
+	}
+
+	ff, f, err := sr.createOrOpenOutputFile(outfile, layers)
+	if err != nil {
+		return err
+	}
+	defer ff.Close()
+	var vars []string // The variables to copy.
+	for r := 0; r <= sr.Realizations && r <= old.Realizations(); r++ {
+		for _, pol := range polNames {
+			vars = append(vars, realizationVar(pol, r))
+		}
+	}
+	layerStarts := sr.layerStarts()
+	var n int
+	for i, c := range sr.d.Cells() {
+		for l, layer := range layers {
+			if c.Layer != layer {
+				continue
+			}
+			oldIndex, ok := oldSources[source{layer: c.Layer, b: *c.Bounds()}]
+			if !ok {
+				continue
+			}
+			row := i - layerStarts[c.Layer]
+			for _, pol := range vars {
+				data, err := old.source(pol, oldLayers[c.Layer], oldIndex)
+				if err != nil {
+					return fmt.Errorf("sr: reading SR matrix: %v", err)
+				}
+				if regrid {
+					if data, err = inmap.Regrid(oldGrid, sr.grid, data); err != nil {
+						return fmt.Errorf("sr: regridding SR matrix: %v", err)
+					}
+				}
+				data32 := make([]float32, len(data))
+				for j, v := range data {
+					data32[j] = float32(v)
+				}
+				if _, err := f.Writer(pol, []int{l, row, 0}, []int{l, row, len(data32)}).Write(data32); err != nil {
+					return fmt.Errorf("sr: writing results for row=%v, layer=%v: %v", i, c.Layer, err)
+				}
+			}
+			n++
+		}
+	}
+	log.Printf("sr: copied %d source grid cells from %s", n, oldfile)
+	if err := cdf.UpdateNumRecs(ff); err != nil {
+		return fmt.Errorf("sr: finalizing output NetCDF file: %v", err)
+	}
+	return nil
+}
+
 // results gets the results of the simulation specified by the arguments
 // and regrids them to match the SR grid.
 func (sr *SR) results(ctx context.Context, jobName string, i int, cell *inmap.Cell) (map[string][]float64, error) {
@@ -375,8 +614,12 @@ func (sr *SR) results(ctx context.Context, jobName string, i int, cell *inmap.Ce
 			var err error
 			jobOutput, err = sr.client.Output(ctx, &cloudrpc.JobName{
 				Version: inmap.Version,
-				Name:    sr.jobName(jobName, i, cell),
+				Name:    sr.queueName(jobName) + "/" + taskName(i, cell),
 			})
+			if err != nil && strings.Contains(err.Error(), "has failed") {
+				// Failed simulations have already been retried.
+				return backoff.Permanent(err)
+			}
 			return err
 		},
 		backoff.NewExponentialBackOff(),
@@ -445,45 +688,15 @@ func (sr *SR) results(ctx context.Context, jobName string, i int, cell *inmap.Ce
 	return results, nil
 }
 
-// Clean removes intermediate files created during simulations carried out
-// to create a source-receptor matrix.
-// layers specifies the grid layers that SR relationships
-// should be calculated for. begin and end are indices in the static variable
-// grid where the computations should begin and end. if end<0, then end will
-// be set to the last grid cell in the static grid.
-func (sr *SR) Clean(ctx context.Context, jobName string, layers []int, begin, end int) error {
-
-	var maxLayer int
-	for _, l := range layers {
-		if l > maxLayer {
-			maxLayer = l
-		}
-	}
-
-	layersMap := make(map[int]struct{})
-	for _, l := range layers {
-		layersMap[l] = struct{}{}
-	}
-	if l := len(sr.d.Cells()); end < 0 || end > l {
-		end = l
-	}
-	for i := 0; i < len(sr.d.Cells()); i++ {
-		cell := sr.d.Cells()[i]
-		_, layerok := layersMap[cell.Layer]
-		if i >= end || cell.Layer > maxLayer {
-			break
-		} else if i < begin || !layerok {
-			continue
-		}
-
-		// Delete the job.
-		_, err := sr.client.Delete(ctx, &cloudrpc.JobName{
-			Name:    sr.jobName(jobName, i, cell),
-			Version: inmap.Version,
-		})
-		if err != nil {
-			return fmt.Errorf("sr: cleaning up index %d layer %d: %v", i, cell.Layer, err)
-		}
+// Clean removes the work queue job that runs the simulations carried out
+// to create a source-receptor matrix, along with its intermediate files.
+func (sr *SR) Clean(ctx context.Context, jobName string) error {
+	_, err := sr.client.Delete(ctx, &cloudrpc.JobName{
+		Name:    sr.queueName(jobName),
+		Version: inmap.Version,
+	})
+	if err != nil {
+		return fmt.Errorf("sr: cleaning up: %v", err)
 	}
 	return nil
 }
@@ -525,12 +738,18 @@ func (sr *SR) createOrOpenOutputFile(outfile string, layers []int) (*os.File, *c
 		h.AddVariable("layers", []string{"layers"}, []int32{0})
 		h.AddAttribute("layers", "description", "Layer indices for which the SR calculation was performed")
 
-		for _, k := range sortKeys(outputVars) {
-			vs := outputVars[k]
-			h.AddVariable(vs, []string{"layer", "source", "receptor"},
-				[]float32{0})
-			h.AddAttribute(vs, "description", fmt.Sprintf("%s source-receptor relationships", vs))
-			h.AddAttribute(vs, "units", "μg m-3 concentration at receptor location per μg s-1 emissions at source location")
+		for r := 0; r <= sr.Realizations; r++ {
+			for _, k := range sortKeys(outputVars) {
+				vs := realizationVar(outputVars[k], r)
+				h.AddVariable(vs, []string{"layer", "source", "receptor"},
+					[]float32{0})
+				if r == 0 {
+					h.AddAttribute(vs, "description", fmt.Sprintf("%s source-receptor relationships", vs))
+				} else {
+					h.AddAttribute(vs, "description", fmt.Sprintf("%s source-receptor relationships, realization %d", outputVars[k], r))
+				}
+				h.AddAttribute(vs, "units", "μg m-3 concentration at receptor location per μg s-1 emissions at source location")
+			}
 		}
 		// InMAP data.
 		for _, i := range sortKeys(inmapVars) {
@@ -20,16 +20,24 @@ package sr_test
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/BurntSushi/toml"
 	"github.com/ctessum/cdf"
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/proj"
 	"github.com/gonum/floats"
 	"github.com/yuzhou-wang/inmap"
 	"github.com/yuzhou-wang/inmap/cloud"
@@ -105,7 +113,7 @@ func loadConfig(file string) (*config, error) {
 }
 
 func TestSR(t *testing.T) {
-	checkConfig := func(cmd []string) {
+	checkTask := func(cmd []string) {
 		var foundOutputVars, foundEmisUnits, foundEmissionsShapefiles bool
 		for _, a := range cmd {
 			if strings.Contains(a, "EmissionsShapefiles") {
@@ -138,6 +146,38 @@ func TestSR(t *testing.T) {
 			t.Error("didn't find output variables")
 		}
 	}
+	// checkConfig checks the configuration of each of the simulations in
+	// the work queue job.
+	checkConfig := func(cmd []string) {
+		if !reflect.DeepEqual(cmd[:3], []string{"inmap", "cloud", "work"}) {
+			t.Fatalf("wrong command %v", cmd)
+		}
+		queueFile := strings.TrimPrefix(cmd[3], "--queue=file://")
+		b, err := ioutil.ReadFile(queueFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var q struct {
+			Workers int
+			Tasks   []struct{ Args []string }
+		}
+		if err := json.Unmarshal(b, &q); err != nil {
+			t.Fatal(err)
+		}
+		if q.Workers != 1 {
+			t.Errorf("workers: have %d, want 1", q.Workers)
+		}
+		if len(q.Tasks) == 0 {
+			t.Error("no tasks")
+		}
+		for _, task := range q.Tasks {
+			var args []string
+			for i := 0; i < len(task.Args); i += 2 {
+				args = append(args, task.Args[i]+"="+task.Args[i+1])
+			}
+			checkTask(args)
+		}
+	}
 
 	checkRun := func(o []byte, err error) {
 		if err != nil {
@@ -175,6 +215,7 @@ func TestSR(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	s.Workers = 1
 	outfile := "../cmd/inmap/testdata/testSR.ncf"
 	defer os.Remove(outfile)
 	layers := []int{0, 2, 4}
@@ -196,6 +237,7 @@ func TestSR(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	s.Workers = 1
 	begin = 20 // layer 2
 	end = 22
 	if err = s.Start(ctx, "sr_test", "latest", layers, begin, end, cfg.Root, cfg.Viper, []string{"run", "steady"}, cfg.InputFiles(), 2); err != nil {
@@ -204,11 +246,299 @@ func TestSR(t *testing.T) {
 	if err = s.Save(ctx, outfile, "sr_test", layers, begin, end); err != nil {
 		t.Fatal(err)
 	}
+	if err = s.Clean(ctx, "sr_test"); err != nil {
+		t.Fatal(err)
+	}
+	filepath.Walk("test/test_user/sr_test", func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			t.Errorf("%s should have been deleted", path)
+		}
+		return nil
+	})
 	t.Run("compare ncf", func(t *testing.T) {
 		ncfWithinTol(t, "../cmd/inmap/testdata/testSR.ncf", "../cmd/inmap/testdata/testSR_golden.ncf", 1.e-9)
 	})
 }
 
+func TestSR_resume(t *testing.T) {
+	config, err := loadConfig("../cmd/inmap/configExample.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	varGridFile := strings.TrimSuffix(config.VariableGridData, ".gob") + "_SRresume.gob"
+	saveSRGrid(t, varGridFile)
+	defer os.Remove(varGridFile)
+	varGridReader, err := os.Open(varGridFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := sr.NewSR(varGridReader, &config.VarGrid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "sr_resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	golden, err := ioutil.ReadFile("../cmd/inmap/testdata/testSR_golden.ncf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial := dir + "/partial.ncf"
+	if err = ioutil.WriteFile(partial, golden, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove the results for source 3 in layer 0.
+	f, err := os.OpenFile(partial, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := cdf.Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nCells := cf.Header.Lengths("PrimaryPM25")[1]
+	for _, pol := range []string{"pNH4", "pNO3", "pSO4", "SOA", "PrimaryPM25"} {
+		if _, err := cf.Writer(pol, []int{0, 3, 0}, []int{0, 3, nCells}).Write(make([]float32, nCells)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	completed, err := s.Completed(partial, []int{0, 2, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(completed) != 3*nCells-1 || completed[3] || !completed[4] {
+		t.Errorf("wrong completed cells: %v", completed)
+	}
+	if err := s.Resume(partial, []int{0, 2}); err == nil {
+		t.Error("resuming with the wrong layers should cause an error")
+	}
+
+	extended := dir + "/extended.ncf"
+	if err := s.Extend(partial, extended, []int{0, 2}); err != nil {
+		t.Fatal(err)
+	}
+	completed, err = s.Completed(extended, []int{0, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(completed) != 2*nCells-1 || completed[3] {
+		t.Errorf("wrong completed cells after extending: %v", completed)
+	}
+	if err := s.Extend(partial, extended, []int{0, 2}); err == nil {
+		t.Error("extending into an existing file should cause an error")
+	}
+
+	oldR, err := os.Open(partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oldR.Close()
+	oldSR, err := sr.NewReader(oldR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newR, err := os.Open(extended)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newR.Close()
+	newSR, err := sr.NewReader(newR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 5, nCells - 1} {
+		want, err := oldSR.Source("pSO4", 1, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := newSR.Source("pSO4", 1, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("source %d: have %v, want %v", i, have, want)
+		}
+	}
+}
+
+func TestSR_realizations(t *testing.T) {
+	config, err := loadConfig("../cmd/inmap/configExample.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	varGridFile := strings.TrimSuffix(config.VariableGridData, ".gob") + "_SRrealizations.gob"
+	saveSRGrid(t, varGridFile)
+	defer os.Remove(varGridFile)
+	varGridReader, err := os.Open(varGridFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := sr.NewSR(varGridReader, &config.VarGrid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Realizations = 2
+
+	dir, err := ioutil.TempDir("", "sr_realizations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	layers := []int{0, 2, 4}
+
+	// Create an SR matrix with room for the realizations, where the
+	// central estimate is copied from the golden file.
+	realizations := dir + "/realizations.ncf"
+	if err := s.Extend("../cmd/inmap/testdata/testSR_golden.ncf", realizations, layers); err != nil {
+		t.Fatal(err)
+	}
+	s.Realization = 1
+	completed, err := s.Completed(realizations, layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(completed) != 0 {
+		t.Errorf("realization 1 should not have any completed cells: %v", completed)
+	}
+	s.Realization = 3
+	if _, err := s.Completed(realizations, layers); err == nil {
+		t.Error("a realization that there is no room for should cause an error")
+	}
+
+	// Realizations 1 and 2 are half and twice the central estimate.
+	f, err := os.OpenFile(realizations, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := cdf.Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nCells := cf.Header.Lengths("PrimaryPM25")[1]
+	for _, pol := range []string{"pNH4", "pNO3", "pSO4", "SOA", "PrimaryPM25"} {
+		for l := range layers {
+			for i := 0; i < nCells; i++ {
+				r := cf.Reader(pol, []int{l, i, 0}, []int{l, i, nCells - 1})
+				buf := r.Zero(-1)
+				if _, err := r.Read(buf); err != nil {
+					t.Fatal(err)
+				}
+				for j, factor := range []float32{0.5, 2} {
+					data := make([]float32, nCells)
+					for k, v := range buf.([]float32) {
+						data[k] = v * factor
+					}
+					v := fmt.Sprintf("%s_r%d", pol, j+1)
+					if _, err := cf.Writer(v, []int{l, i, 0}, []int{l, i, nCells}).Write(data); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+		}
+	}
+	f.Close()
+	s.Realization = 2
+	completed, err = s.Completed(realizations, layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(completed) != 3*nCells {
+		t.Errorf("realization 2 should be complete: %v", completed)
+	}
+
+	r, err := sr.Open(context.Background(), realizations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.Realizations() != 2 {
+		t.Fatalf("realizations: have %d, want 2", r.Realizations())
+	}
+	emis := &inmap.EmisRecord{Geom: geom.Point{X: -3500, Y: -3500}, PM25: 1, SOx: 1, Height: 150}
+	c, err := r.ConcentrationRealizations(0, emis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 3 {
+		t.Fatalf("have %d realizations, want 3", len(c))
+	}
+	low, high := sr.ConcentrationRange(c)
+	for i, v := range c[0].TotalPM25() {
+		if v == 0 {
+			t.Errorf("cell %d: concentration should not be zero", i)
+		}
+		for _, tt := range []struct {
+			name string
+			have float64
+			want float64
+		}{
+			{"realization 1", c[1].TotalPM25()[i], v * 0.5},
+			{"realization 2", c[2].TotalPM25()[i], v * 2},
+			{"low", low.TotalPM25()[i], v * 0.5},
+			{"high", high.TotalPM25()[i], v * 2},
+		} {
+			if math.Abs(tt.have-tt.want) > tt.want*1e-6 {
+				t.Errorf("cell %d %s: have %g, want %g", i, tt.name, tt.have, tt.want)
+			}
+		}
+	}
+	if _, err := r.SourceRealization("PrimaryPM25", 3, 0, 0); err == nil {
+		t.Error("a realization that isn't in the SR matrix should cause an error")
+	}
+
+	// The realizations should be copied when extending the SR matrix.
+	extended := dir + "/extended.ncf"
+	if err := s.Extend(realizations, extended, layers); err != nil {
+		t.Fatal(err)
+	}
+	r2, err := sr.Open(context.Background(), extended)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	want, err := r.SourceRealization("pSO4", 2, 1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := r2.SourceRealization("pSO4", 2, 1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("extended realization: have %v, want %v", have, want)
+	}
+
+	// The server should return the uncertainty ranges.
+	gridSR, err := proj.Parse(config.VarGrid.GridProj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := sr.NewServer(r, gridSR, map[string]string{"TotalPM25": "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(sr.PredictRequest{Emissions: []sr.PointEmissions{{Lon: -97, Lat: 40, PM25: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/predict", bytes.NewReader(body)))
+	var resp sr.PredictResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	sum := resp.Sums["TotalPM25"]
+	if sum <= 0 || math.Abs(resp.SumsLow["TotalPM25"]-sum*0.5) > sum*1e-6 || math.Abs(resp.SumsHigh["TotalPM25"]-sum*2) > sum*1e-6 {
+		t.Errorf("wrong uncertainty range: %g, %g, %g", resp.SumsLow["TotalPM25"], sum, resp.SumsHigh["TotalPM25"])
+	}
+}
+
 // ncfWithinTol creates errors if the new and old files are more different
 // than the given floating-point tolerance.
 func ncfWithinTol(t *testing.T, newFile, oldFile string, tol float64) {
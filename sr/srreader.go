@@ -21,6 +21,8 @@ package sr
 import (
 	"context"
 	"fmt"
+	"io"
+	"math"
 	"reflect"
 	"runtime"
 	"strings"
@@ -36,13 +38,27 @@ import (
 	"github.com/yuzhou-wang/inmap/science/chem/simplechem"
 )
 
-// Reader allows the interaction with a NetCDF-formatted source-receptor (SR) database.
+// Reader allows the interaction with a source-receptor (SR) database,
+// which can be in NetCDF or Zarr (see WriteZarr) format.
 type Reader struct {
+	// File is the underlying NetCDF file. It is empty for SR matrices
+	// in other formats.
 	cdf.File
+
+	// data is the underlying SR matrix data.
+	data matrixData
+	// closer closes the underlying storage, if it was opened by the Reader.
+	closer io.Closer
+
 	d                 inmap.InMAP
 	indices           map[*inmap.Cell]int
 	layers            []int // layers are the vertical layers that are represented in the SR matrix.
 	nCellsGroundLevel int   // number of cells in the lowest model layer
+	realizations      int   // number of additional realizations in the SR matrix
+
+	// surrogate, if not nil, is used to calculate concentrations
+	// (see SetSurrogate).
+	surrogate *Surrogate
 
 	// CacheSize specifies the number of records to be held in the memory cache.
 	// Larger numbers lead to faster operation but greater memory use.
@@ -59,19 +75,120 @@ type Reader struct {
 	sourceInit sync.Once
 }
 
+// matrixData is the storage format of an SR matrix.
+type matrixData interface {
+	// variables returns the names of the variables.
+	variables() []string
+
+	// lengths returns the lengths of the dimensions of a variable.
+	lengths(varName string) []int
+
+	// dimensions returns the names of the dimensions of a variable.
+	dimensions(varName string) []string
+
+	// readAll returns all of the values of a variable as a slice
+	// of the variable's type.
+	readAll(varName string) (interface{}, error)
+
+	// row returns the source-receptor relationships of pollutant pol
+	// for source grid cell index in SR layer index layer.
+	row(pol string, layer, index int) ([]float32, error)
+}
+
+// cdfData is an SR matrix in NetCDF format.
+type cdfData struct {
+	f *cdf.File
+}
+
+func (c cdfData) variables() []string                { return c.f.Header.Variables() }
+func (c cdfData) lengths(varName string) []int       { return c.f.Header.Lengths(varName) }
+func (c cdfData) dimensions(varName string) []string { return c.f.Header.Dimensions(varName) }
+
+func (c cdfData) readAll(varName string) (interface{}, error) {
+	r := c.f.Reader(varName, nil, nil)
+	buf := r.Zero(-1)
+	if _, err := r.Read(buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (c cdfData) row(pol string, layer, index int) ([]float32, error) {
+	n := c.f.Header.Lengths(pol)[2]
+	r := c.f.Reader(pol, []int{layer, index, 0}, []int{layer, index, n - 1})
+	buf := r.Zero(-1)
+	if _, err := r.Read(buf); err != nil {
+		return nil, err
+	}
+	return buf.([]float32), nil
+}
+
+// Open opens the SR matrix at path, which can be a NetCDF file or a Zarr
+// store. NetCDF files can be local files or remote files (see OpenStorage).
+// Zarr stores can be local directories or URLs ending in ".zarr" on
+// web servers or in storage buckets (e.g., "s3://bucket/sr.zarr").
+// The returned Reader should be closed after use.
+func Open(ctx context.Context, path string) (*Reader, error) {
+	if isZarr(path) {
+		z, err := openZarr(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		return newReader(z, nil)
+	}
+	s, err := OpenStorage(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReader(s)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	r.closer = s
+	return r, nil
+}
+
+// Close closes the underlying storage if the receiver was created
+// using Open.
+func (sr *Reader) Close() error {
+	if sr.closer != nil {
+		return sr.closer.Close()
+	}
+	return nil
+}
+
 // NewReader creates a new SR reader from the netcdf database specified by r.
 func NewReader(r cdf.ReaderWriterAt) (*Reader, error) {
 	cf, err := cdf.Open(r)
 	if err != nil {
 		return nil, err
 	}
+	return newReader(cdfData{f: cf}, cf)
+}
+
+// newReader creates a new SR reader from the given data. cf is the
+// underlying NetCDF file, if any.
+func newReader(data matrixData, cf *cdf.File) (*Reader, error) {
 	sr := &Reader{
-		File:      *cf,
+		data:      data,
 		CacheSize: 100,
 	}
-	nCells := sr.Header.Lengths("N")[0] // number of InMAP cells.
+	if cf != nil {
+		sr.File = *cf
+	}
+	var err error
+	for _, v := range []string{"N", "PrimaryPM25", "layers"} {
+		if sr.data.lengths(v) == nil {
+			return nil, fmt.Errorf("sr: SR matrix is missing variable %s", v)
+		}
+	}
+	nCells := sr.data.lengths("N")[0] // number of InMAP cells.
 	cells := make([]*inmap.Cell, nCells)
-	sr.nCellsGroundLevel = sr.Header.Lengths("PrimaryPM25")[1]
+	sr.nCellsGroundLevel = sr.data.lengths("PrimaryPM25")[1]
+	for sr.data.lengths(realizationVar("PrimaryPM25", sr.realizations+1)) != nil {
+		sr.realizations++
+	}
 
 	// Get the grid cell geometry
 	g := make([][]float64, 4)
@@ -93,9 +210,8 @@ func NewReader(r cdf.ReaderWriterAt) (*Reader, error) {
 	}
 
 	// Get the included layers.
-	rr := sr.File.Reader("layers", nil, nil)
-	buf := rr.Zero(-1)
-	if _, err = rr.Read(buf); err != nil {
+	buf, err := sr.data.readAll("layers")
+	if err != nil {
 		return nil, err
 	}
 	l := buf.([]int32)
@@ -106,7 +222,7 @@ func NewReader(r cdf.ReaderWriterAt) (*Reader, error) {
 
 	// Get InMAP data
 	varMap := make(map[string]string)
-	for _, v := range sr.File.Header.Variables() {
+	for _, v := range sr.data.variables() {
 		varMap[v] = ""
 	}
 	cellVarMap := make(map[string]string)
@@ -142,8 +258,8 @@ func NewReader(r cdf.ReaderWriterAt) (*Reader, error) {
 	// and save it as PopData.
 	sr.d.PopIndices = make(map[string]int)
 	var popI int
-	for _, v := range sr.File.Header.Variables() {
-		if sr.File.Header.Dimensions(v)[0] != "allcells" {
+	for _, v := range sr.data.variables() {
+		if sr.data.dimensions(v)[0] != "allcells" {
 			continue // We're only interested in the InMAP variables.
 		}
 		if _, ok := cellVarMap[v]; !ok {
@@ -184,9 +300,7 @@ func NewReader(r cdf.ReaderWriterAt) (*Reader, error) {
 // readFullVar reads a full float64 variable and returns it as a
 // []float64.
 func (sr *Reader) readFullVar64(varName string) ([]float64, error) {
-	r := sr.File.Reader(varName, nil, nil)
-	buf := r.Zero(-1)
-	_, err := r.Read(buf)
+	buf, err := sr.data.readAll(varName)
 	if err != nil {
 		return nil, err
 	}
@@ -245,6 +359,25 @@ func (c *Concentrations) TotalPM25() []float64 {
 	return o
 }
 
+// pol returns the concentrations of the pollutant with the given name,
+// which must be one of polNames.
+func (c *Concentrations) pol(name string) []float64 {
+	switch name {
+	case "pNH4":
+		return c.PNH4
+	case "pNO3":
+		return c.PNO3
+	case "pSO4":
+		return c.PSO4
+	case "SOA":
+		return c.SOA
+	case "PrimaryPM25":
+		return c.PrimaryPM25
+	default:
+		panic(fmt.Errorf("invalid pollutant %s", name))
+	}
+}
+
 // Concentrations returns the change in Total PM2.5 concentrations caused
 // by the emissions specified by e, after accounting for plume rise.
 // If the emission plume height is above the highest layer in the SR
@@ -252,9 +385,70 @@ func (c *Concentrations) TotalPM25() []float64 {
 // and an error of type AboveTopErr will be returned. In some cases it
 // may be appropriate to ignore errors of this type.
 // As specified in the EmisRecord documentation,
-// emission units should be in μg/s.
+// emission units should be in μg/s. If a Surrogate has been set using
+// SetSurrogate, the results are approximate.
 func (sr *Reader) Concentrations(emis ...*inmap.EmisRecord) (*Concentrations, error) {
+	return sr.concentrations(0, emis...)
+}
 
+// Realizations returns the number of additional realizations of the
+// source-receptor relationships in the SR matrix, such as from simulations
+// with perturbed parameters or meteorology from different seasons,
+// in addition to the central estimate (see SR.Realizations).
+func (sr *Reader) Realizations() int { return sr.realizations }
+
+// ConcentrationRealizations returns the change in PM2.5 concentrations
+// caused by the emissions specified by e, as with ConcentrationsParallel,
+// for the central estimate followed by each of the additional realizations
+// in the SR matrix (see Realizations). The spread among the realizations is
+// an estimate of the uncertainty in the results (see ConcentrationRange).
+func (sr *Reader) ConcentrationRealizations(nprocs int, emis ...*inmap.EmisRecord) ([]*Concentrations, error) {
+	out := make([]*Concentrations, sr.realizations+1)
+	var stickyErr error
+	for r := range out {
+		var err error
+		out[r], err = sr.concentrationsParallel(r, nprocs, emis...)
+		if err != nil {
+			if _, ok := err.(AboveTopErr); !ok {
+				return nil, err
+			}
+			stickyErr = err
+		}
+	}
+	return out, stickyErr
+}
+
+// ConcentrationRange returns the minimum and maximum concentration of each
+// pollutant in each grid cell among the given realizations, for example from
+// ConcentrationRealizations. The range of combined values, such as total
+// PM2.5, should be calculated from the realizations themselves.
+func ConcentrationRange(realizations []*Concentrations) (low, high *Concentrations) {
+	low, high = new(Concentrations), new(Concentrations)
+	for i, c := range realizations {
+		for _, p := range []struct{ c, lo, hi *[]float64 }{
+			{&c.PNH4, &low.PNH4, &high.PNH4},
+			{&c.PNO3, &low.PNO3, &high.PNO3},
+			{&c.PSO4, &low.PSO4, &high.PSO4},
+			{&c.SOA, &low.SOA, &high.SOA},
+			{&c.PrimaryPM25, &low.PrimaryPM25, &high.PrimaryPM25},
+		} {
+			if i == 0 {
+				*p.lo = append([]float64{}, *p.c...)
+				*p.hi = append([]float64{}, *p.c...)
+				continue
+			}
+			for j, v := range *p.c {
+				(*p.lo)[j] = math.Min((*p.lo)[j], v)
+				(*p.hi)[j] = math.Max((*p.hi)[j], v)
+			}
+		}
+	}
+	return low, high
+}
+
+// concentrations returns the change in concentrations caused by emis,
+// as described for Concentrations, for realization r.
+func (sr *Reader) concentrations(r int, emis ...*inmap.EmisRecord) (*Concentrations, error) {
 	out := &Concentrations{
 		PNH4:        make([]float64, sr.nCellsGroundLevel),
 		PNO3:        make([]float64, sr.nCellsGroundLevel),
@@ -268,15 +462,55 @@ func (sr *Reader) Concentrations(emis ...*inmap.EmisRecord) (*Concentrations, er
 	// result anyway.
 	var stickyErr error
 
+	// add adds the contribution of emissions of pollutant i in SR layer
+	// index layer and source grid cell index to the output.
+	add := func(i, layer, index int, emis float64) error {
+		v, err := sr.SourceRealization(polNames[i], r, layer, index)
+		if err != nil {
+			return err
+		}
+		floats.AddScaled(out.pol(polNames[i]), emis, v)
+		return nil
+	}
+	var expand func()
+	if s := sr.surrogate; s != nil && r == 0 {
+		// Combine the surrogate coefficients of all of the emissions
+		// and expand them at the end.
+		coef := make(map[string][][]float64)
+		for _, pol := range polNames {
+			coef[pol] = make([][]float64, len(sr.layers))
+			for l := range sr.layers {
+				coef[pol][l] = make([]float64, s.Rank)
+			}
+		}
+		add = func(i, layer, index int, emis float64) error {
+			s.coefficients(coef[polNames[i]][layer], polNames[i], layer, index, emis)
+			return nil
+		}
+		expand = func() {
+			for _, pol := range polNames {
+				for l := range sr.layers {
+					s.expand(out.pol(pol), coef[pol][l], pol, l)
+				}
+			}
+		}
+	}
+
 	for _, e := range emis {
 		cells, fractions := sr.d.CellIntersections(e.Geom)
 		for i, c := range cells {
 			// Figure out if this cell is the right layer.
 			var plumeHeight float64
-			if e.Height != 0 {
+			layerFrac := 1.
+			if e.ReleaseTop > 0 {
+				layerFrac, plumeHeight = c.ReleaseFraction(e)
+				if layerFrac == 0 {
+					continue
+				}
+			} else if e.Height != 0 {
 				var in bool
 				var err error
-				in, plumeHeight, err = c.IsPlumeIn(e.Height, e.Diam, e.Temp, e.Velocity)
+				in, plumeHeight, err = c.IsPlumeInRecord(e)
 				if err != nil {
 					return nil, err
 				}
@@ -288,7 +522,7 @@ func (sr *Reader) Concentrations(emis ...*inmap.EmisRecord) (*Concentrations, er
 					continue
 				}
 			}
-			frac := fractions[i]
+			frac := fractions[i] * layerFrac
 			index := sr.indices[c]
 
 			layers, layerfracs, err := sr.layerFracs(c, plumeHeight)
@@ -306,29 +540,78 @@ func (sr *Reader) Concentrations(emis ...*inmap.EmisRecord) (*Concentrations, er
 
 				for i, emis := range []float64{e.NH3, e.NOx, e.SOx, e.VOC, e.PM25} {
 					if emis != 0 {
-						v, err := sr.Source(polNames[i], layer, index)
-						if err != nil {
+						if err := add(i, layer, index, emis*frac*layerfrac); err != nil {
 							return nil, err
 						}
-						switch polNames[i] {
-						case "pNH4":
-							floats.AddScaled(out.PNH4, emis*frac*layerfrac, v)
-						case "pNO3":
-							floats.AddScaled(out.PNO3, emis*frac*layerfrac, v)
-						case "pSO4":
-							floats.AddScaled(out.PSO4, emis*frac*layerfrac, v)
-						case "SOA":
-							floats.AddScaled(out.SOA, emis*frac*layerfrac, v)
-						case "PrimaryPM25":
-							floats.AddScaled(out.PrimaryPM25, emis*frac*layerfrac, v)
-						default:
-							panic(fmt.Errorf("invalid pollutant %s", polNames[i]))
-						}
 					}
 				}
 			}
 		}
 	}
+	if expand != nil {
+		expand()
+	}
+	return out, stickyErr
+}
+
+// ConcentrationsParallel is the same as Concentrations, except that the
+// emissions are divided among nprocs goroutines, which query the SR matrix
+// concurrently, and the results are summed. This is faster when there are
+// many emissions sources, especially when the SR matrix is in remote
+// storage. If nprocs is less than one, runtime.GOMAXPROCS(-1) goroutines
+// are used.
+func (sr *Reader) ConcentrationsParallel(nprocs int, emis ...*inmap.EmisRecord) (*Concentrations, error) {
+	return sr.concentrationsParallel(0, nprocs, emis...)
+}
+
+// concentrationsParallel is the same as ConcentrationsParallel, but for
+// realization r.
+func (sr *Reader) concentrationsParallel(r, nprocs int, emis ...*inmap.EmisRecord) (*Concentrations, error) {
+	if nprocs < 1 {
+		nprocs = runtime.GOMAXPROCS(-1)
+	}
+	if nprocs > len(emis) {
+		nprocs = len(emis)
+	}
+	if nprocs <= 1 {
+		return sr.concentrations(r, emis...)
+	}
+	results := make([]*Concentrations, nprocs)
+	errs := make([]error, nprocs)
+	var wg sync.WaitGroup
+	wg.Add(nprocs)
+	for p := 0; p < nprocs; p++ {
+		go func(p int) {
+			defer wg.Done()
+			// Interleave the records so that each goroutine gets a similar mix of sources.
+			var e []*inmap.EmisRecord
+			for i := p; i < len(emis); i += nprocs {
+				e = append(e, emis[i])
+			}
+			results[p], errs[p] = sr.concentrations(r, e...)
+		}(p)
+	}
+	wg.Wait()
+
+	// stickyErr is an AboveTopErr that should be returned with the result.
+	var stickyErr error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if _, ok := err.(AboveTopErr); !ok {
+			return nil, err
+		}
+		stickyErr = err
+	}
+	out := results[0]
+	for _, r := range results[1:] {
+		floats.Add(out.PNH4, r.PNH4)
+		floats.Add(out.PNO3, r.PNO3)
+		floats.Add(out.PSO4, r.PSO4)
+		floats.Add(out.SOA, r.SOA)
+		floats.Add(out.PrimaryPM25, r.PrimaryPM25)
+	}
 	return out, stickyErr
 }
 
@@ -399,12 +682,87 @@ func (sr *Reader) Output(shapefilePath string, variables map[string]string, func
 	return nil
 }
 
+// Results returns the results specified by variables for the
+// ground-level grid cells, as with Output, but without writing them
+// to a file. This function assumes that concentrations have already been
+// set using SetConcentrations.
+func (sr *Reader) Results(variables map[string]string, funcs map[string]govaluate.ExpressionFunction) (map[string][]float64, error) {
+	m := simplechem.Mechanism{}
+	o, err := inmap.NewOutputter("", false, variables, funcs, m)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.CheckOutputVars(m)(&sr.d); err != nil {
+		return nil, err
+	}
+	return sr.d.Results(o)
+}
+
+// SourceResults returns the sum across all ground-level grid cells of each
+// of the results specified by variables, as in Results, caused by each of
+// the emissions sources in emis separately; for example, the monetary
+// damages caused by each source. The concentrations of the last source
+// are left set in the receiver, so this function is not
+// concurrency-safe. As with Concentrations, an AboveTopErr is returned
+// along with the results if any of the emissions are above the top layer
+// of the SR matrix.
+func (sr *Reader) SourceResults(variables map[string]string, funcs map[string]govaluate.ExpressionFunction, emis ...*inmap.EmisRecord) ([]map[string]float64, error) {
+	m := simplechem.Mechanism{}
+	o, err := inmap.NewOutputter("", false, variables, funcs, m)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.CheckOutputVars(m)(&sr.d); err != nil {
+		return nil, err
+	}
+	// stickyErr is an AboveTopErr that should be returned with the results.
+	var stickyErr error
+	out := make([]map[string]float64, len(emis))
+	for i, e := range emis {
+		c, err := sr.Concentrations(e)
+		if err != nil {
+			if _, ok := err.(AboveTopErr); !ok {
+				return nil, err
+			}
+			stickyErr = err
+		}
+		if err := sr.SetConcentrations(c); err != nil {
+			return nil, err
+		}
+		results, err := sr.d.Results(o)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = make(map[string]float64, len(results))
+		for k, v := range results {
+			out[i][k] = floats.Sum(v)
+		}
+	}
+	return out, stickyErr
+}
+
+// realizationVar returns the name of the SR matrix variable that holds
+// the results for pollutant pol in realization r.
+func realizationVar(pol string, r int) string {
+	if r == 0 {
+		return pol
+	}
+	return fmt.Sprintf("%s_r%d", pol, r)
+}
+
 // polNames lists the pollutant names.
 var polNames = []string{"pNH4", "pNO3", "pSO4", "SOA", "PrimaryPM25"}
 
-// layerFracs interpolates the height of c among the layers in the
-// SR matrix and returns a list of layers that should be used to represent
-// the emissions in c and the weighting fraction of each layer.
+// layerFracs interpolates the plume height of emissions in c among the
+// layers in the SR matrix and returns a list of layers that should be used
+// to represent the emissions and the weighting fraction of each layer.
+// The SR matrix holds the results for emissions released at the center of
+// each of its layers, so the results for emissions released at other
+// heights, for example because of plume rise, are interpolated linearly
+// by height between the two nearest layers. Emissions below the center of
+// the lowest layer use the lowest layer, and emissions above the center of
+// the highest layer use the highest layer; an AboveTopErr is returned if
+// the emissions are in a grid layer above the highest layer in the SR matrix.
 func (sr *Reader) layerFracs(c *inmap.Cell, plumeHeight float64) ([]int, []float64, error) {
 	var m simplechem.Mechanism
 	layerHeights, _, err := sr.d.VerticalProfile("WindSpeed", c.Centroid(), m)
@@ -412,25 +770,22 @@ func (sr *Reader) layerFracs(c *inmap.Cell, plumeHeight float64) ([]int, []float
 		return nil, nil, err
 	}
 
-	for i := 0; i < len(sr.layers); i++ {
-		if c.Layer == sr.layers[i] {
-			return []int{i}, []float64{1.}, nil
-		}
+	top := len(sr.layers) - 1
+	if c.Layer > sr.layers[top] {
+		return []int{top}, []float64{1.}, AboveTopErr{PlumeHeight: plumeHeight}
 	}
-
-	for i := 0; i < len(sr.layers)-1; i++ {
-		if sr.layers[i] < c.Layer && sr.layers[i+1] > c.Layer {
-			below := layerHeights[sr.layers[i]]
-			above := layerHeights[sr.layers[i+1]]
+	if plumeHeight <= layerHeights[sr.layers[0]] {
+		return []int{0}, []float64{1.}, nil
+	}
+	for i := 0; i < top; i++ {
+		below := layerHeights[sr.layers[i]]
+		above := layerHeights[sr.layers[i+1]]
+		if plumeHeight <= above {
 			frac := (plumeHeight - below) / (above - below)
-			return []int{i, i + 1}, []float64{frac, 1 - frac}, nil
+			return []int{i, i + 1}, []float64{1 - frac, frac}, nil
 		}
 	}
-
-	if c.Layer > sr.layers[len(sr.layers)-1] {
-		return []int{len(sr.layers) - 1}, []float64{1.}, AboveTopErr{PlumeHeight: plumeHeight}
-	}
-	panic("problem in layerFracs")
+	return []int{top}, []float64{1.}, nil
 }
 
 // AboveTopErr is returned when the plume height of an emissions
@@ -452,6 +807,16 @@ func (e AboveTopErr) Error() string {
 // which could cause subsequent results from this function to be incorrect.
 // If the layer and index are not known, use the Concentrations method instead.
 func (sr *Reader) Source(pol string, layer, index int) ([]float64, error) {
+	return sr.SourceRealization(pol, 0, layer, index)
+}
+
+// SourceRealization is the same as Source, but returns the results for
+// realization r, where zero is the central estimate and 1 through
+// Realizations() are the additional realizations.
+func (sr *Reader) SourceRealization(pol string, r, layer, index int) ([]float64, error) {
+	if r < 0 || r > sr.realizations {
+		return nil, fmt.Errorf("sr: requested realization %d is not in the SR matrix, which has %d additional realizations", r, sr.realizations)
+	}
 	sr.sourceInit.Do(func() {
 		sr.sourceCache = requestcache.NewCache(func(ctx context.Context, request interface{}) (interface{}, error) {
 			r := request.(sourceRequest)
@@ -459,9 +824,10 @@ func (sr *Reader) Source(pol string, layer, index int) ([]float64, error) {
 		}, runtime.GOMAXPROCS(-1),
 			requestcache.Deduplicate(), requestcache.Memory(sr.CacheSize))
 	})
+	v := realizationVar(pol, r)
 	req := sr.sourceCache.NewRequest(context.TODO(),
-		sourceRequest{pol: pol, layer: layer, index: index},
-		fmt.Sprintf("%s_%d_%d", pol, layer, index),
+		sourceRequest{pol: v, layer: layer, index: index},
+		fmt.Sprintf("%s_%d_%d", v, layer, index),
 	)
 	result, err := req.Result()
 	return result.([]float64), err
@@ -474,7 +840,8 @@ type sourceRequest struct {
 
 // source returns concentrations in μg m-3 for emissions in μg s-1 of
 // pollutant pol in SR layer index 'layer' and horizontal grid cell index
-// 'index'.
+// 'index'. pol can also be the name of the variable for a pollutant in one
+// of the additional realizations (see realizationVar).
 func (sr *Reader) source(pol string, layer, index int) ([]float64, error) {
 	if layer >= len(sr.layers) {
 		return nil, fmt.Errorf("sr: requested layer %d >= number of layers (%d)", layer, len(sr.layers))
@@ -484,32 +851,22 @@ func (sr *Reader) source(pol string, layer, index int) ([]float64, error) {
 	}
 	foundPol := false
 	for _, p := range polNames {
-		if p == pol {
-			foundPol = true
-			break
+		for r := 0; r <= sr.realizations; r++ {
+			if realizationVar(p, r) == pol {
+				foundPol = true
+			}
 		}
 	}
 	if !foundPol {
 		return nil, fmt.Errorf("sr: requested pollutant %s not one of valid pollutants (%+v)", pol, polNames)
 	}
-	start := []int{layer, index, 0}
-	end := []int{layer, index, sr.nCellsGroundLevel - 1}
-	return sr.get(pol, start, end)
-}
-
-// get returns data from a variable starting and ending at the given indices.
-func (sr *Reader) get(pol string, start, end []int) ([]float64, error) {
-	// indices: layer, source, receptor.
-	r := sr.File.Reader(pol, start, end)
-	buf := r.Zero(-1)
-	_, err := r.Read(buf)
+	dat32, err := sr.data.row(pol, layer, index)
 	if err != nil {
 		return nil, err
 	}
-	dat32 := buf.([]float32)
 	dat64 := make([]float64, len(dat32))
 	for i, v := range dat32 {
 		dat64[i] = float64(v)
 	}
-	return dat64, err
+	return dat64, nil
 }
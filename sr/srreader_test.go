@@ -19,6 +19,7 @@ along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
 package sr
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"math/rand"
@@ -46,8 +47,10 @@ func TestLayerFracs(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	// 100 m is slightly closer to the middle of layer 0 than layer 2,
+	// so layer 0 should get slightly more weight.
 	wantLayers := []int{0, 1}
-	wantFracs := []float64{0.4501243546645219, 0.5498756453354781}
+	wantFracs := []float64{0.5498756453354781, 0.4501243546645219}
 
 	if !reflect.DeepEqual(wantLayers, layers) {
 		t.Errorf("layers: want %v but have %v", wantLayers, layers)
@@ -293,15 +296,15 @@ func TestConcentrations(t *testing.T) {
 				2.885646832595512e-09, 9.169261877550738e-11, 8.041544652392929e-10, 7.038127303182762e-10,
 				1.4493828359718464e-10, 1.6445405801035484e-11},
 		},
-		{ // PM25 100m
-			d: []float64{1.0384019515664409e-06, 4.806791708367362e-07, 1.3779439660174915e-07, 3.255841114416068e-07,
-				2.3568557381549462e-07, 1.6861964589935698e-08, 6.997043397091758e-08, 6.392484788112892e-08,
-				1.5372791544187306e-08, 5.5777951037364604e-09},
+		{ // PM25 100m, interpolated between layers 0 and 2
+			d: []float64{1.265767973516092e-06, 5.844341387139885e-07, 1.6605622273027536e-07, 3.9521762241397377e-07,
+				2.8502645168247673e-07, 1.992441912702227e-08, 8.355941264284708e-08, 7.589886117439095e-08,
+				1.8003575015236022e-08, 6.476359681709342e-09},
 		},
-		{ // PM25 200m
-			d: []float64{1.2420400707924273e-08, 1.2488357015172369e-08, 1.0263853766900866e-08, 1.136522786993055e-08,
-				1.3036516754993954e-08, 3.0427411701339224e-09, 8.650623328776419e-09, 9.89251436323002e-09,
-				3.5014693366974825e-09, 1.5230525729492683e-09},
+		{ // PM25 200m, interpolated between layers 2 and 4
+			d: []float64{1.1871144205457919e-08, 1.19370903345631e-08, 9.812236716684572e-09, 1.0863627266848564e-08,
+				1.2461830511409962e-08, 2.9095889637058093e-09, 8.270368437780717e-09, 9.45849360625609e-09,
+				3.3481384457404065e-09, 1.4566063059116483e-09},
 		},
 		{ // PM25 800m
 			d: []float64{3.835875714286452e-11, 6.099905996981292e-11, 8.292511816110348e-11, 5.7506100575865915e-11,
@@ -331,6 +334,55 @@ func TestConcentrations(t *testing.T) {
 	}
 }
 
+func TestConcentrationsParallel(t *testing.T) {
+	r, err := os.Open("../cmd/inmap/testdata/testSR_golden.ncf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, err := NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	e := make([]*inmap.EmisRecord, 100)
+	for i := range e {
+		e[i] = &inmap.EmisRecord{
+			Geom:   geom.Point{X: rnd.Float64()*7000 - 3500, Y: rnd.Float64()*7000 - 3500},
+			PM25:   rnd.Float64(),
+			NOx:    rnd.Float64(),
+			NH3:    rnd.Float64(),
+			SOx:    rnd.Float64(),
+			VOC:    rnd.Float64(),
+			Height: rnd.Float64() * 400,
+		}
+	}
+	want, err := sr.Concentrations(e...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nprocs := range []int{0, 1, 3, 200} {
+		have, err := sr.ConcentrationsParallel(nprocs, e...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, w := range want.TotalPM25() {
+			if v := have.TotalPM25()[i]; math.Abs(w-v)*2/(w+v) > 1.e-10 {
+				t.Errorf("nprocs %d, row %d: want %v but have %v", nprocs, i, w, v)
+			}
+		}
+	}
+
+	// Errors for sources above the top layer should be returned with the result.
+	e = append(e, &inmap.EmisRecord{Geom: geom.Point{X: -3500, Y: -3500}, PM25: 1, Height: 800})
+	c, err := sr.ConcentrationsParallel(4, e...)
+	if _, ok := err.(AboveTopErr); !ok {
+		t.Errorf("error should be AboveTopErr but is %v", err)
+	}
+	if c == nil {
+		t.Error("result should not be nil")
+	}
+}
+
 func BenchmarkConcentrations(b *testing.B) {
 	r, err := os.Open("../cmd/inmap/testdata/testSR_golden.ncf")
 	if err != nil {
@@ -501,3 +553,41 @@ func TestOutput(t *testing.T) {
 	dec.Close()
 	inmap.DeleteShapefile(TestOutputFilename)
 }
+
+func TestSourceResults(t *testing.T) {
+	r, err := Open(context.Background(), goldenSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	emis := []*inmap.EmisRecord{
+		{Geom: geom.Point{}, PM25: 1, SOx: 2},
+		{Geom: geom.Point{X: -3000, Y: 2000}, PM25: 1, NH3: 1, ReleaseBottom: 100, ReleaseTop: 100},
+	}
+	vars := map[string]string{"TotalPM25": "PrimaryPM25 + pNH4 + pSO4 + pNO3 + SOA"}
+	results, err := r.SourceResults(vars, nil, emis...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(emis) {
+		t.Fatalf("have %d results, want %d", len(results), len(emis))
+	}
+	// TotalPM25 is linear in the emissions, so the sum of the results for
+	// the individual sources should match the results for all of them.
+	c, err := r.Concentrations(emis...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want float64
+	for _, v := range c.TotalPM25() {
+		want += v
+	}
+	have := results[0]["TotalPM25"] + results[1]["TotalPM25"]
+	if math.Abs(have-want)/want > 1.e-10 {
+		t.Errorf("have %g, want %g", have, want)
+	}
+	if results[0]["TotalPM25"] <= 0 || results[1]["TotalPM25"] <= 0 {
+		t.Errorf("results should be positive: %v", results)
+	}
+}
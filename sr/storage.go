@@ -0,0 +1,313 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sr
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"gocloud.dev/blob"
+)
+
+// Storage is the underlying storage of an SR matrix file. It can be
+// passed to NewReader.
+type Storage interface {
+	// ReadAt and WriteAt read and write data at the given offset
+	// in the file. Storage that is only readable returns an error
+	// from WriteAt.
+	io.ReaderAt
+	io.WriterAt
+
+	// Size returns the size of the file in bytes.
+	Size() int64
+
+	io.Closer
+}
+
+const (
+	// DefaultBlockSize is the size in bytes of the blocks that are
+	// cached when reading SR matrices from remote storage.
+	DefaultBlockSize = 1 << 20
+
+	// DefaultCacheBlocks is the number of blocks that are held in
+	// the cache when reading SR matrices from remote storage.
+	DefaultCacheBlocks = 256
+)
+
+// OpenStorage opens the SR matrix file at path for reading. path can be
+// a local file, an HTTP or HTTPS URL on a server that supports range
+// requests, or a storage bucket URL (e.g., "s3://bucket/sr.ncf" or
+// "gs://bucket/sr.ncf"; see cloud.OpenBucket). Only the parts of remote
+// files that are needed are downloaded, and they are held in a
+// least-recently-used cache of DefaultCacheBlocks blocks of
+// DefaultBlockSize bytes, so large SR matrices can be queried without
+// downloading them entirely.
+func OpenStorage(ctx context.Context, path string) (Storage, error) {
+	var s Storage
+	var err error
+	switch {
+	case strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://"):
+		s, err = openHTTPStorage(ctx, path)
+	case strings.HasPrefix(path, "s3://") || strings.HasPrefix(path, "gs://") || strings.HasPrefix(path, "file://"):
+		s, err = openBlobStorage(ctx, path)
+	default:
+		return openFileStorage(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewBlockCache(s, DefaultBlockSize, DefaultCacheBlocks), nil
+}
+
+// fileStorage is SR matrix storage in a local file.
+type fileStorage struct {
+	*os.File
+	size int64
+}
+
+func openFileStorage(path string) (*fileStorage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileStorage{File: f, size: fi.Size()}, nil
+}
+
+func (f *fileStorage) Size() int64 { return f.size }
+
+// readOnly can be embedded to implement WriteAt for storage that
+// does not support writing.
+type readOnly struct{}
+
+func (readOnly) WriteAt(p []byte, off int64) (int, error) {
+	return 0, fmt.Errorf("sr: SR matrix storage is read-only")
+}
+
+// httpStorage is SR matrix storage on a web server, which is read using
+// HTTP range requests.
+type httpStorage struct {
+	readOnly
+	ctx    context.Context
+	url    string
+	size   int64
+	client *http.Client
+}
+
+func openHTTPStorage(ctx context.Context, url string) (*httpStorage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sr: opening %s: %v", url, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("sr: opening %s: %s", url, resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return nil, fmt.Errorf("sr: opening %s: server did not report the file size", url)
+	}
+	return &httpStorage{ctx: ctx, url: url, size: resp.ContentLength, client: http.DefaultClient}, nil
+}
+
+func (h *httpStorage) Size() int64 { return h.size }
+
+func (h *httpStorage) Close() error { return nil }
+
+func (h *httpStorage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= h.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > h.size {
+		end = h.size
+	}
+	req, err := http.NewRequestWithContext(h.ctx, http.MethodGet, h.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, end-1))
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("sr: reading %s: %v", h.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("sr: reading %s: server does not support range requests: %s", h.url, resp.Status)
+	}
+	n, err := io.ReadFull(resp.Body, p[:end-off])
+	if err == nil && end-off < int64(len(p)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// blobStorage is SR matrix storage in a storage bucket.
+type blobStorage struct {
+	readOnly
+	ctx    context.Context
+	bucket *blob.Bucket
+	key    string
+	size   int64
+}
+
+func openBlobStorage(ctx context.Context, rawURL string) (*blobStorage, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	b, err := openBucket(ctx, u.Scheme+"://"+u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("sr: opening %s: %v", rawURL, err)
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	attrs, err := b.Attributes(ctx, key)
+	if err != nil {
+		b.Close()
+		return nil, fmt.Errorf("sr: opening %s: %v", rawURL, err)
+	}
+	return &blobStorage{ctx: ctx, bucket: b, key: key, size: attrs.Size}, nil
+}
+
+func (b *blobStorage) Size() int64 { return b.size }
+
+func (b *blobStorage) Close() error { return b.bucket.Close() }
+
+func (b *blobStorage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	length := int64(len(p))
+	if off+length > b.size {
+		length = b.size - off
+	}
+	r, err := b.bucket.NewRangeReader(b.ctx, b.key, off, length, nil)
+	if err != nil {
+		return 0, fmt.Errorf("sr: reading %s: %v", b.key, err)
+	}
+	defer r.Close()
+	n, err := io.ReadFull(r, p[:length])
+	if err == nil && length < int64(len(p)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// blockCache is a least-recently-used cache of fixed-size blocks
+// of a Storage.
+type blockCache struct {
+	Storage
+	blockSize int64
+	maxBlocks int
+
+	mu     sync.Mutex
+	lru    *list.List              // Most recently used blocks are at the front.
+	blocks map[int64]*list.Element // Elements hold *cacheBlock values.
+}
+
+type cacheBlock struct {
+	i    int64 // The index of the block.
+	data []byte
+}
+
+// NewBlockCache returns a Storage that reads s in blocks of blockSize
+// bytes and holds the maxBlocks most recently used blocks in memory.
+// This avoids repeated requests to remote storage for nearby data,
+// such as the header of a NetCDF file, which is read in many small
+// pieces. The returned Storage is read-only.
+func NewBlockCache(s Storage, blockSize int64, maxBlocks int) Storage {
+	return &blockCache{
+		Storage:   s,
+		blockSize: blockSize,
+		maxBlocks: maxBlocks,
+		lru:       list.New(),
+		blocks:    make(map[int64]*list.Element),
+	}
+}
+
+func (c *blockCache) WriteAt(p []byte, off int64) (int, error) {
+	return readOnly{}.WriteAt(p, off)
+}
+
+func (c *blockCache) ReadAt(p []byte, off int64) (int, error) {
+	size := c.Size()
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= size {
+			return n, io.EOF
+		}
+		data, err := c.block(pos / c.blockSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[pos%c.blockSize:])
+	}
+	return n, nil
+}
+
+// block returns the data in block i, reading it from the underlying
+// storage if it is not in the cache.
+func (c *blockCache) block(i int64) ([]byte, error) {
+	c.mu.Lock()
+	if e, ok := c.blocks[i]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*cacheBlock).data, nil
+	}
+	c.mu.Unlock()
+
+	off := i * c.blockSize
+	length := c.blockSize
+	if off+length > c.Size() {
+		length = c.Size() - off
+	}
+	data := make([]byte, length)
+	if _, err := c.Storage.ReadAt(data, off); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.blocks[i]; ok { // Another goroutine read the block first.
+		c.lru.MoveToFront(e)
+		return e.Value.(*cacheBlock).data, nil
+	}
+	c.blocks[i] = c.lru.PushFront(&cacheBlock{i: i, data: data})
+	for c.lru.Len() > c.maxBlocks {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.blocks, e.Value.(*cacheBlock).i)
+	}
+	return data, nil
+}
@@ -0,0 +1,163 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sr
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const goldenSR = "../cmd/inmap/testdata/testSR_golden.ncf"
+
+func TestOpenStorage(t *testing.T) {
+	golden, err := os.ReadFile(goldenSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	server := httptest.NewServer(http.FileServer(http.Dir(filepath.Dir(goldenSR))))
+	defer server.Close()
+
+	os.Mkdir("storage_test", os.ModePerm)
+	defer os.RemoveAll("storage_test")
+	if err := os.WriteFile(filepath.Join("storage_test", "sr.ncf"), golden, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	local, err := OpenStorage(ctx, goldenSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	want, err := NewReader(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		server.URL + "/" + filepath.Base(goldenSR),
+		"file://storage_test/sr.ncf",
+	} {
+		t.Run(path, func(t *testing.T) {
+			s, err := OpenStorage(ctx, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if s.Size() != int64(len(golden)) {
+				t.Errorf("size: have %d, want %d", s.Size(), len(golden))
+			}
+			if _, err := s.WriteAt([]byte{0}, 0); err == nil {
+				t.Error("remote storage should be read-only")
+			}
+			have, err := NewReader(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(have.Geometry(), want.Geometry()) {
+				t.Error("geometry doesn't match")
+			}
+			for _, i := range []int{0, 4, 9} {
+				h, err := have.Source("pSO4", 1, i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				w, err := want.Source("pSO4", 1, i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(h, w) {
+					t.Errorf("source %d: have %v, want %v", i, h, w)
+				}
+			}
+		})
+	}
+
+	if _, err := OpenStorage(ctx, server.URL+"/xxx.ncf"); err == nil {
+		t.Error("missing file should cause an error")
+	}
+}
+
+// countingStorage counts the number of reads from the underlying storage.
+type countingStorage struct {
+	Storage
+	reads int
+}
+
+func (c *countingStorage) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.Storage.ReadAt(p, off)
+}
+
+func TestBlockCache(t *testing.T) {
+	golden, err := os.ReadFile(goldenSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := openFileStorage(goldenSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s := &countingStorage{Storage: f}
+	c := NewBlockCache(s, 7, 3)
+
+	// Read the whole file in pieces that don't line up with the blocks.
+	var b bytes.Buffer
+	if _, err := io.Copy(&b, io.NewSectionReader(c, 0, c.Size())); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), golden) {
+		t.Error("data doesn't match")
+	}
+	if want := (len(golden) + 6) / 7; s.reads != want {
+		t.Errorf("reads: have %d, want %d", s.reads, want)
+	}
+
+	// Cached blocks should not be read again, but evicted blocks should.
+	s.reads = 0
+	p := make([]byte, 10)
+	if _, err := c.ReadAt(p, int64(len(golden)-10)); err != nil {
+		t.Fatal(err)
+	}
+	if s.reads != 0 {
+		t.Errorf("cached reads: have %d, want 0", s.reads)
+	}
+	if _, err := c.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	}
+	if s.reads != 2 {
+		t.Errorf("evicted reads: have %d, want 2", s.reads)
+	}
+	if !bytes.Equal(p, golden[:10]) {
+		t.Error("data doesn't match")
+	}
+
+	if n, err := c.ReadAt(p, int64(len(golden)-5)); n != 5 || err != io.EOF {
+		t.Errorf("reading past the end: have %d, %v; want 5, EOF", n, err)
+	}
+}
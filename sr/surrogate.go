@@ -0,0 +1,274 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sr
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"reflect"
+
+	"github.com/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// surrogateOversample is the number of extra random vectors that are used
+// to find the range of each SR matrix layer when fitting a Surrogate,
+// which improves the accuracy of the retained singular vectors.
+const surrogateOversample = 10
+
+// Surrogate is a compressed, approximate representation of an SR matrix.
+// For each pollutant and SR layer, the matrix of source-receptor
+// relationships is approximated by a truncated singular value
+// decomposition, so that the concentrations caused by any number of
+// emissions sources can be calculated by combining Rank coefficients for
+// each source and then expanding them once, rather than by reading and
+// summing the full relationships of each source. This makes predictions
+// much faster and the surrogate much smaller than the SR matrix, at the
+// cost of the approximation error reported in Error. Surrogates are
+// created using Reader.FitSurrogate and used with Reader.SetSurrogate.
+type Surrogate struct {
+	// Rank is the number of singular vectors that are retained.
+	Rank int
+
+	// Layers are the vertical layers of the SR matrix that the
+	// Surrogate was fit from.
+	Layers []int
+
+	// NumCells is the number of ground-level grid cells in the SR matrix.
+	NumCells int
+
+	// Error holds the approximation error of each pollutant in each SR
+	// layer, as the Frobenius norm of the difference between the
+	// approximate and the full source-receptor relationships divided
+	// by the Frobenius norm of the full relationships.
+	Error map[string][]float64
+
+	// Source and Receptor hold the factors of the approximation of
+	// each pollutant in each SR layer, as row-major matrices with
+	// NumCells rows and Rank columns. The approximate relationship
+	// between source i and receptor j is the dot product of row i of
+	// Source, which is scaled by the singular values, and row j of Receptor.
+	Source, Receptor map[string][][]float32
+}
+
+// FitSurrogate fits a Surrogate of the given rank to the central estimate
+// of the SR matrix. The source-receptor relationships of each pollutant
+// in each layer are read twice, one source grid cell at a time, and
+// factorized using a randomized singular value decomposition, so that the
+// full SR matrix does not need to fit in memory. Larger ranks result in
+// smaller approximation errors but larger, slower surrogates.
+func (sr *Reader) FitSurrogate(rank int) (*Surrogate, error) {
+	if rank < 1 {
+		return nil, fmt.Errorf("sr: surrogate rank must be at least 1 but is %d", rank)
+	}
+	n := sr.nCellsGroundLevel
+	if rank > n {
+		rank = n
+	}
+	s := &Surrogate{
+		Rank:     rank,
+		Layers:   append([]int{}, sr.layers...),
+		NumCells: n,
+		Error:    make(map[string][]float64),
+		Source:   make(map[string][][]float32),
+		Receptor: make(map[string][][]float32),
+	}
+	for _, pol := range polNames {
+		s.Error[pol] = make([]float64, len(sr.layers))
+		s.Source[pol] = make([][]float32, len(sr.layers))
+		s.Receptor[pol] = make([][]float32, len(sr.layers))
+		for layer := range sr.layers {
+			var err error
+			s.Source[pol][layer], s.Receptor[pol][layer], s.Error[pol][layer], err = sr.fitLayer(pol, layer, rank)
+			if err != nil {
+				return nil, fmt.Errorf("sr: fitting surrogate for %s layer %d: %v", pol, sr.layers[layer], err)
+			}
+		}
+	}
+	return s, nil
+}
+
+// fitLayer returns the source and receptor factors and the relative
+// approximation error of a rank-k approximation of the relationships of
+// pollutant pol in SR layer index layer.
+func (sr *Reader) fitLayer(pol string, layer, k int) (source, receptor []float32, relErr float64, err error) {
+	n := sr.nCellsGroundLevel
+	l := k + surrogateOversample
+	if l > n {
+		l = n
+	}
+	row := func(i int) ([]float64, error) {
+		v, err := sr.data.row(pol, layer, i)
+		if err != nil {
+			return nil, err
+		}
+		o := make([]float64, len(v))
+		for j, vv := range v {
+			o[j] = float64(vv)
+		}
+		return o, nil
+	}
+
+	// Find an orthonormal basis Q for the range of the matrix A by
+	// multiplying it by random vectors: Y = A Ω. A fixed seed is used so
+	// that the results are reproducible.
+	rng := rand.New(rand.NewSource(1))
+	omega := mat.NewDense(n, l, nil)
+	for i := 0; i < n; i++ {
+		for j := 0; j < l; j++ {
+			omega.Set(i, j, rng.NormFloat64())
+		}
+	}
+	y := mat.NewDense(n, l, nil)
+	var norm2 float64
+	for i := 0; i < n; i++ {
+		a, err := row(i)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		yi := y.RawRowView(i)
+		for c, v := range a {
+			if v != 0 {
+				norm2 += v * v
+				floats.AddScaled(yi, v, omega.RawRowView(c))
+			}
+		}
+	}
+	if norm2 == 0 {
+		// All of the relationships are zero, so they are represented
+		// exactly by zero factors.
+		return make([]float32, n*k), make([]float32, n*k), 0, nil
+	}
+	var ySVD mat.SVD
+	if !ySVD.Factorize(y, mat.SVDThinU) {
+		return nil, nil, 0, fmt.Errorf("range factorization failed")
+	}
+	var q mat.Dense
+	ySVD.UTo(&q)
+
+	// Project A onto the basis, B = Qᵀ A, and factorize the small matrix B.
+	b := mat.NewDense(l, n, nil)
+	for i := 0; i < n; i++ {
+		a, err := row(i)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		for j := 0; j < l; j++ {
+			if qij := q.At(i, j); qij != 0 {
+				floats.AddScaled(b.RawRowView(j), qij, a)
+			}
+		}
+	}
+	var bSVD mat.SVD
+	if !bSVD.Factorize(b, mat.SVDThin) {
+		return nil, nil, 0, fmt.Errorf("projection factorization failed")
+	}
+	values := bSVD.Values(nil)
+	var ub, v, u mat.Dense
+	bSVD.UTo(&ub)
+	bSVD.VTo(&v)
+	u.Mul(&q, &ub)
+
+	// Because A is approximated by its projection Q B, the remaining
+	// error is the part of the norm of A that isn't in the retained
+	// singular values.
+	resid := norm2
+	source, receptor = make([]float32, n*k), make([]float32, n*k)
+	for j := 0; j < k && j < len(values); j++ {
+		resid -= values[j] * values[j]
+		for i := 0; i < n; i++ {
+			source[i*k+j] = float32(u.At(i, j) * values[j])
+			receptor[i*k+j] = float32(v.At(i, j))
+		}
+	}
+	return source, receptor, math.Sqrt(math.Max(resid, 0) / norm2), nil
+}
+
+// MaxError returns the largest approximation error among all of the
+// pollutants and layers in the receiver (see Surrogate.Error).
+func (s *Surrogate) MaxError() float64 {
+	var max float64
+	for _, e := range s.Error {
+		for _, v := range e {
+			max = math.Max(max, v)
+		}
+	}
+	return max
+}
+
+// Write writes the receiver to w in gob format.
+func (s *Surrogate) Write(w io.Writer) error {
+	if err := gob.NewEncoder(w).Encode(s); err != nil {
+		return fmt.Errorf("sr: writing surrogate: %v", err)
+	}
+	return nil
+}
+
+// ReadSurrogate reads a Surrogate that was written using Surrogate.Write.
+func ReadSurrogate(r io.Reader) (*Surrogate, error) {
+	s := new(Surrogate)
+	if err := gob.NewDecoder(r).Decode(s); err != nil {
+		return nil, fmt.Errorf("sr: reading surrogate: %v", err)
+	}
+	return s, nil
+}
+
+// SetSurrogate sets the receiver to use s to calculate the central
+// estimate of concentrations in Concentrations and ConcentrationsParallel,
+// instead of reading the full source-receptor relationships. s must have
+// been fit to an SR matrix with the same grid and layers as the receiver.
+// Other methods, such as Source, are not affected. If s is nil, the full
+// source-receptor relationships are used again.
+func (sr *Reader) SetSurrogate(s *Surrogate) error {
+	if s != nil && (s.NumCells != sr.nCellsGroundLevel || !reflect.DeepEqual(s.Layers, sr.layers)) {
+		return fmt.Errorf("sr: surrogate with %d grid cells and layers %v doesn't match SR matrix with %d grid cells and layers %v",
+			s.NumCells, s.Layers, sr.nCellsGroundLevel, sr.layers)
+	}
+	sr.surrogate = s
+	return nil
+}
+
+// Surrogate returns the surrogate set using SetSurrogate, if any.
+func (sr *Reader) Surrogate() *Surrogate { return sr.surrogate }
+
+// coefficients accumulates the surrogate coefficients of emissions of
+// pollutant pol at rate emis from source grid cell index in SR layer
+// index layer into coef.
+func (s *Surrogate) coefficients(coef []float64, pol string, layer, index int, emis float64) {
+	u := s.Source[pol][layer][index*s.Rank : (index+1)*s.Rank]
+	for j, v := range u {
+		coef[j] += emis * float64(v)
+	}
+}
+
+// expand adds the concentrations represented by the surrogate
+// coefficients coef of pollutant pol in SR layer index layer to dst.
+func (s *Surrogate) expand(dst, coef []float64, pol string, layer int) {
+	v := s.Receptor[pol][layer]
+	for i := range dst {
+		var sum float64
+		for j, c := range coef {
+			sum += c * float64(v[i*s.Rank+j])
+		}
+		dst[i] += sum
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sr
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/yuzhou-wang/inmap"
+)
+
+func TestSurrogate(t *testing.T) {
+	r, err := Open(context.Background(), goldenSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	emis := []*inmap.EmisRecord{
+		{Geom: geom.Point{}, PM25: 1, SOx: 2, NOx: 1},
+		{Geom: geom.Point{X: -3000, Y: 2000}, PM25: 1, NH3: 1, ReleaseBottom: 100, ReleaseTop: 100},
+	}
+	want, err := r.Concentrations(emis...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("full rank", func(t *testing.T) {
+		s, err := r.FitSurrogate(r.nCellsGroundLevel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e := s.MaxError(); e > 1.e-6 {
+			t.Errorf("full-rank surrogate error should be ~0 but is %g", e)
+		}
+		var b bytes.Buffer
+		if err := s.Write(&b); err != nil {
+			t.Fatal(err)
+		}
+		s, err = ReadSurrogate(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.SetSurrogate(s); err != nil {
+			t.Fatal(err)
+		}
+		defer r.SetSurrogate(nil)
+		have, err := r.Concentrations(emis...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, h := want.TotalPM25(), have.TotalPM25()
+		for i := range w {
+			if math.Abs(w[i]-h[i])/w[i] > 1.e-5 {
+				t.Errorf("row %d: want %g but have %g", i, w[i], h[i])
+			}
+		}
+	})
+
+	t.Run("low rank", func(t *testing.T) {
+		s, err := r.FitSurrogate(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The reported error should match the actual error.
+		const pol, layer = "PrimaryPM25", 0
+		var diff2, norm2 float64
+		for i := 0; i < s.NumCells; i++ {
+			a, err := r.Source(pol, layer, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j, v := range a {
+				var approx float64
+				for k := 0; k < s.Rank; k++ {
+					approx += float64(s.Source[pol][layer][i*s.Rank+k] * s.Receptor[pol][layer][j*s.Rank+k])
+				}
+				diff2 += (v - approx) * (v - approx)
+				norm2 += v * v
+			}
+		}
+		have, want := s.Error[pol][layer], math.Sqrt(diff2/norm2)
+		if have <= 0 || math.Abs(have-want) > 1.e-4 {
+			t.Errorf("error: have %g, want %g", have, want)
+		}
+	})
+
+	if err := r.SetSurrogate(&Surrogate{NumCells: 3, Layers: r.layers}); err == nil {
+		t.Error("mismatched surrogate should cause an error")
+	}
+}
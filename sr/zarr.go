@@ -0,0 +1,420 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sr
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// zarrCompressionLevel is the zlib compression level of Zarr SR matrices.
+const zarrCompressionLevel = 6
+
+// zarrArray is the metadata (.zarray) of a Zarr (version 2) array.
+type zarrArray struct {
+	Shape      []int           `json:"shape"`
+	Chunks     []int           `json:"chunks"`
+	DType      string          `json:"dtype"`
+	Compressor *zarrCompressor `json:"compressor"`
+	FillValue  float64         `json:"fill_value"`
+	Order      string          `json:"order"`
+	Filters    []interface{}   `json:"filters"`
+	ZarrFormat int             `json:"zarr_format"`
+}
+
+type zarrCompressor struct {
+	ID    string `json:"id"`
+	Level int    `json:"level"`
+}
+
+// zarrMetadata is the consolidated metadata (.zmetadata) of a Zarr store.
+type zarrMetadata struct {
+	Metadata map[string]json.RawMessage `json:"metadata"`
+	Format   int                        `json:"zarr_consolidated_format"`
+}
+
+// isZarr returns whether path refers to a Zarr store: either a URL or
+// path with the extension ".zarr" or a local directory.
+func isZarr(path string) bool {
+	if filepath.Ext(strings.TrimSuffix(path, "/")) == ".zarr" {
+		return true
+	}
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// zarrStore retrieves the objects in a Zarr store. It returns an error
+// satisfying os.IsNotExist for objects that don't exist.
+type zarrStore func(key string) ([]byte, error)
+
+// zarrData is an SR matrix in Zarr format.
+type zarrData struct {
+	get    zarrStore
+	vars   []string
+	arrays map[string]*zarrArray
+	dims   map[string][]string
+}
+
+// openZarr opens the Zarr SR matrix at path, which can be a local
+// directory, an HTTP or HTTPS URL, or a storage bucket URL.
+func openZarr(ctx context.Context, path string) (*zarrData, error) {
+	path = strings.TrimSuffix(path, "/")
+	var get zarrStore
+	switch {
+	case strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://"):
+		get = func(key string) ([]byte, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, path+"/"+key, nil)
+			if err != nil {
+				return nil, err
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode == http.StatusNotFound {
+				return nil, &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+			} else if resp.StatusCode != http.StatusOK {
+				return nil, fmt.Errorf("reading %s: %s", key, resp.Status)
+			}
+			return io.ReadAll(resp.Body)
+		}
+	case strings.HasPrefix(path, "s3://") || strings.HasPrefix(path, "gs://") || strings.HasPrefix(path, "file://"):
+		u, err := url.Parse(path)
+		if err != nil {
+			return nil, err
+		}
+		var b *blob.Bucket
+		b, err = openBucket(ctx, u.Scheme+"://"+u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("sr: opening %s: %v", path, err)
+		}
+		prefix := strings.TrimPrefix(u.Path, "/")
+		get = func(key string) ([]byte, error) {
+			data, err := b.ReadAll(ctx, prefix+"/"+key)
+			if gcerrors.Code(err) == gcerrors.NotFound {
+				return nil, &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+			}
+			return data, err
+		}
+	default:
+		get = func(key string) ([]byte, error) {
+			return os.ReadFile(filepath.Join(path, filepath.FromSlash(key)))
+		}
+	}
+
+	b, err := get(".zmetadata")
+	if err != nil {
+		return nil, fmt.Errorf("sr: opening Zarr SR matrix %s: %v", path, err)
+	}
+	var md zarrMetadata
+	if err := json.Unmarshal(b, &md); err != nil {
+		return nil, fmt.Errorf("sr: opening Zarr SR matrix %s: %v", path, err)
+	}
+	z := &zarrData{
+		get:    get,
+		arrays: make(map[string]*zarrArray),
+		dims:   make(map[string][]string),
+	}
+	for key, val := range md.Metadata {
+		if !strings.HasSuffix(key, "/.zarray") {
+			continue
+		}
+		v := strings.TrimSuffix(key, "/.zarray")
+		a := new(zarrArray)
+		if err := json.Unmarshal(val, a); err != nil {
+			return nil, fmt.Errorf("sr: opening Zarr SR matrix %s: variable %s: %v", path, v, err)
+		}
+		var attrs struct {
+			Dims []string `json:"_ARRAY_DIMENSIONS"`
+		}
+		if err := json.Unmarshal(md.Metadata[v+"/.zattrs"], &attrs); err != nil {
+			return nil, fmt.Errorf("sr: opening Zarr SR matrix %s: variable %s: %v", path, v, err)
+		}
+		if len(attrs.Dims) != len(a.Shape) {
+			return nil, fmt.Errorf("sr: opening Zarr SR matrix %s: variable %s has %d dimension names but %d dimensions", path, v, len(attrs.Dims), len(a.Shape))
+		}
+		z.vars = append(z.vars, v)
+		z.arrays[v] = a
+		z.dims[v] = attrs.Dims
+	}
+	sort.Strings(z.vars)
+	return z, nil
+}
+
+func (z *zarrData) variables() []string { return z.vars }
+
+func (z *zarrData) lengths(varName string) []int {
+	if a, ok := z.arrays[varName]; ok {
+		return a.Shape
+	}
+	return nil
+}
+
+func (z *zarrData) dimensions(varName string) []string { return z.dims[varName] }
+
+// chunk reads and decodes the chunk with the given key of array a
+// into a slice of the array's type with n elements. Missing chunks are
+// filled with the fill value.
+func (z *zarrData) chunk(varName, key string, n int) (interface{}, error) {
+	a := z.arrays[varName]
+	var out interface{}
+	switch a.DType {
+	case "<f4":
+		out = make([]float32, n)
+	case "<f8":
+		out = make([]float64, n)
+	case "<i4":
+		out = make([]int32, n)
+	default:
+		return nil, fmt.Errorf("sr: Zarr variable %s has unsupported type %s", varName, a.DType)
+	}
+	b, err := z.get(varName + "/" + key)
+	if os.IsNotExist(err) {
+		switch o := out.(type) {
+		case []float32:
+			for i := range o {
+				o[i] = float32(a.FillValue)
+			}
+		case []float64:
+			for i := range o {
+				o[i] = a.FillValue
+			}
+		case []int32:
+			for i := range o {
+				o[i] = int32(a.FillValue)
+			}
+		}
+		return out, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("sr: reading Zarr variable %s: %v", varName, err)
+	}
+	var r io.Reader = bytes.NewReader(b)
+	if a.Compressor != nil {
+		if a.Compressor.ID != "zlib" {
+			return nil, fmt.Errorf("sr: Zarr variable %s has unsupported compressor %s", varName, a.Compressor.ID)
+		}
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("sr: reading Zarr variable %s: %v", varName, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	if err := binary.Read(r, binary.LittleEndian, out); err != nil {
+		return nil, fmt.Errorf("sr: reading Zarr variable %s: %v", varName, err)
+	}
+	return out, nil
+}
+
+func (z *zarrData) readAll(varName string) (interface{}, error) {
+	a, ok := z.arrays[varName]
+	if !ok {
+		return nil, fmt.Errorf("sr: Zarr SR matrix does not have variable %s", varName)
+	}
+	n := 1
+	key := make([]string, len(a.Shape))
+	for i, l := range a.Shape {
+		if a.Chunks[i] != l {
+			return nil, fmt.Errorf("sr: Zarr variable %s must be stored in a single chunk", varName)
+		}
+		n *= l
+		key[i] = "0"
+	}
+	return z.chunk(varName, strings.Join(key, "."), n)
+}
+
+func (z *zarrData) row(pol string, layer, index int) ([]float32, error) {
+	a, ok := z.arrays[pol]
+	if !ok {
+		return nil, fmt.Errorf("sr: Zarr SR matrix does not have variable %s", pol)
+	}
+	if len(a.Chunks) != 3 || a.Chunks[0] != 1 || a.Chunks[1] != 1 || a.Chunks[2] != a.Shape[2] {
+		return nil, fmt.Errorf("sr: Zarr variable %s must be stored in one chunk per source", pol)
+	}
+	d, err := z.chunk(pol, fmt.Sprintf("%d.%d.0", layer, index), a.Shape[2])
+	if err != nil {
+		return nil, err
+	}
+	return d.([]float32), nil
+}
+
+// WriteZarr writes the SR matrix in r to a Zarr (version 2) store in the
+// local directory path, which must not already exist. The source-receptor
+// relationships are stored in a separate zlib-compressed chunk for each
+// source grid cell, so that the relationships for any source can be read
+// with a single small request, and the chunks for sources whose
+// relationships are all zero (e.g., sources that have not yet been
+// calculated) are omitted. The metadata of all variables is consolidated
+// into a single index object (".zmetadata"). The resulting store can be
+// read using Open, and it can be uploaded to a web server or storage
+// bucket and read from there.
+func WriteZarr(r *Reader, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("sr: writing Zarr SR matrix: %s already exists", path)
+	}
+	md := zarrMetadata{Metadata: make(map[string]json.RawMessage), Format: 1}
+	put := func(key string, data []byte) error {
+		p := filepath.Join(path, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+			return err
+		}
+		return os.WriteFile(p, data, 0644)
+	}
+	putJSON := func(key string, v interface{}) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		md.Metadata[key] = b
+		return put(key, b)
+	}
+	attributes := func(v string) map[string]interface{} {
+		attrs := make(map[string]interface{})
+		if r.File.Header == nil {
+			return attrs
+		}
+		for _, a := range r.File.Header.Attributes(v) {
+			attrs[a] = r.File.Header.GetAttribute(v, a)
+		}
+		return attrs
+	}
+	if err := putJSON(".zgroup", map[string]int{"zarr_format": 2}); err != nil {
+		return fmt.Errorf("sr: writing Zarr SR matrix: %v", err)
+	}
+	if err := putJSON(".zattrs", attributes("")); err != nil {
+		return fmt.Errorf("sr: writing Zarr SR matrix: %v", err)
+	}
+
+	encode := func(data interface{}) ([]byte, error) {
+		var b bytes.Buffer
+		w, err := zlib.NewWriterLevel(&b, zarrCompressionLevel)
+		if err != nil {
+			return nil, err
+		}
+		if err := binary.Write(w, binary.LittleEndian, data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+
+	for _, v := range r.data.variables() {
+		dims := r.data.dimensions(v)
+		shape := r.data.lengths(v)
+		a := &zarrArray{
+			Shape:      shape,
+			Chunks:     append([]int{}, shape...),
+			Compressor: &zarrCompressor{ID: "zlib", Level: zarrCompressionLevel},
+			Order:      "C",
+			ZarrFormat: 2,
+		}
+		isSR := len(dims) == 3 && dims[0] == "layer" && dims[1] == "source"
+		if isSR {
+			a.Chunks[0], a.Chunks[1] = 1, 1
+			a.DType = "<f4"
+		} else {
+			data, err := r.data.readAll(v)
+			if err != nil {
+				return fmt.Errorf("sr: writing Zarr SR matrix: reading %s: %v", v, err)
+			}
+			switch data.(type) {
+			case []float32:
+				a.DType = "<f4"
+			case []float64:
+				a.DType = "<f8"
+			case []int32:
+				a.DType = "<i4"
+			default:
+				return fmt.Errorf("sr: writing Zarr SR matrix: variable %s has unsupported type %T", v, data)
+			}
+			b, err := encode(data)
+			if err != nil {
+				return fmt.Errorf("sr: writing Zarr SR matrix: %v", err)
+			}
+			key := make([]string, len(shape))
+			for i := range key {
+				key[i] = "0"
+			}
+			if err := put(v+"/"+strings.Join(key, "."), b); err != nil {
+				return fmt.Errorf("sr: writing Zarr SR matrix: %v", err)
+			}
+		}
+		if err := putJSON(v+"/.zarray", a); err != nil {
+			return fmt.Errorf("sr: writing Zarr SR matrix: %v", err)
+		}
+		attrs := attributes(v)
+		attrs["_ARRAY_DIMENSIONS"] = dims
+		if err := putJSON(v+"/.zattrs", attrs); err != nil {
+			return fmt.Errorf("sr: writing Zarr SR matrix: %v", err)
+		}
+		if !isSR {
+			continue
+		}
+		for l := 0; l < shape[0]; l++ {
+			for s := 0; s < shape[1]; s++ {
+				data, err := r.data.row(v, l, s)
+				if err != nil {
+					return fmt.Errorf("sr: writing Zarr SR matrix: reading %s: %v", v, err)
+				}
+				zero := true
+				for _, val := range data {
+					if val != 0 {
+						zero = false
+						break
+					}
+				}
+				if zero {
+					continue
+				}
+				b, err := encode(data)
+				if err != nil {
+					return fmt.Errorf("sr: writing Zarr SR matrix: %v", err)
+				}
+				if err := put(fmt.Sprintf("%s/%d.%d.0", v, l, s), b); err != nil {
+					return fmt.Errorf("sr: writing Zarr SR matrix: %v", err)
+				}
+			}
+		}
+	}
+	b, err := json.Marshal(md)
+	if err != nil {
+		return fmt.Errorf("sr: writing Zarr SR matrix: %v", err)
+	}
+	if err := put(".zmetadata", b); err != nil {
+		return fmt.Errorf("sr: writing Zarr SR matrix: %v", err)
+	}
+	return nil
+}
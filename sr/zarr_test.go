@@ -0,0 +1,118 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sr
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/yuzhou-wang/inmap"
+)
+
+func TestWriteZarr(t *testing.T) {
+	ctx := context.Background()
+	want, err := Open(ctx, goldenSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer want.Close()
+
+	dir, err := os.MkdirTemp("", "sr_zarr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sr.zarr")
+	if err := WriteZarr(want, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteZarr(want, path); err == nil {
+		t.Error("writing to an existing store should cause an error")
+	}
+
+	// There should be a separate chunk for each source.
+	if _, err := os.Stat(filepath.Join(path, "PrimaryPM25", "2.9.0")); err != nil {
+		t.Error(err)
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+
+	for _, p := range []string{path, server.URL + "/sr.zarr"} {
+		t.Run(p, func(t *testing.T) {
+			have, err := Open(ctx, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer have.Close()
+			if !reflect.DeepEqual(have.Geometry(), want.Geometry()) {
+				t.Error("geometry doesn't match")
+			}
+			if !reflect.DeepEqual(have.layers, want.layers) {
+				t.Errorf("layers: have %v, want %v", have.layers, want.layers)
+			}
+			vars := []string{"TotalPop", "allcause", "BaselineTotalPM25", "UAvg"}
+			haveVars, err := have.Variables(vars...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantVars, err := want.Variables(vars...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(haveVars, wantVars) {
+				t.Error("variables don't match")
+			}
+			for l := range want.layers {
+				for i := 0; i < want.nCellsGroundLevel; i++ {
+					for _, pol := range polNames {
+						h, err := have.Source(pol, l, i)
+						if err != nil {
+							t.Fatal(err)
+						}
+						w, err := want.Source(pol, l, i)
+						if err != nil {
+							t.Fatal(err)
+						}
+						if !reflect.DeepEqual(h, w) {
+							t.Errorf("%s layer %d source %d: have %v, want %v", pol, l, i, h, w)
+						}
+					}
+				}
+			}
+			e := &inmap.EmisRecord{PM25: 1, SOx: 1, Geom: want.Geometry()[3].Centroid()}
+			hc, err := have.Concentrations(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wc, err := want.Concentrations(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(hc, wc) {
+				t.Error("concentrations don't match")
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/ctessum/cdf"
+	"github.com/ctessum/geom/proj"
+)
+
+// OutputStream appends the values of the output variables of an Outputter
+// at a series of times to a NetCDF file as the simulation progresses,
+// so that the results for all of the times do not need to be held
+// in memory. The file has an unlimited "time" dimension and a "cell"
+// dimension; the "time" variable holds the number of hours since the
+// start time, and the "xmin", "xmax", "ymin", "ymax", and "layer"
+// variables hold the bounds and the vertical layer of each grid cell. The
+// grid is assumed not to change after the first time is written.
+type OutputStream struct {
+	o        *Outputter
+	fileName string
+	sr       *proj.SR
+	start    time.Time
+
+	w      *os.File
+	f      *cdf.File
+	vars   []string
+	nCells int
+	nRecs  int
+}
+
+// NewOutputStream returns a new stream that writes the output variables
+// of o to the NetCDF file fileName, which is created when the first time
+// is written. sr is the spatial reference of the model grid, and times are
+// recorded relative to start.
+func (o *Outputter) NewOutputStream(fileName string, sr *proj.SR, start time.Time) *OutputStream {
+	return &OutputStream{o: o, fileName: fileName, sr: sr, start: start}
+}
+
+// Write returns a function that appends the current values of the output
+// variables to the stream as the values at time t.
+func (s *OutputStream) Write(t time.Time) DomainManipulator {
+	return func(d *InMAP) error {
+		results, err := d.Results(s.o)
+		if err != nil {
+			return err
+		}
+		if s.f == nil {
+			if err := s.create(d, results); err != nil {
+				return err
+			}
+		}
+		hours := t.Sub(s.start).Hours()
+		if _, err = s.f.Writer("time", []int{s.nRecs}, []int{s.nRecs + 1}).Write([]float64{hours}); err != nil {
+			return fmt.Errorf("inmap: writing output stream: %v", err)
+		}
+		for _, v := range s.vars {
+			if len(results[v]) != s.nCells {
+				return fmt.Errorf("inmap: writing output stream: the number of grid cells changed from %d to %d", s.nCells, len(results[v]))
+			}
+			if _, err = s.f.Writer(v, []int{s.nRecs, 0}, []int{s.nRecs + 1, s.nCells}).Write(results[v]); err != nil {
+				return fmt.Errorf("inmap: writing output stream variable %s: %v", v, err)
+			}
+		}
+		s.nRecs++
+		// Update the number of records after each time so that the file
+		// can be read while the simulation is running.
+		if err = cdf.UpdateNumRecs(s.w); err != nil {
+			return fmt.Errorf("inmap: writing output stream: %v", err)
+		}
+		return nil
+	}
+}
+
+// create creates the output file and writes the grid cell information.
+func (s *OutputStream) create(d *InMAP, results map[string][]float64) error {
+	s.vars = make([]string, 0, len(results))
+	for v := range results {
+		s.vars = append(s.vars, v)
+	}
+	sort.Strings(s.vars)
+	s.nCells = len(results[s.vars[0]])
+
+	h := cdf.NewHeader([]string{"time", "cell"}, []int{0, s.nCells})
+	h.AddAttribute("", "comment", "InMAP time-resolved output")
+	if s.sr != nil {
+		wkt, err := projectionWKT(s.sr)
+		if err != nil {
+			return err
+		}
+		h.AddAttribute("", "grid_projection", wkt)
+	}
+	h.AddVariable("time", []string{"time"}, []float64{0})
+	h.AddAttribute("time", "units", "hours since "+s.start.UTC().Format("2006-01-02 15:04:05"))
+	for _, v := range []string{"xmin", "xmax", "ymin", "ymax"} {
+		h.AddVariable(v, []string{"cell"}, []float64{0})
+		h.AddAttribute(v, "description", "grid cell "+v)
+	}
+	h.AddVariable("layer", []string{"cell"}, []int32{0})
+	h.AddAttribute("layer", "description", "vertical layer index")
+	for _, v := range s.vars {
+		h.AddVariable(v, []string{"time", "cell"}, []float64{0})
+		h.AddAttribute(v, "expression", s.o.outputVariables[v])
+	}
+	h.Define()
+
+	var err error
+	if s.w, err = os.Create(s.fileName); err != nil {
+		return fmt.Errorf("inmap: creating output stream file: %v", err)
+	}
+	if s.f, err = cdf.Create(s.w, h); err != nil {
+		return fmt.Errorf("inmap: creating output stream file: %v", err)
+	}
+
+	cells := d.cells.array()[:s.nCells]
+	bounds := map[string][]float64{
+		"xmin": make([]float64, s.nCells),
+		"xmax": make([]float64, s.nCells),
+		"ymin": make([]float64, s.nCells),
+		"ymax": make([]float64, s.nCells),
+	}
+	layers := make([]int32, s.nCells)
+	for i, c := range cells {
+		b := c.Bounds()
+		bounds["xmin"][i], bounds["xmax"][i] = b.Min.X, b.Max.X
+		bounds["ymin"][i], bounds["ymax"][i] = b.Min.Y, b.Max.Y
+		layers[i] = int32(c.Layer)
+	}
+	for v, vals := range bounds {
+		if _, err = s.f.Writer(v, []int{0}, []int{s.nCells}).Write(vals); err != nil {
+			return fmt.Errorf("inmap: writing output stream: %v", err)
+		}
+	}
+	if _, err = s.f.Writer("layer", []int{0}, []int{s.nCells}).Write(layers); err != nil {
+		return fmt.Errorf("inmap: writing output stream: %v", err)
+	}
+	return nil
+}
+
+// Close closes the output file. It does nothing if no times have been
+// written or if the file has already been closed.
+func (s *OutputStream) Close() error {
+	if s.w == nil {
+		return nil
+	}
+	err := s.w.Close()
+	s.w = nil
+	return err
+}
@@ -0,0 +1,112 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ctessum/cdf"
+	"github.com/ctessum/geom/proj"
+	"github.com/yuzhou-wang/inmap"
+	"github.com/yuzhou-wang/inmap/science/chem/simplechem"
+)
+
+func TestOutputStream(t *testing.T) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := inmap.VarGridTestData()
+	emis := inmap.NewEmissions()
+	var m simplechem.Mechanism
+
+	d := &inmap.InMAP{
+		InitFuncs: []inmap.DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	o, err := inmap.NewOutputter("", false, map[string]string{"WindSpeed": "WindSpeed"}, nil, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grid, err := d.Results(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, err := proj.Parse(inmap.TestGridSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := os.MkdirTemp("", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "stream.ncf")
+
+	start := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	s := o.NewOutputStream(fileName, sr, start)
+	for _, h := range []time.Duration{6, 12, 18} {
+		if err := s.Write(start.Add(h * time.Hour))(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ff, err := cdf.Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nCells := len(grid["WindSpeed"])
+	if l := ff.Header.Lengths("WindSpeed"); !reflect.DeepEqual(l, []int{0, nCells}) {
+		t.Fatalf("WindSpeed dimensions: have %v, want %v", l, []int{0, nCells})
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := ff.Header.NumRecs(fi.Size()); n != 3 {
+		t.Fatalf("have %d records, want 3", n)
+	}
+	times := make([]float64, 3)
+	if _, err := ff.Reader("time", []int{0}, []int{3}).Read(times); err != nil {
+		t.Fatal(err)
+	}
+	if want := []float64{6, 12, 18}; !reflect.DeepEqual(times, want) {
+		t.Errorf("times: have %v, want %v", times, want)
+	}
+	vals := make([]float64, nCells)
+	if _, err := ff.Reader("WindSpeed", []int{2, 0}, []int{3, nCells}).Read(vals); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, grid["WindSpeed"]) {
+		t.Errorf("WindSpeed values do not match")
+	}
+}
@@ -0,0 +1,417 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/wkb"
+	"github.com/ctessum/geom/proj"
+	_ "github.com/mattn/go-sqlite3" // Register the sqlite3 database driver.
+)
+
+// topologyEdge holds the relationship between a grid cell and one of its
+// neighbors.
+type topologyEdge struct {
+	from, to       int    // Cell IDs.
+	direction      string // Direction of the neighbor from the cell.
+	coverFrac      float64
+	centerDistance float64
+}
+
+// topology returns the cells in d and the relationships between each of
+// the cells and each of its neighbors. The ID of each cell is its index
+// in the returned array plus one. The boundaries of the domain are not
+// included as cells; instead, boundary gives the sides of each cell
+// that are at the edge of the domain (e.g. "west top").
+func (d *InMAP) topology() (cells []*Cell, edges []topologyEdge, boundary []string) {
+	cells = d.cells.array()
+	ids := make(map[*Cell]int, len(cells))
+	for i, c := range cells {
+		ids[c] = i + 1
+	}
+	boundary = make([]string, len(cells))
+	for i, c := range cells {
+		var sides []string
+		for _, n := range []struct {
+			direction, side string
+			l               cellList
+		}{
+			{"west", "west", c.west}, {"east", "east", c.east},
+			{"south", "south", c.south}, {"north", "north", c.north},
+			{"below", "", c.below}, {"above", "top", c.above},
+		} {
+			atBoundary := false
+			for _, nc := range n.l {
+				if nc.boundary {
+					atBoundary = true
+					continue
+				}
+				if nc.Cell == c {
+					continue // Reflective boundary at ground level.
+				}
+				edges = append(edges, topologyEdge{
+					from:           i + 1,
+					to:             ids[nc.Cell],
+					direction:      n.direction,
+					coverFrac:      nc.info.coverFrac,
+					centerDistance: nc.info.centerDistance,
+				})
+			}
+			if atBoundary {
+				sides = append(sides, n.side)
+			}
+		}
+		boundary[i] = strings.Join(sides, " ")
+	}
+	return cells, edges, boundary
+}
+
+// OutputTopology returns a function that writes the structure of the
+// variable resolution grid—the cell polygons, their layers and sizes,
+// and the neighbors of each cell—to fileName, so that it can be analyzed
+// or visualized with other tools or used to couple other models to InMAP.
+// The format is chosen by the file extension: ".gpkg" for GeoPackage
+// (see WriteTopologyGeoPackage) or ".graphml" for GraphML (see
+// WriteTopologyGraphML). sr is the spatial reference of the grid.
+func OutputTopology(fileName string, sr *proj.SR) DomainManipulator {
+	return func(d *InMAP) error {
+		switch ext := strings.ToLower(filepath.Ext(fileName)); ext {
+		case ".gpkg":
+			return d.WriteTopologyGeoPackage(fileName, sr)
+		case ".graphml":
+			f, err := os.Create(fileName)
+			if err != nil {
+				return fmt.Errorf("inmap: writing grid topology: %v", err)
+			}
+			if err := d.WriteTopologyGraphML(f); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		default:
+			return fmt.Errorf("inmap: writing grid topology: unsupported file extension '%s'; it should be '.gpkg' or '.graphml'", ext)
+		}
+	}
+}
+
+// gpkgSRSID is the GeoPackage spatial reference system ID of the grid.
+const gpkgSRSID = 100000
+
+// gpkgSchema creates the tables that are required by the GeoPackage
+// specification (version 1.2).
+const gpkgSchema = `
+PRAGMA application_id = 1196444487;
+PRAGMA user_version = 10200;
+CREATE TABLE gpkg_spatial_ref_sys (
+	srs_name TEXT NOT NULL,
+	srs_id INTEGER NOT NULL PRIMARY KEY,
+	organization TEXT NOT NULL,
+	organization_coordsys_id INTEGER NOT NULL,
+	definition TEXT NOT NULL,
+	description TEXT
+);
+CREATE TABLE gpkg_contents (
+	table_name TEXT NOT NULL PRIMARY KEY,
+	data_type TEXT NOT NULL,
+	identifier TEXT UNIQUE,
+	description TEXT DEFAULT '',
+	last_change DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+	min_x DOUBLE,
+	min_y DOUBLE,
+	max_x DOUBLE,
+	max_y DOUBLE,
+	srs_id INTEGER,
+	CONSTRAINT fk_gc_r_srs_id FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys(srs_id)
+);
+CREATE TABLE gpkg_geometry_columns (
+	table_name TEXT NOT NULL,
+	column_name TEXT NOT NULL,
+	geometry_type_name TEXT NOT NULL,
+	srs_id INTEGER NOT NULL,
+	z TINYINT NOT NULL,
+	m TINYINT NOT NULL,
+	CONSTRAINT pk_geom_cols PRIMARY KEY (table_name, column_name),
+	CONSTRAINT fk_gc_tn FOREIGN KEY (table_name) REFERENCES gpkg_contents(table_name),
+	CONSTRAINT fk_gc_srs FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys (srs_id)
+);
+INSERT INTO gpkg_spatial_ref_sys VALUES
+	('Undefined cartesian SRS', -1, 'NONE', -1, 'undefined', 'undefined cartesian coordinate reference system'),
+	('Undefined geographic SRS', 0, 'NONE', 0, 'undefined', 'undefined geographic coordinate reference system'),
+	('WGS 84 geodetic', 4326, 'EPSG', 4326, 'GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AUTHORITY["EPSG","4326"]]', 'longitude/latitude coordinates in decimal degrees on the WGS 84 spheroid');
+CREATE TABLE cells (
+	fid INTEGER PRIMARY KEY,
+	geom MULTIPOLYGON,
+	layer INTEGER,
+	nest_level INTEGER,
+	layer_height REAL,
+	dx REAL,
+	dy REAL,
+	dz REAL,
+	boundary TEXT
+);
+CREATE TABLE neighbors (
+	fid INTEGER PRIMARY KEY AUTOINCREMENT,
+	cell INTEGER,
+	neighbor INTEGER,
+	direction TEXT,
+	cover_frac REAL,
+	center_distance REAL
+);
+`
+
+// WriteTopologyGeoPackage writes the structure of the variable resolution
+// grid to a GeoPackage file, replacing the file if it already exists.
+// The "cells" feature table contains the polygon, layer, nest level
+// (where 0 is the coarsest), layer bottom height [m], and dimensions [m]
+// of each grid cell, as well as the sides of the cell that are at the
+// edge of the domain. The "neighbors" attribute table contains a row for
+// each cell and each of its neighbors to the west, east, south, north,
+// below, and above, with the fraction of the cell face that the
+// neighbor covers and the distance between the cell centers [m].
+// sr is the spatial reference of the grid.
+func (d *InMAP) WriteTopologyGeoPackage(fileName string, sr *proj.SR) error {
+	wkt, err := projectionWKT(sr)
+	if err != nil {
+		return fmt.Errorf("inmap: writing GeoPackage: %v", err)
+	}
+	if err = os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("inmap: writing GeoPackage: %v", err)
+	}
+	db, err := sql.Open("sqlite3", fileName)
+	if err != nil {
+		return fmt.Errorf("inmap: writing GeoPackage: %v", err)
+	}
+	defer db.Close()
+	if _, err = db.Exec(gpkgSchema); err != nil {
+		return fmt.Errorf("inmap: writing GeoPackage: %v", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("inmap: writing GeoPackage: %v", err)
+	}
+	if err = writeTopologyGeoPackage(tx, d, wkt); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("inmap: writing GeoPackage: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("inmap: writing GeoPackage: %v", err)
+	}
+	return db.Close()
+}
+
+func writeTopologyGeoPackage(tx *sql.Tx, d *InMAP, wkt string) error {
+	cells, edges, boundary := d.topology()
+
+	if _, err := tx.Exec(`INSERT INTO gpkg_spatial_ref_sys VALUES (?, ?, ?, ?, ?, ?)`,
+		"InMAP grid", gpkgSRSID, "NONE", gpkgSRSID, wkt, "spatial reference of the InMAP grid"); err != nil {
+		return err
+	}
+	b := geom.NewBounds()
+	for _, c := range cells {
+		b.Extend(c.Bounds())
+	}
+	if _, err := tx.Exec(`INSERT INTO gpkg_contents (table_name, data_type, identifier, description, min_x, min_y, max_x, max_y, srs_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		"cells", "features", "cells", "InMAP grid cells", b.Min.X, b.Min.Y, b.Max.X, b.Max.Y, gpkgSRSID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO gpkg_geometry_columns VALUES (?, ?, ?, ?, ?, ?)`,
+		"cells", "geom", "MULTIPOLYGON", gpkgSRSID, 0, 0); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO gpkg_contents (table_name, data_type, identifier, description) VALUES (?, ?, ?, ?)`,
+		"neighbors", "attributes", "neighbors", "InMAP grid cell neighbors"); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO cells VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i, c := range cells {
+		g, err := gpkgGeometry(geom.MultiPolygon(c.Polygons()), c.Bounds())
+		if err != nil {
+			return err
+		}
+		if _, err = stmt.Exec(i+1, g, c.Layer, len(c.Index)-1, c.LayerHeight, c.Dx, c.Dy, c.Dz, boundary[i]); err != nil {
+			return err
+		}
+	}
+
+	stmt, err = tx.Prepare(`INSERT INTO neighbors (cell, neighbor, direction, cover_frac, center_distance) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, e := range edges {
+		if _, err = stmt.Exec(e.from, e.to, e.direction, e.coverFrac, e.centerDistance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gpkgGeometry returns g in the GeoPackage binary format: a header with
+// the spatial reference ID and the envelope b of g, followed by
+// the well-known binary representation of g.
+func gpkgGeometry(g geom.Geom, b *geom.Bounds) ([]byte, error) {
+	w := new(bytes.Buffer)
+	w.WriteString("GP")
+	w.WriteByte(0) // Version 1.
+	const (
+		littleEndian = 1
+		xyEnvelope   = 1 << 1
+	)
+	w.WriteByte(littleEndian | xyEnvelope)
+	for _, v := range []interface{}{int32(gpkgSRSID), b.Min.X, b.Max.X, b.Min.Y, b.Max.Y} {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	if err := wkb.Write(w, wkb.NDR, g); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+// graphML is the root element of a GraphML file.
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+// graphMLKey declares a node or edge attribute.
+type graphMLKey struct {
+	ID       string `xml:"id,attr"`
+	For      string `xml:"for,attr"`
+	AttrName string `xml:"attr.name,attr"`
+	AttrType string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+	ID          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// WriteTopologyGraphML writes the structure of the variable resolution
+// grid to w in the GraphML format. The graph has a node for each grid cell,
+// with its layer, nest level (where 0 is the coarsest), centroid,
+// layer bottom height [m], dimensions [m], and the sides of the cell
+// that are at the edge of the domain, and a directed edge from each cell
+// to each of its neighbors, with the direction of the neighbor
+// (west, east, south, north, below, or above), the fraction of the cell
+// face that the neighbor covers, and the distance between the cell
+// centers [m].
+func (d *InMAP) WriteTopologyGraphML(w io.Writer) error {
+	cells, edges, boundary := d.topology()
+	g := graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{ID: "layer", For: "node", AttrName: "layer", AttrType: "int"},
+			{ID: "nestLevel", For: "node", AttrName: "nestLevel", AttrType: "int"},
+			{ID: "x", For: "node", AttrName: "x", AttrType: "double"},
+			{ID: "y", For: "node", AttrName: "y", AttrType: "double"},
+			{ID: "layerHeight", For: "node", AttrName: "layerHeight", AttrType: "double"},
+			{ID: "dx", For: "node", AttrName: "dx", AttrType: "double"},
+			{ID: "dy", For: "node", AttrName: "dy", AttrType: "double"},
+			{ID: "dz", For: "node", AttrName: "dz", AttrType: "double"},
+			{ID: "boundary", For: "node", AttrName: "boundary", AttrType: "string"},
+			{ID: "direction", For: "edge", AttrName: "direction", AttrType: "string"},
+			{ID: "coverFrac", For: "edge", AttrName: "coverFrac", AttrType: "double"},
+			{ID: "centerDistance", For: "edge", AttrName: "centerDistance", AttrType: "double"},
+		},
+		Graph: graphMLGraph{
+			ID:          "grid",
+			EdgeDefault: "directed",
+			Nodes:       make([]graphMLNode, len(cells)),
+			Edges:       make([]graphMLEdge, len(edges)),
+		},
+	}
+	f := func(v float64) string { return fmt.Sprint(v) }
+	for i, c := range cells {
+		p := c.Centroid()
+		g.Graph.Nodes[i] = graphMLNode{
+			ID: graphMLNodeID(i + 1),
+			Data: []graphMLData{
+				{Key: "layer", Value: fmt.Sprint(c.Layer)},
+				{Key: "nestLevel", Value: fmt.Sprint(len(c.Index) - 1)},
+				{Key: "x", Value: f(p.X)},
+				{Key: "y", Value: f(p.Y)},
+				{Key: "layerHeight", Value: f(c.LayerHeight)},
+				{Key: "dx", Value: f(c.Dx)},
+				{Key: "dy", Value: f(c.Dy)},
+				{Key: "dz", Value: f(c.Dz)},
+				{Key: "boundary", Value: boundary[i]},
+			},
+		}
+	}
+	for i, e := range edges {
+		g.Graph.Edges[i] = graphMLEdge{
+			Source: graphMLNodeID(e.from),
+			Target: graphMLNodeID(e.to),
+			Data: []graphMLData{
+				{Key: "direction", Value: e.direction},
+				{Key: "coverFrac", Value: f(e.coverFrac)},
+				{Key: "centerDistance", Value: f(e.centerDistance)},
+			},
+		}
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return fmt.Errorf("inmap: writing GraphML: %v", err)
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(g); err != nil {
+		return fmt.Errorf("inmap: writing GraphML: %v", err)
+	}
+	return nil
+}
+
+// graphMLNodeID returns the GraphML node ID of the cell with the given ID.
+func graphMLNodeID(id int) string { return fmt.Sprintf("n%d", id) }
@@ -0,0 +1,195 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/ctessum/geom"
+	"github.com/ctessum/geom/encoding/wkb"
+	"github.com/ctessum/geom/index/rtree"
+	"github.com/ctessum/geom/proj"
+)
+
+// topologyTestGrid returns a variable resolution test grid and its
+// spatial reference.
+func topologyTestGrid(t *testing.T) (*InMAP, *proj.SR) {
+	cfg, ctmdata, pop, popIndices, mr, mortIndices := VarGridTestData()
+	emis := &Emissions{data: rtree.NewTree(25, 50)}
+	mutator, err := PopulationMutator(cfg, popIndices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Mech
+	d := &InMAP{
+		InitFuncs: []DomainManipulator{
+			cfg.RegularGrid(ctmdata, pop, popIndices, mr, mortIndices, emis, m),
+			cfg.MutateGrid(mutator, ctmdata, pop, mr, emis, m, nil),
+		},
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	sr, err := proj.Parse(cfg.GridProj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, sr
+}
+
+func TestTopology(t *testing.T) {
+	d, _ := topologyTestGrid(t)
+	cells, edges, boundary := d.topology()
+	if len(cells) != d.cells.len() {
+		t.Fatalf("have %d cells, want %d", len(cells), d.cells.len())
+	}
+	opposite := map[string]string{
+		"west": "east", "east": "west", "south": "north",
+		"north": "south", "below": "above", "above": "below",
+	}
+	type pair struct {
+		from, to  int
+		direction string
+	}
+	have := make(map[pair]bool)
+	for _, e := range edges {
+		have[pair{e.from, e.to, e.direction}] = true
+	}
+	for _, e := range edges {
+		if !have[pair{e.to, e.from, opposite[e.direction]}] {
+			t.Errorf("edge %d -> %d (%s) has no reverse edge", e.from, e.to, e.direction)
+		}
+	}
+	// Cell 0 is in the southwest corner of the ground layer.
+	if boundary[0] != "west south" {
+		t.Errorf("cell 0 boundary: have '%s', want 'west south'", boundary[0])
+	}
+	if b := boundary[len(cells)-1]; b == "" {
+		t.Errorf("the last cell should be at the top boundary but has boundary '%s'", b)
+	}
+}
+
+func TestWriteTopologyGeoPackage(t *testing.T) {
+	const fileName = "testTopology.gpkg"
+	d, sr := topologyTestGrid(t)
+	if err := OutputTopology(fileName, sr)(d); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fileName)
+	cells, edges, _ := d.topology()
+
+	db, err := sql.Open("sqlite3", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var definition string
+	if err := db.QueryRow(`SELECT s.definition FROM gpkg_geometry_columns g
+		JOIN gpkg_spatial_ref_sys s ON g.srs_id = s.srs_id WHERE g.table_name = 'cells'`).Scan(&definition); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proj.Parse(definition); err != nil {
+		t.Errorf("invalid spatial reference: %v", err)
+	}
+
+	rows, err := db.Query(`SELECT fid, geom, layer, dz FROM cells ORDER BY fid`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for rows.Next() {
+		var (
+			fid, layer int
+			g          []byte
+			dz         float64
+		)
+		if err := rows.Scan(&fid, &g, &layer, &dz); err != nil {
+			t.Fatal(err)
+		}
+		c := cells[fid-1]
+		if layer != c.Layer || dz != c.Dz {
+			t.Errorf("cell %d: have layer %d and dz %g, want %d and %g", fid, layer, dz, c.Layer, c.Dz)
+		}
+		if !bytes.HasPrefix(g, []byte("GP")) {
+			t.Fatalf("cell %d: invalid GeoPackage geometry header", fid)
+		}
+		const headerLen = 8 + 4*8 // magic, version, flags, SRS ID, and envelope
+		gg, err := wkb.Decode(g[headerLen:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a, want := gg.(geom.Polygonal).Area(), c.Area(); math.Abs(a-want) > 1.e-6*want {
+			t.Errorf("cell %d: have area %g, want %g", fid, a, want)
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(cells) {
+		t.Errorf("have %d cells, want %d", n, len(cells))
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM neighbors`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(edges) {
+		t.Errorf("have %d neighbors, want %d", n, len(edges))
+	}
+}
+
+func TestWriteTopologyGraphML(t *testing.T) {
+	d, _ := topologyTestGrid(t)
+	var b bytes.Buffer
+	if err := d.WriteTopologyGraphML(&b); err != nil {
+		t.Fatal(err)
+	}
+	cells, edges, _ := d.topology()
+
+	var g graphML
+	if err := xml.Unmarshal(b.Bytes(), &g); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Graph.Nodes) != len(cells) {
+		t.Errorf("have %d nodes, want %d", len(g.Graph.Nodes), len(cells))
+	}
+	if len(g.Graph.Edges) != len(edges) {
+		t.Errorf("have %d edges, want %d", len(g.Graph.Edges), len(edges))
+	}
+	nodes := make(map[string]bool)
+	for _, n := range g.Graph.Nodes {
+		nodes[n.ID] = true
+	}
+	for _, e := range g.Graph.Edges {
+		if !nodes[e.Source] || !nodes[e.Target] {
+			t.Errorf("edge %s -> %s refers to a missing node", e.Source, e.Target)
+		}
+	}
+}
+
+func TestOutputTopology_extension(t *testing.T) {
+	if err := OutputTopology("topology.txt", nil)(new(InMAP)); err == nil {
+		t.Error("an unsupported file extension should cause an error")
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Valuation specifies how health impacts are converted to monetary
+// damages (see DamageOutputVariables).
+type Valuation struct {
+	// VSL is the value of a statistical life [$], which is the monetary
+	// value of each premature death avoided.
+	VSL float64
+
+	// IncomeColumn is optionally the name of a variable with the per
+	// capita income in each grid cell (see VarGridConfig.IncomeColumn).
+	// If it is not empty, VSL is adjusted in each grid cell by the ratio
+	// of the income in the grid cell to BaseIncome, raised to the power
+	// of IncomeElasticity.
+	IncomeColumn string
+
+	// BaseIncome is the per capita income at which VSL was estimated.
+	BaseIncome float64
+
+	// IncomeElasticity is the income elasticity of VSL, which is the
+	// fractional change in VSL caused by a fractional change in income.
+	IncomeElasticity float64
+
+	// CessationLag optionally specifies the fraction of the deaths that
+	// occur in each year after the change in exposure, starting with the
+	// year of the change. The fractions must sum to 1. If it is empty,
+	// all deaths occur in the year of the change.
+	CessationLag []float64
+
+	// DiscountRate is the annual rate at which the value of deaths that
+	// occur in later years (see CessationLag) is discounted.
+	DiscountRate float64
+}
+
+// DiscountFactor returns the present value of a death whose timing is
+// distributed according to CessationLag, relative to the value of a death
+// in the year of the change in exposure.
+func (v *Valuation) DiscountFactor() (float64, error) {
+	if len(v.CessationLag) == 0 {
+		return 1, nil
+	}
+	var sum, f float64
+	for i, l := range v.CessationLag {
+		if l < 0 {
+			return 0, fmt.Errorf("inmap: cessation lag fraction %d is negative", i)
+		}
+		sum += l
+		f += l / math.Pow(1+v.DiscountRate, float64(i))
+	}
+	if math.Abs(sum-1) > 1.e-3 {
+		return 0, fmt.Errorf("inmap: cessation lag fractions sum to %g rather than 1", sum)
+	}
+	return f, nil
+}
+
+// DamageOutputVariables returns output variable expressions (see
+// NewOutputter) for the monetary damages [$] caused by premature deaths,
+// as valued by v. The keys of damages are the names of the damage output
+// variables and the values are the names of the output variables with the
+// numbers of deaths; for example, {"TotalDmg": "TotalPopD"}. Because the
+// expressions are calculated in each grid cell, the damages can be summed
+// across grid cells or, in SR predictions, calculated for each emissions
+// source.
+func DamageOutputVariables(v *Valuation, damages map[string]string) (map[string]string, error) {
+	if len(damages) == 0 {
+		return nil, nil
+	}
+	if v.VSL <= 0 {
+		return nil, fmt.Errorf("inmap: VSL must be positive but is %g", v.VSL)
+	}
+	discount, err := v.DiscountFactor()
+	if err != nil {
+		return nil, err
+	}
+	format := func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+	value := format(v.VSL * discount)
+	if v.IncomeColumn != "" {
+		if v.BaseIncome <= 0 {
+			return nil, fmt.Errorf("inmap: BaseIncome must be positive for income adjustment but is %g", v.BaseIncome)
+		}
+		value = fmt.Sprintf("%s * pow(%s / %s, %s)", value, v.IncomeColumn, format(v.BaseIncome), format(v.IncomeElasticity))
+	}
+	o := make(map[string]string, len(damages))
+	for name, deaths := range damages {
+		o[name] = fmt.Sprintf("%s * %s", deaths, value)
+	}
+	return o, nil
+}
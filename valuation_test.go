@@ -0,0 +1,87 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDamageOutputVariables(t *testing.T) {
+	v := &Valuation{VSL: 1e7}
+	vars, err := DamageOutputVariables(v, map[string]string{"TotalDmg": "TotalPopD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"TotalDmg": "TotalPopD * 10000000"}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("have %v, want %v", vars, want)
+	}
+
+	v = &Valuation{
+		VSL:              1e7,
+		IncomeColumn:     "Income",
+		BaseIncome:       50000,
+		IncomeElasticity: 0.4,
+		CessationLag:     []float64{0.5, 0.5},
+		DiscountRate:     0.25,
+	}
+	vars, err = DamageOutputVariables(v, map[string]string{"TotalDmg": "TotalPopD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]string{"TotalDmg": "TotalPopD * 9000000 * pow(Income / 50000, 0.4)"}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("have %v, want %v", vars, want)
+	}
+
+	if vars, err := DamageOutputVariables(v, nil); vars != nil || err != nil {
+		t.Errorf("no damages: have %v, %v", vars, err)
+	}
+	v.BaseIncome = 0
+	if _, err := DamageOutputVariables(v, map[string]string{"D": "TotalPopD"}); err == nil {
+		t.Error("missing base income should cause an error")
+	}
+}
+
+func TestValuation_DiscountFactor(t *testing.T) {
+	// The 20-year cessation lag used by the US EPA.
+	lag := []float64{0.3, 0.125, 0.125, 0.125, 0.125}
+	for i := 0; i < 15; i++ {
+		lag = append(lag, 0.2/15)
+	}
+	v := Valuation{CessationLag: lag, DiscountRate: 0.03}
+	f, err := v.DiscountFactor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want float64
+	for i, l := range lag {
+		want += l * math.Pow(1.03, -float64(i))
+	}
+	if math.Abs(f-want) > 1e-12 || f >= 1 || f < 0.9 {
+		t.Errorf("have %g, want %g", f, want)
+	}
+
+	v.CessationLag = []float64{0.5, 0.2}
+	if _, err := v.DiscountFactor(); err == nil {
+		t.Error("fractions that don't sum to 1 should cause an error")
+	}
+}
@@ -53,6 +53,13 @@ type VarGridConfig struct {
 	Ynests         []int   // Nesting multiples in the Y direction
 	HiResLayers    int     // number of layers to do in high resolution (layers above this will be lowest resolution.
 
+	// LayerHeights are the heights above ground [m] of the edges of the
+	// vertical layers, starting with zero. If they are specified, the CTM
+	// data are regridded to these layers when they are loaded (see
+	// (*CTMData).RegridLayers); otherwise, the layers of the CTM data are
+	// used.
+	LayerHeights []float64
+
 	PopDensityThreshold float64 // limit for people per unit area in the grid cell
 	PopThreshold        float64 // limit for total number of people in the grid cell
 
@@ -61,6 +68,45 @@ type VarGridConfig struct {
 	// See the documentation for PopConcMutator for more information.
 	PopConcThreshold float64
 
+	// RefinementCriteria are the criteria that are used to decide which
+	// grid cells to divide when a static grid is created. They can be any
+	// combination of "population" (PopDensityThreshold and PopThreshold),
+	// "emissions" (EmisDensityThreshold), "landuse" (LandUseFile),
+	// "importance" (ImportanceFile), and "gradient" (GradientFile), and
+	// a cell is divided if any of them are met. If RefinementCriteria is
+	// empty, "population" is used. See RefinementMutator for more
+	// information.
+	RefinementCriteria []string
+
+	// EmisDensityThreshold is the limit for the total emissions of all
+	// pollutants per unit area in the grid cell [μg/s/m²].
+	EmisDensityThreshold float64
+
+	// LandUseFile is the path to a land use shapefile, LandUseColumn is
+	// the field in the shapefile containing the land use categories, and
+	// LandUseCategories are the categories where the grid should be
+	// divided (e.g., urban areas).
+	LandUseFile       string
+	LandUseColumn     string
+	LandUseCategories []string
+
+	// ImportanceFile is the path to a shapefile containing user-defined
+	// importance values (e.g., the cells of a raster converted to
+	// polygons) in the field ImportanceColumn. ImportanceThreshold is the
+	// limit for the area-weighted average importance in the grid cell.
+	ImportanceFile      string
+	ImportanceColumn    string
+	ImportanceThreshold float64
+
+	// GradientFile is the path to a shapefile of concentrations, such as
+	// the output of a previous simulation, with the concentrations in the
+	// field GradientColumn. GradientThreshold is the limit for the
+	// difference between the highest and lowest concentrations within
+	// the grid cell divided by the highest concentration in the file.
+	GradientFile      string
+	GradientColumn    string
+	GradientThreshold float64
+
 	CensusFile        string   // Path to census shapefile or COARDS-compliant NetCDF file
 	CensusPopColumns  []string // Shapefile fields containing populations for multiple demographics
 	PopGridColumn     string   // Name of field in shapefile to be used for determining variable grid resolution
@@ -71,7 +117,65 @@ type VarGridConfig struct {
 	// should be used for population-weighting each mortality rate.
 	MortalityRateColumns map[string]string
 
-	GridProj string // projection info for CTM grid; Proj4 format
+	// AgeGroups optionally specify the population and baseline mortality
+	// rate columns of age groups, which are loaded in addition to
+	// CensusPopColumns and MortalityRateColumns so that the health
+	// impacts in each age group can be calculated
+	// (see AgeGroupOutputVariables).
+	AgeGroups []AgeGroup
+
+	// MorbidityEndpoints optionally specify health endpoints other than
+	// premature mortality, whose population and baseline incidence rate
+	// columns are loaded in the same way as AgeGroups
+	// (see MorbidityOutputVariables).
+	MorbidityEndpoints []MorbidityEndpoint
+
+	// PopulationRasters optionally give the paths to gridded population
+	// files in the ESRI ASCII grid format and longitude-latitude
+	// coordinates, such as those of the Gridded Population of the World
+	// (GPW) and WorldPop datasets, for each of the CensusPopColumns
+	// (as keys). If they are specified, they are used instead of CensusFile.
+	PopulationRasters map[string]string
+
+	// CountryMortalityFile optionally gives the path to a CSV file with
+	// country-level baseline mortality rates, such as those from the
+	// Global Burden of Disease (GBD) study, with a column named
+	// CountryIDColumn containing the country identifiers and a column for
+	// each of the MortalityRateColumns. The rates are assigned to the
+	// country boundaries in the shapefile CountryFile, which also has a
+	// CountryIDColumn field, and used instead of MortalityRateFile.
+	CountryMortalityFile string
+	CountryFile          string
+	CountryIDColumn      string
+
+	// ProjectionFile optionally gives the path to a CSV file with factors
+	// for projecting the population and baseline mortality rates to a
+	// future year. It has a header row and the columns ProjectionIDColumn,
+	// which contains region identifiers, "Year", and any of the
+	// CensusPopColumns and MortalityRateColumns, including those of the
+	// AgeGroups, which contain the factors that the population and
+	// mortality rates are multiplied by. The factors for ProjectionYear
+	// are applied to the population and mortality rate shapes whose
+	// centroids are within each region in the shapefile
+	// ProjectionRegionFile, such as counties, which also has a
+	// ProjectionIDColumn field. Columns and regions without factors are
+	// not changed.
+	ProjectionFile       string
+	ProjectionRegionFile string
+	ProjectionIDColumn   string
+	ProjectionYear       int
+
+	// IncomeColumn optionally gives the name of a field in MortalityRateFile
+	// that contains per capita income, which is population-weighted by
+	// PopGridColumn in the same way as the mortality rates and can be used
+	// to adjust the value of statistical life (see Valuation).
+	IncomeColumn string
+
+	// GridProj is the projection info for the CTM grid in Proj4 or WKT
+	// format. A grid in the longitude-latitude projection whose outermost
+	// nest spans 360° in the x direction is a global grid, whose western
+	// and eastern edges are neighbors.
+	GridProj string
 }
 
 func (c *VarGridConfig) bounds() *geom.Bounds {
@@ -161,6 +265,9 @@ func (config *VarGridConfig) LoadCTMData(rw cdf.ReaderWriterAt) (*CTMData, error
 		Data        *sparse.DenseArray
 	})
 	for _, v := range f.Header.Variables() {
+		if dims := f.Header.Dimensions(v); len(dims) == 1 && dims[0] == v {
+			continue // Skip CF coordinate variables.
+		}
 		d := struct {
 			Dims        []string
 			Description string
@@ -169,6 +276,9 @@ func (config *VarGridConfig) LoadCTMData(rw cdf.ReaderWriterAt) (*CTMData, error
 		}{}
 		d.Description = f.Header.GetAttribute(v, "description").(string)
 		d.Units = f.Header.GetAttribute(v, "units").(string)
+		if u, ok := f.Header.GetAttribute(v, "inmap_units").(string); ok {
+			d.Units = u // The original units of a CF file.
+		}
 		dims := f.Header.Lengths(v)
 		r := f.Reader(v, nil, nil)
 		d.Data = sparse.ZerosDense(dims...)
@@ -195,19 +305,131 @@ func (config *VarGridConfig) LoadCTMData(rw cdf.ReaderWriterAt) (*CTMData, error
 		od[v] = d
 	}
 	o.Data = od
+	if len(config.LayerHeights) > 0 {
+		return o.RegridLayers(config.LayerHeights)
+	}
 	return o, nil
 }
 
+// ctmVariables are the variables that CTM data must include to
+// create a variable resolution grid.
+var ctmVariables = []string{"UAvg", "VAvg", "WAvg", "UDeviation", "VDeviation",
+	"aOrgPartitioning", "bOrgPartitioning", "NOPartitioning", "SPartitioning",
+	"NHPartitioning", "SO2oxidation", "ParticleDryDep", "SO2DryDep", "NOxDryDep",
+	"NH3DryDep", "VOCDryDep", "Kxxyy", "LayerHeights", "Dz", "ParticleWetDep",
+	"SO2WetDep", "OtherGasWetDep", "Kzz", "M2u", "M2d", "WindSpeed",
+	"WindSpeedInverse", "WindSpeedMinusThird", "WindSpeedMinusOnePointFour",
+	"Temperature", "S1", "Sclass", "TotalPM25", "gNH", "pNH", "gNO", "pNO",
+	"gS", "pS", "aVOC", "aSOA"}
+
+// CheckCTMData checks, by reading only the header of the CTM data file
+// rw, that it can be used with config: that its data version is
+// compatible, that it includes all of the variables required to create
+// a grid, that its projection matches GridProj if the file specifies
+// one, and that it covers the variable resolution grid.
+func (config *VarGridConfig) CheckCTMData(rw cdf.ReaderWriterAt) error {
+	f, err := cdf.Open(rw)
+	if err != nil {
+		return fmt.Errorf("inmap: reading CTM data: %v", err)
+	}
+	if v, _ := f.Header.GetAttribute("", "data_version").(string); v != InMAPDataVersion {
+		return fmt.Errorf("inmap: CTM data version %q is incompatible with the "+
+			"required version %s; rerun the preprocessor to update it", v, InMAPDataVersion)
+	}
+	vars := make(map[string]bool)
+	for _, v := range f.Header.Variables() {
+		vars[v] = true
+	}
+	var missing []string
+	for _, v := range ctmVariables {
+		if !vars[v] {
+			missing = append(missing, v)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("inmap: CTM data is missing variable(s) %s", strings.Join(missing, ", "))
+	}
+
+	if p, ok := f.Header.GetAttribute("", "grid_projection").(string); ok && p != "" {
+		ctmSR, err := proj.Parse(p)
+		if err != nil {
+			return fmt.Errorf("inmap: parsing CTM data grid projection: %v", err)
+		}
+		gridSR, err := proj.Parse(config.GridProj)
+		if err != nil {
+			return fmt.Errorf("inmap: parsing GridProj: %v", err)
+		}
+		if !ctmSR.Equal(gridSR, 100) {
+			return fmt.Errorf("inmap: CTM data grid projection %q does not match GridProj %q", p, config.GridProj)
+		}
+	}
+
+	if len(config.Xnests) == 0 || len(config.Ynests) == 0 || config.globalBounds() != nil {
+		return nil
+	}
+	dx, _ := f.Header.GetAttribute("", "dx").([]float64)
+	dy, _ := f.Header.GetAttribute("", "dy").([]float64)
+	nx, _ := f.Header.GetAttribute("", "nx").([]int32)
+	ny, _ := f.Header.GetAttribute("", "ny").([]int32)
+	x0, _ := f.Header.GetAttribute("", "x0").([]float64)
+	y0, _ := f.Header.GetAttribute("", "y0").([]float64)
+	if len(dx) == 0 || len(dy) == 0 || len(nx) == 0 || len(ny) == 0 || len(x0) == 0 || len(y0) == 0 {
+		return fmt.Errorf("inmap: CTM data is missing grid attributes")
+	}
+	ctm := &geom.Bounds{
+		Min: geom.Point{X: x0[0], Y: y0[0]},
+		Max: geom.Point{X: x0[0] + dx[0]*float64(nx[0]), Y: y0[0] + dy[0]*float64(ny[0])},
+	}
+	b := config.bounds()
+	tolerance := math.Max(dx[0], dy[0]) * 1.e-6
+	if b.Min.X < ctm.Min.X-tolerance || b.Min.Y < ctm.Min.Y-tolerance ||
+		b.Max.X > ctm.Max.X+tolerance || b.Max.Y > ctm.Max.Y+tolerance {
+		return fmt.Errorf("inmap: the variable resolution grid, which extends from "+
+			"(%g, %g) to (%g, %g), is not within the CTM data grid, which extends from "+
+			"(%g, %g) to (%g, %g); check that the grid and the CTM data are in the same "+
+			"projection (GridProj)", b.Min.X, b.Min.Y, b.Max.X, b.Max.Y,
+			ctm.Min.X, ctm.Min.Y, ctm.Max.X, ctm.Max.Y)
+	}
+	return nil
+}
+
 // Write writes d to netcdf file w.
 func (d *CTMData) Write(w *os.File) error {
+	return d.write(w, false, "")
+}
+
+// WriteCF writes d to netcdf file w following the Climate and Forecast
+// (CF) metadata conventions, so that it can be inspected with tools
+// such as Panoply or xarray. In addition to the contents of the file
+// written by Write, the file includes coordinate variables for each
+// dimension and CF long names and units for each variable. gridProj is
+// the spatial reference of the CTM grid; if it is a longitude-latitude
+// projection, the x and y coordinates are written as longitudes and
+// latitudes. The file can also be read by LoadCTMData.
+func (d *CTMData) WriteCF(w *os.File, gridProj string) error {
+	return d.write(w, true, gridProj)
+}
+
+// cfUnits holds CF-compliant replacements for the units of InMAP
+// variables that are not UDUNITS-compatible.
+var cfUnits = map[string]string{
+	"fraction":             "1",
+	"?":                    "1",
+	"0=Unstable; 1=Stable": "1",
+	"(m s-1)^(-1)":         "s m-1",
+}
+
+// write writes d to netcdf file w, following the CF conventions if
+// cf is true.
+func (d *CTMData) write(w *os.File, cf bool, gridProj string) error {
 	windSpeed := d.Data["WindSpeed"].Data
 	uAvg := d.Data["UAvg"].Data
 	vAvg := d.Data["VAvg"].Data
 	wAvg := d.Data["WAvg"].Data
-	h := cdf.NewHeader(
-		[]string{"x", "y", "z", "xStagger", "yStagger", "zStagger"},
-		[]int{windSpeed.Shape[2], windSpeed.Shape[1], windSpeed.Shape[0],
-			uAvg.Shape[2], vAvg.Shape[1], wAvg.Shape[0]})
+	dimNames := []string{"x", "y", "z", "xStagger", "yStagger", "zStagger"}
+	dimLengths := []int{windSpeed.Shape[2], windSpeed.Shape[1], windSpeed.Shape[0],
+		uAvg.Shape[2], vAvg.Shape[1], wAvg.Shape[0]}
+	h := cdf.NewHeader(dimNames, dimLengths)
 	h.AddAttribute("", "comment", "InMAP meteorology and baseline chemistry data file")
 
 	h.AddAttribute("", "x0", []float64{d.xo})
@@ -219,6 +441,17 @@ func (d *CTMData) Write(w *os.File) error {
 
 	h.AddAttribute("", "data_version", InMAPDataVersion)
 
+	var coords map[string][]float64
+	if cf {
+		h.AddAttribute("", "Conventions", "CF-1.8")
+		h.AddAttribute("", "title", "InMAP meteorology and baseline chemistry data")
+		h.AddAttribute("", "source", "InMAP preprocessor")
+		if gridProj != "" {
+			h.AddAttribute("", "grid_projection", gridProj)
+		}
+		coords = d.addCFCoordinates(h, gridProj, dimNames, dimLengths)
+	}
+
 	// Sort the names so they write in the same order every time.
 	names := make([]string, 0, len(d.Data))
 	for n := range d.Data {
@@ -230,7 +463,17 @@ func (d *CTMData) Write(w *os.File) error {
 		dd := d.Data[name]
 		h.AddVariable(name, dd.Dims, []float32{0})
 		h.AddAttribute(name, "description", dd.Description)
-		h.AddAttribute(name, "units", dd.Units)
+		if !cf {
+			h.AddAttribute(name, "units", dd.Units)
+			continue
+		}
+		h.AddAttribute(name, "long_name", dd.Description)
+		if u, ok := cfUnits[dd.Units]; ok {
+			h.AddAttribute(name, "units", u)
+			h.AddAttribute(name, "inmap_units", dd.Units)
+		} else {
+			h.AddAttribute(name, "units", dd.Units)
+		}
 	}
 	h.Define()
 
@@ -239,6 +482,13 @@ func (d *CTMData) Write(w *os.File) error {
 		return err
 	}
 
+	for _, name := range dimNames {
+		if c, ok := coords[name]; ok {
+			if _, err = f.Writer(name, []int{0}, []int{len(c)}).Write(c); err != nil {
+				return fmt.Errorf("inmap: writing coordinate variable %s to netcdf file: %v", name, err)
+			}
+		}
+	}
 	for _, name := range names {
 		dd := d.Data[name]
 		if err = writeNCF(f, name, dd.Data); err != nil {
@@ -252,6 +502,93 @@ func (d *CTMData) Write(w *os.File) error {
 	return nil
 }
 
+// addCFCoordinates adds CF coordinate variables for the given dimensions
+// of d and their lengths to h and returns their values.
+func (d *CTMData) addCFCoordinates(h *cdf.Header, gridProj string, dimNames []string, dimLengths []int) map[string][]float64 {
+	xName, yName := "projection_x_coordinate", "projection_y_coordinate"
+	xUnits, yUnits := "m", "m"
+	if strings.Contains(gridProj, "longlat") || strings.Contains(gridProj, "latlong") {
+		xName, yName = "longitude", "latitude"
+		xUnits, yUnits = "degrees_east", "degrees_north"
+	}
+	// Staggered dimensions hold the edges of the grid cells, and
+	// vertical layer indices start at 0.
+	origins := map[string]float64{
+		"x": d.xo + d.dx/2, "y": d.yo + d.dy/2, "z": 0,
+		"xStagger": d.xo, "yStagger": d.yo, "zStagger": -0.5,
+	}
+	spacing := map[string]float64{
+		"x": d.dx, "y": d.dy, "z": 1,
+		"xStagger": d.dx, "yStagger": d.dy, "zStagger": 1,
+	}
+	coords := make(map[string][]float64)
+	for i, name := range dimNames {
+		c := make([]float64, dimLengths[i])
+		for j := range c {
+			c[j] = origins[name] + spacing[name]*float64(j)
+		}
+		coords[name] = c
+	}
+	attrs := []struct {
+		name, standardName, longName, units, axis string
+	}{
+		{"x", xName, "x coordinate of grid cell center", xUnits, "X"},
+		{"y", yName, "y coordinate of grid cell center", yUnits, "Y"},
+		{"z", "model_level_number", "vertical layer index", "1", "Z"},
+		{"xStagger", xName, "x coordinate of grid cell edge", xUnits, ""},
+		{"yStagger", yName, "y coordinate of grid cell edge", yUnits, ""},
+		{"zStagger", "model_level_number", "vertical layer edge index", "1", ""},
+	}
+	for _, a := range attrs {
+		h.AddVariable(a.name, []string{a.name}, []float64{0})
+		h.AddAttribute(a.name, "standard_name", a.standardName)
+		h.AddAttribute(a.name, "long_name", a.longName)
+		h.AddAttribute(a.name, "units", a.units)
+		if a.axis != "" {
+			h.AddAttribute(a.name, "axis", a.axis)
+		}
+		if a.name == "z" || a.name == "zStagger" {
+			h.AddAttribute(a.name, "positive", "up")
+		}
+	}
+	return coords
+}
+
+// AverageCTMData returns the average of the variables in data, where
+// each item in data is weighted by the corresponding item in weights
+// (e.g., the number of hours in the period it represents).
+// All items in data must have the same grid and variables.
+func AverageCTMData(data []*CTMData, weights []float64) (*CTMData, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if len(weights) != len(data) {
+		return nil, fmt.Errorf("inmap: averaging CTM data: %d weights for %d datasets", len(weights), len(data))
+	}
+	var wSum float64
+	for _, w := range weights {
+		wSum += w
+	}
+	o := new(CTMData)
+	o.xo, o.yo, o.dx, o.dy = data[0].xo, data[0].yo, data[0].dx, data[0].dy
+	o.nx, o.ny = data[0].nx, data[0].ny
+	for name, v := range data[0].Data {
+		avg := sparse.ZerosDense(v.Data.Shape...)
+		for i, d := range data {
+			dv, ok := d.Data[name]
+			if !ok || len(dv.Data.Elements) != len(avg.Elements) {
+				return nil, fmt.Errorf("inmap: averaging CTM data: inconsistent variable %s in dataset %d", name, i)
+			}
+			f := weights[i] / wSum
+			for j, val := range dv.Data.Elements {
+				avg.Elements[j] += val * f
+			}
+		}
+		o.AddVariable(name, v.Dims, v.Description, v.Units, avg)
+	}
+	return o, nil
+}
+
 // CombineCTMData returns the combination of the input data nests.
 // The output will have the extent of the first nest and the horizontal
 // resolution of the highest resolution nest. It is assumed that
@@ -301,14 +638,26 @@ func CombineCTMData(nests ...*CTMData) (*CTMData, error) {
 		nestio := round((nest.xo - o.xo) / o.dx) // x-index in output grid of nest ll corner.
 		nestjo := round((nest.yo - o.yo) / o.dy) // y-index in output grid of nest ll corner.
 
-		// Closure for copying one layer
-		copyLayer := func(get func(j, i int) float64, set func(v float64, j, i int)) {
-			for nj := 0; nj < nest.ny; nj++ {
-				for ni := 0; ni < nest.nx; ni++ {
+		// Closure for copying one layer. Staggered variables have one more
+		// value than the number of grid cells in the staggered direction;
+		// the values at the upper edge of the nest are copied to the
+		// corresponding edge in the output grid.
+		copyLayer := func(get func(j, i int) float64, set func(v float64, j, i int), yStagger, xStagger int) {
+			onx, ony := o.nx+xStagger, o.ny+yStagger
+			for nj := 0; nj < nest.ny+yStagger; nj++ {
+				ojEnd := nestjo + (nj+1)*yNestFac
+				if nj == nest.ny {
+					ojEnd = nestjo + nj*yNestFac + 1
+				}
+				for ni := 0; ni < nest.nx+xStagger; ni++ {
+					oiEnd := nestio + (ni+1)*xNestFac
+					if ni == nest.nx {
+						oiEnd = nestio + ni*xNestFac + 1
+					}
 					v := get(nj, ni)
-					for oj := nestjo + nj*yNestFac; oj < nestjo+(nj+1)*yNestFac; oj++ {
-						for oi := nestio + ni*xNestFac; oi < nestio+(ni+1)*xNestFac; oi++ {
-							if oi >= 0 && oj >= 0 && oi < o.nx && oj < o.ny {
+					for oj := nestjo + nj*yNestFac; oj < ojEnd; oj++ {
+						for oi := nestio + ni*xNestFac; oi < oiEnd; oi++ {
+							if oi >= 0 && oj >= 0 && oi < onx && oj < ony {
 								set(v, oj, oi)
 							}
 						}
@@ -318,25 +667,38 @@ func CombineCTMData(nests ...*CTMData) (*CTMData, error) {
 		}
 
 		for name, data := range nest.Data {
+			var xStagger, yStagger, zStagger int
+			for _, dim := range data.Dims {
+				switch dim {
+				case "xStagger":
+					xStagger = 1
+				case "yStagger":
+					yStagger = 1
+				case "zStagger":
+					zStagger = 1
+				}
+			}
 			switch len(data.Dims) {
 			case 3:
 				if _, ok := o.Data[name]; !ok {
-					o.AddVariable(name, data.Dims, data.Description, data.Units, sparse.ZerosDense(nz, o.ny, o.nx))
+					o.AddVariable(name, data.Dims, data.Description, data.Units,
+						sparse.ZerosDense(nz+zStagger, o.ny+yStagger, o.nx+xStagger))
 				}
 				od := o.Data[name]
-				for k := 0; k < nz; k++ {
+				for k := 0; k < nz+zStagger; k++ {
 					get := func(j, i int) float64 { return data.Data.Get(k, j, i) }
 					set := func(v float64, j, i int) { od.Data.Set(v, k, j, i) }
-					copyLayer(get, set)
+					copyLayer(get, set, yStagger, xStagger)
 				}
 			case 2:
 				if _, ok := o.Data[name]; !ok {
-					o.AddVariable(name, data.Dims, data.Description, data.Units, sparse.ZerosDense(o.ny, o.nx))
+					o.AddVariable(name, data.Dims, data.Description, data.Units,
+						sparse.ZerosDense(o.ny+yStagger, o.nx+xStagger))
 				}
 				od := o.Data[name]
 				get := func(j, i int) float64 { return data.Data.Get(j, i) }
 				set := func(v float64, j, i int) { od.Data.Set(v, j, i) }
-				copyLayer(get, set)
+				copyLayer(get, set, yStagger, xStagger)
 			default:
 				return nil, fmt.Errorf("inmap: invalid number of dimensions (%d) when combining CTM data", len(data.Dims))
 			}
@@ -392,19 +754,44 @@ type PopIndices map[string]int
 // mortality rate.
 type MortIndices map[string]int
 
-// LoadPopMort loads the population and mortality rate data from the shapefiles
-// specified in config.
+// LoadPopMort loads the population and mortality rate data from the files
+// specified in config, including the columns of config.AgeGroups,
+// config.MorbidityEndpoints, and config.IncomeColumn, and projects them to
+// config.ProjectionYear if config.ProjectionFile is specified.
 func (config *VarGridConfig) LoadPopMort() (*Population, PopIndices, *MortalityRates, MortIndices, error) {
+	config.addAgeGroupColumns()
+	config.addMorbidityColumns()
+	if config.IncomeColumn != "" {
+		config.addRateColumn(config.IncomeColumn, config.PopGridColumn)
+	}
+
 	gridSR, err := proj.Parse(config.GridProj)
 	if err != nil {
 		return nil, nil, nil, nil, fmt.Errorf("inmap: while parsing GridProj: %v", err)
 	}
 
-	pop, popIndex, err := config.loadPopulation(gridSR, config.bounds())
+	global := config.globalBounds()
+	bounds := config.bounds()
+	if global != nil {
+		// Include the population that can be wrapped into the grid.
+		bounds.Min.X -= 360
+		bounds.Max.X += 360
+	}
+	pf, err := config.loadProjection(gridSR)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("inmap: while loading projection factors: %v", err)
+	}
+	pop, popIndex, err := config.loadPopulation(gridSR, bounds)
 	if err != nil {
 		return nil, nil, nil, nil, fmt.Errorf("inmap: while loading population: %v", err)
 	}
-	mort, mortIndex, err := config.loadMortality(gridSR)
+	if pf != nil {
+		pop = projectPopulation(pop, pf, popIndex)
+	}
+	if global != nil {
+		pop = wrapPopulation(pop)
+	}
+	mort, mortIndex, err := config.loadMortality(gridSR, pf)
 	if err != nil {
 		return nil, nil, nil, nil, fmt.Errorf("inmap: while loading mortality rate: %v", err)
 	}
@@ -413,9 +800,9 @@ func (config *VarGridConfig) LoadPopMort() (*Population, PopIndices, *MortalityR
 
 // getCells returns all the grid cells in cellTree that are within box
 // and at vertical layer layer.
-func getCells(cellTree *rtree.Rtree, box *geom.Bounds, layer int) *cellList {
+func getCells(cellTree *rtree.Rtree, box *geom.Bounds, layer int) cellList {
 	x := cellTree.SearchIntersect(box)
-	cells := new(cellList)
+	var cells cellList
 	for _, xx := range x {
 		c := xx.(*Cell)
 		if c.Layer == layer {
@@ -425,28 +812,30 @@ func getCells(cellTree *rtree.Rtree, box *geom.Bounds, layer int) *cellList {
 	return cells
 }
 
-func (config *VarGridConfig) webMapTrans() (t proj.Transformer, notMeters bool, err error) {
+func (config *VarGridConfig) webMapTrans() (t proj.Transformer, units gridUnits, err error) {
 
 	// webMapProj is the spatial reference definition for web mapping.
 	const webMapProj = "+proj=merc +a=6378137 +b=6378137 +lat_ts=0.0 +lon_0=0.0 +x_0=0.0 +y_0=0 +k=1.0 +units=m +nadgrids=@null +no_defs"
 	// webMapSR is the spatial reference for web mapping.
 	webMapSR, err := proj.Parse(webMapProj)
 	if err != nil {
-		return nil, false, fmt.Errorf("inmap: while parsing webMapProj: %v", err)
+		return nil, otherUnits, fmt.Errorf("inmap: while parsing webMapProj: %v", err)
 	}
 
 	gridSR, err := proj.Parse(config.GridProj)
 	if err != nil {
-		return nil, false, fmt.Errorf("inmap: while parsing GridProj: %v", err)
+		return nil, otherUnits, fmt.Errorf("inmap: while parsing GridProj: %v", err)
 	}
 	webMapTrans, err := gridSR.NewTransform(webMapSR)
 	if err != nil {
-		return nil, false, fmt.Errorf("inmap: while creating webMapTrans: %v", err)
+		return nil, otherUnits, fmt.Errorf("inmap: while creating webMapTrans: %v", err)
 	}
-	if gridSR.ToMeter > 1.0000001 || gridSR.ToMeter < 0.999999 || gridSR.Name == "longlat" {
-		notMeters = true
+	if gridSR.Name == "longlat" {
+		units = degreeUnits
+	} else if gridSR.ToMeter > 1.0000001 || gridSR.ToMeter < 0.999999 {
+		units = otherUnits
 	}
-	return webMapTrans, notMeters, nil
+	return webMapTrans, units, nil
 }
 
 // RegularGrid returns a function that creates a new regular
@@ -454,13 +843,14 @@ func (config *VarGridConfig) webMapTrans() (t proj.Transformer, notMeters bool,
 // as specified by the information in c.
 func (config *VarGridConfig) RegularGrid(data *CTMData, pop *Population, popIndex PopIndices, mortRates *MortalityRates, mortIndex MortIndices, emis *Emissions, m Mechanism) DomainManipulator {
 	return func(d *InMAP) error {
-		webMapTrans, notMeters, err := config.webMapTrans()
+		webMapTrans, units, err := config.webMapTrans()
 		if err != nil {
 			return err
 		}
 
 		d.PopIndices = (map[string]int)(popIndex)
 		d.mortIndices = (map[string]int)(mortIndex)
+		d.global = config.globalBounds()
 
 		nz := data.Data["UAvg"].Data.Shape[0]
 		d.nlayers = nz
@@ -483,7 +873,7 @@ func (config *VarGridConfig) RegularGrid(data *CTMData, pop *Population, popInde
 				}
 			}
 		}
-		err = d.addCells(config, indices, layers, nil, data, pop, mortRates, emis, webMapTrans, m, notMeters)
+		err = d.addCells(config, indices, layers, nil, data, pop, mortRates, emis, webMapTrans, m, units)
 		if err != nil {
 			return err
 		}
@@ -526,7 +916,7 @@ func (config *VarGridConfig) MutateGrid(divideRule GridMutator, data *CTMData, p
 			return err
 		}
 
-		webMapTrans, notMeters, err := config.webMapTrans()
+		webMapTrans, units, err := config.webMapTrans()
 		if err != nil {
 			return err
 		}
@@ -537,14 +927,14 @@ func (config *VarGridConfig) MutateGrid(divideRule GridMutator, data *CTMData, p
 			var newCellIndices [][][2]int
 			var newCellLayers []int
 			var newCellConc [][]float64
-			var cellsToDelete []*cellRef
+			var cellsToDelete []*Cell
 			for _, cell := range *d.cells {
 				if len(cell.Index) < len(config.Xnests) {
 					if divideRule(cell.Cell, totalMass, totalPopulation) {
 						continueMutating = true
 
 						// mark the grid cell for deletion
-						cellsToDelete = append(cellsToDelete, cell)
+						cellsToDelete = append(cellsToDelete, cell.Cell)
 
 						// Create inner nested cells instead of using this one.
 						for ii := 0; ii < config.Xnests[len(cell.Index)]; ii++ {
@@ -566,17 +956,23 @@ func (config *VarGridConfig) MutateGrid(divideRule GridMutator, data *CTMData, p
 
 			// Delete the grid cells.
 			for _, cell := range cellsToDelete {
-				d.cells.delete(cell)
-				d.index.Delete(cell.Cell)
+				d.cells.deleteCell(cell)
+				d.index.Delete(cell)
 				cell.dereferenceNeighbors(d)
 			}
 
 			// Add new cells.
 			err = d.addCells(config, newCellIndices, newCellLayers, newCellConc,
-				data, pop, mortRates, emis, webMapTrans, m, notMeters)
+				data, pop, mortRates, emis, webMapTrans, m, units)
 			if err != nil {
 				return err
 			}
+			// The concentrations of the deleted cells are used to
+			// initialize the new cells, so their memory can only be
+			// reused afterwards.
+			for _, cell := range cellsToDelete {
+				d.cellStore.release(cell)
+			}
 		}
 
 		endCells := d.cells.len()
@@ -592,11 +988,18 @@ func (config *VarGridConfig) MutateGrid(divideRule GridMutator, data *CTMData, p
 func (d *InMAP) addCells(config *VarGridConfig, newCellIndices [][][2]int,
 	newCellLayers []int, conc [][]float64, data *CTMData, pop *Population,
 	mortRates *MortalityRates, emis *Emissions, webMapTrans proj.Transformer,
-	m Mechanism, notMeters bool) error {
+	m Mechanism, units gridUnits) error {
 	type cellErr struct {
+		i    int
 		cell *Cell
 		err  error
 	}
+	// The cells are allocated here rather than by the workers so that
+	// they are placed in memory in the order of newCellIndices.
+	newCells := make([]*Cell, len(newCellIndices))
+	for i := range newCells {
+		newCells[i] = d.cellStore.newCell()
+	}
 	cellErrChan := make(chan cellErr, len(newCellIndices))
 	cellIndexChan := make(chan int)
 	nprocs := runtime.GOMAXPROCS(-1)
@@ -609,9 +1012,9 @@ func (d *InMAP) addCells(config *VarGridConfig, newCellIndices [][][2]int,
 				if conc != nil {
 					conci = conc[i]
 				}
-				cell, err2 := config.createCell(data, pop, d.PopIndices, mortRates, d.mortIndices, ii,
-					newCellLayers[i], conci, webMapTrans, m, notMeters)
-				cellErrChan <- cellErr{cell: cell, err: err2}
+				cell, err2 := config.createCell(newCells[i], data, pop, d.PopIndices, mortRates, d.mortIndices, ii,
+					newCellLayers[i], conci, webMapTrans, m, units)
+				cellErrChan <- cellErr{i: i, cell: cell, err: err2}
 			}
 		}()
 	}
@@ -621,13 +1024,23 @@ func (d *InMAP) addCells(config *VarGridConfig, newCellIndices [][][2]int,
 		cellIndexChan <- i
 	}
 	close(cellIndexChan)
-	// Insert the new cells into d.
+	// Insert the new cells into d in the order of newCellIndices,
+	// rather than the order they are created in, because the order
+	// affects the order of each cell's neighbors and therefore the
+	// results of the simulation.
+	cells := make([]*Cell, len(newCellIndices))
 	for range newCellIndices {
 		cellerr := <-cellErrChan
 		if cellerr.err != nil {
 			return cellerr.err
 		}
-		d.InsertCell(cellerr.cell, m)
+		cells[cellerr.i] = cellerr.cell
+	}
+	for _, cell := range cells {
+		d.InsertCell(cell, m)
+	}
+	if err := d.cellStore.error(); err != nil {
+		return err
 	}
 
 	// Add emissions to new cells.
@@ -639,17 +1052,28 @@ func (d *InMAP) addCells(config *VarGridConfig, newCellIndices [][][2]int,
 }
 
 // SetEmissionsFlux sets the emissions flux for the cells in the receiver
-// based on the emissions in e.
+// based on the emissions in e. If emis.PlumeDistance is greater than zero,
+// emissions from elevated sources are added using a Gaussian plume
+// sub-model (see Emissions.PlumeDistance).
 func (d *InMAP) SetEmissionsFlux(emis *Emissions, m Mechanism) error {
 	nprocs := runtime.GOMAXPROCS(-1)
 	if emis != nil {
+		if d.global != nil {
+			if err := emis.wrap(d.global); err != nil {
+				return err
+			}
+		}
+		// Plume-in-grid emissions can be added to cells other than the
+		// ones that the sources are in, so the emissions of all cells
+		// need to be recalculated when the grid changes.
+		plumeInGrid := emis.PlumeDistance > 0
 		cellIndexChan2 := make(chan int)
 		errChan := make(chan error)
 		for p := 0; p < nprocs; p++ {
 			go func() {
 				for i := range cellIndexChan2 {
 					c := (*d.cells)[i]
-					if len(c.EmisFlux) == 0 {
+					if len(c.EmisFlux) == 0 || plumeInGrid {
 						if err := c.SetEmissionsFlux(emis, m); err != nil { // This needs to be called after setNeighbors.
 							errChan <- err
 							return
@@ -668,6 +1092,9 @@ func (d *InMAP) SetEmissionsFlux(emis *Emissions, m Mechanism) error {
 				return err
 			}
 		}
+		if plumeInGrid {
+			return d.addPlumeInGridEmissions(emis, m)
+		}
 	}
 	return nil
 }
@@ -682,6 +1109,7 @@ func (d *InMAP) InsertCell(c *Cell, m Mechanism) {
 	if c.Layer > d.nlayers-1 { // Make sure we still have the right number of layers
 		d.nlayers = c.Layer + 1
 	}
+	d.cellStore.store(c)
 	d.cells.add(c)
 	d.index.Insert(c)
 	d.setNeighbors(c, m)
@@ -709,7 +1137,7 @@ func PopulationMutator(config *VarGridConfig, popIndices PopIndices) (GridMutato
 	return func(cell *Cell, _, _ float64) bool {
 		population := 0.
 		aboveDensityThreshold := false
-		for _, g := range *cell.groundLevel {
+		for _, g := range cell.groundLevel {
 			population += g.PopData[popIndex]
 			if g.AboveDensityThreshold {
 				aboveDensityThreshold = true
@@ -752,14 +1180,14 @@ func (p *PopConcMutator) Mutate() GridMutator {
 			return false
 		}
 		var groundCellPop float64
-		for _, gc := range *cell.groundLevel {
+		for _, gc := range cell.groundLevel {
 			groundCellPop += gc.PopData[iPop]
 		}
 		totalMassPop := totalMass * totalPopulation
-		for _, group := range []*cellList{cell.west, cell.east, cell.north, cell.south} {
-			for _, neighbor := range *group {
+		for _, group := range []cellList{cell.west, cell.east, cell.north, cell.south} {
+			for _, neighbor := range group {
 				var groundNeighborPop float64
-				for _, gc := range *neighbor.groundLevel {
+				for _, gc := range neighbor.groundLevel {
 					groundNeighborPop += gc.PopData[iPop]
 				}
 				ΣΔC := 0.
@@ -798,12 +1226,11 @@ func (config *VarGridConfig) cellGeometry(index [][2]int) geom.Polygonal {
 // that intersect the cell are above the population density threshold,
 // then the grid cell is also set to being above the density threshold.
 // If conc != nil, the concentration data for the new cell will be set to conc.
-// notMeters should be set to true if the units of the grid are not
-// in meters.
-func (config *VarGridConfig) createCell(data *CTMData, pop *Population, popIndices PopIndices,
-	mortRates *MortalityRates, mortIndices MortIndices, index [][2]int, layer int, conc []float64, webMapTrans proj.Transformer, m Mechanism, notMeters bool) (*Cell, error) {
+// units are the units of the grid coordinates. The new cell is stored in
+// cell, which should be empty.
+func (config *VarGridConfig) createCell(cell *Cell, data *CTMData, pop *Population, popIndices PopIndices,
+	mortRates *MortalityRates, mortIndices MortIndices, index [][2]int, layer int, conc []float64, webMapTrans proj.Transformer, m Mechanism, units gridUnits) (*Cell, error) {
 
-	cell := new(Cell)
 	cell.PopData = make([]float64, len(popIndices))
 	cell.MortData = make([]float64, len(mortIndices))
 
@@ -815,20 +1242,28 @@ func (config *VarGridConfig) createCell(data *CTMData, pop *Population, popIndic
 		cell.loadPopMortalityRate(config, mortRates, mortIndices, pop, popIndices)
 	}
 
-	gg, err := cell.Polygonal.Transform(webMapTrans)
+	webMapGeom := cell.Polygonal
+	if units == degreeUnits {
+		webMapGeom = webMapBounds(cell.Polygonal.Bounds())
+	}
+	gg, err := webMapGeom.Transform(webMapTrans)
 	if err != nil {
 		return nil, err
 	}
 	cell.WebMapGeom = gg.(geom.Polygonal)
 
-	var bounds *geom.Bounds
-	if notMeters {
-		bounds = cell.WebMapGeom.Bounds()
-	} else {
-		bounds = cell.Polygonal.Bounds()
+	switch units {
+	case degreeUnits:
+		cell.Dx, cell.Dy = lonLatCellSize(cell.Polygonal.Bounds())
+	case otherUnits:
+		bounds := cell.WebMapGeom.Bounds()
+		cell.Dx = bounds.Max.X - bounds.Min.X
+		cell.Dy = bounds.Max.Y - bounds.Min.Y
+	default:
+		bounds := cell.Polygonal.Bounds()
+		cell.Dx = bounds.Max.X - bounds.Min.X
+		cell.Dy = bounds.Max.Y - bounds.Min.Y
 	}
-	cell.Dx = bounds.Max.X - bounds.Min.X
-	cell.Dy = bounds.Max.Y - bounds.Min.Y
 
 	cell.make(m)
 	if err := cell.loadData(data, layer); err != nil {
@@ -946,11 +1381,15 @@ type mortality struct {
 }
 
 // loadPopulation loads population information from a shapefile or
-// COARDS-compliant NetCDF file (determined by file extension), converting it
+// COARDS-compliant NetCDF file (determined by file extension), or from
+// config.PopulationRasters if they are specified, converting it
 // to spatial reference sr and then discarding any geometries that do not
 // overlap with bounds. The function outputs an index holding the population
 // information and a map giving the array index of each population type.
 func (config *VarGridConfig) loadPopulation(sr *proj.SR, bounds *geom.Bounds) (func(*geom.Bounds) func() (*population, error), map[string]int, error) {
+	if len(config.PopulationRasters) > 0 {
+		return config.loadPopulationRasters(sr)
+	}
 	x := filepath.Ext(config.CensusFile)
 	if x == ".shp" {
 		return config.loadPopulationShapefile(sr, bounds)
@@ -1152,7 +1591,51 @@ func s2f(s string) (float64, error) {
 	return f, err
 }
 
-func (config *VarGridConfig) loadMortality(sr *proj.SR) (*rtree.Rtree, map[string]int, error) {
+// loadMortality loads baseline mortality rates from config.MortalityRateFile,
+// or from config.CountryMortalityFile if it is specified, and projects them
+// using p if it is not nil.
+func (config *VarGridConfig) loadMortality(sr *proj.SR, p *projectionFactors) (*rtree.Rtree, map[string]int, error) {
+	if config.CountryMortalityFile != "" {
+		return config.loadMortalityCountries(sr, p)
+	}
+	return config.loadMortalityShapefile(sr, p)
+}
+
+// mortalityColumns returns the sorted names of config.MortalityRateColumns
+// and a map giving the array index of each.
+func (config *VarGridConfig) mortalityColumns() ([]string, map[string]int) {
+	// Extract mortality rate column names from map of population to mortality rates
+	mortRateColumns := make([]string, len(config.MortalityRateColumns))
+	i := 0
+	for m := range config.MortalityRateColumns {
+		mortRateColumns[i] = m
+		i++
+	}
+	sort.Strings(mortRateColumns)
+	mortIndices := make(map[string]int)
+	for i, m := range mortRateColumns {
+		mortIndices[m] = i
+	}
+	return mortRateColumns, mortIndices
+}
+
+// insertMortality inserts m into mortRates, along with copies of it shifted
+// by 360° of longitude if the grid is global.
+func insertMortality(mortRates *rtree.Rtree, m *mortality, global *geom.Bounds) error {
+	mortRates.Insert(m)
+	if global != nil {
+		copies, err := wrappedCopies(m.Polygonal, global)
+		if err != nil {
+			return err
+		}
+		for _, g := range copies {
+			mortRates.Insert(&mortality{Polygonal: g.(geom.Polygonal), MortData: m.MortData})
+		}
+	}
+	return nil
+}
+
+func (config *VarGridConfig) loadMortalityShapefile(sr *proj.SR, p *projectionFactors) (*rtree.Rtree, map[string]int, error) {
 	mortshp, err := shp.NewDecoder(config.MortalityRateFile)
 	if err != nil {
 		return nil, nil, err
@@ -1167,21 +1650,9 @@ func (config *VarGridConfig) loadMortality(sr *proj.SR) (*rtree.Rtree, map[strin
 		return nil, nil, err
 	}
 
-	// Create a list of array indices for each mortality rate.
-	mortIndices := make(map[string]int)
-
-	// Extract mortality rate column names from map of population to mortality rates
-	mortRateColumns := make([]string, len(config.MortalityRateColumns))
-	i := 0
-	for m := range config.MortalityRateColumns {
-		mortRateColumns[i] = m
-		i++
-	}
-	sort.Strings(mortRateColumns)
-	for i, m := range mortRateColumns {
-		mortIndices[m] = i
-	}
+	mortRateColumns, mortIndices := config.mortalityColumns()
 	mortRates := rtree.NewTree(25, 50)
+	global := config.globalBounds()
 	for {
 		g, fields, more := mortshp.DecodeRowFields(mortRateColumns...)
 		if !more {
@@ -1212,7 +1683,10 @@ func (config *VarGridConfig) loadMortality(sr *proj.SR) (*rtree.Rtree, map[strin
 		default:
 			return nil, nil, fmt.Errorf("inmap: loadMortality: mortality rate shapes need to be polygons")
 		}
-		mortRates.Insert(m)
+		m.MortData = p.scale(m.Polygonal, m.MortData, mortIndices)
+		if err := insertMortality(mortRates, m, global); err != nil {
+			return nil, nil, err
+		}
 	}
 	if err := mortshp.Error(); err != nil {
 		return nil, nil, err
@@ -1335,6 +1809,36 @@ func (c *Cell) loadData(data *CTMData, k int) error {
 			k, ctmrow, ctmcol) * frac
 		c.CBaseline[ipOrg] += data.Data["aSOA"].Data.Get(
 			k, ctmrow, ctmcol) * frac
+
+		// The ozone variables are only present if the data
+		// was preprocessed with the Ozone option.
+		for name, v := range map[string]*float64{
+			"O3":               &c.BaselineO3,
+			"O3NOxSensitivity": &c.O3NOxSensitivity,
+			"NOxOxidation":     &c.NOxOxidation,
+			"VOCOxidation":     &c.VOCOxidation,
+		} {
+			if d, ok := data.Data[name]; ok {
+				*v += d.Data.Get(k, ctmrow, ctmcol) * frac
+			}
+		}
+
+		// The coarse particle dry deposition velocity is only present
+		// if the data was preprocessed with the CoarsePM option.
+		if d, ok := data.Data["CoarseParticleDryDep"]; ok {
+			c.CoarseParticleDryDep += d.Data.Get(k, ctmrow, ctmcol) * frac
+		}
+
+		// The seasonal meteorology is only present if the data was
+		// preprocessed with the NitrateEquilibrium option.
+		for s, name := range Seasons {
+			if d, ok := data.Data["Temperature"+name]; ok {
+				c.SeasonalTemperature[s] += d.Data.Get(k, ctmrow, ctmcol) * frac
+			}
+			if d, ok := data.Data["RH"+name]; ok {
+				c.SeasonalRH[s] += d.Data.Get(k, ctmrow, ctmcol) * frac
+			}
+		}
 	}
 	return nil
 }
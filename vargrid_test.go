@@ -24,8 +24,10 @@ import (
 	"math"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/ctessum/cdf"
 	"github.com/ctessum/geom"
 	"github.com/ctessum/geom/index/rtree"
 	"github.com/ctessum/geom/proj"
@@ -534,11 +536,11 @@ func (d *InMAP) TestCellAlignment2(t *testing.T) {
 	for _, cell := range *d.cells {
 		var westCoverage, eastCoverage, northCoverage, southCoverage float64
 		var aboveCoverage, belowCoverage, groundLevelCoverage float64
-		for _, w := range *cell.west {
+		for _, w := range cell.west {
 			westCoverage += w.info.coverFrac
 			if !w.boundary {
 				pass := false
-				for _, e := range *w.east {
+				for _, e := range w.east {
 					if e.Cell == cell.Cell {
 						pass = true
 						if different(w.info.diff, e.info.diff, testTolerance) {
@@ -555,11 +557,11 @@ func (d *InMAP) TestCellAlignment2(t *testing.T) {
 				}
 			}
 		}
-		for _, e := range *cell.east {
+		for _, e := range cell.east {
 			eastCoverage += e.info.coverFrac
 			if !e.boundary {
 				pass := false
-				for _, w := range *e.west {
+				for _, w := range e.west {
 					if w.Cell == cell.Cell {
 						pass = true
 						if different(e.info.diff, w.info.diff, testTolerance) {
@@ -576,11 +578,11 @@ func (d *InMAP) TestCellAlignment2(t *testing.T) {
 				}
 			}
 		}
-		for _, n := range *cell.north {
+		for _, n := range cell.north {
 			northCoverage += n.info.coverFrac
 			if !n.boundary {
 				pass := false
-				for _, s := range *n.south {
+				for _, s := range n.south {
 					if s.Cell == cell.Cell {
 						pass = true
 						if different(n.info.diff, s.info.diff, testTolerance) {
@@ -597,11 +599,11 @@ func (d *InMAP) TestCellAlignment2(t *testing.T) {
 				}
 			}
 		}
-		for _, s := range *cell.south {
+		for _, s := range cell.south {
 			southCoverage += s.info.coverFrac
 			if !s.boundary {
 				pass := false
-				for _, n := range *s.north {
+				for _, n := range s.north {
 					if n.Cell == cell.Cell {
 						pass = true
 						if different(s.info.diff, n.info.diff, testTolerance) {
@@ -618,11 +620,11 @@ func (d *InMAP) TestCellAlignment2(t *testing.T) {
 				}
 			}
 		}
-		for _, a := range *cell.above {
+		for _, a := range cell.above {
 			aboveCoverage += a.info.coverFrac
 			if !a.boundary {
 				pass := false
-				for _, b := range *a.below {
+				for _, b := range a.below {
 					if b.Cell == cell.Cell {
 						pass = true
 						if different(a.info.diff, b.info.diff, testTolerance) {
@@ -641,13 +643,13 @@ func (d *InMAP) TestCellAlignment2(t *testing.T) {
 				}
 			}
 		}
-		for _, b := range *cell.below {
+		for _, b := range cell.below {
 			belowCoverage += b.info.coverFrac
 			pass := false
 			if cell.Layer == 0 && b.Cell == cell.Cell {
 				pass = true
 			} else {
-				for _, a := range *b.above {
+				for _, a := range b.above {
 					if a.Cell == cell.Cell {
 						pass = true
 						if different(b.info.diff, a.info.diff, testTolerance) {
@@ -665,7 +667,7 @@ func (d *InMAP) TestCellAlignment2(t *testing.T) {
 			}
 		}
 		// Assume upper cells are never higher resolution than lower cells
-		for _, g := range *cell.groundLevel {
+		for _, g := range cell.groundLevel {
 			groundLevelCoverage += g.info.coverFrac
 			g2 := g
 			pass := false
@@ -674,7 +676,7 @@ func (d *InMAP) TestCellAlignment2(t *testing.T) {
 					pass = false
 					break
 				}
-				if g2.Cell == (*g2.above)[0].Cell {
+				if g2.Cell == g2.above[0].Cell {
 					pass = false
 					break
 				}
@@ -682,7 +684,7 @@ func (d *InMAP) TestCellAlignment2(t *testing.T) {
 					pass = true
 					break
 				}
-				g2 = (*g2.above)[0]
+				g2 = g2.above[0]
 			}
 			if !pass {
 				t.Errorf("Failed for Cell %v GroundLevel", cell)
@@ -774,6 +776,62 @@ func TestReadWriteCTMData(t *testing.T) {
 	os.Remove(TestCTMDataFile)
 }
 
+func TestReadWriteCTMDataCF(t *testing.T) {
+	cfg, ctmdata := CreateTestCTMData()
+
+	f, err := os.Create(TestCTMDataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(TestCTMDataFile)
+
+	if err = ctmdata.WriteCF(f, "+proj=lcc +lat_1=33 +lat_2=45 +lat_0=40 +lon_0=-97"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	f, err = os.Open(TestCTMDataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	nc, err := cdf.Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := nc.Header.GetAttribute("", "Conventions"); c != "CF-1.8" {
+		t.Errorf("Conventions: have %v, want CF-1.8", c)
+	}
+	for v, want := range map[string][]float64{
+		"x":        {-6000, 6000},
+		"xStagger": {-12000, 0},
+		"z":        {0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+	} {
+		have := make([]float64, len(want))
+		if _, err = nc.Reader(v, nil, nil).Read(have); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("%s: have %v, want %v", v, have, want)
+		}
+		if u := nc.Header.GetAttribute(v, "units"); v != "z" && u != "m" {
+			t.Errorf("%s units: have %v, want m", v, u)
+		}
+	}
+	if u := nc.Header.GetAttribute("SPartitioning", "units"); u != "1" {
+		t.Errorf("SPartitioning units: have %v, want 1", u)
+	}
+	if n := nc.Header.GetAttribute("gNO", "long_name"); n != ctmdata.Data["gNO"].Description {
+		t.Errorf("gNO long_name: have %v", n)
+	}
+
+	ctmdata2, err := cfg.LoadCTMData(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareCTMData(ctmdata, ctmdata2, 1.0e-10, t)
+}
+
 func TestCombineCTMData(t *testing.T) {
 	flag.Parse()
 
@@ -933,3 +991,43 @@ func TestLoadPopulationCOARDS(t *testing.T) {
 		t.Errorf("sum: %g != %g", popSum, wantSum)
 	}
 }
+
+func TestCheckCTMData(t *testing.T) {
+	check := func(ctmdata *CTMData, cfg *VarGridConfig, gridProj string) error {
+		t.Helper()
+		f, err := os.Create(TestCTMDataFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(TestCTMDataFile)
+		if err = ctmdata.WriteCF(f, gridProj); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		f, err = os.Open(TestCTMDataFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		return cfg.CheckCTMData(f)
+	}
+
+	cfg, ctmdata := CreateTestCTMData()
+	if err := check(ctmdata, &cfg, cfg.GridProj); err != nil {
+		t.Error(err)
+	}
+	if err := check(ctmdata, &cfg, "+proj=longlat"); err == nil || !strings.Contains(err.Error(), "does not match GridProj") {
+		t.Errorf("expected a projection mismatch error, have %v", err)
+	}
+
+	outside := cfg
+	outside.VariableGridXo -= 100000
+	if err := check(ctmdata, &outside, ""); err == nil || !strings.Contains(err.Error(), "is not within the CTM data grid") {
+		t.Errorf("expected an extent error, have %v", err)
+	}
+
+	delete(ctmdata.Data, "Kzz")
+	if err := check(ctmdata, &cfg, ""); err == nil || !strings.Contains(err.Error(), "missing variable(s) Kzz") {
+		t.Errorf("expected a missing variable error, have %v", err)
+	}
+}
@@ -0,0 +1,384 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ctessum/atmos/seinfeld"
+	"github.com/ctessum/atmos/wesely1989"
+)
+
+// wrfFormat is the format of the dates in WRF-Chem output file names.
+const wrfFormat = "2006-01-02_15_04_05"
+
+// WRF-Chem chemical mechanisms that are supported by the
+// WRF-Chem preprocessor.
+const (
+	// WRFChemRADM2MADEVBS is the RADM2 gas-phase mechanism with the
+	// MADE/VBS aerosol scheme (WRF-Chem chem_opt=108).
+	WRFChemRADM2MADEVBS = "RADM2-MADE/VBS"
+
+	// WRFChemMOZARTMOSAIC is the MOZART gas-phase mechanism with the
+	// 4-bin MOSAIC aerosol scheme and simple volatility basis set
+	// secondary organic aerosol (WRF-Chem chem_opt=201).
+	WRFChemMOZARTMOSAIC = "MOZART-MOSAIC"
+)
+
+// WRFChem is an InMAP preprocessor for WRF-Chem output. Meteorological
+// variables are read in the same way as for WRF-Cmaq output, and
+// chemical species are read and lumped according to the chemical
+// mechanism, which can be set using SetMechanism.
+type WRFChem struct {
+	// WRFCmaq provides the meteorological variables.
+	*WRFCmaq
+
+	mechanism string
+
+	aVOC, bVOC, aSOA, bSOA, nox, pNO, sox, pS, nh3, pNH, totalPM25 map[string]float64
+
+	// ho and h2o2 are the names of the hydroxyl radical and hydrogen
+	// peroxide variables.
+	ho, h2o2 string
+}
+
+// NewWRFChem initializes a WRF-Chem preprocessor from the given
+// configuration information.
+// WRFOut is the location of WRF-Chem output files.
+// [DATE] should be used as a wild card for the simulation date.
+// startDate and endDate are the dates of the beginning and end of the
+// simulation, respectively, in the format "YYYYMMDD".
+// If msgChan is not nil, status messages will be sent to it.
+// By default, the output is assumed to be from the RADM2 gas-phase
+// mechanism with the MADE/VBS aerosol scheme, and land use categories
+// are assumed to be from the USGS classification.
+func NewWRFChem(WRFOut, startDate, endDate string, msgChan chan string) (*WRFChem, error) {
+	met, err := NewWRFCmaq(WRFOut, startDate, endDate, msgChan)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: WRF-Chem preprocessor: %v", err)
+	}
+	met.dateFormat = wrfFormat
+	met.SetLandUseTable(usgsLandUse())
+	w := &WRFChem{WRFCmaq: met}
+	if err := w.SetMechanism(WRFChemRADM2MADEVBS); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// SetMechanism sets the chemical mechanism of the WRF-Chem output,
+// which determines the species that make up each of the chemical
+// species groups. Valid options are "RADM2-MADE/VBS" and "MOZART-MOSAIC".
+//
+// Gas-phase species are in units of [ppmv] and particle-phase species
+// are in units of [μg/kg dry air]; both are converted to [μg/m3].
+func (w *WRFChem) SetMechanism(mechanism string) error {
+	switch mechanism {
+	case WRFChemRADM2MADEVBS:
+		w.setRADM2MADEVBS()
+	case WRFChemMOZARTMOSAIC:
+		w.setMOZARTMOSAIC()
+	default:
+		return fmt.Errorf("inmap: WRF-Chem preprocessor: invalid mechanism '%s'; valid options are %s and %s",
+			mechanism, WRFChemRADM2MADEVBS, WRFChemMOZARTMOSAIC)
+	}
+	w.mechanism = mechanism
+	return w.checkSpecies()
+}
+
+// setRADM2MADEVBS sets the species groups for the RADM2 gas-phase
+// mechanism and the MADE/VBS aerosol scheme.
+func (w *WRFChem) setRADM2MADEVBS() {
+	// Only includes anthropogenic precursors to SOA from
+	// anthropogenic (aSOA) and biogenic (bSOA) sources as
+	// in Ahmadov et al. (2012).
+	// We assume condensable vapor from SOA has a molar mass of 70.
+	w.aVOC = map[string]float64{
+		"hc5":     ppmvToUgKg(72),
+		"hc8":     ppmvToUgKg(114),
+		"olt":     ppmvToUgKg(42),
+		"oli":     ppmvToUgKg(68),
+		"tol":     ppmvToUgKg(92),
+		"xyl":     ppmvToUgKg(106),
+		"csl":     ppmvToUgKg(108),
+		"cvasoa1": ppmvToUgKg(70),
+		"cvasoa2": ppmvToUgKg(70),
+		"cvasoa3": ppmvToUgKg(70),
+		"cvasoa4": ppmvToUgKg(70),
+	}
+	w.bVOC = map[string]float64{
+		"iso":     ppmvToUgKg(68),
+		"api":     ppmvToUgKg(136),
+		"sesq":    ppmvToUgKg(84.2),
+		"lim":     ppmvToUgKg(136),
+		"cvbsoa1": ppmvToUgKg(70),
+		"cvbsoa2": ppmvToUgKg(70),
+		"cvbsoa3": ppmvToUgKg(70),
+		"cvbsoa4": ppmvToUgKg(70),
+	}
+	// Aitken (i) and accumulation (j) mode aerosol.
+	w.aSOA = modes(1, "asoa1", "asoa2", "asoa3", "asoa4")
+	w.bSOA = modes(1, "bsoa1", "bsoa2", "bsoa3", "bsoa4")
+	w.nox = map[string]float64{"no": ppmvToUgKg(mwN), "no2": ppmvToUgKg(mwN)}
+	w.pNO = modes(mwN/mwNO3, "no3a")
+	w.sox = map[string]float64{"so2": ppmvToUgKg(mwS), "sulf": ppmvToUgKg(mwS)}
+	w.pS = modes(mwS/mwSO4, "so4a")
+	w.nh3 = map[string]float64{"nh3": ppmvToUgKg(mwN)}
+	w.pNH = modes(mwN/mwNH4, "nh4a")
+	w.totalPM25 = map[string]float64{"PM2_5_DRY": 1.}
+	w.ho, w.h2o2 = "ho", "h2o2"
+}
+
+// modes returns the Aitken ("i") and accumulation ("j") mode
+// variables for the given MADE aerosol species, each multiplied by factor.
+func modes(factor float64, species ...string) map[string]float64 {
+	o := make(map[string]float64)
+	for _, s := range species {
+		o[s+"i"] = factor
+		o[s+"j"] = factor
+	}
+	return o
+}
+
+// setMOZARTMOSAIC sets the species groups for the MOZART gas-phase
+// mechanism and the 4-bin MOSAIC aerosol scheme with simple volatility basis
+// set SOA (Knote et al., 2014).
+func (w *WRFChem) setMOZARTMOSAIC() {
+	// Anthropogenic and biogenic SOA precursors and the condensable
+	// vapors of the volatility basis set, for which we assume a
+	// molar mass of 250.
+	w.aVOC = map[string]float64{
+		"bigalk":  ppmvToUgKg(72.15),
+		"bigene":  ppmvToUgKg(56.11),
+		"toluene": ppmvToUgKg(92.14),
+		"benzene": ppmvToUgKg(78.11),
+		"xylenes": ppmvToUgKg(106.16),
+		"cvasoaX": ppmvToUgKg(250),
+		"cvasoa1": ppmvToUgKg(250),
+		"cvasoa2": ppmvToUgKg(250),
+		"cvasoa3": ppmvToUgKg(250),
+		"cvasoa4": ppmvToUgKg(250),
+	}
+	w.bVOC = map[string]float64{
+		"isopr":   ppmvToUgKg(68.12),
+		"c10h16":  ppmvToUgKg(136.24),
+		"cvbsoaX": ppmvToUgKg(250),
+		"cvbsoa1": ppmvToUgKg(250),
+		"cvbsoa2": ppmvToUgKg(250),
+		"cvbsoa3": ppmvToUgKg(250),
+		"cvbsoa4": ppmvToUgKg(250),
+	}
+	w.aSOA = mosaicBins(1, "asoaX", "asoa1", "asoa2", "asoa3", "asoa4")
+	w.bSOA = mosaicBins(1, "bsoaX", "bsoa1", "bsoa2", "bsoa3", "bsoa4")
+	w.nox = map[string]float64{"no": ppmvToUgKg(mwN), "no2": ppmvToUgKg(mwN)}
+	w.pNO = mosaicBins(mwN/mwNO3, "no3")
+	w.sox = map[string]float64{"so2": ppmvToUgKg(mwS), "h2so4": ppmvToUgKg(mwS)}
+	w.pS = mosaicBins(mwS/mwSO4, "so4")
+	w.nh3 = map[string]float64{"nh3": ppmvToUgKg(mwN)}
+	w.pNH = mosaicBins(mwN/mwNH4, "nh4")
+	w.totalPM25 = map[string]float64{"PM2_5_DRY": 1.}
+	w.ho, w.h2o2 = "oh", "h2o2"
+}
+
+// mosaicBins returns the variables for the given MOSAIC aerosol
+// species in the size bins that make up PM2.5, each multiplied by factor.
+// The fourth bin (2.5–10 μm) is excluded.
+func mosaicBins(factor float64, species ...string) map[string]float64 {
+	o := make(map[string]float64)
+	for _, s := range species {
+		for bin := 1; bin <= 3; bin++ {
+			o[fmt.Sprintf("%s_a%02d", s, bin)] = factor
+		}
+	}
+	return o
+}
+
+// Mechanism returns the chemical mechanism of the WRF-Chem output.
+func (w *WRFChem) Mechanism() string { return w.mechanism }
+
+func (w *WRFChem) readGroup(varGroup map[string]float64) NextData {
+	dataFuncs := make(map[string]NextData)
+	for v := range varGroup {
+		dataFuncs[v] = w.WRFCmaq.read(v)
+	}
+	return nextDataGroup(dataFuncs, varGroup)
+}
+
+// readGroupAlt reads a group of variables and converts them
+// from [μg/kg] to [μg/m3].
+func (w *WRFChem) readGroupAlt(varGroup map[string]float64) NextData {
+	return divideByAlt(w.readGroup(varGroup), w.WRFCmaq.ALT())
+}
+
+// AVOC helps fulfill the Preprocessor interface.
+func (w *WRFChem) AVOC() NextData { return w.readGroupAlt(w.aVOC) }
+
+// BVOC helps fulfill the Preprocessor interface.
+func (w *WRFChem) BVOC() NextData { return w.readGroupAlt(w.bVOC) }
+
+// NOx helps fulfill the Preprocessor interface.
+func (w *WRFChem) NOx() NextData { return w.readGroupAlt(w.nox) }
+
+// SOx helps fulfill the Preprocessor interface.
+func (w *WRFChem) SOx() NextData { return w.readGroupAlt(w.sox) }
+
+// NH3 helps fulfill the Preprocessor interface.
+func (w *WRFChem) NH3() NextData { return w.readGroupAlt(w.nh3) }
+
+// ASOA helps fulfill the Preprocessor interface.
+func (w *WRFChem) ASOA() NextData { return w.readGroupAlt(w.aSOA) }
+
+// BSOA helps fulfill the Preprocessor interface.
+func (w *WRFChem) BSOA() NextData { return w.readGroupAlt(w.bSOA) }
+
+// PNO helps fulfill the Preprocessor interface.
+func (w *WRFChem) PNO() NextData { return w.readGroupAlt(w.pNO) }
+
+// PS helps fulfill the Preprocessor interface.
+func (w *WRFChem) PS() NextData { return w.readGroupAlt(w.pS) }
+
+// PNH helps fulfill the Preprocessor interface.
+func (w *WRFChem) PNH() NextData { return w.readGroupAlt(w.pNH) }
+
+// TotalPM25 helps fulfill the Preprocessor interface.
+func (w *WRFChem) TotalPM25() NextData { return w.readGroup(w.totalPM25) }
+
+// HO helps fulfill the Preprocessor interface
+// by returning hydroxyl radical concentration [ppmv].
+func (w *WRFChem) HO() NextData { return w.WRFCmaq.read(w.ho) }
+
+// H2O2 helps fulfill the Preprocessor interface
+// by returning hydrogen peroxide concentration [ppmv].
+func (w *WRFChem) H2O2() NextData { return w.WRFCmaq.read(w.h2o2) }
+
+// O3 helps fulfill the Preprocessor interface
+// by returning ozone concentration [ppmv]. The name of the
+// variable is the same in all of the supported mechanisms.
+func (w *WRFChem) O3() NextData { return w.WRFCmaq.read("o3") }
+
+// HNO3 helps fulfill the Preprocessor interface
+// by returning nitric acid concentration [ppmv].
+func (w *WRFChem) HNO3() NextData { return w.WRFCmaq.read("hno3") }
+
+// checkSpecies makes sure that each of the species groups of the mechanism
+// has at least one species in the first WRF-Chem output file, so that a
+// mismatch between the configured and actual mechanisms is found before
+// preprocessing starts. Individual species may be missing, because
+// not all tracers are always written out.
+func (w *WRFChem) checkSpecies() error {
+	ff, err := ncfFromTemplate(w.cmaqOut, w.dateFormat, w.start)
+	if err != nil {
+		return fmt.Errorf("inmap: WRF-Chem preprocessor: %v", err)
+	}
+	defer ff.Close()
+	var missing []string
+	for _, group := range []map[string]float64{w.aVOC, w.bVOC, w.aSOA, w.bSOA, w.nox, w.pNO,
+		w.sox, w.pS, w.nh3, w.pNH, w.totalPM25, {w.ho: 1}, {w.h2o2: 1}} {
+		var vars []string
+		found := false
+		for v := range group {
+			vars = append(vars, v)
+			if ff.Lengths(v) != nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			sort.Strings(vars)
+			missing = append(missing, strings.Join(vars, "+"))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("inmap: WRF-Chem preprocessor: none of the species in group(s) %s of mechanism %s are in the WRF-Chem output",
+			strings.Join(missing, ", "), w.mechanism)
+	}
+	return nil
+}
+
+// USGSseinfeld lookup table to go from USGS land classes to land classes for
+// particle dry deposition.
+var USGSseinfeld = []seinfeld.LandUseCategory{
+	seinfeld.Desert,    //'Urban and Built-Up Land'
+	seinfeld.Grass,     //'Dryland Cropland and Pasture'
+	seinfeld.Grass,     //'Irrigated Cropland and Pasture'
+	seinfeld.Grass,     //'Mixed Dryland/Irrigated Cropland and Pasture'
+	seinfeld.Grass,     //'Cropland/Grassland Mosaic'
+	seinfeld.Grass,     //'Cropland/Woodland Mosaic'
+	seinfeld.Grass,     //'Grassland'
+	seinfeld.Shrubs,    //'Shrubland'
+	seinfeld.Shrubs,    //'Mixed Shrubland/Grassland'
+	seinfeld.Grass,     //'Savanna'
+	seinfeld.Deciduous, //'Deciduous Broadleaf Forest'
+	seinfeld.Evergreen, //'Deciduous Needleleaf Forest'
+	seinfeld.Deciduous, //'Evergreen Broadleaf Forest'
+	seinfeld.Evergreen, //'Evergreen Needleleaf Forest'
+	seinfeld.Deciduous, //'Mixed Forest'
+	seinfeld.Desert,    //'Water Bodies'
+	seinfeld.Grass,     //'Herbaceous Wetland'
+	seinfeld.Deciduous, //'Wooded Wetland'
+	seinfeld.Desert,    //'Barren or Sparsely Vegetated'
+	seinfeld.Shrubs,    //'Herbaceous Tundra'
+	seinfeld.Deciduous, //'Wooded Tundra'
+	seinfeld.Shrubs,    //'Mixed Tundra'
+	seinfeld.Desert,    //'Bare Ground Tundra'
+	seinfeld.Desert,    //'Snow or Ice'
+	seinfeld.Desert,    //'Playa'
+	seinfeld.Desert,    //'Lava'
+	seinfeld.Desert,    //'White Sand'
+}
+
+// USGSwesely lookup table to go from USGS land classes to land classes for
+// gas dry deposition.
+var USGSwesely = []wesely1989.LandUseCategory{
+	wesely1989.Urban,        //'Urban and Built-Up Land'
+	wesely1989.RangeAg,      //'Dryland Cropland and Pasture'
+	wesely1989.RangeAg,      //'Irrigated Cropland and Pasture'
+	wesely1989.RangeAg,      //'Mixed Dryland/Irrigated Cropland and Pasture'
+	wesely1989.RangeAg,      //'Cropland/Grassland Mosaic'
+	wesely1989.Agricultural, //'Cropland/Woodland Mosaic'
+	wesely1989.Range,        //'Grassland'
+	wesely1989.RockyShrubs,  //'Shrubland'
+	wesely1989.RangeAg,      //'Mixed Shrubland/Grassland'
+	wesely1989.Range,        //'Savanna'
+	wesely1989.Deciduous,    //'Deciduous Broadleaf Forest'
+	wesely1989.Coniferous,   //'Deciduous Needleleaf Forest'
+	wesely1989.Deciduous,    //'Evergreen Broadleaf Forest'
+	wesely1989.Coniferous,   //'Evergreen Needleleaf Forest'
+	wesely1989.MixedForest,  //'Mixed Forest'
+	wesely1989.Water,        //'Water Bodies'
+	wesely1989.Wetland,      //'Herbaceous Wetland'
+	wesely1989.Wetland,      //'Wooded Wetland'
+	wesely1989.Barren,       //'Barren or Sparsely Vegetated'
+	wesely1989.RockyShrubs,  //'Herbaceous Tundra'
+	wesely1989.MixedForest,  //'Wooded Tundra'
+	wesely1989.RockyShrubs,  //'Mixed Tundra'
+	wesely1989.Barren,       //'Bare Ground Tundra'
+	wesely1989.Barren,       //'Snow or Ice'
+	wesely1989.Barren,       //'Playa'
+	wesely1989.Barren,       //'Lava'
+	wesely1989.Barren,       //'White Sand'
+}
+
+// USGSz0 holds Roughness lengths for USGS land classes ([m]), from WRF file
+// VEGPARM.TBL.
+var USGSz0 = []float64{.50, .1, .06, .1, 0.095, .20, .11,
+	.03, .035, .15, .50, .50, .50, .50, .35, 0.0001, .20, .40,
+	.01, .10, .30, .15, .075, 0.001, .01, .15, .01}
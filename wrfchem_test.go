@@ -0,0 +1,86 @@
+/*
+Copyright © 2013 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"os"
+	"testing"
+)
+
+func TestWRFChemMechanism(t *testing.T) {
+	wrf, err := NewWRFChem("cmd/inmap/testdata/preproc/wrfout_d01_[DATE]", "20050101", "20050103", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := wrf.Mechanism(); m != WRFChemRADM2MADEVBS {
+		t.Errorf("default mechanism: have %s, want %s", m, WRFChemRADM2MADEVBS)
+	}
+	// The test data is from the RADM2 mechanism, so the MOZART-MOSAIC
+	// species should not be found.
+	if err = wrf.SetMechanism(WRFChemMOZARTMOSAIC); err == nil {
+		t.Error("expected an error for MOZART-MOSAIC species in RADM2 output")
+	}
+	if err = wrf.SetMechanism("xxx"); err == nil {
+		t.Error("expected an error for an invalid mechanism")
+	}
+
+	// Only the PM2.5 size bins should be included.
+	bins := mosaicBins(1, "so4")
+	for _, v := range []string{"so4_a01", "so4_a02", "so4_a03"} {
+		if _, ok := bins[v]; !ok {
+			t.Errorf("MOSAIC bins: %s is missing", v)
+		}
+	}
+	if len(bins) != 3 {
+		t.Errorf("MOSAIC bins: have %v, want 3 bins", bins)
+	}
+}
+
+func TestWRFChemRADM2MADEVBS(t *testing.T) {
+	wrf, err := NewWRFChem("cmd/inmap/testdata/preproc/wrfout_d01_[DATE]", "20050101", "20050103", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newData, err := Preprocess(wrf, -2004000, -540000, 12000, 12000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open("cmd/inmap/testdata/preproc/inmapData_WRFChem_golden.ncf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var cfg VarGridConfig
+	goldenData, err := cfg.LoadCTMData(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the chemical species groups are compared, because the
+	// deposition variables depend on the land use table.
+	for _, v := range []string{"aVOC", "bVOC", "aSOA", "bSOA", "gNO", "pNO", "gS", "pS", "gNH", "pNH",
+		"TotalPM25", "aOrgPartitioning", "SO2oxidation"} {
+		want, have := goldenData.Data[v].Data, newData.Data[v].Data
+		for i, w := range want.Elements {
+			if h := have.Elements[i]; different(h, w, 1.e-6) {
+				t.Errorf("%s[%d]: have %g, want %g", v, i, h, w)
+				break
+			}
+		}
+	}
+}
@@ -48,8 +48,22 @@ type WRFCmaq struct {
 
 	cmaqOut string
 
+	// dateFormat is the format of the dates in the output file names.
+	dateFormat string
+
 	recordDelta, fileDelta time.Duration
 
+	// landUse converts the LU_INDEX land use categories to
+	// deposition parameters.
+	landUse LandUseTable
+
+	// fractionalLandUse specifies whether to use the fractional land use
+	// in LANDUSEF rather than the dominant category in LU_INDEX.
+	fractionalLandUse bool
+
+	// gaps handles missing input data, if it is not nil.
+	gaps *gapTracker
+
 	msgChan chan string
 }
 
@@ -75,6 +89,8 @@ func NewWRFCmaq(WRFOut, startDate, endDate string, msgChan chan string) (*WRFCma
                 pS: map[string]float64{"pS": 1.},
                 pNH: map[string]float64{"pNH": 1.},
 		cmaqOut:  WRFOut,
+		dateFormat: cmaqFormat,
+		landUse: nlcdLandUse(),
 		msgChan: msgChan,
 	}
 
@@ -88,57 +104,126 @@ func NewWRFCmaq(WRFOut, startDate, endDate string, msgChan chan string) (*WRFCma
 		return nil, fmt.Errorf("inmap: WRF-Cmaq preprocessor end time: %v", err)
 	}
 
-	w.recordDelta, err = time.ParseDuration("1h")
+	w.recordDelta, w.fileDelta = time.Hour, 24*time.Hour
+	return &w, nil
+}
+
+// SetTimeIntervals sets the time interval between the records in each
+// WRF output file (recordDelta) and the time interval covered by each file
+// (fileDelta). Each can be a duration such as "10m" or "6h", and fileDelta
+// can also be "monthly". If either is "auto", it is detected from the
+// time coordinate of the first file, and if either is empty it is left
+// unchanged. By default, there is one record per hour and one file per day.
+// Files that each cover less than a day should be specified using
+// the [HOUR] and [MINUTE] wildcards in addition to [DATE].
+func (w *WRFCmaq) SetTimeIntervals(recordDelta, fileDelta string) error {
+	var err error
+	w.recordDelta, w.fileDelta, err = timeIntervals(recordDelta, fileDelta, w.recordDelta, w.fileDelta, func() (ncfFile, error) {
+		return ncfFromTemplate(w.cmaqOut, w.dateFormat, w.start)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("inmap: WRF-Cmaq preprocessor recordDelta: %v", err)
+		return fmt.Errorf("inmap: WRF-Cmaq preprocessor: %v", err)
 	}
-	w.fileDelta, err = time.ParseDuration("24h")
+	return nil
+}
+
+// SetLandUseTable sets the table used to convert the LU_INDEX land use
+// categories to deposition parameters. By default, the 40-category
+// "NLCD" table is used.
+func (w *WRFCmaq) SetLandUseTable(t LandUseTable) { w.landUse = t }
+
+// SetFractionalLandUse sets whether to use the fraction of each grid cell
+// covered by each land use category (WRF variable LANDUSEF) rather than
+// only the dominant category (LU_INDEX). If fractional is true, the
+// roughness length and dry deposition velocities of each grid cell are
+// averaged by area over the land use categories within it.
+func (w *WRFCmaq) SetFractionalLandUse(fractional bool) { w.fractionalLandUse = fractional }
+
+// SetMissingDataPolicy sets how WRF output files that are missing and
+// time steps that cannot be read are handled. policy can be "fail"
+// (the default), "skip", or "interpolate"; see MissingDataPolicy.
+// A summary of the missing data is available from MissingDataReport
+// after preprocessing. The output file for the first day of the
+// simulation must always be available.
+func (w *WRFCmaq) SetMissingDataPolicy(policy string) error {
+	var err error
+	w.gaps, err = newGapTracker(policy, w.checkFile)
 	if err != nil {
-		return nil, fmt.Errorf("inmap: WRF-Cmaq preprocessor fileDelta: %v", err)
+		return fmt.Errorf("inmap: WRF-Cmaq preprocessor: %v", err)
 	}
-	return &w, nil
+	return nil
 }
 
+// MissingDataReport returns a summary of the input data that was
+// missing or could not be read, or an empty string if there was none.
+func (w *WRFCmaq) MissingDataReport() string { return w.gaps.report() }
+
+// checkFile returns an error if the WRF output file for the
+// given date cannot be opened.
+func (w *WRFCmaq) checkFile(date time.Time) error {
+	ff, err := ncfFromTemplate(w.cmaqOut, w.dateFormat, date)
+	if err != nil {
+		return err
+	}
+	return ff.Close()
+}
 
 func (w *WRFCmaq) read(varName string) NextData {
-	return nextDataNCF(w.cmaqOut, cmaqFormat, varName, w.start, w.end, w.recordDelta, w.fileDelta, readNCF, w.msgChan)
+	if w.gaps != nil {
+		return w.gaps.nextData(varName, w.start, w.end, w.recordDelta, w.fileDelta, func(date time.Time, index int) (*sparse.DenseArray, error) {
+			ff, err := ncfFromTemplate(w.cmaqOut, w.dateFormat, date)
+			if err != nil {
+				return nil, err
+			}
+			defer ff.Close()
+			return readNCF(varName, ff, index)
+		}, w.msgChan)
+	}
+	return nextDataNCF(w.cmaqOut, w.dateFormat, varName, w.start, w.end, w.recordDelta, w.fileDelta, readNCF, w.msgChan)
 }
 
 func (w *WRFCmaq) readGroup(varGroup map[string]float64) NextData {
-	return nextDataGroupNCF(w.cmaqOut, cmaqFormat, varGroup, w.start, w.end, w.recordDelta, w.fileDelta, readNCF, w.msgChan)
+	if w.gaps != nil {
+		dataFuncs := make(map[string]NextData)
+		for v := range varGroup {
+			dataFuncs[v] = w.read(v)
+		}
+		return nextDataGroup(dataFuncs, varGroup)
+	}
+	return nextDataGroupNCF(w.cmaqOut, w.dateFormat, varGroup, w.start, w.end, w.recordDelta, w.fileDelta, readNCF, w.msgChan)
 }
 
 // Nx helps fulfill the Preprocessor interface by returning
 // the number of grid cells in the West-East direction.
 func (w *WRFCmaq) Nx() (int, error) {
-	f, ff, err := ncfFromTemplate(w.cmaqOut, cmaqFormat, w.start)
+	ff, err := ncfFromTemplate(w.cmaqOut, w.dateFormat, w.start)
 	if err != nil {
 		return -1, fmt.Errorf("nx: %v", err)
 	}
-	defer f.Close()
-	return ff.Header.Lengths("ALT")[3], nil
+	defer ff.Close()
+	return ff.Lengths("ALT")[3], nil
 }
 
 // Ny helps fulfill the Preprocessor interface by returning
 // the number of grid cells in the South-North direction.
 func (w *WRFCmaq) Ny() (int, error) {
-	f, ff, err := ncfFromTemplate(w.cmaqOut, cmaqFormat, w.start)
+	ff, err := ncfFromTemplate(w.cmaqOut, w.dateFormat, w.start)
 	if err != nil {
 		return -1, fmt.Errorf("ny: %v", err)
 	}
-	defer f.Close()
-	return ff.Header.Lengths("ALT")[2], nil
+	defer ff.Close()
+	return ff.Lengths("ALT")[2], nil
 }
 
 // Nz helps fulfill the Preprocessor interface by returning
 // the number of grid cells in the below-above direction.
 func (w *WRFCmaq) Nz() (int, error) {
-	f, ff, err := ncfFromTemplate(w.cmaqOut, cmaqFormat, w.start)
+	ff, err := ncfFromTemplate(w.cmaqOut, w.dateFormat, w.start)
 	if err != nil {
 		return -1, fmt.Errorf("nz: %v", err)
 	}
-	defer f.Close()
-	return ff.Header.Lengths("ALT")[1], nil
+	defer ff.Close()
+	return ff.Lengths("ALT")[1], nil
 }
 
 // PBLH helps fulfill the Preprocessor interface by returning
@@ -285,15 +370,60 @@ func (w *WRFCmaq) HO() NextData { return w.read("oh") }
 // by returning hydrogen peroxide concentration [ppmv].
 func (w *WRFCmaq) H2O2() NextData { return w.read("h2o2") }
 
+// O3 helps fulfill the Preprocessor interface
+// by returning ozone concentration [ppmv].
+func (w *WRFCmaq) O3() NextData { return w.read("o3") }
+
+// HNO3 helps fulfill the Preprocessor interface
+// by returning nitric acid concentration [ppmv].
+func (w *WRFCmaq) HNO3() NextData { return w.read("hno3") }
+
+// RH helps fulfill the Preprocessor interface
+// by returning relative humidity [fraction].
+func (w *WRFCmaq) RH() NextData { return relativeHumidity(w.read("QVAPOR"), w.T(), w.P()) }
+
+// relativeHumidity returns a function that calculates relative humidity
+// [fraction] from water vapor mixing ratio (qFunc [kg/kg]),
+// temperature (TFunc [K]), and pressure (PFunc [Pa]), using the
+// saturation vapor pressure over water from Bolton (1980,
+// doi:10.1175/1520-0493(1980)108<1046:TCOEPT>2.0.CO;2).
+func relativeHumidity(qFunc, TFunc, PFunc NextData) NextData {
+	return func() (*sparse.DenseArray, error) {
+		q, err := qFunc() // water vapor mixing ratio [kg/kg]
+		if err != nil {
+			return nil, err
+		}
+		T, err := TFunc() // temperature [K]
+		if err != nil {
+			return nil, err
+		}
+		P, err := PFunc() // pressure [Pa]
+		if err != nil {
+			return nil, err
+		}
+		const epsilon = 0.622 // ratio of molar masses of water and dry air
+		rh := sparse.ZerosDense(q.Shape...)
+		for i, t := range T.Elements {
+			es := 611.2 * math.Exp(17.67*(t-273.15)/(t-29.65)) // saturation vapor pressure [Pa]
+			qs := epsilon * es / (P.Elements[i] - es)           // saturation mixing ratio [kg/kg]
+			rh.Elements[i] = q.Elements[i] / qs
+		}
+		return rh, nil
+	}
+}
+
 // SeinfeldLandUse helps fulfill the Preprocessor interface
 // by returning land use categories as
 // specified in github.com/ctessum/atmos/seinfeld.
 func (w *WRFCmaq) SeinfeldLandUse() NextData {
+	if w.fractionalLandUse {
+		return cmaqSeinfeldLandUseFraction(w.read("LANDUSEF"), w.landUse)
+	}
 	luFunc := w.read("LU_INDEX") // USGS land use index
-	return cmaqSeinfeldLandUse(luFunc)
+	return cmaqSeinfeldLandUse(luFunc, w.landUse)
 }
 
-func cmaqSeinfeldLandUse(luFunc NextData) NextData {
+func cmaqSeinfeldLandUse(luFunc NextData, t LandUseTable) NextData {
 	return func() (*sparse.DenseArray, error) {
 		lu, err := luFunc() // USGS land use index
 		if err != nil {
@@ -302,13 +432,31 @@ func cmaqSeinfeldLandUse(luFunc NextData) NextData {
 		o := sparse.ZerosDense(lu.Shape...)
 		for j := 0; j < lu.Shape[0]; j++ {
 			for i := 0; i < lu.Shape[1]; i++ {
-				o.Set(float64(NLCDseinfeld[f2i(lu.Get(j, i)) - 1]), j, i)
+				c, err := t.class(lu.Get(j, i))
+				if err != nil {
+					return nil, err
+				}
+				o.Set(float64(c.Seinfeld), j, i)
 			}
 		}
 		return o, nil
 	}
 }
 
+// cmaqSeinfeldLandUseFraction returns the fraction of each grid cell
+// covered by each Seinfeld land use category, given the fraction covered
+// by each category in t.
+func cmaqSeinfeldLandUseFraction(lufFunc NextData, t LandUseTable) NextData {
+	return func() (*sparse.DenseArray, error) {
+		luf, err := lufFunc() // land use fraction
+		if err != nil {
+			return nil, err
+		}
+		return landUseCategoryFractions(luf, t, int(seinfeld.Shrubs)+1,
+			func(c LandUseClass) int { return int(c.Seinfeld) })
+	}
+}
+
 // NLCDseinfeld lookup table to go from USGS land classes to land classes for
 // particle dry deposition.
 var NLCDseinfeld = []seinfeld.LandUseCategory{
@@ -387,11 +535,14 @@ func geopotentialToHeight(ph, phb *sparse.DenseArray) *sparse.DenseArray {
 // by returning land use categories as
 // specified in github.com/ctessum/atmos/wesely1989.
 func (w *WRFCmaq) WeselyLandUse() NextData {
+	if w.fractionalLandUse {
+		return cmaqWeselyLandUseFraction(w.read("LANDUSEF"), w.landUse)
+	}
 	luFunc := w.read("LU_INDEX") // NLCD land use index
-	return cmaqWeselyLandUse(luFunc)
+	return cmaqWeselyLandUse(luFunc, w.landUse)
 }
 
-func cmaqWeselyLandUse(luFunc NextData) NextData {
+func cmaqWeselyLandUse(luFunc NextData, t LandUseTable) NextData {
 	return func() (*sparse.DenseArray, error) {
 		lu, err := luFunc() // NLCD land use index
 		if err != nil {
@@ -400,13 +551,31 @@ func cmaqWeselyLandUse(luFunc NextData) NextData {
 		o := sparse.ZerosDense(lu.Shape...)
 		for j := 0; j < lu.Shape[0]; j++ {
 			for i := 0; i < lu.Shape[1]; i++ {
-				o.Set(float64(NLCDwesely[f2i(lu.Get(j, i)) - 1]), j, i)
+				c, err := t.class(lu.Get(j, i))
+				if err != nil {
+					return nil, err
+				}
+				o.Set(float64(c.Wesely), j, i)
 			}
 		}
 		return o, nil
 	}
 }
 
+// cmaqWeselyLandUseFraction returns the fraction of each grid cell
+// covered by each Wesely land use category, given the fraction covered
+// by each category in t.
+func cmaqWeselyLandUseFraction(lufFunc NextData, t LandUseTable) NextData {
+	return func() (*sparse.DenseArray, error) {
+		luf, err := lufFunc() // land use fraction
+		if err != nil {
+			return nil, err
+		}
+		return landUseCategoryFractions(luf, t, int(wesely1989.RockyShrubs)+1,
+			func(c LandUseClass) int { return int(c.Wesely) })
+	}
+}
+
 // NLCDwesely lookup table to go from NLCD land classes to land classes for
 // gas dry deposition.
 var NLCDwesely = []wesely1989.LandUseCategory{
@@ -456,8 +625,11 @@ var NLCDwesely = []wesely1989.LandUseCategory{
 // Z0 helps fulfill the Preprocessor interface by
 // returning roughness length.
 func (w *WRFCmaq) Z0() NextData {
+	if w.fractionalLandUse {
+		return cmaqZ0Fraction(w.read("LANDUSEF"), w.landUse)
+	}
 	LUIndexFunc := w.read("LU_INDEX") //NLCD land use index
-	return cmaqZ0(LUIndexFunc)
+	return cmaqZ0(LUIndexFunc, w.landUse)
 }
 
 // NLCDz0 holds Mean Roughness lengths for NLCD land classes ([m]), from WRF file
@@ -467,7 +639,7 @@ var NLCDz0 = []float64{.50, .50, .50, .50, .35, .03, .035, .03, .15, .11,
         .0001, .001, .50, .70, 1.5, 2.0, .01, .50, .50, .35,
         .025, .03, .11, .20, .01, .01, .10, .06, .40, .20}
 
-func cmaqZ0(LUIndexFunc NextData) NextData {
+func cmaqZ0(LUIndexFunc NextData, t LandUseTable) NextData {
 	return func() (*sparse.DenseArray, error) {
 		luIndex, err := LUIndexFunc()
 		if err != nil {
@@ -475,12 +647,28 @@ func cmaqZ0(LUIndexFunc NextData) NextData {
 		}
 		zo := sparse.ZerosDense(luIndex.Shape...)
 		for i, lu := range luIndex.Elements {
-			zo.Elements[i] = NLCDz0[f2i(lu) - 1] // roughness length [m]
+			c, err := t.class(lu)
+			if err != nil {
+				return nil, err
+			}
+			zo.Elements[i] = c.Z0 // roughness length [m]
 		}
 		return zo, nil
 	}
 }
 
+// cmaqZ0Fraction returns the roughness length of each grid cell, averaged
+// by area over the land use categories in t.
+func cmaqZ0Fraction(lufFunc NextData, t LandUseTable) NextData {
+	return func() (*sparse.DenseArray, error) {
+		luf, err := lufFunc() // land use fraction
+		if err != nil {
+			return nil, err
+		}
+		return landUseZ0(luf, t)
+	}
+}
+
 // QRain helps fulfill the Preprocessor interface by
 // returning rain mass fraction.
 func (w *WRFCmaq) QRain() NextData { return w.read("QRAIN") }
@@ -0,0 +1,163 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// WRFGrid holds the location of a WRF domain within its parent
+// domain, as specified by the global attributes of WRF output files.
+type WRFGrid struct {
+	// ID is the domain number (GRID_ID), and ParentID is the
+	// domain number of its parent (PARENT_ID). The outermost domain
+	// is its own parent.
+	ID, ParentID int
+
+	// IParentStart and JParentStart are the one-based indices of the
+	// grid cell of the parent domain that contains the lower-left
+	// corner of the domain (I_PARENT_START and J_PARENT_START).
+	IParentStart, JParentStart int
+
+	// ParentGridRatio is the ratio of the parent grid cell size to
+	// the grid cell size of the domain (PARENT_GRID_RATIO).
+	ParentGridRatio int
+
+	// DX and DY are the grid cell edge lengths [m].
+	DX, DY float64
+}
+
+// WRFGrid returns the location of the WRF domain within its parent domain.
+func (w *WRFCmaq) WRFGrid() (WRFGrid, error) {
+	ff, err := ncfFromTemplate(w.cmaqOut, w.dateFormat, w.start)
+	if err != nil {
+		return WRFGrid{}, fmt.Errorf("inmap: WRF grid: %v", err)
+	}
+	defer ff.Close()
+	var g WRFGrid
+	for _, a := range []struct {
+		name string
+		int  *int
+		f    *float64
+	}{
+		{name: "GRID_ID", int: &g.ID},
+		{name: "PARENT_ID", int: &g.ParentID},
+		{name: "I_PARENT_START", int: &g.IParentStart},
+		{name: "J_PARENT_START", int: &g.JParentStart},
+		{name: "PARENT_GRID_RATIO", int: &g.ParentGridRatio},
+		{name: "DX", f: &g.DX},
+		{name: "DY", f: &g.DY},
+	} {
+		v := ff.Attribute("", a.name)
+		if v == nil {
+			return WRFGrid{}, fmt.Errorf("inmap: WRF grid: missing global attribute %s", a.name)
+		}
+		vals, err := ncfFloats(v)
+		if err != nil || len(vals) != 1 {
+			return WRFGrid{}, fmt.Errorf("inmap: WRF grid: invalid global attribute %s: %v", a.name, v)
+		}
+		if a.int != nil {
+			*a.int = f2i(vals[0])
+		} else {
+			*a.f = vals[0]
+		}
+	}
+	return g, nil
+}
+
+// nestLocations returns the lower-left corner coordinates and grid cell
+// edge lengths of the given domains, where xo and yo are the
+// coordinates of the lower-left corner of the first (outermost) domain.
+// Each domain must come after its parent.
+func nestLocations(grids []WRFGrid, xo, yo float64) (xos, yos, dxs, dys []float64, err error) {
+	n := len(grids)
+	xos, yos, dxs, dys = make([]float64, n), make([]float64, n), make([]float64, n), make([]float64, n)
+	index := make(map[int]int) // Grid ID to index.
+	for i, g := range grids {
+		if _, ok := index[g.ID]; ok {
+			return nil, nil, nil, nil, fmt.Errorf("inmap: nested WRF domains: domain %d is included more than once", g.ID)
+		}
+		index[g.ID] = i
+		if i == 0 {
+			xos[i], yos[i], dxs[i], dys[i] = xo, yo, g.DX, g.DY
+			continue
+		}
+		p, ok := index[g.ParentID]
+		if !ok || g.ParentID == g.ID {
+			return nil, nil, nil, nil, fmt.Errorf("inmap: nested WRF domains: the parent (%d) of domain %d "+
+				"must come before it", g.ParentID, g.ID)
+		}
+		if g.ParentGridRatio < 1 {
+			return nil, nil, nil, nil, fmt.Errorf("inmap: nested WRF domains: domain %d has invalid parent grid ratio %d",
+				g.ID, g.ParentGridRatio)
+		}
+		xos[i] = xos[p] + float64(g.IParentStart-1)*dxs[p]
+		yos[i] = yos[p] + float64(g.JParentStart-1)*dys[p]
+		dxs[i] = dxs[p] / float64(g.ParentGridRatio)
+		dys[i] = dys[p] / float64(g.ParentGridRatio)
+	}
+	return xos, yos, dxs, dys, nil
+}
+
+// PreprocessWRFNests preprocesses the output of nested WRF domains and
+// combines them into a single dataset using CombineCTMData, so that
+// data from each inner domain overrides the data from its parent where
+// they overlap. domains must be ordered from the outermost to the
+// innermost, each after its parent, and must implement
+// the method WRFGrid() (WRFGrid, error), as WRFCmaq, WRFChem, and CAMx do.
+// xo and yo are the coordinates of the lower-left corner of
+// the outermost domain; the locations and grid cell sizes of the nests are
+// determined from the WRF output. opts are applied to each domain; if
+// Checkpoint is specified, the checkpoint files of each domain
+// are saved in a separate subdirectory.
+func PreprocessWRFNests(domains []Preprocessor, xo, yo float64, opts ...PreprocessOption) (*CTMData, error) {
+	grids := make([]WRFGrid, len(domains))
+	for i, d := range domains {
+		g, ok := d.(interface {
+			WRFGrid() (WRFGrid, error)
+		})
+		if !ok {
+			return nil, fmt.Errorf("inmap: nested WRF domains: preprocessor type %T does not support nesting", d)
+		}
+		var err error
+		if grids[i], err = g.WRFGrid(); err != nil {
+			return nil, err
+		}
+	}
+	xos, yos, dxs, dys, err := nestLocations(grids, xo, yo)
+	if err != nil {
+		return nil, err
+	}
+	o := new(preprocessOptions)
+	for _, opt := range opts {
+		opt(o)
+	}
+	nests := make([]*CTMData, len(domains))
+	for i, d := range domains {
+		oo := *o
+		if oo.checkpointDir != "" {
+			oo.checkpointDir = filepath.Join(oo.checkpointDir, fmt.Sprintf("d%02d", grids[i].ID))
+		}
+		if nests[i], err = oo.preprocess(d, xos[i], yos[i], dxs[i], dys[i]); err != nil {
+			return nil, fmt.Errorf("inmap: nested WRF domain %d: %v", grids[i].ID, err)
+		}
+	}
+	return CombineCTMData(nests...)
+}
@@ -0,0 +1,103 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNestLocations(t *testing.T) {
+	grids := []WRFGrid{
+		{ID: 1, ParentID: 1, IParentStart: 1, JParentStart: 1, ParentGridRatio: 1, DX: 36000, DY: 36000},
+		{ID: 2, ParentID: 1, IParentStart: 11, JParentStart: 21, ParentGridRatio: 3, DX: 12000, DY: 12000},
+		{ID: 3, ParentID: 2, IParentStart: 5, JParentStart: 2, ParentGridRatio: 3, DX: 4000, DY: 4000},
+	}
+	xos, yos, dxs, dys, err := nestLocations(grids, -100000, 50000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name       string
+		have, want []float64
+	}{
+		{name: "xo", have: xos, want: []float64{-100000, 260000, 308000}},
+		{name: "yo", have: yos, want: []float64{50000, 770000, 782000}},
+		{name: "dx", have: dxs, want: []float64{36000, 12000, 4000}},
+		{name: "dy", have: dys, want: []float64{36000, 12000, 4000}},
+	} {
+		if !reflect.DeepEqual(test.have, test.want) {
+			t.Errorf("%s: have %v, want %v", test.name, test.have, test.want)
+		}
+	}
+
+	// The parent must come before the nest.
+	if _, _, _, _, err := nestLocations([]WRFGrid{grids[0], grids[2], grids[1]}, 0, 0); err == nil {
+		t.Error("out of order domains should cause an error")
+	}
+	if _, _, _, _, err := nestLocations([]WRFGrid{grids[0], grids[0]}, 0, 0); err == nil {
+		t.Error("duplicate domains should cause an error")
+	}
+}
+
+func TestPreprocessWRFNests(t *testing.T) {
+	newWRF := func() *WRFChem {
+		wrf, err := NewWRFChem("cmd/inmap/testdata/preproc/wrfout_d01_[DATE]", "20050101", "20050102", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wrf
+	}
+	g, err := newWRF().WRFGrid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := WRFGrid{ID: 1, ParentID: 1, IParentStart: 1, JParentStart: 1, ParentGridRatio: 1, DX: 12000, DY: 12000}
+	if g != want {
+		t.Errorf("WRF grid: have %+v, want %+v", g, want)
+	}
+
+	// A single domain should give the same result as preprocessing it directly.
+	nested, err := PreprocessWRFNests([]Preprocessor{newWRF()}, -2004000, -540000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	single, err := Preprocess(newWRF(), -2004000, -540000, 12000, 12000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, w := range single.Data {
+		h, ok := nested.Data[name]
+		if !ok {
+			t.Errorf("missing variable %s", name)
+			continue
+		}
+		for i, v := range w.Data.Elements {
+			if different(h.Data.Elements[i], v, 1.e-10) {
+				t.Errorf("%s[%d]: have %g, want %g", name, i, h.Data.Elements[i], v)
+				break
+			}
+		}
+	}
+
+	// Including the same domain twice should cause an error.
+	if _, err := PreprocessWRFNests([]Preprocessor{newWRF(), newWRF()}, -2004000, -540000); err == nil {
+		t.Error("duplicate domains should cause an error")
+	}
+}
@@ -0,0 +1,591 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gocloud.dev/blob"
+	_ "gocloud.dev/blob/gcsblob" // Register the gs:// scheme.
+	_ "gocloud.dev/blob/s3blob"  // Register the s3:// scheme.
+	"gocloud.dev/gcerrors"
+)
+
+// isZarr returns whether path refers to a Zarr store rather than a
+// NetCDF file: either a local directory or a storage bucket URL with the
+// extension ".zarr" (e.g., "s3://bucket/wrfout.zarr" or
+// "gs://bucket/wrfout.zarr"). Other storage bucket URLs are checked for
+// Zarr stores by openBlobNCF.
+func isZarr(path string) bool {
+	if strings.HasPrefix(path, "file://") {
+		return true
+	}
+	if isBucket(path) {
+		return filepath.Ext(strings.TrimSuffix(path, "/")) == ".zarr"
+	}
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// zarrStores holds the Zarr stores that have already been opened, keyed
+// by path, so that repeatedly opening the same store (once per record)
+// does not require the metadata to be downloaded and parsed each time.
+var zarrStores sync.Map
+
+// openZarr opens the Zarr (version 2) store at the given path, which
+// can be a local directory or a storage bucket URL. Only the array
+// metadata is read when the store is opened; the chunks
+// are read as they are needed.
+func openZarr(path string) (ncfFile, error) {
+	if z, ok := zarrStores.Load(path); ok {
+		return z.(*zarrGroup), nil
+	}
+	s, err := newZarrStore(path)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: opening Zarr store %s: %v", path, err)
+	}
+	z, err := loadZarrGroup(s)
+	if err != nil {
+		return nil, fmt.Errorf("inmap: opening Zarr store %s: %v", path, err)
+	}
+	zz, _ := zarrStores.LoadOrStore(path, z)
+	return zz.(*zarrGroup), nil
+}
+
+// zarrStore is a key-value store containing a Zarr hierarchy.
+type zarrStore interface {
+	// get returns the value at key, or an error satisfying
+	// os.IsNotExist if there is no such key.
+	get(key string) ([]byte, error)
+
+	// list returns the names of the direct children of the given prefix.
+	list(prefix string) ([]string, error)
+}
+
+// newZarrStore returns the store at the given path.
+func newZarrStore(p string) (zarrStore, error) {
+	if !strings.Contains(p, "://") {
+		return zarrDir(p), nil
+	}
+	u, err := url.Parse(p)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "file" {
+		// As elsewhere, the host is treated as the first element of the path.
+		return zarrDir(filepath.Join(u.Host, filepath.FromSlash(u.Path))), nil
+	}
+	ctx := context.Background()
+	b, err := openBucket(ctx, u.Scheme+"://"+u.Host)
+	if err != nil {
+		return nil, err
+	}
+	return &zarrBucket{ctx: ctx, b: b, prefix: strings.Trim(u.Path, "/")}, nil
+}
+
+// zarrDir is a Zarr store in a local directory.
+type zarrDir string
+
+func (d zarrDir) get(key string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(string(d), filepath.FromSlash(key)))
+}
+
+func (d zarrDir) list(prefix string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(string(d), filepath.FromSlash(prefix)))
+	if err != nil {
+		return nil, err
+	}
+	o := make([]string, len(entries))
+	for i, f := range entries {
+		o[i] = f.Name()
+	}
+	return o, nil
+}
+
+// zarrBucket is a Zarr store in a cloud storage bucket.
+type zarrBucket struct {
+	ctx    context.Context
+	b      *blob.Bucket
+	prefix string
+}
+
+func (z *zarrBucket) get(key string) ([]byte, error) {
+	b, err := z.b.ReadAll(z.ctx, path.Join(z.prefix, key))
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return nil, &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+	}
+	return b, err
+}
+
+func (z *zarrBucket) list(prefix string) ([]string, error) {
+	p := path.Join(z.prefix, prefix) + "/"
+	iter := z.b.List(&blob.ListOptions{Prefix: p, Delimiter: "/"})
+	var o []string
+	for {
+		obj, err := iter.Next(z.ctx)
+		if err != nil {
+			if err == io.EOF {
+				return o, nil
+			}
+			return nil, err
+		}
+		o = append(o, strings.Trim(strings.TrimPrefix(obj.Key, p), "/"))
+	}
+}
+
+// zarrGroup is a Zarr group, which fulfills the ncfFile interface.
+type zarrGroup struct {
+	s      zarrStore
+	attrs  map[string]interface{}
+	arrays map[string]*zarrArray
+}
+
+// zarrArray holds the metadata for a Zarr array.
+type zarrArray struct {
+	Shape      []int             `json:"shape"`
+	Chunks     []int             `json:"chunks"`
+	DType      string            `json:"dtype"`
+	Compressor *zarrCompressor   `json:"compressor"`
+	FillValue  interface{}       `json:"fill_value"`
+	Order      string            `json:"order"`
+	Filters    []json.RawMessage `json:"filters"`
+	Separator  string            `json:"dimension_separator"`
+
+	attrs map[string]interface{}
+	dims  []string
+}
+
+// zarrCompressor holds the compressor settings for a Zarr array.
+type zarrCompressor struct {
+	ID string `json:"id"`
+}
+
+// loadZarrGroup reads the metadata for the arrays in the root group of s,
+// using the consolidated metadata if it is available.
+func loadZarrGroup(s zarrStore) (*zarrGroup, error) {
+	meta := make(map[string]json.RawMessage)
+	if b, err := s.get(".zmetadata"); err == nil {
+		var consolidated struct {
+			Metadata map[string]json.RawMessage `json:"metadata"`
+		}
+		if err := json.Unmarshal(b, &consolidated); err != nil {
+			return nil, fmt.Errorf("reading .zmetadata: %v", err)
+		}
+		meta = consolidated.Metadata
+	} else if os.IsNotExist(err) {
+		names, err := s.list("")
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range []string{".zgroup", ".zattrs"} {
+			if b, err := s.get(key); err == nil {
+				meta[key] = b
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		for _, name := range names {
+			if strings.HasPrefix(name, ".") {
+				continue
+			}
+			for _, key := range []string{name + "/.zarray", name + "/.zattrs"} {
+				if b, err := s.get(key); err == nil {
+					meta[key] = b
+				} else if !os.IsNotExist(err) {
+					return nil, err
+				}
+			}
+		}
+	} else {
+		return nil, err
+	}
+	if _, ok := meta[".zgroup"]; !ok {
+		return nil, fmt.Errorf("not a Zarr group")
+	}
+
+	z := &zarrGroup{s: s, arrays: make(map[string]*zarrArray)}
+	if b, ok := meta[".zattrs"]; ok {
+		if err := json.Unmarshal(b, &z.attrs); err != nil {
+			return nil, fmt.Errorf("reading .zattrs: %v", err)
+		}
+	}
+	for key, b := range meta {
+		if !strings.HasSuffix(key, "/.zarray") {
+			continue
+		}
+		name := strings.TrimSuffix(key, "/.zarray")
+		a := new(zarrArray)
+		if err := json.Unmarshal(b, a); err != nil {
+			return nil, fmt.Errorf("reading %s: %v", key, err)
+		}
+		if err := a.check(); err != nil {
+			return nil, fmt.Errorf("array %s: %v", name, err)
+		}
+		if b, ok := meta[name+"/.zattrs"]; ok {
+			if err := json.Unmarshal(b, &a.attrs); err != nil {
+				return nil, fmt.Errorf("reading %s/.zattrs: %v", name, err)
+			}
+		}
+		// Dimension names are stored by xarray in the
+		// _ARRAY_DIMENSIONS attribute.
+		if dims, ok := a.attrs["_ARRAY_DIMENSIONS"].([]interface{}); ok {
+			for _, d := range dims {
+				s, _ := d.(string)
+				a.dims = append(a.dims, s)
+			}
+		}
+		z.arrays[name] = a
+	}
+	return z, nil
+}
+
+// check makes sure that the array is in a supported format.
+func (a *zarrArray) check() error {
+	if len(a.Shape) != len(a.Chunks) {
+		return fmt.Errorf("shape %v and chunks %v have different numbers of dimensions", a.Shape, a.Chunks)
+	}
+	if a.Order != "" && a.Order != "C" {
+		return fmt.Errorf("order %s is not supported; only C order is supported", a.Order)
+	}
+	if len(a.Filters) != 0 {
+		return fmt.Errorf("filters are not supported")
+	}
+	if _, _, _, err := parseZarrDType(a.DType); err != nil {
+		return err
+	}
+	if a.Compressor != nil {
+		switch a.Compressor.ID {
+		case "zlib", "gzip", "blosc":
+		default:
+			return fmt.Errorf("compressor %s is not supported; supported compressors are zlib, gzip, and blosc", a.Compressor.ID)
+		}
+	}
+	return nil
+}
+
+// parseZarrDType parses a Zarr data type string (e.g., "<f4").
+func parseZarrDType(dtype string) (order binary.ByteOrder, kind byte, size int, err error) {
+	if len(dtype) < 3 {
+		return nil, 0, 0, fmt.Errorf("invalid data type %s", dtype)
+	}
+	switch dtype[0] {
+	case '<', '|':
+		order = binary.LittleEndian
+	case '>':
+		order = binary.BigEndian
+	default:
+		return nil, 0, 0, fmt.Errorf("invalid data type %s", dtype)
+	}
+	kind = dtype[1]
+	size, err = strconv.Atoi(dtype[2:])
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("invalid data type %s", dtype)
+	}
+	switch {
+	case kind == 'f' && (size == 4 || size == 8):
+	case (kind == 'i' || kind == 'u') && (size == 1 || size == 2 || size == 4 || size == 8):
+	default:
+		return nil, 0, 0, fmt.Errorf("data type %s is not supported", dtype)
+	}
+	return order, kind, size, nil
+}
+
+// Variables helps fulfill the ncfFile interface.
+func (z *zarrGroup) Variables() []string {
+	o := make([]string, 0, len(z.arrays))
+	for name := range z.arrays {
+		o = append(o, name)
+	}
+	sort.Strings(o)
+	return o
+}
+
+// Lengths helps fulfill the ncfFile interface.
+func (z *zarrGroup) Lengths(varName string) []int {
+	a, ok := z.arrays[varName]
+	if !ok {
+		return nil
+	}
+	return a.Shape
+}
+
+// Dimensions helps fulfill the ncfFile interface.
+func (z *zarrGroup) Dimensions(varName string) []string {
+	a, ok := z.arrays[varName]
+	if !ok {
+		return nil
+	}
+	return a.dims
+}
+
+// Attribute helps fulfill the ncfFile interface. Numeric attributes
+// are returned as []float64.
+func (z *zarrGroup) Attribute(varName, attribute string) interface{} {
+	attrs := z.attrs
+	if varName != "" {
+		a, ok := z.arrays[varName]
+		if !ok {
+			return nil
+		}
+		attrs = a.attrs
+	}
+	switch v := attrs[attribute].(type) {
+	case string:
+		return v
+	case float64:
+		return []float64{v}
+	case []interface{}:
+		o := make([]float64, len(v))
+		for i, vv := range v {
+			f, ok := vv.(float64)
+			if !ok {
+				return v
+			}
+			o[i] = f
+		}
+		return o
+	default:
+		return v
+	}
+}
+
+// Close helps fulfill the ncfFile interface. The store is kept open
+// so that it can be reused.
+func (z *zarrGroup) Close() error { return nil }
+
+// Read helps fulfill the ncfFile interface. Values are
+// returned as []float64.
+func (z *zarrGroup) Read(varName string, start, end []int) (interface{}, error) {
+	a, ok := z.arrays[varName]
+	if !ok {
+		return nil, fmt.Errorf("variable %s is not in the Zarr store", varName)
+	}
+	nd := len(a.Shape)
+	if start == nil {
+		start, end = make([]int, nd), a.Shape
+	}
+	if len(start) != nd || len(end) != nd {
+		return nil, fmt.Errorf("variable %s has %d dimensions but %d were requested", varName, nd, len(start))
+	}
+	outShape := make([]int, nd)
+	outN := 1
+	for i := range start {
+		if start[i] < 0 || end[i] > a.Shape[i] || start[i] > end[i] {
+			return nil, fmt.Errorf("variable %s: index range %v to %v is out of bounds for shape %v", varName, start, end, a.Shape)
+		}
+		outShape[i] = end[i] - start[i]
+		outN *= outShape[i]
+	}
+	out := make([]float64, outN)
+	if outN == 0 {
+		return out, nil
+	}
+
+	// Iterate over the chunks that overlap the requested region.
+	c0, c1 := make([]int, nd), make([]int, nd)
+	for i := range start {
+		c0[i] = start[i] / a.Chunks[i]
+		c1[i] = (end[i]-1)/a.Chunks[i] + 1
+	}
+	ci := append([]int{}, c0...)
+	for {
+		chunk, err := a.readChunk(z.s, varName, ci)
+		if err != nil {
+			return nil, fmt.Errorf("variable %s: %v", varName, err)
+		}
+		a.copyChunk(out, outShape, start, end, ci, chunk)
+		// Move to the next chunk.
+		d := nd - 1
+		for ; d >= 0; d-- {
+			ci[d]++
+			if ci[d] < c1[d] {
+				break
+			}
+			ci[d] = c0[d]
+		}
+		if d < 0 {
+			break
+		}
+	}
+	return out, nil
+}
+
+// copyChunk copies the values in the chunk with index ci that are
+// between start and end into out, which has shape outShape.
+func (a *zarrArray) copyChunk(out []float64, outShape, start, end, ci []int, chunk []float64) {
+	nd := len(a.Shape)
+	lo, hi := make([]int, nd), make([]int, nd)
+	for i := range ci {
+		lo[i], hi[i] = ci[i]*a.Chunks[i], (ci[i]+1)*a.Chunks[i]
+		if start[i] > lo[i] {
+			lo[i] = start[i]
+		}
+		if end[i] < hi[i] {
+			hi[i] = end[i]
+		}
+	}
+	idx := append([]int{}, lo...)
+	for {
+		var oi, ki int
+		for i := range idx {
+			oi = oi*outShape[i] + idx[i] - start[i]
+			ki = ki*a.Chunks[i] + idx[i] - ci[i]*a.Chunks[i]
+		}
+		out[oi] = chunk[ki]
+		d := nd - 1
+		for ; d >= 0; d-- {
+			idx[d]++
+			if idx[d] < hi[d] {
+				break
+			}
+			idx[d] = lo[d]
+		}
+		if d < 0 {
+			return
+		}
+	}
+}
+
+// readChunk reads and decodes the chunk of array name with index ci.
+// Chunks that have not been written are filled with the array's
+// fill value.
+func (a *zarrArray) readChunk(s zarrStore, name string, ci []int) ([]float64, error) {
+	n := 1
+	for _, c := range a.Chunks {
+		n *= c
+	}
+	sep := a.Separator
+	if sep == "" {
+		sep = "."
+	}
+	idx := make([]string, len(ci))
+	for i, c := range ci {
+		idx[i] = strconv.Itoa(c)
+	}
+	if len(idx) == 0 {
+		idx = []string{"0"}
+	}
+	key := name + "/" + strings.Join(idx, sep)
+	b, err := s.get(key)
+	if os.IsNotExist(err) {
+		out := make([]float64, n)
+		fill := a.fillValue()
+		for i := range out {
+			out[i] = fill
+		}
+		return out, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if b, err = a.decompress(b); err != nil {
+		return nil, fmt.Errorf("decompressing chunk %s: %v", key, err)
+	}
+	order, kind, size, _ := parseZarrDType(a.DType)
+	if len(b) != n*size {
+		return nil, fmt.Errorf("chunk %s has %d bytes; expected %d", key, len(b), n*size)
+	}
+	out := make([]float64, n)
+	for i := range out {
+		v := b[i*size : (i+1)*size]
+		switch {
+		case kind == 'f' && size == 4:
+			out[i] = float64(math.Float32frombits(order.Uint32(v)))
+		case kind == 'f' && size == 8:
+			out[i] = math.Float64frombits(order.Uint64(v))
+		case kind == 'i' && size == 1:
+			out[i] = float64(int8(v[0]))
+		case kind == 'u' && size == 1:
+			out[i] = float64(v[0])
+		case kind == 'i' && size == 2:
+			out[i] = float64(int16(order.Uint16(v)))
+		case kind == 'u' && size == 2:
+			out[i] = float64(order.Uint16(v))
+		case kind == 'i' && size == 4:
+			out[i] = float64(int32(order.Uint32(v)))
+		case kind == 'u' && size == 4:
+			out[i] = float64(order.Uint32(v))
+		case kind == 'i' && size == 8:
+			out[i] = float64(int64(order.Uint64(v)))
+		case kind == 'u' && size == 8:
+			out[i] = float64(order.Uint64(v))
+		}
+	}
+	return out, nil
+}
+
+// fillValue returns the value of unwritten chunks.
+func (a *zarrArray) fillValue() float64 {
+	switch v := a.FillValue.(type) {
+	case float64:
+		return v
+	case string:
+		switch v {
+		case "NaN":
+			return math.NaN()
+		case "Infinity":
+			return math.Inf(1)
+		case "-Infinity":
+			return math.Inf(-1)
+		}
+	}
+	return 0
+}
+
+// decompress decompresses a chunk using the array's compressor.
+func (a *zarrArray) decompress(b []byte) ([]byte, error) {
+	if a.Compressor == nil {
+		return b, nil
+	}
+	switch a.Compressor.ID {
+	case "zlib":
+		r, err := zlib.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case "blosc":
+		return bloscDecompress(b)
+	default:
+		return nil, fmt.Errorf("unsupported compressor %s", a.Compressor.ID)
+	}
+}
@@ -0,0 +1,243 @@
+/*
+Copyright © 2017 the InMAP authors.
+This file is part of InMAP.
+
+InMAP is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+InMAP is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with InMAP.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package inmap
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeZarr writes a Zarr store to dir with a zlib-compressed
+// float32 variable PBLH with dimensions (Time, south_north, west_east)
+// and shape (2, 3, 4) in chunks of (1, 2, 3). The chunk at index
+// (1, 1, 1) is not written, so it takes the fill value.
+func writeZarr(dir string) error {
+	files := map[string]string{
+		".zgroup": `{"zarr_format": 2}`,
+		".zattrs": `{"DX": 12000, "TITLE": "test"}`,
+		"PBLH/.zarray": `{"shape": [2, 3, 4], "chunks": [1, 2, 3], "dtype": "<f4",
+			"compressor": {"id": "zlib", "level": 1}, "fill_value": -1, "order": "C",
+			"filters": null, "zarr_format": 2}`,
+		"PBLH/.zattrs": `{"_ARRAY_DIMENSIONS": ["Time", "south_north", "west_east"], "units": "m"}`,
+	}
+	for key, val := range files {
+		p := filepath.Join(dir, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+			return err
+		}
+		if err := os.WriteFile(p, []byte(val), 0644); err != nil {
+			return err
+		}
+	}
+	// The value at each index is t*100 + j*10 + i.
+	for t := 0; t < 2; t++ {
+		for cj := 0; cj < 2; cj++ {
+			for ci := 0; ci < 2; ci++ {
+				if t == 1 && cj == 1 && ci == 1 {
+					continue
+				}
+				b := new(bytes.Buffer)
+				w := zlib.NewWriter(b)
+				for j := cj * 2; j < cj*2+2; j++ {
+					for i := ci * 3; i < ci*3+3; i++ {
+						// Values outside of the array are also stored.
+						v := float32(t*100 + j*10 + i)
+						if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+							return err
+						}
+					}
+				}
+				if err := w.Close(); err != nil {
+					return err
+				}
+				key := filepath.Join(dir, "PBLH", fmt.Sprintf("%d.%d.%d", t, cj, ci))
+				if err := os.WriteFile(key, b.Bytes(), 0644); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func TestZarr(t *testing.T) {
+	dir, err := os.MkdirTemp("", "zarr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "wrfout_2005-01-01.zarr")
+	if err = writeZarr(path); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ncfFromTemplate(filepath.Join(dir, "wrfout_[DATE].zarr"), "2006-01-02",
+		time.Date(2005, time.January, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if have, want := f.Variables(), []string{"PBLH"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("variables: have %v, want %v", have, want)
+	}
+	if have, want := f.Lengths("PBLH"), []int{2, 3, 4}; !reflect.DeepEqual(have, want) {
+		t.Errorf("lengths: have %v, want %v", have, want)
+	}
+	if have, want := f.Dimensions("PBLH"), []string{"Time", "south_north", "west_east"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("dimensions: have %v, want %v", have, want)
+	}
+	if have, want := f.Attribute("", "DX"), []float64{12000}; !reflect.DeepEqual(have, want) {
+		t.Errorf("global attribute: have %v, want %v", have, want)
+	}
+	if have, want := f.Attribute("PBLH", "units"), "m"; !reflect.DeepEqual(have, want) {
+		t.Errorf("attribute: have %v, want %v", have, want)
+	}
+
+	data, err := readNCF("PBLH", f, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []float64{0, 1, 2, 3, 10, 11, 12, 13, 20, 21, 22, 23}
+	if !reflect.DeepEqual(data.Elements, want) {
+		t.Errorf("readNCF: have %v, want %v", data.Elements, want)
+	}
+	data, err = readNCF("PBLH", f, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []float64{100, 101, 102, 103, 110, 111, 112, 113, 120, 121, 122, -1}
+	if !reflect.DeepEqual(data.Elements, want) {
+		t.Errorf("readNCF fill value: have %v, want %v", data.Elements, want)
+	}
+	if !reflect.DeepEqual(data.Shape, []int{3, 4}) {
+		t.Errorf("readNCF shape: have %v, want [3 4]", data.Shape)
+	}
+	vals, err := f.Read("PBLH", []int{0, 1, 2}, []int{1, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []float64{12, 13, 22, 23}; !reflect.DeepEqual(vals, want) {
+		t.Errorf("read subset: have %v, want %v", vals, want)
+	}
+}
+
+func TestZarrConsolidatedBlosc(t *testing.T) {
+	dir, err := os.MkdirTemp("", "zarr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	meta := `{"metadata": {
+		".zgroup": {"zarr_format": 2},
+		"HGT/.zarray": {"shape": [2, 2], "chunks": [2, 2], "dtype": ">f8",
+			"compressor": {"id": "blosc", "cname": "lz4", "clevel": 5, "shuffle": 0},
+			"fill_value": "NaN", "order": "C", "filters": null, "zarr_format": 2},
+		"HGT/.zattrs": {"_ARRAY_DIMENSIONS": ["south_north", "west_east"]}
+	}, "zarr_format": 1}`
+	if err = os.WriteFile(filepath.Join(dir, ".zmetadata"), []byte(meta), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(filepath.Join(dir, "HGT"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	raw := new(bytes.Buffer)
+	for _, v := range []float64{1.5, 2.5, 3.5, 4.5} {
+		binary.Write(raw, binary.BigEndian, v)
+	}
+	// A Blosc buffer whose contents are stored without compression.
+	header := []byte{2, 1, bloscMemcpyed, 8}
+	header = binary.LittleEndian.AppendUint32(header, uint32(raw.Len()))
+	header = binary.LittleEndian.AppendUint32(header, uint32(raw.Len()))
+	header = binary.LittleEndian.AppendUint32(header, uint32(raw.Len()+16))
+	if err = os.WriteFile(filepath.Join(dir, "HGT", "0.0"), append(header, raw.Bytes()...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := openNCF(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := readNCFNoHour("HGT", f, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []float64{1.5, 2.5, 3.5, 4.5}; !reflect.DeepEqual(data.Elements, want) {
+		t.Errorf("have %v, want %v", data.Elements, want)
+	}
+}
+
+func TestBloscLZ4Shuffle(t *testing.T) {
+	// Eight little-endian uint16 values, byte-shuffled and then
+	// compressed as a single LZ4 block, which repeats the low bytes
+	// and contains the high bytes as literals.
+	want := []byte{7, 1, 7, 2, 7, 3, 7, 4, 7, 5, 7, 6, 7, 7, 7, 8}
+	shuffled := []byte{7, 7, 7, 7, 7, 7, 7, 7, 1, 2, 3, 4, 5, 6, 7, 8}
+	lz4 := []byte{0x13, 7, 1, 0, 0x80, 1, 2, 3, 4, 5, 6, 7, 8}
+	if d, err := lz4Decompress(lz4, len(shuffled)); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(d, shuffled) {
+		t.Fatalf("lz4: have %v, want %v", d, shuffled)
+	}
+	b := []byte{2, 1, bloscShuffle | bloscCodeLZ4<<5, 2}
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(want)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(want)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(16+4+4+len(lz4)))
+	b = binary.LittleEndian.AppendUint32(b, 20) // Start of the block.
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(lz4)))
+	b = append(b, lz4...)
+	have, err := bloscDecompress(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	// Unsupported internal compressors cause an error.
+	b[2] = bloscCodeZstd << 5
+	if _, err := bloscDecompress(b); err == nil {
+		t.Error("expected an error for the zstd compressor")
+	}
+}
+
+func TestZarrUnsupported(t *testing.T) {
+	a := &zarrArray{Shape: []int{2}, Chunks: []int{2}, DType: "<f4", Order: "F"}
+	if err := a.check(); err == nil {
+		t.Error("expected an error for Fortran order")
+	}
+	a = &zarrArray{Shape: []int{2}, Chunks: []int{2}, DType: "<c8"}
+	if err := a.check(); err == nil {
+		t.Error("expected an error for a complex data type")
+	}
+	a = &zarrArray{Shape: []int{2}, Chunks: []int{2}, DType: "<f4", Compressor: &zarrCompressor{ID: "zstd"}}
+	if err := a.check(); err == nil {
+		t.Error("expected an error for the zstd compressor")
+	}
+	if v := (&zarrArray{FillValue: "NaN"}).fillValue(); !math.IsNaN(v) {
+		t.Errorf("fill value: have %v, want NaN", v)
+	}
+}